@@ -0,0 +1,160 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ============================================================================
+// Internal Access Filtering
+// ============================================================================
+
+const (
+	accessCacheTTL      = time.Minute
+	maxFilterCandidates = 10000
+	internalTokenHeader = "X-Internal-Token"
+)
+
+// AccessFilterRequest asks which candidate documents a user may read
+type AccessFilterRequest struct {
+	UserID      string   `json:"user_id" binding:"required"`
+	DocumentIDs []string `json:"document_ids"`
+}
+
+// accessEntry caches the set of documents a user may read
+type accessEntry struct {
+	readable  map[string]bool
+	allAccess bool   // admins may read everything
+	pool      string // the org-wide pool it was built from
+	version   uint64
+	expiresAt time.Time
+}
+
+var (
+	accessCache = make(map[string]accessEntry) // user_id -> entry
+	accessMutex sync.RWMutex
+
+	// docVersion increments on every ownership change so cached entries
+	// built from an older view are ignored
+	docVersion atomic.Uint64
+)
+
+// bumpDocVersion invalidates cached access decisions
+func bumpDocVersion() {
+	docVersion.Add(1)
+}
+
+// internalAuthMiddleware guards service-to-service endpoints with a shared
+// token and, if configured, a request signature (internalsigning.go). The
+// endpoints are disabled when INTERNAL_API_TOKEN is unset.
+func internalAuthMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		expected := config.Auth.InternalAPIToken
+		if expected == "" {
+			respondError(c, http.StatusServiceUnavailable, codeNotConfigured, "Internal API is not configured")
+			c.Abort()
+			return
+		}
+
+		provided := c.GetHeader(internalTokenHeader)
+		if subtle.ConstantTimeCompare([]byte(provided), []byte(expected)) != 1 {
+			respondError(c, http.StatusUnauthorized, codeUnauthorized, "Invalid internal token")
+			c.Abort()
+			return
+		}
+		if !requireInternalSignature(c) {
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// readableDocuments returns the cached access entry for a user, rebuilding
+// it when ownership has changed or the entry has expired
+func readableDocuments(user *User) accessEntry {
+	version, pool := docVersion.Load(), defaultService.poolOf(user)
+	lock := userLock(user)
+	lock.RLock()
+	allAccess := user.Role == "admin"
+	lock.RUnlock()
+
+	accessMutex.RLock()
+	entry, exists := accessCache[user.ID]
+	accessMutex.RUnlock()
+
+	if exists && entry.version == version && time.Now().Before(entry.expiresAt) &&
+		entry.allAccess == allAccess && entry.pool == pool {
+		return entry
+	}
+
+	entry = accessEntry{
+		allAccess: allAccess,
+		pool:      pool,
+		version:   version,
+		expiresAt: time.Now().Add(accessCacheTTL),
+	}
+	if !entry.allAccess {
+		owned, shared := documentsOf(user.ID), orgWideDocuments(user)
+		entry.readable = make(map[string]bool, len(owned)+len(shared))
+		for _, doc := range owned {
+			entry.readable[doc] = true
+		}
+		// Org-wide documents are readable by every member of the pool
+		// without a share
+		for _, doc := range shared {
+			entry.readable[doc] = true
+		}
+		// Time-boxed grants; the entry lapses with the first of them
+		for doc, until := range grantsTo(user.ID) {
+			entry.readable[doc] = true
+			entry.expiresAt = earliest(entry.expiresAt, until)
+		}
+	}
+
+	accessMutex.Lock()
+	accessCache[user.ID] = entry
+	accessMutex.Unlock()
+
+	return entry
+}
+
+// filterAccess returns the subset of candidate documents the user may read,
+// preserving the input order
+func filterAccess(c *gin.Context) {
+	var req AccessFilterRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondBindError(c, err)
+		return
+	}
+	if len(req.DocumentIDs) > maxFilterCandidates {
+		respondError(c, http.StatusBadRequest, codeInvalidRequest, "Too many candidate documents")
+		return
+	}
+
+	user := lookupUser(req.UserID)
+	if user == nil {
+		respondError(c, http.StatusNotFound, codeNotFound, "User not found")
+		return
+	}
+	// Disabled, pending and merged accounts read nothing, as their tokens
+	// would be refused
+	if !defaultService.active(user) {
+		respondServiceError(c, errAccountDisabled)
+		return
+	}
+
+	allowed := readableSubset(user, req.DocumentIDs)
+
+	c.JSON(http.StatusOK, gin.H{
+		"user_id":      req.UserID,
+		"allowed":      allowed,
+		"denied_count": len(req.DocumentIDs) - len(allowed),
+		"languages":    defaultService.DocumentLanguages(allowed),
+	})
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// accessDecision is the filter's answer
+type accessDecision struct {
+	Allowed     []string `json:"allowed"`
+	DeniedCount int      `json:"denied_count"`
+}
+
+// filter posts candidates to the access filter with the internal token
+func (ts *testServer) filter(userID string, docs ...string) (accessDecision, int, string) {
+	ts.t.Helper()
+	body := fmt.Sprintf(`{"user_id":%q,"document_ids":["%s"]}`, userID, strings.Join(docs, `","`))
+	w := ts.do(http.MethodPost, "/v1/internal/access/filter", "", body, internalTokenHeader, testInternalToken)
+	var resp accessDecision
+	if w.Code == http.StatusOK {
+		decodeJSON(ts.t, w, &resp)
+	}
+	return resp, w.Code, w.Body.String()
+}
+
+func TestAccessFilter(t *testing.T) {
+	withConfig(t, func(cfg *Config) {
+		cfg.Passwords.Algorithm, cfg.Passwords.BcryptCost = "bcrypt", bcrypt.MinCost
+		cfg.Passwords.MinScore = 0
+		cfg.Auth.InternalAPIToken = testInternalToken
+	})
+	// The filter reads the process's stores
+	t.Cleanup(func() { resetLocalStores(t) })
+	srv, err := NewServer(defaultService)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := &testServer{t: t, srv: srv}
+
+	admin := ts.admin("admin@example.com")
+	owner, ownerID := ts.register("owner@example.com")
+	other, otherID := ts.register("other@example.com")
+	ts.do(http.MethodPost, "/v1/documents/register", owner, `{"filename":"mine.pdf"}`)
+	ts.do(http.MethodPost, "/v1/documents/register", other, `{"filename":"theirs.pdf"}`)
+
+	resp, code, body := ts.filter(ownerID, "theirs.pdf", "mine.pdf", "missing.pdf")
+	if code != http.StatusOK || len(resp.Allowed) != 1 || resp.Allowed[0] != "mine.pdf" || resp.DeniedCount != 2 {
+		t.Fatalf("owner: %d %s", code, body)
+	}
+	// The cached entry follows ownership changes
+	if w := ts.do(http.MethodDelete, "/v1/documents/mine.pdf", owner, ""); w.Code != http.StatusOK {
+		t.Fatalf("unregister: %d %s", w.Code, w.Body)
+	}
+	if resp, _, body := ts.filter(ownerID, "mine.pdf"); len(resp.Allowed) != 0 {
+		t.Fatalf("after unregister: %s", body)
+	}
+	// and role changes
+	if w := ts.do(http.MethodPatch, "/v1/admin/users/"+otherID, admin, `{"role":"admin"}`); w.Code != http.StatusOK {
+		t.Fatalf("promote: %d %s", w.Code, w.Body)
+	}
+	if resp, _, body := ts.filter(otherID, "theirs.pdf", "anything.pdf"); len(resp.Allowed) != 2 {
+		t.Fatalf("after promotion: %s", body)
+	}
+
+	if _, code, _ := ts.filter("no-such-user", "theirs.pdf"); code != http.StatusNotFound {
+		t.Fatalf("unknown user: got %d, want 404", code)
+	}
+	// An account that can't sign in reads nothing
+	if w := ts.do(http.MethodPatch, "/v1/admin/users/"+otherID, admin, `{"status":"disabled"}`); w.Code != http.StatusOK {
+		t.Fatalf("disable: %d %s", w.Code, w.Body)
+	}
+	_, code, body = ts.filter(otherID, "theirs.pdf")
+	if code != http.StatusForbidden || !strings.Contains(body, codeAccountDisabled) {
+		t.Fatalf("disabled user: %d %s", code, body)
+	}
+	pending := ts.srv.svc.users.ByID(ownerID)
+	pending.Status = UserPending
+	if _, code, _ := ts.filter(ownerID, "theirs.pdf"); code != http.StatusForbidden {
+		t.Fatalf("pending user: got %d, want 403", code)
+	}
+
+	if _, code, _ := ts.filter(ownerID, make([]string, maxFilterCandidates+1)...); code != http.StatusBadRequest {
+		t.Fatalf("too many candidates: got %d, want 400", code)
+	}
+	w := ts.do(http.MethodPost, "/v1/internal/access/filter", "", `{"user_id":"`+ownerID+`"}`, internalTokenHeader, "wrong")
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("wrong internal token: got %d, want 401", w.Code)
+	}
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ============================================================================
+// Document Access Log
+// ============================================================================
+//
+// Owners can see when other members read their documents: org-wide ones and
+// those shared through grants (grants.go). After retrieving chunks for a
+// query the gateway reports the sources it used to POST
+// /internal/access/retrievals, and each document read by someone other than
+// its owner gets an entry. Owners (and admins) read the log at GET
+// /documents/:filename/access-log, newest first.
+//
+// The privacy settings live under access_log: logging can be turned off
+// altogether, and with readers set to "anonymous" owners see when their
+// documents were read but not by whom. In org mode an org may override
+// both for the documents its members own (Org.AccessLog). Entries are kept
+// for access_log.retention, at most access_log.max_entries per document, in
+// keyedRecords, so in cluster mode every replica sees the reads reported to
+// any of them. Each entry remembers who owned the document at the time, so
+// a document registered again by someone else starts with an empty log.
+
+const (
+	accessLogNamed     = "named"
+	accessLogAnonymous = "anonymous"
+
+	accessLogRecord = "access-log" // filename -> []accessRead, oldest first
+)
+
+// RetrievalReport for POST /internal/access/retrievals
+type RetrievalReport struct {
+	UserID    string   `json:"user_id" binding:"required"`
+	Documents []string `json:"documents" binding:"required,max=1000"`
+	QueryID   string   `json:"query_id,omitempty" binding:"max=128"` // the gateway's ID for the query, if any
+}
+
+// AccessLogEntry is one read of a document
+type AccessLogEntry struct {
+	UserID  string    `json:"user_id,omitempty"` // omitted when readers are anonymous
+	Name    string    `json:"name,omitempty"`
+	Email   string    `json:"email,omitempty"`
+	QueryID string    `json:"query_id,omitempty"`
+	At      time.Time `json:"at"`
+}
+
+// accessRead is an entry as kept, with who owned the document when it was
+// read
+type accessRead struct {
+	AccessLogEntry
+	Owner string `json:"owner"`
+}
+
+// OrgAccessLog is an org's override of the access_log privacy settings;
+// unset fields follow the configuration
+type OrgAccessLog struct {
+	Enabled *bool  `json:"enabled,omitempty"`
+	Readers string `json:"readers,omitempty" binding:"omitempty,oneof=named anonymous"`
+}
+
+// accessLogPolicy is the privacy setting that applies to a document
+type accessLogPolicy struct {
+	Enabled bool
+	Readers string
+}
+
+// accessLogPolicyFor returns the settings for documents ownerID owns:
+// the configuration, overridden by their org's in org mode
+func (s *Service) accessLogPolicyFor(ownerID string) accessLogPolicy {
+	policy := accessLogPolicy{Enabled: config.AccessLog.Enabled, Readers: config.AccessLog.Readers}
+	owner := s.users.ByID(ownerID)
+	if owner == nil {
+		return policy
+	}
+	if org, exists := lookupOrg(s.poolOf(owner)); exists && org.AccessLog != nil {
+		if org.AccessLog.Enabled != nil {
+			policy.Enabled = *org.AccessLog.Enabled
+		}
+		if org.AccessLog.Readers != "" {
+			policy.Readers = org.AccessLog.Readers
+		}
+	}
+	return policy
+}
+
+// accessLogLock serializes changes to one document's log
+func accessLogLock(filename string) (func(), error) {
+	ctx, cancel := context.WithTimeout(context.Background(), config.Cluster.LockTTL)
+	defer cancel()
+	release, err := acquireLock(ctx, accessLogRecord+":"+filename, config.Cluster.LockTTL)
+	if err != nil {
+		slog.Error("Access log lock failed", "error", err)
+		return nil, errStoreUnavailable
+	}
+	return release, nil
+}
+
+// accessReads returns a document's kept reads, oldest first
+func accessReads(filename string) ([]accessRead, error) {
+	data, found, err := keyedRecords().record(context.Background(), accessLogRecord, filename)
+	if err != nil {
+		slog.Error("Record store read failed", "op", "access_log", "error", err)
+		return nil, errStoreUnavailable
+	}
+	var log []accessRead
+	if found {
+		if err := json.Unmarshal(data, &log); err != nil {
+			return nil, err
+		}
+	}
+	return log, nil
+}
+
+// saveAccessReads replaces a document's reads; they expire together
+// access_log.retention after the latest. Callers hold accessLogLock.
+func saveAccessReads(filename string, log []accessRead) error {
+	ctx := context.Background()
+	var err error
+	if len(log) == 0 {
+		err = keyedRecords().deleteRecord(ctx, accessLogRecord, filename)
+	} else {
+		var data []byte
+		if data, err = json.Marshal(log); err == nil {
+			ttl := time.Until(log[len(log)-1].At.Add(config.AccessLog.Retention))
+			err = keyedRecords().saveRecord(ctx, accessLogRecord, filename, data, ttl)
+		}
+	}
+	if err != nil {
+		slog.Error("Record store write failed", "op", "access_log", "error", err)
+		return errStoreUnavailable
+	}
+	return nil
+}
+
+// pruneAccessLog drops entries past retention and over the cap
+func pruneAccessLog(log []accessRead, now time.Time) []accessRead {
+	cutoff := now.Add(-config.AccessLog.Retention)
+	i := 0
+	for i < len(log) && log[i].At.Before(cutoff) {
+		i++
+	}
+	if over := len(log) - i - config.AccessLog.MaxEntries; over > 0 {
+		i += over
+	}
+	return log[i:]
+}
+
+// recordRetrievals logs the documents a user's query retrieved that they
+// don't own, where their owner's settings keep a log; it returns how many
+// entries were added
+func (s *Service) recordRetrievals(user *User, report RetrievalReport, now time.Time) (int, error) {
+	var read []accessRead
+	var filenames []string
+	s.documents.View(func(tx DocumentTx) {
+		for _, filename := range report.Documents {
+			owner := tx.owner(filename)
+			if owner == "" || owner == user.ID {
+				continue
+			}
+			if user.Role != "admin" && !s.readable(tx, user, filename) {
+				continue
+			}
+			entry := AccessLogEntry{UserID: user.ID, QueryID: report.QueryID, At: now}
+			read = append(read, accessRead{AccessLogEntry: entry, Owner: owner})
+			filenames = append(filenames, filename)
+		}
+	})
+
+	recorded := 0
+	policies := make(map[string]accessLogPolicy)
+	for i, filename := range filenames {
+		policy, seen := policies[read[i].Owner]
+		if !seen {
+			policy = s.accessLogPolicyFor(read[i].Owner)
+			policies[read[i].Owner] = policy
+		}
+		if !policy.Enabled {
+			continue
+		}
+		if err := appendAccessRead(filename, read[i], now); err != nil {
+			return recorded, err
+		}
+		recorded++
+	}
+	return recorded, nil
+}
+
+// appendAccessRead adds one read to a document's log
+func appendAccessRead(filename string, read accessRead, now time.Time) error {
+	release, err := accessLogLock(filename)
+	if err != nil {
+		return err
+	}
+	defer release()
+	log, err := accessReads(filename)
+	if err != nil {
+		return err
+	}
+	return saveAccessReads(filename, pruneAccessLog(append(log, read), now))
+}
+
+// AccessLog returns the reads of a document while its current owner has
+// held it, newest first, and the settings that apply to it; only the owner
+// or an admin may see them
+func (s *Service) AccessLog(filename string, actor *User) ([]AccessLogEntry, accessLogPolicy, error) {
+	owner := s.DocumentOwner(filename)
+	if owner == "" {
+		return nil, accessLogPolicy{}, errDocumentNotFound
+	}
+	if owner != actor.ID && actor.Role != "admin" {
+		return nil, accessLogPolicy{}, errNotDocumentOwner
+	}
+
+	log, err := accessReads(filename)
+	if err != nil {
+		return nil, accessLogPolicy{}, err
+	}
+	log = pruneAccessLog(log, time.Now())
+	entries := make([]AccessLogEntry, 0, len(log))
+	for i := len(log) - 1; i >= 0; i-- {
+		if log[i].Owner == owner {
+			entries = append(entries, log[i].AccessLogEntry)
+		}
+	}
+
+	policy := s.accessLogPolicyFor(owner)
+	for i := range entries {
+		if policy.Readers == accessLogAnonymous {
+			entries[i].UserID = ""
+			continue
+		}
+		entries[i].Name, entries[i].Email, _ = s.users.Contact(entries[i].UserID)
+	}
+	return entries, policy, nil
+}
+
+// ----------------------------------------------------------------------------
+// Handlers
+// ----------------------------------------------------------------------------
+
+// recordRetrieval takes the gateway's report of the sources a query used
+func (s *Server) recordRetrieval(c *gin.Context) {
+	var report RetrievalReport
+	if err := c.ShouldBindJSON(&report); err != nil {
+		respondBindError(c, err)
+		return
+	}
+	user := s.svc.users.ByID(report.UserID)
+	if user == nil {
+		respondError(c, http.StatusNotFound, codeNotFound, "User not found")
+		return
+	}
+	now := time.Now().UTC()
+	touchDocuments(user.ID, s.svc.readableOf(user, report.Documents), now)
+	recorded, err := s.svc.recordRetrievals(user, report, now)
+	if err != nil {
+		respondServiceError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"recorded": recorded})
+}
+
+// getAccessLog lists who read a document and when (owner or admin)
+func (s *Server) getAccessLog(c *gin.Context) {
+	filename := c.Param("filename")
+	entries, policy, err := s.svc.AccessLog(filename, c.MustGet("user").(*User))
+	if err != nil {
+		respondServiceError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"filename": filename,
+		"enabled":  policy.Enabled,
+		"readers":  policy.Readers,
+		"entries":  entries,
+		"count":    len(entries),
+	})
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// resetAccessLogs forgets the reads kept in this process once the test ends
+func resetAccessLogs(t *testing.T) {
+	t.Helper()
+	t.Cleanup(func() {
+		logs, _ := localRecords.records(context.Background(), accessLogRecord)
+		for filename := range logs {
+			localRecords.deleteRecord(context.Background(), accessLogRecord, filename)
+		}
+	})
+}
+
+// reportRetrievals posts the gateway's report and returns how many reads
+// were recorded
+func (ts *testServer) reportRetrievals(body string) int {
+	ts.t.Helper()
+	w := ts.do(http.MethodPost, "/v1/internal/access/retrievals", "", body, internalTokenHeader, testInternalToken)
+	if w.Code != http.StatusOK {
+		ts.t.Fatalf("report: %d %s", w.Code, w.Body)
+	}
+	var resp struct {
+		Recorded int `json:"recorded"`
+	}
+	decodeJSON(ts.t, w, &resp)
+	return resp.Recorded
+}
+
+func TestDocumentAccessLog(t *testing.T) {
+	ts := newTestServer(t)
+	withConfig(t, func(cfg *Config) { cfg.Auth.InternalAPIToken = testInternalToken })
+	resetAccessLogs(t)
+	owner, _ := ts.register("owner@example.com")
+	reviewer, reviewerID := ts.register("reviewer@example.com")
+	ts.do(http.MethodPost, "/v1/documents/register", owner, `{"filename":"draft.pdf"}`)
+	ts.do(http.MethodPost, "/v1/documents/register", owner, `{"filename":"private.pdf"}`)
+	tomorrow := time.Now().UTC().AddDate(0, 0, 1).Format(time.DateOnly)
+	ts.do(http.MethodPost, "/v1/documents/draft.pdf/grants", owner, `{"email":"reviewer@example.com","expires_at":"`+tomorrow+`"}`)
+
+	report := ts.reportRetrievals
+	// Only reads of documents shared with the reader count
+	if n := report(`{"user_id":"` + reviewerID + `","documents":["draft.pdf","private.pdf","missing.pdf"],"query_id":"q1"}`); n != 1 {
+		t.Fatalf("recorded %d, want 1", n)
+	}
+
+	var log struct {
+		Entries []AccessLogEntry `json:"entries"`
+	}
+	if w := ts.do(http.MethodGet, "/v1/documents/draft.pdf/access-log", reviewer, ""); w.Code != http.StatusForbidden {
+		t.Fatalf("log as reader: got %d, want 403", w.Code)
+	}
+	decodeJSON(t, ts.do(http.MethodGet, "/v1/documents/draft.pdf/access-log", owner, ""), &log)
+	if len(log.Entries) != 1 || log.Entries[0].Email != "reviewer@example.com" || log.Entries[0].QueryID != "q1" {
+		t.Fatalf("entries: %+v", log.Entries)
+	}
+
+	withConfig(t, func(cfg *Config) { cfg.AccessLog.Readers = accessLogAnonymous })
+	var anonymous struct {
+		Entries []AccessLogEntry `json:"entries"`
+	}
+	decodeJSON(t, ts.do(http.MethodGet, "/v1/documents/draft.pdf/access-log", owner, ""), &anonymous)
+	if len(anonymous.Entries) != 1 || anonymous.Entries[0].UserID != "" || anonymous.Entries[0].Email != "" {
+		t.Fatalf("anonymous entries: %+v", anonymous.Entries)
+	}
+
+	withConfig(t, func(cfg *Config) { cfg.AccessLog.Enabled = false })
+	if n := report(`{"user_id":"` + reviewerID + `","documents":["draft.pdf"]}`); n != 0 {
+		t.Fatalf("recorded %d with the log off", n)
+	}
+}
+
+func TestAccessLogOrgOverride(t *testing.T) {
+	useOrgs(t)
+	ts := newTestServer(t)
+	withConfig(t, func(cfg *Config) { cfg.Auth.InternalAPIToken = testInternalToken })
+	resetAccessLogs(t)
+	admin := ts.admin("admin@example.com")
+	ts.do(http.MethodPost, "/v1/admin/orgs", admin, `{"id":"acme","name":"Acme"}`)
+	owner, ownerID := ts.register("owner@acme.test")
+	loner, _ := ts.register("loner@example.com")
+	_, readerID := ts.register("reader@acme.test")
+	tomorrow := time.Now().UTC().AddDate(0, 0, 1).Format(time.DateOnly)
+	ts.srv.svc.users.ByID(ownerID).OrgID = "acme"
+	for token, filename := range map[string]string{owner: "acme.pdf", loner: "open.pdf"} {
+		ts.do(http.MethodPost, "/v1/documents/register", token, `{"filename":"`+filename+`"}`)
+		ts.do(http.MethodPost, "/v1/documents/"+filename+"/grants", token, `{"email":"reader@acme.test","expires_at":"`+tomorrow+`"}`)
+	}
+	var log struct {
+		Enabled bool             `json:"enabled"`
+		Readers string           `json:"readers"`
+		Entries []AccessLogEntry `json:"entries"`
+	}
+
+	// The org hides its readers' names from its own members' documents only
+	if w := ts.do(http.MethodPatch, "/v1/admin/orgs/acme", admin, `{"access_log":{"readers":"anonymous"}}`); w.Code != http.StatusOK {
+		t.Fatalf("override: %d %s", w.Code, w.Body)
+	}
+	if n := ts.reportRetrievals(`{"user_id":"` + readerID + `","documents":["acme.pdf","open.pdf"]}`); n != 2 {
+		t.Fatalf("recorded %d, want 2", n)
+	}
+	decodeJSON(t, ts.do(http.MethodGet, "/v1/documents/acme.pdf/access-log", owner, ""), &log)
+	if log.Readers != accessLogAnonymous || len(log.Entries) != 1 || log.Entries[0].UserID != "" {
+		t.Fatalf("org log: %+v", log)
+	}
+	decodeJSON(t, ts.do(http.MethodGet, "/v1/documents/open.pdf/access-log", loner, ""), &log)
+	if log.Readers != accessLogNamed || len(log.Entries) != 1 || log.Entries[0].UserID != readerID {
+		t.Fatalf("log outside the org: %+v", log)
+	}
+
+	// or stops the log for them
+	ts.do(http.MethodPatch, "/v1/admin/orgs/acme", admin, `{"access_log":{"enabled":false}}`)
+	if n := ts.reportRetrievals(`{"user_id":"` + readerID + `","documents":["acme.pdf","open.pdf"]}`); n != 1 {
+		t.Fatalf("recorded %d with the org's log off, want 1", n)
+	}
+	decodeJSON(t, ts.do(http.MethodGet, "/v1/documents/acme.pdf/access-log", owner, ""), &log)
+	if log.Enabled || log.Readers != accessLogNamed {
+		t.Fatalf("org log off: %+v", log)
+	}
+	if w := ts.do(http.MethodPatch, "/v1/admin/orgs/acme", admin, `{"access_log":{"readers":"everyone"}}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("unknown readers setting: got %d, want 400", w.Code)
+	}
+}
+
+func TestAccessLogSharedStore(t *testing.T) {
+	mr := useSharedStore(t)
+	ts := newTestServer(t)
+	withConfig(t, func(cfg *Config) { cfg.Auth.InternalAPIToken = testInternalToken })
+	owner, _ := ts.register("owner@example.com")
+	_, readerID := ts.register("reader@example.com")
+	ts.do(http.MethodPost, "/v1/documents/register", owner, `{"filename":"draft.pdf"}`)
+	tomorrow := time.Now().UTC().AddDate(0, 0, 1).Format(time.DateOnly)
+	ts.do(http.MethodPost, "/v1/documents/draft.pdf/grants", owner, `{"email":"reader@example.com","expires_at":"`+tomorrow+`"}`)
+
+	// A read reported to one replica is kept where every replica sees it
+	if n := ts.reportRetrievals(`{"user_id":"` + readerID + `","documents":["draft.pdf"]}`); n != 1 {
+		t.Fatalf("recorded %d, want 1", n)
+	}
+	if logs, _ := localRecords.records(context.Background(), accessLogRecord); len(logs) != 0 {
+		t.Fatalf("kept in process: %v", logs)
+	}
+	logs, err := clusterStore.records(context.Background(), accessLogRecord)
+	if err != nil || len(logs) != 1 || logs["draft.pdf"] == nil {
+		t.Fatalf("shared store: %v %v", logs, err)
+	}
+
+	// An unreachable store fails the report rather than dropping the read
+	mr.Close()
+	if w := ts.do(http.MethodPost, "/v1/internal/access/retrievals", "", `{"user_id":"`+readerID+`","documents":["draft.pdf"]}`,
+		internalTokenHeader, testInternalToken); w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("store down: got %d, want 503", w.Code)
+	}
+}
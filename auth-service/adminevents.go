@@ -0,0 +1,257 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ============================================================================
+// Admin Activity Feed
+// ============================================================================
+//
+// GET /admin/events/stream pushes what is happening to the admin dashboard
+// as Server-Sent Events: every security event (signups, sign-ins and their
+// failures, lockouts, role changes... see siem.go) plus
+//
+//	document.uploaded   a file was uploaded and queued
+//	document.processed  ingestion finished
+//	document.failed     ingestion gave up after its last attempt
+//	query.failed        the backend couldn't answer a query
+//	server.error        a request answered 5xx or panicked (errorreport.go)
+//
+// ?types=auth.login.failure,document picks events by type, a name matching
+// itself and everything under it ("auth" is every auth.* event). Each
+// event is one message whose data is an AdminEvent and whose id is its
+// sequence number. The last adminEventBacklog events are kept, so a client
+// that reconnects with Last-Event-ID (EventSource does this by itself)
+// gets what it missed; an ID older than the backlog gets the whole
+// backlog. A comment is sent every adminEventHeartbeat to keep proxies from
+// closing an idle stream, and a client too slow to keep up is disconnected
+// to catch up through Last-Event-ID.
+//
+// The feed is per instance, like security alerts: behind a load balancer a
+// dashboard sees the replica it is connected to. Sequence numbers start
+// from the process's start time in microseconds, so IDs from before a
+// restart are older than any after it.
+
+const (
+	adminEventBacklog   = 1000
+	adminEventHeartbeat = 15 * time.Second
+	adminEventRetry     = 3 * time.Second // reconnection delay suggested to clients
+	adminEventBuffer    = 64              // per subscriber, before it counts as too slow
+)
+
+// Admin feed event types, beyond the security events
+const (
+	AdminEventDocumentUploaded  = "document.uploaded"
+	AdminEventDocumentProcessed = "document.processed"
+	AdminEventDocumentFailed    = "document.failed"
+	AdminEventQueryFailed       = "query.failed"
+	AdminEventServerError       = "server.error"
+)
+
+// AdminEvent is one message of the activity feed
+type AdminEvent struct {
+	ID      uint64            `json:"id"`
+	Type    string            `json:"type"`
+	At      time.Time         `json:"at"`
+	UserID  string            `json:"user_id,omitempty"`
+	Email   string            `json:"email,omitempty"`
+	Outcome string            `json:"outcome,omitempty"` // success | failure
+	Details map[string]string `json:"details,omitempty"`
+}
+
+// adminSubscriber is one open stream
+type adminSubscriber struct {
+	types  []string // empty takes everything
+	events chan AdminEvent
+}
+
+var (
+	adminEvents      []AdminEvent // the backlog, oldest first
+	adminEventSeq    = uint64(time.Now().UnixMicro())
+	adminSubscribers = make(map[*adminSubscriber]struct{})
+	adminEventMutex  sync.Mutex
+)
+
+// matchesEventType reports whether an event type is picked by a filter
+func matchesEventType(types []string, eventType string) bool {
+	if len(types) == 0 {
+		return true
+	}
+	for _, want := range types {
+		if eventType == want || strings.HasPrefix(eventType, want+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// publishAdminEvent adds an event to the feed without blocking; subscribers
+// that can't take it are dropped
+func publishAdminEvent(event AdminEvent) {
+	adminEventMutex.Lock()
+	defer adminEventMutex.Unlock()
+	adminEventSeq++
+	event.ID = adminEventSeq
+	if event.At.IsZero() {
+		event.At = time.Now().UTC()
+	}
+	adminEvents = append(adminEvents, event)
+	if over := len(adminEvents) - adminEventBacklog; over > 0 {
+		adminEvents = append(adminEvents[:0:0], adminEvents[over:]...)
+	}
+	for sub := range adminSubscribers {
+		if !matchesEventType(sub.types, event.Type) {
+			continue
+		}
+		select {
+		case sub.events <- event:
+		default:
+			close(sub.events)
+			delete(adminSubscribers, sub)
+		}
+	}
+}
+
+// subscribeAdminEvents opens a subscription and returns the backlog after
+// lastID that it matches
+func subscribeAdminEvents(types []string, lastID uint64) (*adminSubscriber, []AdminEvent) {
+	adminEventMutex.Lock()
+	defer adminEventMutex.Unlock()
+	var missed []AdminEvent
+	if lastID > 0 {
+		for _, event := range adminEvents {
+			if event.ID > lastID && matchesEventType(types, event.Type) {
+				missed = append(missed, event)
+			}
+		}
+	}
+	sub := &adminSubscriber{types: types, events: make(chan AdminEvent, adminEventBuffer)}
+	adminSubscribers[sub] = struct{}{}
+	return sub, missed
+}
+
+// unsubscribeAdminEvents closes a subscription unless publishing already did
+func unsubscribeAdminEvents(sub *adminSubscriber) {
+	adminEventMutex.Lock()
+	defer adminEventMutex.Unlock()
+	if _, open := adminSubscribers[sub]; open {
+		close(sub.events)
+		delete(adminSubscribers, sub)
+	}
+}
+
+// closeAdminEventStreams ends every stream, for shutdown: Shutdown doesn't
+// wait out streams that never go idle
+func closeAdminEventStreams() {
+	adminEventMutex.Lock()
+	defer adminEventMutex.Unlock()
+	for sub := range adminSubscribers {
+		close(sub.events)
+		delete(adminSubscribers, sub)
+	}
+}
+
+// adminEventOf puts a security event on the feed
+func adminEventOf(event SecurityEvent) AdminEvent {
+	details := make(map[string]string, len(event.Details)+2)
+	for key, value := range event.Details {
+		details[key] = value
+	}
+	if event.Reason != "" {
+		details["reason"] = event.Reason
+	}
+	if event.SourceIP != "" {
+		details["source_ip"] = event.SourceIP
+	}
+	if event.ActorID != "" {
+		details["actor_id"] = event.ActorID
+	}
+	return AdminEvent{
+		Type:    event.Type,
+		At:      event.Timestamp,
+		UserID:  event.UserID,
+		Email:   event.Email,
+		Outcome: event.Outcome,
+		Details: details,
+	}
+}
+
+// writeAdminEvent writes one SSE message
+func writeAdminEvent(w gin.ResponseWriter, event AdminEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(w, "id: %d\ndata: %s\n\n", event.ID, data); err != nil {
+		return err
+	}
+	w.Flush()
+	return nil
+}
+
+// streamAdminEvents sends the activity feed until the client goes away
+// (admin)
+func streamAdminEvents(c *gin.Context) {
+	var types []string
+	for _, raw := range strings.Split(c.Query("types"), ",") {
+		if raw = strings.TrimSpace(raw); raw != "" {
+			types = append(types, raw)
+		}
+	}
+	lastID := c.GetHeader("Last-Event-ID")
+	if lastID == "" {
+		lastID = c.Query("last_event_id") // for clients that can't set headers
+	}
+	var since uint64
+	if lastID != "" {
+		parsed, err := strconv.ParseUint(lastID, 10, 64)
+		if err != nil {
+			respondError(c, http.StatusBadRequest, codeInvalidRequest, "Last-Event-ID must be an event id")
+			return
+		}
+		since = parsed
+	}
+
+	sub, missed := subscribeAdminEvents(types, since)
+	defer unsubscribeAdminEvents(sub)
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	fmt.Fprintf(c.Writer, "retry: %d\n\n", adminEventRetry.Milliseconds())
+	c.Writer.Flush()
+	for _, event := range missed {
+		if writeAdminEvent(c.Writer, event) != nil {
+			return
+		}
+	}
+
+	heartbeat := time.NewTicker(adminEventHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-c.Request.Context().Done():
+			return
+		case event, open := <-sub.events:
+			if !open || writeAdminEvent(c.Writer, event) != nil {
+				return
+			}
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(c.Writer, ": keep-alive\n\n"); err != nil {
+				return
+			}
+			c.Writer.Flush()
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readAdminEvent reads up to the next event's data, skipping comments and
+// the retry hint
+func readAdminEvent(t *testing.T, reader *bufio.Reader) AdminEvent {
+	t.Helper()
+	id := ""
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("stream ended: %v", err)
+		}
+		line = strings.TrimRight(line, "\n")
+		if value, ok := strings.CutPrefix(line, "id: "); ok {
+			id = value
+		}
+		if data, ok := strings.CutPrefix(line, "data: "); ok {
+			var event AdminEvent
+			if err := json.Unmarshal([]byte(data), &event); err != nil {
+				t.Fatal(err)
+			}
+			if strconv.FormatUint(event.ID, 10) != id {
+				t.Fatalf("event %d sent with id %q", event.ID, id)
+			}
+			return event
+		}
+	}
+}
+
+func TestAdminEventStream(t *testing.T) {
+	ts := newTestServer(t)
+	adminEventMutex.Lock()
+	adminEvents = nil // other tests' events
+	adminEventMutex.Unlock()
+	t.Cleanup(func() {
+		closeAdminEventStreams()
+		adminEventMutex.Lock()
+		adminEvents = nil
+		adminEventMutex.Unlock()
+	})
+	gateway := httptest.NewServer(ts.srv)
+	defer gateway.Close()
+	admin := ts.admin("admin@example.com")
+	user, _ := ts.register("user@example.com")
+
+	open := func(ctx context.Context, query, lastID string) *bufio.Reader {
+		t.Helper()
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, gateway.URL+"/v1/admin/events/stream"+query, nil)
+		req.Header.Set("Authorization", "Bearer "+admin)
+		if lastID != "" {
+			req.Header.Set("Last-Event-ID", lastID)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+			t.Fatalf("open stream: %d %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		return bufio.NewReader(resp.Body)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// Only sign-in events come through a stream filtered to them
+	stream := open(ctx, "?types=auth.login", "")
+	ts.do(http.MethodPost, "/v1/documents/register", user, `{"filename":"handbook.pdf"}`)
+	ts.do(http.MethodPost, "/v1/auth/login", "", `{"email":"user@example.com","password":"wrong-password"}`)
+	failure := readAdminEvent(t, stream)
+	if failure.Type != EventLoginFailure || failure.Outcome != "failure" || failure.Details["source_ip"] == "" {
+		t.Fatalf("first event: %+v", failure)
+	}
+
+	// Reconnecting with Last-Event-ID replays what came after it
+	adminEventMutex.Lock()
+	first := adminEvents[0]
+	adminEventMutex.Unlock()
+	if first.Type != EventRegister {
+		t.Fatalf("backlog starts with %+v", first)
+	}
+	replay := open(ctx, "?types=auth", strconv.FormatUint(first.ID, 10))
+	if event := readAdminEvent(t, replay); event.Type != EventRegister || event.ID <= first.ID {
+		t.Fatalf("replayed: %+v", event)
+	}
+	if event := readAdminEvent(t, replay); event.ID != failure.ID {
+		t.Fatalf("replayed: %+v, want the sign-in failure", event)
+	}
+
+	publishAdminEvent(AdminEvent{Type: AdminEventDocumentFailed, Details: map[string]string{"filename": "handbook.pdf"}})
+	publishAdminEvent(AdminEvent{Type: EventLogout, UserID: "u1"})
+	if event := readAdminEvent(t, replay); event.Type != EventLogout {
+		t.Fatalf("live after replay: %+v", event)
+	}
+
+	if w := ts.do(http.MethodGet, "/v1/admin/events/stream", admin, "", "Last-Event-ID", "yesterday"); w.Code != http.StatusBadRequest {
+		t.Fatalf("bad Last-Event-ID: got %d, want 400", w.Code)
+	}
+	if w := ts.do(http.MethodGet, "/v1/admin/events/stream", user, ""); w.Code != http.StatusForbidden {
+		t.Fatalf("non-admin: got %d, want 403", w.Code)
+	}
+
+	// A subscriber that falls behind is let go to catch up by reconnecting
+	slow, _ := subscribeAdminEvents(nil, 0)
+	for i := 0; i <= adminEventBuffer; i++ {
+		publishAdminEvent(AdminEvent{Type: AdminEventQueryFailed})
+	}
+	received := 0
+	for range slow.events {
+		received++
+	}
+	if received != adminEventBuffer {
+		t.Fatalf("slow subscriber got %d events before being dropped, want %d", received, adminEventBuffer)
+	}
+	adminEventMutex.Lock()
+	backlog := len(adminEvents)
+	adminEventMutex.Unlock()
+	for i := backlog; i <= adminEventBacklog; i++ {
+		publishAdminEvent(AdminEvent{Type: AdminEventQueryFailed})
+	}
+	adminEventMutex.Lock()
+	backlog = len(adminEvents)
+	adminEventMutex.Unlock()
+	if backlog != adminEventBacklog {
+		t.Fatalf("backlog holds %d events, want %d", backlog, adminEventBacklog)
+	}
+}
+
+func TestMatchesEventType(t *testing.T) {
+	for _, tc := range []struct {
+		types []string
+		event string
+		want  bool
+	}{
+		{nil, EventLoginSuccess, true},
+		{[]string{"auth"}, EventLoginFailure, true},
+		{[]string{"auth.login"}, EventLoginFailure, true},
+		{[]string{"auth.log"}, EventLoginFailure, false},
+		{[]string{"document.failed", "server.error"}, AdminEventServerError, true},
+		{[]string{"document"}, EventRegister, false},
+	} {
+		if got := matchesEventType(tc.types, tc.event); got != tc.want {
+			t.Errorf("%v matching %s: %v, want %v", tc.types, tc.event, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"embed"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ============================================================================
+// Admin UI
+// ============================================================================
+//
+// /admin/ui is a small single-page console built into the binary: users
+// (create, promote, disable, delete), document ownership, audit log search,
+// and the runtime registration, maintenance and logging switches. The page
+// itself is static and public like /docs, except that the admin allowlist
+// applies; the admin signs in on it and every action is a call to the /v1
+// API with their JWT, so it can do nothing the API wouldn't let them do.
+//
+// The token is kept in sessionStorage and goes out as a bearer header, never
+// a cookie, so the console isn't open to CSRF. The CSP only allows the
+// page's own scripts and styles, and it can't be framed.
+
+//go:embed adminui
+var adminUIFiles embed.FS
+
+const adminUICSP = "default-src 'self'; frame-ancestors 'none'; form-action 'self'; base-uri 'none'"
+
+// mountAdminUI serves the admin console under /admin/ui
+func mountAdminUI(r *gin.Engine) {
+	ui := r.Group("/admin/ui", adminNetworkOnly())
+	ui.GET("", serveAdminUI)
+	ui.GET("/*filepath", serveAdminUI)
+}
+
+// serveAdminUI answers with an embedded asset, index.html for the root
+func serveAdminUI(c *gin.Context) {
+	name := strings.TrimPrefix(path.Clean("/"+c.Param("filepath")), "/")
+	if name == "" {
+		name = "index.html"
+	}
+	body, err := adminUIFiles.ReadFile("adminui/" + name)
+	if err != nil {
+		respondError(c, http.StatusNotFound, codeNotFound, "Route not found")
+		return
+	}
+
+	contentType := mime.TypeByExtension(path.Ext(name))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	c.Header("Content-Security-Policy", adminUICSP)
+	c.Header("X-Frame-Options", "DENY")
+	c.Header("X-Content-Type-Options", "nosniff")
+	c.Header("Referrer-Policy", "no-referrer")
+	// Small and embedded, so always revalidate rather than serve a stale
+	// console after an upgrade
+	c.Header("Cache-Control", "no-cache")
+	c.Data(http.StatusOK, contentType, body)
+}
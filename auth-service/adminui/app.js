@@ -0,0 +1,414 @@
+// Admin console for the auth service. Everything goes through the public
+// /v1 API with the admin's own JWT, so the server enforces the same rules
+// as for any other client; this page only renders the answers.
+"use strict";
+
+const api = "/v1";
+const pageSize = 50;
+
+const session = {
+  get token() { return sessionStorage.getItem("admin.token") || ""; },
+  get csrf() { return sessionStorage.getItem("admin.csrf") || ""; },
+  save(token, csrf) {
+    sessionStorage.setItem("admin.token", token || "");
+    sessionStorage.setItem("admin.csrf", csrf || "");
+  },
+  clear() {
+    sessionStorage.removeItem("admin.token");
+    sessionStorage.removeItem("admin.csrf");
+  },
+};
+
+const $ = (selector) => document.querySelector(selector);
+
+// request calls the API and returns the decoded body, throwing the server's
+// error detail on failure. A 401 means the session is over.
+async function request(method, path, body) {
+  const headers = { Accept: "application/json" };
+  if (session.token) headers.Authorization = "Bearer " + session.token;
+  if (session.csrf && method !== "GET") headers["X-CSRF-Token"] = session.csrf;
+  if (body !== undefined) headers["Content-Type"] = "application/json";
+
+  const response = await fetch(api + path, {
+    method,
+    headers,
+    body: body === undefined ? undefined : JSON.stringify(body),
+    credentials: "same-origin",
+  });
+  const data = await response.json().catch(() => ({}));
+  if (response.status === 401 && path !== "/auth/login") {
+    signedOut(data.detail || "Session expired; sign in again");
+  }
+  if (!response.ok) {
+    throw new Error(data.detail || data.error || response.statusText);
+  }
+  return data;
+}
+
+function flash(message, isError) {
+  const el = $("#flash");
+  el.textContent = message;
+  el.className = isError ? "error" : "ok";
+  el.hidden = !message;
+}
+
+// guard runs an action, reporting its failure instead of throwing
+async function guard(action) {
+  try {
+    await action();
+  } catch (err) {
+    flash(err.message, true);
+  }
+}
+
+function cell(row, content) {
+  const td = document.createElement("td");
+  if (content instanceof Node) td.appendChild(content);
+  else td.textContent = content === undefined || content === null ? "" : String(content);
+  row.appendChild(td);
+  return td;
+}
+
+function button(label, onClick) {
+  const el = document.createElement("button");
+  el.type = "button";
+  el.textContent = label;
+  el.addEventListener("click", () => guard(onClick));
+  return el;
+}
+
+function formatTime(value) {
+  return value ? new Date(value).toLocaleString() : "";
+}
+
+function splitList(value) {
+  return value.split(",").map((item) => item.trim()).filter(Boolean);
+}
+
+// ---------------------------------------------------------------------------
+// Sign-in
+// ---------------------------------------------------------------------------
+
+function signedOut(message) {
+  session.clear();
+  $("#tabs").hidden = true;
+  $("#logout").hidden = true;
+  $("#whoami").textContent = "";
+  document.querySelectorAll("main > section").forEach((s) => { s.hidden = s.id !== "login"; });
+  if (message) flash(message, true);
+}
+
+async function signedIn() {
+  const me = await request("GET", "/users/me");
+  if (me.role !== "admin") {
+    signedOut("Admin access required");
+    return;
+  }
+  $("#whoami").textContent = me.email;
+  $("#tabs").hidden = false;
+  $("#logout").hidden = false;
+  show("users");
+}
+
+$("#login-form").addEventListener("submit", (event) => {
+  event.preventDefault();
+  const form = event.target;
+  guard(async () => {
+    const auth = await request("POST", "/auth/login", {
+      email: form.email.value,
+      password: form.password.value,
+    });
+    session.save(auth.token, auth.csrf_token);
+    form.reset();
+    flash("");
+    await signedIn();
+  });
+});
+
+$("#logout").addEventListener("click", () => guard(async () => {
+  await request("POST", "/auth/logout").catch(() => {});
+  signedOut();
+}));
+
+// ---------------------------------------------------------------------------
+// Tabs
+// ---------------------------------------------------------------------------
+
+const loaders = {
+  users: loadUsers,
+  documents: () => loadDocuments(true),
+  audit: () => loadAudit(true),
+  settings: loadSettings,
+};
+
+function show(tab) {
+  document.querySelectorAll("#tabs button").forEach((b) => {
+    b.classList.toggle("active", b.dataset.tab === tab);
+  });
+  document.querySelectorAll("main > section").forEach((s) => { s.hidden = s.id !== tab; });
+  guard(loaders[tab]);
+}
+
+document.querySelectorAll("#tabs button").forEach((b) => {
+  b.addEventListener("click", () => show(b.dataset.tab));
+});
+
+// ---------------------------------------------------------------------------
+// Users
+// ---------------------------------------------------------------------------
+
+let users = [];
+
+async function loadUsers() {
+  const data = await request("GET", "/users/");
+  users = data.users.sort((a, b) => a.email.localeCompare(b.email));
+  $("#users-total").textContent = "(" + data.total + ")";
+  renderUsers();
+}
+
+function renderUsers() {
+  const filter = $("#users-filter").value.trim().toLowerCase();
+  const rows = $("#users-rows");
+  rows.replaceChildren();
+  for (const user of users) {
+    if (filter && !user.email.toLowerCase().includes(filter) && !user.name.toLowerCase().includes(filter)) {
+      continue;
+    }
+    const row = document.createElement("tr");
+    cell(row, user.email);
+    cell(row, user.name);
+    cell(row, user.role);
+    cell(row, user.merged_into ? "merged" : user.status);
+    cell(row, formatTime(user.created_at));
+    const actions = cell(row, "");
+    actions.className = "actions";
+    if (!user.merged_into) {
+      const otherRole = user.role === "admin" ? "user" : "admin";
+      actions.appendChild(button("Make " + otherRole, () => updateUser(user, { role: otherRole })));
+      const disabled = user.status === "disabled";
+      actions.appendChild(button(disabled ? "Enable" : "Disable", () => updateUser(user, { status: disabled ? "active" : "disabled" })));
+    }
+    actions.appendChild(button("Delete", () => deleteUser(user)));
+    rows.appendChild(row);
+  }
+}
+
+async function updateUser(user, changes) {
+  await request("PATCH", "/admin/users/" + encodeURIComponent(user.id), changes);
+  flash("Updated " + user.email);
+  await loadUsers();
+}
+
+async function deleteUser(user) {
+  if (!confirm("Delete " + user.email + " and release their documents?")) return;
+  await request("DELETE", "/admin/users/" + encodeURIComponent(user.id));
+  flash("Deleted " + user.email);
+  await loadUsers();
+}
+
+$("#users-filter").addEventListener("input", renderUsers);
+
+$("#user-create").addEventListener("submit", (event) => {
+  event.preventDefault();
+  const form = event.target;
+  guard(async () => {
+    const created = await request("POST", "/admin/users", {
+      email: form.email.value,
+      name: form.name.value,
+      role: form.role.value,
+      invite: form.invite.checked,
+    });
+    form.reset();
+    flash(created.temporary_password
+      ? "Created " + created.user.email + "; temporary password: " + created.temporary_password
+      : "Invitation sent to " + created.user.email);
+    await loadUsers();
+  });
+});
+
+// ---------------------------------------------------------------------------
+// Documents
+// ---------------------------------------------------------------------------
+
+let documentsCursor = "";
+
+async function loadDocuments(first) {
+  if (first) {
+    documentsCursor = "";
+    $("#documents-rows").replaceChildren();
+  }
+  const query = new URLSearchParams({ limit: pageSize });
+  if (documentsCursor) query.set("cursor", documentsCursor);
+  const data = await request("GET", "/documents/all?" + query);
+
+  $("#documents-total").textContent = "(" + data.total_documents + " documents, " + data.total_users + " owners)";
+  for (const group of data.users) {
+    const row = document.createElement("tr");
+    cell(row, group.user_name);
+    cell(row, group.user_email);
+    cell(row, group.count);
+    const list = document.createElement("ul");
+    for (const filename of group.documents) {
+      const item = document.createElement("li");
+      item.textContent = filename;
+      list.appendChild(item);
+    }
+    cell(row, list);
+    $("#documents-rows").appendChild(row);
+  }
+  documentsCursor = data.next_cursor;
+  $("#documents-more").hidden = !documentsCursor;
+}
+
+$("#documents-more").addEventListener("click", () => guard(() => loadDocuments(false)));
+
+// ---------------------------------------------------------------------------
+// Audit log
+// ---------------------------------------------------------------------------
+
+let auditOffset = 0;
+
+async function loadAudit(first) {
+  if (first) {
+    auditOffset = 0;
+    $("#audit-rows").replaceChildren();
+  }
+  const form = $("#audit-form");
+  const query = new URLSearchParams({ limit: pageSize, offset: auditOffset });
+  for (const name of ["actor", "action", "resource"]) {
+    if (form[name].value.trim()) query.set(name, form[name].value.trim());
+  }
+  for (const name of ["since", "until"]) {
+    if (form[name].value) query.set(name, new Date(form[name].value).toISOString());
+  }
+  const data = await request("GET", "/admin/audit?" + query);
+
+  $("#audit-total").textContent = "(" + data.total + " matching)";
+  for (const entry of data.entries) {
+    const row = document.createElement("tr");
+    cell(row, entry.seq);
+    cell(row, formatTime(entry.timestamp));
+    cell(row, entry.actor_email || entry.actor_id);
+    cell(row, entry.action);
+    cell(row, entry.resource);
+    cell(row, entry.status);
+    const change = document.createElement("pre");
+    if (entry.before || entry.after) {
+      change.textContent = JSON.stringify({ before: entry.before, after: entry.after }, null, 2);
+    }
+    cell(row, change);
+    $("#audit-rows").appendChild(row);
+  }
+  auditOffset += data.entries.length;
+  $("#audit-more").hidden = auditOffset >= data.total;
+}
+
+$("#audit-form").addEventListener("submit", (event) => {
+  event.preventDefault();
+  guard(() => loadAudit(true));
+});
+$("#audit-more").addEventListener("click", () => guard(() => loadAudit(false)));
+
+// ---------------------------------------------------------------------------
+// Settings
+// ---------------------------------------------------------------------------
+
+async function loadSettings() {
+  const [registration, maintenance, logging] = await Promise.all([
+    request("GET", "/admin/registration"),
+    request("GET", "/admin/maintenance"),
+    request("GET", "/admin/logging"),
+  ]);
+  renderRegistration(registration);
+  renderMaintenance(maintenance);
+  renderLogging(logging);
+}
+
+function renderRegistration(settings) {
+  const form = $("#registration-form");
+  form.mode.value = settings.mode;
+  form.allowed_domains.value = (settings.allowed_domains || []).join(", ");
+  $("#registration-overridden").textContent = settings.overridden ? "(changed at runtime)" : "(as configured)";
+}
+
+function renderMaintenance(status) {
+  const form = $("#maintenance-form");
+  form.enabled.checked = status.enabled;
+  form.message.value = status.message || "";
+  form.retry_after.value = status.retry_after || "";
+  $("#maintenance-state").textContent = status.enabled
+    ? "(on since " + formatTime(status.since) + ", " + status.in_flight + " requests in flight)"
+    : "(off)";
+}
+
+function renderLogging(status) {
+  const form = $("#logging-form");
+  form.level.value = status.level;
+  const modules = $("#logging-modules");
+  modules.querySelectorAll("label").forEach((label) => label.remove());
+  for (const name of Object.keys(status.modules).sort()) {
+    const label = document.createElement("label");
+    const box = document.createElement("input");
+    box.type = "checkbox";
+    box.dataset.module = name;
+    box.checked = status.modules[name];
+    label.append(box, " " + name);
+    modules.appendChild(label);
+  }
+  $("#logging-revert").textContent = status.revert_at ? "Reverts " + formatTime(status.revert_at) : "";
+}
+
+$("#registration-form").addEventListener("submit", (event) => {
+  event.preventDefault();
+  const form = event.target;
+  guard(async () => {
+    renderRegistration(await request("PUT", "/admin/registration", {
+      mode: form.mode.value,
+      allowed_domains: splitList(form.allowed_domains.value),
+    }));
+    flash("Registration settings saved");
+  });
+});
+
+$("#registration-reset").addEventListener("click", () => guard(async () => {
+  renderRegistration(await request("DELETE", "/admin/registration"));
+  flash("Registration settings restored");
+}));
+
+$("#maintenance-form").addEventListener("submit", (event) => {
+  event.preventDefault();
+  const form = event.target;
+  guard(async () => {
+    renderMaintenance(await request("PUT", "/admin/maintenance", {
+      enabled: form.enabled.checked,
+      message: form.message.value,
+      retry_after: form.retry_after.value,
+    }));
+    flash("Maintenance mode " + (form.enabled.checked ? "on" : "off"));
+  });
+});
+
+$("#logging-form").addEventListener("submit", (event) => {
+  event.preventDefault();
+  const form = event.target;
+  const modules = {};
+  form.querySelectorAll("input[data-module]").forEach((box) => { modules[box.dataset.module] = box.checked; });
+  guard(async () => {
+    renderLogging(await request("PUT", "/admin/logging", {
+      level: form.level.value,
+      modules,
+      expires_in: form.expires_in.value,
+    }));
+    flash("Logging settings saved");
+  });
+});
+
+// ---------------------------------------------------------------------------
+// Start
+// ---------------------------------------------------------------------------
+
+if (session.token || session.csrf) {
+  guard(signedIn);
+} else {
+  signedOut();
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestAdminUI(t *testing.T) {
+	ts := newTestServer(t)
+
+	w := ts.do(http.MethodGet, "/admin/ui", "", "")
+	if w.Code != http.StatusOK || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/html") {
+		t.Fatalf("page: %d %s", w.Code, w.Header().Get("Content-Type"))
+	}
+	if !strings.Contains(w.Body.String(), `src="/admin/ui/app.js"`) {
+		t.Fatalf("page doesn't load its script: %s", w.Body.String())
+	}
+	if w.Header().Get("Content-Security-Policy") != adminUICSP || w.Header().Get("X-Frame-Options") != "DENY" {
+		t.Fatalf("headers = %v", w.Header())
+	}
+
+	for path, want := range map[string]string{"/admin/ui/app.js": "javascript", "/admin/ui/style.css": "text/css"} {
+		w = ts.do(http.MethodGet, path, "", "")
+		if w.Code != http.StatusOK || !strings.Contains(w.Header().Get("Content-Type"), want) {
+			t.Fatalf("%s: %d %s", path, w.Code, w.Header().Get("Content-Type"))
+		}
+	}
+	for _, path := range []string{"/admin/ui/missing.js", "/admin/ui/../adminui.go"} {
+		if w = ts.do(http.MethodGet, path, "", ""); w.Code == http.StatusOK {
+			t.Fatalf("%s served: %s", path, w.Body.String())
+		}
+	}
+
+	// Outside the admin allowlist the console is as unreachable as the API
+	useNetworkRules(t, testRule(t, networkListAdminAllow, "10.0.0.0/8", nil))
+	if w = ts.do(http.MethodGet, "/admin/ui", "", ""); w.Code != http.StatusForbidden {
+		t.Fatalf("blocked address: %d", w.Code)
+	}
+}
@@ -0,0 +1,631 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// ============================================================================
+// Admin User Management
+// ============================================================================
+//
+// Admins create, edit and delete accounts under /admin/users. A new
+// account either gets a temporary password, returned once in the response,
+// or an emailed invitation: the account stays "invited", with no password,
+// until the link is used to set one. Disabled accounts can't log in and
+// their tokens stop working. Every change is audited, and no change may
+// leave the service without an active admin; changes are serialized per
+// Service so two admins can't demote each other at once. Invitations are
+// kept in keyedRecords, so the link works on any replica, and an admin can
+// resend one, which voids the earlier link.
+
+// Account statuses; users stored before statuses existed have none and
+// count as active
+const (
+	UserActive   = "active"
+	UserDisabled = "disabled"
+	UserInvited  = "invited"
+	UserPending  = "pending" // self-registered, awaiting approval (approvals.go)
+)
+
+const invitationLifetime = 7 * 24 * time.Hour
+
+// invitationRecord is the record kind of pending invitations
+const invitationRecord = "invitation"
+
+var (
+	errLastAdmin         = errors.New("At least one active admin must remain")
+	errInvalidInvitation = errors.New("Invitation is invalid or has expired")
+	errNotInvited        = errors.New("User has already accepted their invitation or was not invited")
+)
+
+// CreateUserRequest for POST /admin/users
+type CreateUserRequest struct {
+	Email  string `json:"email" binding:"required,email"`
+	Name   string `json:"name" binding:"required,min=2"`
+	Role   string `json:"role" binding:"omitempty,oneof=user admin"` // default user
+	Invite bool   `json:"invite"`                                    // email an invitation instead of returning a temporary password
+}
+
+// UpdateUserRequest for PATCH /admin/users/:id; omitted fields stay as they are
+type UpdateUserRequest struct {
+	Name    *string `json:"name,omitempty" binding:"omitempty,min=2"`
+	Email   *string `json:"email,omitempty" binding:"omitempty,email"`
+	Role    *string `json:"role,omitempty" binding:"omitempty,oneof=user admin"`
+	Status  *string `json:"status,omitempty" binding:"omitempty,oneof=active disabled"`
+	Plan    *string `json:"plan,omitempty" binding:"omitempty,max=64"`                   // one of rate_limit.plans; empty returns to the default
+	OrgID   *string `json:"org_id,omitempty"`                                            // org in org mode (orgs.go); empty leaves any org
+	OrgRole *string `json:"org_role,omitempty" binding:"omitempty,oneof=member manager"` // default: the org's default role when org_id changes
+}
+
+// AcceptInvitationRequest for POST /auth/invitations/accept
+type AcceptInvitationRequest struct {
+	Token    string `json:"token" binding:"required"`
+	Password string `json:"password" binding:"required,min=6"`
+}
+
+// CreateUserResponse returns the account and, without an invitation, its
+// temporary password
+type CreateUserResponse struct {
+	User                UserProfile `json:"user"`
+	TemporaryPassword   string      `json:"temporary_password,omitempty"`
+	InvitationExpiresAt *time.Time  `json:"invitation_expires_at,omitempty"`
+}
+
+// accountStatus returns a user's status; callers hold the user's lock
+func accountStatus(user *User) string {
+	if user.Status == "" {
+		return UserActive
+	}
+	return user.Status
+}
+
+// generatePassword returns a random password for a new account
+func generatePassword() (string, error) {
+	raw := make([]byte, 18)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(raw), nil
+}
+
+// ----------------------------------------------------------------------------
+// Service operations
+// ----------------------------------------------------------------------------
+
+// CreateUser adds an account on an admin's behalf. An invited user has no
+// password hash.
+func (s *Service) CreateUser(email, name, role, status, hash string) (*User, error) {
+	if s.users.ByEmail(email) != nil {
+		return nil, errEmailTaken
+	}
+	now := time.Now()
+	user := &User{
+		ID:        uuid.New().String(),
+		Email:     email,
+		Password:  hash,
+		Name:      name,
+		Role:      role,
+		Status:    status,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	placeInOrg(user)
+	if err := reserveEmail(user.Email, user.ID); err != nil {
+		return nil, err
+	}
+	if err := saveUser(user); err != nil {
+		releaseEmail(user.Email)
+		return nil, err
+	}
+	return s.users.Add(user)
+}
+
+// UpdateUser applies an admin's edits to an account, refusing any that
+// would leave no active admin. A change of role, email or status revokes
+// the account's tokens, which rotated reports.
+func (s *Service) UpdateUser(user *User, req UpdateUserRequest) (rotated bool, err error) {
+	s.adminMu.Lock()
+	defer s.adminMu.Unlock()
+
+	lock := s.users.FieldLock(user)
+	lock.RLock()
+	previous := *user
+	lock.RUnlock()
+
+	role, status := previous.Role, accountStatus(&previous)
+	if status == UserMerged {
+		return false, errAccountMerged
+	}
+	if req.Role != nil {
+		role = *req.Role
+	}
+	if req.Status != nil {
+		status = *req.Status
+		if accountStatus(&previous) == UserInvited && status == UserActive {
+			status = UserInvited // activated by accepting the invitation
+		}
+	}
+	if previous.Role == "admin" && accountStatus(&previous) == UserActive &&
+		(role != "admin" || status != UserActive) && s.activeAdmins() <= 1 {
+		return false, errLastAdmin
+	}
+
+	emailChanged := req.Email != nil && *req.Email != previous.Email
+	if emailChanged {
+		if err := reserveEmail(*req.Email, user.ID); err != nil {
+			return false, err
+		}
+		if err := s.users.ChangeEmail(user, previous.Email, *req.Email); err != nil {
+			releaseEmail(*req.Email)
+			return false, err
+		}
+	}
+
+	rotated = emailChanged || role != previous.Role || status != accountStatus(&previous)
+	lock.Lock()
+	if req.Name != nil {
+		user.Name = *req.Name
+	}
+	if req.Plan != nil {
+		user.Plan = *req.Plan
+	}
+	if req.OrgID != nil && *req.OrgID != user.OrgID {
+		user.OrgID, user.OrgRole = *req.OrgID, ""
+		if org, exists := lookupOrg(user.OrgID); exists {
+			user.OrgRole = org.DefaultRole
+		}
+	}
+	if req.OrgRole != nil && user.OrgID != "" {
+		user.OrgRole = *req.OrgRole
+	}
+	if emailChanged {
+		user.Email = *req.Email
+	}
+	user.Role, user.Status = role, status
+	user.UpdatedAt = time.Now()
+	if rotated {
+		user.TokensRevokedAt = revocationTime()
+	}
+	err = saveUser(user)
+	if err != nil {
+		*user = previous
+	}
+	lock.Unlock()
+
+	if err != nil {
+		if emailChanged {
+			s.users.ChangeEmail(user, *req.Email, previous.Email)
+			releaseEmail(*req.Email)
+		}
+		return false, err
+	}
+	if emailChanged {
+		releaseEmail(previous.Email)
+	}
+	if rotated {
+		forgetUserTokens(user.ID)
+	}
+	bumpUserVersion()
+	return rotated, nil
+}
+
+// DeleteUser removes an account and releases the documents it owned
+func (s *Service) DeleteUser(user *User) error {
+	s.adminMu.Lock()
+	defer s.adminMu.Unlock()
+	return s.deleteUser(user)
+}
+
+// deleteUser is DeleteUser for callers holding adminMu
+func (s *Service) deleteUser(user *User) error {
+	lock := s.users.FieldLock(user)
+	lock.RLock()
+	email, phone := user.Email, user.Phone
+	lastAdmin := user.Role == "admin" && accountStatus(user) == UserActive
+	lock.RUnlock()
+	if lastAdmin && s.activeAdmins() <= 1 {
+		return errLastAdmin
+	}
+
+	for _, filename := range s.DocumentsOf(user.ID) {
+		if err := s.ReleaseDocument(filename, user); err != nil && err != errDocumentNotFound {
+			return err
+		}
+	}
+	if err := deleteSharedUser(user.ID, email, phone); err != nil {
+		return err
+	}
+	s.users.Remove(user)
+	forgetUserTokens(user.ID)
+	return nil
+}
+
+// activeAdmins counts admins who can log in
+func (s *Service) activeAdmins() int {
+	count := 0
+	s.users.Each(func(user *User) {
+		if user.Role == "admin" && accountStatus(user) == UserActive {
+			count++
+		}
+	})
+	return count
+}
+
+// ----------------------------------------------------------------------------
+// Invitations
+// ----------------------------------------------------------------------------
+
+type invitation struct {
+	UserID    string    `json:"user_id"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+func invitationKey(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// newInvitation issues a single-use token for an invited user, voiding
+// any earlier ones
+func newInvitation(userID string) (string, time.Time, error) {
+	token, err := generatePassword()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	expiresAt := time.Now().Add(invitationLifetime).UTC()
+	data, err := json.Marshal(invitation{UserID: userID, ExpiresAt: expiresAt})
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	ctx := context.Background()
+	if err := deleteInvitations(ctx, userID); err != nil {
+		return "", time.Time{}, err
+	}
+	if err := keyedRecords().saveRecord(ctx, invitationRecord, invitationKey(token), data, invitationLifetime); err != nil {
+		slog.Error("Record store write failed", "op", "invitation", "error", err)
+		return "", time.Time{}, errStoreUnavailable
+	}
+	return token, expiresAt, nil
+}
+
+// deleteInvitations voids a user's pending invitations
+func deleteInvitations(ctx context.Context, userID string) error {
+	pending, err := keyedRecords().records(ctx, invitationRecord)
+	for key, data := range pending {
+		var inv invitation
+		if err != nil || json.Unmarshal(data, &inv) != nil || inv.UserID != userID {
+			continue
+		}
+		err = keyedRecords().deleteRecord(ctx, invitationRecord, key)
+	}
+	if err != nil {
+		slog.Error("Record store write failed", "op", "invitations", "error", err)
+		return errStoreUnavailable
+	}
+	return nil
+}
+
+// takeInvitation consumes a token, returning the invited user's ID
+func takeInvitation(token string) (string, bool, error) {
+	return lookupInvitation(token, true)
+}
+
+// peekInvitation returns the invited user's ID, leaving the token usable
+func peekInvitation(token string) (string, bool, error) {
+	return lookupInvitation(token, false)
+}
+
+func lookupInvitation(token string, consume bool) (string, bool, error) {
+	ctx := context.Background()
+	var data []byte
+	var found bool
+	var err error
+	if consume {
+		data, found, err = keyedRecords().takeRecord(ctx, invitationRecord, invitationKey(token))
+	} else {
+		data, found, err = keyedRecords().record(ctx, invitationRecord, invitationKey(token))
+	}
+	if err != nil {
+		slog.Error("Record store read failed", "op", "invitation", "error", err)
+		return "", false, errStoreUnavailable
+	}
+	var inv invitation
+	if !found || json.Unmarshal(data, &inv) != nil || time.Now().After(inv.ExpiresAt) {
+		return "", false, nil
+	}
+	return inv.UserID, true, nil
+}
+
+// sendInvitation issues an invitation and emails its link
+func (s *Server) sendInvitation(c *gin.Context, user *User) (time.Time, error) {
+	token, expiresAt, err := newInvitation(user.ID)
+	if err != nil {
+		return time.Time{}, err
+	}
+	admin, _ := c.Get("user")
+	inviterName, _, _ := s.svc.users.Contact(admin.(*User).ID)
+	_, email, _ := s.svc.users.Contact(user.ID)
+	lang := config.I18n.DefaultLanguage
+	queueEmail(email, EmailInvitation, lang, map[string]any{
+		"InviterName": inviterName,
+		"Link":        config.Mail.BaseURL + "/accept-invitation?token=" + token,
+		"ExpiresIn":   translate(lang, "7 days"),
+	})
+	return expiresAt, nil
+}
+
+// ----------------------------------------------------------------------------
+// Handlers
+// ----------------------------------------------------------------------------
+
+// createUser adds an account with a temporary password or an invitation
+func (s *Server) createUser(c *gin.Context) {
+	var req CreateUserRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondBindError(c, err)
+		return
+	}
+	if req.Role == "" {
+		req.Role = "user"
+	}
+
+	var resp CreateUserResponse
+	status, hash := UserActive, ""
+	if req.Invite {
+		status = UserInvited
+	} else {
+		password, err := generatePassword()
+		if err == nil {
+			hash, err = hashPassword(password)
+		}
+		if err == errPasswordBusy {
+			respondServiceError(c, err)
+			return
+		}
+		if err != nil {
+			respondServiceError(c, errPasswordProcessing)
+			return
+		}
+		resp.TemporaryPassword = password
+	}
+
+	user, err := s.svc.CreateUser(req.Email, req.Name, req.Role, status, hash)
+	if err != nil {
+		respondServiceError(c, err)
+		return
+	}
+	resp.User = toProfile(user)
+
+	if req.Invite {
+		expiresAt, err := s.sendInvitation(c, user)
+		if err != nil {
+			// The account exists either way; the invitation can be resent
+			slog.Error("Invitation not created", "user_id", user.ID, "error", err)
+			respondServiceError(c, err)
+			return
+		}
+		resp.InvitationExpiresAt = &expiresAt
+	}
+
+	auditChange(c, "admin.user.create", "user:"+user.ID, nil, resp.User)
+	c.JSON(http.StatusCreated, resp)
+}
+
+// updateUser edits an account's name, email, role, status, plan or org
+func (s *Server) updateUser(c *gin.Context) {
+	var req UpdateUserRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondBindError(c, err)
+		return
+	}
+	if req.Plan != nil && *req.Plan != "" {
+		if _, known := config.RateLimit.Plans[*req.Plan]; !known {
+			respondError(c, http.StatusBadRequest, codeInvalidRequest,
+				fmt.Sprintf(translate(requestLanguage(c), "Unknown plan %s"), *req.Plan))
+			return
+		}
+	}
+	if req.OrgID != nil && *req.OrgID != "" {
+		if !orgModeOn() {
+			respondError(c, http.StatusConflict, codeConflict, errOrgModeOff.Error())
+			return
+		}
+		if _, exists := lookupOrg(*req.OrgID); !exists {
+			respondError(c, http.StatusBadRequest, codeInvalidRequest, errUnknownOrg.Error())
+			return
+		}
+	}
+	user := s.svc.users.ByID(c.Param("id"))
+	if user == nil {
+		respondError(c, http.StatusNotFound, codeNotFound, "User not found")
+		return
+	}
+
+	before := s.profileOf(user)
+	rotated, err := s.svc.UpdateUser(user, req)
+	if err != nil {
+		respondAdminUserError(c, err)
+		return
+	}
+	after := s.profileOf(user)
+	auditChange(c, "admin.user.update", "user:"+user.ID, before, after)
+	response := gin.H{"message": "User updated", "user": after}
+	if !rotated {
+		c.JSON(http.StatusOK, response)
+		return
+	}
+
+	event := httpSecurityEvent(c, EventTokenRevoked, "success")
+	event.UserID, event.Email = user.ID, after.Email
+	event.Reason = "privilege_change"
+	emitSecurityEvent(event)
+
+	// Admins editing themselves lose their own token with the rest, so
+	// they get a new one carrying the new claims
+	if c.MustGet("user").(*User) == user {
+		token, err := s.svc.IssueToken(user)
+		if err != nil {
+			respondServiceError(c, err)
+			return
+		}
+		session := sessionResponse(c, user, token, "")
+		if session.Token != "" {
+			response["token"] = session.Token
+		}
+		if session.CSRFToken != "" {
+			response["csrf_token"] = session.CSRFToken
+		}
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// deleteUser removes an account
+func (s *Server) deleteUser(c *gin.Context) {
+	user := s.svc.users.ByID(c.Param("id"))
+	if user == nil {
+		respondError(c, http.StatusNotFound, codeNotFound, "User not found")
+		return
+	}
+
+	before := s.profileOf(user)
+	if err := s.svc.DeleteUser(user); err != nil {
+		respondAdminUserError(c, err)
+		return
+	}
+	notificationMutex.Lock()
+	delete(notifications, user.ID)
+	notificationMutex.Unlock()
+
+	auditChange(c, "admin.user.delete", "user:"+user.ID, before, nil)
+	c.JSON(http.StatusOK, gin.H{"message": "User deleted"})
+}
+
+// resendInvitation emails an invited user a new link, voiding the old one
+func (s *Server) resendInvitation(c *gin.Context) {
+	user := s.svc.users.ByID(c.Param("id"))
+	if user == nil {
+		respondError(c, http.StatusNotFound, codeNotFound, "User not found")
+		return
+	}
+	profile := s.profileOf(user)
+	if profile.Status != UserInvited {
+		respondError(c, http.StatusConflict, codeConflict, errNotInvited.Error())
+		return
+	}
+
+	expiresAt, err := s.sendInvitation(c, user)
+	if err != nil {
+		slog.Error("Invitation not created", "user_id", user.ID, "error", err)
+		respondServiceError(c, err)
+		return
+	}
+	auditChange(c, "admin.user.invitation.resend", "user:"+user.ID, nil, gin.H{"invitation_expires_at": expiresAt})
+	c.JSON(http.StatusOK, gin.H{"message": "Invitation sent", "invitation_expires_at": expiresAt})
+}
+
+// acceptInvitation sets an invited user's password and logs them in
+func (s *Server) acceptInvitation(c *gin.Context) {
+	var req AcceptInvitationRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondBindError(c, err)
+		return
+	}
+	// A weak password is refused before the token is spent, so the user
+	// can try another
+	userID, ok, err := peekInvitation(req.Token)
+	if err != nil {
+		respondServiceError(c, err)
+		return
+	}
+	user := s.svc.users.ByID(userID)
+	if !ok || user == nil {
+		respondError(c, http.StatusBadRequest, codeInvalidToken, errInvalidInvitation.Error())
+		return
+	}
+	lock := s.svc.users.FieldLock(user)
+	lock.RLock()
+	email, name := user.Email, user.Name
+	lock.RUnlock()
+	if err := checkPasswordStrength(req.Password, email, name); err != nil {
+		respondServiceError(c, err)
+		return
+	}
+	taken, ok, err := takeInvitation(req.Token)
+	if err != nil {
+		respondServiceError(c, err)
+		return
+	}
+	if !ok || taken != userID {
+		respondError(c, http.StatusBadRequest, codeInvalidToken, errInvalidInvitation.Error())
+		return
+	}
+
+	hash, err := hashPassword(req.Password)
+	if err == errPasswordBusy {
+		respondServiceError(c, err)
+		return
+	}
+	if err != nil {
+		respondServiceError(c, errPasswordProcessing)
+		return
+	}
+
+	lock.Lock()
+	if accountStatus(user) != UserInvited {
+		lock.Unlock()
+		respondError(c, http.StatusBadRequest, codeInvalidToken, errInvalidInvitation.Error())
+		return
+	}
+	previous := *user
+	user.Password, user.Status, user.UpdatedAt = hash, UserActive, time.Now()
+	err = saveUser(user)
+	if err != nil {
+		*user = previous
+	}
+	lock.Unlock()
+	if err != nil {
+		respondServiceError(c, err)
+		return
+	}
+	bumpUserVersion()
+
+	token, err := s.svc.IssueToken(user)
+	if err != nil {
+		respondServiceError(c, errTokenGeneration)
+		return
+	}
+	auditActor(c, user)
+	auditChange(c, "user.invitation.accept", "user:"+user.ID, toProfile(&previous), s.profileOf(user))
+	c.JSON(http.StatusOK, sessionResponse(c, user, token, "Invitation accepted"))
+}
+
+// profileOf reads a user's profile under its lock
+func (s *Server) profileOf(user *User) UserProfile {
+	lock := s.svc.users.FieldLock(user)
+	lock.RLock()
+	defer lock.RUnlock()
+	return toProfile(user)
+}
+
+// respondAdminUserError adds the last-admin rule to respondServiceError
+func respondAdminUserError(c *gin.Context, err error) {
+	if err == errLastAdmin {
+		respondError(c, http.StatusConflict, codeLastAdmin, err.Error())
+		return
+	}
+	respondServiceError(c, err)
+}
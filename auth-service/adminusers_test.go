@@ -0,0 +1,252 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// login returns a token, failing the test unless the login gets want
+func (ts *testServer) login(email, password string, want int) string {
+	ts.t.Helper()
+	w := ts.do(http.MethodPost, "/v1/auth/login", "", `{"email":"`+email+`","password":"`+password+`"}`)
+	if w.Code != want {
+		ts.t.Fatalf("login %s: got %d, want %d: %s", email, w.Code, want, w.Body)
+	}
+	var resp AuthResponse
+	if w.Code == http.StatusOK {
+		decodeJSON(ts.t, w, &resp)
+	}
+	return resp.Token
+}
+
+func TestAdminCreateUser(t *testing.T) {
+	ts := newTestServer(t)
+	admin := ts.admin("admin@example.com")
+	user, _ := ts.register("user@example.com")
+
+	if w := ts.do(http.MethodPost, "/v1/admin/users", user, `{"email":"new@example.com","name":"New User"}`); w.Code != http.StatusForbidden {
+		t.Fatalf("create as user: got %d, want 403", w.Code)
+	}
+
+	w := ts.do(http.MethodPost, "/v1/admin/users", admin, `{"email":"new@example.com","name":"New User","role":"admin"}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create: %d %s", w.Code, w.Body)
+	}
+	var created CreateUserResponse
+	decodeJSON(t, w, &created)
+	if created.TemporaryPassword == "" || created.User.Role != "admin" || created.User.Status != UserActive {
+		t.Fatalf("created = %+v", created)
+	}
+	ts.login("new@example.com", created.TemporaryPassword, http.StatusOK)
+
+	if w := ts.do(http.MethodPost, "/v1/admin/users", admin, `{"email":"new@example.com","name":"Again"}`); w.Code != http.StatusConflict {
+		t.Fatalf("duplicate email: got %d, want 409", w.Code)
+	}
+	if w := ts.do(http.MethodPost, "/v1/admin/users", admin, `{"email":"x@example.com","name":"X User","role":"owner"}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("unknown role: got %d, want 400", w.Code)
+	}
+}
+
+func TestAdminInviteUser(t *testing.T) {
+	ts := newTestServer(t)
+	admin := ts.admin("admin@example.com")
+
+	w := ts.do(http.MethodPost, "/v1/admin/users", admin, `{"email":"invitee@example.com","name":"Invitee","invite":true}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("invite: %d %s", w.Code, w.Body)
+	}
+	var created CreateUserResponse
+	decodeJSON(t, w, &created)
+	if created.TemporaryPassword != "" || created.InvitationExpiresAt == nil || created.User.Status != UserInvited {
+		t.Fatalf("invited = %+v", created)
+	}
+	ts.login("invitee@example.com", "", http.StatusBadRequest)
+	ts.login("invitee@example.com", "anything", http.StatusUnauthorized)
+
+	// The emailed token isn't observable here, so issue another
+	token, _, err := newInvitation(created.User.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := `{"token":"` + token + `","password":"chosen-password"}`
+	if w := ts.do(http.MethodPost, "/v1/auth/invitations/accept", "", body); w.Code != http.StatusOK {
+		t.Fatalf("accept: %d %s", w.Code, w.Body)
+	}
+	if w := ts.do(http.MethodPost, "/v1/auth/invitations/accept", "", body); w.Code != http.StatusBadRequest {
+		t.Fatalf("accept twice: got %d, want 400", w.Code)
+	}
+	ts.login("invitee@example.com", "chosen-password", http.StatusOK)
+}
+
+func TestAdminUpdateUser(t *testing.T) {
+	ts := newTestServer(t)
+	admin := ts.admin("admin@example.com")
+	user, userID := ts.register("user@example.com")
+
+	w := ts.do(http.MethodPatch, "/v1/admin/users/"+userID, admin, `{"name":"Renamed","email":"moved@example.com"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("update: %d %s", w.Code, w.Body)
+	}
+	ts.login("moved@example.com", "secret123", http.StatusOK)
+	ts.login("user@example.com", "secret123", http.StatusUnauthorized)
+	if ts.srv.svc.users.ByID(userID).Name != "Renamed" {
+		t.Fatal("name not updated")
+	}
+
+	ts.register("other@example.com")
+	if w := ts.do(http.MethodPatch, "/v1/admin/users/"+userID, admin, `{"email":"other@example.com"}`); w.Code != http.StatusConflict {
+		t.Fatalf("taken email: got %d, want 409", w.Code)
+	}
+
+	// Disabling locks the account out, tokens included
+	if w := ts.do(http.MethodPatch, "/v1/admin/users/"+userID, admin, `{"status":"disabled"}`); w.Code != http.StatusOK {
+		t.Fatalf("disable: %d %s", w.Code, w.Body)
+	}
+	if w := ts.do(http.MethodGet, "/v1/users/me", user, ""); w.Code != http.StatusUnauthorized {
+		t.Fatalf("disabled user's token: got %d, want 401", w.Code)
+	}
+	w = ts.do(http.MethodPost, "/v1/auth/login", "", `{"email":"moved@example.com","password":"secret123"}`)
+	if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), codeAccountDisabled) {
+		t.Fatalf("disabled login: %d %s", w.Code, w.Body)
+	}
+	ts.login("moved@example.com", "wrong-password", http.StatusUnauthorized)
+
+	if w := ts.do(http.MethodPatch, "/v1/admin/users/"+userID, admin, `{"status":"active","role":"admin"}`); w.Code != http.StatusOK {
+		t.Fatalf("re-enable: %d %s", w.Code, w.Body)
+	}
+	token := ts.login("moved@example.com", "secret123", http.StatusOK)
+	if w := ts.do(http.MethodGet, "/v1/users/", token, ""); w.Code != http.StatusOK {
+		t.Fatalf("promoted user listing users: got %d", w.Code)
+	}
+
+	if w := ts.do(http.MethodPatch, "/v1/admin/users/"+userID, admin, `{"status":"invited"}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("set invited: got %d, want 400", w.Code)
+	}
+	if w := ts.do(http.MethodPatch, "/v1/admin/users/no-such-user", admin, `{"name":"Nobody"}`); w.Code != http.StatusNotFound {
+		t.Fatalf("unknown user: got %d, want 404", w.Code)
+	}
+}
+
+func TestAdminDeleteUser(t *testing.T) {
+	ts := newTestServer(t)
+	admin := ts.admin("admin@example.com")
+	user, userID := ts.register("user@example.com")
+	ts.do(http.MethodPost, "/v1/documents/register", user, `{"filename":"report.pdf"}`)
+
+	if w := ts.do(http.MethodDelete, "/v1/admin/users/"+userID, admin, ""); w.Code != http.StatusOK {
+		t.Fatalf("delete: %d %s", w.Code, w.Body)
+	}
+	if ts.srv.svc.users.ByID(userID) != nil || ts.srv.svc.users.ByEmail("user@example.com") != nil {
+		t.Fatal("user still stored")
+	}
+	if owner := ts.srv.svc.DocumentOwner("report.pdf"); owner != "" {
+		t.Fatalf("document still owned by %q", owner)
+	}
+	if w := ts.do(http.MethodGet, "/v1/users/me", user, ""); w.Code != http.StatusUnauthorized {
+		t.Fatalf("deleted user's token: got %d, want 401", w.Code)
+	}
+	if w := ts.do(http.MethodDelete, "/v1/admin/users/"+userID, admin, ""); w.Code != http.StatusNotFound {
+		t.Fatalf("delete twice: got %d, want 404", w.Code)
+	}
+	// The email can be used again
+	ts.register("user@example.com")
+}
+
+func TestLastAdminProtected(t *testing.T) {
+	ts := newTestServer(t)
+	admin := ts.admin("admin@example.com")
+	adminID := ts.srv.svc.users.ByEmail("admin@example.com").ID
+
+	for _, tc := range []struct{ method, body string }{
+		{http.MethodPatch, `{"role":"user"}`},
+		{http.MethodPatch, `{"status":"disabled"}`},
+		{http.MethodDelete, ""},
+	} {
+		w := ts.do(tc.method, "/v1/admin/users/"+adminID, admin, tc.body)
+		if w.Code != http.StatusConflict || !strings.Contains(w.Body.String(), codeLastAdmin) {
+			t.Errorf("%s %s on the last admin: %d %s", tc.method, tc.body, w.Code, w.Body)
+		}
+	}
+
+	// A disabled admin doesn't count
+	_, otherID := ts.register("other@example.com")
+	ts.do(http.MethodPatch, "/v1/admin/users/"+otherID, admin, `{"role":"admin","status":"disabled"}`)
+	if w := ts.do(http.MethodDelete, "/v1/admin/users/"+adminID, admin, ""); w.Code != http.StatusConflict {
+		t.Fatalf("delete with only a disabled second admin: got %d, want 409", w.Code)
+	}
+
+	ts.do(http.MethodPatch, "/v1/admin/users/"+otherID, admin, `{"status":"active"}`)
+	if w := ts.do(http.MethodPatch, "/v1/admin/users/"+adminID, admin, `{"role":"user"}`); w.Code != http.StatusOK {
+		t.Fatalf("demote with another admin: %d %s", w.Code, w.Body)
+	}
+}
+
+// captureEmails queues email for the test instead of sending it
+func captureEmails(t *testing.T) chan queuedEmail {
+	t.Helper()
+	queue, ready := mailQueue, mailReady.Load()
+	captured := make(chan queuedEmail, 16)
+	mailQueue = captured
+	mailReady.Store(true)
+	t.Cleanup(func() {
+		mailQueue = queue
+		mailReady.Store(ready)
+	})
+	return captured
+}
+
+// invitationToken takes the token from the next invitation email
+func invitationToken(t *testing.T, emails chan queuedEmail) string {
+	t.Helper()
+	select {
+	case email := <-emails:
+		link, _ := email.data["Link"].(string)
+		_, token, found := strings.Cut(link, "token=")
+		if email.template != EmailInvitation || !found {
+			t.Fatalf("email: %+v", email)
+		}
+		return token
+	default:
+		t.Fatal("no invitation sent")
+		return ""
+	}
+}
+
+func TestAdminResendInvitation(t *testing.T) {
+	ts := newTestServer(t)
+	admin := ts.admin("admin@example.com")
+	emails := captureEmails(t)
+	useSharedStore(t)
+
+	w := ts.do(http.MethodPost, "/v1/admin/users", admin, `{"email":"invitee@example.com","name":"Invitee","invite":true}`)
+	var created CreateUserResponse
+	decodeJSON(t, w, &created)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("invite: %d %s", w.Code, w.Body)
+	}
+	first := invitationToken(t, emails)
+
+	w = ts.do(http.MethodPost, "/v1/admin/users/"+created.User.ID+"/invitation", admin, "")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "invitation_expires_at") {
+		t.Fatalf("resend: %d %s", w.Code, w.Body)
+	}
+	second := invitationToken(t, emails)
+
+	// The old link is void; the new one works on a replica that didn't
+	// send it
+	if w := ts.do(http.MethodPost, "/v1/auth/invitations/accept", "", `{"token":"`+first+`","password":"chosen-password"}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("accept the old link: got %d, want 400", w.Code)
+	}
+	localRecords = newMemoryRecords()
+	if w := ts.do(http.MethodPost, "/v1/auth/invitations/accept", "", `{"token":"`+second+`","password":"chosen-password"}`); w.Code != http.StatusOK {
+		t.Fatalf("accept the new link: %d %s", w.Code, w.Body)
+	}
+
+	if w := ts.do(http.MethodPost, "/v1/admin/users/"+created.User.ID+"/invitation", admin, ""); w.Code != http.StatusConflict {
+		t.Fatalf("resend after accepting: got %d, want 409", w.Code)
+	}
+	if w := ts.do(http.MethodPost, "/v1/admin/users/nope/invitation", admin, ""); w.Code != http.StatusNotFound {
+		t.Fatalf("resend to an unknown user: got %d, want 404", w.Code)
+	}
+}
@@ -0,0 +1,482 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"google.golang.org/grpc/metadata"
+)
+
+// ============================================================================
+// Login Anomaly Detection
+// ============================================================================
+//
+// Each successful login is recorded per user with a device fingerprint and,
+// when the edge proxy supplies them (anomaly.country_header and the
+// latitude/longitude headers, e.g. CloudFront-Viewer-Country), its location.
+// A login from a country the user has never logged in from, or one that
+// implies travelling faster than anomaly.max_travel_kmh since the last
+// located login, raises a security alert. Alerts show on the user's security
+// page and in the admin feed, and go to the SIEM.
+//
+// With anomaly.step_up the anomalous login is held instead of completed.
+// The service has no second factor yet, so the step-up is an admin review:
+// resolving the alert with trust=true records the login as known, and the
+// user's next attempt from there succeeds. Logins from a device the user
+// marked trusted are alerted on but never held.
+//
+// Login histories and alerts are kept in keyedRecords, so in cluster mode
+// every replica judges a login against the same history and a review on
+// one replica releases the login on all of them. Alerts are kept for
+// securityAlertRetention.
+
+const (
+	maxLoginHistory        = 50
+	securityAlertRetention = 90 * 24 * time.Hour
+
+	// Record kinds: a user's logins, oldest first, by user ID, and alerts
+	// by alert ID
+	loginHistoryRecord  = "login-history"
+	securityAlertRecord = "security-alert"
+
+	// Locations closer than this are treated as the same place; geo-IP
+	// data is too coarse for anything finer
+	minTravelDistanceKm = 100
+	earthRadiusKm       = 6371
+
+	anomalyNewCountry       = "new_country"
+	anomalyImpossibleTravel = "impossible_travel"
+	anomalyNewDevice        = "new_device"
+
+	EventLoginAnomaly = "auth.login.anomaly"
+)
+
+// errStepUpRequired is returned for logins held by an anomaly
+var errStepUpRequired = errors.New("Unusual sign-in held for verification; contact an administrator")
+
+// geoPoint is a login's coordinates
+type geoPoint struct {
+	Lat float64 `json:"lat"`
+	Lon float64 `json:"lon"`
+}
+
+// LoginRecord is one sign-in as shown on the security page
+type LoginRecord struct {
+	At        time.Time `json:"at"`
+	IP        string    `json:"ip,omitempty"`
+	UserAgent string    `json:"user_agent,omitempty"`
+	Device    string    `json:"device"` // fingerprint
+	Country   string    `json:"country,omitempty"`
+	Location  *geoPoint `json:"location,omitempty"`
+	Language  string    `json:"-"`                 // negotiated from Accept-Language, for alert emails
+	Trusted   bool      `json:"trusted,omitempty"` // from a device the user trusts, so never held (devices.go)
+}
+
+// SecurityAlert is an anomalous login
+type SecurityAlert struct {
+	ID         string      `json:"id"`
+	UserID     string      `json:"user_id"`
+	Email      string      `json:"email"`
+	At         time.Time   `json:"at"`
+	Reasons    []string    `json:"reasons"`
+	Login      LoginRecord `json:"login"`
+	Held       bool        `json:"held"` // the login was refused pending review
+	Resolved   bool        `json:"resolved"`
+	ResolvedBy string      `json:"resolved_by,omitempty"`
+	ResolvedAt *time.Time  `json:"resolved_at,omitempty"`
+}
+
+// loginHistoryLock serializes changes to one user's login history
+func loginHistoryLock(userID string) (func(), error) {
+	ctx, cancel := context.WithTimeout(context.Background(), config.Cluster.LockTTL)
+	defer cancel()
+	release, err := acquireLock(ctx, loginHistoryRecord+":"+userID, config.Cluster.LockTTL)
+	if err != nil {
+		slog.Error("Login history lock failed", "error", err)
+		return nil, errStoreUnavailable
+	}
+	return release, nil
+}
+
+// loginHistory returns a user's logins, oldest first
+func loginHistory(userID string) ([]LoginRecord, error) {
+	data, found, err := keyedRecords().record(context.Background(), loginHistoryRecord, userID)
+	if err != nil {
+		slog.Error("Record store read failed", "op", "login_history", "error", err)
+		return nil, errStoreUnavailable
+	}
+	var history []LoginRecord
+	if found {
+		if err := json.Unmarshal(data, &history); err != nil {
+			return nil, err
+		}
+	}
+	return history, nil
+}
+
+// saveLoginHistory replaces a user's logins, keeping the latest
+// maxLoginHistory; callers hold loginHistoryLock
+func saveLoginHistory(userID string, history []LoginRecord) error {
+	if len(history) > maxLoginHistory {
+		history = history[len(history)-maxLoginHistory:]
+	}
+	ctx := context.Background()
+	var err error
+	if len(history) == 0 {
+		err = keyedRecords().deleteRecord(ctx, loginHistoryRecord, userID)
+	} else {
+		var data []byte
+		if data, err = json.Marshal(history); err == nil {
+			err = keyedRecords().saveRecord(ctx, loginHistoryRecord, userID, data, 0)
+		}
+	}
+	if err != nil {
+		slog.Error("Record store write failed", "op", "login_history", "error", err)
+		return errStoreUnavailable
+	}
+	return nil
+}
+
+// recordLogin appends to a user's history
+func recordLogin(userID string, record LoginRecord) error {
+	release, err := loginHistoryLock(userID)
+	if err != nil {
+		return err
+	}
+	defer release()
+	history, err := loginHistory(userID)
+	if err != nil {
+		return err
+	}
+	return saveLoginHistory(userID, append(history, record))
+}
+
+// saveSecurityAlert stores an alert until securityAlertRetention after it
+// was raised
+func saveSecurityAlert(alert *SecurityAlert) error {
+	data, err := json.Marshal(alert)
+	if err == nil {
+		ttl := time.Until(alert.At.Add(securityAlertRetention))
+		err = keyedRecords().saveRecord(context.Background(), securityAlertRecord, alert.ID, data, ttl)
+	}
+	if err != nil {
+		slog.Error("Record store write failed", "op", "security_alert", "error", err)
+		return errStoreUnavailable
+	}
+	return nil
+}
+
+// securityAlerts returns the kept alerts, oldest first
+func securityAlerts() ([]*SecurityAlert, error) {
+	records, err := keyedRecords().records(context.Background(), securityAlertRecord)
+	if err != nil {
+		slog.Error("Record store read failed", "op", "security_alerts", "error", err)
+		return nil, errStoreUnavailable
+	}
+	alerts := make([]*SecurityAlert, 0, len(records))
+	for _, data := range records {
+		var alert SecurityAlert
+		if json.Unmarshal(data, &alert) == nil {
+			alerts = append(alerts, &alert)
+		}
+	}
+	sort.Slice(alerts, func(i, j int) bool { return alerts[i].At.Before(alerts[j].At) })
+	return alerts, nil
+}
+
+// httpLoginRecord describes a login from the request's headers
+func httpLoginRecord(c *gin.Context) LoginRecord {
+	return newLoginRecord(c.ClientIP(), c.Request.UserAgent(), c.GetHeader("Accept-Language"), c.GetHeader)
+}
+
+// grpcLoginRecord describes a login from the call's metadata
+func grpcLoginRecord(ctx context.Context) LoginRecord {
+	get := grpcHeader(ctx)
+	return newLoginRecord(grpcPeerIP(ctx), get("user-agent"), get("accept-language"), get)
+}
+
+// grpcHeader reads the call's metadata like an HTTP header
+func grpcHeader(ctx context.Context) func(string) string {
+	md, _ := metadata.FromIncomingContext(ctx)
+	return func(key string) string {
+		if values := md.Get(strings.ToLower(key)); len(values) > 0 {
+			return values[0]
+		}
+		return ""
+	}
+}
+
+func newLoginRecord(ip, userAgent, language string, header func(string) string) LoginRecord {
+	sum := sha256.Sum256([]byte(userAgent + "\x00" + language))
+	record := LoginRecord{
+		At:        time.Now().UTC(),
+		IP:        ip,
+		UserAgent: userAgent,
+		Device:    hex.EncodeToString(sum[:8]),
+		Language:  negotiateLanguage(language),
+	}
+
+	cfg := config.Anomaly
+	if cfg.CountryHeader != "" {
+		country := strings.ToUpper(strings.TrimSpace(header(cfg.CountryHeader)))
+		// Proxies use XX or T1 for unknown and Tor
+		if len(country) == 2 && country != "XX" && country != "T1" {
+			record.Country = country
+		}
+	}
+	if cfg.LatitudeHeader != "" && cfg.LongitudeHeader != "" {
+		lat, latErr := strconv.ParseFloat(header(cfg.LatitudeHeader), 64)
+		lon, lonErr := strconv.ParseFloat(header(cfg.LongitudeHeader), 64)
+		if latErr == nil && lonErr == nil && math.Abs(lat) <= 90 && math.Abs(lon) <= 180 {
+			record.Location = &geoPoint{Lat: lat, Lon: lon}
+		}
+	}
+	return record
+}
+
+// checkLogin compares a successful login with the user's history. It
+// records the login unless it is held, in which case it returns
+// errStepUpRequired.
+func checkLogin(user *User, record LoginRecord) error {
+	if !config.Anomaly.Enabled {
+		return nil
+	}
+
+	release, err := loginHistoryLock(user.ID)
+	if err != nil {
+		return err
+	}
+	history, err := loginHistory(user.ID)
+	if err != nil {
+		release()
+		return err
+	}
+	reasons := loginAnomalies(history, record)
+	var alert *SecurityAlert
+	if len(reasons) > 0 {
+		alert = &SecurityAlert{
+			ID:      uuid.New().String(),
+			UserID:  user.ID,
+			Email:   user.Email,
+			At:      record.At,
+			Reasons: reasons,
+			Login:   record,
+			Held:    config.Anomaly.StepUp && !record.Trusted,
+		}
+		err = saveSecurityAlert(alert)
+	}
+	if err == nil && (alert == nil || !alert.Held) {
+		err = saveLoginHistory(user.ID, append(history, record))
+	}
+	release()
+	if err != nil {
+		return err
+	}
+
+	if alert == nil {
+		return nil
+	}
+	event := newSecurityEvent(EventLoginAnomaly, "success")
+	event.Severity = "high"
+	event.UserID, event.Email = user.ID, user.Email
+	event.SourceIP, event.UserAgent = record.IP, record.UserAgent
+	event.Reason = strings.Join(reasons, ",")
+	event.Details = map[string]string{"alert_id": alert.ID, "country": record.Country, "held": strconv.FormatBool(alert.Held)}
+	emitSecurityEvent(event)
+
+	location := record.Country
+	if location == "" {
+		location = "unknown"
+	}
+	lock := userLock(user)
+	lock.RLock()
+	name := user.Name
+	lock.RUnlock()
+	queueEmail(user.Email, EmailLoginAlert, record.Language, map[string]any{
+		"Name":     name,
+		"Time":     record.At.Format(time.RFC1123),
+		"IP":       record.IP,
+		"Location": location,
+		"Device":   record.UserAgent,
+		"Held":     alert.Held,
+	})
+
+	if alert.Held {
+		return errStepUpRequired
+	}
+	return nil
+}
+
+// loginAnomalies lists what is unusual about a login. A user's first
+// login has nothing to compare with and is never anomalous.
+func loginAnomalies(history []LoginRecord, record LoginRecord) []string {
+	if len(history) == 0 {
+		return nil
+	}
+
+	var reasons []string
+	knownCountry, knownDevice, sawCountry := false, false, false
+	for _, past := range history {
+		if past.Country != "" {
+			sawCountry = true
+			knownCountry = knownCountry || past.Country == record.Country
+		}
+		knownDevice = knownDevice || past.Device == record.Device
+	}
+	if record.Country != "" && sawCountry && !knownCountry {
+		reasons = append(reasons, anomalyNewCountry)
+	}
+
+	if record.Location != nil {
+		for i := len(history) - 1; i >= 0; i-- {
+			past := history[i]
+			if past.Location == nil {
+				continue
+			}
+			distance := haversineKm(*past.Location, *record.Location)
+			hours := math.Max(record.At.Sub(past.At).Hours(), 1.0/60)
+			if distance > minTravelDistanceKm && distance/hours > float64(config.Anomaly.MaxTravelKmh) {
+				reasons = append(reasons, anomalyImpossibleTravel)
+			}
+			break
+		}
+	}
+
+	if !knownDevice && config.Anomaly.AlertNewDevice {
+		reasons = append(reasons, anomalyNewDevice)
+	}
+	return reasons
+}
+
+// haversineKm is the great-circle distance between two points
+func haversineKm(a, b geoPoint) float64 {
+	toRad := func(deg float64) float64 { return deg * math.Pi / 180 }
+	dLat, dLon := toRad(b.Lat-a.Lat), toRad(b.Lon-a.Lon)
+	h := math.Pow(math.Sin(dLat/2), 2) + math.Cos(toRad(a.Lat))*math.Cos(toRad(b.Lat))*math.Pow(math.Sin(dLon/2), 2)
+	return 2 * earthRadiusKm * math.Asin(math.Sqrt(h))
+}
+
+// alertsFor returns alerts newest first, optionally for one user
+func alertsFor(userID string, unresolvedOnly bool, limit int) ([]SecurityAlert, error) {
+	all, err := securityAlerts()
+	if err != nil {
+		return nil, err
+	}
+	alerts := make([]SecurityAlert, 0)
+	for i := len(all) - 1; i >= 0 && len(alerts) < limit; i-- {
+		alert := all[i]
+		if (userID != "" && alert.UserID != userID) || (unresolvedOnly && alert.Resolved) {
+			continue
+		}
+		alerts = append(alerts, *alert)
+	}
+	return alerts, nil
+}
+
+// getMySecurity returns the current user's recent logins and alerts
+func getMySecurity(c *gin.Context) {
+	user, _ := c.Get("user")
+	currentUser := user.(*User)
+
+	history, err := loginHistory(currentUser.ID)
+	if err != nil {
+		respondServiceError(c, err)
+		return
+	}
+	logins := make([]LoginRecord, 0, len(history))
+	for i := len(history) - 1; i >= 0; i-- {
+		logins = append(logins, history[i])
+	}
+	alerts, err := alertsFor(currentUser.ID, false, maxLoginHistory)
+	if err != nil {
+		respondServiceError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"recent_logins": logins,
+		"alerts":        alerts,
+	})
+}
+
+// listSecurityAlerts is the admin alert feed (?user_id=, ?unresolved=true,
+// ?limit=)
+func listSecurityAlerts(c *gin.Context) {
+	limit := defaultAuditPageSize
+	if raw := c.Query("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 || n > maxAuditPageSize {
+			respondError(c, http.StatusBadRequest, codeInvalidRequest, "limit must be between 1 and "+strconv.Itoa(maxAuditPageSize))
+			return
+		}
+		limit = n
+	}
+	alerts, err := alertsFor(c.Query("user_id"), c.Query("unresolved") == "true", limit)
+	if err != nil {
+		respondServiceError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"alerts": alerts, "count": len(alerts)})
+}
+
+// ResolveAlertRequest closes an alert; Trust also records a held login as
+// known so the user can sign in from there
+type ResolveAlertRequest struct {
+	Trust bool `json:"trust"`
+}
+
+// resolveSecurityAlert marks an alert reviewed (admin only)
+func resolveSecurityAlert(c *gin.Context) {
+	var req ResolveAlertRequest
+	if err := c.ShouldBindJSON(&req); err != nil && err != io.EOF {
+		respondBindError(c, err)
+		return
+	}
+	user, _ := c.Get("user")
+	admin := user.(*User)
+
+	data, found, err := keyedRecords().record(c.Request.Context(), securityAlertRecord, c.Param("id"))
+	var alert SecurityAlert
+	if err == nil && found {
+		err = json.Unmarshal(data, &alert)
+	}
+	if err != nil {
+		slog.Error("Record store read failed", "op", "security_alert", "error", err)
+		respondServiceError(c, errStoreUnavailable)
+		return
+	}
+	if !found {
+		respondError(c, http.StatusNotFound, codeNotFound, "Alert not found")
+		return
+	}
+	before := alert
+	now := time.Now().UTC()
+	alert.Resolved, alert.ResolvedBy, alert.ResolvedAt = true, admin.ID, &now
+	if err := saveSecurityAlert(&alert); err != nil {
+		respondServiceError(c, err)
+		return
+	}
+	if req.Trust && alert.Held && !before.Resolved {
+		if err := recordLogin(alert.UserID, alert.Login); err != nil {
+			respondServiceError(c, err)
+			return
+		}
+	}
+	after := alert
+
+	auditChange(c, "security.alert.resolve", "alert:"+after.ID, before, after)
+	c.JSON(http.StatusOK, after)
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestHeldSignInAcrossReplicas(t *testing.T) {
+	ts := newTestServer(t)
+	withConfig(t, func(cfg *Config) {
+		cfg.Anomaly.Enabled, cfg.Anomaly.StepUp = true, true
+		cfg.Anomaly.CountryHeader = "CloudFront-Viewer-Country"
+	})
+	admin := ts.admin("admin@example.com")
+	mr := useSharedStore(t)
+	ts.register("a@example.com")
+	if status, _ := ts.loginFrom("a@example.com", chromeOnMac, "CloudFront-Viewer-Country", "US"); status != http.StatusOK {
+		t.Fatalf("first sign-in: got %d", status)
+	}
+	if status, _ := ts.loginFrom("a@example.com", chromeOnMac, "CloudFront-Viewer-Country", "FR"); status != http.StatusForbidden {
+		t.Fatalf("held sign-in: got %d, want 403", status)
+	}
+	var histories, alerts int
+	for _, key := range mr.Keys() {
+		switch {
+		case strings.HasPrefix(key, recordKey(loginHistoryRecord, "")):
+			histories++
+		case strings.HasPrefix(key, recordKey(securityAlertRecord, "")):
+			alerts++
+		}
+	}
+	if histories != 1 || alerts != 1 {
+		t.Fatalf("shared store holds %d histories and %d alerts, want 1 and 1", histories, alerts)
+	}
+
+	// A replica with nothing of its own sees the alert and releases the
+	// sign-in for every replica
+	localRecords = newMemoryRecords()
+	w := ts.do(http.MethodGet, "/v1/admin/security-alerts", admin, "")
+	var list struct {
+		Alerts []SecurityAlert `json:"alerts"`
+	}
+	decodeJSON(t, w, &list)
+	if w.Code != http.StatusOK || len(list.Alerts) != 1 || !list.Alerts[0].Held || list.Alerts[0].Login.Country != "FR" {
+		t.Fatalf("alerts: %d %s", w.Code, w.Body)
+	}
+	if w := ts.do(http.MethodPost, "/v1/admin/security-alerts/"+list.Alerts[0].ID+"/resolve", admin, `{"trust":true}`); w.Code != http.StatusOK {
+		t.Fatalf("resolve: %d %s", w.Code, w.Body)
+	}
+	if status, _ := ts.loginFrom("a@example.com", chromeOnMac, "CloudFront-Viewer-Country", "FR"); status != http.StatusOK {
+		t.Fatalf("sign-in after trusting: got %d, want 200", status)
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ============================================================================
+// Signup Approval
+// ============================================================================
+//
+// In approval mode (registration.go) self-registered accounts start
+// "pending": they get no token and can't log in until an admin approves
+// them under /admin/approvals. Admins are notified of each new signup.
+// Approval activates the account; denial deletes it, freeing the email.
+// Either way the applicant is emailed, and the decision is audited.
+
+// NotificationSignupPending tells admins a registration awaits approval
+const NotificationSignupPending = "signup.pending"
+
+var errNotPending = errors.New("User is not awaiting approval")
+
+// ApprovalDecisionRequest for POST /admin/approvals
+type ApprovalDecisionRequest struct {
+	UserID   string `json:"user_id" binding:"required"`
+	Decision string `json:"decision" binding:"required,oneof=approve deny"`
+	Reason   string `json:"reason" binding:"max=500"` // included in the denial email
+}
+
+// notifySignupPending tells every active admin about a pending registration
+func (s *Service) notifySignupPending(user *User) {
+	var admins []string
+	s.users.Each(func(u *User) {
+		if u.Role == "admin" && accountStatus(u) == UserActive {
+			admins = append(admins, u.ID)
+		}
+	})
+	for _, id := range admins {
+		notify(id, NotificationSignupPending, "Registration awaiting approval",
+			user.Name+" <"+user.Email+"> registered and is waiting for approval.",
+			map[string]string{"user_id": user.ID})
+	}
+}
+
+// DecideSignup approves or denies a pending registration. A denied
+// account is deleted.
+func (s *Service) DecideSignup(user *User, approve bool) error {
+	s.adminMu.Lock()
+	defer s.adminMu.Unlock()
+
+	lock := s.users.FieldLock(user)
+	lock.Lock()
+	if accountStatus(user) != UserPending {
+		lock.Unlock()
+		return errNotPending
+	}
+	if !approve {
+		lock.Unlock()
+		return s.deleteUser(user)
+	}
+	previous := *user
+	user.Status, user.UpdatedAt = UserActive, time.Now()
+	err := saveUser(user)
+	if err != nil {
+		*user = previous
+	}
+	lock.Unlock()
+	if err != nil {
+		return err
+	}
+	bumpUserVersion()
+	return nil
+}
+
+// listApprovals returns pending registrations, oldest first
+func (s *Server) listApprovals(c *gin.Context) {
+	pending := []UserProfile{}
+	s.svc.users.Each(func(user *User) {
+		if accountStatus(user) == UserPending {
+			pending = append(pending, toProfile(user))
+		}
+	})
+	sort.Slice(pending, func(i, j int) bool { return pending[i].CreatedAt.Before(pending[j].CreatedAt) })
+
+	c.JSON(http.StatusOK, gin.H{"approvals": pending, "count": len(pending)})
+}
+
+// decideApproval approves or denies a pending registration and emails the
+// applicant
+func (s *Server) decideApproval(c *gin.Context) {
+	var req ApprovalDecisionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondBindError(c, err)
+		return
+	}
+	user := s.svc.users.ByID(req.UserID)
+	if user == nil {
+		respondError(c, http.StatusNotFound, codeNotFound, "User not found")
+		return
+	}
+
+	before := s.profileOf(user)
+	approve := req.Decision == "approve"
+	if err := s.svc.DecideSignup(user, approve); err != nil {
+		if err == errNotPending {
+			respondError(c, http.StatusConflict, codeConflict, err.Error())
+			return
+		}
+		respondAdminUserError(c, err)
+		return
+	}
+
+	lang := config.I18n.DefaultLanguage
+	if approve {
+		queueEmail(before.Email, EmailSignupApproved, lang, map[string]any{"Name": before.Name})
+		after := s.profileOf(user)
+		auditChange(c, "admin.approval.approve", "user:"+user.ID, before, after)
+		c.JSON(http.StatusOK, gin.H{"message": "Registration approved", "user": after})
+		return
+	}
+
+	queueEmail(before.Email, EmailSignupDenied, lang, map[string]any{"Name": before.Name, "Reason": req.Reason})
+	notificationMutex.Lock()
+	delete(notifications, user.ID)
+	notificationMutex.Unlock()
+	auditChange(c, "admin.approval.deny", "user:"+user.ID, before, nil)
+	c.JSON(http.StatusOK, gin.H{"message": "Registration denied"})
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// registerPending signs up in approval mode and returns the pending ID
+func (ts *testServer) registerPending(email string) string {
+	ts.t.Helper()
+	w := ts.do(http.MethodPost, "/v1/auth/register", "",
+		`{"email":"`+email+`","password":"secret123","name":"Test User"}`)
+	if w.Code != http.StatusAccepted {
+		ts.t.Fatalf("register %s: got %d, want 202: %s", email, w.Code, w.Body)
+	}
+	var resp AuthResponse
+	decodeJSON(ts.t, w, &resp)
+	if resp.Token != "" || resp.User.Status != UserPending {
+		ts.t.Fatalf("pending registration = %+v", resp)
+	}
+	return resp.User.ID
+}
+
+func TestSignupApproval(t *testing.T) {
+	resetNotifications(t)
+	ts := newTestServer(t)
+	admin := ts.admin("admin@example.com")
+	user, _ := ts.register("user@example.com")
+	withConfig(t, func(cfg *Config) { cfg.Registration.Mode = registrationApproval })
+
+	id := ts.registerPending("new@example.com")
+	w := ts.do(http.MethodPost, "/v1/auth/login", "", `{"email":"new@example.com","password":"secret123"}`)
+	if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), codeApprovalPending) {
+		t.Fatalf("pending login: %d %s", w.Code, w.Body)
+	}
+	ts.login("new@example.com", "wrong-password", http.StatusUnauthorized)
+
+	adminID := ts.srv.svc.users.ByEmail("admin@example.com").ID
+	notificationMutex.Lock()
+	inbox := notifications[adminID]
+	notificationMutex.Unlock()
+	if len(inbox) != 1 || inbox[0].Kind != NotificationSignupPending || inbox[0].Data["user_id"] != id {
+		t.Fatalf("admin inbox = %+v", inbox)
+	}
+
+	if w := ts.do(http.MethodGet, "/v1/admin/approvals", user, ""); w.Code != http.StatusForbidden {
+		t.Fatalf("list as user: got %d, want 403", w.Code)
+	}
+	w = ts.do(http.MethodGet, "/v1/admin/approvals", admin, "")
+	var list struct {
+		Approvals []UserProfile `json:"approvals"`
+		Count     int           `json:"count"`
+	}
+	decodeJSON(t, w, &list)
+	if list.Count != 1 || list.Approvals[0].ID != id {
+		t.Fatalf("approvals = %+v", list)
+	}
+
+	if w := ts.do(http.MethodPost, "/v1/admin/approvals", admin, `{"user_id":"`+id+`","decision":"approve"}`); w.Code != http.StatusOK {
+		t.Fatalf("approve: %d %s", w.Code, w.Body)
+	}
+	ts.login("new@example.com", "secret123", http.StatusOK)
+	if w := ts.do(http.MethodPost, "/v1/admin/approvals", admin, `{"user_id":"`+id+`","decision":"deny"}`); w.Code != http.StatusConflict {
+		t.Fatalf("decide twice: got %d, want 409", w.Code)
+	}
+	decodeJSON(t, ts.do(http.MethodGet, "/v1/admin/approvals", admin, ""), &list)
+	if list.Count != 0 {
+		t.Fatalf("approved user still listed: %+v", list)
+	}
+}
+
+func TestSignupDenial(t *testing.T) {
+	ts := newTestServer(t)
+	admin := ts.admin("admin@example.com")
+	withConfig(t, func(cfg *Config) { cfg.Registration.Mode = registrationApproval })
+
+	id := ts.registerPending("new@example.com")
+	if w := ts.do(http.MethodPost, "/v1/admin/approvals", admin, `{"user_id":"`+id+`","decision":"maybe"}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("unknown decision: got %d, want 400", w.Code)
+	}
+	w := ts.do(http.MethodPost, "/v1/admin/approvals", admin, `{"user_id":"`+id+`","decision":"deny","reason":"Unknown organization"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("deny: %d %s", w.Code, w.Body)
+	}
+	if ts.srv.svc.users.ByID(id) != nil || ts.srv.svc.users.ByEmail("new@example.com") != nil {
+		t.Fatal("denied user still stored")
+	}
+	if w := ts.do(http.MethodPost, "/v1/admin/approvals", admin, `{"user_id":"`+id+`","decision":"approve"}`); w.Code != http.StatusNotFound {
+		t.Fatalf("decide on a deleted user: got %d, want 404", w.Code)
+	}
+	// The email can be used again
+	ts.registerPending("new@example.com")
+}
@@ -0,0 +1,632 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// ============================================================================
+// Audit Log
+// ============================================================================
+//
+// Every state-changing request is appended to the audit log, which is kept
+// in memory for queries and written through to audit.file (JSON lines) so
+// it survives restarts. The auditTrail middleware records mutating requests
+// automatically; handlers call auditChange to name the action and attach
+// before/after state. Entries are hash-chained so edits are detectable:
+// the chain is checked at startup and on demand via /admin/audit/verify,
+// and only retention removes entries. Each instance keeps its own file,
+// except with cluster.mode mongo, where the chain lives in the shared store
+// (cluster_mongo.go) and every replica appends to and reads the same log.
+
+const (
+	auditContextKey      = "audit"
+	auditSweepInterval   = time.Hour
+	auditStoreTimeout    = 5 * time.Second
+	defaultAuditPageSize = 100
+	maxAuditPageSize     = 1000
+)
+
+// AuditEntry is one recorded action
+type AuditEntry struct {
+	Seq        uint64          `json:"seq"`
+	ID         string          `json:"id"`
+	Timestamp  time.Time       `json:"timestamp"`
+	ActorID    string          `json:"actor_id,omitempty"`
+	ActorEmail string          `json:"actor_email,omitempty"`
+	Action     string          `json:"action"`
+	Resource   string          `json:"resource,omitempty"`
+	Status     int             `json:"status,omitempty"`
+	SourceIP   string          `json:"source_ip,omitempty"`
+	UserAgent  string          `json:"user_agent,omitempty"`
+	RequestID  string          `json:"request_id,omitempty"`
+	Transport  string          `json:"transport"`
+	Before     json.RawMessage `json:"before,omitempty"`
+	After      json.RawMessage `json:"after,omitempty"`
+	PrevHash   string          `json:"prev_hash"`
+	Hash       string          `json:"hash"`
+}
+
+// auditChainStore is a shared store that keeps the audit chain itself.
+// appendAudit assigns the entry's sequence number and links and seals it
+// against the newest entry, whichever replica wrote that.
+type auditChainStore interface {
+	appendAudit(ctx context.Context, entry AuditEntry) (AuditEntry, error)
+	auditEntries(ctx context.Context) ([]AuditEntry, error) // oldest first
+	pruneAudit(ctx context.Context, before time.Time) (int, error)
+}
+
+// sharedAuditChain is the store holding the audit chain, or nil when each
+// instance keeps its own
+func sharedAuditChain() auditChainStore {
+	chain, _ := clusterStore.(auditChainStore)
+	return chain
+}
+
+// auditNote is what a handler attaches to its request
+type auditNote struct {
+	action   string
+	resource string
+	actor    *User
+	before   interface{}
+	after    interface{}
+}
+
+var (
+	auditLog   []AuditEntry
+	auditSeq   uint64
+	auditFile  *os.File
+	auditMutex sync.RWMutex
+
+	// Mutating routes that don't change state (reads over POST, sessions)
+	auditSkipRoutes = map[string]bool{
+		"POST /auth/login":             true,
+		"POST /auth/logout":            true,
+		"POST /query/stream":           true,
+		"POST /internal/access/filter": true,
+		"POST /admin/graphql":          true, // mutations call auditChange
+		"POST /batch":                  true, // sub-requests are recorded individually
+	}
+)
+
+// auditChange names the action a handler performed and records the state
+// before and after it. Either state may be nil.
+func auditChange(c *gin.Context, action, resource string, before, after interface{}) {
+	note := auditNoteFor(c)
+	note.action, note.resource = action, resource
+	note.before, note.after = before, after
+}
+
+// auditActor sets the actor for requests that aren't authenticated yet
+// (e.g. registration)
+func auditActor(c *gin.Context, user *User) {
+	auditNoteFor(c).actor = user
+}
+
+func auditNoteFor(c *gin.Context) *auditNote {
+	if note, exists := c.Get(auditContextKey); exists {
+		return note.(*auditNote)
+	}
+	note := &auditNote{}
+	c.Set(auditContextKey, note)
+	return note
+}
+
+// auditTrail records mutating requests, and any request whose handler
+// called auditChange, after the handler runs
+func auditTrail() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Next()
+
+		_, route := splitAPIVersion(c.FullPath())
+		routeKey := c.Request.Method + " " + route
+
+		raw, annotated := c.Get(auditContextKey)
+		mutating := c.Request.Method != http.MethodGet && c.Request.Method != http.MethodHead &&
+			c.Request.Method != http.MethodOptions
+		if !annotated && (!mutating || route == "" || auditSkipRoutes[routeKey]) {
+			return
+		}
+
+		note := &auditNote{}
+		if annotated {
+			note = raw.(*auditNote)
+		}
+		entry := AuditEntry{
+			Action:    note.action,
+			Resource:  note.resource,
+			Status:    c.Writer.Status(),
+			SourceIP:  c.ClientIP(),
+			UserAgent: c.Request.UserAgent(),
+			RequestID: c.GetString(requestIDContextKey),
+			Transport: "http",
+			Before:    auditJSON(note.before),
+			After:     auditJSON(note.after),
+		}
+		if entry.Action == "" {
+			entry.Action = routeKey
+		}
+		if entry.Resource == "" {
+			var params []string
+			for _, p := range c.Params {
+				params = append(params, p.Key+"="+p.Value)
+			}
+			entry.Resource = strings.Join(params, ",")
+		}
+
+		actor := note.actor
+		if user, exists := c.Get("user"); exists && actor == nil {
+			actor = user.(*User)
+		}
+		if actor != nil {
+			entry.ActorID, entry.ActorEmail = actor.ID, actor.Email
+		}
+
+		appendAudit(entry)
+	}
+}
+
+// auditJSON encodes before/after state, dropping values that can't be encoded
+func auditJSON(v interface{}) json.RawMessage {
+	if v == nil {
+		return nil
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil
+	}
+	return data
+}
+
+// appendAudit assigns an entry its sequence number and chain hash and
+// appends it. Non-HTTP callers (gRPC, background jobs) use it directly.
+func appendAudit(entry AuditEntry) {
+	auditMutex.Lock()
+	defer auditMutex.Unlock()
+
+	entry.ID = uuid.New().String()
+	entry.Timestamp = time.Now().UTC()
+	if chain := sharedAuditChain(); chain != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), auditStoreTimeout)
+		defer cancel()
+		if _, err := chain.appendAudit(ctx, entry); err != nil {
+			slog.Error("Audit log write failed", "store", config.Cluster.Mode, "action", entry.Action, "error", err)
+		}
+		return
+	}
+
+	auditSeq++
+	entry.Seq = auditSeq
+	if len(auditLog) > 0 {
+		entry.PrevHash = auditLog[len(auditLog)-1].Hash
+	}
+	entry.Hash = auditHash(entry)
+
+	auditLog = append(auditLog, entry)
+	if auditFile != nil {
+		line, _ := json.Marshal(entry)
+		if _, err := auditFile.Write(append(line, '\n')); err != nil {
+			slog.Error("Audit log write failed", "seq", entry.Seq, "error", err)
+		}
+	}
+}
+
+// openAuditLog loads the entries persisted in audit.file, checks their
+// chain and keeps the file open for appending. When the shared store keeps
+// the chain it checks that instead.
+func openAuditLog() error {
+	if chain := sharedAuditChain(); chain != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), auditStoreTimeout)
+		defer cancel()
+		entries, err := chain.auditEntries(ctx)
+		if err != nil {
+			return fmt.Errorf("read shared audit log: %w", err)
+		}
+		if result := verifyAuditChain(entries); !result.Valid {
+			slog.Error("Audit log chain is broken", "store", config.Cluster.Mode, "seq", result.BrokenAtSeq, "reason", result.Reason)
+		}
+		slog.Info("Audit log loaded", "store", config.Cluster.Mode, "entries", len(entries))
+		return nil
+	}
+
+	path := config.Audit.File
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+
+	var loaded []AuditEntry
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64<<10), 16<<20)
+	for line := 1; scanner.Scan(); line++ {
+		var entry AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			// A torn final write, or tampering; verification reports the gap
+			slog.Warn("Skipping unreadable audit entry", "file", path, "line", line, "error", err)
+			continue
+		}
+		loaded = append(loaded, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		file.Close()
+		return fmt.Errorf("read %s: %w", path, err)
+	}
+
+	auditMutex.Lock()
+	defer auditMutex.Unlock()
+	auditLog, auditFile = loaded, file
+	if len(loaded) > 0 {
+		auditSeq = loaded[len(loaded)-1].Seq
+	}
+	if result := verifyAuditChain(loaded); !result.Valid {
+		slog.Error("Audit log chain is broken", "file", path, "seq", result.BrokenAtSeq, "reason", result.Reason)
+	}
+	slog.Info("Audit log loaded", "file", path, "entries", len(loaded))
+	return nil
+}
+
+// rewriteAuditFile replaces audit.file with the entries still held, after
+// retention; callers hold auditMutex
+func rewriteAuditFile() error {
+	if auditFile == nil {
+		return nil
+	}
+	path := config.Audit.File
+	tmp, err := os.OpenFile(path+".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(tmp)
+	for _, entry := range auditLog {
+		line, _ := json.Marshal(entry)
+		writer.Write(append(line, '\n'))
+	}
+	if err := writer.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	auditFile.Close()
+	auditFile = file
+	return nil
+}
+
+// AuditVerification is the result of checking the hash chain
+type AuditVerification struct {
+	Valid       bool      `json:"valid"`
+	Entries     int       `json:"entries"`
+	FirstSeq    uint64    `json:"first_seq,omitempty"`
+	LastSeq     uint64    `json:"last_seq,omitempty"`
+	BrokenAtSeq uint64    `json:"broken_at_seq,omitempty"`
+	Reason      string    `json:"reason,omitempty"`
+	CheckedAt   time.Time `json:"checked_at"`
+}
+
+// verifyAuditChain recomputes every hash and checks that each entry links
+// to the one before it. The first entry's prev_hash is not checked, since
+// retention may have removed its predecessor.
+func verifyAuditChain(entries []AuditEntry) AuditVerification {
+	result := AuditVerification{Valid: true, Entries: len(entries), CheckedAt: time.Now().UTC()}
+	if len(entries) == 0 {
+		return result
+	}
+	result.FirstSeq, result.LastSeq = entries[0].Seq, entries[len(entries)-1].Seq
+
+	for i, entry := range entries {
+		reason := ""
+		switch {
+		case auditHash(entry) != entry.Hash:
+			reason = "entry content does not match its hash"
+		case i > 0 && entry.Seq != entries[i-1].Seq+1:
+			reason = fmt.Sprintf("sequence jumps from %d", entries[i-1].Seq)
+		case i > 0 && entry.PrevHash != entries[i-1].Hash:
+			reason = "prev_hash does not match the previous entry"
+		}
+		if reason != "" {
+			result.Valid, result.BrokenAtSeq, result.Reason = false, entry.Seq, reason
+			return result
+		}
+	}
+	return result
+}
+
+// verifyAudit checks the hash chain of the log held by this instance, or
+// the shared one (admin only)
+func verifyAudit(c *gin.Context) {
+	entries, err := readAuditLog(c.Request.Context())
+	if err != nil {
+		respondServiceError(c, err)
+		return
+	}
+	result := verifyAuditChain(entries)
+
+	if !result.Valid {
+		slog.Error("Audit log chain is broken", "seq", result.BrokenAtSeq, "reason", result.Reason)
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+// auditHash hashes an entry's content together with the previous hash
+func auditHash(entry AuditEntry) string {
+	entry.Hash = ""
+	data, _ := json.Marshal(entry)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// startAuditRetention prunes entries older than the retention period
+func startAuditRetention() {
+	retention := config.Audit.Retention
+	if retention == 0 {
+		return
+	}
+
+	goBackground(func(ctx context.Context) {
+		ticker := time.NewTicker(auditSweepInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			// Replicas sharing a volume may point at the same file
+			release, err := tryLock("audit-retention:"+auditLockName(), config.Cluster.LockTTL)
+			if err != nil {
+				if err != errLockHeld {
+					slog.Warn("Audit retention skipped", "error", err)
+				}
+				continue
+			}
+
+			cutoff := time.Now().Add(-retention)
+
+			if chain := sharedAuditChain(); chain != nil {
+				pruneCtx, cancel := context.WithTimeout(ctx, auditStoreTimeout)
+				expired, err := chain.pruneAudit(pruneCtx, cutoff)
+				cancel()
+				release()
+				if err != nil {
+					slog.Error("Audit retention failed", "store", config.Cluster.Mode, "error", err)
+				} else if expired > 0 {
+					slog.Info("Audit retention removed entries", "count", expired)
+				}
+				continue
+			}
+
+			auditMutex.Lock()
+			expired := 0
+			for expired < len(auditLog) && auditLog[expired].Timestamp.Before(cutoff) {
+				expired++
+			}
+			if expired > 0 {
+				auditLog = append([]AuditEntry(nil), auditLog[expired:]...)
+				if err := rewriteAuditFile(); err != nil {
+					slog.Error("Audit log rewrite failed", "file", config.Audit.File, "error", err)
+				}
+			}
+			auditMutex.Unlock()
+			release()
+
+			if expired > 0 {
+				slog.Info("Audit retention removed entries", "count", expired)
+			}
+		}
+	})
+}
+
+// auditLockName identifies the audit file across processes, or the
+// shared chain
+func auditLockName() string {
+	if sharedAuditChain() != nil {
+		return "shared"
+	}
+	if path, err := filepath.Abs(config.Audit.File); err == nil {
+		return path
+	}
+	return config.Audit.File
+}
+
+// auditFilter selects entries from query parameters
+type auditFilter struct {
+	actor    string
+	action   string
+	resource string
+	since    time.Time
+	until    time.Time
+}
+
+func parseAuditFilter(c *gin.Context) (auditFilter, bool) {
+	filter := auditFilter{
+		actor:    c.Query("actor"),
+		action:   c.Query("action"),
+		resource: c.Query("resource"),
+	}
+	for name, target := range map[string]*time.Time{"since": &filter.since, "until": &filter.until} {
+		if raw := c.Query(name); raw != "" {
+			parsed, err := time.Parse(time.RFC3339, raw)
+			if err != nil {
+				respondError(c, http.StatusBadRequest, codeInvalidRequest, name+" must be an RFC 3339 timestamp")
+				return filter, false
+			}
+			*target = parsed
+		}
+	}
+	return filter, true
+}
+
+// matches reports whether an entry passes the filter. Actions match by
+// prefix, so "POST /documents" or "document." select a family.
+func (f auditFilter) matches(entry AuditEntry) bool {
+	if f.actor != "" && entry.ActorID != f.actor && !strings.EqualFold(entry.ActorEmail, f.actor) {
+		return false
+	}
+	if f.action != "" && !strings.HasPrefix(entry.Action, f.action) {
+		return false
+	}
+	if f.resource != "" && !strings.Contains(entry.Resource, f.resource) {
+		return false
+	}
+	if !f.since.IsZero() && entry.Timestamp.Before(f.since) {
+		return false
+	}
+	if !f.until.IsZero() && !entry.Timestamp.Before(f.until) {
+		return false
+	}
+	return true
+}
+
+// readAuditLog returns the whole log, oldest first
+func readAuditLog(ctx context.Context) ([]AuditEntry, error) {
+	if chain := sharedAuditChain(); chain != nil {
+		entries, err := chain.auditEntries(ctx)
+		if err != nil {
+			slog.Error("Shared audit log read failed", "error", err)
+			return nil, errStoreUnavailable
+		}
+		return entries, nil
+	}
+
+	auditMutex.RLock()
+	defer auditMutex.RUnlock()
+	return append([]AuditEntry(nil), auditLog...), nil
+}
+
+// selectAudit returns matching entries, newest first
+func selectAudit(ctx context.Context, filter auditFilter) ([]AuditEntry, error) {
+	entries, err := readAuditLog(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var matched []AuditEntry
+	for i := len(entries) - 1; i >= 0; i-- {
+		if filter.matches(entries[i]) {
+			matched = append(matched, entries[i])
+		}
+	}
+	return matched, nil
+}
+
+// listAudit returns a page of matching audit entries (admin only)
+func listAudit(c *gin.Context) {
+	filter, ok := parseAuditFilter(c)
+	if !ok {
+		return
+	}
+
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(defaultAuditPageSize)))
+	if err != nil || limit < 1 || limit > maxAuditPageSize {
+		respondError(c, http.StatusBadRequest, codeInvalidRequest, "limit must be between 1 and 1000")
+		return
+	}
+	offset, err := strconv.Atoi(c.DefaultQuery("offset", "0"))
+	if err != nil || offset < 0 {
+		respondError(c, http.StatusBadRequest, codeInvalidRequest, "offset must be a non-negative integer")
+		return
+	}
+
+	matched, err := selectAudit(c.Request.Context(), filter)
+	if err != nil {
+		respondServiceError(c, err)
+		return
+	}
+	page := []AuditEntry{}
+	if offset < len(matched) {
+		end := offset + limit
+		if end > len(matched) {
+			end = len(matched)
+		}
+		page = matched[offset:end]
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"entries": page,
+		"total":   len(matched),
+		"limit":   limit,
+		"offset":  offset,
+	})
+}
+
+// exportAudit downloads all matching entries as JSON or CSV (admin only)
+func exportAudit(c *gin.Context) {
+	filter, ok := parseAuditFilter(c)
+	if !ok {
+		return
+	}
+	matched, err := selectAudit(c.Request.Context(), filter)
+	if err != nil {
+		respondServiceError(c, err)
+		return
+	}
+	stamp := time.Now().UTC().Format("20060102T150405Z")
+
+	switch c.DefaultQuery("format", "json") {
+	case "json":
+		c.Header("Content-Disposition", `attachment; filename="audit-`+stamp+`.json"`)
+		c.JSON(http.StatusOK, matched)
+	case "csv":
+		c.Header("Content-Disposition", `attachment; filename="audit-`+stamp+`.csv"`)
+		c.Header("Content-Type", "text/csv; charset=utf-8")
+		c.Status(http.StatusOK)
+
+		w := csv.NewWriter(c.Writer)
+		w.Write(auditCSVHeader)
+		for _, e := range matched {
+			w.Write(auditCSVRow(e))
+		}
+		w.Flush()
+	default:
+		respondError(c, http.StatusBadRequest, codeInvalidRequest, "format must be json or csv")
+	}
+}
+
+var auditCSVHeader = []string{"seq", "id", "timestamp", "actor_id", "actor_email", "action", "resource",
+	"status", "source_ip", "user_agent", "request_id", "transport", "before", "after", "prev_hash", "hash"}
+
+// auditCSVRow is an entry as a CSV row under auditCSVHeader
+func auditCSVRow(e AuditEntry) []string {
+	row := []string{
+		strconv.FormatUint(e.Seq, 10), e.ID, e.Timestamp.Format(time.RFC3339Nano), e.ActorID, e.ActorEmail,
+		e.Action, e.Resource, strconv.Itoa(e.Status), e.SourceIP, e.UserAgent, e.RequestID, e.Transport,
+		string(e.Before), string(e.After), e.PrevHash, e.Hash,
+	}
+	for i := range row {
+		row[i] = csvSafe(row[i])
+	}
+	return row
+}
+
+// csvSafe stops spreadsheets from evaluating a cell as a formula
+func csvSafe(value string) string {
+	if value != "" && strings.ContainsRune("=+-@\t\r", rune(value[0])) {
+		return "'" + value
+	}
+	return value
+}
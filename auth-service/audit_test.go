@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// useAuditLog gives the test an empty audit log written to a file of its own
+func useAuditLog(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	withConfig(t, func(cfg *Config) { cfg.Audit.File = path })
+	reset := func() {
+		auditMutex.Lock()
+		if auditFile != nil {
+			auditFile.Close()
+		}
+		auditLog, auditSeq, auditFile = nil, 0, nil
+		auditMutex.Unlock()
+	}
+	reset()
+	t.Cleanup(reset)
+	if err := openAuditLog(); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// auditEntries copies the entries held
+func auditEntries() []AuditEntry {
+	auditMutex.RLock()
+	defer auditMutex.RUnlock()
+	return append([]AuditEntry(nil), auditLog...)
+}
+
+func TestAuditChain(t *testing.T) {
+	useAuditLog(t)
+	ts := newTestServer(t)
+	admin := ts.admin("admin@example.com")
+	user, _ := ts.register("user@example.com")
+	ts.do(http.MethodPost, "/v1/documents/register", user, `{"filename":"handbook.pdf"}`)
+	ts.do(http.MethodDelete, "/v1/documents/handbook.pdf", user, "")
+
+	entries := auditEntries()
+	if len(entries) < 3 {
+		t.Fatalf("%d entries", len(entries))
+	}
+	for i, entry := range entries {
+		if entry.Seq != uint64(i+1) || entry.Hash != auditHash(entry) || (i > 0 && entry.PrevHash != entries[i-1].Hash) {
+			t.Fatalf("entry %d: %+v", i, entry)
+		}
+	}
+	var result AuditVerification
+	decodeJSON(t, ts.do(http.MethodGet, "/v1/admin/audit/verify", admin, ""), &result)
+	if !result.Valid || result.FirstSeq != 1 || result.LastSeq != entries[len(entries)-1].Seq {
+		t.Fatalf("verify: %+v", result)
+	}
+
+	// An edited entry, a removed one or a relinked one breaks the chain
+	edited := append([]AuditEntry(nil), entries...)
+	edited[1].Action = "document.nothing"
+	if result := verifyAuditChain(edited); result.Valid || result.BrokenAtSeq != 2 || result.Reason != "entry content does not match its hash" {
+		t.Fatalf("edited: %+v", result)
+	}
+	removed := append(append([]AuditEntry(nil), entries[:1]...), entries[2:]...)
+	if result := verifyAuditChain(removed); result.Valid || result.BrokenAtSeq != 3 {
+		t.Fatalf("removed: %+v", result)
+	}
+	relinked := append([]AuditEntry(nil), entries...)
+	relinked[2].PrevHash = relinked[0].Hash
+	relinked[2].Hash = auditHash(relinked[2])
+	if result := verifyAuditChain(relinked); result.Valid || result.BrokenAtSeq != 3 || result.Reason != "prev_hash does not match the previous entry" {
+		t.Fatalf("relinked: %+v", result)
+	}
+
+	// Retention may drop the oldest entries
+	if result := verifyAuditChain(entries[1:]); !result.Valid {
+		t.Fatalf("after retention: %+v", result)
+	}
+
+	// The log tells the admin when it has been tampered with
+	auditMutex.Lock()
+	auditLog[0].ActorID = "someone else"
+	auditMutex.Unlock()
+	decodeJSON(t, ts.do(http.MethodGet, "/v1/admin/audit/verify", admin, ""), &result)
+	if result.Valid || result.BrokenAtSeq != 1 {
+		t.Fatalf("verify after tampering: %+v", result)
+	}
+}
+
+func TestAuditLogReload(t *testing.T) {
+	path := useAuditLog(t)
+	appendAudit(AuditEntry{Action: "first", Transport: "test"})
+	appendAudit(AuditEntry{Action: "second", Transport: "test"})
+	written := auditEntries()
+
+	// A restart reads the file back and carries on the chain
+	auditMutex.Lock()
+	auditFile.Close()
+	auditLog, auditSeq, auditFile = nil, 0, nil
+	auditMutex.Unlock()
+	if err := openAuditLog(); err != nil {
+		t.Fatal(err)
+	}
+	appendAudit(AuditEntry{Action: "third", Transport: "test"})
+	entries := auditEntries()
+	if len(entries) != 3 || entries[1].Hash != written[1].Hash || entries[2].Seq != 3 || entries[2].PrevHash != written[1].Hash {
+		t.Fatalf("after reload: %+v", entries)
+	}
+	if result := verifyAuditChain(entries); !result.Valid {
+		t.Fatalf("after reload: %+v", result)
+	}
+
+	// An edit to the file shows when it is read back
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, bytes.Replace(data, []byte(`"second"`), []byte(`"altered"`), 1), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	auditMutex.Lock()
+	auditFile.Close()
+	auditLog, auditSeq, auditFile = nil, 0, nil
+	auditMutex.Unlock()
+	if err := openAuditLog(); err != nil {
+		t.Fatal(err)
+	}
+	if result := verifyAuditChain(auditEntries()); result.Valid || result.BrokenAtSeq != 2 {
+		t.Fatalf("after editing the file: %+v", result)
+	}
+}
+
+func TestAuditQueryAndExport(t *testing.T) {
+	useAuditLog(t)
+	ts := newTestServer(t)
+	admin := ts.admin("admin@example.com")
+	user, userID := ts.register("user@example.com")
+	ts.do(http.MethodPost, "/v1/documents/register", user, `{"filename":"handbook.pdf"}`, "User-Agent", "=HYPERLINK(\"http://evil\")")
+	ts.do(http.MethodPost, "/v1/documents/register", user, `{"filename":"notes.pdf"}`)
+
+	var page struct {
+		Entries []AuditEntry `json:"entries"`
+		Total   int          `json:"total"`
+	}
+	decodeJSON(t, ts.do(http.MethodGet, "/v1/admin/audit?actor="+userID+"&resource=handbook.pdf", admin, ""), &page)
+	if page.Total != 1 || page.Entries[0].ActorID != userID {
+		t.Fatalf("filtered: %+v", page)
+	}
+	// Newest first, a page at a time
+	decodeJSON(t, ts.do(http.MethodGet, "/v1/admin/audit?actor=user@example.com&limit=1&offset=1", admin, ""), &page)
+	if page.Total < 2 || len(page.Entries) != 1 || !strings.Contains(page.Entries[0].Resource, "handbook.pdf") {
+		t.Fatalf("second page: %+v", page)
+	}
+	for _, query := range []string{"limit=0", "offset=-1", "since=yesterday"} {
+		if w := ts.do(http.MethodGet, "/v1/admin/audit?"+query, admin, ""); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: got %d, want 400", query, w.Code)
+		}
+	}
+	if w := ts.do(http.MethodGet, "/v1/admin/audit", user, ""); w.Code != http.StatusForbidden {
+		t.Fatalf("member reading the log: got %d, want 403", w.Code)
+	}
+
+	// A value a spreadsheet would evaluate is exported as text
+	w := ts.do(http.MethodGet, "/v1/admin/audit/export?format=csv&resource=handbook.pdf", admin, "")
+	rows, err := csv.NewReader(w.Body).ReadAll()
+	if err != nil || len(rows) != 2 || rows[0][9] != "user_agent" {
+		t.Fatalf("csv: %v %v", rows, err)
+	}
+	if got := rows[1][9]; got != `'=HYPERLINK("http://evil")` {
+		t.Fatalf("user agent exported as %q", got)
+	}
+	if w := ts.do(http.MethodGet, "/v1/admin/audit/export?format=xml", admin, ""); w.Code != http.StatusBadRequest {
+		t.Fatalf("unknown format: got %d, want 400", w.Code)
+	}
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"auth-service/pkg/authmw"
+
+	"golang.org/x/crypto/bcrypt"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// TestAuthMiddlewarePackage checks that a sibling service using authmw
+// refuses what this service refuses
+func TestAuthMiddlewarePackage(t *testing.T) {
+	withConfig(t, func(cfg *Config) {
+		cfg.Passwords.Algorithm, cfg.Passwords.BcryptCost = "bcrypt", bcrypt.MinCost
+		cfg.Passwords.MinScore = 0
+		cfg.Auth.InternalAPIToken = "internal-secret"
+	})
+	t.Cleanup(func() { resetLocalStores(t) })
+	srv, err := NewServer(defaultService)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := &testServer{t: t, srv: srv}
+	backend := httptest.NewServer(srv)
+	defer backend.Close()
+
+	admin := ts.admin("admin@example.com")
+	token, userID := ts.register("member@example.com")
+	ts.do(http.MethodPost, "/v1/documents/register", token, `{"filename":"mine.pdf"}`)
+	verifier := authmw.New(backend.URL, authmw.WithCacheTTL(0), authmw.WithInternalToken("internal-secret"))
+
+	sibling := authmw.Middleware(verifier)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		identity, _ := authmw.FromContext(r.Context())
+		w.Write([]byte(identity.UserID))
+	}))
+	call := func(h http.Handler, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/ingest", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := call(sibling, token); w.Code != http.StatusOK || w.Body.String() != userID {
+		t.Fatalf("valid token: %d %s", w.Code, w.Body)
+	}
+	if w := call(sibling, ""); w.Code != http.StatusUnauthorized || !strings.Contains(w.Body.String(), codeUnauthorized) {
+		t.Fatalf("no token: %d %s", w.Code, w.Body)
+	}
+	if w := call(sibling, "not-a-token"); w.Code != http.StatusUnauthorized || !strings.Contains(w.Body.String(), codeInvalidToken) {
+		t.Fatalf("bad token: %d %s", w.Code, w.Body)
+	}
+	adminOnly := authmw.Middleware(verifier, authmw.RequireRole("admin"))(sibling)
+	if w := call(adminOnly, token); w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), codeAdminRequired) {
+		t.Fatalf("member on admin route: %d %s", w.Code, w.Body)
+	}
+	if w := call(adminOnly, admin); w.Code != http.StatusOK {
+		t.Fatalf("admin on admin route: %d %s", w.Code, w.Body)
+	}
+
+	allowed, err := verifier.FilterDocuments(context.Background(), userID, []string{"mine.pdf", "other.pdf"})
+	if err != nil || len(allowed) != 1 || allowed[0] != "mine.pdf" {
+		t.Fatalf("filter = %v, %v", allowed, err)
+	}
+
+	interceptor := authmw.UnaryServerInterceptor(verifier, nil, authmw.RequireRole("admin"))
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		identity, _ := authmw.FromContext(ctx)
+		return identity.Role, nil
+	}
+	info := &grpc.UnaryServerInfo{FullMethod: "/ingest.Ingest/Add"}
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "Bearer "+admin))
+	if role, err := interceptor(ctx, nil, info, handler); err != nil || role != "admin" {
+		t.Fatalf("grpc admin: %v, %v", role, err)
+	}
+	ctx = metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "Bearer "+token))
+	if _, err := interceptor(ctx, nil, info, handler); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("grpc member: %v", err)
+	}
+
+	// A disabled account is refused by the sibling as soon as it is here
+	ts.do(http.MethodPatch, "/v1/admin/users/"+userID, admin, `{"status":"disabled"}`)
+	if w := call(sibling, token); w.Code != http.StatusUnauthorized {
+		t.Fatalf("disabled account: %d %s", w.Code, w.Body)
+	}
+}
+
+func TestAuthMiddlewareCache(t *testing.T) {
+	ts := newTestServer(t)
+	token, _ := ts.register("member@example.com")
+	calls := 0
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		ts.srv.ServeHTTP(w, r)
+	}))
+	defer backend.Close()
+
+	verifier := authmw.New(backend.URL)
+	for i := 0; i < 3; i++ {
+		if _, err := verifier.Verify(context.Background(), token); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if calls != 1 {
+		t.Fatalf("auth service asked %d times, want 1", calls)
+	}
+	// Unreachable auth service
+	backend.Close()
+	if _, err := authmw.New(backend.URL).Verify(context.Background(), token); status.Code(authmw.StatusError(err)) != codes.Unavailable {
+		t.Fatalf("unreachable: %v", err)
+	}
+}
+
+func TestAuthMiddlewareRevocations(t *testing.T) {
+	ts := newTestServer(t)
+	withConfig(t, func(cfg *Config) { cfg.Auth.InternalAPIToken = testInternalToken })
+	token, _ := ts.register("member@example.com")
+	other, _ := ts.register("other@example.com")
+	verifications := 0
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/auth/verify") {
+			verifications++
+		}
+		ts.srv.ServeHTTP(w, r)
+	}))
+	defer backend.Close()
+
+	verifier := authmw.New(backend.URL, authmw.WithCacheTTL(time.Hour), authmw.WithInternalToken(testInternalToken))
+	verify := func(tok string) error {
+		_, err := verifier.Verify(context.Background(), tok)
+		return err
+	}
+	if verify(token) != nil || verify(other) != nil || verifications != 2 {
+		t.Fatalf("first verifications: %d", verifications)
+	}
+	if w := ts.do(http.MethodPost, "/v1/auth/logout-all", token, ""); w.Code != http.StatusOK {
+		t.Fatalf("logout-all: %d %s", w.Code, w.Body)
+	}
+	// Remembered until the revocation is synced...
+	if err := verify(token); err != nil || verifications != 2 {
+		t.Fatalf("before syncing: %v after %d verifications", err, verifications)
+	}
+	if err := verifier.SyncRevocations(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	// ...then refused, while other users' tokens stay remembered
+	var refused *authmw.Error
+	if err := verify(token); !errors.As(err, &refused) || refused.Status != http.StatusUnauthorized {
+		t.Fatalf("revoked token after syncing: %v", err)
+	}
+	if err := verify(other); err != nil || verifications != 3 {
+		t.Fatalf("another user's token: %v after %d verifications", err, verifications)
+	}
+	// Syncing again applies nothing new
+	if err := verifier.SyncRevocations(context.Background()); err != nil || verify(other) != nil || verifications != 3 {
+		t.Fatalf("second sync: %v after %d verifications", err, verifications)
+	}
+
+	if err := authmw.New(backend.URL).SyncRevocations(context.Background()); err == nil {
+		t.Fatal("syncing without the internal token: want an error")
+	}
+}
+
+func TestAuthMiddlewareScopes(t *testing.T) {
+	ts := newTestServer(t)
+	withConfig(t, func(cfg *Config) { cfg.Auth.InternalAPIToken = testInternalToken })
+	token, _ := ts.register("member@example.com")
+	exchanged, code, body := ts.exchange(exchangeForm(token))
+	if code != http.StatusOK {
+		t.Fatalf("exchange: %d %s", code, body)
+	}
+	backend := httptest.NewServer(ts.srv)
+	defer backend.Close()
+	verifier := authmw.New(backend.URL, authmw.WithCacheTTL(0))
+
+	identity, err := verifier.Verify(context.Background(), exchanged.AccessToken)
+	if err != nil || len(identity.Scopes) != 1 || identity.Scopes[0] != scopeDocumentsRead {
+		t.Fatalf("exchanged token: %+v, %v", identity, err)
+	}
+	if identity, err := verifier.Verify(context.Background(), token); err != nil || len(identity.Scopes) != 0 {
+		t.Fatalf("full token: %+v, %v", identity, err)
+	}
+
+	// A narrowed token reaches only the routes its scope covers
+	var refused *authmw.Error
+	if _, err := verifier.Authorize(context.Background(), exchanged.AccessToken, authmw.RequireScope(scopeProfileRead)); !errors.As(err, &refused) ||
+		refused.Status != http.StatusForbidden || refused.Code != codeInsufficientScope {
+		t.Fatalf("outside its scope: %v", err)
+	}
+	if _, err := verifier.Authorize(context.Background(), exchanged.AccessToken, authmw.RequireScope(scopeDocumentsRead)); err != nil {
+		t.Fatalf("within its scope: %v", err)
+	}
+	if _, err := verifier.Authorize(context.Background(), token, authmw.RequireScope(scopeProfileRead)); err != nil {
+		t.Fatalf("full token: %v", err)
+	}
+}
+
+func TestAuthMiddlewareOAuthScopes(t *testing.T) {
+	useOAuthClients(t)
+	ts := newTestServer(t)
+	admin := ts.admin("admin@example.com")
+	user, _ := ts.register("member@example.com")
+	partner := ts.registerClient(admin, `{"name":"Partner Notes","redirect_uris":["`+testRedirectURI+`"],"scopes":["documents:read","profile:read"]}`)
+	oauthToken := func(scope string) string {
+		req := authorizeRequest(partner.ID)
+		req.Scope = scope
+		form := codeForm(ts.authorize(user, req).Get("code"))
+		form.Set("client_id", partner.ID)
+		form.Set("client_secret", partner.ClientSecret)
+		resp, status, body := ts.redeem(form)
+		if status != http.StatusOK {
+			t.Fatalf("token for %s: %d %s", scope, status, body)
+		}
+		return resp.AccessToken
+	}
+	backend := httptest.NewServer(ts.srv)
+	defer backend.Close()
+	verifier := authmw.New(backend.URL, authmw.WithCacheTTL(0))
+
+	// A partner app gets what the user consented to and no more, over HTTP
+	// and gRPC alike
+	profile := authmw.Middleware(verifier, authmw.RequireScope(scopeProfileRead))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		identity, _ := authmw.FromContext(r.Context())
+		w.Write([]byte(strings.Join(identity.Scopes, " ")))
+	}))
+	call := func(token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/profile", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		profile.ServeHTTP(w, req)
+		return w
+	}
+	documentsOnly, both := oauthToken(scopeDocumentsRead), oauthToken("profile:read documents:read")
+	if w := call(documentsOnly); w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), codeInsufficientScope) {
+		t.Fatalf("without consent: %d %s", w.Code, w.Body)
+	}
+	if w := call(both); w.Code != http.StatusOK || w.Body.String() != "documents:read profile:read" {
+		t.Fatalf("with consent: %d %s", w.Code, w.Body)
+	}
+	interceptor := authmw.UnaryServerInterceptor(verifier, nil, authmw.RequireScope(scopeProfileRead))
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) { return nil, nil }
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "Bearer "+documentsOnly))
+	if _, err := interceptor(ctx, nil, &grpc.UnaryServerInfo{FullMethod: "/profile.Profile/Get"}, handler); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("grpc without consent: %v", err)
+	}
+}
@@ -0,0 +1,919 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net/http"
+	"path"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/scrypt"
+)
+
+// ============================================================================
+// Backup and Restore
+// ============================================================================
+//
+// POST /admin/backup downloads an encrypted archive of the service's
+// state: every user, password hashes included, every document with its
+// owner, scope (org-wide or private), size and tags, the orgs users belong
+// to and the registered OAuth clients with their secret hashes, which is
+// all the access control the service keeps. POST /admin/restore loads such
+// an archive, replacing that state; with ?dry_run=true it only reports
+// what would be created, updated and deleted. Audit entries, login
+// history, jobs and exports are not part of a backup. Version 1 archives
+// predate orgs and clients; restoring one leaves both as they are.
+//
+// Archives are gzipped JSON sealed with AES-256-GCM under a key derived
+// from backup.passphrase with scrypt, so a backup is only as safe as the
+// passphrase; without one the endpoints answer 503. The file is
+//
+//	"AUTHBAK1" | 16-byte salt | 12-byte nonce | ciphertext
+//
+// A restore is checked before anything changes (unique IDs and emails, a
+// known owner for every document, a known org for every member, at least
+// one active admin) but is not atomic: a write that fails part way, such
+// as an unreachable cluster store, leaves the changes made so far. Running
+// it again converges.
+//
+// With backup.interval set, the service also uploads a backup to S3 (or
+// S3-compatible storage) on that schedule. Replicas each run the schedule;
+// a cluster lock keeps their uploads from overlapping.
+
+const (
+	backupFormatVersion = 2
+	backupOrgsVersion   = 2 // first version holding orgs and OAuth clients
+	backupMagic         = "AUTHBAK1"
+	backupSaltSize      = 16
+	backupFilePrefix    = "auth-backup-"
+	maxBackupSize       = 64 << 20
+
+	// scrypt cost; about 100ms per archive
+	backupScryptN = 1 << 15
+	backupScryptR = 8
+	backupScryptP = 1
+)
+
+var (
+	errBackupsNotConfigured = errors.New("Backups are not configured")
+	errBackupUnreadable     = errors.New("Backup could not be decrypted; check the passphrase and the file")
+
+	backupClient = &http.Client{Timeout: 5 * time.Minute}
+)
+
+// BackupData is an archive's content
+type BackupData struct {
+	Version   int              `json:"version"`
+	CreatedAt time.Time        `json:"created_at"`
+	Users     []sharedUser     `json:"users"`
+	Documents []BackupDocument `json:"documents"`
+
+	Orgs         []*Org              `json:"orgs"`
+	OAuthClients []storedOAuthClient `json:"oauth_clients"`
+}
+
+// BackupDocument is one document in an archive
+type BackupDocument struct {
+	Filename string `json:"filename"`
+	Owner    string `json:"owner_id"`
+	sharedDocumentMeta
+}
+
+// RestoreItem is one user, document, org or OAuth client a restore changes
+type RestoreItem struct {
+	ID      string   `json:"id"`                // user, org or client ID, or filename
+	Email   string   `json:"email,omitempty"`   // users only
+	Changes []string `json:"changes,omitempty"` // fields an update changes
+}
+
+// RestoreDiff is what a restore does to one kind of record
+type RestoreDiff struct {
+	Create    []RestoreItem `json:"create"`
+	Update    []RestoreItem `json:"update"`
+	Delete    []RestoreItem `json:"delete"`
+	Unchanged int           `json:"unchanged"`
+}
+
+// changes counts the records a diff creates, updates or deletes
+func (d RestoreDiff) changes() int {
+	return len(d.Create) + len(d.Update) + len(d.Delete)
+}
+
+// RestorePlan is the response to POST /admin/restore
+type RestorePlan struct {
+	DryRun          bool        `json:"dry_run"`
+	BackupCreatedAt time.Time   `json:"backup_created_at"`
+	Users           RestoreDiff `json:"users"`
+	Documents       RestoreDiff `json:"documents"`
+	Orgs            RestoreDiff `json:"orgs"`
+	OAuthClients    RestoreDiff `json:"oauth_clients"`
+}
+
+// ----------------------------------------------------------------------------
+// Archives
+// ----------------------------------------------------------------------------
+
+// snapshotBackup copies svc's users and documents, the orgs and the OAuth
+// clients, sorted
+func snapshotBackup(svc *Service, now time.Time) BackupData {
+	data := BackupData{Version: backupFormatVersion, CreatedAt: now.UTC()}
+	svc.users.Each(func(user *User) {
+		data.Users = append(data.Users, sharedUserOf(user))
+	})
+	svc.documents.View(func(tx DocumentTx) {
+		tx.each(func(filename string, record documentRecord) {
+			data.Documents = append(data.Documents, BackupDocument{Filename: filename, Owner: record.Owner, sharedDocumentMeta: documentMeta(record)})
+		})
+	})
+	orgMutex.RLock()
+	for _, org := range orgs {
+		data.Orgs = append(data.Orgs, org)
+	}
+	orgMutex.RUnlock()
+	oauthServerMutex.Lock()
+	for _, client := range oauthClients {
+		data.OAuthClients = append(data.OAuthClients, storedOAuthClient{OAuthClient: client, SecretHash: client.secretHash})
+	}
+	oauthServerMutex.Unlock()
+
+	sort.Slice(data.Users, func(i, j int) bool { return data.Users[i].ID < data.Users[j].ID })
+	sort.Slice(data.Documents, func(i, j int) bool { return data.Documents[i].Filename < data.Documents[j].Filename })
+	sort.Slice(data.Orgs, func(i, j int) bool { return data.Orgs[i].ID < data.Orgs[j].ID })
+	sort.Slice(data.OAuthClients, func(i, j int) bool { return data.OAuthClients[i].ID < data.OAuthClients[j].ID })
+	return data
+}
+
+// backupKey derives the archive key from the passphrase
+func backupKey(passphrase string, salt []byte) (cipher.AEAD, error) {
+	key, err := scrypt.Key([]byte(passphrase), salt, backupScryptN, backupScryptR, backupScryptP, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// sealBackup compresses and encrypts an archive
+func sealBackup(data BackupData, passphrase string) ([]byte, error) {
+	var plain bytes.Buffer
+	zw := gzip.NewWriter(&plain)
+	if err := json.NewEncoder(zw).Encode(data); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+
+	salt := make([]byte, backupSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	aead, err := backupKey(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	archive := append([]byte(backupMagic), salt...)
+	archive = append(archive, nonce...)
+	return aead.Seal(archive, nonce, plain.Bytes(), []byte(backupMagic)), nil
+}
+
+// openBackup decrypts and decodes an archive
+func openBackup(archive []byte, passphrase string) (BackupData, error) {
+	var data BackupData
+	header := len(backupMagic) + backupSaltSize
+	if len(archive) < header || string(archive[:len(backupMagic)]) != backupMagic {
+		return data, errBackupUnreadable
+	}
+	aead, err := backupKey(passphrase, archive[len(backupMagic):header])
+	if err != nil {
+		return data, err
+	}
+	if len(archive) < header+aead.NonceSize() {
+		return data, errBackupUnreadable
+	}
+	nonce := archive[header : header+aead.NonceSize()]
+	plain, err := aead.Open(nil, nonce, archive[header+aead.NonceSize():], []byte(backupMagic))
+	if err != nil {
+		return data, errBackupUnreadable
+	}
+
+	zr, err := gzip.NewReader(bytes.NewReader(plain))
+	if err != nil {
+		return data, errBackupUnreadable
+	}
+	if err := json.NewDecoder(zr).Decode(&data); err != nil {
+		return data, errBackupUnreadable
+	}
+	return data, nil
+}
+
+// checkBackup reports why an archive can't be restored, or nil
+func checkBackup(data BackupData) error {
+	if data.Version < 1 || data.Version > backupFormatVersion {
+		return fmt.Errorf("unsupported backup version %d", data.Version)
+	}
+	knownOrgs, err := backupOrgs(data)
+	if err != nil {
+		return err
+	}
+	clients := make(map[string]bool, len(data.OAuthClients))
+	for _, client := range data.OAuthClients {
+		switch {
+		case client.OAuthClient == nil || client.ID == "":
+			return fmt.Errorf("an OAuth client has no ID")
+		case clients[client.ID]:
+			return fmt.Errorf("OAuth client %s appears twice", client.ID)
+		}
+		clients[client.ID] = true
+	}
+
+	ids := make(map[string]bool, len(data.Users))
+	emails := make(map[string]bool, len(data.Users))
+	phones := make(map[string]bool)
+	admins := 0
+	for _, record := range data.Users {
+		switch {
+		case record.ID == "" || record.Email == "":
+			return fmt.Errorf("a user has no ID or email")
+		case ids[record.ID]:
+			return fmt.Errorf("user %s appears twice", record.ID)
+		case emails[record.Email]:
+			return fmt.Errorf("email %s is used by two users", record.Email)
+		case record.Phone != "" && phones[record.Phone]:
+			return fmt.Errorf("phone %s is used by two users", record.Phone)
+		case record.OrgID != "" && !knownOrgs[record.OrgID]:
+			return fmt.Errorf("user %s is in unknown org %s", record.ID, record.OrgID)
+		}
+		ids[record.ID], emails[record.Email] = true, true
+		if record.Phone != "" {
+			phones[record.Phone] = true
+		}
+		if record.Role == "admin" && accountStatus(&User{Status: record.Status}) == UserActive {
+			admins++
+		}
+	}
+	if admins == 0 {
+		return fmt.Errorf("backup has no active admin")
+	}
+
+	filenames := make(map[string]bool, len(data.Documents))
+	for _, doc := range data.Documents {
+		switch {
+		case doc.Filename == "":
+			return fmt.Errorf("a document has no filename")
+		case filenames[doc.Filename]:
+			return fmt.Errorf("document %s appears twice", doc.Filename)
+		case !ids[doc.Owner]:
+			return fmt.Errorf("document %s is owned by unknown user %s", doc.Filename, doc.Owner)
+		}
+		filenames[doc.Filename] = true
+	}
+	return nil
+}
+
+// backupOrgs returns the org IDs an archive's users may belong to: the
+// archive's orgs, or for an archive without them the current ones, which
+// a restore keeps
+func backupOrgs(data BackupData) (map[string]bool, error) {
+	known := make(map[string]bool)
+	if data.Version < backupOrgsVersion {
+		orgMutex.RLock()
+		defer orgMutex.RUnlock()
+		for id := range orgs {
+			known[id] = true
+		}
+		return known, nil
+	}
+	for _, org := range data.Orgs {
+		switch {
+		case org == nil || org.ID == "":
+			return nil, fmt.Errorf("an org has no ID")
+		case known[org.ID]:
+			return nil, fmt.Errorf("org %s appears twice", org.ID)
+		}
+		known[org.ID] = true
+	}
+	return known, nil
+}
+
+// ----------------------------------------------------------------------------
+// Restore
+// ----------------------------------------------------------------------------
+
+// userChanges lists the fields restoring record would change
+func userChanges(current, record sharedUser) []string {
+	var changes []string
+	for _, field := range []struct {
+		name     string
+		from, to string
+	}{
+		{"email", current.Email, record.Email},
+		{"password", current.PasswordHash, record.PasswordHash},
+		{"name", current.Name, record.Name},
+		{"avatar", current.Avatar, record.Avatar},
+		{"role", current.Role, record.Role},
+		{"status", current.Status, record.Status},
+		{"phone", current.Phone, record.Phone},
+		{"merged_into", current.MergedInto, record.MergedInto},
+		{"referral_code", current.ReferralCode, record.ReferralCode},
+		{"referred_by", current.ReferredBy, record.ReferredBy},
+		{"plan", current.Plan, record.Plan},
+		{"org_id", current.OrgID, record.OrgID},
+		{"org_role", current.OrgRole, record.OrgRole},
+	} {
+		if field.from != field.to {
+			changes = append(changes, field.name)
+		}
+	}
+	if !current.CreatedAt.Equal(record.CreatedAt) {
+		changes = append(changes, "created_at")
+	}
+	if !current.TokensRevokedAt.Equal(record.TokensRevokedAt) {
+		changes = append(changes, "tokens_revoked_at")
+	}
+	// Which devices, their names and trust; last seen is activity
+	if !slices.EqualFunc(current.Devices, record.Devices, func(a, b Device) bool {
+		return a.ID == b.ID && a.Name == b.Name && a.trusted(time.Now()) == b.trusted(time.Now())
+	}) {
+		changes = append(changes, "devices")
+	}
+	if !slices.Equal(current.Starred, record.Starred) {
+		changes = append(changes, "starred")
+	}
+	return changes
+}
+
+// documentChanges lists the fields restoring doc would change
+func documentChanges(current documentRecord, doc BackupDocument) []string {
+	var changes []string
+	if current.Owner != doc.Owner {
+		changes = append(changes, "owner")
+	}
+	if current.Name != documentName(doc.Filename, doc.Name) {
+		changes = append(changes, "name")
+	}
+	if current.OrgWide != doc.OrgWide {
+		changes = append(changes, "org_wide")
+	}
+	if strings.Join(current.Tags, "\x00") != strings.Join(doc.Tags, "\x00") {
+		changes = append(changes, "tags")
+	}
+	if !maps.EqualFunc(current.Grants, doc.Grants, time.Time.Equal) {
+		changes = append(changes, "grants")
+	}
+	if !slices.Equal(current.Notes, doc.Notes) {
+		changes = append(changes, "notes")
+	}
+	if !samePreview(current.Preview, doc.Preview) {
+		changes = append(changes, "preview")
+	}
+	if !sameChunking(current.Chunking, doc.Chunking) {
+		changes = append(changes, "chunking")
+	}
+	if !sameChunking(current.ChunkedWith, doc.ChunkedWith) {
+		changes = append(changes, "chunked_with")
+	}
+	if current.Size != doc.Size {
+		changes = append(changes, "size")
+	}
+	if current.Type != doc.Type {
+		changes = append(changes, "type")
+	}
+	if !current.AddedAt.Equal(doc.AddedAt) {
+		changes = append(changes, "added_at")
+	}
+	return changes
+}
+
+// orgChanges lists the fields restoring org would change
+func orgChanges(current, org *Org) []string {
+	var changes []string
+	if current.Name != org.Name {
+		changes = append(changes, "name")
+	}
+	if current.DefaultRole != org.DefaultRole {
+		changes = append(changes, "default_role")
+	}
+	if !slices.EqualFunc(current.Domains, org.Domains, func(a, b OrgDomain) bool {
+		return a.Domain == b.Domain && a.TXTValue == b.TXTValue && (a.VerifiedAt == nil) == (b.VerifiedAt == nil)
+	}) {
+		changes = append(changes, "domains")
+	}
+	if !reflect.DeepEqual(current.AccessLog, org.AccessLog) {
+		changes = append(changes, "access_log")
+	}
+	if current.CreatedBy != org.CreatedBy || !current.CreatedAt.Equal(org.CreatedAt) {
+		changes = append(changes, "created")
+	}
+	return changes
+}
+
+// clientChanges lists the fields restoring client would change
+func clientChanges(current *OAuthClient, client storedOAuthClient) []string {
+	var changes []string
+	if current.Name != client.Name {
+		changes = append(changes, "name")
+	}
+	if !slices.Equal(current.RedirectURIs, client.RedirectURIs) {
+		changes = append(changes, "redirect_uris")
+	}
+	if !slices.Equal(current.Scopes, client.Scopes) {
+		changes = append(changes, "scopes")
+	}
+	if current.Public != client.Public {
+		changes = append(changes, "public")
+	}
+	if current.secretHash != client.SecretHash {
+		changes = append(changes, "secret")
+	}
+	return changes
+}
+
+// diffRecords sorts an archive's records into a diff against the current
+// ones, both by ID
+func diffRecords[C, R any](current map[string]C, restored map[string]R, changes func(C, R) []string) RestoreDiff {
+	diff := RestoreDiff{Create: []RestoreItem{}, Update: []RestoreItem{}, Delete: []RestoreItem{}}
+	for id, record := range restored {
+		existing, exists := current[id]
+		if !exists {
+			diff.Create = append(diff.Create, RestoreItem{ID: id})
+		} else if fields := changes(existing, record); len(fields) > 0 {
+			diff.Update = append(diff.Update, RestoreItem{ID: id, Changes: fields})
+		} else {
+			diff.Unchanged++
+		}
+	}
+	for id := range current {
+		if _, kept := restored[id]; !kept {
+			diff.Delete = append(diff.Delete, RestoreItem{ID: id})
+		}
+	}
+	for _, items := range [][]RestoreItem{diff.Create, diff.Update, diff.Delete} {
+		sort.Slice(items, func(i, j int) bool { return items[i].ID < items[j].ID })
+	}
+	return diff
+}
+
+// planRestore compares an archive with svc's current state
+func planRestore(svc *Service, data BackupData) RestorePlan {
+	plan := RestorePlan{BackupCreatedAt: data.CreatedAt}
+	plan.Users.Create, plan.Users.Update, plan.Users.Delete = []RestoreItem{}, []RestoreItem{}, []RestoreItem{}
+	plan.Documents.Create, plan.Documents.Update, plan.Documents.Delete = []RestoreItem{}, []RestoreItem{}, []RestoreItem{}
+
+	current := make(map[string]sharedUser)
+	svc.users.Each(func(user *User) {
+		current[user.ID] = sharedUserOf(user)
+	})
+	restored := make(map[string]bool, len(data.Users))
+	for _, record := range data.Users {
+		restored[record.ID] = true
+		existing, exists := current[record.ID]
+		switch changes := userChanges(existing, record); {
+		case !exists:
+			plan.Users.Create = append(plan.Users.Create, RestoreItem{ID: record.ID, Email: record.Email})
+		case len(changes) > 0:
+			plan.Users.Update = append(plan.Users.Update, RestoreItem{ID: record.ID, Email: record.Email, Changes: changes})
+		default:
+			plan.Users.Unchanged++
+		}
+	}
+	for id, existing := range current {
+		if !restored[id] {
+			plan.Users.Delete = append(plan.Users.Delete, RestoreItem{ID: id, Email: existing.Email})
+		}
+	}
+	sort.Slice(plan.Users.Delete, func(i, j int) bool { return plan.Users.Delete[i].ID < plan.Users.Delete[j].ID })
+
+	svc.documents.View(func(tx DocumentTx) {
+		restored := make(map[string]bool, len(data.Documents))
+		for _, doc := range data.Documents {
+			restored[doc.Filename] = true
+			existing, exists := tx.get(doc.Filename)
+			switch changes := documentChanges(existing, doc); {
+			case !exists:
+				plan.Documents.Create = append(plan.Documents.Create, RestoreItem{ID: doc.Filename})
+			case len(changes) > 0:
+				plan.Documents.Update = append(plan.Documents.Update, RestoreItem{ID: doc.Filename, Changes: changes})
+			default:
+				plan.Documents.Unchanged++
+			}
+		}
+		tx.each(func(filename string, _ documentRecord) {
+			if !restored[filename] {
+				plan.Documents.Delete = append(plan.Documents.Delete, RestoreItem{ID: filename})
+			}
+		})
+	})
+	sort.Slice(plan.Documents.Delete, func(i, j int) bool { return plan.Documents.Delete[i].ID < plan.Documents.Delete[j].ID })
+
+	empty := RestoreDiff{Create: []RestoreItem{}, Update: []RestoreItem{}, Delete: []RestoreItem{}}
+	plan.Orgs, plan.OAuthClients = empty, empty
+	if data.Version >= backupOrgsVersion {
+		orgMutex.RLock()
+		currentOrgs := maps.Clone(orgs)
+		orgMutex.RUnlock()
+		restoredOrgs := make(map[string]*Org, len(data.Orgs))
+		for _, org := range data.Orgs {
+			restoredOrgs[org.ID] = org
+		}
+		plan.Orgs = diffRecords(currentOrgs, restoredOrgs, orgChanges)
+
+		oauthServerMutex.Lock()
+		currentClients := maps.Clone(oauthClients)
+		oauthServerMutex.Unlock()
+		restoredClients := make(map[string]storedOAuthClient, len(data.OAuthClients))
+		for _, client := range data.OAuthClients {
+			restoredClients[client.ID] = client
+		}
+		plan.OAuthClients = diffRecords(currentClients, restoredClients, clientChanges)
+	}
+	return plan
+}
+
+// Restore replaces svc's users and documents with an archive's, or with
+// dryRun only reports what that would change. The archive must have passed
+// checkBackup.
+func (s *Service) Restore(data BackupData, dryRun bool) (RestorePlan, error) {
+	s.adminMu.Lock()
+	defer s.adminMu.Unlock()
+
+	plan := planRestore(s, data)
+	plan.DryRun = dryRun
+	if dryRun {
+		return plan, nil
+	}
+
+	// Orgs first, so restored members find theirs
+	if data.Version >= backupOrgsVersion {
+		if err := restoreOrgsAndClients(data, plan); err != nil {
+			return plan, err
+		}
+		for _, item := range plan.OAuthClients.Delete {
+			if err := deleteAuthorizationCodes(item.ID); err != nil {
+				return plan, err
+			}
+		}
+	}
+
+	// Deletions first, which frees their emails and phone numbers
+	for _, item := range plan.Users.Delete {
+		user := s.users.ByID(item.ID)
+		if user == nil {
+			continue
+		}
+		lock := s.users.FieldLock(user)
+		lock.RLock()
+		email, phone := user.Email, user.Phone
+		lock.RUnlock()
+		if err := deleteSharedUser(user.ID, email, phone); err != nil {
+			return plan, err
+		}
+		s.users.Remove(user)
+		forgetUserTokens(user.ID)
+	}
+
+	records := make(map[string]sharedUser, len(data.Users))
+	for _, record := range data.Users {
+		records[record.ID] = record
+	}
+	// Users swapping emails or phones only succeed once the other has
+	// moved, so retry while the pass makes progress
+	pending := append(append([]RestoreItem(nil), plan.Users.Update...), plan.Users.Create...)
+	for len(pending) > 0 {
+		var retry []RestoreItem
+		var lastErr error
+		for _, item := range pending {
+			if err := s.restoreUser(records[item.ID]); err == errEmailTaken || err == errPhoneTaken {
+				retry, lastErr = append(retry, item), err
+			} else if err != nil {
+				return plan, err
+			}
+		}
+		if len(retry) == len(pending) {
+			return plan, lastErr
+		}
+		pending = retry
+	}
+	bumpUserVersion()
+
+	err := s.documents.Update(func(tx DocumentTx) error {
+		restored := make(map[string]bool, len(data.Documents))
+		for _, doc := range data.Documents {
+			restored[doc.Filename] = true
+			existing, exists := tx.get(doc.Filename)
+			if exists && len(documentChanges(existing, doc)) == 0 {
+				continue
+			}
+			owner := existing.Owner
+			if !exists {
+				claimed, err := claimSharedDocument(doc.Filename, doc.Owner, doc.sharedDocumentMeta)
+				if err != nil {
+					return err
+				}
+				owner = claimed
+			}
+			if owner != doc.Owner {
+				if err := transferSharedDocument(doc.Filename, owner, doc.Owner); err != nil {
+					return err
+				}
+			}
+			tx.put(doc.Filename, doc.record(doc.Owner))
+			saveDocumentMeta(doc.Filename, doc.sharedDocumentMeta)
+		}
+
+		var removed []string
+		tx.each(func(filename string, _ documentRecord) {
+			if !restored[filename] {
+				removed = append(removed, filename)
+			}
+		})
+		for _, filename := range removed {
+			if err := releaseSharedDocument(filename, tx.owner(filename)); err != nil {
+				return err
+			}
+			tx.remove(filename)
+		}
+		return nil
+	})
+	bumpDocVersion()
+	return plan, err
+}
+
+// restoreOrgsAndClients replaces the orgs and OAuth clients with an
+// archive's, skipping either when the plan leaves it unchanged
+func restoreOrgsAndClients(data BackupData, plan RestorePlan) error {
+	if plan.Orgs.changes() > 0 {
+		err := updateOrgs(func(changed map[string]*Org) error {
+			clear(changed)
+			for _, org := range data.Orgs {
+				changed[org.ID] = org
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if plan.OAuthClients.changes() == 0 {
+		return nil
+	}
+	return updateOAuthClients(func(clients map[string]*OAuthClient) error {
+		clear(clients)
+		for _, stored := range data.OAuthClients {
+			client := *stored.OAuthClient
+			client.secretHash = stored.SecretHash
+			clients[client.ID] = &client
+		}
+		return nil
+	})
+}
+
+// restoreUser creates a user from an archive record or brings an existing
+// one in line with it
+func (s *Service) restoreUser(record sharedUser) error {
+	user := s.users.ByID(record.ID)
+	if user == nil {
+		restored := &User{}
+		applyRecord(restored, record)
+		if err := reserveEmail(record.Email, record.ID); err != nil {
+			return err
+		}
+		if record.Phone != "" {
+			if err := reservePhone(record.Phone, record.ID); err != nil {
+				releaseEmail(record.Email)
+				return err
+			}
+		}
+		if err := saveUser(restored); err != nil {
+			releaseEmail(record.Email)
+			releasePhone(record.Phone)
+			return err
+		}
+		stored, err := s.users.Add(restored)
+		if err != nil {
+			return err
+		}
+		return s.users.ChangePhone(stored, "", record.Phone)
+	}
+
+	lock := s.users.FieldLock(user)
+	lock.RLock()
+	previous := sharedUserOf(user)
+	lock.RUnlock()
+
+	if record.Email != previous.Email {
+		if err := reserveEmail(record.Email, record.ID); err != nil {
+			return err
+		}
+		if err := s.users.ChangeEmail(user, previous.Email, record.Email); err != nil {
+			releaseEmail(record.Email)
+			return err
+		}
+	}
+	if record.Phone != previous.Phone {
+		if record.Phone != "" {
+			if err := reservePhone(record.Phone, record.ID); err != nil {
+				return err
+			}
+		}
+		if err := s.users.ChangePhone(user, previous.Phone, record.Phone); err != nil {
+			releasePhone(record.Phone)
+			return err
+		}
+	}
+
+	lock.Lock()
+	applyRecord(user, record)
+	lock.Unlock()
+	if err := saveUser(user); err != nil {
+		return err
+	}
+	if record.Email != previous.Email {
+		releaseEmail(previous.Email)
+	}
+	if record.Phone != previous.Phone {
+		releasePhone(previous.Phone)
+	}
+	if record.Role != previous.Role || record.Status != previous.Status || record.Email != previous.Email ||
+		record.PasswordHash != previous.PasswordHash || !record.TokensRevokedAt.Equal(previous.TokensRevokedAt) {
+		forgetUserTokens(user.ID)
+	}
+	forgetCachedUser(user.ID)
+	return nil
+}
+
+// applyRecord sets a user's fields from an archive record
+func applyRecord(user *User, record sharedUser) {
+	user.ID, user.Email, user.Password = record.ID, record.Email, record.PasswordHash
+	user.Name, user.Avatar, user.Role = record.Name, record.Avatar, record.Role
+	user.Status, user.Phone, user.MergedInto = record.Status, record.Phone, record.MergedInto
+	user.ReferralCode, user.ReferredBy, user.Plan = record.ReferralCode, record.ReferredBy, record.Plan
+	user.OrgID, user.OrgRole = record.OrgID, record.OrgRole
+	user.CreatedAt, user.UpdatedAt = record.CreatedAt, record.UpdatedAt
+	user.TokensRevokedAt, user.Devices = record.TokensRevokedAt, record.Devices
+	user.Starred = record.Starred
+}
+
+// ----------------------------------------------------------------------------
+// Scheduled Backups
+// ----------------------------------------------------------------------------
+
+// startScheduledBackups uploads a backup of svc every backup.interval
+func startScheduledBackups(svc *Service) {
+	if config.Backup.Interval <= 0 {
+		return
+	}
+	goBackground(func(ctx context.Context) {
+		ticker := time.NewTicker(config.Backup.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			release, err := tryLock("backup", config.Cluster.LockTTL)
+			if err != nil {
+				if err != errLockHeld {
+					slog.Warn("Scheduled backup skipped", "error", err)
+				}
+				continue
+			}
+			key, err := uploadBackup(ctx, svc, time.Now())
+			release()
+			if err != nil {
+				slog.Error("Scheduled backup failed", "error", err)
+				continue
+			}
+			slog.Info("Backup uploaded", "bucket", config.Backup.S3Bucket, "key", key)
+		}
+	})
+}
+
+// backupFilename names an archive taken at now
+func backupFilename(now time.Time) string {
+	return backupFilePrefix + now.UTC().Format("20060102T150405Z") + ".bak"
+}
+
+// uploadBackup puts a backup of svc in the configured bucket and returns
+// its object key
+func uploadBackup(ctx context.Context, svc *Service, now time.Time) (string, error) {
+	archive, err := sealBackup(snapshotBackup(svc, now), config.Backup.Passphrase)
+	if err != nil {
+		return "", err
+	}
+	cfg := config.Backup
+	key := path.Join(cfg.S3Prefix, backupFilename(now))
+	endpoint := fmt.Sprintf("https://%s.s3.%s.amazonaws.com/%s", cfg.S3Bucket, cfg.S3Region, s3EscapePath(key))
+	if cfg.S3Endpoint != "" {
+		// S3-compatible storage, addressed path-style
+		endpoint = strings.TrimSuffix(cfg.S3Endpoint, "/") + "/" + cfg.S3Bucket + "/" + s3EscapePath(key)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, endpoint, bytes.NewReader(archive))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	sum := sha256.Sum256(archive)
+	signAWSRequest(req, "s3", cfg.S3Region, cfg.S3AccessKeyID, cfg.S3SecretAccessKey, "", hex.EncodeToString(sum[:]), now.UTC())
+	resp, err := backupClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode/100 != 2 {
+		return "", fmt.Errorf("PUT %s returned %s", key, resp.Status)
+	}
+	return key, nil
+}
+
+// ----------------------------------------------------------------------------
+// Handlers
+// ----------------------------------------------------------------------------
+
+// createBackup downloads an encrypted archive (admin only)
+func (s *Server) createBackup(c *gin.Context) {
+	if config.Backup.Passphrase == "" {
+		respondError(c, http.StatusServiceUnavailable, codeNotConfigured, errBackupsNotConfigured.Error())
+		return
+	}
+	now := time.Now()
+	data := snapshotBackup(s.svc, now)
+	archive, err := sealBackup(data, config.Backup.Passphrase)
+	if err != nil {
+		respondServiceError(c, err)
+		return
+	}
+
+	auditChange(c, "backup.create", "system", nil, gin.H{"users": len(data.Users), "documents": len(data.Documents)})
+	c.Header("Cache-Control", "no-store")
+	c.Header("Content-Disposition", `attachment; filename="`+backupFilename(now)+`"`)
+	c.Data(http.StatusOK, "application/octet-stream", archive)
+}
+
+// restoreBackup loads an archive, or with ?dry_run=true reports what it
+// would change (admin only)
+func (s *Server) restoreBackup(c *gin.Context) {
+	if config.Backup.Passphrase == "" {
+		respondError(c, http.StatusServiceUnavailable, codeNotConfigured, errBackupsNotConfigured.Error())
+		return
+	}
+	dryRun := c.Query("dry_run") == "true"
+	archive, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		respondError(c, http.StatusRequestEntityTooLarge, codePayloadTooLarge, "Backup is too large")
+		return
+	}
+	data, err := openBackup(archive, config.Backup.Passphrase)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, codeInvalidRequest, errBackupUnreadable.Error())
+		return
+	}
+	if err := checkBackup(data); err != nil {
+		respondError(c, http.StatusBadRequest, codeInvalidRequest, "Backup cannot be restored: "+err.Error())
+		return
+	}
+
+	plan, err := s.svc.Restore(data, dryRun)
+	if err != nil {
+		respondPhoneError(c, err)
+		return
+	}
+	if !dryRun {
+		auditChange(c, "backup.restore", "system", nil, gin.H{
+			"backup_created_at": data.CreatedAt,
+			"users":             gin.H{"created": len(plan.Users.Create), "updated": len(plan.Users.Update), "deleted": len(plan.Users.Delete)},
+			"documents":         gin.H{"created": len(plan.Documents.Create), "updated": len(plan.Documents.Update), "deleted": len(plan.Documents.Delete)},
+			"orgs":              gin.H{"created": len(plan.Orgs.Create), "updated": len(plan.Orgs.Update), "deleted": len(plan.Orgs.Delete)},
+			"oauth_clients":     gin.H{"created": len(plan.OAuthClients.Create), "updated": len(plan.OAuthClients.Update), "deleted": len(plan.OAuthClients.Delete)},
+		})
+	}
+	c.JSON(http.StatusOK, plan)
+}
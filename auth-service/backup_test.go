@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testBackupPassphrase = "correct horse battery staple"
+
+func TestBackupArchive(t *testing.T) {
+	data := BackupData{
+		Version:   backupFormatVersion,
+		CreatedAt: time.Now().UTC().Truncate(time.Second),
+		Users:     []sharedUser{{ID: "u1", Email: "a@example.com", PasswordHash: "hash", Role: "admin"}},
+		Documents: []BackupDocument{{Filename: "plan.pdf", Owner: "u1", sharedDocumentMeta: sharedDocumentMeta{OrgWide: true, Tags: []string{"q3"}}}},
+	}
+	archive, err := sealBackup(data, testBackupPassphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(archive), "a@example.com") {
+		t.Fatal("archive is not encrypted")
+	}
+
+	got, err := openBackup(archive, testBackupPassphrase)
+	if err != nil || len(got.Users) != 1 || got.Users[0].PasswordHash != "hash" ||
+		len(got.Documents) != 1 || !got.Documents[0].OrgWide || got.Documents[0].Tags[0] != "q3" {
+		t.Fatalf("openBackup = %+v, %v", got, err)
+	}
+	if _, err := openBackup(archive, "another passphrase entirely"); err != errBackupUnreadable {
+		t.Fatalf("wrong passphrase: %v", err)
+	}
+	archive[len(archive)-1] ^= 1
+	if _, err := openBackup(archive, testBackupPassphrase); err != errBackupUnreadable {
+		t.Fatalf("corrupted archive: %v", err)
+	}
+}
+
+func TestCheckBackup(t *testing.T) {
+	admin := sharedUser{ID: "u1", Email: "a@example.com", Role: "admin"}
+	user := sharedUser{ID: "u2", Email: "b@example.com", Role: "user"}
+	cases := map[string]BackupData{
+		"no admin":        {Users: []sharedUser{user}},
+		"disabled admin":  {Users: []sharedUser{{ID: "u1", Email: "a@example.com", Role: "admin", Status: UserDisabled}}},
+		"duplicate email": {Users: []sharedUser{admin, {ID: "u2", Email: "a@example.com"}}},
+		"unknown owner":   {Users: []sharedUser{admin}, Documents: []BackupDocument{{Filename: "x.pdf", Owner: "u9"}}},
+		"newer version":   {Version: backupFormatVersion + 1, Users: []sharedUser{admin}},
+		"unknown org":     {Users: []sharedUser{admin, {ID: "u2", Email: "b@example.com", OrgID: "acme"}}},
+		"duplicate org":   {Users: []sharedUser{admin}, Orgs: []*Org{{ID: "acme"}, {ID: "acme"}}},
+		"duplicate client": {Users: []sharedUser{admin}, OAuthClients: []storedOAuthClient{
+			{OAuthClient: &OAuthClient{ID: "c1"}}, {OAuthClient: &OAuthClient{ID: "c1"}},
+		}},
+	}
+	for name, data := range cases {
+		if data.Version == 0 {
+			data.Version = backupFormatVersion
+		}
+		if err := checkBackup(data); err == nil {
+			t.Errorf("%s: accepted", name)
+		}
+	}
+	member := sharedUser{ID: "u3", Email: "c@example.com", OrgID: "acme"}
+	valid := BackupData{Version: backupFormatVersion, Users: []sharedUser{admin, user, member}, Documents: []BackupDocument{{Filename: "x.pdf", Owner: "u2"}},
+		Orgs: []*Org{{ID: "acme"}}}
+	if err := checkBackup(valid); err != nil {
+		t.Fatal(err)
+	}
+	// Archives from before orgs were backed up keep the current orgs
+	useOrgs(t)
+	legacy := BackupData{Version: 1, Users: []sharedUser{admin, member}}
+	if err := checkBackup(legacy); err == nil {
+		t.Fatal("version 1 archive with an unknown org accepted")
+	}
+	orgs["acme"] = &Org{ID: "acme"}
+	if err := checkBackup(legacy); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBackupRestoresOrgsAndClients(t *testing.T) {
+	useOrgs(t)
+	useOAuthClients(t)
+	ts := newTestServer(t)
+	withConfig(t, func(cfg *Config) { cfg.Backup.Passphrase = testBackupPassphrase })
+	admin := ts.admin("admin@example.com")
+	_, bobID := ts.register("bob@example.com")
+	if w := ts.do(http.MethodPost, "/v1/admin/orgs", admin, `{"id":"acme","name":"Acme"}`); w.Code != http.StatusCreated {
+		t.Fatalf("create org: %d %s", w.Code, w.Body)
+	}
+	if w := ts.do(http.MethodPatch, "/v1/admin/users/"+bobID, admin, `{"org_id":"acme"}`); w.Code != http.StatusOK {
+		t.Fatalf("join org: %d %s", w.Code, w.Body)
+	}
+	client := ts.registerClient(admin, `{"name":"Partner","redirect_uris":["`+testRedirectURI+`"],"scopes":["`+scopeDocumentsRead+`"]}`)
+
+	w := ts.do(http.MethodPost, "/v1/admin/backup", admin, "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("backup: %d %s", w.Code, w.Body)
+	}
+	archive := w.Body.String()
+
+	// Lose both, then add an org the backup doesn't know
+	ts.do(http.MethodPatch, "/v1/admin/users/"+bobID, admin, `{"org_id":""}`)
+	if w := ts.do(http.MethodDelete, "/v1/admin/orgs/acme", admin, ""); w.Code != http.StatusOK {
+		t.Fatalf("delete org: %d %s", w.Code, w.Body)
+	}
+	ts.do(http.MethodDelete, "/v1/admin/oauth/clients/"+client.ID, admin, "")
+	ts.do(http.MethodPost, "/v1/admin/orgs", admin, `{"id":"later","name":"Later"}`)
+
+	w = ts.do(http.MethodPost, "/v1/admin/restore?dry_run=true", admin, archive, "Content-Type", "application/octet-stream")
+	var plan RestorePlan
+	decodeJSON(t, w, &plan)
+	if len(plan.Orgs.Create) != 1 || plan.Orgs.Create[0].ID != "acme" || len(plan.Orgs.Delete) != 1 || plan.Orgs.Delete[0].ID != "later" ||
+		len(plan.OAuthClients.Create) != 1 || plan.OAuthClients.Create[0].ID != client.ID {
+		t.Fatalf("dry run: %+v", plan)
+	}
+
+	if w := ts.do(http.MethodPost, "/v1/admin/restore", admin, archive, "Content-Type", "application/octet-stream"); w.Code != http.StatusOK {
+		t.Fatalf("restore: %d %s", w.Code, w.Body)
+	}
+	if _, found := lookupOrg("acme"); !found {
+		t.Fatal("org not restored")
+	}
+	if _, found := lookupOrg("later"); found {
+		t.Fatal("org created after the backup survived the restore")
+	}
+	if ts.srv.svc.users.ByID(bobID).OrgID != "acme" {
+		t.Fatal("membership not restored")
+	}
+	restored, found := lookupOAuthClient(client.ID)
+	if !found || restored.secretHash != hashClientSecret(client.ClientSecret) {
+		t.Fatalf("client not restored with its secret: %+v", restored)
+	}
+}
+
+func TestBackupAndRestore(t *testing.T) {
+	t.Run("standalone", testBackupAndRestore)
+	t.Run("clustered", func(t *testing.T) {
+		useSharedStore(t)
+		testBackupAndRestore(t)
+	})
+}
+
+func testBackupAndRestore(t *testing.T) {
+	ts := newTestServer(t)
+	withConfig(t, func(cfg *Config) { cfg.Backup.Passphrase = testBackupPassphrase })
+	admin := ts.admin("admin@example.com")
+	_, bobID := ts.register("bob@example.com")
+	svc := ts.srv.svc
+	if _, err := svc.ClaimDocument("plan.pdf", bobID); err != nil {
+		t.Fatal(err)
+	}
+
+	w := ts.do(http.MethodPost, "/v1/admin/backup", admin, "")
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/octet-stream" ||
+		!strings.Contains(w.Header().Get("Content-Disposition"), backupFilePrefix) {
+		t.Fatalf("backup: %d %v", w.Code, w.Header())
+	}
+	archive := w.Body.String()
+
+	// Diverge: a new user, a renamed one, a document swapped for another
+	_, carolID := ts.register("carol@example.com")
+	bob := svc.users.ByID(bobID)
+	bob.Name = "Robert"
+	svc.ReleaseDocument("plan.pdf", bob)
+	svc.ClaimDocument("new.pdf", carolID)
+
+	restore := func(query string) (RestorePlan, int) {
+		w := ts.do(http.MethodPost, "/v1/admin/restore"+query, admin, archive, "Content-Type", "application/octet-stream")
+		var plan RestorePlan
+		if w.Code == http.StatusOK {
+			decodeJSON(t, w, &plan)
+		}
+		return plan, w.Code
+	}
+	plan, code := restore("?dry_run=true")
+	if code != http.StatusOK || !plan.DryRun || len(plan.Users.Create) != 0 ||
+		len(plan.Users.Update) != 1 || plan.Users.Update[0].ID != bobID || plan.Users.Update[0].Changes[0] != "name" ||
+		len(plan.Users.Delete) != 1 || plan.Users.Delete[0].ID != carolID ||
+		len(plan.Documents.Create) != 1 || plan.Documents.Create[0].ID != "plan.pdf" ||
+		len(plan.Documents.Delete) != 1 || plan.Documents.Delete[0].ID != "new.pdf" {
+		t.Fatalf("dry run: %d %+v", code, plan)
+	}
+	if svc.users.ByID(carolID) == nil || svc.DocumentOwner("new.pdf") != carolID {
+		t.Fatal("dry run changed state")
+	}
+
+	if plan, code = restore(""); code != http.StatusOK || plan.DryRun {
+		t.Fatalf("restore: %d %+v", code, plan)
+	}
+	if svc.users.ByID(carolID) != nil || svc.users.ByEmail("carol@example.com") != nil {
+		t.Fatal("user created after the backup survived the restore")
+	}
+	if bob.Name != "Test User" || svc.DocumentOwner("plan.pdf") != bobID || svc.DocumentOwner("new.pdf") != "" {
+		t.Fatalf("state not restored: name %q, plan.pdf %q, new.pdf %q", bob.Name, svc.DocumentOwner("plan.pdf"), svc.DocumentOwner("new.pdf"))
+	}
+	if plan, _ := restore("?dry_run=true"); len(plan.Users.Update)+len(plan.Users.Delete)+len(plan.Documents.Create)+len(plan.Documents.Delete) != 0 {
+		t.Fatalf("second restore is not a no-op: %+v", plan)
+	}
+	// Restored hashes still verify
+	ts.login("bob@example.com", "secret123", http.StatusOK)
+
+	w = ts.do(http.MethodPost, "/v1/admin/restore", admin, "not an archive", "Content-Type", "application/octet-stream")
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("garbage archive: got %d, want 400", w.Code)
+	}
+}
+
+func TestBackupNotConfigured(t *testing.T) {
+	ts := newTestServer(t)
+	withConfig(t, func(cfg *Config) { cfg.Backup.Passphrase = "" })
+	admin := ts.admin("admin@example.com")
+	if w := ts.do(http.MethodPost, "/v1/admin/backup", admin, ""); w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("backup: got %d, want 503", w.Code)
+	}
+}
+
+func TestUploadBackup(t *testing.T) {
+	ts := newTestServer(t)
+	ts.admin("admin@example.com")
+	var method, path, auth string
+	var body []byte
+	status := http.StatusOK
+	s3 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method, path, auth = r.Method, r.URL.Path, r.Header.Get("Authorization")
+		body, _ = io.ReadAll(r.Body)
+		w.WriteHeader(status)
+	}))
+	defer s3.Close()
+	withConfig(t, func(cfg *Config) {
+		cfg.Backup = BackupConfig{
+			Passphrase: testBackupPassphrase, S3Bucket: "backups", S3Region: "eu-west-1", S3Prefix: "auth",
+			S3Endpoint: s3.URL, S3AccessKeyID: "AKIDEXAMPLE", S3SecretAccessKey: "secret",
+		}
+	})
+
+	now := time.Date(2026, 10, 17, 3, 0, 0, 0, time.UTC)
+	key, err := uploadBackup(context.Background(), ts.srv.svc, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key != "auth/auth-backup-20261017T030000Z.bak" || method != http.MethodPut || path != "/backups/"+key ||
+		!strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20261017/eu-west-1/s3/") {
+		t.Fatalf("upload: key %q, %s %s, auth %q", key, method, path, auth)
+	}
+	if data, err := openBackup(body, testBackupPassphrase); err != nil || len(data.Users) != 1 {
+		t.Fatalf("uploaded archive: %+v, %v", data, err)
+	}
+
+	status = http.StatusForbidden
+	if _, err := uploadBackup(context.Background(), ts.srv.svc, now); err == nil {
+		t.Fatal("rejected upload reported success")
+	}
+}
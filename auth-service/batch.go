@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ============================================================================
+// Batch Requests
+// ============================================================================
+
+const maxBatchItems = 50
+
+// BatchItem is one sub-request in a batch. Paths are relative to the API
+// version the batch was sent to (e.g. "/users/me").
+type BatchItem struct {
+	Method  string            `json:"method" binding:"required"`
+	Path    string            `json:"path" binding:"required"`
+	Headers map[string]string `json:"headers,omitempty"` // only batchItemHeaders are passed on
+	Body    json.RawMessage   `json:"body,omitempty"`
+}
+
+// BatchRequest is the body of POST /batch
+type BatchRequest struct {
+	Requests    []BatchItem `json:"requests" binding:"required,min=1,dive"`
+	StopOnError bool        `json:"stop_on_error"`
+}
+
+// BatchResult is the outcome of one sub-request
+type BatchResult struct {
+	Index  int             `json:"index"`
+	Method string          `json:"method"`
+	Path   string          `json:"path"`
+	Status int             `json:"status"`
+	Body   json.RawMessage `json:"body,omitempty"`
+}
+
+// Sub-requests that can't be answered with a single buffered response
+var batchExcludedPaths = append([]string{"/batch", "/ws/", "/documents/upload"}, eventStreamPaths()...)
+
+// Item headers passed on to sub-requests. Anything else, X-Forwarded-For
+// and X-Real-IP above all, would let an item speak for someone else.
+var batchItemHeaders = []string{"If-Match", "If-None-Match", idempotencyKeyHeader, "Accept-Language", "Content-Type"}
+
+// eventStreamPaths returns the paths of the documented Server-Sent Events
+// routes. Their handlers run until the client goes away, which a sub-request
+// never does, so one would hold the whole batch open.
+func eventStreamPaths() []string {
+	var paths []string
+	for key, doc := range routeDocs {
+		if doc.Produces == "text/event-stream" {
+			paths = append(paths, key[strings.Index(key, " ")+1:])
+		}
+	}
+	return paths
+}
+
+// batchItemKey marks the context of a sub-request
+type batchItemKey struct{}
+
+// batchHandler runs sub-requests in order through the router with the
+// caller's credentials and returns one result per item
+func batchHandler(engine *gin.Engine, version string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Request.Context().Value(batchItemKey{}) != nil {
+			respondError(c, http.StatusBadRequest, codeInvalidRequest, "Batches can't be nested")
+			return
+		}
+		var req BatchRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			respondBindError(c, err)
+			return
+		}
+		if len(req.Requests) > maxBatchItems {
+			respondError(c, http.StatusBadRequest, codeInvalidRequest, "Too many requests in batch")
+			return
+		}
+
+		results := make([]BatchResult, 0, len(req.Requests))
+		failed := 0
+		for i, item := range req.Requests {
+			result := runBatchItem(c, engine, version, item)
+			result.Index = i
+			results = append(results, result)
+
+			if result.Status >= http.StatusBadRequest {
+				failed++
+				if req.StopOnError {
+					break
+				}
+			}
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"results":   results,
+			"succeeded": len(results) - failed,
+			"failed":    failed,
+			"skipped":   len(req.Requests) - len(results),
+		})
+	}
+}
+
+// runBatchItem executes one sub-request against the router
+func runBatchItem(c *gin.Context, engine *gin.Engine, version string, item BatchItem) BatchResult {
+	method := strings.ToUpper(item.Method)
+	result := BatchResult{Method: method, Path: item.Path}
+
+	target, err := url.Parse(item.Path)
+	if err != nil || !strings.HasPrefix(target.Path, "/") {
+		result.Status = http.StatusBadRequest
+		result.Body = batchError("Path must start with /")
+		return result
+	}
+	// Match on the path as routed: unescaped and cleaned, so /%62atch and
+	// /./batch are /batch
+	routed := strings.TrimPrefix(path.Clean(target.Path), "/"+version)
+	for _, excluded := range batchExcludedPaths {
+		if routed == strings.TrimSuffix(excluded, "/") || strings.HasPrefix(routed, strings.TrimSuffix(excluded, "/")+"/") {
+			result.Status = http.StatusBadRequest
+			result.Body = batchError("Endpoint is not available in a batch")
+			return result
+		}
+	}
+
+	ctx := context.WithValue(c.Request.Context(), batchItemKey{}, true)
+	sub, err := http.NewRequestWithContext(ctx, method, "/"+version+strings.TrimPrefix(item.Path, "/"+version), bytes.NewReader(item.Body))
+	if err != nil {
+		result.Status = http.StatusBadRequest
+		result.Body = batchError("Invalid sub-request")
+		return result
+	}
+	for name, value := range item.Headers {
+		for _, allowed := range batchItemHeaders {
+			if strings.EqualFold(name, allowed) {
+				sub.Header.Set(allowed, value)
+			}
+		}
+	}
+	// Always run as the batch caller, from the batch's address. The batch
+	// itself passed any CSRF check, so its token is passed on with the
+	// session cookie.
+	sub.Header.Set("Authorization", c.GetHeader("Authorization"))
+	sub.Header.Set("Cookie", c.GetHeader("Cookie"))
+	sub.Header.Set(csrfHeader, c.GetHeader(csrfHeader))
+	sub.Header.Set(requestIDHeader, c.GetString(requestIDContextKey))
+	for _, name := range []string{"X-Forwarded-For", "X-Real-IP"} {
+		if values := c.Request.Header.Values(name); len(values) > 0 {
+			sub.Header[http.CanonicalHeaderKey(name)] = values
+		}
+	}
+	if len(item.Body) > 0 && sub.Header.Get("Content-Type") == "" {
+		sub.Header.Set("Content-Type", "application/json")
+	}
+	sub.RemoteAddr = c.Request.RemoteAddr
+
+	recorder := httptest.NewRecorder()
+	engine.ServeHTTP(recorder, sub)
+
+	result.Status = recorder.Code
+	if body := bytes.TrimSpace(recorder.Body.Bytes()); json.Valid(body) {
+		result.Body = body
+	} else if len(body) > 0 {
+		result.Body, _ = json.Marshal(string(body))
+	}
+	return result
+}
+
+// batchError builds a problem-style body for items rejected before dispatch
+func batchError(detail string) json.RawMessage {
+	body, _ := json.Marshal(gin.H{"code": codeInvalidRequest, "detail": detail, "error": detail})
+	return body
+}
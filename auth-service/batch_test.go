@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// batchResults runs a batch and returns its per-item statuses
+func (ts *testServer) batchResults(token, body string, headers ...string) []BatchResult {
+	ts.t.Helper()
+	w := ts.do(http.MethodPost, "/v1/batch", token, body, headers...)
+	if w.Code != http.StatusOK {
+		ts.t.Fatalf("batch: %d %s", w.Code, w.Body)
+	}
+	var resp struct {
+		Results []BatchResult `json:"results"`
+	}
+	decodeJSON(ts.t, w, &resp)
+	return resp.Results
+}
+
+func TestBatch(t *testing.T) {
+	ts := newTestServer(t)
+	token, _ := ts.register("user@example.com")
+
+	results := ts.batchResults(token, `{"requests":[`+
+		`{"method":"get","path":"/users/me"},`+
+		`{"method":"POST","path":"/v1/documents/register","body":{"filename":"handbook.pdf"}},`+
+		`{"method":"GET","path":"/nope"},`+
+		`{"method":"GET","path":"users/me"}]}`)
+	if len(results) != 4 || results[0].Status != http.StatusOK || results[0].Method != http.MethodGet ||
+		results[1].Status != http.StatusCreated || results[2].Status != http.StatusNotFound || results[3].Status != http.StatusBadRequest {
+		t.Fatalf("results: %+v", results)
+	}
+
+	w := ts.do(http.MethodPost, "/v1/batch", token, `{"stop_on_error":true,"requests":[`+
+		`{"method":"GET","path":"/nope"},{"method":"GET","path":"/users/me"}]}`)
+	var stopped struct {
+		Results []BatchResult `json:"results"`
+		Failed  int           `json:"failed"`
+		Skipped int           `json:"skipped"`
+	}
+	decodeJSON(t, w, &stopped)
+	if len(stopped.Results) != 1 || stopped.Failed != 1 || stopped.Skipped != 1 {
+		t.Fatalf("stop_on_error: %+v", stopped)
+	}
+
+	if w := ts.do(http.MethodPost, "/v1/batch", "", `{"requests":[{"method":"GET","path":"/users/me"}]}`); w.Code != http.StatusUnauthorized {
+		t.Fatalf("anonymous batch: got %d, want 401", w.Code)
+	}
+}
+
+func TestBatchExcludedPaths(t *testing.T) {
+	ts := newTestServer(t)
+	token, _ := ts.register("user@example.com")
+
+	// However the path is spelled, streams, uploads and batches stay out
+	for _, path := range []string{"/batch", "/v1/batch", "/%62atch", "/users/../batch", "/./query/stream",
+		"/query/%73tream", "/documents/upload", "/ws/chat"} {
+		results := ts.batchResults(token, `{"requests":[{"method":"POST","path":"`+path+`","body":{"requests":[{"method":"GET","path":"/users/me"}]}}]}`)
+		if results[0].Status != http.StatusBadRequest {
+			t.Fatalf("%s: got %d, want 400", path, results[0].Status)
+		}
+	}
+	results := ts.batchResults(token, `{"requests":[{"method":"GET","path":"/batches"}]}`)
+	if results[0].Status != http.StatusNotFound {
+		t.Fatalf("/batches: got %d, want 404", results[0].Status)
+	}
+
+	// An event stream would hold the batch open until the client gave up
+	admin := ts.admin("admin@example.com")
+	done := make(chan []BatchResult, 1)
+	go func() {
+		done <- ts.batchResults(admin, `{"requests":[{"method":"GET","path":"/admin/events/stream"}]}`)
+	}()
+	select {
+	case results := <-done:
+		if results[0].Status != http.StatusBadRequest {
+			t.Fatalf("event stream: got %d, want 400", results[0].Status)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("event stream held the batch open")
+	}
+}
+
+func TestBatchItemHeaders(t *testing.T) {
+	withConfig(t, func(cfg *Config) {
+		cfg.Server.TrustedProxies = []string{"192.0.2.0/24"} // httptest's peer address
+	})
+	ts := newTestServer(t)
+	useNetworkRules(t, testRule(t, networkListAdminAllow, "10.0.0.0/8", nil))
+	admin := ts.admin("admin@example.com")
+
+	if w := ts.do(http.MethodGet, "/v1/admin/config", admin, "", "X-Forwarded-For", "203.0.113.9"); w.Code != http.StatusForbidden {
+		t.Fatalf("outside the admin network: got %d, want 403", w.Code)
+	}
+	// An item can't claim another address...
+	spoofed := `{"requests":[{"method":"GET","path":"/admin/config","headers":{"X-Forwarded-For":"10.1.2.3","x-real-ip":"10.1.2.3"}}]}`
+	if results := ts.batchResults(admin, spoofed, "X-Forwarded-For", "203.0.113.9"); results[0].Status != http.StatusForbidden {
+		t.Fatalf("spoofed item: got %d, want 403", results[0].Status)
+	}
+	// ...but runs from the batch's own
+	plain := `{"requests":[{"method":"GET","path":"/admin/config"}]}`
+	if results := ts.batchResults(admin, plain, "X-Forwarded-For", "10.1.2.3"); results[0].Status != http.StatusOK {
+		t.Fatalf("from the admin network: got %d, want 200", results[0].Status)
+	}
+
+	// Allowed headers pass through
+	user, _ := ts.register("user@example.com")
+	etag := ts.do(http.MethodGet, "/v1/users/me", user, "").Header().Get("ETag")
+	cached := `{"requests":[{"method":"GET","path":"/users/me","headers":{"if-none-match":` + strconv.Quote(etag) + `}}]}`
+	if results := ts.batchResults(user, cached); etag == "" || results[0].Status != http.StatusNotModified {
+		t.Fatalf("If-None-Match %s: got %d, want 304", etag, results[0].Status)
+	}
+}
+
+func TestBatchRunsAsCaller(t *testing.T) {
+	ts := newTestServer(t)
+	user, userID := ts.register("user@example.com")
+	admin := ts.admin("admin@example.com")
+
+	// Item headers can't switch the account an item runs as
+	as := `{"requests":[{"method":"GET","path":"/users/me","headers":{"Authorization":"Bearer ` + admin + `","Cookie":"session=x"}},` +
+		`{"method":"GET","path":"/users/"}]}`
+	results := ts.batchResults(user, as)
+	var me UserProfile
+	json.Unmarshal(results[0].Body, &me)
+	if results[0].Status != http.StatusOK || me.ID != userID || results[1].Status != http.StatusForbidden {
+		t.Fatalf("items as another account: %+v", results)
+	}
+
+	items := strings.Repeat(`{"method":"GET","path":"/users/me"},`, maxBatchItems+1)
+	if w := ts.do(http.MethodPost, "/v1/batch", user, `{"requests":[`+strings.TrimSuffix(items, ",")+`]}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("%d items: got %d, want 400", maxBatchItems+1, w.Code)
+	}
+}
+
+func TestBatchWithCookieSession(t *testing.T) {
+	withConfig(t, func(cfg *Config) { cfg.Session.Mode = sessionModeCookie })
+	ts := newTestServer(t)
+	w := ts.do(http.MethodPost, "/v1/auth/register", "", `{"email":"user@example.com","password":"secret123","name":"Test User"}`)
+	var resp AuthResponse
+	decodeJSON(t, w, &resp)
+	cookie := config.Session.CookieName + "=" + w.Result().Cookies()[0].Value
+	register := `{"requests":[{"method":"POST","path":"/documents/register","body":{"filename":"handbook.pdf"}}]}`
+
+	// The batch's CSRF check covers its items
+	if w := ts.do(http.MethodPost, "/v1/batch", "", register, "Cookie", cookie); w.Code != http.StatusForbidden {
+		t.Fatalf("batch without the CSRF header: got %d, want 403", w.Code)
+	}
+	results := ts.batchResults("", register, "Cookie", cookie, csrfHeader, resp.CSRFToken)
+	if results[0].Status != http.StatusCreated {
+		t.Fatalf("item in a cookie session: %+v", results)
+	}
+}
+
+func TestBatchRunsInOrder(t *testing.T) {
+	ts := newTestServer(t)
+	token, _ := ts.register("user@example.com")
+
+	// Each item sees what the ones before it did
+	w := ts.do(http.MethodPost, "/v1/batch", token, `{"requests":[`+
+		`{"method":"POST","path":"/documents/register","body":{"filename":"handbook.pdf"}},`+
+		`{"method":"GET","path":"/documents/my"},`+
+		`{"method":"DELETE","path":"/documents/handbook.pdf"},`+
+		`{"method":"DELETE","path":"/documents/handbook.pdf"}]}`)
+	var resp struct {
+		Results   []BatchResult `json:"results"`
+		Succeeded int           `json:"succeeded"`
+		Failed    int           `json:"failed"`
+		Skipped   int           `json:"skipped"`
+	}
+	decodeJSON(t, w, &resp)
+	if resp.Succeeded != 3 || resp.Failed != 1 || resp.Skipped != 0 {
+		t.Fatalf("counts: %+v", resp)
+	}
+	var mine struct {
+		Documents []string `json:"documents"`
+	}
+	json.Unmarshal(resp.Results[1].Body, &mine)
+	if len(mine.Documents) != 1 || mine.Documents[0] != "handbook.pdf" {
+		t.Fatalf("listing after registering: %s", resp.Results[1].Body)
+	}
+	for i, result := range resp.Results {
+		if result.Index != i {
+			t.Fatalf("result %d has index %d", i, result.Index)
+		}
+	}
+	if resp.Results[3].Status != http.StatusNotFound {
+		t.Fatalf("second unregister: got %d, want 404", resp.Results[3].Status)
+	}
+}
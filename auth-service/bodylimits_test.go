@@ -0,0 +1,151 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+)
+
+// bodyRouter serves a JSON route and the upload route behind validateBody()
+func bodyRouter(t *testing.T, modify func(*RequestConfig)) *gin.Engine {
+	t.Helper()
+	withConfig(t, func(cfg *Config) {
+		cfg.Request = RequestConfig{MaxBodySize: "1KB", StrictContentType: true, RejectUnknownFields: true}
+		if modify != nil {
+			modify(&cfg.Request)
+		}
+	})
+	t.Cleanup(func() { binding.EnableDecoderDisallowUnknownFields = false })
+
+	type thing struct {
+		Name string `json:"name" binding:"required"`
+	}
+	r := gin.New()
+	r.Use(validateBody())
+	r.POST("/v1/things", func(c *gin.Context) {
+		var req thing
+		if err := c.ShouldBindJSON(&req); err != nil {
+			respondBindError(c, err)
+			return
+		}
+		c.Status(http.StatusNoContent)
+	})
+	r.POST("/v1/documents/upload", func(c *gin.Context) { c.Status(http.StatusNoContent) })
+	r.GET("/v1/things", func(c *gin.Context) { c.Status(http.StatusNoContent) })
+	return r
+}
+
+// jsonOfSize returns a valid thing whose encoding is about n bytes
+func jsonOfSize(n int) string {
+	return `{"name":"` + strings.Repeat("a", n) + `"}`
+}
+
+func sendBody(r http.Handler, method, path, contentType string, body io.Reader, contentLength int64) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, body)
+	req.ContentLength = contentLength
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestBodySizeLimit(t *testing.T) {
+	r := bodyRouter(t, nil)
+	small, large := jsonOfSize(100), jsonOfSize(2048)
+
+	if w := sendBody(r, http.MethodPost, "/v1/things", "application/json", strings.NewReader(small), int64(len(small))); w.Code != http.StatusNoContent {
+		t.Fatalf("small body: got %d %s, want 204", w.Code, w.Body)
+	}
+
+	w := sendBody(r, http.MethodPost, "/v1/things", "application/json", strings.NewReader(large), int64(len(large)))
+	if w.Code != http.StatusRequestEntityTooLarge || !strings.Contains(w.Body.String(), "1KB") {
+		t.Fatalf("declared length over the limit: got %d %s, want 413", w.Code, w.Body)
+	}
+
+	// A chunked body is cut off while reading
+	w = sendBody(r, http.MethodPost, "/v1/things", "application/json", io.MultiReader(strings.NewReader(large)), -1)
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("chunked body over the limit: got %d %s, want 413", w.Code, w.Body)
+	}
+}
+
+func TestRouteBodyLimits(t *testing.T) {
+	r := bodyRouter(t, func(cfg *RequestConfig) {
+		cfg.RouteLimits = map[string]string{"POST /things": "4KB"}
+	})
+	body := jsonOfSize(2048)
+	if w := sendBody(r, http.MethodPost, "/v1/things", "application/json", strings.NewReader(body), int64(len(body))); w.Code != http.StatusNoContent {
+		t.Fatalf("within the route limit: got %d %s, want 204", w.Code, w.Body)
+	}
+
+	if got := bodyLimit("POST /documents/upload"); got != maxUploadSize+1<<20 {
+		t.Fatalf("upload limit = %d", got)
+	}
+	if got := bodyLimit("PUT /profile"); got != 1<<10 {
+		t.Fatalf("default limit = %d, want 1024", got)
+	}
+}
+
+func TestContentTypeChecks(t *testing.T) {
+	r := bodyRouter(t, nil)
+	body := jsonOfSize(10)
+
+	if w := sendBody(r, http.MethodPost, "/v1/things", "text/plain", strings.NewReader(body), int64(len(body))); w.Code != http.StatusUnsupportedMediaType {
+		t.Fatalf("text/plain: got %d, want 415", w.Code)
+	}
+	if w := sendBody(r, http.MethodPost, "/v1/things", "application/json; charset=utf-8", strings.NewReader(body), int64(len(body))); w.Code != http.StatusNoContent {
+		t.Fatalf("JSON with charset: got %d, want 204", w.Code)
+	}
+	if w := sendBody(r, http.MethodPost, "/v1/documents/upload", "application/json", strings.NewReader(body), int64(len(body))); w.Code != http.StatusUnsupportedMediaType {
+		t.Fatalf("JSON upload: got %d, want 415", w.Code)
+	}
+	if w := sendBody(r, http.MethodPost, "/v1/documents/upload", "multipart/form-data; boundary=x", strings.NewReader("--x--"), 5); w.Code != http.StatusNoContent {
+		t.Fatalf("multipart upload: got %d, want 204", w.Code)
+	}
+	if w := sendBody(r, http.MethodGet, "/v1/things", "", nil, 0); w.Code != http.StatusNoContent {
+		t.Fatalf("GET without a body: got %d, want 204", w.Code)
+	}
+
+	r = bodyRouter(t, func(cfg *RequestConfig) { cfg.StrictContentType = false })
+	if w := sendBody(r, http.MethodPost, "/v1/things", "text/plain", strings.NewReader(body), int64(len(body))); w.Code != http.StatusNoContent {
+		t.Fatalf("lenient content type: got %d, want 204", w.Code)
+	}
+}
+
+func TestUnknownFieldsRejected(t *testing.T) {
+	r := bodyRouter(t, nil)
+	body := `{"name":"a","nmae":"b"}`
+	w := sendBody(r, http.MethodPost, "/v1/things", "application/json", strings.NewReader(body), int64(len(body)))
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "nmae") {
+		t.Fatalf("unknown field: got %d %s, want 400 naming the field", w.Code, w.Body)
+	}
+}
+
+func TestParseByteSize(t *testing.T) {
+	for raw, want := range map[string]int64{
+		"1048576": 1 << 20,
+		"512KB":   512 << 10,
+		"10 mb":   10 << 20,
+		"1GB":     1 << 30,
+		"100B":    100,
+	} {
+		if got, err := parseByteSize(raw); err != nil || got != want {
+			t.Errorf("parseByteSize(%q) = %d, %v; want %d", raw, got, err, want)
+		}
+	}
+	for _, raw := range []string{"", "0", "-1MB", "ten MB", "1TB"} {
+		if _, err := parseByteSize(raw); err == nil {
+			t.Errorf("parseByteSize(%q) accepted", raw)
+		}
+	}
+	if got := formatByteSize(10 << 20); got != "10MB" {
+		t.Errorf("formatByteSize = %q, want 10MB", got)
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestBulkUserDocuments(t *testing.T) {
+	ts := newTestServer(t)
+	admin := ts.admin("admin@example.com")
+	adminID := ts.srv.svc.users.ByEmail("admin@example.com").ID
+	leaver, leaverID := ts.register("leaver@example.com")
+	other, _ := ts.register("other@example.com")
+	for _, filename := range []string{"a.pdf", "b.pdf", "c.pdf"} {
+		ts.do(http.MethodPost, "/v1/documents/register", leaver, `{"filename":"`+filename+`"}`)
+	}
+	ts.do(http.MethodPost, "/v1/documents/register", other, `{"filename":"x.pdf"}`)
+	bulk := func(userID, body string) (int, BulkDocumentsResponse) {
+		t.Helper()
+		w := ts.do(http.MethodPost, "/v1/admin/users/"+userID+"/documents:bulk", admin, body)
+		var resp BulkDocumentsResponse
+		if w.Code == http.StatusOK {
+			decodeJSON(t, w, &resp)
+		}
+		return w.Code, resp
+	}
+
+	code, resp := bulk(leaverID, `{"action":"transfer","target_id":"`+adminID+`","dry_run":true}`)
+	if code != http.StatusOK || !resp.DryRun || resp.Succeeded != 3 || resp.Failed != 0 {
+		t.Fatalf("dry run: %d %+v", code, resp)
+	}
+	if docs := ts.srv.svc.DocumentsOf(leaverID); len(docs) != 3 {
+		t.Fatalf("dry run moved documents: %v", docs)
+	}
+
+	code, resp = bulk(leaverID, `{"action":"retag","filenames":["a.pdf","x.pdf"],"tags":["Finance"," finance","q3"]}`)
+	if code != http.StatusOK || resp.Succeeded != 1 || resp.Results[1].Code != codeDocumentOwned {
+		t.Fatalf("retag: %d %+v", code, resp)
+	}
+	if tags := ts.srv.svc.DocumentTags("a.pdf"); !reflect.DeepEqual(tags, []string{"finance", "q3"}) {
+		t.Fatalf("tags = %v", tags)
+	}
+
+	if code, _ := bulk(leaverID, `{"action":"transfer"}`); code != http.StatusBadRequest {
+		t.Fatalf("transfer without target: got %d, want 400", code)
+	}
+	if code, _ := bulk(leaverID, `{"action":"transfer","target_id":"`+leaverID+`"}`); code != http.StatusBadRequest {
+		t.Fatalf("transfer to owner: got %d, want 400", code)
+	}
+	if w := ts.do(http.MethodPost, "/v1/admin/users/"+leaverID+"/documentsX", admin, `{"action":"retag"}`); w.Code != http.StatusNotFound {
+		t.Fatalf("near-miss path: got %d, want 404", w.Code)
+	}
+
+	code, resp = bulk(leaverID, `{"action":"transfer","target_id":"`+adminID+`"}`)
+	if code != http.StatusOK || resp.Succeeded != 3 {
+		t.Fatalf("transfer: %d %+v", code, resp)
+	}
+	if docs := ts.srv.svc.DocumentsOf(adminID); len(docs) != 3 || len(ts.srv.svc.DocumentsOf(leaverID)) != 0 {
+		t.Fatalf("admin documents = %v", docs)
+	}
+	if tags := ts.srv.svc.DocumentTags("a.pdf"); len(tags) != 2 {
+		t.Fatalf("transfer dropped tags: %v", tags)
+	}
+
+	code, resp = bulk(adminID, `{"action":"unregister","filenames":["a.pdf","missing.pdf"]}`)
+	if code != http.StatusOK || resp.Succeeded != 1 || resp.Results[1].Code != codeNotFound {
+		t.Fatalf("unregister: %d %+v", code, resp)
+	}
+	if owner := ts.srv.svc.DocumentOwner("a.pdf"); owner != "" {
+		t.Fatalf("a.pdf still owned by %s", owner)
+	}
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ============================================================================
+// Chunking Settings
+// ============================================================================
+//
+// How the RAG backend splits a document into chunks is decided here and
+// sent with every upload, so the settings live in one place rather than in
+// each backend replica. A document's settings are resolved field by field:
+// its own override (PUT /documents/:filename/chunking), then the profile of
+// its collection, then chunking.splitter/size/overlap. A collection is a
+// document tag with a profile under chunking.collections; a document with
+// several such tags uses the first in alphabetical order.
+//
+// The record keeps the settings a document was last chunked with.
+// Changing a document's override re-chunks it at once. Documents whose
+// collection or the defaults changed in the configuration are stale until
+// re-chunked: POST /admin/reindex with stale_chunking covers only those,
+// and with chunking.rechunk_on_change such a campaign starts by itself at
+// startup. Its documents are checked again as it reaches them, so
+// replicas starting the same campaign don't chunk a document twice.
+// Documents ingested before settings were recorded count as chunked with
+// the backend's built-in defaults.
+
+// Splitters the backend offers
+const (
+	splitterRecursive = "recursive" // paragraphs, then sentences, then words
+	splitterSemantic  = "semantic"  // where the topic shifts, by embedding similarity
+	splitterPage      = "page"      // one chunk per page, split further if longer than size
+)
+
+var splitters = []string{splitterRecursive, splitterSemantic, splitterPage}
+
+const (
+	minChunkSize = 100
+	maxChunkSize = 10000
+)
+
+// backendChunking is what the backend used before settings were sent
+var backendChunking = ChunkingSettings{Splitter: splitterRecursive, Size: 350, Overlap: 35}
+
+var errNotChunkingOwner = errors.New("Only the document's owner can change its chunking")
+
+// chunkingError explains why settings were refused
+type chunkingError struct {
+	Reason string
+}
+
+func (e *chunkingError) Error() string {
+	return "Invalid chunking settings: " + e.Reason
+}
+
+// ChunkingSettings say how a document is split. In overrides and profiles
+// zero fields inherit, so only chunking.overlap can turn overlap off.
+type ChunkingSettings struct {
+	Splitter string `json:"splitter,omitempty" yaml:"splitter" bson:"splitter,omitempty"` // recursive | semantic | page
+	Size     int    `json:"size,omitempty" yaml:"size" bson:"size,omitempty"`             // characters per chunk
+	Overlap  int    `json:"overlap,omitempty" yaml:"overlap" bson:"overlap,omitempty"`    // characters repeated from the previous chunk
+}
+
+// DocumentChunking for GET and PUT /documents/:filename/chunking
+type DocumentChunking struct {
+	Filename    string            `json:"filename"`
+	Override    *ChunkingSettings `json:"override"`     // null inherits everything
+	Effective   ChunkingSettings  `json:"effective"`    // what the next upload uses
+	ChunkedWith ChunkingSettings  `json:"chunked_with"` // what the backend holds now
+	Stale       bool              `json:"stale"`
+}
+
+// over fills s's zero fields from base
+func (s ChunkingSettings) over(base ChunkingSettings) ChunkingSettings {
+	if s.Splitter == "" {
+		s.Splitter = base.Splitter
+	}
+	if s.Size == 0 {
+		s.Size = base.Size
+	}
+	if s.Overlap == 0 {
+		s.Overlap = base.Overlap
+	}
+	return s
+}
+
+// check validates resolved settings
+func (s ChunkingSettings) check() error {
+	if !slices.Contains(splitters, s.Splitter) {
+		return &chunkingError{Reason: fmt.Sprintf("splitter must be one of %s", strings.Join(splitters, ", "))}
+	}
+	if s.Size < minChunkSize || s.Size > maxChunkSize {
+		return &chunkingError{Reason: fmt.Sprintf("size must be between %d and %d", minChunkSize, maxChunkSize)}
+	}
+	if s.Overlap < 0 || s.Overlap*2 > s.Size {
+		return &chunkingError{Reason: "overlap must be between 0 and half the size"}
+	}
+	return nil
+}
+
+// defaultChunking is chunking.splitter, size and overlap
+func defaultChunking() ChunkingSettings {
+	return ChunkingSettings{Splitter: config.Chunking.Splitter, Size: config.Chunking.Size, Overlap: config.Chunking.Overlap}
+}
+
+// resolveChunking returns the settings a document is chunked with
+func resolveChunking(record documentRecord) ChunkingSettings {
+	settings := defaultChunking()
+	for _, tag := range record.Tags { // sorted
+		if profile, ok := config.Chunking.Collections[tag]; ok {
+			settings = profile.over(settings)
+			break
+		}
+	}
+	if record.Chunking != nil {
+		settings = record.Chunking.over(settings)
+	}
+	return settings
+}
+
+func sameChunking(a, b *ChunkingSettings) bool {
+	return (a == nil) == (b == nil) && (a == nil || *a == *b)
+}
+
+// chunkedWith returns the settings a document was last chunked with
+func chunkedWith(record documentRecord) ChunkingSettings {
+	if record.ChunkedWith == nil {
+		return backendChunking
+	}
+	return *record.ChunkedWith
+}
+
+func documentChunking(filename string, record documentRecord) DocumentChunking {
+	view := DocumentChunking{
+		Filename:    filename,
+		Override:    record.Chunking,
+		Effective:   resolveChunking(record),
+		ChunkedWith: chunkedWith(record),
+	}
+	view.Stale = view.Effective != view.ChunkedWith
+	return view
+}
+
+// ChunkingFor returns the settings to upload a document with
+func (s *Service) ChunkingFor(filename string) ChunkingSettings {
+	settings := defaultChunking()
+	s.documents.View(func(tx DocumentTx) {
+		if record, exists := tx.get(filename); exists {
+			settings = resolveChunking(record)
+		}
+	})
+	return settings
+}
+
+// MarkChunked records the settings the backend chunked a document with
+func (s *Service) MarkChunked(filename string, settings ChunkingSettings) {
+	s.documents.Update(func(tx DocumentTx) error {
+		if record, exists := tx.get(filename); exists && (record.ChunkedWith == nil || *record.ChunkedWith != settings) {
+			record.ChunkedWith = &settings
+			tx.put(filename, record)
+			saveDocumentMeta(filename, documentMeta(record))
+		}
+		return nil
+	})
+}
+
+// ChunkingStale reports whether a document's chunks were made with settings
+// other than its current ones
+func (s *Service) ChunkingStale(filename string) bool {
+	stale := false
+	s.documents.View(func(tx DocumentTx) {
+		if record, exists := tx.get(filename); exists {
+			stale = documentChunking(filename, record).Stale
+		}
+	})
+	return stale
+}
+
+// StaleChunking lists the documents to re-chunk, sorted
+func (s *Service) StaleChunking() []string {
+	var stale []string
+	s.documents.View(func(tx DocumentTx) {
+		tx.each(func(filename string, record documentRecord) {
+			if documentChunking(filename, record).Stale {
+				stale = append(stale, filename)
+			}
+		})
+	})
+	sort.Strings(stale)
+	return stale
+}
+
+// DocumentChunking returns the settings of a document the user can read
+func (s *Service) DocumentChunking(filename string, user *User) (DocumentChunking, error) {
+	var view DocumentChunking
+	var err error
+	s.documents.View(func(tx DocumentTx) {
+		var record documentRecord
+		if record, err = s.readableRecord(tx, filename, user); err == nil {
+			view = documentChunking(filename, record)
+		}
+	})
+	return view, err
+}
+
+// SetDocumentChunking replaces a document's override; nil or empty
+// settings inherit everything again
+func (s *Service) SetDocumentChunking(filename string, user *User, override *ChunkingSettings) (before, after DocumentChunking, err error) {
+	if override != nil && *override == (ChunkingSettings{}) {
+		override = nil
+	}
+	err = s.documents.Update(func(tx DocumentTx) error {
+		record, err := s.readableRecord(tx, filename, user)
+		if err != nil {
+			return err
+		}
+		if record.Owner != user.ID && user.Role != "admin" {
+			return errNotChunkingOwner
+		}
+		before = documentChunking(filename, record)
+		record.Chunking = override
+		after = documentChunking(filename, record)
+		if err := after.Effective.check(); err != nil {
+			return err
+		}
+		tx.put(filename, record)
+		saveDocumentMeta(filename, documentMeta(record))
+		return nil
+	})
+	return before, after, err
+}
+
+// Rechunk uploads a document again in the background so the backend chunks
+// it with its current settings
+func (s *Service) Rechunk(filename string) {
+	goBackground(func(ctx context.Context) {
+		ctx, cancel := context.WithTimeout(ctx, jobAttemptLimit)
+		defer cancel()
+		if err := s.Reindex(ctx, filename); err != nil {
+			slog.Warn("Re-chunk failed", "file", filename, "error", err)
+		}
+	})
+}
+
+// startStaleRechunk starts a campaign over stale documents when
+// chunking.rechunk_on_change is set
+func startStaleRechunk() {
+	if !config.Chunking.RechunkOnChange {
+		return
+	}
+	stale := defaultService.StaleChunking()
+	if len(stale) == 0 {
+		return
+	}
+	campaignMutex.Lock()
+	defer campaignMutex.Unlock()
+	if activeCampaign() != nil {
+		return
+	}
+	campaign := launchCampaign(StartReindexRequest{StaleChunking: true}, "system", stale)
+	slog.Info("Re-chunking documents whose settings changed", "campaign_id", campaign.ID, "documents", len(stale))
+}
+
+// ----------------------------------------------------------------------------
+// Handlers
+// ----------------------------------------------------------------------------
+
+// respondChunkingError maps chunking errors to problems
+func respondChunkingError(c *gin.Context, err error) {
+	var invalid *chunkingError
+	switch {
+	case errors.As(err, &invalid):
+		respondProblem(c, Problem{
+			Status:     http.StatusBadRequest,
+			Code:       codeInvalidRequest,
+			Detail:     "Invalid chunking settings",
+			Extensions: map[string]interface{}{"reason": invalid.Reason},
+		})
+	case err == errNotChunkingOwner:
+		respondError(c, http.StatusForbidden, codeForbidden, err.Error())
+	default:
+		respondServiceError(c, err)
+	}
+}
+
+// getDocumentChunking shows the chunking settings of a document the current
+// user can read
+func (s *Server) getDocumentChunking(c *gin.Context) {
+	view, err := s.svc.DocumentChunking(c.Param("filename"), c.MustGet("user").(*User))
+	if err != nil {
+		respondChunkingError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, view)
+}
+
+// setDocumentChunking overrides a document's settings and re-chunks it if
+// they changed (owner or admin)
+func (s *Server) setDocumentChunking(c *gin.Context) {
+	var req ChunkingSettings
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondBindError(c, err)
+		return
+	}
+	filename := c.Param("filename")
+	before, after, err := s.svc.SetDocumentChunking(filename, c.MustGet("user").(*User), &req)
+	if err != nil {
+		respondChunkingError(c, err)
+		return
+	}
+	auditChange(c, "document.chunking", "document:"+filename, before, after)
+	if after.Stale {
+		s.svc.Rechunk(filename)
+	}
+	c.JSON(http.StatusOK, gin.H{"chunking": after, "rechunking": after.Stale})
+}
+
+// getChunkingSettings shows the defaults, collection profiles and how many
+// documents await re-chunking (admin)
+func (s *Server) getChunkingSettings(c *gin.Context) {
+	collections := config.Chunking.Collections
+	if collections == nil {
+		collections = map[string]ChunkingSettings{}
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"defaults":    defaultChunking(),
+		"collections": collections,
+		"splitters":   splitters,
+		"stale":       len(s.svc.StaleChunking()),
+	})
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestChunkingResolution(t *testing.T) {
+	ts := newTestServer(t)
+	owner, ownerID := ts.register("owner@example.com")
+	ts.do(http.MethodPost, "/v1/documents/register", owner, `{"filename":"a.pdf"}`)
+	ts.do(http.MethodPost, "/v1/documents/register", owner, `{"filename":"b.pdf"}`)
+
+	if got := ts.srv.svc.ChunkingFor("a.pdf"); got != backendChunking {
+		t.Fatalf("defaults: %+v", got)
+	}
+	if stale := ts.srv.svc.StaleChunking(); len(stale) != 0 {
+		t.Fatalf("documents are stale before any change: %v", stale)
+	}
+
+	withConfig(t, func(cfg *Config) {
+		cfg.Chunking.Collections = map[string]ChunkingSettings{"contracts": {Splitter: splitterPage, Size: 2000}}
+	})
+	ts.srv.svc.BulkDocuments(ownerID, "retag", []string{"a.pdf"}, "", []string{"contracts", "legal"}, false)
+	want := ChunkingSettings{Splitter: splitterPage, Size: 2000, Overlap: 35}
+	if got := ts.srv.svc.ChunkingFor("a.pdf"); got != want {
+		t.Fatalf("collection profile: got %+v, want %+v", got, want)
+	}
+	if stale := ts.srv.svc.StaleChunking(); len(stale) != 1 || stale[0] != "a.pdf" {
+		t.Fatalf("stale after a profile change: %v", stale)
+	}
+	ts.srv.svc.MarkChunked("a.pdf", want)
+	if ts.srv.svc.ChunkingStale("a.pdf") {
+		t.Fatal("still stale after re-chunking")
+	}
+}
+
+func TestDocumentChunkingEndpoint(t *testing.T) {
+	ts := newTestServer(t)
+	owner, _ := ts.register("owner@example.com")
+	reader, _ := ts.register("reader@example.com")
+	ts.do(http.MethodPost, "/v1/documents/register", owner, `{"filename":"a.pdf"}`)
+	tomorrow := time.Now().AddDate(0, 0, 1).Format(time.RFC3339)
+	ts.do(http.MethodPost, "/v1/documents/a.pdf/grants", owner, `{"email":"reader@example.com","expires_at":"`+tomorrow+`"}`)
+
+	uploads := make(chan [3]string, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			w.Write([]byte("contract text"))
+			return
+		}
+		uploads <- [3]string{r.FormValue("splitter"), r.FormValue("chunk_size"), r.FormValue("chunk_overlap")}
+	}))
+	defer backend.Close()
+	withConfig(t, func(cfg *Config) { cfg.RAGBackend.URL = backend.URL })
+
+	if w := ts.do(http.MethodPut, "/v1/documents/a.pdf/chunking", owner, `{"size":50}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("size below the minimum: got %d, want 400", w.Code)
+	}
+	if w := ts.do(http.MethodPut, "/v1/documents/a.pdf/chunking", owner, `{"overlap":300}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("overlap above half the size: got %d, want 400", w.Code)
+	}
+	if w := ts.do(http.MethodPut, "/v1/documents/a.pdf/chunking", reader, `{"size":1000}`); w.Code != http.StatusForbidden {
+		t.Fatalf("reader changing settings: got %d, want 403", w.Code)
+	}
+
+	var resp struct {
+		Chunking   DocumentChunking `json:"chunking"`
+		Rechunking bool             `json:"rechunking"`
+	}
+	decodeJSON(t, ts.do(http.MethodPut, "/v1/documents/a.pdf/chunking", owner, `{"splitter":"semantic","size":1000}`), &resp)
+	if !resp.Rechunking || resp.Chunking.Effective != (ChunkingSettings{Splitter: splitterSemantic, Size: 1000, Overlap: 35}) {
+		t.Fatalf("override: %+v", resp)
+	}
+	select {
+	case got := <-uploads:
+		if got != [3]string{"semantic", "1000", "35"} {
+			t.Fatalf("re-chunk sent %v", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("document was not re-chunked")
+	}
+
+	var view DocumentChunking
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		decodeJSON(t, ts.do(http.MethodGet, "/v1/documents/a.pdf/chunking", reader, ""), &view)
+		if !view.Stale || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if view.Stale || view.ChunkedWith.Size != 1000 {
+		t.Fatalf("after re-chunking: %+v", view)
+	}
+}
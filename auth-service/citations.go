@@ -0,0 +1,324 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ============================================================================
+// Citations
+// ============================================================================
+//
+// Retrieval says which documents a query read (accesslog.go); citations say
+// which of them the generated answer actually relied on. After generating
+// an answer the gateway reports the chunks it cited to POST
+// /internal/access/citations, one report per answer. Citations of documents
+// the user can't read are dropped, as are those of unknown documents.
+//
+// Counts are kept per document and day for statsRetention, in memory on the
+// instance that received the callback, and belong to the document's owner
+// at the time: a document registered again by someone else starts from
+// zero. GET /documents/:filename/citations shows a document's counts and
+// its most cited chunks to anyone who can read it; GET /admin/citations
+// ranks the most cited sources and counts the documents no answer cited.
+// Both take ?period= like /admin/stats.
+
+const (
+	maxCitedChunks    = 20  // per document summary
+	defaultTopSources = 20  // GET /admin/citations without ?limit=
+	maxTopSources     = 200 // and its largest ?limit=
+)
+
+// CitedChunk is one chunk an answer cited
+type CitedChunk struct {
+	Filename string `json:"filename" binding:"required,max=255"`
+	ChunkID  string `json:"chunk_id,omitempty" binding:"max=128"`
+	Page     int    `json:"page,omitempty" binding:"min=0"`
+}
+
+// CitationReport for POST /internal/access/citations
+type CitationReport struct {
+	UserID    string       `json:"user_id" binding:"required"`
+	QueryID   string       `json:"query_id,omitempty" binding:"max=128"`
+	Citations []CitedChunk `json:"citations" binding:"required,max=1000,dive"`
+}
+
+// ChunkCitations is how often one chunk of a document was cited
+type ChunkCitations struct {
+	ChunkID string `json:"chunk_id,omitempty"`
+	Page    int    `json:"page,omitempty"`
+	Count   int    `json:"count"`
+}
+
+// DocumentCitations summarizes a document's citations over a period
+type DocumentCitations struct {
+	Filename    string           `json:"filename"`
+	Owner       string           `json:"owner,omitempty"` // in admin rankings
+	Citations   int              `json:"citations"`       // chunks cited
+	Answers     int              `json:"answers"`         // answers citing it at least once
+	LastCitedAt *time.Time       `json:"last_cited_at,omitempty"`
+	Chunks      []ChunkCitations `json:"chunks,omitempty"` // most cited first
+}
+
+// citedChunk identifies a chunk within a document
+type citedChunk struct {
+	chunkID string
+	page    int
+}
+
+// citationDay is one document's citations on one UTC day
+type citationDay struct {
+	citations int
+	answers   int
+	lastAt    time.Time
+	chunks    map[citedChunk]int
+}
+
+// documentCitationLog is a document's days, for the owner who held it
+type documentCitationLog struct {
+	owner string
+	days  map[int64]*citationDay // unix day -> counts
+}
+
+var (
+	citationLogs  = make(map[string]*documentCitationLog) // filename -> log
+	citationMutex sync.Mutex
+)
+
+func unixDay(t time.Time) int64 {
+	return t.Unix() / 86400
+}
+
+// RecordCitations counts the chunks an answer cited; it returns how many
+// were counted
+func (s *Service) RecordCitations(user *User, report CitationReport, now time.Time) int {
+	owners := make(map[string]string)
+	s.documents.View(func(tx DocumentTx) {
+		for _, cited := range report.Citations {
+			if _, seen := owners[cited.Filename]; seen {
+				continue
+			}
+			owner := tx.owner(cited.Filename)
+			if owner != "" && user.Role != "admin" && !s.readable(tx, user, cited.Filename) {
+				owner = ""
+			}
+			owners[cited.Filename] = owner
+		}
+	})
+
+	citationMutex.Lock()
+	defer citationMutex.Unlock()
+	today, oldest := unixDay(now), unixDay(now.Add(-statsRetention))
+	answered := make(map[string]bool)
+	counted := 0
+	for _, cited := range report.Citations {
+		owner := owners[cited.Filename]
+		if owner == "" {
+			continue
+		}
+		log := citationLogs[cited.Filename]
+		if log == nil || log.owner != owner {
+			log = &documentCitationLog{owner: owner, days: make(map[int64]*citationDay)}
+			citationLogs[cited.Filename] = log
+		}
+		for day := range log.days {
+			if day < oldest {
+				delete(log.days, day)
+			}
+		}
+		day := log.days[today]
+		if day == nil {
+			day = &citationDay{chunks: make(map[citedChunk]int)}
+			log.days[today] = day
+		}
+		day.citations++
+		day.lastAt = now
+		day.chunks[citedChunk{chunkID: cited.ChunkID, page: cited.Page}]++
+		if !answered[cited.Filename] {
+			answered[cited.Filename] = true
+			day.answers++
+		}
+		counted++
+	}
+	return counted
+}
+
+// citationsSince sums a document's days from since on, with the count of
+// each chunk; callers hold citationMutex
+func citationsSince(filename, owner string, since time.Time) (DocumentCitations, map[citedChunk]int) {
+	summary := DocumentCitations{Filename: filename}
+	chunks := make(map[citedChunk]int)
+	log := citationLogs[filename]
+	if log == nil || log.owner != owner {
+		return summary, chunks
+	}
+	from := unixDay(since)
+	for unix, day := range log.days {
+		if unix < from {
+			continue
+		}
+		summary.Citations += day.citations
+		summary.Answers += day.answers
+		for chunk, count := range day.chunks {
+			chunks[chunk] += count
+		}
+		if summary.LastCitedAt == nil || day.lastAt.After(*summary.LastCitedAt) {
+			last := day.lastAt
+			summary.LastCitedAt = &last
+		}
+	}
+	return summary, chunks
+}
+
+// DocumentCitations summarizes the citations of a document the user can
+// read, with its most cited chunks
+func (s *Service) DocumentCitations(filename string, user *User, since time.Time) (DocumentCitations, error) {
+	var owner string
+	var err error
+	s.documents.View(func(tx DocumentTx) {
+		var record documentRecord
+		if record, err = s.readableRecord(tx, filename, user); err == nil {
+			owner = record.Owner
+		}
+	})
+	if err != nil {
+		return DocumentCitations{}, err
+	}
+
+	citationMutex.Lock()
+	summary, chunks := citationsSince(filename, owner, since)
+	citationMutex.Unlock()
+
+	summary.Chunks = make([]ChunkCitations, 0, len(chunks))
+	for chunk, count := range chunks {
+		summary.Chunks = append(summary.Chunks, ChunkCitations{ChunkID: chunk.chunkID, Page: chunk.page, Count: count})
+	}
+	sort.Slice(summary.Chunks, func(i, j int) bool {
+		a, b := summary.Chunks[i], summary.Chunks[j]
+		if a.Count != b.Count {
+			return a.Count > b.Count
+		}
+		if a.Page != b.Page {
+			return a.Page < b.Page
+		}
+		return a.ChunkID < b.ChunkID
+	})
+	if len(summary.Chunks) > maxCitedChunks {
+		summary.Chunks = summary.Chunks[:maxCitedChunks]
+	}
+	return summary, nil
+}
+
+// MostCited ranks registered documents by citations since a time, most
+// cited first, and counts those no answer cited
+func (s *Service) MostCited(since time.Time, limit int) (top []DocumentCitations, uncited int) {
+	owners := make(map[string]string)
+	s.documents.View(func(tx DocumentTx) {
+		tx.each(func(filename string, record documentRecord) {
+			owners[filename] = record.Owner
+		})
+	})
+
+	citationMutex.Lock()
+	for filename, owner := range owners {
+		summary, _ := citationsSince(filename, owner, since)
+		if summary.Citations == 0 {
+			uncited++
+			continue
+		}
+		summary.Owner = owner
+		top = append(top, summary)
+	}
+	citationMutex.Unlock()
+
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].Citations != top[j].Citations {
+			return top[i].Citations > top[j].Citations
+		}
+		if top[i].Answers != top[j].Answers {
+			return top[i].Answers > top[j].Answers
+		}
+		return top[i].Filename < top[j].Filename
+	})
+	if len(top) > limit {
+		top = top[:limit]
+	}
+	return top, uncited
+}
+
+// ----------------------------------------------------------------------------
+// Handlers
+// ----------------------------------------------------------------------------
+
+// citationPeriod reads ?period= (default month); it answers 400 and returns
+// false if the period is unknown
+func citationPeriod(c *gin.Context) (string, time.Time, bool) {
+	name := c.DefaultQuery("period", "month")
+	period, ok := statsPeriods[name]
+	if !ok {
+		respondError(c, http.StatusBadRequest, codeInvalidRequest, "period must be day, week, month or quarter")
+		return "", time.Time{}, false
+	}
+	return name, time.Now().UTC().Add(-period.window), true
+}
+
+// recordCitations takes the gateway's report of the chunks an answer cited
+func (s *Server) recordCitations(c *gin.Context) {
+	var report CitationReport
+	if err := c.ShouldBindJSON(&report); err != nil {
+		respondBindError(c, err)
+		return
+	}
+	user := s.svc.users.ByID(report.UserID)
+	if user == nil {
+		respondError(c, http.StatusNotFound, codeNotFound, "User not found")
+		return
+	}
+	recorded := s.svc.RecordCitations(user, report, time.Now().UTC())
+	noteQueryCitations(report.QueryID, recorded)
+	c.JSON(http.StatusOK, gin.H{"recorded": recorded})
+}
+
+// getDocumentCitations shows how often answers cited a document the current
+// user can read
+func (s *Server) getDocumentCitations(c *gin.Context) {
+	period, since, ok := citationPeriod(c)
+	if !ok {
+		return
+	}
+	summary, err := s.svc.DocumentCitations(c.Param("filename"), c.MustGet("user").(*User), since)
+	if err != nil {
+		respondServiceError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"period": period, "citations": summary})
+}
+
+// getMostCited ranks the most cited sources (admin)
+func (s *Server) getMostCited(c *gin.Context) {
+	period, since, ok := citationPeriod(c)
+	if !ok {
+		return
+	}
+	limit := defaultTopSources
+	if raw := c.Query("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 || n > maxTopSources {
+			respondError(c, http.StatusBadRequest, codeInvalidRequest,
+				fmt.Sprintf(translate(requestLanguage(c), "limit must be between 1 and %d"), maxTopSources))
+			return
+		}
+		limit = n
+	}
+	top, uncited := s.svc.MostCited(since, limit)
+	if top == nil {
+		top = []DocumentCitations{}
+	}
+	c.JSON(http.StatusOK, gin.H{"period": period, "sources": top, "count": len(top), "uncited": uncited})
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestCitations(t *testing.T) {
+	ts := newTestServer(t)
+	withConfig(t, func(cfg *Config) { cfg.Auth.InternalAPIToken = testInternalToken })
+	t.Cleanup(func() {
+		citationMutex.Lock()
+		citationLogs = make(map[string]*documentCitationLog)
+		citationMutex.Unlock()
+	})
+	admin := ts.admin("admin@example.com")
+	owner, ownerID := ts.register("owner@example.com")
+	other, _ := ts.register("other@example.com")
+	for _, filename := range []string{"handbook.pdf", "policy.pdf", "unused.pdf"} {
+		ts.do(http.MethodPost, "/v1/documents/register", owner, `{"filename":"`+filename+`"}`)
+	}
+
+	report := func(body string) int {
+		w := ts.do(http.MethodPost, "/v1/internal/access/citations", "", body, internalTokenHeader, testInternalToken)
+		var resp struct {
+			Recorded int `json:"recorded"`
+		}
+		decodeJSON(t, w, &resp)
+		return resp.Recorded
+	}
+	if n := report(`{"user_id":"` + ownerID + `","query_id":"q1","citations":[` +
+		`{"filename":"handbook.pdf","chunk_id":"c7","page":3},{"filename":"handbook.pdf","chunk_id":"c9","page":4},` +
+		`{"filename":"policy.pdf","chunk_id":"c1"},{"filename":"missing.pdf","chunk_id":"c1"}]}`); n != 3 {
+		t.Fatalf("recorded %d, want 3", n)
+	}
+	report(`{"user_id":"` + ownerID + `","citations":[{"filename":"handbook.pdf","chunk_id":"c7","page":3}]}`)
+
+	var doc struct {
+		Citations DocumentCitations `json:"citations"`
+	}
+	decodeJSON(t, ts.do(http.MethodGet, "/v1/documents/handbook.pdf/citations?period=week", owner, ""), &doc)
+	if c := doc.Citations; c.Citations != 3 || c.Answers != 2 || c.LastCitedAt == nil || len(c.Chunks) != 2 ||
+		c.Chunks[0] != (ChunkCitations{ChunkID: "c7", Page: 3, Count: 2}) {
+		t.Fatalf("handbook citations: %+v", c)
+	}
+	if w := ts.do(http.MethodGet, "/v1/documents/handbook.pdf/citations", other, ""); w.Code != http.StatusNotFound {
+		t.Fatalf("citations of an unreadable document: got %d, want 404", w.Code)
+	}
+
+	var top struct {
+		Sources []DocumentCitations `json:"sources"`
+		Uncited int                 `json:"uncited"`
+	}
+	decodeJSON(t, ts.do(http.MethodGet, "/v1/admin/citations?period=day", admin, ""), &top)
+	if len(top.Sources) != 2 || top.Sources[0].Filename != "handbook.pdf" || top.Sources[1].Filename != "policy.pdf" || top.Uncited != 1 {
+		t.Fatalf("most cited: %+v", top)
+	}
+	if w := ts.do(http.MethodGet, "/v1/admin/citations?limit=0", admin, ""); w.Code != http.StatusBadRequest {
+		t.Fatalf("limit 0: got %d, want 400", w.Code)
+	}
+}
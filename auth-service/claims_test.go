@@ -0,0 +1,96 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// planClaims puts each user's plan in their tokens and rejects tokens
+// whose plan is out of date
+type planClaims struct {
+	mu    sync.Mutex
+	plans map[string]string // email -> plan
+	extra map[string]any
+}
+
+func (p *planClaims) Name() string { return "plans" }
+
+func (p *planClaims) Claims(user *User) (map[string]any, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	claims := map[string]any{"plan": p.plans[user.Email], "features": []string{"search"}}
+	for name, value := range p.extra {
+		claims[name] = value
+	}
+	return claims, nil
+}
+
+func (p *planClaims) Validate(user *User, claims map[string]any) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if claims["plan"] != p.plans[user.Email] {
+		return errors.New("plan changed")
+	}
+	return nil
+}
+
+func withClaimsProvider(t *testing.T, provider ClaimsProvider) {
+	t.Helper()
+	previous := claimsProviders
+	RegisterClaimsProvider(provider)
+	t.Cleanup(func() { claimsProviders = previous })
+}
+
+func TestCustomClaims(t *testing.T) {
+	ts := newTestServer(t)
+	plans := &planClaims{plans: map[string]string{"a@example.com": "pro"}}
+	withClaimsProvider(t, plans)
+
+	token, _ := ts.register("a@example.com")
+	parsed, _, err := jwt.NewParser().ParseUnverified(token, jwt.MapClaims{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims := parsed.Claims.(jwt.MapClaims); claims["plan"] != "pro" || claims["email"] != "a@example.com" {
+		t.Fatalf("token claims = %v", claims)
+	}
+
+	for i := 0; i < 2; i++ { // the second check is answered from the token cache
+		w := ts.do(http.MethodGet, "/v1/auth/verify", token, "")
+		var resp struct {
+			Claims map[string]any `json:"claims"`
+		}
+		decodeJSON(t, w, &resp)
+		if w.Code != http.StatusOK || resp.Claims["plan"] != "pro" || len(resp.Claims["features"].([]any)) != 1 || resp.Claims["user_id"] != nil {
+			t.Fatalf("verify %d: %d %s", i, w.Code, w.Body)
+		}
+	}
+
+	plans.mu.Lock()
+	plans.plans["a@example.com"] = "free"
+	plans.mu.Unlock()
+	if w := ts.do(http.MethodGet, "/v1/auth/verify", token, ""); w.Code != http.StatusUnauthorized {
+		t.Fatalf("stale plan: got %d, want 401", w.Code)
+	}
+	ts.login("a@example.com", "secret123", http.StatusOK)
+}
+
+func TestCustomClaimsReserved(t *testing.T) {
+	ts := newTestServer(t)
+	ts.register("a@example.com")
+
+	for _, extra := range []map[string]any{{"role": "admin"}, {"exp": 0}} {
+		withClaimsProvider(t, &planClaims{plans: map[string]string{}, extra: extra})
+		ts.login("a@example.com", "secret123", http.StatusInternalServerError)
+		claimsProviders = nil
+	}
+
+	// Two providers may not set the same claim
+	withClaimsProvider(t, &planClaims{plans: map[string]string{}})
+	RegisterClaimsProvider(&planClaims{plans: map[string]string{}})
+	ts.login("a@example.com", "secret123", http.StatusInternalServerError)
+}
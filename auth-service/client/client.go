@@ -0,0 +1,640 @@
+// Package client is a typed Go client for the auth service's REST API.
+//
+// A Client holds the caller's bearer token. When it was created with
+// credentials (WithCredentials or a successful Login), it logs in again
+// shortly before the token expires and once more if a request comes back
+// 401. Idempotent requests are retried with backoff on network errors and
+// 429/5xx responses.
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultTimeout    = 30 * time.Second
+	defaultMaxRetries = 3
+	retryBackoffBase  = 200 * time.Millisecond
+	retryBackoffMax   = 5 * time.Second
+	refreshMargin     = time.Minute // re-login this long before expiry
+
+	apiPrefix            = "/v1"
+	internalTokenHeader  = "X-Internal-Token"
+	idempotencyKeyHeader = "Idempotency-Key"
+)
+
+// Client calls the auth service. It is safe for concurrent use.
+type Client struct {
+	baseURL       string
+	httpClient    *http.Client
+	maxRetries    int
+	internalToken string
+
+	mu        sync.Mutex
+	token     string
+	expiresAt time.Time
+	email     string
+	password  string
+}
+
+// Option configures a Client
+type Option func(*Client)
+
+// WithHTTPClient replaces the default HTTP client
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) { c.httpClient = hc }
+}
+
+// WithRetries sets how many times an idempotent request is retried
+func WithRetries(n int) Option {
+	return func(c *Client) { c.maxRetries = n }
+}
+
+// WithToken starts the client with an existing bearer token
+func WithToken(token string) Option {
+	return func(c *Client) { c.setToken(token) }
+}
+
+// WithCredentials lets the client log in on demand and refresh its token
+func WithCredentials(email, password string) Option {
+	return func(c *Client) { c.email, c.password = email, password }
+}
+
+// WithInternalToken sets the shared token for /internal endpoints
+func WithInternalToken(token string) Option {
+	return func(c *Client) { c.internalToken = token }
+}
+
+// New creates a client for the auth service at baseURL
+// (e.g. "http://localhost:8001")
+func New(baseURL string, opts ...Option) *Client {
+	c := &Client{
+		baseURL:    strings.TrimRight(baseURL, "/"),
+		httpClient: &http.Client{Timeout: defaultTimeout},
+		maxRetries: defaultMaxRetries,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// Token returns the current bearer token
+func (c *Client) Token() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.token
+}
+
+// setToken stores a token and its expiry, read from the unverified claims
+func (c *Client) setToken(token string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.token = token
+	c.expiresAt = time.Time{}
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return
+	}
+	var claims struct {
+		ExpiresAt int64 `json:"exp"`
+	}
+	if json.Unmarshal(payload, &claims) == nil && claims.ExpiresAt > 0 {
+		c.expiresAt = time.Unix(claims.ExpiresAt, 0)
+	}
+}
+
+// bearer returns a usable token, logging in first if the current one is
+// missing or about to expire and credentials are available
+func (c *Client) bearer(ctx context.Context) (string, error) {
+	c.mu.Lock()
+	token, expiresAt, email := c.token, c.expiresAt, c.email
+	c.mu.Unlock()
+
+	stale := token == "" || (!expiresAt.IsZero() && time.Until(expiresAt) < refreshMargin)
+	if stale && email != "" {
+		if err := c.relogin(ctx); err != nil {
+			return "", err
+		}
+		return c.Token(), nil
+	}
+	return token, nil
+}
+
+// relogin exchanges the stored credentials for a fresh token
+func (c *Client) relogin(ctx context.Context) error {
+	c.mu.Lock()
+	email, password := c.email, c.password
+	c.mu.Unlock()
+
+	_, err := c.Login(ctx, email, password)
+	return err
+}
+
+// request describes one API call
+type request struct {
+	method      string
+	path        string
+	body        []byte
+	contentType string
+	auth        bool // send the bearer token
+	internal    bool // send the internal token
+	idempotent  bool // safe to retry
+
+	// idempotencyKey makes a mutating request safe to retry: the server
+	// replays the first response instead of running it again
+	idempotencyKey string
+}
+
+// newIdempotencyKey returns a random key for one logical request
+func newIdempotencyKey() string {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(buf)
+}
+
+// do sends a request and decodes a JSON response into out (if non-nil)
+func (c *Client) do(ctx context.Context, req request, out interface{}) error {
+	resp, err := c.send(ctx, req)
+	if err != nil {
+		return err
+	}
+	// One re-login on 401 when the client manages its own credentials
+	if resp.StatusCode == http.StatusUnauthorized && req.auth && c.hasCredentials() {
+		resp.Body.Close()
+		if err := c.relogin(ctx); err != nil {
+			return err
+		}
+		if resp, err = c.send(ctx, req); err != nil {
+			return err
+		}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return decodeError(resp)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func (c *Client) hasCredentials() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.email != ""
+}
+
+// send performs the HTTP round trip, retrying idempotent requests
+func (c *Client) send(ctx context.Context, req request) (*http.Response, error) {
+	attempts := 1
+	if req.idempotent || req.idempotencyKey != "" {
+		attempts += c.maxRetries
+	}
+
+	var lastErr error
+	var retryAfter time.Duration
+	for attempt := 0; attempt < attempts; attempt++ {
+		if attempt > 0 {
+			delay := backoff(attempt)
+			if retryAfter > delay {
+				delay = min(retryAfter, retryBackoffMax)
+			}
+			if err := sleep(ctx, delay); err != nil {
+				return nil, err
+			}
+		}
+
+		httpReq, err := http.NewRequestWithContext(ctx, req.method, c.baseURL+apiPrefix+req.path, bytes.NewReader(req.body))
+		if err != nil {
+			return nil, err
+		}
+		if req.contentType != "" {
+			httpReq.Header.Set("Content-Type", req.contentType)
+		}
+		if req.auth {
+			token, err := c.bearer(ctx)
+			if err != nil {
+				return nil, err
+			}
+			httpReq.Header.Set("Authorization", "Bearer "+token)
+		}
+		if req.internal {
+			httpReq.Header.Set(internalTokenHeader, c.internalToken)
+		}
+		if req.idempotencyKey != "" {
+			httpReq.Header.Set(idempotencyKeyHeader, req.idempotencyKey)
+		}
+
+		resp, err := c.httpClient.Do(httpReq)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			lastErr = err
+			continue
+		}
+		if retryable(resp.StatusCode) && attempt < attempts-1 {
+			retryAfter = parseRetryAfter(resp.Header.Get("Retry-After"))
+			resp.Body.Close()
+			lastErr = &APIError{StatusCode: resp.StatusCode, Message: http.StatusText(resp.StatusCode)}
+			continue
+		}
+		return resp, nil
+	}
+	return nil, lastErr
+}
+
+// retryable reports whether a status is worth another attempt
+func retryable(status int) bool {
+	switch status {
+	case http.StatusTooManyRequests, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// parseRetryAfter reads a Retry-After header given in seconds
+func parseRetryAfter(value string) time.Duration {
+	seconds, err := strconv.Atoi(value)
+	if err != nil || seconds < 0 {
+		return 0
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// backoff doubles from retryBackoffBase up to retryBackoffMax
+func backoff(attempt int) time.Duration {
+	delay := retryBackoffBase << (attempt - 1)
+	if delay <= 0 || delay > retryBackoffMax {
+		delay = retryBackoffMax
+	}
+	return delay
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// decodeError builds an APIError from a problem+json body
+func decodeError(resp *http.Response) error {
+	var problem struct {
+		Code      string       `json:"code"`
+		Detail    string       `json:"detail"`
+		RequestID string       `json:"request_id"`
+		Errors    []FieldError `json:"errors"`
+	}
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if json.Unmarshal(data, &problem) != nil || problem.Detail == "" {
+		problem.Detail = http.StatusText(resp.StatusCode)
+	}
+	return &APIError{
+		StatusCode: resp.StatusCode,
+		Code:       problem.Code,
+		Message:    problem.Detail,
+		RequestID:  problem.RequestID,
+		Fields:     problem.Errors,
+	}
+}
+
+// IsCode reports whether err is an APIError with the given error code
+func IsCode(err error, code string) bool {
+	var apiErr *APIError
+	return errors.As(err, &apiErr) && apiErr.Code == code
+}
+
+// jsonRequest builds a request with a JSON body
+func jsonRequest(method, path string, payload interface{}) (request, error) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return request{}, err
+	}
+	return request{method: method, path: path, body: body, contentType: "application/json"}, nil
+}
+
+// IsStatus reports whether err is an APIError with the given status
+func IsStatus(err error, status int) bool {
+	var apiErr *APIError
+	return errors.As(err, &apiErr) && apiErr.StatusCode == status
+}
+
+// ============================================================================
+// Auth
+// ============================================================================
+
+// Register creates an account and keeps its token for later calls
+func (c *Client) Register(ctx context.Context, email, password, name string) (*AuthResponse, error) {
+	req, err := jsonRequest(http.MethodPost, "/auth/register", map[string]string{
+		"email": email, "password": password, "name": name,
+	})
+	if err != nil {
+		return nil, err
+	}
+	req.idempotencyKey = newIdempotencyKey()
+
+	var resp AuthResponse
+	if err := c.do(ctx, req, &resp); err != nil {
+		return nil, err
+	}
+	c.setToken(resp.Token)
+	return &resp, nil
+}
+
+// Login authenticates and keeps the credentials so the token can be refreshed
+func (c *Client) Login(ctx context.Context, email, password string) (*AuthResponse, error) {
+	req, err := jsonRequest(http.MethodPost, "/auth/login", map[string]string{
+		"email": email, "password": password,
+	})
+	if err != nil {
+		return nil, err
+	}
+	req.idempotent = true
+
+	var resp AuthResponse
+	if err := c.do(ctx, req, &resp); err != nil {
+		return nil, err
+	}
+	c.setToken(resp.Token)
+
+	c.mu.Lock()
+	c.email, c.password = email, password
+	c.mu.Unlock()
+	return &resp, nil
+}
+
+// Logout forgets the token and credentials
+func (c *Client) Logout(ctx context.Context) error {
+	err := c.do(ctx, request{method: http.MethodPost, path: "/auth/logout"}, nil)
+
+	c.mu.Lock()
+	c.token, c.expiresAt, c.email, c.password = "", time.Time{}, "", ""
+	c.mu.Unlock()
+	return err
+}
+
+// Verify checks the current token and returns its user
+func (c *Client) Verify(ctx context.Context) (*UserProfile, error) {
+	resp, err := c.VerifyClaims(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &resp.User, nil
+}
+
+// VerifyClaims checks the current token and returns its user together with
+// the token's custom claims and, for a narrowed token, its scope
+func (c *Client) VerifyClaims(ctx context.Context) (*Verification, error) {
+	var resp Verification
+	req := request{method: http.MethodGet, path: "/auth/verify", auth: true, idempotent: true}
+	if err := c.do(ctx, req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// ============================================================================
+// Users
+// ============================================================================
+
+// Me returns the current user's profile
+func (c *Client) Me(ctx context.Context) (*UserProfile, error) {
+	var profile UserProfile
+	req := request{method: http.MethodGet, path: "/users/me", auth: true, idempotent: true}
+	if err := c.do(ctx, req, &profile); err != nil {
+		return nil, err
+	}
+	return &profile, nil
+}
+
+// UpdateProfile changes the current user's name or avatar
+func (c *Client) UpdateProfile(ctx context.Context, update UpdateProfileRequest) (*UserProfile, error) {
+	req, err := jsonRequest(http.MethodPut, "/users/me", update)
+	if err != nil {
+		return nil, err
+	}
+	req.auth, req.idempotent = true, true
+
+	var resp struct {
+		User UserProfile `json:"user"`
+	}
+	if err := c.do(ctx, req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp.User, nil
+}
+
+// GetUser returns a user's profile by ID
+func (c *Client) GetUser(ctx context.Context, id string) (*UserProfile, error) {
+	var profile UserProfile
+	req := request{method: http.MethodGet, path: "/users/" + url.PathEscape(id), auth: true, idempotent: true}
+	if err := c.do(ctx, req, &profile); err != nil {
+		return nil, err
+	}
+	return &profile, nil
+}
+
+// ListUsers returns every user (admin only)
+func (c *Client) ListUsers(ctx context.Context) ([]UserProfile, error) {
+	var resp struct {
+		Users []UserProfile `json:"users"`
+	}
+	req := request{method: http.MethodGet, path: "/users/", auth: true, idempotent: true}
+	if err := c.do(ctx, req, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Users, nil
+}
+
+// ============================================================================
+// Documents
+// ============================================================================
+
+// RegisterDocument records the current user as a document's owner. It
+// reports false if the user already owned it.
+func (c *Client) RegisterDocument(ctx context.Context, filename string) (bool, error) {
+	req, err := jsonRequest(http.MethodPost, "/documents/register", map[string]string{"filename": filename})
+	if err != nil {
+		return false, err
+	}
+	// Registering is idempotent for the same owner, so it is safe to retry
+	req.auth, req.idempotent = true, true
+
+	var resp struct {
+		UserID string `json:"user_id"`
+	}
+	if err := c.do(ctx, req, &resp); err != nil {
+		return false, err
+	}
+	return resp.UserID != "", nil
+}
+
+// UnregisterDocument removes a document's ownership (owner or admin)
+func (c *Client) UnregisterDocument(ctx context.Context, filename string) error {
+	req := request{method: http.MethodDelete, path: "/documents/" + url.PathEscape(filename), auth: true, idempotent: true}
+	return c.do(ctx, req, nil)
+}
+
+// MyDocuments lists the current user's documents
+func (c *Client) MyDocuments(ctx context.Context) ([]string, error) {
+	var resp UserDocuments
+	req := request{method: http.MethodGet, path: "/documents/my", auth: true, idempotent: true}
+	if err := c.do(ctx, req, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Documents, nil
+}
+
+// UserDocuments lists another user's documents (admin only)
+func (c *Client) UserDocuments(ctx context.Context, userID string) (*UserDocuments, error) {
+	var resp UserDocuments
+	req := request{method: http.MethodGet, path: "/documents/user/" + url.PathEscape(userID), auth: true, idempotent: true}
+	if err := c.do(ctx, req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// AllDocuments returns every document with its owner (admin only)
+func (c *Client) AllDocuments(ctx context.Context) (*DocumentIndex, error) {
+	var resp DocumentIndex
+	req := request{method: http.MethodGet, path: "/documents/all", auth: true, idempotent: true}
+	if err := c.do(ctx, req, &resp); err != nil {
+		return nil, err
+	}
+	for _, owner := range resp.Users {
+		for _, filename := range owner.Documents {
+			resp.AllDocuments = append(resp.AllDocuments, DocumentWithOwner{
+				Filename: filename, UserID: owner.UserID, UserName: owner.UserName, UserEmail: owner.UserEmail,
+			})
+		}
+	}
+	return &resp, nil
+}
+
+// DocumentsPage returns one page of owners and their documents (admin
+// only). Pass the previous page's NextCursor, or "" for the first page.
+func (c *Client) DocumentsPage(ctx context.Context, limit int, cursor string) (*DocumentPage, error) {
+	query := url.Values{"limit": {strconv.Itoa(limit)}}
+	if cursor != "" {
+		query.Set("cursor", cursor)
+	}
+	var resp DocumentPage
+	req := request{method: http.MethodGet, path: "/documents/all?" + query.Encode(), auth: true, idempotent: true}
+	if err := c.do(ctx, req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// UploadDocument uploads a file and queues it for processing. Retries carry
+// the same Idempotency-Key so they can't queue a second job.
+func (c *Client) UploadDocument(ctx context.Context, filename string, content io.Reader) (*UploadResult, error) {
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	part, err := writer.CreateFormFile("file", filename)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(part, content); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+
+	var resp UploadResult
+	req := request{
+		method:      http.MethodPost,
+		path:        "/documents/upload",
+		body:        body.Bytes(),
+		contentType: writer.FormDataContentType(),
+		auth:        true,
+
+		idempotencyKey: newIdempotencyKey(),
+	}
+	if err := c.do(ctx, req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// GetJob returns the status of a processing job
+func (c *Client) GetJob(ctx context.Context, id string) (*Job, error) {
+	var job Job
+	req := request{method: http.MethodGet, path: "/jobs/" + url.PathEscape(id), auth: true, idempotent: true}
+	if err := c.do(ctx, req, &job); err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// ============================================================================
+// Internal
+// ============================================================================
+
+// FilterAccess returns the candidate documents a user may read. The client
+// must be configured WithInternalToken.
+func (c *Client) FilterAccess(ctx context.Context, userID string, documentIDs []string) (*AccessDecision, error) {
+	req, err := jsonRequest(http.MethodPost, "/internal/access/filter", map[string]interface{}{
+		"user_id": userID, "document_ids": documentIDs,
+	})
+	if err != nil {
+		return nil, err
+	}
+	req.internal, req.idempotent = true, true
+
+	var resp AccessDecision
+	if err := c.do(ctx, req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// Revocations returns the token cut-offs set after since; a zero since
+// returns all of them. The client must be configured WithInternalToken.
+func (c *Client) Revocations(ctx context.Context, since time.Time) ([]Revocation, error) {
+	path := "/internal/revocations"
+	if !since.IsZero() {
+		path += "?" + url.Values{"since": {since.UTC().Format(time.RFC3339)}}.Encode()
+	}
+	req := request{method: http.MethodGet, path: path, internal: true, idempotent: true}
+
+	var resp struct {
+		Revocations []Revocation `json:"revocations"`
+	}
+	if err := c.do(ctx, req, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Revocations, nil
+}
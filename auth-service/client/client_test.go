@@ -0,0 +1,301 @@
+package client
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testToken returns a token that expires at exp; the client reads only its
+// claims
+func testToken(id string, exp time.Time) string {
+	claims, _ := json.Marshal(map[string]interface{}{"sub": id, "exp": exp.Unix()})
+	return "header." + base64.RawURLEncoding.EncodeToString(claims) + ".signature"
+}
+
+// fakeService records the requests it is sent and answers them with handle
+type fakeService struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	requests []*http.Request
+	bodies   []string
+}
+
+func newFakeService(t *testing.T, handle func(w http.ResponseWriter, r *http.Request, n int)) *fakeService {
+	t.Helper()
+	fs := &fakeService{}
+	fs.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		fs.mu.Lock()
+		fs.requests = append(fs.requests, r)
+		fs.bodies = append(fs.bodies, string(body))
+		n := len(fs.requests)
+		fs.mu.Unlock()
+		handle(w, r, n)
+	}))
+	t.Cleanup(fs.Close)
+	return fs
+}
+
+// sent returns the requests received so far
+func (fs *fakeService) sent() []*http.Request {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return append([]*http.Request(nil), fs.requests...)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func TestClientLogsInAgain(t *testing.T) {
+	ctx := context.Background()
+	var mu sync.Mutex
+	logins, valid := 0, ""
+	fs := newFakeService(t, func(w http.ResponseWriter, r *http.Request, _ int) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch r.URL.Path {
+		case "/v1/auth/login":
+			logins++
+			// The first token is close to expiring
+			exp := time.Now().Add(time.Hour)
+			if logins == 1 {
+				exp = time.Now().Add(refreshMargin / 2)
+			}
+			valid = testToken(fmt.Sprint("login-", logins), exp)
+			writeJSON(w, http.StatusOK, AuthResponse{Token: valid})
+		case "/v1/users/me":
+			if r.Header.Get("Authorization") != "Bearer "+valid {
+				writeJSON(w, http.StatusUnauthorized, map[string]string{"code": "unauthorized", "detail": "Invalid token"})
+				return
+			}
+			writeJSON(w, http.StatusOK, UserProfile{ID: "u1"})
+		}
+	})
+
+	c := New(fs.URL+"/", WithCredentials("user@example.com", "secret123"))
+	if _, err := c.Me(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// A token about to expire is replaced before it is sent
+	if _, err := c.Me(ctx); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	if logins != 2 {
+		t.Fatalf("%d logins, want 2", logins)
+	}
+	// A token the service stops taking is replaced once
+	valid = "revoked"
+	mu.Unlock()
+	if _, err := c.Me(ctx); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	if logins != 3 || c.Token() != valid {
+		t.Fatalf("%d logins, token %q", logins, c.Token())
+	}
+	mu.Unlock()
+
+	// Without credentials a 401 is the caller's to handle
+	c = New(fs.URL, WithToken("stale"))
+	if _, err := c.Me(ctx); !IsStatus(err, http.StatusUnauthorized) || !IsCode(err, "unauthorized") {
+		t.Fatalf("without credentials: %v", err)
+	}
+	for _, r := range fs.sent() {
+		if r.URL.Path == "/v1/auth/login" && r.Header.Get("Authorization") != "" {
+			t.Fatal("login sent a bearer token")
+		}
+	}
+}
+
+func TestClientRetries(t *testing.T) {
+	ctx := context.Background()
+	fs := newFakeService(t, func(w http.ResponseWriter, r *http.Request, n int) {
+		if n%2 == 1 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		switch r.URL.Path {
+		case "/v1/documents/upload":
+			writeJSON(w, http.StatusAccepted, UploadResult{Filename: "handbook.pdf", JobID: "job-1"})
+		default:
+			writeJSON(w, http.StatusOK, map[string]interface{}{})
+		}
+	})
+	c := New(fs.URL, WithToken("token"))
+
+	// An idempotent read is tried again
+	if _, err := c.Me(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// An upload is tried again under the same key
+	result, err := c.UploadDocument(ctx, "handbook.pdf", strings.NewReader("%PDF"))
+	if err != nil || result.JobID != "job-1" {
+		t.Fatalf("upload: %+v %v", result, err)
+	}
+	sent := fs.sent()
+	if len(sent) != 4 {
+		t.Fatalf("%d requests, want 4", len(sent))
+	}
+	key := sent[2].Header.Get(idempotencyKeyHeader)
+	if key == "" || sent[3].Header.Get(idempotencyKeyHeader) != key {
+		t.Fatalf("upload keys %q and %q", key, sent[3].Header.Get(idempotencyKeyHeader))
+	}
+	if !strings.Contains(fs.bodies[3], "%PDF") || !strings.HasPrefix(sent[3].Header.Get("Content-Type"), "multipart/form-data") {
+		t.Fatalf("upload retried without its file: %q", fs.bodies[3])
+	}
+
+	// A change without a key is sent once
+	if err := c.Logout(ctx); !IsStatus(err, http.StatusServiceUnavailable) {
+		t.Fatalf("logout: %v", err)
+	}
+	if len(fs.sent()) != 5 {
+		t.Fatalf("logout retried: %d requests", len(fs.sent()))
+	}
+
+	// Retries run out
+	down := newFakeService(t, func(w http.ResponseWriter, _ *http.Request, _ int) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	c = New(down.URL, WithToken("token"), WithRetries(1))
+	if _, err := c.Me(ctx); !IsStatus(err, http.StatusServiceUnavailable) || len(down.sent()) != 2 {
+		t.Fatalf("service down: %v after %d requests", err, len(down.sent()))
+	}
+}
+
+func TestClientErrors(t *testing.T) {
+	ctx := context.Background()
+	fs := newFakeService(t, func(w http.ResponseWriter, r *http.Request, _ int) {
+		switch r.URL.Path {
+		case "/v1/auth/register":
+			writeJSON(w, http.StatusBadRequest, map[string]interface{}{
+				"code": "validation_failed", "detail": "Invalid request", "request_id": "req-1",
+				"errors": []FieldError{{Field: "email", Rule: "email", Message: "must be an email address"}},
+			})
+		default:
+			w.WriteHeader(http.StatusBadGateway)
+			io.WriteString(w, "<html>bad gateway</html>")
+		}
+	})
+	c := New(fs.URL, WithRetries(0))
+
+	_, err := c.Register(ctx, "not an email", "secret123", "Test User")
+	apiErr, ok := err.(*APIError)
+	if !ok || apiErr.StatusCode != http.StatusBadRequest || apiErr.Code != "validation_failed" ||
+		apiErr.RequestID != "req-1" || len(apiErr.Fields) != 1 || apiErr.Fields[0].Field != "email" {
+		t.Fatalf("register: %#v", err)
+	}
+	if got := err.Error(); got != "auth-service: 400 validation_failed: Invalid request" {
+		t.Fatalf("message = %q", got)
+	}
+
+	// A body that isn't a problem falls back to the status text
+	_, err = c.Me(ctx)
+	if apiErr, ok := err.(*APIError); !ok || apiErr.Code != "" || apiErr.Message != "Bad Gateway" {
+		t.Fatalf("non-JSON error: %#v", err)
+	}
+	if got := err.Error(); got != "auth-service: 502 Bad Gateway" {
+		t.Fatalf("message = %q", got)
+	}
+}
+
+func TestClientRequests(t *testing.T) {
+	ctx := context.Background()
+	fs := newFakeService(t, func(w http.ResponseWriter, r *http.Request, _ int) {
+		switch r.URL.Path {
+		case "/v1/documents/all":
+			writeJSON(w, http.StatusOK, DocumentIndex{TotalUsers: 2, Users: []UserDocuments{
+				{UserID: "u1", UserName: "Ada", Documents: []string{"a.pdf", "b.pdf"}},
+				{UserID: "u2", UserName: "Root", Documents: []string{"c.pdf"}},
+			}})
+		case "/v1/internal/access/filter":
+			writeJSON(w, http.StatusOK, AccessDecision{UserID: "u1", Allowed: []string{"a.pdf"}, DeniedCount: 1})
+		default:
+			writeJSON(w, http.StatusOK, map[string]interface{}{})
+		}
+	})
+	c := New(fs.URL, WithToken("token"), WithInternalToken("internal"))
+
+	index, err := c.AllDocuments(ctx)
+	if err != nil || len(index.AllDocuments) != 3 || index.AllDocuments[2] != (DocumentWithOwner{Filename: "c.pdf", UserID: "u2", UserName: "Root"}) {
+		t.Fatalf("all documents: %+v %v", index, err)
+	}
+	if _, err := c.DocumentsPage(ctx, 10, "next"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.UnregisterDocument(ctx, "reports/q1 plan.pdf"); err != nil {
+		t.Fatal(err)
+	}
+	decision, err := c.FilterAccess(ctx, "u1", []string{"a.pdf", "c.pdf"})
+	if err != nil || len(decision.Allowed) != 1 || decision.DeniedCount != 1 {
+		t.Fatalf("filter: %+v %v", decision, err)
+	}
+	since := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	if _, err := c.Revocations(ctx, since); err != nil {
+		t.Fatal(err)
+	}
+
+	sent := fs.sent()
+	if got := sent[1].URL.RawQuery; got != "cursor=next&limit=10" {
+		t.Fatalf("page query = %q", got)
+	}
+	if got := sent[2].URL.EscapedPath(); got != "/v1/documents/reports%2Fq1%20plan.pdf" || sent[2].Method != http.MethodDelete {
+		t.Fatalf("unregister %s %s", sent[2].Method, got)
+	}
+	// Internal calls carry the internal token, not the user's
+	if sent[3].Header.Get(internalTokenHeader) != "internal" || sent[3].Header.Get("Authorization") != "" {
+		t.Fatalf("filter headers: %v", sent[3].Header)
+	}
+	var body struct {
+		UserID      string   `json:"user_id"`
+		DocumentIDs []string `json:"document_ids"`
+	}
+	if err := json.Unmarshal([]byte(fs.bodies[3]), &body); err != nil || body.UserID != "u1" || len(body.DocumentIDs) != 2 {
+		t.Fatalf("filter body %q", fs.bodies[3])
+	}
+	if got := sent[4].URL.Query().Get("since"); got != "2024-01-02T03:04:05Z" {
+		t.Fatalf("since = %q", got)
+	}
+}
+
+func TestClientBackoff(t *testing.T) {
+	for attempt, want := range map[int]time.Duration{1: retryBackoffBase, 2: 2 * retryBackoffBase, 10: retryBackoffMax, 80: retryBackoffMax} {
+		if got := backoff(attempt); got != want {
+			t.Errorf("backoff(%d) = %s, want %s", attempt, got, want)
+		}
+	}
+	for value, want := range map[string]time.Duration{"3": 3 * time.Second, "": 0, "-1": 0, "Wed, 21 Oct 2015 07:28:00 GMT": 0} {
+		if got := parseRetryAfter(value); got != want {
+			t.Errorf("parseRetryAfter(%q) = %s, want %s", value, got, want)
+		}
+	}
+
+	// A caller that gives up stops the retries
+	fs := newFakeService(t, func(w http.ResponseWriter, _ *http.Request, _ int) {
+		w.Header().Set("Retry-After", "60")
+		w.WriteHeader(http.StatusTooManyRequests)
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := New(fs.URL, WithToken("token")).Me(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("cancelled retry: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second || len(fs.sent()) != 1 {
+		t.Fatalf("gave up after %s and %d requests", elapsed, len(fs.sent()))
+	}
+}
@@ -0,0 +1,133 @@
+package client
+
+import (
+	"fmt"
+	"time"
+)
+
+// UserProfile is a user's public profile
+type UserProfile struct {
+	ID        string    `json:"id"`
+	Email     string    `json:"email"`
+	Name      string    `json:"name"`
+	Avatar    string    `json:"avatar,omitempty"`
+	Role      string    `json:"role"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// AuthResponse is returned by Register and Login
+type AuthResponse struct {
+	Token   string      `json:"token"`
+	User    UserProfile `json:"user"`
+	Message string      `json:"message"`
+}
+
+// Verification is what the service says about a valid token
+type Verification struct {
+	User   UserProfile            `json:"user"`
+	Claims map[string]interface{} `json:"claims,omitempty"`
+	Scope  string                 `json:"scope,omitempty"` // space-separated; empty for a full user token
+}
+
+// UpdateProfileRequest holds the profile fields to change; empty fields are
+// left as they are
+type UpdateProfileRequest struct {
+	Name   string `json:"name,omitempty"`
+	Avatar string `json:"avatar,omitempty"`
+}
+
+// UserDocuments lists the documents owned by one user
+type UserDocuments struct {
+	UserID    string   `json:"user_id"`
+	UserName  string   `json:"user_name,omitempty"`
+	UserEmail string   `json:"user_email,omitempty"`
+	Documents []string `json:"documents"`
+	Count     int      `json:"count"`
+}
+
+// DocumentWithOwner is one document and its owner
+type DocumentWithOwner struct {
+	Filename  string `json:"filename"`
+	UserID    string `json:"user_id"`
+	UserName  string `json:"user_name"`
+	UserEmail string `json:"user_email"`
+}
+
+// DocumentIndex is the admin view of every document and owner.
+// AllDocuments is Users flattened, filled in by the client.
+type DocumentIndex struct {
+	TotalDocuments int                 `json:"total_documents"`
+	TotalUsers     int                 `json:"total_users"`
+	Users          []UserDocuments     `json:"users"`
+	AllDocuments   []DocumentWithOwner `json:"-"`
+}
+
+// DocumentPage is one page of the admin document listing
+type DocumentPage struct {
+	Users          []UserDocuments `json:"users"`
+	Count          int             `json:"count"`
+	TotalUsers     int             `json:"total_users"`
+	TotalDocuments int             `json:"total_documents"`
+	NextCursor     string          `json:"next_cursor"` // empty on the last page
+}
+
+// UploadResult describes a queued upload
+type UploadResult struct {
+	Message  string `json:"message"`
+	Filename string `json:"filename"`
+	JobID    string `json:"job_id"`
+	Status   string `json:"status"`
+}
+
+// Job is the status of a document processing job
+type Job struct {
+	ID          string     `json:"id"`
+	Type        string     `json:"type"`
+	UserID      string     `json:"user_id"`
+	Filename    string     `json:"filename"`
+	Status      string     `json:"status"`
+	Attempts    int        `json:"attempts"`
+	MaxAttempts int        `json:"max_attempts"`
+	LastError   string     `json:"last_error,omitempty"`
+	NextRunAt   *time.Time `json:"next_run_at,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+}
+
+// AccessDecision is the result of an internal access filter
+type AccessDecision struct {
+	UserID      string   `json:"user_id"`
+	Allowed     []string `json:"allowed"`
+	DeniedCount int      `json:"denied_count"`
+}
+
+// Revocation is a user's token cut-off: their tokens issued at or before
+// RevokedBefore are refused
+type Revocation struct {
+	UserID        string    `json:"user_id"`
+	RevokedBefore time.Time `json:"revoked_before"`
+}
+
+// FieldError describes one invalid request field
+type FieldError struct {
+	Field   string `json:"field"`
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+// APIError is a non-2xx response from the auth service. Branch on Code
+// rather than Message; codes are stable, messages are not.
+type APIError struct {
+	StatusCode int
+	Code       string
+	Message    string
+	RequestID  string
+	Fields     []FieldError
+}
+
+func (e *APIError) Error() string {
+	if e.Code != "" {
+		return fmt.Sprintf("auth-service: %d %s: %s", e.StatusCode, e.Code, e.Message)
+	}
+	return fmt.Sprintf("auth-service: %d %s", e.StatusCode, e.Message)
+}
@@ -0,0 +1,892 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+// ============================================================================
+// Cluster Mode
+// ============================================================================
+//
+// With cluster.mode redis or mongo, several replicas can serve the same
+// users and documents. The shared store (Redis, cluster_redis.go, or
+// MongoDB, cluster_mongo.go) holds the authoritative copy of users
+// (including password hashes) and document ownership; each replica keeps
+// its in-memory maps as a read replica, loaded at startup, updated from a
+// change feed and rebuilt every cluster.resync_interval in case messages
+// were missed.
+//
+// Consistency guarantees:
+//   - Writes go to the store before the local replica; if the store is
+//     unreachable the write fails with 503 and nothing changes.
+//   - Email uniqueness and document claims are atomic across replicas
+//     (set-if-absent), so two replicas racing to register the same email or
+//     claim the same filename produce exactly one winner.
+//   - Releasing a document is a compare-and-delete on its owner.
+//   - Reads are eventually consistent: another replica sees a change when
+//     the feed message arrives (normally milliseconds), at worst after the
+//     next resync. A user who registers on one replica and immediately
+//     logs in through another may briefly get "invalid credentials".
+//   - Startup seeding runs under a distributed lock, so replicas booting
+//     together create the bootstrap admin once.
+//   - Background work that touches shared state takes a lock too: one
+//     reindex campaign runs across the cluster at a time, a connector
+//     source is synced by one replica at a time, one replica at a time
+//     runs the saved queries that are due, and audit retention skips a
+//     sweep while another process is rewriting the same file or pruning
+//     the shared chain. Locks are renewed while held and expire
+//     cluster.lock_ttl after a holder dies.
+//
+// The shared store also holds the provider failover chain (providers.go),
+// collections' search settings (search.go), OAuth clients (oauthserver.go)
+// and orgs (orgs.go), the admin switches for maintenance mode
+// (maintenance.go), registration (registration.go) and log settings
+// (logcontrol.go), which admins change once for every replica, the
+// runtime and automatic network rules (netrules.go), so an address banned
+// by one replica is refused by all, sign-in histories and security alerts
+// (anomaly.go), so a login held on one replica can't go through on
+// another, pending admin actions (dualcontrol.go), invitations
+// (adminusers.go) and OAuth authorization codes, which any replica can
+// approve or redeem, the cost ledger (costs.go), since usage reports
+// land on any replica, document access logs (accesslog.go), since the
+// gateway reports reads to any replica, retrieval experiments with the
+// queries they assigned (experiments.go), so one comparison covers every
+// replica, and saved conversations (conversations.go) and saved queries
+// (savedqueries.go), which their users open and change through any
+// replica. Conversations and saved queries are read from the store each
+// time they're used rather than kept in the local replica.
+//
+// With cluster.mode mongo it also holds the audit log (audit.go), so
+// every replica appends to one hash chain.
+//
+// Everything else stays per instance: jobs and their queues run where they
+// were submitted, evaluation sets and runs (evaluation.store_dir) and
+// export archives (exports.dir) stay with the replica that made them, and
+// the admin activity feed, connector links and, with Redis, the audit log
+// are kept by the replica that wrote them. All replicas must share
+// auth.jwt_secret, and rate_limit.backend should be redis so limits are
+// not multiplied by the replica count.
+
+const (
+	clusterModeStandalone = "standalone"
+	clusterModeRedis      = "redis"
+	clusterModeMongo      = "mongo"
+
+	// Values a user holds exclusively, for sharedStore.reserve
+	reserveEmailIndex = "email"
+	reservePhoneIndex = "phone"
+
+	lockRetryInterval = 100 * time.Millisecond
+)
+
+var errStoreUnavailable = errors.New("Shared store unavailable; try again shortly")
+
+var errLockHeld = errors.New("lock is held elsewhere")
+
+// sharedStore is where replicas keep the state they share. Writes that
+// need one winner across replicas are conditional: reserve, claimDocument,
+// transferDocument, releaseDocument and the lock methods. Reads report a
+// missing record with found == false rather than an error.
+type sharedStore interface {
+	ping(ctx context.Context) error
+	close() error
+
+	users(ctx context.Context) (map[string]sharedUser, error)
+	user(ctx context.Context, id string) (record sharedUser, found bool, err error)
+	saveUser(ctx context.Context, record sharedUser) error
+	deleteUser(ctx context.Context, id, email, phone string) error
+	// reserve claims value in an index (reserveEmailIndex, ...) for a
+	// user; false means someone else holds it
+	reserve(ctx context.Context, index, value, userID string) (bool, error)
+	release(ctx context.Context, index, value string) error
+
+	documents(ctx context.Context) (map[string]sharedDocument, error)
+	document(ctx context.Context, filename string) (doc sharedDocument, found bool, err error)
+	// claimDocument registers a document unless it has an owner already,
+	// and returns the owner
+	claimDocument(ctx context.Context, filename, userID string, meta sharedDocumentMeta) (string, error)
+	transferDocument(ctx context.Context, filename, fromID, toID string) error
+	releaseDocument(ctx context.Context, filename, ownerID string) error
+	saveDocumentMeta(ctx context.Context, filename string, meta sharedDocumentMeta) error
+
+	setActivity(ctx context.Context, key string, at time.Time, ttl time.Duration) error
+	activity(ctx context.Context, key string) (at time.Time, found bool, err error)
+
+	// setting and saveSetting keep admin-managed settings that every
+	// replica follows, as JSON by name (providerChainSetting, ...)
+	setting(ctx context.Context, name string) (data []byte, found bool, err error)
+	saveSetting(ctx context.Context, name string, data []byte) error
+
+	recordStore
+
+	lock(ctx context.Context, name, token string, ttl time.Duration) (bool, error)
+	extendLock(ctx context.Context, name, token string, ttl time.Duration) (bool, error)
+	unlock(ctx context.Context, name, token string) error
+
+	publish(ctx context.Context, change clusterChange) error
+	// subscribe delivers changes published from now on until ctx is done
+	subscribe(ctx context.Context) <-chan clusterChange
+}
+
+// recordStore keeps small records of one kind (pending admin actions,
+// ...) as JSON by ID. A zero ttl keeps a record until it is deleted.
+// addRecord writes only if the ID is free and takeRecord reads and deletes
+// in one step, so each has one winner across replicas.
+type recordStore interface {
+	records(ctx context.Context, kind string) (map[string][]byte, error)
+	record(ctx context.Context, kind, id string) (data []byte, found bool, err error)
+	saveRecord(ctx context.Context, kind, id string, data []byte, ttl time.Duration) error
+	addRecord(ctx context.Context, kind, id string, data []byte, ttl time.Duration) (bool, error)
+	takeRecord(ctx context.Context, kind, id string) (data []byte, found bool, err error)
+	deleteRecord(ctx context.Context, kind, id string) error
+}
+
+// sharedUser is a user as the shared store keeps it; unlike User it keeps
+// the hash
+type sharedUser struct {
+	ID           string    `json:"id" bson:"_id"`
+	Email        string    `json:"email" bson:"email"`
+	PasswordHash string    `json:"password_hash" bson:"password_hash"`
+	Name         string    `json:"name" bson:"name"`
+	Avatar       string    `json:"avatar,omitempty" bson:"avatar,omitempty"`
+	Role         string    `json:"role" bson:"role"`
+	Status       string    `json:"status,omitempty" bson:"status,omitempty"`
+	Phone        string    `json:"phone,omitempty" bson:"phone,omitempty"`
+	Plan         string    `json:"plan,omitempty" bson:"plan,omitempty"`
+	OrgID        string    `json:"org_id,omitempty" bson:"org_id,omitempty"`
+	OrgRole      string    `json:"org_role,omitempty" bson:"org_role,omitempty"`
+	MergedInto   string    `json:"merged_into,omitempty" bson:"merged_into,omitempty"`
+	ReferralCode string    `json:"referral_code,omitempty" bson:"referral_code,omitempty"`
+	ReferredBy   string    `json:"referred_by,omitempty" bson:"referred_by,omitempty"`
+	CreatedAt    time.Time `json:"created_at" bson:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at" bson:"updated_at"`
+
+	TokensRevokedAt time.Time `json:"tokens_revoked_at,omitempty" bson:"tokens_revoked_at,omitempty"`
+	Devices         []Device  `json:"devices,omitempty" bson:"devices,omitempty"`
+	Starred         []string  `json:"starred,omitempty" bson:"starred,omitempty"`
+}
+
+// sharedDocumentMeta is what stats need about a document
+type sharedDocumentMeta struct {
+	Name    string    `json:"name,omitempty" bson:"name,omitempty"` // empty from before names were per owner
+	AddedAt time.Time `json:"added_at" bson:"added_at"`
+	Size    int64     `json:"size,omitempty" bson:"size,omitempty"`
+	Type    string    `json:"type,omitempty" bson:"type,omitempty"`
+	OrgWide bool      `json:"org_wide,omitempty" bson:"org_wide,omitempty"`
+	Tags    []string  `json:"tags,omitempty" bson:"tags,omitempty"`
+
+	Grants map[string]time.Time `json:"grants,omitempty" bson:"grants,omitempty"` // grantee -> expiry
+	Notes  []DocumentNote       `json:"notes,omitempty" bson:"notes,omitempty"`
+
+	Preview *DocumentPreview `json:"preview,omitempty" bson:"preview,omitempty"`
+
+	Chunking    *ChunkingSettings `json:"chunking,omitempty" bson:"chunking,omitempty"`
+	ChunkedWith *ChunkingSettings `json:"chunked_with,omitempty" bson:"chunked_with,omitempty"`
+}
+
+// sharedDocument is a document's owner and metadata
+type sharedDocument struct {
+	Owner string
+	Meta  sharedDocumentMeta
+}
+
+// documentMeta is what the cluster store keeps about a record besides its
+// owner
+func documentMeta(record documentRecord) sharedDocumentMeta {
+	return sharedDocumentMeta{Name: record.Name, AddedAt: record.AddedAt, Size: record.Size, Type: record.Type, OrgWide: record.OrgWide, Tags: record.Tags,
+		Grants: record.Grants, Notes: record.Notes, Preview: record.Preview, Chunking: record.Chunking, ChunkedWith: record.ChunkedWith}
+}
+
+// record rebuilds a document's record from its owner and metadata
+func (m sharedDocumentMeta) record(owner string) documentRecord {
+	return documentRecord{Owner: owner, Name: m.Name, AddedAt: m.AddedAt, Size: m.Size, Type: m.Type, OrgWide: m.OrgWide, Tags: m.Tags,
+		Grants: m.Grants, Notes: m.Notes, Preview: m.Preview, Chunking: m.Chunking, ChunkedWith: m.ChunkedWith}
+}
+
+// clusterChange announces a write so other replicas refresh that record
+type clusterChange struct {
+	Origin string `json:"origin" bson:"origin"`
+	Kind   string `json:"kind" bson:"kind"` // user | document | setting
+	ID     string `json:"id" bson:"id"`
+}
+
+var (
+	clusterStore sharedStore // nil when standalone
+	instanceID   string
+
+	// Standalone locks; each channel holds one token while locked
+	localLocks   = make(map[string]chan struct{})
+	localLocksMu sync.Mutex
+
+	// Standalone records
+	localRecords = newMemoryRecords()
+)
+
+// clustered reports whether state is shared with other replicas
+func clustered() bool {
+	return clusterStore != nil
+}
+
+// keyedRecords is where records are kept: the shared store when clustered,
+// otherwise this process's memory
+func keyedRecords() recordStore {
+	if clustered() {
+		return clusterStore
+	}
+	return localRecords
+}
+
+// setupCluster connects to the shared store and loads the local replica
+func setupCluster() error {
+	cfg := config.Cluster
+	instanceID = cfg.InstanceID
+	if instanceID == "" {
+		instanceID, _ = os.Hostname()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var store sharedStore
+	var err error
+	switch cfg.Mode {
+	case clusterModeRedis:
+		store, err = newRedisStore(cfg.RedisURL)
+	case clusterModeMongo:
+		store, err = newMongoStore(cfg.MongoURL, cfg.MongoDatabase, cfg.MigrateOnStart)
+	default:
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := store.ping(ctx); err != nil {
+		store.close()
+		return fmt.Errorf("connect to cluster store: %w", err)
+	}
+	clusterStore = store
+	if err := resyncShared(ctx); err != nil {
+		return err
+	}
+	if config.RateLimit.Enabled && config.RateLimit.Backend != "redis" {
+		slog.Warn("Cluster mode with in-memory rate limits; each replica enforces its own limits")
+	}
+
+	goBackground(followChanges)
+	slog.Info("Cluster mode enabled", "instance", instanceID, "store", cfg.Mode)
+	return nil
+}
+
+// followChanges applies other replicas' writes and resyncs periodically
+func followChanges(ctx context.Context) {
+	changes := clusterStore.subscribe(ctx)
+	ticker := time.NewTicker(config.Cluster.ResyncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := resyncShared(ctx); err != nil {
+				slog.Warn("Cluster resync failed", "error", err)
+			}
+		case change, ok := <-changes:
+			if !ok {
+				// The feed broke; resyncs keep replicas converging
+				changes = nil
+				continue
+			}
+			// Own changes are applied too: a resync that read the store just
+			// before one of our writes would otherwise hide it until the next
+			if err := refreshRecord(ctx, change); err != nil {
+				slog.Warn("Cluster change not applied; waiting for resync", "kind", change.Kind, "error", err)
+			}
+		}
+	}
+}
+
+// publishChange tells other replicas a record changed; a lost message is
+// repaired by the next resync
+func publishChange(ctx context.Context, kind, id string) {
+	if err := clusterStore.publish(ctx, clusterChange{Origin: instanceID, Kind: kind, ID: id}); err != nil {
+		slog.Warn("Cluster change not published", "kind", kind, "error", err)
+	}
+}
+
+// refreshRecord reloads one record from the shared store
+func refreshRecord(ctx context.Context, change clusterChange) error {
+	switch change.Kind {
+	case "user":
+		record, found, err := clusterStore.user(ctx, change.ID)
+		if err != nil {
+			return err
+		}
+		if !found {
+			removeLocalUser(change.ID)
+			return nil
+		}
+		applySharedUser(record)
+	case "document":
+		doc, found, err := clusterStore.document(ctx, change.ID)
+		if err != nil {
+			return err
+		}
+		if !found {
+			applySharedDocument(change.ID, "", sharedDocumentMeta{})
+			return nil
+		}
+		applySharedDocument(change.ID, doc.Owner, doc.Meta)
+	case "setting":
+		return refreshSetting(ctx, change.ID)
+	}
+	return nil
+}
+
+// refreshSetting reloads an admin-managed setting from the shared store
+func refreshSetting(ctx context.Context, name string) error {
+	data, found, err := clusterStore.setting(ctx, name)
+	if err != nil || !found {
+		return err
+	}
+	switch name {
+	case providerChainSetting:
+		return applyProviderChain(data)
+	case maintenanceSetting:
+		return applyMaintenanceSetting(data)
+	case registrationSetting:
+		return applyRegistrationSetting(data)
+	case networkRulesSetting:
+		return applyNetworkRulesSetting(data)
+	case loggingSetting:
+		return applyLoggingSetting(data)
+	case orgsSetting:
+		return applyOrgsSetting(data)
+	case oauthClientsSetting:
+		return applyOAuthClientsSetting(data)
+	case experimentsSetting:
+		return applyExperimentsSetting(data)
+	case searchSetting:
+		return applySearchSetting(data)
+	}
+	return nil
+}
+
+// saveSharedSetting stores an admin-managed setting and tells every replica
+func saveSharedSetting(name string, data []byte) error {
+	ctx := context.Background()
+	if err := clusterStore.saveSetting(ctx, name, data); err != nil {
+		slog.Error("Cluster store write failed", "op", "save_setting", "setting", name, "error", err)
+		return errStoreUnavailable
+	}
+	publishChange(ctx, "setting", name)
+	return nil
+}
+
+// resyncShared reloads every user and rebuilds document ownership
+func resyncShared(ctx context.Context) error {
+	started := time.Now()
+	users, err := clusterStore.users(ctx)
+	if err != nil {
+		return fmt.Errorf("load users: %w", err)
+	}
+	docs, err := clusterStore.documents(ctx)
+	if err != nil {
+		return fmt.Errorf("load documents: %w", err)
+	}
+
+	for _, record := range users {
+		applySharedUser(record)
+	}
+	// Users deleted while this replica missed the feed; ones created since
+	// the snapshot was read are simply newer than it
+	var deleted []string
+	localUsers.Each(func(user *User) {
+		if _, exists := users[user.ID]; !exists && user.CreatedAt.Before(started) {
+			deleted = append(deleted, user.ID)
+		}
+	})
+	for _, id := range deleted {
+		removeLocalUser(id)
+	}
+
+	index := newDocumentIndex()
+	for filename, doc := range docs {
+		index.put(filename, doc.Meta.record(doc.Owner))
+	}
+	localDocuments.replace(index)
+	bumpDocVersion()
+
+	if err := refreshSetting(ctx, providerChainSetting); err != nil {
+		return fmt.Errorf("load provider chain: %w", err)
+	}
+	if err := refreshSetting(ctx, maintenanceSetting); err != nil {
+		return fmt.Errorf("load maintenance mode: %w", err)
+	}
+	if err := refreshSetting(ctx, registrationSetting); err != nil {
+		return fmt.Errorf("load registration settings: %w", err)
+	}
+	if err := refreshSetting(ctx, networkRulesSetting); err != nil {
+		return fmt.Errorf("load network rules: %w", err)
+	}
+	if err := refreshSetting(ctx, loggingSetting); err != nil {
+		return fmt.Errorf("load log settings: %w", err)
+	}
+	if err := refreshSetting(ctx, oauthClientsSetting); err != nil {
+		return fmt.Errorf("load OAuth clients: %w", err)
+	}
+	if err := refreshSetting(ctx, orgsSetting); err != nil {
+		return fmt.Errorf("load orgs: %w", err)
+	}
+	if err := refreshSetting(ctx, experimentsSetting); err != nil {
+		return fmt.Errorf("load experiments: %w", err)
+	}
+	if err := refreshSetting(ctx, searchSetting); err != nil {
+		return fmt.Errorf("load search settings: %w", err)
+	}
+	return nil
+}
+
+// applySharedUser updates the local replica in place, so *User pointers
+// held by in-flight requests see the change
+func applySharedUser(record sharedUser) {
+	user, _ := localUsers.byID.putIfAbsent(record.ID, &User{ID: record.ID})
+
+	lock := localUsers.FieldLock(user)
+	lock.Lock()
+	previousEmail, previousRole, previousStatus, previousPhone := user.Email, user.Role, user.Status, user.Phone
+	previousRevokedAt := user.TokensRevokedAt
+	user.Email, user.Password = record.Email, record.PasswordHash
+	user.Name, user.Avatar, user.Role = record.Name, record.Avatar, record.Role
+	user.Status, user.Phone, user.MergedInto = record.Status, record.Phone, record.MergedInto
+	user.ReferralCode, user.ReferredBy, user.Plan = record.ReferralCode, record.ReferredBy, record.Plan
+	user.OrgID, user.OrgRole = record.OrgID, record.OrgRole
+	user.CreatedAt, user.UpdatedAt = record.CreatedAt, record.UpdatedAt
+	user.TokensRevokedAt, user.Devices = record.TokensRevokedAt, record.Devices
+	user.Starred = record.Starred
+	lock.Unlock()
+
+	if previousRole != record.Role || previousStatus != record.Status || previousEmail != record.Email ||
+		!previousRevokedAt.Equal(record.TokensRevokedAt) {
+		forgetUserTokens(record.ID)
+	}
+	if previousEmail != record.Email {
+		localUsers.byEmail.remove(previousEmail, user)
+		forgetCachedUser(record.ID)
+	}
+	localUsers.byEmail.put(record.Email, user)
+	if previousPhone != record.Phone && previousPhone != "" {
+		localUsers.byPhone.remove(previousPhone, user)
+	}
+	if record.Phone != "" {
+		localUsers.byPhone.put(record.Phone, user)
+	}
+	bumpUserVersion()
+}
+
+// removeLocalUser drops a user deleted on another replica
+func removeLocalUser(id string) {
+	if user := localUsers.ByID(id); user != nil {
+		localUsers.Remove(user)
+		forgetUserTokens(id)
+	}
+}
+
+// applySharedDocument sets or (with an empty owner) removes a document in
+// the local replica
+func applySharedDocument(filename, owner string, meta sharedDocumentMeta) {
+	localDocuments.Update(func(tx DocumentTx) error {
+		if owner == "" {
+			tx.remove(filename)
+		} else {
+			tx.put(filename, meta.record(owner))
+		}
+		return nil
+	})
+	bumpDocVersion()
+}
+
+// reserveEmail claims an email for a new user across replicas
+func reserveEmail(email, userID string) error {
+	return reserveShared(reserveEmailIndex, email, userID, errEmailTaken)
+}
+
+// releaseEmail undoes reserveEmail when creating the user fails
+func releaseEmail(email string) {
+	if clustered() {
+		clusterStore.release(context.Background(), reserveEmailIndex, email)
+	}
+}
+
+// reservePhone claims a verified phone number across replicas
+func reservePhone(phone, userID string) error {
+	return reserveShared(reservePhoneIndex, phone, userID, errPhoneTaken)
+}
+
+// releasePhone frees a phone number reserved by reservePhone
+func releasePhone(phone string) {
+	if clustered() && phone != "" {
+		clusterStore.release(context.Background(), reservePhoneIndex, phone)
+	}
+}
+
+// reserveShared implements reserveEmail and reservePhone, failing with
+// taken if another user holds the value
+func reserveShared(index, value, userID string, taken error) error {
+	if !clustered() {
+		return nil
+	}
+	ok, err := clusterStore.reserve(context.Background(), index, value, userID)
+	if err != nil {
+		slog.Error("Cluster store write failed", "op", "reserve_"+index, "error", err)
+		return errStoreUnavailable
+	}
+	if !ok {
+		return taken
+	}
+	return nil
+}
+
+// sharedUserOf copies a user's fields, hash included; callers hold the
+// user's FieldLock or own the user
+func sharedUserOf(user *User) sharedUser {
+	return sharedUser{
+		ID:           user.ID,
+		Email:        user.Email,
+		PasswordHash: user.Password,
+		Name:         user.Name,
+		Avatar:       user.Avatar,
+		Role:         user.Role,
+		Status:       user.Status,
+		Phone:        user.Phone,
+		Plan:         user.Plan,
+		OrgID:        user.OrgID,
+		OrgRole:      user.OrgRole,
+		MergedInto:   user.MergedInto,
+		ReferralCode: user.ReferralCode,
+		ReferredBy:   user.ReferredBy,
+		CreatedAt:    user.CreatedAt,
+		UpdatedAt:    user.UpdatedAt,
+
+		TokensRevokedAt: user.TokensRevokedAt,
+		Devices:         user.Devices,
+		Starred:         user.Starred,
+	}
+}
+
+// saveUser writes a user to the shared store and announces the change
+func saveUser(user *User) error {
+	if !clustered() {
+		return nil
+	}
+	ctx := context.Background()
+	if err := clusterStore.saveUser(ctx, sharedUserOf(user)); err != nil {
+		slog.Error("Cluster store write failed", "op", "save_user", "error", err)
+		return errStoreUnavailable
+	}
+	publishChange(ctx, "user", user.ID)
+	return nil
+}
+
+// deleteSharedUser removes a user, their email and their phone from the
+// shared store and announces the change
+func deleteSharedUser(id, email, phone string) error {
+	if !clustered() {
+		return nil
+	}
+	ctx := context.Background()
+	if err := clusterStore.deleteUser(ctx, id, email, phone); err != nil {
+		slog.Error("Cluster store write failed", "op", "delete_user", "error", err)
+		return errStoreUnavailable
+	}
+	publishChange(ctx, "user", id)
+	return nil
+}
+
+// claimSharedDocument registers a document across replicas. It returns
+// the owner, which is someone else's ID if another replica got there first.
+func claimSharedDocument(filename, userID string, meta sharedDocumentMeta) (string, error) {
+	if !clustered() {
+		return userID, nil
+	}
+	ctx := context.Background()
+	owner, err := clusterStore.claimDocument(ctx, filename, userID, meta)
+	if err != nil {
+		slog.Error("Cluster store write failed", "op", "claim_document", "error", err)
+		return "", errStoreUnavailable
+	}
+	if owner == userID {
+		publishChange(ctx, "document", filename)
+	}
+	return owner, nil
+}
+
+// transferSharedDocument gives a document to toID if fromID still owns it
+func transferSharedDocument(filename, fromID, toID string) error {
+	if !clustered() {
+		return nil
+	}
+	ctx := context.Background()
+	if err := clusterStore.transferDocument(ctx, filename, fromID, toID); err != nil {
+		slog.Error("Cluster store write failed", "op", "transfer_document", "error", err)
+		return errStoreUnavailable
+	}
+	publishChange(ctx, "document", filename)
+	return nil
+}
+
+// releaseSharedDocument removes a document if ownerID still owns it
+func releaseSharedDocument(filename, ownerID string) error {
+	if !clustered() {
+		return nil
+	}
+	ctx := context.Background()
+	if err := clusterStore.releaseDocument(ctx, filename, ownerID); err != nil {
+		slog.Error("Cluster store write failed", "op", "release_document", "error", err)
+		return errStoreUnavailable
+	}
+	publishChange(ctx, "document", filename)
+	return nil
+}
+
+// saveDocumentMeta records a document's registration time, size, scope and
+// tags
+func saveDocumentMeta(filename string, meta sharedDocumentMeta) {
+	if !clustered() {
+		return
+	}
+	ctx := context.Background()
+	if err := clusterStore.saveDocumentMeta(ctx, filename, meta); err != nil {
+		slog.Warn("Cluster store write failed", "op", "document_meta", "error", err)
+		return
+	}
+	publishChange(ctx, "document", filename)
+}
+
+// shareSessionActivity records a token's last use for the other replicas;
+// the record lapses once the token would be idle anyway
+func shareSessionActivity(key [32]byte, at time.Time, timeout time.Duration) {
+	err := clusterStore.setActivity(context.Background(), hex.EncodeToString(key[:]), at, timeout)
+	if err != nil {
+		slog.Warn("Cluster store write failed", "op", "session_activity", "error", err)
+	}
+}
+
+// sharedSessionActivity returns a token's last use on any replica
+func sharedSessionActivity(key [32]byte) (time.Time, bool) {
+	at, found, err := clusterStore.activity(context.Background(), hex.EncodeToString(key[:]))
+	if err != nil {
+		slog.Warn("Cluster store read failed", "op", "session_activity", "error", err)
+		return time.Time{}, false
+	}
+	return at, found
+}
+
+// acquireLock takes a named lock across replicas (or within this process
+// when standalone), waiting until ctx is done. The lock is renewed while
+// held and expires after ttl if its holder dies; release is idempotent.
+func acquireLock(ctx context.Context, name string, ttl time.Duration) (func(), error) {
+	return takeLock(ctx, name, ttl, true)
+}
+
+// tryLock takes a named lock without waiting, returning errLockHeld if
+// someone else has it
+func tryLock(name string, ttl time.Duration) (func(), error) {
+	return takeLock(context.Background(), name, ttl, false)
+}
+
+// takeLock implements acquireLock and tryLock
+func takeLock(ctx context.Context, name string, ttl time.Duration, wait bool) (func(), error) {
+	if !clustered() {
+		localLocksMu.Lock()
+		lock, exists := localLocks[name]
+		if !exists {
+			lock = make(chan struct{}, 1)
+			localLocks[name] = lock
+		}
+		localLocksMu.Unlock()
+
+		select {
+		case lock <- struct{}{}:
+		default:
+			if !wait {
+				return nil, errLockHeld
+			}
+			select {
+			case lock <- struct{}{}:
+			case <-ctx.Done():
+				return nil, fmt.Errorf("lock %s: %w", name, ctx.Err())
+			}
+		}
+		var once sync.Once
+		return func() { once.Do(func() { <-lock }) }, nil
+	}
+
+	raw := make([]byte, 16)
+	rand.Read(raw)
+	token := hex.EncodeToString(raw)
+	for {
+		ok, err := clusterStore.lock(ctx, name, token, ttl)
+		if err != nil {
+			return nil, fmt.Errorf("lock %s: %w", name, err)
+		}
+		if ok {
+			break
+		}
+		if !wait {
+			return nil, errLockHeld
+		}
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("lock %s: %w", name, ctx.Err())
+		case <-time.After(lockRetryInterval):
+		}
+	}
+
+	stop := make(chan struct{})
+	go renewLock(name, token, ttl, stop)
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(stop)
+			clusterStore.unlock(context.Background(), name, token)
+		})
+	}, nil
+}
+
+// renewLock extends a held lock every third of its ttl until stop is
+// closed, so work that outlives ttl keeps it
+func renewLock(name, token string, ttl time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(ttl / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		held, err := clusterStore.extendLock(context.Background(), name, token, ttl)
+		if err != nil {
+			slog.Warn("Lock renewal failed", "lock", name, "error", err)
+			continue
+		}
+		if !held {
+			slog.Warn("Lock lost before release", "lock", name)
+			return
+		}
+	}
+}
+
+// memoryRecords is the recordStore of a standalone instance
+type memoryRecords struct {
+	mu        sync.Mutex
+	kinds     map[string]map[string]memoryRecord
+	lastSweep time.Time
+}
+
+type memoryRecord struct {
+	data      []byte
+	expiresAt time.Time // zero for none
+}
+
+// memorySweepInterval is how often writes drop expired records
+const memorySweepInterval = time.Minute
+
+func newMemoryRecords() *memoryRecords {
+	return &memoryRecords{kinds: make(map[string]map[string]memoryRecord)}
+}
+
+func (r memoryRecord) live(now time.Time) bool {
+	return r.expiresAt.IsZero() || r.expiresAt.After(now)
+}
+
+// put stores a record; callers hold m.mu
+func (m *memoryRecords) put(kind, id string, data []byte, ttl time.Duration) {
+	now := time.Now()
+	if now.Sub(m.lastSweep) > memorySweepInterval {
+		for _, records := range m.kinds {
+			for key, record := range records {
+				if !record.live(now) {
+					delete(records, key)
+				}
+			}
+		}
+		m.lastSweep = now
+	}
+	records := m.kinds[kind]
+	if records == nil {
+		records = make(map[string]memoryRecord)
+		m.kinds[kind] = records
+	}
+	record := memoryRecord{data: slices.Clone(data)}
+	if ttl > 0 {
+		record.expiresAt = now.Add(ttl)
+	}
+	records[id] = record
+}
+
+func (m *memoryRecords) records(_ context.Context, kind string) (map[string][]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	found := make(map[string][]byte)
+	for id, record := range m.kinds[kind] {
+		if record.live(now) {
+			found[id] = slices.Clone(record.data)
+		}
+	}
+	return found, nil
+}
+
+func (m *memoryRecords) record(_ context.Context, kind, id string) ([]byte, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	record, exists := m.kinds[kind][id]
+	if !exists || !record.live(time.Now()) {
+		return nil, false, nil
+	}
+	return slices.Clone(record.data), true, nil
+}
+
+func (m *memoryRecords) saveRecord(_ context.Context, kind, id string, data []byte, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.put(kind, id, data, ttl)
+	return nil
+}
+
+func (m *memoryRecords) addRecord(_ context.Context, kind, id string, data []byte, ttl time.Duration) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if record, exists := m.kinds[kind][id]; exists && record.live(time.Now()) {
+		return false, nil
+	}
+	m.put(kind, id, data, ttl)
+	return true, nil
+}
+
+func (m *memoryRecords) takeRecord(_ context.Context, kind, id string) ([]byte, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	record, exists := m.kinds[kind][id]
+	delete(m.kinds[kind], id)
+	if !exists || !record.live(time.Now()) {
+		return nil, false, nil
+	}
+	return record.data, true, nil
+}
+
+func (m *memoryRecords) deleteRecord(_ context.Context, kind, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.kinds[kind], id)
+	return nil
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ============================================================================
+// Redis Shared Store
+// ============================================================================
+//
+// cluster.mode redis keeps shared state in hashes under one key prefix.
+// Reservations and claims are HSETNX; compare-and-delete and
+// compare-and-swap on an owner or lock holder are Lua scripts, so they are
+// atomic on the server. The change feed is pub/sub, which drops messages
+// while a replica is disconnected; the periodic resync covers that.
+
+const (
+	clusterKeyPrefix    = "auth-service:"
+	clusterUsersKey     = clusterKeyPrefix + "users"       // id -> sharedUser JSON
+	clusterEmailsKey    = clusterKeyPrefix + "user-emails" // email -> id
+	clusterPhonesKey    = clusterKeyPrefix + "user-phones" // verified phone -> id
+	clusterDocsKey      = clusterKeyPrefix + "documents"   // filename -> owner id
+	clusterDocMetaKey   = clusterKeyPrefix + "document-meta"
+	clusterChangesTopic = clusterKeyPrefix + "changes"
+	clusterLockPrefix   = clusterKeyPrefix + "lock:"
+	clusterActivityKey  = clusterKeyPrefix + "session-activity:" // + token hash -> unix seconds
+	clusterSettingsKey  = clusterKeyPrefix + "settings"          // name -> JSON
+	clusterRecordPrefix = clusterKeyPrefix + "record:"           // + kind:id -> JSON
+)
+
+// releaseDocumentScript deletes a document only if it still has the
+// expected owner
+var releaseDocumentScript = redis.NewScript(`
+if redis.call("HGET", KEYS[1], ARGV[1]) ~= ARGV[2] then return 0 end
+redis.call("HDEL", KEYS[1], ARGV[1])
+redis.call("HDEL", KEYS[2], ARGV[1])
+return 1`)
+
+// transferDocumentScript changes a document's owner only if the expected
+// owner still has it
+var transferDocumentScript = redis.NewScript(`
+if redis.call("HGET", KEYS[1], ARGV[1]) ~= ARGV[2] then return 0 end
+redis.call("HSET", KEYS[1], ARGV[1], ARGV[3])
+return 1`)
+
+// releaseLockScript deletes a lock only if this holder still owns it
+var releaseLockScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then return redis.call("DEL", KEYS[1]) end
+return 0`)
+
+// extendLockScript pushes a lock's expiry out only if this holder still owns it
+var extendLockScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then return redis.call("PEXPIRE", KEYS[1], ARGV[2]) end
+return 0`)
+
+// redisStore is the sharedStore for cluster.mode redis
+type redisStore struct {
+	client *redis.Client
+}
+
+// newRedisStore connects lazily; setupCluster pings it
+func newRedisStore(url string) (*redisStore, error) {
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, fmt.Errorf("cluster.redis_url: %w", err)
+	}
+	return &redisStore{client: redis.NewClient(opts)}, nil
+}
+
+func (s *redisStore) ping(ctx context.Context) error {
+	return s.client.Ping(ctx).Err()
+}
+
+func (s *redisStore) close() error {
+	return s.client.Close()
+}
+
+// reserveKey is the hash holding an index's reservations
+func reserveKey(index string) string {
+	if index == reservePhoneIndex {
+		return clusterPhonesKey
+	}
+	return clusterEmailsKey
+}
+
+func (s *redisStore) users(ctx context.Context) (map[string]sharedUser, error) {
+	raw, err := s.client.HGetAll(ctx, clusterUsersKey).Result()
+	if err != nil {
+		return nil, err
+	}
+	users := make(map[string]sharedUser, len(raw))
+	for id, payload := range raw {
+		var record sharedUser
+		if err := json.Unmarshal([]byte(payload), &record); err == nil {
+			users[id] = record
+		}
+	}
+	return users, nil
+}
+
+func (s *redisStore) user(ctx context.Context, id string) (sharedUser, bool, error) {
+	var record sharedUser
+	raw, err := s.client.HGet(ctx, clusterUsersKey, id).Result()
+	if err == redis.Nil {
+		return record, false, nil
+	}
+	if err != nil {
+		return record, false, err
+	}
+	if err := json.Unmarshal([]byte(raw), &record); err != nil {
+		return record, false, err
+	}
+	return record, true, nil
+}
+
+func (s *redisStore) saveUser(ctx context.Context, record sharedUser) error {
+	payload, _ := json.Marshal(record)
+	return s.client.HSet(ctx, clusterUsersKey, record.ID, payload).Err()
+}
+
+func (s *redisStore) deleteUser(ctx context.Context, id, email, phone string) error {
+	_, err := s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HDel(ctx, clusterUsersKey, id)
+		pipe.HDel(ctx, clusterEmailsKey, email)
+		if phone != "" {
+			pipe.HDel(ctx, clusterPhonesKey, phone)
+		}
+		return nil
+	})
+	return err
+}
+
+func (s *redisStore) reserve(ctx context.Context, index, value, userID string) (bool, error) {
+	return s.client.HSetNX(ctx, reserveKey(index), value, userID).Result()
+}
+
+func (s *redisStore) release(ctx context.Context, index, value string) error {
+	return s.client.HDel(ctx, reserveKey(index), value).Err()
+}
+
+func (s *redisStore) documents(ctx context.Context) (map[string]sharedDocument, error) {
+	owners, err := s.client.HGetAll(ctx, clusterDocsKey).Result()
+	if err != nil {
+		return nil, err
+	}
+	rawMeta, err := s.client.HGetAll(ctx, clusterDocMetaKey).Result()
+	if err != nil {
+		return nil, err
+	}
+	docs := make(map[string]sharedDocument, len(owners))
+	for filename, owner := range owners {
+		doc := sharedDocument{Owner: owner}
+		json.Unmarshal([]byte(rawMeta[filename]), &doc.Meta)
+		docs[filename] = doc
+	}
+	return docs, nil
+}
+
+func (s *redisStore) document(ctx context.Context, filename string) (sharedDocument, bool, error) {
+	var doc sharedDocument
+	owner, err := s.client.HGet(ctx, clusterDocsKey, filename).Result()
+	if err == redis.Nil {
+		return doc, false, nil
+	}
+	if err != nil {
+		return doc, false, err
+	}
+	doc.Owner = owner
+	if raw, err := s.client.HGet(ctx, clusterDocMetaKey, filename).Result(); err == nil {
+		json.Unmarshal([]byte(raw), &doc.Meta)
+	}
+	return doc, true, nil
+}
+
+func (s *redisStore) claimDocument(ctx context.Context, filename, userID string, meta sharedDocumentMeta) (string, error) {
+	claimed, err := s.client.HSetNX(ctx, clusterDocsKey, filename, userID).Result()
+	if err != nil {
+		return "", err
+	}
+	if !claimed {
+		return s.client.HGet(ctx, clusterDocsKey, filename).Result()
+	}
+	payload, _ := json.Marshal(meta)
+	if err := s.client.HSet(ctx, clusterDocMetaKey, filename, payload).Err(); err != nil {
+		// Undo the claim so a retry starts clean
+		releaseDocumentScript.Run(ctx, s.client, []string{clusterDocsKey, clusterDocMetaKey}, filename, userID)
+		return "", err
+	}
+	return userID, nil
+}
+
+func (s *redisStore) transferDocument(ctx context.Context, filename, fromID, toID string) error {
+	return transferDocumentScript.Run(ctx, s.client, []string{clusterDocsKey}, filename, fromID, toID).Err()
+}
+
+func (s *redisStore) releaseDocument(ctx context.Context, filename, ownerID string) error {
+	return releaseDocumentScript.Run(ctx, s.client, []string{clusterDocsKey, clusterDocMetaKey}, filename, ownerID).Err()
+}
+
+func (s *redisStore) saveDocumentMeta(ctx context.Context, filename string, meta sharedDocumentMeta) error {
+	payload, _ := json.Marshal(meta)
+	return s.client.HSet(ctx, clusterDocMetaKey, filename, payload).Err()
+}
+
+func (s *redisStore) setActivity(ctx context.Context, key string, at time.Time, ttl time.Duration) error {
+	return s.client.Set(ctx, clusterActivityKey+key, at.Unix(), ttl).Err()
+}
+
+func (s *redisStore) activity(ctx context.Context, key string) (time.Time, bool, error) {
+	seconds, err := s.client.Get(ctx, clusterActivityKey+key).Int64()
+	if err == redis.Nil {
+		return time.Time{}, false, nil
+	}
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	return time.Unix(seconds, 0), true, nil
+}
+
+func (s *redisStore) setting(ctx context.Context, name string) ([]byte, bool, error) {
+	data, err := s.client.HGet(ctx, clusterSettingsKey, name).Bytes()
+	if err == redis.Nil {
+		return nil, false, nil
+	}
+	return data, err == nil, err
+}
+
+func (s *redisStore) saveSetting(ctx context.Context, name string, data []byte) error {
+	return s.client.HSet(ctx, clusterSettingsKey, name, data).Err()
+}
+
+// recordKey is the key of one record
+func recordKey(kind, id string) string {
+	return clusterRecordPrefix + kind + ":" + id
+}
+
+func (s *redisStore) records(ctx context.Context, kind string) (map[string][]byte, error) {
+	prefix := recordKey(kind, "")
+	var keys []string
+	iter := s.client.Scan(ctx, 0, prefix+"*", 100).Iterator()
+	for iter.Next(ctx) {
+		keys = append(keys, iter.Val())
+	}
+	if err := iter.Err(); err != nil {
+		return nil, err
+	}
+	records := make(map[string][]byte, len(keys))
+	if len(keys) == 0 {
+		return records, nil
+	}
+	values, err := s.client.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+	for i, value := range values {
+		// A record can expire between the scan and the read
+		if data, ok := value.(string); ok {
+			records[strings.TrimPrefix(keys[i], prefix)] = []byte(data)
+		}
+	}
+	return records, nil
+}
+
+func (s *redisStore) record(ctx context.Context, kind, id string) ([]byte, bool, error) {
+	data, err := s.client.Get(ctx, recordKey(kind, id)).Bytes()
+	if err == redis.Nil {
+		return nil, false, nil
+	}
+	return data, err == nil, err
+}
+
+func (s *redisStore) saveRecord(ctx context.Context, kind, id string, data []byte, ttl time.Duration) error {
+	return s.client.Set(ctx, recordKey(kind, id), data, ttl).Err()
+}
+
+func (s *redisStore) addRecord(ctx context.Context, kind, id string, data []byte, ttl time.Duration) (bool, error) {
+	return s.client.SetNX(ctx, recordKey(kind, id), data, ttl).Result()
+}
+
+func (s *redisStore) takeRecord(ctx context.Context, kind, id string) ([]byte, bool, error) {
+	data, err := s.client.GetDel(ctx, recordKey(kind, id)).Bytes()
+	if err == redis.Nil {
+		return nil, false, nil
+	}
+	return data, err == nil, err
+}
+
+func (s *redisStore) deleteRecord(ctx context.Context, kind, id string) error {
+	return s.client.Del(ctx, recordKey(kind, id)).Err()
+}
+
+func (s *redisStore) lock(ctx context.Context, name, token string, ttl time.Duration) (bool, error) {
+	return s.client.SetNX(ctx, clusterLockPrefix+name, token, ttl).Result()
+}
+
+func (s *redisStore) extendLock(ctx context.Context, name, token string, ttl time.Duration) (bool, error) {
+	held, err := extendLockScript.Run(ctx, s.client, []string{clusterLockPrefix + name}, token, ttl.Milliseconds()).Int()
+	return held == 1, err
+}
+
+func (s *redisStore) unlock(ctx context.Context, name, token string) error {
+	return releaseLockScript.Run(ctx, s.client, []string{clusterLockPrefix + name}, token).Err()
+}
+
+func (s *redisStore) publish(ctx context.Context, change clusterChange) error {
+	payload, _ := json.Marshal(change)
+	return s.client.Publish(ctx, clusterChangesTopic, payload).Err()
+}
+
+func (s *redisStore) subscribe(ctx context.Context) <-chan clusterChange {
+	sub := s.client.Subscribe(ctx, clusterChangesTopic)
+	changes := make(chan clusterChange)
+	go func() {
+		defer close(changes)
+		defer sub.Close()
+		messages := sub.Channel()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case msg, ok := <-messages:
+				if !ok {
+					return
+				}
+				var change clusterChange
+				if err := json.Unmarshal([]byte(msg.Payload), &change); err != nil {
+					continue
+				}
+				select {
+				case changes <- change:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return changes
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// sharedStores returns each store backend the conformance tests run
+// against. Redis always runs on miniredis; MongoDB runs when
+// AUTH_TEST_MONGO_URL points at a server, e.g.
+//
+//	docker run --rm -p 27017:27017 mongo:7
+//	AUTH_TEST_MONGO_URL=mongodb://localhost:27017 go test -run SharedStore ./...
+//
+// CI sets it against a mongo service container
+// (.github/workflows/auth-service.yml). Each Mongo test gets its own
+// database, dropped afterwards.
+func sharedStores(t *testing.T) map[string]func(t *testing.T) sharedStore {
+	stores := map[string]func(t *testing.T) sharedStore{
+		"redis": func(t *testing.T) sharedStore {
+			mr := miniredis.RunT(t)
+			store := &redisStore{client: redis.NewClient(&redis.Options{Addr: mr.Addr()})}
+			t.Cleanup(func() { store.close() })
+			return store
+		},
+	}
+	if url := os.Getenv("AUTH_TEST_MONGO_URL"); url != "" {
+		stores["mongo"] = func(t *testing.T) sharedStore {
+			store, err := newMongoStore(url, fmt.Sprintf("auth_service_test_%d", time.Now().UnixNano()), true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() {
+				store.db.Drop(context.Background())
+				store.close()
+			})
+			return store
+		}
+	}
+	return stores
+}
+
+func TestSharedStoreUsers(t *testing.T) {
+	for name, open := range sharedStores(t) {
+		t.Run(name, func(t *testing.T) {
+			store, ctx := open(t), context.Background()
+			if ok, err := store.reserve(ctx, reserveEmailIndex, "a@example.com", "u1"); err != nil || !ok {
+				t.Fatalf("reserve = %v, %v", ok, err)
+			}
+			if ok, _ := store.reserve(ctx, reserveEmailIndex, "a@example.com", "u2"); ok {
+				t.Fatal("email reserved twice")
+			}
+			if ok, _ := store.reserve(ctx, reservePhoneIndex, "a@example.com", "u2"); !ok {
+				t.Fatal("indexes are not separate")
+			}
+
+			created := time.Now().UTC().Truncate(time.Millisecond)
+			record := sharedUser{ID: "u1", Email: "a@example.com", PasswordHash: "hash", Role: "admin", CreatedAt: created}
+			if err := store.saveUser(ctx, record); err != nil {
+				t.Fatal(err)
+			}
+			got, found, err := store.user(ctx, "u1")
+			if err != nil || !found || got.PasswordHash != "hash" || !got.CreatedAt.Equal(created) {
+				t.Fatalf("user = %+v, %v, %v", got, found, err)
+			}
+			record.Role = "user"
+			store.saveUser(ctx, record)
+			if users, _ := store.users(ctx); len(users) != 1 || users["u1"].Role != "user" {
+				t.Fatalf("users = %+v", users)
+			}
+
+			if err := store.deleteUser(ctx, "u1", "a@example.com", ""); err != nil {
+				t.Fatal(err)
+			}
+			if _, found, _ := store.user(ctx, "u1"); found {
+				t.Fatal("user survived delete")
+			}
+			if ok, _ := store.reserve(ctx, reserveEmailIndex, "a@example.com", "u3"); !ok {
+				t.Fatal("email still reserved after delete")
+			}
+		})
+	}
+}
+
+func TestSharedStoreDocuments(t *testing.T) {
+	for name, open := range sharedStores(t) {
+		t.Run(name, func(t *testing.T) {
+			store, ctx := open(t), context.Background()
+			meta := sharedDocumentMeta{AddedAt: time.Now().UTC().Truncate(time.Millisecond)}
+			if owner, err := store.claimDocument(ctx, "report.pdf", "u1", meta); err != nil || owner != "u1" {
+				t.Fatalf("claim = %q, %v", owner, err)
+			}
+			if owner, _ := store.claimDocument(ctx, "report.pdf", "u2", meta); owner != "u1" {
+				t.Fatalf("second claim owner = %q; want u1", owner)
+			}
+
+			meta.Size, meta.Tags = 42, []string{"finance"}
+			store.saveDocumentMeta(ctx, "report.pdf", meta)
+			// Stale owners change nothing
+			store.transferDocument(ctx, "report.pdf", "u2", "u3")
+			store.releaseDocument(ctx, "report.pdf", "u2")
+			doc, found, err := store.document(ctx, "report.pdf")
+			if err != nil || !found || doc.Owner != "u1" || doc.Meta.Size != 42 || len(doc.Meta.Tags) != 1 {
+				t.Fatalf("document = %+v, %v, %v", doc, found, err)
+			}
+
+			store.transferDocument(ctx, "report.pdf", "u1", "u2")
+			if docs, _ := store.documents(ctx); docs["report.pdf"].Owner != "u2" {
+				t.Fatalf("documents = %+v", docs)
+			}
+			store.releaseDocument(ctx, "report.pdf", "u2")
+			if _, found, _ := store.document(ctx, "report.pdf"); found {
+				t.Fatal("document survived release")
+			}
+		})
+	}
+}
+
+func TestSharedStoreLocksAndActivity(t *testing.T) {
+	for name, open := range sharedStores(t) {
+		t.Run(name, func(t *testing.T) {
+			store, ctx := open(t), context.Background()
+			if ok, err := store.lock(ctx, "job", "a", time.Minute); err != nil || !ok {
+				t.Fatalf("lock = %v, %v", ok, err)
+			}
+			if ok, err := store.lock(ctx, "job", "b", time.Minute); err != nil || ok {
+				t.Fatalf("second lock = %v, %v", ok, err)
+			}
+			if ok, _ := store.extendLock(ctx, "job", "b", time.Minute); ok {
+				t.Fatal("non-holder extended the lock")
+			}
+			if ok, _ := store.extendLock(ctx, "job", "a", time.Minute); !ok {
+				t.Fatal("holder could not extend the lock")
+			}
+			store.unlock(ctx, "job", "b")
+			if ok, _ := store.lock(ctx, "job", "b", time.Minute); ok {
+				t.Fatal("non-holder released the lock")
+			}
+			store.unlock(ctx, "job", "a")
+			if ok, _ := store.lock(ctx, "job", "b", time.Minute); !ok {
+				t.Fatal("lock not free after release")
+			}
+
+			at := time.Unix(time.Now().Unix(), 0)
+			if err := store.setActivity(ctx, "token", at, time.Minute); err != nil {
+				t.Fatal(err)
+			}
+			if got, found, err := store.activity(ctx, "token"); err != nil || !found || !got.Equal(at) {
+				t.Fatalf("activity = %v, %v, %v", got, found, err)
+			}
+			if _, found, _ := store.activity(ctx, "other"); found {
+				t.Fatal("activity for an unknown token")
+			}
+		})
+	}
+}
+
+func TestSharedStoreSettings(t *testing.T) {
+	for name, open := range sharedStores(t) {
+		t.Run(name, func(t *testing.T) {
+			store, ctx := open(t), context.Background()
+			if _, found, err := store.setting(ctx, providerChainSetting); err != nil || found {
+				t.Fatalf("unset setting = %v, %v", found, err)
+			}
+			store.saveSetting(ctx, providerChainSetting, []byte(`{"version":1}`))
+			store.saveSetting(ctx, providerChainSetting, []byte(`{"version":2}`))
+			if data, found, err := store.setting(ctx, providerChainSetting); err != nil || !found || string(data) != `{"version":2}` {
+				t.Fatalf("setting = %s, %v, %v", data, found, err)
+			}
+		})
+	}
+}
+
+func TestSharedStoreAuditChain(t *testing.T) {
+	for name, open := range sharedStores(t) {
+		t.Run(name, func(t *testing.T) {
+			chain, ok := open(t).(auditChainStore)
+			if !ok {
+				t.Skip("the audit log stays per instance with this store")
+			}
+			ctx, start := context.Background(), time.Now().UTC().Add(-time.Hour)
+
+			// Replicas appending together still produce one unbroken chain
+			var wg sync.WaitGroup
+			for i := 0; i < 10; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					entry := AuditEntry{ID: fmt.Sprint(i), Timestamp: start.Add(time.Duration(i) * time.Minute), Action: "test", Transport: "http"}
+					if _, err := chain.appendAudit(ctx, entry); err != nil {
+						t.Error(err)
+					}
+				}(i)
+			}
+			wg.Wait()
+			entries, err := chain.auditEntries(ctx)
+			if err != nil || len(entries) != 10 {
+				t.Fatalf("entries = %d, %v", len(entries), err)
+			}
+			if result := verifyAuditChain(entries); !result.Valid || result.FirstSeq != 1 || result.LastSeq != 10 {
+				t.Fatalf("verification = %+v", result)
+			}
+
+			cutoff := start.Add(5 * time.Minute)
+			if removed, err := chain.pruneAudit(ctx, cutoff); err != nil || removed != 5 {
+				t.Fatalf("prune = %d, %v", removed, err)
+			}
+			left, _ := chain.auditEntries(ctx)
+			for _, entry := range left {
+				if entry.Timestamp.Before(cutoff) {
+					t.Fatalf("entry %d outlived retention", entry.Seq)
+				}
+			}
+		})
+	}
+}
+
+func TestRecordStores(t *testing.T) {
+	stores := map[string]func(t *testing.T) recordStore{
+		"memory": func(*testing.T) recordStore { return newMemoryRecords() },
+	}
+	for name, open := range sharedStores(t) {
+		stores[name] = func(t *testing.T) recordStore { return open(t) }
+	}
+	for name, open := range stores {
+		t.Run(name, func(t *testing.T) {
+			store, ctx := open(t), context.Background()
+			if _, found, err := store.record(ctx, "a", "1"); err != nil || found {
+				t.Fatalf("unset record = %v, %v", found, err)
+			}
+			store.saveRecord(ctx, "a", "1", []byte(`{"n":1}`), 0)
+			store.saveRecord(ctx, "a", "1", []byte(`{"n":2}`), 0)
+			store.saveRecord(ctx, "a", "2", []byte(`{"n":3}`), time.Minute)
+			store.saveRecord(ctx, "b", "1", []byte(`{"n":4}`), 0)
+			if data, found, err := store.record(ctx, "a", "1"); err != nil || !found || string(data) != `{"n":2}` {
+				t.Fatalf("record = %s, %v, %v", data, found, err)
+			}
+			records, err := store.records(ctx, "a")
+			if err != nil || len(records) != 2 || string(records["2"]) != `{"n":3}` {
+				t.Fatalf("records = %s, %v", records, err)
+			}
+
+			// One add and one take win
+			if added, err := store.addRecord(ctx, "a", "1", []byte(`{}`), 0); err != nil || added {
+				t.Fatalf("add over a live record = %v, %v", added, err)
+			}
+			if added, err := store.addRecord(ctx, "a", "3", []byte(`{"n":5}`), time.Minute); err != nil || !added {
+				t.Fatalf("add = %v, %v", added, err)
+			}
+			if data, found, err := store.takeRecord(ctx, "a", "3"); err != nil || !found || string(data) != `{"n":5}` {
+				t.Fatalf("take = %s, %v, %v", data, found, err)
+			}
+			if _, found, err := store.takeRecord(ctx, "a", "3"); err != nil || found {
+				t.Fatalf("second take = %v, %v", found, err)
+			}
+
+			store.deleteRecord(ctx, "a", "1")
+			if _, found, _ := store.record(ctx, "a", "1"); found {
+				t.Fatal("deleted record found")
+			}
+			if _, found, _ := store.record(ctx, "b", "1"); !found {
+				t.Fatal("delete reached another kind")
+			}
+		})
+	}
+}
+
+func TestMemoryRecordsExpire(t *testing.T) {
+	store, ctx := newMemoryRecords(), context.Background()
+	store.saveRecord(ctx, "a", "1", []byte(`{}`), time.Nanosecond)
+	time.Sleep(time.Millisecond)
+	if _, found, _ := store.record(ctx, "a", "1"); found {
+		t.Fatal("expired record found")
+	}
+	if added, _ := store.addRecord(ctx, "a", "1", []byte(`{}`), 0); !added {
+		t.Fatal("expired record blocks add")
+	}
+}
+
+func TestSharedStoreChangeFeed(t *testing.T) {
+	for name, open := range sharedStores(t) {
+		t.Run(name, func(t *testing.T) {
+			store := open(t)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			changes := store.subscribe(ctx)
+
+			want := clusterChange{Origin: "a", Kind: "user", ID: "u1"}
+			deadline := time.After(5 * time.Second)
+			for {
+				// Subscriptions start asynchronously, so publish until one arrives
+				if err := store.publish(ctx, want); err != nil {
+					t.Fatal(err)
+				}
+				select {
+				case got := <-changes:
+					if got != want {
+						t.Fatalf("change = %+v; want %+v", got, want)
+					}
+					return
+				case <-time.After(50 * time.Millisecond):
+				case <-deadline:
+					t.Fatal("no change delivered")
+				}
+			}
+		})
+	}
+}
+
+func TestMongoChangeEncoding(t *testing.T) {
+	raw, err := bson.Marshal(mongoChange{Change: clusterChange{Origin: "a", Kind: "document", ID: "report.pdf"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fields bson.M
+	bson.Unmarshal(raw, &fields)
+	if fields["kind"] != "document" || fields["id"] != "report.pdf" {
+		t.Fatalf("encoded change = %v", fields)
+	}
+	if _, exists := fields["_id"]; exists {
+		t.Fatal("empty ObjectID encoded; the server should assign it")
+	}
+}
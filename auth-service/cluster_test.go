@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+// useSharedStore switches the process into cluster mode against an
+// in-memory Redis for the duration of a test
+func useSharedStore(t *testing.T) *miniredis.Miniredis {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	clusterStore = &redisStore{client: redis.NewClient(&redis.Options{Addr: mr.Addr()})}
+	instanceID = "test"
+	t.Cleanup(func() {
+		clusterStore.close()
+		clusterStore = nil
+	})
+	return mr
+}
+
+// resetLocalStores empties the local user and document replicas
+func resetLocalStores(t testing.TB) {
+	t.Helper()
+	localUsers.byEmail, localUsers.byID = newUserIndex(), newUserIndex()
+	localDocuments.replace(newDocumentIndex())
+}
+
+func TestReserveEmail(t *testing.T) {
+	if err := reserveEmail("a@example.com", "u1"); err != nil {
+		t.Fatalf("standalone reserve: %v", err)
+	}
+
+	useSharedStore(t)
+	if err := reserveEmail("a@example.com", "u1"); err != nil {
+		t.Fatalf("first reserve: %v", err)
+	}
+	if err := reserveEmail("a@example.com", "u2"); err != errEmailTaken {
+		t.Fatalf("second reserve = %v, want errEmailTaken", err)
+	}
+	releaseEmail("a@example.com")
+	if err := reserveEmail("a@example.com", "u2"); err != nil {
+		t.Fatalf("reserve after release: %v", err)
+	}
+}
+
+func TestReserveEmailStoreDown(t *testing.T) {
+	mr := useSharedStore(t)
+	mr.Close()
+	if err := reserveEmail("a@example.com", "u1"); err != errStoreUnavailable {
+		t.Fatalf("reserve = %v, want errStoreUnavailable", err)
+	}
+}
+
+func TestClaimAndReleaseSharedDocument(t *testing.T) {
+	mr := useSharedStore(t)
+	addedAt := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	owner, err := claimSharedDocument("report.pdf", "u1", sharedDocumentMeta{Name: "report.pdf", AddedAt: addedAt})
+	if err != nil || owner != "u1" {
+		t.Fatalf("claim = %q, %v; want u1", owner, err)
+	}
+	owner, err = claimSharedDocument("report.pdf", "u2", sharedDocumentMeta{Name: "report.pdf", AddedAt: time.Now()})
+	if err != nil || owner != "u1" {
+		t.Fatalf("competing claim = %q, %v; want u1", owner, err)
+	}
+	if mr.HGet(clusterDocMetaKey, "report.pdf") == "" {
+		t.Fatal("document metadata not stored")
+	}
+
+	// Only the owner can release
+	if err := releaseSharedDocument("report.pdf", "u2"); err != nil {
+		t.Fatal(err)
+	}
+	if got := mr.HGet(clusterDocsKey, "report.pdf"); got != "u1" {
+		t.Fatalf("owner after foreign release = %q, want u1", got)
+	}
+	if err := releaseSharedDocument("report.pdf", "u1"); err != nil {
+		t.Fatal(err)
+	}
+	if mr.HGet(clusterDocsKey, "report.pdf") != "" || mr.HGet(clusterDocMetaKey, "report.pdf") != "" {
+		t.Fatal("document still registered after release")
+	}
+}
+
+func TestClaimSharedDocumentMetaWriteFails(t *testing.T) {
+	mr := useSharedStore(t)
+	// A key of the wrong type makes the metadata HSET fail
+	mr.Set(clusterDocMetaKey, "not a hash")
+
+	if _, err := claimSharedDocument("report.pdf", "u1", sharedDocumentMeta{AddedAt: time.Now()}); err != errStoreUnavailable {
+		t.Fatalf("claim = %v, want errStoreUnavailable", err)
+	}
+	if got := mr.HGet(clusterDocsKey, "report.pdf"); got != "" {
+		t.Fatalf("claim left behind for %q", got)
+	}
+}
+
+func TestSharedStateReachesReplica(t *testing.T) {
+	useSharedStore(t)
+	resetLocalStores(t)
+	t.Cleanup(func() { resetLocalStores(t) })
+
+	now := time.Now().UTC()
+	user := &User{ID: "u1", Email: "a@example.com", Password: "hash", Name: "A", Role: "user", CreatedAt: now, UpdatedAt: now}
+	if err := saveUser(user); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := claimSharedDocument("report.pdf", "u1", sharedDocumentMeta{Name: "report.pdf", AddedAt: now}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A replica that missed the change feed catches up on resync
+	if err := resyncShared(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	got := localUsers.ByEmail("a@example.com")
+	if got == nil || got.ID != "u1" || got.Password != "hash" {
+		t.Fatalf("user after resync = %+v", got)
+	}
+	if owner := defaultService.DocumentOwner("report.pdf"); owner != "u1" {
+		t.Fatalf("document owner after resync = %q, want u1", owner)
+	}
+
+	// A change message refreshes a single record
+	user.Name = "Renamed"
+	if err := saveUser(user); err != nil {
+		t.Fatal(err)
+	}
+	if err := refreshRecord(context.Background(), clusterChange{Kind: "user", ID: "u1"}); err != nil {
+		t.Fatal(err)
+	}
+	name, _, _ := userContact("u1")
+	if name != "Renamed" {
+		t.Fatalf("name after refresh = %q, want Renamed", name)
+	}
+}
+
+func TestSharedDeleteReachesReplica(t *testing.T) {
+	useSharedStore(t)
+	resetLocalStores(t)
+	t.Cleanup(func() { resetLocalStores(t) })
+
+	created := time.Now().Add(-time.Minute)
+	for _, id := range []string{"u1", "u2"} {
+		user := &User{ID: id, Email: id + "@example.com", Role: "user", CreatedAt: created, UpdatedAt: created}
+		if err := saveUser(user); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := resyncShared(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// u1 through the change feed, u2 by a resync after a missed message
+	for _, id := range []string{"u1", "u2"} {
+		if err := deleteSharedUser(id, id+"@example.com", ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := refreshRecord(context.Background(), clusterChange{Kind: "user", ID: "u1"}); err != nil {
+		t.Fatal(err)
+	}
+	if localUsers.ByID("u1") != nil || localUsers.ByID("u2") == nil {
+		t.Fatal("change message for u1 should remove u1 alone")
+	}
+	if err := resyncShared(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if localUsers.ByID("u2") != nil || localUsers.ByEmail("u2@example.com") != nil {
+		t.Fatal("u2 kept after resync")
+	}
+	if err := reserveEmail("u1@example.com", "u3"); err != nil {
+		t.Fatalf("deleted user's email still reserved: %v", err)
+	}
+}
+
+func TestLockExclusive(t *testing.T) {
+	for _, mode := range []string{clusterModeStandalone, clusterModeRedis} {
+		t.Run(mode, func(t *testing.T) {
+			if mode == clusterModeRedis {
+				useSharedStore(t)
+			}
+			release, err := acquireLock(context.Background(), "job", time.Minute)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := tryLock("job", time.Minute); err != errLockHeld {
+				t.Fatalf("tryLock while held = %v, want errLockHeld", err)
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+			if _, err := acquireLock(ctx, "job", time.Minute); !errors.Is(err, context.DeadlineExceeded) {
+				t.Fatalf("acquireLock while held = %v, want deadline exceeded", err)
+			}
+			if other, err := tryLock("other-job", time.Minute); err != nil {
+				t.Fatalf("unrelated lock: %v", err)
+			} else {
+				other()
+			}
+
+			release()
+			release() // idempotent
+			again, err := tryLock("job", time.Minute)
+			if err != nil {
+				t.Fatalf("tryLock after release: %v", err)
+			}
+			again()
+		})
+	}
+}
+
+func TestLockWaitsForRelease(t *testing.T) {
+	useSharedStore(t)
+	release, err := acquireLock(context.Background(), "job", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.AfterFunc(150*time.Millisecond, release)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	next, err := acquireLock(ctx, "job", time.Minute)
+	if err != nil {
+		t.Fatalf("waiting acquire: %v", err)
+	}
+	next()
+}
+
+func TestLockRenewedWhileHeld(t *testing.T) {
+	mr := useSharedStore(t)
+	const ttl = 90 * time.Millisecond
+	release, err := acquireLock(context.Background(), "job", ttl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+
+	key := clusterLockPrefix + "job"
+	mr.FastForward(80 * time.Millisecond)
+	time.Sleep(ttl / 2) // at least one renewal
+	if remaining := mr.TTL(key); remaining <= 10*time.Millisecond {
+		t.Fatalf("lock TTL = %v; not renewed", remaining)
+	}
+}
+
+func TestLockReleaseKeepsNewHolder(t *testing.T) {
+	mr := useSharedStore(t)
+	release, err := acquireLock(context.Background(), "job", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The lock expires and someone else takes it
+	mr.Del(clusterLockPrefix + "job")
+	next, err := tryLock("job", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer next()
+
+	release()
+	if !mr.Exists(clusterLockPrefix + "job") {
+		t.Fatal("stale release removed the new holder's lock")
+	}
+}
+
+func TestSourceLockName(t *testing.T) {
+	a := &ConnectorLink{Kind: "s3", UserID: "u1", Settings: map[string]string{"bucket": "docs", "region": "us-east-1"}}
+	b := &ConnectorLink{Kind: "s3", UserID: "u1", Settings: map[string]string{"region": "us-east-1", "bucket": "docs"}}
+	c := &ConnectorLink{Kind: "s3", UserID: "u1", Settings: map[string]string{"bucket": "other", "region": "us-east-1"}}
+
+	if sourceLockName(a) != sourceLockName(b) {
+		t.Fatal("same source produced different lock names")
+	}
+	if sourceLockName(a) == sourceLockName(c) {
+		t.Fatal("different sources share a lock name")
+	}
+}
@@ -0,0 +1,142 @@
+// Command authctl runs operator tasks against the auth service's stores.
+// For now that is schema migrations of the MongoDB shared store
+// (cluster.mode mongo):
+//
+//	authctl migrate status
+//	authctl migrate up
+//	authctl migrate down [-steps 1]
+//	authctl migrate force VERSION
+//
+// The database comes from -mongo-url and -database, which default to
+// CLUSTER_MONGO_URL and CLUSTER_MONGO_DATABASE like the service's own
+// settings. Migrations are the ones built into this binary, so use the
+// authctl from the release being deployed. force only records a version,
+// after a failed migration has been repaired by hand; it runs nothing.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strconv"
+
+	"auth-service/migrations"
+
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+const usage = `usage: authctl migrate status|up|down|force [flags] [VERSION]
+
+Flags:
+`
+
+func main() {
+	if len(os.Args) < 3 || os.Args[1] != "migrate" {
+		fmt.Fprint(os.Stderr, usage)
+		flags, _ := migrateFlags("migrate")
+		flags.PrintDefaults()
+		os.Exit(2)
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	if err := migrate(ctx, os.Args[2], os.Args[3:]); err != nil {
+		fmt.Fprintln(os.Stderr, "authctl:", err)
+		os.Exit(1)
+	}
+}
+
+// connection is where migrations run
+type connection struct {
+	url, database string
+	steps         int
+}
+
+// migrateFlags returns the flags every migrate command takes, bound to
+// the connection they describe
+func migrateFlags(name string) (*flag.FlagSet, *connection) {
+	conn := &connection{}
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	database := os.Getenv("CLUSTER_MONGO_DATABASE")
+	if database == "" {
+		database = "auth_service"
+	}
+	flags.StringVar(&conn.url, "mongo-url", os.Getenv("CLUSTER_MONGO_URL"), "MongoDB connection string")
+	flags.StringVar(&conn.database, "database", database, "database holding the shared store")
+	flags.IntVar(&conn.steps, "steps", 1, "migrations to revert (down only)")
+	return flags, conn
+}
+
+// migrate runs one migrate subcommand
+func migrate(ctx context.Context, command string, args []string) error {
+	flags, conn := migrateFlags("migrate " + command)
+	flags.Parse(args)
+	if conn.url == "" {
+		return fmt.Errorf("-mongo-url (or CLUSTER_MONGO_URL) is required")
+	}
+
+	known, err := migrations.Embedded()
+	if err != nil {
+		return err
+	}
+	client, err := mongo.Connect(options.Client().ApplyURI(conn.url))
+	if err != nil {
+		return err
+	}
+	defer client.Disconnect(context.Background())
+	runner := migrations.NewRunner(client.Database(conn.database), known)
+
+	switch command {
+	case "status":
+		status, err := runner.Status(ctx)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("database:  %s\nversion:   %d\nlatest:    %d\npending:   %d\ndirty:     %t\n",
+			conn.database, status.Current, status.Latest, status.Pending, status.Dirty)
+		for _, migration := range known {
+			state := "pending"
+			if migration.Version <= status.Current {
+				state = "applied"
+			}
+			fmt.Printf("  %04d %-30s %s\n", migration.Version, migration.Name, state)
+		}
+	case "up":
+		applied, err := runner.Up(ctx)
+		for _, migration := range applied {
+			fmt.Printf("applied  %04d %s\n", migration.Version, migration.Name)
+		}
+		if err != nil {
+			return err
+		}
+		if len(applied) == 0 {
+			fmt.Println("schema is up to date")
+		}
+	case "down":
+		if conn.steps < 1 {
+			return fmt.Errorf("-steps must be at least 1")
+		}
+		reverted, err := runner.Down(ctx, conn.steps)
+		for _, migration := range reverted {
+			fmt.Printf("reverted %04d %s\n", migration.Version, migration.Name)
+		}
+		return err
+	case "force":
+		if flags.NArg() != 1 {
+			return fmt.Errorf("force needs the version to record")
+		}
+		version, err := strconv.Atoi(flags.Arg(0))
+		if err != nil {
+			return fmt.Errorf("invalid version %q", flags.Arg(0))
+		}
+		if err := runner.Force(ctx, version); err != nil {
+			return err
+		}
+		fmt.Printf("version set to %d\n", version)
+	default:
+		return fmt.Errorf("unknown command %q; want status, up, down or force", command)
+	}
+	return nil
+}
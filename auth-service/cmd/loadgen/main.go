@@ -0,0 +1,373 @@
+// Command loadgen drives a running auth service with login, token
+// verification and document registration traffic and reports throughput and
+// latency percentiles per operation.
+//
+//	go run ./cmd/loadgen -url http://localhost:8001 -concurrency 32 -duration 30s \
+//	    -mix login=1,verify=8,register=1 -max-p99 50ms
+//
+// It registers its own accounts first (-users, default one per worker), so
+// run it against a disposable instance with RATE_LIMIT_ENABLED=false or the
+// auth limits will reject most of the setup and login traffic. Documents it
+// registers are released again at the end unless -keep is set. With
+// -max-p99 or -max-errors it exits 1 when a threshold is missed, which is
+// how CI catches regressions.
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+
+	"auth-service/client"
+)
+
+// Operations loadgen knows how to run
+const (
+	opLogin    = "login"
+	opVerify   = "verify"
+	opRegister = "register"
+)
+
+var operations = []string{opLogin, opVerify, opRegister}
+
+type options struct {
+	url         string
+	concurrency int
+	duration    time.Duration
+	requests    int
+	users       int
+	mix         map[string]int
+	timeout     time.Duration
+	keep        bool
+	jsonOutput  bool
+	maxP99      time.Duration
+	maxErrors   float64
+}
+
+// account is one loadgen user and the client logged in as it
+type account struct {
+	email, password string
+	client          *client.Client
+}
+
+// sample is one timed operation
+type sample struct {
+	op      string
+	latency time.Duration
+	err     error
+}
+
+// Result summarises one operation
+type Result struct {
+	Operation   string  `json:"operation"`
+	Requests    int     `json:"requests"`
+	Errors      int     `json:"errors"`
+	RateLimited int     `json:"rate_limited"`
+	PerSecond   float64 `json:"per_second"`
+	P50         float64 `json:"p50_ms"`
+	P90         float64 `json:"p90_ms"`
+	P99         float64 `json:"p99_ms"`
+	Max         float64 `json:"max_ms"`
+}
+
+func main() {
+	opts, err := parseFlags()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "loadgen:", err)
+		os.Exit(2)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	httpClient := &http.Client{
+		Timeout:   opts.timeout,
+		Transport: &http.Transport{MaxIdleConnsPerHost: opts.concurrency, ForceAttemptHTTP2: true},
+	}
+	newClient := func() *client.Client {
+		return client.New(opts.url, client.WithHTTPClient(httpClient), client.WithRetries(0))
+	}
+
+	runID := randomHex(4)
+	accounts, err := setupAccounts(ctx, opts, runID, newClient)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "loadgen: setup:", err)
+		os.Exit(1)
+	}
+
+	started := time.Now()
+	samples, registered := run(ctx, opts, runID, accounts)
+	elapsed := time.Since(started)
+
+	if !opts.keep {
+		cleanup(accounts, registered)
+	}
+
+	results := summarise(samples, elapsed)
+	if opts.jsonOutput {
+		json.NewEncoder(os.Stdout).Encode(map[string]any{
+			"url":         opts.url,
+			"concurrency": opts.concurrency,
+			"elapsed_s":   elapsed.Seconds(),
+			"results":     results,
+		})
+	} else {
+		printResults(results, opts, elapsed)
+	}
+
+	if failures := checkThresholds(results, opts); len(failures) > 0 {
+		for _, failure := range failures {
+			fmt.Fprintln(os.Stderr, "loadgen: FAIL:", failure)
+		}
+		os.Exit(1)
+	}
+}
+
+func parseFlags() (*options, error) {
+	opts := &options{}
+	var mix string
+	flag.StringVar(&opts.url, "url", "http://localhost:8001", "auth service base URL")
+	flag.IntVar(&opts.concurrency, "concurrency", 8, "concurrent workers")
+	flag.DurationVar(&opts.duration, "duration", 10*time.Second, "how long to run")
+	flag.IntVar(&opts.requests, "requests", 0, "stop after this many operations (0 = run for -duration)")
+	flag.IntVar(&opts.users, "users", 0, "accounts to create (0 = one per worker)")
+	flag.StringVar(&mix, "mix", "login=1,verify=8,register=1", "operation weights, from "+strings.Join(operations, ", "))
+	flag.DurationVar(&opts.timeout, "timeout", 10*time.Second, "per-request timeout")
+	flag.BoolVar(&opts.keep, "keep", false, "leave registered documents in place")
+	flag.BoolVar(&opts.jsonOutput, "json", false, "print results as JSON")
+	flag.DurationVar(&opts.maxP99, "max-p99", 0, "fail if any operation's p99 latency exceeds this")
+	flag.Float64Var(&opts.maxErrors, "max-errors", -1, "fail if any operation's error rate exceeds this fraction")
+	flag.Parse()
+
+	if opts.concurrency < 1 {
+		return nil, errors.New("-concurrency must be at least 1")
+	}
+	if opts.users <= 0 {
+		opts.users = opts.concurrency
+	}
+	var err error
+	if opts.mix, err = parseMix(mix); err != nil {
+		return nil, err
+	}
+	return opts, nil
+}
+
+// parseMix reads "op=weight,..." into a weight per operation
+func parseMix(spec string) (map[string]int, error) {
+	mix := make(map[string]int)
+	for _, part := range strings.Split(spec, ",") {
+		name, weightText, found := strings.Cut(strings.TrimSpace(part), "=")
+		weight := 1
+		if found {
+			var err error
+			if weight, err = strconv.Atoi(weightText); err != nil || weight < 0 {
+				return nil, fmt.Errorf("-mix: bad weight in %q", part)
+			}
+		}
+		known := false
+		for _, op := range operations {
+			known = known || op == name
+		}
+		if !known {
+			return nil, fmt.Errorf("-mix: unknown operation %q (have %s)", name, strings.Join(operations, ", "))
+		}
+		if weight > 0 {
+			mix[name] = weight
+		}
+	}
+	if len(mix) == 0 {
+		return nil, errors.New("-mix selects no operations")
+	}
+	return mix, nil
+}
+
+// schedule expands the mix into a repeating sequence of operations
+func schedule(mix map[string]int) []string {
+	var ops []string
+	for _, op := range operations {
+		for i := 0; i < mix[op]; i++ {
+			ops = append(ops, op)
+		}
+	}
+	return ops
+}
+
+// setupAccounts registers the run's accounts; their clients keep the token
+func setupAccounts(ctx context.Context, opts *options, runID string, newClient func() *client.Client) ([]*account, error) {
+	accounts := make([]*account, opts.users)
+	for i := range accounts {
+		acct := &account{
+			email:    fmt.Sprintf("loadgen-%s-%d@loadgen.test", runID, i),
+			password: "Lg-" + randomHex(12),
+			client:   newClient(),
+		}
+		if _, err := acct.client.Register(ctx, acct.email, acct.password, "Loadgen "+strconv.Itoa(i)); err != nil {
+			return nil, fmt.Errorf("register %s: %w", acct.email, err)
+		}
+		accounts[i] = acct
+	}
+	return accounts, nil
+}
+
+// run starts the workers and collects every sample, plus the documents
+// registered per account
+func run(ctx context.Context, opts *options, runID string, accounts []*account) ([]sample, map[*account][]string) {
+	if opts.requests == 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.duration)
+		defer cancel()
+	}
+	ops := schedule(opts.mix)
+
+	var (
+		mu         sync.Mutex
+		samples    []sample
+		registered = make(map[*account][]string)
+		issued     atomic.Int64
+		wg         sync.WaitGroup
+	)
+
+	for w := 0; w < opts.concurrency; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			acct := accounts[w%len(accounts)]
+			var local []sample
+			var docs []string
+			for n := 0; ctx.Err() == nil; n++ {
+				if opts.requests > 0 && issued.Add(1) > int64(opts.requests) {
+					break
+				}
+				op := ops[(w+n)%len(ops)]
+				start := time.Now()
+				var err error
+				switch op {
+				case opLogin:
+					_, err = acct.client.Login(ctx, acct.email, acct.password)
+				case opVerify:
+					_, err = acct.client.Verify(ctx)
+				case opRegister:
+					filename := fmt.Sprintf("loadgen-%s-w%d-%d.pdf", runID, w, n)
+					if _, err = acct.client.RegisterDocument(ctx, filename); err == nil {
+						docs = append(docs, filename)
+					}
+				}
+				if ctx.Err() != nil {
+					break // cut off by the deadline, not a real result
+				}
+				local = append(local, sample{op: op, latency: time.Since(start), err: err})
+			}
+			mu.Lock()
+			samples = append(samples, local...)
+			registered[acct] = append(registered[acct], docs...)
+			mu.Unlock()
+		}(w)
+	}
+	wg.Wait()
+	return samples, registered
+}
+
+// cleanup releases the documents the run registered
+func cleanup(accounts []*account, registered map[*account][]string) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	for _, acct := range accounts {
+		for _, filename := range registered[acct] {
+			if err := acct.client.UnregisterDocument(ctx, filename); err != nil {
+				fmt.Fprintf(os.Stderr, "loadgen: release %s: %v\n", filename, err)
+			}
+		}
+	}
+}
+
+// summarise groups samples by operation
+func summarise(samples []sample, elapsed time.Duration) []Result {
+	byOp := make(map[string][]sample)
+	for _, s := range samples {
+		byOp[s.op] = append(byOp[s.op], s)
+	}
+
+	var results []Result
+	for _, op := range operations {
+		group := byOp[op]
+		if len(group) == 0 {
+			continue
+		}
+		latencies := make([]time.Duration, len(group))
+		result := Result{Operation: op, Requests: len(group), PerSecond: float64(len(group)) / elapsed.Seconds()}
+		for i, s := range group {
+			latencies[i] = s.latency
+			if s.err != nil {
+				result.Errors++
+				if client.IsStatus(s.err, http.StatusTooManyRequests) {
+					result.RateLimited++
+				}
+			}
+		}
+		sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+		result.P50 = millis(percentile(latencies, 50))
+		result.P90 = millis(percentile(latencies, 90))
+		result.P99 = millis(percentile(latencies, 99))
+		result.Max = millis(latencies[len(latencies)-1])
+		results = append(results, result)
+	}
+	return results
+}
+
+// percentile returns the nearest-rank percentile of sorted latencies
+func percentile(sorted []time.Duration, p int) time.Duration {
+	rank := (p*len(sorted) + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+func millis(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+func printResults(results []Result, opts *options, elapsed time.Duration) {
+	fmt.Printf("%s, %d workers, %d accounts, %s\n\n", opts.url, opts.concurrency, opts.users, elapsed.Round(time.Millisecond))
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "operation\trequests\terrors\t429s\treq/s\tp50 ms\tp90 ms\tp99 ms\tmax ms\t")
+	for _, r := range results {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%.1f\t%.2f\t%.2f\t%.2f\t%.2f\t\n",
+			r.Operation, r.Requests, r.Errors, r.RateLimited, r.PerSecond, r.P50, r.P90, r.P99, r.Max)
+	}
+	tw.Flush()
+}
+
+// checkThresholds lists the -max-p99 and -max-errors violations
+func checkThresholds(results []Result, opts *options) []string {
+	var failures []string
+	for _, r := range results {
+		if opts.maxP99 > 0 && r.P99 > millis(opts.maxP99) {
+			failures = append(failures, fmt.Sprintf("%s p99 %.2fms exceeds %s", r.Operation, r.P99, opts.maxP99))
+		}
+		if opts.maxErrors >= 0 && float64(r.Errors)/float64(r.Requests) > opts.maxErrors {
+			failures = append(failures, fmt.Sprintf("%s error rate %d/%d exceeds %.3f", r.Operation, r.Errors, r.Requests, opts.maxErrors))
+		}
+	}
+	return failures
+}
+
+func randomHex(n int) string {
+	buf := make([]byte, n)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+	"github.com/gin-gonic/gin"
+)
+
+// ============================================================================
+// Response Compression
+// ============================================================================
+//
+// Responses are compressed with brotli or gzip, whichever the client
+// prefers in Accept-Encoding (brotli on a tie). The first
+// server.compression_min_size bytes are buffered so small responses go out
+// as they are; a Flush before then decides early, so streamed listings
+// start compressing at their first flush. Event streams, WebSocket
+// upgrades, responses that already carry a Content-Encoding and types that
+// don't compress (anything but text, JSON, XML, JavaScript and YAML) pass
+// through untouched.
+
+const (
+	encodingBrotli = "br"
+	encodingGzip   = "gzip"
+
+	// brotliLevel trades a little ratio for speed on dynamic responses
+	brotliLevel = 4
+)
+
+// compressor is the part of gzip.Writer and brotli.Writer this file uses
+type compressor interface {
+	io.Writer
+	Flush() error
+	Close() error
+	Reset(io.Writer)
+}
+
+var compressorPools = map[string]*sync.Pool{
+	encodingBrotli: {New: func() any { return brotli.NewWriterLevel(io.Discard, brotliLevel) }},
+	encodingGzip:   {New: func() any { return gzip.NewWriter(io.Discard) }},
+}
+
+// compressResponses negotiates and applies response compression
+func compressResponses() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !config.Server.Compression || c.Request.Method == http.MethodHead || c.GetHeader("Upgrade") != "" {
+			c.Next()
+			return
+		}
+		encoding := negotiateEncoding(c.GetHeader("Accept-Encoding"))
+		c.Writer.Header().Add("Vary", "Accept-Encoding")
+		if encoding == "" {
+			c.Next()
+			return
+		}
+
+		w := &compressWriter{ResponseWriter: c.Writer, encoding: encoding, minSize: config.Server.CompressionMinSize}
+		c.Writer = w
+		defer func() {
+			w.finish()
+			c.Writer = w.ResponseWriter
+		}()
+		c.Next()
+	}
+}
+
+// negotiateEncoding picks br or gzip from an Accept-Encoding header, or ""
+// for identity
+func negotiateEncoding(header string) string {
+	best, bestQ := "", 0.0
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		q := 1.0
+		if value, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			parsed, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				continue
+			}
+			q = parsed
+		}
+		if name == "*" {
+			name = encodingBrotli
+		}
+		if _, supported := compressorPools[name]; !supported || q <= 0 {
+			continue
+		}
+		if q > bestQ || (q == bestQ && name == encodingBrotli) {
+			best, bestQ = name, q
+		}
+	}
+	return best
+}
+
+// compressibleType reports whether a Content-Type is worth compressing
+func compressibleType(contentType string) bool {
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+	switch {
+	case mediaType == "text/event-stream":
+		return false
+	case strings.HasPrefix(mediaType, "text/"):
+		return true
+	}
+	for _, kind := range []string{"json", "xml", "javascript", "yaml"} {
+		if strings.Contains(mediaType, kind) {
+			return true
+		}
+	}
+	return false
+}
+
+// compressWriter buffers the start of a response, then either compresses
+// the rest or passes it through
+type compressWriter struct {
+	gin.ResponseWriter
+	encoding string
+	minSize  int
+
+	buf     []byte
+	decided bool
+	out     compressor // nil when passing through
+}
+
+func (w *compressWriter) Write(data []byte) (int, error) {
+	if !w.decided {
+		if !w.eligible() {
+			w.decide(false)
+			return w.ResponseWriter.Write(data)
+		}
+		w.buf = append(w.buf, data...)
+		if len(w.buf) < w.minSize {
+			return len(data), nil
+		}
+		if err := w.decide(true); err != nil {
+			return 0, err
+		}
+		return len(data), nil
+	}
+	if w.out != nil {
+		return w.out.Write(data)
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *compressWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+// Written counts buffered bytes as written, so handlers don't write twice
+func (w *compressWriter) Written() bool {
+	return len(w.buf) > 0 || w.ResponseWriter.Written()
+}
+
+// WriteHeaderNow commits the headers, so compression must be decided first
+func (w *compressWriter) WriteHeaderNow() {
+	if !w.decided {
+		w.decide(w.eligible() && len(w.buf) > 0)
+	}
+	w.ResponseWriter.WriteHeaderNow()
+}
+
+// Flush sends what is buffered; an undecided response is compressed if
+// it is eligible at all, since a flushing handler is streaming
+func (w *compressWriter) Flush() {
+	if !w.decided {
+		w.decide(w.eligible() && len(w.buf) > 0)
+	}
+	if w.out != nil {
+		w.out.Flush()
+	}
+	w.ResponseWriter.Flush()
+}
+
+// eligible reports whether the response headers allow compression
+func (w *compressWriter) eligible() bool {
+	status := w.ResponseWriter.Status()
+	if status < http.StatusOK || status == http.StatusNoContent || status == http.StatusNotModified {
+		return false
+	}
+	header := w.ResponseWriter.Header()
+	return header.Get("Content-Encoding") == "" && compressibleType(header.Get("Content-Type"))
+}
+
+// decide commits to compressing or not and writes out the buffer
+func (w *compressWriter) decide(compress bool) error {
+	w.decided = true
+	if compress {
+		header := w.ResponseWriter.Header()
+		header.Set("Content-Encoding", w.encoding)
+		header.Del("Content-Length")
+		w.out = compressorPools[w.encoding].Get().(compressor)
+		w.out.Reset(w.ResponseWriter)
+	}
+	buf := w.buf
+	w.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	var err error
+	if w.out != nil {
+		_, err = w.out.Write(buf)
+	} else {
+		_, err = w.ResponseWriter.Write(buf)
+	}
+	return err
+}
+
+// finish writes a still-buffered response as is and closes the compressor
+func (w *compressWriter) finish() {
+	if !w.decided {
+		w.decide(false)
+	}
+	if w.out != nil {
+		w.out.Close()
+		w.out.Reset(io.Discard)
+		compressorPools[w.encoding].Put(w.out)
+		w.out = nil
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/net/http2"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	for header, want := range map[string]string{
+		"":                        "",
+		"identity":                "",
+		"gzip":                    "gzip",
+		"gzip, deflate, br":       "br",
+		"br;q=0.5, gzip":          "gzip",
+		"br;q=0, gzip;q=0":        "",
+		"*":                       "br",
+		"GZIP;q=0.8, br;q=0.8":    "br",
+		"deflate, gzip;q=invalid": "",
+	} {
+		if got := negotiateEncoding(header); got != want {
+			t.Errorf("negotiateEncoding(%q) = %q, want %q", header, got, want)
+		}
+	}
+}
+
+func compressionRouter() *gin.Engine {
+	r := gin.New()
+	r.Use(compressResponses())
+	r.GET("/large", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"data": strings.Repeat("document ", 500)})
+	})
+	r.GET("/small", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"ok": true})
+	})
+	r.GET("/events", func(c *gin.Context) {
+		c.Header("Content-Type", "text/event-stream")
+		c.String(http.StatusOK, strings.Repeat("data: x\n\n", 500))
+	})
+	r.GET("/stream", func(c *gin.Context) {
+		c.Header("Content-Type", "application/json")
+		c.Writer.WriteString(`{"part":1}`)
+		c.Writer.Flush()
+		c.Writer.WriteString(`{"part":2}`)
+	})
+	return r
+}
+
+func getEncoded(r http.Handler, path, acceptEncoding string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	req.Header.Set("Accept-Encoding", acceptEncoding)
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func decodeBody(t *testing.T, w *httptest.ResponseRecorder) string {
+	t.Helper()
+	var reader io.Reader = w.Body
+	switch w.Header().Get("Content-Encoding") {
+	case "gzip":
+		zr, err := gzip.NewReader(w.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader = zr
+	case "br":
+		reader = brotli.NewReader(w.Body)
+	}
+	body, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(body)
+}
+
+func TestCompressResponses(t *testing.T) {
+	withConfig(t, func(cfg *Config) { cfg.Server.Compression, cfg.Server.CompressionMinSize = true, 1024 })
+	r := compressionRouter()
+	plain := getEncoded(r, "/large", "")
+
+	for _, encoding := range []string{"gzip", "br"} {
+		w := getEncoded(r, "/large", encoding)
+		if got := w.Header().Get("Content-Encoding"); got != encoding {
+			t.Fatalf("%s: Content-Encoding = %q", encoding, got)
+		}
+		if w.Body.Len() >= plain.Body.Len() {
+			t.Errorf("%s: %d bytes, uncompressed %d", encoding, w.Body.Len(), plain.Body.Len())
+		}
+		if decodeBody(t, w) != plain.Body.String() {
+			t.Errorf("%s: body does not round-trip", encoding)
+		}
+		if w.Header().Get("Vary") != "Accept-Encoding" {
+			t.Errorf("%s: Vary = %q", encoding, w.Header().Get("Vary"))
+		}
+	}
+
+	for _, path := range []string{"/small", "/events"} {
+		if w := getEncoded(r, path, "gzip"); w.Header().Get("Content-Encoding") != "" || w.Body.Len() == 0 {
+			t.Errorf("%s compressed (%q) or empty", path, w.Header().Get("Content-Encoding"))
+		}
+	}
+
+	w := getEncoded(r, "/stream", "gzip")
+	if w.Header().Get("Content-Encoding") != "gzip" || decodeBody(t, w) != `{"part":1}{"part":2}` {
+		t.Errorf("flushed stream: encoding %q", w.Header().Get("Content-Encoding"))
+	}
+}
+
+func TestCompressResponsesDisabled(t *testing.T) {
+	withConfig(t, func(cfg *Config) { cfg.Server.Compression = false })
+	if w := getEncoded(compressionRouter(), "/large", "gzip"); w.Header().Get("Content-Encoding") != "" {
+		t.Fatal("compressed with compression off")
+	}
+}
+
+func TestH2C(t *testing.T) {
+	withConfig(t, func(cfg *Config) { cfg.Server.HTTP2 = true })
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Proto)
+	}))
+	if err := configureHTTP2(server.Config); err != nil {
+		t.Fatal(err)
+	}
+	server.Start()
+	defer server.Close()
+
+	client := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, addr)
+		},
+	}}
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if !bytes.Equal(body, []byte("HTTP/2.0")) {
+		t.Fatalf("served over %s", body)
+	}
+}
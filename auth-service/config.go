@@ -0,0 +1,1307 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"os"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v3"
+)
+
+// ============================================================================
+// Configuration
+// ============================================================================
+//
+// Settings come from built-in defaults, then an optional YAML file
+// (CONFIG_FILE), then environment variables, which win. Each field names its
+// variable in an env tag; fields tagged secret are masked by /admin/config.
+// See config.example.yaml for the file layout.
+
+// defaultJWTSecret is only acceptable outside release mode
+const defaultJWTSecret = "your-secret-key-change-in-production"
+
+const minJWTSecretLength = 32
+
+// Config is the service's complete configuration
+type Config struct {
+	Server         ServerConfig         `yaml:"server"`
+	Auth           AuthConfig           `yaml:"auth"`
+	Session        SessionConfig        `yaml:"session"`
+	Registration   RegistrationConfig   `yaml:"registration"`
+	Orgs           OrgsConfig           `yaml:"orgs"`
+	Passwords      PasswordsConfig      `yaml:"passwords"`
+	Anomaly        AnomalyConfig        `yaml:"anomaly"`
+	Network        NetworkConfig        `yaml:"network"`
+	Risk           RiskConfig           `yaml:"risk"`
+	Request        RequestConfig        `yaml:"request"`
+	Maintenance    MaintenanceConfig    `yaml:"maintenance"`
+	Cluster        ClusterConfig        `yaml:"cluster"`
+	Log            LogConfig            `yaml:"log"`
+	RAGBackend     RAGBackendConfig     `yaml:"rag_backend"`
+	Health         HealthConfig         `yaml:"health"`
+	Providers      ProvidersConfig      `yaml:"providers"`
+	Jobs           JobsConfig           `yaml:"jobs"`
+	Connectors     ConnectorsConfig     `yaml:"connectors"`
+	SIEM           SIEMConfig           `yaml:"siem"`
+	Mail           MailConfig           `yaml:"mail"`
+	SMS            SMSConfig            `yaml:"sms"`
+	I18n           I18nConfig           `yaml:"i18n"`
+	ErrorReporting ErrorReportingConfig `yaml:"error_reporting"`
+	Audit          AuditConfig          `yaml:"audit"`
+	DualControl    DualControlConfig    `yaml:"dual_control"`
+	Exports        ExportsConfig        `yaml:"exports"`
+	AccessLog      AccessLogConfig      `yaml:"access_log"`
+	Documents      DocumentsConfig      `yaml:"documents"`
+	Scanning       ScanningConfig       `yaml:"scanning"`
+	Chunking       ChunkingConfig       `yaml:"chunking"`
+	Evaluation     EvaluationConfig     `yaml:"evaluation"`
+	Search         SearchConfig         `yaml:"search"`
+	Conversations  ConversationsConfig  `yaml:"conversations"`
+	SavedQueries   SavedQueriesConfig   `yaml:"saved_queries"`
+	Costs          CostsConfig          `yaml:"costs"`
+	Backup         BackupConfig         `yaml:"backup"`
+	Seed           SeedConfig           `yaml:"seed"`
+	RateLimit      RateLimitConfig      `yaml:"rate_limit"`
+	CORS           CORSConfig           `yaml:"cors"`
+	TLS            TLSConfig            `yaml:"tls"`
+	Secrets        SecretsConfig        `yaml:"secrets"`
+	Middleware     []MiddlewareConfig   `yaml:"middleware"`
+}
+
+type ServerConfig struct {
+	Port               string        `yaml:"port" env:"AUTH_PORT"`
+	GRPCPort           string        `yaml:"grpc_port" env:"GRPC_PORT"`
+	GRPCReflection     bool          `yaml:"grpc_reflection" env:"GRPC_REFLECTION"` // list services and schemas to grpcurl and the like
+	GinMode            string        `yaml:"gin_mode" env:"GIN_MODE"`
+	LegacyAPISunset    string        `yaml:"legacy_api_sunset" env:"LEGACY_API_SUNSET"`
+	ShutdownTimeout    time.Duration `yaml:"shutdown_timeout" env:"SHUTDOWN_TIMEOUT"`
+	ShutdownDrainDelay time.Duration `yaml:"shutdown_drain_delay" env:"SHUTDOWN_DRAIN_DELAY"`
+	TrustedProxies     []string      `yaml:"trusted_proxies" env:"TRUSTED_PROXIES"` // CIDRs allowed to set X-Forwarded-For; empty trusts none
+
+	ReadHeaderTimeout  time.Duration `yaml:"read_header_timeout" env:"READ_HEADER_TIMEOUT"`
+	ReadTimeout        time.Duration `yaml:"read_timeout" env:"READ_TIMEOUT"` // whole request, body included
+	IdleTimeout        time.Duration `yaml:"idle_timeout" env:"IDLE_TIMEOUT"` // keep-alive and idle HTTP/2 connections
+	HTTP2              bool          `yaml:"http2" env:"HTTP2"`               // h2 over TLS, h2c without
+	Compression        bool          `yaml:"compression" env:"COMPRESSION"`   // br/gzip responses
+	CompressionMinSize int           `yaml:"compression_min_size" env:"COMPRESSION_MIN_SIZE"`
+}
+
+type AuthConfig struct {
+	JWTSecret        string        `yaml:"jwt_secret" env:"JWT_SECRET" secret:"true"`
+	InternalAPIToken string        `yaml:"internal_api_token" env:"INTERNAL_API_TOKEN" secret:"true"`
+	TokenCacheTTL    time.Duration `yaml:"token_cache_ttl" env:"TOKEN_CACHE_TTL"` // 0 disables
+	UserCacheTTL     time.Duration `yaml:"user_cache_ttl" env:"USER_CACHE_TTL"`   // 0 disables
+
+	// Lifetime of scoped tokens issued by token exchange (tokenexchange.go)
+	ExchangeTokenTTL time.Duration `yaml:"exchange_token_ttl" env:"EXCHANGE_TOKEN_TTL"`
+
+	// Lifetime of tokens issued to OAuth clients (oauthserver.go)
+	OAuthTokenTTL time.Duration `yaml:"oauth_token_ttl" env:"OAUTH_TOKEN_TTL"`
+
+	// Registered OAuth clients when standalone; clusters keep them in the shared store
+	OAuthClientsFile string `yaml:"oauth_clients_file" env:"OAUTH_CLIENTS_FILE"`
+
+	// Signed internal requests (internalsigning.go)
+	InternalSigning           string `yaml:"internal_signing" env:"INTERNAL_SIGNING"` // off | optional | required
+	InternalSigningKeys       string `yaml:"internal_signing_keys" env:"INTERNAL_SIGNING_KEYS" secret:"true"`
+	InternalSigningPublicKeys string `yaml:"internal_signing_public_keys" env:"INTERNAL_SIGNING_PUBLIC_KEYS"`
+}
+
+type RegistrationConfig struct {
+	Mode           string   `yaml:"mode" env:"REGISTRATION_MODE"`                       // open | approval | closed
+	AllowedDomains []string `yaml:"allowed_domains" env:"REGISTRATION_ALLOWED_DOMAINS"` // e.g. us.inc; empty allows any
+}
+
+type OrgsConfig struct {
+	Enabled   bool   `yaml:"enabled" env:"ORGS_ENABLED"`       // org mode: several orgs, each with members and claimed email domains
+	StoreFile string `yaml:"store_file" env:"ORGS_STORE_FILE"` // the orgs when standalone; clusters keep them in the shared store
+}
+
+type SessionConfig struct {
+	Mode           string `yaml:"mode" env:"SESSION_MODE"` // bearer | cookie | both
+	CookieName     string `yaml:"cookie_name" env:"SESSION_COOKIE_NAME"`
+	CSRFCookieName string `yaml:"csrf_cookie_name" env:"SESSION_CSRF_COOKIE_NAME"`
+	CookieDomain   string `yaml:"cookie_domain" env:"SESSION_COOKIE_DOMAIN"`
+	CookieSecure   bool   `yaml:"cookie_secure" env:"SESSION_COOKIE_SECURE"`
+	SameSite       string `yaml:"same_site" env:"SESSION_SAME_SITE"` // lax | strict | none
+
+	IdleTimeout       time.Duration     `yaml:"idle_timeout" env:"SESSION_IDLE_TIMEOUT"`                 // 0 disables
+	IdleTimeoutByRole map[string]string `yaml:"idle_timeout_by_role" env:"SESSION_IDLE_TIMEOUT_BY_ROLE"` // role -> duration, e.g. admin=15m
+
+	// How long sign-ins last; remembered ones refresh up to the absolute cap
+	Lifetime         time.Duration `yaml:"lifetime" env:"SESSION_LIFETIME"`
+	RememberLifetime time.Duration `yaml:"remember_lifetime" env:"SESSION_REMEMBER_LIFETIME"`
+	AbsoluteLifetime time.Duration `yaml:"absolute_lifetime" env:"SESSION_ABSOLUTE_LIFETIME"` // since the password was entered
+}
+
+type PasswordsConfig struct {
+	Algorithm         string `yaml:"algorithm" env:"PASSWORD_ALGORITHM"` // bcrypt | argon2id
+	BcryptCost        int    `yaml:"bcrypt_cost" env:"PASSWORD_BCRYPT_COST"`
+	Argon2Memory      int    `yaml:"argon2_memory" env:"PASSWORD_ARGON2_MEMORY"` // KiB
+	Argon2Iterations  int    `yaml:"argon2_iterations" env:"PASSWORD_ARGON2_ITERATIONS"`
+	Argon2Parallelism int    `yaml:"argon2_parallelism" env:"PASSWORD_ARGON2_PARALLELISM"`
+
+	Workers      int           `yaml:"workers" env:"PASSWORD_WORKERS"` // 0 = one per CPU
+	QueueSize    int           `yaml:"queue_size" env:"PASSWORD_QUEUE_SIZE"`
+	QueueTimeout time.Duration `yaml:"queue_timeout" env:"PASSWORD_QUEUE_TIMEOUT"`
+
+	MinScore int `yaml:"min_score" env:"PASSWORD_MIN_SCORE"` // 0-4 strength estimate; 0 = no check
+
+	Peppers  string `yaml:"peppers" env:"PASSWORD_PEPPERS" secret:"true"` // id:base64-key,...
+	PepperID string `yaml:"pepper_id" env:"PASSWORD_PEPPER_ID"`           // defaults to the last listed
+}
+
+type AnomalyConfig struct {
+	Enabled         bool   `yaml:"enabled" env:"ANOMALY_DETECTION_ENABLED"`
+	CountryHeader   string `yaml:"country_header" env:"ANOMALY_COUNTRY_HEADER"` // ISO country set by the edge proxy
+	LatitudeHeader  string `yaml:"latitude_header" env:"ANOMALY_LATITUDE_HEADER"`
+	LongitudeHeader string `yaml:"longitude_header" env:"ANOMALY_LONGITUDE_HEADER"`
+	MaxTravelKmh    int    `yaml:"max_travel_kmh" env:"ANOMALY_MAX_TRAVEL_KMH"`
+	AlertNewDevice  bool   `yaml:"alert_new_device" env:"ANOMALY_ALERT_NEW_DEVICE"`
+	StepUp          bool   `yaml:"step_up" env:"ANOMALY_STEP_UP"` // hold anomalous logins for admin review
+}
+
+type NetworkConfig struct {
+	AdminAllowlist   []string      `yaml:"admin_allowlist" env:"NETWORK_ADMIN_ALLOWLIST"` // CIDRs; empty allows all
+	Denylist         []string      `yaml:"denylist" env:"NETWORK_DENYLIST"`
+	AutoBanThreshold int           `yaml:"auto_ban_threshold" env:"NETWORK_AUTO_BAN_THRESHOLD"` // 0 disables
+	AutoBanWindow    time.Duration `yaml:"auto_ban_window" env:"NETWORK_AUTO_BAN_WINDOW"`
+	AutoBanDuration  time.Duration `yaml:"auto_ban_duration" env:"NETWORK_AUTO_BAN_DURATION"`
+
+	// Decoy routes that ban whoever requests them (honeypot.go)
+	HoneypotPaths       []string      `yaml:"honeypot_paths" env:"NETWORK_HONEYPOT_PATHS"` // empty disables
+	HoneypotBanDuration time.Duration `yaml:"honeypot_ban_duration" env:"NETWORK_HONEYPOT_BAN_DURATION"`
+	HoneypotTarpit      time.Duration `yaml:"honeypot_tarpit" env:"NETWORK_HONEYPOT_TARPIT"` // how long the hit is held before its 404
+}
+
+type RiskConfig struct {
+	Enabled   bool          `yaml:"enabled" env:"RISK_ENABLED"`
+	Window    time.Duration `yaml:"window" env:"RISK_WINDOW"`         // failed sign-ins count for this long
+	ASNHeader string        `yaml:"asn_header" env:"RISK_ASN_HEADER"` // network number set by the edge proxy
+
+	AccountWeight int `yaml:"account_weight" env:"RISK_ACCOUNT_WEIGHT"` // score per failure, capped at 100
+	IPWeight      int `yaml:"ip_weight" env:"RISK_IP_WEIGHT"`
+	ASNWeight     int `yaml:"asn_weight" env:"RISK_ASN_WEIGHT"`
+
+	DelayBase      time.Duration `yaml:"delay_base" env:"RISK_DELAY_BASE"`
+	DelayMax       time.Duration `yaml:"delay_max" env:"RISK_DELAY_MAX"`
+	IPMaxFailures  int           `yaml:"ip_max_failures" env:"RISK_IP_MAX_FAILURES"` // 0 disables
+	ASNMaxFailures int           `yaml:"asn_max_failures" env:"RISK_ASN_MAX_FAILURES"`
+
+	CaptchaScore     int    `yaml:"captcha_score" env:"RISK_CAPTCHA_SCORE"` // 0 disables
+	CaptchaVerifyURL string `yaml:"captcha_verify_url" env:"RISK_CAPTCHA_VERIFY_URL"`
+	CaptchaSiteKey   string `yaml:"captcha_site_key" env:"RISK_CAPTCHA_SITE_KEY"`
+	CaptchaSecret    string `yaml:"captcha_secret" env:"RISK_CAPTCHA_SECRET" secret:"true"`
+}
+
+type RequestConfig struct {
+	MaxBodySize         string            `yaml:"max_body_size" env:"MAX_BODY_SIZE"`    // e.g. 1MB
+	RouteLimits         map[string]string `yaml:"route_limits" env:"ROUTE_BODY_LIMITS"` // "POST /path" -> size
+	StrictContentType   bool              `yaml:"strict_content_type" env:"STRICT_CONTENT_TYPE"`
+	RejectUnknownFields bool              `yaml:"reject_unknown_fields" env:"REJECT_UNKNOWN_FIELDS"`
+}
+
+type MaintenanceConfig struct {
+	Enabled    bool          `yaml:"enabled" env:"MAINTENANCE_MODE"` // start in maintenance mode
+	RetryAfter time.Duration `yaml:"retry_after" env:"MAINTENANCE_RETRY_AFTER"`
+}
+
+type ClusterConfig struct {
+	Mode           string        `yaml:"mode" env:"CLUSTER_MODE"` // standalone | redis | mongo
+	RedisURL       string        `yaml:"redis_url" env:"CLUSTER_REDIS_URL" secret:"true"`
+	MongoURL       string        `yaml:"mongo_url" env:"CLUSTER_MONGO_URL" secret:"true"`
+	MongoDatabase  string        `yaml:"mongo_database" env:"CLUSTER_MONGO_DATABASE"`
+	InstanceID     string        `yaml:"instance_id" env:"INSTANCE_ID"` // defaults to the hostname
+	ResyncInterval time.Duration `yaml:"resync_interval" env:"CLUSTER_RESYNC_INTERVAL"`
+	LockTTL        time.Duration `yaml:"lock_ttl" env:"CLUSTER_LOCK_TTL"`
+
+	// Apply pending schema migrations (mongo mode) at startup
+	MigrateOnStart bool `yaml:"migrate_on_start" env:"CLUSTER_MIGRATE_ON_START"`
+}
+
+type LogConfig struct {
+	Level  string `yaml:"level" env:"LOG_LEVEL"`
+	Format string `yaml:"format" env:"LOG_FORMAT"` // json | text
+}
+
+type RAGBackendConfig struct {
+	URL string `yaml:"url" env:"RAG_BACKEND_URL"`
+}
+
+type HealthConfig struct {
+	Services map[string]string `yaml:"services" env:"HEALTH_SERVICES"` // name -> health URL, checked by /health/system
+	Timeout  time.Duration     `yaml:"timeout" env:"HEALTH_TIMEOUT"`   // per service
+	CacheTTL time.Duration     `yaml:"cache_ttl" env:"HEALTH_CACHE_TTL"`
+}
+
+type ProvidersConfig struct {
+	StoreFile        string        `yaml:"store_file" env:"PROVIDERS_STORE_FILE"`               // the failover chain when standalone; clusters keep it in the shared store
+	HealthInterval   time.Duration `yaml:"health_interval" env:"PROVIDERS_HEALTH_INTERVAL"`     // how often providers' health URLs are probed
+	FailureThreshold int           `yaml:"failure_threshold" env:"PROVIDERS_FAILURE_THRESHOLD"` // failures in a row that open a provider's breaker
+	OpenFor          time.Duration `yaml:"open_for" env:"PROVIDERS_OPEN_FOR"`                   // how long an open breaker skips its provider
+}
+
+type JobsConfig struct {
+	Workers   int           `yaml:"workers" env:"JOB_WORKERS"`
+	StoreDir  string        `yaml:"store_dir" env:"JOB_STORE_DIR"` // queued jobs and payloads
+	Retention time.Duration `yaml:"retention" env:"JOB_RETENTION"` // finished jobs are kept this long
+}
+
+type ConnectorsConfig struct {
+	RedirectBase           string        `yaml:"redirect_base" env:"CONNECTOR_REDIRECT_BASE"`
+	SyncInterval           time.Duration `yaml:"sync_interval" env:"CONNECTOR_SYNC_INTERVAL"`
+	GDriveClientID         string        `yaml:"gdrive_client_id" env:"GDRIVE_CLIENT_ID"`
+	GDriveClientSecret     string        `yaml:"gdrive_client_secret" env:"GDRIVE_CLIENT_SECRET" secret:"true"`
+	SharePointTenant       string        `yaml:"sharepoint_tenant" env:"SHAREPOINT_TENANT"`
+	SharePointClientID     string        `yaml:"sharepoint_client_id" env:"SHAREPOINT_CLIENT_ID"`
+	SharePointClientSecret string        `yaml:"sharepoint_client_secret" env:"SHAREPOINT_CLIENT_SECRET" secret:"true"`
+}
+
+type SIEMConfig struct {
+	WebhookURL    string `yaml:"webhook_url" env:"SIEM_WEBHOOK_URL" secret:"true"` // may embed credentials
+	WebhookSecret string `yaml:"webhook_secret" env:"SIEM_WEBHOOK_SECRET" secret:"true"`
+	SyslogAddr    string `yaml:"syslog_addr" env:"SIEM_SYSLOG_ADDR"`
+}
+
+type MailConfig struct {
+	Provider       string `yaml:"provider" env:"MAIL_PROVIDER"` // log | smtp | ses | sendgrid
+	From           string `yaml:"from" env:"MAIL_FROM"`
+	FromName       string `yaml:"from_name" env:"MAIL_FROM_NAME"`
+	BaseURL        string `yaml:"base_url" env:"MAIL_BASE_URL"` // links in emails point here
+	MaxAttempts    int    `yaml:"max_attempts" env:"MAIL_MAX_ATTEMPTS"`
+	SMTPHost       string `yaml:"smtp_host" env:"SMTP_HOST"`
+	SMTPPort       string `yaml:"smtp_port" env:"SMTP_PORT"`
+	SMTPUsername   string `yaml:"smtp_username" env:"SMTP_USERNAME"`
+	SMTPPassword   string `yaml:"smtp_password" env:"SMTP_PASSWORD" secret:"true"`
+	SMTPTLS        string `yaml:"smtp_tls" env:"SMTP_TLS"` // starttls | tls | none
+	SESRegion      string `yaml:"ses_region" env:"MAIL_SES_REGION"`
+	SendGridAPIKey string `yaml:"sendgrid_api_key" env:"SENDGRID_API_KEY" secret:"true"`
+}
+
+type SMSConfig struct {
+	Provider         string        `yaml:"provider" env:"SMS_PROVIDER"` // log | twilio | sns
+	From             string        `yaml:"from" env:"SMS_FROM"`         // sender number for twilio
+	Login            bool          `yaml:"login" env:"SMS_LOGIN"`       // allow signing in with a code sent to a verified phone
+	CodeTTL          time.Duration `yaml:"code_ttl" env:"SMS_CODE_TTL"`
+	MaxAttempts      int           `yaml:"max_attempts" env:"SMS_CODE_MAX_ATTEMPTS"` // wrong guesses before a code is void
+	TwilioAccountSID string        `yaml:"twilio_account_sid" env:"TWILIO_ACCOUNT_SID"`
+	TwilioAuthToken  string        `yaml:"twilio_auth_token" env:"TWILIO_AUTH_TOKEN" secret:"true"`
+	SNSRegion        string        `yaml:"sns_region" env:"SMS_SNS_REGION"`
+}
+
+type I18nConfig struct {
+	DefaultLanguage string `yaml:"default_language" env:"DEFAULT_LANGUAGE"` // when Accept-Language matches nothing
+	CatalogDir      string `yaml:"catalog_dir" env:"I18N_CATALOG_DIR"`      // <lang>.json files over the built-in translations
+}
+
+type ErrorReportingConfig struct {
+	Backend     string `yaml:"backend" env:"ERROR_REPORTING_BACKEND"` // none | sentry | webhook
+	DSN         string `yaml:"dsn" env:"SENTRY_DSN" secret:"true"`
+	WebhookURL  string `yaml:"webhook_url" env:"ERROR_REPORTING_WEBHOOK_URL" secret:"true"` // may embed credentials
+	Environment string `yaml:"environment" env:"ERROR_REPORTING_ENVIRONMENT"`
+	Release     string `yaml:"release" env:"RELEASE"` // defaults to the build's VCS revision
+}
+
+type AuditConfig struct {
+	File      string        `yaml:"file" env:"AUDIT_FILE"`           // JSON lines, one entry per line
+	Retention time.Duration `yaml:"retention" env:"AUDIT_RETENTION"` // 0 keeps entries forever
+}
+
+type DualControlConfig struct {
+	Enabled bool          `yaml:"enabled" env:"DUAL_CONTROL_ENABLED"`
+	Window  time.Duration `yaml:"window" env:"DUAL_CONTROL_WINDOW"`   // a second admin must approve within this
+	Actions []string      `yaml:"actions" env:"DUAL_CONTROL_ACTIONS"` // which high-risk actions need approval
+}
+
+type ExportsConfig struct {
+	Dir       string        `yaml:"dir" env:"EXPORT_DIR"`             // generated files; one per instance
+	Retention time.Duration `yaml:"retention" env:"EXPORT_RETENTION"` // finished exports are deleted after this
+}
+
+type AccessLogConfig struct {
+	Enabled    bool          `yaml:"enabled" env:"ACCESS_LOG_ENABLED"`
+	Readers    string        `yaml:"readers" env:"ACCESS_LOG_READERS"`         // named | anonymous: whether owners see who read their documents
+	Retention  time.Duration `yaml:"retention" env:"ACCESS_LOG_RETENTION"`     // entries older than this are dropped
+	MaxEntries int           `yaml:"max_entries" env:"ACCESS_LOG_MAX_ENTRIES"` // per document; the oldest go first
+}
+
+type DocumentsConfig struct {
+	OnConflict   string   `yaml:"on_conflict" env:"DOCUMENT_ON_CONFLICT"`     // suffix | reject: what registering a name another user's document has as its filename does
+	AllowedTypes []string `yaml:"allowed_types" env:"DOCUMENT_ALLOWED_TYPES"` // pdf, docx, txt, md, html; checked against the content on upload
+}
+
+type ScanningConfig struct {
+	Provider      string        `yaml:"provider" env:"SCAN_PROVIDER"`             // none | clamav | http
+	ClamAVAddress string        `yaml:"clamav_address" env:"SCAN_CLAMAV_ADDRESS"` // clamd TCP host:port
+	URL           string        `yaml:"url" env:"SCAN_URL"`                       // scanning API for the http provider
+	Token         string        `yaml:"token" env:"SCAN_TOKEN" secret:"true"`     // sent as a bearer token to the scanning API
+	Timeout       time.Duration `yaml:"timeout" env:"SCAN_TIMEOUT"`               // per file
+}
+
+type ChunkingConfig struct {
+	Splitter        string                      `yaml:"splitter" env:"CHUNK_SPLITTER"`                   // recursive | semantic | page
+	Size            int                         `yaml:"size" env:"CHUNK_SIZE"`                           // characters per chunk
+	Overlap         int                         `yaml:"overlap" env:"CHUNK_OVERLAP"`                     // characters shared by neighbouring chunks
+	Collections     map[string]ChunkingSettings `yaml:"collections"`                                     // document tag -> settings for documents with it; zero fields inherit
+	RechunkOnChange bool                        `yaml:"rechunk_on_change" env:"CHUNK_RECHUNK_ON_CHANGE"` // re-chunk stale documents at startup
+}
+
+type EvaluationConfig struct {
+	StoreDir string        `yaml:"store_dir" env:"EVALUATION_STORE_DIR"` // golden sets and runs; one per instance
+	NChunks  int           `yaml:"n_chunks" env:"EVALUATION_N_CHUNKS"`   // chunks retrieved per question, as the UI asks for
+	Timeout  time.Duration `yaml:"timeout" env:"EVALUATION_TIMEOUT"`     // per question
+}
+
+type SearchConfig struct {
+	KeywordWeight float64  `yaml:"keyword_weight" env:"SEARCH_KEYWORD_WEIGHT"` // BM25's share of the hybrid score; 0 is vector search only
+	Reranker      string   `yaml:"reranker" env:"SEARCH_RERANKER"`             // default reranker; empty skips reranking
+	RerankTopN    int      `yaml:"rerank_top_n" env:"SEARCH_RERANK_TOP_N"`     // candidates the reranker scores
+	Rerankers     []string `yaml:"rerankers" env:"SEARCH_RERANKERS"`           // models the backend has loaded
+	StoreFile     string   `yaml:"store_file" env:"SEARCH_STORE_FILE"`         // collection settings and their versions when standalone; clusters keep them in the shared store
+}
+
+type ConversationsConfig struct {
+	StoreDir string `yaml:"store_dir" env:"CONVERSATIONS_STORE_DIR"` // saved conversations when standalone; clusters keep them in the shared store
+}
+
+type SavedQueriesConfig struct {
+	StoreDir string        `yaml:"store_dir" env:"SAVED_QUERIES_STORE_DIR"` // saved queries and their last runs when standalone; clusters keep them in the shared store
+	NChunks  int           `yaml:"n_chunks" env:"SAVED_QUERIES_N_CHUNKS"`   // chunks retrieved per run
+	Timeout  time.Duration `yaml:"timeout" env:"SAVED_QUERIES_TIMEOUT"`     // per run
+}
+
+type CostsConfig struct {
+	Currency          string                `yaml:"currency" env:"COSTS_CURRENCY"`                         // what prices are in; reports only label it
+	DefaultOrg        string                `yaml:"default_org" env:"COSTS_DEFAULT_ORG"`                   // charged for users without an org_id
+	StoragePerGBMonth float64               `yaml:"storage_per_gb_month" env:"COSTS_STORAGE_PER_GB_MONTH"` // per GB of documents kept a whole month
+	Models            map[string]ModelPrice `yaml:"models"`                                                // model name -> token prices; unlisted models cost nothing
+	StoreFile         string                `yaml:"store_file" env:"COSTS_STORE_FILE"`                     // metered usage by month and org when standalone; clusters keep it in the shared store
+}
+
+type BackupConfig struct {
+	Passphrase string        `yaml:"passphrase" env:"BACKUP_PASSPHRASE" secret:"true"` // archives are encrypted with a key derived from it; empty disables backups
+	Interval   time.Duration `yaml:"interval" env:"BACKUP_INTERVAL"`                   // upload a backup to S3 this often; 0 disables
+
+	S3Bucket          string `yaml:"s3_bucket" env:"BACKUP_S3_BUCKET"`
+	S3Region          string `yaml:"s3_region" env:"BACKUP_S3_REGION"`
+	S3Prefix          string `yaml:"s3_prefix" env:"BACKUP_S3_PREFIX"`     // key prefix for uploaded archives
+	S3Endpoint        string `yaml:"s3_endpoint" env:"BACKUP_S3_ENDPOINT"` // S3-compatible storage, addressed path-style; empty is AWS
+	S3AccessKeyID     string `yaml:"s3_access_key_id" env:"BACKUP_S3_ACCESS_KEY_ID" secret:"true"`
+	S3SecretAccessKey string `yaml:"s3_secret_access_key" env:"BACKUP_S3_SECRET_ACCESS_KEY" secret:"true"`
+}
+
+type SeedConfig struct {
+	Enabled    bool   `yaml:"enabled" env:"SEED_ENABLED"` // false starts with no users
+	File       string `yaml:"file" env:"SEED_FILE"`       // accounts to create; see seed.example.yaml
+	AdminEmail string `yaml:"admin_email" env:"SEED_ADMIN_EMAIL"`
+}
+
+type RateLimitConfig struct {
+	Enabled       bool   `yaml:"enabled" env:"RATE_LIMIT_ENABLED"`
+	Backend       string `yaml:"backend" env:"RATE_LIMIT_BACKEND"` // memory | redis
+	RedisURL      string `yaml:"redis_url" env:"RATE_LIMIT_REDIS_URL" secret:"true"`
+	AuthPerMinute int    `yaml:"auth_per_minute" env:"RATE_LIMIT_AUTH_PER_MINUTE"` // login/register, per IP
+	AuthBurst     int    `yaml:"auth_burst" env:"RATE_LIMIT_AUTH_BURST"`
+	APIPerMinute  int    `yaml:"api_per_minute" env:"RATE_LIMIT_API_PER_MINUTE"` // authenticated calls, per user
+	APIBurst      int    `yaml:"api_burst" env:"RATE_LIMIT_API_BURST"`
+
+	DefaultPlan string               `yaml:"default_plan" env:"RATE_LIMIT_DEFAULT_PLAN"` // for users without one
+	Plans       map[string]QueryPlan `yaml:"plans"`                                      // plan name -> daily query allowance
+	// QuotaWarningPercent is the share of a day's queries after which the
+	// user is notified; 0 disables the warning
+	QuotaWarningPercent int `yaml:"quota_warning_percent" env:"RATE_LIMIT_QUOTA_WARNING_PERCENT"`
+}
+
+type CORSConfig struct {
+	AllowedOrigins   []string      `yaml:"allowed_origins" env:"CORS_ALLOWED_ORIGINS"` // comma-separated in the environment
+	AllowCredentials bool          `yaml:"allow_credentials" env:"CORS_ALLOW_CREDENTIALS"`
+	MaxAge           time.Duration `yaml:"max_age" env:"CORS_MAX_AGE"` // preflight cache lifetime
+	Routes           []CORSRoute   `yaml:"routes"`
+}
+
+// CORSRoute overrides the CORS policy for paths under a prefix
+type CORSRoute struct {
+	PathPrefix       string   `yaml:"path_prefix"`
+	AllowedOrigins   []string `yaml:"allowed_origins"`
+	AllowCredentials bool     `yaml:"allow_credentials"`
+}
+
+type TLSConfig struct {
+	Mode             string   `yaml:"mode" env:"TLS_MODE"` // off | files | autocert
+	CertFile         string   `yaml:"cert_file" env:"TLS_CERT_FILE"`
+	KeyFile          string   `yaml:"key_file" env:"TLS_KEY_FILE"`
+	AutocertDomains  []string `yaml:"autocert_domains" env:"TLS_AUTOCERT_DOMAINS"`
+	AutocertCacheDir string   `yaml:"autocert_cache_dir" env:"TLS_AUTOCERT_CACHE_DIR"`
+	AutocertEmail    string   `yaml:"autocert_email" env:"TLS_AUTOCERT_EMAIL"`
+	RedirectHTTP     bool     `yaml:"redirect_http" env:"TLS_REDIRECT_HTTP"`
+	HTTPPort         string   `yaml:"http_port" env:"TLS_HTTP_PORT"` // redirect and ACME challenge listener
+}
+
+type SecretsConfig struct {
+	Provider        string            `yaml:"provider" env:"SECRETS_PROVIDER"` // none | vault | aws
+	RefreshInterval time.Duration     `yaml:"refresh_interval" env:"SECRETS_REFRESH_INTERVAL"`
+	Refs            map[string]string `yaml:"refs" env:"SECRETS_REFS"` // setting -> reference; "a=b,c=d" in the environment
+	VaultAddr       string            `yaml:"vault_addr" env:"VAULT_ADDR"`
+	VaultToken      string            `yaml:"vault_token" env:"VAULT_TOKEN" secret:"true"`
+	VaultNamespace  string            `yaml:"vault_namespace" env:"VAULT_NAMESPACE"`
+	AWSRegion       string            `yaml:"aws_region" env:"AWS_REGION"`
+}
+
+// config is the loaded configuration. It holds the defaults until main
+// calls loadConfig and is read-only afterwards.
+var config = defaultConfig()
+
+func defaultConfig() *Config {
+	return &Config{
+		Server: ServerConfig{
+			Port:            "8001",
+			GRPCPort:        "9001",
+			GRPCReflection:  true,
+			GinMode:         gin.ReleaseMode,
+			ShutdownTimeout: 30 * time.Second,
+
+			ReadHeaderTimeout:  10 * time.Second,
+			ReadTimeout:        30 * time.Second,
+			IdleTimeout:        2 * time.Minute,
+			HTTP2:              true,
+			Compression:        true,
+			CompressionMinSize: 1024,
+		},
+		Auth: AuthConfig{JWTSecret: defaultJWTSecret, TokenCacheTTL: 30 * time.Second, ExchangeTokenTTL: 5 * time.Minute, OAuthTokenTTL: time.Hour, OAuthClientsFile: "oauth-clients.json", InternalSigning: internalSigningOff},
+		Session: SessionConfig{
+			Mode:           sessionModeBearer,
+			CookieName:     "session",
+			CSRFCookieName: "csrf_token",
+			CookieSecure:   true,
+			SameSite:       "lax",
+
+			Lifetime:         tokenLifetime,
+			RememberLifetime: 30 * 24 * time.Hour,
+			AbsoluteLifetime: 90 * 24 * time.Hour,
+		},
+		Registration: RegistrationConfig{Mode: registrationOpen},
+		Orgs:         OrgsConfig{StoreFile: "orgs.json"},
+		Passwords: PasswordsConfig{
+			Algorithm:         passwordAlgBcrypt,
+			BcryptCost:        bcrypt.DefaultCost,
+			Argon2Memory:      64 * 1024,
+			Argon2Iterations:  3,
+			Argon2Parallelism: 2,
+			QueueSize:         256,
+			QueueTimeout:      5 * time.Second,
+			MinScore:          2,
+		},
+		Anomaly: AnomalyConfig{Enabled: true, MaxTravelKmh: 900},
+		Risk: RiskConfig{
+			Window:         15 * time.Minute,
+			AccountWeight:  10,
+			IPWeight:       2,
+			ASNWeight:      0,
+			DelayBase:      250 * time.Millisecond,
+			DelayMax:       5 * time.Second,
+			IPMaxFailures:  50,
+			ASNMaxFailures: 500,
+			CaptchaScore:   50,
+		},
+		Network: NetworkConfig{
+			AutoBanThreshold: 0, // opt-in: one address can be a whole office behind NAT
+			AutoBanWindow:    10 * time.Minute,
+			AutoBanDuration:  time.Hour,
+
+			HoneypotPaths:       defaultHoneypotPaths,
+			HoneypotBanDuration: 24 * time.Hour,
+			HoneypotTarpit:      10 * time.Second,
+		},
+		Request: RequestConfig{
+			MaxBodySize:         "1MB",
+			StrictContentType:   true,
+			RejectUnknownFields: true,
+		},
+		Maintenance: MaintenanceConfig{RetryAfter: 5 * time.Minute},
+		Cluster: ClusterConfig{
+			Mode:           clusterModeStandalone,
+			MongoDatabase:  "auth_service",
+			MigrateOnStart: true,
+			ResyncInterval: 5 * time.Minute,
+			LockTTL:        30 * time.Second,
+		},
+		Log:        LogConfig{Level: "info", Format: "json"},
+		RAGBackend: RAGBackendConfig{URL: "http://localhost:8000"},
+		Jobs:       JobsConfig{Workers: 2, StoreDir: "job-store", Retention: 24 * time.Hour},
+		Health: HealthConfig{
+			Services: map[string]string{"rag_backend": "http://localhost:8000/health"},
+			Timeout:  2 * time.Second,
+			CacheTTL: 5 * time.Second,
+		},
+		Providers: ProvidersConfig{
+			StoreFile:        "provider-chain.json",
+			HealthInterval:   30 * time.Second,
+			FailureThreshold: 3,
+			OpenFor:          time.Minute,
+		},
+		Connectors: ConnectorsConfig{
+			RedirectBase:     "http://localhost:8001",
+			SyncInterval:     15 * time.Minute,
+			SharePointTenant: "common",
+		},
+		Mail: MailConfig{
+			Provider:    mailProviderLog,
+			From:        "no-reply@localhost",
+			FromName:    "USF RAG",
+			BaseURL:     "http://localhost:8000",
+			MaxAttempts: 5,
+			SMTPPort:    "587",
+			SMTPTLS:     smtpTLSStartTLS,
+		},
+		SMS: SMSConfig{
+			Provider:    smsProviderLog,
+			Login:       true,
+			CodeTTL:     5 * time.Minute,
+			MaxAttempts: 5,
+		},
+		I18n:           I18nConfig{DefaultLanguage: "en"},
+		ErrorReporting: ErrorReportingConfig{Backend: errorReportingNone},
+		Audit:          AuditConfig{File: "audit-log.jsonl", Retention: 365 * 24 * time.Hour},
+		DualControl:    DualControlConfig{Window: 24 * time.Hour, Actions: dualControlActions},
+		Exports:        ExportsConfig{Dir: "export-store", Retention: 24 * time.Hour},
+		AccessLog:      AccessLogConfig{Enabled: true, Readers: accessLogNamed, Retention: 30 * 24 * time.Hour, MaxEntries: 1000},
+		Documents:      DocumentsConfig{OnConflict: onConflictSuffix, AllowedTypes: fileTypes},
+		Scanning:       ScanningConfig{Provider: scanProviderNone, ClamAVAddress: "localhost:3310", Timeout: time.Minute},
+		Chunking:       ChunkingConfig{Splitter: splitterRecursive, Size: 350, Overlap: 35, RechunkOnChange: true},
+		Evaluation:     EvaluationConfig{StoreDir: "evaluation-store", NChunks: 5, Timeout: 2 * time.Minute},
+		Search:         SearchConfig{StoreFile: "search-settings.json"},
+		Conversations:  ConversationsConfig{StoreDir: "conversation-store"},
+		SavedQueries:   SavedQueriesConfig{StoreDir: "saved-query-store", NChunks: 5, Timeout: 2 * time.Minute},
+		Costs:          CostsConfig{Currency: "USD", DefaultOrg: "default", StoreFile: "cost-ledger.json"},
+		Backup:         BackupConfig{S3Prefix: "auth-service"},
+		Seed:           SeedConfig{Enabled: true, AdminEmail: "admin@us.inc"},
+		RateLimit: RateLimitConfig{
+			Enabled:       true,
+			Backend:       "memory",
+			AuthPerMinute: 10,
+			AuthBurst:     5,
+			APIPerMinute:  300,
+			APIBurst:      60,
+			DefaultPlan:   "free",
+			Plans:         map[string]QueryPlan{"free": {QueriesPerDay: 100}, "pro": {QueriesPerDay: 2000}},
+
+			QuotaWarningPercent: 80,
+		},
+		CORS: CORSConfig{AllowedOrigins: []string{"*"}, MaxAge: 10 * time.Minute},
+		TLS:  TLSConfig{Mode: tlsModeOff, AutocertCacheDir: "autocert-cache", HTTPPort: "80"},
+		Secrets: SecretsConfig{
+			Provider:        secretsProviderNone,
+			RefreshInterval: 5 * time.Minute,
+		},
+	}
+}
+
+// configFile is the YAML file the configuration was read from, if any
+var configFile string
+
+// loadConfig reads the file and environment into config and validates the
+// result. On error config still holds whatever was loaded, so logging can be
+// set up to report it.
+func loadConfig() error {
+	cfg := defaultConfig()
+	config = cfg
+
+	if path := os.Getenv("CONFIG_FILE"); path != "" {
+		file, err := os.Open(path)
+		if err != nil {
+			return fmt.Errorf("read config file: %w", err)
+		}
+		decoder := yaml.NewDecoder(file)
+		decoder.KnownFields(true) // catch misspelled keys
+		err = decoder.Decode(cfg)
+		file.Close()
+		if err != nil && !errors.Is(err, io.EOF) {
+			return fmt.Errorf("parse config file %s: %w", path, err)
+		}
+		configFile = path
+	}
+
+	if err := applyEnv(reflect.ValueOf(cfg).Elem()); err != nil {
+		return err
+	}
+	if err := loadSecrets(cfg); err != nil {
+		return err
+	}
+	return cfg.validate()
+}
+
+// Secrets provider state, kept for periodic refresh
+var (
+	activeSecretsProvider secretsProvider
+	resolvedSecrets       map[string]string
+)
+
+// loadSecrets resolves secrets.refs through the configured provider
+func loadSecrets(cfg *Config) error {
+	switch cfg.Secrets.Provider {
+	case secretsProviderNone:
+		if len(cfg.Secrets.Refs) > 0 {
+			return errors.New("secrets.refs is set but secrets.provider is none")
+		}
+		return nil
+	case secretsProviderVault:
+		if cfg.Secrets.VaultAddr == "" || cfg.Secrets.VaultToken == "" {
+			return errors.New("secrets.vault_addr and secrets.vault_token are required for the vault provider")
+		}
+	case secretsProviderAWS:
+		if cfg.Secrets.AWSRegion == "" {
+			return errors.New("secrets.aws_region is required for the aws provider")
+		}
+	default:
+		return errors.New("secrets.provider must be none, vault or aws")
+	}
+	if cfg.Secrets.RefreshInterval < 0 {
+		return errors.New("secrets.refresh_interval must not be negative")
+	}
+
+	provider, err := newSecretsProvider(cfg.Secrets)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	values, err := resolveSecrets(ctx, cfg, provider)
+	if err != nil {
+		return err
+	}
+	activeSecretsProvider, resolvedSecrets = provider, values
+	return nil
+}
+
+// applyEnv overrides fields from the variables named in their env tags
+func applyEnv(v reflect.Value) error {
+	for i := 0; i < v.NumField(); i++ {
+		field, meta := v.Field(i), v.Type().Field(i)
+		if field.Kind() == reflect.Struct {
+			if err := applyEnv(field); err != nil {
+				return err
+			}
+			continue
+		}
+
+		name := meta.Tag.Get("env")
+		raw, set := os.LookupEnv(name)
+		if name == "" || !set {
+			continue
+		}
+		switch {
+		case field.Type() == reflect.TypeOf(time.Duration(0)):
+			d, err := time.ParseDuration(raw)
+			if err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+			field.SetInt(int64(d))
+		case field.Kind() == reflect.Map:
+			items := make(map[string]string)
+			for _, item := range strings.Split(raw, ",") {
+				key, value, ok := strings.Cut(item, "=")
+				if !ok {
+					return fmt.Errorf("%s: expected key=value pairs", name)
+				}
+				items[strings.TrimSpace(key)] = strings.TrimSpace(value)
+			}
+			field.Set(reflect.ValueOf(items))
+		case field.Kind() == reflect.Slice:
+			var items []string
+			for _, item := range strings.Split(raw, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					items = append(items, item)
+				}
+			}
+			field.Set(reflect.ValueOf(items))
+		case field.Kind() == reflect.Bool:
+			b, err := strconv.ParseBool(raw)
+			if err != nil {
+				return fmt.Errorf("%s: must be true or false", name)
+			}
+			field.SetBool(b)
+		case field.Kind() == reflect.Int:
+			n, err := strconv.Atoi(raw)
+			if err != nil {
+				return fmt.Errorf("%s: must be an integer", name)
+			}
+			field.SetInt(int64(n))
+		default:
+			field.SetString(raw)
+		}
+	}
+	return nil
+}
+
+// validate reports every problem at once so a bad deploy is fixed in one go
+func (cfg *Config) validate() error {
+	var problems []string
+	fail := func(format string, args ...any) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	for name, port := range map[string]string{"server.port": cfg.Server.Port, "server.grpc_port": cfg.Server.GRPCPort} {
+		if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+			fail("%s must be a port number, got %q", name, port)
+		}
+	}
+	switch cfg.Server.GinMode {
+	case gin.ReleaseMode, gin.DebugMode, gin.TestMode:
+	default:
+		fail("server.gin_mode must be release, debug or test")
+	}
+	if cfg.Server.LegacyAPISunset != "" {
+		if _, err := http.ParseTime(cfg.Server.LegacyAPISunset); err != nil {
+			fail("server.legacy_api_sunset must be an HTTP-date")
+		}
+	}
+	if cfg.Server.ShutdownTimeout <= 0 || cfg.Server.ShutdownDrainDelay < 0 {
+		fail("server.shutdown_timeout must be positive and shutdown_drain_delay non-negative")
+	}
+	if cfg.Server.ReadHeaderTimeout <= 0 || cfg.Server.ReadTimeout < 0 || cfg.Server.IdleTimeout < 0 {
+		fail("server.read_header_timeout must be positive and read_timeout and idle_timeout non-negative")
+	}
+	if cfg.Server.CompressionMinSize < 0 {
+		fail("server.compression_min_size must not be negative")
+	}
+
+	if cfg.Server.GinMode == gin.ReleaseMode {
+		switch {
+		case cfg.Auth.JWTSecret == defaultJWTSecret:
+			fail("auth.jwt_secret (JWT_SECRET) must be changed from the default in release mode")
+		case len(cfg.Auth.JWTSecret) < minJWTSecretLength:
+			fail("auth.jwt_secret must be at least %d bytes in release mode", minJWTSecretLength)
+		}
+	}
+
+	if cfg.Auth.TokenCacheTTL < 0 || cfg.Auth.TokenCacheTTL > maxTokenCacheTTL {
+		fail("auth.token_cache_ttl must be between 0 and %s", maxTokenCacheTTL)
+	}
+	if cfg.Auth.UserCacheTTL < 0 || cfg.Auth.UserCacheTTL > maxTokenCacheTTL {
+		fail("auth.user_cache_ttl must be between 0 and %s", maxTokenCacheTTL)
+	}
+	if cfg.Auth.ExchangeTokenTTL <= 0 || cfg.Auth.ExchangeTokenTTL > time.Hour {
+		fail("auth.exchange_token_ttl must be positive and at most 1h")
+	}
+	switch cfg.Auth.InternalSigning {
+	case internalSigningOff, internalSigningOptional, internalSigningRequired:
+	default:
+		fail("auth.internal_signing must be off, optional or required")
+	}
+	if keys, err := parseSigningKeys(cfg.Auth.InternalSigningKeys, cfg.Auth.InternalSigningPublicKeys); err != nil {
+		fail("%s", err)
+	} else if cfg.Auth.InternalSigning != internalSigningOff && len(keys.hmac)+len(keys.ed25519) == 0 {
+		fail("auth.internal_signing needs auth.internal_signing_keys or auth.internal_signing_public_keys")
+	}
+	if cfg.Auth.OAuthTokenTTL <= 0 || cfg.Auth.OAuthTokenTTL > 24*time.Hour {
+		fail("auth.oauth_token_ttl must be positive and at most 24h")
+	}
+	if cfg.Auth.OAuthClientsFile == "" {
+		fail("auth.oauth_clients_file is required")
+	}
+
+	switch cfg.Registration.Mode {
+	case registrationOpen, registrationApproval, registrationClosed:
+	default:
+		fail("registration.mode must be open, approval or closed")
+	}
+	for _, domain := range cfg.Registration.AllowedDomains {
+		if !validEmailDomain(domain) {
+			fail("registration.allowed_domains: %q is not a domain", domain)
+		}
+	}
+	if cfg.Orgs.StoreFile == "" {
+		fail("orgs.store_file is required")
+	}
+	switch cfg.Session.Mode {
+	case sessionModeBearer, sessionModeCookie, sessionModeBoth:
+	default:
+		fail("session.mode must be bearer, cookie or both")
+	}
+	switch cfg.Session.SameSite {
+	case "lax", "strict":
+	case "none":
+		if !cfg.Session.CookieSecure {
+			fail("session.same_site none requires session.cookie_secure")
+		}
+	default:
+		fail("session.same_site must be lax, strict or none")
+	}
+	if cfg.Session.CookieName == "" || cfg.Session.CSRFCookieName == "" || cfg.Session.CookieName == cfg.Session.CSRFCookieName {
+		fail("session.cookie_name and session.csrf_cookie_name must be set and differ")
+	}
+	if cfg.Session.IdleTimeout < 0 {
+		fail("session.idle_timeout must not be negative")
+	}
+	for role, raw := range cfg.Session.IdleTimeoutByRole {
+		if role != "user" && role != "admin" {
+			fail("session.idle_timeout_by_role: %q is not a role", role)
+		} else if timeout, err := time.ParseDuration(raw); err != nil || timeout < 0 {
+			fail("session.idle_timeout_by_role.%s must be a duration such as 15m", role)
+		}
+	}
+	if cfg.Session.Lifetime <= 0 {
+		fail("session.lifetime must be positive")
+	}
+	if cfg.Session.RememberLifetime < cfg.Session.Lifetime || cfg.Session.AbsoluteLifetime < cfg.Session.RememberLifetime {
+		fail("session lifetimes must satisfy lifetime <= remember_lifetime <= absolute_lifetime")
+	}
+
+	switch cfg.Passwords.Algorithm {
+	case passwordAlgBcrypt:
+		if cfg.Passwords.BcryptCost < bcrypt.MinCost || cfg.Passwords.BcryptCost > bcrypt.MaxCost {
+			fail("passwords.bcrypt_cost must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+		}
+	case passwordAlgArgon2id:
+		p := cfg.Passwords
+		if p.Argon2Memory < 0 || p.Argon2Iterations < 0 || p.Argon2Parallelism < 0 || p.Argon2Parallelism > 255 {
+			fail("passwords.argon2_* must not be negative and parallelism must be at most 255")
+		} else if err := (argon2Params{memory: uint32(p.Argon2Memory), iterations: uint32(p.Argon2Iterations), parallelism: uint8(p.Argon2Parallelism)}).check(); err != nil {
+			fail("passwords.argon2_*: %v", err)
+		}
+	default:
+		fail("passwords.algorithm must be bcrypt or argon2id")
+	}
+	if cfg.Passwords.Workers < 0 || cfg.Passwords.QueueSize < 0 || cfg.Passwords.QueueTimeout <= 0 {
+		fail("passwords.workers and passwords.queue_size must not be negative and passwords.queue_timeout must be positive")
+	}
+	if cfg.Passwords.MinScore < 0 || cfg.Passwords.MinScore > 4 {
+		fail("passwords.min_score must be between 0 and 4")
+	}
+	if _, err := parsePeppers(cfg.Passwords.Peppers, cfg.Passwords.PepperID); err != nil {
+		fail("%s", err)
+	}
+
+	if cfg.Anomaly.MaxTravelKmh < 1 {
+		fail("anomaly.max_travel_kmh must be positive")
+	}
+	if (cfg.Anomaly.LatitudeHeader == "") != (cfg.Anomaly.LongitudeHeader == "") {
+		fail("anomaly.latitude_header and anomaly.longitude_header must be set together")
+	}
+
+	if cfg.Risk.Window <= 0 || cfg.Risk.DelayBase < 0 || cfg.Risk.DelayMax < cfg.Risk.DelayBase {
+		fail("risk.window must be positive and risk.delay_max at least risk.delay_base")
+	}
+	if cfg.Risk.AccountWeight < 0 || cfg.Risk.IPWeight < 0 || cfg.Risk.ASNWeight < 0 ||
+		cfg.Risk.IPMaxFailures < 0 || cfg.Risk.ASNMaxFailures < 0 {
+		fail("risk weights and failure limits must not be negative")
+	}
+	if cfg.Risk.CaptchaScore < 0 || cfg.Risk.CaptchaScore > maxRiskScore {
+		fail("risk.captcha_score must be between 0 and %d", maxRiskScore)
+	}
+	if cfg.Risk.Enabled && cfg.Risk.CaptchaScore > 0 && (cfg.Risk.CaptchaVerifyURL == "" || cfg.Risk.CaptchaSecret == "") {
+		fail("risk.captcha_score needs risk.captcha_verify_url and risk.captcha_secret; set it to 0 to go without CAPTCHAs")
+	}
+
+	for name, entries := range map[string][]string{
+		"server.trusted_proxies":  cfg.Server.TrustedProxies,
+		"network.admin_allowlist": cfg.Network.AdminAllowlist,
+		"network.denylist":        cfg.Network.Denylist,
+	} {
+		for _, entry := range entries {
+			if _, err := parseCIDR(entry); err != nil {
+				fail("%s: %v", name, err)
+			}
+		}
+	}
+	if cfg.Network.AutoBanThreshold > 0 && (cfg.Network.AutoBanWindow <= 0 || cfg.Network.AutoBanDuration <= 0) {
+		fail("network.auto_ban_window and auto_ban_duration must be positive when auto-ban is on")
+	}
+	if len(cfg.Network.HoneypotPaths) > 0 && (cfg.Network.HoneypotBanDuration <= 0 || cfg.Network.HoneypotTarpit < 0) {
+		fail("network.honeypot_ban_duration must be positive and honeypot_tarpit non-negative when honeypot paths are set")
+	}
+	for _, path := range cfg.Network.HoneypotPaths {
+		if err := checkHoneypotPath(path); err != nil {
+			fail("network.honeypot_paths: %v", err)
+		}
+	}
+
+	if _, err := parseByteSize(cfg.Request.MaxBodySize); err != nil {
+		fail("request.max_body_size: %v", err)
+	}
+	for route, size := range cfg.Request.RouteLimits {
+		if _, err := parseByteSize(size); err != nil {
+			fail("request.route_limits[%s]: %v", route, err)
+		}
+	}
+
+	if cfg.Maintenance.RetryAfter < 0 {
+		fail("maintenance.retry_after must not be negative")
+	}
+
+	switch cfg.Cluster.Mode {
+	case clusterModeStandalone:
+	case clusterModeRedis, clusterModeMongo:
+		if cfg.Cluster.Mode == clusterModeRedis && cfg.Cluster.RedisURL == "" {
+			fail("cluster.redis_url is required in redis mode")
+		}
+		if cfg.Cluster.Mode == clusterModeMongo && (cfg.Cluster.MongoURL == "" || cfg.Cluster.MongoDatabase == "") {
+			fail("cluster.mongo_url and cluster.mongo_database are required in mongo mode")
+		}
+		if cfg.Auth.JWTSecret == defaultJWTSecret {
+			fail("auth.jwt_secret must be set explicitly in cluster mode so replicas accept each other's tokens")
+		}
+	default:
+		fail("cluster.mode must be standalone, redis or mongo")
+	}
+	if cfg.Cluster.ResyncInterval <= 0 || cfg.Cluster.LockTTL <= 0 {
+		fail("cluster.resync_interval and cluster.lock_ttl must be positive")
+	}
+
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(cfg.Log.Level)); err != nil {
+		fail("log.level must be debug, info, warn or error")
+	}
+	if cfg.Log.Format != "json" && cfg.Log.Format != "text" {
+		fail("log.format must be json or text")
+	}
+
+	for name, raw := range map[string]string{"rag_backend.url": cfg.RAGBackend.URL, "connectors.redirect_base": cfg.Connectors.RedirectBase} {
+		if u, err := url.Parse(raw); err != nil || u.Scheme == "" || u.Host == "" {
+			fail("%s must be an absolute URL", name)
+		}
+	}
+	for name, raw := range cfg.Health.Services {
+		if u, err := url.Parse(raw); name == "" || err != nil || u.Scheme == "" || u.Host == "" {
+			fail("health.services.%s must be an absolute URL", name)
+		}
+	}
+	if cfg.Health.Timeout <= 0 {
+		fail("health.timeout must be positive")
+	}
+	if cfg.Health.CacheTTL < 0 {
+		fail("health.cache_ttl must not be negative")
+	}
+	if cfg.Providers.StoreFile == "" {
+		fail("providers.store_file is required")
+	}
+	if cfg.Providers.HealthInterval <= 0 {
+		fail("providers.health_interval must be positive")
+	}
+	if cfg.Providers.FailureThreshold < 1 {
+		fail("providers.failure_threshold must be at least 1")
+	}
+	if cfg.Providers.OpenFor <= 0 {
+		fail("providers.open_for must be positive")
+	}
+	if cfg.Jobs.Workers < 1 {
+		fail("jobs.workers must be at least 1")
+	}
+	if cfg.Jobs.StoreDir == "" {
+		fail("jobs.store_dir is required")
+	}
+	if cfg.Jobs.Retention <= 0 {
+		fail("jobs.retention must be positive")
+	}
+	if cfg.Connectors.SyncInterval <= 0 {
+		fail("connectors.sync_interval must be positive")
+	}
+	if cfg.SIEM.SyslogAddr != "" {
+		if _, err := newSyslogSink(cfg.SIEM.SyslogAddr); err != nil {
+			fail("siem.syslog_addr: %v", err)
+		}
+	}
+	if _, err := mail.ParseAddress(cfg.Mail.From); err != nil {
+		fail("mail.from must be an email address")
+	}
+	if u, err := url.Parse(cfg.Mail.BaseURL); err != nil || u.Scheme == "" || u.Host == "" {
+		fail("mail.base_url must be an absolute URL")
+	}
+	if cfg.Mail.MaxAttempts < 1 {
+		fail("mail.max_attempts must be at least 1")
+	}
+	switch cfg.Mail.Provider {
+	case mailProviderLog:
+	case mailProviderSMTP:
+		if n, err := strconv.Atoi(cfg.Mail.SMTPPort); err != nil || n < 1 || n > 65535 {
+			fail("mail.smtp_port must be a port number")
+		}
+		if _, err := newSMTPMailer(cfg.Mail); err != nil {
+			fail("mail: %v", err)
+		}
+	case mailProviderSES, mailProviderSendGrid:
+		if _, err := newMailer(cfg.Mail); err != nil {
+			fail("mail: %v", err)
+		}
+	default:
+		fail("mail.provider must be log, smtp, ses or sendgrid")
+	}
+	if cfg.SMS.CodeTTL < time.Minute || cfg.SMS.CodeTTL > time.Hour {
+		fail("sms.code_ttl must be between 1m and 1h")
+	}
+	if cfg.SMS.MaxAttempts < 1 {
+		fail("sms.max_attempts must be at least 1")
+	}
+	if _, err := newSMSSender(cfg.SMS); err != nil {
+		fail("sms: %v", err)
+	}
+	if cfg.I18n.DefaultLanguage == "" || cfg.I18n.DefaultLanguage != strings.ToLower(cfg.I18n.DefaultLanguage) {
+		fail("i18n.default_language must be a lowercase language tag such as en")
+	}
+	switch cfg.ErrorReporting.Backend {
+	case errorReportingNone:
+	case errorReportingSentry, errorReportingWebhook:
+		if _, err := newErrorReporter(cfg.ErrorReporting); err != nil {
+			fail("error_reporting: %v", err)
+		}
+	default:
+		fail("error_reporting.backend must be none, sentry or webhook")
+	}
+	if cfg.Audit.File == "" {
+		fail("audit.file is required")
+	}
+	if cfg.Audit.Retention < 0 {
+		fail("audit.retention must not be negative")
+	}
+	if cfg.DualControl.Enabled && cfg.DualControl.Window <= 0 {
+		fail("dual_control.window must be positive")
+	}
+	for _, action := range cfg.DualControl.Actions {
+		if !slices.Contains(dualControlActions, action) {
+			fail("dual_control.actions: unknown action %q; use %s", action, strings.Join(dualControlActions, ", "))
+		}
+	}
+	if cfg.Exports.Dir == "" {
+		fail("exports.dir is required")
+	}
+	if cfg.Exports.Retention <= 0 {
+		fail("exports.retention must be positive")
+	}
+	if cfg.AccessLog.Readers != accessLogNamed && cfg.AccessLog.Readers != accessLogAnonymous {
+		fail("access_log.readers must be %s or %s", accessLogNamed, accessLogAnonymous)
+	}
+	if cfg.AccessLog.Retention <= 0 || cfg.AccessLog.MaxEntries < 1 {
+		fail("access_log.retention and access_log.max_entries must be positive")
+	}
+	if cfg.Documents.OnConflict != onConflictSuffix && cfg.Documents.OnConflict != onConflictReject {
+		fail("documents.on_conflict must be %s or %s", onConflictSuffix, onConflictReject)
+	}
+	if len(cfg.Documents.AllowedTypes) == 0 {
+		fail("documents.allowed_types must list at least one type")
+	}
+	for _, fileType := range cfg.Documents.AllowedTypes {
+		if !slices.Contains(fileTypes, fileType) {
+			fail("documents.allowed_types: unknown type %q; use %s", fileType, strings.Join(fileTypes, ", "))
+		}
+	}
+	if cfg.Scanning.Timeout <= 0 || cfg.Scanning.Timeout > jobAttemptLimit {
+		fail("scanning.timeout must be positive and at most %s", jobAttemptLimit)
+	}
+	if _, err := newScanner(cfg.Scanning); err != nil {
+		fail("scanning: %v", err)
+	}
+	chunking := ChunkingSettings{Splitter: cfg.Chunking.Splitter, Size: cfg.Chunking.Size, Overlap: cfg.Chunking.Overlap}
+	if err := chunking.check(); err != nil {
+		fail("chunking: %s", err.(*chunkingError).Reason)
+	}
+	for tag, profile := range cfg.Chunking.Collections {
+		if err := profile.over(chunking).check(); err != nil {
+			fail("chunking.collections.%s: %s", tag, err.(*chunkingError).Reason)
+		}
+	}
+	if cfg.Evaluation.StoreDir == "" {
+		fail("evaluation.store_dir is required")
+	}
+	if cfg.Evaluation.NChunks < 1 || cfg.Evaluation.NChunks > 10 {
+		fail("evaluation.n_chunks must be between 1 and 10")
+	}
+	if cfg.Evaluation.Timeout <= 0 || cfg.Evaluation.Timeout > jobAttemptLimit {
+		fail("evaluation.timeout must be positive and at most %s", jobAttemptLimit)
+	}
+	search := SearchSettings{KeywordWeight: cfg.Search.KeywordWeight, Reranker: cfg.Search.Reranker, RerankTopN: cfg.Search.RerankTopN}
+	if err := search.normalize().check(cfg.Search.Rerankers); err != nil {
+		fail("search: %s", err.(*searchError).Reason)
+	}
+	if cfg.Search.StoreFile == "" {
+		fail("search.store_file is required")
+	}
+	if cfg.Conversations.StoreDir == "" {
+		fail("conversations.store_dir is required")
+	}
+	if cfg.SavedQueries.StoreDir == "" {
+		fail("saved_queries.store_dir is required")
+	}
+	if cfg.SavedQueries.NChunks < 1 || cfg.SavedQueries.NChunks > 10 {
+		fail("saved_queries.n_chunks must be between 1 and 10")
+	}
+	if cfg.SavedQueries.Timeout <= 0 || cfg.SavedQueries.Timeout > jobAttemptLimit {
+		fail("saved_queries.timeout must be positive and at most %s", jobAttemptLimit)
+	}
+	if cfg.Costs.Currency == "" {
+		fail("costs.currency is required")
+	}
+	if !orgIDPattern.MatchString(cfg.Costs.DefaultOrg) {
+		fail("costs.default_org must be lowercase letters, digits, - or _")
+	}
+	if cfg.Costs.StoreFile == "" {
+		fail("costs.store_file is required")
+	}
+	if cfg.Costs.StoragePerGBMonth < 0 {
+		fail("costs.storage_per_gb_month must not be negative")
+	}
+	for name, price := range cfg.Costs.Models {
+		if price.PromptPer1K < 0 || price.CompletionPer1K < 0 {
+			fail("costs.models.%s prices must not be negative", name)
+		}
+	}
+	if cfg.Backup.Passphrase != "" && len(cfg.Backup.Passphrase) < 16 {
+		fail("backup.passphrase must be at least 16 characters")
+	}
+	if cfg.Backup.Interval < 0 {
+		fail("backup.interval must not be negative")
+	}
+	if cfg.Backup.Interval > 0 {
+		if cfg.Backup.Passphrase == "" {
+			fail("backup.passphrase is required with backup.interval")
+		}
+		if !validS3Location(cfg.Backup.S3Bucket, cfg.Backup.S3Region) {
+			fail("backup.s3_bucket and backup.s3_region must be valid with backup.interval")
+		}
+		if cfg.Backup.S3AccessKeyID == "" || cfg.Backup.S3SecretAccessKey == "" {
+			fail("backup.s3_access_key_id and backup.s3_secret_access_key are required with backup.interval")
+		}
+	}
+	if cfg.Backup.S3Endpoint != "" {
+		if u, err := url.Parse(cfg.Backup.S3Endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			fail("backup.s3_endpoint must be an http(s) URL")
+		}
+	}
+	if cfg.RateLimit.Enabled {
+		switch cfg.RateLimit.Backend {
+		case "memory":
+		case "redis":
+			if cfg.RateLimit.RedisURL == "" {
+				fail("rate_limit.redis_url is required with the redis backend")
+			}
+		default:
+			fail("rate_limit.backend must be memory or redis")
+		}
+		if cfg.RateLimit.AuthPerMinute < 1 || cfg.RateLimit.AuthBurst < 1 ||
+			cfg.RateLimit.APIPerMinute < 1 || cfg.RateLimit.APIBurst < 1 {
+			fail("rate_limit rates and bursts must be at least 1")
+		}
+	}
+	if _, known := cfg.RateLimit.Plans[cfg.RateLimit.DefaultPlan]; !known {
+		fail("rate_limit.default_plan must be one of rate_limit.plans")
+	}
+	for name, plan := range cfg.RateLimit.Plans {
+		if plan.QueriesPerDay < 0 {
+			fail("rate_limit.plans.%s.queries_per_day must not be negative", name)
+		}
+	}
+	if cfg.RateLimit.QuotaWarningPercent < 0 || cfg.RateLimit.QuotaWarningPercent > 100 {
+		fail("rate_limit.quota_warning_percent must be between 0 and 100")
+	}
+	validateCORS := func(name string, origins []string, credentials bool) {
+		for _, origin := range origins {
+			if origin == "*" {
+				if credentials {
+					fail("%s: \"*\" cannot be combined with allow_credentials", name)
+				}
+				continue
+			}
+			u, err := url.Parse(strings.Replace(origin, "://*.", "://", 1))
+			if err != nil || u.Scheme == "" || u.Host == "" || (u.Path != "" && u.Path != "/") {
+				fail("%s: %q is not an origin", name, origin)
+			}
+		}
+	}
+	validateCORS("cors.allowed_origins", cfg.CORS.AllowedOrigins, cfg.CORS.AllowCredentials)
+	for i, route := range cfg.CORS.Routes {
+		if !strings.HasPrefix(route.PathPrefix, "/") {
+			fail("cors.routes[%d].path_prefix must start with /", i)
+		}
+		validateCORS(fmt.Sprintf("cors.routes[%d].allowed_origins", i), route.AllowedOrigins, route.AllowCredentials)
+	}
+	for i, entry := range cfg.Middleware {
+		if _, ok := middlewareFactory(entry.Name); !ok {
+			fail("middleware[%d].name %q is not a registered middleware", i, entry.Name)
+		}
+		if stage := entry.middlewareStage(); stage != middlewareStageEarly && stage != middlewareStageLate {
+			fail("middleware[%d].stage must be early or late", i)
+		}
+	}
+	switch cfg.TLS.Mode {
+	case tlsModeOff:
+	case tlsModeFiles:
+		if cfg.TLS.CertFile == "" || cfg.TLS.KeyFile == "" {
+			fail("tls.cert_file and tls.key_file are required with tls.mode files")
+		}
+	case tlsModeAutocert:
+		if len(cfg.TLS.AutocertDomains) == 0 || cfg.TLS.AutocertCacheDir == "" {
+			fail("tls.autocert_domains and tls.autocert_cache_dir are required with tls.mode autocert")
+		}
+	default:
+		fail("tls.mode must be off, files or autocert")
+	}
+	if cfg.TLS.Mode != tlsModeOff {
+		if n, err := strconv.Atoi(cfg.TLS.HTTPPort); err != nil || n < 1 || n > 65535 {
+			fail("tls.http_port must be a port number")
+		} else if cfg.TLS.HTTPPort == cfg.Server.Port {
+			fail("tls.http_port must differ from server.port")
+		}
+	}
+	if cfg.Seed.Enabled && cfg.Seed.File == "" {
+		if _, err := mail.ParseAddress(cfg.Seed.AdminEmail); err != nil {
+			fail("seed.admin_email must be an email address")
+		}
+	}
+
+	if len(problems) > 0 {
+		return errors.New("invalid configuration: " + strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// configView renders a config section for display, masking secrets and
+// formatting durations
+func configView(v reflect.Value) map[string]interface{} {
+	view := make(map[string]interface{})
+	for i := 0; i < v.NumField(); i++ {
+		field, meta := v.Field(i), v.Type().Field(i)
+		key := strings.Split(meta.Tag.Get("yaml"), ",")[0]
+
+		switch {
+		case field.Kind() == reflect.Struct:
+			view[key] = configView(field)
+		case field.Kind() == reflect.Slice && field.Type().Elem().Kind() == reflect.Struct:
+			items := make([]interface{}, field.Len())
+			for j := range items {
+				items[j] = configView(field.Index(j))
+			}
+			view[key] = items
+		case meta.Tag.Get("secret") == "true":
+			if field.String() != "" {
+				view[key] = "********"
+			} else {
+				view[key] = ""
+			}
+		case field.Type() == reflect.TypeOf(time.Duration(0)):
+			view[key] = time.Duration(field.Int()).String()
+		default:
+			view[key] = field.Interface()
+		}
+	}
+	return view
+}
+
+// getConfig returns the effective configuration with secrets masked (admin only)
+func getConfig(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"config": configView(reflect.ValueOf(config).Elem()),
+		"file":   configFile,
+	})
+}
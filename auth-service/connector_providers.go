@@ -0,0 +1,422 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ============================================================================
+// Google Drive
+// ============================================================================
+
+type driveConnector struct {
+	provider *oauthProvider
+}
+
+func newDriveConnector() *driveConnector {
+	return &driveConnector{provider: &oauthProvider{
+		AuthURL:      "https://accounts.google.com/o/oauth2/v2/auth",
+		TokenURL:     "https://oauth2.googleapis.com/token",
+		Scopes:       []string{"https://www.googleapis.com/auth/drive.readonly"},
+		ClientID:     config.Connectors.GDriveClientID,
+		ClientSecret: config.Connectors.GDriveClientSecret,
+		RedirectURL:  connectorRedirectURL("gdrive"),
+		// Request a refresh token so syncs keep working after the first hour
+		ExtraAuthParams: url.Values{"access_type": {"offline"}, "prompt": {"consent"}},
+	}}
+}
+
+func (d *driveConnector) Kind() string          { return "gdrive" }
+func (d *driveConnector) OAuth() *oauthProvider { return d.provider }
+
+// ListFiles lists files in the configured folder (folder_id), or the whole
+// drive when no folder is set. Native Google Docs have no binary content
+// and are skipped.
+func (d *driveConnector) ListFiles(ctx context.Context, link *ConnectorLink) ([]RemoteFile, error) {
+	token, err := accessToken(ctx, link, d.provider)
+	if err != nil {
+		return nil, err
+	}
+
+	query := "trashed = false and not mimeType contains 'application/vnd.google-apps.'"
+	if folder := link.Settings["folder_id"]; folder != "" {
+		query += fmt.Sprintf(" and '%s' in parents", strings.ReplaceAll(folder, "'", ""))
+	}
+
+	var files []RemoteFile
+	pageToken := ""
+	for {
+		params := url.Values{
+			"q":        {query},
+			"fields":   {"nextPageToken, files(id, name, md5Checksum, modifiedTime, size)"},
+			"pageSize": {"1000"},
+		}
+		if pageToken != "" {
+			params.Set("pageToken", pageToken)
+		}
+
+		resp, err := bearerGet(ctx, "https://www.googleapis.com/drive/v3/files?"+params.Encode(), token)
+		if err != nil {
+			return nil, err
+		}
+
+		var page struct {
+			NextPageToken string `json:"nextPageToken"`
+			Files         []struct {
+				ID           string `json:"id"`
+				Name         string `json:"name"`
+				MD5Checksum  string `json:"md5Checksum"`
+				ModifiedTime string `json:"modifiedTime"`
+				Size         int64  `json:"size,string"`
+			} `json:"files"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("decode file list: %w", err)
+		}
+
+		for _, f := range page.Files {
+			version := f.MD5Checksum
+			if version == "" {
+				version = f.ModifiedTime
+			}
+			files = append(files, RemoteFile{ID: f.ID, Name: f.Name, Version: version, Size: f.Size})
+		}
+
+		if page.NextPageToken == "" {
+			return files, nil
+		}
+		pageToken = page.NextPageToken
+	}
+}
+
+func (d *driveConnector) Download(ctx context.Context, link *ConnectorLink, file RemoteFile) (io.ReadCloser, error) {
+	token, err := accessToken(ctx, link, d.provider)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := bearerGet(ctx, "https://www.googleapis.com/drive/v3/files/"+url.PathEscape(file.ID)+"?alt=media", token)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// ============================================================================
+// SharePoint / OneDrive (Microsoft Graph)
+// ============================================================================
+
+type sharePointConnector struct {
+	provider *oauthProvider
+}
+
+func newSharePointConnector() *sharePointConnector {
+	tenant := config.Connectors.SharePointTenant
+	return &sharePointConnector{provider: &oauthProvider{
+		AuthURL:      "https://login.microsoftonline.com/" + tenant + "/oauth2/v2.0/authorize",
+		TokenURL:     "https://login.microsoftonline.com/" + tenant + "/oauth2/v2.0/token",
+		Scopes:       []string{"offline_access", "Files.Read.All", "Sites.Read.All"},
+		ClientID:     config.Connectors.SharePointClientID,
+		ClientSecret: config.Connectors.SharePointClientSecret,
+		RedirectURL:  connectorRedirectURL("sharepoint"),
+	}}
+}
+
+func (s *sharePointConnector) Kind() string          { return "sharepoint" }
+func (s *sharePointConnector) OAuth() *oauthProvider { return s.provider }
+
+// driveBase returns the Graph path of the configured drive (drive_id), or
+// the user's own OneDrive
+func (s *sharePointConnector) driveBase(link *ConnectorLink) string {
+	if drive := link.Settings["drive_id"]; drive != "" {
+		return "https://graph.microsoft.com/v1.0/drives/" + url.PathEscape(drive)
+	}
+	return "https://graph.microsoft.com/v1.0/me/drive"
+}
+
+// ListFiles lists files directly inside the configured folder_path
+func (s *sharePointConnector) ListFiles(ctx context.Context, link *ConnectorLink) ([]RemoteFile, error) {
+	token, err := accessToken(ctx, link, s.provider)
+	if err != nil {
+		return nil, err
+	}
+
+	next := s.driveBase(link) + "/root/children"
+	if folder := strings.Trim(link.Settings["folder_path"], "/"); folder != "" {
+		next = s.driveBase(link) + "/root:/" + url.PathEscape(folder) + ":/children"
+	}
+
+	var files []RemoteFile
+	for next != "" {
+		resp, err := bearerGet(ctx, next, token)
+		if err != nil {
+			return nil, err
+		}
+
+		var page struct {
+			NextLink string `json:"@odata.nextLink"`
+			Value    []struct {
+				ID   string    `json:"id"`
+				Name string    `json:"name"`
+				ETag string    `json:"eTag"`
+				Size int64     `json:"size"`
+				File *struct{} `json:"file"` // nil for folders
+			} `json:"value"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("decode file list: %w", err)
+		}
+
+		for _, item := range page.Value {
+			if item.File == nil {
+				continue
+			}
+			files = append(files, RemoteFile{ID: item.ID, Name: item.Name, Version: item.ETag, Size: item.Size})
+		}
+		next = page.NextLink
+	}
+	return files, nil
+}
+
+func (s *sharePointConnector) Download(ctx context.Context, link *ConnectorLink, file RemoteFile) (io.ReadCloser, error) {
+	token, err := accessToken(ctx, link, s.provider)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := bearerGet(ctx, s.driveBase(link)+"/items/"+url.PathEscape(file.ID)+"/content", token)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// ============================================================================
+// Amazon S3
+// ============================================================================
+
+// s3Connector reads from a bucket with static access keys, signing requests
+// with AWS Signature Version 4
+type s3Connector struct{}
+
+// Bucket and region become part of the request host, so anything outside
+// the S3 naming rules could point signed requests elsewhere
+var (
+	s3BucketPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9.-]{1,61}[a-z0-9]$`)
+	s3RegionPattern = regexp.MustCompile(`^[a-z]{2}(-[a-z]+)+-\d$`)
+)
+
+func newS3Connector() *s3Connector { return &s3Connector{} }
+
+func (s *s3Connector) Kind() string { return "s3" }
+
+// validS3Location reports whether bucket and region are well-formed names
+func validS3Location(bucket, region string) bool {
+	return s3BucketPattern.MatchString(bucket) && !strings.Contains(bucket, "..") &&
+		s3RegionPattern.MatchString(region)
+}
+
+func (s *s3Connector) endpoint(link *ConnectorLink) (string, error) {
+	bucket, region := link.Settings["bucket"], link.Settings["region"]
+	if !validS3Location(bucket, region) {
+		return "", fmt.Errorf("invalid bucket or region")
+	}
+	return fmt.Sprintf("https://%s.s3.%s.amazonaws.com", bucket, region), nil
+}
+
+// ListFiles lists objects under the configured prefix
+func (s *s3Connector) ListFiles(ctx context.Context, link *ConnectorLink) ([]RemoteFile, error) {
+	var files []RemoteFile
+	continuation := ""
+	for {
+		params := url.Values{"list-type": {"2"}}
+		if prefix := link.Settings["prefix"]; prefix != "" {
+			params.Set("prefix", prefix)
+		}
+		if continuation != "" {
+			params.Set("continuation-token", continuation)
+		}
+
+		resp, err := s.get(ctx, link, "/", params)
+		if err != nil {
+			return nil, err
+		}
+
+		var page struct {
+			IsTruncated           bool   `xml:"IsTruncated"`
+			NextContinuationToken string `xml:"NextContinuationToken"`
+			Contents              []struct {
+				Key  string `xml:"Key"`
+				ETag string `xml:"ETag"`
+				Size int64  `xml:"Size"`
+			} `xml:"Contents"`
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("decode object list: %w", err)
+		}
+
+		for _, obj := range page.Contents {
+			if strings.HasSuffix(obj.Key, "/") {
+				continue // folder placeholder
+			}
+			name := obj.Key[strings.LastIndex(obj.Key, "/")+1:]
+			files = append(files, RemoteFile{ID: obj.Key, Name: name, Version: obj.ETag, Size: obj.Size})
+		}
+
+		if !page.IsTruncated {
+			return files, nil
+		}
+		continuation = page.NextContinuationToken
+	}
+}
+
+func (s *s3Connector) Download(ctx context.Context, link *ConnectorLink, file RemoteFile) (io.ReadCloser, error) {
+	resp, err := s.get(ctx, link, "/"+s3EscapePath(file.ID), nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// get sends a signed GET request to the bucket
+func (s *s3Connector) get(ctx context.Context, link *ConnectorLink, path string, params url.Values) (*http.Response, error) {
+	endpoint, err := s.endpoint(link)
+	if err != nil {
+		return nil, err
+	}
+	rawURL := endpoint + path
+	if len(params) > 0 {
+		rawURL += "?" + params.Encode()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	signS3Request(req, link.Settings["region"], link.Secrets["access_key_id"], link.Secrets["secret_access_key"], time.Now().UTC())
+
+	resp, err := connectorClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("GET %s returned %s", path, resp.Status)
+	}
+	return resp, nil
+}
+
+// s3EscapePath URI-encodes an object key, keeping slashes
+func s3EscapePath(key string) string {
+	segments := strings.Split(key, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+// signS3Request adds AWS SigV4 headers for an unsigned-payload GET request
+func signS3Request(req *http.Request, region, accessKey, secretKey string, now time.Time) {
+	signAWSRequest(req, "s3", region, accessKey, secretKey, "", "UNSIGNED-PAYLOAD", now)
+}
+
+// signAWSRequest adds AWS SigV4 headers. payloadHash is the hex SHA-256 of
+// the body, or UNSIGNED-PAYLOAD where the service allows it (S3).
+func signAWSRequest(req *http.Request, service, region, accessKey, secretKey, sessionToken, payloadHash string, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+	if sessionToken != "" {
+		req.Header.Set("x-amz-security-token", sessionToken)
+	}
+
+	// Canonical query string: keys and values sorted and strictly encoded
+	query := req.URL.Query()
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, 0, len(keys))
+	for _, key := range keys {
+		for _, value := range query[key] {
+			pairs = append(pairs, awsEscape(key)+"="+awsEscape(value))
+		}
+	}
+
+	// Sign host and every x-amz-* header, in sorted order
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		if lower := strings.ToLower(name); strings.HasPrefix(lower, "x-amz-") {
+			headers[lower] = strings.TrimSpace(values[0])
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		strings.Join(pairs, "&"),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := day + "/" + region + "/" + service + "/aws4_request"
+	canonicalHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), day)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// awsEscape applies the RFC 3986 encoding SigV4 expects
+func awsEscape(s string) string {
+	return strings.ReplaceAll(url.QueryEscape(s), "+", "%20")
+}
@@ -0,0 +1,690 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// ============================================================================
+// Source Connectors
+// ============================================================================
+
+// RemoteFile is a file discovered in an external source
+type RemoteFile struct {
+	ID      string `json:"id"`
+	Name    string `json:"name"`
+	Version string `json:"version"` // changes whenever the file content changes
+	Size    int64  `json:"size"`
+}
+
+// Connector pulls files from an external source on behalf of a linked user
+type Connector interface {
+	Kind() string
+	ListFiles(ctx context.Context, link *ConnectorLink) ([]RemoteFile, error)
+	Download(ctx context.Context, link *ConnectorLink, file RemoteFile) (io.ReadCloser, error)
+}
+
+// oauthConnector is implemented by connectors linked through OAuth2
+type oauthConnector interface {
+	Connector
+	OAuth() *oauthProvider
+}
+
+// OAuthToken holds the credentials issued by a provider's token endpoint
+type OAuthToken struct {
+	AccessToken  string    `json:"access_token"`
+	RefreshToken string    `json:"refresh_token,omitempty"`
+	TokenType    string    `json:"token_type,omitempty"`
+	Expiry       time.Time `json:"expiry,omitempty"`
+}
+
+// ConnectorLink is a user's authorization to pull from one external source
+type ConnectorLink struct {
+	ID         string            `json:"id"`
+	UserID     string            `json:"user_id"`
+	Kind       string            `json:"kind"`
+	Settings   map[string]string `json:"settings,omitempty"` // e.g. folder_id, bucket
+	Token      *OAuthToken       `json:"-"`
+	Secrets    map[string]string `json:"-"` // non-OAuth credentials, e.g. S3 keys
+	Seen       map[string]string `json:"-"` // remote file ID -> last synced version
+	Files      int               `json:"files"`
+	CreatedAt  time.Time         `json:"created_at"`
+	LastSyncAt *time.Time        `json:"last_sync_at,omitempty"`
+	LastError  string            `json:"last_error,omitempty"`
+	syncing    bool
+}
+
+// oauthState tracks an in-flight authorization so the callback can be tied
+// back to the user who started it
+type oauthState struct {
+	UserID    string
+	Kind      string
+	Settings  map[string]string
+	ExpiresAt time.Time
+}
+
+var (
+	connectors      = make(map[string]Connector)      // kind -> connector
+	connectorLinks  = make(map[string]*ConnectorLink) // link id -> link
+	oauthStates     = make(map[string]oauthState)     // state -> pending authorization
+	connectorMutex  sync.Mutex
+	connectorClient = &http.Client{Timeout: 60 * time.Second}
+)
+
+const oauthStateTTL = 10 * time.Minute
+
+// registerConnectors builds the connectors from the loaded configuration
+func registerConnectors() {
+	for _, conn := range []Connector{newDriveConnector(), newSharePointConnector(), newS3Connector()} {
+		connectors[conn.Kind()] = conn
+	}
+}
+
+// connectorEnabled reports whether a connector has the configuration it needs
+func connectorEnabled(conn Connector) bool {
+	if oc, ok := conn.(oauthConnector); ok {
+		return oc.OAuth().ClientID != ""
+	}
+	return true
+}
+
+// ----------------------------------------------------------------------------
+// OAuth2
+// ----------------------------------------------------------------------------
+
+// oauthProvider describes an OAuth2 authorization-code endpoint pair
+type oauthProvider struct {
+	AuthURL      string
+	TokenURL     string
+	Scopes       []string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	// ExtraAuthParams are added to the authorization URL (e.g. offline access)
+	ExtraAuthParams url.Values
+}
+
+// connectorRedirectURL builds the callback URL registered with providers
+func connectorRedirectURL(kind string) string {
+	return strings.TrimRight(config.Connectors.RedirectBase, "/") + "/connectors/callback/" + kind
+}
+
+// AuthCodeURL returns the URL the user visits to grant access
+func (p *oauthProvider) AuthCodeURL(state string) string {
+	params := url.Values{
+		"response_type": {"code"},
+		"client_id":     {p.ClientID},
+		"redirect_uri":  {p.RedirectURL},
+		"scope":         {strings.Join(p.Scopes, " ")},
+		"state":         {state},
+	}
+	for key, values := range p.ExtraAuthParams {
+		params[key] = values
+	}
+	return p.AuthURL + "?" + params.Encode()
+}
+
+// Exchange trades an authorization code for a token
+func (p *oauthProvider) Exchange(ctx context.Context, code string) (*OAuthToken, error) {
+	return p.requestToken(ctx, url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {code},
+		"redirect_uri": {p.RedirectURL},
+	})
+}
+
+// Refresh obtains a new access token. Providers may omit the refresh token
+// in the response, in which case the existing one is kept.
+func (p *oauthProvider) Refresh(ctx context.Context, token *OAuthToken) (*OAuthToken, error) {
+	if token.RefreshToken == "" {
+		return nil, errors.New("token expired and no refresh token available")
+	}
+	fresh, err := p.requestToken(ctx, url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {token.RefreshToken},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if fresh.RefreshToken == "" {
+		fresh.RefreshToken = token.RefreshToken
+	}
+	return fresh, nil
+}
+
+// requestToken posts to the token endpoint
+func (p *oauthProvider) requestToken(ctx context.Context, form url.Values) (*OAuthToken, error) {
+	form.Set("client_id", p.ClientID)
+	form.Set("client_secret", p.ClientSecret)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := connectorClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("token request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		AccessToken      string `json:"access_token"`
+		RefreshToken     string `json:"refresh_token"`
+		TokenType        string `json:"token_type"`
+		ExpiresIn        int64  `json:"expires_in"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("decode token response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK || body.AccessToken == "" {
+		return nil, fmt.Errorf("token endpoint returned %s: %s %s", resp.Status, body.Error, body.ErrorDescription)
+	}
+
+	token := &OAuthToken{
+		AccessToken:  body.AccessToken,
+		RefreshToken: body.RefreshToken,
+		TokenType:    body.TokenType,
+	}
+	if body.ExpiresIn > 0 {
+		token.Expiry = time.Now().Add(time.Duration(body.ExpiresIn) * time.Second)
+	}
+	return token, nil
+}
+
+// accessToken returns a valid access token for the link, refreshing and
+// storing a new one when the current token is about to expire
+func accessToken(ctx context.Context, link *ConnectorLink, provider *oauthProvider) (string, error) {
+	connectorMutex.Lock()
+	token := link.Token
+	connectorMutex.Unlock()
+
+	if token == nil {
+		return "", errors.New("connector is not authorized")
+	}
+	if token.Expiry.IsZero() || time.Until(token.Expiry) > time.Minute {
+		return token.AccessToken, nil
+	}
+
+	fresh, err := provider.Refresh(ctx, token)
+	if err != nil {
+		return "", err
+	}
+
+	connectorMutex.Lock()
+	link.Token = fresh
+	connectorMutex.Unlock()
+
+	return fresh.AccessToken, nil
+}
+
+// bearerGet performs an authenticated GET against a provider API
+func bearerGet(ctx context.Context, rawURL, token string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := connectorClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("GET %s returned %s", req.URL.Path, resp.Status)
+	}
+	return resp, nil
+}
+
+// newOAuthState generates an unguessable state value
+func newOAuthState() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// ----------------------------------------------------------------------------
+// Sync
+// ----------------------------------------------------------------------------
+
+// syncLink pulls new and changed files from a link's source into the
+// document pipeline and registers them to the linking user
+func syncLink(ctx context.Context, link *ConnectorLink) error {
+	connectorMutex.Lock()
+	if link.syncing {
+		connectorMutex.Unlock()
+		return errors.New("sync already in progress")
+	}
+	link.syncing = true
+	conn := connectors[link.Kind]
+	connectorMutex.Unlock()
+
+	defer func() {
+		connectorMutex.Lock()
+		link.syncing = false
+		connectorMutex.Unlock()
+	}()
+
+	// Another replica may have linked the same source
+	release, err := tryLock(sourceLockName(link), config.Cluster.LockTTL)
+	if err == errLockHeld {
+		return errors.New("sync already in progress on another instance")
+	}
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	files, err := conn.ListFiles(ctx, link)
+	if err == nil {
+		err = ingestFiles(ctx, conn, link, files)
+	}
+
+	now := time.Now()
+	connectorMutex.Lock()
+	link.LastSyncAt = &now
+	link.LastError = ""
+	if err != nil {
+		link.LastError = err.Error()
+	}
+	connectorMutex.Unlock()
+
+	return err
+}
+
+// sourceLockName identifies the remote source a link syncs from, so links
+// to the same source share a lock
+func sourceLockName(link *ConnectorLink) string {
+	keys := make([]string, 0, len(link.Settings))
+	for key := range link.Settings {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	sum := sha256.New()
+	fmt.Fprintf(sum, "%s\x00%s", link.Kind, link.UserID)
+	for _, key := range keys {
+		fmt.Fprintf(sum, "\x00%s=%s", key, link.Settings[key])
+	}
+	return "connector-sync:" + hex.EncodeToString(sum.Sum(nil))
+}
+
+// ingestFiles uploads every file whose version differs from the last sync
+func ingestFiles(ctx context.Context, conn Connector, link *ConnectorLink, files []RemoteFile) error {
+	var failures []string
+	for _, file := range files {
+		connectorMutex.Lock()
+		seen := link.Seen[file.ID]
+		connectorMutex.Unlock()
+		if seen == file.Version {
+			debugLog("connectors", "File unchanged; skipping", "connector_id", link.ID, "file", file.Name)
+			continue
+		}
+		debugLog("connectors", "Ingesting file", "connector_id", link.ID, "file", file.Name, "version", file.Version)
+
+		if err := ingestFile(ctx, conn, link, file); err != nil {
+			slog.Warn("Connector file sync failed", "connector_id", link.ID, "file", file.Name, "error", err)
+			failures = append(failures, file.Name)
+			continue
+		}
+
+		connectorMutex.Lock()
+		if _, existed := link.Seen[file.ID]; !existed {
+			link.Files++
+		}
+		link.Seen[file.ID] = file.Version
+		connectorMutex.Unlock()
+	}
+
+	if len(failures) > 0 {
+		return fmt.Errorf("failed to sync %d file(s): %s", len(failures), strings.Join(failures, ", "))
+	}
+	return nil
+}
+
+// ingestFile downloads one file, claims it for the linking user, and
+// queues it for processing
+func ingestFile(ctx context.Context, conn Connector, link *ConnectorLink, file RemoteFile) error {
+	// Claim first so a file owned by someone else is never overwritten
+	filename, created, err := registerDocumentAs(file.Name, link.UserID)
+	if err != nil {
+		return err
+	}
+	release := func() {
+		if created {
+			releaseDocument(filename, &User{ID: link.UserID})
+		}
+	}
+
+	body, err := conn.Download(ctx, link, file)
+	if err != nil {
+		return fmt.Errorf("download: %w", err)
+	}
+	defer body.Close()
+
+	content, err := io.ReadAll(io.LimitReader(body, maxUploadSize+1))
+	if err != nil {
+		return fmt.Errorf("download: %w", err)
+	}
+	if len(content) > maxUploadSize {
+		release()
+		return fmt.Errorf("file exceeds 10MB limit")
+	}
+	mediaType, err := checkFileType(file.Name, content)
+	if err != nil {
+		release()
+		return err
+	}
+
+	_, err = enqueueIngestJob(link.UserID, filename, mediaType, content)
+	return err
+}
+
+// startConnectorSync periodically syncs every linked source
+func startConnectorSync() {
+	interval := config.Connectors.SyncInterval
+	goBackground(func(ctx context.Context) {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			connectorMutex.Lock()
+			links := make([]*ConnectorLink, 0, len(connectorLinks))
+			for _, link := range connectorLinks {
+				links = append(links, link)
+			}
+			connectorMutex.Unlock()
+
+			for _, link := range links {
+				if ctx.Err() != nil {
+					return
+				}
+				syncCtx, cancel := context.WithTimeout(ctx, interval)
+				if err := syncLink(syncCtx, link); err != nil {
+					slog.Warn("Connector sync failed", "connector_id", link.ID, "kind", link.Kind, "error", err)
+				}
+				cancel()
+			}
+		}
+	})
+}
+
+// ----------------------------------------------------------------------------
+// Handlers
+// ----------------------------------------------------------------------------
+
+// LinkS3Request for linking an S3 bucket
+type LinkS3Request struct {
+	Bucket          string `json:"bucket" binding:"required"`
+	Region          string `json:"region" binding:"required"`
+	Prefix          string `json:"prefix,omitempty"`
+	AccessKeyID     string `json:"access_key_id" binding:"required"`
+	SecretAccessKey string `json:"secret_access_key" binding:"required"`
+}
+
+// listConnectors returns the available connector kinds and the caller's links
+func listConnectors(c *gin.Context) {
+	user, _ := c.Get("user")
+	currentUser := user.(*User)
+
+	connectorMutex.Lock()
+	defer connectorMutex.Unlock()
+
+	available := make([]gin.H, 0, len(connectors))
+	for kind, conn := range connectors {
+		_, isOAuth := conn.(oauthConnector)
+		available = append(available, gin.H{
+			"kind":    kind,
+			"oauth":   isOAuth,
+			"enabled": connectorEnabled(conn),
+		})
+	}
+
+	links := make([]ConnectorLink, 0)
+	for _, link := range connectorLinks {
+		if link.UserID == currentUser.ID {
+			links = append(links, *link)
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"connectors": available,
+		"links":      links,
+	})
+}
+
+// authorizeConnector starts the OAuth flow for a connector
+func authorizeConnector(c *gin.Context) {
+	kind := c.Param("kind")
+	conn, ok := connectors[kind].(oauthConnector)
+	if !ok {
+		respondError(c, http.StatusNotFound, codeNotFound, "Unknown OAuth connector")
+		return
+	}
+	if !connectorEnabled(conn) {
+		respondError(c, http.StatusServiceUnavailable, codeNotConfigured, "Connector is not configured")
+		return
+	}
+
+	user, _ := c.Get("user")
+	currentUser := user.(*User)
+
+	state, err := newOAuthState()
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, codeInternal, "Failed to start authorization")
+		return
+	}
+
+	// Optional source settings (folder, drive) are carried through the flow
+	settings := make(map[string]string)
+	for key, values := range c.Request.URL.Query() {
+		if len(values) > 0 {
+			settings[key] = values[0]
+		}
+	}
+
+	connectorMutex.Lock()
+	for key, pending := range oauthStates {
+		if time.Now().After(pending.ExpiresAt) {
+			delete(oauthStates, key)
+		}
+	}
+	oauthStates[state] = oauthState{
+		UserID:    currentUser.ID,
+		Kind:      kind,
+		Settings:  settings,
+		ExpiresAt: time.Now().Add(oauthStateTTL),
+	}
+	connectorMutex.Unlock()
+
+	c.JSON(http.StatusOK, gin.H{"auth_url": conn.OAuth().AuthCodeURL(state)})
+}
+
+// connectorCallback completes the OAuth flow and stores the link
+func connectorCallback(c *gin.Context) {
+	kind := c.Param("kind")
+	state := c.Query("state")
+
+	connectorMutex.Lock()
+	pending, exists := oauthStates[state]
+	delete(oauthStates, state)
+	connectorMutex.Unlock()
+
+	if !exists || pending.Kind != kind || time.Now().After(pending.ExpiresAt) {
+		respondError(c, http.StatusBadRequest, codeInvalidRequest, "Invalid or expired authorization state")
+		return
+	}
+	if errCode := c.Query("error"); errCode != "" {
+		respondError(c, http.StatusBadRequest, codeInvalidRequest, "Authorization denied: "+errCode)
+		return
+	}
+
+	conn := connectors[kind].(oauthConnector)
+	token, err := conn.OAuth().Exchange(c.Request.Context(), c.Query("code"))
+	if err != nil {
+		slog.Warn("Connector code exchange failed", "kind", kind, "error", err)
+		respondError(c, http.StatusBadGateway, codeUpstreamUnavailable, "Failed to complete authorization")
+		return
+	}
+
+	link := &ConnectorLink{
+		ID:        uuid.New().String(),
+		UserID:    pending.UserID,
+		Kind:      kind,
+		Settings:  pending.Settings,
+		Token:     token,
+		Seen:      make(map[string]string),
+		CreatedAt: time.Now(),
+	}
+
+	// Respond with a copy: the sync below updates the link concurrently
+	connectorMutex.Lock()
+	connectorLinks[link.ID] = link
+	snapshot := *link
+	connectorMutex.Unlock()
+
+	goBackground(func(ctx context.Context) {
+		if err := syncLink(ctx, link); err != nil {
+			slog.Warn("Connector initial sync failed", "connector_id", link.ID, "kind", kind, "error", err)
+		}
+	})
+
+	auditActor(c, lookupUser(link.UserID))
+	auditChange(c, "connector.link", "connector_link:"+link.ID, nil, gin.H{"kind": link.Kind, "user_id": link.UserID})
+	c.JSON(http.StatusCreated, gin.H{"message": "Connector linked", "link": snapshot})
+}
+
+// linkS3Connector links an S3 bucket using access keys
+func linkS3Connector(c *gin.Context) {
+	var req LinkS3Request
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondBindError(c, err)
+		return
+	}
+
+	if !validS3Location(req.Bucket, req.Region) {
+		respondError(c, http.StatusBadRequest, codeInvalidRequest, "Invalid bucket name or region")
+		return
+	}
+
+	user, _ := c.Get("user")
+	currentUser := user.(*User)
+
+	link := &ConnectorLink{
+		ID:     uuid.New().String(),
+		UserID: currentUser.ID,
+		Kind:   "s3",
+		Settings: map[string]string{
+			"bucket": req.Bucket,
+			"region": req.Region,
+			"prefix": req.Prefix,
+		},
+		Secrets: map[string]string{
+			"access_key_id":     req.AccessKeyID,
+			"secret_access_key": req.SecretAccessKey,
+		},
+		Seen:      make(map[string]string),
+		CreatedAt: time.Now(),
+	}
+
+	// Verify the credentials before storing them
+	if _, err := connectors["s3"].ListFiles(c.Request.Context(), link); err != nil {
+		slog.Warn("S3 connector verification failed", "bucket", req.Bucket, "error", err)
+		respondError(c, http.StatusBadRequest, codeInvalidRequest, "Unable to access bucket with these credentials")
+		return
+	}
+
+	// Respond with a copy: the sync below updates the link concurrently
+	connectorMutex.Lock()
+	connectorLinks[link.ID] = link
+	snapshot := *link
+	connectorMutex.Unlock()
+
+	goBackground(func(ctx context.Context) {
+		if err := syncLink(ctx, link); err != nil {
+			slog.Warn("Connector initial sync failed", "connector_id", link.ID, "kind", "s3", "error", err)
+		}
+	})
+
+	c.JSON(http.StatusCreated, gin.H{"message": "Connector linked", "link": snapshot})
+}
+
+// ownedLink looks up a link that the current user may manage
+func ownedLink(c *gin.Context) (*ConnectorLink, bool) {
+	user, _ := c.Get("user")
+	currentUser := user.(*User)
+
+	connectorMutex.Lock()
+	link, exists := connectorLinks[c.Param("id")]
+	connectorMutex.Unlock()
+
+	if !exists {
+		respondError(c, http.StatusNotFound, codeNotFound, "Connector link not found")
+		return nil, false
+	}
+	if link.UserID != currentUser.ID && currentUser.Role != "admin" {
+		respondError(c, http.StatusForbidden, codeForbidden, "Not authorized to manage this connector")
+		return nil, false
+	}
+	return link, true
+}
+
+// syncConnectorLink triggers an immediate sync of a link
+func syncConnectorLink(c *gin.Context) {
+	link, ok := ownedLink(c)
+	if !ok {
+		return
+	}
+
+	goBackground(func(ctx context.Context) {
+		if err := syncLink(ctx, link); err != nil {
+			slog.Warn("Connector manual sync failed", "connector_id", link.ID, "kind", link.Kind, "error", err)
+		}
+	})
+
+	c.JSON(http.StatusAccepted, gin.H{"message": "Sync started", "link_id": link.ID})
+}
+
+// unlinkConnector removes a link and its stored credentials. Documents
+// already ingested stay registered to the user.
+func unlinkConnector(c *gin.Context) {
+	link, ok := ownedLink(c)
+	if !ok {
+		return
+	}
+
+	connectorMutex.Lock()
+	delete(connectorLinks, link.ID)
+	connectorMutex.Unlock()
+
+	c.JSON(http.StatusOK, gin.H{"message": "Connector unlinked", "link_id": link.ID})
+}
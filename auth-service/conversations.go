@@ -0,0 +1,949 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"maps"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// ============================================================================
+// Shared Conversations
+// ============================================================================
+//
+// A conversation is a saved chat thread: questions with the answers and the
+// documents they drew on. Turns are added with POST
+// /conversations/:id/turns, or by the chat WebSocket when a query names
+// the conversation in conversation_id, with the documents the backend says
+// the answer drew on as its sources. The owner shares a conversation
+// with members by email, as a viewer (read only) or a collaborator (may
+// add turns), or through a link: anyone signed in who opens it sees the
+// conversation, and joining makes them a member with the link's role. A
+// link is shown once; replacing or deleting it stops the old one working.
+//
+// Sharing a conversation never shares its documents. Every view is built
+// for the viewer: sources they can't read under the document ACLs (owner,
+// org scope, grants) are left out of each turn and counted in
+// hidden_sources, and the answer drawn from them is withheld
+// (answer_withheld), so a viewer learns nothing about documents beyond that
+// some exist. An admin's chat query searches every document; if the backend
+// names no sources for it, the turn is unscoped and its answer is withheld
+// from everyone but admins. Share link tokens are masked in request logs
+// (logging.go). Conversations are files under conversations.store_dir, or
+// records in the shared store in cluster mode: each replica reads a
+// conversation from the store whenever it's used, and changes to one are
+// made under its lock, so members can be served by any replica.
+
+// Conversation roles
+const (
+	conversationOwner        = "owner"
+	conversationCollaborator = "collaborator"
+	conversationViewer       = "viewer"
+)
+
+const (
+	maxConversationTurns   = 500
+	maxConversationMembers = 50
+
+	conversationRecord = "conversation" // id -> Conversation, in cluster mode
+)
+
+// NotificationConversationShared tells a member a conversation was shared
+// with them
+const NotificationConversationShared = "conversation.shared"
+
+var (
+	errConversationNotFound = errors.New("Conversation not found")
+	errNotConversationOwner = errors.New("Only the conversation's owner can do this")
+	errConversationReadOnly = errors.New("You can view this conversation but not add to it")
+	errConversationFull     = errors.New("Conversation has too many turns")
+	errTooManyMembers       = errors.New("Conversation has too many members")
+	errMemberIsOwner        = errors.New("The owner is already in this conversation")
+	errMemberNotFound       = errors.New("Member not found")
+	errShareLinkNotFound    = errors.New("Share link not found")
+)
+
+// ConversationTurn is one question and its answer
+type ConversationTurn struct {
+	ID       string    `json:"id"`
+	AuthorID string    `json:"author_id"`
+	Question string    `json:"question"`
+	Answer   string    `json:"answer"`
+	Sources  []string  `json:"sources,omitempty"`  // documents the answer drew on
+	Unscoped bool      `json:"unscoped,omitempty"` // drew on any document, sources unknown
+	AskedAt  time.Time `json:"asked_at"`
+}
+
+// Conversation is a saved thread as stored
+type Conversation struct {
+	ID        string             `json:"id"`
+	Title     string             `json:"title"`
+	OwnerID   string             `json:"owner_id"`
+	Members   map[string]string  `json:"members,omitempty"`   // user ID -> viewer | collaborator
+	LinkHash  string             `json:"link_hash,omitempty"` // sha256 of the share link's token
+	LinkRole  string             `json:"link_role,omitempty"`
+	Turns     []ConversationTurn `json:"turns"`
+	CreatedAt time.Time          `json:"created_at"`
+	UpdatedAt time.Time          `json:"updated_at"`
+}
+
+// ConversationMember is someone a conversation is shared with
+type ConversationMember struct {
+	UserID string `json:"user_id"`
+	Email  string `json:"email,omitempty"`
+	Role   string `json:"role"`
+}
+
+// TurnView is a turn as one viewer sees it
+type TurnView struct {
+	ConversationTurn
+	HiddenSources  int  `json:"hidden_sources,omitempty"`  // sources the viewer can't read
+	AnswerWithheld bool `json:"answer_withheld,omitempty"` // the answer drew on hidden sources
+}
+
+// ConversationView is a conversation as one viewer sees it
+type ConversationView struct {
+	ID        string               `json:"id"`
+	Title     string               `json:"title"`
+	OwnerID   string               `json:"owner_id"`
+	Role      string               `json:"role"`              // the viewer's
+	Members   []ConversationMember `json:"members,omitempty"` // to the owner
+	LinkRole  string               `json:"link_role,omitempty"`
+	Turns     []TurnView           `json:"turns"`
+	CreatedAt time.Time            `json:"created_at"`
+	UpdatedAt time.Time            `json:"updated_at"`
+}
+
+// ConversationSummary lists a conversation without its turns
+type ConversationSummary struct {
+	ID        string    `json:"id"`
+	Title     string    `json:"title"`
+	OwnerID   string    `json:"owner_id"`
+	Role      string    `json:"role"`
+	Turns     int       `json:"turns"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// ConversationRequest for creating or renaming a conversation
+type ConversationRequest struct {
+	Title string `json:"title" binding:"required,max=200"`
+}
+
+// ConversationTurnRequest for POST /conversations/:id/turns
+type ConversationTurnRequest struct {
+	Question string   `json:"question" binding:"required,max=10000"`
+	Answer   string   `json:"answer" binding:"max=100000"`
+	Sources  []string `json:"sources,omitempty" binding:"max=50"`
+	Unscoped bool     `json:"-"` // set by the chat WebSocket only
+}
+
+// ConversationMemberRequest for POST /conversations/:id/members
+type ConversationMemberRequest struct {
+	Email string `json:"email" binding:"required,email"`
+	Role  string `json:"role" binding:"required,oneof=viewer collaborator"`
+}
+
+// ShareLinkRequest for PUT /conversations/:id/link
+type ShareLinkRequest struct {
+	Role string `json:"role" binding:"required,oneof=viewer collaborator"`
+}
+
+var (
+	conversations     = make(map[string]*Conversation) // id -> conversation
+	conversationLinks = make(map[string]string)        // link hash -> conversation id
+	conversationMutex sync.Mutex
+	conversationStore jobFiles // <id>.json
+)
+
+// startConversations loads stored conversations; in cluster mode they're
+// read from the shared store as they're used
+func startConversations() {
+	conversationStore = jobFiles{dir: config.Conversations.StoreDir}
+	if clustered() {
+		return
+	}
+	if err := loadConversations(); err != nil {
+		fatal("Failed to open conversation store", "dir", conversationStore.dir, "error", err)
+	}
+}
+
+func loadConversations() error {
+	if err := os.MkdirAll(conversationStore.dir, 0o700); err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(conversationStore.dir)
+	if err != nil {
+		return err
+	}
+	conversationMutex.Lock()
+	defer conversationMutex.Unlock()
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(conversationStore.dir, entry.Name()))
+		if err != nil {
+			return err
+		}
+		var conversation Conversation
+		if err := json.Unmarshal(data, &conversation); err != nil {
+			slog.Warn("Skipping unreadable conversation", "file", entry.Name(), "error", err)
+			continue
+		}
+		cacheConversation(&conversation)
+	}
+	return nil
+}
+
+// cacheConversation puts a conversation and its link in the local maps;
+// callers hold conversationMutex
+func cacheConversation(conversation *Conversation) {
+	if previous, exists := conversations[conversation.ID]; exists {
+		delete(conversationLinks, previous.LinkHash)
+	}
+	conversations[conversation.ID] = conversation
+	if conversation.LinkHash != "" {
+		conversationLinks[conversation.LinkHash] = conversation.ID
+	}
+}
+
+// dropConversation takes a conversation and its link out of the local
+// maps; callers hold conversationMutex
+func dropConversation(id string) {
+	if conversation, exists := conversations[id]; exists {
+		delete(conversationLinks, conversation.LinkHash)
+		delete(conversations, id)
+	}
+}
+
+// refreshConversation replaces the local copy of a conversation with the
+// shared store's in cluster mode; callers hold conversationMutex
+func refreshConversation(id string) error {
+	if !clustered() {
+		return nil
+	}
+	data, found, err := keyedRecords().record(context.Background(), conversationRecord, id)
+	if err != nil {
+		slog.Error("Record store read failed", "op", "conversation", "error", err)
+		return errStoreUnavailable
+	}
+	if !found {
+		dropConversation(id)
+		return nil
+	}
+	var conversation Conversation
+	if err := json.Unmarshal(data, &conversation); err != nil {
+		return err
+	}
+	cacheConversation(&conversation)
+	return nil
+}
+
+// refreshConversations replaces every local copy with the shared store's
+// in cluster mode; callers hold conversationMutex
+func refreshConversations() error {
+	if !clustered() {
+		return nil
+	}
+	records, err := keyedRecords().records(context.Background(), conversationRecord)
+	if err != nil {
+		slog.Error("Record store read failed", "op", "conversations", "error", err)
+		return errStoreUnavailable
+	}
+	conversations, conversationLinks = make(map[string]*Conversation), make(map[string]string)
+	for id, data := range records {
+		var conversation Conversation
+		if err := json.Unmarshal(data, &conversation); err != nil {
+			slog.Warn("Skipping unreadable conversation", "conversation_id", id, "error", err)
+			continue
+		}
+		cacheConversation(&conversation)
+	}
+	return nil
+}
+
+// conversationLock serializes changes to one conversation across replicas;
+// it's taken before conversationMutex
+func conversationLock(id string) (func(), error) {
+	ctx, cancel := context.WithTimeout(context.Background(), config.Cluster.LockTTL)
+	defer cancel()
+	release, err := acquireLock(ctx, conversationRecord+":"+id, config.Cluster.LockTTL)
+	if err != nil {
+		slog.Error("Conversation lock failed", "error", err)
+		return nil, errStoreUnavailable
+	}
+	return release, nil
+}
+
+// persistConversation saves a conversation. In cluster mode it goes to the
+// shared store and a failed write is returned; otherwise it goes to its
+// file, logging rather than failing like persistEvaluation. Callers hold
+// conversationMutex.
+func persistConversation(conversation *Conversation) error {
+	data, err := json.Marshal(conversation)
+	if err != nil {
+		return err
+	}
+	if clustered() {
+		if err := keyedRecords().saveRecord(context.Background(), conversationRecord, conversation.ID, data, 0); err != nil {
+			slog.Error("Record store write failed", "op", "conversation", "error", err)
+			return errStoreUnavailable
+		}
+		return nil
+	}
+	if err := conversationStore.write(conversationStore.path(conversation.ID, ".json"), data); err != nil {
+		slog.Error("Conversation store write failed", "conversation_id", conversation.ID, "error", err)
+	}
+	return nil
+}
+
+// removeConversation deletes a stored conversation; callers hold
+// conversationMutex
+func removeConversation(id string) error {
+	if clustered() {
+		if err := keyedRecords().deleteRecord(context.Background(), conversationRecord, id); err != nil {
+			slog.Error("Record store write failed", "op", "conversation", "error", err)
+			return errStoreUnavailable
+		}
+		return nil
+	}
+	conversationStore.remove(id)
+	return nil
+}
+
+func linkHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// roleIn returns a user's role in a conversation, or "" if they have none;
+// admins may view any conversation
+func (conversation *Conversation) roleIn(user *User) string {
+	switch {
+	case conversation.OwnerID == user.ID:
+		return conversationOwner
+	case conversation.Members[user.ID] != "":
+		return conversation.Members[user.ID]
+	case user.Role == "admin":
+		return conversationViewer
+	}
+	return ""
+}
+
+// conversationFor returns a conversation the user has a role in, and the
+// role; callers hold conversationMutex
+func conversationFor(id string, user *User) (*Conversation, string, error) {
+	if err := refreshConversation(id); err != nil {
+		return nil, "", err
+	}
+	conversation, exists := conversations[id]
+	if !exists {
+		return nil, "", errConversationNotFound
+	}
+	role := conversation.roleIn(user)
+	if role == "" {
+		return nil, "", errConversationNotFound
+	}
+	return conversation, role, nil
+}
+
+// ownedConversation returns a conversation only its owner may change;
+// callers hold conversationMutex
+func ownedConversation(id string, user *User) (*Conversation, error) {
+	conversation, role, err := conversationFor(id, user)
+	if err == nil && role != conversationOwner {
+		err = errNotConversationOwner
+	}
+	return conversation, err
+}
+
+// readableSources keeps the documents a user can read, in order
+func (s *Service) readableSources(user *User, sources []string) ([]string, int) {
+	if user.Role == "admin" || len(sources) == 0 {
+		return sources, 0
+	}
+	readable := make([]string, 0, len(sources))
+	s.documents.View(func(tx DocumentTx) {
+		for _, filename := range sources {
+			if s.readable(tx, user, filename) {
+				readable = append(readable, filename)
+			}
+		}
+	})
+	return readable, len(sources) - len(readable)
+}
+
+// viewConversation builds a viewer's copy of a conversation, with the
+// sources they can't read, and answers drawn from them, left out
+func (s *Service) viewConversation(conversation Conversation, viewer *User, role string) ConversationView {
+	view := ConversationView{
+		ID:        conversation.ID,
+		Title:     conversation.Title,
+		OwnerID:   conversation.OwnerID,
+		Role:      role,
+		Turns:     make([]TurnView, 0, len(conversation.Turns)),
+		CreatedAt: conversation.CreatedAt,
+		UpdatedAt: conversation.UpdatedAt,
+	}
+	for _, turn := range conversation.Turns {
+		turnView := TurnView{ConversationTurn: turn}
+		turnView.Sources, turnView.HiddenSources = s.readableSources(viewer, turn.Sources)
+		if turnView.HiddenSources > 0 || turn.Unscoped && viewer.Role != "admin" {
+			turnView.Answer, turnView.AnswerWithheld = "", true
+		}
+		view.Turns = append(view.Turns, turnView)
+	}
+	if role == conversationOwner {
+		view.LinkRole = conversation.LinkRole
+		for userID, memberRole := range conversation.Members {
+			member := ConversationMember{UserID: userID, Role: memberRole}
+			if user := s.users.ByID(userID); user != nil {
+				member.Email = user.Email
+			}
+			view.Members = append(view.Members, member)
+		}
+		sort.Slice(view.Members, func(i, j int) bool { return view.Members[i].Email < view.Members[j].Email })
+	}
+	return view
+}
+
+// snapshotConversation copies a conversation so it can be viewed without
+// the lock; callers hold conversationMutex
+func snapshotConversation(conversation *Conversation) Conversation {
+	snapshot := *conversation
+	snapshot.Members = maps.Clone(conversation.Members)
+	snapshot.Turns = slices.Clone(conversation.Turns)
+	return snapshot
+}
+
+// CreateConversation starts an empty conversation
+func (s *Service) CreateConversation(owner *User, title string) (ConversationView, error) {
+	now := time.Now().UTC()
+	conversation := &Conversation{
+		ID:        uuid.New().String(),
+		Title:     title,
+		OwnerID:   owner.ID,
+		Turns:     []ConversationTurn{},
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	conversationMutex.Lock()
+	err := persistConversation(conversation)
+	if err == nil {
+		cacheConversation(conversation)
+	}
+	snapshot := snapshotConversation(conversation)
+	conversationMutex.Unlock()
+	if err != nil {
+		return ConversationView{}, err
+	}
+	return s.viewConversation(snapshot, owner, conversationOwner), nil
+}
+
+// Conversations lists the conversations a user owns or is a member of,
+// most recently updated first
+func (s *Service) Conversations(user *User) ([]ConversationSummary, error) {
+	list := []ConversationSummary{}
+	conversationMutex.Lock()
+	defer conversationMutex.Unlock()
+	if err := refreshConversations(); err != nil {
+		return nil, err
+	}
+	for _, conversation := range conversations {
+		role := conversation.roleIn(user)
+		if role == "" || (role == conversationViewer && conversation.Members[user.ID] == "") {
+			continue // admins see others' conversations only by ID
+		}
+		list = append(list, ConversationSummary{
+			ID:        conversation.ID,
+			Title:     conversation.Title,
+			OwnerID:   conversation.OwnerID,
+			Role:      role,
+			Turns:     len(conversation.Turns),
+			UpdatedAt: conversation.UpdatedAt,
+		})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].UpdatedAt.After(list[j].UpdatedAt) })
+	return list, nil
+}
+
+// Conversation returns a conversation as the user sees it
+func (s *Service) Conversation(id string, user *User) (ConversationView, error) {
+	conversationMutex.Lock()
+	conversation, role, err := conversationFor(id, user)
+	var snapshot Conversation
+	if err == nil {
+		snapshot = snapshotConversation(conversation)
+	}
+	conversationMutex.Unlock()
+	if err != nil {
+		return ConversationView{}, err
+	}
+	return s.viewConversation(snapshot, user, role), nil
+}
+
+// RenameConversation changes a conversation's title (owner)
+func (s *Service) RenameConversation(id string, owner *User, title string) (ConversationView, error) {
+	release, err := conversationLock(id)
+	if err != nil {
+		return ConversationView{}, err
+	}
+	defer release()
+	conversationMutex.Lock()
+	conversation, err := ownedConversation(id, owner)
+	var snapshot Conversation
+	if err == nil {
+		conversation.Title = title
+		conversation.UpdatedAt = time.Now().UTC()
+		err = persistConversation(conversation)
+		snapshot = snapshotConversation(conversation)
+	}
+	conversationMutex.Unlock()
+	if err != nil {
+		return ConversationView{}, err
+	}
+	return s.viewConversation(snapshot, owner, conversationOwner), nil
+}
+
+// DeleteConversation removes a conversation and its link (owner)
+func (s *Service) DeleteConversation(id string, owner *User) error {
+	release, err := conversationLock(id)
+	if err != nil {
+		return err
+	}
+	defer release()
+	conversationMutex.Lock()
+	defer conversationMutex.Unlock()
+	if _, err := ownedConversation(id, owner); err != nil {
+		return err
+	}
+	if err := removeConversation(id); err != nil {
+		return err
+	}
+	dropConversation(id)
+	return nil
+}
+
+// AddTurn appends a turn; the owner and collaborators may. Sources the
+// author can't read are dropped.
+func (s *Service) AddTurn(id string, author *User, req ConversationTurnRequest) (TurnView, error) {
+	sources, _ := s.readableSources(author, req.Sources)
+	turn := ConversationTurn{
+		ID:       uuid.New().String(),
+		AuthorID: author.ID,
+		Question: req.Question,
+		Answer:   req.Answer,
+		Sources:  sources,
+		Unscoped: req.Unscoped,
+		AskedAt:  time.Now().UTC(),
+	}
+	release, err := conversationLock(id)
+	if err != nil {
+		return TurnView{}, err
+	}
+	defer release()
+	conversationMutex.Lock()
+	defer conversationMutex.Unlock()
+	conversation, role, err := conversationFor(id, author)
+	switch {
+	case err != nil:
+		return TurnView{}, err
+	case role == conversationViewer:
+		return TurnView{}, errConversationReadOnly
+	case len(conversation.Turns) >= maxConversationTurns:
+		return TurnView{}, errConversationFull
+	}
+	conversation.Turns = append(conversation.Turns, turn)
+	conversation.UpdatedAt = turn.AskedAt
+	if err := persistConversation(conversation); err != nil {
+		return TurnView{}, err
+	}
+	return TurnView{ConversationTurn: turn}, nil
+}
+
+// CanAddTurn reports why a user can't add to a conversation, if they can't
+func (s *Service) CanAddTurn(id string, user *User) error {
+	conversationMutex.Lock()
+	defer conversationMutex.Unlock()
+	_, role, err := conversationFor(id, user)
+	if err == nil && role == conversationViewer {
+		err = errConversationReadOnly
+	}
+	return err
+}
+
+// ShareConversation makes a user a member with a role, or changes their
+// role (owner)
+func (s *Service) ShareConversation(id string, owner, member *User, role string) error {
+	release, err := conversationLock(id)
+	if err != nil {
+		return err
+	}
+	defer release()
+	conversationMutex.Lock()
+	defer conversationMutex.Unlock()
+	conversation, err := ownedConversation(id, owner)
+	if err != nil {
+		return err
+	}
+	return addMember(conversation, member.ID, role)
+}
+
+// addMember sets a member's role; callers hold conversationMutex
+func addMember(conversation *Conversation, userID, role string) error {
+	if userID == conversation.OwnerID {
+		return errMemberIsOwner
+	}
+	if conversation.Members[userID] == "" && len(conversation.Members) >= maxConversationMembers {
+		return errTooManyMembers
+	}
+	if conversation.Members == nil {
+		conversation.Members = make(map[string]string)
+	}
+	conversation.Members[userID] = role
+	conversation.UpdatedAt = time.Now().UTC()
+	return persistConversation(conversation)
+}
+
+// RemoveMember stops sharing a conversation with a member; the owner may
+// remove anyone and members may leave
+func (s *Service) RemoveMember(id string, actor *User, memberID string) error {
+	release, err := conversationLock(id)
+	if err != nil {
+		return err
+	}
+	defer release()
+	conversationMutex.Lock()
+	defer conversationMutex.Unlock()
+	conversation, role, err := conversationFor(id, actor)
+	if err != nil {
+		return err
+	}
+	if role != conversationOwner && actor.ID != memberID {
+		return errNotConversationOwner
+	}
+	if conversation.Members[memberID] == "" {
+		return errMemberNotFound
+	}
+	delete(conversation.Members, memberID)
+	conversation.UpdatedAt = time.Now().UTC()
+	return persistConversation(conversation)
+}
+
+// SetShareLink replaces a conversation's link and returns its token (owner)
+func (s *Service) SetShareLink(id string, owner *User, role string) (string, error) {
+	token, err := generatePassword()
+	if err != nil {
+		return "", err
+	}
+	release, err := conversationLock(id)
+	if err != nil {
+		return "", err
+	}
+	defer release()
+	conversationMutex.Lock()
+	defer conversationMutex.Unlock()
+	conversation, err := ownedConversation(id, owner)
+	if err != nil {
+		return "", err
+	}
+	delete(conversationLinks, conversation.LinkHash)
+	conversation.LinkHash, conversation.LinkRole = linkHash(token), role
+	conversationLinks[conversation.LinkHash] = conversation.ID
+	if err := persistConversation(conversation); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// DeleteShareLink stops a conversation's link working (owner)
+func (s *Service) DeleteShareLink(id string, owner *User) error {
+	release, err := conversationLock(id)
+	if err != nil {
+		return err
+	}
+	defer release()
+	conversationMutex.Lock()
+	defer conversationMutex.Unlock()
+	conversation, err := ownedConversation(id, owner)
+	if err != nil {
+		return err
+	}
+	if conversation.LinkHash == "" {
+		return errShareLinkNotFound
+	}
+	delete(conversationLinks, conversation.LinkHash)
+	conversation.LinkHash, conversation.LinkRole = "", ""
+	return persistConversation(conversation)
+}
+
+// linkedConversation returns the conversation a link opens; callers hold
+// conversationMutex
+func linkedConversation(token string) (*Conversation, error) {
+	if err := refreshConversations(); err != nil {
+		return nil, err
+	}
+	conversation, exists := conversations[conversationLinks[linkHash(token)]]
+	if !exists {
+		return nil, errShareLinkNotFound
+	}
+	return conversation, nil
+}
+
+// OpenShareLink shows the conversation a link opens; members keep their
+// role, anyone else views it read only
+func (s *Service) OpenShareLink(token string, user *User) (ConversationView, error) {
+	conversationMutex.Lock()
+	conversation, err := linkedConversation(token)
+	var snapshot Conversation
+	role := conversationViewer
+	if err == nil {
+		snapshot = snapshotConversation(conversation)
+		if member := conversation.roleIn(user); member != "" {
+			role = member
+		}
+	}
+	conversationMutex.Unlock()
+	if err != nil {
+		return ConversationView{}, err
+	}
+	return s.viewConversation(snapshot, user, role), nil
+}
+
+// JoinShareLink makes the user a member with the link's role; a member's
+// role is raised to it but never lowered
+func (s *Service) JoinShareLink(token string, user *User) (ConversationView, error) {
+	conversationMutex.Lock()
+	conversation, err := linkedConversation(token)
+	conversationMutex.Unlock()
+	if err != nil {
+		return ConversationView{}, err
+	}
+	release, err := conversationLock(conversation.ID)
+	if err != nil {
+		return ConversationView{}, err
+	}
+	defer release()
+
+	// The link may have changed while the lock was awaited
+	conversationMutex.Lock()
+	conversation, err = linkedConversation(token)
+	var snapshot Conversation
+	var role string
+	if err == nil {
+		role = conversation.roleIn(user)
+		if role == "" || (role == conversationViewer && conversation.LinkRole == conversationCollaborator) {
+			role = conversation.LinkRole
+			err = addMember(conversation, user.ID, role)
+		}
+		snapshot = snapshotConversation(conversation)
+	}
+	conversationMutex.Unlock()
+	if err != nil {
+		return ConversationView{}, err
+	}
+	return s.viewConversation(snapshot, user, role), nil
+}
+
+// ----------------------------------------------------------------------------
+// Handlers
+// ----------------------------------------------------------------------------
+
+// respondConversationError maps conversation errors to problems
+func respondConversationError(c *gin.Context, err error) {
+	switch err {
+	case errConversationNotFound, errMemberNotFound, errShareLinkNotFound, errGranteeAbsent:
+		respondError(c, http.StatusNotFound, codeNotFound, err.Error())
+	case errNotConversationOwner, errConversationReadOnly:
+		respondError(c, http.StatusForbidden, codeForbidden, err.Error())
+	case errConversationFull, errTooManyMembers:
+		respondError(c, http.StatusConflict, codeConflict, err.Error())
+	case errMemberIsOwner:
+		respondError(c, http.StatusBadRequest, codeInvalidRequest, err.Error())
+	default:
+		respondServiceError(c, err)
+	}
+}
+
+// createConversation starts a conversation
+func (s *Server) createConversation(c *gin.Context) {
+	var req ConversationRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondBindError(c, err)
+		return
+	}
+	view, err := s.svc.CreateConversation(c.MustGet("user").(*User), req.Title)
+	if err != nil {
+		respondConversationError(c, err)
+		return
+	}
+	c.JSON(http.StatusCreated, view)
+}
+
+// listConversations lists the current user's conversations and those shared
+// with them
+func (s *Server) listConversations(c *gin.Context) {
+	list, err := s.svc.Conversations(c.MustGet("user").(*User))
+	if err != nil {
+		respondConversationError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"conversations": list, "count": len(list)})
+}
+
+// getConversation shows a conversation the current user has a role in
+func (s *Server) getConversation(c *gin.Context) {
+	view, err := s.svc.Conversation(c.Param("id"), c.MustGet("user").(*User))
+	if err != nil {
+		respondConversationError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, view)
+}
+
+// renameConversation changes a conversation's title (owner)
+func (s *Server) renameConversation(c *gin.Context) {
+	var req ConversationRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondBindError(c, err)
+		return
+	}
+	view, err := s.svc.RenameConversation(c.Param("id"), c.MustGet("user").(*User), req.Title)
+	if err != nil {
+		respondConversationError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, view)
+}
+
+// deleteConversation removes a conversation (owner)
+func (s *Server) deleteConversation(c *gin.Context) {
+	id := c.Param("id")
+	if err := s.svc.DeleteConversation(id, c.MustGet("user").(*User)); err != nil {
+		respondConversationError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Conversation deleted", "id": id})
+}
+
+// addConversationTurn appends a question and answer (owner or
+// collaborator)
+func (s *Server) addConversationTurn(c *gin.Context) {
+	var req ConversationTurnRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondBindError(c, err)
+		return
+	}
+	turn, err := s.svc.AddTurn(c.Param("id"), c.MustGet("user").(*User), req)
+	if err != nil {
+		respondConversationError(c, err)
+		return
+	}
+	c.JSON(http.StatusCreated, turn)
+}
+
+// shareConversation shares a conversation with a member (owner)
+func (s *Server) shareConversation(c *gin.Context) {
+	var req ConversationMemberRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondBindError(c, err)
+		return
+	}
+	owner := c.MustGet("user").(*User)
+	id := c.Param("id")
+	member := s.svc.users.ByEmail(req.Email)
+	if member == nil || !s.svc.active(member) {
+		respondConversationError(c, errGranteeAbsent)
+		return
+	}
+	if err := s.svc.ShareConversation(id, owner, member, req.Role); err != nil {
+		respondConversationError(c, err)
+		return
+	}
+
+	shared := ConversationMember{UserID: member.ID, Email: member.Email, Role: req.Role}
+	auditChange(c, "conversation.share", "conversation:"+id, nil, shared)
+	notify(member.ID, NotificationConversationShared, "Conversation shared with you",
+		owner.Name+" shared a conversation with you as a "+req.Role+".",
+		map[string]string{"conversation_id": id, "role": req.Role})
+	c.JSON(http.StatusCreated, gin.H{"member": shared})
+}
+
+// removeConversationMember stops sharing a conversation with a member; a
+// member may remove themselves
+func (s *Server) removeConversationMember(c *gin.Context) {
+	id, memberID := c.Param("id"), c.Param("user_id")
+	if err := s.svc.RemoveMember(id, c.MustGet("user").(*User), memberID); err != nil {
+		respondConversationError(c, err)
+		return
+	}
+	auditChange(c, "conversation.unshare", "conversation:"+id, gin.H{"user_id": memberID}, nil)
+	c.JSON(http.StatusOK, gin.H{"message": "Member removed", "id": id, "user_id": memberID})
+}
+
+// setShareLink creates or replaces a conversation's link (owner)
+func (s *Server) setShareLink(c *gin.Context) {
+	var req ShareLinkRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondBindError(c, err)
+		return
+	}
+	id := c.Param("id")
+	token, err := s.svc.SetShareLink(id, c.MustGet("user").(*User), req.Role)
+	if err != nil {
+		respondConversationError(c, err)
+		return
+	}
+	auditChange(c, "conversation.link", "conversation:"+id, nil, gin.H{"role": req.Role})
+	c.JSON(http.StatusCreated, gin.H{
+		"token": token,
+		"role":  req.Role,
+		"url":   config.Mail.BaseURL + "/conversations/shared/" + token,
+	})
+}
+
+// deleteShareLink stops a conversation's link working (owner)
+func (s *Server) deleteShareLink(c *gin.Context) {
+	id := c.Param("id")
+	if err := s.svc.DeleteShareLink(id, c.MustGet("user").(*User)); err != nil {
+		respondConversationError(c, err)
+		return
+	}
+	auditChange(c, "conversation.link.revoke", "conversation:"+id, nil, nil)
+	c.JSON(http.StatusOK, gin.H{"message": "Share link deleted", "id": id})
+}
+
+// openShareLink shows the conversation a link opens
+func (s *Server) openShareLink(c *gin.Context) {
+	view, err := s.svc.OpenShareLink(c.Param("token"), c.MustGet("user").(*User))
+	if err != nil {
+		respondConversationError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, view)
+}
+
+// joinShareLink makes the current user a member of the conversation a link
+// opens
+func (s *Server) joinShareLink(c *gin.Context) {
+	view, err := s.svc.JoinShareLink(c.Param("token"), c.MustGet("user").(*User))
+	if err != nil {
+		respondConversationError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, view)
+}
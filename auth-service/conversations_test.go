@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// useConversationStore keeps conversations in a temporary directory
+func useConversationStore(t *testing.T) {
+	t.Helper()
+	savedStore := conversationStore
+	conversationStore = jobFiles{dir: t.TempDir()}
+	t.Cleanup(func() {
+		conversationMutex.Lock()
+		conversations, conversationLinks, conversationStore = make(map[string]*Conversation), make(map[string]string), savedStore
+		conversationMutex.Unlock()
+	})
+}
+
+func TestConversations(t *testing.T) {
+	ts := newTestServer(t)
+	useConversationStore(t)
+	owner, _ := ts.register("owner@example.com")
+	viewer, _ := ts.register("viewer@example.com")
+	teammate, teammateID := ts.register("teammate@example.com")
+	ts.do(http.MethodPost, "/v1/documents/register", owner, `{"filename":"handbook.pdf"}`)
+
+	var conversation ConversationView
+	decodeJSON(t, ts.do(http.MethodPost, "/v1/conversations", owner, `{"title":"Leave policy"}`), &conversation)
+	if conversation.Role != conversationOwner {
+		t.Fatalf("created: %+v", conversation)
+	}
+	path := "/v1/conversations/" + conversation.ID
+	if w := ts.do(http.MethodPost, path+"/turns", owner,
+		`{"question":"How much leave?","answer":"25 days","sources":["handbook.pdf","missing.pdf"]}`); w.Code != http.StatusCreated {
+		t.Fatalf("add turn: %d %s", w.Code, w.Body)
+	}
+	if w := ts.do(http.MethodGet, path, viewer, ""); w.Code != http.StatusNotFound {
+		t.Fatalf("unshared conversation: got %d, want 404", w.Code)
+	}
+
+	if w := ts.do(http.MethodPost, path+"/members", owner, `{"email":"viewer@example.com","role":"viewer"}`); w.Code != http.StatusCreated {
+		t.Fatalf("share: %d %s", w.Code, w.Body)
+	}
+	decodeJSON(t, ts.do(http.MethodGet, path, viewer, ""), &conversation)
+	if conversation.Role != conversationViewer || len(conversation.Turns) != 1 ||
+		len(conversation.Turns[0].Sources) != 0 || conversation.Turns[0].HiddenSources != 1 ||
+		conversation.Turns[0].Answer != "" || !conversation.Turns[0].AnswerWithheld || conversation.Members != nil {
+		t.Fatalf("viewer's view: %+v", conversation)
+	}
+	if w := ts.do(http.MethodPost, path+"/turns", viewer, `{"question":"Can I add?"}`); w.Code != http.StatusForbidden {
+		t.Fatalf("viewer adding a turn: got %d, want 403", w.Code)
+	}
+
+	// A grant on the cited document makes it visible in the conversation
+	until := time.Now().Add(24 * time.Hour).UTC().Format(time.RFC3339)
+	ts.do(http.MethodPost, "/v1/documents/handbook.pdf/grants", owner, `{"email":"viewer@example.com","expires_at":"`+until+`"}`)
+	var granted ConversationView
+	decodeJSON(t, ts.do(http.MethodGet, path, viewer, ""), &granted)
+	if turn := granted.Turns[0]; len(turn.Sources) != 1 || turn.Sources[0] != "handbook.pdf" || turn.HiddenSources != 0 || turn.Answer != "25 days" {
+		t.Fatalf("viewer's view with a grant: %+v", turn)
+	}
+
+	var link struct {
+		Token string `json:"token"`
+	}
+	decodeJSON(t, ts.do(http.MethodPut, path+"/link", owner, `{"role":"collaborator"}`), &link)
+	decodeJSON(t, ts.do(http.MethodGet, "/v1/conversations/shared/"+link.Token, teammate, ""), &conversation)
+	if conversation.Role != conversationViewer {
+		t.Fatalf("opening a link: role %q, want viewer", conversation.Role)
+	}
+	decodeJSON(t, ts.do(http.MethodPost, "/v1/conversations/shared/"+link.Token+"/join", teammate, ""), &conversation)
+	if conversation.Role != conversationCollaborator {
+		t.Fatalf("joining through a link: role %q, want collaborator", conversation.Role)
+	}
+	if w := ts.do(http.MethodPost, path+"/turns", teammate, `{"question":"And sick leave?","answer":"10 days"}`); w.Code != http.StatusCreated {
+		t.Fatalf("collaborator adding a turn: %d %s", w.Code, w.Body)
+	}
+
+	var list struct {
+		Conversations []ConversationSummary `json:"conversations"`
+	}
+	decodeJSON(t, ts.do(http.MethodGet, "/v1/conversations", teammate, ""), &list)
+	if len(list.Conversations) != 1 || list.Conversations[0].Turns != 2 {
+		t.Fatalf("teammate's conversations: %+v", list.Conversations)
+	}
+
+	// Replacing the link stops the old one working
+	old := link.Token
+	decodeJSON(t, ts.do(http.MethodPut, path+"/link", owner, `{"role":"viewer"}`), &link)
+	if w := ts.do(http.MethodGet, "/v1/conversations/shared/"+old, viewer, ""); w.Code != http.StatusNotFound {
+		t.Fatalf("replaced link: got %d, want 404", w.Code)
+	}
+
+	if w := ts.do(http.MethodDelete, path+"/members/"+teammateID, teammate, ""); w.Code != http.StatusOK {
+		t.Fatalf("leaving: %d %s", w.Code, w.Body)
+	}
+	if w := ts.do(http.MethodGet, path, teammate, ""); w.Code != http.StatusNotFound {
+		t.Fatalf("after leaving: got %d, want 404", w.Code)
+	}
+	if w := ts.do(http.MethodDelete, path, viewer, ""); w.Code != http.StatusForbidden {
+		t.Fatalf("viewer deleting: got %d, want 403", w.Code)
+	}
+
+	// Restarting reloads what was stored, links included
+	conversationMutex.Lock()
+	conversations, conversationLinks = make(map[string]*Conversation), make(map[string]string)
+	conversationMutex.Unlock()
+	if err := loadConversations(); err != nil {
+		t.Fatal(err)
+	}
+	decodeJSON(t, ts.do(http.MethodGet, "/v1/conversations/shared/"+link.Token, owner, ""), &conversation)
+	if len(conversation.Turns) != 2 || len(conversation.Members) != 1 || conversation.LinkRole != conversationViewer {
+		t.Fatalf("after reload: %+v", conversation)
+	}
+}
+
+func TestShareLinkTokenNotLogged(t *testing.T) {
+	var logged bytes.Buffer
+	saved := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&logged, nil)))
+	t.Cleanup(func() { slog.SetDefault(saved) })
+
+	r := gin.New()
+	r.Use(requestLogger())
+	r.GET("/v1/conversations/shared/:token", func(c *gin.Context) { c.Status(http.StatusNoContent) })
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/v1/conversations/shared/s3cr3t-link", nil))
+
+	if strings.Contains(logged.String(), "s3cr3t-link") || !strings.Contains(logged.String(), `"path":"/v1/conversations/shared/[REDACTED]"`) {
+		t.Fatalf("logged: %s", logged.String())
+	}
+}
+
+func TestChatTurnSources(t *testing.T) {
+	ts := newTestServer(t)
+	useConversationStore(t)
+	gateway := httptest.NewServer(ts.srv)
+	defer gateway.Close()
+	admin := ts.admin("admin@example.com")
+	owner, _ := ts.register("owner@example.com")
+	viewer, _ := ts.register("viewer@example.com")
+	ts.do(http.MethodPost, "/v1/documents/register", owner, `{"filename":"handbook.pdf"}`)
+
+	// ask puts one chat answer in a new conversation shared with the viewer
+	// and returns the turn as the viewer sees it
+	ask := func(token string, chunks ...string) TurnView {
+		t.Helper()
+		chatBackend(t, chunks...)
+		var conversation ConversationView
+		decodeJSON(t, ts.do(http.MethodPost, "/v1/conversations", token, `{"title":"Leave"}`), &conversation)
+		ts.do(http.MethodPost, "/v1/conversations/"+conversation.ID+"/members", token, `{"email":"viewer@example.com","role":"viewer"}`)
+		conn := dialChat(t, gateway, token)
+		conn.WriteJSON(ChatMessage{Type: "query", Question: "How much leave?", ConversationID: conversation.ID})
+		for msg := readChat(t, conn); msg.Type != "done"; msg = readChat(t, conn) {
+			if msg.Type == "error" {
+				t.Fatalf("query: %+v", msg)
+			}
+		}
+		decodeJSON(t, ts.do(http.MethodGet, "/v1/conversations/"+conversation.ID, viewer, ""), &conversation)
+		return conversation.Turns[0]
+	}
+
+	// An admin's answer from someone else's document is withheld, whether
+	// the backend names the document or names none
+	if turn := ask(admin, "25 days", "[SOURCES]handbook.pdf[/SOURCES]"); turn.Answer != "" || !turn.AnswerWithheld || turn.HiddenSources != 1 {
+		t.Fatalf("admin answer with sources: %+v", turn)
+	}
+	if turn := ask(admin, "25 days"); turn.Answer != "" || !turn.AnswerWithheld || !turn.Unscoped {
+		t.Fatalf("admin answer without sources: %+v", turn)
+	}
+
+	// Sources the viewer can read leave the answer visible
+	until := time.Now().Add(24 * time.Hour).UTC().Format(time.RFC3339)
+	ts.do(http.MethodPost, "/v1/documents/handbook.pdf/grants", owner, `{"email":"viewer@example.com","expires_at":"`+until+`"}`)
+	if turn := ask(admin, "25 days", "[SOURCES]handbook.pdf[/SOURCES]"); turn.Answer != "25 days" || len(turn.Sources) != 1 {
+		t.Fatalf("admin answer from a granted document: %+v", turn)
+	}
+}
+
+func TestConversationsShared(t *testing.T) {
+	useSharedStore(t)
+	ts := newTestServer(t)
+	useConversationStore(t)
+	owner, _ := ts.register("owner@example.com")
+	teammate, _ := ts.register("teammate@example.com")
+
+	// Another replica: nothing local but what the shared store holds
+	otherReplica := func() {
+		conversationMutex.Lock()
+		conversations, conversationLinks = make(map[string]*Conversation), make(map[string]string)
+		conversationMutex.Unlock()
+	}
+
+	var conversation ConversationView
+	decodeJSON(t, ts.do(http.MethodPost, "/v1/conversations", owner, `{"title":"Leave policy"}`), &conversation)
+	path := "/v1/conversations/" + conversation.ID
+	otherReplica()
+	if w := ts.do(http.MethodPost, path+"/turns", owner, `{"question":"How much leave?","answer":"25 days"}`); w.Code != http.StatusCreated {
+		t.Fatalf("add turn on another replica: %d %s", w.Code, w.Body)
+	}
+	var link struct {
+		Token string `json:"token"`
+	}
+	decodeJSON(t, ts.do(http.MethodPut, path+"/link", owner, `{"role":"collaborator"}`), &link)
+
+	otherReplica()
+	decodeJSON(t, ts.do(http.MethodPost, "/v1/conversations/shared/"+link.Token+"/join", teammate, ""), &conversation)
+	if conversation.Role != conversationCollaborator || len(conversation.Turns) != 1 {
+		t.Fatalf("joined on another replica: %+v", conversation)
+	}
+	otherReplica()
+	var list struct {
+		Conversations []ConversationSummary `json:"conversations"`
+	}
+	decodeJSON(t, ts.do(http.MethodGet, "/v1/conversations", teammate, ""), &list)
+	if len(list.Conversations) != 1 || list.Conversations[0].Role != conversationCollaborator {
+		t.Fatalf("teammate's conversations: %+v", list.Conversations)
+	}
+
+	// A deletion on one replica is seen by the others
+	if w := ts.do(http.MethodDelete, path, owner, ""); w.Code != http.StatusOK {
+		t.Fatalf("delete: %d %s", w.Code, w.Body)
+	}
+	conversationMutex.Lock()
+	conversations[conversation.ID] = &Conversation{ID: conversation.ID, OwnerID: "stale"}
+	conversationMutex.Unlock()
+	if w := ts.do(http.MethodGet, path, teammate, ""); w.Code != http.StatusNotFound {
+		t.Fatalf("deleted conversation: got %d, want 404", w.Code)
+	}
+	if entries, _ := os.ReadDir(conversationStore.dir); len(entries) != 0 {
+		t.Fatalf("clustered conversations written to files: %d", len(entries))
+	}
+}
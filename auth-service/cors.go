@@ -0,0 +1,139 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ============================================================================
+// CORS
+// ============================================================================
+//
+// Browser origins are checked against cors.allowed_origins. Entries are
+// exact origins ("https://app.example.com"), subdomain wildcards
+// ("https://*.example.com") or "*" for any origin. Credentials mode, needed
+// for cookie sessions, echoes the matched origin instead of "*". Entries in
+// cors.routes override the policy for paths under their prefix.
+
+const (
+	corsAllowMethods  = "GET, POST, PUT, DELETE, OPTIONS"
+	corsAllowHeaders  = "Content-Type, Authorization, API-Version, X-Request-ID, Idempotency-Key, If-Match, If-None-Match, X-CSRF-Token"
+	corsExposeHeaders = "ETag, X-Request-ID, API-Version, Deprecation, Link, Idempotent-Replayed, Retry-After, X-RateLimit-Limit, X-RateLimit-Remaining, X-RateLimit-Reset"
+)
+
+// corsPolicy is the effective policy for a path
+type corsPolicy struct {
+	origins     []string
+	credentials bool
+}
+
+// corsPolicyFor returns the policy of the longest matching route override,
+// or the global one
+func corsPolicyFor(path string) corsPolicy {
+	policy := corsPolicy{origins: config.CORS.AllowedOrigins, credentials: config.CORS.AllowCredentials}
+	longest := -1
+	for _, route := range config.CORS.Routes {
+		if strings.HasPrefix(path, route.PathPrefix) && len(route.PathPrefix) > longest {
+			policy = corsPolicy{origins: route.AllowedOrigins, credentials: route.AllowCredentials}
+			longest = len(route.PathPrefix)
+		}
+	}
+	return policy
+}
+
+// allows reports whether origin matches an allowlist entry
+func (p corsPolicy) allows(origin string) bool {
+	for _, allowed := range p.origins {
+		if corsOriginMatches(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// wildcard reports whether any origin is allowed without credentials
+func (p corsPolicy) wildcard() bool {
+	for _, allowed := range p.origins {
+		if allowed == "*" {
+			return !p.credentials
+		}
+	}
+	return false
+}
+
+func corsOriginMatches(pattern, origin string) bool {
+	if pattern == "*" || strings.EqualFold(pattern, origin) {
+		return true
+	}
+	// "https://*.example.com" matches any subdomain, but not the apex
+	scheme, host, ok := strings.Cut(pattern, "://*.")
+	if !ok {
+		return false
+	}
+	prefix := scheme + "://"
+	if !strings.HasPrefix(strings.ToLower(origin), strings.ToLower(prefix)) {
+		return false
+	}
+	rest := origin[len(prefix):]
+	return len(rest) > len(host)+1 && strings.HasSuffix(strings.ToLower(rest), "."+strings.ToLower(host))
+}
+
+// cors applies the configured policy and answers preflight requests
+func cors() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		origin := c.GetHeader("Origin")
+		preflight := c.Request.Method == http.MethodOptions
+		if origin == "" {
+			if preflight {
+				c.AbortWithStatus(http.StatusNoContent)
+				return
+			}
+			c.Next()
+			return
+		}
+
+		policy := corsPolicyFor(c.Request.URL.Path)
+		c.Header("Vary", "Origin")
+		if !policy.allows(origin) {
+			if preflight && c.GetHeader("Access-Control-Request-Method") != "" {
+				respondError(c, http.StatusForbidden, codeForbidden, "Origin not allowed")
+				c.Abort()
+				return
+			}
+			// Serve the request; the browser withholds the response
+			c.Next()
+			return
+		}
+
+		if policy.wildcard() {
+			c.Header("Access-Control-Allow-Origin", "*")
+		} else {
+			c.Header("Access-Control-Allow-Origin", origin)
+		}
+		if policy.credentials {
+			c.Header("Access-Control-Allow-Credentials", "true")
+		}
+		c.Header("Access-Control-Expose-Headers", corsExposeHeaders)
+
+		if preflight {
+			c.Header("Access-Control-Allow-Methods", corsAllowMethods)
+			c.Header("Access-Control-Allow-Headers", corsAllowHeaders)
+			if maxAge := int(config.CORS.MaxAge.Seconds()); maxAge > 0 {
+				c.Header("Access-Control-Max-Age", strconv.Itoa(maxAge))
+			}
+			c.AbortWithStatus(http.StatusNoContent)
+			return
+		}
+		c.Next()
+	}
+}
+
+// wsCheckOrigin applies the CORS allowlist to WebSocket upgrades, which
+// browsers don't preflight
+func wsCheckOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	return origin == "" || corsPolicyFor(r.URL.Path).allows(origin)
+}
@@ -0,0 +1,662 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"math"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ============================================================================
+// Cost Tracking
+// ============================================================================
+//
+// For internal chargeback every user's spending is charged to an org: in
+// org mode the org they belong to (orgs.go), and otherwise, or for accounts
+// outside any org, costs.default_org, which stands for the whole deployment.
+//
+// Two things are metered per org and calendar month (UTC):
+//
+//	tokens   the backend reports each answer's prompt and completion tokens
+//	         and the model that produced them to POST /internal/usage
+//	storage  every costSampleInterval the bytes of documents owned by each
+//	         org's members are added up, as byte-hours
+//
+// GET /admin/orgs/:id/costs, or GET /users/me/org/costs for the org's
+// managers, prices a month with costs.models (per 1000 tokens) and costs.storage_per_gb_month, as JSON or as CSV line items for
+// the finance system; models without a price count at zero and are listed
+// as unpriced. Prices apply when a report is made, so changing them reprices
+// past months too. The ledger covers costMonthsKept months and is kept in
+// costs.store_file. Usage reports land on any replica, so when clustered
+// each replica instead adds what it metered to the shared store every
+// costFlushInterval, one record per org and month, and reports add up the
+// shared totals; a ledger file left from before clustering is added once
+// and removed. Replicas take turns sampling storage, each charging the
+// hours since the last sample any of them took.
+
+const (
+	costSampleInterval = time.Hour
+	costFlushInterval  = time.Minute
+	costMonthsKept     = 24
+	costMonthLayout    = "2006-01"
+	bytesPerGB         = 1e9
+
+	// costUsageRecord keys an org's month in the shared store as month/org
+	costUsageRecord = "cost-usage"
+	// costSampleRecord holds when any replica last sampled storage
+	costSampleRecord = "cost-sample"
+)
+
+var (
+	errOrgNotFound  = errors.New("No usage recorded for this org in that month")
+	orgIDPattern    = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,63}$`)
+	errInvalidOrgID = errors.New("org_id must be lowercase letters, digits, - or _")
+)
+
+// ModelPrice is what a model costs per 1000 tokens
+type ModelPrice struct {
+	PromptPer1K     float64 `yaml:"prompt_per_1k" json:"prompt_per_1k"`
+	CompletionPer1K float64 `yaml:"completion_per_1k" json:"completion_per_1k"`
+}
+
+// ModelUsage counts one model's answers
+type ModelUsage struct {
+	Queries          int64 `json:"queries"`
+	PromptTokens     int64 `json:"prompt_tokens"`
+	CompletionTokens int64 `json:"completion_tokens"`
+}
+
+// OrgUsage is one org's metered use in one month
+type OrgUsage struct {
+	Models    map[string]*ModelUsage `json:"models"`
+	ByteHours float64                `json:"byte_hours"`
+}
+
+// UsageReport for POST /internal/usage
+type UsageReport struct {
+	UserID           string `json:"user_id" binding:"required"`
+	Model            string `json:"model" binding:"required,max=128"`
+	PromptTokens     int64  `json:"prompt_tokens" binding:"min=0"`
+	CompletionTokens int64  `json:"completion_tokens" binding:"min=0"`
+}
+
+// ModelCost is one line of a cost report
+type ModelCost struct {
+	Model string `json:"model"`
+	ModelUsage
+	Cost float64 `json:"cost"`
+}
+
+// StorageCost is a report's storage line
+type StorageCost struct {
+	GBMonths float64 `json:"gb_months"` // average GB stored over the month
+	Cost     float64 `json:"cost"`
+}
+
+// CostReport prices one org's month
+type CostReport struct {
+	Org            string      `json:"org"`
+	Month          string      `json:"month"`
+	Currency       string      `json:"currency"`
+	Models         []ModelCost `json:"models"`
+	Storage        StorageCost `json:"storage"`
+	Total          float64     `json:"total"`
+	UnpricedModels []string    `json:"unpriced_models,omitempty"`
+	GeneratedAt    time.Time   `json:"generated_at"`
+}
+
+// OrgSummary lists an org with its month's total
+type OrgSummary struct {
+	Org     string  `json:"org"`
+	Name    string  `json:"name,omitempty"` // empty for costs.default_org and deleted orgs
+	Members int     `json:"members"`
+	Total   float64 `json:"total"`
+}
+
+var (
+	costLedger     = make(map[string]map[string]*OrgUsage) // month -> org -> usage; when clustered, only what isn't flushed yet
+	costMutex      sync.Mutex
+	costDirty      bool
+	costFileLeft   bool      // clustered with a ledger file from before, removed once flushed
+	lastCostSample time.Time // standalone; clusters keep it in the shared store
+)
+
+// orgOf is the org a user's spending is charged to
+func orgOf(user *User) string {
+	if user.OrgID != "" && orgModeOn() {
+		return user.OrgID
+	}
+	return config.Costs.DefaultOrg
+}
+
+// startCostTracking loads the ledger and starts sampling storage and
+// writing the ledger back
+func startCostTracking(svc *Service) {
+	if err := loadCostLedger(); err != nil {
+		fatal("Failed to open cost ledger", "file", config.Costs.StoreFile, "error", err)
+	}
+	goBackground(func(ctx context.Context) {
+		svc.sampleStorage(time.Now())
+		sample := time.NewTicker(costSampleInterval)
+		flush := time.NewTicker(costFlushInterval)
+		defer sample.Stop()
+		defer flush.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				flushCostLedger()
+				return
+			case now := <-sample.C:
+				svc.sampleStorage(now)
+			case <-flush.C:
+			}
+			flushCostLedger()
+		}
+	})
+}
+
+// loadCostLedger reads costs.store_file. When clustered, what it holds
+// is flushed to the shared store like newly metered usage.
+func loadCostLedger() error {
+	data, err := os.ReadFile(config.Costs.StoreFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	costMutex.Lock()
+	defer costMutex.Unlock()
+	if err := json.Unmarshal(data, &costLedger); err != nil {
+		return err
+	}
+	if clustered() {
+		costDirty, costFileLeft = true, true
+	}
+	return nil
+}
+
+// flushCostLedger writes the ledger if it changed, dropping months past
+// costMonthsKept
+func flushCostLedger() {
+	if clustered() {
+		flushSharedCosts()
+		return
+	}
+	costMutex.Lock()
+	defer costMutex.Unlock()
+	if !costDirty {
+		return
+	}
+	oldest := time.Now().UTC().AddDate(0, -costMonthsKept, 0).Format(costMonthLayout)
+	for month := range costLedger {
+		if month < oldest {
+			delete(costLedger, month)
+		}
+	}
+	data, err := json.Marshal(costLedger)
+	if err == nil {
+		err = jobFiles{}.write(config.Costs.StoreFile, data)
+	}
+	if err != nil {
+		slog.Error("Cost ledger write failed", "file", config.Costs.StoreFile, "error", err)
+		return
+	}
+	costDirty = false
+}
+
+// flushSharedCosts adds what this replica metered since the last flush to
+// the shared store; what can't be added waits for the next flush
+func flushSharedCosts() {
+	costMutex.Lock()
+	pending := costLedger
+	costLedger, costDirty = make(map[string]map[string]*OrgUsage), false
+	costMutex.Unlock()
+
+	oldest := time.Now().UTC().AddDate(0, -costMonthsKept, 0).Format(costMonthLayout)
+	for month, orgs := range pending {
+		for org, usage := range orgs {
+			if month >= oldest {
+				if err := addSharedUsage(month, org, usage); err != nil {
+					continue
+				}
+			}
+			delete(orgs, org)
+		}
+		if len(orgs) == 0 {
+			delete(pending, month)
+		}
+	}
+
+	costMutex.Lock()
+	defer costMutex.Unlock()
+	for month, orgs := range pending {
+		for org, usage := range orgs {
+			orgUsage(month, org).add(usage)
+		}
+		costDirty = true
+	}
+	if costFileLeft && len(pending) == 0 {
+		if err := os.Remove(config.Costs.StoreFile); err != nil && !errors.Is(err, os.ErrNotExist) {
+			slog.Warn("Failed to remove flushed cost ledger", "file", config.Costs.StoreFile, "error", err)
+			return
+		}
+		costFileLeft = false
+	}
+}
+
+// addSharedUsage adds to an org's month in the shared store
+func addSharedUsage(month, org string, usage *OrgUsage) error {
+	id := month + "/" + org
+	ctx, cancel := context.WithTimeout(context.Background(), config.Cluster.LockTTL)
+	defer cancel()
+	release, err := acquireLock(ctx, costUsageRecord+":"+id, config.Cluster.LockTTL)
+	if err != nil {
+		slog.Error("Cost usage lock failed", "error", err)
+		return errStoreUnavailable
+	}
+	defer release()
+
+	store := keyedRecords()
+	total := &OrgUsage{Models: make(map[string]*ModelUsage)}
+	data, found, err := store.record(ctx, costUsageRecord, id)
+	if err == nil && found {
+		err = json.Unmarshal(data, total)
+	}
+	if err != nil {
+		slog.Error("Record store read failed", "op", "cost_usage", "error", err)
+		return errStoreUnavailable
+	}
+	total.add(usage)
+	if data, err = json.Marshal(total); err != nil {
+		return err
+	}
+	start, _ := time.Parse(costMonthLayout, month)
+	keep := time.Until(start.AddDate(0, costMonthsKept+1, 0))
+	if err := store.saveRecord(ctx, costUsageRecord, id, data, keep); err != nil {
+		slog.Error("Record store write failed", "op", "cost_usage", "error", err)
+		return errStoreUnavailable
+	}
+	return nil
+}
+
+// add counts another tally into this one
+func (u *OrgUsage) add(other *OrgUsage) {
+	if u.Models == nil {
+		u.Models = make(map[string]*ModelUsage)
+	}
+	for name, model := range other.Models {
+		counts := u.Models[name]
+		if counts == nil {
+			counts = &ModelUsage{}
+			u.Models[name] = counts
+		}
+		counts.Queries += model.Queries
+		counts.PromptTokens += model.PromptTokens
+		counts.CompletionTokens += model.CompletionTokens
+	}
+	u.ByteHours += other.ByteHours
+}
+
+// orgUsage returns an org's entry for a month, creating it; callers hold
+// costMutex
+func orgUsage(month, org string) *OrgUsage {
+	orgs := costLedger[month]
+	if orgs == nil {
+		orgs = make(map[string]*OrgUsage)
+		costLedger[month] = orgs
+	}
+	usage := orgs[org]
+	if usage == nil {
+		usage = &OrgUsage{Models: make(map[string]*ModelUsage)}
+		orgs[org] = usage
+	}
+	return usage
+}
+
+// recordTokens charges an answer's tokens to a user's org
+func recordTokens(user *User, report UsageReport, at time.Time) {
+	costMutex.Lock()
+	defer costMutex.Unlock()
+	usage := orgUsage(at.UTC().Format(costMonthLayout), orgOf(user))
+	model := usage.Models[report.Model]
+	if model == nil {
+		model = &ModelUsage{}
+		usage.Models[report.Model] = model
+	}
+	model.Queries++
+	model.PromptTokens += report.PromptTokens
+	model.CompletionTokens += report.CompletionTokens
+	costDirty = true
+}
+
+// sampleStorage charges each org for what its members stored since the
+// last sample. The first sample only starts the clock.
+func (s *Service) sampleStorage(now time.Time) {
+	owned := make(map[string]int64) // user ID -> bytes
+	s.documents.View(func(tx DocumentTx) {
+		tx.each(func(_ string, record documentRecord) {
+			owned[record.Owner] += record.Size
+		})
+	})
+	stored := make(map[string]int64) // org -> bytes
+	for userID, size := range owned {
+		org := config.Costs.DefaultOrg
+		if user := s.users.ByID(userID); user != nil {
+			org = orgOf(user)
+		}
+		stored[org] += size
+	}
+
+	since, err := advanceCostSample(now)
+	if err != nil || since.IsZero() || !now.After(since) {
+		return
+	}
+	costMutex.Lock()
+	defer costMutex.Unlock()
+	month := now.UTC().Format(costMonthLayout)
+	hours := now.Sub(since).Hours()
+	for org, size := range stored {
+		if size > 0 {
+			orgUsage(month, org).ByteHours += float64(size) * hours
+			costDirty = true
+		}
+	}
+}
+
+// advanceCostSample records a storage sample and returns when the one
+// before it was taken, on any replica when clustered
+func advanceCostSample(now time.Time) (time.Time, error) {
+	if !clustered() {
+		costMutex.Lock()
+		defer costMutex.Unlock()
+		since := lastCostSample
+		lastCostSample = now
+		return since, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), config.Cluster.LockTTL)
+	defer cancel()
+	release, err := acquireLock(ctx, costSampleRecord, config.Cluster.LockTTL)
+	if err != nil {
+		slog.Error("Cost sample lock failed", "error", err)
+		return time.Time{}, errStoreUnavailable
+	}
+	defer release()
+	store := keyedRecords()
+	var since time.Time
+	data, found, err := store.record(ctx, costSampleRecord, "last")
+	if err == nil && found {
+		err = since.UnmarshalText(data)
+	}
+	if err != nil {
+		slog.Error("Record store read failed", "op", "cost_sample", "error", err)
+		return time.Time{}, errStoreUnavailable
+	}
+	if !now.After(since) {
+		return since, nil
+	}
+	data, _ = now.MarshalText()
+	if err := store.saveRecord(ctx, costSampleRecord, "last", data, 0); err != nil {
+		slog.Error("Record store write failed", "op", "cost_sample", "error", err)
+		return time.Time{}, errStoreUnavailable
+	}
+	return since, nil
+}
+
+// roundCost keeps costs to a hundredth of a cent
+func roundCost(cost float64) float64 {
+	return math.Round(cost*1e4) / 1e4
+}
+
+// hoursIn is the length of a month
+func hoursIn(month time.Time) float64 {
+	return month.AddDate(0, 1, 0).Sub(month).Hours()
+}
+
+// priceUsage turns an org's metered month into a report
+func priceUsage(org string, month time.Time, usage OrgUsage) CostReport {
+	report := CostReport{
+		Org:         org,
+		Month:       month.Format(costMonthLayout),
+		Currency:    config.Costs.Currency,
+		Models:      []ModelCost{},
+		GeneratedAt: time.Now().UTC(),
+	}
+	for name, model := range usage.Models {
+		line := ModelCost{Model: name, ModelUsage: *model}
+		price, priced := config.Costs.Models[name]
+		if !priced {
+			report.UnpricedModels = append(report.UnpricedModels, name)
+		}
+		line.Cost = roundCost(float64(model.PromptTokens)/1000*price.PromptPer1K +
+			float64(model.CompletionTokens)/1000*price.CompletionPer1K)
+		report.Models = append(report.Models, line)
+		report.Total += line.Cost
+	}
+	sort.Slice(report.Models, func(i, j int) bool { return report.Models[i].Model < report.Models[j].Model })
+	sort.Strings(report.UnpricedModels)
+
+	report.Storage.GBMonths = usage.ByteHours / bytesPerGB / hoursIn(month)
+	report.Storage.Cost = roundCost(report.Storage.GBMonths * config.Costs.StoragePerGBMonth)
+	report.Storage.GBMonths = math.Round(report.Storage.GBMonths*1e6) / 1e6
+	report.Total = roundCost(report.Total + report.Storage.Cost)
+	return report
+}
+
+// monthUsage copies each org's metered month; when clustered it adds the
+// shared totals to what this replica hasn't flushed yet
+func monthUsage(month string) (map[string]*OrgUsage, error) {
+	usage := make(map[string]*OrgUsage)
+	tally := func(org string, counted *OrgUsage) {
+		total := usage[org]
+		if total == nil {
+			total = &OrgUsage{Models: make(map[string]*ModelUsage)}
+			usage[org] = total
+		}
+		total.add(counted)
+	}
+	costMutex.Lock()
+	for org, counted := range costLedger[month] {
+		tally(org, counted)
+	}
+	costMutex.Unlock()
+	if !clustered() {
+		return usage, nil
+	}
+
+	stored, err := keyedRecords().records(context.Background(), costUsageRecord)
+	if err != nil {
+		slog.Error("Record store read failed", "op", "cost_usage", "error", err)
+		return nil, errStoreUnavailable
+	}
+	for id, data := range stored {
+		recorded, org, _ := strings.Cut(id, "/")
+		if recorded != month {
+			continue
+		}
+		var counted OrgUsage
+		if err := json.Unmarshal(data, &counted); err != nil {
+			slog.Warn("Skipping unreadable cost usage", "id", id, "error", err)
+			continue
+		}
+		tally(org, &counted)
+	}
+	return usage, nil
+}
+
+// CostReport prices an org's month; an org that is configured as the
+// default or has members gets an empty report rather than an error
+func (s *Service) CostReport(org string, month time.Time) (CostReport, error) {
+	usage, err := monthUsage(month.Format(costMonthLayout))
+	if err != nil {
+		return CostReport{}, err
+	}
+	counted, exists := usage[org]
+	if !exists {
+		if org != config.Costs.DefaultOrg && s.orgMembers()[org] == 0 {
+			return CostReport{}, errOrgNotFound
+		}
+		counted = &OrgUsage{Models: map[string]*ModelUsage{}}
+	}
+	return priceUsage(org, month, *counted), nil
+}
+
+// orgMembers counts each org's users
+func (s *Service) orgMembers() map[string]int {
+	members := make(map[string]int)
+	s.users.Each(func(user *User) {
+		members[orgOf(user)]++
+	})
+	return members
+}
+
+// Orgs lists the orgs, and any others with members or usage in a month,
+// costliest first
+func (s *Service) Orgs(month time.Time) ([]OrgSummary, error) {
+	usage, err := monthUsage(month.Format(costMonthLayout))
+	if err != nil {
+		return nil, err
+	}
+	members := s.orgMembers()
+	names := make(map[string]string)
+	if orgModeOn() {
+		orgMutex.RLock()
+		for id, org := range orgs {
+			names[id] = org.Name
+			if _, listed := members[id]; !listed {
+				members[id] = 0
+			}
+		}
+		orgMutex.RUnlock()
+	}
+	for org := range usage {
+		if _, listed := members[org]; !listed {
+			members[org] = 0
+		}
+	}
+
+	list := make([]OrgSummary, 0, len(members))
+	for org, count := range members {
+		counted := usage[org]
+		if counted == nil {
+			counted = &OrgUsage{}
+		}
+		list = append(list, OrgSummary{Org: org, Name: names[org], Members: count, Total: priceUsage(org, month, *counted).Total})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Total != list[j].Total {
+			return list[i].Total > list[j].Total
+		}
+		return list[i].Org < list[j].Org
+	})
+	return list, nil
+}
+
+// ----------------------------------------------------------------------------
+
+// costMonth reads ?month=YYYY-MM, the current month by default; it answers
+// 400 and returns false if the value isn't a month
+func costMonth(c *gin.Context) (time.Time, bool) {
+	now := time.Now().UTC()
+	month := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	if raw := c.Query("month"); raw != "" {
+		parsed, err := time.Parse(costMonthLayout, raw)
+		if err != nil {
+			respondError(c, http.StatusBadRequest, codeInvalidRequest, "month must be YYYY-MM")
+			return time.Time{}, false
+		}
+		month = parsed
+	}
+	return month, true
+}
+
+// listOrgs lists orgs with their month's totals (admin)
+func (s *Server) listOrgs(c *gin.Context) {
+	month, ok := costMonth(c)
+	if !ok {
+		return
+	}
+	list, err := s.svc.Orgs(month)
+	if err != nil {
+		respondServiceError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"month": month.Format(costMonthLayout), "currency": config.Costs.Currency, "orgs": list, "count": len(list)})
+}
+
+var costCSVHeader = []string{"org", "month", "item", "queries", "prompt_tokens", "completion_tokens", "gb_months", "cost", "currency"}
+
+// getOrgCosts prices an org's month as JSON or CSV (admin)
+func (s *Server) getOrgCosts(c *gin.Context) {
+	s.respondOrgCosts(c, c.Param("id"))
+}
+
+// respondOrgCosts writes an org's report for ?month= as ?format=
+func (s *Server) respondOrgCosts(c *gin.Context, org string) {
+	month, ok := costMonth(c)
+	if !ok {
+		return
+	}
+	report, err := s.svc.CostReport(org, month)
+	if err == errOrgNotFound {
+		respondError(c, http.StatusNotFound, codeNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		respondServiceError(c, err)
+		return
+	}
+
+	switch c.DefaultQuery("format", "json") {
+	case "json":
+		c.JSON(http.StatusOK, report)
+	case "csv":
+		c.Header("Content-Disposition", `attachment; filename="costs-`+report.Org+`-`+report.Month+`.csv"`)
+		c.Header("Content-Type", "text/csv; charset=utf-8")
+		c.Status(http.StatusOK)
+
+		w := csv.NewWriter(c.Writer)
+		w.Write(costCSVHeader)
+		for _, line := range report.Models {
+			w.Write(csvSafeRow([]string{report.Org, report.Month, "model:" + line.Model,
+				strconv.FormatInt(line.Queries, 10), strconv.FormatInt(line.PromptTokens, 10),
+				strconv.FormatInt(line.CompletionTokens, 10), "", strconv.FormatFloat(line.Cost, 'f', 4, 64), report.Currency}))
+		}
+		w.Write(csvSafeRow([]string{report.Org, report.Month, "storage", "", "", "",
+			strconv.FormatFloat(report.Storage.GBMonths, 'f', 6, 64), strconv.FormatFloat(report.Storage.Cost, 'f', 4, 64), report.Currency}))
+		w.Write(csvSafeRow([]string{report.Org, report.Month, "total", "", "", "", "",
+			strconv.FormatFloat(report.Total, 'f', 4, 64), report.Currency}))
+		w.Flush()
+	default:
+		respondError(c, http.StatusBadRequest, codeInvalidRequest, "format must be json or csv")
+	}
+}
+
+// recordUsage takes the backend's token count for an answer
+func (s *Server) recordUsage(c *gin.Context) {
+	var report UsageReport
+	if err := c.ShouldBindJSON(&report); err != nil {
+		respondBindError(c, err)
+		return
+	}
+	user := s.svc.users.ByID(report.UserID)
+	if user == nil {
+		respondError(c, http.StatusNotFound, codeNotFound, "User not found")
+		return
+	}
+	recordTokens(user, report, time.Now())
+	c.JSON(http.StatusOK, gin.H{"org": orgOf(user)})
+}
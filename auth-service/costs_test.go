@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/csv"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestOrgCosts(t *testing.T) {
+	ts := newTestServer(t)
+	withConfig(t, func(cfg *Config) {
+		cfg.Auth.InternalAPIToken = testInternalToken
+		cfg.Costs.StoragePerGBMonth = 0.5
+		cfg.Costs.Models = map[string]ModelPrice{"gpt-test": {PromptPer1K: 0.01, CompletionPer1K: 0.03}}
+	})
+	useOrgs(t)
+	t.Cleanup(func() {
+		costMutex.Lock()
+		costLedger, lastCostSample, costDirty = make(map[string]map[string]*OrgUsage), time.Time{}, false
+		costMutex.Unlock()
+	})
+	admin := ts.admin("admin@example.com")
+	user, userID := ts.register("user@example.com")
+	_, otherID := ts.register("other@example.com")
+
+	if w := ts.do(http.MethodPost, "/v1/admin/orgs", admin, `{"id":"research","name":"Research"}`); w.Code != http.StatusCreated {
+		t.Fatalf("create org: %d %s", w.Code, w.Body)
+	}
+	if w := ts.do(http.MethodPatch, "/v1/admin/users/"+userID, admin, `{"org_id":"marketing"}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("unknown org: got %d, want 400", w.Code)
+	}
+	var updated struct {
+		User UserProfile `json:"user"`
+	}
+	decodeJSON(t, ts.do(http.MethodPatch, "/v1/admin/users/"+userID, admin, `{"org_id":"research"}`), &updated)
+	if updated.User.OrgID != "research" {
+		t.Fatalf("updated: %+v", updated.User)
+	}
+
+	report := func(userID, model string, prompt, completion int) {
+		t.Helper()
+		body := `{"user_id":"` + userID + `","model":"` + model + `","prompt_tokens":` +
+			strconv.Itoa(prompt) + `,"completion_tokens":` + strconv.Itoa(completion) + `}`
+		if w := ts.do(http.MethodPost, "/v1/internal/usage", "", body, internalTokenHeader, testInternalToken); w.Code != http.StatusOK {
+			t.Fatalf("report usage: %d %s", w.Code, w.Body)
+		}
+	}
+	report(userID, "gpt-test", 1500, 600)
+	report(userID, "gpt-test", 500, 400)
+	report(userID, "local-llm", 800, 200)
+	report(otherID, "gpt-test", 1000, 1000)
+
+	// 2 GB kept for ten days
+	ts.do(http.MethodPost, "/v1/documents/register", user, `{"filename":"handbook.pdf"}`)
+	ts.srv.svc.documents.Update(func(tx DocumentTx) error {
+		tx.setSize("handbook.pdf", 2e9)
+		return nil
+	})
+	now := time.Now().UTC()
+	month := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	ts.srv.svc.sampleStorage(month)
+	ts.srv.svc.sampleStorage(month.Add(240 * time.Hour))
+
+	var costs CostReport
+	decodeJSON(t, ts.do(http.MethodGet, "/v1/admin/orgs/research/costs", admin, ""), &costs)
+	gbMonths := 2 * 240 / hoursIn(month)
+	if len(costs.Models) != 2 || costs.Models[0].Model != "gpt-test" || costs.Models[0].Queries != 2 ||
+		costs.Models[0].Cost != 0.05 || costs.Models[1].Cost != 0 || len(costs.UnpricedModels) != 1 {
+		t.Fatalf("models: %+v", costs)
+	}
+	if math.Abs(costs.Storage.GBMonths-gbMonths) > 1e-6 || costs.Storage.Cost != roundCost(gbMonths*0.5) ||
+		costs.Total != roundCost(0.05+costs.Storage.Cost) || costs.Currency != "USD" {
+		t.Fatalf("storage and total: %+v", costs)
+	}
+
+	var orgs struct {
+		Orgs []OrgSummary `json:"orgs"`
+	}
+	decodeJSON(t, ts.do(http.MethodGet, "/v1/admin/orgs", admin, ""), &orgs)
+	if len(orgs.Orgs) != 2 || orgs.Orgs[0].Org != "research" || orgs.Orgs[0].Name != "Research" ||
+		orgs.Orgs[1].Org != "default" || orgs.Orgs[1].Total != 0.04 {
+		t.Fatalf("orgs: %+v", orgs.Orgs)
+	}
+
+	w := ts.do(http.MethodGet, "/v1/admin/orgs/research/costs?format=csv", admin, "")
+	rows, err := csv.NewReader(w.Body).ReadAll()
+	if err != nil || w.Code != http.StatusOK {
+		t.Fatalf("csv: %d %v", w.Code, err)
+	}
+	if len(rows) != 5 || rows[0][0] != "org" || rows[1][2] != "model:gpt-test" || rows[3][2] != "storage" || rows[4][2] != "total" {
+		t.Fatalf("csv rows: %v", rows)
+	}
+
+	if w := ts.do(http.MethodGet, "/v1/admin/orgs/marketing/costs", admin, ""); w.Code != http.StatusNotFound {
+		t.Fatalf("unknown org: got %d, want 404", w.Code)
+	}
+	if w := ts.do(http.MethodGet, "/v1/admin/orgs/research/costs?month=March", admin, ""); w.Code != http.StatusBadRequest {
+		t.Fatalf("bad month: got %d, want 400", w.Code)
+	}
+	decodeJSON(t, ts.do(http.MethodGet, "/v1/admin/orgs/research/costs?month=2020-01", admin, ""), &costs)
+	if costs.Total != 0 || len(costs.Models) != 0 {
+		t.Fatalf("a month without usage: %+v", costs)
+	}
+	if w := ts.do(http.MethodGet, "/v1/admin/orgs", user, ""); w.Code != http.StatusForbidden {
+		t.Fatalf("non-admin: got %d, want 403", w.Code)
+	}
+}
+
+func TestCostsAcrossReplicas(t *testing.T) {
+	ts := newTestServer(t)
+	withConfig(t, func(cfg *Config) {
+		cfg.Auth.InternalAPIToken = testInternalToken
+		cfg.Costs.StoreFile = filepath.Join(t.TempDir(), "cost-ledger.json")
+	})
+	reset := func() {
+		costMutex.Lock()
+		costLedger, lastCostSample, costDirty, costFileLeft = make(map[string]map[string]*OrgUsage), time.Time{}, false, false
+		costMutex.Unlock()
+	}
+	t.Cleanup(reset)
+	admin := ts.admin("admin@example.com")
+	user, userID := ts.register("user@example.com")
+	month := time.Now().UTC().Format(costMonthLayout)
+
+	// A replica's ledger from before clustering is added to the shared
+	// store once
+	before := `{"` + month + `":{"default":{"models":{"gpt-test":{"queries":1,"prompt_tokens":100,"completion_tokens":0}}}}}`
+	if err := os.WriteFile(config.Costs.StoreFile, []byte(before), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	useSharedStore(t)
+	reset()
+	if err := loadCostLedger(); err != nil {
+		t.Fatal(err)
+	}
+	flushCostLedger()
+	if _, err := os.Stat(config.Costs.StoreFile); !os.IsNotExist(err) {
+		t.Fatalf("flushed ledger file kept: %v", err)
+	}
+
+	report := func() {
+		t.Helper()
+		body := `{"user_id":"` + userID + `","model":"gpt-test","prompt_tokens":10}`
+		if w := ts.do(http.MethodPost, "/v1/internal/usage", "", body, internalTokenHeader, testInternalToken); w.Code != http.StatusOK {
+			t.Fatalf("report usage: %d %s", w.Code, w.Body)
+		}
+	}
+	report()
+	flushCostLedger()
+
+	// Another replica sees the flushed totals along with its own usage
+	// that isn't flushed yet
+	reset()
+	report()
+	var costs CostReport
+	decodeJSON(t, ts.do(http.MethodGet, "/v1/admin/orgs/default/costs", admin, ""), &costs)
+	if len(costs.Models) != 1 || costs.Models[0].Queries != 3 || costs.Models[0].PromptTokens != 120 {
+		t.Fatalf("costs across replicas: %+v", costs)
+	}
+
+	// Replicas take turns sampling storage: each charges only the hours
+	// since the last sample any of them took
+	ts.do(http.MethodPost, "/v1/documents/register", user, `{"filename":"handbook.pdf"}`)
+	ts.srv.svc.documents.Update(func(tx DocumentTx) error {
+		tx.setSize("handbook.pdf", 1e9)
+		return nil
+	})
+	now := time.Now().UTC()
+	start := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	ts.srv.svc.sampleStorage(start)
+	flushCostLedger()
+	reset()
+	ts.srv.svc.sampleStorage(start.Add(time.Hour))
+	flushCostLedger()
+	reset()
+	ts.srv.svc.sampleStorage(start.Add(time.Hour))
+	ts.srv.svc.sampleStorage(start.Add(2 * time.Hour))
+	flushCostLedger()
+	usage, err := monthUsage(month)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if byteHours := usage["default"].ByteHours; byteHours != 2e9 {
+		t.Fatalf("byte-hours: got %v, want 2e9", byteHours)
+	}
+}
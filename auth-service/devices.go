@@ -0,0 +1,345 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// ============================================================================
+// Devices
+// ============================================================================
+//
+// Each sign-in is tied to a device record on the user: the fingerprint the
+// anomaly checks already compute (anomaly.go), a platform and browser read
+// from the User-Agent, and when the device was first and last seen. The
+// token a sign-in returns carries the device's ID, so removing a device
+// through DELETE /users/me/devices/:id signs out every session on it,
+// remembered ones included; a later sign-in from the same browser starts
+// a new device.
+//
+// Devices are stored with the user, so they persist and replicate wherever
+// users do. Last seen is the last sign-in, or token use at most every
+// deviceSeenInterval so busy clients don't write on each request.
+//
+// The service has no second factor; the closest is the anomaly step-up,
+// which holds unusual sign-ins for review. A device the user marks trusted
+// skips that hold for deviceTrustPeriod. Its sign-ins are still checked
+// and alerted on.
+
+const (
+	maxDevicesPerUser  = 50
+	deviceTrustPeriod  = 30 * 24 * time.Hour
+	deviceSeenInterval = 5 * time.Minute
+)
+
+var errDeviceNotFound = errors.New("Device not found")
+
+// Device is one browser or app a user has signed in from
+type Device struct {
+	ID           string     `json:"id" bson:"id"`
+	Fingerprint  string     `json:"fingerprint" bson:"fingerprint"`
+	Name         string     `json:"name" bson:"name"`
+	Platform     string     `json:"platform" bson:"platform"`
+	UserAgent    string     `json:"user_agent,omitempty" bson:"user_agent,omitempty"`
+	LastIP       string     `json:"last_ip,omitempty" bson:"last_ip,omitempty"`
+	FirstSeenAt  time.Time  `json:"first_seen_at" bson:"first_seen_at"`
+	LastSeenAt   time.Time  `json:"last_seen_at" bson:"last_seen_at"`
+	TrustedUntil *time.Time `json:"trusted_until,omitempty" bson:"trusted_until,omitempty"`
+
+	// The remembered session, if any (remember.go)
+	AuthenticatedAt time.Time  `json:"authenticated_at" bson:"authenticated_at"` // last password or code sign-in
+	RememberedUntil *time.Time `json:"remembered_until,omitempty" bson:"remembered_until,omitempty"`
+	RefreshHash     string     `json:"refresh_hash,omitempty" bson:"refresh_hash,omitempty"` // never shown to users; see view
+}
+
+// DeviceView is a device as listed to its user
+type DeviceView struct {
+	Device
+	Trusted bool `json:"trusted"`
+	Current bool `json:"current"` // the device making the request
+}
+
+// UpdateDeviceRequest renames a device or changes its trust
+type UpdateDeviceRequest struct {
+	Name    *string `json:"name" binding:"omitempty,min=1,max=100"`
+	Trusted *bool   `json:"trusted"`
+}
+
+// trusted reports whether the device is trusted at now
+func (d Device) trusted(now time.Time) bool {
+	return d.TrustedUntil != nil && now.Before(*d.TrustedUntil)
+}
+
+// view is the device as its user sees it from the device with fingerprint
+func (d Device) view(now time.Time, fingerprint string) DeviceView {
+	d.RefreshHash = ""
+	return DeviceView{Device: d, Trusted: d.trusted(now), Current: d.Fingerprint == fingerprint}
+}
+
+// devicePlatform names the operating system in a User-Agent
+func devicePlatform(userAgent string) string {
+	ua := strings.ToLower(userAgent)
+	switch {
+	case strings.Contains(ua, "iphone"), strings.Contains(ua, "ipad"):
+		return "iOS"
+	case strings.Contains(ua, "android"):
+		return "Android"
+	case strings.Contains(ua, "cros"):
+		return "ChromeOS"
+	case strings.Contains(ua, "windows"):
+		return "Windows"
+	case strings.Contains(ua, "mac os"), strings.Contains(ua, "macintosh"):
+		return "macOS"
+	case strings.Contains(ua, "linux"):
+		return "Linux"
+	}
+	return "Unknown"
+}
+
+// deviceName is the default name, e.g. "Firefox on Linux"
+func deviceName(userAgent string) string {
+	ua := strings.ToLower(userAgent)
+	browser := "Browser"
+	switch {
+	case strings.Contains(ua, "edg/"):
+		browser = "Edge"
+	case strings.Contains(ua, "firefox/"):
+		browser = "Firefox"
+	case strings.Contains(ua, "chrome/"), strings.Contains(ua, "crios/"):
+		browser = "Chrome"
+	case strings.Contains(ua, "safari/"):
+		browser = "Safari"
+	case userAgent != "" && !strings.Contains(ua, "mozilla/"):
+		browser = "App" // API clients and SDKs
+	}
+	return browser + " on " + devicePlatform(userAgent)
+}
+
+// deviceTrusted reports whether the user trusts the device a sign-in comes
+// from
+func (s *Service) deviceTrusted(user *User, fingerprint string) bool {
+	lock := s.users.FieldLock(user)
+	lock.RLock()
+	defer lock.RUnlock()
+	now := time.Now()
+	for _, device := range user.Devices {
+		if device.Fingerprint == fingerprint && device.trusted(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// SeeDevice records a sign-in on the user's device for its fingerprint,
+// adding the device if it is new, and returns the device's ID and, with
+// rememberMe, a refresh token (remember.go)
+func (s *Service) SeeDevice(user *User, record LoginRecord, rememberMe bool) (string, string, error) {
+	lock := s.users.FieldLock(user)
+	lock.Lock()
+	defer lock.Unlock()
+
+	previous := user.Devices
+	devices := slices.Clone(previous)
+	i := slices.IndexFunc(devices, func(d Device) bool { return d.Fingerprint == record.Device })
+	if i < 0 {
+		if len(devices) >= maxDevicesPerUser {
+			// Make room by forgetting the device seen longest ago
+			oldest := 0
+			for j := range devices {
+				if devices[j].LastSeenAt.Before(devices[oldest].LastSeenAt) {
+					oldest = j
+				}
+			}
+			devices = slices.Delete(devices, oldest, oldest+1)
+		}
+		devices = append(devices, Device{
+			ID:          uuid.New().String(),
+			Fingerprint: record.Device,
+			Name:        deviceName(record.UserAgent),
+			Platform:    devicePlatform(record.UserAgent),
+			FirstSeenAt: record.At,
+		})
+		i = len(devices) - 1
+	}
+	devices[i].UserAgent, devices[i].LastIP, devices[i].LastSeenAt = record.UserAgent, record.IP, record.At
+	devices[i].AuthenticatedAt = record.At
+	refresh, err := remember(&devices[i], user.ID, rememberMe, record.At)
+	if err != nil {
+		return "", "", err
+	}
+
+	user.Devices = devices
+	if err := saveUser(user); err != nil {
+		user.Devices = previous
+		return "", "", err
+	}
+	return devices[i].ID, refresh, nil
+}
+
+// deviceSession records a sign-in that passed its checks on the device it
+// came from and returns the session token, bound to that device, and the
+// refresh token if the user asked to be remembered. The session token
+// replaces the unbound one the sign-in method issued.
+func (s *Service) deviceSession(user *User, record LoginRecord, rememberMe bool) (string, string, error) {
+	deviceID, refresh, err := s.SeeDevice(user, record, rememberMe)
+	if err != nil {
+		return "", "", err
+	}
+	token, err := s.issueDeviceToken(user, time.Now().Add(config.Session.Lifetime), "", deviceID)
+	if err != nil {
+		return "", "", errTokenGeneration
+	}
+	return token, refresh, nil
+}
+
+// touchDevice moves a device's last seen forward when a token bound to it
+// is used, at most every deviceSeenInterval
+func (s *Service) touchDevice(user *User, deviceID string) {
+	if deviceID == "" {
+		return
+	}
+	now := time.Now().UTC()
+	lock := s.users.FieldLock(user)
+	lock.RLock()
+	i := slices.IndexFunc(user.Devices, func(d Device) bool { return d.ID == deviceID })
+	stale := i >= 0 && now.Sub(user.Devices[i].LastSeenAt) >= deviceSeenInterval
+	lock.RUnlock()
+	if !stale {
+		return
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	previous := user.Devices
+	devices := slices.Clone(previous)
+	if i = slices.IndexFunc(devices, func(d Device) bool { return d.ID == deviceID }); i < 0 {
+		return
+	}
+	devices[i].LastSeenAt = now
+	user.Devices = devices
+	if saveUser(user) != nil {
+		user.Devices = previous // seen again on the next request
+	}
+}
+
+// UpdateDevice renames a device or sets its trust
+func (s *Service) UpdateDevice(user *User, deviceID string, req UpdateDeviceRequest) (Device, error) {
+	lock := s.users.FieldLock(user)
+	lock.Lock()
+	defer lock.Unlock()
+
+	previous := user.Devices
+	devices := slices.Clone(previous)
+	i := slices.IndexFunc(devices, func(d Device) bool { return d.ID == deviceID })
+	if i < 0 {
+		return Device{}, errDeviceNotFound
+	}
+	if req.Name != nil {
+		devices[i].Name = strings.TrimSpace(*req.Name)
+	}
+	if req.Trusted != nil {
+		devices[i].TrustedUntil = nil
+		if *req.Trusted {
+			until := time.Now().UTC().Add(deviceTrustPeriod)
+			devices[i].TrustedUntil = &until
+		}
+	}
+
+	user.Devices = devices
+	if err := saveUser(user); err != nil {
+		user.Devices = previous
+		return Device{}, err
+	}
+	return devices[i], nil
+}
+
+// RemoveDevice forgets a device, refusing every token issued to it
+func (s *Service) RemoveDevice(user *User, deviceID string) error {
+	lock := s.users.FieldLock(user)
+	lock.Lock()
+	previous := user.Devices
+	i := slices.IndexFunc(previous, func(d Device) bool { return d.ID == deviceID })
+	if i < 0 {
+		lock.Unlock()
+		return errDeviceNotFound
+	}
+	user.Devices = slices.Delete(slices.Clone(previous), i, i+1)
+	err := saveUser(user)
+	if err != nil {
+		user.Devices = previous
+	}
+	lock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	forgetUserTokens(user.ID)
+	return nil
+}
+
+// ----------------------------------------------------------------------------
+// Handlers
+// ----------------------------------------------------------------------------
+
+// listMyDevices returns the current user's devices, most recently seen first
+func (s *Server) listMyDevices(c *gin.Context) {
+	user, _ := c.Get("user")
+	currentUser := user.(*User)
+	fingerprint := httpLoginRecord(c).Device
+
+	lock := s.svc.users.FieldLock(currentUser)
+	lock.RLock()
+	devices := slices.Clone(currentUser.Devices)
+	lock.RUnlock()
+
+	now := time.Now()
+	views := make([]DeviceView, 0, len(devices))
+	for _, device := range devices {
+		views = append(views, device.view(now, fingerprint))
+	}
+	slices.SortFunc(views, func(a, b DeviceView) int { return b.LastSeenAt.Compare(a.LastSeenAt) })
+	c.JSON(http.StatusOK, gin.H{"devices": views})
+}
+
+// updateMyDevice renames one of the current user's devices or changes its
+// trust
+func (s *Server) updateMyDevice(c *gin.Context) {
+	var req UpdateDeviceRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondBindError(c, err)
+		return
+	}
+	user, _ := c.Get("user")
+	currentUser := user.(*User)
+
+	device, err := s.svc.UpdateDevice(currentUser, c.Param("id"), req)
+	if err != nil {
+		respondServiceError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, device.view(time.Now(), httpLoginRecord(c).Device))
+}
+
+// removeMyDevice signs one of the current user's devices out
+func (s *Server) removeMyDevice(c *gin.Context) {
+	user, _ := c.Get("user")
+	currentUser := user.(*User)
+
+	if err := s.svc.RemoveDevice(currentUser, c.Param("id")); err != nil {
+		respondServiceError(c, err)
+		return
+	}
+	event := httpSecurityEvent(c, EventTokenRevoked, "success")
+	event.UserID, event.Email = currentUser.ID, currentUser.Email
+	event.Reason = "device_removed"
+	event.Details = map[string]string{"device_id": c.Param("id")}
+	emitSecurityEvent(event)
+
+	c.JSON(http.StatusOK, gin.H{"message": "Device signed out"})
+}
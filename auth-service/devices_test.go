@@ -0,0 +1,142 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+const (
+	chromeOnMac    = "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0 Safari/537.36"
+	firefoxOnLinux = "Mozilla/5.0 (X11; Linux x86_64; rv:121.0) Gecko/20100101 Firefox/121.0"
+)
+
+// loginFrom signs in with a User-Agent and extra headers and returns the
+// status and token
+func (ts *testServer) loginFrom(email, userAgent string, headers ...string) (int, string) {
+	ts.t.Helper()
+	headers = append([]string{"User-Agent", userAgent}, headers...)
+	w := ts.do(http.MethodPost, "/v1/auth/login", "", `{"email":"`+email+`","password":"secret123"}`, headers...)
+	var resp AuthResponse
+	if w.Code == http.StatusOK {
+		decodeJSON(ts.t, w, &resp)
+	}
+	return w.Code, resp.Token
+}
+
+// devices lists a user's devices as seen from userAgent
+func (ts *testServer) devices(token, userAgent string) []DeviceView {
+	ts.t.Helper()
+	w := ts.do(http.MethodGet, "/v1/users/me/devices", token, "", "User-Agent", userAgent)
+	var resp struct {
+		Devices []DeviceView `json:"devices"`
+	}
+	decodeJSON(ts.t, w, &resp)
+	if w.Code != http.StatusOK {
+		ts.t.Fatalf("list devices: %d %s", w.Code, w.Body)
+	}
+	return resp.Devices
+}
+
+func TestDevices(t *testing.T) {
+	ts := newTestServer(t)
+	ts.register("a@example.com")
+	_, chrome := ts.loginFrom("a@example.com", chromeOnMac)
+	_, firefox := ts.loginFrom("a@example.com", firefoxOnLinux)
+	_, chromeAgain := ts.loginFrom("a@example.com", chromeOnMac)
+
+	devices := ts.devices(chrome, chromeOnMac)
+	if len(devices) != 2 {
+		t.Fatalf("devices: %+v", devices)
+	}
+	var chromeDevice, firefoxDevice DeviceView
+	for _, device := range devices {
+		switch device.Name {
+		case "Chrome on macOS":
+			chromeDevice = device
+		case "Firefox on Linux":
+			firefoxDevice = device
+		}
+	}
+	if !chromeDevice.Current || firefoxDevice.Current || chromeDevice.Platform != "macOS" || firefoxDevice.ID == "" ||
+		chromeDevice.FirstSeenAt.After(chromeDevice.LastSeenAt) || devices[0].ID != chromeDevice.ID {
+		t.Fatalf("devices: %+v", devices)
+	}
+
+	w := ts.do(http.MethodPatch, "/v1/users/me/devices/"+firefoxDevice.ID, chrome, `{"name":"Work laptop"}`)
+	var renamed DeviceView
+	decodeJSON(t, w, &renamed)
+	if w.Code != http.StatusOK || renamed.Name != "Work laptop" || renamed.Trusted {
+		t.Fatalf("rename: %d %s", w.Code, w.Body)
+	}
+
+	// Removing a device signs out its sessions and no others
+	if w := ts.do(http.MethodDelete, "/v1/users/me/devices/"+firefoxDevice.ID, chrome, ""); w.Code != http.StatusOK {
+		t.Fatalf("remove: %d %s", w.Code, w.Body)
+	}
+	if w := ts.do(http.MethodGet, "/v1/auth/verify", firefox, ""); w.Code != http.StatusUnauthorized {
+		t.Fatalf("token of a removed device: got %d, want 401", w.Code)
+	}
+	for _, token := range []string{chrome, chromeAgain} {
+		if w := ts.do(http.MethodGet, "/v1/auth/verify", token, ""); w.Code != http.StatusOK {
+			t.Fatalf("token of a remaining device: got %d, want 200", w.Code)
+		}
+	}
+	if w := ts.do(http.MethodDelete, "/v1/users/me/devices/"+firefoxDevice.ID, chrome, ""); w.Code != http.StatusNotFound {
+		t.Fatalf("remove twice: got %d, want 404", w.Code)
+	}
+
+	// Another user can't see or touch them
+	other, _ := ts.register("b@example.com")
+	if w := ts.do(http.MethodPatch, "/v1/users/me/devices/"+chromeDevice.ID, other, `{"trusted":true}`); w.Code != http.StatusNotFound {
+		t.Fatalf("trust another user's device: got %d, want 404", w.Code)
+	}
+}
+
+func TestTrustedDeviceSkipsStepUp(t *testing.T) {
+	ts := newTestServer(t)
+	withConfig(t, func(cfg *Config) {
+		cfg.Anomaly.Enabled, cfg.Anomaly.StepUp = true, true
+		cfg.Anomaly.CountryHeader = "CloudFront-Viewer-Country"
+	})
+	ts.register("a@example.com")
+	_, token := ts.loginFrom("a@example.com", chromeOnMac, "CloudFront-Viewer-Country", "US")
+
+	// A new country is held until the device is trusted
+	if status, _ := ts.loginFrom("a@example.com", chromeOnMac, "CloudFront-Viewer-Country", "FR"); status != http.StatusForbidden {
+		t.Fatalf("held sign-in: got %d, want 403", status)
+	}
+	device := ts.devices(token, chromeOnMac)[0]
+	w := ts.do(http.MethodPatch, "/v1/users/me/devices/"+device.ID, token, `{"trusted":true}`)
+	var trusted DeviceView
+	decodeJSON(t, w, &trusted)
+	if w.Code != http.StatusOK || !trusted.Trusted || trusted.TrustedUntil == nil {
+		t.Fatalf("trust: %d %s", w.Code, w.Body)
+	}
+	if status, _ := ts.loginFrom("a@example.com", chromeOnMac, "CloudFront-Viewer-Country", "DE"); status != http.StatusOK {
+		t.Fatalf("sign-in from a trusted device: got %d, want 200", status)
+	}
+	// Other devices are still held
+	if status, _ := ts.loginFrom("a@example.com", firefoxOnLinux, "CloudFront-Viewer-Country", "JP"); status != http.StatusForbidden {
+		t.Fatalf("sign-in from an untrusted device: got %d, want 403", status)
+	}
+
+	ts.do(http.MethodPatch, "/v1/users/me/devices/"+device.ID, token, `{"trusted":false}`)
+	if status, _ := ts.loginFrom("a@example.com", chromeOnMac, "CloudFront-Viewer-Country", "BR"); status != http.StatusForbidden {
+		t.Fatalf("sign-in after revoking trust: got %d, want 403", status)
+	}
+}
+
+func TestDeviceName(t *testing.T) {
+	for userAgent, want := range map[string]string{
+		chromeOnMac:    "Chrome on macOS",
+		firefoxOnLinux: "Firefox on Linux",
+		"Mozilla/5.0 (iPhone; CPU iPhone OS 17_0 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.0 Mobile/15E148 Safari/604.1": "Safari on iOS",
+		"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0 Safari/537.36 Edg/120.0":                   "Edge on Windows",
+		"okhttp/4.12.0": "App on Unknown",
+		"":              "Browser on Unknown",
+	} {
+		if got := deviceName(userAgent); got != want {
+			t.Errorf("deviceName(%q) = %q, want %q", userAgent, got, want)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"expvar"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	runtimepprof "runtime/pprof"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ============================================================================
+// Runtime Diagnostics
+// ============================================================================
+//
+// /admin/debug exposes the standard profiling endpoints behind the same
+// admin token and address allowlist as the rest of the admin API, so the
+// service can be profiled in production when latency degrades:
+//
+//	go tool pprof -http=: -H "Authorization: Bearer $TOKEN" \
+//	    https://auth.example.com/v1/admin/debug/pprof/profile?seconds=30
+//
+// /admin/debug/vars is expvar (memstats plus the service's own counters),
+// /admin/debug/goroutines is a full stack dump and /admin/debug/heap a heap
+// profile taken after a GC.
+
+var startedAt = time.Now()
+
+func init() {
+	expvar.Publish("auth_service", expvar.Func(func() any {
+		users := localUsers.Count()
+		var documentCount int
+		localDocuments.View(func(tx DocumentTx) { documentCount = tx.len() })
+
+		return map[string]any{
+			"uptime_seconds":         int64(time.Since(startedAt).Seconds()),
+			"goroutines":             runtime.NumGoroutine(),
+			"in_flight_requests":     inFlightRequests.Load(),
+			"users":                  users,
+			"documents":              documentCount,
+			"siem_dropped_events":    droppedEvents.Load(),
+			"error_reports_dropped":  droppedErrorReports.Load(),
+			"password_checks_queued": queuedPasswordWork(),
+			"password_peppers":       pepperUsage(),
+			"token_cache_hits":       tokenCacheHits.Load(),
+			"token_cache_misses":     tokenCacheMisses.Load(),
+			"user_cache_hits":        userCache.hits.Load(),
+			"user_cache_misses":      userCache.misses.Load(),
+			"mail_sent":              sentMail.Load(),
+			"mail_failed":            failedMail.Load(),
+			"mail_dropped":           droppedMail.Load(),
+			"honeypot_hits":          honeypotHits.Load(),
+			"honeypot_bans":          honeypotBans.Load(),
+		}
+	}))
+}
+
+// registerDiagnostics mounts the debug endpoints on an admin group
+func registerDiagnostics(admin *gin.RouterGroup) {
+	debug := admin.Group("/debug")
+	debug.GET("/pprof/", gin.WrapF(pprof.Index))
+	debug.GET("/pprof/cmdline", gin.WrapF(pprof.Cmdline))
+	debug.GET("/pprof/profile", gin.WrapF(pprof.Profile))
+	debug.GET("/pprof/symbol", gin.WrapF(pprof.Symbol))
+	debug.GET("/pprof/trace", gin.WrapF(pprof.Trace))
+	debug.GET("/pprof/:profile", pprofProfile)
+	debug.GET("/vars", gin.WrapH(expvar.Handler()))
+	debug.GET("/goroutines", dumpGoroutines)
+	debug.GET("/heap", dumpHeap)
+	debug.GET("/runtime", runtimeStats)
+}
+
+// pprofProfile serves a named profile (heap, goroutine, allocs, block,
+// mutex, threadcreate); pprof.Index expects them under /debug/pprof/
+func pprofProfile(c *gin.Context) {
+	name := c.Param("profile")
+	if runtimepprof.Lookup(name) == nil {
+		respondError(c, http.StatusNotFound, codeNotFound, "Unknown profile "+name)
+		return
+	}
+	pprof.Handler(name).ServeHTTP(c.Writer, c.Request)
+}
+
+// dumpGoroutines writes every goroutine's stack as text
+func dumpGoroutines(c *gin.Context) {
+	c.Header("Content-Type", "text/plain; charset=utf-8")
+	c.Status(http.StatusOK)
+	runtimepprof.Lookup("goroutine").WriteTo(c.Writer, 2)
+}
+
+// dumpHeap downloads a heap profile for go tool pprof
+func dumpHeap(c *gin.Context) {
+	runtime.GC()
+	c.Header("Content-Type", "application/octet-stream")
+	c.Header("Content-Disposition", `attachment; filename="heap-`+time.Now().UTC().Format("20060102T150405Z")+`.pprof"`)
+	c.Status(http.StatusOK)
+	runtimepprof.Lookup("heap").WriteTo(c.Writer, 0)
+}
+
+// RuntimeStats is a quick look at the process without a profiler
+type RuntimeStats struct {
+	Uptime       string `json:"uptime"`
+	GoVersion    string `json:"go_version"`
+	Release      string `json:"release"`
+	Goroutines   int    `json:"goroutines"`
+	CPUs         int    `json:"cpus"`
+	GOMAXPROCS   int    `json:"gomaxprocs"`
+	HeapAlloc    uint64 `json:"heap_alloc_bytes"`
+	HeapInuse    uint64 `json:"heap_inuse_bytes"`
+	HeapObjects  uint64 `json:"heap_objects"`
+	Sys          uint64 `json:"sys_bytes"`
+	NumGC        uint32 `json:"num_gc"`
+	LastGCPause  string `json:"last_gc_pause"`
+	PauseTotal   string `json:"gc_pause_total"`
+	NextGCTarget uint64 `json:"next_gc_bytes"`
+}
+
+// runtimeStats summarises goroutines, memory and GC (admin only)
+func runtimeStats(c *gin.Context) {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	c.JSON(http.StatusOK, RuntimeStats{
+		Uptime:       time.Since(startedAt).Round(time.Second).String(),
+		GoVersion:    runtime.Version(),
+		Release:      serviceRelease,
+		Goroutines:   runtime.NumGoroutine(),
+		CPUs:         runtime.NumCPU(),
+		GOMAXPROCS:   runtime.GOMAXPROCS(0),
+		HeapAlloc:    mem.HeapAlloc,
+		HeapInuse:    mem.HeapInuse,
+		HeapObjects:  mem.HeapObjects,
+		Sys:          mem.Sys,
+		NumGC:        mem.NumGC,
+		LastGCPause:  time.Duration(mem.PauseNs[(mem.NumGC+255)%256]).String(),
+		PauseTotal:   time.Duration(mem.PauseTotalNs).String(),
+		NextGCTarget: mem.NextGC,
+	})
+}
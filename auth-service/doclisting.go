@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ============================================================================
+// Admin Document Listing
+// ============================================================================
+//
+// GET /documents/all lists every document grouped by owner. Without
+// parameters the whole listing is streamed one owner at a time; with limit
+// (and the next_cursor of the previous page) it returns owners in pages,
+// ordered by user ID. Either way the document store is only locked to copy
+// the owner list and then each owner's documents, never while looking up names or
+// writing the response, so a listing of a million documents doesn't stall
+// uploads. Owners are read one at a time, so a listing taken while
+// documents change is consistent per owner rather than as a whole.
+
+const (
+	defaultDocumentPageSize  = 100 // owners per page
+	maxDocumentPageSize      = 1000
+	documentStreamFlushEvery = 100 // owners between flushes
+)
+
+// DocumentOwnerGroup is one owner and their documents
+type DocumentOwnerGroup struct {
+	UserID    string   `json:"user_id"`
+	UserName  string   `json:"user_name"`
+	UserEmail string   `json:"user_email"`
+	Documents []string `json:"documents"`
+	Count     int      `json:"count"`
+}
+
+// DocumentOwners returns the IDs of users who own documents, sorted
+func (s *Service) DocumentOwners() []string {
+	var owners []string
+	s.documents.View(func(tx DocumentTx) {
+		owners = tx.owners()
+	})
+
+	sort.Strings(owners)
+	return owners
+}
+
+// DocumentCount returns how many documents are registered
+func (s *Service) DocumentCount() int {
+	var count int
+	s.documents.View(func(tx DocumentTx) {
+		count = tx.len()
+	})
+	return count
+}
+
+// OwnerGroup copies one owner's documents; ok is false if they have none
+// left
+func (s *Service) OwnerGroup(userID string) (group DocumentOwnerGroup, ok bool) {
+	docs := s.DocumentsOf(userID)
+	if len(docs) == 0 {
+		return group, false
+	}
+	name, email, _ := s.users.Contact(userID)
+	return DocumentOwnerGroup{UserID: userID, UserName: name, UserEmail: email, Documents: docs, Count: len(docs)}, true
+}
+
+// getAllDocuments returns all documents with their owners (admin only)
+func (s *Server) getAllDocuments(c *gin.Context) {
+	user, _ := c.Get("user")
+	currentUser := user.(*User)
+
+	if currentUser.Role != "admin" {
+		respondError(c, http.StatusForbidden, codeAdminRequired, "Admin access required")
+		return
+	}
+
+	if notModified(c, documentsETag("all")) {
+		return
+	}
+	if c.Query("limit") == "" && c.Query("cursor") == "" {
+		s.streamAllDocuments(c)
+		return
+	}
+
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(defaultDocumentPageSize)))
+	if err != nil || limit < 1 || limit > maxDocumentPageSize {
+		respondError(c, http.StatusBadRequest, codeInvalidRequest,
+			fmt.Sprintf("limit must be between 1 and %d", maxDocumentPageSize))
+		return
+	}
+	var after string
+	if cursor := c.Query("cursor"); cursor != "" {
+		raw, err := base64.RawURLEncoding.DecodeString(cursor)
+		if err != nil {
+			respondError(c, http.StatusBadRequest, codeInvalidRequest, "cursor is not valid; use next_cursor from the previous page")
+			return
+		}
+		after = string(raw)
+	}
+
+	owners := s.svc.DocumentOwners()
+	start := sort.Search(len(owners), func(i int) bool { return owners[i] > after })
+	groups := make([]DocumentOwnerGroup, 0, limit)
+	next := ""
+	for i := start; i < len(owners); i++ {
+		if len(groups) == limit {
+			next = base64.RawURLEncoding.EncodeToString([]byte(groups[len(groups)-1].UserID))
+			break
+		}
+		if group, ok := s.svc.OwnerGroup(owners[i]); ok {
+			groups = append(groups, group)
+		}
+	}
+
+	totalDocuments := s.svc.DocumentCount()
+
+	c.JSON(http.StatusOK, gin.H{
+		"users":           groups,
+		"count":           len(groups),
+		"total_users":     len(owners),
+		"total_documents": totalDocuments,
+		"next_cursor":     next,
+	})
+}
+
+// streamAllDocuments writes the full listing owner by owner; the totals
+// come last and match what was written
+func (s *Server) streamAllDocuments(c *gin.Context) {
+	owners := s.svc.DocumentOwners()
+
+	c.Header("Content-Type", "application/json; charset=utf-8")
+	c.Status(http.StatusOK)
+	w := c.Writer
+	io.WriteString(w, `{"users":[`)
+
+	written, documents := 0, 0
+	for _, userID := range owners {
+		if c.Request.Context().Err() != nil {
+			return
+		}
+		group, ok := s.svc.OwnerGroup(userID)
+		if !ok {
+			continue
+		}
+		data, _ := json.Marshal(group)
+		if written > 0 {
+			io.WriteString(w, ",")
+		}
+		w.Write(data)
+		written++
+		documents += group.Count
+		if written%documentStreamFlushEvery == 0 {
+			w.Flush()
+		}
+	}
+	fmt.Fprintf(w, `],"total_users":%d,"total_documents":%d}`, written, documents)
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// seedDocuments gives each of owners users perOwner documents
+func seedDocuments(tb testing.TB, owners, perOwner int) {
+	tb.Helper()
+	resetLocalStores(tb)
+	localDocuments.Update(func(tx DocumentTx) error {
+		for i := 0; i < owners; i++ {
+			id := fmt.Sprintf("user-%06d", i)
+			localUsers.Add(&User{ID: id, Email: id + "@example.com", Name: "User " + id})
+			for j := 0; j < perOwner; j++ {
+				tx.put(fmt.Sprintf("%s-doc-%06d.pdf", id, j), documentRecord{Owner: id})
+			}
+		}
+		return nil
+	})
+	bumpDocVersion()
+
+	tb.Cleanup(func() { resetLocalStores(tb) })
+}
+
+func listingRouter() *gin.Engine {
+	s := &Server{svc: defaultService}
+	r := gin.New()
+	r.GET("/v1/documents/all", func(c *gin.Context) {
+		c.Set("user", &User{ID: "admin", Role: "admin"})
+	}, s.getAllDocuments)
+	return r
+}
+
+type documentListing struct {
+	Users          []DocumentOwnerGroup `json:"users"`
+	TotalUsers     int                  `json:"total_users"`
+	TotalDocuments int                  `json:"total_documents"`
+	NextCursor     string               `json:"next_cursor"`
+}
+
+func getListing(t *testing.T, r http.Handler, query string) (int, documentListing) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/v1/documents/all"+query, nil))
+	var listing documentListing
+	if w.Code == http.StatusOK {
+		if err := json.Unmarshal(w.Body.Bytes(), &listing); err != nil {
+			t.Fatalf("invalid JSON: %v\n%s", err, w.Body)
+		}
+	}
+	return w.Code, listing
+}
+
+func TestAllDocumentsStreamed(t *testing.T) {
+	seedDocuments(t, 250, 3)
+	code, listing := getListing(t, listingRouter(), "")
+	if code != http.StatusOK {
+		t.Fatalf("got %d", code)
+	}
+	if listing.TotalUsers != 250 || listing.TotalDocuments != 750 || len(listing.Users) != 250 {
+		t.Fatalf("totals %d users, %d documents, %d groups", listing.TotalUsers, listing.TotalDocuments, len(listing.Users))
+	}
+	first := listing.Users[0]
+	if first.UserID != "user-000000" || first.UserName != "User user-000000" || first.Count != 3 {
+		t.Fatalf("first group = %+v", first)
+	}
+}
+
+func TestAllDocumentsPaged(t *testing.T) {
+	seedDocuments(t, 25, 3)
+	r := listingRouter()
+
+	seen := make(map[string]bool)
+	pages, cursor := 0, ""
+	for {
+		query := "?limit=10"
+		if cursor != "" {
+			query += "&cursor=" + cursor
+		}
+		code, page := getListing(t, r, query)
+		if code != http.StatusOK {
+			t.Fatalf("page %d: got %d", pages+1, code)
+		}
+		pages++
+		if page.TotalUsers != 25 || page.TotalDocuments != 75 {
+			t.Fatalf("page %d totals: %d users, %d documents", pages, page.TotalUsers, page.TotalDocuments)
+		}
+		for _, group := range page.Users {
+			for _, doc := range group.Documents {
+				if seen[doc] {
+					t.Fatalf("%s listed twice", doc)
+				}
+				seen[doc] = true
+			}
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		cursor = page.NextCursor
+	}
+	if pages != 3 || len(seen) != 75 {
+		t.Fatalf("%d pages covering %d documents, want 3 pages and 75", pages, len(seen))
+	}
+}
+
+func TestAllDocumentsRejectsBadPaging(t *testing.T) {
+	seedDocuments(t, 1, 1)
+	r := listingRouter()
+	for _, query := range []string{"?limit=0", "?limit=1001", "?limit=ten", "?limit=5&cursor=not*base64"} {
+		if code, _ := getListing(t, r, query); code != http.StatusBadRequest {
+			t.Errorf("%s: got %d, want 400", query, code)
+		}
+	}
+}
+
+func TestAllDocumentsDoesNotHoldLockWhileWriting(t *testing.T) {
+	seedDocuments(t, 3, 1)
+	w := &blockingWriter{ResponseRecorder: httptest.NewRecorder(), wrote: make(chan struct{}), release: make(chan struct{})}
+	go listingRouter().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/v1/documents/all", nil))
+	<-w.wrote
+
+	// The response is stuck on a slow client; writers must still get in
+	locked := make(chan struct{})
+	go func() {
+		localDocuments.Update(func(DocumentTx) error { return nil })
+		close(locked)
+	}()
+	select {
+	case <-locked:
+	case <-time.After(time.Second):
+		t.Fatal("document store locked while writing the response")
+	}
+	close(w.release)
+}
+
+// blockingWriter stalls on its first write, like a slow client
+type blockingWriter struct {
+	*httptest.ResponseRecorder
+	wrote, release chan struct{}
+	stalled        bool
+}
+
+func (w *blockingWriter) Write(data []byte) (int, error) {
+	if !w.stalled {
+		w.stalled = true
+		close(w.wrote)
+		<-w.release
+	}
+	return w.ResponseRecorder.Write(data)
+}
+
+// discardWriter is a ResponseWriter that throws the body away
+type discardWriter struct{ header http.Header }
+
+func (w *discardWriter) Header() http.Header            { return w.header }
+func (w *discardWriter) Write(data []byte) (int, error) { return len(data), nil }
+func (w *discardWriter) WriteHeader(int)                {}
+func (w *discardWriter) Flush()                         {}
+
+// BenchmarkAllDocuments lists a million documents (10,000 owners with 100
+// each), streamed in full and as the first page
+func BenchmarkAllDocuments(b *testing.B) {
+	seedDocuments(b, 10000, 100)
+	r := listingRouter()
+
+	for name, query := range map[string]string{"stream": "", "page": "?limit=100"} {
+		b.Run(name, func(b *testing.B) {
+			req := httptest.NewRequest(http.MethodGet, "/v1/documents/all"+query, nil)
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				r.ServeHTTP(&discardWriter{header: make(http.Header)}, req)
+			}
+		})
+	}
+}
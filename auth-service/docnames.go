@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// ============================================================================
+// Document Names
+// ============================================================================
+//
+// A document has a name, which is unique among its owner's documents, and
+// a filename, which is unique across the deployment because it is also the
+// document's source name in the RAG backend's vector store and the key
+// every other record (grants, notes, stars, citations) refers to it by.
+// Two members can both have a report.pdf: the first to register it gets
+// report.pdf as its filename too, and with documents.on_conflict set to
+// "suffix" (the default) the second gets the first free "report (n).pdf".
+// Registering a name again lands on the member's own document, whatever
+// its filename, so retries and connector syncs stay idempotent. "reject"
+// refuses a name another member's document has as its filename, which
+// keeps names unique across owners. Clients register a document before
+// uploading it and store it under the filename the response returns; the
+// web app sends that name to the RAG backend's /upload, so the second
+// report.pdf doesn't overwrite the first on disk.
+//
+// When a document changes hands (a merge or a bulk transfer) and the new
+// owner has a document by its name already, it takes the first free
+// suffixed name among theirs; its filename doesn't change.
+//
+// Documents registered before names were per owner keep their filenames,
+// which the vector store indexed them under, and take them as their names:
+// records without a name are given their filename as they are loaded, from
+// the cluster store or a backup, so each lands in its owner's namespace
+// unchanged. The MongoDB store's migration 0003 writes those names into
+// the documents collection; the Redis store keeps no schema and is named on
+// load alone.
+
+const (
+	onConflictSuffix = "suffix"
+	onConflictReject = "reject"
+
+	// maxFilenameSuffix bounds the search for a free filename
+	maxFilenameSuffix = 100
+)
+
+// documentName returns a record's name, which is its filename for records
+// from before names were per owner
+func documentName(filename, name string) string {
+	if name == "" {
+		return filename
+	}
+	return name
+}
+
+// suffixedFilename returns "name (n).ext" for filename
+func suffixedFilename(filename string, n int) string {
+	dir, base := path.Split(filename)
+	ext := path.Ext(base)
+	stem := strings.TrimSuffix(base, ext)
+	if stem == "" {
+		// A dotfile such as .env has no extension to keep apart
+		stem, ext = base, ""
+	}
+	return fmt.Sprintf("%s%s (%d)%s", dir, stem, n, ext)
+}
+
+// freeName returns name or, if the user has a document by that name, the
+// first suffixed name they don't have
+func freeName(tx DocumentTx, userID, name string) string {
+	candidate := name
+	for n := 2; ; n++ {
+		if _, taken := tx.named(userID, candidate); !taken {
+			return candidate
+		}
+		candidate = suffixedFilename(name, n)
+	}
+}
+
+// RegisterDocument registers a document to a user under name. Its
+// filename is the name or, if another user's document has that filename
+// and documents.on_conflict is suffix, the first free suffixed one. It
+// returns the filename and whether the document was newly registered.
+func (s *Service) RegisterDocument(name, userID string) (string, bool, error) {
+	filename, created, err := s.claimDocument(name, name, userID)
+	if err != errDocumentOwned || config.Documents.OnConflict != onConflictSuffix {
+		return filename, created, err
+	}
+	for n := 2; n <= maxFilenameSuffix; n++ {
+		filename, created, err := s.claimDocument(suffixedFilename(name, n), name, userID)
+		if err != errDocumentOwned {
+			return filename, created, err
+		}
+	}
+	return name, false, errDocumentOwned
+}
+
+// NamesOf returns the names of a user's documents by filename
+func (s *Service) NamesOf(userID string) map[string]string {
+	names := make(map[string]string)
+	s.documents.View(func(tx DocumentTx) {
+		for _, filename := range tx.ownedBy(userID) {
+			record, _ := tx.get(filename)
+			names[filename] = record.Name
+		}
+	})
+	return names
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"maps"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestSuffixedFilename(t *testing.T) {
+	for filename, want := range map[string]string{
+		"report.pdf":        "report (2).pdf",
+		"archive.tar.gz":    "archive.tar (2).gz",
+		"README":            "README (2)",
+		".env":              ".env (2)",
+		"reports/q3.pdf":    "reports/q3 (2).pdf",
+		"reports.v2/README": "reports.v2/README (2)",
+	} {
+		if got := suffixedFilename(filename, 2); got != want {
+			t.Errorf("suffixedFilename(%q) = %q, want %q", filename, got, want)
+		}
+	}
+}
+
+// registered is a register or upload response
+type registered struct {
+	Filename string `json:"filename"`
+	Name     string `json:"name"`
+}
+
+// myNames returns the names of a user's documents by filename
+func (ts *testServer) myNames(token string) map[string]string {
+	ts.t.Helper()
+	var mine struct {
+		Names map[string]string `json:"names"`
+	}
+	decodeJSON(ts.t, ts.do(http.MethodGet, "/v1/documents/my", token, ""), &mine)
+	return mine.Names
+}
+
+func TestRegisterConflictingFilename(t *testing.T) {
+	ts := newTestServer(t)
+	alice, _ := ts.register("alice@example.com")
+	bob, bobID := ts.register("bob@example.com")
+	ts.do(http.MethodPost, "/v1/documents/register", alice, `{"filename":"report.pdf"}`)
+
+	// Bob's report.pdf is his own; only its filename is suffixed
+	var resp registered
+	w := ts.do(http.MethodPost, "/v1/documents/register", bob, `{"filename":"report.pdf"}`)
+	decodeJSON(t, w, &resp)
+	if w.Code != http.StatusCreated || resp.Filename != "report (2).pdf" || resp.Name != "report.pdf" {
+		t.Fatalf("conflicting register: %d %+v", w.Code, resp)
+	}
+	if owner := ts.srv.svc.DocumentOwner("report (2).pdf"); owner != bobID {
+		t.Fatalf("suffixed document owned by %q", owner)
+	}
+	if names := ts.myNames(bob); len(names) != 1 || names["report (2).pdf"] != "report.pdf" {
+		t.Fatalf("bob's names = %v", names)
+	}
+	if names := ts.myNames(alice); names["report.pdf"] != "report.pdf" {
+		t.Fatalf("alice's names = %v", names)
+	}
+
+	// Registering the same name again lands on bob's document
+	w = ts.do(http.MethodPost, "/v1/documents/register", bob, `{"filename":"report.pdf"}`)
+	decodeJSON(t, w, &resp)
+	if w.Code != http.StatusOK || resp.Filename != "report (2).pdf" {
+		t.Fatalf("re-register: %d %+v", w.Code, resp)
+	}
+
+	// A name that is the filename of another of bob's documents is a new
+	// document, not that one
+	w = ts.do(http.MethodPost, "/v1/documents/register", bob, `{"filename":"report (2).pdf"}`)
+	decodeJSON(t, w, &resp)
+	if w.Code != http.StatusCreated || resp.Filename != "report (2) (2).pdf" || resp.Name != "report (2).pdf" {
+		t.Fatalf("register a name bob has as a filename: %d %+v", w.Code, resp)
+	}
+}
+
+func TestTransferRenamesClashingNames(t *testing.T) {
+	ts := newTestServer(t)
+	admin := ts.admin("admin@example.com")
+	alice, aliceID := ts.register("alice@example.com")
+	bob, bobID := ts.register("bob@example.com")
+	ts.do(http.MethodPost, "/v1/documents/register", alice, `{"filename":"report.pdf"}`)
+	ts.do(http.MethodPost, "/v1/documents/register", bob, `{"filename":"report.pdf"}`)
+	ts.do(http.MethodPost, "/v1/documents/register", bob, `{"filename":"notes.txt"}`)
+
+	w := ts.do(http.MethodPost, "/v1/admin/users/"+bobID+"/documents:bulk", admin, `{"action":"transfer","target_id":"`+aliceID+`"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("transfer: %d %s", w.Code, w.Body)
+	}
+	names := ts.myNames(alice)
+	want := map[string]string{"report.pdf": "report.pdf", "report (2).pdf": "report (2).pdf", "notes.txt": "notes.txt"}
+	if !maps.Equal(names, want) {
+		t.Fatalf("alice's names = %v, want %v", names, want)
+	}
+
+	// Alice's report.pdf is still the one she registered
+	var resp registered
+	decodeJSON(t, ts.do(http.MethodPost, "/v1/documents/register", alice, `{"filename":"report.pdf"}`), &resp)
+	if resp.Filename != "report.pdf" {
+		t.Fatalf("re-register after transfer: %+v", resp)
+	}
+}
+
+func TestDocumentsFromBeforeNames(t *testing.T) {
+	t.Cleanup(func() { resetLocalStores(t) })
+	useSharedStore(t)
+
+	// Written by a replica that kept no names
+	ctx := context.Background()
+	if _, err := clusterStore.claimDocument(ctx, "old.pdf", "u1", sharedDocumentMeta{AddedAt: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	if err := refreshRecord(ctx, clusterChange{Kind: "document", ID: "old.pdf"}); err != nil {
+		t.Fatal(err)
+	}
+	if names := defaultService.NamesOf("u1"); names["old.pdf"] != "old.pdf" {
+		t.Fatalf("names = %v", names)
+	}
+	filename, created, err := defaultService.RegisterDocument("old.pdf", "u1")
+	if err != nil || created || filename != "old.pdf" {
+		t.Fatalf("register an old document's name = %q, %v, %v", filename, created, err)
+	}
+
+	// Another user's old.pdf is theirs, under a suffixed filename
+	filename, created, err = defaultService.RegisterDocument("old.pdf", "u2")
+	if err != nil || !created || filename != "old (2).pdf" {
+		t.Fatalf("register another's old name = %q, %v, %v", filename, created, err)
+	}
+	doc, found, err := clusterStore.document(ctx, filename)
+	if err != nil || !found || doc.Meta.Name != "old.pdf" {
+		t.Fatalf("shared record = %+v, %v, %v", doc, found, err)
+	}
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// ============================================================================
+// Document Store
+// ============================================================================
+//
+// Documents are indexed twice: by filename, holding the ownership record,
+// and by owner, holding the set of filenames they own and, by name, the
+// filename each of their names is registered under (docnames.go). The
+// indexes change together, so registering or releasing a document is O(1)
+// however many documents its owner has, and an owner drops out of the
+// owner index when their last document goes. Org-wide documents are also kept in a set of
+// their own so access checks don't scan every record, and time-boxed
+// grants (grants.go) by grantee. The index is not synchronized itself;
+// memoryDocumentRepository guards it with one lock and hands it to View and
+// Update callbacks as their DocumentTx.
+
+// documentRecord is what the store knows about one document
+type documentRecord struct {
+	Owner   string
+	Name    string // unique among the owner's documents; the filename is unique across them all (docnames.go)
+	AddedAt time.Time
+	Size    int64                // bytes, when uploaded
+	Type    string               // media type sniffed from the upload (filetypes.go)
+	OrgWide bool                 // readable by every member, not just the owner
+	Tags    []string             // sorted; set by admins
+	Grants  map[string]time.Time // grantee user_id -> when access ends; never changed in place
+	Notes   []DocumentNote       // oldest first; replaced, never changed in place (notes.go)
+	Preview *DocumentPreview     // extracted on ingestion (preview.go)
+
+	Chunking    *ChunkingSettings // the owner's override (chunking.go)
+	ChunkedWith *ChunkingSettings // what the backend last chunked it with; nil for its built-in defaults
+}
+
+// documentIndex maps filenames to records and owners to their filenames
+type documentIndex struct {
+	records map[string]documentRecord       // filename -> record
+	byOwner map[string]map[string]struct{}  // user_id -> filenames
+	names   map[string]map[string]string    // user_id -> name -> filename
+	orgWide map[string]struct{}             // filenames shared with the org
+	grants  map[string]map[string]time.Time // grantee user_id -> filename -> expiry
+	bytes   int64                           // sum of record sizes
+}
+
+// memoryDocumentRepository is the in-memory DocumentRepository
+type memoryDocumentRepository struct {
+	mu    sync.RWMutex
+	index *documentIndex
+}
+
+func newMemoryDocumentRepository() *memoryDocumentRepository {
+	return &memoryDocumentRepository{index: newDocumentIndex()}
+}
+
+// View runs fn under the read lock
+func (r *memoryDocumentRepository) View(fn func(tx DocumentTx)) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	fn(r.index)
+}
+
+// Update runs fn under the write lock
+func (r *memoryDocumentRepository) Update(fn func(tx DocumentTx) error) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return fn(r.index)
+}
+
+// replace swaps in a rebuilt index, for a replica resync
+func (r *memoryDocumentRepository) replace(index *documentIndex) {
+	r.mu.Lock()
+	r.index = index
+	r.mu.Unlock()
+}
+
+func newDocumentIndex() *documentIndex {
+	return &documentIndex{
+		records: make(map[string]documentRecord),
+		byOwner: make(map[string]map[string]struct{}),
+		names:   make(map[string]map[string]string),
+		orgWide: make(map[string]struct{}),
+		grants:  make(map[string]map[string]time.Time),
+	}
+}
+
+// get returns a document's record
+func (ix *documentIndex) get(filename string) (documentRecord, bool) {
+	record, exists := ix.records[filename]
+	return record, exists
+}
+
+// owner returns a document's owner, or "" if it isn't registered
+func (ix *documentIndex) owner(filename string) string {
+	return ix.records[filename].Owner
+}
+
+// put stores a record, moving the document if it had another owner
+func (ix *documentIndex) put(filename string, record documentRecord) {
+	ix.remove(filename)
+	record.Name = documentName(filename, record.Name)
+	ix.records[filename] = record
+	ix.bytes += record.Size
+	if record.OrgWide {
+		ix.orgWide[filename] = struct{}{}
+	}
+	for userID, until := range record.Grants {
+		granted, exists := ix.grants[userID]
+		if !exists {
+			granted = make(map[string]time.Time)
+			ix.grants[userID] = granted
+		}
+		granted[filename] = until
+	}
+
+	owned, exists := ix.byOwner[record.Owner]
+	if !exists {
+		owned = make(map[string]struct{})
+		ix.byOwner[record.Owner] = owned
+	}
+	owned[filename] = struct{}{}
+	named, exists := ix.names[record.Owner]
+	if !exists {
+		named = make(map[string]string)
+		ix.names[record.Owner] = named
+	}
+	named[record.Name] = filename
+}
+
+// setSize records a document's size; it reports false if the document
+// isn't registered
+func (ix *documentIndex) setSize(filename string, size int64) (documentRecord, bool) {
+	record, exists := ix.records[filename]
+	if !exists {
+		return record, false
+	}
+	ix.bytes += size - record.Size
+	record.Size = size
+	ix.records[filename] = record
+	return record, true
+}
+
+// setOrgWide shares a document with the org or makes it personal again;
+// it reports false if the document isn't registered
+func (ix *documentIndex) setOrgWide(filename string, orgWide bool) (documentRecord, bool) {
+	record, exists := ix.records[filename]
+	if !exists {
+		return record, false
+	}
+	record.OrgWide = orgWide
+	ix.records[filename] = record
+	if orgWide {
+		ix.orgWide[filename] = struct{}{}
+	} else {
+		delete(ix.orgWide, filename)
+	}
+	return record, true
+}
+
+// remove deletes a document and returns the record it had
+func (ix *documentIndex) remove(filename string) (documentRecord, bool) {
+	record, exists := ix.records[filename]
+	if !exists {
+		return record, false
+	}
+	delete(ix.records, filename)
+	delete(ix.orgWide, filename)
+	ix.bytes -= record.Size
+	for userID := range record.Grants {
+		delete(ix.grants[userID], filename)
+		if len(ix.grants[userID]) == 0 {
+			delete(ix.grants, userID)
+		}
+	}
+
+	owned := ix.byOwner[record.Owner]
+	delete(owned, filename)
+	if len(owned) == 0 {
+		delete(ix.byOwner, record.Owner)
+	}
+	named := ix.names[record.Owner]
+	if named[record.Name] == filename {
+		delete(named, record.Name)
+	}
+	if len(named) == 0 {
+		delete(ix.names, record.Owner)
+	}
+	return record, true
+}
+
+// ownedBy returns a user's documents, sorted
+func (ix *documentIndex) ownedBy(userID string) []string {
+	owned := ix.byOwner[userID]
+	docs := make([]string, 0, len(owned))
+	for filename := range owned {
+		docs = append(docs, filename)
+	}
+	sort.Strings(docs)
+	return docs
+}
+
+// named returns the filename of a user's document with the given name
+func (ix *documentIndex) named(userID, name string) (string, bool) {
+	filename, exists := ix.names[userID][name]
+	return filename, exists
+}
+
+// orgWideDocuments returns the documents shared with the org, sorted
+func (ix *documentIndex) orgWideDocuments() []string {
+	docs := make([]string, 0, len(ix.orgWide))
+	for filename := range ix.orgWide {
+		docs = append(docs, filename)
+	}
+	sort.Strings(docs)
+	return docs
+}
+
+// readable reports whether a user owns a document, it is org-wide or it
+// is granted to them
+func (ix *documentIndex) readable(userID, filename string) bool {
+	_, shared := ix.orgWide[filename]
+	if shared || ix.owns(userID, filename) {
+		return true
+	}
+	until, granted := ix.grants[userID][filename]
+	return granted && time.Now().Before(until)
+}
+
+// grantedTo returns the documents granted to a user that are still
+// unexpired at now, with their expiry
+func (ix *documentIndex) grantedTo(userID string, now time.Time) map[string]time.Time {
+	granted := make(map[string]time.Time)
+	for filename, until := range ix.grants[userID] {
+		if now.Before(until) {
+			granted[filename] = until
+		}
+	}
+	return granted
+}
+
+// lapsedGrants returns the grants that ended by now, unsorted
+func (ix *documentIndex) lapsedGrants(now time.Time) []DocumentGrant {
+	var lapsed []DocumentGrant
+	for userID, granted := range ix.grants {
+		for filename, until := range granted {
+			if !until.After(now) {
+				lapsed = append(lapsed, DocumentGrant{Filename: filename, UserID: userID, ExpiresAt: until})
+			}
+		}
+	}
+	return lapsed
+}
+
+// owns reports whether a user owns a document
+func (ix *documentIndex) owns(userID, filename string) bool {
+	_, owned := ix.byOwner[userID][filename]
+	return owned
+}
+
+// countOwnedBy returns how many documents a user owns
+func (ix *documentIndex) countOwnedBy(userID string) int {
+	return len(ix.byOwner[userID])
+}
+
+// owners returns the IDs of users who own at least one document, unsorted
+func (ix *documentIndex) owners() []string {
+	ids := make([]string, 0, len(ix.byOwner))
+	for userID := range ix.byOwner {
+		ids = append(ids, userID)
+	}
+	return ids
+}
+
+// ownerCount returns how many users own at least one document
+func (ix *documentIndex) ownerCount() int {
+	return len(ix.byOwner)
+}
+
+// totalBytes returns the summed size of all documents
+func (ix *documentIndex) totalBytes() int64 {
+	return ix.bytes
+}
+
+func (ix *documentIndex) len() int {
+	return len(ix.records)
+}
+
+// each calls fn for every document
+func (ix *documentIndex) each(fn func(filename string, record documentRecord)) {
+	for filename, record := range ix.records {
+		fn(filename, record)
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+	"testing/quick"
+)
+
+// docOp is one random operation against the document index: op%3 picks
+// put, remove or setSize; the filename and owner come from small pools so
+// operations collide often
+type docOp struct {
+	Op, File, Owner uint8
+	Size            uint16
+}
+
+// checkDocumentIndex compares the index against a plain filename -> record
+// model
+func checkDocumentIndex(ix *documentIndex, model map[string]documentRecord) error {
+	if ix.len() != len(model) {
+		return fmt.Errorf("len = %d, model has %d", ix.len(), len(model))
+	}
+	byOwner := make(map[string][]string)
+	var bytes int64
+	for filename, want := range model {
+		if got, ok := ix.get(filename); !ok || !reflect.DeepEqual(got, want) {
+			return fmt.Errorf("get(%s) = %+v, %v; want %+v", filename, got, ok, want)
+		}
+		byOwner[want.Owner] = append(byOwner[want.Owner], filename)
+		bytes += want.Size
+	}
+	if ix.bytes != bytes {
+		return fmt.Errorf("bytes = %d, want %d", ix.bytes, bytes)
+	}
+	if ix.ownerCount() != len(byOwner) || len(ix.owners()) != len(byOwner) {
+		return fmt.Errorf("%d owners, want %d", ix.ownerCount(), len(byOwner))
+	}
+	for owner, want := range byOwner {
+		sort.Strings(want)
+		got := ix.ownedBy(owner)
+		if fmt.Sprint(got) != fmt.Sprint(want) || ix.countOwnedBy(owner) != len(want) {
+			return fmt.Errorf("ownedBy(%s) = %v, want %v", owner, got, want)
+		}
+		for _, filename := range want {
+			if !ix.owns(owner, filename) {
+				return fmt.Errorf("owns(%s, %s) = false", owner, filename)
+			}
+			if named, ok := ix.named(owner, model[filename].Name); !ok || named != filename {
+				return fmt.Errorf("named(%s, %s) = %q, %v; want %s", owner, model[filename].Name, named, ok, filename)
+			}
+		}
+	}
+	if len(ix.names) != len(byOwner) {
+		return fmt.Errorf("names for %d owners, want %d", len(ix.names), len(byOwner))
+	}
+	return nil
+}
+
+func TestDocumentIndexMatchesModel(t *testing.T) {
+	property := func(ops []docOp) bool {
+		ix := newDocumentIndex()
+		model := make(map[string]documentRecord)
+		for _, op := range ops {
+			filename := fmt.Sprintf("doc-%d.pdf", op.File%16)
+			switch op.Op % 3 {
+			case 0:
+				// Records from before names were per owner have none
+				record := documentRecord{Owner: fmt.Sprintf("user-%d", op.Owner%4), Size: int64(op.Size)}
+				if op.Owner&4 != 0 {
+					record.Name = "named " + filename
+				}
+				ix.put(filename, record)
+				record.Name = documentName(filename, record.Name)
+				model[filename] = record
+			case 1:
+				_, removed := ix.remove(filename)
+				_, existed := model[filename]
+				if removed != existed {
+					t.Logf("remove(%s) = %v, model had it: %v", filename, removed, existed)
+					return false
+				}
+				delete(model, filename)
+			case 2:
+				_, updated := ix.setSize(filename, int64(op.Size))
+				if record, exists := model[filename]; exists {
+					record.Size = int64(op.Size)
+					model[filename] = record
+				} else if updated {
+					t.Logf("setSize(%s) registered an unknown document", filename)
+					return false
+				}
+			}
+			if err := checkDocumentIndex(ix, model); err != nil {
+				t.Logf("after %+v: %v", op, err)
+				return false
+			}
+		}
+		return true
+	}
+	if err := quick.Check(property, &quick.Config{MaxCount: 500}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDocumentIndexPutMovesOwner(t *testing.T) {
+	ix := newDocumentIndex()
+	ix.put("a.pdf", documentRecord{Owner: "u1", Size: 10})
+	ix.put("a.pdf", documentRecord{Owner: "u2", Size: 5})
+
+	if ix.owns("u1", "a.pdf") || ix.countOwnedBy("u1") != 0 {
+		t.Fatal("previous owner still holds the document")
+	}
+	if !ix.owns("u2", "a.pdf") || ix.bytes != 5 {
+		t.Fatalf("owns = %v, bytes = %d", ix.owns("u2", "a.pdf"), ix.bytes)
+	}
+	if _, named := ix.named("u1", "a.pdf"); named {
+		t.Fatal("previous owner still has the document's name")
+	}
+}
+
+// BenchmarkDocumentRemove releases documents from an owner with many
+func BenchmarkDocumentRemove(b *testing.B) {
+	ix := newDocumentIndex()
+	for i := 0; i < 100000; i++ {
+		ix.put(fmt.Sprintf("doc-%06d.pdf", i), documentRecord{Owner: "u1"})
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		filename := fmt.Sprintf("doc-%06d.pdf", i%100000)
+		record, _ := ix.remove(filename)
+		ix.put(filename, record)
+	}
+}
@@ -0,0 +1,458 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// ============================================================================
+// Two-Person Approval
+// ============================================================================
+//
+// With dual_control.enabled, the high-risk admin actions listed in
+// dual_control.actions are not carried out when requested. The request is
+// kept as a pending action, the other admins are notified, and the caller
+// gets 202 with the action's ID. A different admin then approves it under
+// /admin/pending-actions within dual_control.window, which replays the
+// original request through the router with the approver's credentials, or
+// rejects it; the requester may reject (withdraw) their own. Requesting,
+// approving, rejecting and the action itself are all audited.
+//
+// The actions are:
+//
+//   - user.delete: DELETE /admin/users/:id
+//   - documents.bulk_unregister: POST /admin/users/:id/documents:bulk with
+//     action "unregister", unless it is a dry run
+//   - role.escalate: creating an admin, or making a user one
+//   - backup.restore: POST /admin/restore, unless it is a dry run
+//   - user.merge: POST /admin/users/:id/merge, unless it is a dry run
+//
+// Pending actions are kept in the shared store when clustered, so any
+// replica can list and decide them, and otherwise in memory until a
+// restart. Deciding an action holds a lock on it, so two admins approving
+// at once replay it once. With a single active admin nothing listed can be
+// approved, so leave it off.
+
+const (
+	dualControlUserDelete     = "user.delete"
+	dualControlBulkUnregister = "documents.bulk_unregister"
+	dualControlRoleEscalate   = "role.escalate"
+	dualControlRestore        = "backup.restore"
+	dualControlUserMerge      = "user.merge"
+
+	pendingActionPending  = "pending"
+	pendingActionExecuted = "executed"
+	pendingActionFailed   = "failed" // approved, but the replayed request failed
+	pendingActionRejected = "rejected"
+	pendingActionExpired  = "expired"
+
+	// approvedActionHeader carries "id.grant" on a replayed request
+	approvedActionHeader = "X-Approved-Action"
+
+	// Record kinds: pending actions, and the one-time grants that let an
+	// approved action's replay through
+	pendingActionRecord = "pending-action"
+	actionGrantRecord   = "action-grant"
+	actionGrantTTL      = time.Minute
+
+	// NotificationActionPending tells admins an action awaits their approval
+	NotificationActionPending = "admin.action.pending"
+)
+
+var dualControlActions = []string{dualControlUserDelete, dualControlBulkUnregister, dualControlRoleEscalate, dualControlRestore, dualControlUserMerge}
+
+var (
+	errPendingActionNotFound = errors.New("Pending action not found")
+	errPendingActionDecided  = errors.New("Pending action was already decided")
+	errPendingActionExpired  = errors.New("Pending action has expired")
+	errSelfApproval          = errors.New("A second administrator must approve this action")
+	errInvalidApproval       = errors.New("Approval is invalid or was already used")
+)
+
+// PendingAction is a high-risk admin request awaiting a second admin
+type PendingAction struct {
+	ID          string               `json:"id"`
+	Action      string               `json:"action"`
+	Method      string               `json:"method"`
+	Path        string               `json:"path"`
+	Body        json.RawMessage      `json:"body,omitempty"`
+	Status      string               `json:"status"`
+	RequestedBy string               `json:"requested_by"`
+	RequestedAt time.Time            `json:"requested_at"`
+	ExpiresAt   time.Time            `json:"expires_at"`
+	DecidedBy   string               `json:"decided_by,omitempty"`
+	DecidedAt   *time.Time           `json:"decided_at,omitempty"`
+	Reason      string               `json:"reason,omitempty"`
+	Result      *PendingActionResult `json:"result,omitempty"`
+}
+
+// storedPendingAction is a pending action as keyedRecords keeps it
+type storedPendingAction struct {
+	PendingAction
+	RawBody     []byte `json:"raw_body,omitempty"` // a body that isn't JSON, such as a backup archive
+	ContentType string `json:"content_type,omitempty"`
+	Replaying   bool   `json:"replaying,omitempty"`
+}
+
+// PendingActionResult is the replayed request's response
+type PendingActionResult struct {
+	Status int             `json:"status"`
+	Body   json.RawMessage `json:"body,omitempty"`
+}
+
+// PendingActionDecisionRequest for POST /admin/pending-actions
+type PendingActionDecisionRequest struct {
+	ActionID string `json:"action_id" binding:"required"`
+	Decision string `json:"decision" binding:"required,oneof=approve reject"`
+	Reason   string `json:"reason" binding:"max=500"`
+}
+
+// expire marks an overdue pending action expired
+func (a *PendingAction) expire(now time.Time) {
+	if a.Status == pendingActionPending && now.After(a.ExpiresAt) {
+		a.Status = pendingActionExpired
+	}
+}
+
+// savePendingAction stores an action until a window after it expires
+func savePendingAction(ctx context.Context, action *storedPendingAction) error {
+	data, err := json.Marshal(action)
+	if err != nil {
+		return err
+	}
+	ttl := time.Until(action.ExpiresAt.Add(config.DualControl.Window))
+	if err := keyedRecords().saveRecord(ctx, pendingActionRecord, action.ID, data, ttl); err != nil {
+		slog.Error("Record store write failed", "op", "pending_action", "error", err)
+		return errStoreUnavailable
+	}
+	return nil
+}
+
+// loadPendingAction returns an action, or nil if there is none
+func loadPendingAction(ctx context.Context, id string) (*storedPendingAction, error) {
+	data, found, err := keyedRecords().record(ctx, pendingActionRecord, id)
+	if err != nil {
+		slog.Error("Record store read failed", "op", "pending_action", "error", err)
+		return nil, errStoreUnavailable
+	}
+	if !found {
+		return nil, nil
+	}
+	var action storedPendingAction
+	if err := json.Unmarshal(data, &action); err != nil {
+		return nil, err
+	}
+	action.expire(time.Now())
+	return &action, nil
+}
+
+// ----------------------------------------------------------------------------
+// Middleware
+// ----------------------------------------------------------------------------
+
+// dualControl holds a route's requests for a second admin when action is
+// under dual control. applies, if set, picks which requests count from
+// the request and its body.
+func (s *Server) dualControl(action string, applies func(c *gin.Context, body []byte) bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !config.DualControl.Enabled || !slices.Contains(config.DualControl.Actions, action) {
+			c.Next()
+			return
+		}
+		if approval := c.GetHeader(approvedActionHeader); approval != "" {
+			if !redeemApproval(c.Request.Context(), approval, c.Request.Method, c.Request.URL.RequestURI()) {
+				respondError(c, http.StatusForbidden, codeForbidden, errInvalidApproval.Error())
+				c.Abort()
+				return
+			}
+			c.Next()
+			return
+		}
+
+		var body []byte
+		if c.Request.Body != nil {
+			var err error
+			if body, err = io.ReadAll(c.Request.Body); err != nil {
+				if limit, tooLarge := bodyTooLarge(err); tooLarge {
+					respondBodyTooLarge(c, limit)
+				} else {
+					respondError(c, http.StatusBadRequest, codeInvalidRequest, "Invalid request body")
+				}
+				c.Abort()
+				return
+			}
+			c.Request.Body = io.NopCloser(bytes.NewReader(body))
+		}
+		if applies != nil && !applies(c, body) {
+			c.Next()
+			return
+		}
+
+		user, _ := c.Get("user")
+		now := time.Now().UTC()
+		pending := &storedPendingAction{PendingAction: PendingAction{
+			ID:          uuid.New().String(),
+			Action:      action,
+			Method:      c.Request.Method,
+			Path:        c.Request.URL.RequestURI(),
+			Status:      pendingActionPending,
+			RequestedBy: user.(*User).ID,
+			RequestedAt: now,
+			ExpiresAt:   now.Add(config.DualControl.Window),
+		}}
+		if json.Valid(body) {
+			pending.Body = body
+		} else if len(body) > 0 {
+			pending.RawBody, pending.ContentType = body, c.ContentType()
+		}
+		if err := savePendingAction(c.Request.Context(), pending); err != nil {
+			respondServiceError(c, err)
+			c.Abort()
+			return
+		}
+		view := pending.PendingAction
+
+		s.svc.notifyActionPending(pending.RequestedBy, &view)
+		auditChange(c, "admin.action.request", "pending_action:"+pending.ID, nil, view)
+		c.JSON(http.StatusAccepted, gin.H{"message": "Waiting for a second administrator to approve", "pending_action": view})
+		c.Abort()
+	}
+}
+
+// redeemApproval checks a replayed request's approval and spends it; any
+// attempt spends it, so a grant can't be guessed at
+func redeemApproval(ctx context.Context, approval, method, path string) bool {
+	id, grant, _ := strings.Cut(approval, ".")
+	action, err := loadPendingAction(ctx, id)
+	if err != nil || action == nil || !action.Replaying || action.Method != method || action.Path != path {
+		return false
+	}
+	data, found, err := keyedRecords().takeRecord(ctx, actionGrantRecord, id)
+	var want string
+	if err != nil || !found || json.Unmarshal(data, &want) != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(want), []byte(grant)) == 1
+}
+
+// notifyActionPending tells every active admin but the requester
+func (s *Service) notifyActionPending(requesterID string, action *PendingAction) {
+	var admins []string
+	s.users.Each(func(u *User) {
+		if u.Role == "admin" && u.ID != requesterID && accountStatus(u) == UserActive {
+			admins = append(admins, u.ID)
+		}
+	})
+	for _, id := range admins {
+		notify(id, NotificationActionPending, "Admin action awaiting approval",
+			action.Method+" "+action.Path+" ("+action.Action+") needs a second administrator's approval.",
+			map[string]string{"action_id": action.ID})
+	}
+}
+
+// requestsAdminRole reports whether a user create or update body grants the
+// admin role
+func requestsAdminRole(_ *gin.Context, body []byte) bool {
+	var req struct {
+		Role *string `json:"role"`
+	}
+	return json.Unmarshal(body, &req) == nil && req.Role != nil && *req.Role == "admin"
+}
+
+// bulkUnregisters reports whether a bulk documents body unregisters for real
+func bulkUnregisters(_ *gin.Context, body []byte) bool {
+	var req struct {
+		Action string `json:"action"`
+		DryRun bool   `json:"dry_run"`
+	}
+	return json.Unmarshal(body, &req) == nil && req.Action == bulkUnregister && !req.DryRun
+}
+
+// restoresForReal reports whether a restore request is more than a dry run
+func restoresForReal(c *gin.Context, _ []byte) bool {
+	return c.Query("dry_run") != "true"
+}
+
+// mergesForReal reports whether an admin merge body is more than a dry run.
+// A body that doesn't parse is held too; the handler refuses it on replay.
+func mergesForReal(_ *gin.Context, body []byte) bool {
+	var req struct {
+		DryRun bool `json:"dry_run"`
+	}
+	return json.Unmarshal(body, &req) != nil || !req.DryRun
+}
+
+// ----------------------------------------------------------------------------
+// Handlers
+// ----------------------------------------------------------------------------
+
+// listPendingActions returns pending and recently decided actions, newest
+// first (admin only)
+func listPendingActions(c *gin.Context) {
+	status := c.Query("status")
+	records, err := keyedRecords().records(c.Request.Context(), pendingActionRecord)
+	if err != nil {
+		slog.Error("Record store read failed", "op", "pending_actions", "error", err)
+		respondServiceError(c, errStoreUnavailable)
+		return
+	}
+	now := time.Now()
+	actions := make([]PendingAction, 0, len(records))
+	for _, data := range records {
+		var action PendingAction
+		if json.Unmarshal(data, &action) != nil {
+			continue
+		}
+		action.expire(now)
+		if status == "" || action.Status == status {
+			actions = append(actions, action)
+		}
+	}
+
+	sort.Slice(actions, func(i, j int) bool { return actions[i].RequestedAt.After(actions[j].RequestedAt) })
+	c.JSON(http.StatusOK, gin.H{"actions": actions, "count": len(actions)})
+}
+
+// decidePendingAction approves or rejects a pending action (admin only).
+// Approval runs the original request and returns its outcome.
+func (s *Server) decidePendingAction(c *gin.Context) {
+	var req PendingActionDecisionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondBindError(c, err)
+		return
+	}
+	user, _ := c.Get("user")
+	admin := user.(*User)
+	approve := req.Decision == "approve"
+
+	ctx := c.Request.Context()
+	release, err := acquireLock(ctx, pendingActionRecord+":"+req.ActionID, config.Cluster.LockTTL)
+	if err != nil {
+		slog.Error("Pending action lock failed", "error", err)
+		respondServiceError(c, errStoreUnavailable)
+		return
+	}
+	defer release()
+	now := time.Now().UTC()
+	action, err := loadPendingAction(ctx, req.ActionID)
+	switch {
+	case err != nil:
+	case action == nil:
+		err = errPendingActionNotFound
+	case action.Status == pendingActionExpired:
+		err = errPendingActionExpired
+	case action.Status != pendingActionPending || action.Replaying:
+		err = errPendingActionDecided
+	case approve && action.RequestedBy == admin.ID:
+		err = errSelfApproval
+	}
+	if err != nil {
+		respondPendingActionError(c, err)
+		return
+	}
+	before := action.PendingAction
+	if !approve {
+		action.Status, action.DecidedBy, action.DecidedAt, action.Reason = pendingActionRejected, admin.ID, &now, req.Reason
+		if err := savePendingAction(ctx, action); err != nil {
+			respondServiceError(c, err)
+			return
+		}
+		after := action.PendingAction
+
+		auditChange(c, "admin.action.reject", "pending_action:"+action.ID, before, after)
+		c.JSON(http.StatusOK, gin.H{"message": "Action rejected", "pending_action": after})
+		return
+	}
+	raw := make([]byte, 16)
+	rand.Read(raw)
+	grant, _ := json.Marshal(hex.EncodeToString(raw))
+	if err := keyedRecords().saveRecord(ctx, actionGrantRecord, action.ID, grant, actionGrantTTL); err != nil {
+		slog.Error("Record store write failed", "op", "action_grant", "error", err)
+		respondServiceError(c, errStoreUnavailable)
+		return
+	}
+	action.Replaying = true
+	if err := savePendingAction(ctx, action); err != nil {
+		respondServiceError(c, err)
+		return
+	}
+	release()
+
+	result := s.replayAction(c, action, hex.EncodeToString(raw))
+
+	keyedRecords().deleteRecord(ctx, actionGrantRecord, action.ID)
+	action.Replaying = false
+	action.Status, action.DecidedBy, action.DecidedAt, action.Reason = pendingActionExecuted, admin.ID, &now, req.Reason
+	if result.Status >= http.StatusBadRequest {
+		action.Status = pendingActionFailed
+	}
+	action.Result = &result
+	if err := savePendingAction(ctx, action); err != nil {
+		// The action ran; only its record is stale
+		slog.Warn("Pending action outcome not saved", "action_id", action.ID, "error", err)
+	}
+	after := action.PendingAction
+
+	auditChange(c, "admin.action.approve", "pending_action:"+action.ID, before, after)
+	c.JSON(http.StatusOK, gin.H{"message": "Action approved", "pending_action": after})
+}
+
+// replayAction runs an approved request through the router as the approver
+func (s *Server) replayAction(c *gin.Context, action *storedPendingAction, grant string) PendingActionResult {
+	body, contentType := []byte(action.Body), "application/json"
+	if action.RawBody != nil {
+		body, contentType = action.RawBody, action.ContentType
+	}
+	sub, err := http.NewRequestWithContext(c.Request.Context(), action.Method, action.Path, bytes.NewReader(body))
+	if err != nil {
+		return PendingActionResult{Status: http.StatusInternalServerError}
+	}
+	sub.Header.Set("Authorization", c.GetHeader("Authorization"))
+	sub.Header.Set("Cookie", c.GetHeader("Cookie"))
+	sub.Header.Set(csrfHeader, c.GetHeader(csrfHeader))
+	sub.Header.Set(requestIDHeader, c.GetString(requestIDContextKey))
+	sub.Header.Set(approvedActionHeader, action.ID+"."+grant)
+	if len(body) > 0 && contentType != "" {
+		sub.Header.Set("Content-Type", contentType)
+	}
+	sub.RemoteAddr = c.Request.RemoteAddr
+
+	recorder := httptest.NewRecorder()
+	s.engine.ServeHTTP(recorder, sub)
+
+	result := PendingActionResult{Status: recorder.Code}
+	if body := bytes.TrimSpace(recorder.Body.Bytes()); json.Valid(body) {
+		result.Body = body
+	}
+	return result
+}
+
+// respondPendingActionError maps decision errors to responses
+func respondPendingActionError(c *gin.Context, err error) {
+	switch err {
+	case errPendingActionNotFound:
+		respondError(c, http.StatusNotFound, codeNotFound, err.Error())
+	case errSelfApproval:
+		respondError(c, http.StatusForbidden, codeForbidden, err.Error())
+	case errPendingActionDecided, errPendingActionExpired:
+		respondError(c, http.StatusConflict, codeConflict, err.Error())
+	default:
+		respondServiceError(c, err)
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+// useDualControl turns two-person approval on with no actions left over
+func useDualControl(t *testing.T) {
+	t.Helper()
+	withConfig(t, func(cfg *Config) { cfg.DualControl.Enabled = true })
+	reset := func() { localRecords = newMemoryRecords() }
+	reset()
+	t.Cleanup(reset)
+}
+
+type pendingActionResponse struct {
+	PendingAction PendingAction `json:"pending_action"`
+}
+
+func TestDualControlUserDelete(t *testing.T) {
+	ts := newTestServer(t)
+	useDualControl(t)
+	first, second := ts.admin("first@example.com"), ts.admin("second@example.com")
+	_, victim := ts.register("victim@example.com")
+
+	w := ts.do(http.MethodDelete, "/v1/admin/users/"+victim, first, "")
+	var requested pendingActionResponse
+	decodeJSON(t, w, &requested)
+	if w.Code != http.StatusAccepted || requested.PendingAction.Status != pendingActionPending {
+		t.Fatalf("request: %d %s", w.Code, w.Body)
+	}
+	if ts.srv.svc.users.ByID(victim) == nil {
+		t.Fatal("user deleted before approval")
+	}
+
+	decide := func(token, decision string) *pendingActionResponse {
+		w := ts.do(http.MethodPost, "/v1/admin/pending-actions", token,
+			`{"action_id":"`+requested.PendingAction.ID+`","decision":"`+decision+`"}`)
+		if w.Code != http.StatusOK {
+			t.Logf("%s: %d %s", decision, w.Code, w.Body)
+			return nil
+		}
+		var resp pendingActionResponse
+		decodeJSON(t, w, &resp)
+		return &resp
+	}
+	if decide(first, "approve") != nil {
+		t.Fatal("requester approved their own action")
+	}
+	approved := decide(second, "approve")
+	if approved == nil || approved.PendingAction.Status != pendingActionExecuted || approved.PendingAction.Result.Status != http.StatusOK {
+		t.Fatalf("approve: %+v", approved)
+	}
+	if ts.srv.svc.users.ByID(victim) != nil {
+		t.Fatal("user not deleted after approval")
+	}
+	if decide(second, "approve") != nil {
+		t.Fatal("action approved twice")
+	}
+
+	// The approval can't be replayed from outside
+	w = ts.do(http.MethodDelete, "/v1/admin/users/"+victim, first, "", approvedActionHeader, requested.PendingAction.ID+".guess")
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("forged approval: %d %s", w.Code, w.Body)
+	}
+}
+
+func TestDualControlSelectsRequests(t *testing.T) {
+	ts := newTestServer(t)
+	useDualControl(t)
+	first := ts.admin("first@example.com")
+	_, id := ts.register("user@example.com")
+
+	// Renaming is not high-risk; granting admin is
+	if w := ts.do(http.MethodPatch, "/v1/admin/users/"+id, first, `{"name":"Renamed"}`); w.Code != http.StatusOK {
+		t.Fatalf("rename: %d %s", w.Code, w.Body)
+	}
+	if w := ts.do(http.MethodPatch, "/v1/admin/users/"+id, first, `{"role":"admin"}`); w.Code != http.StatusAccepted {
+		t.Fatalf("escalation: %d %s", w.Code, w.Body)
+	}
+	bulk := "/v1/admin/users/" + id + "/documents:bulk"
+	if w := ts.do(http.MethodPost, bulk, first, `{"action":"unregister","filenames":["a.pdf"],"dry_run":true}`); w.Code != http.StatusOK {
+		t.Fatalf("dry run: %d %s", w.Code, w.Body)
+	}
+	if w := ts.do(http.MethodPost, bulk, first, `{"action":"unregister","filenames":["a.pdf"]}`); w.Code != http.StatusAccepted {
+		t.Fatalf("bulk unregister: %d %s", w.Code, w.Body)
+	}
+
+	// The requester may withdraw their own
+	var list struct {
+		Actions []PendingAction `json:"actions"`
+	}
+	decodeJSON(t, ts.do(http.MethodGet, "/v1/admin/pending-actions?status=pending", first, ""), &list)
+	if len(list.Actions) != 2 || list.Actions[0].Action != dualControlBulkUnregister {
+		t.Fatalf("pending: %+v", list.Actions)
+	}
+	w := ts.do(http.MethodPost, "/v1/admin/pending-actions", first, `{"action_id":"`+list.Actions[0].ID+`","decision":"reject","reason":"wrong user"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("withdraw: %d %s", w.Code, w.Body)
+	}
+
+	withConfig(t, func(cfg *Config) { cfg.DualControl.Enabled = false })
+	if w := ts.do(http.MethodPatch, "/v1/admin/users/"+id, first, `{"role":"admin"}`); w.Code != http.StatusOK {
+		t.Fatalf("dual control off: %d %s", w.Code, w.Body)
+	}
+}
+
+// decideAction approves or rejects a pending action and returns the response
+func (ts *testServer) decideAction(token, id, decision string) *httptest.ResponseRecorder {
+	ts.t.Helper()
+	return ts.do(http.MethodPost, "/v1/admin/pending-actions", token, `{"action_id":"`+id+`","decision":"`+decision+`"}`)
+}
+
+func TestDualControlRestoreAndMerge(t *testing.T) {
+	ts := newTestServer(t)
+	useDualControl(t)
+	withConfig(t, func(cfg *Config) { cfg.Backup.Passphrase = testBackupPassphrase })
+	first, second := ts.admin("first@example.com"), ts.admin("second@example.com")
+	_, targetID := ts.register("target@example.com")
+	_, sourceID := ts.register("source@example.com")
+	archive := ts.do(http.MethodPost, "/v1/admin/backup", first, "").Body.String()
+	_, laterID := ts.register("later@example.com")
+
+	// Dry runs go through; the real thing waits, archive and all
+	restore := func(query string) *httptest.ResponseRecorder {
+		return ts.do(http.MethodPost, "/v1/admin/restore"+query, first, archive, "Content-Type", "application/octet-stream")
+	}
+	if w := restore("?dry_run=true"); w.Code != http.StatusOK {
+		t.Fatalf("restore dry run: %d %s", w.Code, w.Body)
+	}
+	w := restore("")
+	var requested pendingActionResponse
+	decodeJSON(t, w, &requested)
+	if w.Code != http.StatusAccepted || requested.PendingAction.Action != dualControlRestore || requested.PendingAction.Body != nil {
+		t.Fatalf("restore: %d %s", w.Code, w.Body)
+	}
+	if ts.srv.svc.users.ByID(laterID) == nil {
+		t.Fatal("restored before approval")
+	}
+	var approved pendingActionResponse
+	decodeJSON(t, ts.decideAction(second, requested.PendingAction.ID, "approve"), &approved)
+	if result := approved.PendingAction.Result; result == nil || result.Status != http.StatusOK {
+		t.Fatalf("restore approval: %+v", approved.PendingAction)
+	}
+	if ts.srv.svc.users.ByID(laterID) != nil {
+		t.Fatal("approved restore not applied")
+	}
+
+	merge := "/v1/admin/users/" + targetID + "/merge"
+	if w := ts.do(http.MethodPost, merge, first, `{"source_id":"`+sourceID+`","dry_run":true}`); w.Code != http.StatusOK {
+		t.Fatalf("merge dry run: %d %s", w.Code, w.Body)
+	}
+	w = ts.do(http.MethodPost, merge, first, `{"source_id":"`+sourceID+`"}`)
+	decodeJSON(t, w, &requested)
+	if w.Code != http.StatusAccepted || requested.PendingAction.Action != dualControlUserMerge {
+		t.Fatalf("merge: %d %s", w.Code, w.Body)
+	}
+	if source := ts.srv.svc.users.ByID(sourceID); source.Status == UserMerged {
+		t.Fatal("merged before approval")
+	}
+	decodeJSON(t, ts.decideAction(second, requested.PendingAction.ID, "approve"), &approved)
+	if approved.PendingAction.Status != pendingActionExecuted || ts.srv.svc.users.ByID(sourceID).Status != UserMerged {
+		t.Fatalf("merge approval: %+v", approved.PendingAction)
+	}
+}
+
+func TestDualControlAcrossReplicas(t *testing.T) {
+	ts := newTestServer(t)
+	useDualControl(t)
+	first, second, third := ts.admin("first@example.com"), ts.admin("second@example.com"), ts.admin("third@example.com")
+	_, victim := ts.register("victim@example.com")
+	useSharedStore(t)
+
+	w := ts.do(http.MethodDelete, "/v1/admin/users/"+victim, first, "")
+	var requested pendingActionResponse
+	decodeJSON(t, w, &requested)
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("request: %d %s", w.Code, w.Body)
+	}
+	// Kept where every replica can see it
+	if _, found, err := clusterStore.record(context.Background(), pendingActionRecord, requested.PendingAction.ID); err != nil || !found {
+		t.Fatalf("pending action not in the shared store: %v, %v", found, err)
+	}
+
+	// Two admins approving at once run it once
+	codes := make(chan int, 2)
+	for _, token := range []string{second, third} {
+		go func(token string) { codes <- ts.decideAction(token, requested.PendingAction.ID, "approve").Code }(token)
+	}
+	got := []int{<-codes, <-codes}
+	slices.Sort(got)
+	if got[0] != http.StatusOK || got[1] != http.StatusConflict {
+		t.Fatalf("concurrent approvals: %v, want one 200 and one 409", got)
+	}
+	if ts.srv.svc.users.ByID(victim) != nil {
+		t.Fatal("user not deleted after approval")
+	}
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// ============================================================================
+// Error Reporting
+// ============================================================================
+//
+// Panics and 5xx responses (REST and gRPC) are reported to an error tracker
+// (error_reporting.backend): Sentry via its DSN, or a generic JSON webhook.
+// Reports carry the route, status, request ID and user ID so they can be
+// matched with the logs, but never the client address, query string,
+// headers or email addresses, and messages pass through the log redactor.
+// Every report is tagged with the release (error_reporting.release, else
+// the build's VCS revision). 503s are left out: they are what maintenance
+// and draining return on purpose. Like SIEM export, reporting is
+// best-effort and drops reports rather than slowing requests.
+
+const (
+	errorReportingNone    = "none"
+	errorReportingSentry  = "sentry"
+	errorReportingWebhook = "webhook"
+
+	errorReportQueueSize = 256
+
+	// errorReportedKey marks a request whose failure was already reported
+	errorReportedKey = "error_reported"
+	// problemDetailKey holds the detail of a 5xx problem response
+	problemDetailKey = "problem_detail"
+)
+
+// ErrorReport is one captured failure
+type ErrorReport struct {
+	ID          string    `json:"id"`
+	Timestamp   time.Time `json:"timestamp"`
+	Level       string    `json:"level"` // error | fatal (panics)
+	Message     string    `json:"message"`
+	Stack       string    `json:"stack,omitempty"`
+	Release     string    `json:"release"`
+	Environment string    `json:"environment,omitempty"`
+	ServerName  string    `json:"server_name,omitempty"`
+	Transport   string    `json:"transport"` // http | grpc
+	Method      string    `json:"method"`    // HTTP method or gRPC full method
+	Route       string    `json:"route,omitempty"`
+	Status      string    `json:"status"` // HTTP status or gRPC code
+	RequestID   string    `json:"request_id,omitempty"`
+	UserID      string    `json:"user_id,omitempty"`
+}
+
+// errorReporter delivers reports to a tracking backend
+type errorReporter interface {
+	send(report ErrorReport) error
+}
+
+var (
+	errorReports        = make(chan ErrorReport, errorReportQueueSize)
+	droppedErrorReports atomic.Uint64
+	errorReportingReady atomic.Bool
+	errorReportClient   = &http.Client{Timeout: 10 * time.Second}
+	serviceRelease      string
+	serverName, _       = os.Hostname()
+)
+
+// buildRelease returns the configured release or the build's VCS revision
+func buildRelease() string {
+	if config.ErrorReporting.Release != "" {
+		return config.ErrorReporting.Release
+	}
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	revision, dirty := "", false
+	for _, setting := range info.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			revision = setting.Value
+		case "vcs.modified":
+			dirty = setting.Value == "true"
+		}
+	}
+	if revision == "" {
+		return "unknown"
+	}
+	if len(revision) > 12 {
+		revision = revision[:12]
+	}
+	if dirty {
+		revision += "-dirty"
+	}
+	return revision
+}
+
+// newErrorReporter builds the configured reporter; nil when disabled
+func newErrorReporter(cfg ErrorReportingConfig) (errorReporter, error) {
+	switch cfg.Backend {
+	case errorReportingSentry:
+		return newSentryReporter(cfg.DSN)
+	case errorReportingWebhook:
+		if u, err := url.Parse(cfg.WebhookURL); err != nil || u.Scheme == "" || u.Host == "" {
+			return nil, fmt.Errorf("webhook_url must be an absolute URL")
+		}
+		return webhookReporter{url: cfg.WebhookURL}, nil
+	}
+	return nil, nil
+}
+
+// startErrorReporting starts the reporter if a backend is configured
+func startErrorReporting() {
+	serviceRelease = buildRelease()
+	reporter, err := newErrorReporter(config.ErrorReporting)
+	if err != nil {
+		fatal("Invalid error reporting configuration", "error", err)
+	}
+	if reporter == nil {
+		return
+	}
+
+	errorReportingReady.Store(true)
+	slog.Info("Error reporting enabled", "backend", config.ErrorReporting.Backend, "release", serviceRelease)
+
+	goBackground(func(ctx context.Context) {
+		deliver := func(report ErrorReport) {
+			if err := reporter.send(report); err != nil {
+				slog.Warn("Error report delivery failed", "report_id", report.ID, "error", err)
+			}
+		}
+		for {
+			select {
+			case report := <-errorReports:
+				deliver(report)
+			case <-ctx.Done():
+				for {
+					select {
+					case report := <-errorReports:
+						deliver(report)
+					default:
+						return
+					}
+				}
+			}
+		}
+	})
+}
+
+// reportError puts a failure on the admin feed (adminevents.go), fills the
+// common fields and queues a report without blocking
+func reportError(report ErrorReport) {
+	report.Timestamp = time.Now().UTC()
+	report.Message = redactString(report.Message)
+	publishAdminEvent(AdminEvent{Type: AdminEventServerError, At: report.Timestamp, UserID: report.UserID, Outcome: "failure",
+		Details: map[string]string{"transport": report.Transport, "method": report.Method, "route": report.Route,
+			"status": report.Status, "request_id": report.RequestID, "message": report.Message}})
+	if !errorReportingReady.Load() {
+		return
+	}
+	report.ID = strings.ReplaceAll(uuid.New().String(), "-", "")
+	report.Release = serviceRelease
+	report.Environment = config.ErrorReporting.Environment
+	report.ServerName = serverName
+
+	select {
+	case errorReports <- report:
+	default:
+		if droppedErrorReports.Add(1)%100 == 1 {
+			slog.Warn("Error report queue full", "dropped_total", droppedErrorReports.Load())
+		}
+	}
+}
+
+// httpErrorReport describes a failed request
+func httpErrorReport(c *gin.Context, level, message string) ErrorReport {
+	report := ErrorReport{
+		Level:     level,
+		Message:   message,
+		Transport: "http",
+		Method:    c.Request.Method,
+		Route:     c.FullPath(),
+		Status:    strconv.Itoa(c.Writer.Status()),
+		RequestID: c.GetString(requestIDContextKey),
+	}
+	if user, exists := c.Get("user"); exists {
+		report.UserID = user.(*User).ID
+	}
+	return report
+}
+
+// reportPanic reports a recovered panic from an HTTP handler
+func reportPanic(c *gin.Context, recovered any, stack []byte) {
+	report := httpErrorReport(c, "fatal", fmt.Sprint("panic: ", recovered))
+	report.Status = strconv.Itoa(http.StatusInternalServerError)
+	report.Stack = string(stack)
+	reportError(report)
+	c.Set(errorReportedKey, true)
+}
+
+// reportServerError reports a finished request that answered 5xx
+func reportServerError(c *gin.Context) {
+	status := c.Writer.Status()
+	if status < 500 || status == http.StatusServiceUnavailable || c.GetBool(errorReportedKey) {
+		return
+	}
+	message := c.GetString(problemDetailKey)
+	if len(c.Errors) > 0 {
+		message = c.Errors.String()
+	}
+	if message == "" {
+		message = http.StatusText(status)
+	}
+	reportError(httpErrorReport(c, "error", message))
+}
+
+// grpcReportErrors recovers panics in gRPC handlers and reports them and
+// Internal or Unknown errors, mirroring recoverPanics for the REST API
+func grpcReportErrors(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{}, err error) {
+	report := func(level, message string, code codes.Code) ErrorReport {
+		r := ErrorReport{Level: level, Message: message, Transport: "grpc", Method: info.FullMethod, Status: code.String()}
+		if user := grpcUser(ctx); user != nil {
+			r.UserID = user.ID
+		}
+		return r
+	}
+
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			stack := debug.Stack()
+			slog.Error("Panic recovered",
+				"method", info.FullMethod,
+				"panic", fmt.Sprint(recovered),
+				"stack", string(stack))
+			r := report("fatal", fmt.Sprint("panic: ", recovered), codes.Internal)
+			r.Stack = string(stack)
+			reportError(r)
+			resp, err = nil, status.Error(codes.Internal, "Internal server error")
+		}
+	}()
+
+	resp, err = handler(ctx, req)
+	if code := status.Code(err); code == codes.Internal || code == codes.Unknown {
+		reportError(report("error", status.Convert(err).Message(), code))
+	}
+	return resp, err
+}
+
+// webhookReporter posts each report as JSON
+type webhookReporter struct {
+	url string
+}
+
+func (w webhookReporter) send(report ErrorReport) error {
+	body, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	resp, err := errorReportClient.Post(w.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+// sentryReporter sends events to Sentry's store endpoint
+type sentryReporter struct {
+	endpoint  string
+	publicKey string
+}
+
+// newSentryReporter parses a DSN such as
+// https://<key>@o0.ingest.sentry.io/<project>
+func newSentryReporter(dsn string) (sentryReporter, error) {
+	u, err := url.Parse(dsn)
+	if err != nil || u.Host == "" || u.User == nil || u.User.Username() == "" {
+		return sentryReporter{}, fmt.Errorf("dsn must look like https://<key>@host/<project>")
+	}
+	path := strings.Trim(u.Path, "/")
+	prefix, project := "", path
+	if i := strings.LastIndex(path, "/"); i >= 0 {
+		prefix, project = "/"+path[:i], path[i+1:]
+	}
+	if project == "" {
+		return sentryReporter{}, fmt.Errorf("dsn has no project ID")
+	}
+	return sentryReporter{
+		endpoint:  fmt.Sprintf("%s://%s%s/api/%s/store/", u.Scheme, u.Host, prefix, project),
+		publicKey: u.User.Username(),
+	}, nil
+}
+
+func (s sentryReporter) send(report ErrorReport) error {
+	extra := map[string]string{"request_id": report.RequestID}
+	if report.Stack != "" {
+		extra["stack"] = report.Stack
+	}
+	event := gin.H{
+		"event_id":    report.ID,
+		"timestamp":   report.Timestamp.Format(time.RFC3339),
+		"platform":    "go",
+		"level":       report.Level,
+		"logger":      "auth-service",
+		"server_name": report.ServerName,
+		"release":     report.Release,
+		"environment": report.Environment,
+		"message":     gin.H{"formatted": report.Message},
+		"tags": gin.H{
+			"transport": report.Transport,
+			"method":    report.Method,
+			"route":     report.Route,
+			"status":    report.Status,
+		},
+		"extra": extra,
+	}
+	if report.UserID != "" {
+		event["user"] = gin.H{"id": report.UserID}
+	}
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, s.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Sentry-Auth", fmt.Sprintf(
+		"Sentry sentry_version=7, sentry_client=auth-service/%s, sentry_key=%s", report.Release, s.publicKey))
+
+	resp, err := errorReportClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("sentry returned %s", resp.Status)
+	}
+	return nil
+}
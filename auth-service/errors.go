@@ -0,0 +1,303 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"reflect"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/go-playground/validator/v10"
+	"github.com/google/uuid"
+)
+
+// ============================================================================
+// Error Responses
+// ============================================================================
+//
+// Every error is an RFC 7807 problem+json body with a stable machine-readable
+// code. Clients should branch on "code"; "detail" is for humans and may
+// change. "error" repeats the detail for clients written before the
+// envelope existed.
+
+// Stable error codes
+const (
+	codeInvalidRequest        = "invalid_request"
+	codeValidationFailed      = "validation_failed"
+	codeUnauthorized          = "unauthorized"
+	codeInvalidToken          = "invalid_token"
+	codeSessionIdle           = "session_idle"
+	codeInvalidCredentials    = "invalid_credentials"
+	codeForbidden             = "forbidden"
+	codeCSRFFailed            = "csrf_failed"
+	codeStepUpRequired        = "step_up_required"
+	codeAdminRequired         = "admin_required"
+	codeAccountDisabled       = "account_disabled"
+	codeLastAdmin             = "last_admin"
+	codeApprovalPending       = "approval_pending"
+	codeAccountMerged         = "account_merged"
+	codeRegistrationClosed    = "registration_closed"
+	codeEmailDomainNotAllowed = "email_domain_not_allowed"
+	codeWeakPassword          = "weak_password"
+	codeInvalidReferralCode   = "invalid_referral_code"
+	codeNotFound              = "not_found"
+	codeConflict              = "conflict"
+	codeEmailTaken            = "email_taken"
+	codePhoneTaken            = "phone_taken"
+	codeInvalidCode           = "invalid_code"
+	codeDocumentOwned         = "document_owned"
+	codeIdempotencyMismatch   = "idempotency_key_mismatch"
+	codeIdempotencyInProgress = "idempotency_in_progress"
+	codeRateLimited           = "rate_limited"
+	codeQuotaExceeded         = "quota_exceeded"
+	codeIPBlocked             = "ip_blocked"
+	codePayloadTooLarge       = "payload_too_large"
+	codeUnsupportedMediaType  = "unsupported_media_type"
+	codePreconditionFailed    = "precondition_failed"
+	codeNotConfigured         = "not_configured"
+	codeUpstreamUnavailable   = "upstream_unavailable"
+	codeMaintenance           = "maintenance"
+	codeStoreUnavailable      = "store_unavailable"
+	codeQueueFull             = "queue_full"
+	codeServerBusy            = "server_busy"
+	codeUnsupportedVersion    = "unsupported_api_version"
+	codeInsufficientScope     = "insufficient_scope"
+	codeInvalidGrant          = "invalid_grant"
+	codeInvalidScope          = "invalid_scope"
+	codeUnsupportedGrantType  = "unsupported_grant_type"
+	codeInternal              = "internal_error"
+
+	codeInvalidClient           = "invalid_client"
+	codeUnsupportedResponseType = "unsupported_response_type"
+	codeReauthRequired          = "reauthentication_required"
+	codeCaptchaRequired         = "captcha_required"
+	codeInvalidSignature        = "invalid_signature"
+	codeFileTypeNotAllowed      = "file_type_not_allowed"
+)
+
+const (
+	requestIDHeader     = "X-Request-ID"
+	problemContentType  = "application/problem+json"
+	maxRequestIDLength  = 128
+	requestIDContextKey = "request_id"
+)
+
+// FieldError describes one invalid request field
+type FieldError struct {
+	Field   string `json:"field"`
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+// Problem is an RFC 7807 problem details body
+type Problem struct {
+	Type      string       `json:"type"`
+	Title     string       `json:"title"`
+	Status    int          `json:"status"`
+	Code      string       `json:"code"`
+	Detail    string       `json:"detail"`
+	Instance  string       `json:"instance,omitempty"`
+	RequestID string       `json:"request_id,omitempty"`
+	Errors    []FieldError `json:"errors,omitempty"`
+	Error     string       `json:"error"` // deprecated: same as detail
+
+	// Extensions are extra members merged into the body (e.g. campaign_id)
+	Extensions map[string]interface{} `json:"-"`
+}
+
+// MarshalJSON merges extension members into the problem body
+func (p Problem) MarshalJSON() ([]byte, error) {
+	type plain Problem
+	body, err := json.Marshal(plain(p))
+	if err != nil || len(p.Extensions) == 0 {
+		return body, err
+	}
+
+	members := make(map[string]interface{})
+	if err := json.Unmarshal(body, &members); err != nil {
+		return nil, err
+	}
+	for key, value := range p.Extensions {
+		if _, reserved := members[key]; !reserved {
+			members[key] = value
+		}
+	}
+	return json.Marshal(members)
+}
+
+func init() {
+	// Report JSON field names rather than Go field names in validation errors
+	if v, ok := binding.Validator.Engine().(*validator.Validate); ok {
+		v.RegisterTagNameFunc(func(field reflect.StructField) string {
+			name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+			if name == "-" {
+				return ""
+			}
+			if name == "" {
+				return field.Name
+			}
+			return name
+		})
+	}
+}
+
+// requestID assigns each request an ID, reusing the caller's X-Request-ID
+// when it is reasonable, and echoes it on the response
+func requestID() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader(requestIDHeader)
+		if id == "" || len(id) > maxRequestIDLength {
+			id = uuid.New().String()
+		}
+		c.Set(requestIDContextKey, id)
+		c.Header(requestIDHeader, id)
+		c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), requestIDKey{}, id))
+		c.Next()
+	}
+}
+
+// respondProblem writes a problem body, filling in the common members
+func respondProblem(c *gin.Context, p Problem) {
+	if p.Type == "" {
+		p.Type = "about:blank"
+	}
+	if p.Status >= 500 {
+		c.Set(problemDetailKey, p.Detail) // logged in English
+	}
+	lang := requestLanguage(c)
+	p.Title = translate(lang, http.StatusText(p.Status))
+	p.Detail = translate(lang, p.Detail)
+	p.Instance = c.Request.URL.Path
+	p.RequestID = c.GetString(requestIDContextKey)
+	p.Error = p.Detail
+
+	c.Header("Content-Type", problemContentType)
+	c.Header("Content-Language", lang)
+	c.Writer.Header().Add("Vary", "Accept-Language")
+	c.JSON(p.Status, p)
+}
+
+// respondError writes a problem with a code and detail message
+func respondError(c *gin.Context, status int, code, detail string) {
+	respondProblem(c, Problem{Status: status, Code: code, Detail: detail})
+}
+
+// respondBindError reports a request body that failed to bind, with
+// per-field details for validation failures and unknown fields
+func respondBindError(c *gin.Context, err error) {
+	if limit, tooLarge := bodyTooLarge(err); tooLarge {
+		respondBodyTooLarge(c, limit)
+		return
+	}
+	lang := requestLanguage(c)
+	if field, unknown := strings.CutPrefix(err.Error(), "json: unknown field "); unknown {
+		field = strings.Trim(field, `"`)
+		respondProblem(c, Problem{
+			Status: http.StatusBadRequest,
+			Code:   codeValidationFailed,
+			Detail: fmt.Sprintf(translate(lang, "Invalid request: unknown field %s"), field),
+			Errors: []FieldError{{Field: field, Rule: "unknown", Message: fmt.Sprintf(translate(lang, "%s is not a recognised field"), field)}},
+		})
+		return
+	}
+
+	var validationErrs validator.ValidationErrors
+	if !errors.As(err, &validationErrs) {
+		respondError(c, http.StatusBadRequest, codeInvalidRequest, "Invalid request: "+err.Error())
+		return
+	}
+
+	fields := make([]FieldError, 0, len(validationErrs))
+	for _, fe := range validationErrs {
+		fields = append(fields, FieldError{
+			Field:   fe.Field(),
+			Rule:    fe.Tag(),
+			Message: fieldMessage(lang, fe),
+		})
+	}
+	respondProblem(c, Problem{
+		Status: http.StatusBadRequest,
+		Code:   codeValidationFailed,
+		Detail: "Invalid request: one or more fields are invalid",
+		Errors: fields,
+	})
+}
+
+// fieldMessage renders a validation failure as a sentence in lang; the
+// field name itself stays as sent
+func fieldMessage(lang string, fe validator.FieldError) string {
+	switch fe.Tag() {
+	case "required":
+		return fmt.Sprintf(translate(lang, "%s is required"), fe.Field())
+	case "email":
+		return fmt.Sprintf(translate(lang, "%s must be a valid email address"), fe.Field())
+	case "min":
+		return fmt.Sprintf(translate(lang, "%s must be at least %s characters"), fe.Field(), fe.Param())
+	case "max":
+		return fmt.Sprintf(translate(lang, "%s must be at most %s characters"), fe.Field(), fe.Param())
+	case "oneof":
+		return fmt.Sprintf(translate(lang, "%s must be one of: %s"), fe.Field(), fe.Param())
+	case "e164":
+		return fmt.Sprintf(translate(lang, "%s must be a phone number such as +14155550100"), fe.Field())
+	}
+	return fmt.Sprintf(translate(lang, "%s failed the %s check"), fe.Field(), fe.Tag())
+}
+
+// respondServiceError maps service-layer errors to problems
+func respondServiceError(c *gin.Context, err error) {
+	switch err {
+	case errEmailTaken:
+		respondError(c, http.StatusConflict, codeEmailTaken, err.Error())
+	case errDocumentOwned:
+		respondError(c, http.StatusConflict, codeDocumentOwned, err.Error())
+	case errInvalidCredentials:
+		respondError(c, http.StatusUnauthorized, codeInvalidCredentials, err.Error())
+	case errInvalidToken, errInvalidClaims, errUserNotFound, errTokenRevoked, errInvalidRefreshToken:
+		respondError(c, http.StatusUnauthorized, codeInvalidToken, err.Error())
+	case errSessionIdle:
+		respondError(c, http.StatusUnauthorized, codeSessionIdle, err.Error())
+	case errReauthRequired:
+		respondError(c, http.StatusUnauthorized, codeReauthRequired, err.Error())
+	case errDocumentNotFound, errDeviceNotFound:
+		respondError(c, http.StatusNotFound, codeNotFound, err.Error())
+	case errNotDocumentOwner:
+		respondError(c, http.StatusForbidden, codeForbidden, err.Error())
+	case errAccountDisabled:
+		respondError(c, http.StatusForbidden, codeAccountDisabled, err.Error())
+	case errApprovalPending:
+		respondError(c, http.StatusForbidden, codeApprovalPending, err.Error())
+	case errAccountMerged:
+		respondError(c, http.StatusForbidden, codeAccountMerged, err.Error())
+	case errRegistrationClosed:
+		respondError(c, http.StatusForbidden, codeRegistrationClosed, err.Error())
+	case errEmailDomainNotAllowed:
+		respondError(c, http.StatusForbidden, codeEmailDomainNotAllowed, err.Error())
+	case errWeakPassword:
+		respondError(c, http.StatusBadRequest, codeWeakPassword, err.Error())
+	case errInvalidReferralCode:
+		respondError(c, http.StatusBadRequest, codeInvalidReferralCode, err.Error())
+	case errStepUpRequired:
+		respondError(c, http.StatusForbidden, codeStepUpRequired, err.Error())
+	case errInsufficientScope:
+		respondError(c, http.StatusForbidden, codeInsufficientScope, err.Error())
+	case errStoreUnavailable:
+		respondError(c, http.StatusServiceUnavailable, codeStoreUnavailable, err.Error())
+	case errQueueFull:
+		c.Header("Retry-After", "30")
+		respondError(c, http.StatusServiceUnavailable, codeQueueFull, err.Error())
+	case errPasswordBusy:
+		c.Header("Retry-After", "1")
+		respondError(c, http.StatusServiceUnavailable, codeServerBusy, err.Error())
+	default:
+		// Unexpected errors can carry upstream URLs or store messages; keep
+		// them in the logs (and error reports, via c.Errors)
+		slog.Error("Request failed", "request_id", c.GetString(requestIDContextKey), "error", err)
+		c.Error(err)
+		respondError(c, http.StatusInternalServerError, codeInternal, "Internal server error")
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// etagRouter serves the profile and document listing for one user
+func etagRouter(user *User) *gin.Engine {
+	s := &Server{svc: defaultService}
+	r := gin.New()
+	r.Use(func(c *gin.Context) { c.Set("user", user) })
+	r.GET("/v1/profile", s.getProfile)
+	r.PUT("/v1/profile", s.updateProfile)
+	r.GET("/v1/documents/mine", s.getMyDocuments)
+	return r
+}
+
+func sendWithHeaders(r http.Handler, method, path, body string, headers map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestProfileConditionalGet(t *testing.T) {
+	r := etagRouter(&User{ID: "u1", Name: "A", UpdatedAt: time.Now()})
+
+	first := sendWithHeaders(r, http.MethodGet, "/v1/profile", "", nil)
+	etag := first.Header().Get("ETag")
+	if first.Code != http.StatusOK || etag == "" {
+		t.Fatalf("got %d with ETag %q", first.Code, etag)
+	}
+
+	for _, header := range []string{etag, "W/" + etag, `"other", ` + etag, "*"} {
+		w := sendWithHeaders(r, http.MethodGet, "/v1/profile", "", map[string]string{"If-None-Match": header})
+		if w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+			t.Errorf("If-None-Match %s: got %d, want 304 without a body", header, w.Code)
+		}
+	}
+	w := sendWithHeaders(r, http.MethodGet, "/v1/profile", "", map[string]string{"If-None-Match": `"stale"`})
+	if w.Code != http.StatusOK {
+		t.Fatalf("stale If-None-Match: got %d, want 200", w.Code)
+	}
+}
+
+func TestProfileIfMatch(t *testing.T) {
+	r := etagRouter(&User{ID: "u1", Name: "A", UpdatedAt: time.Now().Add(-time.Minute)})
+	etag := sendWithHeaders(r, http.MethodGet, "/v1/profile", "", nil).Header().Get("ETag")
+
+	w := sendWithHeaders(r, http.MethodPut, "/v1/profile", `{"name":"B"}`, map[string]string{"If-Match": `"stale"`})
+	if w.Code != http.StatusPreconditionFailed || w.Header().Get("ETag") != etag {
+		t.Fatalf("stale If-Match: got %d with ETag %q, want 412 with %q", w.Code, w.Header().Get("ETag"), etag)
+	}
+
+	// If-Match is a strong comparison
+	w = sendWithHeaders(r, http.MethodPut, "/v1/profile", `{"name":"B"}`, map[string]string{"If-Match": "W/" + etag})
+	if w.Code != http.StatusPreconditionFailed {
+		t.Fatalf("weak If-Match: got %d, want 412", w.Code)
+	}
+
+	w = sendWithHeaders(r, http.MethodPut, "/v1/profile", `{"name":"B"}`, map[string]string{"If-Match": etag})
+	updated := w.Header().Get("ETag")
+	if w.Code != http.StatusOK || updated == "" || updated == etag {
+		t.Fatalf("current If-Match: got %d with ETag %q", w.Code, updated)
+	}
+
+	// The old tag no longer validates the cache or a second edit
+	if w := sendWithHeaders(r, http.MethodGet, "/v1/profile", "", map[string]string{"If-None-Match": etag}); w.Code != http.StatusOK {
+		t.Fatalf("old tag after update: got %d, want 200", w.Code)
+	}
+	if w := sendWithHeaders(r, http.MethodPut, "/v1/profile", `{"name":"C"}`, map[string]string{"If-Match": etag}); w.Code != http.StatusPreconditionFailed {
+		t.Fatalf("lost update: got %d, want 412", w.Code)
+	}
+
+	// Without If-Match the edit goes through
+	if w := sendWithHeaders(r, http.MethodPut, "/v1/profile", `{"name":"C"}`, nil); w.Code != http.StatusOK {
+		t.Fatalf("unconditional update: got %d, want 200", w.Code)
+	}
+}
+
+func TestDocumentListingETagFollowsChanges(t *testing.T) {
+	r := etagRouter(&User{ID: "u1"})
+	etag := sendWithHeaders(r, http.MethodGet, "/v1/documents/mine", "", nil).Header().Get("ETag")
+
+	if w := sendWithHeaders(r, http.MethodGet, "/v1/documents/mine", "", map[string]string{"If-None-Match": etag}); w.Code != http.StatusNotModified {
+		t.Fatalf("unchanged listing: got %d, want 304", w.Code)
+	}
+
+	bumpDocVersion()
+	if w := sendWithHeaders(r, http.MethodGet, "/v1/documents/mine", "", map[string]string{"If-None-Match": etag}); w.Code != http.StatusOK {
+		t.Fatalf("after a document change: got %d, want 200", w.Code)
+	}
+
+	// Listings embed owner names
+	etag = sendWithHeaders(r, http.MethodGet, "/v1/documents/mine", "", nil).Header().Get("ETag")
+	bumpUserVersion()
+	if w := sendWithHeaders(r, http.MethodGet, "/v1/documents/mine", "", map[string]string{"If-None-Match": etag}); w.Code != http.StatusOK {
+		t.Fatalf("after a user change: got %d, want 200", w.Code)
+	}
+}
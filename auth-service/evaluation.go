@@ -0,0 +1,733 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// ============================================================================
+// RAG Evaluation
+// ============================================================================
+//
+// Admins keep golden sets: questions with the answer and the source
+// documents a good response should have, each set scoped to a collection
+// (a document tag, chunking.go) or to every document. A run asks each
+// question through the backend's /chat endpoint, limited to the set's
+// collection, and scores the response:
+//
+//   - precision: share of the retrieved documents that were expected
+//   - recall: share of the expected documents that were retrieved
+//   - faithfulness: share of the answer's content words found in the
+//     retrieved chunks, a lexical stand-in for "grounded in the context"
+//   - answer_similarity: token F1 between the answer and the expected one
+//
+// A metric is left out for a question that can't be scored on it (no
+// expected sources, say), and a run's metrics average the questions that
+// could be. Each run records the pipeline it measured (chunking settings,
+// n_chunks, how many documents) so GET /admin/evaluations/sets/:id/metrics
+// can chart quality against configuration changes over time.
+//
+// Sets and runs are files under evaluation.store_dir on the instance that
+// created them; a run interrupted by a restart is marked failed.
+
+// EvaluationStatus is where a run is in its lifecycle
+type EvaluationStatus string
+
+const (
+	EvaluationRunning   EvaluationStatus = "running"
+	EvaluationCompleted EvaluationStatus = "completed"
+	EvaluationFailed    EvaluationStatus = "failed"
+)
+
+var (
+	errGoldenSetNotFound     = errors.New("Golden set not found")
+	errEvaluationNotFound    = errors.New("Evaluation run not found")
+	errEvaluationInProgress  = errors.New("An evaluation of this golden set is already running")
+	errEvaluationNoDocuments = errors.New("The golden set's collection has no documents")
+)
+
+// GoldenItem is one question with what a good response contains
+type GoldenItem struct {
+	Question        string   `json:"question" binding:"required,max=2000"`
+	ExpectedAnswer  string   `json:"expected_answer,omitempty" binding:"max=10000"`
+	ExpectedSources []string `json:"expected_sources,omitempty" binding:"max=20"`
+}
+
+// GoldenSet is a collection's questions
+type GoldenSet struct {
+	ID         string       `json:"id"`
+	Name       string       `json:"name"`
+	Collection string       `json:"collection,omitempty"` // document tag; empty for every document
+	Items      []GoldenItem `json:"items"`
+	CreatedBy  string       `json:"created_by"`
+	CreatedAt  time.Time    `json:"created_at"`
+	UpdatedAt  time.Time    `json:"updated_at"`
+}
+
+// GoldenSetRequest for creating or replacing a golden set
+type GoldenSetRequest struct {
+	Name       string       `json:"name" binding:"required,max=100"`
+	Collection string       `json:"collection,omitempty" binding:"max=64"`
+	Items      []GoldenItem `json:"items" binding:"required,min=1,max=500,dive"`
+}
+
+// StartEvaluationRequest for starting a run
+type StartEvaluationRequest struct {
+	Label string `json:"label,omitempty" binding:"max=100"` // e.g. the change being measured
+}
+
+// EvaluationMetrics are scores between 0 and 1; null when no question could
+// be scored on them
+type EvaluationMetrics struct {
+	Precision        *float64 `json:"precision"`
+	Recall           *float64 `json:"recall"`
+	Faithfulness     *float64 `json:"faithfulness"`
+	AnswerSimilarity *float64 `json:"answer_similarity"`
+}
+
+// EvaluationPipeline is the configuration a run measured
+type EvaluationPipeline struct {
+	Chunking  ChunkingSettings `json:"chunking"` // the collection's profile over the defaults
+	Search    QuerySearch      `json:"search"`   // the collection's search settings and their version
+	NChunks   int              `json:"n_chunks"`
+	Documents int              `json:"documents"` // in the collection when the run started
+}
+
+// EvaluationResult is one question's response and scores
+type EvaluationResult struct {
+	Question  string   `json:"question"`
+	Answer    string   `json:"answer,omitempty"`
+	Sources   []string `json:"sources,omitempty"` // retrieved, in rank order
+	LatencyMS int64    `json:"latency_ms"`
+	Error     string   `json:"error,omitempty"`
+	EvaluationMetrics
+}
+
+// EvaluationRun is one pass over a golden set
+type EvaluationRun struct {
+	ID          string             `json:"id"`
+	SetID       string             `json:"set_id"`
+	SetName     string             `json:"set_name"`
+	Collection  string             `json:"collection,omitempty"`
+	Label       string             `json:"label,omitempty"`
+	Status      EvaluationStatus   `json:"status"`
+	Pipeline    EvaluationPipeline `json:"pipeline"`
+	Metrics     EvaluationMetrics  `json:"metrics"`
+	Total       int                `json:"total"`
+	Completed   int                `json:"completed"`
+	Failed      int                `json:"failed"` // questions the backend couldn't answer
+	Error       string             `json:"error,omitempty"`
+	Results     []EvaluationResult `json:"results,omitempty"`
+	CreatedBy   string             `json:"created_by"`
+	CreatedAt   time.Time          `json:"created_at"`
+	CompletedAt *time.Time         `json:"completed_at,omitempty"`
+}
+
+// EvaluationPoint is one run in a golden set's history
+type EvaluationPoint struct {
+	RunID     string             `json:"run_id"`
+	Label     string             `json:"label,omitempty"`
+	At        time.Time          `json:"at"`
+	Pipeline  EvaluationPipeline `json:"pipeline"`
+	Metrics   EvaluationMetrics  `json:"metrics"`
+	Completed int                `json:"completed"`
+	Failed    int                `json:"failed"`
+}
+
+var (
+	goldenSets      = make(map[string]*GoldenSet)     // id -> set
+	evaluationRuns  = make(map[string]*EvaluationRun) // id -> run
+	evaluationMutex sync.Mutex
+	evaluationStore jobFiles // sets as set-<id>.json, runs as run-<id>.json
+)
+
+// startEvaluations loads stored sets and runs
+func startEvaluations() {
+	evaluationStore = jobFiles{dir: config.Evaluation.StoreDir}
+	if err := loadEvaluations(); err != nil {
+		fatal("Failed to open evaluation store", "dir", evaluationStore.dir, "error", err)
+	}
+}
+
+func loadEvaluations() error {
+	if err := os.MkdirAll(evaluationStore.dir, 0o700); err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(evaluationStore.dir)
+	if err != nil {
+		return err
+	}
+	evaluationMutex.Lock()
+	defer evaluationMutex.Unlock()
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(evaluationStore.dir, name))
+		if err != nil {
+			return err
+		}
+		switch {
+		case strings.HasPrefix(name, "set-"):
+			var set GoldenSet
+			if err := json.Unmarshal(data, &set); err != nil {
+				slog.Warn("Skipping unreadable golden set", "file", name, "error", err)
+				continue
+			}
+			goldenSets[set.ID] = &set
+		case strings.HasPrefix(name, "run-"):
+			var run EvaluationRun
+			if err := json.Unmarshal(data, &run); err != nil {
+				slog.Warn("Skipping unreadable evaluation run", "file", name, "error", err)
+				continue
+			}
+			if run.Status == EvaluationRunning {
+				finishRun(&run, EvaluationFailed, "Interrupted by a restart")
+			}
+			evaluationRuns[run.ID] = &run
+		}
+	}
+	return nil
+}
+
+// persistEvaluation saves a set or run, logging rather than failing like
+// persistJob; callers hold evaluationMutex
+func persistEvaluation(kind, id string, v interface{}) {
+	data, err := json.Marshal(v)
+	if err == nil {
+		err = evaluationStore.write(evaluationStore.path(kind+"-"+id, ".json"), data)
+	}
+	if err != nil {
+		slog.Error("Evaluation store write failed", kind+"_id", id, "error", err)
+	}
+}
+
+// finishRun ends a run; callers hold evaluationMutex
+func finishRun(run *EvaluationRun, status EvaluationStatus, reason string) {
+	now := time.Now().UTC()
+	run.Status = status
+	run.Error = reason
+	run.CompletedAt = &now
+	run.Metrics = averageMetrics(run.Results)
+	persistEvaluation("run", run.ID, run)
+}
+
+// collectionDocuments lists the documents in a collection, or every
+// document for ""
+func (s *Service) collectionDocuments(collection string) []string {
+	var filenames []string
+	s.documents.View(func(tx DocumentTx) {
+		tx.each(func(filename string, record documentRecord) {
+			if collection == "" || slices.Contains(record.Tags, collection) {
+				filenames = append(filenames, filename)
+			}
+		})
+	})
+	sort.Strings(filenames)
+	return filenames
+}
+
+// StartEvaluation runs a golden set in the background and returns the run
+func (s *Service) StartEvaluation(setID string, req StartEvaluationRequest, actor *User) (EvaluationRun, error) {
+	evaluationMutex.Lock()
+	defer evaluationMutex.Unlock()
+	set, exists := goldenSets[setID]
+	if !exists {
+		return EvaluationRun{}, errGoldenSetNotFound
+	}
+	for _, run := range evaluationRuns {
+		if run.SetID == setID && run.Status == EvaluationRunning {
+			return EvaluationRun{}, errEvaluationInProgress
+		}
+	}
+	documents := s.collectionDocuments(set.Collection)
+	if len(documents) == 0 {
+		return EvaluationRun{}, errEvaluationNoDocuments
+	}
+
+	chunking := defaultChunking()
+	if profile, ok := config.Chunking.Collections[set.Collection]; ok {
+		chunking = profile.over(chunking)
+	}
+	run := &EvaluationRun{
+		ID:         uuid.New().String(),
+		SetID:      set.ID,
+		SetName:    set.Name,
+		Collection: set.Collection,
+		Label:      req.Label,
+		Status:     EvaluationRunning,
+		Pipeline:   EvaluationPipeline{Chunking: chunking, Search: searchFor(set.Collection), NChunks: config.Evaluation.NChunks, Documents: len(documents)},
+		Total:      len(set.Items),
+		CreatedBy:  actor.ID,
+		CreatedAt:  time.Now().UTC(),
+	}
+	evaluationRuns[run.ID] = run
+	persistEvaluation("run", run.ID, run)
+
+	items := slices.Clone(set.Items)
+	if set.Collection == "" {
+		documents = nil // unfiltered
+	}
+	search := run.Pipeline.Search
+	goBackground(func(ctx context.Context) { runEvaluation(ctx, run, items, documents, search) })
+	return *run, nil
+}
+
+// runEvaluation asks each question in turn and scores the responses
+func runEvaluation(ctx context.Context, run *EvaluationRun, items []GoldenItem, sources []string, search QuerySearch) {
+	for _, item := range items {
+		if ctx.Err() != nil {
+			break
+		}
+		result := evaluateItem(ctx, item, sources, search)
+		evaluationMutex.Lock()
+		run.Results = append(run.Results, result)
+		if result.Error != "" {
+			run.Failed++
+		} else {
+			run.Completed++
+		}
+		run.Metrics = averageMetrics(run.Results)
+		evaluationMutex.Unlock()
+	}
+
+	evaluationMutex.Lock()
+	defer evaluationMutex.Unlock()
+	switch {
+	case ctx.Err() != nil:
+		finishRun(run, EvaluationFailed, "Interrupted by shutdown")
+	case run.Completed == 0:
+		finishRun(run, EvaluationFailed, "The backend answered none of the questions")
+	default:
+		finishRun(run, EvaluationCompleted, "")
+	}
+	slog.Info("Evaluation finished", "run_id", run.ID, "set_id", run.SetID, "status", run.Status,
+		"completed", run.Completed, "failed", run.Failed)
+}
+
+// chatResponse is the part of the backend's ChatResponse the gateway reads
+type chatResponse struct {
+	Answer     string `json:"answer"`
+	ChunksUsed []struct {
+		Content string `json:"content"`
+		Source  string `json:"source"`
+	} `json:"chunks_used"`
+}
+
+// askBackend runs one query through the backend's non-streaming /chat
+func askBackend(ctx context.Context, query StreamQueryRequest) (chatResponse, error) {
+	var answer chatResponse
+	query.Providers = providersFor(time.Now())
+	body, err := json.Marshal(query)
+	if err != nil {
+		return answer, fmt.Errorf("encode query: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, ragBackendURL()+"/chat", bytes.NewReader(body))
+	if err != nil {
+		return answer, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := backendClient.Do(req)
+	if err != nil {
+		return answer, fmt.Errorf("query: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return answer, fmt.Errorf("query returned %s", resp.Status)
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 10<<20)).Decode(&answer); err != nil {
+		return answer, fmt.Errorf("decode answer: %w", err)
+	}
+	return answer, nil
+}
+
+// evaluateItem asks one question through the backend and scores it
+func evaluateItem(ctx context.Context, item GoldenItem, sources []string, search QuerySearch) EvaluationResult {
+	result := EvaluationResult{Question: item.Question}
+	ctx, cancel := context.WithTimeout(ctx, config.Evaluation.Timeout)
+	defer cancel()
+
+	started := time.Now()
+	answer, err := askBackend(ctx, StreamQueryRequest{
+		Question:      item.Question,
+		NChunks:       config.Evaluation.NChunks,
+		FilterSources: sources,
+		Collection:    search.Collection,
+		Search:        &search,
+	})
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	result.LatencyMS = time.Since(started).Milliseconds()
+	result.Answer = answer.Answer
+
+	var retrieved []string
+	for _, chunk := range answer.ChunksUsed {
+		if !slices.Contains(result.Sources, chunk.Source) {
+			result.Sources = append(result.Sources, chunk.Source)
+		}
+		retrieved = append(retrieved, chunk.Content)
+	}
+	result.Precision, result.Recall = sourceScores(result.Sources, item.ExpectedSources)
+	result.Faithfulness = faithfulness(answer.Answer, strings.Join(retrieved, " "))
+	if item.ExpectedAnswer != "" {
+		result.AnswerSimilarity = tokenF1(answer.Answer, item.ExpectedAnswer)
+	}
+	return result
+}
+
+// ----------------------------------------------------------------------------
+// Metrics
+// ----------------------------------------------------------------------------
+
+// stopWords aren't counted as content when comparing texts
+var stopWords = map[string]bool{
+	"a": true, "an": true, "and": true, "are": true, "as": true, "at": true, "be": true, "by": true,
+	"for": true, "from": true, "has": true, "have": true, "in": true, "is": true, "it": true, "its": true,
+	"of": true, "on": true, "or": true, "that": true, "the": true, "this": true, "to": true, "was": true,
+	"were": true, "will": true, "with": true,
+}
+
+// contentTokens lowercases text and splits it into words, without stop
+// words
+func contentTokens(text string) []string {
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	tokens := words[:0]
+	for _, word := range words {
+		if !stopWords[word] {
+			tokens = append(tokens, word)
+		}
+	}
+	return tokens
+}
+
+func ratio(n, d int) *float64 {
+	score := float64(n) / float64(d)
+	return &score
+}
+
+// sourceScores compares the retrieved documents with the expected ones;
+// both are nil without expected sources
+func sourceScores(retrieved, expected []string) (precision, recall *float64) {
+	if len(expected) == 0 {
+		return nil, nil
+	}
+	hits := 0
+	for _, source := range retrieved {
+		if slices.Contains(expected, source) {
+			hits++
+		}
+	}
+	if len(retrieved) > 0 {
+		precision = ratio(hits, len(retrieved))
+	} else {
+		precision = ratio(0, 1)
+	}
+	return precision, ratio(hits, len(expected))
+}
+
+// faithfulness is the share of the answer's distinct content words that
+// appear in the context; nil for an answer without any
+func faithfulness(answer, context string) *float64 {
+	words := make(map[string]bool)
+	for _, token := range contentTokens(answer) {
+		words[token] = true
+	}
+	if len(words) == 0 {
+		return nil
+	}
+	known := make(map[string]bool)
+	for _, token := range contentTokens(context) {
+		known[token] = true
+	}
+	found := 0
+	for word := range words {
+		if known[word] {
+			found++
+		}
+	}
+	return ratio(found, len(words))
+}
+
+// tokenF1 is the harmonic mean of token precision and recall between an
+// answer and the expected one, counting repeated words
+func tokenF1(answer, expected string) *float64 {
+	got, want := contentTokens(answer), contentTokens(expected)
+	if len(got) == 0 || len(want) == 0 {
+		return ratio(0, 1)
+	}
+	counts := make(map[string]int)
+	for _, token := range want {
+		counts[token]++
+	}
+	common := 0
+	for _, token := range got {
+		if counts[token] > 0 {
+			counts[token]--
+			common++
+		}
+	}
+	if common == 0 {
+		return ratio(0, 1)
+	}
+	precision := float64(common) / float64(len(got))
+	recall := float64(common) / float64(len(want))
+	f1 := 2 * precision * recall / (precision + recall)
+	return &f1
+}
+
+// averageMetrics averages each metric over the results scored on it
+func averageMetrics(results []EvaluationResult) EvaluationMetrics {
+	mean := func(pick func(EvaluationMetrics) *float64) *float64 {
+		sum, n := 0.0, 0
+		for _, result := range results {
+			if score := pick(result.EvaluationMetrics); score != nil {
+				sum += *score
+				n++
+			}
+		}
+		if n == 0 {
+			return nil
+		}
+		avg := sum / float64(n)
+		return &avg
+	}
+	return EvaluationMetrics{
+		Precision:        mean(func(m EvaluationMetrics) *float64 { return m.Precision }),
+		Recall:           mean(func(m EvaluationMetrics) *float64 { return m.Recall }),
+		Faithfulness:     mean(func(m EvaluationMetrics) *float64 { return m.Faithfulness }),
+		AnswerSimilarity: mean(func(m EvaluationMetrics) *float64 { return m.AnswerSimilarity }),
+	}
+}
+
+// ----------------------------------------------------------------------------
+// Handlers
+// ----------------------------------------------------------------------------
+
+// respondEvaluationError maps evaluation errors to problems
+func respondEvaluationError(c *gin.Context, err error) {
+	switch err {
+	case errGoldenSetNotFound, errEvaluationNotFound:
+		respondError(c, http.StatusNotFound, codeNotFound, err.Error())
+	case errEvaluationInProgress, errEvaluationNoDocuments:
+		respondError(c, http.StatusConflict, codeConflict, err.Error())
+	default:
+		respondServiceError(c, err)
+	}
+}
+
+// createGoldenSet stores a new golden set (admin)
+func createGoldenSet(c *gin.Context) {
+	var req GoldenSetRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondBindError(c, err)
+		return
+	}
+	now := time.Now().UTC()
+	set := &GoldenSet{
+		ID:         uuid.New().String(),
+		Name:       req.Name,
+		Collection: strings.ToLower(strings.TrimSpace(req.Collection)),
+		Items:      req.Items,
+		CreatedBy:  c.MustGet("user").(*User).ID,
+		CreatedAt:  now,
+		UpdatedAt:  now,
+	}
+	evaluationMutex.Lock()
+	goldenSets[set.ID] = set
+	persistEvaluation("set", set.ID, set)
+	evaluationMutex.Unlock()
+	auditChange(c, "evaluation.set_created", "golden_set:"+set.ID, nil, set)
+	c.JSON(http.StatusCreated, set)
+}
+
+// listGoldenSets lists golden sets by name, without their items (admin)
+func listGoldenSets(c *gin.Context) {
+	type summary struct {
+		ID         string    `json:"id"`
+		Name       string    `json:"name"`
+		Collection string    `json:"collection,omitempty"`
+		Items      int       `json:"items"`
+		UpdatedAt  time.Time `json:"updated_at"`
+	}
+	evaluationMutex.Lock()
+	list := make([]summary, 0, len(goldenSets))
+	for _, set := range goldenSets {
+		list = append(list, summary{ID: set.ID, Name: set.Name, Collection: set.Collection, Items: len(set.Items), UpdatedAt: set.UpdatedAt})
+	}
+	evaluationMutex.Unlock()
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Name != list[j].Name {
+			return list[i].Name < list[j].Name
+		}
+		return list[i].ID < list[j].ID
+	})
+	c.JSON(http.StatusOK, gin.H{"sets": list, "count": len(list)})
+}
+
+// getGoldenSet returns a golden set with its items (admin)
+func getGoldenSet(c *gin.Context) {
+	evaluationMutex.Lock()
+	set, exists := goldenSets[c.Param("id")]
+	var snapshot GoldenSet
+	if exists {
+		snapshot = *set
+	}
+	evaluationMutex.Unlock()
+	if !exists {
+		respondEvaluationError(c, errGoldenSetNotFound)
+		return
+	}
+	c.JSON(http.StatusOK, snapshot)
+}
+
+// replaceGoldenSet replaces a golden set's name, collection and items;
+// earlier runs keep their results (admin)
+func replaceGoldenSet(c *gin.Context) {
+	var req GoldenSetRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondBindError(c, err)
+		return
+	}
+	evaluationMutex.Lock()
+	set, exists := goldenSets[c.Param("id")]
+	if !exists {
+		evaluationMutex.Unlock()
+		respondEvaluationError(c, errGoldenSetNotFound)
+		return
+	}
+	before := *set
+	set.Name = req.Name
+	set.Collection = strings.ToLower(strings.TrimSpace(req.Collection))
+	set.Items = req.Items
+	set.UpdatedAt = time.Now().UTC()
+	after := *set
+	persistEvaluation("set", set.ID, set)
+	evaluationMutex.Unlock()
+	auditChange(c, "evaluation.set_updated", "golden_set:"+after.ID, before, after)
+	c.JSON(http.StatusOK, after)
+}
+
+// deleteGoldenSet removes a golden set; its runs stay in the history
+// (admin)
+func deleteGoldenSet(c *gin.Context) {
+	id := c.Param("id")
+	evaluationMutex.Lock()
+	set, exists := goldenSets[id]
+	if exists {
+		delete(goldenSets, id)
+		os.Remove(evaluationStore.path("set-"+id, ".json"))
+	}
+	evaluationMutex.Unlock()
+	if !exists {
+		respondEvaluationError(c, errGoldenSetNotFound)
+		return
+	}
+	auditChange(c, "evaluation.set_deleted", "golden_set:"+id, set, nil)
+	c.JSON(http.StatusOK, gin.H{"deleted": id})
+}
+
+// startEvaluation evaluates a golden set against the current pipeline
+// (admin)
+func (s *Server) startEvaluation(c *gin.Context) {
+	var req StartEvaluationRequest
+	if err := c.ShouldBindJSON(&req); err != nil && err != io.EOF {
+		respondBindError(c, err)
+		return
+	}
+	run, err := s.svc.StartEvaluation(c.Param("id"), req, c.MustGet("user").(*User))
+	if err != nil {
+		respondEvaluationError(c, err)
+		return
+	}
+	c.JSON(http.StatusAccepted, run)
+}
+
+// listEvaluationRuns lists runs newest first, without per-question results;
+// ?set_id= limits them to one golden set (admin)
+func listEvaluationRuns(c *gin.Context) {
+	setID := c.Query("set_id")
+	evaluationMutex.Lock()
+	list := make([]EvaluationRun, 0, len(evaluationRuns))
+	for _, run := range evaluationRuns {
+		if setID == "" || run.SetID == setID {
+			summary := *run
+			summary.Results = nil
+			list = append(list, summary)
+		}
+	}
+	evaluationMutex.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.After(list[j].CreatedAt) })
+	c.JSON(http.StatusOK, gin.H{"runs": list, "count": len(list)})
+}
+
+// getEvaluationRun returns a run with each question's response and scores
+// (admin)
+func getEvaluationRun(c *gin.Context) {
+	evaluationMutex.Lock()
+	run, exists := evaluationRuns[c.Param("id")]
+	var snapshot EvaluationRun
+	if exists {
+		snapshot = *run
+		snapshot.Results = slices.Clone(run.Results)
+	}
+	evaluationMutex.Unlock()
+	if !exists {
+		respondEvaluationError(c, errEvaluationNotFound)
+		return
+	}
+	c.JSON(http.StatusOK, snapshot)
+}
+
+// getEvaluationMetrics returns a golden set's completed runs oldest first,
+// for charting its metrics over time (admin)
+func getEvaluationMetrics(c *gin.Context) {
+	id := c.Param("id")
+	evaluationMutex.Lock()
+	_, exists := goldenSets[id]
+	var points []EvaluationPoint
+	for _, run := range evaluationRuns {
+		if run.SetID == id && run.Status == EvaluationCompleted {
+			points = append(points, EvaluationPoint{
+				RunID:     run.ID,
+				Label:     run.Label,
+				At:        run.CreatedAt,
+				Pipeline:  run.Pipeline,
+				Metrics:   run.Metrics,
+				Completed: run.Completed,
+				Failed:    run.Failed,
+			})
+		}
+	}
+	evaluationMutex.Unlock()
+	if !exists && len(points) == 0 {
+		respondEvaluationError(c, errGoldenSetNotFound)
+		return
+	}
+	sort.Slice(points, func(i, j int) bool { return points[i].At.Before(points[j].At) })
+	if points == nil {
+		points = []EvaluationPoint{}
+	}
+	c.JSON(http.StatusOK, gin.H{"set_id": id, "points": points, "count": len(points)})
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestEvaluationMetrics(t *testing.T) {
+	near := func(got *float64, want float64) bool { return got != nil && math.Abs(*got-want) < 1e-9 }
+
+	precision, recall := sourceScores([]string{"a.pdf", "b.pdf"}, []string{"a.pdf", "c.pdf", "d.pdf"})
+	if !near(precision, 0.5) || !near(recall, 1.0/3) {
+		t.Errorf("source scores: %v %v", *precision, *recall)
+	}
+	if p, r := sourceScores([]string{"a.pdf"}, nil); p != nil || r != nil {
+		t.Error("source scores without expected sources")
+	}
+	if got := faithfulness("The refund window is 30 days", "Refunds: the refund window is 30 days from delivery."); !near(got, 1) {
+		t.Errorf("grounded answer: %v", *got)
+	}
+	if got := faithfulness("Refunds take 90 days", "the refund window is 30 days"); !near(got, 0.25) {
+		t.Errorf("partly grounded answer: %v", *got)
+	}
+	if got := tokenF1("The window is 30 days", "30 days"); !near(got, 0.8) {
+		t.Errorf("token F1: %v", *got)
+	}
+	avg := averageMetrics([]EvaluationResult{
+		{EvaluationMetrics: EvaluationMetrics{Precision: ratio(1, 1)}},
+		{EvaluationMetrics: EvaluationMetrics{Precision: ratio(0, 1), Recall: ratio(1, 2)}},
+	})
+	if !near(avg.Precision, 0.5) || !near(avg.Recall, 0.5) || avg.Faithfulness != nil {
+		t.Errorf("averages: %+v", avg)
+	}
+}
+
+func TestEvaluationRun(t *testing.T) {
+	ts := newTestServer(t)
+	admin := ts.admin("admin@example.com")
+	owner, ownerID := ts.register("owner@example.com")
+	ts.do(http.MethodPost, "/v1/documents/register", owner, `{"filename":"refunds.pdf"}`)
+	ts.do(http.MethodPost, "/v1/documents/register", owner, `{"filename":"shipping.pdf"}`)
+	ts.srv.svc.BulkDocuments(ownerID, "retag", []string{"refunds.pdf"}, "", []string{"policies"}, false)
+
+	savedStore := evaluationStore
+	evaluationStore = jobFiles{dir: t.TempDir()}
+	t.Cleanup(func() {
+		evaluationMutex.Lock()
+		goldenSets, evaluationRuns, evaluationStore = make(map[string]*GoldenSet), make(map[string]*EvaluationRun), savedStore
+		evaluationMutex.Unlock()
+	})
+
+	var filters [][]string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req StreamQueryRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		filters = append(filters, req.FilterSources)
+		if req.Question == "broken?" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte(`{"answer":"Refunds within 30 days","sources":["refunds.pdf"],` +
+			`"chunks_used":[{"content":"Refunds are accepted within 30 days.","source":"refunds.pdf"}]}`))
+	}))
+	defer backend.Close()
+	withConfig(t, func(cfg *Config) { cfg.RAGBackend.URL = backend.URL })
+
+	var set GoldenSet
+	w := ts.do(http.MethodPost, "/v1/admin/evaluations/sets", admin, `{"name":"Policies","collection":"Policies","items":[`+
+		`{"question":"How long do refunds take?","expected_answer":"30 days","expected_sources":["refunds.pdf"]},`+
+		`{"question":"broken?"}]}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create set: %d %s", w.Code, w.Body)
+	}
+	decodeJSON(t, w, &set)
+	if set.Collection != "policies" {
+		t.Fatalf("collection not normalized: %q", set.Collection)
+	}
+
+	var run EvaluationRun
+	decodeJSON(t, ts.do(http.MethodPost, "/v1/admin/evaluations/sets/"+set.ID+"/runs", admin, `{"label":"baseline"}`), &run)
+	if run.Pipeline.Documents != 1 || run.Pipeline.NChunks != config.Evaluation.NChunks {
+		t.Fatalf("pipeline: %+v", run.Pipeline)
+	}
+	for deadline := time.Now().Add(5 * time.Second); run.Status == EvaluationRunning && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+		decodeJSON(t, ts.do(http.MethodGet, "/v1/admin/evaluations/runs/"+run.ID, admin, ""), &run)
+	}
+	if run.Status != EvaluationCompleted || run.Completed != 1 || run.Failed != 1 || len(run.Results) != 2 {
+		t.Fatalf("run: %+v", run)
+	}
+	// "refunds within 30 days" shares "30 days" with the expected answer
+	if m := run.Metrics; *m.Precision != 1 || *m.Recall != 1 || *m.Faithfulness != 1 || math.Abs(*m.AnswerSimilarity-2.0/3) > 1e-9 {
+		t.Fatalf("metrics: precision %v recall %v faithfulness %v similarity %v", *m.Precision, *m.Recall, *m.Faithfulness, *m.AnswerSimilarity)
+	}
+	if len(filters) != 2 || len(filters[0]) != 1 || filters[0][0] != "refunds.pdf" {
+		t.Fatalf("questions not limited to the collection: %v", filters)
+	}
+
+	var history struct {
+		Points []EvaluationPoint `json:"points"`
+	}
+	decodeJSON(t, ts.do(http.MethodGet, "/v1/admin/evaluations/sets/"+set.ID+"/metrics", admin, ""), &history)
+	if len(history.Points) != 1 || history.Points[0].Label != "baseline" {
+		t.Fatalf("history: %+v", history.Points)
+	}
+
+	// Restarting reloads what was stored
+	evaluationMutex.Lock()
+	goldenSets, evaluationRuns = make(map[string]*GoldenSet), make(map[string]*EvaluationRun)
+	evaluationMutex.Unlock()
+	if err := loadEvaluations(); err != nil {
+		t.Fatal(err)
+	}
+	if w := ts.do(http.MethodGet, "/v1/admin/evaluations/runs/"+run.ID, admin, ""); w.Code != http.StatusOK {
+		t.Fatalf("run after reload: %d", w.Code)
+	}
+
+	empty := ts.do(http.MethodPost, "/v1/admin/evaluations/sets", admin, `{"name":"Empty","collection":"none","items":[{"question":"q"}]}`)
+	decodeJSON(t, empty, &set)
+	if w := ts.do(http.MethodPost, "/v1/admin/evaluations/sets/"+set.ID+"/runs", admin, ""); w.Code != http.StatusConflict {
+		t.Fatalf("run over an empty collection: got %d, want 409", w.Code)
+	}
+}
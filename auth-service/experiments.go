@@ -0,0 +1,612 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// ============================================================================
+// Retrieval Experiments
+// ============================================================================
+//
+// An experiment compares retrieval settings (how many chunks, which
+// reranker) across variants. While it runs, every query through
+// /query/stream or the chat WebSocket is assigned a variant by hashing the
+// experiment ID with the user's ID, or with the chat session for
+// unit "session", so the same user or session keeps seeing the same
+// variant; variants are weighted. The variant's settings replace the
+// client's, and the backend gets the assignment as "variant" so it can log
+// it too. One experiment runs at a time.
+//
+// Each query is kept in the query history with its variant, latency and
+// outcome. The query's ID is the request ID forwarded to the backend; when
+// the gateway reports the answer's citations (citations.go) with that ID,
+// the record is marked cited. GET /admin/experiments/:id/results compares
+// the variants on these.
+//
+// When clustered, experiments are kept in the shared store like runtime
+// network rules, so starting or stopping one applies to every replica. The
+// queries an experiment assigned a variant go to the record store,
+// whichever replica served them, and expire experimentQueryTTL after they
+// ran; results and ?experiment= history read them from there. The rest of
+// the query history stays in memory on the instance that served it.
+
+const (
+	experimentUnitUser    = "user"
+	experimentUnitSession = "session"
+
+	maxQueryHistory = 10000 // records kept, newest first out
+
+	// experimentsSetting names the experiments in the shared store
+	experimentsSetting = "experiments"
+	// experimentQueryRecord keys an experiment's queries by query ID
+	experimentQueryRecord = "experiment-query"
+	experimentQueryTTL    = 90 * 24 * time.Hour
+
+	queryAnswered  = "answered"
+	queryFailed    = "failed"
+	queryCancelled = "cancelled"
+)
+
+var (
+	errExperimentNotFound = errors.New("Experiment not found")
+	errExperimentRunning  = errors.New("Another experiment is already running; stop it first")
+)
+
+// RetrievalSettings are what a variant changes about a query
+type RetrievalSettings struct {
+	NChunks  int    `json:"n_chunks,omitempty" binding:"omitempty,min=1,max=10"`
+	Reranker string `json:"reranker,omitempty" binding:"max=64"` // one of search.rerankers; replaces the collection's
+}
+
+// ExperimentVariant is one arm of an experiment
+type ExperimentVariant struct {
+	Name     string            `json:"name" binding:"required,max=32"`
+	Weight   int               `json:"weight,omitempty" binding:"min=0,max=100"` // share of traffic; 0 counts as 1
+	Settings RetrievalSettings `json:"settings"`
+}
+
+// Experiment compares retrieval settings
+type Experiment struct {
+	ID          string              `json:"id"`
+	Name        string              `json:"name"`
+	Description string              `json:"description,omitempty"`
+	Unit        string              `json:"unit"` // user | session
+	Variants    []ExperimentVariant `json:"variants"`
+	Running     bool                `json:"running"`
+	CreatedBy   string              `json:"created_by"`
+	CreatedAt   time.Time           `json:"created_at"`
+	StoppedAt   *time.Time          `json:"stopped_at,omitempty"`
+}
+
+// CreateExperimentRequest for starting an experiment
+type CreateExperimentRequest struct {
+	Name        string              `json:"name" binding:"required,max=100"`
+	Description string              `json:"description,omitempty" binding:"max=500"`
+	Unit        string              `json:"unit,omitempty" binding:"omitempty,oneof=user session"`
+	Variants    []ExperimentVariant `json:"variants" binding:"required,min=2,max=10,dive"`
+}
+
+// QueryRecord is one query in the history
+type QueryRecord struct {
+	ID           string    `json:"id"` // the request ID forwarded to the backend
+	UserID       string    `json:"user_id"`
+	Experiment   string    `json:"experiment,omitempty"`
+	Variant      string    `json:"variant,omitempty"`
+	NChunks      int       `json:"n_chunks,omitempty"`
+	Reranker     string    `json:"reranker,omitempty"`
+	Outcome      string    `json:"outcome"` // answered | failed | cancelled
+	FirstByteMS  int64     `json:"first_byte_ms,omitempty"`
+	LatencyMS    int64     `json:"latency_ms"`
+	AnswerLength int       `json:"answer_length,omitempty"` // characters
+	Citations    int       `json:"citations,omitempty"`     // chunks the answer cited, once reported
+	At           time.Time `json:"at"`
+
+	unit string // who the variant was assigned to
+}
+
+// experimentQuery is a query as kept for its experiment's results, with
+// the unit its variant was assigned to
+type experimentQuery struct {
+	QueryRecord
+	Unit string `json:"unit"`
+}
+
+// VariantResults compares one variant's queries
+type VariantResults struct {
+	Variant          string            `json:"variant"`
+	Settings         RetrievalSettings `json:"settings"`
+	Queries          int               `json:"queries"`
+	Units            int               `json:"units"` // distinct users or sessions
+	FailureRate      float64           `json:"failure_rate"`
+	CancelRate       float64           `json:"cancel_rate"`
+	MeanFirstByteMS  float64           `json:"mean_first_byte_ms"`
+	MeanLatencyMS    float64           `json:"mean_latency_ms"`
+	MeanAnswerLength float64           `json:"mean_answer_length"`
+	CitedRate        float64           `json:"cited_rate"`     // answered queries with any citation
+	MeanCitations    float64           `json:"mean_citations"` // per answered query
+}
+
+var (
+	experiments     = make(map[string]*Experiment)  // id -> experiment; replaced, never modified in place
+	queryHistory    []*QueryRecord                  // oldest first
+	queryIndex      = make(map[string]*QueryRecord) // id -> record, for citation reports
+	experimentMutex sync.Mutex
+)
+
+// runningExperiment returns the running experiment, if any
+func runningExperiment(all map[string]*Experiment) *Experiment {
+	for _, experiment := range all {
+		if experiment.Running {
+			return experiment
+		}
+	}
+	return nil
+}
+
+// updateExperiments changes the experiments one writer at a time. When
+// clustered it starts from the shared store's copy and saves the result
+// there for every replica; a failed save changes nothing.
+func updateExperiments(change func(all map[string]*Experiment) error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), config.Cluster.LockTTL)
+	defer cancel()
+	release, err := acquireLock(ctx, experimentsSetting, config.Cluster.LockTTL)
+	if err != nil {
+		slog.Error("Experiments lock failed", "error", err)
+		return errStoreUnavailable
+	}
+	defer release()
+	if clustered() {
+		if err := refreshSetting(ctx, experimentsSetting); err != nil {
+			slog.Error("Cluster store read failed", "op", "experiments", "error", err)
+			return errStoreUnavailable
+		}
+	}
+
+	experimentMutex.Lock()
+	changed := maps.Clone(experiments)
+	experimentMutex.Unlock()
+	if err := change(changed); err != nil {
+		return err
+	}
+	if clustered() {
+		data, err := json.Marshal(changed)
+		if err != nil {
+			return err
+		}
+		if err := saveSharedSetting(experimentsSetting, data); err != nil {
+			return err
+		}
+	}
+	experimentMutex.Lock()
+	experiments = changed
+	experimentMutex.Unlock()
+	return nil
+}
+
+// applyExperimentsSetting replaces this replica's copy of the experiments
+func applyExperimentsSetting(data []byte) error {
+	shared := make(map[string]*Experiment)
+	if err := json.Unmarshal(data, &shared); err != nil {
+		return err
+	}
+	experimentMutex.Lock()
+	experiments = shared
+	experimentMutex.Unlock()
+	return nil
+}
+
+// assignVariant picks a unit's variant: the same unit always gets the same
+// one for an experiment
+func assignVariant(experiment *Experiment, unit string) ExperimentVariant {
+	total := 0
+	for _, variant := range experiment.Variants {
+		total += max(variant.Weight, 1)
+	}
+	sum := sha256.Sum256([]byte(experiment.ID + ":" + unit))
+	point := int(binary.BigEndian.Uint64(sum[:8]) % uint64(total))
+	for _, variant := range experiment.Variants {
+		if point -= max(variant.Weight, 1); point < 0 {
+			return variant
+		}
+	}
+	return experiment.Variants[len(experiment.Variants)-1]
+}
+
+// startQueryRecord applies the running experiment, if any, to a query and
+// starts its history record; sessionID is the chat session, if any
+func startQueryRecord(queryID string, user *User, sessionID string, req *StreamQueryRequest) *QueryRecord {
+	record := &QueryRecord{ID: queryID, UserID: user.ID, At: time.Now().UTC()}
+	experimentMutex.Lock()
+	if experiment := runningExperiment(experiments); experiment != nil {
+		record.unit = user.ID
+		if experiment.Unit == experimentUnitSession && sessionID != "" {
+			record.unit = sessionID
+		}
+		variant := assignVariant(experiment, record.unit)
+		record.Experiment, record.Variant = experiment.ID, variant.Name
+		if variant.Settings.NChunks != 0 {
+			req.NChunks = variant.Settings.NChunks
+		}
+		if variant.Settings.Reranker != "" && req.Search != nil {
+			search := *req.Search
+			search.Reranker = variant.Settings.Reranker
+			search.SearchSettings = search.normalize()
+			req.Search = &search
+		}
+		req.Variant = experiment.ID + "/" + variant.Name
+	}
+	experimentMutex.Unlock()
+	record.NChunks = req.NChunks
+	if req.Search != nil {
+		record.Reranker = req.Search.Reranker
+	}
+	return record
+}
+
+// finishQueryRecord adds a finished query to the history
+func finishQueryRecord(record *QueryRecord, outcome string, firstByte time.Time, answerLength int) {
+	record.Outcome = outcome
+	record.LatencyMS = time.Since(record.At).Milliseconds()
+	if !firstByte.IsZero() {
+		record.FirstByteMS = firstByte.Sub(record.At).Milliseconds()
+	}
+	record.AnswerLength = answerLength
+	if outcome == queryFailed {
+		publishAdminEvent(AdminEvent{Type: AdminEventQueryFailed, UserID: record.UserID, Outcome: "failure",
+			Details: map[string]string{"request_id": record.ID, "latency_ms": strconv.FormatInt(record.LatencyMS, 10)}})
+	}
+
+	experimentMutex.Lock()
+	if record.ID != "" {
+		queryIndex[record.ID] = record
+	}
+	queryHistory = append(queryHistory, record)
+	if over := len(queryHistory) - maxQueryHistory; over > 0 {
+		for _, old := range queryHistory[:over] {
+			delete(queryIndex, old.ID)
+		}
+		queryHistory = slices.Clone(queryHistory[over:])
+	}
+	kept := experimentQuery{QueryRecord: *record, Unit: record.unit}
+	experimentMutex.Unlock()
+
+	if kept.Experiment != "" {
+		if kept.ID == "" {
+			kept.ID = uuid.New().String()
+		}
+		saveExperimentQuery(kept)
+	}
+}
+
+// saveExperimentQuery keeps a query for its experiment's results
+func saveExperimentQuery(query experimentQuery) error {
+	data, err := json.Marshal(query)
+	if err != nil {
+		return err
+	}
+	ttl := time.Until(query.At.Add(experimentQueryTTL))
+	if err := keyedRecords().saveRecord(context.Background(), experimentQueryRecord, query.ID, data, ttl); err != nil {
+		slog.Error("Record store write failed", "op", "experiment_query", "error", err)
+		return errStoreUnavailable
+	}
+	return nil
+}
+
+// experimentQueries returns an experiment's kept queries, oldest first
+func experimentQueries(experimentID string) ([]experimentQuery, error) {
+	stored, err := keyedRecords().records(context.Background(), experimentQueryRecord)
+	if err != nil {
+		slog.Error("Record store read failed", "op", "experiment_queries", "error", err)
+		return nil, errStoreUnavailable
+	}
+	var queries []experimentQuery
+	for _, data := range stored {
+		var query experimentQuery
+		if json.Unmarshal(data, &query) == nil && query.Experiment == experimentID {
+			queries = append(queries, query)
+		}
+	}
+	sort.Slice(queries, func(i, j int) bool { return queries[i].At.Before(queries[j].At) })
+	return queries, nil
+}
+
+// noteQueryCitations records how many chunks a query's answer cited. A
+// query this instance doesn't know may have run on another replica, so an
+// experiment's kept copy is updated too.
+func noteQueryCitations(queryID string, cited int) {
+	if queryID == "" {
+		return
+	}
+	experimentMutex.Lock()
+	record, known := queryIndex[queryID]
+	if known {
+		record.Citations += cited
+	}
+	inExperiment := known && record.Experiment != ""
+	experimentMutex.Unlock()
+	if known && !inExperiment {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), config.Cluster.LockTTL)
+	defer cancel()
+	release, err := acquireLock(ctx, experimentQueryRecord+":"+queryID, config.Cluster.LockTTL)
+	if err != nil {
+		slog.Error("Experiment query lock failed", "error", err)
+		return
+	}
+	defer release()
+	data, found, err := keyedRecords().record(ctx, experimentQueryRecord, queryID)
+	if err != nil {
+		slog.Error("Record store read failed", "op", "experiment_query", "error", err)
+		return
+	}
+	var query experimentQuery
+	if !found || json.Unmarshal(data, &query) != nil {
+		return
+	}
+	query.Citations += cited
+	saveExperimentQuery(query)
+}
+
+// experimentResults compares an experiment's variants over its queries
+func experimentResults(experiment Experiment, queries []experimentQuery) []VariantResults {
+	type totals struct {
+		queries, failed, cancelled, answered, cited, citations, timed int
+		firstByte, latency, length                                    int64
+		units                                                         map[string]bool
+	}
+	byVariant := make(map[string]*totals)
+	for _, variant := range experiment.Variants {
+		byVariant[variant.Name] = &totals{units: make(map[string]bool)}
+	}
+	for _, record := range queries {
+		t := byVariant[record.Variant]
+		if t == nil {
+			continue
+		}
+		t.queries++
+		t.units[record.Unit] = true
+		switch record.Outcome {
+		case queryFailed:
+			t.failed++
+			continue
+		case queryCancelled:
+			t.cancelled++
+			continue
+		}
+		t.answered++
+		t.latency += record.LatencyMS
+		t.length += int64(record.AnswerLength)
+		if record.FirstByteMS > 0 {
+			t.timed++
+			t.firstByte += record.FirstByteMS
+		}
+		if record.Citations > 0 {
+			t.cited++
+			t.citations += record.Citations
+		}
+	}
+
+	rate := func(n, d int) float64 {
+		if d == 0 {
+			return 0
+		}
+		return float64(n) / float64(d)
+	}
+	results := make([]VariantResults, 0, len(experiment.Variants))
+	for _, variant := range experiment.Variants {
+		t := byVariant[variant.Name]
+		results = append(results, VariantResults{
+			Variant:          variant.Name,
+			Settings:         variant.Settings,
+			Queries:          t.queries,
+			Units:            len(t.units),
+			FailureRate:      rate(t.failed, t.queries),
+			CancelRate:       rate(t.cancelled, t.queries),
+			MeanFirstByteMS:  rate(int(t.firstByte), t.timed),
+			MeanLatencyMS:    rate(int(t.latency), t.answered),
+			MeanAnswerLength: rate(int(t.length), t.answered),
+			CitedRate:        rate(t.cited, t.answered),
+			MeanCitations:    rate(t.citations, t.answered),
+		})
+	}
+	return results
+}
+
+// ----------------------------------------------------------------------------
+// Handlers
+// ----------------------------------------------------------------------------
+
+// respondExperimentError maps experiment errors to problems
+func respondExperimentError(c *gin.Context, err error) {
+	switch err {
+	case errExperimentNotFound:
+		respondError(c, http.StatusNotFound, codeNotFound, err.Error())
+	case errExperimentRunning:
+		respondError(c, http.StatusConflict, codeConflict, err.Error())
+	default:
+		respondServiceError(c, err)
+	}
+}
+
+// createExperiment starts an experiment (admin)
+func createExperiment(c *gin.Context) {
+	var req CreateExperimentRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondBindError(c, err)
+		return
+	}
+	names := make(map[string]bool, len(req.Variants))
+	for _, variant := range req.Variants {
+		if names[variant.Name] {
+			respondError(c, http.StatusBadRequest, codeInvalidRequest, "Variant names must be unique")
+			return
+		}
+		names[variant.Name] = true
+		if reranker := variant.Settings.Reranker; reranker != "" && !slices.Contains(config.Search.Rerankers, reranker) {
+			respondError(c, http.StatusBadRequest, codeInvalidRequest,
+				fmt.Sprintf(translate(requestLanguage(c), "Unknown reranker %s"), reranker))
+			return
+		}
+	}
+	if req.Unit == "" {
+		req.Unit = experimentUnitUser
+	}
+
+	experiment := &Experiment{
+		ID:          uuid.New().String(),
+		Name:        req.Name,
+		Description: req.Description,
+		Unit:        req.Unit,
+		Variants:    req.Variants,
+		Running:     true,
+		CreatedBy:   c.MustGet("user").(*User).ID,
+		CreatedAt:   time.Now().UTC(),
+	}
+	var running *Experiment
+	err := updateExperiments(func(all map[string]*Experiment) error {
+		if running = runningExperiment(all); running != nil {
+			return errExperimentRunning
+		}
+		all[experiment.ID] = experiment
+		return nil
+	})
+	if err == errExperimentRunning {
+		respondProblem(c, Problem{
+			Status:     http.StatusConflict,
+			Code:       codeConflict,
+			Detail:     errExperimentRunning.Error(),
+			Extensions: map[string]interface{}{"experiment_id": running.ID},
+		})
+		return
+	}
+	if err != nil {
+		respondExperimentError(c, err)
+		return
+	}
+	snapshot := *experiment
+
+	auditChange(c, "experiment.started", "experiment:"+snapshot.ID, nil, snapshot)
+	c.JSON(http.StatusCreated, snapshot)
+}
+
+// listExperiments lists experiments, newest first (admin)
+func listExperiments(c *gin.Context) {
+	experimentMutex.Lock()
+	list := make([]Experiment, 0, len(experiments))
+	for _, experiment := range experiments {
+		list = append(list, *experiment)
+	}
+	experimentMutex.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.After(list[j].CreatedAt) })
+	c.JSON(http.StatusOK, gin.H{"experiments": list, "count": len(list)})
+}
+
+// stopExperiment ends an experiment; its results stay available (admin)
+func stopExperiment(c *gin.Context) {
+	var snapshot Experiment
+	err := updateExperiments(func(all map[string]*Experiment) error {
+		current, exists := all[c.Param("id")]
+		if !exists {
+			return errExperimentNotFound
+		}
+		snapshot = *current
+		if snapshot.Running {
+			now := time.Now().UTC()
+			snapshot.Running = false
+			snapshot.StoppedAt = &now
+		}
+		stopped := snapshot
+		all[snapshot.ID] = &stopped
+		return nil
+	})
+	if err != nil {
+		respondExperimentError(c, err)
+		return
+	}
+	auditChange(c, "experiment.stopped", "experiment:"+snapshot.ID, nil, snapshot)
+	c.JSON(http.StatusOK, snapshot)
+}
+
+// getExperimentResults compares an experiment's variants (admin)
+func getExperimentResults(c *gin.Context) {
+	experimentMutex.Lock()
+	experiment, exists := experiments[c.Param("id")]
+	var snapshot Experiment
+	if exists {
+		snapshot = *experiment
+	}
+	experimentMutex.Unlock()
+	if !exists {
+		respondExperimentError(c, errExperimentNotFound)
+		return
+	}
+	queries, err := experimentQueries(snapshot.ID)
+	if err != nil {
+		respondExperimentError(c, err)
+		return
+	}
+	results := experimentResults(snapshot, queries)
+	c.JSON(http.StatusOK, gin.H{"experiment": snapshot, "variants": results})
+}
+
+// listQueryHistory lists recent queries, newest first; ?experiment= and
+// ?variant= filter them (admin)
+func listQueryHistory(c *gin.Context) {
+	limit := 100
+	if raw := c.Query("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 || n > maxQueryHistory {
+			respondError(c, http.StatusBadRequest, codeInvalidRequest,
+				fmt.Sprintf(translate(requestLanguage(c), "limit must be between 1 and %d"), maxQueryHistory))
+			return
+		}
+		limit = n
+	}
+	experimentID, variant := c.Query("experiment"), c.Query("variant")
+
+	// An experiment's queries are kept for every replica
+	if experimentID != "" {
+		queries, err := experimentQueries(experimentID)
+		if err != nil {
+			respondExperimentError(c, err)
+			return
+		}
+		records := make([]QueryRecord, 0, min(limit, len(queries)))
+		for i := len(queries) - 1; i >= 0 && len(records) < limit; i-- {
+			if variant == "" || queries[i].Variant == variant {
+				records = append(records, queries[i].QueryRecord)
+			}
+		}
+		c.JSON(http.StatusOK, gin.H{"queries": records, "count": len(records)})
+		return
+	}
+
+	experimentMutex.Lock()
+	records := make([]QueryRecord, 0, min(limit, len(queryHistory)))
+	for i := len(queryHistory) - 1; i >= 0 && len(records) < limit; i-- {
+		record := queryHistory[i]
+		if variant == "" || record.Variant == variant {
+			records = append(records, *record)
+		}
+	}
+	experimentMutex.Unlock()
+	c.JSON(http.StatusOK, gin.H{"queries": records, "count": len(records)})
+}
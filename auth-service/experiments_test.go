@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useExperiments gives a test no experiments and an empty query history
+func useExperiments(t *testing.T) {
+	t.Helper()
+	reset := func() {
+		experimentMutex.Lock()
+		experiments, queryHistory, queryIndex = make(map[string]*Experiment), nil, make(map[string]*QueryRecord)
+		experimentMutex.Unlock()
+		localRecords = newMemoryRecords()
+	}
+	reset()
+	t.Cleanup(reset)
+}
+
+func TestAssignVariant(t *testing.T) {
+	experiment := &Experiment{ID: "exp", Variants: []ExperimentVariant{{Name: "a", Weight: 3}, {Name: "b", Weight: 1}}}
+	counts := make(map[string]int)
+	for i := 0; i < 4000; i++ {
+		unit := fmt.Sprintf("user-%d", i)
+		variant := assignVariant(experiment, unit)
+		if again := assignVariant(experiment, unit); again.Name != variant.Name {
+			t.Fatalf("%s assigned %s then %s", unit, variant.Name, again.Name)
+		}
+		counts[variant.Name]++
+	}
+	if counts["a"] < 2700 || counts["a"] > 3300 {
+		t.Fatalf("weights not respected: %v", counts)
+	}
+}
+
+func TestExperiments(t *testing.T) {
+	ts := newTestServer(t)
+	withConfig(t, func(cfg *Config) {
+		cfg.Auth.InternalAPIToken = testInternalToken
+		cfg.Search.Rerankers = []string{"cross-encoder"}
+	})
+	useExperiments(t)
+	admin := ts.admin("admin@example.com")
+	owner, ownerID := ts.register("owner@example.com")
+	ts.do(http.MethodPost, "/v1/documents/register", owner, `{"filename":"handbook.pdf"}`)
+
+	var sent []StreamQueryRequest
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req StreamQueryRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		sent = append(sent, req)
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte("data: Thirty days\n\ndata: [DONE]\n\n"))
+	}))
+	defer backend.Close()
+	withConfig(t, func(cfg *Config) { cfg.RAGBackend.URL = backend.URL })
+
+	if w := ts.do(http.MethodPost, "/v1/admin/experiments", admin,
+		`{"name":"Unknown","variants":[{"name":"a"},{"name":"b","settings":{"reranker":"other"}}]}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("unknown reranker: got %d, want 400", w.Code)
+	}
+	if w := ts.do(http.MethodPost, "/v1/admin/experiments", admin,
+		`{"name":"Dup","variants":[{"name":"a"},{"name":"a"}]}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("duplicate variants: got %d, want 400", w.Code)
+	}
+	var experiment Experiment
+	w := ts.do(http.MethodPost, "/v1/admin/experiments", admin, `{"name":"Top-k","variants":[`+
+		`{"name":"k4","settings":{"n_chunks":4}},{"name":"k8","settings":{"n_chunks":8,"reranker":"cross-encoder"}}]}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create experiment: %d %s", w.Code, w.Body)
+	}
+	decodeJSON(t, w, &experiment)
+	if experiment.Unit != experimentUnitUser || !experiment.Running {
+		t.Fatalf("experiment: %+v", experiment)
+	}
+	if w := ts.do(http.MethodPost, "/v1/admin/experiments", admin,
+		`{"name":"Second","variants":[{"name":"a"},{"name":"b"}]}`); w.Code != http.StatusConflict {
+		t.Fatalf("second running experiment: got %d, want 409", w.Code)
+	}
+
+	// Admins query without a source filter, which keeps the backend
+	// stub simple
+	_, analystID := ts.register("analyst@example.com")
+	analyst := ts.srv.svc.users.ByID(analystID)
+	analyst.Role = "admin"
+	asker, err := ts.srv.svc.IssueToken(analyst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Streaming needs a real connection rather than a recorder
+	gateway := httptest.NewServer(ts.srv)
+	defer gateway.Close()
+	query := func(body, requestID string) {
+		req, _ := http.NewRequest(http.MethodPost, gateway.URL+"/v1/query/stream", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+asker)
+		req.Header.Set("Content-Type", "application/json")
+		if requestID != "" {
+			req.Header.Set(requestIDHeader, requestID)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("query: %s", resp.Status)
+		}
+	}
+	want := assignVariant(&experiment, analystID)
+	for i := 0; i < 2; i++ {
+		query(`{"question":"How long are refunds?","n_chunks":2}`, fmt.Sprintf("query-%d", i))
+	}
+	if len(sent) != 2 || sent[0].Variant != experiment.ID+"/"+want.Name || sent[1].Variant != sent[0].Variant ||
+		sent[0].NChunks != want.Settings.NChunks || sent[0].Search.Reranker != want.Settings.Reranker {
+		t.Fatalf("backend requests: %+v, want variant %s", sent, want.Name)
+	}
+
+	ts.do(http.MethodPost, "/v1/internal/access/citations", "", `{"user_id":"`+ownerID+`","query_id":"query-0","citations":[`+
+		`{"filename":"handbook.pdf","chunk_id":"c1"}]}`, internalTokenHeader, testInternalToken)
+
+	var history struct {
+		Queries []QueryRecord `json:"queries"`
+	}
+	decodeJSON(t, ts.do(http.MethodGet, "/v1/admin/queries?experiment="+experiment.ID, admin, ""), &history)
+	if len(history.Queries) != 2 || history.Queries[0].ID != "query-1" || history.Queries[1].Citations != 1 ||
+		history.Queries[0].Variant != want.Name || history.Queries[0].Outcome != queryAnswered || history.Queries[0].AnswerLength != len("Thirty days") {
+		t.Fatalf("history: %+v", history.Queries)
+	}
+
+	var results struct {
+		Variants []VariantResults `json:"variants"`
+	}
+	decodeJSON(t, ts.do(http.MethodGet, "/v1/admin/experiments/"+experiment.ID+"/results", admin, ""), &results)
+	for _, r := range results.Variants {
+		if r.Variant == want.Name && (r.Queries != 2 || r.Units != 1 || r.CitedRate != 0.5 || r.MeanCitations != 0.5) {
+			t.Fatalf("results for %s: %+v", r.Variant, r)
+		}
+		if r.Variant != want.Name && r.Queries != 0 {
+			t.Fatalf("results for %s: %+v", r.Variant, r)
+		}
+	}
+
+	decodeJSON(t, ts.do(http.MethodPost, "/v1/admin/experiments/"+experiment.ID+"/stop", admin, ""), &experiment)
+	if experiment.Running || experiment.StoppedAt == nil {
+		t.Fatalf("stopped experiment: %+v", experiment)
+	}
+	query(`{"question":"And now?"}`, "")
+	if last := sent[len(sent)-1]; last.Variant != "" || last.Search.Reranker != "" {
+		t.Fatalf("query after stopping: %+v", last)
+	}
+	if w := ts.do(http.MethodGet, "/v1/admin/experiments/missing/results", admin, ""); w.Code != http.StatusNotFound {
+		t.Fatalf("unknown experiment: got %d, want 404", w.Code)
+	}
+}
+
+func TestExperimentsShared(t *testing.T) {
+	useSharedStore(t)
+	useExperiments(t)
+	ts := newTestServer(t)
+	admin := ts.admin("admin@example.com")
+
+	var experiment Experiment
+	w := ts.do(http.MethodPost, "/v1/admin/experiments", admin, `{"name":"Top-k","variants":[{"name":"a"},{"name":"b"}]}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create experiment: %d %s", w.Code, w.Body)
+	}
+	decodeJSON(t, w, &experiment)
+
+	// Another replica: nothing local but what the shared store holds
+	experimentMutex.Lock()
+	experiments = make(map[string]*Experiment)
+	experimentMutex.Unlock()
+	if err := refreshSetting(context.Background(), experimentsSetting); err != nil {
+		t.Fatal(err)
+	}
+	if w := ts.do(http.MethodPost, "/v1/admin/experiments", admin, `{"name":"Second","variants":[{"name":"a"},{"name":"b"}]}`); w.Code != http.StatusConflict {
+		t.Fatalf("second running experiment: got %d, want 409", w.Code)
+	}
+
+	// A query one replica served counts in results read on another, and
+	// so do citations reported to it
+	req := &StreamQueryRequest{}
+	record := startQueryRecord("q1", &User{ID: "u1"}, "", req)
+	finishQueryRecord(record, queryAnswered, time.Time{}, 10)
+	experimentMutex.Lock()
+	queryHistory, queryIndex = nil, make(map[string]*QueryRecord)
+	experimentMutex.Unlock()
+	noteQueryCitations("q1", 2)
+
+	var results struct {
+		Variants []VariantResults `json:"variants"`
+	}
+	decodeJSON(t, ts.do(http.MethodGet, "/v1/admin/experiments/"+experiment.ID+"/results", admin, ""), &results)
+	for _, r := range results.Variants {
+		if r.Variant == record.Variant && (r.Queries != 1 || r.Units != 1 || r.MeanCitations != 2) {
+			t.Fatalf("results for %s: %+v", r.Variant, r)
+		}
+	}
+	var history struct {
+		Queries []QueryRecord `json:"queries"`
+	}
+	decodeJSON(t, ts.do(http.MethodGet, "/v1/admin/queries?experiment="+experiment.ID, admin, ""), &history)
+	if len(history.Queries) != 1 || history.Queries[0].ID != "q1" || history.Queries[0].Citations != 2 {
+		t.Fatalf("history: %+v", history.Queries)
+	}
+
+	if w := ts.do(http.MethodPost, "/v1/admin/experiments/"+experiment.ID+"/stop", admin, ""); w.Code != http.StatusOK {
+		t.Fatalf("stop: %d %s", w.Code, w.Body)
+	}
+	data, _, _ := clusterStore.setting(context.Background(), experimentsSetting)
+	if !strings.Contains(string(data), `"running":false`) {
+		t.Fatalf("shared experiments after stop: %s", data)
+	}
+}
@@ -0,0 +1,522 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// ============================================================================
+// Data Exports
+// ============================================================================
+//
+// Admins export a date range of one dataset as CSV or JSON lines:
+//
+//	audit   audit log entries, oldest first
+//	logins  sign-ins from the login history
+//	usage   per-hour signups, active users, logins and documents added
+//
+// POST /admin/exports answers 202 at once and the file is written in the
+// background; GET /admin/exports/:id reports progress, and once the export
+// is ready its download_url serves the file to admins. Files are kept in
+// exports.dir for exports.retention after they finish and then deleted with
+// their record, as are files left over from a previous run, since records
+// are in memory. Exports are per replica, like jobs.
+//
+// Login history and usage counters are held in memory for a limited time
+// (the last sign-ins per user, 90 days of usage), so those exports cover
+// what the service still remembers.
+
+// ExportStatus is the lifecycle state of an export
+type ExportStatus string
+
+const (
+	ExportQueued  ExportStatus = "queued"
+	ExportRunning ExportStatus = "running"
+	ExportReady   ExportStatus = "ready"
+	ExportFailed  ExportStatus = "failed"
+)
+
+const (
+	exportDatasetAudit  = "audit"
+	exportDatasetLogins = "logins"
+	exportDatasetUsage  = "usage"
+
+	exportWorkers       = 2
+	maxPendingExports   = 10 // queued or running
+	exportSweepInterval = 10 * time.Minute
+	exportFilePrefix    = "export-"
+)
+
+var errExportsBusy = errors.New("Too many exports in progress; retry later")
+
+// ExportRequest for POST /admin/exports; the range is [since, until)
+type ExportRequest struct {
+	Dataset string    `json:"dataset" binding:"required,oneof=audit logins usage"`
+	Format  string    `json:"format" binding:"required,oneof=csv jsonl"`
+	Since   time.Time `json:"since" binding:"required"`
+	Until   time.Time `json:"until" binding:"required"`
+}
+
+// Export is an asynchronous data export
+type Export struct {
+	ID          string       `json:"id"`
+	Dataset     string       `json:"dataset"`
+	Format      string       `json:"format"`
+	Since       time.Time    `json:"since"`
+	Until       time.Time    `json:"until"`
+	Status      ExportStatus `json:"status"`
+	Rows        int          `json:"rows"`
+	SizeBytes   int64        `json:"size_bytes"`
+	Error       string       `json:"error,omitempty"`
+	CreatedBy   string       `json:"created_by"`
+	CreatedAt   time.Time    `json:"created_at"`
+	CompletedAt *time.Time   `json:"completed_at,omitempty"`
+	ExpiresAt   *time.Time   `json:"expires_at,omitempty"`
+	DownloadURL string       `json:"download_url,omitempty"`
+}
+
+var (
+	exports      = make(map[string]*Export)
+	exportsMutex sync.Mutex
+	exportSlots  = make(chan struct{}, exportWorkers)
+)
+
+// exportRecord is one row, as JSON for jsonl and as fields for CSV
+type exportRecord struct {
+	value  interface{}
+	fields []string
+}
+
+// LoginExportRow is one sign-in in a logins export
+type LoginExportRow struct {
+	At        time.Time `json:"at"`
+	UserID    string    `json:"user_id"`
+	Email     string    `json:"email"`
+	IP        string    `json:"ip,omitempty"`
+	UserAgent string    `json:"user_agent,omitempty"`
+	Device    string    `json:"device"`
+	Country   string    `json:"country,omitempty"`
+}
+
+// UsageExportRow is one hour in a usage export
+type UsageExportRow struct {
+	Hour           time.Time `json:"hour"`
+	Signups        int       `json:"signups"`
+	ActiveUsers    int       `json:"active_users"`
+	Logins         int       `json:"logins"`
+	LoginFailures  int       `json:"login_failures"`
+	DocumentsAdded int       `json:"documents_added"`
+}
+
+// exportPath is where an export's file is written
+func exportPath(export *Export) string {
+	return filepath.Join(config.Exports.Dir, exportFilePrefix+export.ID+"."+export.Format)
+}
+
+// startExport queues an export of svc's data and returns a snapshot of it
+func startExport(svc *Service, req ExportRequest, createdBy string) (Export, error) {
+	exportsMutex.Lock()
+	pending := 0
+	for _, export := range exports {
+		if export.Status == ExportQueued || export.Status == ExportRunning {
+			pending++
+		}
+	}
+	if pending >= maxPendingExports {
+		exportsMutex.Unlock()
+		return Export{}, errExportsBusy
+	}
+	export := &Export{
+		ID:        uuid.New().String(),
+		Dataset:   req.Dataset,
+		Format:    req.Format,
+		Since:     req.Since.UTC(),
+		Until:     req.Until.UTC(),
+		Status:    ExportQueued,
+		CreatedBy: createdBy,
+		CreatedAt: time.Now().UTC(),
+	}
+	exports[export.ID] = export
+	snapshot := *export
+	exportsMutex.Unlock()
+
+	goBackground(func(ctx context.Context) { runExport(ctx, svc, export) })
+	return snapshot, nil
+}
+
+// runExport writes an export's file once a worker slot is free
+func runExport(ctx context.Context, svc *Service, export *Export) {
+	select {
+	case exportSlots <- struct{}{}:
+		defer func() { <-exportSlots }()
+	case <-ctx.Done():
+		finishExport(export, 0, 0, errors.New("shutting down"))
+		return
+	}
+	exportsMutex.Lock()
+	export.Status = ExportRunning
+	exportsMutex.Unlock()
+
+	header, records, err := exportRecords(svc, export.Dataset, export.Since, export.Until)
+	if err != nil {
+		finishExport(export, 0, 0, err)
+		return
+	}
+	size, err := writeExport(exportPath(export), export.Format, header, records)
+	finishExport(export, len(records), size, err)
+}
+
+func finishExport(export *Export, rows int, size int64, err error) {
+	now := time.Now().UTC()
+	exportsMutex.Lock()
+	defer exportsMutex.Unlock()
+	export.CompletedAt = &now
+	if err != nil {
+		slog.Error("Export failed", "export_id", export.ID, "dataset", export.Dataset, "error", err)
+		export.Status, export.Error = ExportFailed, "Export could not be written"
+		return
+	}
+	expiresAt := now.Add(config.Exports.Retention)
+	export.Status, export.Rows, export.SizeBytes, export.ExpiresAt = ExportReady, rows, size, &expiresAt
+}
+
+// exportRecords collects a dataset's rows in the range
+func exportRecords(svc *Service, dataset string, since, until time.Time) ([]string, []exportRecord, error) {
+	switch dataset {
+	case exportDatasetAudit:
+		records, err := auditExportRecords(since, until)
+		return auditCSVHeader, records, err
+	case exportDatasetLogins:
+		records, err := loginExportRecords(svc, since, until)
+		return []string{"at", "user_id", "email", "ip", "user_agent", "device", "country"}, records, err
+	default:
+		return []string{"hour", "signups", "active_users", "logins", "login_failures", "documents_added"}, usageExportRecords(svc, since, until), nil
+	}
+}
+
+func auditExportRecords(since, until time.Time) ([]exportRecord, error) {
+	matched, err := selectAudit(context.Background(), auditFilter{since: since, until: until})
+	if err != nil {
+		return nil, err
+	}
+	records := make([]exportRecord, len(matched))
+	for i, entry := range matched {
+		// selectAudit is newest first
+		records[len(matched)-1-i] = exportRecord{value: entry, fields: auditCSVRow(entry)}
+	}
+	return records, nil
+}
+
+func loginExportRecords(svc *Service, since, until time.Time) ([]exportRecord, error) {
+	histories, err := keyedRecords().records(context.Background(), loginHistoryRecord)
+	if err != nil {
+		return nil, err
+	}
+	var rows []LoginExportRow
+	for userID, data := range histories {
+		var history []LoginRecord
+		if json.Unmarshal(data, &history) != nil {
+			continue
+		}
+		for _, login := range history {
+			if !login.At.Before(since) && login.At.Before(until) {
+				rows = append(rows, LoginExportRow{At: login.At, UserID: userID, IP: login.IP, UserAgent: login.UserAgent, Device: login.Device, Country: login.Country})
+			}
+		}
+	}
+	sort.Slice(rows, func(i, j int) bool { return rows[i].At.Before(rows[j].At) })
+
+	records := make([]exportRecord, len(rows))
+	for i := range rows {
+		_, rows[i].Email, _ = svc.users.Contact(rows[i].UserID)
+		row := rows[i]
+		records[i] = exportRecord{value: row, fields: csvSafeRow([]string{
+			row.At.Format(time.RFC3339Nano), row.UserID, row.Email, row.IP, row.UserAgent, row.Device, row.Country,
+		})}
+	}
+	return records, nil
+}
+
+// usageExportRecords reports the hours in the range that saw any activity
+func usageExportRecords(svc *Service, since, until time.Time) []exportRecord {
+	hours := make(map[int64]*UsageExportRow)
+	hourOf := func(t time.Time) *UsageExportRow {
+		if t.Before(since) || !t.Before(until) {
+			return nil
+		}
+		hour := t.Unix() / 3600
+		if hours[hour] == nil {
+			hours[hour] = &UsageExportRow{Hour: time.Unix(hour*3600, 0).UTC()}
+		}
+		return hours[hour]
+	}
+
+	svc.users.Each(func(user *User) {
+		if row := hourOf(user.CreatedAt); row != nil {
+			row.Signups++
+		}
+	})
+	svc.documents.View(func(tx DocumentTx) {
+		tx.each(func(_ string, record documentRecord) {
+			if row := hourOf(record.AddedAt); row != nil {
+				row.DocumentsAdded++
+			}
+		})
+	})
+	statsMutex.Lock()
+	for hour, stats := range hourlyStats {
+		if row := hourOf(time.Unix(hour*3600, 0)); row != nil {
+			row.ActiveUsers, row.Logins, row.LoginFailures = len(stats.active), stats.logins, stats.loginFailures
+		}
+	}
+	statsMutex.Unlock()
+
+	rows := make([]*UsageExportRow, 0, len(hours))
+	for _, row := range hours {
+		rows = append(rows, row)
+	}
+	sort.Slice(rows, func(i, j int) bool { return rows[i].Hour.Before(rows[j].Hour) })
+	records := make([]exportRecord, len(rows))
+	for i, row := range rows {
+		records[i] = exportRecord{value: *row, fields: []string{
+			row.Hour.Format(time.RFC3339), strconv.Itoa(row.Signups), strconv.Itoa(row.ActiveUsers),
+			strconv.Itoa(row.Logins), strconv.Itoa(row.LoginFailures), strconv.Itoa(row.DocumentsAdded),
+		}}
+	}
+	return records
+}
+
+func csvSafeRow(row []string) []string {
+	for i := range row {
+		row[i] = csvSafe(row[i])
+	}
+	return row
+}
+
+// writeExport writes records to path and returns the file's size. The file
+// appears under its name only once complete.
+func writeExport(path, format string, header []string, records []exportRecord) (int64, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return 0, err
+	}
+	tmp := path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp) // no-op once renamed
+
+	buffered := bufio.NewWriter(file)
+	if format == "csv" {
+		w := csv.NewWriter(buffered)
+		w.Write(header)
+		for _, record := range records {
+			w.Write(record.fields)
+		}
+		w.Flush()
+		err = w.Error()
+	} else {
+		encoder := json.NewEncoder(buffered)
+		for _, record := range records {
+			if err = encoder.Encode(record.value); err != nil {
+				break
+			}
+		}
+	}
+	if err == nil {
+		err = buffered.Flush()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return 0, err
+	}
+	info, err := os.Stat(tmp)
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), os.Rename(tmp, path)
+}
+
+// removeExport forgets an export and deletes its file; callers hold
+// exportsMutex
+func removeExport(export *Export) {
+	delete(exports, export.ID)
+	os.Remove(exportPath(export))
+}
+
+// startExports deletes files from a previous run, which no record points
+// to any more, and starts expiring finished exports
+func startExports() {
+	if entries, err := os.ReadDir(config.Exports.Dir); err == nil {
+		for _, entry := range entries {
+			if strings.HasPrefix(entry.Name(), exportFilePrefix) {
+				os.Remove(filepath.Join(config.Exports.Dir, entry.Name()))
+			}
+		}
+	}
+
+	goBackground(func(ctx context.Context) {
+		ticker := time.NewTicker(exportSweepInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			sweepExports(time.Now())
+		}
+	})
+}
+
+// sweepExports removes finished exports past their retention
+func sweepExports(now time.Time) {
+	exportsMutex.Lock()
+	defer exportsMutex.Unlock()
+	for _, export := range exports {
+		if export.CompletedAt != nil && now.Sub(*export.CompletedAt) >= config.Exports.Retention {
+			removeExport(export)
+		}
+	}
+}
+
+// exportSnapshot copies an export for a response, with its download link
+// once ready; callers hold exportsMutex
+func exportSnapshot(c *gin.Context, export *Export) Export {
+	snapshot := *export
+	if export.Status == ExportReady {
+		version, _ := splitAPIVersion(c.FullPath())
+		snapshot.DownloadURL = "/" + version + "/admin/exports/" + export.ID + "/download"
+	}
+	return snapshot
+}
+
+// findExport returns an unexpired export; callers hold exportsMutex
+func findExport(id string) *Export {
+	export, exists := exports[id]
+	if !exists {
+		return nil
+	}
+	if export.ExpiresAt != nil && !time.Now().Before(*export.ExpiresAt) {
+		removeExport(export)
+		return nil
+	}
+	return export
+}
+
+// ----------------------------------------------------------------------------
+// Handlers
+// ----------------------------------------------------------------------------
+
+// createExport queues an export (admin only)
+func (s *Server) createExport(c *gin.Context) {
+	var req ExportRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondBindError(c, err)
+		return
+	}
+	if !req.Until.After(req.Since) {
+		respondError(c, http.StatusBadRequest, codeInvalidRequest, "until must be after since")
+		return
+	}
+	user, _ := c.Get("user")
+	export, err := startExport(s.svc, req, user.(*User).ID)
+	if err == errExportsBusy {
+		c.Header("Retry-After", "30")
+		respondError(c, http.StatusServiceUnavailable, codeQueueFull, err.Error())
+		return
+	}
+
+	auditChange(c, "export.create", "export:"+export.ID, nil, req)
+	c.JSON(http.StatusAccepted, export)
+}
+
+// listExports returns exports, newest first (admin only)
+func listExports(c *gin.Context) {
+	exportsMutex.Lock()
+	list := make([]Export, 0, len(exports))
+	for id := range exports {
+		if export := findExport(id); export != nil {
+			list = append(list, exportSnapshot(c, export))
+		}
+	}
+	exportsMutex.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.After(list[j].CreatedAt) })
+	c.JSON(http.StatusOK, gin.H{"exports": list, "total": len(list)})
+}
+
+// getExport reports an export's progress (admin only)
+func getExport(c *gin.Context) {
+	exportsMutex.Lock()
+	defer exportsMutex.Unlock()
+	export := findExport(c.Param("id"))
+	if export == nil {
+		respondError(c, http.StatusNotFound, codeNotFound, "Export not found")
+		return
+	}
+	c.JSON(http.StatusOK, exportSnapshot(c, export))
+}
+
+// downloadExport serves a ready export's file (admin only)
+func downloadExport(c *gin.Context) {
+	exportsMutex.Lock()
+	export := findExport(c.Param("id"))
+	var snapshot Export
+	if export != nil {
+		snapshot = *export
+	}
+	exportsMutex.Unlock()
+	switch {
+	case export == nil:
+		respondError(c, http.StatusNotFound, codeNotFound, "Export not found")
+		return
+	case snapshot.Status != ExportReady:
+		respondError(c, http.StatusConflict, codeConflict, "Export is not ready")
+		return
+	}
+
+	auditChange(c, "export.download", "export:"+snapshot.ID, nil, nil)
+	contentType := "text/csv; charset=utf-8"
+	if snapshot.Format == "jsonl" {
+		contentType = "application/x-ndjson"
+	}
+	c.Header("Content-Type", contentType)
+	name := snapshot.Dataset + "-" + snapshot.Since.Format("20060102T150405Z") + "-" + snapshot.Until.Format("20060102T150405Z") + "." + snapshot.Format
+	c.FileAttachment(exportPath(&snapshot), name)
+}
+
+// deleteExport removes an export and its file before it expires (admin
+// only)
+func deleteExport(c *gin.Context) {
+	exportsMutex.Lock()
+	defer exportsMutex.Unlock()
+	export := findExport(c.Param("id"))
+	switch {
+	case export == nil:
+		respondError(c, http.StatusNotFound, codeNotFound, "Export not found")
+		return
+	case export.CompletedAt == nil:
+		respondError(c, http.StatusConflict, codeConflict, "Export is not ready")
+		return
+	}
+	removeExport(export)
+	auditChange(c, "export.delete", "export:"+export.ID, *export, nil)
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useExports gives a test its own export directory and records
+func useExports(t *testing.T) {
+	t.Helper()
+	dir := t.TempDir()
+	withConfig(t, func(cfg *Config) { cfg.Exports.Dir = dir })
+	reset := func() {
+		exportsMutex.Lock()
+		exports = make(map[string]*Export)
+		exportsMutex.Unlock()
+	}
+	reset()
+	t.Cleanup(reset)
+}
+
+// awaitExport polls an export until it has finished
+func (ts *testServer) awaitExport(token, id string) Export {
+	ts.t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		var export Export
+		decodeJSON(ts.t, ts.do(http.MethodGet, "/v1/admin/exports/"+id, token, ""), &export)
+		if export.Status == ExportReady || export.Status == ExportFailed {
+			return export
+		}
+		if time.Now().After(deadline) {
+			ts.t.Fatalf("export still %s", export.Status)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// export runs an export of the last hour and returns its file
+func (ts *testServer) export(token, dataset, format string) (Export, string) {
+	ts.t.Helper()
+	now := time.Now().UTC()
+	body := `{"dataset":"` + dataset + `","format":"` + format + `","since":"` + now.Add(-time.Hour).Format(time.RFC3339) +
+		`","until":"` + now.Add(time.Hour).Format(time.RFC3339) + `"}`
+	w := ts.do(http.MethodPost, "/v1/admin/exports", token, body)
+	if w.Code != http.StatusAccepted {
+		ts.t.Fatalf("create %s: %d %s", dataset, w.Code, w.Body)
+	}
+	var queued Export
+	decodeJSON(ts.t, w, &queued)
+
+	export := ts.awaitExport(token, queued.ID)
+	if export.Status != ExportReady || export.ExpiresAt == nil || export.DownloadURL != "/v1/admin/exports/"+export.ID+"/download" {
+		ts.t.Fatalf("export = %+v", export)
+	}
+	w = ts.do(http.MethodGet, export.DownloadURL, token, "")
+	if w.Code != http.StatusOK || !strings.Contains(w.Header().Get("Content-Disposition"), dataset+"-") {
+		ts.t.Fatalf("download: %d %v", w.Code, w.Header())
+	}
+	return export, w.Body.String()
+}
+
+func TestExports(t *testing.T) {
+	useExports(t)
+	ts := newTestServer(t)
+	admin := ts.admin("exports-admin@example.com")
+	ts.register("exported@example.com")
+	ts.login("exported@example.com", "secret123", http.StatusOK)
+
+	export, body := ts.export(admin, exportDatasetLogins, "csv")
+	lines := strings.Split(strings.TrimSpace(body), "\n")
+	if lines[0] != "at,user_id,email,ip,user_agent,device,country" || !strings.Contains(body, "exported@example.com") || export.Rows != len(lines)-1 {
+		t.Fatalf("logins export (%d rows):\n%s", export.Rows, body)
+	}
+
+	_, body = ts.export(admin, exportDatasetUsage, "jsonl")
+	var hour UsageExportRow
+	if err := json.Unmarshal([]byte(strings.Split(body, "\n")[0]), &hour); err != nil || hour.Signups < 2 {
+		t.Fatalf("usage export: %v\n%s", err, body)
+	}
+
+	_, body = ts.export(admin, exportDatasetAudit, "jsonl")
+	if !strings.Contains(body, `"action":"export.create"`) {
+		t.Fatalf("audit export misses the exports themselves:\n%s", body)
+	}
+
+	// Only admins, and only sensible ranges
+	userToken, _ := ts.register("not-admin@example.com")
+	if w := ts.do(http.MethodGet, "/v1/admin/exports", userToken, ""); w.Code != http.StatusForbidden {
+		t.Fatalf("non-admin list: %d", w.Code)
+	}
+	w := ts.do(http.MethodPost, "/v1/admin/exports", admin,
+		`{"dataset":"audit","format":"csv","since":"2026-02-01T00:00:00Z","until":"2026-01-01T00:00:00Z"}`)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("backwards range: %d", w.Code)
+	}
+
+	var list struct {
+		Exports []Export `json:"exports"`
+		Total   int      `json:"total"`
+	}
+	decodeJSON(t, ts.do(http.MethodGet, "/v1/admin/exports", admin, ""), &list)
+	if list.Total != 3 || list.Exports[0].Dataset != exportDatasetAudit {
+		t.Fatalf("list = %+v", list)
+	}
+}
+
+func TestExportExpiry(t *testing.T) {
+	useExports(t)
+	ts := newTestServer(t)
+	admin := ts.admin("expiry-admin@example.com")
+	export, _ := ts.export(admin, exportDatasetUsage, "csv")
+	path := exportPath(&export)
+	if _, err := os.Stat(path); err != nil {
+		t.Fatal(err)
+	}
+
+	// Past its expiry the export is gone even before the sweep runs
+	exportsMutex.Lock()
+	expired := time.Now().Add(-time.Second)
+	exports[export.ID].ExpiresAt = &expired
+	exportsMutex.Unlock()
+	if w := ts.do(http.MethodGet, export.DownloadURL, admin, ""); w.Code != http.StatusNotFound {
+		t.Fatalf("expired download: %d", w.Code)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("expired file kept: %v", err)
+	}
+
+	// The sweep removes exports retention has passed
+	export, _ = ts.export(admin, exportDatasetUsage, "jsonl")
+	sweepExports(time.Now().Add(config.Exports.Retention))
+	if w := ts.do(http.MethodGet, "/v1/admin/exports/"+export.ID, admin, ""); w.Code != http.StatusNotFound {
+		t.Fatalf("swept export: %d", w.Code)
+	}
+	if _, err := os.Stat(exportPath(&export)); !os.IsNotExist(err) {
+		t.Fatalf("swept file kept: %v", err)
+	}
+
+	// Files from a previous run are cleared on start
+	stale := exportPath(&Export{ID: "stale", Format: "csv"})
+	os.WriteFile(stale, []byte("x"), 0o600)
+	startExports()
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Fatalf("stale file kept: %v", err)
+	}
+}
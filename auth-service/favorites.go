@@ -0,0 +1,174 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ============================================================================
+// Starred and Recent Documents
+// ============================================================================
+//
+// Two short lists let the chat UI offer sources without listing everything.
+//
+// Members star documents they read often with POST
+// /documents/:filename/star; stars are kept on the user record, so they
+// follow the account across instances, and GET /documents/starred lists
+// them, newest first. Recent documents come from access events: the sources
+// a member picks for a streamed query and those the gateway reports
+// retrieving for them (accesslog.go). GET /documents/recent lists the last
+// maxRecentDocuments, most recent first; like notifications, the list lives
+// in memory on the instance that saw the access. Both lists leave out
+// documents the member can no longer read.
+
+const (
+	maxStarredDocuments = 200
+	maxRecentDocuments  = 50
+)
+
+var errTooManyStars = errors.New("Too many starred documents; unstar some first")
+
+// RecentDocument is a document a member used lately
+type RecentDocument struct {
+	Filename   string    `json:"filename"`
+	AccessedAt time.Time `json:"accessed_at"`
+}
+
+var (
+	recentDocuments     = make(map[string][]RecentDocument) // user_id -> most recent first
+	recentDocumentMutex sync.Mutex
+)
+
+// canRead reports whether a user may read a registered document
+func (s *Service) canRead(user *User, filename string) bool {
+	var readable bool
+	s.documents.View(func(tx DocumentTx) {
+		_, exists := tx.get(filename)
+		readable = exists && (user.Role == "admin" || s.readable(tx, user, filename))
+	})
+	return readable
+}
+
+// readableOf keeps the filenames a user may still read, in order
+func (s *Service) readableOf(user *User, filenames []string) []string {
+	kept := make([]string, 0, len(filenames))
+	s.documents.View(func(tx DocumentTx) {
+		for _, filename := range filenames {
+			if _, exists := tx.get(filename); exists && (user.Role == "admin" || s.readable(tx, user, filename)) {
+				kept = append(kept, filename)
+			}
+		}
+	})
+	return kept
+}
+
+// StarDocument stars or unstars a document for a user
+func (s *Service) StarDocument(user *User, filename string, star bool) error {
+	if star && !s.canRead(user, filename) {
+		return errDocumentNotFound
+	}
+
+	lock := s.users.FieldLock(user)
+	lock.Lock()
+	defer lock.Unlock()
+	previous := user.Starred
+	i := slices.Index(previous, filename)
+	switch {
+	case star && i >= 0, !star && i < 0:
+		return nil
+	case star && len(previous) >= maxStarredDocuments:
+		return errTooManyStars
+	case star:
+		user.Starred = append(slices.Clip(previous), filename)
+	default:
+		user.Starred = slices.Delete(slices.Clone(previous), i, i+1)
+	}
+	if err := saveUser(user); err != nil {
+		user.Starred = previous
+		return err
+	}
+	return nil
+}
+
+// StarredDocuments returns the documents a user starred and may still
+// read, newest first
+func (s *Service) StarredDocuments(user *User) []string {
+	lock := s.users.FieldLock(user)
+	lock.RLock()
+	starred := slices.Clone(user.Starred)
+	lock.RUnlock()
+	slices.Reverse(starred)
+	return s.readableOf(user, starred)
+}
+
+// touchDocuments moves documents to the front of a user's recent list
+func touchDocuments(userID string, filenames []string, now time.Time) {
+	if len(filenames) == 0 {
+		return
+	}
+	recentDocumentMutex.Lock()
+	defer recentDocumentMutex.Unlock()
+	recent := make([]RecentDocument, 0, maxRecentDocuments)
+	for _, filename := range filenames {
+		if len(recent) < maxRecentDocuments && !slices.ContainsFunc(recent, func(r RecentDocument) bool { return r.Filename == filename }) {
+			recent = append(recent, RecentDocument{Filename: filename, AccessedAt: now})
+		}
+	}
+	for _, previous := range recentDocuments[userID] {
+		if len(recent) < maxRecentDocuments && !slices.Contains(filenames, previous.Filename) {
+			recent = append(recent, previous)
+		}
+	}
+	recentDocuments[userID] = recent
+}
+
+// RecentDocuments returns the documents a user used lately and may still
+// read, most recent first
+func (s *Service) RecentDocuments(user *User) []RecentDocument {
+	recentDocumentMutex.Lock()
+	recent := slices.Clone(recentDocuments[user.ID])
+	recentDocumentMutex.Unlock()
+
+	filenames := make([]string, len(recent))
+	for i, r := range recent {
+		filenames[i] = r.Filename
+	}
+	readable := s.readableOf(user, filenames)
+	return slices.DeleteFunc(recent, func(r RecentDocument) bool { return !slices.Contains(readable, r.Filename) })
+}
+
+// ----------------------------------------------------------------------------
+// Handlers
+// ----------------------------------------------------------------------------
+
+// starDocument stars (POST) or unstars (DELETE) a document
+func (s *Server) starDocument(c *gin.Context) {
+	filename := c.Param("filename")
+	star := c.Request.Method == http.MethodPost
+	if err := s.svc.StarDocument(c.MustGet("user").(*User), filename, star); err != nil {
+		if err == errTooManyStars {
+			respondError(c, http.StatusConflict, codeConflict, err.Error())
+			return
+		}
+		respondServiceError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"filename": filename, "starred": star})
+}
+
+// getStarredDocuments lists the current user's starred documents
+func (s *Server) getStarredDocuments(c *gin.Context) {
+	docs := s.svc.StarredDocuments(c.MustGet("user").(*User))
+	c.JSON(http.StatusOK, gin.H{"documents": docs, "count": len(docs)})
+}
+
+// getRecentDocuments lists the documents the current user used lately
+func (s *Server) getRecentDocuments(c *gin.Context) {
+	docs := s.svc.RecentDocuments(c.MustGet("user").(*User))
+	c.JSON(http.StatusOK, gin.H{"documents": docs, "count": len(docs)})
+}
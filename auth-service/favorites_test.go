@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestStarredAndRecentDocuments(t *testing.T) {
+	ts := newTestServer(t)
+	withConfig(t, func(cfg *Config) { cfg.Auth.InternalAPIToken = testInternalToken })
+	owner, ownerID := ts.register("owner@example.com")
+	other, _ := ts.register("other@example.com")
+	for _, filename := range []string{"a.pdf", "b.pdf", "c.pdf"} {
+		ts.do(http.MethodPost, "/v1/documents/register", owner, `{"filename":"`+filename+`"}`)
+	}
+
+	var list struct {
+		Documents []string `json:"documents"`
+	}
+	if w := ts.do(http.MethodPost, "/v1/documents/a.pdf/star", other, ""); w.Code != http.StatusNotFound {
+		t.Fatalf("star unreadable: got %d, want 404", w.Code)
+	}
+	ts.do(http.MethodPost, "/v1/documents/a.pdf/star", owner, "")
+	ts.do(http.MethodPost, "/v1/documents/b.pdf/star", owner, "")
+	ts.do(http.MethodPost, "/v1/documents/b.pdf/star", owner, "") // again: no-op
+	decodeJSON(t, ts.do(http.MethodGet, "/v1/documents/starred", owner, ""), &list)
+	if len(list.Documents) != 2 || list.Documents[0] != "b.pdf" {
+		t.Fatalf("starred: %v", list.Documents)
+	}
+	ts.do(http.MethodDelete, "/v1/documents/b.pdf/star", owner, "")
+	decodeJSON(t, ts.do(http.MethodGet, "/v1/documents/starred", owner, ""), &list)
+	if len(list.Documents) != 1 || list.Documents[0] != "a.pdf" {
+		t.Fatalf("after unstar: %v", list.Documents)
+	}
+
+	// Retrievals reported by the gateway move documents to the front
+	report := func(documents string) {
+		ts.do(http.MethodPost, "/v1/internal/access/retrievals", "",
+			`{"user_id":"`+ownerID+`","documents":[`+documents+`]}`, internalTokenHeader, testInternalToken)
+	}
+	report(`"a.pdf","b.pdf"`)
+	report(`"c.pdf","b.pdf"`)
+	var recent struct {
+		Documents []RecentDocument `json:"documents"`
+	}
+	decodeJSON(t, ts.do(http.MethodGet, "/v1/documents/recent", owner, ""), &recent)
+	if len(recent.Documents) != 3 || recent.Documents[0].Filename != "c.pdf" || recent.Documents[2].Filename != "a.pdf" {
+		t.Fatalf("recent: %+v", recent.Documents)
+	}
+
+	// Documents that are gone drop out of both lists
+	ts.do(http.MethodDelete, "/v1/documents/a.pdf", owner, "")
+	decodeJSON(t, ts.do(http.MethodGet, "/v1/documents/starred", owner, ""), &list)
+	decodeJSON(t, ts.do(http.MethodGet, "/v1/documents/recent", owner, ""), &recent)
+	if len(list.Documents) != 0 || len(recent.Documents) != 2 {
+		t.Fatalf("after release: starred %v, recent %+v", list.Documents, recent.Documents)
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"net/http"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ============================================================================
+// Document Types
+// ============================================================================
+//
+// Uploads (and connector downloads) are checked against
+// documents.allowed_types before anything is stored. The type comes from
+// the content, not the name: http.DetectContentType recognizes PDF and
+// HTML, a ZIP is a DOCX only if it holds word/document.xml, and plain text
+// is Markdown when its name says so, since nothing in the bytes tells the
+// two apart. A file whose name claims a different known type than its
+// content is refused as well, so a script renamed to report.pdf doesn't get
+// through. The detected type is kept on the document record.
+//
+// Registering a document by name carries no content, so there only the
+// extension can be checked against the allowlist.
+
+// Document types documents.allowed_types may list
+const (
+	fileTypePDF  = "pdf"
+	fileTypeDOCX = "docx"
+	fileTypeTXT  = "txt"
+	fileTypeMD   = "md"
+	fileTypeHTML = "html"
+)
+
+var fileTypes = []string{fileTypePDF, fileTypeDOCX, fileTypeTXT, fileTypeMD, fileTypeHTML}
+
+// fileTypeMIME is the media type recorded for each document type
+var fileTypeMIME = map[string]string{
+	fileTypePDF:  "application/pdf",
+	fileTypeDOCX: "application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+	fileTypeTXT:  "text/plain",
+	fileTypeMD:   "text/markdown",
+	fileTypeHTML: "text/html",
+}
+
+// fileTypeByExtension maps filename extensions to document types
+var fileTypeByExtension = map[string]string{
+	".pdf":      fileTypePDF,
+	".docx":     fileTypeDOCX,
+	".txt":      fileTypeTXT,
+	".text":     fileTypeTXT,
+	".md":       fileTypeMD,
+	".markdown": fileTypeMD,
+	".html":     fileTypeHTML,
+	".htm":      fileTypeHTML,
+}
+
+// fileTypeError explains why a file was refused
+type fileTypeError struct {
+	Detected string // document type, or the sniffed media type if it is none
+	Claimed  string // document type the extension names, if it differs
+}
+
+func (e *fileTypeError) Error() string {
+	if e.Claimed != "" {
+		return fmt.Sprintf("File content is %s but its name says %s", e.Detected, e.Claimed)
+	}
+	return fmt.Sprintf("File type %s is not allowed", e.Detected)
+}
+
+// extensionType returns the document type a filename's extension names
+func extensionType(filename string) string {
+	return fileTypeByExtension[strings.ToLower(path.Ext(filename))]
+}
+
+// sniffFileType works out a file's document type from its content; for
+// content it doesn't recognize it returns the sniffed media type
+func sniffFileType(filename string, content []byte) string {
+	sniffed, _, _ := strings.Cut(http.DetectContentType(content), ";")
+	switch sniffed {
+	case "application/pdf":
+		return fileTypePDF
+	case "text/html":
+		return fileTypeHTML
+	case "text/plain":
+		if extensionType(filename) == fileTypeMD {
+			return fileTypeMD
+		}
+		return fileTypeTXT
+	case "application/zip":
+		if isDOCX(content) {
+			return fileTypeDOCX
+		}
+	}
+	return sniffed
+}
+
+// isDOCX reports whether a ZIP archive is a Word document
+func isDOCX(content []byte) bool {
+	archive, err := zip.NewReader(bytes.NewReader(content), int64(len(content)))
+	if err != nil {
+		return false
+	}
+	return slices.ContainsFunc(archive.File, func(f *zip.File) bool { return f.Name == "word/document.xml" })
+}
+
+// checkFileType sniffs an uploaded file and checks it against the
+// allowlist, returning its media type
+func checkFileType(filename string, content []byte) (string, error) {
+	detected := sniffFileType(filename, content)
+	if !slices.Contains(config.Documents.AllowedTypes, detected) {
+		return "", &fileTypeError{Detected: detected}
+	}
+	if claimed := extensionType(filename); claimed != "" && claimed != detected {
+		return "", &fileTypeError{Detected: detected, Claimed: claimed}
+	}
+	return fileTypeMIME[detected], nil
+}
+
+// checkFileExtension checks a document registered by name alone
+func checkFileExtension(filename string) error {
+	claimed := extensionType(filename)
+	if !slices.Contains(config.Documents.AllowedTypes, claimed) {
+		detected := strings.TrimPrefix(strings.ToLower(path.Ext(filename)), ".")
+		if detected == "" {
+			detected = "unknown"
+		}
+		return &fileTypeError{Detected: detected}
+	}
+	return nil
+}
+
+// respondFileTypeError reports a refused file with what was detected and
+// what is allowed
+func respondFileTypeError(c *gin.Context, err *fileTypeError) {
+	detail := fmt.Sprintf(translate(requestLanguage(c), "File type %s is not allowed"), err.Detected)
+	if err.Claimed != "" {
+		detail = fmt.Sprintf(translate(requestLanguage(c), "File content is %s but its name says %s"), err.Detected, err.Claimed)
+	}
+	extensions := map[string]interface{}{
+		"detected_type": err.Detected,
+		"allowed_types": config.Documents.AllowedTypes,
+	}
+	if err.Claimed != "" {
+		extensions["claimed_type"] = err.Claimed
+	}
+	respondProblem(c, Problem{
+		Status:     http.StatusUnsupportedMediaType,
+		Code:       codeFileTypeNotAllowed,
+		Detail:     detail,
+		Extensions: extensions,
+	})
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestCheckFileType(t *testing.T) {
+	var docx bytes.Buffer
+	zw := zip.NewWriter(&docx)
+	zw.Create("word/document.xml")
+	zw.Close()
+
+	for _, tc := range []struct {
+		filename string
+		content  []byte
+		want     string // media type, or "" if refused
+	}{
+		{"report.pdf", []byte("%PDF-1.7\n..."), "application/pdf"},
+		{"memo.docx", docx.Bytes(), fileTypeMIME[fileTypeDOCX]},
+		{"notes.md", []byte("# Notes\n"), "text/markdown"},
+		{"notes.txt", []byte("plain words"), "text/plain"},
+		{"page.html", []byte("<!DOCTYPE html><html></html>"), "text/html"},
+		{"report.pdf", []byte("<html><script>alert(1)</script></html>"), ""}, // renamed HTML
+		{"image.png", []byte("\x89PNG\r\n\x1a\n"), ""},
+		{"archive.docx", []byte("PK\x03\x04 not word"), ""},
+	} {
+		got, err := checkFileType(tc.filename, tc.content)
+		var typeErr *fileTypeError
+		if tc.want == "" && !errors.As(err, &typeErr) || got != tc.want {
+			t.Errorf("checkFileType(%s) = %q, %v; want %q", tc.filename, got, err, tc.want)
+		}
+	}
+
+	withConfig(t, func(cfg *Config) { cfg.Documents.AllowedTypes = []string{fileTypePDF} })
+	if _, err := checkFileType("notes.txt", []byte("plain words")); err == nil {
+		t.Error("text accepted with only pdf allowed")
+	}
+}
+
+func TestRegisterChecksExtension(t *testing.T) {
+	ts := newTestServer(t)
+	token, _ := ts.register("alice@example.com")
+	w := ts.do(http.MethodPost, "/v1/documents/register", token, `{"filename":"setup.exe"}`)
+	if w.Code != http.StatusUnsupportedMediaType || !strings.Contains(w.Body.String(), `"detected_type":"exe"`) {
+		t.Fatalf("register exe: %d %s", w.Code, w.Body)
+	}
+}
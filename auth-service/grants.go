@@ -0,0 +1,347 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"maps"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ============================================================================
+// Time-boxed Document Grants
+// ============================================================================
+//
+// A document's owner (or an admin) can share it with one other member until
+// a given time, e.g. an external reviewer who needs a source for a week:
+// POST /documents/:filename/grants with the grantee's email and
+// expires_at, either a date ("2025-01-31", good through the end of that day
+// UTC) or an RFC 3339 time. Until then the grantee reads the document like
+// an org-wide one, through the access filter, gRPC and the query proxy. The
+// grants live on the document record, so they are replicated, backed up and
+// survive restarts.
+//
+// Access ends on its own at expires_at; a sweep every grantSweepInterval,
+// run by one replica at a time, also drops the lapsed grant from the record
+// and tells the grantee in their inbox. The owner can end a grant early with DELETE
+// /documents/:filename/grants/:user_id, and the grantee lists what was
+// shared with them at GET /documents/shared.
+
+const grantSweepInterval = time.Minute
+
+// NotificationShareExpired tells a grantee their access has ended
+const NotificationShareExpired = "document.share_expired"
+
+var (
+	errGrantExpiry   = errors.New("expires_at must be a future date (YYYY-MM-DD) or RFC 3339 time")
+	errGrantToOwner  = errors.New("The owner can already read this document")
+	errGrantNotFound = errors.New("Grant not found")
+	errGranteeAbsent = errors.New("No active user has that email")
+)
+
+// DocumentGrantRequest for POST /documents/:filename/grants
+type DocumentGrantRequest struct {
+	Email     string `json:"email" binding:"required,email"`
+	ExpiresAt string `json:"expires_at" binding:"required"` // YYYY-MM-DD or RFC 3339
+}
+
+// DocumentGrant is one member's time-boxed access to a document
+type DocumentGrant struct {
+	Filename  string    `json:"filename"`
+	UserID    string    `json:"user_id"`
+	Email     string    `json:"email,omitempty"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// parseGrantExpiry reads expires_at; a bare date lasts through that day
+func parseGrantExpiry(value string, now time.Time) (time.Time, error) {
+	until, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		day, dayErr := time.Parse(time.DateOnly, value)
+		if dayErr != nil {
+			return time.Time{}, errGrantExpiry
+		}
+		until = day.AddDate(0, 0, 1)
+	}
+	if !until.After(now) {
+		return time.Time{}, errGrantExpiry
+	}
+	return until.UTC(), nil
+}
+
+// withGrant returns a copy of grants with userID's grant set, or removed if
+// until is zero; records are shared by value, so their map is never
+// changed in place
+func withGrant(grants map[string]time.Time, userID string, until time.Time) map[string]time.Time {
+	next := maps.Clone(grants)
+	if until.IsZero() {
+		delete(next, userID)
+	} else {
+		if next == nil {
+			next = make(map[string]time.Time)
+		}
+		next[userID] = until
+	}
+	if len(next) == 0 {
+		return nil
+	}
+	return next
+}
+
+// sharingRecord returns a document's record if actor may manage its grants
+func sharingRecord(tx DocumentTx, filename string, actor *User) (documentRecord, error) {
+	record, exists := tx.get(filename)
+	if !exists {
+		return record, errDocumentNotFound
+	}
+	if record.Owner != actor.ID && actor.Role != "admin" {
+		return record, errNotDocumentOwner
+	}
+	return record, nil
+}
+
+// GrantDocument lets grantee read a document until the given time,
+// replacing any grant they already had
+func (s *Service) GrantDocument(filename string, actor, grantee *User, until time.Time) error {
+	return s.documents.Update(func(tx DocumentTx) error {
+		record, err := sharingRecord(tx, filename, actor)
+		if err != nil {
+			return err
+		}
+		if record.Owner == grantee.ID {
+			return errGrantToOwner
+		}
+		record.Grants = withGrant(record.Grants, grantee.ID, until)
+		tx.put(filename, record)
+		saveDocumentMeta(filename, documentMeta(record))
+		bumpDocVersion()
+		return nil
+	})
+}
+
+// RevokeGrant ends a grant before it expires
+func (s *Service) RevokeGrant(filename string, actor *User, granteeID string) error {
+	return s.documents.Update(func(tx DocumentTx) error {
+		record, err := sharingRecord(tx, filename, actor)
+		if err != nil {
+			return err
+		}
+		if _, exists := record.Grants[granteeID]; !exists {
+			return errGrantNotFound
+		}
+		record.Grants = withGrant(record.Grants, granteeID, time.Time{})
+		tx.put(filename, record)
+		saveDocumentMeta(filename, documentMeta(record))
+		bumpDocVersion()
+		return nil
+	})
+}
+
+// DocumentGrants returns a document's unexpired grants, soonest to end
+// first
+func (s *Service) DocumentGrants(filename string, actor *User) ([]DocumentGrant, error) {
+	var grants []DocumentGrant
+	var err error
+	now := time.Now()
+	s.documents.View(func(tx DocumentTx) {
+		var record documentRecord
+		if record, err = sharingRecord(tx, filename, actor); err != nil {
+			return
+		}
+		for userID, until := range record.Grants {
+			if until.After(now) {
+				grants = append(grants, DocumentGrant{Filename: filename, UserID: userID, ExpiresAt: until})
+			}
+		}
+	})
+	sortGrants(grants)
+	return grants, err
+}
+
+// SharedWith returns the documents granted to a user that haven't expired,
+// with when each grant ends
+func (s *Service) SharedWith(userID string) map[string]time.Time {
+	var granted map[string]time.Time
+	s.documents.View(func(tx DocumentTx) {
+		granted = tx.grantedTo(userID, time.Now())
+	})
+	return granted
+}
+
+// sortGrants orders grants by expiry, then filename
+func sortGrants(grants []DocumentGrant) {
+	sort.Slice(grants, func(i, j int) bool {
+		if !grants[i].ExpiresAt.Equal(grants[j].ExpiresAt) {
+			return grants[i].ExpiresAt.Before(grants[j].ExpiresAt)
+		}
+		return grants[i].Filename < grants[j].Filename
+	})
+}
+
+// ----------------------------------------------------------------------------
+// Expiry
+// ----------------------------------------------------------------------------
+
+// startGrantExpiry sweeps lapsed grants until shutdown
+func startGrantExpiry(svc *Service) {
+	goBackground(func(ctx context.Context) {
+		ticker := time.NewTicker(grantSweepInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			svc.expireGrants(time.Now())
+		}
+	})
+}
+
+// expireGrants drops the grants that ended by now and notifies their
+// grantees; it returns them
+func (s *Service) expireGrants(now time.Time) []DocumentGrant {
+	// Every replica holds the same grants; one sweep is enough
+	release, err := tryLock("grant-sweep", config.Cluster.LockTTL)
+	if err != nil {
+		if err != errLockHeld {
+			slog.Warn("Grant sweep skipped", "error", err)
+		}
+		return nil
+	}
+	defer release()
+
+	var expired []DocumentGrant
+	s.documents.Update(func(tx DocumentTx) error {
+		expired = tx.lapsedGrants(now)
+		for _, grant := range expired {
+			record, _ := tx.get(grant.Filename)
+			record.Grants = withGrant(record.Grants, grant.UserID, time.Time{})
+			tx.put(grant.Filename, record)
+		}
+		if len(expired) > 0 {
+			bumpDocVersion()
+		}
+		return nil
+	})
+
+	// Share the changed records outside the write lock, reading each again
+	// so a change made since isn't overwritten
+	sortGrants(expired)
+	shared := make(map[string]bool)
+	for _, grant := range expired {
+		if shared[grant.Filename] {
+			continue
+		}
+		shared[grant.Filename] = true
+		var record documentRecord
+		var exists bool
+		s.documents.View(func(tx DocumentTx) {
+			record, exists = tx.get(grant.Filename)
+		})
+		if exists {
+			saveDocumentMeta(grant.Filename, documentMeta(record))
+		}
+	}
+	for _, grant := range expired {
+		notify(grant.UserID, NotificationShareExpired, "Shared document no longer available",
+			"Your access to "+grant.Filename+" has expired.",
+			map[string]string{"filename": grant.Filename})
+		debugLog("documents", "Document grant expired", "filename", grant.Filename, "user_id", grant.UserID)
+	}
+	return expired
+}
+
+// ----------------------------------------------------------------------------
+// Handlers
+// ----------------------------------------------------------------------------
+
+// respondGrantError maps grant errors to problems
+func respondGrantError(c *gin.Context, err error) {
+	switch err {
+	case errGrantExpiry, errGrantToOwner:
+		respondError(c, http.StatusBadRequest, codeInvalidRequest, err.Error())
+	case errGrantNotFound, errGranteeAbsent:
+		respondError(c, http.StatusNotFound, codeNotFound, err.Error())
+	default:
+		respondServiceError(c, err)
+	}
+}
+
+// grantDocument shares a document with another member until a given time
+func (s *Server) grantDocument(c *gin.Context) {
+	var req DocumentGrantRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondBindError(c, err)
+		return
+	}
+	actor := c.MustGet("user").(*User)
+	filename := c.Param("filename")
+
+	until, err := parseGrantExpiry(req.ExpiresAt, time.Now())
+	if err != nil {
+		respondGrantError(c, err)
+		return
+	}
+	grantee := s.svc.users.ByEmail(req.Email)
+	if grantee == nil || !s.svc.active(grantee) {
+		respondGrantError(c, errGranteeAbsent)
+		return
+	}
+	if err := s.svc.GrantDocument(filename, actor, grantee, until); err != nil {
+		respondGrantError(c, err)
+		return
+	}
+
+	grant := DocumentGrant{Filename: filename, UserID: grantee.ID, Email: req.Email, ExpiresAt: until}
+	auditChange(c, "document.grant", "document:"+filename, nil, grant)
+	notify(grantee.ID, NotificationDocumentShared, "Document shared with you",
+		actor.Name+" shared "+filename+" with you until "+until.Format(time.RFC3339)+".",
+		map[string]string{"filename": filename, "expires_at": until.Format(time.RFC3339)})
+	c.JSON(http.StatusCreated, gin.H{"grant": grant})
+}
+
+// listDocumentGrants lists who a document is shared with and until when
+func (s *Server) listDocumentGrants(c *gin.Context) {
+	grants, err := s.svc.DocumentGrants(c.Param("filename"), c.MustGet("user").(*User))
+	if err != nil {
+		respondGrantError(c, err)
+		return
+	}
+	for i := range grants {
+		if user := s.svc.users.ByID(grants[i].UserID); user != nil {
+			grants[i].Email = user.Email
+		}
+	}
+	if grants == nil {
+		grants = []DocumentGrant{}
+	}
+	c.JSON(http.StatusOK, gin.H{"grants": grants, "count": len(grants)})
+}
+
+// revokeDocumentGrant ends a grant early
+func (s *Server) revokeDocumentGrant(c *gin.Context) {
+	filename, granteeID := c.Param("filename"), c.Param("user_id")
+	if err := s.svc.RevokeGrant(filename, c.MustGet("user").(*User), granteeID); err != nil {
+		respondGrantError(c, err)
+		return
+	}
+	auditChange(c, "document.grant.revoke", "document:"+filename,
+		gin.H{"filename": filename, "user_id": granteeID}, nil)
+	c.JSON(http.StatusOK, gin.H{"message": "Grant revoked", "filename": filename, "user_id": granteeID})
+}
+
+// getSharedDocuments lists the documents shared with the current user
+func (s *Server) getSharedDocuments(c *gin.Context) {
+	user := c.MustGet("user").(*User)
+	grants := []DocumentGrant{}
+	for filename, until := range s.svc.SharedWith(user.ID) {
+		grants = append(grants, DocumentGrant{Filename: filename, UserID: user.ID, ExpiresAt: until})
+	}
+	sortGrants(grants)
+	c.JSON(http.StatusOK, gin.H{"documents": grants, "count": len(grants)})
+}
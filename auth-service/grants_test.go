@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestDocumentGrantEndpoints(t *testing.T) {
+	ts := newTestServer(t)
+	owner, _ := ts.register("owner@example.com")
+	reviewer, reviewerID := ts.register("reviewer@example.com")
+	ts.do(http.MethodPost, "/v1/documents/register", owner, `{"filename":"draft.pdf"}`)
+
+	tomorrow := time.Now().UTC().AddDate(0, 0, 1).Format(time.DateOnly)
+	grant := `{"email":"reviewer@example.com","expires_at":"` + tomorrow + `"}`
+	if w := ts.do(http.MethodPost, "/v1/documents/draft.pdf/grants", reviewer, grant); w.Code != http.StatusForbidden {
+		t.Fatalf("grant by non-owner: got %d, want 403", w.Code)
+	}
+	if w := ts.do(http.MethodPost, "/v1/documents/draft.pdf/grants", owner, `{"email":"owner@example.com","expires_at":"`+tomorrow+`"}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("grant to owner: got %d, want 400", w.Code)
+	}
+	if w := ts.do(http.MethodPost, "/v1/documents/draft.pdf/grants", owner, `{"email":"reviewer@example.com","expires_at":"2020-01-31"}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("past expiry: got %d, want 400", w.Code)
+	}
+	if w := ts.do(http.MethodPost, "/v1/documents/draft.pdf/grants", owner, grant); w.Code != http.StatusCreated {
+		t.Fatalf("grant: %d %s", w.Code, w.Body)
+	}
+
+	// A date is good through the end of that day
+	var shared struct {
+		Documents []DocumentGrant `json:"documents"`
+	}
+	decodeJSON(t, ts.do(http.MethodGet, "/v1/documents/shared", reviewer, ""), &shared)
+	if len(shared.Documents) != 1 || shared.Documents[0].Filename != "draft.pdf" ||
+		shared.Documents[0].ExpiresAt.Format(time.DateOnly) != time.Now().UTC().AddDate(0, 0, 2).Format(time.DateOnly) {
+		t.Fatalf("shared with reviewer: %+v", shared.Documents)
+	}
+	var list struct {
+		Grants []DocumentGrant `json:"grants"`
+	}
+	decodeJSON(t, ts.do(http.MethodGet, "/v1/documents/draft.pdf/grants", owner, ""), &list)
+	if len(list.Grants) != 1 || list.Grants[0].Email != "reviewer@example.com" {
+		t.Fatalf("grants: %+v", list.Grants)
+	}
+
+	if w := ts.do(http.MethodDelete, "/v1/documents/draft.pdf/grants/"+reviewerID, owner, ""); w.Code != http.StatusOK {
+		t.Fatalf("revoke: %d %s", w.Code, w.Body)
+	}
+	decodeJSON(t, ts.do(http.MethodGet, "/v1/documents/shared", reviewer, ""), &shared)
+	if len(shared.Documents) != 0 {
+		t.Fatalf("after revoke: %+v", shared.Documents)
+	}
+	if w := ts.do(http.MethodDelete, "/v1/documents/draft.pdf/grants/"+reviewerID, owner, ""); w.Code != http.StatusNotFound {
+		t.Fatalf("revoke twice: got %d, want 404", w.Code)
+	}
+}
+
+func TestDocumentGrantExpiry(t *testing.T) {
+	t.Cleanup(func() { resetLocalStores(t) })
+	owner, reviewer := &User{ID: "owner", Role: "user"}, &User{ID: "reviewer", Role: "user"}
+	if _, err := defaultService.ClaimDocument("draft.pdf", owner.ID); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	if err := defaultService.GrantDocument("draft.pdf", owner, reviewer, now.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if allowed := readableSubset(reviewer, []string{"draft.pdf"}); len(allowed) != 1 {
+		t.Fatalf("while granted: %v", allowed)
+	}
+	if docs := defaultService.ReadableBy(reviewer); len(docs) != 1 {
+		t.Fatalf("readable by reviewer: %v", docs)
+	}
+
+	if expired := defaultService.expireGrants(now); len(expired) != 0 {
+		t.Fatalf("expired early: %+v", expired)
+	}
+	expired := defaultService.expireGrants(now.Add(2 * time.Hour))
+	if len(expired) != 1 || expired[0].UserID != reviewer.ID {
+		t.Fatalf("expired: %+v", expired)
+	}
+	if allowed := readableSubset(reviewer, []string{"draft.pdf"}); len(allowed) != 0 {
+		t.Fatalf("after expiry: %v", allowed)
+	}
+
+	notificationMutex.Lock()
+	inbox := notifications[reviewer.ID]
+	delete(notifications, reviewer.ID)
+	notificationMutex.Unlock()
+	if len(inbox) != 1 || inbox[0].Kind != NotificationShareExpired {
+		t.Fatalf("grantee not notified: %+v", inbox)
+	}
+}
+
+func TestDocumentGrantSweepAcrossReplicas(t *testing.T) {
+	t.Cleanup(func() { resetLocalStores(t) })
+	useSharedStore(t)
+	owner := &User{ID: "owner", Role: "user"}
+	now := time.Now()
+	for _, filename := range []string{"a.pdf", "b.pdf"} {
+		if _, err := defaultService.ClaimDocument(filename, owner.ID); err != nil {
+			t.Fatal(err)
+		}
+		for _, grantee := range []string{"r1", "r2"} {
+			if err := defaultService.GrantDocument(filename, owner, &User{ID: grantee, Role: "user"}, now.Add(time.Hour)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	defaultService.GrantDocument("b.pdf", owner, &User{ID: "r3", Role: "user"}, now.Add(3*time.Hour))
+
+	// While another replica sweeps, this one leaves the grants alone
+	release, err := tryLock("grant-sweep", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expired := defaultService.expireGrants(now.Add(2 * time.Hour)); len(expired) != 0 {
+		t.Fatalf("swept while another replica holds the lock: %+v", expired)
+	}
+	release()
+
+	expired := defaultService.expireGrants(now.Add(2 * time.Hour))
+	if len(expired) != 4 {
+		t.Fatalf("expired: %+v", expired)
+	}
+	for filename, want := range map[string]int{"a.pdf": 0, "b.pdf": 1} {
+		doc, found, err := clusterStore.document(context.Background(), filename)
+		if err != nil || !found || len(doc.Meta.Grants) != want {
+			t.Fatalf("%s in the shared store: %+v %v", filename, doc.Meta.Grants, err)
+		}
+	}
+}
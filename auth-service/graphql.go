@@ -0,0 +1,488 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/language/ast"
+	"github.com/graphql-go/graphql/language/parser"
+	"github.com/graphql-go/graphql/language/source"
+)
+
+// ============================================================================
+// Admin GraphQL API
+// ============================================================================
+//
+// A read-mostly schema over users, documents, jobs and usage stats so the
+// admin dashboard can fetch nested data in one round trip. Field names
+// follow the REST API's snake_case payloads. Resolvers work on copies of
+// the stored records, and queries are limited in depth and size because
+// the user/document relations can be nested without end.
+
+const (
+	gqlMaxDepth  = 6   // nested selection levels
+	gqlMaxFields = 300 // fields selected, with fragments expanded
+)
+
+// GraphQLRequest is a standard GraphQL-over-HTTP request body
+type GraphQLRequest struct {
+	Query         string                 `json:"query" binding:"required"`
+	OperationName string                 `json:"operationName"`
+	Variables     map[string]interface{} `json:"variables"`
+}
+
+// gqlDocument is a document as seen by the schema
+type gqlDocument struct {
+	Filename string
+	OwnerID  string
+}
+
+type (
+	gqlLoaderKey struct{}
+	gqlActorKey  struct{} // the admin making the request
+)
+
+// gqlLoader indexes jobs once per request so nested job fields don't rescan
+// the job store for every document
+type gqlLoader struct {
+	once   sync.Once
+	latest map[string]Job   // filename -> most recent job
+	byUser map[string][]Job // user_id -> jobs, newest first
+}
+
+func (l *gqlLoader) load() {
+	l.once.Do(func() {
+		l.latest = make(map[string]Job)
+		l.byUser = make(map[string][]Job)
+
+		jobMutex.RLock()
+		for _, job := range jobs {
+			snapshot := *job
+			if current, exists := l.latest[job.Filename]; !exists || job.CreatedAt.After(current.CreatedAt) {
+				l.latest[job.Filename] = snapshot
+			}
+			l.byUser[job.UserID] = append(l.byUser[job.UserID], snapshot)
+		}
+		jobMutex.RUnlock()
+
+		for _, list := range l.byUser {
+			sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.After(list[j].CreatedAt) })
+		}
+	})
+}
+
+func loaderFrom(ctx context.Context) *gqlLoader {
+	loader, _ := ctx.Value(gqlLoaderKey{}).(*gqlLoader)
+	loader.load()
+	return loader
+}
+
+// userCopy returns a copy of a user taken under the lock, or nil; the
+// default resolvers read fields after the lock would be released
+func userCopy(id string) *User {
+	return localUsers.Snapshot(id)
+}
+
+// documentsFor returns a user's documents in schema form
+func documentsFor(userID string) []gqlDocument {
+	var docs []gqlDocument
+	for _, filename := range documentsOf(userID) {
+		docs = append(docs, gqlDocument{Filename: filename, OwnerID: userID})
+	}
+	return docs
+}
+
+var (
+	gqlJobType = graphql.NewObject(graphql.ObjectConfig{
+		Name: "Job",
+		Fields: graphql.Fields{
+			"id":           &graphql.Field{Type: graphql.NewNonNull(graphql.ID)},
+			"type":         &graphql.Field{Type: graphql.String},
+			"user_id":      &graphql.Field{Type: graphql.String},
+			"filename":     &graphql.Field{Type: graphql.String},
+			"status":       &graphql.Field{Type: graphql.String},
+			"attempts":     &graphql.Field{Type: graphql.Int},
+			"max_attempts": &graphql.Field{Type: graphql.Int},
+			"last_error":   &graphql.Field{Type: graphql.String},
+			"created_at":   &graphql.Field{Type: graphql.DateTime},
+			"updated_at":   &graphql.Field{Type: graphql.DateTime},
+		},
+	})
+
+	gqlUserType     *graphql.Object
+	gqlDocumentType *graphql.Object
+)
+
+func init() {
+	gqlDocumentType = graphql.NewObject(graphql.ObjectConfig{
+		Name: "Document",
+		Fields: graphql.FieldsThunk(func() graphql.Fields {
+			return graphql.Fields{
+				"filename": &graphql.Field{
+					Type: graphql.NewNonNull(graphql.String),
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						return p.Source.(gqlDocument).Filename, nil
+					},
+				},
+				"tags": &graphql.Field{
+					Type:        graphql.NewList(graphql.String),
+					Description: "Labels set by admins",
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						return documentTags(p.Source.(gqlDocument).Filename), nil
+					},
+				},
+				"owner": &graphql.Field{
+					Type: gqlUserType,
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						if owner := userCopy(p.Source.(gqlDocument).OwnerID); owner != nil {
+							return owner, nil
+						}
+						return nil, nil
+					},
+				},
+				"status": &graphql.Field{
+					Type:        graphql.String,
+					Description: "Status of the most recent processing job, if any",
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						if job, exists := loaderFrom(p.Context).latest[p.Source.(gqlDocument).Filename]; exists {
+							return string(job.Status), nil
+						}
+						return nil, nil
+					},
+				},
+				"latest_job": &graphql.Field{
+					Type: gqlJobType,
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						if job, exists := loaderFrom(p.Context).latest[p.Source.(gqlDocument).Filename]; exists {
+							return job, nil
+						}
+						return nil, nil
+					},
+				},
+			}
+		}),
+	})
+
+	gqlUserType = graphql.NewObject(graphql.ObjectConfig{
+		Name: "User",
+		Fields: graphql.Fields{
+			"id":         &graphql.Field{Type: graphql.NewNonNull(graphql.ID)},
+			"email":      &graphql.Field{Type: graphql.String},
+			"name":       &graphql.Field{Type: graphql.String},
+			"avatar":     &graphql.Field{Type: graphql.String},
+			"role":       &graphql.Field{Type: graphql.String},
+			"created_at": &graphql.Field{Type: graphql.DateTime},
+			"documents": &graphql.Field{
+				Type: graphql.NewList(gqlDocumentType),
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return documentsFor(p.Source.(*User).ID), nil
+				},
+			},
+			"document_count": &graphql.Field{
+				Type: graphql.Int,
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					var count int
+					localDocuments.View(func(tx DocumentTx) { count = tx.countOwnedBy(p.Source.(*User).ID) })
+					return count, nil
+				},
+			},
+			"jobs": &graphql.Field{
+				Type: graphql.NewList(gqlJobType),
+				Args: graphql.FieldConfigArgument{
+					"limit": &graphql.ArgumentConfig{Type: graphql.Int, DefaultValue: 20},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					list := loaderFrom(p.Context).byUser[p.Source.(*User).ID]
+					if limit, _ := p.Args["limit"].(int); limit >= 0 && limit < len(list) {
+						list = list[:limit]
+					}
+					return list, nil
+				},
+			},
+		},
+	})
+
+	gqlSchema = mustBuildSchema()
+}
+
+var gqlStatsType = graphql.NewObject(graphql.ObjectConfig{
+	Name: "Stats",
+	Fields: graphql.Fields{
+		"total_users":          &graphql.Field{Type: graphql.Int},
+		"admin_users":          &graphql.Field{Type: graphql.Int},
+		"total_documents":      &graphql.Field{Type: graphql.Int},
+		"users_with_documents": &graphql.Field{Type: graphql.Int},
+		"connector_links":      &graphql.Field{Type: graphql.Int},
+		"jobs_by_status": &graphql.Field{Type: graphql.NewList(graphql.NewObject(graphql.ObjectConfig{
+			Name: "StatusCount",
+			Fields: graphql.Fields{
+				"status": &graphql.Field{Type: graphql.String},
+				"count":  &graphql.Field{Type: graphql.Int},
+			},
+		}))},
+	},
+})
+
+// usageStats summarises the stores for the Stats type
+func usageStats() map[string]interface{} {
+	stats := make(map[string]interface{})
+
+	total, admins := 0, 0
+	localUsers.Each(func(user *User) {
+		total++
+		if user.Role == "admin" {
+			admins++
+		}
+	})
+	stats["total_users"] = total
+	stats["admin_users"] = admins
+
+	localDocuments.View(func(tx DocumentTx) {
+		stats["total_documents"] = tx.len()
+		stats["users_with_documents"] = tx.ownerCount()
+	})
+
+	connectorMutex.Lock()
+	stats["connector_links"] = len(connectorLinks)
+	connectorMutex.Unlock()
+
+	counts := make(map[JobStatus]int)
+	jobMutex.RLock()
+	for _, job := range jobs {
+		counts[job.Status]++
+	}
+	jobMutex.RUnlock()
+
+	var byStatus []map[string]interface{}
+	for _, status := range []JobStatus{JobQueued, JobRunning, JobRetrying, JobSucceeded, JobDeadLettered, JobBlocked} {
+		byStatus = append(byStatus, map[string]interface{}{"status": string(status), "count": counts[status]})
+	}
+	stats["jobs_by_status"] = byStatus
+
+	return stats
+}
+
+var gqlSchema graphql.Schema
+
+func mustBuildSchema() graphql.Schema {
+	query := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Query",
+		Fields: graphql.Fields{
+			"users": &graphql.Field{
+				Type: graphql.NewList(gqlUserType),
+				Args: graphql.FieldConfigArgument{
+					"role": &graphql.ArgumentConfig{Type: graphql.String},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					role, _ := p.Args["role"].(string)
+
+					var list []*User
+					localUsers.Each(func(user *User) {
+						if role == "" || user.Role == role {
+							snapshot := *user
+							list = append(list, &snapshot)
+						}
+					})
+
+					sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.Before(list[j].CreatedAt) })
+					return list, nil
+				},
+			},
+			"user": &graphql.Field{
+				Type: gqlUserType,
+				Args: graphql.FieldConfigArgument{
+					"id": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.ID)},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					if user := userCopy(p.Args["id"].(string)); user != nil {
+						return user, nil
+					}
+					return nil, nil
+				},
+			},
+			"documents": &graphql.Field{
+				Type: graphql.NewList(gqlDocumentType),
+				Args: graphql.FieldConfigArgument{
+					"owner_id": &graphql.ArgumentConfig{Type: graphql.ID},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					if ownerID, ok := p.Args["owner_id"].(string); ok {
+						return documentsFor(ownerID), nil
+					}
+
+					var docs []gqlDocument
+					localDocuments.View(func(tx DocumentTx) {
+						docs = make([]gqlDocument, 0, tx.len())
+						tx.each(func(filename string, record documentRecord) {
+							docs = append(docs, gqlDocument{Filename: filename, OwnerID: record.Owner})
+						})
+					})
+
+					sort.Slice(docs, func(i, j int) bool { return docs[i].Filename < docs[j].Filename })
+					return docs, nil
+				},
+			},
+			"document": &graphql.Field{
+				Type: gqlDocumentType,
+				Args: graphql.FieldConfigArgument{
+					"filename": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					filename := p.Args["filename"].(string)
+
+					ownerID := defaultService.DocumentOwner(filename)
+
+					if ownerID == "" {
+						return nil, nil
+					}
+					return gqlDocument{Filename: filename, OwnerID: ownerID}, nil
+				},
+			},
+			"stats": &graphql.Field{
+				Type: gqlStatsType,
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return usageStats(), nil
+				},
+			},
+		},
+	})
+
+	mutation := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Mutation",
+		Fields: graphql.Fields{
+			"unregister_document": &graphql.Field{
+				Type: graphql.Boolean,
+				Args: graphql.FieldConfigArgument{
+					"filename": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					actor, _ := p.Context.Value(gqlActorKey{}).(*User)
+					filename := p.Args["filename"].(string)
+					if err := releaseDocument(filename, actor); err != nil {
+						return false, err
+					}
+					appendAudit(AuditEntry{
+						ActorID:    actor.ID,
+						ActorEmail: actor.Email,
+						Action:     "document.unregister",
+						Resource:   "document:" + filename,
+						Transport:  "graphql",
+						Before:     auditJSON(gin.H{"filename": filename}),
+					})
+					return true, nil
+				},
+			},
+		},
+	})
+
+	schema, err := graphql.NewSchema(graphql.SchemaConfig{Query: query, Mutation: mutation})
+	if err != nil {
+		panic("graphql schema: " + err.Error())
+	}
+	return schema
+}
+
+// adminGraphQL executes a GraphQL request for an admin
+func adminGraphQL(c *gin.Context) {
+	var req GraphQLRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondBindError(c, err)
+		return
+	}
+
+	if err := checkQueryLimits(req.Query); err != nil {
+		respondError(c, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		return
+	}
+
+	user, _ := c.Get("user")
+	ctx := context.WithValue(c.Request.Context(), gqlLoaderKey{}, &gqlLoader{})
+	ctx = context.WithValue(ctx, gqlActorKey{}, user.(*User))
+
+	result := graphql.Do(graphql.Params{
+		Schema:         gqlSchema,
+		RequestString:  req.Query,
+		VariableValues: req.Variables,
+		OperationName:  req.OperationName,
+		Context:        ctx,
+	})
+
+	// Per the GraphQL-over-HTTP convention, resolver errors are reported in
+	// the body; only documents that fail to parse or validate are 400s
+	status := http.StatusOK
+	if result.Data == nil && result.HasErrors() {
+		status = http.StatusBadRequest
+	}
+	c.JSON(status, result)
+}
+
+// checkQueryLimits rejects documents nested deeper than gqlMaxDepth or
+// selecting more than gqlMaxFields fields. Documents that don't parse are
+// left for graphql.Do to report.
+func checkQueryLimits(query string) error {
+	doc, err := parser.Parse(parser.ParseParams{Source: source.NewSource(&source.Source{Body: []byte(query)})})
+	if err != nil {
+		return nil
+	}
+
+	fragments := make(map[string]*ast.FragmentDefinition)
+	for _, def := range doc.Definitions {
+		if fragment, ok := def.(*ast.FragmentDefinition); ok {
+			fragments[fragment.Name.Value] = fragment
+		}
+	}
+
+	fields := 0
+	var walk func(set *ast.SelectionSet, depth int, expanding map[string]bool) error
+	walk = func(set *ast.SelectionSet, depth int, expanding map[string]bool) error {
+		if set == nil {
+			return nil
+		}
+		if depth > gqlMaxDepth {
+			return fmt.Errorf("Query exceeds the maximum depth of %d", gqlMaxDepth)
+		}
+		for _, selection := range set.Selections {
+			switch s := selection.(type) {
+			case *ast.Field:
+				if fields++; fields > gqlMaxFields {
+					return fmt.Errorf("Query selects more than %d fields", gqlMaxFields)
+				}
+				if err := walk(s.SelectionSet, depth+1, expanding); err != nil {
+					return err
+				}
+			case *ast.InlineFragment:
+				if err := walk(s.SelectionSet, depth, expanding); err != nil {
+					return err
+				}
+			case *ast.FragmentSpread:
+				name := s.Name.Value
+				fragment, exists := fragments[name]
+				if !exists || expanding[name] {
+					// Unknown and cyclic spreads fail validation later
+					continue
+				}
+				expanding[name] = true
+				err := walk(fragment.SelectionSet, depth, expanding)
+				delete(expanding, name)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+
+	for _, def := range doc.Definitions {
+		if op, ok := def.(*ast.OperationDefinition); ok {
+			if err := walk(op.SelectionSet, 1, make(map[string]bool)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
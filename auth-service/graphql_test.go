@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// gqlResult is a GraphQL response
+type gqlResult struct {
+	Data   map[string]json.RawMessage `json:"data"`
+	Errors []struct {
+		Message string `json:"message"`
+	} `json:"errors"`
+}
+
+// graphQL runs a query as token and returns the status and result
+func (ts *testServer) graphQL(token, query string) (int, gqlResult) {
+	ts.t.Helper()
+	body, _ := json.Marshal(GraphQLRequest{Query: query})
+	w := ts.do(http.MethodPost, "/v1/admin/graphql", token, string(body))
+	var result gqlResult
+	if w.Code != http.StatusForbidden {
+		decodeJSON(ts.t, w, &result)
+	}
+	return w.Code, result
+}
+
+// useGraphQLData fills the process's stores, which the schema reads, with
+// two users, their documents and a job
+func useGraphQLData(t *testing.T) {
+	t.Helper()
+	resetLocalStores(t)
+	t.Cleanup(func() { resetLocalStores(t) })
+	created := time.Now().Add(-time.Hour)
+	for i, user := range []*User{
+		{ID: "u1", Email: "ada@example.com", Name: "Ada", Role: "user", CreatedAt: created},
+		{ID: "u2", Email: "root@example.com", Name: "Root", Role: "admin", CreatedAt: created.Add(time.Minute)},
+	} {
+		if _, err := localUsers.Add(user); err != nil {
+			t.Fatalf("user %d: %v", i, err)
+		}
+	}
+	for _, filename := range []string{"a.pdf", "b.pdf"} {
+		if _, err := defaultService.ClaimDocument(filename, "u1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	jobMutex.Lock()
+	jobs["job-old"] = &Job{ID: "job-old", UserID: "u1", Filename: "a.pdf", Status: JobDeadLettered, CreatedAt: created}
+	jobs["job-new"] = &Job{ID: "job-new", UserID: "u1", Filename: "a.pdf", Status: JobSucceeded, CreatedAt: created.Add(time.Minute)}
+	jobMutex.Unlock()
+	t.Cleanup(func() {
+		jobMutex.Lock()
+		delete(jobs, "job-old")
+		delete(jobs, "job-new")
+		jobMutex.Unlock()
+	})
+}
+
+func TestGraphQLQueries(t *testing.T) {
+	useGraphQLData(t)
+	ts := newTestServer(t)
+	admin := ts.admin("admin@example.com")
+	user, _ := ts.register("user@example.com")
+
+	if status, _ := ts.graphQL(user, `{ stats { total_users } }`); status != http.StatusForbidden {
+		t.Fatalf("as a user: got %d, want 403", status)
+	}
+
+	status, result := ts.graphQL(admin, `{
+		users(role: "user") { id document_count documents { filename status owner { email } } jobs(limit: 1) { id } }
+		document(filename: "a.pdf") { owner { id } latest_job { id status } }
+		missing: document(filename: "none.pdf") { filename }
+		stats { total_users admin_users total_documents users_with_documents }
+	}`)
+	if status != http.StatusOK || len(result.Errors) != 0 {
+		t.Fatalf("query: %d %+v", status, result)
+	}
+	var users []struct {
+		ID            string `json:"id"`
+		DocumentCount int    `json:"document_count"`
+		Documents     []struct {
+			Filename string  `json:"filename"`
+			Status   *string `json:"status"`
+			Owner    struct {
+				Email string `json:"email"`
+			} `json:"owner"`
+		} `json:"documents"`
+		Jobs []struct {
+			ID string `json:"id"`
+		} `json:"jobs"`
+	}
+	json.Unmarshal(result.Data["users"], &users)
+	if len(users) != 1 || users[0].ID != "u1" || users[0].DocumentCount != 2 || len(users[0].Documents) != 2 {
+		t.Fatalf("users = %+v", users)
+	}
+	docs := users[0].Documents
+	if docs[0].Filename != "a.pdf" || docs[0].Status == nil || *docs[0].Status != string(JobSucceeded) ||
+		docs[1].Status != nil || docs[0].Owner.Email != "ada@example.com" {
+		t.Fatalf("documents = %+v", docs)
+	}
+	if len(users[0].Jobs) != 1 || users[0].Jobs[0].ID != "job-new" {
+		t.Fatalf("jobs = %+v", users[0].Jobs)
+	}
+	if got := string(result.Data["document"]); got != `{"latest_job":{"id":"job-new","status":"succeeded"},"owner":{"id":"u1"}}` {
+		t.Fatalf("document = %s", got)
+	}
+	if got := string(result.Data["missing"]); got != "null" {
+		t.Fatalf("missing document = %s", got)
+	}
+	if got := string(result.Data["stats"]); got != `{"admin_users":1,"total_documents":2,"total_users":2,"users_with_documents":1}` {
+		t.Fatalf("stats = %s", got)
+	}
+}
+
+func TestGraphQLLimits(t *testing.T) {
+	useGraphQLData(t)
+	ts := newTestServer(t)
+	admin := ts.admin("admin@example.com")
+	refused := func(query string) Problem {
+		t.Helper()
+		body, _ := json.Marshal(GraphQLRequest{Query: query})
+		w := ts.do(http.MethodPost, "/v1/admin/graphql", admin, string(body))
+		var problem Problem
+		decodeJSON(t, w, &problem)
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("%s: got %d, want 400", query, w.Code)
+		}
+		return problem
+	}
+
+	// The user/document relation nests without end
+	deep := `{ users { documents { owner { documents { owner { documents { filename } } } } } } }`
+	if problem := refused(deep); !strings.Contains(problem.Detail, "maximum depth") {
+		t.Fatalf("too deep: %+v", problem)
+	}
+
+	// Fragments count once for every place they are spread: nine lists of
+	// five spreads of seven fields
+	wide := `fragment F on User { id email name avatar role created_at document_count } {`
+	for i := 0; i < 9; i++ {
+		wide += fmt.Sprintf(" u%d: users { ...F ...F ...F ...F ...F }", i)
+	}
+	if problem := refused(wide + " }"); !strings.Contains(problem.Detail, "more than") {
+		t.Fatalf("too many fields: %+v", problem)
+	}
+
+	// Cyclic fragments and syntax errors fail validation rather than hang
+	cyclic := `fragment A on User { documents { owner { ...B } } } fragment B on User { ...A } { users { ...A } }`
+	for name, query := range map[string]string{"cyclic": cyclic, "syntax": `{ users { id `} {
+		if status, result := ts.graphQL(admin, query); status != http.StatusBadRequest || len(result.Errors) == 0 {
+			t.Errorf("%s: %d %+v", name, status, result)
+		}
+	}
+}
+
+func TestGraphQLUnregister(t *testing.T) {
+	useGraphQLData(t)
+	useAuditLog(t)
+	ts := newTestServer(t)
+	admin := ts.admin("admin@example.com")
+
+	status, result := ts.graphQL(admin, `mutation { unregister_document(filename: "a.pdf") }`)
+	if status != http.StatusOK || len(result.Errors) != 0 || string(result.Data["unregister_document"]) != "true" {
+		t.Fatalf("unregister: %d %+v", status, result)
+	}
+	if owner := defaultService.DocumentOwner("a.pdf"); owner != "" {
+		t.Fatalf("still owned by %q", owner)
+	}
+	var recorded bool
+	for _, entry := range auditEntries() {
+		recorded = recorded || entry.Action == "document.unregister" && entry.Resource == "document:a.pdf" && entry.Transport == "graphql"
+	}
+	if !recorded {
+		t.Fatal("unregister not audited")
+	}
+
+	// A resolver's error comes back in the body
+	status, result = ts.graphQL(admin, `mutation { unregister_document(filename: "a.pdf") }`)
+	if status != http.StatusOK || len(result.Errors) != 1 || result.Errors[0].Message != errDocumentNotFound.Error() {
+		t.Fatalf("unregister twice: %d %+v", status, result)
+	}
+}
+
+func TestGraphQLVariables(t *testing.T) {
+	useGraphQLData(t)
+	ts := newTestServer(t)
+	admin := ts.admin("admin@example.com")
+
+	// Variables fill arguments, and the operation name picks the query run
+	body, _ := json.Marshal(GraphQLRequest{
+		Query: `query Owner($id: ID!) { user(id: $id) { email } }
+			query Documents($owner: ID) { documents(owner_id: $owner) { filename } }`,
+		OperationName: "Owner",
+		Variables:     map[string]interface{}{"id": "u1"},
+	})
+	var result gqlResult
+	decodeJSON(t, ts.do(http.MethodPost, "/v1/admin/graphql", admin, string(body)), &result)
+	if len(result.Errors) != 0 || string(result.Data["user"]) != `{"email":"ada@example.com"}` || result.Data["documents"] != nil {
+		t.Fatalf("Owner: %+v", result)
+	}
+	body, _ = json.Marshal(GraphQLRequest{Query: `query Owner($id: ID!) { user(id: $id) { email } }`})
+	decodeJSON(t, ts.do(http.MethodPost, "/v1/admin/graphql", admin, string(body)), &result)
+	if len(result.Errors) == 0 {
+		t.Fatal("missing variable accepted")
+	}
+
+	// Secrets aren't in the schema
+	if _, result := ts.graphQL(admin, `{ user(id: "u1") { password_hash } }`); len(result.Errors) == 0 {
+		t.Fatalf("password hash: %+v", result)
+	}
+}
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"log/slog"
+	"net"
+	"strings"
+	"time"
+
+	"auth-service/authpb"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// ============================================================================
+// gRPC API
+// ============================================================================
+//
+// Besides AuthService and DocumentService the server answers the standard
+// grpc.health.v1.Health protocol, for Kubernetes grpc probes and
+// grpc_health_probe, and server reflection (server.grpc_reflection) for
+// grpcurl. The overall status ("") and each service's follow GET
+// /health/ready: NOT_SERVING while draining or while the shared store's
+// schema is behind. Health checks skip authentication and maintenance mode,
+// which the probes have no say in.
+
+// grpcHealthInterval is how often the health service's status is refreshed
+const grpcHealthInterval = 5 * time.Second
+
+var grpcHealth *health.Server
+
+type grpcUserKey struct{}
+
+// Methods that authenticate through their own arguments or the internal token
+var grpcPublicMethods = map[string]bool{
+	authpb.AuthService_Register_FullMethodName:         true,
+	authpb.AuthService_Login_FullMethodName:            true,
+	authpb.AuthService_VerifyToken_FullMethodName:      true,
+	authpb.DocumentService_FilterAccess_FullMethodName: true,
+}
+
+// grpcAuthInterceptor resolves the bearer token in the "authorization"
+// metadata against svc, mirroring authMiddleware for the REST API
+func grpcAuthInterceptor(svc *Service) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if _, denied := matchRule(networkListDeny, grpcPeerIP(ctx)); denied {
+			return nil, status.Error(codes.PermissionDenied, "Requests from this address are blocked")
+		}
+		if info.FullMethod == healthpb.Health_Check_FullMethodName {
+			return handler(ctx, req)
+		}
+		if maintenanceOn.Load() {
+			return nil, status.Error(codes.Unavailable, maintenanceStatus().Message)
+		}
+		debugLog("grpc", "Call received", "method", info.FullMethod, "peer", grpcPeerIP(ctx))
+		if grpcPublicMethods[info.FullMethod] {
+			return handler(ctx, req)
+		}
+
+		md, _ := metadata.FromIncomingContext(ctx)
+		values := md.Get("authorization")
+		if len(values) == 0 {
+			return nil, status.Error(codes.Unauthenticated, "Authorization metadata required")
+		}
+
+		parts := strings.Split(values[0], " ")
+		if len(parts) != 2 || parts[0] != "Bearer" {
+			return nil, status.Error(codes.Unauthenticated, "Invalid authorization format")
+		}
+
+		user, err := svc.Authenticate(parts[1])
+		if err != nil {
+			debugLog("grpc", "Call rejected", "method", info.FullMethod, "reason", err)
+			event := grpcSecurityEvent(ctx, EventTokenInvalid, "failure")
+			event.Reason = err.Error()
+			emitSecurityEvent(event)
+			return nil, status.Error(codes.Unauthenticated, err.Error())
+		}
+		if !allowCall(ctx, apiRateLimit, "user:"+user.ID) {
+			return nil, status.Error(codes.ResourceExhausted, "Too many requests; retry later")
+		}
+		recordActivity(user.ID)
+
+		return handler(context.WithValue(ctx, grpcUserKey{}, user), req)
+	}
+}
+
+// grpcUser returns the user resolved by grpcAuthInterceptor
+func grpcUser(ctx context.Context) *User {
+	user, _ := ctx.Value(grpcUserKey{}).(*User)
+	return user
+}
+
+// toProto converts a User to its protobuf profile
+func toProto(user *User) *authpb.UserProfile {
+	return &authpb.UserProfile{
+		Id:        user.ID,
+		Email:     user.Email,
+		Name:      user.Name,
+		Avatar:    user.Avatar,
+		Role:      user.Role,
+		CreatedAt: timestamppb.New(user.CreatedAt),
+	}
+}
+
+// grpcError maps service-layer errors to gRPC status codes
+func grpcError(err error) error {
+	code := codes.Internal
+	switch err {
+	case errEmailTaken, errDocumentOwned:
+		code = codes.AlreadyExists
+	case errInvalidCredentials, errInvalidToken, errInvalidClaims, errUserNotFound, errSessionIdle, errTokenRevoked,
+		errInvalidRefreshToken, errReauthRequired:
+		code = codes.Unauthenticated
+	case errDocumentNotFound:
+		code = codes.NotFound
+	case errWeakPassword, errInvalidReferralCode:
+		code = codes.InvalidArgument
+	case errNotDocumentOwner, errStepUpRequired, errAccountDisabled, errApprovalPending,
+		errRegistrationClosed, errEmailDomainNotAllowed, errAccountMerged, errInsufficientScope:
+		code = codes.PermissionDenied
+	case errStoreUnavailable, errQueueFull, errPasswordBusy:
+		code = codes.Unavailable
+	default:
+		slog.Error("gRPC call failed", "error", err)
+		return status.Error(codes.Internal, "Internal server error")
+	}
+	return status.Error(code, err.Error())
+}
+
+// grpcAuditEntry builds an audit entry for a gRPC call
+func grpcAuditEntry(ctx context.Context, actor *User, action, resource string, before, after interface{}) AuditEntry {
+	return AuditEntry{
+		ActorID:    actor.ID,
+		ActorEmail: actor.Email,
+		Action:     action,
+		Resource:   resource,
+		SourceIP:   grpcPeerIP(ctx),
+		Transport:  "grpc",
+		Before:     auditJSON(before),
+		After:      auditJSON(after),
+	}
+}
+
+// authServer implements authpb.AuthServiceServer
+type authServer struct {
+	authpb.UnimplementedAuthServiceServer
+	svc *Service
+}
+
+func (s authServer) Register(ctx context.Context, req *authpb.RegisterRequest) (*authpb.AuthResponse, error) {
+	if !allowCall(ctx, authRateLimit, "ip:"+grpcPeerIP(ctx)) {
+		return nil, status.Error(codes.ResourceExhausted, "Too many requests; retry later")
+	}
+	// Same constraints as the REST binding tags
+	if !strings.Contains(req.Email, "@") || len(req.Password) < 6 || len(req.Name) < 2 {
+		return nil, status.Error(codes.InvalidArgument, "Email, password (min 6) and name (min 2) are required")
+	}
+
+	user, token, err := s.svc.Register(req.Email, req.Password, req.Name, "")
+	if err != nil {
+		return nil, grpcError(err)
+	}
+
+	appendAudit(grpcAuditEntry(ctx, user, "user.register", "user:"+user.ID, nil, toProfile(user)))
+
+	event := grpcSecurityEvent(ctx, EventRegister, "success")
+	event.UserID, event.Email = user.ID, user.Email
+	emitSecurityEvent(event)
+	return &authpb.AuthResponse{Token: token, User: toProto(user)}, nil
+}
+
+func (s authServer) Login(ctx context.Context, req *authpb.LoginRequest) (*authpb.AuthResponse, error) {
+	if !allowCall(ctx, authRateLimit, "ip:"+grpcPeerIP(ctx)) {
+		return nil, status.Error(codes.ResourceExhausted, "Too many login attempts; retry later")
+	}
+	asn := riskASN(grpcHeader(ctx))
+	assessment := assessLogin(req.Email, grpcPeerIP(ctx), asn)
+	switch {
+	case assessment.Throttled != "":
+		recordRiskOutcome(riskThrottled)
+		return nil, status.Error(codes.ResourceExhausted, "Too many failed sign-ins from this network; retry later")
+	case assessment.Challenge:
+		// The proto has no CAPTCHA field; the client must sign in over HTTP
+		recordRiskOutcome(riskChallenged)
+		return nil, status.Error(codes.FailedPrecondition, errCaptchaRequired.Error())
+	}
+	sleepContext(ctx, assessment.Delay)
+
+	user, token, err := s.svc.Login(req.Email, req.Password)
+	if err == nil {
+		record := grpcLoginRecord(ctx)
+		record.Trusted = s.svc.deviceTrusted(user, record.Device)
+		err = checkLogin(user, record)
+		if err == nil {
+			token, _, err = s.svc.deviceSession(user, record, false) // the proto has no refresh token
+		}
+	}
+	if err != nil {
+		event := grpcSecurityEvent(ctx, EventLoginFailure, "failure")
+		event.Email, event.Reason = req.Email, err.Error()
+		emitSecurityEvent(event)
+		if err == errInvalidCredentials {
+			recordAbuse(grpcPeerIP(ctx), "failed logins")
+			recordLoginOutcome(false)
+			recordLoginRisk(req.Email, grpcPeerIP(ctx), asn, false)
+		}
+		return nil, grpcError(err)
+	}
+
+	event := grpcSecurityEvent(ctx, EventLoginSuccess, "success")
+	event.UserID, event.Email = user.ID, user.Email
+	emitSecurityEvent(event)
+	recordLoginOutcome(true)
+	recordLoginRisk(req.Email, grpcPeerIP(ctx), asn, true)
+	return &authpb.AuthResponse{Token: token, User: toProto(user)}, nil
+}
+
+func (s authServer) VerifyToken(ctx context.Context, req *authpb.VerifyTokenRequest) (*authpb.UserProfile, error) {
+	user, err := s.svc.Authenticate(req.Token)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return toProto(user), nil
+}
+
+func (s authServer) GetUser(ctx context.Context, req *authpb.GetUserRequest) (*authpb.UserProfile, error) {
+	user := s.svc.users.ByID(req.Id)
+	if user == nil {
+		return nil, status.Error(codes.NotFound, "User not found")
+	}
+	return toProto(user), nil
+}
+
+// documentServer implements authpb.DocumentServiceServer
+type documentServer struct {
+	authpb.UnimplementedDocumentServiceServer
+	svc *Service
+}
+
+func (s documentServer) RegisterDocument(ctx context.Context, req *authpb.DocumentRequest) (*authpb.RegisterDocumentResponse, error) {
+	if req.Filename == "" {
+		return nil, status.Error(codes.InvalidArgument, "Filename is required")
+	}
+
+	if err := checkFileExtension(req.Filename); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	user := grpcUser(ctx)
+	filename, created, err := s.svc.RegisterDocument(req.Filename, user.ID)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	if created {
+		appendAudit(grpcAuditEntry(ctx, user, "document.register", "document:"+filename, nil,
+			map[string]string{"filename": filename, "owner_id": user.ID}))
+	}
+	return &authpb.RegisterDocumentResponse{Filename: filename, UserId: user.ID, Created: created}, nil
+}
+
+func (s documentServer) UnregisterDocument(ctx context.Context, req *authpb.DocumentRequest) (*authpb.UnregisterDocumentResponse, error) {
+	if err := s.svc.ReleaseDocument(req.Filename, grpcUser(ctx)); err != nil {
+		return nil, grpcError(err)
+	}
+	appendAudit(grpcAuditEntry(ctx, grpcUser(ctx), "document.unregister", "document:"+req.Filename,
+		map[string]string{"filename": req.Filename}, nil))
+	return &authpb.UnregisterDocumentResponse{Filename: req.Filename}, nil
+}
+
+func (s documentServer) ListDocuments(ctx context.Context, req *authpb.ListDocumentsRequest) (*authpb.ListDocumentsResponse, error) {
+	user := grpcUser(ctx)
+	userID := req.UserId
+	if userID == "" {
+		userID = user.ID
+	}
+	if userID != user.ID && user.Role != "admin" {
+		return nil, status.Error(codes.PermissionDenied, "Admin access required")
+	}
+	return &authpb.ListDocumentsResponse{UserId: userID, Documents: s.svc.DocumentsOf(userID)}, nil
+}
+
+func (s documentServer) FilterAccess(ctx context.Context, req *authpb.FilterAccessRequest) (*authpb.FilterAccessResponse, error) {
+	expected := config.Auth.InternalAPIToken
+	if expected == "" {
+		return nil, status.Error(codes.Unavailable, "Internal API is not configured")
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	values := md.Get(strings.ToLower(internalTokenHeader))
+	if len(values) == 0 || subtle.ConstantTimeCompare([]byte(values[0]), []byte(expected)) != 1 {
+		return nil, status.Error(codes.Unauthenticated, "Invalid internal token")
+	}
+	if len(req.DocumentIds) > maxFilterCandidates {
+		return nil, status.Error(codes.InvalidArgument, "Too many candidate documents")
+	}
+
+	user := s.svc.users.ByID(req.UserId)
+	if user == nil {
+		return nil, status.Error(codes.NotFound, "User not found")
+	}
+	if !s.svc.active(user) {
+		return nil, grpcError(errAccountDisabled)
+	}
+
+	allowed := readableSubset(user, req.DocumentIds)
+	return &authpb.FilterAccessResponse{
+		UserId:      req.UserId,
+		Allowed:     allowed,
+		DeniedCount: int32(len(req.DocumentIds) - len(allowed)),
+	}, nil
+}
+
+// startGRPCServer serves the gRPC API on GRPC_PORT (default 9001), over TLS
+// when tlsConfig is set
+func startGRPCServer(svc *Service, tlsConfig *tls.Config) *grpc.Server {
+	port := config.Server.GRPCPort
+
+	lis, err := net.Listen("tcp", ":"+port)
+	if err != nil {
+		fatal("Failed to listen for gRPC", "port", port, "error", err)
+	}
+
+	server := newGRPCServer(svc, tlsConfig)
+	goBackground(watchGRPCHealth)
+
+	slog.Info("gRPC API listening", "port", port)
+	go func() {
+		if err := server.Serve(lis); err != nil {
+			fatal("gRPC server stopped", "error", err)
+		}
+	}()
+	return server
+}
+
+// newGRPCServer builds the gRPC server with its services, health checking
+// and, when enabled, reflection
+func newGRPCServer(svc *Service, tlsConfig *tls.Config) *grpc.Server {
+	opts := []grpc.ServerOption{grpc.ChainUnaryInterceptor(grpcAuthInterceptor(svc), grpcReportErrors)}
+	if tlsConfig != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+	server := grpc.NewServer(opts...)
+	authpb.RegisterAuthServiceServer(server, authServer{svc: svc})
+	authpb.RegisterDocumentServiceServer(server, documentServer{svc: svc})
+
+	grpcHealth = health.NewServer()
+	healthpb.RegisterHealthServer(server, grpcHealth)
+	updateGRPCHealth()
+	if config.Server.GRPCReflection {
+		reflection.Register(server)
+	}
+	return server
+}
+
+// updateGRPCHealth sets every service's health status from readiness
+func updateGRPCHealth() {
+	serving := healthpb.HealthCheckResponse_SERVING
+	if readiness := checkReadiness(); readiness.Reason != "" {
+		serving = healthpb.HealthCheckResponse_NOT_SERVING
+	}
+	for _, service := range []string{"", authpb.AuthService_ServiceDesc.ServiceName, authpb.DocumentService_ServiceDesc.ServiceName} {
+		grpcHealth.SetServingStatus(service, serving)
+	}
+}
+
+// watchGRPCHealth keeps the health status current, so Watch streams hear
+// of changes, until shutdown
+func watchGRPCHealth(ctx context.Context) {
+	ticker := time.NewTicker(grpcHealthInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			updateGRPCHealth()
+		}
+	}
+}
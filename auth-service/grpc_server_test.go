@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"auth-service/authpb"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	reflectionpb "google.golang.org/grpc/reflection/grpc_reflection_v1"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func TestGRPCHealthAndReflection(t *testing.T) {
+	ts := newTestServer(t)
+	lis := bufconn.Listen(1 << 20)
+	server := newGRPCServer(ts.srv.svc, nil)
+	go server.Serve(lis)
+	t.Cleanup(func() {
+		server.Stop()
+		grpcHealth = nil
+		shuttingDown.Store(false)
+		maintenanceOn.Store(false)
+	})
+	conn, err := grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	client := healthpb.NewHealthClient(conn)
+	check := func(service string) healthpb.HealthCheckResponse_ServingStatus {
+		t.Helper()
+		resp, err := client.Check(ctx, &healthpb.HealthCheckRequest{Service: service})
+		if err != nil {
+			t.Fatalf("check %q: %v", service, err)
+		}
+		return resp.Status
+	}
+
+	// No credentials needed, maintenance or not
+	maintenanceOn.Store(true)
+	for _, service := range []string{"", authpb.AuthService_ServiceDesc.ServiceName, authpb.DocumentService_ServiceDesc.ServiceName} {
+		if got := check(service); got != healthpb.HealthCheckResponse_SERVING {
+			t.Fatalf("%q: %s, want SERVING", service, got)
+		}
+	}
+	if _, err := client.Check(ctx, &healthpb.HealthCheckRequest{Service: "auth.v1.Nope"}); err == nil {
+		t.Fatal("unknown service: want NotFound")
+	}
+
+	shuttingDown.Store(true)
+	updateGRPCHealth()
+	if got := check(""); got != healthpb.HealthCheckResponse_NOT_SERVING {
+		t.Fatalf("draining: %s, want NOT_SERVING", got)
+	}
+
+	stream, err := reflectionpb.NewServerReflectionClient(conn).ServerReflectionInfo(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.Send(&reflectionpb.ServerReflectionRequest{
+		MessageRequest: &reflectionpb.ServerReflectionRequest_ListServices{},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := stream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	listed := map[string]bool{}
+	for _, service := range resp.GetListServicesResponse().GetService() {
+		listed[service.Name] = true
+	}
+	if !listed[authpb.AuthService_ServiceDesc.ServiceName] || !listed[authpb.DocumentService_ServiceDesc.ServiceName] || !listed[healthpb.Health_ServiceDesc.ServiceName] {
+		t.Fatalf("reflection lists %v", listed)
+	}
+}
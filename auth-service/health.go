@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"auth-service/migrations"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ============================================================================
+// System Health
+// ============================================================================
+//
+// GET /health/system gives the frontend one status for the whole RAG
+// system. It checks every service in health.services (name -> health URL,
+// e.g. ingestion, query gateway, vector store) in parallel, each with
+// health.timeout, and reports them next to this service with their
+// latencies:
+//
+//	healthy    everything answered 2xx
+//	degraded   some sibling failed, or maintenance mode is on
+//	unhealthy  this service is draining or every sibling failed (503)
+//
+// The endpoint is public like /health, so a result is reused for
+// health.cache_ttl: however often it is polled, siblings see at most one
+// check per interval from each replica. Failures are summarized ("timeout",
+// "status 502") rather than passing on upstream errors, which could name
+// internal hosts.
+
+const (
+	healthHealthy   = "healthy"
+	healthDegraded  = "degraded"
+	healthUnhealthy = "unhealthy"
+)
+
+// ServiceHealth is one service's part of the system status
+type ServiceHealth struct {
+	Name       string `json:"name"`
+	Status     string `json:"status"` // healthy | unhealthy
+	LatencyMS  int64  `json:"latency_ms"`
+	HTTPStatus int    `json:"http_status,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// SystemHealth is the response of GET /health/system
+type SystemHealth struct {
+	Status    string          `json:"status"` // healthy | degraded | unhealthy
+	CheckedAt time.Time       `json:"checked_at"`
+	Services  []ServiceHealth `json:"services"` // this service first, then by name
+}
+
+var healthClient = &http.Client{}
+
+var (
+	systemHealthCache   *SystemHealth
+	systemHealthMu      sync.Mutex // held through a check so concurrent callers share it
+	systemHealthExpires time.Time
+)
+
+// currentSystemHealth returns the cached status, checking again once it is
+// older than health.cache_ttl. The check isn't tied to the request that
+// triggered it, since its result is shared.
+func currentSystemHealth() SystemHealth {
+	systemHealthMu.Lock()
+	defer systemHealthMu.Unlock()
+	if systemHealthCache != nil && time.Now().Before(systemHealthExpires) {
+		return *systemHealthCache
+	}
+	health := checkSystemHealth(context.Background())
+	systemHealthCache, systemHealthExpires = &health, time.Now().Add(config.Health.CacheTTL)
+	return health
+}
+
+// checkSystemHealth checks every configured service in parallel
+func checkSystemHealth(ctx context.Context) SystemHealth {
+	self := ServiceHealth{Name: "auth-service", Status: healthHealthy}
+	if shuttingDown.Load() {
+		self.Status, self.Error = healthUnhealthy, "draining"
+	}
+
+	siblings := make([]ServiceHealth, 0, len(config.Health.Services))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for name, target := range config.Health.Services {
+		wg.Add(1)
+		go func(name, target string) {
+			defer wg.Done()
+			result := checkService(ctx, name, target)
+			mu.Lock()
+			siblings = append(siblings, result)
+			mu.Unlock()
+		}(name, target)
+	}
+	wg.Wait()
+	sort.Slice(siblings, func(i, j int) bool { return siblings[i].Name < siblings[j].Name })
+
+	failed := 0
+	for _, sibling := range siblings {
+		if sibling.Status != healthHealthy {
+			failed++
+		}
+	}
+	status := healthHealthy
+	switch {
+	case self.Status != healthHealthy || (failed > 0 && failed == len(siblings)):
+		status = healthUnhealthy
+	case failed > 0 || maintenanceOn.Load():
+		status = healthDegraded
+	}
+	return SystemHealth{Status: status, CheckedAt: time.Now().UTC(), Services: append([]ServiceHealth{self}, siblings...)}
+}
+
+// checkService calls one service's health URL; any 2xx answer is healthy
+func checkService(ctx context.Context, name, target string) ServiceHealth {
+	result := ServiceHealth{Name: name, Status: healthUnhealthy}
+	ctx, cancel := context.WithTimeout(ctx, config.Health.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		result.Error = "invalid health URL"
+		return result
+	}
+
+	started := time.Now()
+	resp, err := healthClient.Do(req)
+	result.LatencyMS = time.Since(started).Milliseconds()
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		result.Error = "timeout"
+	case err != nil:
+		result.Error = "unreachable"
+	default:
+		resp.Body.Close()
+		result.HTTPStatus = resp.StatusCode
+		if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+			result.Status = healthHealthy
+		} else {
+			result.Error = "status " + strconv.Itoa(resp.StatusCode)
+		}
+	}
+	return result
+}
+
+// getSystemHealth reports the status of this service and its siblings
+func getSystemHealth(c *gin.Context) {
+	health := currentSystemHealth()
+	code := http.StatusOK
+	if health.Status == healthUnhealthy {
+		code = http.StatusServiceUnavailable
+	}
+	c.JSON(code, health)
+}
+
+// ----------------------------------------------------------------------------
+// Readiness
+// ----------------------------------------------------------------------------
+//
+// GET /health/ready tells an orchestrator whether to route traffic here.
+// Unlike /health it fails (503) while the shared store's schema is behind
+// this binary or dirty after a failed migration, so a replica started with
+// cluster.migrate_on_start off stays out of rotation until someone runs
+// authctl migrate up. The schema check is cached like the system status.
+
+// Readiness is the response of GET /health/ready
+type Readiness struct {
+	Status string             `json:"status"` // ready | not_ready
+	Reason string             `json:"reason,omitempty"`
+	Schema *migrations.Status `json:"schema,omitempty"` // cluster.mode mongo only
+}
+
+// schemaVersioned is a shared store whose schema is migrated
+type schemaVersioned interface {
+	schemaStatus(ctx context.Context) (migrations.Status, error)
+}
+
+var (
+	schemaStatusCache   *migrations.Status
+	schemaStatusMu      sync.Mutex
+	schemaStatusExpires time.Time
+)
+
+// currentSchemaStatus returns the shared store's cached migration status,
+// or nil when the store has no schema
+func currentSchemaStatus() (*migrations.Status, error) {
+	store, ok := clusterStore.(schemaVersioned)
+	if !ok {
+		return nil, nil
+	}
+	schemaStatusMu.Lock()
+	defer schemaStatusMu.Unlock()
+	if schemaStatusCache != nil && time.Now().Before(schemaStatusExpires) {
+		return schemaStatusCache, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), config.Health.Timeout)
+	defer cancel()
+	status, err := store.schemaStatus(ctx)
+	if err != nil {
+		return nil, err
+	}
+	schemaStatusCache, schemaStatusExpires = &status, time.Now().Add(config.Health.CacheTTL)
+	return &status, nil
+}
+
+// checkReadiness reports whether this replica should receive traffic, for
+// GET /health/ready and the gRPC health service
+func checkReadiness() Readiness {
+	readiness := Readiness{Status: "ready"}
+	schema, err := currentSchemaStatus()
+	readiness.Schema = schema
+	switch {
+	case shuttingDown.Load():
+		readiness.Reason = "draining"
+	case err != nil:
+		readiness.Reason = "shared store unreachable"
+	case schema != nil && schema.Dirty:
+		readiness.Reason = "schema migration failed; see authctl migrate status"
+	case schema != nil && schema.Pending > 0:
+		readiness.Reason = "schema migrations pending"
+	}
+	if readiness.Reason != "" {
+		readiness.Status = "not_ready"
+	}
+	return readiness
+}
+
+// getReadiness reports whether this replica should receive traffic
+func getReadiness(c *gin.Context) {
+	readiness := checkReadiness()
+	if readiness.Reason != "" {
+		c.JSON(http.StatusServiceUnavailable, readiness)
+		return
+	}
+	c.JSON(http.StatusOK, readiness)
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"auth-service/migrations"
+)
+
+func TestSystemHealth(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"status":"healthy"}`))
+	}))
+	defer up.Close()
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer failing.Close()
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+		}
+	}))
+	defer slow.Close()
+
+	check := func(services map[string]string, wantCode int, wantStatus string) SystemHealth {
+		t.Helper()
+		withConfig(t, func(cfg *Config) {
+			cfg.Health.Services = services
+			cfg.Health.Timeout = 50 * time.Millisecond
+			cfg.Health.CacheTTL = 0
+		})
+		ts := newTestServer(t)
+		w := ts.do(http.MethodGet, "/health/system", "", "")
+		var health SystemHealth
+		decodeJSON(t, w, &health)
+		if w.Code != wantCode || health.Status != wantStatus {
+			t.Fatalf("%v: %d %+v", services, w.Code, health)
+		}
+		return health
+	}
+
+	health := check(map[string]string{"vector_store": up.URL, "ingestion": up.URL}, http.StatusOK, healthHealthy)
+	if len(health.Services) != 3 || health.Services[0].Name != "auth-service" || health.Services[1].Name != "ingestion" {
+		t.Fatalf("services = %+v", health.Services)
+	}
+
+	health = check(map[string]string{"ingestion": up.URL, "query": failing.URL, "vector_store": slow.URL}, http.StatusOK, healthDegraded)
+	if query := health.Services[2]; query.Status != healthUnhealthy || query.HTTPStatus != http.StatusBadGateway || query.Error != "status 502" {
+		t.Fatalf("query = %+v", query)
+	}
+	if store := health.Services[3]; store.Status != healthUnhealthy || store.Error != "timeout" {
+		t.Fatalf("vector_store = %+v", store)
+	}
+
+	check(map[string]string{"query": failing.URL}, http.StatusServiceUnavailable, healthUnhealthy)
+	check(nil, http.StatusOK, healthHealthy)
+}
+
+func TestSystemHealthCache(t *testing.T) {
+	var calls atomic.Int32
+	sibling := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+	}))
+	defer sibling.Close()
+	withConfig(t, func(cfg *Config) {
+		cfg.Health.Services = map[string]string{"query": sibling.URL}
+		cfg.Health.CacheTTL = time.Minute
+	})
+	systemHealthCache = nil
+	t.Cleanup(func() { systemHealthCache = nil })
+
+	ts := newTestServer(t)
+	for i := 0; i < 3; i++ {
+		if w := ts.do(http.MethodGet, "/health/system", "", ""); w.Code != http.StatusOK {
+			t.Fatalf("status %d", w.Code)
+		}
+	}
+	if calls.Load() != 1 {
+		t.Fatalf("sibling checked %d times", calls.Load())
+	}
+}
+
+// versionedStore is a shared store reporting a fixed schema status
+type versionedStore struct {
+	sharedStore
+	status migrations.Status
+}
+
+func (s versionedStore) schemaStatus(context.Context) (migrations.Status, error) {
+	return s.status, nil
+}
+
+func TestReadiness(t *testing.T) {
+	withConfig(t, func(cfg *Config) { cfg.Health.CacheTTL = 0 })
+	ts := newTestServer(t)
+	check := func(wantCode int, wantReason string) {
+		t.Helper()
+		w := ts.do(http.MethodGet, "/health/ready", "", "")
+		var readiness Readiness
+		decodeJSON(t, w, &readiness)
+		if w.Code != wantCode || readiness.Reason != wantReason {
+			t.Fatalf("readiness = %d %+v; want %d %q", w.Code, readiness, wantCode, wantReason)
+		}
+	}
+	check(http.StatusOK, "")
+
+	useSharedStore(t)
+	store := versionedStore{sharedStore: clusterStore, status: migrations.Status{Current: 1, Latest: 2, Pending: 1}}
+	clusterStore = store
+	check(http.StatusServiceUnavailable, "schema migrations pending")
+
+	store.status = migrations.Status{Current: 2, Latest: 2, Dirty: true}
+	clusterStore = store
+	check(http.StatusServiceUnavailable, "schema migration failed; see authctl migrate status")
+
+	store.status = migrations.Status{Current: 2, Latest: 2}
+	clusterStore = store
+	check(http.StatusOK, "")
+
+	shuttingDown.Store(true)
+	defer shuttingDown.Store(false)
+	check(http.StatusServiceUnavailable, "draining")
+}
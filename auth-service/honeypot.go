@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ============================================================================
+// Honeypot Routes
+// ============================================================================
+//
+// network.honeypot_paths are decoy routes no client of this service ever
+// calls: the WordPress, PHP and dotfile paths vulnerability scanners probe
+// first. A request for one bans its address on the denylist for
+// network.honeypot_ban_duration (source "honeypot"), then is held for
+// network.honeypot_tarpit before getting the same 404 as any unknown route,
+// so the scanner learns nothing and wastes its time. Addresses on the admin
+// allowlist are never banned. Hits and bans are counted in
+// /admin/debug/vars, and /admin/network-rules/banned lists the addresses
+// currently banned automatically.
+
+// maxTarpitted caps how many decoy requests are held at once; past it they
+// are answered straight away
+const maxTarpitted = 256
+
+var defaultHoneypotPaths = []string{"/wp-login.php", "/wp-admin", "/xmlrpc.php", "/.env", "/.git/config", "/phpmyadmin"}
+
+var (
+	honeypotHits atomic.Int64
+	honeypotBans atomic.Int64
+
+	tarpitSlots = make(chan struct{}, maxTarpitted)
+)
+
+// checkHoneypotPath rejects paths that can't be registered as a plain route
+func checkHoneypotPath(path string) error {
+	if !strings.HasPrefix(path, "/") || path == "/" {
+		return fmt.Errorf("%q must be an absolute path below /", path)
+	}
+	if strings.ContainsAny(path, ":*?#") {
+		return fmt.Errorf("%q must be a literal path, without wildcards or a query", path)
+	}
+	return nil
+}
+
+// registerHoneypots mounts the decoy routes, refusing any that would shadow
+// a real one
+func registerHoneypots(r *gin.Engine) error {
+	for _, path := range config.Network.HoneypotPaths {
+		for _, route := range r.Routes() {
+			if route.Path == path || strings.HasPrefix(route.Path, path+"/") {
+				return fmt.Errorf("network.honeypot_paths: %s is a real route", path)
+			}
+		}
+		r.Any(path, honeypot)
+	}
+	return nil
+}
+
+// honeypot bans whoever requests a decoy route and keeps them waiting
+func honeypot(c *gin.Context) {
+	honeypotHits.Add(1)
+	ip := c.ClientIP()
+	if banAddress(ip, networkRuleFromDecoy, "requested "+c.Request.URL.Path, config.Network.HoneypotBanDuration) != nil {
+		honeypotBans.Add(1)
+	}
+
+	select {
+	case tarpitSlots <- struct{}{}:
+		sleepContext(c.Request.Context(), config.Network.HoneypotTarpit)
+		<-tarpitSlots
+	default:
+	}
+	respondError(c, http.StatusNotFound, codeNotFound, "Route not found")
+}
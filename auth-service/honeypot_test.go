@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestHoneypotBansScanner(t *testing.T) {
+	ts := newTestServer(t)
+	withConfig(t, func(cfg *Config) { cfg.Network.HoneypotTarpit = 0 })
+	useNetworkRules(t, testRule(t, networkListAdminAllow, "192.0.2.0/24", nil))
+	admin := ts.admin("admin@example.com")
+	hits, bans := honeypotHits.Load(), honeypotBans.Load()
+
+	const scanner = "198.51.100.7"
+	if w := requestFrom(ts.srv, http.MethodGet, "/.env", scanner, "", ""); w.Code != http.StatusNotFound {
+		t.Fatalf("decoy: %d %s", w.Code, w.Body)
+	}
+	if w := requestFrom(ts.srv, http.MethodGet, "/health", scanner, "", ""); w.Code != http.StatusForbidden {
+		t.Fatalf("after decoy: got %d, want 403", w.Code)
+	}
+
+	// The admin network is never banned
+	if w := ts.do(http.MethodPost, "/wp-login.php", "", ""); w.Code != http.StatusNotFound {
+		t.Fatalf("decoy from the admin network: %d", w.Code)
+	}
+
+	var resp struct {
+		Banned       []BannedAddress `json:"banned"`
+		HoneypotHits int64           `json:"honeypot_hits"`
+		HoneypotBans int64           `json:"honeypot_bans"`
+	}
+	decodeJSON(t, ts.do(http.MethodGet, "/v1/admin/network-rules/banned", admin, ""), &resp)
+	if len(resp.Banned) != 1 || resp.Banned[0].CIDR != scanner+"/32" || resp.Banned[0].Source != networkRuleFromDecoy {
+		t.Fatalf("banned: %+v", resp.Banned)
+	}
+	if resp.HoneypotHits != hits+2 || resp.HoneypotBans != bans+1 {
+		t.Fatalf("counters: %+v", resp)
+	}
+
+	// Lifting the ban lets the address back in
+	ts.do(http.MethodDelete, "/v1/admin/network-rules/"+resp.Banned[0].RuleID, admin, "")
+	if w := requestFrom(ts.srv, http.MethodGet, "/health", scanner, "", ""); w.Code != http.StatusOK {
+		t.Fatalf("after unban: %d", w.Code)
+	}
+}
+
+func TestRegisterHoneypotsRefusesRealRoutes(t *testing.T) {
+	withConfig(t, func(cfg *Config) { cfg.Network.HoneypotPaths = []string{"/health"} })
+	r := gin.New()
+	r.GET("/health/ready", func(c *gin.Context) {})
+	if err := registerHoneypots(r); err == nil {
+		t.Fatal("a decoy over a real route was accepted")
+	}
+}
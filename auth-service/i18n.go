@@ -0,0 +1,236 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ============================================================================
+// Internationalization
+// ============================================================================
+//
+// User-facing text is written in English and translated on the way out.
+// The request's Accept-Language picks the language; anything the catalog
+// can't translate stays English, so a missing entry degrades to the text
+// we have today rather than an error. Message keys are the English text
+// itself (gettext style), which keeps call sites readable. Email templates
+// are keyed "<template>.subject", "<template>.text" and "<template>.html"
+// and are only used when all three parts are translated.
+//
+// Translations for Spanish and Hindi are built in (translations.go).
+// i18n.catalog_dir adds or overrides languages with <lang>.json files, each
+// a flat object from key to translation. Error codes and field names are
+// never translated; clients should match on those.
+
+const languageContextKey = "language"
+
+// Catalog supplies translations
+type Catalog interface {
+	// Languages lists the languages with at least one translation
+	Languages() []string
+	// Translate returns key in lang, if the catalog has it
+	Translate(lang, key string) (string, bool)
+}
+
+// mapCatalog is a catalog held in memory: lang -> key -> translation
+type mapCatalog map[string]map[string]string
+
+func (m mapCatalog) Languages() []string {
+	langs := make([]string, 0, len(m))
+	for lang := range m {
+		langs = append(langs, lang)
+	}
+	sort.Strings(langs)
+	return langs
+}
+
+func (m mapCatalog) Translate(lang, key string) (string, bool) {
+	text, ok := m[lang][key]
+	return text, ok
+}
+
+// layeredCatalog consults each catalog in turn, so earlier ones override
+// later ones
+type layeredCatalog []Catalog
+
+func (l layeredCatalog) Languages() []string {
+	seen := make(map[string]bool)
+	var langs []string
+	for _, c := range l {
+		for _, lang := range c.Languages() {
+			if !seen[lang] {
+				seen[lang] = true
+				langs = append(langs, lang)
+			}
+		}
+	}
+	sort.Strings(langs)
+	return langs
+}
+
+func (l layeredCatalog) Translate(lang, key string) (string, bool) {
+	for _, c := range l {
+		if text, ok := c.Translate(lang, key); ok {
+			return text, true
+		}
+	}
+	return "", false
+}
+
+// Set by setCatalog
+var (
+	messageCatalog Catalog
+	// supportedLanguages are the languages requests can negotiate; English
+	// is always among them
+	supportedLanguages map[string]bool
+	// localizedEmails are the fully translated templates: lang -> name
+	localizedEmails map[string]map[string]emailTemplate
+)
+
+func init() {
+	if err := setCatalog(builtinCatalog); err != nil {
+		panic(err)
+	}
+}
+
+// setupI18n installs the built-in catalog under any catalog_dir files
+func setupI18n() error {
+	catalog := Catalog(builtinCatalog)
+	if dir := config.I18n.CatalogDir; dir != "" {
+		files, err := loadCatalogDir(dir)
+		if err != nil {
+			return err
+		}
+		catalog = layeredCatalog{files, builtinCatalog}
+	}
+	if err := setCatalog(catalog); err != nil {
+		return err
+	}
+	if !supportedLanguages[config.I18n.DefaultLanguage] {
+		return fmt.Errorf("i18n.default_language %q has no translations", config.I18n.DefaultLanguage)
+	}
+	slog.Info("Translations loaded", "languages", messageCatalog.Languages(), "default", config.I18n.DefaultLanguage)
+	return nil
+}
+
+// setCatalog replaces the catalog and compiles its email templates. It is
+// called at startup, before any request is served.
+func setCatalog(catalog Catalog) error {
+	languages := map[string]bool{"en": true}
+	emails := make(map[string]map[string]emailTemplate)
+	for _, lang := range catalog.Languages() {
+		languages[lang] = true
+		for name := range emailTemplates {
+			subject, ok1 := catalog.Translate(lang, name+".subject")
+			text, ok2 := catalog.Translate(lang, name+".text")
+			html, ok3 := catalog.Translate(lang, name+".html")
+			if !ok1 || !ok2 || !ok3 {
+				continue
+			}
+			tmpl, err := parseEmailTemplate(lang+"."+name, subject, text, html)
+			if err != nil {
+				return fmt.Errorf("%s email template %s: %w", lang, name, err)
+			}
+			if emails[lang] == nil {
+				emails[lang] = make(map[string]emailTemplate)
+			}
+			emails[lang][name] = tmpl
+		}
+	}
+	messageCatalog, supportedLanguages, localizedEmails = catalog, languages, emails
+	return nil
+}
+
+// loadCatalogDir reads <lang>.json files from dir
+func loadCatalogDir(dir string) (mapCatalog, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	catalog := make(mapCatalog)
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		var entries map[string]string
+		if err := json.Unmarshal(data, &entries); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		catalog[strings.ToLower(strings.TrimSuffix(filepath.Base(path), ".json"))] = entries
+	}
+	return catalog, nil
+}
+
+// translate returns text in lang, or text unchanged when the catalog has
+// no translation
+func translate(lang, text string) string {
+	if lang == "en" || text == "" {
+		return text
+	}
+	if translated, ok := messageCatalog.Translate(lang, text); ok {
+		return translated
+	}
+	return text
+}
+
+// requestLanguage negotiates the request's language once and remembers it
+func requestLanguage(c *gin.Context) string {
+	if lang := c.GetString(languageContextKey); lang != "" {
+		return lang
+	}
+	lang := negotiateLanguage(c.GetHeader("Accept-Language"))
+	c.Set(languageContextKey, lang)
+	return lang
+}
+
+// negotiateLanguage picks the best supported language from an
+// Accept-Language header, trying each range's primary subtag after the
+// full tag (es-MX matches es), and falling back to the default language
+func negotiateLanguage(header string) string {
+	type weighted struct {
+		tag string
+		q   float64
+	}
+	var ranges []weighted
+	for _, part := range strings.Split(header, ",") {
+		tag, params, _ := strings.Cut(part, ";")
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" {
+			continue
+		}
+		q := 1.0
+		if value, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			parsed, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				continue
+			}
+			q = parsed
+		}
+		if q > 0 {
+			ranges = append(ranges, weighted{tag, q})
+		}
+	}
+	sort.SliceStable(ranges, func(i, j int) bool { return ranges[i].q > ranges[j].q })
+
+	for _, r := range ranges {
+		if r.tag == "*" {
+			break
+		}
+		if supportedLanguages[r.tag] {
+			return r.tag
+		}
+		if primary, _, _ := strings.Cut(r.tag, "-"); supportedLanguages[primary] {
+			return primary
+		}
+	}
+	return config.I18n.DefaultLanguage
+}
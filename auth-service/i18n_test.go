@@ -0,0 +1,160 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestNegotiateLanguage(t *testing.T) {
+	for header, want := range map[string]string{
+		"":                          "en",
+		"es":                        "es",
+		"es-MX,es;q=0.9":            "es",
+		"HI-in":                     "hi",
+		"fr-FR,fr;q=0.9,hi;q=0.5":   "hi",
+		"en;q=0.5,es;q=0.8":         "es",
+		"es;q=0,hi;q=0.1":           "hi",
+		"fr, *":                     "en",
+		"de;q=bogus,es;q=0.4":       "es",
+		"pt-BR, pt;q=0.9, en;q=0.8": "en",
+	} {
+		if got := negotiateLanguage(header); got != want {
+			t.Errorf("negotiateLanguage(%q) = %q, want %q", header, got, want)
+		}
+	}
+
+	withConfig(t, func(cfg *Config) { cfg.I18n.DefaultLanguage = "es" })
+	if got := negotiateLanguage("fr"); got != "es" {
+		t.Fatalf("fallback = %q, want the default language es", got)
+	}
+}
+
+// TestBuiltinCatalogKeys guards against a key drifting from the English
+// text the code writes, which would silently stop translating it
+func TestBuiltinCatalogKeys(t *testing.T) {
+	var source strings.Builder
+	paths, _ := filepath.Glob("*.go")
+	for _, path := range paths {
+		if strings.HasSuffix(path, "_test.go") || path == "translations.go" {
+			continue
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		source.Write(data)
+	}
+	statusTexts := make(map[string]bool)
+	for code := 100; code < 600; code++ {
+		statusTexts[http.StatusText(code)] = true
+	}
+
+	for _, lang := range builtinCatalog.Languages() {
+		for key, text := range builtinCatalog[lang] {
+			if _, part, isEmail := strings.Cut(key, "."); isEmail && (part == "subject" || part == "text" || part == "html") {
+				continue
+			}
+			if !statusTexts[key] && !strings.Contains(source.String(), strconv.Quote(key)) {
+				t.Errorf("%s: key %q does not appear in the source", lang, key)
+			}
+			if strings.Count(key, "%") != strings.Count(text, "%") {
+				t.Errorf("%s: %q and its translation have different format verbs", lang, key)
+			}
+		}
+		for name := range emailTemplates {
+			if localizedEmails[lang][name].subject == nil {
+				t.Errorf("%s: email template %s is not translated", lang, name)
+			}
+		}
+	}
+	for key := range builtinCatalog["es"] {
+		if _, ok := builtinCatalog["hi"][key]; !ok {
+			t.Errorf("hi lacks %q", key)
+		}
+	}
+}
+
+func TestLocalizedProblems(t *testing.T) {
+	ts := newTestServer(t)
+	ts.register("a@example.com")
+
+	w := ts.do(http.MethodPost, "/v1/auth/login", "", `{"email":"a@example.com","password":"wrong-password"}`,
+		"Accept-Language", "es-ES,es;q=0.9")
+	var problem Problem
+	decodeJSON(t, w, &problem)
+	if problem.Detail != "Correo electrónico o contraseña incorrectos" || problem.Title != "No autorizado" {
+		t.Fatalf("Spanish problem = %+v", problem)
+	}
+	if problem.Code != codeInvalidCredentials || problem.Error != problem.Detail {
+		t.Fatalf("code or error changed: %+v", problem)
+	}
+	if w.Header().Get("Content-Language") != "es" || !strings.Contains(strings.Join(w.Header().Values("Vary"), ","), "Accept-Language") {
+		t.Fatalf("headers = %v", w.Header())
+	}
+
+	w = ts.do(http.MethodPost, "/v1/auth/register", "", `{"email":"b@example.com","password":"secret123"}`,
+		"Accept-Language", "hi")
+	decodeJSON(t, w, &problem)
+	if len(problem.Errors) != 1 || problem.Errors[0].Message != "name आवश्यक है" {
+		t.Fatalf("Hindi field errors = %+v", problem.Errors)
+	}
+
+	// Unknown languages and untranslated text stay English
+	w = ts.do(http.MethodPost, "/v1/auth/login", "", `{"email":"a@example.com","password":"wrong-password"}`,
+		"Accept-Language", "fr")
+	decodeJSON(t, w, &problem)
+	if problem.Detail != errInvalidCredentials.Error() || w.Header().Get("Content-Language") != "en" {
+		t.Fatalf("fallback problem = %+v", problem)
+	}
+}
+
+func TestLocalizedEmail(t *testing.T) {
+	data := map[string]any{"Name": "Ana", "Link": "https://example.com/r", "ExpiresIn": "1h"}
+
+	msg, err := renderEmail(EmailPasswordReset, "es", "ana@example.com", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Subject != "Restablece tu contraseña de "+config.Mail.FromName || !strings.Contains(msg.Text, "Hola, Ana:") {
+		t.Fatalf("Spanish email = %+v", msg)
+	}
+	msg, err = renderEmail(EmailPasswordReset, "fr", "ana@example.com", data)
+	if err != nil || !strings.HasPrefix(msg.Subject, "Reset your") {
+		t.Fatalf("fallback email = %+v, %v", msg, err)
+	}
+}
+
+func TestCatalogDir(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "es.json"), []byte(`{"Invalid email or password": "Credenciales incorrectas"}`), 0o600)
+	os.WriteFile(filepath.Join(dir, "fr.json"), []byte(`{"Invalid email or password": "Identifiants invalides"}`), 0o600)
+	withConfig(t, func(cfg *Config) { cfg.I18n.CatalogDir = dir })
+	t.Cleanup(func() { setCatalog(builtinCatalog) })
+	if err := setupI18n(); err != nil {
+		t.Fatal(err)
+	}
+
+	for lang, want := range map[string]string{
+		"es": "Credenciales incorrectas", // overrides the built-in text
+		"fr": "Identifiants invalides",   // a language added by file
+		"hi": "ईमेल या पासवर्ड गलत है",   // built-in still underneath
+	} {
+		if got := translate(negotiateLanguage(lang), "Invalid email or password"); got != want {
+			t.Errorf("%s: got %q, want %q", lang, got, want)
+		}
+	}
+
+	// Templates in a catalog must parse
+	os.WriteFile(filepath.Join(dir, "de.json"), []byte(`{
+		"login_alert.subject": "{{.AppName",
+		"login_alert.text": "x",
+		"login_alert.html": "x"
+	}`), 0o600)
+	if err := setupI18n(); err == nil {
+		t.Fatal("broken template accepted")
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ============================================================================
+// Idempotency Keys
+// ============================================================================
+//
+// Mutating endpoints accept an Idempotency-Key header. The first request with
+// a key runs normally and its response is stored; retries with the same key
+// and body replay that response instead of running again. Multipart bodies
+// are compared by their fields and files, so a retry that picks a new
+// boundary still matches.
+
+const (
+	idempotencyKeyHeader   = "Idempotency-Key"
+	idempotencyTTL         = 24 * time.Hour
+	idempotencySweepPeriod = time.Minute
+	maxIdempotencyKeyLen   = 255
+	maxFingerprintBody     = maxUploadSize + 1<<20 // uploads plus multipart overhead
+)
+
+// idempotencyRecord is a stored response for one key
+type idempotencyRecord struct {
+	fingerprint string
+	done        bool
+	status      int
+	contentType string
+	cookies     []string // Set-Cookie headers, e.g. the session from register
+	body        []byte
+	expiresAt   time.Time
+}
+
+var (
+	idempotencyRecords   = make(map[string]*idempotencyRecord) // scope -> record
+	idempotencyNextSweep time.Time
+	idempotencyMutex     sync.Mutex
+)
+
+// recordingWriter copies the response body so it can be replayed
+type recordingWriter struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *recordingWriter) Write(data []byte) (int, error) {
+	w.body.Write(data)
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *recordingWriter) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
+
+// sweepIdempotencyRecords drops expired records at most once per sweep
+// period; callers hold idempotencyMutex
+func sweepIdempotencyRecords(now time.Time) {
+	if now.Before(idempotencyNextSweep) {
+		return
+	}
+	idempotencyNextSweep = now.Add(idempotencySweepPeriod)
+	for scope, record := range idempotencyRecords {
+		if record.done && now.After(record.expiresAt) {
+			delete(idempotencyRecords, scope)
+		}
+	}
+}
+
+// requestFingerprint hashes a request body. Multipart bodies are hashed
+// part by part (field name, file name, content) without the boundary.
+func requestFingerprint(contentType string, body []byte) (string, error) {
+	sum := sha256.New()
+	mediaType, params, _ := mime.ParseMediaType(contentType)
+	if mediaType != "multipart/form-data" || params["boundary"] == "" {
+		sum.Write(body)
+		return hex.EncodeToString(sum.Sum(nil)), nil
+	}
+
+	reader := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		writeField(sum, part.FormName())
+		writeField(sum, part.FileName())
+		content, err := io.ReadAll(part)
+		if err != nil {
+			return "", err
+		}
+		writeField(sum, string(content))
+	}
+	return hex.EncodeToString(sum.Sum(nil)), nil
+}
+
+// writeField writes a length-prefixed value so adjacent fields can't run
+// together
+func writeField(h hash.Hash, value string) {
+	fmt.Fprintf(h, "%d:%s", len(value), value)
+}
+
+// idempotent replays stored responses for repeated Idempotency-Keys. Keys
+// are scoped to the caller and endpoint, so two users can't collide.
+func idempotent() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := c.GetHeader(idempotencyKeyHeader)
+		if key == "" {
+			c.Next()
+			return
+		}
+		if len(key) > maxIdempotencyKeyLen {
+			respondError(c, http.StatusBadRequest, codeInvalidRequest, "Idempotency-Key is too long")
+			c.Abort()
+			return
+		}
+
+		// Fingerprint the body, then restore it for the handler
+		body, err := io.ReadAll(io.LimitReader(c.Request.Body, maxFingerprintBody+1))
+		if limit, tooLarge := bodyTooLarge(err); tooLarge {
+			respondBodyTooLarge(c, limit)
+			c.Abort()
+			return
+		}
+		if len(body) > maxFingerprintBody {
+			respondBodyTooLarge(c, maxFingerprintBody)
+			c.Abort()
+			return
+		}
+		if err != nil {
+			respondError(c, http.StatusBadRequest, codeInvalidRequest, "Failed to read request body")
+			c.Abort()
+			return
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+		fingerprint, err := requestFingerprint(c.GetHeader("Content-Type"), body)
+		if err != nil {
+			respondError(c, http.StatusBadRequest, codeInvalidRequest, "Malformed multipart body")
+			c.Abort()
+			return
+		}
+
+		caller := "anonymous"
+		if user, exists := c.Get("user"); exists {
+			caller = user.(*User).ID
+		}
+		_, path := splitAPIVersion(c.FullPath())
+		scope := caller + " " + c.Request.Method + " " + path + " " + key
+
+		now := time.Now()
+		idempotencyMutex.Lock()
+		sweepIdempotencyRecords(now)
+		record, exists := idempotencyRecords[scope]
+		var previous idempotencyRecord
+		if exists {
+			previous = *record
+		} else {
+			record = &idempotencyRecord{fingerprint: fingerprint}
+			idempotencyRecords[scope] = record
+		}
+		idempotencyMutex.Unlock()
+
+		if exists {
+			switch {
+			case previous.fingerprint != fingerprint:
+				respondError(c, http.StatusUnprocessableEntity, codeIdempotencyMismatch,
+					"Idempotency-Key was already used with a different request")
+			case !previous.done:
+				respondError(c, http.StatusConflict, codeIdempotencyInProgress,
+					"A request with this Idempotency-Key is still being processed")
+			default:
+				c.Header("Idempotent-Replayed", "true")
+				for _, cookie := range previous.cookies {
+					c.Writer.Header().Add("Set-Cookie", cookie)
+				}
+				c.Data(previous.status, previous.contentType, previous.body)
+			}
+			c.Abort()
+			return
+		}
+
+		writer := &recordingWriter{ResponseWriter: c.Writer}
+		c.Writer = writer
+		finished := false
+		defer func() {
+			idempotencyMutex.Lock()
+			defer idempotencyMutex.Unlock()
+
+			// Server errors and panics are not stored so the client's
+			// retry runs again
+			if !finished || writer.Status() >= http.StatusInternalServerError {
+				delete(idempotencyRecords, scope)
+				return
+			}
+			record.done = true
+			record.status = writer.Status()
+			record.contentType = writer.Header().Get("Content-Type")
+			record.cookies = writer.Header().Values("Set-Cookie")
+			record.body = writer.body.Bytes()
+			record.expiresAt = time.Now().Add(idempotencyTTL)
+		}()
+		c.Next()
+		finished = true
+	}
+}
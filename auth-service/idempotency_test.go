@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// idempotencyRouter serves POST /v1/things behind idempotent(); the
+// X-Test-User header stands in for authentication
+func idempotencyRouter(t *testing.T, handler gin.HandlerFunc) *gin.Engine {
+	t.Helper()
+	idempotencyMutex.Lock()
+	idempotencyRecords = make(map[string]*idempotencyRecord)
+	idempotencyMutex.Unlock()
+
+	r := gin.New()
+	r.Use(gin.CustomRecovery(func(c *gin.Context, _ interface{}) {
+		c.AbortWithStatus(http.StatusInternalServerError)
+	}))
+	r.Use(func(c *gin.Context) {
+		if id := c.GetHeader("X-Test-User"); id != "" {
+			c.Set("user", &User{ID: id})
+		}
+	})
+	r.POST("/v1/things", idempotent(), handler)
+	return r
+}
+
+func postThing(r http.Handler, key, user, contentType string, body []byte) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/v1/things", bytes.NewReader(body))
+	req.Header.Set("Content-Type", contentType)
+	if key != "" {
+		req.Header.Set(idempotencyKeyHeader, key)
+	}
+	if user != "" {
+		req.Header.Set("X-Test-User", user)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+// counting returns a handler that answers 201 with a running count
+func counting(calls *int32) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		n := atomic.AddInt32(calls, 1)
+		c.SetCookie("session", "s", 60, "/", "", false, true)
+		c.JSON(http.StatusCreated, gin.H{"call": n})
+	}
+}
+
+func TestIdempotentReplay(t *testing.T) {
+	var calls int32
+	r := idempotencyRouter(t, counting(&calls))
+	body := []byte(`{"name":"a"}`)
+
+	first := postThing(r, "k1", "u1", "application/json", body)
+	second := postThing(r, "k1", "u1", "application/json", body)
+
+	if calls != 1 {
+		t.Fatalf("handler ran %d times, want 1", calls)
+	}
+	if second.Code != http.StatusCreated || second.Body.String() != first.Body.String() {
+		t.Fatalf("replay = %d %s, want %d %s", second.Code, second.Body, first.Code, first.Body)
+	}
+	if second.Header().Get("Idempotent-Replayed") != "true" {
+		t.Fatal("replay not marked")
+	}
+	if got := second.Header().Get("Set-Cookie"); !strings.HasPrefix(got, "session=s") {
+		t.Fatalf("replayed Set-Cookie = %q", got)
+	}
+}
+
+func TestIdempotencyScopes(t *testing.T) {
+	var calls int32
+	r := idempotencyRouter(t, counting(&calls))
+	body := []byte(`{}`)
+
+	postThing(r, "k1", "u1", "application/json", body)
+	postThing(r, "k1", "u2", "application/json", body) // another caller
+	postThing(r, "k2", "u1", "application/json", body) // another key
+	postThing(r, "", "u1", "application/json", body)   // no key
+	postThing(r, "", "u1", "application/json", body)
+	if calls != 5 {
+		t.Fatalf("handler ran %d times, want 5", calls)
+	}
+}
+
+func TestIdempotencyMismatch(t *testing.T) {
+	var calls int32
+	r := idempotencyRouter(t, counting(&calls))
+
+	postThing(r, "k1", "u1", "application/json", []byte(`{"name":"a"}`))
+	w := postThing(r, "k1", "u1", "application/json", []byte(`{"name":"b"}`))
+	if w.Code != http.StatusUnprocessableEntity || !strings.Contains(w.Body.String(), codeIdempotencyMismatch) {
+		t.Fatalf("got %d %s, want 422 %s", w.Code, w.Body, codeIdempotencyMismatch)
+	}
+}
+
+func TestIdempotencyInProgress(t *testing.T) {
+	entered, unblock := make(chan struct{}), make(chan struct{})
+	r := idempotencyRouter(t, func(c *gin.Context) {
+		close(entered)
+		<-unblock
+		c.Status(http.StatusNoContent)
+	})
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() { done <- postThing(r, "k1", "u1", "application/json", nil) }()
+	<-entered
+	w := postThing(r, "k1", "u1", "application/json", nil)
+	close(unblock)
+	<-done
+
+	if w.Code != http.StatusConflict || !strings.Contains(w.Body.String(), codeIdempotencyInProgress) {
+		t.Fatalf("got %d %s, want 409 %s", w.Code, w.Body, codeIdempotencyInProgress)
+	}
+}
+
+func TestIdempotencyRetriesFailures(t *testing.T) {
+	for name, fail := range map[string]gin.HandlerFunc{
+		"server error": func(c *gin.Context) { c.Status(http.StatusBadGateway) },
+		"panic":        func(c *gin.Context) { panic("boom") },
+	} {
+		t.Run(name, func(t *testing.T) {
+			var calls int32
+			r := idempotencyRouter(t, func(c *gin.Context) {
+				if atomic.AddInt32(&calls, 1) == 1 {
+					fail(c)
+					return
+				}
+				c.Status(http.StatusCreated)
+			})
+
+			postThing(r, "k1", "u1", "application/json", nil)
+			w := postThing(r, "k1", "u1", "application/json", nil)
+			if calls != 2 || w.Code != http.StatusCreated {
+				t.Fatalf("retry: calls=%d status=%d, want 2 201", calls, w.Code)
+			}
+		})
+	}
+}
+
+// multipartBody builds an upload with the given boundary and file content
+func multipartBody(t *testing.T, boundary, content string) (string, []byte) {
+	t.Helper()
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	if err := mw.SetBoundary(boundary); err != nil {
+		t.Fatal(err)
+	}
+	part, _ := mw.CreateFormFile("file", "report.pdf")
+	part.Write([]byte(content))
+	mw.Close()
+	return mw.FormDataContentType(), buf.Bytes()
+}
+
+func TestIdempotencyMultipart(t *testing.T) {
+	var calls int32
+	r := idempotencyRouter(t, counting(&calls))
+
+	contentType, body := multipartBody(t, "first-boundary", "v1")
+	postThing(r, "k1", "u1", contentType, body)
+
+	// Same content under a new boundary is the same request
+	contentType, body = multipartBody(t, "second-boundary", "v1")
+	if w := postThing(r, "k1", "u1", contentType, body); w.Header().Get("Idempotent-Replayed") != "true" {
+		t.Fatalf("retry with new boundary not replayed: %d %s", w.Code, w.Body)
+	}
+
+	// Different file content is not
+	contentType, body = multipartBody(t, "first-boundary", "v2")
+	if w := postThing(r, "k1", "u1", contentType, body); w.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("changed file: got %d, want 422", w.Code)
+	}
+	if calls != 1 {
+		t.Fatalf("handler ran %d times, want 1", calls)
+	}
+
+	if w := postThing(r, "k2", "u1", "multipart/form-data; boundary=x", []byte("garbage")); w.Code != http.StatusBadRequest {
+		t.Fatalf("malformed multipart: got %d, want 400", w.Code)
+	}
+}
+
+func TestIdempotencyKeyTooLong(t *testing.T) {
+	var calls int32
+	r := idempotencyRouter(t, counting(&calls))
+	w := postThing(r, strings.Repeat("k", maxIdempotencyKeyLen+1), "u1", "application/json", nil)
+	if w.Code != http.StatusBadRequest || calls != 0 {
+		t.Fatalf("got %d with %d calls, want 400 and no call", w.Code, calls)
+	}
+}
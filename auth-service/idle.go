@@ -0,0 +1,125 @@
+package main
+
+import (
+	"crypto/sha256"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ============================================================================
+// Idle Session Timeout
+// ============================================================================
+//
+// With session.idle_timeout set, a token that goes unused for longer than
+// that is refused even though it hasn't expired, and every use pushes the
+// deadline back (sliding expiration). session.idle_timeout_by_role gives a
+// role its own limit, typically shorter for admins. The role is the
+// account's current one, so promoting someone tightens their open sessions
+// at once. A token not seen before counts as last used when it was issued.
+//
+// Activity is kept per token, keyed by its SHA-256 like the token cache.
+// In a cluster it is shared through the store so a load balancer moving a
+// client between replicas doesn't log it out: each replica writes a
+// token's activity at most every tenth of its timeout and reads the shared
+// value only when its own view says the token is idle. A token can
+// therefore time out up to a tenth of the limit early, never late.
+
+const sessionActivityMaxEntries = 100000
+
+var errSessionIdle = errors.New("Session expired after inactivity; sign in again")
+
+type sessionActivityEntry struct {
+	lastSeen time.Time
+	shared   time.Time // when lastSeen was last written to the cluster store
+}
+
+var (
+	sessionActivity      = make(map[[sha256.Size]byte]sessionActivityEntry)
+	sessionActivityMutex sync.Mutex
+)
+
+// idleTimeoutFor returns a role's idle timeout; zero means none
+func idleTimeoutFor(role string) time.Duration {
+	if raw, ok := config.Session.IdleTimeoutByRole[role]; ok {
+		if timeout, err := time.ParseDuration(raw); err == nil {
+			return timeout
+		}
+	}
+	return config.Session.IdleTimeout
+}
+
+// touchSession records a use of a token, refusing it with errSessionIdle if
+// it had been idle for longer than the role allows. issuedAt is the token's
+// iat, the baseline for a token not seen before.
+func touchSession(key [sha256.Size]byte, role string, issuedAt time.Time) error {
+	timeout := idleTimeoutFor(role)
+	if timeout <= 0 {
+		return nil
+	}
+	now := time.Now()
+
+	sessionActivityMutex.Lock()
+	entry, seen := sessionActivity[key]
+	sessionActivityMutex.Unlock()
+	if !seen {
+		entry.lastSeen = issuedAt
+	}
+	if now.Sub(entry.lastSeen) > timeout && clustered() {
+		// Another replica may have served it since
+		if shared, ok := sharedSessionActivity(key); ok && shared.After(entry.lastSeen) {
+			entry.lastSeen, entry.shared = shared, shared
+		}
+	}
+	if now.Sub(entry.lastSeen) > timeout {
+		return errSessionIdle
+	}
+
+	entry.lastSeen = now
+	if clustered() && now.Sub(entry.shared) >= timeout/10 {
+		shareSessionActivity(key, now, timeout)
+		entry.shared = now
+	}
+
+	sessionActivityMutex.Lock()
+	defer sessionActivityMutex.Unlock()
+	if _, exists := sessionActivity[key]; !exists && len(sessionActivity) >= sessionActivityMaxEntries {
+		pruneSessionActivity(now)
+	}
+	sessionActivity[key] = entry
+	return nil
+}
+
+// tokenErrorCode is the error code for a token that didn't authenticate,
+// telling an idle session apart so clients can say why
+func tokenErrorCode(err error) string {
+	if err == errSessionIdle {
+		return codeSessionIdle
+	}
+	return codeInvalidToken
+}
+
+// checkIdle is touchSession for a token resolved to user
+func (s *Service) checkIdle(key [sha256.Size]byte, user *User, issuedAt time.Time) error {
+	lock := s.users.FieldLock(user)
+	lock.RLock()
+	role := user.Role
+	lock.RUnlock()
+	return touchSession(key, role, issuedAt)
+}
+
+// pruneSessionActivity drops tokens idle beyond every configured timeout;
+// forgetting them is safe because their issue time is older still. Live
+// tokens are kept however many there are. Callers hold
+// sessionActivityMutex.
+func pruneSessionActivity(now time.Time) {
+	longest := config.Session.IdleTimeout
+	for role := range config.Session.IdleTimeoutByRole {
+		longest = max(longest, idleTimeoutFor(role))
+	}
+	for key, entry := range sessionActivity {
+		if now.Sub(entry.lastSeen) > longest {
+			delete(sessionActivity, key)
+		}
+	}
+}
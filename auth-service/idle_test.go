@@ -0,0 +1,82 @@
+package main
+
+import (
+	"crypto/sha256"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// idleFor backdates every token's recorded activity
+func idleFor(d time.Duration) {
+	sessionActivityMutex.Lock()
+	defer sessionActivityMutex.Unlock()
+	for key, entry := range sessionActivity {
+		entry.lastSeen = entry.lastSeen.Add(-d)
+		sessionActivity[key] = entry
+	}
+}
+
+func resetSessionActivity(t *testing.T) {
+	t.Cleanup(func() {
+		sessionActivityMutex.Lock()
+		sessionActivity = make(map[[sha256.Size]byte]sessionActivityEntry)
+		sessionActivityMutex.Unlock()
+	})
+}
+
+func TestIdleSessionTimeout(t *testing.T) {
+	resetSessionActivity(t)
+	withConfig(t, func(cfg *Config) {
+		cfg.Session.IdleTimeout = time.Hour
+		cfg.Session.IdleTimeoutByRole = map[string]string{"admin": "5m"}
+	})
+	ts := newTestServer(t)
+	admin := ts.admin("admin@example.com")
+	token, _ := ts.register("member@example.com")
+	for _, tok := range []string{admin, token} {
+		if w := ts.do(http.MethodGet, "/v1/users/me", tok, ""); w.Code != http.StatusOK {
+			t.Fatalf("fresh token: %d", w.Code)
+		}
+	}
+
+	// Each use slides the deadline, so two gaps just under an hour are fine
+	// for a user; the admin's shorter limit has already run out
+	idleFor(50 * time.Minute)
+	if w := ts.do(http.MethodGet, "/v1/users/me", token, ""); w.Code != http.StatusOK {
+		t.Fatalf("after 50 minutes: %d", w.Code)
+	}
+	w := ts.do(http.MethodGet, "/v1/users/me", admin, "")
+	if w.Code != http.StatusUnauthorized || !strings.Contains(w.Body.String(), codeSessionIdle) {
+		t.Fatalf("idle admin: %d %s", w.Code, w.Body)
+	}
+	idleFor(50 * time.Minute)
+	if w := ts.do(http.MethodGet, "/v1/users/me", token, ""); w.Code != http.StatusOK {
+		t.Fatalf("after another 50 minutes: %d", w.Code)
+	}
+
+	idleFor(61 * time.Minute)
+	if w := ts.do(http.MethodGet, "/v1/users/me", token, ""); w.Code != http.StatusUnauthorized {
+		t.Fatalf("idle user: got %d, want 401", w.Code)
+	}
+}
+
+func TestIdleTimeoutBaseline(t *testing.T) {
+	resetSessionActivity(t)
+	withConfig(t, func(cfg *Config) { cfg.Session.IdleTimeout = time.Hour })
+	// A token never seen here counts from when it was issued
+	if err := touchSession(sha256.Sum256([]byte("old")), "user", time.Now().Add(-2*time.Hour)); err != errSessionIdle {
+		t.Fatalf("old unseen token: %v", err)
+	}
+	if err := touchSession(sha256.Sum256([]byte("new")), "user", time.Now().Add(-time.Minute)); err != nil {
+		t.Fatalf("recent unseen token: %v", err)
+	}
+
+	cfg := defaultConfig()
+	cfg.Session.IdleTimeoutByRole = map[string]string{"guest": "5m", "admin": "soon"}
+	err := cfg.validate()
+	if err == nil || !strings.Contains(err.Error(), `"guest" is not a role`) || !strings.Contains(err.Error(), "idle_timeout_by_role.admin") {
+		t.Fatalf("validate = %v", err)
+	}
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ============================================================================
+// Internal Request Signing
+// ============================================================================
+//
+// The internal token alone lets anyone who sees it (in a log, a leaked
+// URL with headers, a proxy dump) call /internal routes for as long as it
+// is valid. With auth.internal_signing set to required, internal calls must
+// also be signed by the calling service, over the request line, a
+// timestamp, a nonce and a digest of the body:
+//
+//	X-Signature-Timestamp: 1760700000
+//	X-Signature-Nonce: 8c0a7f3e2b9d41f6
+//	Content-Digest: sha-256=:<base64 SHA-256 of the body>:
+//	X-Signature: keyid="rag-backend", alg="ed25519", sig="<base64>"
+//
+// The signed string is the method, the request URI as sent, the
+// timestamp, the nonce and the Content-Digest value, joined by newlines.
+// alg is hmac-sha256 with a shared key from auth.internal_signing_keys, or
+// ed25519 with a public key from auth.internal_signing_public_keys, so the
+// service only holds what it needs to verify. Requests more than
+// internalSignatureSkew from now are refused, and a nonce is accepted once
+// per key within that window, so a captured request can't be replayed.
+// Nonces are remembered in the shared store when clustered, so a request
+// can't be replayed against another replica either.
+//
+// With optional, signed requests are verified and unsigned ones let
+// through on the token alone, for rolling out signing one caller at a time.
+
+const (
+	internalSigningOff      = "off"
+	internalSigningOptional = "optional"
+	internalSigningRequired = "required"
+
+	signatureHeader          = "X-Signature"
+	signatureTimestampHeader = "X-Signature-Timestamp"
+	signatureNonceHeader     = "X-Signature-Nonce"
+	contentDigestHeader      = "Content-Digest"
+
+	signatureAlgHMAC    = "hmac-sha256"
+	signatureAlgEd25519 = "ed25519"
+
+	internalSignatureSkew = 5 * time.Minute
+	minSignatureNonce     = 16
+	maxSignatureNonce     = 128
+	minSigningKeyLength   = 32 // bytes, for HMAC keys
+
+	// signatureNonceRecord remembers "keyid:nonce" in keyedRecords
+	signatureNonceRecord = "signature-nonce"
+)
+
+// signingKeySet holds the keys callers sign internal requests with
+type signingKeySet struct {
+	hmac    map[string][]byte
+	ed25519 map[string]ed25519.PublicKey
+}
+
+// parseSigningKeys reads "id:base64,..." lists of HMAC keys and Ed25519
+// public keys
+func parseSigningKeys(hmacKeys, publicKeys string) (*signingKeySet, error) {
+	set := &signingKeySet{hmac: make(map[string][]byte), ed25519: make(map[string]ed25519.PublicKey)}
+	for _, list := range []struct {
+		setting string
+		raw     string
+		public  bool
+	}{{"auth.internal_signing_keys", hmacKeys, false}, {"auth.internal_signing_public_keys", publicKeys, true}} {
+		if strings.TrimSpace(list.raw) == "" {
+			continue
+		}
+		for _, entry := range strings.Split(list.raw, ",") {
+			id, encoded, ok := strings.Cut(strings.TrimSpace(entry), ":")
+			key, err := base64.StdEncoding.DecodeString(encoded)
+			if !ok || id == "" || err != nil {
+				return nil, fmt.Errorf("%s entries must be id:base64-key", list.setting)
+			}
+			if set.hmac[id] != nil || set.ed25519[id] != nil {
+				return nil, fmt.Errorf("%s: key ID %q is used twice", list.setting, id)
+			}
+			switch {
+			case list.public && len(key) != ed25519.PublicKeySize:
+				return nil, fmt.Errorf("%s: %q is not an Ed25519 public key", list.setting, id)
+			case list.public:
+				set.ed25519[id] = ed25519.PublicKey(key)
+			case len(key) < minSigningKeyLength:
+				return nil, fmt.Errorf("%s: %q must be at least %d bytes", list.setting, id, minSigningKeyLength)
+			default:
+				set.hmac[id] = key
+			}
+		}
+	}
+	return set, nil
+}
+
+// configuredSigningKeys returns the keys from the configuration, which
+// validate has already checked
+func configuredSigningKeys() *signingKeySet {
+	set, err := parseSigningKeys(config.Auth.InternalSigningKeys, config.Auth.InternalSigningPublicKeys)
+	if err != nil {
+		return &signingKeySet{}
+	}
+	return set
+}
+
+// signatureParams splits `keyid="a", alg="b", sig="c"` into its members
+func signatureParams(header string) map[string]string {
+	params := make(map[string]string)
+	for _, part := range strings.Split(header, ",") {
+		name, value, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if ok {
+			params[strings.ToLower(name)] = strings.Trim(value, `"`)
+		}
+	}
+	return params
+}
+
+// bodyDigest is the Content-Digest value for a body
+func bodyDigest(body []byte) string {
+	sum := sha256.Sum256(body)
+	return "sha-256=:" + base64.StdEncoding.EncodeToString(sum[:]) + ":"
+}
+
+// signingString is what a signature covers
+func signingString(method, requestURI, timestamp, nonce, digest string) []byte {
+	return []byte(strings.Join([]string{method, requestURI, timestamp, nonce, digest}, "\n"))
+}
+
+// verifyInternalSignature checks a request's signature and records its
+// nonce. It reads and restores the body.
+func verifyInternalSignature(r *http.Request, keys *signingKeySet, now time.Time) error {
+	params := signatureParams(r.Header.Get(signatureHeader))
+	keyID, alg, encoded := params["keyid"], params["alg"], params["sig"]
+	if keyID == "" || alg == "" || encoded == "" {
+		return fmt.Errorf("%s must carry keyid, alg and sig", signatureHeader)
+	}
+	signature, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return errors.New("sig is not base64")
+	}
+
+	timestamp := r.Header.Get(signatureTimestampHeader)
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("%s must be Unix seconds", signatureTimestampHeader)
+	}
+	signedAt := time.Unix(seconds, 0)
+	if signedAt.Before(now.Add(-internalSignatureSkew)) || signedAt.After(now.Add(internalSignatureSkew)) {
+		return errors.New("signature timestamp is too far from the server's clock")
+	}
+	nonce := r.Header.Get(signatureNonceHeader)
+	if len(nonce) < minSignatureNonce || len(nonce) > maxSignatureNonce {
+		return fmt.Errorf("%s must be %d to %d characters", signatureNonceHeader, minSignatureNonce, maxSignatureNonce)
+	}
+
+	var body []byte
+	if r.Body != nil {
+		if body, err = io.ReadAll(r.Body); err != nil {
+			return err
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	digest := r.Header.Get(contentDigestHeader)
+	if subtle.ConstantTimeCompare([]byte(digest), []byte(bodyDigest(body))) != 1 {
+		return fmt.Errorf("%s does not match the body", contentDigestHeader)
+	}
+
+	message := signingString(r.Method, r.RequestURI, timestamp, nonce, digest)
+	switch alg {
+	case signatureAlgHMAC:
+		key := keys.hmac[keyID]
+		if key == nil {
+			return fmt.Errorf("unknown signing key %q", keyID)
+		}
+		mac := hmac.New(sha256.New, key)
+		mac.Write(message)
+		if !hmac.Equal(mac.Sum(nil), signature) {
+			return errors.New("signature does not verify")
+		}
+	case signatureAlgEd25519:
+		key := keys.ed25519[keyID]
+		if key == nil {
+			return fmt.Errorf("unknown signing key %q", keyID)
+		}
+		if !ed25519.Verify(key, message, signature) {
+			return errors.New("signature does not verify")
+		}
+	default:
+		return fmt.Errorf("alg must be %s or %s", signatureAlgHMAC, signatureAlgEd25519)
+	}
+
+	fresh, err := rememberNonce(r.Context(), keyID+":"+nonce)
+	if err != nil {
+		return err
+	}
+	if !fresh {
+		return errors.New("signature nonce was already used")
+	}
+	return nil
+}
+
+// rememberNonce records a nonce for the skew window, reporting false if it
+// was already seen. Keys have no colon, so "keyid:nonce" is unambiguous.
+func rememberNonce(ctx context.Context, key string) (bool, error) {
+	// Covers timestamps up to the skew ahead of now as well as behind
+	fresh, err := keyedRecords().addRecord(ctx, signatureNonceRecord, key, []byte("true"), 2*internalSignatureSkew)
+	if err != nil {
+		slog.Error("Record store write failed", "op", "signature_nonce", "error", err)
+		return false, errStoreUnavailable
+	}
+	return fresh, nil
+}
+
+// requireInternalSignature enforces auth.internal_signing on a request that
+// already passed the internal token check; it answers and returns false
+// when the request may not proceed
+func requireInternalSignature(c *gin.Context) bool {
+	mode := config.Auth.InternalSigning
+	if mode == internalSigningOff || mode == "" {
+		return true
+	}
+	if c.GetHeader(signatureHeader) == "" && mode == internalSigningOptional {
+		return true
+	}
+
+	if err := verifyInternalSignature(c.Request, configuredSigningKeys(), time.Now()); err != nil {
+		if limit, tooLarge := bodyTooLarge(err); tooLarge {
+			respondBodyTooLarge(c, limit)
+			return false
+		}
+		if err == errStoreUnavailable {
+			respondServiceError(c, err)
+			return false
+		}
+		debugLog("auth", "Internal request signature rejected", "path", c.Request.URL.Path, "error", err)
+		respondError(c, http.StatusUnauthorized, codeInvalidSignature, "Invalid request signature: "+err.Error())
+		return false
+	}
+	return true
+}
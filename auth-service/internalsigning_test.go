@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// signedHeaders signs a request the way a calling service would
+func signedHeaders(method, uri, body, keyID, alg string, sign func([]byte) []byte, at time.Time) []string {
+	nonce := make([]byte, 12)
+	rand.Read(nonce)
+	timestamp := strconv.FormatInt(at.Unix(), 10)
+	digest := bodyDigest([]byte(body))
+	signature := sign(signingString(method, uri, timestamp, hex.EncodeToString(nonce), digest))
+	return []string{
+		internalTokenHeader, testInternalToken,
+		signatureTimestampHeader, timestamp,
+		signatureNonceHeader, hex.EncodeToString(nonce),
+		contentDigestHeader, digest,
+		signatureHeader, `keyid="` + keyID + `", alg="` + alg + `", sig="` + base64.StdEncoding.EncodeToString(signature) + `"`,
+	}
+}
+
+func TestInternalRequestSigning(t *testing.T) {
+	hmacKey := []byte(strings.Repeat("h", 32))
+	public, private, _ := ed25519.GenerateKey(rand.Reader)
+	signHMAC := func(message []byte) []byte {
+		mac := hmac.New(sha256.New, hmacKey)
+		mac.Write(message)
+		return mac.Sum(nil)
+	}
+	signEd25519 := func(message []byte) []byte { return ed25519.Sign(private, message) }
+
+	ts := newTestServer(t)
+	withConfig(t, func(cfg *Config) {
+		cfg.Auth.InternalAPIToken = testInternalToken
+		cfg.Auth.InternalSigning = internalSigningRequired
+		cfg.Auth.InternalSigningKeys = "jobs:" + base64.StdEncoding.EncodeToString(hmacKey)
+		cfg.Auth.InternalSigningPublicKeys = "rag:" + base64.StdEncoding.EncodeToString(public)
+	})
+	const filter = "/v1/internal/access/filter"
+	body := `{"user_id":"u1","document_ids":["a.pdf"]}`
+	now := time.Now()
+
+	if w := ts.do(http.MethodPost, filter, "", body, internalTokenHeader, testInternalToken); w.Code != http.StatusUnauthorized {
+		t.Fatalf("token alone: got %d, want 401", w.Code)
+	}
+	for name, headers := range map[string][]string{
+		"hmac":    signedHeaders(http.MethodPost, filter, body, "jobs", signatureAlgHMAC, signHMAC, now),
+		"ed25519": signedHeaders(http.MethodPost, filter, body, "rag", signatureAlgEd25519, signEd25519, now),
+	} {
+		// Past the signature check, the filter doesn't know the user
+		if w := ts.do(http.MethodPost, filter, "", body, headers...); w.Code != http.StatusNotFound {
+			t.Fatalf("%s signed: %d %s", name, w.Code, w.Body)
+		}
+		if w := ts.do(http.MethodPost, filter, "", body, headers...); w.Code != http.StatusUnauthorized {
+			t.Fatalf("%s replayed: got %d, want 401", name, w.Code)
+		}
+	}
+
+	rejected := map[string]struct {
+		body    string
+		headers []string
+	}{
+		"tampered body": {strings.Replace(body, "a.pdf", "b.pdf", 1), signedHeaders(http.MethodPost, filter, body, "jobs", signatureAlgHMAC, signHMAC, now)},
+		"other path":    {body, signedHeaders(http.MethodPost, "/v1/internal/token/exchange", body, "jobs", signatureAlgHMAC, signHMAC, now)},
+		"stale":         {body, signedHeaders(http.MethodPost, filter, body, "jobs", signatureAlgHMAC, signHMAC, now.Add(-time.Hour))},
+		"wrong alg":     {body, signedHeaders(http.MethodPost, filter, body, "rag", signatureAlgHMAC, signHMAC, now)},
+		"unknown key":   {body, signedHeaders(http.MethodPost, filter, body, "other", signatureAlgHMAC, signHMAC, now)},
+	}
+	for name, c := range rejected {
+		w := ts.do(http.MethodPost, filter, "", c.body, c.headers...)
+		var problem Problem
+		decodeJSON(t, w, &problem)
+		if w.Code != http.StatusUnauthorized || problem.Code != codeInvalidSignature {
+			t.Errorf("%s: %d %s", name, w.Code, w.Body)
+		}
+	}
+
+	// Optional lets unsigned calls through but still checks signed ones
+	withConfig(t, func(cfg *Config) { cfg.Auth.InternalSigning = internalSigningOptional })
+	if w := ts.do(http.MethodGet, "/v1/internal/revocations", "", "", internalTokenHeader, testInternalToken); w.Code != http.StatusOK {
+		t.Fatalf("optional, unsigned: %d %s", w.Code, w.Body)
+	}
+	headers := signedHeaders(http.MethodGet, "/v1/internal/revocations", "", "jobs", signatureAlgHMAC, signHMAC, now.Add(-time.Hour))
+	if w := ts.do(http.MethodGet, "/v1/internal/revocations", "", "", headers...); w.Code != http.StatusUnauthorized {
+		t.Fatalf("optional, badly signed: got %d, want 401", w.Code)
+	}
+}
+
+func TestParseSigningKeys(t *testing.T) {
+	key := base64.StdEncoding.EncodeToString([]byte(strings.Repeat("k", 32)))
+	public := base64.StdEncoding.EncodeToString(make([]byte, ed25519.PublicKeySize))
+	for _, c := range []struct{ hmacKeys, publicKeys string }{
+		{"a:" + base64.StdEncoding.EncodeToString([]byte("short")), ""},
+		{"a", ""},
+		{"", "a:" + key + "=="},
+		{"a:" + key, "a:" + public},
+	} {
+		if _, err := parseSigningKeys(c.hmacKeys, c.publicKeys); err == nil {
+			t.Errorf("parseSigningKeys(%q, %q) accepted", c.hmacKeys, c.publicKeys)
+		}
+	}
+	set, err := parseSigningKeys("a:"+key+", b:"+key, "c:"+public)
+	if err != nil || len(set.hmac) != 2 || len(set.ed25519) != 1 {
+		t.Fatalf("valid keys: %+v %v", set, err)
+	}
+}
+
+func TestSignatureNonceSharedAcrossReplicas(t *testing.T) {
+	hmacKey := []byte(strings.Repeat("h", 32))
+	signHMAC := func(message []byte) []byte {
+		mac := hmac.New(sha256.New, hmacKey)
+		mac.Write(message)
+		return mac.Sum(nil)
+	}
+	ts := newTestServer(t)
+	withConfig(t, func(cfg *Config) {
+		cfg.Auth.InternalAPIToken = testInternalToken
+		cfg.Auth.InternalSigning = internalSigningRequired
+		cfg.Auth.InternalSigningKeys = "jobs:" + base64.StdEncoding.EncodeToString(hmacKey)
+	})
+	mr := useSharedStore(t)
+	const revocations = "/v1/internal/revocations"
+
+	headers := signedHeaders(http.MethodGet, revocations, "", "jobs", signatureAlgHMAC, signHMAC, time.Now())
+	if w := ts.do(http.MethodGet, revocations, "", "", headers...); w.Code != http.StatusOK {
+		t.Fatalf("signed: %d %s", w.Code, w.Body)
+	}
+	// Every replica sees the nonce as used
+	nonce := headers[slices.Index(headers, signatureNonceHeader)+1]
+	if _, found, err := clusterStore.record(context.Background(), signatureNonceRecord, "jobs:"+nonce); err != nil || !found {
+		t.Fatalf("nonce not in the shared store: %v, %v", found, err)
+	}
+	if w := ts.do(http.MethodGet, revocations, "", "", headers...); w.Code != http.StatusUnauthorized {
+		t.Fatalf("replayed: got %d, want 401", w.Code)
+	}
+
+	// Without the store a nonce can't be checked, so the call waits
+	mr.Close()
+	headers = signedHeaders(http.MethodGet, revocations, "", "jobs", signatureAlgHMAC, signHMAC, time.Now())
+	if w := ts.do(http.MethodGet, revocations, "", "", headers...); w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("store down: got %d, want 503", w.Code)
+
+	}
+}
@@ -0,0 +1,609 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// ============================================================================
+// Ingestion Job Queue
+// ============================================================================
+//
+// Jobs and their payloads are written to jobs.store_dir before the upload is
+// acknowledged, so a 202 survives a restart: on startup, jobs that were
+// queued, retrying or interrupted mid-attempt are queued again. Payloads
+// stay on disk rather than in memory. Finished and dead-lettered jobs are
+// kept for jobs.retention so clients can poll them, then deleted. When the
+// queue is full new uploads get a 503 instead of waiting for a slot. The
+// store is per instance; in cluster mode each replica drains its own.
+
+// JobStatus is the lifecycle state of a job
+type JobStatus string
+
+const (
+	JobQueued       JobStatus = "queued"
+	JobRunning      JobStatus = "running"
+	JobRetrying     JobStatus = "retrying"
+	JobSucceeded    JobStatus = "succeeded"
+	JobDeadLettered JobStatus = "dead_lettered"
+)
+
+const (
+	maxUploadSize   = 10 << 20 // matches the RAG backend's limit
+	jobMaxAttempts  = 5
+	jobBackoffBase  = 2 * time.Second
+	jobBackoffMax   = 5 * time.Minute
+	jobQueueSize    = 1024
+	jobAttemptLimit = 5 * time.Minute // per-attempt processing timeout
+
+	jobSweepInterval = 10 * time.Minute
+)
+
+var errQueueFull = errors.New("Processing queue is full; retry later")
+
+// Job is a unit of document processing work
+type Job struct {
+	ID          string     `json:"id"`
+	Type        string     `json:"type"`
+	UserID      string     `json:"user_id"`
+	Filename    string     `json:"filename"`
+	Status      JobStatus  `json:"status"`
+	Attempts    int        `json:"attempts"`
+	MaxAttempts int        `json:"max_attempts"`
+	LastError   string     `json:"last_error,omitempty"`
+	Threat      string     `json:"threat,omitempty"`       // what the scan found, when blocked
+	ScanSkipped bool       `json:"scan_skipped,omitempty"` // an admin released it from quarantine
+	NextRunAt   *time.Time `json:"next_run_at,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+}
+
+var (
+	jobs     = make(map[string]*Job) // id -> job; mirrors the store
+	jobQueue = make(chan string, jobQueueSize)
+	jobMutex sync.RWMutex
+	jobStore jobFiles
+
+	backendClient = &http.Client{Timeout: jobAttemptLimit}
+)
+
+// jobFiles keeps each job as <id>.json and its payload as <id>.payload.
+// Files are replaced by rename so a crash never leaves half a record.
+type jobFiles struct {
+	dir string
+}
+
+func (s jobFiles) path(id, ext string) string {
+	return filepath.Join(s.dir, id+ext)
+}
+
+func (s jobFiles) write(name string, data []byte) error {
+	tmp := name + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, name)
+}
+
+// save writes a job's record; callers hold jobMutex
+func (s jobFiles) save(job *Job) error {
+	data, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	return s.write(s.path(job.ID, ".json"), data)
+}
+
+func (s jobFiles) savePayload(id string, content []byte) error {
+	return s.write(s.path(id, ".payload"), content)
+}
+
+func (s jobFiles) payload(id string) ([]byte, error) {
+	return os.ReadFile(s.path(id, ".payload"))
+}
+
+func (s jobFiles) dropPayload(id string) {
+	os.Remove(s.path(id, ".payload"))
+}
+
+func (s jobFiles) remove(id string) {
+	os.Remove(s.path(id, ".json"))
+	s.dropPayload(id)
+}
+
+// load reads every stored job
+func (s jobFiles) load() ([]*Job, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	var loaded []*Job
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(s.dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		var job Job
+		if err := json.Unmarshal(data, &job); err != nil {
+			slog.Warn("Skipping unreadable job record", "file", entry.Name(), "error", err)
+			continue
+		}
+		loaded = append(loaded, &job)
+	}
+	return loaded, nil
+}
+
+// persistJob saves a job's state change, logging rather than failing: the
+// in-memory state is still correct until the next restart
+func persistJob(job *Job) {
+	if err := jobStore.save(job); err != nil {
+		slog.Error("Job store write failed", "job_id", job.ID, "error", err)
+	}
+}
+
+// offerJob queues a job without blocking
+func offerJob(id string) bool {
+	select {
+	case jobQueue <- id:
+		return true
+	default:
+		return false
+	}
+}
+
+// enqueueIngestJob stores a file for asynchronous upload to the RAG backend
+// and returns a snapshot of the queued job. It fails with errQueueFull
+// rather than waiting when the queue has no room.
+func enqueueIngestJob(userID, filename, mediaType string, content []byte) (Job, error) {
+	now := time.Now()
+	job := &Job{
+		ID:          uuid.New().String(),
+		Type:        "ingest",
+		UserID:      userID,
+		Filename:    filename,
+		Status:      JobQueued,
+		MaxAttempts: jobMaxAttempts,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+	if len(jobQueue) == cap(jobQueue) {
+		return Job{}, errQueueFull
+	}
+
+	if err := jobStore.savePayload(job.ID, content); err != nil {
+		slog.Error("Job store write failed", "job_id", job.ID, "error", err)
+		return Job{}, errStoreUnavailable
+	}
+	jobMutex.Lock()
+	if err := jobStore.save(job); err != nil {
+		jobMutex.Unlock()
+		jobStore.remove(job.ID)
+		slog.Error("Job store write failed", "job_id", job.ID, "error", err)
+		return Job{}, errStoreUnavailable
+	}
+	jobs[job.ID] = job
+	snapshot := *job
+	jobMutex.Unlock()
+
+	if !offerJob(job.ID) {
+		// Lost the race for the last slot
+		jobMutex.Lock()
+		delete(jobs, job.ID)
+		jobMutex.Unlock()
+		jobStore.remove(job.ID)
+		return Job{}, errQueueFull
+	}
+	recordDocumentUpload(filename, len(content), mediaType)
+	return snapshot, nil
+}
+
+// uploadToBackend sends a file to the RAG backend's upload endpoint with
+// the settings to chunk it with (chunking.go)
+func uploadToBackend(ctx context.Context, filename string, content io.Reader, chunking ChunkingSettings) error {
+	var buf bytes.Buffer
+	form := multipart.NewWriter(&buf)
+	form.WriteField("splitter", chunking.Splitter)
+	form.WriteField("chunk_size", strconv.Itoa(chunking.Size))
+	form.WriteField("chunk_overlap", strconv.Itoa(chunking.Overlap))
+	part, err := form.CreateFormFile("file", filename)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(part, content); err != nil {
+		return fmt.Errorf("read content: %w", err)
+	}
+	if err := form.Close(); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, ragBackendURL()+"/upload", &buf)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", form.FormDataContentType())
+
+	resp, err := backendClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("upload: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("upload returned %s", resp.Status)
+	}
+	return nil
+}
+
+// jobBackoff returns the delay before the given retry attempt
+func jobBackoff(attempt int) time.Duration {
+	delay := time.Duration(float64(jobBackoffBase) * math.Pow(2, float64(attempt-1)))
+	if delay > jobBackoffMax {
+		return jobBackoffMax
+	}
+	return delay
+}
+
+// restoreJobs loads the store and returns the jobs to queue again, oldest
+// first. An attempt cut short by a restart does not count.
+func restoreJobs() ([]string, error) {
+	if err := os.MkdirAll(jobStore.dir, 0o700); err != nil {
+		return nil, err
+	}
+	loaded, err := jobStore.load()
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(loaded, func(i, j int) bool { return loaded[i].CreatedAt.Before(loaded[j].CreatedAt) })
+
+	jobMutex.Lock()
+	defer jobMutex.Unlock()
+
+	var pending []string
+	for _, job := range loaded {
+		jobs[job.ID] = job
+		switch job.Status {
+		case JobRunning:
+			job.Attempts--
+			fallthrough
+		case JobQueued, JobRetrying:
+			job.Status = JobQueued
+			job.NextRunAt = nil
+			persistJob(job)
+			pending = append(pending, job.ID)
+		}
+	}
+	return pending, nil
+}
+
+// startJobWorkers opens the job store and launches the workers that drain
+// the queue
+func startJobWorkers() {
+	jobStore = jobFiles{dir: config.Jobs.StoreDir}
+	pending, err := restoreJobs()
+	if err != nil {
+		fatal("Failed to open job store", "dir", jobStore.dir, "error", err)
+	}
+	if len(pending) > 0 {
+		slog.Info("Restored queued jobs", "count", len(pending))
+		goBackground(func(ctx context.Context) {
+			for _, id := range pending {
+				select {
+				case jobQueue <- id:
+				case <-ctx.Done():
+					return
+				}
+			}
+		})
+	}
+	goBackground(sweepJobs)
+
+	for i := 0; i < config.Jobs.Workers; i++ {
+		// Workers finish the job in hand on shutdown; queued jobs are
+		// restored from the store on the next start
+		goBackground(func(ctx context.Context) {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case id := <-jobQueue:
+					runJob(id)
+				}
+			}
+		})
+	}
+}
+
+// sweepJobs deletes finished and dead-lettered jobs once they are older
+// than jobs.retention
+func sweepJobs(ctx context.Context) {
+	ticker := time.NewTicker(jobSweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		cutoff := time.Now().Add(-config.Jobs.Retention)
+		jobMutex.Lock()
+		evicted := 0
+		for id, job := range jobs {
+			if (job.Status == JobSucceeded || job.Status == JobDeadLettered) && job.UpdatedAt.Before(cutoff) {
+				delete(jobs, id)
+				jobStore.remove(id)
+				evicted++
+			}
+		}
+		jobMutex.Unlock()
+		if evicted > 0 {
+			debugLog("jobs", "Evicted finished jobs", "count", evicted)
+		}
+	}
+}
+
+// scheduleRetry queues a job again after delay. If the queue is full then,
+// it tries again later rather than blocking the timer goroutine.
+func scheduleRetry(id string, delay time.Duration) {
+	time.AfterFunc(delay, func() {
+		if !offerJob(id) {
+			scheduleRetry(id, jobBackoffBase)
+		}
+	})
+}
+
+// runJob processes one job attempt, scheduling a retry or dead-lettering
+// it on failure
+func runJob(id string) {
+	jobMutex.Lock()
+	job, exists := jobs[id]
+	if !exists || (job.Status != JobQueued && job.Status != JobRetrying) {
+		jobMutex.Unlock()
+		return
+	}
+	job.Status = JobRunning
+	job.Attempts++
+	job.NextRunAt = nil
+	job.UpdatedAt = time.Now()
+	filename := job.Filename
+	skipScan := job.ScanSkipped
+	persistJob(job)
+	jobMutex.Unlock()
+
+	var verdict ScanResult
+	chunking := defaultService.ChunkingFor(filename)
+	payload, err := jobStore.payload(id)
+	if err == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), jobAttemptLimit)
+		if !skipScan {
+			verdict, err = scanUpload(ctx, filename, payload)
+		}
+		if err == nil && !verdict.Infected {
+			err = uploadToBackend(ctx, filename, bytes.NewReader(payload), chunking)
+		}
+		cancel()
+		if err == nil && !verdict.Infected {
+			defaultService.MarkChunked(filename, chunking)
+			recordDocumentPreview(filename, extractPreview(filename, payload))
+		}
+	} else {
+		err = fmt.Errorf("read payload: %w", err)
+	}
+
+	jobMutex.Lock()
+	defer jobMutex.Unlock()
+	defer persistJob(job)
+
+	job.UpdatedAt = time.Now()
+	if verdict.Infected {
+		quarantineJob(job, verdict)
+		return
+	}
+	if err == nil {
+		debugLog("jobs", "Job succeeded", "job_id", job.ID, "attempt", job.Attempts)
+		job.Status = JobSucceeded
+		job.LastError = ""
+		jobStore.dropPayload(id)
+		notify(job.UserID, NotificationDocumentProcessed, "Document ready",
+			filename+" has been processed and can be queried.",
+			map[string]string{"filename": filename, "job_id": job.ID})
+		publishAdminEvent(AdminEvent{Type: AdminEventDocumentProcessed, UserID: job.UserID, Outcome: "success",
+			Details: map[string]string{"filename": filename, "job_id": job.ID, "attempts": strconv.Itoa(job.Attempts)}})
+		return
+	}
+
+	job.LastError = err.Error()
+	if job.Attempts >= job.MaxAttempts {
+		// Keep the payload so an admin can retry after fixing the cause
+		job.Status = JobDeadLettered
+		slog.Error("Job dead-lettered", "job_id", job.ID, "file", filename, "attempts", job.Attempts, "error", err)
+		notify(job.UserID, NotificationDocumentFailed, "Document processing failed",
+			fmt.Sprintf("%s could not be processed after %d attempts; an administrator can retry it.", filename, job.Attempts),
+			map[string]string{"filename": filename, "job_id": job.ID})
+		publishAdminEvent(AdminEvent{Type: AdminEventDocumentFailed, UserID: job.UserID, Outcome: "failure",
+			Details: map[string]string{"filename": filename, "job_id": job.ID, "attempts": strconv.Itoa(job.Attempts), "reason": redactString(job.LastError)}})
+		return
+	}
+
+	delay := jobBackoff(job.Attempts)
+	debugLog("jobs", "Job attempt failed; retrying", "job_id", job.ID, "attempt", job.Attempts, "retry_in", delay, "error", err)
+	next := time.Now().Add(delay)
+	job.Status = JobRetrying
+	job.NextRunAt = &next
+	scheduleRetry(id, delay)
+}
+
+// uploadDocument accepts a file, registers it to the caller, and queues it
+// for processing. The response returns as soon as the file is stored.
+func uploadDocument(c *gin.Context) {
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxUploadSize+1<<20)
+	header, err := c.FormFile("file")
+	if limit, tooLarge := bodyTooLarge(err); tooLarge {
+		respondBodyTooLarge(c, limit)
+		return
+	}
+	if err != nil {
+		respondError(c, http.StatusBadRequest, codeInvalidRequest, "File is required")
+		return
+	}
+	if header.Size > maxUploadSize {
+		respondProblem(c, Problem{Status: http.StatusRequestEntityTooLarge, Code: codePayloadTooLarge, Detail: "File exceeds 10MB limit",
+			Extensions: map[string]interface{}{"size": header.Size, "max_bytes": maxUploadSize}})
+		return
+	}
+
+	file, err := header.Open()
+	if err != nil {
+		respondError(c, http.StatusBadRequest, codeInvalidRequest, "Failed to read file")
+		return
+	}
+	content, err := io.ReadAll(file)
+	file.Close()
+	if err != nil {
+		respondError(c, http.StatusBadRequest, codeInvalidRequest, "Failed to read file")
+		return
+	}
+
+	mediaType, err := checkFileType(header.Filename, content)
+	if err != nil {
+		respondFileTypeError(c, err.(*fileTypeError))
+		return
+	}
+
+	user, _ := c.Get("user")
+	currentUser := user.(*User)
+
+	filename, created, err := registerDocumentAs(header.Filename, currentUser.ID)
+	if err != nil {
+		respondServiceError(c, err)
+		return
+	}
+
+	job, err := enqueueIngestJob(currentUser.ID, filename, mediaType, content)
+	if err != nil {
+		if created {
+			// Nothing will be processed, so don't leave the claim behind
+			releaseDocument(filename, currentUser)
+		}
+		respondServiceError(c, err)
+		return
+	}
+	auditChange(c, "document.upload", "document:"+filename, nil,
+		gin.H{"filename": filename, "owner_id": currentUser.ID, "job_id": job.ID, "size": len(content), "type": mediaType})
+	publishAdminEvent(AdminEvent{Type: AdminEventDocumentUploaded, UserID: currentUser.ID, Email: currentUser.Email, Outcome: "success",
+		Details: map[string]string{"filename": filename, "job_id": job.ID, "size": strconv.Itoa(len(content)), "type": mediaType}})
+
+	c.JSON(http.StatusAccepted, gin.H{
+		"message":  "Document queued for processing",
+		"filename": filename,
+		"name":     header.Filename,
+		"job_id":   job.ID,
+		"status":   job.Status,
+	})
+}
+
+// getJob returns the status of a job (owner or admin)
+func getJob(c *gin.Context) {
+	user, _ := c.Get("user")
+	currentUser := user.(*User)
+
+	jobMutex.RLock()
+	job, exists := jobs[c.Param("id")]
+	var snapshot Job
+	if exists {
+		snapshot = *job
+	}
+	jobMutex.RUnlock()
+
+	if !exists {
+		respondError(c, http.StatusNotFound, codeNotFound, "Job not found")
+		return
+	}
+	if snapshot.UserID != currentUser.ID && currentUser.Role != "admin" {
+		respondError(c, http.StatusForbidden, codeForbidden, "Not authorized to view this job")
+		return
+	}
+
+	c.JSON(http.StatusOK, snapshot)
+}
+
+// listDeadLetterJobs returns jobs that exhausted their retries (admin only)
+func listDeadLetterJobs(c *gin.Context) {
+	user, _ := c.Get("user")
+	if user.(*User).Role != "admin" {
+		respondError(c, http.StatusForbidden, codeAdminRequired, "Admin access required")
+		return
+	}
+
+	jobMutex.RLock()
+	dead := make([]Job, 0)
+	for _, job := range jobs {
+		if job.Status == JobDeadLettered {
+			dead = append(dead, *job)
+		}
+	}
+	jobMutex.RUnlock()
+
+	sort.Slice(dead, func(i, j int) bool { return dead[i].UpdatedAt.After(dead[j].UpdatedAt) })
+
+	c.JSON(http.StatusOK, gin.H{
+		"jobs":  dead,
+		"total": len(dead),
+	})
+}
+
+// retryJob re-queues a dead-lettered job with a fresh attempt budget (admin only)
+func retryJob(c *gin.Context) {
+	user, _ := c.Get("user")
+	if user.(*User).Role != "admin" {
+		respondError(c, http.StatusForbidden, codeAdminRequired, "Admin access required")
+		return
+	}
+
+	jobMutex.Lock()
+	job, exists := jobs[c.Param("id")]
+	if !exists {
+		jobMutex.Unlock()
+		respondError(c, http.StatusNotFound, codeNotFound, "Job not found")
+		return
+	}
+	if job.Status != JobDeadLettered {
+		jobMutex.Unlock()
+		respondError(c, http.StatusConflict, codeConflict, "Only dead-lettered jobs can be retried")
+		return
+	}
+	if !offerJob(job.ID) {
+		jobMutex.Unlock()
+		respondServiceError(c, errQueueFull)
+		return
+	}
+	job.Status = JobQueued
+	job.Attempts = 0
+	job.UpdatedAt = time.Now()
+	persistJob(job)
+	jobMutex.Unlock()
+
+	c.JSON(http.StatusAccepted, gin.H{"message": "Job re-queued", "job_id": job.ID})
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"sort"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ============================================================================
+// Document Languages
+// ============================================================================
+//
+// A document's language is detected at ingestion with the rest of its
+// preview (preview.go): declared by the file where it can be, guessed from
+// the text otherwise. It groups documents into per-language collections:
+// GET /documents/languages counts the documents a user can read in each,
+// and the listings under /documents take ?language= to show one.
+//
+// Queries carry it to the RAG backend too. streamQuery sends the question's
+// language, from the request, the question's text or Accept-Language in
+// that order, and the sources it is limited to that are in that language
+// as preferred_sources; the backend can rank those first without excluding
+// the rest. An admin's unrestricted query carries only the language. POST
+// /internal/access/filter returns the language of each allowed document so
+// the gateway can do the same for its own candidates. Documents without a
+// preview are in the "unknown" collection.
+
+// languageUnknown lists and counts documents with no detected language
+const languageUnknown = "unknown"
+
+var languagePattern = regexp.MustCompile(`^[a-z]{2,3}$`)
+
+// LanguageCount is one language collection
+type LanguageCount struct {
+	Language string `json:"language"`
+	Count    int    `json:"count"`
+}
+
+// documentLanguage is a record's detected language, or languageUnknown
+func documentLanguage(record documentRecord) string {
+	if record.Preview == nil || record.Preview.Language == "" {
+		return languageUnknown
+	}
+	return record.Preview.Language
+}
+
+// DocumentLanguages returns the language of each of the given documents
+func (s *Service) DocumentLanguages(filenames []string) map[string]string {
+	languages := make(map[string]string, len(filenames))
+	s.documents.View(func(tx DocumentTx) {
+		for _, filename := range filenames {
+			if record, exists := tx.get(filename); exists {
+				languages[filename] = documentLanguage(record)
+			}
+		}
+	})
+	return languages
+}
+
+// InLanguage keeps the documents in a language, in order
+func (s *Service) InLanguage(filenames []string, language string) []string {
+	languages := s.DocumentLanguages(filenames)
+	matching := make([]string, 0, len(filenames))
+	for _, filename := range filenames {
+		if languages[filename] == language {
+			matching = append(matching, filename)
+		}
+	}
+	return matching
+}
+
+// LanguageCounts counts the documents a user can read in each language,
+// largest collection first
+func (s *Service) LanguageCounts(user *User) []LanguageCount {
+	counts := make(map[string]int)
+	s.documents.View(func(tx DocumentTx) {
+		tx.each(func(filename string, record documentRecord) {
+			if user.Role == "admin" || s.readable(tx, user, filename) {
+				counts[documentLanguage(record)]++
+			}
+		})
+	})
+	collections := make([]LanguageCount, 0, len(counts))
+	for language, count := range counts {
+		collections = append(collections, LanguageCount{Language: language, Count: count})
+	}
+	sort.Slice(collections, func(i, j int) bool {
+		if collections[i].Count != collections[j].Count {
+			return collections[i].Count > collections[j].Count
+		}
+		return collections[i].Language < collections[j].Language
+	})
+	return collections
+}
+
+// questionLanguage picks the language a query is asked in: the one given,
+// else the question's, else fallback (the caller's negotiated language)
+func questionLanguage(req StreamQueryRequest, fallback string) string {
+	if req.Language != "" {
+		return req.Language
+	}
+	if language := guessLanguage(req.Question); language != "" {
+		return language
+	}
+	return fallback
+}
+
+// ----------------------------------------------------------------------------
+// Handlers
+// ----------------------------------------------------------------------------
+
+// languageFilter reads ?language=; it answers 400 and returns false if the
+// value isn't a language code
+func languageFilter(c *gin.Context) (string, bool) {
+	language := c.Query("language")
+	if language != "" && language != languageUnknown && !languagePattern.MatchString(language) {
+		respondError(c, http.StatusBadRequest, codeInvalidRequest, "language must be a two- or three-letter language code")
+		return "", false
+	}
+	return language, true
+}
+
+// languageScope keys a listing's ETag by the language it was filtered to
+func languageScope(scope, language string) string {
+	if language == "" {
+		return scope
+	}
+	return scope + "?language=" + language
+}
+
+// getDocumentLanguages lists the languages of the documents the current user
+// can read, with how many documents each has
+func (s *Server) getDocumentLanguages(c *gin.Context) {
+	collections := s.svc.LanguageCounts(c.MustGet("user").(*User))
+	c.JSON(http.StatusOK, gin.H{"languages": collections, "count": len(collections)})
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestDocumentLanguages(t *testing.T) {
+	ts := newTestServer(t)
+	owner, _ := ts.register("owner@example.com")
+	for filename, language := range map[string]string{"a.pdf": "es", "b.pdf": "en", "c.pdf": "es", "d.pdf": ""} {
+		ts.do(http.MethodPost, "/v1/documents/register", owner, `{"filename":"`+filename+`"}`)
+		if language != "" {
+			ts.srv.svc.SetDocumentPreview(filename, DocumentPreview{Language: language})
+		}
+	}
+
+	var list struct {
+		Documents []string `json:"documents"`
+	}
+	w := ts.do(http.MethodGet, "/v1/documents/my?language=es", owner, "")
+	decodeJSON(t, w, &list)
+	if len(list.Documents) != 2 || list.Documents[0] != "a.pdf" || list.Documents[1] != "c.pdf" {
+		t.Fatalf("spanish documents: %v", list.Documents)
+	}
+	if all := ts.do(http.MethodGet, "/v1/documents/my", owner, ""); all.Header().Get("ETag") == w.Header().Get("ETag") {
+		t.Fatal("filtered and unfiltered listings share an ETag")
+	}
+	decodeJSON(t, ts.do(http.MethodGet, "/v1/documents/my?language=unknown", owner, ""), &list)
+	if len(list.Documents) != 1 || list.Documents[0] != "d.pdf" {
+		t.Fatalf("documents without a language: %v", list.Documents)
+	}
+	if w := ts.do(http.MethodGet, "/v1/documents/my?language=Spanish", owner, ""); w.Code != http.StatusBadRequest {
+		t.Fatalf("bad language code: got %d, want 400", w.Code)
+	}
+
+	var collections struct {
+		Languages []LanguageCount `json:"languages"`
+	}
+	decodeJSON(t, ts.do(http.MethodGet, "/v1/documents/languages", owner, ""), &collections)
+	want := []LanguageCount{{"es", 2}, {"en", 1}, {languageUnknown, 1}}
+	if len(collections.Languages) != len(want) {
+		t.Fatalf("collections: %+v", collections.Languages)
+	}
+	for i := range want {
+		if collections.Languages[i] != want[i] {
+			t.Fatalf("collections: %+v, want %+v", collections.Languages, want)
+		}
+	}
+}
+
+func TestQuestionLanguage(t *testing.T) {
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest(http.MethodPost, "/v1/query/stream", nil)
+	c.Request.Header.Set("Accept-Language", "hi")
+	tests := []struct {
+		req  StreamQueryRequest
+		want string
+	}{
+		{StreamQueryRequest{Question: "¿Cuál es el plazo para la entrega de los informes?", Language: "en"}, "en"},
+		{StreamQueryRequest{Question: "¿Cuál es el plazo para la entrega de los informes?"}, "es"},
+		{StreamQueryRequest{Question: "deadline?"}, "hi"},
+	}
+	for _, tt := range tests {
+		if got := questionLanguage(tt.req, requestLanguage(c)); got != tt.want {
+			t.Errorf("%q (%q): got %q, want %q", tt.req.Question, tt.req.Language, got, tt.want)
+		}
+	}
+}
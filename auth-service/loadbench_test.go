@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// The request benchmarks drive the real handlers in-process and report
+// latency percentiles next to ns/op. Concurrency is goroutines per CPU:
+//
+//	go test -run XXX -bench 'Request' -args -bench.concurrency 8
+//
+// cmd/loadgen measures the same operations against a running server.
+var benchConcurrency = flag.Int("bench.concurrency", 4, "goroutines per CPU for the request benchmarks")
+
+const benchPassword = "bench-password"
+
+// benchRouter mounts the benchmarked routes over a fresh Service and seeds
+// accounts, one per goroutine slot, with tokens for them
+func benchRouter(b *testing.B, accounts int) (*gin.Engine, []string) {
+	b.Helper()
+	withConfig(b, func(cfg *Config) {
+		cfg.Passwords.Algorithm, cfg.Passwords.BcryptCost = "bcrypt", bcrypt.MinCost
+	})
+	keys := &keyRing{}
+	keys.rotate([]byte("request-benchmark-key-0123456789abcdef"))
+	s := &Server{svc: NewService(newMemoryUserRepository(), newMemoryDocumentRepository(), keys)}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(benchPassword), bcrypt.MinCost)
+	if err != nil {
+		b.Fatal(err)
+	}
+	tokens := make([]string, accounts)
+	for i := range tokens {
+		id := fmt.Sprintf("bench-%d", i)
+		user, err := s.svc.users.Add(&User{ID: id, Email: id + "@example.com", Password: string(hash), Role: "user"})
+		if err != nil {
+			b.Fatal(err)
+		}
+		if tokens[i], err = s.svc.IssueToken(user); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	r := gin.New()
+	r.POST("/v1/auth/login", s.login)
+	r.GET("/v1/auth/verify", s.authMiddleware(), s.verifyToken)
+	r.POST("/v1/documents/register", s.authMiddleware(), s.registerDocument)
+	return r, tokens
+}
+
+// runRequests issues requests from *benchConcurrency goroutines per CPU and
+// reports p50, p90 and p99 latency
+func runRequests(b *testing.B, r http.Handler, newRequest func(account, n int) *http.Request) {
+	var (
+		mu        sync.Mutex
+		latencies []time.Duration
+		workers   atomic.Int32
+		failures  atomic.Int64
+	)
+	b.SetParallelism(*benchConcurrency)
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		account := int(workers.Add(1) - 1)
+		var local []time.Duration
+		for n := 0; pb.Next(); n++ {
+			req := newRequest(account, n)
+			w := httptest.NewRecorder()
+			start := time.Now()
+			r.ServeHTTP(w, req)
+			local = append(local, time.Since(start))
+			if w.Code >= 300 {
+				failures.Add(1)
+			}
+		}
+		mu.Lock()
+		latencies = append(latencies, local...)
+		mu.Unlock()
+	})
+	b.StopTimer()
+
+	if failures.Load() > 0 {
+		b.Fatalf("%d of %d requests failed", failures.Load(), len(latencies))
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	for _, p := range []int{50, 90, 99} {
+		rank := (p*len(latencies) + 99) / 100
+		b.ReportMetric(float64(latencies[rank-1].Microseconds()), fmt.Sprintf("p%d-µs", p))
+	}
+}
+
+// benchAccounts is enough accounts for every RunParallel goroutine
+func benchAccounts() int {
+	return *benchConcurrency * runtime.GOMAXPROCS(0)
+}
+
+func jsonBody(b *testing.B, payload interface{}) []byte {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		b.Fatal(err)
+	}
+	return body
+}
+
+func BenchmarkRequestLogin(b *testing.B) {
+	accounts := benchAccounts()
+	bodies := make([][]byte, accounts)
+	for i := range bodies {
+		bodies[i] = jsonBody(b, LoginRequest{Email: fmt.Sprintf("bench-%d@example.com", i), Password: benchPassword})
+	}
+	r, _ := benchRouter(b, accounts)
+	runRequests(b, r, func(account, _ int) *http.Request {
+		req := httptest.NewRequest(http.MethodPost, "/v1/auth/login", bytes.NewReader(bodies[account]))
+		req.Header.Set("Content-Type", "application/json")
+		return req
+	})
+}
+
+func BenchmarkRequestVerify(b *testing.B) {
+	for _, ttl := range []time.Duration{0, 30 * time.Second} {
+		b.Run("token_cache_ttl="+ttl.String(), func(b *testing.B) {
+			r, tokens := benchRouter(b, benchAccounts())
+			withConfig(b, func(cfg *Config) { cfg.Auth.TokenCacheTTL = ttl })
+			runRequests(b, r, func(account, _ int) *http.Request {
+				req := httptest.NewRequest(http.MethodGet, "/v1/auth/verify", nil)
+				req.Header.Set("Authorization", "Bearer "+tokens[account])
+				return req
+			})
+		})
+	}
+}
+
+func BenchmarkRequestRegisterDocument(b *testing.B) {
+	r, tokens := benchRouter(b, benchAccounts())
+	runRequests(b, r, func(account, n int) *http.Request {
+		body := fmt.Sprintf(`{"filename":"bench-%d-%d.pdf"}`, account, n)
+		req := httptest.NewRequest(http.MethodPost, "/v1/documents/register", bytes.NewReader([]byte(body)))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+tokens[account])
+		return req
+	})
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ============================================================================
+// Runtime Log Controls
+// ============================================================================
+//
+// PUT /admin/logging changes the log level and turns on verbose (debug)
+// logging for individual modules without a restart, e.g. only "auth" while
+// chasing a token validation problem, so production isn't flooded with
+// every module's debug output. An optional expires_in puts the configured
+// settings back automatically. In cluster mode the settings live in the
+// shared store and apply to every replica; the redactor still applies to
+// verbose output.
+
+// loggingSetting names the log settings in the shared store
+const loggingSetting = "logging"
+
+// logModules are the modules that write verbose logs
+var logModules = []string{"auth", "connectors", "grpc", "jobs", "ratelimit"}
+
+func isLogModule(name string) bool {
+	for _, module := range logModules {
+		if module == name {
+			return true
+		}
+	}
+	return false
+}
+
+// LoggingStatus is the current log configuration
+type LoggingStatus struct {
+	Level    string          `json:"level"`
+	Modules  map[string]bool `json:"modules"` // module -> verbose
+	RevertAt *time.Time      `json:"revert_at,omitempty"`
+}
+
+var (
+	verboseModules = make(map[string]bool)
+	anyVerbose     atomic.Bool
+	logRevertAt    *time.Time
+	logRevertTimer *time.Timer
+	logControlMu   sync.RWMutex
+)
+
+// verboseModule reports whether a module's debug logs are on by itself
+func verboseModule(module string) bool {
+	if !anyVerbose.Load() {
+		return false
+	}
+	logControlMu.RLock()
+	defer logControlMu.RUnlock()
+	return verboseModules[module]
+}
+
+// debugEnabled reports whether debug logs for module are written
+func debugEnabled(module string) bool {
+	return logLevel.Level() <= slog.LevelDebug || verboseModule(module)
+}
+
+// debugLog writes a debug record tagged with its module
+func debugLog(module, msg string, args ...any) {
+	if !debugEnabled(module) {
+		return
+	}
+	slog.Default().Log(context.Background(), slog.LevelDebug, msg, append([]any{"module", module}, args...)...)
+}
+
+func loggingStatus() LoggingStatus {
+	logControlMu.RLock()
+	defer logControlMu.RUnlock()
+
+	status := LoggingStatus{
+		Level:    strings.ToLower(logLevel.Level().String()),
+		Modules:  make(map[string]bool, len(logModules)),
+		RevertAt: logRevertAt,
+	}
+	for _, module := range logModules {
+		status.Modules[module] = verboseModules[module]
+	}
+	return status
+}
+
+// applyLogging sets the level and module switches; callers hold logControlMu
+func applyLogging(level slog.Level, modules map[string]bool) {
+	logLevel.Set(level)
+	for module, verbose := range modules {
+		if verbose {
+			verboseModules[module] = true
+		} else {
+			delete(verboseModules, module)
+		}
+	}
+	anyVerbose.Store(len(verboseModules) > 0)
+}
+
+// changeLogging applies new log settings, on every replica when clustered
+func changeLogging(status LoggingStatus) error {
+	if clustered() {
+		data, err := json.Marshal(status)
+		if err != nil {
+			return err
+		}
+		if err := saveSharedSetting(loggingSetting, data); err != nil {
+			return err
+		}
+	}
+	applyLoggingStatus(status)
+	return nil
+}
+
+// applyLoggingSetting follows a change made through another replica
+func applyLoggingSetting(data []byte) error {
+	var status LoggingStatus
+	if err := json.Unmarshal(data, &status); err != nil {
+		return err
+	}
+	applyLoggingStatus(status)
+	return nil
+}
+
+// applyLoggingStatus replaces the level, module switches and revert time;
+// settings already past their revert time leave the configured ones
+func applyLoggingStatus(status LoggingStatus) {
+	logControlMu.Lock()
+	defer logControlMu.Unlock()
+	if logRevertTimer != nil {
+		logRevertTimer.Stop()
+		logRevertAt, logRevertTimer = nil, nil
+	}
+	level := slog.LevelInfo
+	verboseModules = make(map[string]bool)
+	if status.RevertAt != nil && !time.Now().Before(*status.RevertAt) {
+		level.UnmarshalText([]byte(config.Log.Level))
+		applyLogging(level, nil)
+		return
+	}
+	level.UnmarshalText([]byte(status.Level))
+	applyLogging(level, status.Modules)
+	if status.RevertAt != nil {
+		at := *status.RevertAt
+		logRevertAt, logRevertTimer = &at, time.AfterFunc(time.Until(at), revertLogging)
+	}
+}
+
+// revertLogging restores log.level and turns every module off
+func revertLogging() {
+	logControlMu.Lock()
+	defer logControlMu.Unlock()
+	if logRevertAt == nil || time.Now().Before(*logRevertAt) {
+		// Superseded by a later change
+		return
+	}
+
+	level := slog.LevelInfo
+	level.UnmarshalText([]byte(config.Log.Level))
+	verboseModules = make(map[string]bool)
+	applyLogging(level, nil)
+	logRevertAt, logRevertTimer = nil, nil
+	slog.Info("Log settings reverted", "level", level.String())
+}
+
+// getLogging reports the log level and verbose modules (admin only)
+func getLogging(c *gin.Context) {
+	c.JSON(http.StatusOK, loggingStatus())
+}
+
+// LoggingRequest changes the log settings; omitted fields are unchanged
+type LoggingRequest struct {
+	Level     string          `json:"level,omitempty" binding:"omitempty,oneof=debug info warn error"`
+	Modules   map[string]bool `json:"modules,omitempty"`    // module -> verbose
+	ExpiresIn string          `json:"expires_in,omitempty"` // revert to the configuration after, e.g. "30m"
+}
+
+// setLogging changes the log level and verbose modules (admin only)
+func setLogging(c *gin.Context) {
+	var req LoggingRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondBindError(c, err)
+		return
+	}
+	for module := range req.Modules {
+		if !isLogModule(module) {
+			respondError(c, http.StatusBadRequest, codeInvalidRequest,
+				"Unknown module "+module+"; expected one of "+strings.Join(logModules, ", "))
+			return
+		}
+	}
+	var expiresIn time.Duration
+	if req.ExpiresIn != "" {
+		d, err := time.ParseDuration(req.ExpiresIn)
+		if err != nil || d <= 0 {
+			respondError(c, http.StatusBadRequest, codeInvalidRequest, "expires_in must be a positive duration such as 30m")
+			return
+		}
+		expiresIn = d
+	}
+
+	before := loggingStatus()
+	next := loggingStatus()
+	if req.Level != "" {
+		next.Level = req.Level
+	}
+	for module, verbose := range req.Modules {
+		next.Modules[module] = verbose
+	}
+	next.RevertAt = nil
+	if expiresIn > 0 {
+		at := time.Now().Add(expiresIn).UTC()
+		next.RevertAt = &at
+	}
+	if err := changeLogging(next); err != nil {
+		respondServiceError(c, err)
+		return
+	}
+	after := loggingStatus()
+
+	slog.Info("Log settings changed", "level", after.Level, "modules", req.Modules, "expires_in", req.ExpiresIn)
+	auditChange(c, "logging.update", "logging", before, after)
+	c.JSON(http.StatusOK, after)
+}
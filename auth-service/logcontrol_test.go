@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestLoggingReachesReplicas(t *testing.T) {
+	ts := newTestServer(t)
+	admin := ts.admin("admin@example.com")
+	useSharedStore(t)
+	t.Cleanup(func() { applyLoggingStatus(LoggingStatus{Level: config.Log.Level}) })
+
+	w := ts.do(http.MethodPut, "/v1/admin/logging", admin, `{"level":"warn","modules":{"auth":true},"expires_in":"10m"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("change: %d %s", w.Code, w.Body)
+	}
+
+	// Another replica catches up through the change feed...
+	applyLoggingStatus(LoggingStatus{Level: "info"})
+	if err := refreshRecord(context.Background(), clusterChange{Kind: "setting", ID: loggingSetting}); err != nil {
+		t.Fatal(err)
+	}
+	status := loggingStatus()
+	if status.Level != "warn" || !status.Modules["auth"] || status.Modules["jobs"] || status.RevertAt == nil || !verboseModule("auth") {
+		t.Fatalf("after change message: %+v", status)
+	}
+	// ...or a resync
+	applyLoggingStatus(LoggingStatus{Level: "info"})
+	if err := resyncShared(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if !verboseModule("auth") {
+		t.Fatal("auth not verbose after resync")
+	}
+
+	// Settings already past their revert time leave the configured ones
+	past := time.Now().Add(-time.Minute)
+	applyLoggingStatus(LoggingStatus{Level: "debug", Modules: map[string]bool{"jobs": true}, RevertAt: &past})
+	if verboseModule("jobs") || logLevel.Level() == slog.LevelDebug || loggingStatus().RevertAt != nil {
+		t.Fatalf("expired settings applied: %+v", loggingStatus())
+	}
+}
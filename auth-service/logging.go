@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"regexp"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ============================================================================
+// Structured Logging
+// ============================================================================
+//
+// All logs are JSON lines via slog (log.format text for local development).
+// A redacting handler scrubs passwords, secrets, bearer tokens, JWTs and
+// email addresses from messages and attributes before they are written.
+
+// logLevel is the minimum level logged, initialised from log.level
+var logLevel = new(slog.LevelVar)
+
+var (
+	emailPattern  = regexp.MustCompile(`([A-Za-z0-9._%+-])[A-Za-z0-9._%+-]*@([A-Za-z0-9.-]+\.[A-Za-z]{2,})`)
+	jwtPattern    = regexp.MustCompile(`eyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+`)
+	bearerPattern = regexp.MustCompile(`(?i)(bearer\s+)\S+`)
+	queryPattern  = regexp.MustCompile(`(?i)((?:token|password|secret|code|state|key)=)[^&\s]+`)
+)
+
+// sensitiveKeys are attribute keys whose values are never logged
+var sensitiveKeys = []string{"password", "secret", "token", "authorization", "api_key", "cookie"}
+
+// setupLogging installs the redacting slog handler as the default logger.
+// The standard log package is routed through it as well.
+func setupLogging() {
+	if err := logLevel.UnmarshalText([]byte(config.Log.Level)); err != nil {
+		logLevel.Set(slog.LevelInfo)
+	}
+
+	// The redacting handler applies logLevel so verbose modules can pass
+	opts := &slog.HandlerOptions{Level: slog.LevelDebug}
+	var handler slog.Handler = slog.NewJSONHandler(os.Stdout, opts)
+	if config.Log.Format == "text" {
+		handler = slog.NewTextHandler(os.Stdout, opts)
+	}
+	slog.SetDefault(slog.New(redactingHandler{handler}))
+}
+
+// fatal logs an error and exits, replacing log.Fatalf
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// redactString masks emails and removes tokens from free text
+func redactString(s string) string {
+	s = jwtPattern.ReplaceAllString(s, "[REDACTED_JWT]")
+	s = bearerPattern.ReplaceAllString(s, "${1}[REDACTED]")
+	s = queryPattern.ReplaceAllString(s, "${1}[REDACTED]")
+	return emailPattern.ReplaceAllString(s, "${1}***@${2}")
+}
+
+func isSensitiveKey(key string) bool {
+	key = strings.ToLower(key)
+	for _, sensitive := range sensitiveKeys {
+		if strings.Contains(key, sensitive) {
+			return true
+		}
+	}
+	return false
+}
+
+// redactingHandler scrubs records before passing them on
+type redactingHandler struct {
+	next slog.Handler
+}
+
+func (h redactingHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return (level >= logLevel.Level() || anyVerbose.Load()) && h.next.Enabled(ctx, level)
+}
+
+func (h redactingHandler) Handle(ctx context.Context, record slog.Record) error {
+	if record.Level < logLevel.Level() && !verboseRecord(record) {
+		return nil
+	}
+	scrubbed := slog.NewRecord(record.Time, record.Level, redactString(record.Message), record.PC)
+	record.Attrs(func(attr slog.Attr) bool {
+		scrubbed.AddAttrs(redactAttr(attr))
+		return true
+	})
+	return h.next.Handle(ctx, scrubbed)
+}
+
+func (h redactingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	scrubbed := make([]slog.Attr, len(attrs))
+	for i, attr := range attrs {
+		scrubbed[i] = redactAttr(attr)
+	}
+	return redactingHandler{h.next.WithAttrs(scrubbed)}
+}
+
+func (h redactingHandler) WithGroup(name string) slog.Handler {
+	return redactingHandler{h.next.WithGroup(name)}
+}
+
+// verboseRecord reports whether a record comes from a verbose module
+func verboseRecord(record slog.Record) bool {
+	verbose := false
+	record.Attrs(func(attr slog.Attr) bool {
+		if attr.Key == "module" {
+			verbose = verboseModule(attr.Value.String())
+			return false
+		}
+		return true
+	})
+	return verbose
+}
+
+// redactAttr scrubs one attribute, descending into groups
+func redactAttr(attr slog.Attr) slog.Attr {
+	if isSensitiveKey(attr.Key) {
+		return slog.String(attr.Key, "[REDACTED]")
+	}
+
+	value := attr.Value.Resolve()
+	switch value.Kind() {
+	case slog.KindString:
+		return slog.String(attr.Key, redactString(value.String()))
+	case slog.KindGroup:
+		group := value.Group()
+		scrubbed := make([]any, len(group))
+		for i, member := range group {
+			scrubbed[i] = redactAttr(member)
+		}
+		return slog.Group(attr.Key, scrubbed...)
+	case slog.KindAny:
+		if err, ok := value.Any().(error); ok {
+			return slog.String(attr.Key, redactString(err.Error()))
+		}
+	}
+	return slog.Attr{Key: attr.Key, Value: value}
+}
+
+// requestLogger replaces Gin's default logger with one structured line per
+// request, tagged with the request ID and the authenticated user
+func requestLogger() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		status := c.Writer.Status()
+		level := slog.LevelInfo
+		switch {
+		case status >= 500:
+			level = slog.LevelError
+		case status >= 400:
+			level = slog.LevelWarn
+		}
+
+		attrs := []slog.Attr{
+			slog.String("request_id", c.GetString(requestIDContextKey)),
+			slog.String("method", c.Request.Method),
+			slog.String("path", loggedPath(c)),
+			slog.String("query", c.Request.URL.RawQuery),
+			slog.String("route", c.FullPath()),
+			slog.Int("status", status),
+			slog.Int("bytes", c.Writer.Size()),
+			slog.Float64("latency_ms", float64(time.Since(start).Microseconds())/1000),
+			slog.String("client_ip", c.ClientIP()),
+			slog.String("user_agent", c.Request.UserAgent()),
+		}
+		if user, exists := c.Get("user"); exists {
+			attrs = append(attrs, slog.String("user_id", user.(*User).ID))
+		}
+		if len(c.Errors) > 0 {
+			attrs = append(attrs, slog.String("errors", c.Errors.String()))
+		}
+
+		slog.LogAttrs(c.Request.Context(), level, "request", attrs...)
+		reportServerError(c)
+	}
+}
+
+// loggedPath is the request path with secret route parameters, such as a
+// share link's token, masked
+func loggedPath(c *gin.Context) string {
+	path := c.Request.URL.Path
+	if token := c.Param("token"); token != "" {
+		path = strings.Replace(path, token, "[REDACTED]", 1)
+	}
+	return path
+}
+
+// requestIDKey carries the request ID on a request's context so calls to
+// other services can forward it
+type requestIDKey struct{}
+
+// contextRequestID returns the request ID stored on ctx, if any
+func contextRequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// forwardRequestID copies the request ID from an outbound request's context
+// onto its X-Request-ID header
+func forwardRequestID(req *http.Request) {
+	if id := contextRequestID(req.Context()); id != "" {
+		req.Header.Set(requestIDHeader, id)
+	}
+}
+
+// recoverPanics replaces gin.Recovery so panics are logged as structured
+// errors and answered with a problem response
+func recoverPanics() gin.HandlerFunc {
+	return gin.CustomRecoveryWithWriter(io.Discard, func(c *gin.Context, recovered any) {
+		stack := debug.Stack()
+		slog.Error("Panic recovered",
+			"request_id", c.GetString(requestIDContextKey),
+			"path", loggedPath(c),
+			"panic", fmt.Sprint(recovered),
+			"stack", string(stack))
+		reportPanic(c, recovered, stack)
+		respondError(c, http.StatusInternalServerError, codeInternal, "Internal server error")
+		c.Abort()
+	})
+}
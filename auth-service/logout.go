@@ -0,0 +1,155 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ============================================================================
+// Logout Everywhere
+// ============================================================================
+//
+// Access tokens are stateless JWTs, so a single token can't be revoked on
+// its own. POST /auth/logout-all instead records a cut-off on the user: any
+// token issued at or before that second, on any device, is refused from
+// then on, and remembered sessions signed in before it can't refresh
+// (remember.go). Tokens carry whole-second issue times, so tokens issued
+// after a cut-off also carry it in their rev claim; that tells a token
+// issued in the same second but after the logout from one issued before.
+//
+// Changing an account's role, email or status moves the cut-off as well
+// (adminusers.go), and tokens whose role or email claims no longer match
+// the account are refused, so stale claims can't be replayed after a
+// privilege change.
+//
+// The cut-off is stored with the user, so it survives restarts and reaches
+// other replicas through the usual user change feed, which also drops
+// their cached validations. Services that verify tokens themselves can poll
+// GET /internal/revocations?since=<RFC 3339> for the users whose cut-off
+// moved.
+
+var errTokenRevoked = errors.New("Token has been revoked")
+
+// Revocation is one user's cut-off, as listed to internal services
+type Revocation struct {
+	UserID        string    `json:"user_id"`
+	RevokedBefore time.Time `json:"revoked_before"` // tokens issued at or before this are refused
+}
+
+// tokenRevoked reports whether a token issued at issuedAt, after the
+// cut-off in its rev claim, predates the user's last cut-off, or was bound
+// to a device since removed (devices.go)
+func (s *Service) tokenRevoked(user *User, issuedAt, cutoff time.Time, deviceID string) bool {
+	lock := s.users.FieldLock(user)
+	lock.RLock()
+	revokedAt := user.TokensRevokedAt
+	knownDevice := deviceID == "" || slices.ContainsFunc(user.Devices, func(d Device) bool { return d.ID == deviceID })
+	lock.RUnlock()
+	if !knownDevice {
+		return true
+	}
+	return !revokedAt.IsZero() && !cutoff.Equal(revokedAt) && !issuedAt.After(revokedAt.Truncate(time.Second))
+}
+
+// claimsStale reports whether a token's email or role claim no longer
+// matches the user
+func (s *Service) claimsStale(user *User, claims map[string]any) bool {
+	email, _ := claims["email"].(string)
+	role, _ := claims["role"].(string)
+	lock := s.users.FieldLock(user)
+	lock.RLock()
+	defer lock.RUnlock()
+	return email != user.Email || role != user.Role
+}
+
+// revokedAt is the user's current cut-off
+func (s *Service) revokedAt(user *User) time.Time {
+	lock := s.users.FieldLock(user)
+	lock.RLock()
+	defer lock.RUnlock()
+	return user.TokensRevokedAt
+}
+
+// RevokeTokens refuses every token issued to the user so far
+func (s *Service) RevokeTokens(user *User) (time.Time, error) {
+	now := revocationTime()
+	lock := s.users.FieldLock(user)
+	lock.Lock()
+	previous := user.TokensRevokedAt
+	user.TokensRevokedAt = now
+	err := saveUser(user)
+	if err != nil {
+		user.TokensRevokedAt = previous
+	}
+	lock.Unlock()
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	forgetUserTokens(user.ID)
+	return now, nil
+}
+
+// revocationTime is a new cut-off, at the precision every store keeps
+func revocationTime() time.Time {
+	return time.Now().UTC().Truncate(time.Millisecond)
+}
+
+// Revocations lists the users whose cut-off is after since, oldest first
+func (s *Service) Revocations(since time.Time) []Revocation {
+	revocations := []Revocation{}
+	s.users.Each(func(user *User) {
+		lock := s.users.FieldLock(user)
+		lock.RLock()
+		// Other services only see whole-second issue times
+		revokedAt := user.TokensRevokedAt.Truncate(time.Second)
+		lock.RUnlock()
+		if !revokedAt.IsZero() && revokedAt.After(since) {
+			revocations = append(revocations, Revocation{UserID: user.ID, RevokedBefore: revokedAt})
+		}
+	})
+	sort.Slice(revocations, func(i, j int) bool {
+		return revocations[i].RevokedBefore.Before(revocations[j].RevokedBefore)
+	})
+	return revocations
+}
+
+// logoutAll revokes every token the caller holds, this one included
+func (s *Server) logoutAll(c *gin.Context) {
+	user := c.MustGet("user").(*User)
+	revokedAt, err := s.svc.RevokeTokens(user)
+	if err != nil {
+		respondServiceError(c, err)
+		return
+	}
+
+	event := httpSecurityEvent(c, EventTokenRevoked, "success")
+	event.UserID, event.Email = user.ID, user.Email
+	event.Reason = "logout_all"
+	emitSecurityEvent(event)
+	if cookieSessions() {
+		clearSessionCookies(c)
+		setRefreshCookie(c, "", time.Time{})
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Logged out everywhere", "revoked_before": revokedAt.Truncate(time.Second)})
+}
+
+// listRevocations returns the cut-offs set since a time (internal only)
+func (s *Server) listRevocations(c *gin.Context) {
+	var since time.Time
+	if raw := c.Query("since"); raw != "" {
+		parsed, err := time.Parse(time.RFC3339, raw)
+		if err != nil {
+			respondError(c, http.StatusBadRequest, codeInvalidRequest, "since must be an RFC 3339 time")
+			return
+		}
+		since = parsed
+	}
+	c.JSON(http.StatusOK, gin.H{"revocations": s.svc.Revocations(since)})
+}
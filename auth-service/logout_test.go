@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestLogoutAll(t *testing.T) {
+	ts := newTestServer(t)
+	withConfig(t, func(cfg *Config) { cfg.Auth.InternalAPIToken = testInternalToken })
+	first, userID := ts.register("a@example.com")
+	second := ts.login("a@example.com", "secret123", http.StatusOK)
+	other, _ := ts.register("b@example.com")
+	// Warm the validation cache so revocation has to get past it
+	ts.do(http.MethodGet, "/v1/auth/verify", first, "")
+
+	if w := ts.do(http.MethodPost, "/v1/auth/logout-all", second, ""); w.Code != http.StatusOK {
+		t.Fatalf("logout-all: %d %s", w.Code, w.Body)
+	}
+	for name, token := range map[string]string{"first": first, "second": second} {
+		if w := ts.do(http.MethodGet, "/v1/auth/verify", token, ""); w.Code != http.StatusUnauthorized {
+			t.Errorf("%s token after logout-all: got %d, want 401", name, w.Code)
+		}
+	}
+	if _, err := ts.srv.svc.Authenticate(first); err != errTokenRevoked {
+		t.Fatalf("Authenticate = %v, want errTokenRevoked", err)
+	}
+	if w := ts.do(http.MethodGet, "/v1/auth/verify", other, ""); w.Code != http.StatusOK {
+		t.Fatalf("another user's token: got %d, want 200", w.Code)
+	}
+
+	// Tokens issued after the cut-off second work
+	time.Sleep(time.Until(time.Now().Truncate(time.Second).Add(time.Second)))
+	fresh := ts.login("a@example.com", "secret123", http.StatusOK)
+	if w := ts.do(http.MethodGet, "/v1/auth/verify", fresh, ""); w.Code != http.StatusOK {
+		t.Fatalf("token issued after logout-all: got %d, want 200", w.Code)
+	}
+
+	var listed struct {
+		Revocations []Revocation `json:"revocations"`
+	}
+	w := ts.do(http.MethodGet, "/v1/internal/revocations", "", "", internalTokenHeader, testInternalToken)
+	decodeJSON(t, w, &listed)
+	if w.Code != http.StatusOK || len(listed.Revocations) != 1 || listed.Revocations[0].UserID != userID {
+		t.Fatalf("revocations: %d %s", w.Code, w.Body)
+	}
+	since := listed.Revocations[0].RevokedBefore.Format(time.RFC3339)
+	w = ts.do(http.MethodGet, "/v1/internal/revocations?since="+since, "", "", internalTokenHeader, testInternalToken)
+	decodeJSON(t, w, &listed)
+	if len(listed.Revocations) != 0 {
+		t.Fatalf("revocations since the cut-off: %s", w.Body)
+	}
+	if w := ts.do(http.MethodGet, "/v1/internal/revocations?since=yesterday", "", "", internalTokenHeader, testInternalToken); w.Code != http.StatusBadRequest {
+		t.Fatalf("bad since: got %d, want 400", w.Code)
+	}
+}
+
+func TestLogoutAllReachesReplica(t *testing.T) {
+	useSharedStore(t)
+	user, token := useTokenCache(t, time.Minute)
+	if _, err := authenticateToken(token); err != nil {
+		t.Fatal(err)
+	}
+
+	// Another replica's logout-all arrives as a changed user record, and
+	// the cached validation must not outlive it
+	record := sharedUserOf(user)
+	record.TokensRevokedAt = time.Now().UTC().Truncate(time.Second)
+	if err := clusterStore.saveUser(context.Background(), record); err != nil {
+		t.Fatal(err)
+	}
+	if err := refreshRecord(context.Background(), clusterChange{Kind: "user", ID: user.ID}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := authenticateToken(token); err != errTokenRevoked {
+		t.Fatalf("token after a replicated logout-all: %v, want errTokenRevoked", err)
+	}
+}
+
+func TestPrivilegeChangeRotatesTokens(t *testing.T) {
+	ts := newTestServer(t)
+	admin := ts.admin("admin@example.com")
+	first, userID := ts.register("a@example.com")
+	second := ts.login("a@example.com", "secret123", http.StatusOK)
+	ts.do(http.MethodGet, "/v1/auth/verify", first, "")
+
+	if w := ts.do(http.MethodPatch, "/v1/admin/users/"+userID, admin, `{"name":"Renamed"}`); w.Code != http.StatusOK {
+		t.Fatalf("rename: %d %s", w.Code, w.Body)
+	}
+	if w := ts.do(http.MethodGet, "/v1/auth/verify", first, ""); w.Code != http.StatusOK {
+		t.Fatalf("token after a rename: got %d, want 200", w.Code)
+	}
+
+	if w := ts.do(http.MethodPatch, "/v1/admin/users/"+userID, admin, `{"role":"admin"}`); w.Code != http.StatusOK {
+		t.Fatalf("promote: %d %s", w.Code, w.Body)
+	}
+	for name, token := range map[string]string{"first": first, "second": second} {
+		if w := ts.do(http.MethodGet, "/v1/auth/verify", token, ""); w.Code != http.StatusUnauthorized {
+			t.Errorf("%s token after promotion: got %d, want 401", name, w.Code)
+		}
+	}
+	// Signing straight back in works, within the same second
+	fresh := ts.login("a@example.com", "secret123", http.StatusOK)
+	if w := ts.do(http.MethodGet, "/v1/auth/verify", fresh, ""); w.Code != http.StatusOK {
+		t.Fatalf("token issued after promotion: got %d, want 200", w.Code)
+	}
+
+	// An admin changing their own email gets a new token in place of theirs
+	adminID := ts.srv.svc.users.ByEmail("admin@example.com").ID
+	w := ts.do(http.MethodPatch, "/v1/admin/users/"+adminID, admin, `{"email":"root@example.com"}`)
+	var updated struct {
+		Token string `json:"token"`
+	}
+	decodeJSON(t, w, &updated)
+	if w.Code != http.StatusOK || updated.Token == "" {
+		t.Fatalf("own email: %d %s", w.Code, w.Body)
+	}
+	if w := ts.do(http.MethodGet, "/v1/auth/verify", admin, ""); w.Code != http.StatusUnauthorized {
+		t.Fatalf("old admin token: got %d, want 401", w.Code)
+	}
+	if w := ts.do(http.MethodGet, "/v1/auth/verify", updated.Token, ""); w.Code != http.StatusOK {
+		t.Fatalf("reissued admin token: got %d, want 200", w.Code)
+	}
+}
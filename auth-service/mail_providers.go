@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"strings"
+	"time"
+)
+
+// ============================================================================
+// Mail Providers
+// ============================================================================
+//
+// Implementations of Mailer, one per mail.provider. The HTTP providers treat
+// 429 and 5xx answers as temporary and other 4xx answers as permanent; SMTP
+// does the same with 4yz and 5yz replies.
+
+var mailClient = &http.Client{Timeout: mailSendTimeout}
+
+// mailHTTPError classifies a failed API response
+func mailHTTPError(provider string, resp *http.Response) error {
+	detail, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	err := fmt.Errorf("%s returned %s: %s", provider, resp.Status, bytes.TrimSpace(detail))
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500 {
+		return err
+	}
+	return permanentMailError{err}
+}
+
+// ----------------------------------------------------------------------------
+// Log (development)
+// ----------------------------------------------------------------------------
+
+// logMailer writes messages to the log instead of sending them
+type logMailer struct{}
+
+func (logMailer) Send(ctx context.Context, msg Email) error {
+	slog.Info("Email not sent; mail.provider is log", "to", msg.To, "subject", msg.Subject, "body", msg.Text)
+	return nil
+}
+
+// ----------------------------------------------------------------------------
+// SMTP
+// ----------------------------------------------------------------------------
+
+const (
+	smtpTLSStartTLS = "starttls" // upgrade a plain connection (port 587)
+	smtpTLSImplicit = "tls"      // TLS from the first byte (port 465)
+	smtpTLSNone     = "none"     // local relays only
+)
+
+type smtpMailer struct {
+	host, port         string
+	username, password string
+	tlsMode            string
+	from               string
+	fromName           string
+}
+
+func newSMTPMailer(cfg MailConfig) (*smtpMailer, error) {
+	if cfg.SMTPHost == "" {
+		return nil, errors.New("smtp_host is required for the smtp provider")
+	}
+	switch cfg.SMTPTLS {
+	case smtpTLSStartTLS, smtpTLSImplicit, smtpTLSNone:
+	default:
+		return nil, errors.New("smtp_tls must be starttls, tls or none")
+	}
+	return &smtpMailer{
+		host:     cfg.SMTPHost,
+		port:     cfg.SMTPPort,
+		username: cfg.SMTPUsername,
+		password: cfg.SMTPPassword,
+		tlsMode:  cfg.SMTPTLS,
+		from:     cfg.From,
+		fromName: cfg.FromName,
+	}, nil
+}
+
+func (m *smtpMailer) Send(ctx context.Context, msg Email) error {
+	addr := net.JoinHostPort(m.host, m.port)
+	dialer := &net.Dialer{}
+	var conn net.Conn
+	var err error
+	if m.tlsMode == smtpTLSImplicit {
+		conn, err = (&tls.Dialer{NetDialer: dialer, Config: &tls.Config{ServerName: m.host}}).DialContext(ctx, "tcp", addr)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	client, err := smtp.NewClient(conn, m.host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	if m.tlsMode == smtpTLSStartTLS {
+		if err := client.StartTLS(&tls.Config{ServerName: m.host}); err != nil {
+			return smtpError(err)
+		}
+	}
+	if m.username != "" {
+		if err := client.Auth(smtp.PlainAuth("", m.username, m.password, m.host)); err != nil {
+			return smtpError(err)
+		}
+	}
+	if err := client.Mail(m.from); err != nil {
+		return smtpError(err)
+	}
+	if err := client.Rcpt(msg.To); err != nil {
+		return smtpError(err)
+	}
+	w, err := client.Data()
+	if err != nil {
+		return smtpError(err)
+	}
+	if _, err := w.Write(buildMIMEMessage(m.from, m.fromName, msg, time.Now())); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return smtpError(err)
+	}
+	return client.Quit()
+}
+
+// smtpError marks 5yz replies as permanent
+func smtpError(err error) error {
+	var reply *textproto.Error
+	if errors.As(err, &reply) && reply.Code >= 500 {
+		return permanentMailError{err}
+	}
+	return err
+}
+
+// buildMIMEMessage formats a multipart/alternative message with text and
+// HTML parts, both quoted-printable
+func buildMIMEMessage(from, fromName string, msg Email, now time.Time) []byte {
+	var boundary, messageID [12]byte
+	rand.Read(boundary[:])
+	rand.Read(messageID[:])
+	domain := "localhost"
+	if at := strings.LastIndex(from, "@"); at >= 0 {
+		domain = from[at+1:]
+	}
+
+	var b bytes.Buffer
+	header := func(name, value string) {
+		b.WriteString(name + ": " + value + "\r\n")
+	}
+	header("From", (&mail.Address{Name: fromName, Address: from}).String())
+	header("To", (&mail.Address{Address: msg.To}).String())
+	header("Subject", mime.QEncoding.Encode("utf-8", msg.Subject))
+	header("Date", now.Format(time.RFC1123Z))
+	header("Message-ID", "<"+hex.EncodeToString(messageID[:])+"@"+domain+">")
+	header("MIME-Version", "1.0")
+	header("Content-Type", `multipart/alternative; boundary="`+hex.EncodeToString(boundary[:])+`"`)
+	b.WriteString("\r\n")
+
+	for _, part := range []struct{ contentType, body string }{
+		{"text/plain; charset=utf-8", msg.Text},
+		{"text/html; charset=utf-8", msg.HTML},
+	} {
+		b.WriteString("--" + hex.EncodeToString(boundary[:]) + "\r\n")
+		header("Content-Type", part.contentType)
+		header("Content-Transfer-Encoding", "quoted-printable")
+		b.WriteString("\r\n")
+		qp := quotedprintable.NewWriter(&b)
+		qp.Write([]byte(part.body))
+		qp.Close()
+		b.WriteString("\r\n")
+	}
+	b.WriteString("--" + hex.EncodeToString(boundary[:]) + "--\r\n")
+	return b.Bytes()
+}
+
+// ----------------------------------------------------------------------------
+// Amazon SES
+// ----------------------------------------------------------------------------
+
+type sesMailer struct {
+	region                             string
+	accessKey, secretKey, sessionToken string
+	from                               string
+	endpoint                           string
+}
+
+func newSESMailer(cfg MailConfig) (*sesMailer, error) {
+	if cfg.SESRegion == "" {
+		return nil, errors.New("ses_region is required for the ses provider")
+	}
+	// Standard AWS credential variables, as for the aws secrets provider
+	m := &sesMailer{
+		region:       cfg.SESRegion,
+		accessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		from:         (&mail.Address{Name: cfg.FromName, Address: cfg.From}).String(),
+		endpoint:     "https://email." + cfg.SESRegion + ".amazonaws.com/v2/email/outbound-emails",
+	}
+	if m.accessKey == "" || m.secretKey == "" {
+		return nil, errors.New("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY are required for the ses provider")
+	}
+	return m, nil
+}
+
+func (m *sesMailer) Send(ctx context.Context, msg Email) error {
+	content := func(data string) map[string]string { return map[string]string{"Data": data, "Charset": "UTF-8"} }
+	body, err := json.Marshal(map[string]any{
+		"FromEmailAddress": m.from,
+		"Destination":      map[string]any{"ToAddresses": []string{msg.To}},
+		"Content": map[string]any{"Simple": map[string]any{
+			"Subject": content(msg.Subject),
+			"Body":    map[string]any{"Text": content(msg.Text), "Html": content(msg.HTML)},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, m.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	bodyHash := sha256.Sum256(body)
+	signAWSRequest(req, "ses", m.region, m.accessKey, m.secretKey, m.sessionToken,
+		hex.EncodeToString(bodyHash[:]), time.Now().UTC())
+
+	resp, err := mailClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return mailHTTPError("SES", resp)
+	}
+	return nil
+}
+
+// ----------------------------------------------------------------------------
+// SendGrid
+// ----------------------------------------------------------------------------
+
+const sendGridEndpoint = "https://api.sendgrid.com/v3/mail/send"
+
+type sendGridMailer struct {
+	apiKey         string
+	from, fromName string
+	endpoint       string
+}
+
+func (m *sendGridMailer) Send(ctx context.Context, msg Email) error {
+	body, err := json.Marshal(map[string]any{
+		"personalizations": []any{map[string]any{"to": []any{map[string]string{"email": msg.To}}}},
+		"from":             map[string]string{"email": m.from, "name": m.fromName},
+		"subject":          msg.Subject,
+		"content": []any{
+			map[string]string{"type": "text/plain", "value": msg.Text},
+			map[string]string{"type": "text/html", "value": msg.HTML},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, m.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+m.apiKey)
+
+	resp, err := mailClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return mailHTTPError("SendGrid", resp)
+	}
+	return nil
+}
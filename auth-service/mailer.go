@@ -0,0 +1,391 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"log/slog"
+	"math"
+	"strings"
+	"sync/atomic"
+	texttemplate "text/template"
+	"time"
+)
+
+// ============================================================================
+// Email Delivery
+// ============================================================================
+//
+// Outgoing mail goes through a Mailer chosen by mail.provider: smtp, ses
+// (the SES v2 API), sendgrid, or log, the default, which writes each message
+// to the log instead of sending it. Flows call queueEmail with a template
+// name and its data; background senders render the message and deliver it,
+// retrying temporary failures with exponential backoff up to
+// mail.max_attempts. Like SIEM export, a full queue drops mail rather than
+// slowing the request that sent it.
+
+const (
+	mailProviderLog      = "log"
+	mailProviderSMTP     = "smtp"
+	mailProviderSES      = "ses"
+	mailProviderSendGrid = "sendgrid"
+
+	mailQueueSize   = 1024
+	mailSenders     = 2
+	mailBackoffBase = time.Second
+	mailBackoffMax  = 2 * time.Minute
+	mailSendTimeout = 30 * time.Second
+)
+
+// Email templates
+const (
+	EmailVerification   = "verification"
+	EmailPasswordReset  = "password_reset"
+	EmailInvitation     = "invitation"
+	EmailLoginAlert     = "login_alert"
+	EmailSignupApproved = "signup_approved"
+	EmailSignupDenied   = "signup_denied"
+	EmailSavedQuery     = "saved_query"
+)
+
+// Email is one rendered message
+type Email struct {
+	To      string
+	Subject string
+	Text    string
+	HTML    string
+}
+
+// Mailer delivers rendered messages
+type Mailer interface {
+	Send(ctx context.Context, msg Email) error
+}
+
+// permanentMailError wraps a failure that retrying won't fix, such as a
+// rejected address or bad credentials
+type permanentMailError struct{ err error }
+
+func (e permanentMailError) Error() string { return e.err.Error() }
+func (e permanentMailError) Unwrap() error { return e.err }
+
+// queuedEmail is a message waiting to be rendered and sent
+type queuedEmail struct {
+	to       string
+	template string
+	lang     string
+	data     map[string]any
+}
+
+var (
+	mailQueue   = make(chan queuedEmail, mailQueueSize)
+	mailReady   atomic.Bool
+	droppedMail atomic.Uint64
+	sentMail    atomic.Uint64
+	failedMail  atomic.Uint64
+)
+
+// newMailer builds the configured provider
+func newMailer(cfg MailConfig) (Mailer, error) {
+	switch cfg.Provider {
+	case mailProviderLog:
+		return logMailer{}, nil
+	case mailProviderSMTP:
+		return newSMTPMailer(cfg)
+	case mailProviderSES:
+		return newSESMailer(cfg)
+	case mailProviderSendGrid:
+		if cfg.SendGridAPIKey == "" {
+			return nil, errors.New("sendgrid_api_key is required for the sendgrid provider")
+		}
+		return &sendGridMailer{apiKey: cfg.SendGridAPIKey, from: cfg.From, fromName: cfg.FromName, endpoint: sendGridEndpoint}, nil
+	}
+	return nil, fmt.Errorf("unknown mail provider %q", cfg.Provider)
+}
+
+// startMailer starts the background senders
+func startMailer() {
+	mailer, err := newMailer(config.Mail)
+	if err != nil {
+		fatal("Invalid mail configuration", "error", err)
+	}
+	mailReady.Store(true)
+	slog.Info("Email delivery enabled", "provider", config.Mail.Provider)
+
+	for i := 0; i < mailSenders; i++ {
+		goBackground(func(ctx context.Context) {
+			for {
+				select {
+				case queued := <-mailQueue:
+					deliverEmail(ctx, mailer, queued, config.Mail.MaxAttempts)
+				case <-ctx.Done():
+					// One attempt each for what is already queued
+					for {
+						select {
+						case queued := <-mailQueue:
+							deliverEmail(context.Background(), mailer, queued, 1)
+						default:
+							return
+						}
+					}
+				}
+			}
+		})
+	}
+}
+
+// queueEmail queues a template for delivery without blocking; it is
+// rendered in lang, if translated, when a sender picks it up
+func queueEmail(to, template, lang string, data map[string]any) {
+	if !mailReady.Load() {
+		return
+	}
+	select {
+	case mailQueue <- queuedEmail{to: to, template: template, lang: lang, data: data}:
+	default:
+		if droppedMail.Add(1)%100 == 1 {
+			slog.Warn("Email queue full", "dropped_total", droppedMail.Load())
+		}
+	}
+}
+
+// deliverEmail renders and sends one message, retrying temporary failures
+// until maxAttempts or ctx ends
+func deliverEmail(ctx context.Context, mailer Mailer, queued queuedEmail, maxAttempts int) {
+	msg, err := renderEmail(queued.template, queued.lang, queued.to, queued.data)
+	if err != nil {
+		failedMail.Add(1)
+		slog.Error("Email template failed", "template", queued.template, "error", err)
+		return
+	}
+
+	for attempt := 1; ; attempt++ {
+		sendCtx, cancel := context.WithTimeout(ctx, mailSendTimeout)
+		err = mailer.Send(sendCtx, msg)
+		cancel()
+		if err == nil {
+			sentMail.Add(1)
+			debugLog("mail", "Email sent", "template", queued.template, "attempt", attempt)
+			return
+		}
+
+		var permanent permanentMailError
+		if errors.As(err, &permanent) || attempt >= maxAttempts {
+			failedMail.Add(1)
+			slog.Warn("Email delivery failed", "template", queued.template, "attempts", attempt, "error", err)
+			return
+		}
+		delay := mailBackoff(attempt)
+		debugLog("mail", "Email delivery failed; retrying", "template", queued.template, "attempt", attempt, "retry_in", delay, "error", err)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			failedMail.Add(1)
+			slog.Warn("Email delivery abandoned at shutdown", "template", queued.template, "attempts", attempt, "error", err)
+			return
+		}
+	}
+}
+
+// mailBackoff returns the delay before the given retry attempt
+func mailBackoff(attempt int) time.Duration {
+	delay := time.Duration(float64(mailBackoffBase) * math.Pow(2, float64(attempt-1)))
+	if delay > mailBackoffMax {
+		return mailBackoffMax
+	}
+	return delay
+}
+
+// ----------------------------------------------------------------------------
+// Templates
+// ----------------------------------------------------------------------------
+//
+// Each template has a subject, a plain-text body and an HTML body. Besides
+// the caller's data, every template can use .AppName and .BaseURL. A
+// missing key is an error rather than an empty string, so a flow that
+// forgets a link fails loudly in its tests instead of in a user's inbox.
+
+type emailTemplate struct {
+	subject *texttemplate.Template
+	text    *texttemplate.Template
+	html    *htmltemplate.Template
+}
+
+func newEmailTemplate(name, subject, text, html string) emailTemplate {
+	tmpl, err := parseEmailTemplate(name, subject, text, html)
+	if err != nil {
+		panic(err)
+	}
+	return tmpl
+}
+
+// parseEmailTemplate compiles the three parts of a template; translations
+// from a catalog go through here so a bad one fails at startup
+func parseEmailTemplate(name, subject, text, html string) (emailTemplate, error) {
+	var tmpl emailTemplate
+	var err error
+	if tmpl.subject, err = texttemplate.New(name + ".subject").Option("missingkey=error").Parse(subject); err != nil {
+		return tmpl, err
+	}
+	if tmpl.text, err = texttemplate.New(name + ".text").Option("missingkey=error").Parse(text); err != nil {
+		return tmpl, err
+	}
+	tmpl.html, err = htmltemplate.New(name + ".html").Option("missingkey=error").Parse(emailLayoutStart + html + emailLayoutEnd)
+	return tmpl, err
+}
+
+const (
+	emailLayoutStart = `<!DOCTYPE html><html><body style="font-family:sans-serif;line-height:1.5;color:#222">`
+	emailLayoutEnd   = `<p style="color:#888;font-size:12px">{{.AppName}}</p></body></html>`
+)
+
+var emailTemplates = map[string]emailTemplate{
+	EmailVerification: newEmailTemplate(EmailVerification,
+		`Verify your {{.AppName}} email address`,
+		`Hi {{.Name}},
+
+Confirm your email address by opening this link:
+
+{{.Link}}
+
+The link expires in {{.ExpiresIn}}. If you didn't create an account, ignore this email.
+`,
+		`<p>Hi {{.Name}},</p>
+<p>Confirm your email address:</p>
+<p><a href="{{.Link}}">Verify email address</a></p>
+<p>The link expires in {{.ExpiresIn}}. If you didn't create an account, ignore this email.</p>`),
+
+	EmailPasswordReset: newEmailTemplate(EmailPasswordReset,
+		`Reset your {{.AppName}} password`,
+		`Hi {{.Name}},
+
+Someone asked to reset your password. To choose a new one, open this link:
+
+{{.Link}}
+
+The link expires in {{.ExpiresIn}}. If it wasn't you, ignore this email; your password stays the same.
+`,
+		`<p>Hi {{.Name}},</p>
+<p>Someone asked to reset your password.</p>
+<p><a href="{{.Link}}">Choose a new password</a></p>
+<p>The link expires in {{.ExpiresIn}}. If it wasn't you, ignore this email; your password stays the same.</p>`),
+
+	EmailInvitation: newEmailTemplate(EmailInvitation,
+		`{{.InviterName}} invited you to {{.AppName}}`,
+		`Hi,
+
+{{.InviterName}} invited you to {{.AppName}}. Accept the invitation and set your password here:
+
+{{.Link}}
+
+The invitation expires in {{.ExpiresIn}}.
+`,
+		`<p>Hi,</p>
+<p>{{.InviterName}} invited you to {{.AppName}}.</p>
+<p><a href="{{.Link}}">Accept the invitation</a></p>
+<p>The invitation expires in {{.ExpiresIn}}.</p>`),
+
+	EmailLoginAlert: newEmailTemplate(EmailLoginAlert,
+		`New sign-in to your {{.AppName}} account`,
+		`Hi {{.Name}},
+
+We noticed an unusual sign-in to your account:
+
+  Time:     {{.Time}}
+  Address:  {{.IP}}
+  Location: {{.Location}}
+  Device:   {{.Device}}
+
+{{if .Held}}The sign-in was held until an administrator reviews it.{{else}}If this was you, there's nothing to do.{{end}} If it wasn't, change your password and review your recent activity at {{.BaseURL}}.
+`,
+		`<p>Hi {{.Name}},</p>
+<p>We noticed an unusual sign-in to your account:</p>
+<table>
+<tr><td>Time</td><td>{{.Time}}</td></tr>
+<tr><td>Address</td><td>{{.IP}}</td></tr>
+<tr><td>Location</td><td>{{.Location}}</td></tr>
+<tr><td>Device</td><td>{{.Device}}</td></tr>
+</table>
+<p>{{if .Held}}The sign-in was held until an administrator reviews it.{{else}}If this was you, there's nothing to do.{{end}}
+If it wasn't, change your password and <a href="{{.BaseURL}}">review your recent activity</a>.</p>`),
+
+	EmailSignupApproved: newEmailTemplate(EmailSignupApproved,
+		`Your {{.AppName}} account is ready`,
+		`Hi {{.Name}},
+
+An administrator approved your registration. You can sign in at {{.BaseURL}} with the email address and password you chose.
+`,
+		`<p>Hi {{.Name}},</p>
+<p>An administrator approved your registration.</p>
+<p><a href="{{.BaseURL}}">Sign in</a> with the email address and password you chose.</p>`),
+
+	EmailSignupDenied: newEmailTemplate(EmailSignupDenied,
+		`Your {{.AppName}} registration`,
+		`Hi {{.Name}},
+
+An administrator reviewed your registration and did not approve it.{{if .Reason}}
+
+Reason: {{.Reason}}{{end}}
+
+Your details have been deleted. If you think this is a mistake, contact your administrator.
+`,
+		`<p>Hi {{.Name}},</p>
+<p>An administrator reviewed your registration and did not approve it.</p>
+{{if .Reason}}<p>Reason: {{.Reason}}</p>{{end}}
+<p>Your details have been deleted. If you think this is a mistake, contact your administrator.</p>`),
+
+	EmailSavedQuery: newEmailTemplate(EmailSavedQuery,
+		`{{.QueryName}}: your scheduled answer`,
+		`Hi {{.Name}},
+
+Here is today's answer to your saved query "{{.QueryName}}".
+
+Question: {{.Question}}
+
+{{.Answer}}
+{{if .Sources}}
+Sources: {{.Sources}}
+{{end}}
+Change or stop this query at {{.BaseURL}}.
+`,
+		`<p>Hi {{.Name}},</p>
+<p>Here is today's answer to your saved query <strong>{{.QueryName}}</strong>.</p>
+<p><em>{{.Question}}</em></p>
+<p>{{.Answer}}</p>
+{{if .Sources}}<p>Sources: {{.Sources}}</p>{{end}}
+<p><a href="{{.BaseURL}}">Change or stop this query</a>.</p>`),
+}
+
+// renderEmail fills in a template for one recipient, in lang when the
+// catalog translates it and in English otherwise
+func renderEmail(name, lang, to string, data map[string]any) (Email, error) {
+	tmpl, exists := localizedEmails[lang][name]
+	if !exists {
+		tmpl, exists = emailTemplates[name]
+	}
+	if !exists {
+		return Email{}, fmt.Errorf("unknown email template %q", name)
+	}
+	values := map[string]any{"AppName": config.Mail.FromName, "BaseURL": config.Mail.BaseURL}
+	for key, value := range data {
+		values[key] = value
+	}
+
+	var subject, text, html bytes.Buffer
+	if err := tmpl.subject.Execute(&subject, values); err != nil {
+		return Email{}, err
+	}
+	if err := tmpl.text.Execute(&text, values); err != nil {
+		return Email{}, err
+	}
+	if err := tmpl.html.Execute(&html, values); err != nil {
+		return Email{}, err
+	}
+	return Email{
+		To:      to,
+		Subject: strings.Join(strings.Fields(subject.String()), " "), // one line, whatever the data held
+		Text:    text.String(),
+		HTML:    html.String(),
+	}, nil
+}
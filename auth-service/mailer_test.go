@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var sampleEmailData = map[string]map[string]any{
+	EmailVerification:  {"Name": "Ana", "Link": "https://app.example.com/verify?token=abc", "ExpiresIn": "24 hours"},
+	EmailPasswordReset: {"Name": "Ana", "Link": "https://app.example.com/reset?token=abc", "ExpiresIn": "1 hour"},
+	EmailInvitation:    {"InviterName": "Admin", "Link": "https://app.example.com/invite?token=abc", "ExpiresIn": "7 days"},
+	EmailLoginAlert: {"Name": "Ana", "Time": "Mon, 02 Jan 2006 15:04:05 UTC", "IP": "203.0.113.9",
+		"Location": "ES", "Device": "Firefox", "Held": true},
+	EmailSignupApproved: {"Name": "Ana"},
+	EmailSignupDenied:   {"Name": "Ana", "Reason": "Unknown organization"},
+	EmailSavedQuery: {"Name": "Ana", "QueryName": "HR policies", "Question": "Summarize new HR policies",
+		"Answer": "Parental leave rises to 20 weeks.", "Sources": "handbook.pdf"},
+}
+
+func TestRenderEmailTemplates(t *testing.T) {
+	for name := range emailTemplates {
+		data, ok := sampleEmailData[name]
+		if !ok {
+			t.Errorf("no sample data for template %s", name)
+			continue
+		}
+		msg, err := renderEmail(name, "en", "ana@example.com", data)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if msg.To != "ana@example.com" || msg.Subject == "" || msg.Text == "" || !strings.Contains(msg.HTML, config.Mail.FromName) {
+			t.Errorf("%s rendered as %+v", name, msg)
+		}
+		if link, ok := data["Link"].(string); ok && !strings.Contains(msg.Text, link) {
+			t.Errorf("%s: text body lacks the link", name)
+		}
+	}
+}
+
+func TestRenderEmailEscapesAndChecksData(t *testing.T) {
+	msg, err := renderEmail(EmailInvitation, "en", "a@example.com", map[string]any{
+		"InviterName": "<b>Eve</b>\r\nBcc: victim@example.com", "Link": "https://x", "ExpiresIn": "1 day",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(msg.HTML, "<b>Eve</b>") {
+		t.Error("HTML body not escaped")
+	}
+	if strings.ContainsAny(msg.Subject, "\r\n") {
+		t.Errorf("subject spans lines: %q", msg.Subject)
+	}
+
+	if _, err := renderEmail(EmailVerification, "en", "a@example.com", map[string]any{"Name": "Ana"}); err == nil {
+		t.Error("missing template data accepted")
+	}
+	if _, err := renderEmail("no-such-template", "en", "a@example.com", nil); err == nil {
+		t.Error("unknown template accepted")
+	}
+}
+
+// scriptedMailer fails with the queued errors, then succeeds
+type scriptedMailer struct {
+	mu       sync.Mutex
+	errs     []error
+	attempts int
+	sent     []Email
+}
+
+func (m *scriptedMailer) Send(ctx context.Context, msg Email) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.attempts++
+	if len(m.errs) > 0 {
+		err := m.errs[0]
+		m.errs = m.errs[1:]
+		return err
+	}
+	m.sent = append(m.sent, msg)
+	return nil
+}
+
+func TestDeliverEmailRetries(t *testing.T) {
+	queued := queuedEmail{to: "a@example.com", template: EmailVerification, data: sampleEmailData[EmailVerification]}
+
+	temporary := &scriptedMailer{errs: []error{errors.New("connection reset")}}
+	deliverEmail(context.Background(), temporary, queued, 3)
+	if temporary.attempts != 2 || len(temporary.sent) != 1 {
+		t.Fatalf("temporary failure: %d attempts, %d sent; want 2 and 1", temporary.attempts, len(temporary.sent))
+	}
+
+	permanent := &scriptedMailer{errs: []error{permanentMailError{errors.New("mailbox unavailable")}}}
+	deliverEmail(context.Background(), permanent, queued, 3)
+	if permanent.attempts != 1 || len(permanent.sent) != 0 {
+		t.Fatalf("permanent failure: %d attempts; want 1 and no retry", permanent.attempts)
+	}
+
+	exhausted := &scriptedMailer{errs: []error{errors.New("timeout")}}
+	deliverEmail(context.Background(), exhausted, queued, 1)
+	if exhausted.attempts != 1 || len(exhausted.sent) != 0 {
+		t.Fatalf("max_attempts 1: %d attempts", exhausted.attempts)
+	}
+
+	// Shutdown stops the backoff wait
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	stopped := &scriptedMailer{errs: []error{errors.New("timeout")}}
+	deliverEmail(ctx, stopped, queued, 5)
+	if stopped.attempts != 1 {
+		t.Fatalf("after shutdown: %d attempts, want 1", stopped.attempts)
+	}
+}
+
+func TestMailBackoff(t *testing.T) {
+	if mailBackoff(1) != mailBackoffBase || mailBackoff(2) != 2*mailBackoffBase {
+		t.Fatalf("backoff starts %s, %s", mailBackoff(1), mailBackoff(2))
+	}
+	if mailBackoff(30) != mailBackoffMax {
+		t.Fatalf("backoff not capped: %s", mailBackoff(30))
+	}
+}
+
+func TestSendGridMailer(t *testing.T) {
+	status := http.StatusAccepted
+	var got struct {
+		Subject          string `json:"subject"`
+		Personalizations []struct {
+			To []struct{ Email string } `json:"to"`
+		} `json:"personalizations"`
+		Content []struct{ Type, Value string } `json:"content"`
+	}
+	var auth string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("Authorization")
+		json.NewDecoder(r.Body).Decode(&got)
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+
+	m := &sendGridMailer{apiKey: "SG.key", from: "no-reply@example.com", fromName: "USF RAG", endpoint: srv.URL}
+	msg := Email{To: "a@example.com", Subject: "Hello", Text: "text", HTML: "<p>html</p>"}
+	if err := m.Send(context.Background(), msg); err != nil {
+		t.Fatal(err)
+	}
+	if auth != "Bearer SG.key" || got.Subject != "Hello" || got.Personalizations[0].To[0].Email != "a@example.com" || len(got.Content) != 2 {
+		t.Fatalf("request: auth %q, body %+v", auth, got)
+	}
+
+	var permanent permanentMailError
+	status = http.StatusBadRequest
+	if err := m.Send(context.Background(), msg); !errors.As(err, &permanent) {
+		t.Errorf("400: got %v, want a permanent error", err)
+	}
+	status = http.StatusServiceUnavailable
+	if err := m.Send(context.Background(), msg); err == nil || errors.As(err, &permanent) {
+		t.Errorf("503: got %v, want a temporary error", err)
+	}
+}
+
+func TestSESMailer(t *testing.T) {
+	var auth string
+	var got struct {
+		FromEmailAddress string
+		Destination      struct{ ToAddresses []string }
+		Content          struct {
+			Simple struct {
+				Subject struct{ Data string }
+			}
+		}
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("Authorization")
+		json.NewDecoder(r.Body).Decode(&got)
+		io.WriteString(w, `{"MessageId":"m-1"}`)
+	}))
+	defer srv.Close()
+
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIDEXAMPLE")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	cfg := config.Mail
+	cfg.Provider, cfg.SESRegion, cfg.From = mailProviderSES, "eu-west-1", "no-reply@example.com"
+	m, err := newSESMailer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.endpoint = srv.URL + "/v2/email/outbound-emails"
+
+	if err := m.Send(context.Background(), Email{To: "a@example.com", Subject: "Hello", Text: "t", HTML: "h"}); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/") || !strings.Contains(auth, "/eu-west-1/ses/aws4_request") {
+		t.Fatalf("Authorization = %q", auth)
+	}
+	if got.Destination.ToAddresses[0] != "a@example.com" || got.Content.Simple.Subject.Data != "Hello" ||
+		!strings.Contains(got.FromEmailAddress, "no-reply@example.com") {
+		t.Fatalf("request body = %+v", got)
+	}
+}
+
+func TestBuildMIMEMessage(t *testing.T) {
+	raw := buildMIMEMessage("no-reply@example.com", "USF RAG", Email{
+		To: "a@example.com", Subject: "Café sign-in", Text: "plain body", HTML: "<p>html body</p>",
+	}, time.Now())
+
+	msg, err := mail.ReadMessage(strings.NewReader(string(raw)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	subject, _ := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+	if subject != "Café sign-in" || !strings.Contains(msg.Header.Get("From"), "USF RAG") {
+		t.Fatalf("headers = %v", msg.Header)
+	}
+	mediaType, params, _ := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if mediaType != "multipart/alternative" {
+		t.Fatalf("Content-Type = %s", mediaType)
+	}
+	reader := multipart.NewReader(msg.Body, params["boundary"])
+	var bodies []string
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(part)
+		bodies = append(bodies, string(body))
+	}
+	if len(bodies) != 2 || bodies[0] != "plain body" || bodies[1] != "<p>html body</p>" {
+		t.Fatalf("parts = %q", bodies)
+	}
+}
+
+// fakeSMTPServer accepts one plaintext SMTP session and records the message
+func fakeSMTPServer(t *testing.T, rcptReply string) (addr string, received chan string) {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { lis.Close() })
+	received = make(chan string, 1)
+
+	go func() {
+		conn, err := lis.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		text := textproto.NewConn(conn)
+		text.PrintfLine("220 fake ESMTP")
+		for {
+			line, err := text.ReadLine()
+			if err != nil {
+				return
+			}
+			switch verb := strings.ToUpper(strings.SplitN(line, " ", 2)[0]); verb {
+			case "EHLO", "HELO":
+				text.PrintfLine("250 fake")
+			case "MAIL":
+				text.PrintfLine("250 OK")
+			case "RCPT":
+				text.PrintfLine(rcptReply)
+			case "DATA":
+				text.PrintfLine("354 go ahead")
+				body, _ := text.ReadDotBytes()
+				received <- string(body)
+				text.PrintfLine("250 queued")
+			case "QUIT":
+				text.PrintfLine("221 bye")
+				return
+			default:
+				text.PrintfLine("502 not implemented")
+			}
+		}
+	}()
+	return lis.Addr().String(), received
+}
+
+func TestSMTPMailer(t *testing.T) {
+	addr, received := fakeSMTPServer(t, "250 OK")
+	host, port, _ := net.SplitHostPort(addr)
+	cfg := config.Mail
+	cfg.SMTPHost, cfg.SMTPPort, cfg.SMTPTLS, cfg.From = host, port, smtpTLSNone, "no-reply@example.com"
+	m, err := newSMTPMailer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := m.Send(ctx, Email{To: "a@example.com", Subject: "Hello", Text: "plain", HTML: "<p>html</p>"}); err != nil {
+		t.Fatal(err)
+	}
+	msg, err := mail.ReadMessage(bufio.NewReader(strings.NewReader(<-received)))
+	if err != nil || msg.Header.Get("Subject") != "Hello" {
+		t.Fatalf("received %v, %v", msg, err)
+	}
+
+	// A rejected recipient is not worth retrying
+	addr, _ = fakeSMTPServer(t, "550 no such user")
+	cfg.SMTPHost, cfg.SMTPPort, _ = net.SplitHostPort(addr)
+	m, _ = newSMTPMailer(cfg)
+	var permanent permanentMailError
+	if err := m.Send(ctx, Email{To: "nobody@example.com", Subject: "x"}); !errors.As(err, &permanent) {
+		t.Fatalf("550 reply: got %v, want a permanent error", err)
+	}
+}
@@ -1,17 +1,12 @@
 package main
 
 import (
-	"log"
+	"errors"
+	"log/slog"
 	"net/http"
-	"os"
-	"strings"
-	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
-	"github.com/golang-jwt/jwt/v5"
-	"github.com/google/uuid"
-	"golang.org/x/crypto/bcrypt"
 )
 
 // User represents a user in the system
@@ -22,8 +17,22 @@ type User struct {
 	Name      string    `json:"name"`
 	Avatar    string    `json:"avatar,omitempty"`
 	Role      string    `json:"role"`
+	Status    string    `json:"status,omitempty"`   // active (or empty), disabled, invited, pending or merged
+	Phone     string    `json:"phone,omitempty"`    // verified, E.164 (phone.go)
+	Plan      string    `json:"plan,omitempty"`     // caps daily queries; empty is the default plan (plans.go)
+	OrgID     string    `json:"org_id,omitempty"`   // org in org mode (orgs.go), charged for usage; empty is the default org (costs.go)
+	OrgRole   string    `json:"org_role,omitempty"` // member or manager of OrgID; empty is member
 	CreatedAt time.Time `json:"created_at"`
 	UpdatedAt time.Time `json:"updated_at"`
+
+	MergedInto   string `json:"merged_into,omitempty"` // the account this one was merged into (merge.go)
+	ReferralCode string `json:"referral_code,omitempty"`
+	ReferredBy   string `json:"referred_by,omitempty"` // the user whose referral code this account registered with
+
+	// Tokens issued at or before this second are refused (logout.go)
+	TokensRevokedAt time.Time `json:"-"`
+	Devices         []Device  `json:"-"` // replaced, never modified in place (devices.go)
+	Starred         []string  `json:"-"` // filenames, oldest first; replaced, never modified in place (favorites.go)
 }
 
 // UserProfile is the public profile (no sensitive data)
@@ -33,13 +42,23 @@ type UserProfile struct {
 	Name      string    `json:"name"`
 	Avatar    string    `json:"avatar,omitempty"`
 	Role      string    `json:"role"`
+	Status    string    `json:"status"`
+	Phone     string    `json:"phone,omitempty"`
+	Plan      string    `json:"plan"`
+	OrgID     string    `json:"org_id"`
+	OrgRole   string    `json:"org_role,omitempty"`
 	CreatedAt time.Time `json:"created_at"`
+
+	MergedInto string `json:"merged_into,omitempty"`
 }
 
 // LoginRequest for user login
 type LoginRequest struct {
 	Email    string `json:"email" binding:"required,email"`
 	Password string `json:"password" binding:"required,min=6"`
+
+	RememberMe   bool   `json:"remember_me"`             // also return a refresh token (remember.go)
+	CaptchaToken string `json:"captcha_token,omitempty"` // when the risk engine asks for one (risk.go)
 }
 
 // RegisterRequest for user registration
@@ -47,6 +66,8 @@ type RegisterRequest struct {
 	Email    string `json:"email" binding:"required,email"`
 	Password string `json:"password" binding:"required,min=6"`
 	Name     string `json:"name" binding:"required,min=2"`
+
+	ReferralCode string `json:"referral_code,omitempty" binding:"max=32"` // optional (referrals.go)
 }
 
 // UpdateProfileRequest for updating user profile
@@ -55,11 +76,15 @@ type UpdateProfileRequest struct {
 	Avatar string `json:"avatar,omitempty"`
 }
 
-// AuthResponse returned after successful login/register
+// AuthResponse returned after successful login/register. In cookie
+// session mode the token travels in a cookie and CSRFToken is set instead.
 type AuthResponse struct {
-	Token   string      `json:"token"`
-	User    UserProfile `json:"user"`
-	Message string      `json:"message"`
+	Token     string      `json:"token,omitempty"`
+	CSRFToken string      `json:"csrf_token,omitempty"`
+	User      UserProfile `json:"user"`
+	Message   string      `json:"message"`
+
+	RefreshToken string `json:"refresh_token,omitempty"` // remember_me sign-ins in bearer mode
 }
 
 // UserDocument tracks document ownership
@@ -69,238 +94,260 @@ type UserDocument struct {
 	UploadedAt time.Time `json:"uploaded_at"`
 }
 
-// In-memory user store (replace with database in production)
-var (
-	users         = make(map[string]*User)         // email -> user
-	usersByID     = make(map[string]*User)         // id -> user
-	userDocuments = make(map[string][]string)      // user_id -> []filename
-	documentOwner = make(map[string]string)        // filename -> user_id
-	userMutex     sync.RWMutex
-	docMutex      sync.RWMutex
-	jwtSecret     = []byte("your-secret-key-change-in-production")
-)
-
-func init() {
-	// Create a default admin user
-	hashedPassword, _ := bcrypt.GenerateFromPassword([]byte("admin123"), bcrypt.DefaultCost)
-	adminUser := &User{
-		ID:        uuid.New().String(),
-		Email:     "admin@us.inc",
-		Password:  string(hashedPassword),
-		Name:      "Admin User",
-		Role:      "admin",
-		CreatedAt: time.Now(),
-		UpdatedAt: time.Now(),
-	}
-	users[adminUser.Email] = adminUser
-	usersByID[adminUser.ID] = adminUser
-
-	// Create test user
-	testPassword, _ := bcrypt.GenerateFromPassword([]byte("testuser#123"), bcrypt.DefaultCost)
-	testUser := &User{
-		ID:        uuid.New().String(),
-		Email:     "testuser1@us.inc",
-		Password:  string(testPassword),
-		Name:      "Test User",
-		Role:      "user",
-		CreatedAt: time.Now(),
-		UpdatedAt: time.Now(),
-	}
-	users[testUser.Email] = testUser
-	usersByID[testUser.ID] = testUser
-}
-
 func main() {
-	// Set Gin mode
-	if os.Getenv("GIN_MODE") == "" {
-		gin.SetMode(gin.ReleaseMode)
-	}
-
-	r := gin.Default()
-
-	// CORS middleware
-	r.Use(func(c *gin.Context) {
-		c.Header("Access-Control-Allow-Origin", "*")
-		c.Header("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		c.Header("Access-Control-Allow-Headers", "Content-Type, Authorization")
-		if c.Request.Method == "OPTIONS" {
-			c.AbortWithStatus(204)
-			return
-		}
-		c.Next()
-	})
-
-	// Health check
-	r.GET("/health", func(c *gin.Context) {
-		c.JSON(http.StatusOK, gin.H{"status": "healthy", "service": "auth-service"})
-	})
-
-	// Auth routes
-	auth := r.Group("/auth")
-	{
-		auth.POST("/register", register)
-		auth.POST("/login", login)
-		auth.POST("/logout", logout)
-		auth.GET("/verify", authMiddleware(), verifyToken)
+	configErr := loadConfig()
+	setupLogging()
+	if configErr != nil {
+		fatal("Refusing to start", "error", configErr)
+	}
+	if config.Auth.JWTSecret == defaultJWTSecret {
+		slog.Warn("Using the default JWT secret; set JWT_SECRET before deploying")
+	}
+	signingKeys.rotate([]byte(config.Auth.JWTSecret))
+	startSecretsRefresh(activeSecretsProvider, resolvedSecrets)
+	gin.SetMode(config.Server.GinMode)
+
+	if err := setupCluster(); err != nil {
+		fatal("Cluster setup failed", "error", err)
+	}
+	if err := openAuditLog(); err != nil { // after the cluster, which may hold the chain
+		fatal("Failed to open audit log", "error", err)
+	}
+	setupPasswordPool()
+	if err := setupPeppers(); err != nil {
+		fatal("Invalid password peppers", "error", err)
+	}
+	if err := seedUsers(); err != nil {
+		fatal("Seeding failed", "error", err)
+	}
+	if err := setupRateLimiting(); err != nil {
+		fatal("Rate limiting setup failed", "error", err)
+	}
+	if err := setupNetworkRules(); err != nil {
+		fatal("Network rules setup failed", "error", err)
+	}
+	if err := setupMaintenance(); err != nil {
+		fatal("Maintenance mode setup failed", "error", err)
+	}
+	if err := setupI18n(); err != nil {
+		fatal("Translations failed to load", "error", err)
+	}
+	if err := loadOAuthClients(); err != nil {
+		fatal("Failed to load OAuth clients", "file", config.Auth.OAuthClientsFile, "error", err)
+	}
+	if err := loadOrgs(); err != nil {
+		fatal("Failed to load orgs", "file", config.Orgs.StoreFile, "error", err)
+	}
+
+	startScanning() // before workers pick up restored jobs
+	startJobWorkers()
+	startStaleRechunk()
+	startEvaluations()
+	startSearchSettings()
+	startProviders()
+	startConversations()
+	startSavedQueries(defaultService)
+	startCostTracking(defaultService)
+	registerConnectors()
+	startConnectorSync()
+	startSecurityExport()
+	startMailer()
+	startSMS()
+	startErrorReporting()
+	startAuditRetention()
+	startExports()
+	startGrantExpiry(defaultService)
+	startScheduledBackups(defaultService)
+
+	srv, err := NewServer(defaultService)
+	if err != nil {
+		fatal("Router setup failed", "error", err)
 	}
 
-	// User routes (protected)
-	userRoutes := r.Group("/users")
-	userRoutes.Use(authMiddleware())
-	{
-		userRoutes.GET("/me", getProfile)
-		userRoutes.PUT("/me", updateProfile)
-		userRoutes.GET("/:id", getUserByID)
-		userRoutes.GET("/", listUsers) // Admin only
+	port := config.Server.Port
+	// No WriteTimeout: it would cut off query streams and large listings
+	server := &http.Server{
+		Addr:              ":" + port,
+		Handler:           srv,
+		ReadHeaderTimeout: config.Server.ReadHeaderTimeout,
+		ReadTimeout:       config.Server.ReadTimeout,
+		IdleTimeout:       config.Server.IdleTimeout,
 	}
+	// Hijacked WebSocket connections and event streams aren't drained by
+	// Shutdown
+	server.RegisterOnShutdown(func() { closeChatSessions("server shutting down") })
+	server.RegisterOnShutdown(closeAdminEventStreams)
 
-	// Document ownership routes (protected)
-	docRoutes := r.Group("/documents")
-	docRoutes.Use(authMiddleware())
-	{
-		docRoutes.POST("/register", registerDocument)       // Register a document to user
-		docRoutes.DELETE("/:filename", unregisterDocument)  // Remove document ownership
-		docRoutes.GET("/my", getMyDocuments)                // Get current user's documents
-		docRoutes.GET("/user/:user_id", getUserDocuments)   // Admin: get specific user's docs
-		docRoutes.GET("/all", getAllDocuments)              // Admin: get all documents with owners
+	tlsConfig, err := setupTLS(server)
+	if err != nil {
+		fatal("TLS setup failed", "error", err)
 	}
-
-	port := os.Getenv("AUTH_PORT")
-	if port == "" {
-		port = "8001"
+	if err := configureHTTP2(server); err != nil {
+		fatal("HTTP/2 setup failed", "error", err)
 	}
+	slog.Info("Auth Service starting", "port", port, "gin_mode", gin.Mode(), "tls", config.TLS.Mode)
 
-	log.Printf("🔐 Auth Service starting on port %s", port)
-	log.Printf("   Default admin: admin@us.inc / admin123")
-	log.Printf("   Test user: testuser1@us.inc / testuser#123")
+	grpcServer := startGRPCServer(defaultService, tlsConfig)
 
-	if err := r.Run(":" + port); err != nil {
-		log.Fatalf("Failed to start server: %v", err)
-	}
+	serveUntilSignal(server, grpcServer)
 }
 
 // register creates a new user account
-func register(c *gin.Context) {
+func (s *Server) register(c *gin.Context) {
 	var req RegisterRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: " + err.Error()})
-		return
-	}
-
-	userMutex.Lock()
-	defer userMutex.Unlock()
-
-	// Check if user already exists
-	if _, exists := users[req.Email]; exists {
-		c.JSON(http.StatusConflict, gin.H{"error": "Email already registered"})
+		respondBindError(c, err)
 		return
 	}
 
-	// Hash password
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+	user, token, err := s.svc.Register(req.Email, req.Password, req.Name, req.ReferralCode)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to process password"})
+		respondServiceError(c, err)
 		return
 	}
 
-	// Create user
-	user := &User{
-		ID:        uuid.New().String(),
-		Email:     req.Email,
-		Password:  string(hashedPassword),
-		Name:      req.Name,
-		Role:      "user",
-		CreatedAt: time.Now(),
-		UpdatedAt: time.Now(),
-	}
+	auditActor(c, user)
+	auditChange(c, "user.register", "user:"+user.ID, nil, toProfile(user))
 
-	users[user.Email] = user
-	usersByID[user.ID] = user
+	event := httpSecurityEvent(c, EventRegister, "success")
+	event.UserID, event.Email = user.ID, user.Email
+	emitSecurityEvent(event)
 
-	// Generate JWT token
-	token, err := generateToken(user)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
+	if user.Status == UserPending {
+		c.JSON(http.StatusAccepted, AuthResponse{User: toProfile(user), Message: "Registration received; an administrator will review it"})
 		return
 	}
-
-	c.JSON(http.StatusCreated, AuthResponse{
-		Token:   token,
-		User:    toProfile(user),
-		Message: "Registration successful",
-	})
+	c.JSON(http.StatusCreated, sessionResponse(c, user, token, "Registration successful"))
 }
 
 // login authenticates a user
-func login(c *gin.Context) {
+func (s *Server) login(c *gin.Context) {
 	var req LoginRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: " + err.Error()})
+		respondBindError(c, err)
 		return
 	}
-
-	userMutex.RLock()
-	user, exists := users[req.Email]
-	userMutex.RUnlock()
-
-	if !exists {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid email or password"})
+	if !screenLogin(c, req.Email, req.CaptchaToken) {
 		return
 	}
 
-	// Check password
-	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(req.Password)); err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid email or password"})
+	user, token, err := s.svc.Login(req.Email, req.Password)
+	s.completeLogin(c, req.Email, req.RememberMe, user, token, err)
+}
+
+// completeLogin applies the checks every sign-in method shares to the
+// outcome of one and answers the request; identifier is the email or
+// phone number the client gave, rememberMe whether it asked for a refresh
+// token
+func (s *Server) completeLogin(c *gin.Context, identifier string, rememberMe bool, user *User, token string, err error) {
+	if err == nil && maintenanceOn.Load() && user.Role != "admin" {
+		respondMaintenance(c)
 		return
 	}
-
-	// Generate JWT token
-	token, err := generateToken(user)
+	var refresh string
+	if err == nil {
+		record := httpLoginRecord(c)
+		record.Trusted = s.svc.deviceTrusted(user, record.Device)
+		err = checkLogin(user, record)
+		if err == nil {
+			token, refresh, err = s.svc.deviceSession(user, record, rememberMe)
+		}
+	}
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
+		event := httpSecurityEvent(c, EventLoginFailure, "failure")
+		event.Email, event.Reason = identifier, err.Error()
+		emitSecurityEvent(event)
+		if err == errInvalidCredentials {
+			recordAbuse(c.ClientIP(), "failed logins")
+			recordLoginOutcome(false)
+			recordLoginRisk(identifier, c.ClientIP(), riskASN(c.GetHeader), false)
+		}
+
+		respondServiceError(c, err)
 		return
 	}
 
-	c.JSON(http.StatusOK, AuthResponse{
-		Token:   token,
-		User:    toProfile(user),
-		Message: "Login successful",
-	})
+	event := httpSecurityEvent(c, EventLoginSuccess, "success")
+	event.UserID, event.Email = user.ID, user.Email
+	emitSecurityEvent(event)
+	recordLoginOutcome(true)
+	recordLoginRisk(identifier, c.ClientIP(), riskASN(c.GetHeader), true)
+
+	c.JSON(http.StatusOK, withRefreshToken(c, sessionResponse(c, user, token, "Login successful"), refresh))
 }
 
-// logout invalidates the token (client-side handling)
-func logout(c *gin.Context) {
+// logout invalidates the token (client-side handling), ends the device's
+// remembered session and clears any session cookies
+func (s *Server) logout(c *gin.Context) {
+	event := httpSecurityEvent(c, EventLogout, "success")
+	if token, _, err := requestToken(c); err == nil {
+		if user, err := s.svc.Authenticate(token); err == nil {
+			event.UserID, event.Email = user.ID, user.Email
+			s.svc.Forget(user, token)
+		}
+	}
+	emitSecurityEvent(event)
+	if cookieSessions() {
+		clearSessionCookies(c)
+		setRefreshCookie(c, "", time.Time{})
+	}
+
 	c.JSON(http.StatusOK, gin.H{"message": "Logout successful"})
 }
 
 // verifyToken checks if the current token is valid
-func verifyToken(c *gin.Context) {
+func (s *Server) verifyToken(c *gin.Context) {
 	user, _ := c.Get("user")
-	c.JSON(http.StatusOK, gin.H{
+	response := gin.H{
 		"valid": true,
 		"user":  toProfile(user.(*User)),
-	})
+	}
+	if claims := c.GetStringMap("claims"); len(claims) > 0 {
+		response["claims"] = claims
+	}
+	if scope := c.GetString("token_scope"); scope != "" {
+		response["scope"] = scope
+	}
+	c.JSON(http.StatusOK, response)
 }
 
 // getProfile returns the current user's profile
-func getProfile(c *gin.Context) {
+func (s *Server) getProfile(c *gin.Context) {
 	user, _ := c.Get("user")
-	c.JSON(http.StatusOK, toProfile(user.(*User)))
+	currentUser := user.(*User)
+
+	lock := s.svc.users.FieldLock(currentUser)
+	lock.RLock()
+	profile, etag := toProfile(currentUser), profileETag(currentUser)
+	lock.RUnlock()
+
+	if notModified(c, etag) {
+		return
+	}
+	c.JSON(http.StatusOK, profile)
 }
 
 // updateProfile updates the current user's profile
-func updateProfile(c *gin.Context) {
+func (s *Server) updateProfile(c *gin.Context) {
 	var req UpdateProfileRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		respondBindError(c, err)
 		return
 	}
 
 	user, _ := c.Get("user")
 	currentUser := user.(*User)
 
-	userMutex.Lock()
-	defer userMutex.Unlock()
+	lock := s.svc.users.FieldLock(currentUser)
+	lock.Lock()
+	defer lock.Unlock()
+
+	// Optimistic concurrency: reject edits based on a stale copy
+	if preconditionFailed(c, profileETag(currentUser)) {
+		return
+	}
+	before := toProfile(currentUser)
+	previous := *currentUser
 
 	if req.Name != "" {
 		currentUser.Name = req.Name
@@ -309,7 +356,15 @@ func updateProfile(c *gin.Context) {
 		currentUser.Avatar = req.Avatar
 	}
 	currentUser.UpdatedAt = time.Now()
+	if err := saveUser(currentUser); err != nil {
+		*currentUser = previous
+		respondServiceError(c, err)
+		return
+	}
+	bumpUserVersion()
+	auditChange(c, "user.profile.update", "user:"+currentUser.ID, before, toProfile(currentUser))
 
+	c.Header("ETag", profileETag(currentUser))
 	c.JSON(http.StatusOK, gin.H{
 		"message": "Profile updated",
 		"user":    toProfile(currentUser),
@@ -317,36 +372,42 @@ func updateProfile(c *gin.Context) {
 }
 
 // getUserByID returns a user by their ID
-func getUserByID(c *gin.Context) {
+func (s *Server) getUserByID(c *gin.Context) {
 	id := c.Param("id")
 
-	userMutex.RLock()
-	user, exists := usersByID[id]
-	userMutex.RUnlock()
+	user := s.svc.users.ByID(id)
+	var profile UserProfile
+	var etag string
+	if user != nil {
+		lock := s.svc.users.FieldLock(user)
+		lock.RLock()
+		profile, etag = toProfile(user), profileETag(user)
+		lock.RUnlock()
+	}
 
-	if !exists {
-		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+	if user == nil {
+		respondError(c, http.StatusNotFound, codeNotFound, "User not found")
 		return
 	}
 
-	c.JSON(http.StatusOK, toProfile(user))
+	if notModified(c, etag) {
+		return
+	}
+	c.JSON(http.StatusOK, profile)
 }
 
 // listUsers returns all users (admin only)
-func listUsers(c *gin.Context) {
+func (s *Server) listUsers(c *gin.Context) {
 	currentUser, _ := c.Get("user")
 	if currentUser.(*User).Role != "admin" {
-		c.JSON(http.StatusForbidden, gin.H{"error": "Admin access required"})
+		respondError(c, http.StatusForbidden, codeAdminRequired, "Admin access required")
 		return
 	}
 
-	userMutex.RLock()
-	defer userMutex.RUnlock()
-
-	profiles := make([]UserProfile, 0, len(users))
-	for _, user := range users {
+	profiles := make([]UserProfile, 0, s.svc.users.Count())
+	s.svc.users.Each(func(user *User) {
 		profiles = append(profiles, toProfile(user))
-	}
+	})
 
 	c.JSON(http.StatusOK, gin.H{
 		"users": profiles,
@@ -354,76 +415,74 @@ func listUsers(c *gin.Context) {
 	})
 }
 
-// generateToken creates a JWT token for a user
-func generateToken(user *User) (string, error) {
-	claims := jwt.MapClaims{
-		"user_id": user.ID,
-		"email":   user.Email,
-		"role":    user.Role,
-		"exp":     time.Now().Add(24 * time.Hour).Unix(),
-		"iat":     time.Now().Unix(),
-	}
+// tokenLifetime is the default session.lifetime, how long issued tokens
+// (and session cookies) last
+const tokenLifetime = 24 * time.Hour
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString(jwtSecret)
-}
+// Token validation errors, surfaced verbatim to clients
+var (
+	errInvalidToken  = errors.New("Invalid or expired token")
+	errInvalidClaims = errors.New("Invalid token claims")
+	errUserNotFound  = errors.New("User not found")
+)
 
-// authMiddleware validates JWT tokens
-func authMiddleware() gin.HandlerFunc {
+// authMiddleware validates JWT tokens from the Authorization header or,
+// in cookie session mode, the session cookie
+func (s *Server) authMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		authHeader := c.GetHeader("Authorization")
-		if authHeader == "" {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Authorization header required"})
+		token, fromCookie, err := requestToken(c)
+		if err != nil {
+			debugLog("auth", "No usable credentials", "reason", err, "session_mode", config.Session.Mode)
+			respondError(c, http.StatusUnauthorized, codeUnauthorized, err.Error())
 			c.Abort()
 			return
 		}
-
-		// Extract token from "Bearer <token>"
-		parts := strings.Split(authHeader, " ")
-		if len(parts) != 2 || parts[0] != "Bearer" {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid authorization format"})
+		if fromCookie && !csrfValid(c, token) {
+			debugLog("auth", "CSRF check failed", "method", c.Request.Method, "header_present", c.GetHeader(csrfHeader) != "")
+			respondError(c, http.StatusForbidden, codeCSRFFailed, "Missing or invalid "+csrfHeader+" header")
 			c.Abort()
 			return
 		}
 
-		tokenString := parts[1]
+		user, claims, scope, err := s.svc.AuthenticateScoped(token)
+		if err != nil {
+			event := httpSecurityEvent(c, EventTokenInvalid, "failure")
+			event.Reason = err.Error()
+			emitSecurityEvent(event)
 
-		// Parse and validate token
-		token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-				return nil, jwt.ErrSignatureInvalid
-			}
-			return jwtSecret, nil
-		})
-
-		if err != nil || !token.Valid {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired token"})
+			respondError(c, http.StatusUnauthorized, tokenErrorCode(err), err.Error())
 			c.Abort()
 			return
 		}
-
-		// Extract claims
-		claims, ok := token.Claims.(jwt.MapClaims)
-		if !ok {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token claims"})
+		// Exchanged tokens only work on the routes their scope lists
+		if _, route := splitAPIVersion(c.FullPath()); scope != "" && !scopeAllows(scope, c.Request.Method+" "+route) {
+			respondError(c, http.StatusForbidden, codeInsufficientScope, errInsufficientScope.Error())
 			c.Abort()
 			return
 		}
 
-		// Get user from store
-		userID := claims["user_id"].(string)
-		userMutex.RLock()
-		user, exists := usersByID[userID]
-		userMutex.RUnlock()
-
-		if !exists {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found"})
+		// Set user, custom claims and any scope in context
+		c.Set("user", user)
+		c.Set("claims", claims)
+		c.Set("token_scope", scope)
+		recordActivity(user.ID)
+		if !allowRequest(c, apiRateLimit, "user:"+user.ID) {
 			c.Abort()
 			return
 		}
+		c.Next()
+	}
+}
 
-		// Set user in context
-		c.Set("user", user)
+// requireAdmin rejects non-admin users; it must run after authMiddleware
+func requireAdmin() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user, _ := c.Get("user")
+		if user.(*User).Role != "admin" {
+			respondError(c, http.StatusForbidden, codeAdminRequired, "Admin access required")
+			c.Abort()
+			return
+		}
 		c.Next()
 	}
 }
@@ -436,7 +495,14 @@ func toProfile(user *User) UserProfile {
 		Name:      user.Name,
 		Avatar:    user.Avatar,
 		Role:      user.Role,
+		Status:    accountStatus(user),
+		Phone:     user.Phone,
+		Plan:      planOf(user),
+		OrgID:     orgOf(user),
+		OrgRole:   orgRoleOf(user),
 		CreatedAt: user.CreatedAt,
+
+		MergedInto: user.MergedInto,
 	}
 }
 
@@ -449,130 +515,124 @@ type RegisterDocumentRequest struct {
 	Filename string `json:"filename" binding:"required"`
 }
 
+// errDocumentOwned is returned when a document belongs to another user
+var errDocumentOwned = errors.New("Document already owned by another user")
+
 // registerDocument associates a document with the current user
-func registerDocument(c *gin.Context) {
+func (s *Server) registerDocument(c *gin.Context) {
 	var req RegisterDocumentRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Filename is required"})
+		respondBindError(c, err)
 		return
 	}
 
 	user, _ := c.Get("user")
 	currentUser := user.(*User)
 
-	docMutex.Lock()
-	defer docMutex.Unlock()
+	if err := checkFileExtension(req.Filename); err != nil {
+		respondFileTypeError(c, err.(*fileTypeError))
+		return
+	}
 
-	// Check if document is already owned
-	if existingOwner, exists := documentOwner[req.Filename]; exists {
-		if existingOwner != currentUser.ID {
-			c.JSON(http.StatusConflict, gin.H{"error": "Document already owned by another user"})
-			return
-		}
+	filename, created, err := s.svc.RegisterDocument(req.Filename, currentUser.ID)
+	if err != nil {
+		respondServiceError(c, err)
+		return
+	}
+	if !created {
 		// Already owned by this user
-		c.JSON(http.StatusOK, gin.H{"message": "Document already registered", "filename": req.Filename})
+		c.JSON(http.StatusOK, gin.H{"message": "Document already registered", "filename": filename, "name": req.Filename})
 		return
 	}
+	auditChange(c, "document.register", "document:"+filename, nil,
+		gin.H{"filename": filename, "name": req.Filename, "owner_id": currentUser.ID})
 
-	// Register document to user
-	documentOwner[req.Filename] = currentUser.ID
-	userDocuments[currentUser.ID] = append(userDocuments[currentUser.ID], req.Filename)
-
+	// The filename differs from the name if another user's document has
+	// it (docnames.go)
 	c.JSON(http.StatusCreated, gin.H{
 		"message":  "Document registered",
-		"filename": req.Filename,
+		"filename": filename,
+		"name":     req.Filename,
 		"user_id":  currentUser.ID,
 	})
 }
 
 // unregisterDocument removes document ownership
-func unregisterDocument(c *gin.Context) {
+func (s *Server) unregisterDocument(c *gin.Context) {
 	filename := c.Param("filename")
 
 	user, _ := c.Get("user")
 	currentUser := user.(*User)
 
-	docMutex.Lock()
-	defer docMutex.Unlock()
+	ownerID := s.svc.DocumentOwner(filename)
 
-	// Check ownership
-	ownerID, exists := documentOwner[filename]
-	if !exists {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Document not found"})
+	if err := s.svc.ReleaseDocument(filename, currentUser); err != nil {
+		respondServiceError(c, err)
 		return
 	}
-
-	// Only owner or admin can delete
-	if ownerID != currentUser.ID && currentUser.Role != "admin" {
-		c.JSON(http.StatusForbidden, gin.H{"error": "Not authorized to delete this document"})
-		return
-	}
-
-	// Remove from documentOwner
-	delete(documentOwner, filename)
-
-	// Remove from userDocuments
-	docs := userDocuments[ownerID]
-	for i, doc := range docs {
-		if doc == filename {
-			userDocuments[ownerID] = append(docs[:i], docs[i+1:]...)
-			break
-		}
-	}
+	auditChange(c, "document.unregister", "document:"+filename,
+		gin.H{"filename": filename, "owner_id": ownerID}, nil)
 
 	c.JSON(http.StatusOK, gin.H{"message": "Document unregistered", "filename": filename})
 }
 
 // getMyDocuments returns documents owned by the current user
-func getMyDocuments(c *gin.Context) {
+func (s *Server) getMyDocuments(c *gin.Context) {
 	user, _ := c.Get("user")
 	currentUser := user.(*User)
 
-	docMutex.RLock()
-	docs := userDocuments[currentUser.ID]
-	docMutex.RUnlock()
+	language, ok := languageFilter(c)
+	if !ok {
+		return
+	}
+	if notModified(c, documentsETag(languageScope(currentUser.ID, language))) {
+		return
+	}
+	docs := s.svc.DocumentsOf(currentUser.ID)
+	if language != "" {
+		docs = s.svc.InLanguage(docs, language)
+	}
 
-	if docs == nil {
-		docs = []string{}
+	owned := s.svc.NamesOf(currentUser.ID)
+	names := make(map[string]string, len(docs))
+	for _, filename := range docs {
+		names[filename] = owned[filename]
 	}
 
 	c.JSON(http.StatusOK, gin.H{
 		"user_id":   currentUser.ID,
 		"documents": docs,
+		"names":     names,
 		"count":     len(docs),
 	})
 }
 
 // getUserDocuments returns documents for a specific user (admin only)
-func getUserDocuments(c *gin.Context) {
+func (s *Server) getUserDocuments(c *gin.Context) {
 	user, _ := c.Get("user")
 	currentUser := user.(*User)
 
 	if currentUser.Role != "admin" {
-		c.JSON(http.StatusForbidden, gin.H{"error": "Admin access required"})
+		respondError(c, http.StatusForbidden, codeAdminRequired, "Admin access required")
 		return
 	}
 
 	userID := c.Param("user_id")
+	language, ok := languageFilter(c)
+	if !ok {
+		return
+	}
+	if notModified(c, documentsETag(languageScope(userID, language))) {
+		return
+	}
 
-	docMutex.RLock()
-	docs := userDocuments[userID]
-	docMutex.RUnlock()
-
-	if docs == nil {
-		docs = []string{}
+	docs := s.svc.DocumentsOf(userID)
+	if language != "" {
+		docs = s.svc.InLanguage(docs, language)
 	}
 
 	// Get user info
-	userMutex.RLock()
-	targetUser, exists := usersByID[userID]
-	userMutex.RUnlock()
-
-	var userName, userEmail string
-	if exists {
-		userName = targetUser.Name
-		userEmail = targetUser.Email
-	}
+	userName, userEmail, _ := s.svc.users.Contact(userID)
 
 	c.JSON(http.StatusOK, gin.H{
 		"user_id":    userID,
@@ -582,74 +642,3 @@ func getUserDocuments(c *gin.Context) {
 		"count":      len(docs),
 	})
 }
-
-// getAllDocuments returns all documents with their owners (admin only)
-func getAllDocuments(c *gin.Context) {
-	user, _ := c.Get("user")
-	currentUser := user.(*User)
-
-	if currentUser.Role != "admin" {
-		c.JSON(http.StatusForbidden, gin.H{"error": "Admin access required"})
-		return
-	}
-
-	docMutex.RLock()
-	userMutex.RLock()
-	defer docMutex.RUnlock()
-	defer userMutex.RUnlock()
-
-	type DocumentWithOwner struct {
-		Filename  string `json:"filename"`
-		UserID    string `json:"user_id"`
-		UserName  string `json:"user_name"`
-		UserEmail string `json:"user_email"`
-	}
-
-	var allDocs []DocumentWithOwner
-	for filename, ownerID := range documentOwner {
-		doc := DocumentWithOwner{
-			Filename: filename,
-			UserID:   ownerID,
-		}
-		if owner, exists := usersByID[ownerID]; exists {
-			doc.UserName = owner.Name
-			doc.UserEmail = owner.Email
-		}
-		allDocs = append(allDocs, doc)
-	}
-
-	// Group by user
-	docsByUser := make(map[string][]string)
-	for filename, ownerID := range documentOwner {
-		docsByUser[ownerID] = append(docsByUser[ownerID], filename)
-	}
-
-	type UserWithDocs struct {
-		UserID    string   `json:"user_id"`
-		UserName  string   `json:"user_name"`
-		UserEmail string   `json:"user_email"`
-		Documents []string `json:"documents"`
-		Count     int      `json:"count"`
-	}
-
-	var usersList []UserWithDocs
-	for userID, docs := range docsByUser {
-		uwd := UserWithDocs{
-			UserID:    userID,
-			Documents: docs,
-			Count:     len(docs),
-		}
-		if owner, exists := usersByID[userID]; exists {
-			uwd.UserName = owner.Name
-			uwd.UserEmail = owner.Email
-		}
-		usersList = append(usersList, uwd)
-	}
-
-	c.JSON(http.StatusOK, gin.H{
-		"total_documents": len(documentOwner),
-		"total_users":     len(docsByUser),
-		"users":           usersList,
-		"all_documents":   allDocs,
-	})
-}
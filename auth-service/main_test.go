@@ -0,0 +1,21 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+// withConfig runs a test against a modified copy of the configuration
+func withConfig(t testing.TB, modify func(*Config)) {
+	t.Helper()
+	saved := config
+	cfg := *saved
+	modify(&cfg)
+	config = &cfg
+	t.Cleanup(func() { config = saved })
+}
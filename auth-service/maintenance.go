@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ============================================================================
+// Maintenance Mode
+// ============================================================================
+//
+// While maintenance mode is on, every route except /health and /admin
+// answers 503 with the operator's message and a Retry-After hint, and gRPC
+// calls fail with Unavailable. Login stays open so admins can sign in to
+// turn it off; other users are refused after their password is checked.
+// Requests already running finish normally: GET /admin/maintenance reports
+// how many are still in flight so migrations can wait until it reaches
+// zero. In cluster mode the switch lives in the shared store, so turning it
+// on through one replica turns it on for all of them; the in-flight count
+// is per replica.
+
+const (
+	defaultMaintenanceMessage = "The service is undergoing maintenance; please try again shortly"
+
+	// maintenanceSetting names the switch in the shared store
+	maintenanceSetting = "maintenance"
+)
+
+// MaintenanceStatus is the current maintenance state
+type MaintenanceStatus struct {
+	Enabled    bool       `json:"enabled"`
+	Message    string     `json:"message,omitempty"`
+	RetryAfter string     `json:"retry_after,omitempty"`
+	Since      *time.Time `json:"since,omitempty"`
+	InFlight   int64      `json:"in_flight"` // non-admin requests still running
+	Drained    bool       `json:"drained"`
+}
+
+var (
+	maintenance      MaintenanceStatus
+	maintenanceMu    sync.RWMutex
+	maintenanceOn    atomic.Bool
+	inFlightRequests atomic.Int64
+)
+
+// setupMaintenance applies maintenance.enabled at startup. A cluster that
+// already has a switch keeps it; the config only seeds a new one.
+func setupMaintenance() error {
+	if !config.Maintenance.Enabled {
+		return nil
+	}
+	if clustered() {
+		_, found, err := clusterStore.setting(context.Background(), maintenanceSetting)
+		if err != nil || found {
+			return err
+		}
+	}
+	return setMaintenance(true, "", config.Maintenance.RetryAfter)
+}
+
+// setMaintenance switches maintenance mode, on every replica when clustered
+func setMaintenance(enabled bool, message string, retryAfter time.Duration) error {
+	status := MaintenanceStatus{}
+	if enabled {
+		if message == "" {
+			message = defaultMaintenanceMessage
+		}
+		since := time.Now().UTC()
+		maintenanceMu.RLock()
+		if maintenance.Enabled {
+			since = *maintenance.Since
+		}
+		maintenanceMu.RUnlock()
+		status = MaintenanceStatus{
+			Enabled:    true,
+			Message:    message,
+			RetryAfter: retryAfter.String(),
+			Since:      &since,
+		}
+	}
+	if clustered() {
+		data, err := json.Marshal(status)
+		if err != nil {
+			return err
+		}
+		if err := saveSharedSetting(maintenanceSetting, data); err != nil {
+			return err
+		}
+	}
+	applyMaintenance(status)
+	return nil
+}
+
+// applyMaintenanceSetting follows a switch made through another replica
+func applyMaintenanceSetting(data []byte) error {
+	var status MaintenanceStatus
+	if err := json.Unmarshal(data, &status); err != nil {
+		return err
+	}
+	applyMaintenance(status)
+	return nil
+}
+
+// applyMaintenance sets the local switch. Turning it on closes chat
+// sessions, which would otherwise hold connections open.
+func applyMaintenance(status MaintenanceStatus) {
+	status.InFlight, status.Drained = 0, false
+	maintenanceMu.Lock()
+	maintenance = status
+	maintenanceMu.Unlock()
+	if wasOn := maintenanceOn.Swap(status.Enabled); status.Enabled && !wasOn {
+		closeChatSessions("maintenance")
+	}
+}
+
+func maintenanceStatus() MaintenanceStatus {
+	maintenanceMu.RLock()
+	status := maintenance
+	maintenanceMu.RUnlock()
+
+	status.InFlight = inFlightRequests.Load()
+	status.Drained = status.Enabled && status.InFlight == 0
+	return status
+}
+
+// maintenanceExempt reports whether a route keeps working in maintenance
+func maintenanceExempt(route string) bool {
+	return route == "/health" || route == "/health/system" || route == "/health/ready" || route == "/auth/login" || strings.HasPrefix(route, "/admin/")
+}
+
+// maintenanceGate refuses non-exempt requests during maintenance and counts
+// the ones in flight
+func maintenanceGate() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		_, route := splitAPIVersion(c.FullPath())
+		if maintenanceExempt(route) {
+			c.Next()
+			return
+		}
+		if maintenanceOn.Load() {
+			respondMaintenance(c)
+			c.Abort()
+			return
+		}
+
+		inFlightRequests.Add(1)
+		defer inFlightRequests.Add(-1)
+		c.Next()
+	}
+}
+
+func respondMaintenance(c *gin.Context) {
+	status := maintenanceStatus()
+	if d, err := time.ParseDuration(status.RetryAfter); err == nil && d > 0 {
+		c.Header("Retry-After", strconv.Itoa(ceilSeconds(d)))
+	}
+	respondError(c, http.StatusServiceUnavailable, codeMaintenance, status.Message)
+}
+
+// getMaintenance reports the maintenance state and drain progress (admin only)
+func getMaintenance(c *gin.Context) {
+	c.JSON(http.StatusOK, maintenanceStatus())
+}
+
+// MaintenanceRequest switches maintenance mode
+type MaintenanceRequest struct {
+	Enabled    bool   `json:"enabled"`
+	Message    string `json:"message,omitempty" binding:"max=500"`
+	RetryAfter string `json:"retry_after,omitempty"` // duration hint for clients, e.g. "15m"
+}
+
+// setMaintenanceMode turns maintenance on or off (admin only)
+func setMaintenanceMode(c *gin.Context) {
+	var req MaintenanceRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondBindError(c, err)
+		return
+	}
+	retryAfter := config.Maintenance.RetryAfter
+	if req.RetryAfter != "" {
+		d, err := time.ParseDuration(req.RetryAfter)
+		if err != nil || d < 0 {
+			respondError(c, http.StatusBadRequest, codeInvalidRequest, "retry_after must be a duration such as 15m")
+			return
+		}
+		retryAfter = d
+	}
+
+	before := maintenanceStatus()
+	if err := setMaintenance(req.Enabled, req.Message, retryAfter); err != nil {
+		respondServiceError(c, err)
+		return
+	}
+	after := maintenanceStatus()
+
+	auditChange(c, "maintenance.update", "maintenance", before, after)
+	c.JSON(http.StatusOK, after)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+)
+
+// resetMaintenance turns maintenance off locally when the test ends
+func resetMaintenance(t *testing.T) {
+	t.Cleanup(func() { applyMaintenance(MaintenanceStatus{}) })
+}
+
+func TestMaintenanceMode(t *testing.T) {
+	ts := newTestServer(t)
+	resetMaintenance(t)
+	admin := ts.admin("admin@example.com")
+	user, _ := ts.register("user@example.com")
+
+	if w := ts.do(http.MethodPut, "/v1/admin/maintenance", admin, `{"enabled":true,"retry_after":"10m"}`); w.Code != http.StatusOK {
+		t.Fatalf("enable: %d %s", w.Code, w.Body)
+	}
+	w := ts.do(http.MethodGet, "/v1/users/me", user, "")
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") != "600" {
+		t.Fatalf("during maintenance: got %d (Retry-After %q), want 503", w.Code, w.Header().Get("Retry-After"))
+	}
+	if w := ts.do(http.MethodGet, "/v1/admin/maintenance", admin, ""); w.Code != http.StatusOK {
+		t.Fatalf("admin routes stay open: got %d", w.Code)
+	}
+
+	if w := ts.do(http.MethodPut, "/v1/admin/maintenance", admin, `{"enabled":false}`); w.Code != http.StatusOK {
+		t.Fatalf("disable: %d %s", w.Code, w.Body)
+	}
+	if w := ts.do(http.MethodGet, "/v1/users/me", user, ""); w.Code != http.StatusOK {
+		t.Fatalf("after maintenance: got %d, want 200", w.Code)
+	}
+}
+
+func TestMaintenanceReachesReplicas(t *testing.T) {
+	ts := newTestServer(t)
+	admin := ts.admin("admin@example.com")
+	useSharedStore(t)
+	resetMaintenance(t)
+
+	if w := ts.do(http.MethodPut, "/v1/admin/maintenance", admin, `{"enabled":true,"message":"Upgrading"}`); w.Code != http.StatusOK {
+		t.Fatalf("enable: %d %s", w.Code, w.Body)
+	}
+
+	// Another replica, still serving, catches up through the change feed...
+	applyMaintenance(MaintenanceStatus{})
+	if err := refreshRecord(context.Background(), clusterChange{Kind: "setting", ID: maintenanceSetting}); err != nil {
+		t.Fatal(err)
+	}
+	if status := maintenanceStatus(); !status.Enabled || status.Message != "Upgrading" || !maintenanceOn.Load() {
+		t.Fatalf("after change message: %+v", status)
+	}
+	// ...or a resync
+	applyMaintenance(MaintenanceStatus{})
+	if err := resyncShared(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if !maintenanceOn.Load() {
+		t.Fatal("maintenance off after resync")
+	}
+
+	// A restarting replica keeps the cluster's switch over its config
+	if err := setMaintenance(false, "", 0); err != nil {
+		t.Fatal(err)
+	}
+	withConfig(t, func(cfg *Config) { cfg.Maintenance.Enabled = true })
+	if err := setupMaintenance(); err != nil {
+		t.Fatal(err)
+	}
+	if maintenanceOn.Load() {
+		t.Fatal("config turned maintenance back on for the cluster")
+	}
+}
@@ -0,0 +1,778 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ============================================================================
+// Account Merge
+// ============================================================================
+//
+// Someone who ends up with two accounts (one from a password sign-up, one
+// from an invitation, say) can fold one, the source, into the other, the
+// target. An admin merges any two accounts with POST
+// /admin/users/:id/merge; a user merges an account of their own into the
+// one they are signed in with through POST /users/me/merge, proving they
+// control it with one of its tokens. The source's documents, its grants
+// on others' documents, the notes it wrote on any document, its starred
+// and recent documents, its devices (without their remembered sessions),
+// connector links, jobs, notifications, sign-in history, security alerts,
+// saved queries and conversations, those it owns and those shared with
+// it, move to the target, as do the signups its referral code brought.
+// The target keeps its own plan, org and referrer and takes the source's
+// where it has none; in org mode two accounts in different orgs aren't
+// merged, since the source's org-wide documents would cross into the
+// target's org. The source is then tombstoned: status "merged",
+// no password or phone, and merged_into pointing at the target. Its tokens stop
+// working, its email stays reserved, and a login with it says which
+// account to use instead. The audit log keeps the source's history under
+// its old ID and records the merge. With dry_run the response lists what
+// would move and nothing changes.
+
+// UserMerged is the status of a tombstoned source account
+const UserMerged = "merged"
+
+var (
+	errMergeSameAccount = errors.New("An account cannot be merged into itself")
+	errAccountMerged    = errors.New("Account has been merged into another; sign in with that account")
+	errMergeAcrossOrgs  = errors.New("Accounts in different orgs cannot be merged; move one into the other's org first")
+)
+
+// AdminMergeRequest for POST /admin/users/:id/merge, which merges source_id
+// into :id
+type AdminMergeRequest struct {
+	SourceID string `json:"source_id" binding:"required"`
+	DryRun   bool   `json:"dry_run"`
+}
+
+// SelfMergeRequest for POST /users/me/merge; token signs in the account to
+// merge into the caller's
+type SelfMergeRequest struct {
+	Token  string `json:"token" binding:"required"`
+	DryRun bool   `json:"dry_run"`
+}
+
+// MergeSummary lists what a merge moves from the source to the target
+type MergeSummary struct {
+	Source         UserProfile `json:"source"`
+	Target         UserProfile `json:"target"`
+	DryRun         bool        `json:"dry_run"`
+	Documents      []string    `json:"documents"`
+	Grants         int         `json:"grants"` // others' documents shared with the account until a time
+	Notes          int         `json:"notes"`  // written on any document
+	Starred        int         `json:"starred"`
+	Devices        int         `json:"devices"`
+	ConnectorLinks int         `json:"connector_links"`
+	Jobs           int         `json:"jobs"`
+	Notifications  int         `json:"notifications"`
+	Logins         int         `json:"logins"`
+	SecurityAlerts int         `json:"security_alerts"`
+	SavedQueries   int         `json:"saved_queries"`
+	Conversations  int         `json:"conversations"` // owned or shared with the account
+	Referrals      int         `json:"referrals"`     // signups with the account's referral code
+
+	// The target's plan, org and referrer once merged (mergeSettings)
+	Plan       string `json:"plan"`
+	OrgID      string `json:"org_id,omitempty"`
+	OrgRole    string `json:"org_role,omitempty"`
+	ReferredBy string `json:"referred_by,omitempty"`
+}
+
+// ----------------------------------------------------------------------------
+// Service operations
+// ----------------------------------------------------------------------------
+
+// MergeUsers folds source into target, or with dryRun only reports what
+// that would move
+func (s *Service) MergeUsers(target, source *User, dryRun bool) (MergeSummary, error) {
+	s.adminMu.Lock()
+	defer s.adminMu.Unlock()
+
+	if target == source {
+		return MergeSummary{}, errMergeSameAccount
+	}
+	targetSnapshot, sourceSnapshot := s.userSnapshot(target), s.userSnapshot(source)
+	if accountStatus(&targetSnapshot) == UserMerged || accountStatus(&sourceSnapshot) == UserMerged {
+		return MergeSummary{}, errAccountMerged
+	}
+	if sourceSnapshot.Role == "admin" && accountStatus(&sourceSnapshot) == UserActive &&
+		!(targetSnapshot.Role == "admin" && accountStatus(&targetSnapshot) == UserActive) && s.activeAdmins() <= 1 {
+		return MergeSummary{}, errLastAdmin
+	}
+
+	summary, err := mergeInventory(s, source.ID)
+	if err != nil {
+		return MergeSummary{}, err
+	}
+	if err := mergeSettings(&summary, &targetSnapshot, &sourceSnapshot); err != nil {
+		return MergeSummary{}, err
+	}
+	summary.Starred, summary.Devices = len(sourceSnapshot.Starred), len(sourceSnapshot.Devices)
+	summary.DryRun = dryRun
+	if dryRun {
+		summary.Source, summary.Target = toProfile(&sourceSnapshot), toProfile(&targetSnapshot)
+		return summary, nil
+	}
+
+	// Tombstone first so the source can't add anything while it moves
+	if err := s.tombstone(source, target.ID); err != nil {
+		return MergeSummary{}, err
+	}
+	// Settle the target's org before its documents arrive
+	if err := s.applyMergeSettings(target, summary); err != nil {
+		slog.Warn("Merged plan, org and referrer not kept", "target", target.ID, "error", err)
+	}
+	if err := s.moveDocuments(source.ID, target.ID); err != nil {
+		// The source is already closed; what didn't move stays listed
+		// under it for an admin to transfer
+		slog.Error("Merge left documents behind", "source", source.ID, "target", target.ID, "error", err)
+		return MergeSummary{}, err
+	}
+	s.moveGrants(source.ID, target.ID)
+	s.moveNotes(source.ID, target.ID)
+	if err := s.moveStars(source, target); err != nil {
+		slog.Warn("Merged stars not moved", "source", source.ID, "error", err)
+	}
+	if err := s.moveDevices(source, target); err != nil {
+		slog.Warn("Merged devices not moved", "source", source.ID, "error", err)
+	}
+	s.moveReferrals(source.ID, target.ID)
+	moveUserRecords(source.ID, target.ID, targetSnapshot.Email)
+
+	summary.Source, summary.Target = s.userProfile(source), s.userProfile(target)
+	return summary, nil
+}
+
+// mergeInventory counts what belongs to userID
+func mergeInventory(s *Service, userID string) (MergeSummary, error) {
+	summary := MergeSummary{Documents: s.DocumentsOf(userID)}
+	if summary.Documents == nil {
+		summary.Documents = []string{}
+	}
+	s.documents.View(func(tx DocumentTx) {
+		summary.Grants = len(tx.grantedTo(userID, time.Now()))
+		tx.each(func(_ string, record documentRecord) {
+			for _, note := range record.Notes {
+				if note.AuthorID == userID {
+					summary.Notes++
+				}
+			}
+		})
+	})
+
+	connectorMutex.Lock()
+	for _, link := range connectorLinks {
+		if link.UserID == userID {
+			summary.ConnectorLinks++
+		}
+	}
+	connectorMutex.Unlock()
+
+	jobMutex.RLock()
+	for _, job := range jobs {
+		if job.UserID == userID {
+			summary.Jobs++
+		}
+	}
+	jobMutex.RUnlock()
+
+	notificationMutex.Lock()
+	summary.Notifications = len(notifications[userID])
+	notificationMutex.Unlock()
+
+	savedQueryMutex.Lock()
+	err := refreshSavedQueries()
+	for _, query := range savedQueries {
+		if query.OwnerID == userID {
+			summary.SavedQueries++
+		}
+	}
+	savedQueryMutex.Unlock()
+	if err != nil {
+		return MergeSummary{}, err
+	}
+
+	conversationMutex.Lock()
+	err = refreshConversations()
+	for _, conversation := range conversations {
+		if conversation.OwnerID == userID || conversation.Members[userID] != "" {
+			summary.Conversations++
+		}
+	}
+	conversationMutex.Unlock()
+	if err != nil {
+		return MergeSummary{}, err
+	}
+
+	s.users.Each(func(user *User) {
+		if user.ReferredBy == userID {
+			summary.Referrals++
+		}
+	})
+
+	history, err := loginHistory(userID)
+	if err != nil {
+		return MergeSummary{}, err
+	}
+	summary.Logins = len(history)
+	alerts, err := securityAlerts()
+	if err != nil {
+		return MergeSummary{}, err
+	}
+	for _, alert := range alerts {
+		if alert.UserID == userID {
+			summary.SecurityAlerts++
+		}
+	}
+	return summary, nil
+}
+
+// mergeSettings fills in the plan, org and referrer target has once source
+// is merged into it. The target keeps its own and takes the source's where
+// it has none; within one org it keeps the stronger role. Outside org mode
+// a second org is ignored, as orgOf ignores both. A referral between the
+// two accounts is dropped.
+func mergeSettings(summary *MergeSummary, target, source *User) error {
+	summary.Plan, summary.ReferredBy = target.Plan, target.ReferredBy
+	if summary.Plan == "" {
+		summary.Plan = source.Plan
+	}
+	if summary.ReferredBy == "" {
+		summary.ReferredBy = source.ReferredBy
+	}
+	if summary.ReferredBy == source.ID || summary.ReferredBy == target.ID {
+		summary.ReferredBy = ""
+	}
+
+	summary.OrgID, summary.OrgRole = target.OrgID, target.OrgRole
+	switch {
+	case source.OrgID == "":
+	case target.OrgID == "":
+		summary.OrgID, summary.OrgRole = source.OrgID, source.OrgRole
+	case source.OrgID != target.OrgID:
+		if orgModeOn() {
+			return errMergeAcrossOrgs
+		}
+	case source.OrgRole == OrgRoleManager:
+		summary.OrgRole = OrgRoleManager
+	}
+	return nil
+}
+
+// applyMergeSettings gives target the plan, org and referrer mergeSettings
+// chose
+func (s *Service) applyMergeSettings(target *User, summary MergeSummary) error {
+	lock := s.users.FieldLock(target)
+	lock.Lock()
+	previous := *target
+	target.Plan, target.OrgID, target.OrgRole = summary.Plan, summary.OrgID, summary.OrgRole
+	target.ReferredBy = summary.ReferredBy
+	if target.Plan == previous.Plan && target.OrgID == previous.OrgID && target.OrgRole == previous.OrgRole &&
+		target.ReferredBy == previous.ReferredBy {
+		lock.Unlock()
+		return nil
+	}
+	target.UpdatedAt = time.Now()
+	err := saveUser(target)
+	if err != nil {
+		*target = previous
+	}
+	lock.Unlock()
+	if err != nil {
+		return err
+	}
+	bumpUserVersion()
+	bumpDocVersion() // the target's org-wide pool may have changed
+	return nil
+}
+
+// moveReferrals credits toID with the signups fromID's referral code
+// brought
+func (s *Service) moveReferrals(fromID, toID string) {
+	var referred []*User
+	s.users.Each(func(user *User) {
+		if user.ReferredBy == fromID && user.ID != toID {
+			referred = append(referred, user)
+		}
+	})
+	for _, user := range referred {
+		lock := s.users.FieldLock(user)
+		lock.Lock()
+		user.ReferredBy = toID
+		if err := saveUser(user); err != nil {
+			user.ReferredBy = fromID
+			slog.Warn("Merged referral not moved", "user_id", user.ID, "error", err)
+		}
+		lock.Unlock()
+	}
+	if len(referred) > 0 {
+		bumpUserVersion()
+	}
+}
+
+// tombstone closes a merged-away account, keeping its email reserved
+func (s *Service) tombstone(user *User, mergedInto string) error {
+	if err := s.SetPhone(user, ""); err != nil {
+		return err
+	}
+	lock := s.users.FieldLock(user)
+	lock.Lock()
+	previous := *user
+	user.Status, user.MergedInto, user.Password = UserMerged, mergedInto, ""
+	user.UpdatedAt = time.Now()
+	err := saveUser(user)
+	if err != nil {
+		*user = previous
+	}
+	lock.Unlock()
+	if err != nil {
+		return err
+	}
+	forgetUserTokens(user.ID)
+	bumpUserVersion()
+	return nil
+}
+
+// moveDocuments gives every document fromID owns to toID, renaming those
+// whose names toID has already
+func (s *Service) moveDocuments(fromID, toID string) error {
+	return s.documents.Update(func(tx DocumentTx) error {
+		for _, filename := range tx.ownedBy(fromID) {
+			if err := transferSharedDocument(filename, fromID, toID); err != nil {
+				return err
+			}
+			record, _ := tx.get(filename)
+			name := freeName(tx, toID, record.Name)
+			record.Owner = toID
+			if name != record.Name {
+				record.Name = name
+				saveDocumentMeta(filename, documentMeta(record))
+			}
+			tx.put(filename, record)
+		}
+		bumpDocVersion()
+		return nil
+	})
+}
+
+// moveGrants gives toID the unexpired grants fromID holds, keeping the
+// later expiry where both hold one, and drops grants that would be to a
+// document toID now owns
+func (s *Service) moveGrants(fromID, toID string) {
+	s.documents.Update(func(tx DocumentTx) error {
+		now := time.Now()
+		for filename, until := range tx.grantedTo(fromID, now) {
+			record, _ := tx.get(filename)
+			grants := withGrant(record.Grants, fromID, time.Time{})
+			if record.Owner != toID && until.After(grants[toID]) {
+				grants = withGrant(grants, toID, until)
+			}
+			record.Grants = grants
+			tx.put(filename, record)
+			saveDocumentMeta(filename, documentMeta(record))
+		}
+		for _, filename := range tx.ownedBy(toID) {
+			if record, _ := tx.get(filename); !record.Grants[toID].IsZero() {
+				record.Grants = withGrant(record.Grants, toID, time.Time{})
+				tx.put(filename, record)
+				saveDocumentMeta(filename, documentMeta(record))
+			}
+		}
+		bumpDocVersion()
+		return nil
+	})
+}
+
+// moveNotes makes toID the author of fromID's notes, keeping their
+// visibility, so private ones stay private to the merged account
+func (s *Service) moveNotes(fromID, toID string) {
+	s.documents.Update(func(tx DocumentTx) error {
+		var annotated []string
+		tx.each(func(filename string, record documentRecord) {
+			if slices.ContainsFunc(record.Notes, func(note DocumentNote) bool { return note.AuthorID == fromID }) {
+				annotated = append(annotated, filename)
+			}
+		})
+		for _, filename := range annotated {
+			record, _ := tx.get(filename)
+			notes := slices.Clone(record.Notes)
+			for i := range notes {
+				if notes[i].AuthorID == fromID {
+					notes[i].AuthorID = toID
+				}
+			}
+			saveNotes(tx, filename, record, notes)
+		}
+		return nil
+	})
+}
+
+// moveStars adds the documents source starred to target's stars, up to
+// maxStarredDocuments, and clears source's
+func (s *Service) moveStars(source, target *User) error {
+	sourceLock := s.users.FieldLock(source)
+	sourceLock.Lock()
+	starred := source.Starred
+	source.Starred = nil
+	if err := saveUser(source); err != nil {
+		source.Starred = starred
+		sourceLock.Unlock()
+		return err
+	}
+	sourceLock.Unlock()
+
+	lock := s.users.FieldLock(target)
+	lock.Lock()
+	defer lock.Unlock()
+	previous := target.Starred
+	merged := slices.Clone(previous)
+	for _, filename := range starred {
+		if len(merged) < maxStarredDocuments && !slices.Contains(merged, filename) {
+			merged = append(merged, filename)
+		}
+	}
+	if len(merged) == len(previous) {
+		return nil
+	}
+	target.Starred = merged
+	if err := saveUser(target); err != nil {
+		target.Starred = previous
+		return err
+	}
+	return nil
+}
+
+// moveDevices adds source's devices to target's without their remembered
+// sessions, which belonged to source's tokens. A device both accounts
+// used is kept once, with the longer trust; past maxDevicesPerUser the
+// devices seen longest ago are forgotten.
+func (s *Service) moveDevices(source, target *User) error {
+	sourceLock := s.users.FieldLock(source)
+	sourceLock.Lock()
+	devices := source.Devices
+	source.Devices = nil
+	if err := saveUser(source); err != nil {
+		source.Devices = devices
+		sourceLock.Unlock()
+		return err
+	}
+	sourceLock.Unlock()
+	if len(devices) == 0 {
+		return nil
+	}
+
+	lock := s.users.FieldLock(target)
+	lock.Lock()
+	defer lock.Unlock()
+	previous := target.Devices
+	merged := slices.Clone(previous)
+	for _, device := range devices {
+		device.RememberedUntil, device.RefreshHash = nil, ""
+		i := slices.IndexFunc(merged, func(d Device) bool { return d.Fingerprint == device.Fingerprint })
+		if i < 0 {
+			merged = append(merged, device)
+			continue
+		}
+		if device.TrustedUntil != nil && (merged[i].TrustedUntil == nil || device.TrustedUntil.After(*merged[i].TrustedUntil)) {
+			merged[i].TrustedUntil = device.TrustedUntil
+		}
+		if device.FirstSeenAt.Before(merged[i].FirstSeenAt) {
+			merged[i].FirstSeenAt = device.FirstSeenAt
+		}
+	}
+	if len(merged) > maxDevicesPerUser {
+		sort.SliceStable(merged, func(i, j int) bool { return merged[i].LastSeenAt.After(merged[j].LastSeenAt) })
+		merged = merged[:maxDevicesPerUser]
+	}
+	target.Devices = merged
+	if err := saveUser(target); err != nil {
+		target.Devices = previous
+		return err
+	}
+	return nil
+}
+
+// moveUserRecords moves the per-user records kept outside the user store:
+// recent documents, connector links, jobs, notifications, sign-in history,
+// security alerts, saved queries and conversations
+func moveUserRecords(fromID, toID, toEmail string) {
+	recentDocumentMutex.Lock()
+	recent := append(recentDocuments[toID], recentDocuments[fromID]...)
+	sort.SliceStable(recent, func(i, j int) bool { return recent[i].AccessedAt.After(recent[j].AccessedAt) })
+	kept := make([]RecentDocument, 0, maxRecentDocuments)
+	for _, r := range recent {
+		if len(kept) < maxRecentDocuments && !slices.ContainsFunc(kept, func(k RecentDocument) bool { return k.Filename == r.Filename }) {
+			kept = append(kept, r)
+		}
+	}
+	if len(kept) > 0 {
+		recentDocuments[toID] = kept
+	}
+	delete(recentDocuments, fromID)
+	recentDocumentMutex.Unlock()
+
+	connectorMutex.Lock()
+	for _, link := range connectorLinks {
+		if link.UserID == fromID {
+			link.UserID = toID
+		}
+	}
+	connectorMutex.Unlock()
+
+	jobMutex.Lock()
+	for _, job := range jobs {
+		if job.UserID == fromID {
+			job.UserID = toID
+			if err := jobStore.save(job); err != nil {
+				slog.Warn("Merged job not saved", "job_id", job.ID, "error", err)
+			}
+		}
+	}
+	jobMutex.Unlock()
+
+	notificationMutex.Lock()
+	inbox := append(notifications[toID], notifications[fromID]...)
+	sort.SliceStable(inbox, func(i, j int) bool { return inbox[i].CreatedAt.Before(inbox[j].CreatedAt) })
+	if len(inbox) > maxNotificationsPerUser {
+		inbox = inbox[len(inbox)-maxNotificationsPerUser:]
+	}
+	if len(inbox) > 0 {
+		notifications[toID] = inbox
+	}
+	delete(notifications, fromID)
+	notificationMutex.Unlock()
+
+	if err := moveLoginHistory(fromID, toID); err != nil {
+		slog.Warn("Merged sign-in history not moved", "source", fromID, "error", err)
+	}
+	alerts, err := securityAlerts()
+	if err != nil {
+		slog.Warn("Merged security alerts not moved", "source", fromID, "error", err)
+	}
+	for _, alert := range alerts {
+		if alert.UserID == fromID {
+			alert.UserID, alert.Email = toID, toEmail
+			if err := saveSecurityAlert(alert); err != nil {
+				slog.Warn("Merged security alert not saved", "alert_id", alert.ID, "error", err)
+			}
+		}
+	}
+
+	if err := moveSavedQueries(fromID, toID); err != nil {
+		slog.Warn("Merged saved queries not moved", "source", fromID, "error", err)
+	}
+	if err := moveConversations(fromID, toID); err != nil {
+		slog.Warn("Merged conversations not moved", "source", fromID, "error", err)
+	}
+}
+
+// moveLoginHistory folds fromID's sign-ins into toID's, keeping the latest
+func moveLoginHistory(fromID, toID string) error {
+	release, err := loginHistoryLock(toID)
+	if err != nil {
+		return err
+	}
+	defer release()
+	from, err := loginHistory(fromID)
+	if err != nil || len(from) == 0 {
+		return err
+	}
+	to, err := loginHistory(toID)
+	if err != nil {
+		return err
+	}
+	history := append(to, from...)
+	sort.SliceStable(history, func(i, j int) bool { return history[i].At.Before(history[j].At) })
+	if err := saveLoginHistory(toID, history); err != nil {
+		return err
+	}
+	return saveLoginHistory(fromID, nil)
+}
+
+// moveSavedQueries hands fromID's saved queries to toID. The scheduler
+// skips queries of inactive owners, so the source's would never run again;
+// the target may end up above maxSavedQueries and can't add more until it
+// deletes some.
+func moveSavedQueries(fromID, toID string) error {
+	savedQueryMutex.Lock()
+	err := refreshSavedQueries()
+	var ids []string
+	for id, query := range savedQueries {
+		if query.OwnerID == fromID {
+			ids = append(ids, id)
+		}
+	}
+	savedQueryMutex.Unlock()
+	if err != nil {
+		return err
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		if err := moveSavedQuery(id, fromID, toID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// moveSavedQuery gives one of fromID's queries to toID under its lock
+func moveSavedQuery(id, fromID, toID string) error {
+	release, err := savedQueryLock(id)
+	if err != nil {
+		return err
+	}
+	defer release()
+	savedQueryMutex.Lock()
+	defer savedQueryMutex.Unlock()
+	if err := refreshSavedQuery(id); err != nil {
+		return err
+	}
+	query, exists := savedQueries[id]
+	if !exists || query.OwnerID != fromID {
+		return nil
+	}
+	query.OwnerID = toID
+	return persistSavedQuery(query)
+}
+
+// moveConversations hands fromID's conversations to toID, along with its
+// turns and its memberships; where both were members toID keeps the
+// stronger role, and a membership in toID's own conversation is dropped
+func moveConversations(fromID, toID string) error {
+	conversationMutex.Lock()
+	err := refreshConversations()
+	var ids []string
+	for id, conversation := range conversations {
+		if conversation.OwnerID == fromID || conversation.Members[fromID] != "" ||
+			slices.ContainsFunc(conversation.Turns, func(turn ConversationTurn) bool { return turn.AuthorID == fromID }) {
+			ids = append(ids, id)
+		}
+	}
+	conversationMutex.Unlock()
+	if err != nil {
+		return err
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		if err := moveConversation(id, fromID, toID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// moveConversation moves one conversation's share of fromID to toID under
+// its lock
+func moveConversation(id, fromID, toID string) error {
+	release, err := conversationLock(id)
+	if err != nil {
+		return err
+	}
+	defer release()
+	conversationMutex.Lock()
+	defer conversationMutex.Unlock()
+	if err := refreshConversation(id); err != nil {
+		return err
+	}
+	conversation, exists := conversations[id]
+	if !exists {
+		return nil
+	}
+	changed := false
+	if conversation.OwnerID == fromID {
+		conversation.OwnerID = toID
+		delete(conversation.Members, toID)
+		changed = true
+	}
+	if role := conversation.Members[fromID]; role != "" {
+		delete(conversation.Members, fromID)
+		if conversation.OwnerID != toID && conversation.Members[toID] != conversationCollaborator {
+			conversation.Members[toID] = role
+		}
+		changed = true
+	}
+	for i := range conversation.Turns {
+		if conversation.Turns[i].AuthorID == fromID {
+			conversation.Turns[i].AuthorID = toID
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	return persistConversation(conversation)
+}
+
+// userProfile reads a user's profile under its lock
+func (s *Service) userProfile(user *User) UserProfile {
+	snapshot := s.userSnapshot(user)
+	return toProfile(&snapshot)
+}
+
+// ----------------------------------------------------------------------------
+// Handlers
+// ----------------------------------------------------------------------------
+
+// mergeUser merges another account into :id (admin)
+func (s *Server) mergeUser(c *gin.Context) {
+	var req AdminMergeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondBindError(c, err)
+		return
+	}
+	target, source := s.svc.users.ByID(c.Param("id")), s.svc.users.ByID(req.SourceID)
+	if target == nil || source == nil {
+		respondError(c, http.StatusNotFound, codeNotFound, "User not found")
+		return
+	}
+	s.respondMerge(c, "admin.user.merge", target, source, req.DryRun)
+}
+
+// mergeOwnAccount merges an account the caller holds a token for into
+// their own
+func (s *Server) mergeOwnAccount(c *gin.Context) {
+	var req SelfMergeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondBindError(c, err)
+		return
+	}
+	source, err := s.svc.Authenticate(req.Token)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, codeInvalidToken, "The token for the account to merge is invalid")
+		return
+	}
+	user, _ := c.Get("user")
+	s.respondMerge(c, "user.merge", user.(*User), source, req.DryRun)
+}
+
+// respondMerge runs a merge and audits it unless it was a dry run
+func (s *Server) respondMerge(c *gin.Context, action string, target, source *User, dryRun bool) {
+	before := s.profileOf(source)
+	summary, err := s.svc.MergeUsers(target, source, dryRun)
+	switch err {
+	case nil:
+	case errMergeSameAccount:
+		respondError(c, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		return
+	case errAccountMerged:
+		respondError(c, http.StatusConflict, codeAccountMerged, err.Error())
+		return
+	case errMergeAcrossOrgs:
+		respondError(c, http.StatusConflict, codeConflict, err.Error())
+		return
+	default:
+		respondAdminUserError(c, err)
+		return
+	}
+	if !dryRun {
+		auditChange(c, action, "user:"+source.ID, before, summary.Source)
+	}
+	c.JSON(http.StatusOK, summary)
+}
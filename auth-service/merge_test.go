@@ -0,0 +1,402 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMergeOwnAccount(t *testing.T) {
+	resetNotifications(t)
+	ts := newTestServer(t)
+	target, targetID := ts.register("work@example.com")
+	_, sourceID := ts.register("home@example.com")
+	source := ts.login("home@example.com", "secret123", http.StatusOK)
+	ts.do(http.MethodPost, "/v1/documents/register", source, `{"filename":"taxes.pdf"}`)
+	ts.do(http.MethodPost, "/v1/documents/register", target, `{"filename":"plan.pdf"}`)
+	ts.do(http.MethodPost, "/v1/documents/register", source, `{"filename":"plan.pdf"}`) // filed as plan (2).pdf
+	notify(sourceID, "test", "Hello", "From the source account", nil)
+
+	w := ts.do(http.MethodPost, "/v1/users/me/merge", target, `{"token":"`+source+`","dry_run":true}`)
+	var preview MergeSummary
+	decodeJSON(t, w, &preview)
+	if w.Code != http.StatusOK || !preview.DryRun || len(preview.Documents) != 2 || preview.Documents[1] != "taxes.pdf" ||
+		preview.Notifications != 1 || preview.Logins == 0 || preview.Source.Status != UserActive {
+		t.Fatalf("dry run: %d %+v", w.Code, preview)
+	}
+	if owner := ts.srv.svc.DocumentOwner("taxes.pdf"); owner != sourceID {
+		t.Fatalf("dry run moved a document to %s", owner)
+	}
+
+	w = ts.do(http.MethodPost, "/v1/users/me/merge", target, `{"token":"`+source+`"}`)
+	var summary MergeSummary
+	decodeJSON(t, w, &summary)
+	if w.Code != http.StatusOK || summary.DryRun || summary.Source.Status != UserMerged || summary.Source.MergedInto != targetID {
+		t.Fatalf("merge: %d %s", w.Code, w.Body)
+	}
+	if docs := ts.srv.svc.DocumentsOf(targetID); len(docs) != 3 {
+		t.Fatalf("target documents = %v", docs)
+	}
+	// The source's plan.pdf is renamed among the target's
+	if names := ts.myNames(target); names["plan.pdf"] != "plan.pdf" || names["plan (2).pdf"] != "plan (2).pdf" {
+		t.Fatalf("target names = %v", names)
+	}
+	notificationMutex.Lock()
+	moved := len(notifications[targetID]) == 1 && len(notifications[sourceID]) == 0
+	notificationMutex.Unlock()
+	if !moved {
+		t.Fatal("notifications not moved")
+	}
+
+	// The source is closed: neither its token nor its password works
+	if w := ts.do(http.MethodGet, "/v1/users/me", source, ""); w.Code != http.StatusUnauthorized {
+		t.Fatalf("source token: got %d, want 401", w.Code)
+	}
+	w = ts.do(http.MethodPost, "/v1/auth/login", "", `{"email":"home@example.com","password":"secret123"}`)
+	if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), codeAccountMerged) {
+		t.Fatalf("source login: %d %s", w.Code, w.Body)
+	}
+	if w := ts.do(http.MethodPost, "/v1/users/me/merge", target, `{"token":"`+target+`"}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("merge into itself: got %d, want 400", w.Code)
+	}
+	if w := ts.do(http.MethodPost, "/v1/users/me/merge", target, `{"token":"not-a-token"}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("bad token: got %d, want 400", w.Code)
+	}
+}
+
+func TestAdminMergeUsers(t *testing.T) {
+	ts := newTestServer(t)
+	admin := ts.admin("admin@example.com")
+	_, targetID := ts.register("a@example.com")
+	_, sourceID := ts.register("b@example.com")
+	adminID := ts.srv.svc.users.ByEmail("admin@example.com").ID
+
+	if w := ts.do(http.MethodPost, "/v1/admin/users/"+targetID+"/merge", admin, `{"source_id":"missing"}`); w.Code != http.StatusNotFound {
+		t.Fatalf("unknown source: got %d, want 404", w.Code)
+	}
+	// Merging the only admin away would leave none
+	if w := ts.do(http.MethodPost, "/v1/admin/users/"+targetID+"/merge", admin, `{"source_id":"`+adminID+`","dry_run":true}`); w.Code != http.StatusConflict {
+		t.Fatalf("last admin: got %d, want 409", w.Code)
+	}
+
+	w := ts.do(http.MethodPost, "/v1/admin/users/"+targetID+"/merge", admin, `{"source_id":"`+sourceID+`"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("merge: %d %s", w.Code, w.Body)
+	}
+	w = ts.do(http.MethodPost, "/v1/admin/users/"+targetID+"/merge", admin, `{"source_id":"`+sourceID+`"}`)
+	if w.Code != http.StatusConflict || !strings.Contains(w.Body.String(), codeAccountMerged) {
+		t.Fatalf("merge twice: %d %s", w.Code, w.Body)
+	}
+	if w := ts.do(http.MethodPatch, "/v1/admin/users/"+sourceID, admin, `{"status":"active"}`); w.Code != http.StatusForbidden {
+		t.Fatalf("reactivate tombstone: got %d, want 403", w.Code)
+	}
+}
+
+func TestMergeMovesConversations(t *testing.T) {
+	ts := newTestServer(t)
+	useConversationStore(t)
+	admin := ts.admin("admin@example.com")
+	target, targetID := ts.register("a@example.com")
+	_, sourceID := ts.register("b@example.com")
+	_, otherID := ts.register("c@example.com")
+	svc := ts.srv.svc
+	targetUser, sourceUser, otherUser := svc.users.ByID(targetID), svc.users.ByID(sourceID), svc.users.ByID(otherID)
+
+	// The source's own thread, which the target could already view
+	own, _ := svc.CreateConversation(sourceUser, "Taxes")
+	if _, err := svc.AddTurn(own.ID, sourceUser, ConversationTurnRequest{Question: "Deadline?", Answer: "April"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := svc.ShareConversation(own.ID, sourceUser, targetUser, conversationViewer); err != nil {
+		t.Fatal(err)
+	}
+	// Someone else's thread shared with both, the source as a collaborator
+	shared, _ := svc.CreateConversation(otherUser, "Plans")
+	svc.ShareConversation(shared.ID, otherUser, sourceUser, conversationCollaborator)
+	svc.ShareConversation(shared.ID, otherUser, targetUser, conversationViewer)
+
+	var preview MergeSummary
+	decodeJSON(t, ts.do(http.MethodPost, "/v1/admin/users/"+targetID+"/merge", admin, `{"source_id":"`+sourceID+`","dry_run":true}`), &preview)
+	if preview.Conversations != 2 {
+		t.Fatalf("dry run: %+v", preview)
+	}
+	if w := ts.do(http.MethodPost, "/v1/admin/users/"+targetID+"/merge", admin, `{"source_id":"`+sourceID+`"}`); w.Code != http.StatusOK {
+		t.Fatalf("merge: %d %s", w.Code, w.Body)
+	}
+
+	var moved ConversationView
+	decodeJSON(t, ts.do(http.MethodGet, "/v1/conversations/"+own.ID, target, ""), &moved)
+	if moved.OwnerID != targetID || moved.Role != conversationOwner || len(moved.Members) != 0 ||
+		len(moved.Turns) != 1 || moved.Turns[0].AuthorID != targetID {
+		t.Fatalf("owned conversation: %+v", moved)
+	}
+	if err := svc.CanAddTurn(shared.ID, targetUser); err != nil {
+		t.Fatalf("shared conversation kept the viewer role: %v", err)
+	}
+	conversationMutex.Lock()
+	_, stillMember := conversations[shared.ID].Members[sourceID]
+	conversationMutex.Unlock()
+	if stillMember {
+		t.Fatal("source still a member")
+	}
+}
+
+func TestMergeMovesSavedQueries(t *testing.T) {
+	ts := newTestServer(t)
+	savedStore := savedQueryStore
+	savedQueryStore = jobFiles{dir: t.TempDir()}
+	t.Cleanup(func() {
+		savedQueryMutex.Lock()
+		savedQueries, savedQueryStore = make(map[string]*SavedQuery), savedStore
+		savedQueryMutex.Unlock()
+	})
+	admin := ts.admin("admin@example.com")
+	target, targetID := ts.register("a@example.com")
+	source, sourceID := ts.register("b@example.com")
+	body := `{"name":"HR digest","question":"What changed in HR policy?","schedule":{"frequency":"daily","hour":8}}`
+	w := ts.do(http.MethodPost, "/v1/saved-queries", source, body)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create: %d %s", w.Code, w.Body)
+	}
+	var query SavedQuery
+	decodeJSON(t, w, &query)
+
+	var preview MergeSummary
+	decodeJSON(t, ts.do(http.MethodPost, "/v1/admin/users/"+targetID+"/merge", admin, `{"source_id":"`+sourceID+`","dry_run":true}`), &preview)
+	if preview.SavedQueries != 1 {
+		t.Fatalf("dry run: %+v", preview)
+	}
+	if w := ts.do(http.MethodPost, "/v1/admin/users/"+targetID+"/merge", admin, `{"source_id":"`+sourceID+`"}`); w.Code != http.StatusOK {
+		t.Fatalf("merge: %d %s", w.Code, w.Body)
+	}
+
+	w = ts.do(http.MethodGet, "/v1/saved-queries/"+query.ID, target, "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("target reads the moved query: %d %s", w.Code, w.Body)
+	}
+	var moved SavedQuery
+	decodeJSON(t, w, &moved)
+	if moved.OwnerID != targetID || moved.NextRunAt == nil {
+		t.Fatalf("moved query: %+v", moved)
+	}
+}
+
+func TestMergeMovesNotes(t *testing.T) {
+	ts := newTestServer(t)
+	admin := ts.admin("admin@example.com")
+	target, targetID := ts.register("a@example.com")
+	source, sourceID := ts.register("b@example.com")
+	ts.do(http.MethodPost, "/v1/documents/register", target, `{"filename":"plan.pdf"}`)
+	ts.do(http.MethodPut, "/v1/admin/documents/plan.pdf/scope", admin, `{"scope":"org"}`)
+	if w := ts.do(http.MethodPost, "/v1/documents/plan.pdf/notes", source, `{"body":"see page 2"}`); w.Code != http.StatusCreated {
+		t.Fatalf("add note: %d %s", w.Code, w.Body)
+	}
+
+	var preview MergeSummary
+	decodeJSON(t, ts.do(http.MethodPost, "/v1/admin/users/"+targetID+"/merge", admin, `{"source_id":"`+sourceID+`","dry_run":true}`), &preview)
+	if preview.Notes != 1 {
+		t.Fatalf("dry run: %+v", preview)
+	}
+	if w := ts.do(http.MethodPost, "/v1/admin/users/"+targetID+"/merge", admin, `{"source_id":"`+sourceID+`"}`); w.Code != http.StatusOK {
+		t.Fatalf("merge: %d %s", w.Code, w.Body)
+	}
+
+	// The private note is now the target's, which sees and edits it
+	var notes struct {
+		Notes []DocumentNote `json:"notes"`
+	}
+	decodeJSON(t, ts.do(http.MethodGet, "/v1/documents/plan.pdf/notes", target, ""), &notes)
+	if len(notes.Notes) != 1 || notes.Notes[0].AuthorID != targetID {
+		t.Fatalf("notes after merge: %+v", notes.Notes)
+	}
+	path := "/v1/documents/plan.pdf/notes/" + notes.Notes[0].ID
+	if w := ts.do(http.MethodPatch, path, target, `{"body":"see page 3"}`); w.Code != http.StatusOK {
+		t.Fatalf("edit moved note: %d %s", w.Code, w.Body)
+	}
+}
+
+func TestMergeMovesStarsAndRecents(t *testing.T) {
+	ts := newTestServer(t)
+	t.Cleanup(func() {
+		recentDocumentMutex.Lock()
+		recentDocuments = make(map[string][]RecentDocument)
+		recentDocumentMutex.Unlock()
+	})
+	admin := ts.admin("admin@example.com")
+	target, targetID := ts.register("a@example.com")
+	source, sourceID := ts.register("b@example.com")
+	for _, filename := range []string{"a.pdf", "b.pdf"} {
+		ts.do(http.MethodPost, "/v1/documents/register", target, `{"filename":"`+filename+`"}`)
+		ts.do(http.MethodPut, "/v1/admin/documents/"+filename+"/scope", admin, `{"scope":"org"}`)
+	}
+	ts.do(http.MethodPost, "/v1/documents/a.pdf/star", target, "")
+	ts.do(http.MethodPost, "/v1/documents/a.pdf/star", source, "")
+	ts.do(http.MethodPost, "/v1/documents/b.pdf/star", source, "")
+	now := time.Now()
+	touchDocuments(targetID, []string{"a.pdf"}, now.Add(-time.Hour))
+	touchDocuments(sourceID, []string{"b.pdf", "a.pdf"}, now)
+
+	var preview MergeSummary
+	decodeJSON(t, ts.do(http.MethodPost, "/v1/admin/users/"+targetID+"/merge", admin, `{"source_id":"`+sourceID+`","dry_run":true}`), &preview)
+	if preview.Starred != 2 {
+		t.Fatalf("dry run: %+v", preview)
+	}
+	if w := ts.do(http.MethodPost, "/v1/admin/users/"+targetID+"/merge", admin, `{"source_id":"`+sourceID+`"}`); w.Code != http.StatusOK {
+		t.Fatalf("merge: %d %s", w.Code, w.Body)
+	}
+
+	if starred := ts.srv.svc.StarredDocuments(ts.srv.svc.users.ByID(targetID)); len(starred) != 2 || starred[0] != "b.pdf" {
+		t.Fatalf("starred after merge: %v", starred)
+	}
+	if starred := ts.srv.svc.users.ByID(sourceID).Starred; len(starred) != 0 {
+		t.Fatalf("source kept its stars: %v", starred)
+	}
+	recent := ts.srv.svc.RecentDocuments(ts.srv.svc.users.ByID(targetID))
+	if len(recent) != 2 || recent[0].Filename != "b.pdf" || !recent[1].AccessedAt.Equal(now) {
+		t.Fatalf("recent after merge: %+v", recent)
+	}
+}
+
+func TestMergeMovesGrants(t *testing.T) {
+	ts := newTestServer(t)
+	admin := ts.admin("admin@example.com")
+	target, targetID := ts.register("a@example.com")
+	source, sourceID := ts.register("b@example.com")
+	owner, _ := ts.register("owner@example.com")
+	ts.do(http.MethodPost, "/v1/documents/register", owner, `{"filename":"draft.pdf"}`)
+	ts.do(http.MethodPost, "/v1/documents/register", source, `{"filename":"notes.pdf"}`)
+
+	soon, later := time.Now().UTC().Add(time.Hour), time.Now().UTC().Add(48*time.Hour)
+	grant := func(token, filename, email string, until time.Time) {
+		t.Helper()
+		body := `{"email":"` + email + `","expires_at":"` + until.Format(time.RFC3339) + `"}`
+		if w := ts.do(http.MethodPost, "/v1/documents/"+filename+"/grants", token, body); w.Code != http.StatusCreated {
+			t.Fatalf("grant %s: %d %s", filename, w.Code, w.Body)
+		}
+	}
+	grant(owner, "draft.pdf", "a@example.com", soon)
+	grant(owner, "draft.pdf", "b@example.com", later)
+	grant(source, "notes.pdf", "a@example.com", later)
+
+	var preview MergeSummary
+	decodeJSON(t, ts.do(http.MethodPost, "/v1/admin/users/"+targetID+"/merge", admin, `{"source_id":"`+sourceID+`","dry_run":true}`), &preview)
+	if preview.Grants != 1 {
+		t.Fatalf("dry run: %+v", preview)
+	}
+	if w := ts.do(http.MethodPost, "/v1/admin/users/"+targetID+"/merge", admin, `{"source_id":"`+sourceID+`"}`); w.Code != http.StatusOK {
+		t.Fatalf("merge: %d %s", w.Code, w.Body)
+	}
+
+	// The target keeps the later of the two grants on draft.pdf, and its
+	// grant on notes.pdf goes now that it owns the document
+	var shared struct {
+		Documents []DocumentGrant `json:"documents"`
+	}
+	decodeJSON(t, ts.do(http.MethodGet, "/v1/documents/shared", target, ""), &shared)
+	if len(shared.Documents) != 1 || shared.Documents[0].Filename != "draft.pdf" ||
+		!shared.Documents[0].ExpiresAt.Equal(later.Truncate(time.Second)) {
+		t.Fatalf("shared with target: %+v", shared.Documents)
+	}
+	ts.srv.svc.documents.View(func(tx DocumentTx) {
+		draft, _ := tx.get("draft.pdf")
+		notes, _ := tx.get("notes.pdf")
+		if _, kept := draft.Grants[sourceID]; kept || len(notes.Grants) != 0 {
+			t.Errorf("grants left behind: draft %v, notes %v", draft.Grants, notes.Grants)
+		}
+	})
+}
+
+func TestMergeMovesDevices(t *testing.T) {
+	ts := newTestServer(t)
+	admin := ts.admin("admin@example.com")
+	_, targetID := ts.register("a@example.com")
+	_, sourceID := ts.register("b@example.com")
+	_, target := ts.loginFrom("a@example.com", chromeOnMac)
+	_, source := ts.loginFrom("b@example.com", chromeOnMac)
+	chrome := ts.devices(source, chromeOnMac)[0]
+	if w := ts.do(http.MethodPatch, "/v1/users/me/devices/"+chrome.ID, source, `{"trusted":true}`); w.Code != http.StatusOK {
+		t.Fatalf("trust: %d %s", w.Code, w.Body)
+	}
+	_, refresh := ts.rememberLogin("b@example.com")
+
+	var preview MergeSummary
+	decodeJSON(t, ts.do(http.MethodPost, "/v1/admin/users/"+targetID+"/merge", admin, `{"source_id":"`+sourceID+`","dry_run":true}`), &preview)
+	if preview.Devices != 2 {
+		t.Fatalf("dry run: %+v", preview)
+	}
+	if w := ts.do(http.MethodPost, "/v1/admin/users/"+targetID+"/merge", admin, `{"source_id":"`+sourceID+`"}`); w.Code != http.StatusOK {
+		t.Fatalf("merge: %d %s", w.Code, w.Body)
+	}
+
+	// The shared browser is listed once and keeps the source's trust; the
+	// source's remembered session doesn't come along
+	devices := ts.devices(target, chromeOnMac)
+	if len(devices) != 2 {
+		t.Fatalf("devices after merge: %+v", devices)
+	}
+	for _, device := range devices {
+		if device.Current && !device.Trusted {
+			t.Errorf("shared browser lost its trust: %+v", device)
+		}
+		if device.RememberedUntil != nil {
+			t.Errorf("remembered session moved: %+v", device)
+		}
+	}
+	if status, _, _ := ts.refresh(refresh); status == http.StatusOK {
+		t.Fatal("the source's refresh token still works")
+	}
+	if left := ts.srv.svc.users.ByID(sourceID).Devices; len(left) != 0 {
+		t.Fatalf("source kept devices: %+v", left)
+	}
+}
+
+func TestMergeKeepsPlanOrgAndReferrals(t *testing.T) {
+	useOrgs(t)
+	ts := newTestServer(t)
+	admin := ts.admin("admin@example.com")
+	_, targetID := ts.register("work@example.com")
+	_, sourceID := ts.register("home@example.com")
+	_, friendID := ts.register("friend@example.com")
+	_, rivalID := ts.register("rival@example.com")
+	target, source := ts.srv.svc.users.ByID(targetID), ts.srv.svc.users.ByID(sourceID)
+	friend, rival := ts.srv.svc.users.ByID(friendID), ts.srv.svc.users.ByID(rivalID)
+	target.OrgID = "acme"
+	source.Plan, source.OrgID, source.OrgRole, source.ReferredBy = "pro", "acme", OrgRoleManager, friendID
+	friend.ReferredBy = sourceID
+	rival.OrgID = "globex"
+	merge := func(targetID, sourceID string, dryRun bool) *httptest.ResponseRecorder {
+		return ts.do(http.MethodPost, "/v1/admin/users/"+targetID+"/merge", admin,
+			fmt.Sprintf(`{"source_id":%q,"dry_run":%t}`, sourceID, dryRun))
+	}
+
+	// Accounts in two orgs stay apart
+	if w := merge(targetID, rivalID, true); w.Code != http.StatusConflict {
+		t.Fatalf("across orgs: got %d, want 409", w.Code)
+	}
+
+	// The preview shows what the target ends up with: its own where set,
+	// the source's elsewhere, and the stronger role in a shared org
+	var preview MergeSummary
+	decodeJSON(t, merge(targetID, sourceID, true), &preview)
+	if preview.Plan != "pro" || preview.OrgID != "acme" || preview.OrgRole != OrgRoleManager ||
+		preview.ReferredBy != friendID || preview.Referrals != 1 {
+		t.Fatalf("preview: %+v", preview)
+	}
+	if target.Plan != "" || friend.ReferredBy != sourceID {
+		t.Fatal("dry run changed the accounts")
+	}
+
+	if w := merge(targetID, sourceID, false); w.Code != http.StatusOK {
+		t.Fatalf("merge: %d %s", w.Code, w.Body)
+	}
+	if target.Plan != "pro" || target.OrgID != "acme" || target.OrgRole != OrgRoleManager || target.ReferredBy != friendID {
+		t.Fatalf("target after merge: %+v", target)
+	}
+	// The signup the source's code brought now counts for the target
+	if friend.ReferredBy != targetID {
+		t.Fatalf("friend referred by %q", friend.ReferredBy)
+	}
+}
@@ -0,0 +1,337 @@
+// Package migrations versions the schema of the auth service's MongoDB
+// shared store (cluster.mode mongo): its capped change feed and its
+// indexes. The Redis store is plain keys and needs none.
+//
+// Migrations are embedded in the binary as mongo/NNNN_name.up.json and
+// NNNN_name.down.json, each a JSON array of database commands in MongoDB
+// extended JSON, run in order with runCommand (the golang-migrate MongoDB
+// format). The database records its version and a dirty flag in the
+// schema_migrations collection; a migration that fails part way leaves the
+// version dirty, and nothing more runs until an operator has repaired the
+// database and set the version with Force.
+//
+// Commands should be safe to repeat. Creating a collection that exists and
+// dropping a collection or index that doesn't are not errors, so the first
+// migration adopts databases that were set up before versioning existed.
+// Runs take a lock in schema_migrations, so replicas starting together
+// apply each migration once.
+package migrations
+
+import (
+	"context"
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+const (
+	// Collection is where the version and the run lock are kept
+	Collection = "schema_migrations"
+
+	versionID = "version"
+	lockID    = "lock"
+
+	// lockTTL bounds how long a crashed run blocks others
+	lockTTL       = 10 * time.Minute
+	lockRetryWait = 500 * time.Millisecond
+
+	// Server error codes that mean a command's work is already done
+	codeNamespaceNotFound = 26
+	codeIndexNotFound     = 27
+	codeNamespaceExists   = 48
+)
+
+//go:embed mongo/*.json
+var embedded embed.FS
+
+// ErrDirty means an earlier run failed part way through a migration
+var ErrDirty = errors.New("schema is dirty after a failed migration; repair it and force the version")
+
+// Migration is one schema change and its inverse
+type Migration struct {
+	Version int
+	Name    string
+	up      []bson.D
+	down    []bson.D
+}
+
+// Status is where a database stands against the known migrations
+type Status struct {
+	Current int  `json:"current_version"`
+	Latest  int  `json:"latest_version"`
+	Pending int  `json:"pending"`
+	Dirty   bool `json:"dirty"`
+}
+
+// Ready reports whether the database is at the latest version and clean
+func (s Status) Ready() bool {
+	return s.Pending == 0 && !s.Dirty
+}
+
+// Embedded returns the migrations built into the binary
+func Embedded() ([]Migration, error) {
+	return Load(embedded, "mongo")
+}
+
+// Load reads migrations from dir in fsys. Versions must start at 1 and be
+// consecutive, and every version needs an up file; a missing down file
+// makes that migration irreversible.
+func Load(fsys fs.FS, dir string) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+	byVersion := make(map[int]*Migration)
+	for _, entry := range entries {
+		name := entry.Name()
+		var direction string
+		switch {
+		case strings.HasSuffix(name, ".up.json"):
+			direction = "up"
+		case strings.HasSuffix(name, ".down.json"):
+			direction = "down"
+		default:
+			continue
+		}
+		prefix, label, _ := strings.Cut(strings.TrimSuffix(name, "."+direction+".json"), "_")
+		version, err := strconv.Atoi(prefix)
+		if err != nil || version <= 0 {
+			return nil, fmt.Errorf("%s: name must start with a positive version number", name)
+		}
+		raw, err := fs.ReadFile(fsys, path.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+		commands, err := parseCommands(raw)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+
+		migration, exists := byVersion[version]
+		if !exists {
+			migration = &Migration{Version: version, Name: label}
+			byVersion[version] = migration
+		} else if migration.Name != label {
+			return nil, fmt.Errorf("version %d is used by both %q and %q", version, migration.Name, label)
+		}
+		if direction == "up" {
+			migration.up = commands
+		} else {
+			migration.down = commands
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, migration := range byVersion {
+		migrations = append(migrations, *migration)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	for i, migration := range migrations {
+		if migration.Version != i+1 {
+			return nil, fmt.Errorf("missing migration version %d", i+1)
+		}
+		if migration.up == nil {
+			return nil, fmt.Errorf("version %d has no up migration", migration.Version)
+		}
+	}
+	return migrations, nil
+}
+
+// parseCommands reads a JSON array of extended JSON command documents,
+// keeping each document's key order (the command name comes first)
+func parseCommands(raw []byte) ([]bson.D, error) {
+	var items []json.RawMessage
+	if err := json.Unmarshal(raw, &items); err != nil {
+		return nil, fmt.Errorf("not a JSON array of commands: %w", err)
+	}
+	commands := make([]bson.D, 0, len(items))
+	for i, item := range items {
+		var command bson.D
+		if err := bson.UnmarshalExtJSON(item, false, &command); err != nil {
+			return nil, fmt.Errorf("command %d: %w", i+1, err)
+		}
+		if len(command) == 0 {
+			return nil, fmt.Errorf("command %d is empty", i+1)
+		}
+		commands = append(commands, command)
+	}
+	return commands, nil
+}
+
+// Runner applies migrations to one database
+type Runner struct {
+	db         *mongo.Database
+	migrations []Migration
+}
+
+// NewRunner returns a runner for db with the given migrations, usually
+// Embedded()
+func NewRunner(db *mongo.Database, migrations []Migration) *Runner {
+	return &Runner{db: db, migrations: migrations}
+}
+
+// versionRecord is the schema_migrations entry holding the version
+type versionRecord struct {
+	Version   int       `bson:"version"`
+	Dirty     bool      `bson:"dirty"`
+	UpdatedAt time.Time `bson:"updated_at"`
+}
+
+// Status reads the database's version
+func (r *Runner) Status(ctx context.Context) (Status, error) {
+	record, err := r.version(ctx)
+	if err != nil {
+		return Status{}, err
+	}
+	latest := len(r.migrations)
+	return Status{Current: record.Version, Latest: latest, Pending: max(latest-record.Version, 0), Dirty: record.Dirty}, nil
+}
+
+// Up applies every pending migration and returns the ones it applied
+func (r *Runner) Up(ctx context.Context) ([]Migration, error) {
+	var applied []Migration
+	err := r.locked(ctx, func(current int) error {
+		for _, migration := range r.migrations[min(current, len(r.migrations)):] {
+			if err := r.apply(ctx, migration.Version, migration.up, migration.Version); err != nil {
+				return fmt.Errorf("migration %d (%s): %w", migration.Version, migration.Name, err)
+			}
+			applied = append(applied, migration)
+		}
+		return nil
+	})
+	return applied, err
+}
+
+// Down reverts the latest steps migrations and returns the ones it
+// reverted, newest first
+func (r *Runner) Down(ctx context.Context, steps int) ([]Migration, error) {
+	var reverted []Migration
+	err := r.locked(ctx, func(current int) error {
+		if current > len(r.migrations) {
+			return fmt.Errorf("database is at version %d, newer than this binary knows (%d)", current, len(r.migrations))
+		}
+		for ; steps > 0 && current > 0; steps-- {
+			migration := r.migrations[current-1]
+			if migration.down == nil {
+				return fmt.Errorf("migration %d (%s) cannot be reverted", migration.Version, migration.Name)
+			}
+			if err := r.apply(ctx, migration.Version, migration.down, current-1); err != nil {
+				return fmt.Errorf("reverting migration %d (%s): %w", migration.Version, migration.Name, err)
+			}
+			reverted = append(reverted, migration)
+			current--
+		}
+		return nil
+	})
+	return reverted, err
+}
+
+// Force sets the version and clears the dirty flag without running
+// anything, after an operator has repaired a failed migration by hand
+func (r *Runner) Force(ctx context.Context, version int) error {
+	if version < 0 || version > len(r.migrations) {
+		return fmt.Errorf("version must be between 0 and %d", len(r.migrations))
+	}
+	return r.withLock(ctx, func() error {
+		return r.setVersion(ctx, version, false)
+	})
+}
+
+// locked runs fn under the lock with the current clean version
+func (r *Runner) locked(ctx context.Context, fn func(current int) error) error {
+	return r.withLock(ctx, func() error {
+		record, err := r.version(ctx)
+		if err != nil {
+			return err
+		}
+		if record.Dirty {
+			return fmt.Errorf("version %d: %w", record.Version, ErrDirty)
+		}
+		return fn(record.Version)
+	})
+}
+
+// apply runs one migration's commands, marking the version dirty until
+// they have all succeeded and then recording target
+func (r *Runner) apply(ctx context.Context, version int, commands []bson.D, target int) error {
+	if err := r.setVersion(ctx, version, true); err != nil {
+		return err
+	}
+	for i, command := range commands {
+		if err := r.db.RunCommand(ctx, command).Err(); err != nil && !alreadyDone(command, err) {
+			return fmt.Errorf("command %d (%s): %w", i+1, command[0].Key, err)
+		}
+	}
+	return r.setVersion(ctx, target, false)
+}
+
+// alreadyDone reports whether err only says the command's effect is
+// already in place
+func alreadyDone(command bson.D, err error) bool {
+	var serverErr mongo.ServerError
+	if !errors.As(err, &serverErr) {
+		return false
+	}
+	switch command[0].Key {
+	case "create":
+		return serverErr.HasErrorCode(codeNamespaceExists)
+	case "drop", "dropIndexes":
+		return serverErr.HasErrorCode(codeNamespaceNotFound) || serverErr.HasErrorCode(codeIndexNotFound)
+	}
+	return false
+}
+
+// version reads the version record; a database never migrated is at 0
+func (r *Runner) version(ctx context.Context) (versionRecord, error) {
+	var record versionRecord
+	err := r.db.Collection(Collection).FindOne(ctx, bson.D{{Key: "_id", Value: versionID}}).Decode(&record)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return versionRecord{}, nil
+	}
+	return record, err
+}
+
+func (r *Runner) setVersion(ctx context.Context, version int, dirty bool) error {
+	_, err := r.db.Collection(Collection).ReplaceOne(ctx, bson.D{{Key: "_id", Value: versionID}},
+		versionRecord{Version: version, Dirty: dirty, UpdatedAt: time.Now().UTC()},
+		options.Replace().SetUpsert(true))
+	return err
+}
+
+// withLock runs fn while holding the migration lock, waiting for it until
+// ctx is done. A lock left by a crashed run lapses after lockTTL.
+func (r *Runner) withLock(ctx context.Context, fn func() error) error {
+	locks := r.db.Collection(Collection)
+	token := bson.NewObjectID().Hex()
+	for {
+		now := time.Now()
+		_, err := locks.UpdateOne(ctx,
+			bson.D{{Key: "_id", Value: lockID}, {Key: "expires_at", Value: bson.D{{Key: "$lte", Value: now}}}},
+			bson.D{{Key: "$set", Value: bson.D{{Key: "token", Value: token}, {Key: "expires_at", Value: now.Add(lockTTL)}}}},
+			options.UpdateOne().SetUpsert(true))
+		if err == nil {
+			break
+		}
+		if !mongo.IsDuplicateKeyError(err) {
+			return fmt.Errorf("take migration lock: %w", err)
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("take migration lock: %w", ctx.Err())
+		case <-time.After(lockRetryWait):
+		}
+	}
+	defer locks.DeleteOne(context.Background(), bson.D{{Key: "_id", Value: lockID}, {Key: "token", Value: token}})
+	return fn()
+}
@@ -0,0 +1,138 @@
+package migrations
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+func TestEmbedded(t *testing.T) {
+	migrations, err := Embedded()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(migrations) == 0 || migrations[0].Name != "initial" {
+		t.Fatalf("migrations = %+v", migrations)
+	}
+	for _, migration := range migrations {
+		if migration.down == nil {
+			t.Errorf("migration %d has no down file", migration.Version)
+		}
+	}
+	// The command name must stay the first key
+	if first := migrations[0].up[0][0].Key; first != "create" {
+		t.Fatalf("first command = %q; key order lost", first)
+	}
+}
+
+func TestLoadRejects(t *testing.T) {
+	for name, files := range map[string]fstest.MapFS{
+		"gap":          {"m/0001_a.up.json": {Data: []byte(`[]`)}, "m/0003_c.up.json": {Data: []byte(`[]`)}},
+		"no up":        {"m/0001_a.down.json": {Data: []byte(`[]`)}},
+		"bad version":  {"m/first_a.up.json": {Data: []byte(`[]`)}},
+		"not an array": {"m/0001_a.up.json": {Data: []byte(`{"create": "x"}`)}},
+		"empty":        {"m/0001_a.up.json": {Data: []byte(`[{}]`)}},
+		"name clash":   {"m/0001_a.up.json": {Data: []byte(`[]`)}, "m/0001_b.down.json": {Data: []byte(`[]`)}},
+	} {
+		if _, err := Load(files, "m"); err == nil {
+			t.Errorf("%s: loaded", name)
+		}
+	}
+
+	migrations, err := Load(fstest.MapFS{
+		"m/0002_b.up.json": {Data: []byte(`[{"create": "b"}]`)},
+		"m/0001_a.up.json": {Data: []byte(`[{"create": "a"}]`)},
+		"m/README.md":      {Data: []byte(`notes`)},
+	}, "m")
+	if err != nil || len(migrations) != 2 || migrations[1].Name != "b" || migrations[1].down != nil {
+		t.Fatalf("Load = %+v, %v", migrations, err)
+	}
+}
+
+func TestStatusReady(t *testing.T) {
+	if !(Status{Current: 2, Latest: 2}).Ready() {
+		t.Fatal("up to date schema not ready")
+	}
+	if (Status{Current: 1, Latest: 2, Pending: 1}).Ready() || (Status{Current: 2, Latest: 2, Dirty: true}).Ready() {
+		t.Fatal("pending or dirty schema ready")
+	}
+}
+
+// testDatabase returns a fresh database on the server at
+// AUTH_TEST_MONGO_URL, e.g.
+//
+//	docker run --rm -p 27017:27017 mongo:7
+//	AUTH_TEST_MONGO_URL=mongodb://localhost:27017 go test ./migrations
+func testDatabase(t *testing.T) *mongo.Database {
+	url := os.Getenv("AUTH_TEST_MONGO_URL")
+	if url == "" {
+		t.Skip("AUTH_TEST_MONGO_URL not set")
+	}
+	client, err := mongo.Connect(options.Client().ApplyURI(url))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := client.Database(fmt.Sprintf("auth_migrations_test_%d", time.Now().UnixNano()))
+	t.Cleanup(func() {
+		db.Drop(context.Background())
+		client.Disconnect(context.Background())
+	})
+	return db
+}
+
+func TestRunner(t *testing.T) {
+	db := testDatabase(t)
+	ctx := context.Background()
+	migrations, err := Load(fstest.MapFS{
+		"m/0001_a.up.json":   {Data: []byte(`[{"create": "a"}]`)},
+		"m/0001_a.down.json": {Data: []byte(`[{"drop": "a"}]`)},
+		"m/0002_b.up.json":   {Data: []byte(`[{"createIndexes": "a", "indexes": [{"key": {"x": 1}, "name": "x_1"}]}]`)},
+		"m/0002_b.down.json": {Data: []byte(`[{"dropIndexes": "a", "index": "x_1"}]`)},
+		"m/0003_c.up.json":   {Data: []byte(`[{"notACommand": 1}]`)},
+	}, "m")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	runner := NewRunner(db, migrations[:2])
+	if status, _ := runner.Status(ctx); status.Current != 0 || status.Pending != 2 {
+		t.Fatalf("fresh status = %+v", status)
+	}
+	if applied, err := runner.Up(ctx); err != nil || len(applied) != 2 {
+		t.Fatalf("Up = %d, %v", len(applied), err)
+	}
+	if applied, err := runner.Up(ctx); err != nil || len(applied) != 0 {
+		t.Fatalf("second Up = %d, %v", len(applied), err)
+	}
+	if reverted, err := runner.Down(ctx, 1); err != nil || len(reverted) != 1 || reverted[0].Version != 2 {
+		t.Fatalf("Down = %+v, %v", reverted, err)
+	}
+	if status, _ := runner.Status(ctx); status.Current != 1 || status.Ready() {
+		t.Fatalf("status after down = %+v", status)
+	}
+
+	// A failing migration leaves the schema dirty until forced
+	runner = NewRunner(db, migrations)
+	if _, err := runner.Up(ctx); err == nil {
+		t.Fatal("bad migration applied")
+	}
+	if status, _ := runner.Status(ctx); !status.Dirty || status.Current != 3 {
+		t.Fatalf("status after failure = %+v", status)
+	}
+	if _, err := runner.Up(ctx); err == nil || !strings.Contains(err.Error(), "dirty") {
+		t.Fatalf("Up on dirty schema = %v", err)
+	}
+	if err := runner.Force(ctx, 2); err != nil {
+		t.Fatal(err)
+	}
+	if status, _ := runner.Status(ctx); status.Dirty || status.Current != 2 {
+		t.Fatalf("status after force = %+v", status)
+	}
+}
@@ -0,0 +1,548 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// ============================================================================
+// Network Rules
+// ============================================================================
+//
+// Denylisted addresses are refused on every route. When the admin allowlist
+// is non-empty, /admin routes only answer addresses inside it (e.g. the
+// corporate VPN). Rules come from the configuration and can be added or
+// removed at runtime through /admin/network-rules. With
+// network.auto_ban_threshold set, addresses that keep failing logins or
+// hitting rate limits are denied automatically for network.auto_ban_duration;
+// it is off by default because one address can be a whole NAT. Requests for
+// a decoy route ban their address straight away (honeypot.go). In cluster
+// mode runtime and automatic rules live in the shared store, so a ban made
+// by one replica holds on all of them; standalone they last until a
+// restart. Abuse counts are per instance.
+//
+// Client addresses come from c.ClientIP(). X-Forwarded-For is only believed
+// from server.trusted_proxies, so behind a load balancer it must be listed
+// there or every client shares the balancer's address.
+
+const (
+	networkListDeny       = "deny"
+	networkListAdminAllow = "admin_allow"
+
+	networkRuleFromConfig = "config"
+	networkRuleFromAdmin  = "admin"
+	networkRuleFromAuto   = "auto"
+	networkRuleFromDecoy  = "honeypot"
+
+	abuseSweepInterval = time.Minute
+	EventIPBanned      = "network.ip.banned"
+
+	// networkRulesSetting names the runtime and automatic rules in the
+	// shared store; changes to them take the lock of the same name
+	networkRulesSetting = "network-rules"
+)
+
+// NetworkRule is one CIDR on a list
+type NetworkRule struct {
+	ID        string     `json:"id"`
+	List      string     `json:"list"` // deny | admin_allow
+	CIDR      string     `json:"cidr"`
+	Reason    string     `json:"reason,omitempty"`
+	Source    string     `json:"source"` // config | admin | auto | honeypot
+	CreatedBy string     `json:"created_by,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+
+	network *net.IPNet
+}
+
+// abuseCounter counts offences from one address in the current window
+type abuseCounter struct {
+	count int
+	since time.Time
+}
+
+var (
+	errNetworkRuleNotFound          = errors.New("Rule not found")
+	errConfiguredRule               = errors.New("Configured rules can only be removed from the configuration")
+	errFirstAllowRuleExcludesCaller = errors.New("The first admin_allow rule must include your own address")
+	errRuleBlocksCaller             = errors.New("Rule would block your own address")
+	errRuleRemovalLocksOut          = errors.New("Removing this rule would lock out your own address")
+)
+
+var (
+	networkRules []*NetworkRule
+	abuseCounts  = make(map[string]*abuseCounter)
+	networkMutex sync.RWMutex
+)
+
+// parseCIDR accepts a CIDR or a bare address
+func parseCIDR(raw string) (*net.IPNet, error) {
+	raw = strings.TrimSpace(raw)
+	if !strings.Contains(raw, "/") {
+		ip := net.ParseIP(raw)
+		if ip == nil {
+			return nil, fmt.Errorf("%q is not an IP address or CIDR", raw)
+		}
+		bits := 128
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 32
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, network, err := net.ParseCIDR(raw)
+	if err != nil {
+		return nil, fmt.Errorf("%q is not an IP address or CIDR", raw)
+	}
+	return network, nil
+}
+
+// setupNetworkRules loads the configured lists
+func setupNetworkRules() error {
+	now := time.Now().UTC()
+	for list, entries := range map[string][]string{
+		networkListDeny:       config.Network.Denylist,
+		networkListAdminAllow: config.Network.AdminAllowlist,
+	} {
+		for _, entry := range entries {
+			network, err := parseCIDR(entry)
+			if err != nil {
+				return err
+			}
+			networkRules = append(networkRules, &NetworkRule{
+				ID:        uuid.New().String(),
+				List:      list,
+				CIDR:      network.String(),
+				Source:    networkRuleFromConfig,
+				CreatedAt: now,
+				network:   network,
+			})
+		}
+	}
+	goBackground(sweepNetworkRules)
+	return nil
+}
+
+// matchRule reports whether ip falls in any live rule on list
+func matchRule(list, ip string) (*NetworkRule, bool) {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return nil, false
+	}
+	now := time.Now()
+
+	networkMutex.RLock()
+	defer networkMutex.RUnlock()
+	for _, rule := range networkRules {
+		if rule.List == list && rule.network.Contains(addr) && (rule.ExpiresAt == nil || rule.ExpiresAt.After(now)) {
+			return rule, true
+		}
+	}
+	return nil, false
+}
+
+// hasRules reports whether list has any entries
+func hasRules(list string) bool {
+	networkMutex.RLock()
+	defer networkMutex.RUnlock()
+	for _, rule := range networkRules {
+		if rule.List == list {
+			return true
+		}
+	}
+	return false
+}
+
+// adminAddressAllowed applies the admin allowlist; an empty list allows all
+func adminAddressAllowed(ip string) bool {
+	if !hasRules(networkListAdminAllow) {
+		return true
+	}
+	_, ok := matchRule(networkListAdminAllow, ip)
+	return ok
+}
+
+// denylist refuses requests from denied addresses
+func denylist() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if _, denied := matchRule(networkListDeny, c.ClientIP()); denied {
+			respondError(c, http.StatusForbidden, codeIPBlocked, "Requests from this address are blocked")
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// adminNetworkOnly restricts a route group to the admin allowlist
+func adminNetworkOnly() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !adminAddressAllowed(c.ClientIP()) {
+			respondError(c, http.StatusForbidden, codeIPBlocked, "Admin API is not available from this address")
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// recordAbuse counts a failed login or rate-limited request from ip and
+// bans it once network.auto_ban_threshold is reached within the window
+func recordAbuse(ip, kind string) {
+	cfg := config.Network
+	addr := net.ParseIP(ip)
+	if cfg.AutoBanThreshold <= 0 || addr == nil {
+		return
+	}
+	if _, allowed := matchRule(networkListAdminAllow, ip); allowed {
+		// Never lock out the admin network
+		return
+	}
+
+	now := time.Now()
+	networkMutex.Lock()
+	counter, exists := abuseCounts[ip]
+	if !exists || now.Sub(counter.since) > cfg.AutoBanWindow {
+		counter = &abuseCounter{since: now}
+		abuseCounts[ip] = counter
+	}
+	counter.count++
+	if counter.count < cfg.AutoBanThreshold {
+		networkMutex.Unlock()
+		return
+	}
+	delete(abuseCounts, ip)
+	networkMutex.Unlock()
+
+	banAddress(ip, networkRuleFromAuto, fmt.Sprintf("%d %s within %s", cfg.AutoBanThreshold, kind, cfg.AutoBanWindow), cfg.AutoBanDuration)
+}
+
+// banAddress denies ip for duration, unless it is on the admin allowlist,
+// and returns the new rule
+func banAddress(ip, source, reason string, duration time.Duration) *NetworkRule {
+	network, err := parseCIDR(ip)
+	if err != nil {
+		return nil
+	}
+	if _, allowed := matchRule(networkListAdminAllow, ip); allowed {
+		// Never lock out the admin network
+		return nil
+	}
+
+	now := time.Now().UTC()
+	expires := now.Add(duration)
+	rule := &NetworkRule{
+		ID:        uuid.New().String(),
+		List:      networkListDeny,
+		CIDR:      network.String(),
+		Reason:    reason,
+		Source:    source,
+		CreatedAt: now,
+		ExpiresAt: &expires,
+		network:   network,
+	}
+	err = updateNetworkRules(func(rules []*NetworkRule) ([]*NetworkRule, error) {
+		return append(rules, rule), nil
+	})
+	if err != nil {
+		// Still keep the address out of this replica
+		slog.Warn("Ban not shared with other replicas", "ip", ip, "error", err)
+		networkMutex.Lock()
+		networkRules = append(networkRules, rule)
+		networkMutex.Unlock()
+	}
+
+	slog.Warn("Address banned", "ip", ip, "source", source, "reason", reason, "until", expires)
+	event := newSecurityEvent(EventIPBanned, "success")
+	event.Severity = "high"
+	event.SourceIP, event.Reason = ip, rule.Reason
+	event.Details = map[string]string{"rule_id": rule.ID, "source": source, "expires_at": expires.Format(time.RFC3339)}
+	emitSecurityEvent(event)
+	return rule
+}
+
+// updateNetworkRules changes the rules one writer at a time. When clustered
+// it starts from the shared store's copy and saves the result there for
+// every replica; a failed save changes nothing.
+func updateNetworkRules(change func(rules []*NetworkRule) ([]*NetworkRule, error)) error {
+	ctx, cancel := context.WithTimeout(context.Background(), config.Cluster.LockTTL)
+	defer cancel()
+	release, err := acquireLock(ctx, networkRulesSetting, config.Cluster.LockTTL)
+	if err != nil {
+		slog.Error("Network rules lock failed", "error", err)
+		return errStoreUnavailable
+	}
+	defer release()
+	if clustered() {
+		if err := refreshSetting(ctx, networkRulesSetting); err != nil {
+			slog.Error("Cluster store read failed", "op", "network_rules", "error", err)
+			return errStoreUnavailable
+		}
+	}
+
+	networkMutex.RLock()
+	rules, err := change(slices.Clone(networkRules))
+	networkMutex.RUnlock()
+	if err != nil {
+		return err
+	}
+	if clustered() {
+		now := time.Now()
+		shared := []*NetworkRule{}
+		for _, rule := range rules {
+			if rule.Source != networkRuleFromConfig && (rule.ExpiresAt == nil || rule.ExpiresAt.After(now)) {
+				shared = append(shared, rule)
+			}
+		}
+		data, err := json.Marshal(shared)
+		if err != nil {
+			return err
+		}
+		if err := saveSharedSetting(networkRulesSetting, data); err != nil {
+			return err
+		}
+	}
+	networkMutex.Lock()
+	networkRules = rules
+	networkMutex.Unlock()
+	return nil
+}
+
+// applyNetworkRulesSetting replaces the runtime and automatic rules with
+// the shared store's; configured rules stay as they are
+func applyNetworkRulesSetting(data []byte) error {
+	var shared []*NetworkRule
+	if err := json.Unmarshal(data, &shared); err != nil {
+		return err
+	}
+	for _, rule := range shared {
+		network, err := parseCIDR(rule.CIDR)
+		if err != nil {
+			return err
+		}
+		rule.network = network
+	}
+
+	networkMutex.Lock()
+	defer networkMutex.Unlock()
+	rules := slices.DeleteFunc(slices.Clone(networkRules), func(rule *NetworkRule) bool {
+		return rule.Source != networkRuleFromConfig
+	})
+	networkRules = append(rules, shared...)
+	return nil
+}
+
+// sweepNetworkRules drops expired rules and stale abuse counters
+func sweepNetworkRules(ctx context.Context) {
+	ticker := time.NewTicker(abuseSweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		now := time.Now()
+		networkMutex.Lock()
+		live := networkRules[:0]
+		for _, rule := range networkRules {
+			if rule.ExpiresAt == nil || rule.ExpiresAt.After(now) {
+				live = append(live, rule)
+			}
+		}
+		networkRules = live
+		for ip, counter := range abuseCounts {
+			if now.Sub(counter.since) > config.Network.AutoBanWindow {
+				delete(abuseCounts, ip)
+			}
+		}
+		networkMutex.Unlock()
+	}
+}
+
+// BannedAddress is an address the service denied on its own
+type BannedAddress struct {
+	RuleID    string    `json:"rule_id"`
+	CIDR      string    `json:"cidr"`
+	Source    string    `json:"source"` // auto | honeypot
+	Reason    string    `json:"reason"`
+	BannedAt  time.Time `json:"banned_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// listBannedAddresses returns the live automatic and honeypot bans, newest
+// first (admin only). They are lifted with DELETE /admin/network-rules/:id.
+func listBannedAddresses(c *gin.Context) {
+	now := time.Now()
+	banned := []BannedAddress{}
+	networkMutex.RLock()
+	for _, rule := range networkRules {
+		automatic := rule.Source == networkRuleFromAuto || rule.Source == networkRuleFromDecoy
+		if automatic && rule.ExpiresAt != nil && rule.ExpiresAt.After(now) {
+			banned = append(banned, BannedAddress{
+				RuleID:    rule.ID,
+				CIDR:      rule.CIDR,
+				Source:    rule.Source,
+				Reason:    rule.Reason,
+				BannedAt:  rule.CreatedAt,
+				ExpiresAt: *rule.ExpiresAt,
+			})
+		}
+	}
+	networkMutex.RUnlock()
+	slices.Reverse(banned)
+
+	c.JSON(http.StatusOK, gin.H{
+		"banned":        banned,
+		"count":         len(banned),
+		"honeypot_hits": honeypotHits.Load(),
+		"honeypot_bans": honeypotBans.Load(),
+	})
+}
+
+// NetworkRuleRequest adds a rule at runtime
+type NetworkRuleRequest struct {
+	List      string `json:"list" binding:"required,oneof=deny admin_allow"`
+	CIDR      string `json:"cidr" binding:"required"`
+	Reason    string `json:"reason,omitempty"`
+	ExpiresIn string `json:"expires_in,omitempty"` // duration, e.g. "24h"; empty is permanent
+}
+
+// listNetworkRules returns every live rule (admin only)
+func listNetworkRules(c *gin.Context) {
+	now := time.Now()
+	networkMutex.RLock()
+	rules := make([]NetworkRule, 0, len(networkRules))
+	for _, rule := range networkRules {
+		if rule.ExpiresAt == nil || rule.ExpiresAt.After(now) {
+			rules = append(rules, *rule)
+		}
+	}
+	networkMutex.RUnlock()
+
+	c.JSON(http.StatusOK, gin.H{"rules": rules, "count": len(rules)})
+}
+
+// createNetworkRule adds a rule (admin only). An admin_allow rule that would
+// exclude the caller is refused so admins can't lock themselves out.
+func createNetworkRule(c *gin.Context) {
+	var req NetworkRuleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondBindError(c, err)
+		return
+	}
+	network, err := parseCIDR(req.CIDR)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		return
+	}
+	user, _ := c.Get("user")
+
+	rule := &NetworkRule{
+		ID:        uuid.New().String(),
+		List:      req.List,
+		CIDR:      network.String(),
+		Reason:    req.Reason,
+		Source:    networkRuleFromAdmin,
+		CreatedBy: user.(*User).ID,
+		CreatedAt: time.Now().UTC(),
+		network:   network,
+	}
+	if req.ExpiresIn != "" {
+		d, err := time.ParseDuration(req.ExpiresIn)
+		if err != nil || d <= 0 {
+			respondError(c, http.StatusBadRequest, codeInvalidRequest, "expires_in must be a positive duration such as 24h")
+			return
+		}
+		expires := rule.CreatedAt.Add(d)
+		rule.ExpiresAt = &expires
+	}
+
+	caller := net.ParseIP(c.ClientIP())
+	err = updateNetworkRules(func(rules []*NetworkRule) ([]*NetworkRule, error) {
+		if req.List == networkListAdminAllow && !slices.ContainsFunc(rules, isAdminAllowRule) && !network.Contains(caller) {
+			return nil, errFirstAllowRuleExcludesCaller
+		}
+		if req.List == networkListDeny && network.Contains(caller) {
+			return nil, errRuleBlocksCaller
+		}
+		return append(rules, rule), nil
+	})
+	if err != nil {
+		respondNetworkRuleError(c, err)
+		return
+	}
+
+	auditChange(c, "network.rule.create", "network_rule:"+rule.ID, nil, rule)
+	c.JSON(http.StatusCreated, rule)
+}
+
+// deleteNetworkRule removes a runtime or automatic rule (admin only).
+// Configured rules are changed in the configuration.
+func deleteNetworkRule(c *gin.Context) {
+	id := c.Param("id")
+	caller := net.ParseIP(c.ClientIP())
+	var rule *NetworkRule
+	err := updateNetworkRules(func(rules []*NetworkRule) ([]*NetworkRule, error) {
+		index := slices.IndexFunc(rules, func(r *NetworkRule) bool { return r.ID == id })
+		if index < 0 {
+			return nil, errNetworkRuleNotFound
+		}
+		rule = rules[index]
+		if rule.Source == networkRuleFromConfig {
+			return nil, errConfiguredRule
+		}
+		if rule.List == networkListAdminAllow {
+			// Removing the rule must still leave the caller allowed
+			remaining := 0
+			callerAllowed := false
+			for _, other := range rules {
+				if other.List == networkListAdminAllow && other != rule {
+					remaining++
+					callerAllowed = callerAllowed || other.network.Contains(caller)
+				}
+			}
+			if remaining > 0 && !callerAllowed {
+				return nil, errRuleRemovalLocksOut
+			}
+		}
+		return slices.Delete(rules, index, index+1), nil
+	})
+	if err != nil {
+		respondNetworkRuleError(c, err)
+		return
+	}
+
+	auditChange(c, "network.rule.delete", "network_rule:"+rule.ID, rule, nil)
+	c.JSON(http.StatusOK, gin.H{"message": "Rule deleted", "id": rule.ID})
+}
+
+// isAdminAllowRule reports whether a rule is on the admin allowlist
+func isAdminAllowRule(rule *NetworkRule) bool {
+	return rule.List == networkListAdminAllow
+}
+
+// respondNetworkRuleError maps rule change errors to responses
+func respondNetworkRuleError(c *gin.Context, err error) {
+	switch err {
+	case errNetworkRuleNotFound:
+		respondError(c, http.StatusNotFound, codeNotFound, err.Error())
+	case errFirstAllowRuleExcludesCaller, errRuleBlocksCaller, errConfiguredRule, errRuleRemovalLocksOut:
+		respondError(c, http.StatusConflict, codeConflict, err.Error())
+	default:
+		respondServiceError(c, err)
+	}
+}
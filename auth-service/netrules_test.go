@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// useNetworkRules replaces the rule lists for the duration of a test
+func useNetworkRules(t *testing.T, rules ...*NetworkRule) {
+	t.Helper()
+	networkMutex.Lock()
+	networkRules = rules
+	abuseCounts = make(map[string]*abuseCounter)
+	networkMutex.Unlock()
+	t.Cleanup(func() {
+		networkMutex.Lock()
+		networkRules = nil
+		abuseCounts = make(map[string]*abuseCounter)
+		networkMutex.Unlock()
+	})
+}
+
+func testRule(t *testing.T, list, cidr string, expiresAt *time.Time) *NetworkRule {
+	t.Helper()
+	network, err := parseCIDR(cidr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &NetworkRule{ID: cidr, List: list, CIDR: network.String(), Source: networkRuleFromAdmin, ExpiresAt: expiresAt, network: network}
+}
+
+// networkRouter mirrors the production setup: the denylist applies to
+// everything and the admin group is behind the allowlist
+func networkRouter(t *testing.T, trustedProxies []string) *gin.Engine {
+	t.Helper()
+	r := gin.New()
+	if err := r.SetTrustedProxies(trustedProxies); err != nil {
+		t.Fatal(err)
+	}
+	r.Use(denylist())
+	ok := func(c *gin.Context) { c.Status(http.StatusNoContent) }
+	r.GET("/v1/public", ok)
+	r.GET("/v1/admin/thing", adminNetworkOnly(), ok)
+	r.POST("/v1/admin/network/rules", adminNetworkOnly(), func(c *gin.Context) {
+		c.Set("user", &User{ID: "admin"})
+		createNetworkRule(c)
+	})
+	return r
+}
+
+func requestFrom(r http.Handler, method, path, peer, forwardedFor, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.RemoteAddr = peer + ":1234"
+	if forwardedFor != "" {
+		req.Header.Set("X-Forwarded-For", forwardedFor)
+	}
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestParseCIDR(t *testing.T) {
+	for raw, want := range map[string]string{
+		"192.0.2.7":        "192.0.2.7/32",
+		" 192.0.2.0/24 ":   "192.0.2.0/24",
+		"192.0.2.7/24":     "192.0.2.0/24",
+		"2001:db8::1":      "2001:db8::1/128",
+		"2001:db8::/32":    "2001:db8::/32",
+		"::ffff:192.0.2.7": "192.0.2.7/32",
+	} {
+		network, err := parseCIDR(raw)
+		if err != nil || network.String() != want {
+			t.Errorf("parseCIDR(%q) = %v, %v; want %s", raw, network, err, want)
+		}
+	}
+	for _, raw := range []string{"", "example.com", "192.0.2.0/33", "192.0.2"} {
+		if _, err := parseCIDR(raw); err == nil {
+			t.Errorf("parseCIDR(%q) accepted", raw)
+		}
+	}
+}
+
+func TestDenylist(t *testing.T) {
+	past := time.Now().Add(-time.Minute)
+	useNetworkRules(t,
+		testRule(t, networkListDeny, "203.0.113.0/24", nil),
+		testRule(t, networkListDeny, "198.51.100.9", &past), // expired
+	)
+	r := networkRouter(t, nil)
+
+	w := requestFrom(r, http.MethodGet, "/v1/public", "203.0.113.5", "", "")
+	if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), codeIPBlocked) {
+		t.Fatalf("denied address: got %d %s", w.Code, w.Body)
+	}
+	if w := requestFrom(r, http.MethodGet, "/v1/public", "198.51.100.9", "", ""); w.Code != http.StatusNoContent {
+		t.Fatalf("expired rule: got %d, want 204", w.Code)
+	}
+	if w := requestFrom(r, http.MethodGet, "/v1/public", "192.0.2.1", "", ""); w.Code != http.StatusNoContent {
+		t.Fatalf("other address: got %d, want 204", w.Code)
+	}
+}
+
+func TestDenylistIgnoresUntrustedForwardedFor(t *testing.T) {
+	useNetworkRules(t, testRule(t, networkListDeny, "203.0.113.5", nil))
+
+	// Without trusted proxies a denied client can't claim another address
+	r := networkRouter(t, nil)
+	if w := requestFrom(r, http.MethodGet, "/v1/public", "203.0.113.5", "192.0.2.1", ""); w.Code != http.StatusForbidden {
+		t.Fatalf("spoofed X-Forwarded-For: got %d, want 403", w.Code)
+	}
+
+	// Behind a trusted proxy the forwarded address is the client
+	r = networkRouter(t, []string{"10.0.0.1"})
+	if w := requestFrom(r, http.MethodGet, "/v1/public", "10.0.0.1", "203.0.113.5", ""); w.Code != http.StatusForbidden {
+		t.Fatalf("denied client via proxy: got %d, want 403", w.Code)
+	}
+	if w := requestFrom(r, http.MethodGet, "/v1/public", "10.0.0.1", "192.0.2.1", ""); w.Code != http.StatusNoContent {
+		t.Fatalf("allowed client via proxy: got %d, want 204", w.Code)
+	}
+}
+
+func TestAdminAllowlist(t *testing.T) {
+	useNetworkRules(t)
+	r := networkRouter(t, nil)
+	if w := requestFrom(r, http.MethodGet, "/v1/admin/thing", "192.0.2.1", "", ""); w.Code != http.StatusNoContent {
+		t.Fatalf("empty allowlist: got %d, want 204", w.Code)
+	}
+
+	useNetworkRules(t, testRule(t, networkListAdminAllow, "10.0.0.0/8", nil))
+	if w := requestFrom(r, http.MethodGet, "/v1/admin/thing", "192.0.2.1", "", ""); w.Code != http.StatusForbidden {
+		t.Fatalf("outside the allowlist: got %d, want 403", w.Code)
+	}
+	if w := requestFrom(r, http.MethodGet, "/v1/admin/thing", "10.1.2.3", "", ""); w.Code != http.StatusNoContent {
+		t.Fatalf("inside the allowlist: got %d, want 204", w.Code)
+	}
+	if w := requestFrom(r, http.MethodGet, "/v1/public", "192.0.2.1", "", ""); w.Code != http.StatusNoContent {
+		t.Fatalf("public route: got %d, want 204", w.Code)
+	}
+}
+
+func TestCreateNetworkRuleRefusesSelfLockout(t *testing.T) {
+	useNetworkRules(t)
+	r := networkRouter(t, nil)
+
+	w := requestFrom(r, http.MethodPost, "/v1/admin/network/rules", "192.0.2.1", "", `{"list":"deny","cidr":"192.0.2.0/24"}`)
+	if w.Code != http.StatusConflict {
+		t.Fatalf("deny own address: got %d, want 409", w.Code)
+	}
+	w = requestFrom(r, http.MethodPost, "/v1/admin/network/rules", "192.0.2.1", "", `{"list":"admin_allow","cidr":"10.0.0.0/8"}`)
+	if w.Code != http.StatusConflict {
+		t.Fatalf("first allow rule without own address: got %d, want 409", w.Code)
+	}
+	w = requestFrom(r, http.MethodPost, "/v1/admin/network/rules", "192.0.2.1", "", `{"list":"admin_allow","cidr":"192.0.2.0/24"}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("allow rule with own address: got %d %s, want 201", w.Code, w.Body)
+	}
+	w = requestFrom(r, http.MethodPost, "/v1/admin/network/rules", "192.0.2.1", "", `{"list":"deny","cidr":"203.0.113.0/24","expires_in":"1h"}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("deny rule: got %d %s, want 201", w.Code, w.Body)
+	}
+	if w := requestFrom(r, http.MethodGet, "/v1/public", "203.0.113.5", "", ""); w.Code != http.StatusForbidden {
+		t.Fatalf("address denied at runtime: got %d, want 403", w.Code)
+	}
+}
+
+func TestAutoBan(t *testing.T) {
+	useNetworkRules(t, testRule(t, networkListAdminAllow, "10.0.0.0/8", nil))
+
+	// Off by default
+	for i := 0; i < 10; i++ {
+		recordAbuse("192.0.2.1", "failed logins")
+	}
+	if _, denied := matchRule(networkListDeny, "192.0.2.1"); denied {
+		t.Fatal("banned with auto-bans disabled")
+	}
+
+	withConfig(t, func(cfg *Config) {
+		cfg.Network.AutoBanThreshold = 3
+		cfg.Network.AutoBanWindow = time.Minute
+		cfg.Network.AutoBanDuration = time.Hour
+	})
+	recordAbuse("192.0.2.1", "failed logins")
+	recordAbuse("192.0.2.1", "failed logins")
+	if _, denied := matchRule(networkListDeny, "192.0.2.1"); denied {
+		t.Fatal("banned below the threshold")
+	}
+	recordAbuse("192.0.2.1", "failed logins")
+	rule, denied := matchRule(networkListDeny, "192.0.2.1")
+	if !denied || rule.Source != networkRuleFromAuto || rule.ExpiresAt == nil {
+		t.Fatalf("third offence: rule %+v, denied %v", rule, denied)
+	}
+
+	// The admin network is never banned
+	for i := 0; i < 5; i++ {
+		recordAbuse("10.1.2.3", "failed logins")
+	}
+	if _, denied := matchRule(networkListDeny, "10.1.2.3"); denied {
+		t.Fatal("admin address banned")
+	}
+}
+
+func TestNetworkRulesReachReplicas(t *testing.T) {
+	useSharedStore(t)
+	configured := testRule(t, networkListAdminAllow, "10.0.0.0/8", nil)
+	configured.Source = networkRuleFromConfig
+	useNetworkRules(t, configured)
+
+	if banAddress("192.0.2.1", networkRuleFromDecoy, "requested /.env", time.Hour) == nil {
+		t.Fatal("ban refused")
+	}
+
+	// Another replica that missed the change message, with its own config
+	useNetworkRules(t, configured)
+	if _, denied := matchRule(networkListDeny, "192.0.2.1"); denied {
+		t.Fatal("local rules not reset")
+	}
+	// bans a second address: the first one is kept, not overwritten
+	banAddress("192.0.2.2", networkRuleFromAuto, "3 failed logins within 1m0s", time.Hour)
+	for _, ip := range []string{"192.0.2.1", "192.0.2.2"} {
+		if _, denied := matchRule(networkListDeny, ip); !denied {
+			t.Fatalf("%s not denied after the second ban", ip)
+		}
+	}
+
+	// A third replica catches up on resync, keeping its configured rules
+	useNetworkRules(t, configured)
+	if err := resyncShared(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	for _, ip := range []string{"192.0.2.1", "192.0.2.2"} {
+		if _, denied := matchRule(networkListDeny, ip); !denied {
+			t.Fatalf("%s not denied after resync", ip)
+		}
+	}
+	if !adminAddressAllowed("10.1.2.3") || adminAddressAllowed("192.0.2.9") {
+		t.Fatal("configured allowlist lost")
+	}
+
+	// Lifting a ban anywhere lifts it everywhere
+	rule, _ := matchRule(networkListDeny, "192.0.2.1")
+	err := updateNetworkRules(func(rules []*NetworkRule) ([]*NetworkRule, error) {
+		return slices.DeleteFunc(rules, func(r *NetworkRule) bool { return r.ID == rule.ID }), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	useNetworkRules(t, configured)
+	if err := refreshRecord(context.Background(), clusterChange{Kind: "setting", ID: networkRulesSetting}); err != nil {
+		t.Fatal(err)
+	}
+	if _, denied := matchRule(networkListDeny, "192.0.2.1"); denied {
+		t.Fatal("lifted ban still applied")
+	}
+	if _, denied := matchRule(networkListDeny, "192.0.2.2"); !denied {
+		t.Fatal("other ban lost")
+	}
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// ============================================================================
+// Document Notes
+// ============================================================================
+//
+// Anyone who can read a document can attach notes to it, optionally pinned
+// to a page or a chunk the RAG backend returned. A note is private to its
+// author unless they share it with the document, which makes it visible to
+// everyone who can read the document. Only the author edits a note; the
+// author, the document's owner or an admin may delete it.
+//
+// Notes marked "index" are extra context for the RAG pipeline: before
+// answering, it asks POST /internal/access/notes for the indexed notes a
+// user may see on the documents it retrieved, so private notes only inform
+// their author's answers. Notes are kept on the document record, like
+// grants, so they are replicated and backed up with it, and go when the
+// document does.
+
+const (
+	noteVisibilityPrivate = "private"
+	noteVisibilityShared  = "shared"
+
+	maxNotesPerDocument = 500
+)
+
+var (
+	errNoteNotFound  = errors.New("Note not found")
+	errNotNoteAuthor = errors.New("Only the author can edit this note")
+	errTooManyNotes  = errors.New("Document has too many notes")
+)
+
+// DocumentNote is a note on a document
+type DocumentNote struct {
+	ID         string    `json:"id" bson:"id"`
+	AuthorID   string    `json:"author_id" bson:"author_id"`
+	Body       string    `json:"body" bson:"body"`
+	Page       int       `json:"page,omitempty" bson:"page,omitempty"`
+	ChunkID    string    `json:"chunk_id,omitempty" bson:"chunk_id,omitempty"`
+	Visibility string    `json:"visibility" bson:"visibility"` // private | shared
+	Index      bool      `json:"index" bson:"index"`           // offer to the RAG pipeline as context
+	CreatedAt  time.Time `json:"created_at" bson:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at" bson:"updated_at"`
+}
+
+// CreateNoteRequest for POST /documents/:filename/notes
+type CreateNoteRequest struct {
+	Body       string `json:"body" binding:"required,max=4000"`
+	Page       int    `json:"page,omitempty" binding:"omitempty,min=1"`
+	ChunkID    string `json:"chunk_id,omitempty" binding:"max=128"`
+	Visibility string `json:"visibility,omitempty" binding:"omitempty,oneof=private shared"` // default private
+	Index      bool   `json:"index"`
+}
+
+// UpdateNoteRequest for PATCH /documents/:filename/notes/:note_id; absent
+// fields are left alone
+type UpdateNoteRequest struct {
+	Body       *string `json:"body,omitempty" binding:"omitempty,min=1,max=4000"`
+	Page       *int    `json:"page,omitempty" binding:"omitempty,min=0"` // 0 unpins
+	ChunkID    *string `json:"chunk_id,omitempty" binding:"omitempty,max=128"`
+	Visibility *string `json:"visibility,omitempty" binding:"omitempty,oneof=private shared"`
+	Index      *bool   `json:"index,omitempty"`
+}
+
+// NotesRequest for POST /internal/access/notes
+type NotesRequest struct {
+	UserID      string   `json:"user_id" binding:"required"`
+	DocumentIDs []string `json:"document_ids" binding:"max=1000"`
+}
+
+// visibleTo reports whether a user may see a note
+func (n DocumentNote) visibleTo(userID string) bool {
+	return n.AuthorID == userID || n.Visibility == noteVisibilityShared
+}
+
+// readableRecord returns a document's record if the user may read it
+func (s *Service) readableRecord(tx DocumentTx, filename string, user *User) (documentRecord, error) {
+	record, exists := tx.get(filename)
+	if !exists || (user.Role != "admin" && !s.readable(tx, user, filename)) {
+		return record, errDocumentNotFound
+	}
+	return record, nil
+}
+
+// saveNotes stores a document's new notes; callers run inside Update
+func saveNotes(tx DocumentTx, filename string, record documentRecord, notes []DocumentNote) {
+	if len(notes) == 0 {
+		notes = nil
+	}
+	record.Notes = notes
+	tx.put(filename, record)
+	saveDocumentMeta(filename, documentMeta(record))
+}
+
+// DocumentNotes returns the notes a user may see on a document, oldest
+// first
+func (s *Service) DocumentNotes(filename string, user *User) ([]DocumentNote, error) {
+	notes := []DocumentNote{}
+	var err error
+	s.documents.View(func(tx DocumentTx) {
+		var record documentRecord
+		if record, err = s.readableRecord(tx, filename, user); err != nil {
+			return
+		}
+		for _, note := range record.Notes {
+			if note.visibleTo(user.ID) {
+				notes = append(notes, note)
+			}
+		}
+	})
+	return notes, err
+}
+
+// AddNote attaches a note to a document the author can read
+func (s *Service) AddNote(filename string, author *User, req CreateNoteRequest) (DocumentNote, error) {
+	now := time.Now().UTC()
+	note := DocumentNote{
+		ID:         uuid.New().String(),
+		AuthorID:   author.ID,
+		Body:       req.Body,
+		Page:       req.Page,
+		ChunkID:    req.ChunkID,
+		Visibility: req.Visibility,
+		Index:      req.Index,
+		CreatedAt:  now,
+		UpdatedAt:  now,
+	}
+	if note.Visibility == "" {
+		note.Visibility = noteVisibilityPrivate
+	}
+	err := s.documents.Update(func(tx DocumentTx) error {
+		record, err := s.readableRecord(tx, filename, author)
+		if err != nil {
+			return err
+		}
+		if len(record.Notes) >= maxNotesPerDocument {
+			return errTooManyNotes
+		}
+		saveNotes(tx, filename, record, append(slices.Clip(record.Notes), note))
+		return nil
+	})
+	return note, err
+}
+
+// UpdateNote edits a note; only its author may
+func (s *Service) UpdateNote(filename, noteID string, author *User, req UpdateNoteRequest) (DocumentNote, error) {
+	var note DocumentNote
+	err := s.documents.Update(func(tx DocumentTx) error {
+		record, err := s.readableRecord(tx, filename, author)
+		if err != nil {
+			return err
+		}
+		i := slices.IndexFunc(record.Notes, func(n DocumentNote) bool { return n.ID == noteID })
+		if i < 0 || !record.Notes[i].visibleTo(author.ID) {
+			return errNoteNotFound
+		}
+		if record.Notes[i].AuthorID != author.ID {
+			return errNotNoteAuthor
+		}
+
+		notes := slices.Clone(record.Notes)
+		note = notes[i]
+		if req.Body != nil {
+			note.Body = *req.Body
+		}
+		if req.Page != nil {
+			note.Page = *req.Page
+		}
+		if req.ChunkID != nil {
+			note.ChunkID = *req.ChunkID
+		}
+		if req.Visibility != nil {
+			note.Visibility = *req.Visibility
+		}
+		if req.Index != nil {
+			note.Index = *req.Index
+		}
+		note.UpdatedAt = time.Now().UTC()
+		notes[i] = note
+		saveNotes(tx, filename, record, notes)
+		return nil
+	})
+	return note, err
+}
+
+// DeleteNote removes a note; its author, the document's owner or an admin
+// may
+func (s *Service) DeleteNote(filename, noteID string, actor *User) (DocumentNote, error) {
+	var note DocumentNote
+	err := s.documents.Update(func(tx DocumentTx) error {
+		record, err := s.readableRecord(tx, filename, actor)
+		if err != nil {
+			return err
+		}
+		i := slices.IndexFunc(record.Notes, func(n DocumentNote) bool { return n.ID == noteID })
+		if i < 0 || !record.Notes[i].visibleTo(actor.ID) {
+			return errNoteNotFound
+		}
+		note = record.Notes[i]
+		if note.AuthorID != actor.ID && record.Owner != actor.ID && actor.Role != "admin" {
+			return errNotNoteAuthor
+		}
+		saveNotes(tx, filename, record, slices.Delete(slices.Clone(record.Notes), i, i+1))
+		return nil
+	})
+	return note, err
+}
+
+// IndexedNotes returns the notes marked for indexing that a user may see on
+// the given documents, by filename
+func (s *Service) IndexedNotes(user *User, filenames []string) map[string][]DocumentNote {
+	found := make(map[string][]DocumentNote)
+	s.documents.View(func(tx DocumentTx) {
+		for _, filename := range filenames {
+			record, err := s.readableRecord(tx, filename, user)
+			if err != nil {
+				continue
+			}
+			for _, note := range record.Notes {
+				if note.Index && note.visibleTo(user.ID) {
+					found[filename] = append(found[filename], note)
+				}
+			}
+		}
+	})
+	return found
+}
+
+// ----------------------------------------------------------------------------
+// Handlers
+// ----------------------------------------------------------------------------
+
+// respondNoteError maps note errors to problems
+func respondNoteError(c *gin.Context, err error) {
+	switch err {
+	case errNoteNotFound:
+		respondError(c, http.StatusNotFound, codeNotFound, err.Error())
+	case errNotNoteAuthor:
+		respondError(c, http.StatusForbidden, codeForbidden, err.Error())
+	case errTooManyNotes:
+		respondError(c, http.StatusConflict, codeConflict, err.Error())
+	default:
+		respondServiceError(c, err)
+	}
+}
+
+// listNotes lists the notes the current user may see on a document
+func (s *Server) listNotes(c *gin.Context) {
+	notes, err := s.svc.DocumentNotes(c.Param("filename"), c.MustGet("user").(*User))
+	if err != nil {
+		respondNoteError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"notes": notes, "count": len(notes)})
+}
+
+// createNote attaches a note to a document
+func (s *Server) createNote(c *gin.Context) {
+	var req CreateNoteRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondBindError(c, err)
+		return
+	}
+	note, err := s.svc.AddNote(c.Param("filename"), c.MustGet("user").(*User), req)
+	if err != nil {
+		respondNoteError(c, err)
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{"note": note})
+}
+
+// updateNote edits one of the current user's notes
+func (s *Server) updateNote(c *gin.Context) {
+	var req UpdateNoteRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondBindError(c, err)
+		return
+	}
+	note, err := s.svc.UpdateNote(c.Param("filename"), c.Param("note_id"), c.MustGet("user").(*User), req)
+	if err != nil {
+		respondNoteError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"note": note})
+}
+
+// deleteNote removes a note
+func (s *Server) deleteNote(c *gin.Context) {
+	filename := c.Param("filename")
+	note, err := s.svc.DeleteNote(filename, c.Param("note_id"), c.MustGet("user").(*User))
+	if err != nil {
+		respondNoteError(c, err)
+		return
+	}
+	if note.AuthorID != c.MustGet("user").(*User).ID {
+		auditChange(c, "document.note.delete", "document:"+filename,
+			gin.H{"filename": filename, "note_id": note.ID, "author_id": note.AuthorID}, nil)
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Note deleted", "id": note.ID})
+}
+
+// indexedNotes gives the RAG pipeline the notes it may use as context for
+// a user's query
+func (s *Server) indexedNotes(c *gin.Context) {
+	var req NotesRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondBindError(c, err)
+		return
+	}
+	user := s.svc.users.ByID(req.UserID)
+	if user == nil {
+		respondError(c, http.StatusNotFound, codeNotFound, "User not found")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"user_id": req.UserID, "notes": s.svc.IndexedNotes(user, req.DocumentIDs)})
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestDocumentNotes(t *testing.T) {
+	ts := newTestServer(t)
+	withConfig(t, func(cfg *Config) { cfg.Auth.InternalAPIToken = testInternalToken })
+	admin := ts.admin("admin@example.com")
+	owner, ownerID := ts.register("owner@example.com")
+	member, memberID := ts.register("member@example.com")
+	ts.do(http.MethodPost, "/v1/documents/register", owner, `{"filename":"handbook.pdf"}`)
+
+	if w := ts.do(http.MethodPost, "/v1/documents/handbook.pdf/notes", member, `{"body":"hi"}`); w.Code != http.StatusNotFound {
+		t.Fatalf("note on unreadable document: got %d, want 404", w.Code)
+	}
+	ts.do(http.MethodPut, "/v1/admin/documents/handbook.pdf/scope", admin, `{"scope":"org"}`)
+
+	add := func(token, body string) DocumentNote {
+		w := ts.do(http.MethodPost, "/v1/documents/handbook.pdf/notes", token, body)
+		var resp struct {
+			Note DocumentNote `json:"note"`
+		}
+		decodeJSON(t, w, &resp)
+		if w.Code != http.StatusCreated {
+			t.Fatalf("add note: %d %s", w.Code, w.Body)
+		}
+		return resp.Note
+	}
+	private := add(owner, `{"body":"check the totals","page":3,"index":true}`)
+	shared := add(member, `{"body":"section 4 is outdated","chunk_id":"c-17","visibility":"shared","index":true}`)
+
+	var list struct {
+		Notes []DocumentNote `json:"notes"`
+	}
+	decodeJSON(t, ts.do(http.MethodGet, "/v1/documents/handbook.pdf/notes", member, ""), &list)
+	if len(list.Notes) != 1 || list.Notes[0].ID != shared.ID {
+		t.Fatalf("member sees: %+v", list.Notes)
+	}
+	decodeJSON(t, ts.do(http.MethodGet, "/v1/documents/handbook.pdf/notes", owner, ""), &list)
+	if len(list.Notes) != 2 || list.Notes[0].Page != 3 {
+		t.Fatalf("owner sees: %+v", list.Notes)
+	}
+
+	// Only the author edits; the owner may still remove a shared note
+	if w := ts.do(http.MethodPatch, "/v1/documents/handbook.pdf/notes/"+shared.ID, owner, `{"body":"edited"}`); w.Code != http.StatusForbidden {
+		t.Fatalf("edit by non-author: got %d, want 403", w.Code)
+	}
+	if w := ts.do(http.MethodPatch, "/v1/documents/handbook.pdf/notes/"+private.ID, owner, `{"index":false}`); w.Code != http.StatusOK {
+		t.Fatalf("edit: %d %s", w.Code, w.Body)
+	}
+
+	// The pipeline only gets indexed notes the querying user may see
+	notes := func(userID string) map[string][]DocumentNote {
+		w := ts.do(http.MethodPost, "/v1/internal/access/notes", "",
+			`{"user_id":"`+userID+`","document_ids":["handbook.pdf","missing.pdf"]}`, internalTokenHeader, testInternalToken)
+		var resp struct {
+			Notes map[string][]DocumentNote `json:"notes"`
+		}
+		decodeJSON(t, w, &resp)
+		return resp.Notes
+	}
+	if got := notes(ownerID); len(got["handbook.pdf"]) != 1 || got["handbook.pdf"][0].ID != shared.ID {
+		t.Fatalf("owner's context: %+v", got)
+	}
+	if got := notes(memberID); len(got["handbook.pdf"]) != 1 {
+		t.Fatalf("member's context: %+v", got)
+	}
+
+	if w := ts.do(http.MethodDelete, "/v1/documents/handbook.pdf/notes/"+shared.ID, owner, ""); w.Code != http.StatusOK {
+		t.Fatalf("owner deletes shared note: %d %s", w.Code, w.Body)
+	}
+	if w := ts.do(http.MethodDelete, "/v1/documents/handbook.pdf/notes/"+private.ID, member, ""); w.Code != http.StatusNotFound {
+		t.Fatalf("delete someone's private note: got %d, want 404", w.Code)
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// ============================================================================
+// In-App Notifications
+// ============================================================================
+//
+// Domain events leave notifications in the affected user's inbox, shown
+// under /users/me/notifications with an unread count for the UI badge.
+// Today the job runner reports documents that finished or failed
+// processing or were quarantined by a scan (scanning.go), time-boxed shares
+// (grants.go) report being granted and expiring, shared conversations
+// (conversations.go) report being shared, and scheduled saved queries
+// (savedqueries.go) deliver their answers, and query plans (plans.go) warn
+// when a user is close to their daily limit. Each user keeps their newest
+// maxNotificationsPerUser. Inboxes live in memory on the instance that
+// raised them.
+
+// Notification kinds
+const (
+	NotificationDocumentProcessed = "document.processed"
+	NotificationDocumentFailed    = "document.processing_failed"
+	NotificationDocumentShared    = "document.shared"
+	NotificationQuotaWarning      = "quota.warning"
+)
+
+const (
+	maxNotificationsPerUser  = 200
+	defaultNotificationLimit = 50
+)
+
+// Notification is one inbox entry
+type Notification struct {
+	ID        string            `json:"id"`
+	Kind      string            `json:"kind"`
+	Title     string            `json:"title"`
+	Message   string            `json:"message"`
+	Data      map[string]string `json:"data,omitempty"` // e.g. filename, job_id
+	CreatedAt time.Time         `json:"created_at"`
+	ReadAt    *time.Time        `json:"read_at,omitempty"`
+}
+
+var (
+	notifications     = make(map[string][]*Notification) // user_id -> oldest first
+	notificationMutex sync.Mutex
+)
+
+// notify adds a notification to a user's inbox, dropping their oldest once
+// the inbox is full
+func notify(userID, kind, title, message string, data map[string]string) {
+	n := &Notification{
+		ID:        uuid.New().String(),
+		Kind:      kind,
+		Title:     title,
+		Message:   message,
+		Data:      data,
+		CreatedAt: time.Now().UTC(),
+	}
+
+	notificationMutex.Lock()
+	defer notificationMutex.Unlock()
+	inbox := append(notifications[userID], n)
+	if len(inbox) > maxNotificationsPerUser {
+		inbox = inbox[len(inbox)-maxNotificationsPerUser:]
+	}
+	notifications[userID] = inbox
+	debugLog("notifications", "Notification added", "user_id", userID, "kind", kind)
+}
+
+// unreadNotifications counts a user's unread notifications; callers hold
+// notificationMutex
+func unreadNotifications(userID string) int {
+	count := 0
+	for _, n := range notifications[userID] {
+		if n.ReadAt == nil {
+			count++
+		}
+	}
+	return count
+}
+
+// findNotification returns the index of a user's notification, or -1;
+// callers hold notificationMutex
+func findNotification(userID, id string) int {
+	for i, n := range notifications[userID] {
+		if n.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// listMyNotifications returns the caller's notifications newest first
+// (?unread=true, ?limit=)
+func listMyNotifications(c *gin.Context) {
+	user, _ := c.Get("user")
+	currentUser := user.(*User)
+	limit := defaultNotificationLimit
+	if raw := c.Query("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 || n > maxNotificationsPerUser {
+			respondError(c, http.StatusBadRequest, codeInvalidRequest,
+				fmt.Sprintf(translate(requestLanguage(c), "limit must be between 1 and %d"), maxNotificationsPerUser))
+			return
+		}
+		limit = n
+	}
+	unreadOnly := c.Query("unread") == "true"
+
+	notificationMutex.Lock()
+	inbox := notifications[currentUser.ID]
+	list := make([]Notification, 0, min(limit, len(inbox)))
+	for i := len(inbox) - 1; i >= 0 && len(list) < limit; i-- {
+		if unreadOnly && inbox[i].ReadAt != nil {
+			continue
+		}
+		list = append(list, *inbox[i])
+	}
+	unread := unreadNotifications(currentUser.ID)
+	notificationMutex.Unlock()
+
+	c.JSON(http.StatusOK, gin.H{"notifications": list, "count": len(list), "unread": unread})
+}
+
+// getUnreadNotificationCount returns the badge count
+func getUnreadNotificationCount(c *gin.Context) {
+	user, _ := c.Get("user")
+	currentUser := user.(*User)
+
+	notificationMutex.Lock()
+	unread := unreadNotifications(currentUser.ID)
+	notificationMutex.Unlock()
+
+	c.JSON(http.StatusOK, gin.H{"unread": unread})
+}
+
+// markNotificationRead marks one of the caller's notifications read
+func markNotificationRead(c *gin.Context) {
+	user, _ := c.Get("user")
+	currentUser := user.(*User)
+
+	notificationMutex.Lock()
+	defer notificationMutex.Unlock()
+	i := findNotification(currentUser.ID, c.Param("id"))
+	if i < 0 {
+		respondError(c, http.StatusNotFound, codeNotFound, "Notification not found")
+		return
+	}
+	n := notifications[currentUser.ID][i]
+	if n.ReadAt == nil {
+		now := time.Now().UTC()
+		n.ReadAt = &now
+	}
+	c.JSON(http.StatusOK, gin.H{"notification": *n, "unread": unreadNotifications(currentUser.ID)})
+}
+
+// markAllNotificationsRead marks every notification of the caller read
+func markAllNotificationsRead(c *gin.Context) {
+	user, _ := c.Get("user")
+	currentUser := user.(*User)
+	now := time.Now().UTC()
+
+	notificationMutex.Lock()
+	marked := 0
+	for _, n := range notifications[currentUser.ID] {
+		if n.ReadAt == nil {
+			n.ReadAt = &now
+			marked++
+		}
+	}
+	notificationMutex.Unlock()
+
+	c.JSON(http.StatusOK, gin.H{"marked": marked, "unread": 0})
+}
+
+// deleteNotification removes one of the caller's notifications
+func deleteNotification(c *gin.Context) {
+	user, _ := c.Get("user")
+	currentUser := user.(*User)
+
+	notificationMutex.Lock()
+	defer notificationMutex.Unlock()
+	i := findNotification(currentUser.ID, c.Param("id"))
+	if i < 0 {
+		respondError(c, http.StatusNotFound, codeNotFound, "Notification not found")
+		return
+	}
+	inbox := notifications[currentUser.ID]
+	inbox = append(inbox[:i], inbox[i+1:]...)
+	if len(inbox) == 0 {
+		delete(notifications, currentUser.ID)
+	} else {
+		notifications[currentUser.ID] = inbox
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Notification deleted", "unread": unreadNotifications(currentUser.ID)})
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+)
+
+func resetNotifications(t *testing.T) {
+	t.Helper()
+	reset := func() {
+		notificationMutex.Lock()
+		notifications = make(map[string][]*Notification)
+		notificationMutex.Unlock()
+	}
+	reset()
+	t.Cleanup(reset)
+}
+
+type notificationList struct {
+	Notifications []Notification `json:"notifications"`
+	Count         int            `json:"count"`
+	Unread        int            `json:"unread"`
+}
+
+func TestNotifyKeepsNewest(t *testing.T) {
+	resetNotifications(t)
+	for i := 0; i < maxNotificationsPerUser+5; i++ {
+		notify("u1", NotificationDocumentProcessed, "Document ready", strconv.Itoa(i), nil)
+	}
+
+	notificationMutex.Lock()
+	inbox := notifications["u1"]
+	notificationMutex.Unlock()
+	if len(inbox) != maxNotificationsPerUser {
+		t.Fatalf("inbox holds %d, want %d", len(inbox), maxNotificationsPerUser)
+	}
+	if inbox[0].Message != "5" || inbox[len(inbox)-1].Message != strconv.Itoa(maxNotificationsPerUser+4) {
+		t.Fatalf("inbox spans %q..%q", inbox[0].Message, inbox[len(inbox)-1].Message)
+	}
+}
+
+func TestNotificationInbox(t *testing.T) {
+	resetNotifications(t)
+	ts := newTestServer(t)
+	token, id := ts.register("a@example.com")
+	for _, name := range []string{"a.pdf", "b.pdf", "c.pdf"} {
+		notify(id, NotificationDocumentProcessed, "Document ready", name, map[string]string{"filename": name})
+	}
+
+	var list notificationList
+	decodeJSON(t, ts.do(http.MethodGet, "/v1/users/me/notifications", token, ""), &list)
+	if list.Count != 3 || list.Unread != 3 || list.Notifications[0].Message != "c.pdf" {
+		t.Fatalf("inbox = %+v", list)
+	}
+	decodeJSON(t, ts.do(http.MethodGet, "/v1/users/me/notifications?limit=2", token, ""), &list)
+	if list.Count != 2 || list.Notifications[1].Message != "b.pdf" {
+		t.Fatalf("limited inbox = %+v", list)
+	}
+	if w := ts.do(http.MethodGet, "/v1/users/me/notifications?limit=0", token, ""); w.Code != http.StatusBadRequest {
+		t.Fatalf("limit=0: got %d, want 400", w.Code)
+	}
+
+	// Mark the newest read
+	newest := list.Notifications[0].ID
+	w := ts.do(http.MethodPost, "/v1/users/me/notifications/"+newest+"/read", token, "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("mark read: %d %s", w.Code, w.Body)
+	}
+	decodeJSON(t, ts.do(http.MethodGet, "/v1/users/me/notifications?unread=true", token, ""), &list)
+	if list.Count != 2 || list.Unread != 2 || list.Notifications[0].Message != "b.pdf" {
+		t.Fatalf("unread inbox = %+v", list)
+	}
+
+	var count struct {
+		Unread int `json:"unread"`
+	}
+	decodeJSON(t, ts.do(http.MethodGet, "/v1/users/me/notifications/unread-count", token, ""), &count)
+	if count.Unread != 2 {
+		t.Fatalf("unread count = %d, want 2", count.Unread)
+	}
+
+	var marked struct {
+		Marked int `json:"marked"`
+	}
+	decodeJSON(t, ts.do(http.MethodPost, "/v1/users/me/notifications/read-all", token, ""), &marked)
+	if marked.Marked != 2 {
+		t.Fatalf("read-all marked %d, want 2", marked.Marked)
+	}
+	decodeJSON(t, ts.do(http.MethodGet, "/v1/users/me/notifications/unread-count", token, ""), &count)
+	if count.Unread != 0 {
+		t.Fatalf("unread after read-all = %d", count.Unread)
+	}
+
+	if w := ts.do(http.MethodDelete, "/v1/users/me/notifications/"+newest, token, ""); w.Code != http.StatusOK {
+		t.Fatalf("delete: %d %s", w.Code, w.Body)
+	}
+	if w := ts.do(http.MethodDelete, "/v1/users/me/notifications/"+newest, token, ""); w.Code != http.StatusNotFound {
+		t.Fatalf("delete twice: got %d, want 404", w.Code)
+	}
+	decodeJSON(t, ts.do(http.MethodGet, "/v1/users/me/notifications", token, ""), &list)
+	if list.Count != 2 {
+		t.Fatalf("inbox after delete holds %d, want 2", list.Count)
+	}
+}
+
+func TestNotificationsArePrivate(t *testing.T) {
+	resetNotifications(t)
+	ts := newTestServer(t)
+	_, aliceID := ts.register("alice@example.com")
+	bob, _ := ts.register("bob@example.com")
+	notify(aliceID, NotificationDocumentFailed, "Document processing failed", "a.pdf", nil)
+
+	notificationMutex.Lock()
+	id := notifications[aliceID][0].ID
+	notificationMutex.Unlock()
+
+	var list notificationList
+	decodeJSON(t, ts.do(http.MethodGet, "/v1/users/me/notifications", bob, ""), &list)
+	if list.Count != 0 {
+		t.Fatalf("bob sees %d notifications", list.Count)
+	}
+	if w := ts.do(http.MethodPost, "/v1/users/me/notifications/"+id+"/read", bob, ""); w.Code != http.StatusNotFound {
+		t.Fatalf("mark another's read: got %d, want 404", w.Code)
+	}
+	if w := ts.do(http.MethodDelete, "/v1/users/me/notifications/"+id, bob, ""); w.Code != http.StatusNotFound {
+		t.Fatalf("delete another's: got %d, want 404", w.Code)
+	}
+}
@@ -0,0 +1,661 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"maps"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// ============================================================================
+// OAuth2 Authorization Server
+// ============================================================================
+//
+// Partner tools get a user's consent instead of their password. An admin
+// registers the tool as a client with its redirect URIs and the scopes it
+// may ask for, then the tool runs the authorization code flow with PKCE
+// (RFC 6749, RFC 7636):
+//
+//  1. It sends the user to its own consent page, which reads
+//     GET /oauth/authorize?response_type=code&client_id=...&redirect_uri=...
+//     &scope=documents:read&state=...&code_challenge=...&code_challenge_method=S256
+//     with the user's session for the client name and scope descriptions.
+//  2. The page posts the user's decision to POST /oauth/authorize and sends
+//     the browser to the redirect_to it gets back, carrying a code or
+//     error=access_denied.
+//  3. The tool trades the code at POST /oauth/token, form-encoded, with its
+//     code_verifier and, for confidential clients, its secret (HTTP Basic
+//     or client_secret in the form).
+//
+// The access token is a scoped token like those from token exchange
+// (tokenexchange.go): it only reaches the routes its scopes list in
+// scopeRoutes, for auth.oauth_token_ttl. There are no refresh tokens; the
+// tool sends the user through the flow again. PKCE with S256 is required of
+// every client, confidential ones included, and codes are single use and
+// expire after authorizationCodeTTL.
+//
+// Clients are kept in auth.oauth_clients_file, or in the shared store when
+// clustered, and every replica holds a copy. Pending codes are kept in
+// keyedRecords, so a code issued by one replica can be redeemed at another.
+// Deleting a client stops new authorizations and unused codes; its tokens
+// run out on their own, or with the user's logout-all (logout.go).
+
+const (
+	authorizationCodeTTL = time.Minute
+	pkceMethodS256       = "S256"
+
+	// oauthClientsSetting names the clients in the shared store
+	oauthClientsSetting     = "oauth-clients"
+	authorizationCodeRecord = "oauth-code"
+)
+
+var (
+	errUnknownClient       = errors.New("Unknown OAuth client")
+	errRedirectURIMismatch = errors.New("redirect_uri is not registered for this client")
+	errPKCERequired        = errors.New("code_challenge with code_challenge_method S256 is required")
+	errScopeNotAllowed     = errors.New("Scope is not allowed for this client")
+	errInvalidCode         = errors.New("Authorization code is invalid or expired")
+	errClientAuthFailed    = errors.New("Client authentication failed")
+)
+
+// OAuthClient is a third-party application registered by an admin
+type OAuthClient struct {
+	ID           string    `json:"client_id"`
+	Name         string    `json:"name"`
+	RedirectURIs []string  `json:"redirect_uris"`
+	Scopes       []string  `json:"scopes"` // what it may request
+	Public       bool      `json:"public"` // no secret, e.g. a desktop or browser app
+	CreatedBy    string    `json:"created_by"`
+	CreatedAt    time.Time `json:"created_at"`
+	secretHash   string    // SHA-256 of the secret; secrets are random, so no need for a slow hash
+}
+
+// storedOAuthClient is a client as saved, with its secret hash
+type storedOAuthClient struct {
+	*OAuthClient
+	SecretHash string `json:"secret_hash,omitempty"`
+}
+
+// authorizationCode is an approved request waiting to be redeemed
+type authorizationCode struct {
+	ClientID      string    `json:"client_id"`
+	UserID        string    `json:"user_id"`
+	RedirectURI   string    `json:"redirect_uri"`
+	Scope         string    `json:"scope"`
+	CodeChallenge string    `json:"code_challenge"`
+	ExpiresAt     time.Time `json:"expires_at"`
+
+	// The authorization request named RedirectURI, so the token request
+	// must repeat it (RFC 6749 section 4.1.3)
+	RedirectURIGiven bool `json:"redirect_uri_given,omitempty"`
+}
+
+var (
+	oauthClients     = make(map[string]*OAuthClient) // client id -> client
+	oauthServerMutex sync.Mutex
+)
+
+// RegisterOAuthClientRequest for POST /admin/oauth/clients
+type RegisterOAuthClientRequest struct {
+	Name         string   `json:"name" binding:"required,max=100"`
+	RedirectURIs []string `json:"redirect_uris" binding:"required,min=1,max=10"`
+	Scopes       []string `json:"scopes"` // defaults to documents:read
+	Public       bool     `json:"public"`
+}
+
+// RegisterOAuthClientResponse carries the secret, shown only this once
+type RegisterOAuthClientResponse struct {
+	*OAuthClient
+	ClientSecret string `json:"client_secret,omitempty"`
+}
+
+// AuthorizeRequest is the authorization request, as query parameters on
+// GET /oauth/authorize and as JSON, with the decision, on POST
+type AuthorizeRequest struct {
+	ResponseType        string `form:"response_type" json:"response_type" binding:"required"`
+	ClientID            string `form:"client_id" json:"client_id" binding:"required"`
+	RedirectURI         string `form:"redirect_uri" json:"redirect_uri"`
+	Scope               string `form:"scope" json:"scope"`
+	State               string `form:"state" json:"state"`
+	CodeChallenge       string `form:"code_challenge" json:"code_challenge"`
+	CodeChallengeMethod string `form:"code_challenge_method" json:"code_challenge_method"`
+	Approve             bool   `form:"-" json:"approve"`
+}
+
+// ScopeInfo describes a scope on the consent screen
+type ScopeInfo struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+// ConsentScreen is what the consent page shows the user
+type ConsentScreen struct {
+	ClientID    string      `json:"client_id"`
+	ClientName  string      `json:"client_name"`
+	Scopes      []ScopeInfo `json:"scopes"`
+	RedirectURI string      `json:"redirect_uri"`
+	State       string      `json:"state,omitempty"`
+}
+
+// OAuthTokenRequest for POST /oauth/token, form-encoded
+type OAuthTokenRequest struct {
+	GrantType    string `form:"grant_type" binding:"required"`
+	Code         string `form:"code"`
+	RedirectURI  string `form:"redirect_uri"`
+	ClientID     string `form:"client_id"`
+	ClientSecret string `form:"client_secret"`
+	CodeVerifier string `form:"code_verifier"`
+}
+
+// OAuthTokenResponse is the RFC 6749 token response
+type OAuthTokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int    `json:"expires_in"`
+	Scope       string `json:"scope"`
+}
+
+// validRedirectURI accepts absolute https URIs without a fragment, and
+// http ones on the loopback interface for native apps (RFC 8252)
+func validRedirectURI(raw string) bool {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" || u.Fragment != "" || u.User != nil {
+		return false
+	}
+	switch u.Scheme {
+	case "https":
+		return true
+	case "http":
+		if u.Hostname() == "localhost" {
+			return true
+		}
+		ip := net.ParseIP(u.Hostname())
+		return ip != nil && ip.IsLoopback()
+	}
+	return false
+}
+
+// newClientSecret generates a client secret and its stored hash
+func newClientSecret() (secret, hash string, err error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", "", err
+	}
+	secret = base64.RawURLEncoding.EncodeToString(buf)
+	return secret, hashClientSecret(secret), nil
+}
+
+func hashClientSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// pkceMatches checks a code verifier against an S256 challenge
+func pkceMatches(verifier, challenge string) bool {
+	if len(verifier) < 43 || len(verifier) > 128 {
+		return false
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	return subtle.ConstantTimeCompare([]byte(base64.RawURLEncoding.EncodeToString(sum[:])), []byte(challenge)) == 1
+}
+
+// lookupOAuthClient returns a registered client
+func lookupOAuthClient(id string) (*OAuthClient, bool) {
+	oauthServerMutex.Lock()
+	defer oauthServerMutex.Unlock()
+	client, exists := oauthClients[id]
+	return client, exists
+}
+
+// ----------------------------------------------------------------------------
+// Storage
+// ----------------------------------------------------------------------------
+
+// loadOAuthClients reads the clients from the shared store when clustered,
+// otherwise from auth.oauth_clients_file
+func loadOAuthClients() error {
+	if clustered() {
+		return refreshSetting(context.Background(), oauthClientsSetting)
+	}
+	data, err := os.ReadFile(config.Auth.OAuthClientsFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return applyOAuthClientsSetting(data)
+}
+
+// applyOAuthClientsSetting replaces this replica's copy of the clients
+func applyOAuthClientsSetting(data []byte) error {
+	var stored []storedOAuthClient
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return err
+	}
+	clients := make(map[string]*OAuthClient, len(stored))
+	for _, entry := range stored {
+		if entry.OAuthClient != nil {
+			entry.secretHash = entry.SecretHash
+			clients[entry.ID] = entry.OAuthClient
+		}
+	}
+	oauthServerMutex.Lock()
+	oauthClients = clients
+	oauthServerMutex.Unlock()
+	return nil
+}
+
+// storeOAuthClients writes the clients where loadOAuthClients reads them
+func storeOAuthClients(clients map[string]*OAuthClient) error {
+	stored := make([]storedOAuthClient, 0, len(clients))
+	for _, client := range clients {
+		stored = append(stored, storedOAuthClient{OAuthClient: client, SecretHash: client.secretHash})
+	}
+	sort.Slice(stored, func(i, j int) bool { return stored[i].CreatedAt.Before(stored[j].CreatedAt) })
+	data, err := json.Marshal(stored)
+	if err != nil {
+		return err
+	}
+	if clustered() {
+		return saveSharedSetting(oauthClientsSetting, data)
+	}
+	if dir := filepath.Dir(config.Auth.OAuthClientsFile); dir != "." {
+		if err := os.MkdirAll(dir, 0o700); err != nil {
+			return err
+		}
+	}
+	return jobFiles{}.write(config.Auth.OAuthClientsFile, data)
+}
+
+// updateOAuthClients changes the clients one writer at a time, starting
+// from the shared store's copy when clustered; a failed save changes
+// nothing
+func updateOAuthClients(change func(clients map[string]*OAuthClient) error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), config.Cluster.LockTTL)
+	defer cancel()
+	release, err := acquireLock(ctx, oauthClientsSetting, config.Cluster.LockTTL)
+	if err != nil {
+		slog.Error("OAuth clients lock failed", "error", err)
+		return errStoreUnavailable
+	}
+	defer release()
+	if clustered() {
+		if err := refreshSetting(ctx, oauthClientsSetting); err != nil {
+			slog.Error("Cluster store read failed", "op", "oauth_clients", "error", err)
+			return errStoreUnavailable
+		}
+	}
+
+	oauthServerMutex.Lock()
+	clients := maps.Clone(oauthClients)
+	oauthServerMutex.Unlock()
+	if err := change(clients); err != nil {
+		return err
+	}
+	if err := storeOAuthClients(clients); err != nil {
+		return err
+	}
+	oauthServerMutex.Lock()
+	oauthClients = clients
+	oauthServerMutex.Unlock()
+	return nil
+}
+
+// saveAuthorizationCode keeps an approved request until it expires
+func saveAuthorizationCode(code string, pending authorizationCode) error {
+	data, err := json.Marshal(pending)
+	if err == nil {
+		err = keyedRecords().saveRecord(context.Background(), authorizationCodeRecord, code, data, time.Until(pending.ExpiresAt))
+	}
+	if err != nil {
+		slog.Error("Record store write failed", "op", "authorization_code", "error", err)
+		return errStoreUnavailable
+	}
+	return nil
+}
+
+// takeAuthorizationCode removes a code and returns its request, so each
+// code is redeemed at most once across replicas
+func takeAuthorizationCode(code string) (authorizationCode, bool, error) {
+	var pending authorizationCode
+	data, found, err := keyedRecords().takeRecord(context.Background(), authorizationCodeRecord, code)
+	if err != nil {
+		slog.Error("Record store write failed", "op", "authorization_code", "error", err)
+		return pending, false, errStoreUnavailable
+	}
+	if !found || json.Unmarshal(data, &pending) != nil {
+		return pending, false, nil
+	}
+	return pending, true, nil
+}
+
+// deleteAuthorizationCodes drops a client's unused codes
+func deleteAuthorizationCodes(clientID string) error {
+	ctx := context.Background()
+	codes, err := keyedRecords().records(ctx, authorizationCodeRecord)
+	for code, data := range codes {
+		var pending authorizationCode
+		if err != nil || json.Unmarshal(data, &pending) != nil || pending.ClientID != clientID {
+			continue
+		}
+		err = keyedRecords().deleteRecord(ctx, authorizationCodeRecord, code)
+	}
+	if err != nil {
+		slog.Error("Record store write failed", "op", "authorization_codes", "error", err)
+		return errStoreUnavailable
+	}
+	return nil
+}
+
+// checkAuthorization validates an authorization request against the
+// client's registration and resolves the redirect URI and scope
+func checkAuthorization(req AuthorizeRequest) (*OAuthClient, string, string, error) {
+	client, exists := lookupOAuthClient(req.ClientID)
+	if !exists {
+		return nil, "", "", errUnknownClient
+	}
+	redirectURI := req.RedirectURI
+	if redirectURI == "" && len(client.RedirectURIs) == 1 {
+		redirectURI = client.RedirectURIs[0]
+	}
+	if !slices.Contains(client.RedirectURIs, redirectURI) {
+		return nil, "", "", errRedirectURIMismatch
+	}
+	if req.CodeChallenge == "" || req.CodeChallengeMethod != pkceMethodS256 {
+		return nil, "", "", errPKCERequired
+	}
+
+	scopes := strings.Fields(req.Scope)
+	if len(scopes) == 0 {
+		scopes = client.Scopes
+	}
+	for _, scope := range scopes {
+		if !slices.Contains(client.Scopes, scope) {
+			return nil, "", "", errScopeNotAllowed
+		}
+	}
+	slices.Sort(scopes)
+	return client, redirectURI, strings.Join(slices.Compact(scopes), " "), nil
+}
+
+// respondAuthorizationError reports a request that can't be sent back to
+// the client; the user sees it instead of being redirected
+func respondAuthorizationError(c *gin.Context, req AuthorizeRequest, err error) {
+	switch {
+	case req.ResponseType != "code":
+		respondError(c, http.StatusBadRequest, codeUnsupportedResponseType, "response_type must be code")
+	case err == errUnknownClient:
+		respondError(c, http.StatusBadRequest, codeInvalidClient, err.Error())
+	case err == errScopeNotAllowed:
+		respondError(c, http.StatusBadRequest, codeInvalidScope, err.Error())
+	default:
+		respondError(c, http.StatusBadRequest, codeInvalidRequest, err.Error())
+	}
+}
+
+// authorizationRedirect adds response parameters to a redirect URI
+func authorizationRedirect(redirectURI string, params url.Values) string {
+	u, _ := url.Parse(redirectURI) // validated at registration
+	query := u.Query()
+	for key, values := range params {
+		query[key] = values
+	}
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+// ----------------------------------------------------------------------------
+// Handlers
+// ----------------------------------------------------------------------------
+
+// registerOAuthClient adds a client and returns its secret (admin only)
+func registerOAuthClient(c *gin.Context) {
+	var req RegisterOAuthClientRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondBindError(c, err)
+		return
+	}
+	for _, uri := range req.RedirectURIs {
+		if !validRedirectURI(uri) {
+			respondError(c, http.StatusBadRequest, codeInvalidRequest, "Redirect URIs must be https, or http on localhost")
+			return
+		}
+	}
+	if len(req.Scopes) == 0 {
+		req.Scopes = []string{scopeDocumentsRead}
+	}
+	for _, scope := range req.Scopes {
+		if _, known := scopeRoutes[scope]; !known {
+			respondError(c, http.StatusBadRequest, codeInvalidScope, "Unsupported scope")
+			return
+		}
+	}
+
+	user, _ := c.Get("user")
+	client := &OAuthClient{
+		ID:           uuid.New().String(),
+		Name:         strings.TrimSpace(req.Name),
+		RedirectURIs: req.RedirectURIs,
+		Scopes:       req.Scopes,
+		Public:       req.Public,
+		CreatedBy:    user.(*User).ID,
+		CreatedAt:    time.Now().UTC(),
+	}
+	resp := RegisterOAuthClientResponse{OAuthClient: client}
+	if !req.Public {
+		secret, hash, err := newClientSecret()
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, codeInternal, "Failed to generate a client secret")
+			return
+		}
+		client.secretHash, resp.ClientSecret = hash, secret
+	}
+
+	err := updateOAuthClients(func(clients map[string]*OAuthClient) error {
+		clients[client.ID] = client
+		return nil
+	})
+	if err != nil {
+		respondServiceError(c, err)
+		return
+	}
+
+	auditChange(c, "admin.oauth_client.create", "oauth_client:"+client.ID, nil, client)
+	c.JSON(http.StatusCreated, resp)
+}
+
+// listOAuthClients returns the registered clients, oldest first (admin only)
+func listOAuthClients(c *gin.Context) {
+	oauthServerMutex.Lock()
+	clients := make([]*OAuthClient, 0, len(oauthClients))
+	for _, client := range oauthClients {
+		clients = append(clients, client)
+	}
+	oauthServerMutex.Unlock()
+
+	sort.Slice(clients, func(i, j int) bool { return clients[i].CreatedAt.Before(clients[j].CreatedAt) })
+	c.JSON(http.StatusOK, gin.H{"clients": clients})
+}
+
+// deleteOAuthClient removes a client and its unused codes (admin only)
+func deleteOAuthClient(c *gin.Context) {
+	id := c.Param("client_id")
+	var client *OAuthClient
+	err := updateOAuthClients(func(clients map[string]*OAuthClient) error {
+		if client = clients[id]; client == nil {
+			return errUnknownClient
+		}
+		delete(clients, id)
+		return nil
+	})
+	if err == errUnknownClient {
+		respondError(c, http.StatusNotFound, codeNotFound, err.Error())
+		return
+	}
+	if err == nil {
+		// Codes are checked against the client when redeemed, so any left
+		// behind can't be used
+		err = deleteAuthorizationCodes(id)
+	}
+	if err != nil {
+		respondServiceError(c, err)
+		return
+	}
+	auditChange(c, "admin.oauth_client.delete", "oauth_client:"+id, client, nil)
+	c.JSON(http.StatusOK, gin.H{"message": "OAuth client deleted"})
+}
+
+// getConsentScreen validates an authorization request and describes it for
+// the consent page
+func getConsentScreen(c *gin.Context) {
+	var req AuthorizeRequest
+	if err := c.ShouldBindQuery(&req); err != nil {
+		respondBindError(c, err)
+		return
+	}
+	client, redirectURI, scope, err := checkAuthorization(req)
+	if req.ResponseType != "code" || err != nil {
+		respondAuthorizationError(c, req, err)
+		return
+	}
+
+	screen := ConsentScreen{ClientID: client.ID, ClientName: client.Name, RedirectURI: redirectURI, State: req.State}
+	for _, name := range strings.Fields(scope) {
+		screen.Scopes = append(screen.Scopes, ScopeInfo{Name: name, Description: scopeDescriptions[name]})
+	}
+	c.JSON(http.StatusOK, screen)
+}
+
+// decideAuthorization records the user's decision and returns where to send
+// the browser: back to the client with a code, or with access_denied
+func decideAuthorization(c *gin.Context) {
+	var req AuthorizeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondBindError(c, err)
+		return
+	}
+	client, redirectURI, scope, err := checkAuthorization(req)
+	if req.ResponseType != "code" || err != nil {
+		respondAuthorizationError(c, req, err)
+		return
+	}
+
+	params := url.Values{}
+	if req.State != "" {
+		params.Set("state", req.State)
+	}
+	if !req.Approve {
+		params.Set("error", "access_denied")
+		c.JSON(http.StatusOK, gin.H{"redirect_to": authorizationRedirect(redirectURI, params)})
+		return
+	}
+
+	code, err := newOAuthState()
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, codeInternal, "Failed to issue an authorization code")
+		return
+	}
+	user, _ := c.Get("user")
+	currentUser := user.(*User)
+
+	err = saveAuthorizationCode(code, authorizationCode{
+		ClientID:         client.ID,
+		UserID:           currentUser.ID,
+		RedirectURI:      redirectURI,
+		Scope:            scope,
+		CodeChallenge:    req.CodeChallenge,
+		ExpiresAt:        time.Now().Add(authorizationCodeTTL),
+		RedirectURIGiven: req.RedirectURI != "",
+	})
+	if err != nil {
+		respondServiceError(c, err)
+		return
+	}
+
+	auditChange(c, "oauth.consent.grant", "oauth_client:"+client.ID, nil, gin.H{"user_id": currentUser.ID, "scope": scope})
+	params.Set("code", code)
+	c.JSON(http.StatusOK, gin.H{"redirect_to": authorizationRedirect(redirectURI, params)})
+}
+
+// issueOAuthToken redeems an authorization code for a scoped access token
+func (s *Server) issueOAuthToken(c *gin.Context) {
+	var req OAuthTokenRequest
+	if err := c.ShouldBind(&req); err != nil {
+		respondBindError(c, err)
+		return
+	}
+	if req.GrantType != "authorization_code" {
+		respondError(c, http.StatusBadRequest, codeUnsupportedGrantType, "grant_type must be authorization_code")
+		return
+	}
+
+	// Client credentials may come as HTTP Basic or in the form
+	clientID, secret, basic := c.Request.BasicAuth()
+	if !basic {
+		clientID, secret = req.ClientID, req.ClientSecret
+	}
+	client, exists := lookupOAuthClient(clientID)
+	if !exists || (!client.Public && subtle.ConstantTimeCompare([]byte(hashClientSecret(secret)), []byte(client.secretHash)) != 1) {
+		if basic {
+			c.Header("WWW-Authenticate", `Basic realm="oauth"`)
+		}
+		respondError(c, http.StatusUnauthorized, codeInvalidClient, errClientAuthFailed.Error())
+		return
+	}
+
+	// Codes are single use: taken out before anything else is checked
+	pending, exists, err := takeAuthorizationCode(req.Code)
+	if err != nil {
+		respondServiceError(c, err)
+		return
+	}
+	// A redirect_uri the authorization named must come back unchanged; one
+	// it left to the registration may be omitted
+	redirectMatches := req.RedirectURI == pending.RedirectURI || (req.RedirectURI == "" && !pending.RedirectURIGiven)
+	if !exists || time.Now().After(pending.ExpiresAt) || pending.ClientID != client.ID ||
+		!redirectMatches || !pkceMatches(req.CodeVerifier, pending.CodeChallenge) {
+		respondError(c, http.StatusBadRequest, codeInvalidGrant, errInvalidCode.Error())
+		return
+	}
+	user := s.svc.users.ByID(pending.UserID)
+	if user == nil || !s.svc.active(user) {
+		respondError(c, http.StatusBadRequest, codeInvalidGrant, errInvalidCode.Error())
+		return
+	}
+
+	expiresAt := time.Now().Add(config.Auth.OAuthTokenTTL)
+	token, err := s.svc.issueToken(user, expiresAt, pending.Scope)
+	if err != nil {
+		respondServiceError(c, err)
+		return
+	}
+	debugLog("auth", "OAuth token issued", "user_id", user.ID, "client_id", client.ID, "scope", pending.Scope)
+
+	c.Header("Cache-Control", "no-store")
+	c.JSON(http.StatusOK, OAuthTokenResponse{
+		AccessToken: token,
+		TokenType:   "Bearer",
+		ExpiresIn:   int(config.Auth.OAuthTokenTTL.Seconds()),
+		Scope:       pending.Scope,
+	})
+}
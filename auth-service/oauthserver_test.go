@@ -0,0 +1,370 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const (
+	testRedirectURI  = "https://partner.example/callback"
+	testCodeVerifier = "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+)
+
+// useOAuthClients gives a test an empty client registry in its own file
+func useOAuthClients(t *testing.T) {
+	t.Helper()
+	withConfig(t, func(cfg *Config) { cfg.Auth.OAuthClientsFile = filepath.Join(t.TempDir(), "oauth-clients.json") })
+	reset := func() {
+		oauthServerMutex.Lock()
+		oauthClients = make(map[string]*OAuthClient)
+		oauthServerMutex.Unlock()
+		localRecords = newMemoryRecords()
+	}
+	reset()
+	t.Cleanup(reset)
+}
+
+func toJSON(t *testing.T, v any) string {
+	t.Helper()
+	body, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(body)
+}
+
+func testCodeChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// registerClient registers a client as admin and returns it with its secret
+func (ts *testServer) registerClient(admin, body string) RegisterOAuthClientResponse {
+	ts.t.Helper()
+	w := ts.do(http.MethodPost, "/v1/admin/oauth/clients", admin, body)
+	if w.Code != http.StatusCreated {
+		ts.t.Fatalf("register client: %d %s", w.Code, w.Body)
+	}
+	var resp RegisterOAuthClientResponse
+	decodeJSON(ts.t, w, &resp)
+	return resp
+}
+
+// authorize approves or denies a request as the user and returns the
+// redirect's query
+func (ts *testServer) authorize(token string, req AuthorizeRequest) url.Values {
+	ts.t.Helper()
+	w := ts.do(http.MethodPost, "/v1/oauth/authorize", token, toJSON(ts.t, req))
+	var resp struct {
+		RedirectTo string `json:"redirect_to"`
+	}
+	decodeJSON(ts.t, w, &resp)
+	redirect, err := url.Parse(resp.RedirectTo)
+	if w.Code != http.StatusOK || err != nil || !strings.HasPrefix(resp.RedirectTo, testRedirectURI+"?") {
+		ts.t.Fatalf("authorize: %d %s", w.Code, w.Body)
+	}
+	return redirect.Query()
+}
+
+// redeem posts to the token endpoint
+func (ts *testServer) redeem(form url.Values, headers ...string) (OAuthTokenResponse, int, string) {
+	ts.t.Helper()
+	headers = append([]string{"Content-Type", "application/x-www-form-urlencoded"}, headers...)
+	w := ts.do(http.MethodPost, "/v1/oauth/token", "", form.Encode(), headers...)
+	var resp OAuthTokenResponse
+	if w.Code == http.StatusOK {
+		decodeJSON(ts.t, w, &resp)
+	}
+	return resp, w.Code, w.Body.String()
+}
+
+func authorizeRequest(clientID string) AuthorizeRequest {
+	return AuthorizeRequest{
+		ResponseType:        "code",
+		ClientID:            clientID,
+		RedirectURI:         testRedirectURI,
+		Scope:               scopeDocumentsRead,
+		State:               "xyz",
+		CodeChallenge:       testCodeChallenge(testCodeVerifier),
+		CodeChallengeMethod: pkceMethodS256,
+		Approve:             true,
+	}
+}
+
+func codeForm(code string) url.Values {
+	return url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {testRedirectURI},
+		"code_verifier": {testCodeVerifier},
+	}
+}
+
+func TestOAuthAuthorizationCodeFlow(t *testing.T) {
+	useOAuthClients(t)
+	ts := newTestServer(t)
+	admin := ts.admin("admin@example.com")
+	user, _ := ts.register("a@example.com")
+	client := ts.registerClient(admin, `{"name":"Partner Notes","redirect_uris":["`+testRedirectURI+`"],"scopes":["documents:read","profile:read"]}`)
+	if client.ClientSecret == "" || client.Public {
+		t.Fatalf("confidential client: %+v", client)
+	}
+
+	// The consent page reads what it is asked to approve
+	query := url.Values{
+		"response_type": {"code"}, "client_id": {client.ID}, "scope": {scopeDocumentsRead}, "state": {"xyz"},
+		"code_challenge": {testCodeChallenge(testCodeVerifier)}, "code_challenge_method": {pkceMethodS256},
+	}
+	w := ts.do(http.MethodGet, "/v1/oauth/authorize?"+query.Encode(), user, "")
+	var screen ConsentScreen
+	decodeJSON(t, w, &screen)
+	if w.Code != http.StatusOK || screen.ClientName != "Partner Notes" || screen.RedirectURI != testRedirectURI ||
+		len(screen.Scopes) != 1 || screen.Scopes[0].Name != scopeDocumentsRead || screen.Scopes[0].Description == "" {
+		t.Fatalf("consent screen: %d %s", w.Code, w.Body)
+	}
+
+	redirect := ts.authorize(user, authorizeRequest(client.ID))
+	if redirect.Get("state") != "xyz" || redirect.Get("code") == "" {
+		t.Fatalf("approved redirect: %v", redirect)
+	}
+	code := redirect.Get("code")
+
+	// Client secret over HTTP Basic
+	basic := "Basic " + base64.StdEncoding.EncodeToString([]byte(client.ID+":"+client.ClientSecret))
+	resp, status, body := ts.redeem(codeForm(code), "Authorization", basic)
+	if status != http.StatusOK || resp.TokenType != "Bearer" || resp.Scope != scopeDocumentsRead || resp.ExpiresIn != 3600 {
+		t.Fatalf("token: %d %s", status, body)
+	}
+	if w := ts.do(http.MethodGet, "/v1/documents/my", resp.AccessToken, ""); w.Code != http.StatusOK {
+		t.Fatalf("GET /documents/my with the OAuth token: got %d, want 200", w.Code)
+	}
+	if w := ts.do(http.MethodGet, "/v1/users/me", resp.AccessToken, ""); w.Code != http.StatusForbidden {
+		t.Fatalf("GET /users/me without profile:read: got %d, want 403", w.Code)
+	}
+
+	// Codes are single use
+	if _, status, _ := ts.redeem(codeForm(code), "Authorization", basic); status != http.StatusBadRequest {
+		t.Fatalf("reused code: got %d, want 400", status)
+	}
+
+	// Both scopes, secret in the form
+	req := authorizeRequest(client.ID)
+	req.Scope = "profile:read documents:read"
+	form := codeForm(ts.authorize(user, req).Get("code"))
+	form.Set("client_id", client.ID)
+	form.Set("client_secret", client.ClientSecret)
+	resp, status, body = ts.redeem(form)
+	if status != http.StatusOK || resp.Scope != "documents:read profile:read" {
+		t.Fatalf("token for both scopes: %d %s", status, body)
+	}
+	for _, path := range []string{"/v1/users/me", "/v1/documents/my"} {
+		if w := ts.do(http.MethodGet, path, resp.AccessToken, ""); w.Code != http.StatusOK {
+			t.Errorf("GET %s with both scopes: got %d, want 200", path, w.Code)
+		}
+	}
+	if w := ts.do(http.MethodPost, "/v1/oauth/authorize", resp.AccessToken, toJSON(t, req)); w.Code != http.StatusForbidden {
+		t.Fatalf("an OAuth token approving its own requests: got %d, want 403", w.Code)
+	}
+
+	// A denial goes back to the client too
+	req = authorizeRequest(client.ID)
+	req.Approve = false
+	if denied := ts.authorize(user, req); denied.Get("error") != "access_denied" || denied.Get("code") != "" {
+		t.Fatalf("denied redirect: %v", denied)
+	}
+}
+
+func TestOAuthPublicClient(t *testing.T) {
+	useOAuthClients(t)
+	ts := newTestServer(t)
+	admin := ts.admin("admin@example.com")
+	user, _ := ts.register("a@example.com")
+	client := ts.registerClient(admin, `{"name":"Desktop","redirect_uris":["http://127.0.0.1:8765/cb","`+testRedirectURI+`"],"public":true}`)
+	if client.ClientSecret != "" || len(client.Scopes) != 1 || client.Scopes[0] != scopeDocumentsRead {
+		t.Fatalf("public client: %+v", client)
+	}
+
+	code := ts.authorize(user, authorizeRequest(client.ID)).Get("code")
+	form := codeForm(code)
+	form.Set("code_verifier", strings.Repeat("x", 43))
+	form.Set("client_id", client.ID)
+	if _, status, _ := ts.redeem(form); status != http.StatusBadRequest {
+		t.Fatalf("wrong verifier: got %d, want 400", status)
+	}
+
+	code = ts.authorize(user, authorizeRequest(client.ID)).Get("code")
+	form = codeForm(code)
+	form.Set("client_id", client.ID)
+	if _, status, body := ts.redeem(form); status != http.StatusOK {
+		t.Fatalf("public client token: %d %s", status, body)
+	}
+}
+
+func TestOAuthRejects(t *testing.T) {
+	useOAuthClients(t)
+	ts := newTestServer(t)
+	admin := ts.admin("admin@example.com")
+	user, _ := ts.register("a@example.com")
+	client := ts.registerClient(admin, `{"name":"Partner","redirect_uris":["`+testRedirectURI+`"]}`)
+
+	for name, body := range map[string]string{
+		"http redirect":  `{"name":"x","redirect_uris":["http://partner.example/cb"]}`,
+		"fragment":       `{"name":"x","redirect_uris":["https://partner.example/cb#frag"]}`,
+		"unknown scope":  `{"name":"x","redirect_uris":["` + testRedirectURI + `"],"scopes":["users:write"]}`,
+		"no redirect":    `{"name":"x","redirect_uris":[]}`,
+		"no name at all": `{"redirect_uris":["` + testRedirectURI + `"]}`,
+	} {
+		if w := ts.do(http.MethodPost, "/v1/admin/oauth/clients", admin, body); w.Code != http.StatusBadRequest {
+			t.Errorf("register with %s: got %d, want 400", name, w.Code)
+		}
+	}
+
+	cases := map[string]struct {
+		edit func(*AuthorizeRequest)
+		want string
+	}{
+		"unknown client": {func(r *AuthorizeRequest) { r.ClientID = "nope" }, codeInvalidClient},
+		"redirect":       {func(r *AuthorizeRequest) { r.RedirectURI = "https://evil.example/cb" }, codeInvalidRequest},
+		"no pkce":        {func(r *AuthorizeRequest) { r.CodeChallenge = "" }, codeInvalidRequest},
+		"plain pkce":     {func(r *AuthorizeRequest) { r.CodeChallengeMethod = "plain" }, codeInvalidRequest},
+		"scope":          {func(r *AuthorizeRequest) { r.Scope = scopeProfileRead }, codeInvalidScope},
+		"response type":  {func(r *AuthorizeRequest) { r.ResponseType = "token" }, codeUnsupportedResponseType},
+	}
+	for name, tc := range cases {
+		req := authorizeRequest(client.ID)
+		tc.edit(&req)
+		w := ts.do(http.MethodPost, "/v1/oauth/authorize", user, toJSON(t, req))
+		if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), `"code":"`+tc.want+`"`) {
+			t.Errorf("%s: %d %s; want 400 %s", name, w.Code, w.Body, tc.want)
+		}
+	}
+
+	code := ts.authorize(user, authorizeRequest(client.ID)).Get("code")
+	form := codeForm(code)
+	form.Set("client_id", client.ID)
+	form.Set("client_secret", "wrong")
+	if _, status, _ := ts.redeem(form); status != http.StatusUnauthorized {
+		t.Fatalf("wrong client secret: got %d, want 401", status)
+	}
+	form.Set("grant_type", "password")
+	if _, status, body := ts.redeem(form); status != http.StatusBadRequest || !strings.Contains(body, codeUnsupportedGrantType) {
+		t.Fatalf("grant type: %d %s", status, body)
+	}
+
+	// Deleting the client voids its unused codes
+	if w := ts.do(http.MethodDelete, "/v1/admin/oauth/clients/"+client.ID, admin, ""); w.Code != http.StatusOK {
+		t.Fatalf("delete client: %d %s", w.Code, w.Body)
+	}
+	if pending, err := localRecords.records(context.Background(), authorizationCodeRecord); err != nil || len(pending) != 0 {
+		t.Fatalf("%d codes left after deleting the client (%v)", len(pending), err)
+	}
+	if w := ts.do(http.MethodGet, "/v1/admin/oauth/clients", admin, ""); !strings.Contains(w.Body.String(), `"clients":[]`) {
+		t.Fatalf("clients after delete: %s", w.Body)
+	}
+}
+
+func TestOAuthRedirectURIAtTokenEndpoint(t *testing.T) {
+	useOAuthClients(t)
+	ts := newTestServer(t)
+	admin := ts.admin("admin@example.com")
+	user, _ := ts.register("a@example.com")
+	client := ts.registerClient(admin, `{"name":"Desktop","redirect_uris":["`+testRedirectURI+`"],"public":true}`)
+
+	// Named in the authorization, redirect_uri must come back exactly
+	for name, redirectURI := range map[string]string{
+		"missing":  "",
+		"trailing": testRedirectURI + "/",
+		"case":     strings.ToUpper(testRedirectURI),
+	} {
+		form := codeForm(ts.authorize(user, authorizeRequest(client.ID)).Get("code"))
+		form.Set("client_id", client.ID)
+		form.Set("redirect_uri", redirectURI)
+		if redirectURI == "" {
+			form.Del("redirect_uri")
+		}
+		if _, status, body := ts.redeem(form); status != http.StatusBadRequest || !strings.Contains(body, codeInvalidGrant) {
+			t.Errorf("%s redirect_uri: %d %s, want 400 %s", name, status, body, codeInvalidGrant)
+		}
+	}
+
+	// Left to the registration, it may be omitted
+	req := authorizeRequest(client.ID)
+	req.RedirectURI = ""
+	form := codeForm(ts.authorize(user, req).Get("code"))
+	form.Set("client_id", client.ID)
+	form.Del("redirect_uri")
+	if _, status, body := ts.redeem(form); status != http.StatusOK {
+		t.Fatalf("omitted in both: %d %s", status, body)
+	}
+}
+
+func TestOAuthClientsSurviveRestart(t *testing.T) {
+	useOAuthClients(t)
+	ts := newTestServer(t)
+	admin := ts.admin("admin@example.com")
+	user, _ := ts.register("a@example.com")
+	client := ts.registerClient(admin, `{"name":"Partner","redirect_uris":["`+testRedirectURI+`"]}`)
+
+	oauthServerMutex.Lock()
+	oauthClients = make(map[string]*OAuthClient)
+	oauthServerMutex.Unlock()
+	if err := loadOAuthClients(); err != nil {
+		t.Fatal(err)
+	}
+	form := codeForm(ts.authorize(user, authorizeRequest(client.ID)).Get("code"))
+	form.Set("client_id", client.ID)
+	form.Set("client_secret", client.ClientSecret)
+	if _, status, body := ts.redeem(form); status != http.StatusOK {
+		t.Fatalf("token after reload: %d %s", status, body)
+	}
+}
+
+func TestOAuthAcrossReplicas(t *testing.T) {
+	useOAuthClients(t)
+	ts := newTestServer(t)
+	admin := ts.admin("admin@example.com")
+	user, _ := ts.register("a@example.com")
+	useSharedStore(t)
+	client := ts.registerClient(admin, `{"name":"Partner","redirect_uris":["`+testRedirectURI+`"]}`)
+	code := ts.authorize(user, authorizeRequest(client.ID)).Get("code")
+
+	// Another replica learns of the client through the change feed and
+	// redeems the code the first one issued
+	oauthServerMutex.Lock()
+	oauthClients = make(map[string]*OAuthClient)
+	oauthServerMutex.Unlock()
+	localRecords = newMemoryRecords()
+	if err := refreshRecord(context.Background(), clusterChange{Kind: "setting", ID: oauthClientsSetting}); err != nil {
+		t.Fatal(err)
+	}
+	form := codeForm(code)
+	form.Set("client_id", client.ID)
+	form.Set("client_secret", client.ClientSecret)
+	if _, status, body := ts.redeem(form); status != http.StatusOK {
+		t.Fatalf("token on another replica: %d %s", status, body)
+	}
+	if _, status, _ := ts.redeem(form); status != http.StatusBadRequest {
+		t.Fatalf("reused code: got %d, want 400", status)
+	}
+
+	// A client deleted on one replica is gone from the rest after a resync
+	if w := ts.do(http.MethodDelete, "/v1/admin/oauth/clients/"+client.ID, admin, ""); w.Code != http.StatusOK {
+		t.Fatalf("delete client: %d %s", w.Code, w.Body)
+	}
+	oauthServerMutex.Lock()
+	oauthClients[client.ID] = &OAuthClient{ID: client.ID}
+	oauthServerMutex.Unlock()
+	if err := resyncShared(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, exists := lookupOAuthClient(client.ID); exists {
+		t.Fatal("deleted client still known after resync")
+	}
+}
@@ -0,0 +1,528 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ============================================================================
+// OpenAPI Spec and Swagger UI
+// ============================================================================
+//
+// The spec is assembled at startup from the router's registered routes, so
+// every endpoint appears even if it has no entry in routeDocs. Request and
+// response schemas are reflected from the Go types the handlers bind.
+// Legacy unversioned aliases are marked deprecated.
+
+// Security schemes a route may require
+const (
+	authBearer   = "bearer"
+	authNone     = "none"
+	authInternal = "internal"
+)
+
+// routeDoc describes one endpoint for the generated spec
+type routeDoc struct {
+	Summary  string
+	Tag      string
+	Auth     string      // defaults to authBearer
+	Request  interface{} // zero value of the JSON request body type
+	Response interface{} // zero value of the success response type
+	Status   int         // success status, defaults to 200
+	Produces string      // non-JSON response content type
+	Consumes string      // non-JSON request content type
+}
+
+var routeDocs = map[string]routeDoc{
+	"GET /health":        {Summary: "Service health check", Tag: "system", Auth: authNone},
+	"GET /health/system": {Summary: "Consolidated status of this service and its siblings, with latencies", Tag: "system", Auth: authNone, Response: SystemHealth{}},
+
+	"GET /health/ready": {Summary: "Readiness: not ready while draining or while schema migrations are pending", Tag: "system", Auth: authNone, Response: Readiness{}},
+
+	"POST /auth/register": {Summary: "Create an account", Tag: "auth", Auth: authNone, Request: RegisterRequest{}, Response: AuthResponse{}, Status: http.StatusCreated},
+	"POST /auth/login":    {Summary: "Log in with email and password", Tag: "auth", Auth: authNone, Request: LoginRequest{}, Response: AuthResponse{}},
+	"POST /auth/logout":   {Summary: "Log out (client discards the token)", Tag: "auth", Auth: authNone},
+	"GET /auth/verify":    {Summary: "Verify the current token", Tag: "auth"},
+
+	"POST /auth/logout-all": {Summary: "Log out everywhere by revoking every token issued so far", Tag: "auth"},
+	"POST /auth/refresh":    {Summary: "Trade a remember_me refresh token for a new access token and the next refresh token", Tag: "auth", Auth: authNone, Request: RefreshRequest{}, Response: AuthResponse{}},
+
+	"GET /oauth/authorize":  {Summary: "Validate an OAuth authorization request and describe it for the consent screen", Tag: "oauth", Response: ConsentScreen{}},
+	"POST /oauth/authorize": {Summary: "Approve or deny an OAuth authorization request; returns where to redirect", Tag: "oauth", Request: AuthorizeRequest{}},
+	"POST /oauth/token":     {Summary: "Redeem an authorization code with its PKCE verifier for a scoped access token", Tag: "oauth", Auth: authNone, Consumes: "application/x-www-form-urlencoded", Response: OAuthTokenResponse{}},
+
+	"POST /auth/invitations/accept": {Summary: "Accept an invitation by setting a password", Tag: "auth", Auth: authNone, Request: AcceptInvitationRequest{}, Response: AuthResponse{}},
+	"POST /auth/phone/code":         {Summary: "Text a login code to a verified phone number", Tag: "auth", Auth: authNone, Request: PhoneRequest{}, Status: http.StatusAccepted},
+	"POST /auth/phone/login":        {Summary: "Log in with a texted code", Tag: "auth", Auth: authNone, Request: PhoneLoginRequest{}, Response: AuthResponse{}},
+	"POST /auth/password-strength":  {Summary: "Estimate how guessable a password is", Tag: "auth", Auth: authNone, Request: PasswordStrengthRequest{}, Response: PasswordStrength{}},
+
+	"GET /users/me":          {Summary: "Get my profile", Tag: "users", Response: UserProfile{}},
+	"PUT /users/me":          {Summary: "Update my profile", Tag: "users", Request: UpdateProfileRequest{}},
+	"GET /users/me/security": {Summary: "My recent sign-ins and security alerts", Tag: "users"},
+	"GET /users/me/usage":    {Summary: "My plan and today's query budget", Tag: "users", Response: QueryUsage{}},
+
+	"POST /users/me/phone":        {Summary: "Text a verification code to a phone number to add", Tag: "users", Request: PhoneRequest{}, Status: http.StatusAccepted},
+	"POST /users/me/phone/verify": {Summary: "Add the phone number with its code", Tag: "users", Request: PhoneVerifyRequest{}},
+	"DELETE /users/me/phone":      {Summary: "Remove my phone number", Tag: "users"},
+	"POST /users/me/merge":        {Summary: "Merge another account of mine into this one", Tag: "users", Request: SelfMergeRequest{}, Response: MergeSummary{}},
+	"GET /users/me/referral":      {Summary: "My referral code and the signups it produced", Tag: "users", Response: ReferralSummary{}},
+
+	"GET /users/me/notifications":              {Summary: "My notifications, newest first (unread, limit)", Tag: "users"},
+	"GET /users/me/notifications/unread-count": {Summary: "Number of unread notifications", Tag: "users"},
+	"POST /users/me/notifications/read-all":    {Summary: "Mark all my notifications read", Tag: "users"},
+	"POST /users/me/notifications/:id/read":    {Summary: "Mark a notification read", Tag: "users"},
+	"DELETE /users/me/notifications/:id":       {Summary: "Delete a notification", Tag: "users"},
+
+	"GET /users/me/devices":        {Summary: "My devices, most recently seen first", Tag: "users"},
+	"PATCH /users/me/devices/:id":  {Summary: "Rename a device, or trust it for 30 days so its sign-ins skip the step-up hold", Tag: "users", Request: UpdateDeviceRequest{}, Response: DeviceView{}},
+	"DELETE /users/me/devices/:id": {Summary: "Remove a device, signing out every session on it", Tag: "users"},
+
+	"GET /users/me/org":       {Summary: "My org and my role in it (org mode)", Tag: "users", Response: OrgMembership{}},
+	"GET /users/me/org/costs": {Summary: "My org's cost report for ?month=YYYY-MM; ?format=csv (org managers)", Tag: "users", Response: CostReport{}},
+
+	"GET /users/:id": {Summary: "Get a user's profile", Tag: "users", Response: UserProfile{}},
+	"GET /users/":    {Summary: "List all users (admin)", Tag: "users"},
+
+	"POST /documents/upload":       {Summary: "Upload a document for asynchronous processing", Tag: "documents", Consumes: "multipart/form-data", Status: http.StatusAccepted},
+	"POST /documents/register":     {Summary: "Register a document to me", Tag: "documents", Request: RegisterDocumentRequest{}, Status: http.StatusCreated},
+	"DELETE /documents/:filename":  {Summary: "Remove document ownership (owner or admin)", Tag: "documents"},
+	"GET /documents/my":            {Summary: "List my documents (language)", Tag: "documents"},
+	"GET /documents/org":           {Summary: "List the documents shared with my org (language)", Tag: "documents"},
+	"GET /documents/user/:user_id": {Summary: "List a user's documents (admin; language)", Tag: "documents"},
+	"GET /documents/all":           {Summary: "List all documents by owner (admin); streamed, or paged with limit and cursor", Tag: "documents"},
+	"POST /query/stream":           {Summary: "Stream an answer scoped to my documents; spends from my plan's daily queries", Tag: "query", Request: StreamQueryRequest{}, Produces: "text/event-stream"},
+	"GET /ws/chat":                 {Summary: "WebSocket chat (token via header or ?token=)", Tag: "query", Auth: authNone, Status: http.StatusSwitchingProtocols},
+	"POST /internal/access/filter": {Summary: "Filter candidate documents by read access", Tag: "internal", Auth: authInternal, Request: AccessFilterRequest{}},
+
+	"GET /documents/shared":                       {Summary: "List the documents shared with me until a time", Tag: "documents"},
+	"GET /documents/:filename/grants":             {Summary: "List who a document is shared with and until when (owner or admin)", Tag: "documents"},
+	"POST /documents/:filename/grants":            {Summary: "Share a document with a member until a date or time", Tag: "documents", Request: DocumentGrantRequest{}, Status: http.StatusCreated},
+	"DELETE /documents/:filename/grants/:user_id": {Summary: "End a share before it expires", Tag: "documents"},
+	"GET /documents/:filename/access-log":         {Summary: "List who read a document and when (owner or admin)", Tag: "documents"},
+	"GET /documents/starred":                      {Summary: "List my starred documents, newest first", Tag: "documents"},
+	"GET /documents/recent":                       {Summary: "List the documents I used lately, most recent first", Tag: "documents"},
+	"POST /documents/:filename/star":              {Summary: "Star a document I can read", Tag: "documents"},
+	"DELETE /documents/:filename/star":            {Summary: "Unstar a document", Tag: "documents"},
+	"GET /documents/:filename/notes":              {Summary: "List the notes I can see on a document", Tag: "documents"},
+	"POST /documents/:filename/notes":             {Summary: "Attach a note to a document, optionally at a page or chunk", Tag: "documents", Request: CreateNoteRequest{}, Status: http.StatusCreated},
+	"PATCH /documents/:filename/notes/:note_id":   {Summary: "Edit my note", Tag: "documents", Request: UpdateNoteRequest{}},
+	"DELETE /documents/:filename/notes/:note_id":  {Summary: "Delete a note (author, document owner or admin)", Tag: "documents"},
+	"POST /internal/access/notes":                 {Summary: "Indexed notes a user may see on documents, as query context", Tag: "internal", Auth: authInternal, Request: NotesRequest{}},
+	"POST /internal/access/retrievals":            {Summary: "Report the documents a query retrieved, for owners' access logs", Tag: "internal", Auth: authInternal, Request: RetrievalReport{}},
+	"GET /documents/:filename/preview":            {Summary: "Title, author, page count, language and opening text of a document I can read", Tag: "documents", Response: DocumentPreviewResponse{}},
+	"GET /documents/languages":                    {Summary: "Languages of the documents I can read, with counts", Tag: "documents"},
+	"GET /admin/quarantine":                       {Summary: "List uploads a malware scan blocked (admin)", Tag: "admin"},
+	"POST /admin/quarantine/:id/release":          {Summary: "Process a blocked upload without scanning it (admin)", Tag: "admin", Status: http.StatusAccepted},
+	"DELETE /admin/quarantine/:id":                {Summary: "Delete a blocked upload and its document claim (admin)", Tag: "admin"},
+	"GET /documents/:filename/chunking":           {Summary: "Chunking settings of a document I can read, and whether it needs re-chunking", Tag: "documents", Response: DocumentChunking{}},
+	"PUT /documents/:filename/chunking":           {Summary: "Override my document's chunking settings; it is re-chunked if they change", Tag: "documents", Request: ChunkingSettings{}},
+	"GET /admin/chunking":                         {Summary: "Chunking defaults, collection profiles and how many documents are stale (admin)", Tag: "admin"},
+	"POST /internal/access/citations":             {Summary: "Report the chunks a generated answer cited", Tag: "internal", Auth: authInternal, Request: CitationReport{}},
+	"GET /documents/:filename/citations":          {Summary: "How often answers cited a document I can read, and its most cited chunks", Tag: "documents"},
+	"GET /admin/citations":                        {Summary: "Most cited sources over a period, and how many documents were never cited (admin)", Tag: "admin"},
+	"POST /admin/evaluations/sets":                {Summary: "Create a golden set of questions for a collection (admin)", Tag: "admin", Request: GoldenSetRequest{}, Response: GoldenSet{}, Status: http.StatusCreated},
+	"GET /admin/evaluations/sets":                 {Summary: "List golden sets (admin)", Tag: "admin"},
+	"GET /admin/evaluations/sets/:id":             {Summary: "Get a golden set with its questions (admin)", Tag: "admin", Response: GoldenSet{}},
+	"PUT /admin/evaluations/sets/:id":             {Summary: "Replace a golden set (admin)", Tag: "admin", Request: GoldenSetRequest{}, Response: GoldenSet{}},
+	"DELETE /admin/evaluations/sets/:id":          {Summary: "Delete a golden set; its runs are kept (admin)", Tag: "admin"},
+	"POST /admin/evaluations/sets/:id/runs":       {Summary: "Evaluate a golden set against the current pipeline (admin)", Tag: "admin", Request: StartEvaluationRequest{}, Response: EvaluationRun{}, Status: http.StatusAccepted},
+	"GET /admin/evaluations/sets/:id/metrics":     {Summary: "A golden set's metrics over time, one point per completed run (admin)", Tag: "admin"},
+	"GET /admin/evaluations/runs":                 {Summary: "List evaluation runs, newest first (admin)", Tag: "admin"},
+	"GET /admin/evaluations/runs/:id":             {Summary: "Get an evaluation run with per-question scores (admin)", Tag: "admin", Response: EvaluationRun{}},
+	"POST /admin/experiments":                     {Summary: "Start a retrieval experiment; one runs at a time (admin)", Tag: "admin", Request: CreateExperimentRequest{}, Response: Experiment{}, Status: http.StatusCreated},
+	"GET /admin/experiments":                      {Summary: "List retrieval experiments, newest first (admin)", Tag: "admin"},
+	"POST /admin/experiments/:id/stop":            {Summary: "Stop a retrieval experiment; its results stay available (admin)", Tag: "admin", Response: Experiment{}},
+	"GET /admin/experiments/:id/results":          {Summary: "Compare an experiment's variants on latency, failures and citations (admin)", Tag: "admin"},
+	"GET /admin/queries":                          {Summary: "Recent queries with their experiment variant, newest first (admin)", Tag: "admin"},
+	"GET /admin/search":                           {Summary: "Search defaults, collections with their own settings and the rerankers on offer (admin)", Tag: "admin"},
+	"GET /admin/search/:collection":               {Summary: "A collection's search settings and their versions, newest first (admin)", Tag: "admin"},
+	"PUT /admin/search/:collection":               {Summary: "Set a collection's hybrid weighting and reranker as a new version; honours If-Match (admin)", Tag: "admin", Request: SearchSettingsRequest{}},
+	"DELETE /admin/search/:collection":            {Summary: "Put a collection back on the default search settings as a new version (admin)", Tag: "admin"},
+	"POST /admin/search/:collection/rollback":     {Summary: "Restore an earlier version of a collection's search settings (admin)", Tag: "admin", Request: SearchRollbackRequest{}},
+	"GET /admin/providers":                        {Summary: "The LLM and embedding failover chain and each provider's circuit breaker (admin)", Tag: "admin"},
+	"PUT /admin/providers":                        {Summary: "Replace the failover chain; honours If-Match (admin)", Tag: "admin", Request: ProviderChain{}},
+	"POST /admin/providers/check":                 {Summary: "Probe providers' health URLs now (admin)", Tag: "admin"},
+	"GET /internal/providers":                     {Summary: "Providers to use, in failover order, open breakers last", Tag: "internal", Auth: authInternal, Response: QueryProviders{}},
+	"POST /internal/providers/report":             {Summary: "Report a provider call that failed or succeeded to its circuit breaker", Tag: "internal", Auth: authInternal, Request: ProviderReport{}, Response: ProviderStatus{}},
+	"GET /internal/search":                        {Summary: "Search settings to query a collection with", Tag: "internal", Auth: authInternal, Response: QuerySearch{}},
+	"POST /internal/quota/queries":                {Summary: "Spend one of a user's daily queries, or check with dry_run; 429 when spent", Tag: "internal", Auth: authInternal, Request: QuotaCheckRequest{}, Response: QueryUsage{}},
+	"POST /internal/usage":                        {Summary: "Record the tokens an answer used against the user's cost org", Tag: "internal", Auth: authInternal, Request: UsageReport{}},
+
+	"POST /conversations":                        {Summary: "Start a conversation", Tag: "conversations", Request: ConversationRequest{}, Response: ConversationView{}, Status: http.StatusCreated},
+	"GET /conversations":                         {Summary: "List my conversations and those shared with me", Tag: "conversations"},
+	"GET /conversations/:id":                     {Summary: "Get a conversation; sources I can't read are hidden", Tag: "conversations", Response: ConversationView{}},
+	"PATCH /conversations/:id":                   {Summary: "Rename my conversation", Tag: "conversations", Request: ConversationRequest{}, Response: ConversationView{}},
+	"DELETE /conversations/:id":                  {Summary: "Delete my conversation", Tag: "conversations"},
+	"POST /conversations/:id/turns":              {Summary: "Add a question and answer (owner or collaborator)", Tag: "conversations", Request: ConversationTurnRequest{}, Response: TurnView{}, Status: http.StatusCreated},
+	"POST /conversations/:id/members":            {Summary: "Share my conversation with a member as a viewer or collaborator", Tag: "conversations", Request: ConversationMemberRequest{}, Status: http.StatusCreated},
+	"DELETE /conversations/:id/members/:user_id": {Summary: "Stop sharing my conversation with a member, or leave one", Tag: "conversations"},
+	"PUT /conversations/:id/link":                {Summary: "Create or replace my conversation's share link", Tag: "conversations", Request: ShareLinkRequest{}, Status: http.StatusCreated},
+	"DELETE /conversations/:id/link":             {Summary: "Stop my conversation's share link working", Tag: "conversations"},
+	"GET /conversations/shared/:token":           {Summary: "View a conversation through a share link", Tag: "conversations", Response: ConversationView{}},
+	"POST /conversations/shared/:token/join":     {Summary: "Join a conversation through a share link", Tag: "conversations", Response: ConversationView{}},
+
+	"POST /saved-queries":         {Summary: "Save a question, optionally on a daily or weekly schedule", Tag: "saved-queries", Request: SavedQueryRequest{}, Response: SavedQuery{}, Status: http.StatusCreated},
+	"GET /saved-queries":          {Summary: "List my saved queries", Tag: "saved-queries"},
+	"GET /saved-queries/:id":      {Summary: "Get my saved query with its last run", Tag: "saved-queries", Response: SavedQuery{}},
+	"PUT /saved-queries/:id":      {Summary: "Replace my saved query", Tag: "saved-queries", Request: SavedQueryRequest{}, Response: SavedQuery{}},
+	"DELETE /saved-queries/:id":   {Summary: "Delete my saved query", Tag: "saved-queries"},
+	"POST /saved-queries/:id/run": {Summary: "Run my saved query now and return the answer", Tag: "saved-queries", Response: SavedQueryRun{}},
+
+	"POST /internal/token/exchange": {Summary: "Exchange a user's token for a short-lived token limited to a scope (RFC 8693)", Tag: "internal", Auth: authInternal, Consumes: "application/x-www-form-urlencoded", Response: TokenExchangeResponse{}},
+	"GET /internal/revocations":     {Summary: "List users whose tokens were revoked since a time", Tag: "internal", Auth: authInternal},
+
+	"GET /jobs/dead-letter":                   {Summary: "List dead-lettered jobs (admin)", Tag: "jobs"},
+	"GET /jobs/:id":                           {Summary: "Get job status", Tag: "jobs", Response: Job{}},
+	"POST /jobs/:id/retry":                    {Summary: "Re-queue a dead-lettered job (admin)", Tag: "jobs", Status: http.StatusAccepted},
+	"POST /admin/reindex":                     {Summary: "Start or schedule a reindex campaign", Tag: "admin", Request: StartReindexRequest{}, Response: ReindexCampaign{}, Status: http.StatusAccepted},
+	"GET /admin/reindex":                      {Summary: "List reindex campaigns", Tag: "admin"},
+	"GET /admin/reindex/:id":                  {Summary: "Get reindex campaign progress", Tag: "admin", Response: ReindexCampaign{}},
+	"POST /admin/reindex/:id/pause":           {Summary: "Pause a reindex campaign", Tag: "admin", Response: ReindexCampaign{}},
+	"POST /admin/reindex/:id/resume":          {Summary: "Resume a reindex campaign", Tag: "admin", Response: ReindexCampaign{}},
+	"POST /admin/reindex/:id/cancel":          {Summary: "Cancel a reindex campaign", Tag: "admin", Response: ReindexCampaign{}},
+	"POST /admin/graphql":                     {Summary: "GraphQL queries for the admin dashboard", Tag: "admin", Request: GraphQLRequest{}},
+	"GET /admin/security-alerts":              {Summary: "List anomalous sign-in alerts (user_id, unresolved, limit)", Tag: "admin"},
+	"POST /admin/security-alerts/:id/resolve": {Summary: "Resolve an alert, optionally trusting a held sign-in", Tag: "admin", Request: ResolveAlertRequest{}, Response: SecurityAlert{}},
+	"GET /admin/stats":                        {Summary: "Usage statistics by period (day, week, month, quarter)", Tag: "admin", Response: StatsResponse{}},
+	"PUT /admin/documents/:filename/scope":    {Summary: "Promote a document to org scope or demote it to personal", Tag: "admin", Request: DocumentScopeRequest{}},
+
+	"GET /connectors":                 {Summary: "List connectors and my linked sources", Tag: "connectors"},
+	"GET /connectors/authorize/:kind": {Summary: "Start OAuth linking for a connector", Tag: "connectors"},
+	"GET /connectors/callback/:kind":  {Summary: "OAuth redirect target", Tag: "connectors", Auth: authNone, Status: http.StatusCreated},
+	"POST /connectors/s3":             {Summary: "Link an S3 bucket", Tag: "connectors", Request: LinkS3Request{}, Status: http.StatusCreated},
+	"POST /connectors/links/:id/sync": {Summary: "Sync a linked source now", Tag: "connectors", Status: http.StatusAccepted},
+	"DELETE /connectors/links/:id":    {Summary: "Unlink a source", Tag: "connectors"},
+
+	"GET /admin/audit":                {Summary: "Query the audit log (actor, action, resource, since, until)", Tag: "admin"},
+	"GET /admin/audit/export":         {Summary: "Export matching audit entries as JSON or CSV", Tag: "admin"},
+	"GET /admin/audit/verify":         {Summary: "Check the audit log's hash chain", Tag: "admin"},
+	"GET /admin/events/stream":        {Summary: "Live activity feed as Server-Sent Events; ?types= filters, Last-Event-ID resumes", Tag: "admin", Produces: "text/event-stream"},
+	"GET /admin/config":               {Summary: "Effective configuration with secrets masked", Tag: "admin"},
+	"GET /admin/network-rules":        {Summary: "List IP allow and deny rules", Tag: "admin"},
+	"GET /admin/network-rules/banned": {Summary: "List addresses banned automatically, with honeypot counters", Tag: "admin"},
+	"POST /admin/network-rules":       {Summary: "Add an IP rule", Tag: "admin", Request: NetworkRuleRequest{}, Response: NetworkRule{}, Status: http.StatusCreated},
+	"DELETE /admin/network-rules/:id": {Summary: "Remove a runtime or automatic IP rule", Tag: "admin"},
+	"GET /admin/maintenance":          {Summary: "Maintenance state and in-flight request count", Tag: "admin", Response: MaintenanceStatus{}},
+	"PUT /admin/maintenance":          {Summary: "Turn maintenance mode on or off", Tag: "admin", Request: MaintenanceRequest{}, Response: MaintenanceStatus{}},
+	"GET /admin/logging":              {Summary: "Log level and verbose modules", Tag: "admin", Response: LoggingStatus{}},
+	"GET /admin/debug/pprof/":         {Summary: "pprof profile index", Tag: "admin", Produces: "text/html"},
+	"GET /admin/debug/pprof/cmdline":  {Summary: "Process command line", Tag: "admin", Produces: "text/plain"},
+	"GET /admin/debug/pprof/profile":  {Summary: "CPU profile (seconds, default 30)", Tag: "admin", Produces: "application/octet-stream"},
+	"GET /admin/debug/pprof/symbol":   {Summary: "Symbol lookup", Tag: "admin", Produces: "text/plain"},
+	"GET /admin/debug/pprof/trace":    {Summary: "Execution trace (seconds, default 1)", Tag: "admin", Produces: "application/octet-stream"},
+	"GET /admin/debug/pprof/:profile": {Summary: "Named profile: heap, goroutine, allocs, block, mutex, threadcreate", Tag: "admin", Produces: "application/octet-stream"},
+	"GET /admin/debug/vars":           {Summary: "expvar: memstats and service counters", Tag: "admin"},
+	"GET /admin/debug/goroutines":     {Summary: "Stack dump of every goroutine", Tag: "admin", Produces: "text/plain"},
+	"GET /admin/debug/heap":           {Summary: "Heap profile taken after a GC", Tag: "admin", Produces: "application/octet-stream"},
+	"GET /admin/debug/runtime":        {Summary: "Goroutine, memory and GC summary", Tag: "admin", Response: RuntimeStats{}},
+	"PUT /admin/logging":              {Summary: "Change the log level or verbose modules at runtime", Tag: "admin", Request: LoggingRequest{}, Response: LoggingStatus{}},
+	"POST /admin/users":               {Summary: "Create a user with a temporary password or an emailed invitation", Tag: "admin", Request: CreateUserRequest{}, Response: CreateUserResponse{}, Status: http.StatusCreated},
+	"PATCH /admin/users/:id":          {Summary: "Change a user's name, email, role, status or plan", Tag: "admin", Request: UpdateUserRequest{}},
+	"DELETE /admin/users/:id":         {Summary: "Delete a user and release their documents", Tag: "admin"},
+	"POST /admin/users/:id/merge":     {Summary: "Merge another account into this user", Tag: "admin", Request: AdminMergeRequest{}, Response: MergeSummary{}},
+	"GET /admin/approvals":            {Summary: "List registrations awaiting approval, oldest first", Tag: "admin"},
+	"POST /admin/approvals":           {Summary: "Approve or deny a pending registration", Tag: "admin", Request: ApprovalDecisionRequest{}},
+	"GET /admin/pending-actions":      {Summary: "List high-risk admin actions awaiting or past a second admin's decision", Tag: "admin"},
+	"POST /admin/pending-actions":     {Summary: "Approve and run, or reject, a pending admin action", Tag: "admin", Request: PendingActionDecisionRequest{}},
+	"GET /admin/registration":         {Summary: "Registration mode and allowed email domains", Tag: "admin", Response: RegistrationSettings{}},
+	"PUT /admin/registration":         {Summary: "Change the registration settings until a restart", Tag: "admin", Request: RegistrationRequest{}, Response: RegistrationSettings{}},
+	"DELETE /admin/registration":      {Summary: "Restore the configured registration settings", Tag: "admin", Response: RegistrationSettings{}},
+	"GET /admin/referrals":            {Summary: "Signups per referral code, most first", Tag: "admin"},
+
+	"GET /admin/orgs":           {Summary: "Orgs with their totals for ?month=YYYY-MM, costliest first", Tag: "admin"},
+	"GET /admin/orgs/:id/costs": {Summary: "An org's token and storage costs for ?month=YYYY-MM; ?format=csv for chargeback", Tag: "admin", Response: CostReport{}},
+
+	"POST /admin/orgs":                            {Summary: "Create an org (org mode)", Tag: "admin", Request: CreateOrgRequest{}, Response: Org{}, Status: http.StatusCreated},
+	"GET /admin/orgs/:id":                         {Summary: "An org with its domains and member count", Tag: "admin", Response: OrgView{}},
+	"PATCH /admin/orgs/:id":                       {Summary: "Rename an org or change its default role", Tag: "admin", Request: UpdateOrgRequest{}, Response: Org{}},
+	"DELETE /admin/orgs/:id":                      {Summary: "Delete an org that has no members", Tag: "admin"},
+	"POST /admin/orgs/:id/domains":                {Summary: "Claim an email domain and get the TXT record that verifies it", Tag: "admin", Request: ClaimDomainRequest{}, Response: OrgDomain{}, Status: http.StatusCreated},
+	"POST /admin/orgs/:id/domains/:domain/verify": {Summary: "Look up a domain's TXT record; once verified, new accounts there join the org", Tag: "admin", Response: OrgDomain{}},
+	"DELETE /admin/orgs/:id/domains/:domain":      {Summary: "Release a domain; its accounts stay in the org", Tag: "admin"},
+
+	"POST /admin/exports":             {Summary: "Export audit events, sign-ins or usage for a date range as CSV or JSON lines", Tag: "admin", Request: ExportRequest{}, Response: Export{}, Status: http.StatusAccepted},
+	"GET /admin/exports":              {Summary: "List exports, newest first", Tag: "admin"},
+	"GET /admin/exports/:id":          {Summary: "An export's progress and download link", Tag: "admin", Response: Export{}},
+	"GET /admin/exports/:id/download": {Summary: "Download a ready export", Tag: "admin", Produces: "text/csv"},
+	"DELETE /admin/exports/:id":       {Summary: "Delete a finished export before it expires", Tag: "admin"},
+
+	"POST /admin/backup":  {Summary: "Download an encrypted archive of users, documents and their ownership, orgs and OAuth clients", Tag: "admin", Produces: "application/octet-stream"},
+	"POST /admin/restore": {Summary: "Replace users, documents, orgs and OAuth clients with an archive's; dry_run=true only reports the changes", Tag: "admin", Consumes: "application/octet-stream", Response: RestorePlan{}},
+
+	"POST /admin/oauth/clients":              {Summary: "Register a third-party OAuth client; the secret is only returned here", Tag: "admin", Request: RegisterOAuthClientRequest{}, Response: RegisterOAuthClientResponse{}, Status: http.StatusCreated},
+	"GET /admin/oauth/clients":               {Summary: "List registered OAuth clients", Tag: "admin"},
+	"DELETE /admin/oauth/clients/:client_id": {Summary: "Remove an OAuth client and its unused authorization codes", Tag: "admin"},
+
+	"POST /admin/users/:id/documents:bulk": {Summary: "Unregister, transfer or retag many of a user's documents; dry_run previews", Tag: "admin", Request: BulkDocumentsRequest{}, Response: BulkDocumentsResponse{}},
+
+	"POST /admin/users/:id/invitation": {Summary: "Email an invited user a new invitation link, voiding the old one", Tag: "admin"},
+
+	"POST /batch": {Summary: "Run several API requests in one round trip", Tag: "system", Request: BatchRequest{}},
+
+	"GET /openapi.json": {Summary: "This OpenAPI document", Tag: "system", Auth: authNone},
+	"GET /docs":         {Summary: "Swagger UI", Tag: "system", Auth: authNone, Produces: "text/html"},
+
+	"GET /admin/ui":           {Summary: "Admin console; signs in with the API", Tag: "admin", Auth: authNone, Produces: "text/html"},
+	"GET /admin/ui/*filepath": {Summary: "Admin console page, script and stylesheet", Tag: "admin", Auth: authNone, Produces: "text/html"},
+}
+
+// schemaBuilder reflects Go types into OpenAPI schemas
+type schemaBuilder struct {
+	components map[string]interface{}
+}
+
+// schemaFor returns an inline schema or a $ref to a named component
+func (b *schemaBuilder) schemaFor(t reflect.Type) map[string]interface{} {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	if t == reflect.TypeOf(time.Time{}) {
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": b.schemaFor(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": b.schemaFor(t.Elem())}
+	case reflect.Struct:
+		name := t.Name()
+		if name == "" {
+			return b.objectSchema(t)
+		}
+		if _, exists := b.components[name]; !exists {
+			b.components[name] = nil // reserve to stop recursion
+			b.components[name] = b.objectSchema(t)
+		}
+		return map[string]interface{}{"$ref": "#/components/schemas/" + name}
+	}
+	return map[string]interface{}{}
+}
+
+// objectSchema builds an object schema from exported, JSON-visible fields
+func (b *schemaBuilder) objectSchema(t reflect.Type) map[string]interface{} {
+	properties := make(map[string]interface{})
+	var required []string
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		properties[name] = b.schemaFor(field.Type)
+
+		if strings.Contains(field.Tag.Get("binding"), "required") {
+			required = append(required, name)
+		}
+	}
+
+	schema := map[string]interface{}{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		sort.Strings(required)
+		schema["required"] = required
+	}
+	return schema
+}
+
+var operationIDReplacer = strings.NewReplacer("/", "_", "{", "by_", "}", "")
+
+// buildOpenAPI assembles the spec from the router's routes
+func buildOpenAPI(routes gin.RoutesInfo) map[string]interface{} {
+	builder := &schemaBuilder{components: make(map[string]interface{})}
+	paths := make(map[string]map[string]interface{})
+	seen := make(map[string]bool, len(routes))
+
+	registered := make(map[string]bool, len(routes))
+	for _, route := range routes {
+		registered[route.Method+" "+route.Path] = true
+	}
+
+	for _, route := range routes {
+		// Versions share documentation entries keyed by the unversioned path
+		version, unversioned := splitAPIVersion(route.Path)
+		key := route.Method + " " + unversioned
+		seen[key] = true
+		doc, documented := routeDocs[key]
+		if !documented {
+			slog.Warn("openapi: route has no documentation entry", "route", key)
+			doc = routeDoc{Summary: key}
+		}
+
+		// Convert gin's :param segments to OpenAPI {param} templates
+		segments := strings.Split(route.Path, "/")
+		var params []interface{}
+		for i, segment := range segments {
+			if strings.HasPrefix(segment, ":") || strings.HasPrefix(segment, "*") {
+				name := segment[1:]
+				segments[i] = "{" + name + "}"
+				params = append(params, map[string]interface{}{
+					"name": name, "in": "path", "required": true,
+					"schema": map[string]interface{}{"type": "string"},
+				})
+			}
+		}
+		path := strings.Join(segments, "/")
+
+		operation := map[string]interface{}{
+			"summary":     doc.Summary,
+			"operationId": strings.ToLower(route.Method) + operationIDReplacer.Replace(path),
+		}
+		// Legacy aliases of versioned routes are deprecated
+		if version == "" && registered[route.Method+" /v1"+route.Path] {
+			operation["deprecated"] = true
+		}
+		if doc.Tag != "" {
+			operation["tags"] = []string{doc.Tag}
+		}
+		if len(params) > 0 {
+			operation["parameters"] = params
+		}
+
+		switch doc.Auth {
+		case authNone:
+			operation["security"] = []interface{}{}
+		case authInternal:
+			operation["security"] = []interface{}{map[string]interface{}{"internalToken": []string{}}}
+		}
+
+		if doc.Request != nil {
+			operation["requestBody"] = map[string]interface{}{
+				"required": true,
+				"content": map[string]interface{}{
+					"application/json": map[string]interface{}{"schema": builder.schemaFor(reflect.TypeOf(doc.Request))},
+				},
+			}
+		} else if doc.Consumes == "multipart/form-data" {
+			operation["requestBody"] = map[string]interface{}{
+				"required": true,
+				"content": map[string]interface{}{
+					"multipart/form-data": map[string]interface{}{"schema": map[string]interface{}{
+						"type":       "object",
+						"properties": map[string]interface{}{"file": map[string]interface{}{"type": "string", "format": "binary"}},
+					}},
+				},
+			}
+		}
+
+		status := doc.Status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		success := map[string]interface{}{"description": http.StatusText(status)}
+		switch {
+		case doc.Produces != "":
+			success["content"] = map[string]interface{}{doc.Produces: map[string]interface{}{}}
+		case doc.Response != nil:
+			success["content"] = map[string]interface{}{
+				"application/json": map[string]interface{}{"schema": builder.schemaFor(reflect.TypeOf(doc.Response))},
+			}
+		}
+		errorResponse := map[string]interface{}{
+			"description": "Error",
+			"content": map[string]interface{}{
+				problemContentType: map[string]interface{}{"schema": map[string]interface{}{"$ref": "#/components/schemas/Problem"}},
+			},
+		}
+		operation["responses"] = map[string]interface{}{
+			strconv.Itoa(status): success,
+			"default":            errorResponse,
+		}
+
+		if paths[path] == nil {
+			paths[path] = make(map[string]interface{})
+		}
+		paths[path][strings.ToLower(route.Method)] = operation
+	}
+
+	for key := range routeDocs {
+		if !seen[key] {
+			slog.Warn("openapi: documentation entry matches no route", "route", key)
+		}
+	}
+
+	builder.schemaFor(reflect.TypeOf(Problem{}))
+
+	// Either scheme authenticates, depending on the session mode
+	schemes := map[string]interface{}{
+		"internalToken": map[string]interface{}{"type": "apiKey", "in": "header", "name": internalTokenHeader},
+	}
+	var security []interface{}
+	if bearerTokens() {
+		schemes["bearerAuth"] = map[string]interface{}{"type": "http", "scheme": "bearer", "bearerFormat": "JWT"}
+		security = append(security, map[string]interface{}{"bearerAuth": []string{}})
+	}
+	if cookieSessions() {
+		schemes["sessionCookie"] = map[string]interface{}{"type": "apiKey", "in": "cookie", "name": config.Session.CookieName}
+		security = append(security, map[string]interface{}{"sessionCookie": []string{}})
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":       "Auth Service API",
+			"version":     "1.0.0",
+			"description": "Authentication, user management, and document ownership for the RAG application.",
+		},
+		"paths":    paths,
+		"security": security,
+		"components": map[string]interface{}{
+			"schemas":         builder.components,
+			"securitySchemes": schemes,
+		},
+	}
+}
+
+const swaggerUIPage = `<!DOCTYPE html>
+<html lang="en">
+<head>
+  <meta charset="utf-8">
+  <title>Auth Service API</title>
+  <link rel="stylesheet" href="https://unpkg.com/swagger-ui-dist@5/swagger-ui.css">
+</head>
+<body>
+  <div id="swagger-ui"></div>
+  <script src="https://unpkg.com/swagger-ui-dist@5/swagger-ui-bundle.js"></script>
+  <script>
+    window.ui = SwaggerUIBundle({ url: "/openapi.json", dom_id: "#swagger-ui" });
+  </script>
+</body>
+</html>`
+
+// mountAPIDocs serves the spec and Swagger UI. Call it after every other
+// route is registered so the spec covers the full router.
+func mountAPIDocs(r *gin.Engine) {
+	var spec map[string]interface{}
+
+	r.GET("/openapi.json", func(c *gin.Context) {
+		c.JSON(http.StatusOK, spec)
+	})
+	r.GET("/docs", func(c *gin.Context) {
+		c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(swaggerUIPage))
+	})
+
+	spec = buildOpenAPI(r.Routes())
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ============================================================================
+// Org-wide Documents
+// ============================================================================
+//
+// Besides the documents each member owns there is a shared pool: an admin
+// promotes a document to org scope with PUT /admin/documents/:filename/scope,
+// and from then on every member may read it. In org mode each org has a
+// pool of its own: an org-wide document is read by the members of its
+// owner's org (orgs.go), and accounts outside any org share the pool of
+// costs.default_org. The access filter (HTTP and gRPC) and the query proxy
+// grant it without any per-user share. The document keeps its owner, who can still
+// release it; demoting it back to personal scope leaves it readable by
+// the owner alone. Members list the pool at GET /documents/org.
+
+const (
+	documentScopePersonal = "personal"
+	documentScopeOrg      = "org"
+)
+
+// DocumentScopeRequest for PUT /admin/documents/:filename/scope
+type DocumentScopeRequest struct {
+	Scope string `json:"scope" binding:"required,oneof=personal org"`
+}
+
+// documentScope names the scope of a record
+func documentScope(record documentRecord) string {
+	if record.OrgWide {
+		return documentScopeOrg
+	}
+	return documentScopePersonal
+}
+
+// SetDocumentScope moves a document between personal and org scope and
+// returns its record before the change
+func (s *Service) SetDocumentScope(filename, scope string) (documentRecord, error) {
+	var previous documentRecord
+	err := s.documents.Update(func(tx DocumentTx) error {
+		var exists bool
+		if previous, exists = tx.get(filename); !exists {
+			return errDocumentNotFound
+		}
+		orgWide := scope == documentScopeOrg
+		if previous.OrgWide == orgWide {
+			return nil
+		}
+		record, _ := tx.setOrgWide(filename, orgWide)
+		saveDocumentMeta(filename, documentMeta(record))
+		bumpDocVersion()
+		return nil
+	})
+	return previous, err
+}
+
+// poolOf names the org whose org-wide documents a user reads; outside org
+// mode there is one pool
+func (s *Service) poolOf(user *User) string {
+	if !orgModeOn() {
+		return ""
+	}
+	lock := s.users.FieldLock(user)
+	lock.RLock()
+	defer lock.RUnlock()
+	return orgOf(user)
+}
+
+// inPool reports whether an org-wide document owned by ownerID is in a
+// user's pool
+func (s *Service) inPool(user *User, ownerID string) bool {
+	if !orgModeOn() || user.ID == ownerID {
+		return true
+	}
+	owner := s.users.ByID(ownerID)
+	return owner != nil && s.poolOf(owner) == s.poolOf(user)
+}
+
+// readable reports whether a user may read a document: they own it, it is
+// granted to them, or it is org-wide and in their pool
+func (s *Service) readable(tx DocumentTx, user *User, filename string) bool {
+	if !tx.readable(user.ID, filename) {
+		return false
+	}
+	record, _ := tx.get(filename)
+	if !record.OrgWide || record.Owner == user.ID {
+		return true
+	}
+	if until, granted := record.Grants[user.ID]; granted && time.Now().Before(until) {
+		return true
+	}
+	return s.inPool(user, record.Owner)
+}
+
+// orgWideFor returns the org-wide documents in a user's pool, sorted
+func (s *Service) orgWideFor(tx DocumentTx, user *User) []string {
+	docs := tx.orgWideDocuments()
+	if !orgModeOn() {
+		return docs
+	}
+	pooled := docs[:0]
+	for _, filename := range docs {
+		if record, _ := tx.get(filename); s.inPool(user, record.Owner) {
+			pooled = append(pooled, filename)
+		}
+	}
+	return pooled
+}
+
+// OrgWideDocuments returns the org-wide documents a user may read, sorted
+func (s *Service) OrgWideDocuments(user *User) []string {
+	var docs []string
+	s.documents.View(func(tx DocumentTx) {
+		docs = s.orgWideFor(tx, user)
+	})
+	return docs
+}
+
+// ReadableBy returns the documents a user owns together with the org-wide
+// ones in their pool and those granted to them, sorted
+func (s *Service) ReadableBy(user *User) []string {
+	userID := user.ID
+	var docs []string
+	s.documents.View(func(tx DocumentTx) {
+		docs = tx.ownedBy(userID)
+		for _, filename := range s.orgWideFor(tx, user) {
+			if !tx.owns(userID, filename) {
+				docs = append(docs, filename)
+			}
+		}
+		for filename := range tx.grantedTo(userID, time.Now()) {
+			if !tx.owns(userID, filename) && !slices.Contains(docs, filename) {
+				docs = append(docs, filename)
+			}
+		}
+	})
+	sort.Strings(docs)
+	return docs
+}
+
+// ----------------------------------------------------------------------------
+// Handlers
+// ----------------------------------------------------------------------------
+
+// getOrgDocuments lists the documents shared with the caller's org
+func (s *Server) getOrgDocuments(c *gin.Context) {
+	language, ok := languageFilter(c)
+	if !ok {
+		return
+	}
+	user := c.MustGet("user").(*User)
+	if notModified(c, documentsETag(languageScope(documentScopeOrg+":"+s.svc.poolOf(user), language))) {
+		return
+	}
+	docs := s.svc.OrgWideDocuments(user)
+	if language != "" {
+		docs = s.svc.InLanguage(docs, language)
+	}
+	c.JSON(http.StatusOK, gin.H{"documents": docs, "count": len(docs)})
+}
+
+// setDocumentScope promotes a document to org scope or demotes it to
+// personal (admin)
+func (s *Server) setDocumentScope(c *gin.Context) {
+	var req DocumentScopeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondBindError(c, err)
+		return
+	}
+	filename := c.Param("filename")
+	previous, err := s.svc.SetDocumentScope(filename, req.Scope)
+	if err != nil {
+		respondServiceError(c, err)
+		return
+	}
+	if documentScope(previous) != req.Scope {
+		auditChange(c, "document.scope", "document:"+filename,
+			gin.H{"filename": filename, "owner_id": previous.Owner, "scope": documentScope(previous)},
+			gin.H{"filename": filename, "owner_id": previous.Owner, "scope": req.Scope})
+	}
+	c.JSON(http.StatusOK, gin.H{"filename": filename, "owner_id": previous.Owner, "scope": req.Scope})
+}
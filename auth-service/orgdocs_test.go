@@ -0,0 +1,138 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestDocumentScopeEndpoints(t *testing.T) {
+	ts := newTestServer(t)
+	admin := ts.admin("admin@example.com")
+	owner, ownerID := ts.register("owner@example.com")
+	member, _ := ts.register("member@example.com")
+	ts.do(http.MethodPost, "/v1/documents/register", owner, `{"filename":"handbook.pdf"}`)
+
+	if w := ts.do(http.MethodPut, "/v1/admin/documents/handbook.pdf/scope", owner, `{"scope":"org"}`); w.Code != http.StatusForbidden {
+		t.Fatalf("promote as owner: got %d, want 403", w.Code)
+	}
+	if w := ts.do(http.MethodPut, "/v1/admin/documents/missing.pdf/scope", admin, `{"scope":"org"}`); w.Code != http.StatusNotFound {
+		t.Fatalf("unknown document: got %d, want 404", w.Code)
+	}
+	if w := ts.do(http.MethodPut, "/v1/admin/documents/handbook.pdf/scope", admin, `{"scope":"team"}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("unknown scope: got %d, want 400", w.Code)
+	}
+	if w := ts.do(http.MethodPut, "/v1/admin/documents/handbook.pdf/scope", admin, `{"scope":"org"}`); w.Code != http.StatusOK {
+		t.Fatalf("promote: %d %s", w.Code, w.Body)
+	}
+
+	w := ts.do(http.MethodGet, "/v1/documents/org", member, "")
+	var pool struct {
+		Documents []string `json:"documents"`
+	}
+	decodeJSON(t, w, &pool)
+	if len(pool.Documents) != 1 || pool.Documents[0] != "handbook.pdf" {
+		t.Fatalf("org pool = %v", pool.Documents)
+	}
+	// Promotion doesn't change who owns it
+	if got := ts.srv.svc.DocumentOwner("handbook.pdf"); got != ownerID {
+		t.Fatalf("owner = %q, want %q", got, ownerID)
+	}
+
+	ts.do(http.MethodPut, "/v1/admin/documents/handbook.pdf/scope", admin, `{"scope":"personal"}`)
+	w = ts.do(http.MethodGet, "/v1/documents/org", member, "")
+	decodeJSON(t, w, &pool)
+	if len(pool.Documents) != 0 {
+		t.Fatalf("after demotion: %v", pool.Documents)
+	}
+}
+
+func TestOrgWideDocumentAccess(t *testing.T) {
+	t.Cleanup(func() { resetLocalStores(t) })
+	member := &User{ID: "member", Role: "user"}
+	for filename, owner := range map[string]string{"handbook.pdf": "owner", "notes.pdf": "owner", "mine.pdf": "member"} {
+		if _, err := defaultService.ClaimDocument(filename, owner); err != nil {
+			t.Fatal(err)
+		}
+	}
+	candidates := []string{"handbook.pdf", "notes.pdf", "mine.pdf"}
+	if allowed := readableSubset(member, candidates); len(allowed) != 1 {
+		t.Fatalf("before promotion: %v", allowed)
+	}
+
+	if _, err := defaultService.SetDocumentScope("handbook.pdf", documentScopeOrg); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := defaultService.SetDocumentScope("mine.pdf", documentScopeOrg); err != nil {
+		t.Fatal(err)
+	}
+	if allowed := readableSubset(member, candidates); len(allowed) != 2 || allowed[0] != "handbook.pdf" || allowed[1] != "mine.pdf" {
+		t.Fatalf("after promotion: %v", allowed)
+	}
+	// Owning an org-wide document doesn't list it twice
+	if sources := allowedSources(member, nil); len(sources) != 2 {
+		t.Fatalf("query sources = %v", sources)
+	}
+	if sources := allowedSources(member, []string{"notes.pdf", "handbook.pdf"}); len(sources) != 1 || sources[0] != "handbook.pdf" {
+		t.Fatalf("requested sources = %v", sources)
+	}
+
+	defaultService.SetDocumentScope("handbook.pdf", documentScopePersonal)
+	if allowed := readableSubset(member, candidates); len(allowed) != 1 || allowed[0] != "mine.pdf" {
+		t.Fatalf("after demotion: %v", allowed)
+	}
+}
+
+func TestOrgWideDocumentsStayInTheirOrg(t *testing.T) {
+	useOrgs(t)
+	resetLocalStores(t)
+	t.Cleanup(func() { resetLocalStores(t) })
+	acmeOwner := &User{ID: "acme-owner", Email: "owner@acme.test", Role: "user", OrgID: "acme"}
+	acmeMember := &User{ID: "acme-member", Email: "member@acme.test", Role: "user", OrgID: "acme"}
+	rival := &User{ID: "globex-member", Email: "member@globex.test", Role: "user", OrgID: "globex"}
+	loner := &User{ID: "loner", Email: "loner@example.com", Role: "user"}
+	outsider := &User{ID: "outsider", Email: "outsider@example.com", Role: "user"}
+	for _, user := range []*User{acmeOwner, acmeMember, rival, loner, outsider} {
+		if _, err := localUsers.Add(user); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for filename, owner := range map[string]string{"acme.pdf": acmeOwner.ID, "open.pdf": loner.ID} {
+		if _, err := defaultService.ClaimDocument(filename, owner); err != nil {
+			t.Fatal(err)
+		}
+		defaultService.SetDocumentScope(filename, documentScopeOrg)
+	}
+	candidates := []string{"acme.pdf", "open.pdf"}
+
+	// Each org reads its own pool; accounts outside any org share one
+	for user, want := range map[*User]string{acmeMember: "acme.pdf", rival: "", outsider: "open.pdf"} {
+		allowed := readableSubset(user, candidates)
+		if got := strings.Join(allowed, ","); got != want {
+			t.Errorf("%s reads %q, want %q", user.ID, got, want)
+		}
+		if got := strings.Join(allowedSources(user, nil), ","); got != want {
+			t.Errorf("%s queries %q, want %q", user.ID, got, want)
+		}
+		if got := strings.Join(defaultService.OrgWideDocuments(user), ","); got != want {
+			t.Errorf("%s lists %q, want %q", user.ID, got, want)
+		}
+	}
+	if sources := allowedSources(rival, []string{"acme.pdf"}); len(sources) != 0 {
+		t.Fatalf("another org's document as a source: %v", sources)
+	}
+
+	// Joining an org switches pools at once, cached decisions or not
+	userLock(rival).Lock()
+	rival.OrgID = "acme"
+	userLock(rival).Unlock()
+	if allowed := readableSubset(rival, candidates); len(allowed) != 1 || allowed[0] != "acme.pdf" {
+		t.Fatalf("after joining acme: %v", allowed)
+	}
+
+	// Without org mode there is one pool
+	withConfig(t, func(cfg *Config) { cfg.Orgs.Enabled = false })
+	if allowed := readableSubset(outsider, candidates); len(allowed) != 2 {
+		t.Fatalf("without org mode: %v", allowed)
+	}
+}
@@ -0,0 +1,623 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"maps"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ============================================================================
+// Organizations
+// ============================================================================
+//
+// By default a deployment serves one organization. With orgs.enabled ("org
+// mode") admins create several under /admin/orgs, and each account belongs
+// to at most one (User.OrgID) with a role in it (User.OrgRole):
+//
+//	member   the default
+//	manager  may also read the org's cost reports at GET /users/me/org/costs
+//
+// An org claims email domains at POST /admin/orgs/:id/domains and proves
+// it controls each by publishing the returned value as a DNS TXT record at
+// _auth-service-verify.<domain>, which POST .../domains/:domain/verify
+// looks up. Once a domain is verified, accounts created with an address
+// there, by sign-up or by an admin, join the org with its default role.
+// A domain belongs to one org at a time, and subdomains don't match.
+//
+// Orgs group accounts for sign-up and chargeback (costs.go), and each has
+// its own pool of org-wide documents (orgdocs.go), read by its members
+// only. An org may also set its own access log privacy (accesslog.go) for
+// the documents its members own. Accounts outside any org are charged to costs.default_org and
+// share its pool. Orgs are kept in orgs.store_file, or in the shared
+// store when clustered, and every replica holds a copy.
+
+const (
+	OrgRoleMember  = "member"
+	OrgRoleManager = "manager"
+
+	// orgsSetting names the orgs in the shared store
+	orgsSetting = "orgs"
+
+	orgVerifyPrefix = "_auth-service-verify."
+	orgVerifyValue  = "auth-service-verification="
+)
+
+var (
+	errOrgModeOff       = errors.New("Org mode is off")
+	errUnknownOrg       = errors.New("Org not found")
+	errOrgExists        = errors.New("An org with this id already exists")
+	errOrgHasMembers    = errors.New("Move the org's members to another org first")
+	errInvalidDomain    = errors.New("domain must be an email domain such as example.com")
+	errDomainClaimed    = errors.New("Domain is already claimed")
+	errDomainNotClaimed = errors.New("Domain is not claimed by this org")
+	errDomainUnverified = errors.New("Verification TXT record not found")
+	errNotOrgManager    = errors.New("Only the org's managers can do this")
+	errNotInOrg         = errors.New("You are not in an org")
+)
+
+// lookupTXT resolves a name's TXT records; tests replace it
+var lookupTXT = net.DefaultResolver.LookupTXT
+
+// Org is an organization in org mode
+type Org struct {
+	ID          string      `json:"id"`
+	Name        string      `json:"name"`
+	DefaultRole string      `json:"default_role"` // for accounts placed by a verified domain
+	Domains     []OrgDomain `json:"domains"`
+	CreatedBy   string      `json:"created_by"`
+	CreatedAt   time.Time   `json:"created_at"`
+
+	// AccessLog overrides access_log.enabled and access_log.readers for
+	// documents the org's members own (accesslog.go)
+	AccessLog *OrgAccessLog `json:"access_log,omitempty"`
+}
+
+// OrgDomain is an email domain an org claims
+type OrgDomain struct {
+	Domain     string     `json:"domain"`
+	TXTName    string     `json:"txt_name"`  // where to publish TXTValue
+	TXTValue   string     `json:"txt_value"` // proves the org controls the domain
+	ClaimedAt  time.Time  `json:"claimed_at"`
+	VerifiedAt *time.Time `json:"verified_at,omitempty"`
+}
+
+// OrgView is an org with its member count
+type OrgView struct {
+	*Org
+	Members int `json:"members"`
+}
+
+// CreateOrgRequest for POST /admin/orgs
+type CreateOrgRequest struct {
+	ID          string `json:"id" binding:"required"`
+	Name        string `json:"name" binding:"required,max=100"`
+	DefaultRole string `json:"default_role" binding:"omitempty,oneof=member manager"` // default member
+}
+
+// UpdateOrgRequest for PATCH /admin/orgs/:id; omitted fields are unchanged
+type UpdateOrgRequest struct {
+	Name        *string       `json:"name,omitempty" binding:"omitempty,min=1,max=100"`
+	DefaultRole *string       `json:"default_role,omitempty" binding:"omitempty,oneof=member manager"`
+	AccessLog   *OrgAccessLog `json:"access_log,omitempty"` // replaces the override; {} follows the configuration again
+}
+
+// ClaimDomainRequest for POST /admin/orgs/:id/domains
+type ClaimDomainRequest struct {
+	Domain string `json:"domain" binding:"required"`
+}
+
+// OrgMembership is GET /users/me/org
+type OrgMembership struct {
+	OrgID   string `json:"org_id"`
+	OrgName string `json:"org_name"`
+	Role    string `json:"role"`
+}
+
+var (
+	orgs     = make(map[string]*Org) // org id -> org; replaced, never modified in place
+	orgMutex sync.RWMutex
+)
+
+func orgModeOn() bool {
+	return config.Orgs.Enabled
+}
+
+// lookupOrg returns an org in org mode
+func lookupOrg(id string) (*Org, bool) {
+	if !orgModeOn() {
+		return nil, false
+	}
+	orgMutex.RLock()
+	defer orgMutex.RUnlock()
+	org, exists := orgs[id]
+	return org, exists
+}
+
+// orgForEmail returns the org that verified an address's domain
+func orgForEmail(email string) *Org {
+	if !orgModeOn() {
+		return nil
+	}
+	_, domain, found := strings.Cut(email, "@")
+	if !found {
+		return nil
+	}
+	domain = normalizeEmailDomain(domain)
+	orgMutex.RLock()
+	defer orgMutex.RUnlock()
+	for _, org := range orgs {
+		for _, claim := range org.Domains {
+			if claim.Domain == domain && claim.VerifiedAt != nil {
+				return org
+			}
+		}
+	}
+	return nil
+}
+
+// placeInOrg puts a new account in the org that verified its email's
+// domain, with the org's default role
+func placeInOrg(user *User) {
+	if org := orgForEmail(user.Email); org != nil {
+		user.OrgID, user.OrgRole = org.ID, org.DefaultRole
+	}
+}
+
+// orgRoleOf is a member's role in their org
+func orgRoleOf(user *User) string {
+	if user.OrgID == "" {
+		return ""
+	}
+	if user.OrgRole == "" {
+		return OrgRoleMember
+	}
+	return user.OrgRole
+}
+
+// ----------------------------------------------------------------------------
+// Storage
+// ----------------------------------------------------------------------------
+
+// loadOrgs reads the orgs from the shared store when clustered, otherwise
+// from orgs.store_file
+func loadOrgs() error {
+	if clustered() {
+		return refreshSetting(context.Background(), orgsSetting)
+	}
+	data, err := os.ReadFile(config.Orgs.StoreFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return applyOrgsSetting(data)
+}
+
+// applyOrgsSetting replaces this replica's copy of the orgs
+func applyOrgsSetting(data []byte) error {
+	var stored []*Org
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return err
+	}
+	loaded := make(map[string]*Org, len(stored))
+	for _, org := range stored {
+		loaded[org.ID] = org
+	}
+	orgMutex.Lock()
+	orgs = loaded
+	orgMutex.Unlock()
+	return nil
+}
+
+// storeOrgs writes the orgs where loadOrgs reads them
+func storeOrgs(changed map[string]*Org) error {
+	stored := make([]*Org, 0, len(changed))
+	for _, org := range changed {
+		stored = append(stored, org)
+	}
+	sort.Slice(stored, func(i, j int) bool { return stored[i].ID < stored[j].ID })
+	data, err := json.Marshal(stored)
+	if err != nil {
+		return err
+	}
+	if clustered() {
+		return saveSharedSetting(orgsSetting, data)
+	}
+	if dir := filepath.Dir(config.Orgs.StoreFile); dir != "." {
+		if err := os.MkdirAll(dir, 0o700); err != nil {
+			return err
+		}
+	}
+	return jobFiles{}.write(config.Orgs.StoreFile, data)
+}
+
+// updateOrgs changes the orgs one writer at a time, starting from the
+// shared store's copy when clustered; a failed save changes nothing
+func updateOrgs(change func(changed map[string]*Org) error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), config.Cluster.LockTTL)
+	defer cancel()
+	release, err := acquireLock(ctx, orgsSetting, config.Cluster.LockTTL)
+	if err != nil {
+		slog.Error("Orgs lock failed", "error", err)
+		return errStoreUnavailable
+	}
+	defer release()
+	if clustered() {
+		if err := refreshSetting(ctx, orgsSetting); err != nil {
+			slog.Error("Cluster store read failed", "op", "orgs", "error", err)
+			return errStoreUnavailable
+		}
+	}
+
+	orgMutex.RLock()
+	changed := maps.Clone(orgs)
+	orgMutex.RUnlock()
+	if err := change(changed); err != nil {
+		return err
+	}
+	if err := storeOrgs(changed); err != nil {
+		return err
+	}
+	orgMutex.Lock()
+	orgs = changed
+	orgMutex.Unlock()
+	return nil
+}
+
+// updateOrg changes one org through updateOrgs. change gets a copy, or nil
+// if the org doesn't exist, and returns the org to keep, nil to delete it.
+func updateOrg(id string, change func(org *Org) (*Org, error)) (*Org, error) {
+	var org *Org
+	err := updateOrgs(func(changed map[string]*Org) error {
+		var draft *Org
+		if current := changed[id]; current != nil {
+			copied := *current
+			copied.Domains = slices.Clone(current.Domains)
+			draft = &copied
+		}
+		var err error
+		if org, err = change(draft); err != nil {
+			return err
+		}
+		if org == nil {
+			delete(changed, id)
+		} else {
+			changed[id] = org
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return org, nil
+}
+
+// domainClaimed reports whether another org claims a domain
+func domainClaimed(domain, exceptOrg string) bool {
+	orgMutex.RLock()
+	defer orgMutex.RUnlock()
+	for _, org := range orgs {
+		if org.ID == exceptOrg {
+			continue
+		}
+		for _, claim := range org.Domains {
+			if claim.Domain == domain {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ----------------------------------------------------------------------------
+// Handlers
+// ----------------------------------------------------------------------------
+
+// requireOrgMode answers 503 unless org mode is on
+func requireOrgMode(c *gin.Context) bool {
+	if !orgModeOn() {
+		respondError(c, http.StatusServiceUnavailable, codeNotConfigured, errOrgModeOff.Error())
+		return false
+	}
+	return true
+}
+
+// respondOrgError maps org errors to responses
+func respondOrgError(c *gin.Context, err error) {
+	switch err {
+	case errUnknownOrg, errDomainNotClaimed:
+		respondError(c, http.StatusNotFound, codeNotFound, err.Error())
+	case errOrgExists, errOrgHasMembers, errDomainClaimed, errDomainUnverified:
+		respondError(c, http.StatusConflict, codeConflict, err.Error())
+	default:
+		respondServiceError(c, err)
+	}
+}
+
+// createOrg adds an org (admin, org mode)
+func createOrg(c *gin.Context) {
+	if !requireOrgMode(c) {
+		return
+	}
+	var req CreateOrgRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondBindError(c, err)
+		return
+	}
+	if !orgIDPattern.MatchString(req.ID) || req.ID == config.Costs.DefaultOrg {
+		respondError(c, http.StatusBadRequest, codeInvalidRequest, errInvalidOrgID.Error())
+		return
+	}
+	if req.DefaultRole == "" {
+		req.DefaultRole = OrgRoleMember
+	}
+
+	user, _ := c.Get("user")
+	org, err := updateOrg(req.ID, func(existing *Org) (*Org, error) {
+		if existing != nil {
+			return nil, errOrgExists
+		}
+		return &Org{
+			ID:          req.ID,
+			Name:        strings.TrimSpace(req.Name),
+			DefaultRole: req.DefaultRole,
+			Domains:     []OrgDomain{},
+			CreatedBy:   user.(*User).ID,
+			CreatedAt:   time.Now().UTC(),
+		}, nil
+	})
+	if err != nil {
+		respondOrgError(c, err)
+		return
+	}
+	auditChange(c, "admin.org.create", "org:"+org.ID, nil, org)
+	c.JSON(http.StatusCreated, org)
+}
+
+// getOrg returns an org with its domains and member count (admin, org mode)
+func (s *Server) getOrg(c *gin.Context) {
+	if !requireOrgMode(c) {
+		return
+	}
+	org, exists := lookupOrg(c.Param("id"))
+	if !exists {
+		respondOrgError(c, errUnknownOrg)
+		return
+	}
+	c.JSON(http.StatusOK, OrgView{Org: org, Members: s.svc.orgMembers()[org.ID]})
+}
+
+// updateOrgSettings renames an org or changes its default role or access
+// log privacy (admin, org mode)
+func updateOrgSettings(c *gin.Context) {
+	if !requireOrgMode(c) {
+		return
+	}
+	var req UpdateOrgRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondBindError(c, err)
+		return
+	}
+	var before Org
+	org, err := updateOrg(c.Param("id"), func(org *Org) (*Org, error) {
+		if org == nil {
+			return nil, errUnknownOrg
+		}
+		before = *org
+		if req.Name != nil {
+			org.Name = strings.TrimSpace(*req.Name)
+		}
+		if req.DefaultRole != nil {
+			org.DefaultRole = *req.DefaultRole
+		}
+		if req.AccessLog != nil {
+			org.AccessLog = req.AccessLog
+			if req.AccessLog.Enabled == nil && req.AccessLog.Readers == "" {
+				org.AccessLog = nil
+			}
+		}
+		return org, nil
+	})
+	if err != nil {
+		respondOrgError(c, err)
+		return
+	}
+	auditChange(c, "admin.org.update", "org:"+org.ID, before, org)
+	c.JSON(http.StatusOK, org)
+}
+
+// deleteOrg removes an org without members (admin, org mode); its cost
+// history stays in the ledger
+func (s *Server) deleteOrg(c *gin.Context) {
+	if !requireOrgMode(c) {
+		return
+	}
+	id := c.Param("id")
+	var before *Org
+	_, err := updateOrg(id, func(org *Org) (*Org, error) {
+		if org == nil {
+			return nil, errUnknownOrg
+		}
+		if s.svc.orgMembers()[id] > 0 {
+			return nil, errOrgHasMembers
+		}
+		before = org
+		return nil, nil
+	})
+	if err != nil {
+		respondOrgError(c, err)
+		return
+	}
+	auditChange(c, "admin.org.delete", "org:"+id, before, nil)
+	c.JSON(http.StatusOK, gin.H{"message": "Org deleted"})
+}
+
+// claimOrgDomain claims an email domain for an org and returns the TXT
+// record that verifies it (admin, org mode)
+func claimOrgDomain(c *gin.Context) {
+	if !requireOrgMode(c) {
+		return
+	}
+	var req ClaimDomainRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondBindError(c, err)
+		return
+	}
+	domain := normalizeEmailDomain(req.Domain)
+	if !validEmailDomain(domain) {
+		respondError(c, http.StatusBadRequest, codeInvalidRequest, errInvalidDomain.Error())
+		return
+	}
+	raw := make([]byte, 16)
+	if _, err := rand.Read(raw); err != nil {
+		respondError(c, http.StatusInternalServerError, codeInternal, "Failed to generate a verification token")
+		return
+	}
+
+	id := c.Param("id")
+	var claim OrgDomain
+	_, err := updateOrg(id, func(org *Org) (*Org, error) {
+		if org == nil {
+			return nil, errUnknownOrg
+		}
+		if domainClaimed(domain, "") {
+			return nil, errDomainClaimed
+		}
+		claim = OrgDomain{
+			Domain:    domain,
+			TXTName:   orgVerifyPrefix + domain,
+			TXTValue:  orgVerifyValue + hex.EncodeToString(raw),
+			ClaimedAt: time.Now().UTC(),
+		}
+		org.Domains = append(org.Domains, claim)
+		return org, nil
+	})
+	if err != nil {
+		respondOrgError(c, err)
+		return
+	}
+	auditChange(c, "admin.org.domain.claim", "org:"+id, nil, gin.H{"domain": domain})
+	c.JSON(http.StatusCreated, claim)
+}
+
+// verifyOrgDomain looks up a claimed domain's TXT record and, if it is
+// there, starts placing the domain's new accounts in the org (admin, org
+// mode)
+func verifyOrgDomain(c *gin.Context) {
+	if !requireOrgMode(c) {
+		return
+	}
+	id, domain := c.Param("id"), normalizeEmailDomain(c.Param("domain"))
+	org, exists := lookupOrg(id)
+	if !exists {
+		respondOrgError(c, errUnknownOrg)
+		return
+	}
+	index := slices.IndexFunc(org.Domains, func(claim OrgDomain) bool { return claim.Domain == domain })
+	if index < 0 {
+		respondOrgError(c, errDomainNotClaimed)
+		return
+	}
+	want := org.Domains[index].TXTValue
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+	records, err := lookupTXT(ctx, orgVerifyPrefix+domain)
+	if err != nil || !slices.Contains(records, want) {
+		debugLog("auth", "Domain verification failed", "domain", domain, "error", err)
+		respondOrgError(c, errDomainUnverified)
+		return
+	}
+
+	var claim OrgDomain
+	_, err = updateOrg(id, func(org *Org) (*Org, error) {
+		if org == nil {
+			return nil, errUnknownOrg
+		}
+		index := slices.IndexFunc(org.Domains, func(claim OrgDomain) bool { return claim.Domain == domain })
+		if index < 0 || org.Domains[index].TXTValue != want {
+			return nil, errDomainNotClaimed
+		}
+		if org.Domains[index].VerifiedAt == nil {
+			now := time.Now().UTC()
+			org.Domains[index].VerifiedAt = &now
+		}
+		claim = org.Domains[index]
+		return org, nil
+	})
+	if err != nil {
+		respondOrgError(c, err)
+		return
+	}
+	auditChange(c, "admin.org.domain.verify", "org:"+id, nil, gin.H{"domain": domain})
+	c.JSON(http.StatusOK, claim)
+}
+
+// releaseOrgDomain drops an org's claim on a domain; its members stay in
+// the org (admin, org mode)
+func releaseOrgDomain(c *gin.Context) {
+	if !requireOrgMode(c) {
+		return
+	}
+	id, domain := c.Param("id"), normalizeEmailDomain(c.Param("domain"))
+	_, err := updateOrg(id, func(org *Org) (*Org, error) {
+		if org == nil {
+			return nil, errUnknownOrg
+		}
+		index := slices.IndexFunc(org.Domains, func(claim OrgDomain) bool { return claim.Domain == domain })
+		if index < 0 {
+			return nil, errDomainNotClaimed
+		}
+		org.Domains = slices.Delete(org.Domains, index, index+1)
+		return org, nil
+	})
+	if err != nil {
+		respondOrgError(c, err)
+		return
+	}
+	auditChange(c, "admin.org.domain.release", "org:"+id, gin.H{"domain": domain}, nil)
+	c.JSON(http.StatusOK, gin.H{"message": "Domain released"})
+}
+
+// getMyOrg returns the caller's org and role in it
+func (s *Server) getMyOrg(c *gin.Context) {
+	user, _ := c.Get("user")
+	snapshot := s.svc.userSnapshot(user.(*User))
+	org, exists := lookupOrg(snapshot.OrgID)
+	if !exists {
+		respondError(c, http.StatusNotFound, codeNotFound, errNotInOrg.Error())
+		return
+	}
+	c.JSON(http.StatusOK, OrgMembership{OrgID: org.ID, OrgName: org.Name, Role: orgRoleOf(&snapshot)})
+}
+
+// getMyOrgCosts prices the caller's org's month (org managers)
+func (s *Server) getMyOrgCosts(c *gin.Context) {
+	user, _ := c.Get("user")
+	snapshot := s.svc.userSnapshot(user.(*User))
+	if _, exists := lookupOrg(snapshot.OrgID); !exists {
+		respondError(c, http.StatusNotFound, codeNotFound, errNotInOrg.Error())
+		return
+	}
+	if orgRoleOf(&snapshot) != OrgRoleManager {
+		respondError(c, http.StatusForbidden, codeForbidden, errNotOrgManager.Error())
+		return
+	}
+	s.respondOrgCosts(c, snapshot.OrgID)
+}
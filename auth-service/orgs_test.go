@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"path/filepath"
+	"testing"
+)
+
+// useOrgs turns on org mode with an empty store
+func useOrgs(t *testing.T) {
+	t.Helper()
+	withConfig(t, func(cfg *Config) {
+		cfg.Orgs.Enabled = true
+		cfg.Orgs.StoreFile = filepath.Join(t.TempDir(), "orgs.json")
+	})
+	reset := func() {
+		orgMutex.Lock()
+		orgs = make(map[string]*Org)
+		orgMutex.Unlock()
+	}
+	reset()
+	t.Cleanup(reset)
+}
+
+// stubTXT answers TXT lookups from a map
+func stubTXT(t *testing.T, records map[string][]string) {
+	t.Helper()
+	saved := lookupTXT
+	lookupTXT = func(_ context.Context, name string) ([]string, error) {
+		return records[name], nil
+	}
+	t.Cleanup(func() { lookupTXT = saved })
+}
+
+func TestOrgModeOff(t *testing.T) {
+	ts := newTestServer(t)
+	admin := ts.admin("admin@example.com")
+	user, userID := ts.register("user@example.com")
+
+	if w := ts.do(http.MethodPost, "/v1/admin/orgs", admin, `{"id":"research","name":"Research"}`); w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("create without org mode: got %d, want 503", w.Code)
+	}
+	if w := ts.do(http.MethodPatch, "/v1/admin/users/"+userID, admin, `{"org_id":"research"}`); w.Code != http.StatusConflict {
+		t.Fatalf("assign without org mode: got %d, want 409", w.Code)
+	}
+	if w := ts.do(http.MethodGet, "/v1/users/me/org", user, ""); w.Code != http.StatusNotFound {
+		t.Fatalf("my org without org mode: got %d, want 404", w.Code)
+	}
+}
+
+func TestOrgDomains(t *testing.T) {
+	useOrgs(t)
+	withConfig(t, func(cfg *Config) { cfg.Auth.InternalAPIToken = testInternalToken })
+	ts := newTestServer(t)
+	admin := ts.admin("admin@example.com")
+
+	if w := ts.do(http.MethodPost, "/v1/admin/orgs", admin, `{"id":"acme","name":"Acme"}`); w.Code != http.StatusCreated {
+		t.Fatalf("create: %d %s", w.Code, w.Body)
+	}
+	if w := ts.do(http.MethodPost, "/v1/admin/orgs", admin, `{"id":"acme","name":"Acme again"}`); w.Code != http.StatusConflict {
+		t.Fatalf("duplicate id: got %d, want 409", w.Code)
+	}
+	if w := ts.do(http.MethodPost, "/v1/admin/orgs", admin, `{"id":"default","name":"Default"}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("the default org's id: got %d, want 400", w.Code)
+	}
+	ts.do(http.MethodPost, "/v1/admin/orgs", admin, `{"id":"rival","name":"Rival"}`)
+
+	var claim OrgDomain
+	w := ts.do(http.MethodPost, "/v1/admin/orgs/acme/domains", admin, `{"domain":"Acme.Test"}`)
+	decodeJSON(t, w, &claim)
+	if w.Code != http.StatusCreated || claim.Domain != "acme.test" || claim.TXTName != "_auth-service-verify.acme.test" || claim.VerifiedAt != nil {
+		t.Fatalf("claim: %d %+v", w.Code, claim)
+	}
+	if w := ts.do(http.MethodPost, "/v1/admin/orgs/rival/domains", admin, `{"domain":"acme.test"}`); w.Code != http.StatusConflict {
+		t.Fatalf("claimed twice: got %d, want 409", w.Code)
+	}
+	if w := ts.do(http.MethodPost, "/v1/admin/orgs/acme/domains", admin, `{"domain":"not a domain"}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("invalid domain: got %d, want 400", w.Code)
+	}
+
+	// Unverified, the domain places no one
+	early, _ := ts.register("early@acme.test")
+	if w := ts.do(http.MethodGet, "/v1/users/me/org", early, ""); w.Code != http.StatusNotFound {
+		t.Fatalf("before verification: got %d, want 404", w.Code)
+	}
+	records := map[string][]string{}
+	stubTXT(t, records)
+	if w := ts.do(http.MethodPost, "/v1/admin/orgs/acme/domains/acme.test/verify", admin, ""); w.Code != http.StatusConflict {
+		t.Fatalf("verify without the record: got %d, want 409", w.Code)
+	}
+	records[claim.TXTName] = []string{"v=spf1 -all", claim.TXTValue}
+	w = ts.do(http.MethodPost, "/v1/admin/orgs/acme/domains/acme.test/verify", admin, "")
+	decodeJSON(t, w, &claim)
+	if w.Code != http.StatusOK || claim.VerifiedAt == nil {
+		t.Fatalf("verify: %d %+v", w.Code, claim)
+	}
+
+	// Sign-ups and admin-created accounts on the domain join the org;
+	// subdomains don't
+	alice, aliceID := ts.register("alice@acme.test")
+	var membership OrgMembership
+	decodeJSON(t, ts.do(http.MethodGet, "/v1/users/me/org", alice, ""), &membership)
+	if membership.OrgID != "acme" || membership.OrgName != "Acme" || membership.Role != OrgRoleMember {
+		t.Fatalf("membership: %+v", membership)
+	}
+	if w := ts.do(http.MethodPost, "/v1/admin/users", admin, `{"email":"bob@acme.test","name":"Bob Builder"}`); w.Code != http.StatusCreated {
+		t.Fatalf("admin create: %d %s", w.Code, w.Body)
+	}
+	if bob := ts.srv.svc.users.ByEmail("bob@acme.test"); bob == nil || bob.OrgID != "acme" {
+		t.Fatalf("admin-created account not placed: %+v", bob)
+	}
+	sub, _ := ts.register("carol@eu.acme.test")
+	if w := ts.do(http.MethodGet, "/v1/users/me/org", sub, ""); w.Code != http.StatusNotFound {
+		t.Fatalf("subdomain: got %d, want 404", w.Code)
+	}
+
+	// Only managers read the org's costs
+	if w := ts.do(http.MethodPost, "/v1/internal/usage", "", `{"user_id":"`+aliceID+`","model":"gpt-test","prompt_tokens":10}`,
+		internalTokenHeader, testInternalToken); w.Code != http.StatusOK {
+		t.Fatalf("report usage: %d %s", w.Code, w.Body)
+	}
+	t.Cleanup(func() {
+		costMutex.Lock()
+		costLedger, costDirty = make(map[string]map[string]*OrgUsage), false
+		costMutex.Unlock()
+	})
+	if w := ts.do(http.MethodGet, "/v1/users/me/org/costs", alice, ""); w.Code != http.StatusForbidden {
+		t.Fatalf("member reads costs: got %d, want 403", w.Code)
+	}
+	if w := ts.do(http.MethodPatch, "/v1/admin/users/"+aliceID, admin, `{"org_role":"manager"}`); w.Code != http.StatusOK {
+		t.Fatalf("promote: %d %s", w.Code, w.Body)
+	}
+	var costs CostReport
+	w = ts.do(http.MethodGet, "/v1/users/me/org/costs", alice, "")
+	decodeJSON(t, w, &costs)
+	if w.Code != http.StatusOK || costs.Org != "acme" || len(costs.Models) != 1 || costs.Models[0].PromptTokens != 10 {
+		t.Fatalf("manager reads costs: %d %+v", w.Code, costs)
+	}
+
+	// An org with members can't be deleted; releasing the domain keeps them
+	if w := ts.do(http.MethodDelete, "/v1/admin/orgs/acme", admin, ""); w.Code != http.StatusConflict {
+		t.Fatalf("delete with members: got %d, want 409", w.Code)
+	}
+	if w := ts.do(http.MethodDelete, "/v1/admin/orgs/acme/domains/acme.test", admin, ""); w.Code != http.StatusOK {
+		t.Fatalf("release: %d %s", w.Code, w.Body)
+	}
+	late, _ := ts.register("dave@acme.test")
+	if w := ts.do(http.MethodGet, "/v1/users/me/org", late, ""); w.Code != http.StatusNotFound {
+		t.Fatalf("after release: got %d, want 404", w.Code)
+	}
+	decodeJSON(t, ts.do(http.MethodGet, "/v1/users/me/org", alice, ""), &membership)
+	if membership.OrgID != "acme" || membership.Role != OrgRoleManager {
+		t.Fatalf("membership after release: %+v", membership)
+	}
+	ts.do(http.MethodPatch, "/v1/admin/users/"+aliceID, admin, `{"org_id":""}`)
+	ts.do(http.MethodPatch, "/v1/admin/users/"+ts.srv.svc.users.ByEmail("bob@acme.test").ID, admin, `{"org_id":""}`)
+	if w := ts.do(http.MethodDelete, "/v1/admin/orgs/acme", admin, ""); w.Code != http.StatusOK {
+		t.Fatalf("delete emptied org: %d %s", w.Code, w.Body)
+	}
+	if user := ts.srv.svc.users.ByID(aliceID); user.OrgID != "" || user.OrgRole != "" {
+		t.Fatalf("left the org: %+v", user)
+	}
+}
+
+func TestOrgsPersist(t *testing.T) {
+	useOrgs(t)
+	ts := newTestServer(t)
+	admin := ts.admin("admin@example.com")
+	ts.do(http.MethodPost, "/v1/admin/orgs", admin, `{"id":"acme","name":"Acme","default_role":"manager"}`)
+
+	// A restart reads the store file back
+	orgMutex.Lock()
+	orgs = make(map[string]*Org)
+	orgMutex.Unlock()
+	if err := loadOrgs(); err != nil {
+		t.Fatal(err)
+	}
+	if org, exists := lookupOrg("acme"); !exists || org.DefaultRole != OrgRoleManager {
+		t.Fatalf("after restart: %+v", org)
+	}
+
+	// Clustered, another replica learns of a new org through the change feed
+	useSharedStore(t)
+	if w := ts.do(http.MethodPost, "/v1/admin/orgs", admin, `{"id":"globex","name":"Globex"}`); w.Code != http.StatusCreated {
+		t.Fatalf("create clustered: %d %s", w.Code, w.Body)
+	}
+	orgMutex.Lock()
+	orgs = make(map[string]*Org)
+	orgMutex.Unlock()
+	if err := refreshRecord(context.Background(), clusterChange{Kind: "setting", ID: orgsSetting}); err != nil {
+		t.Fatal(err)
+	}
+	if _, exists := lookupOrg("globex"); !exists {
+		t.Fatal("org created on another replica is unknown")
+	}
+	if _, exists := lookupOrg("acme"); !exists {
+		t.Fatal("an org from before clustering was lost")
+	}
+}
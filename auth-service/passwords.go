@@ -0,0 +1,432 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log/slog"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ============================================================================
+// Password Hashing
+// ============================================================================
+//
+// passwords.algorithm selects bcrypt or argon2id for new hashes. Each hash
+// records its own algorithm and parameters (argon2id uses the PHC string
+// format), so existing hashes keep verifying after the settings change. A
+// successful login replaces a hash made with another algorithm or other
+// parameters, which upgrades accounts without forcing password resets.
+//
+// Hashing and comparing run on a bounded pool (passwords.workers slots)
+// rather than freely on request goroutines, so a burst of logins can't
+// take every CPU from other handlers. Callers wait for a slot in a queue of
+// passwords.queue_size; when the queue is full, or no slot frees up within
+// passwords.queue_timeout, the request fails fast with 503.
+//
+// With passwords.peppers set, passwords are keyed with a server-side
+// pepper (HMAC-SHA256) before hashing, so a copy of the user store alone
+// isn't enough to brute-force them. The pepper is a secret setting; keep
+// it in Vault or AWS Secrets Manager through secrets.refs rather than next
+// to the database. Peppered hashes are stored as $pepper$<id>$<hash>, so
+// peppers rotate like algorithms do: list the new one (it becomes current
+// unless passwords.pepper_id names another), and each login re-hashes
+// under it. A fetched change to the peppers applies without a restart.
+// Keep retired peppers listed until /admin/debug/vars shows no hashes
+// using them; those passwords can't be checked without their pepper.
+
+const (
+	passwordAlgBcrypt   = "bcrypt"
+	passwordAlgArgon2id = "argon2id"
+
+	argon2SaltLength = 16
+	argon2KeyLength  = 32
+
+	// Bounds for parameters read from stored hashes: argon2.IDKey panics
+	// below one pass or lane, and a hash asking for gigabytes of memory
+	// would take the login handler down with it
+	argon2MaxMemory     = 1 << 20 // KiB (1 GiB)
+	argon2MaxIterations = 100
+	argon2MinSaltLength = 8
+	argon2MaxSaltLength = 64
+	argon2MinKeyLength  = 16
+	argon2MaxKeyLength  = 128
+
+	pepperPrefix      = "$pepper$"
+	minPepperLength   = 32 // bytes
+	maxPepperIDLength = 32
+)
+
+var errPasswordBusy = errors.New("Too many password checks in progress; try again shortly")
+
+// passwordWorkers bounds concurrent hash and compare operations. slots
+// holds a token per running operation; waiting counts queued callers.
+type passwordWorkers struct {
+	slots   chan struct{}
+	waiting atomic.Int64
+	limit   int64
+	timeout time.Duration
+}
+
+var passwordPool *passwordWorkers // nil runs work inline (tests, tools)
+
+// setupPasswordPool sizes the pool from the configuration
+func setupPasswordPool() {
+	cfg := config.Passwords
+	workers := cfg.Workers
+	if workers == 0 {
+		workers = runtime.NumCPU()
+	}
+	passwordPool = &passwordWorkers{
+		slots:   make(chan struct{}, workers),
+		limit:   int64(cfg.QueueSize),
+		timeout: cfg.QueueTimeout,
+	}
+}
+
+// runPasswordWork runs fn once a pool slot is free, or returns
+// errPasswordBusy without running it
+func runPasswordWork(fn func()) error {
+	pool := passwordPool
+	if pool == nil {
+		fn()
+		return nil
+	}
+
+	select {
+	case pool.slots <- struct{}{}:
+	default:
+		if pool.waiting.Add(1) > pool.limit {
+			pool.waiting.Add(-1)
+			return errPasswordBusy
+		}
+		timer := time.NewTimer(pool.timeout)
+		select {
+		case pool.slots <- struct{}{}:
+			timer.Stop()
+			pool.waiting.Add(-1)
+		case <-timer.C:
+			pool.waiting.Add(-1)
+			return errPasswordBusy
+		}
+	}
+	defer func() { <-pool.slots }()
+	fn()
+	return nil
+}
+
+// queuedPasswordWork reports how many callers are waiting for a slot
+func queuedPasswordWork() int64 {
+	if passwordPool == nil {
+		return 0
+	}
+	return passwordPool.waiting.Load()
+}
+
+// argon2Params are the tunable costs of an argon2id hash
+type argon2Params struct {
+	memory      uint32 // KiB
+	iterations  uint32
+	parallelism uint8
+}
+
+// check reports parameters that argon2.IDKey can't or shouldn't run with
+func (p argon2Params) check() error {
+	switch {
+	case p.iterations < 1 || p.iterations > argon2MaxIterations:
+		return fmt.Errorf("argon2id iterations must be between 1 and %d", argon2MaxIterations)
+	case p.parallelism < 1:
+		return errors.New("argon2id parallelism must be at least 1")
+	case p.memory < 8*uint32(p.parallelism) || p.memory > argon2MaxMemory:
+		return fmt.Errorf("argon2id memory must be between 8 KiB per lane and %d KiB", argon2MaxMemory)
+	}
+	return nil
+}
+
+func configuredArgon2Params() argon2Params {
+	cfg := config.Passwords
+	return argon2Params{
+		memory:      uint32(cfg.Argon2Memory),
+		iterations:  uint32(cfg.Argon2Iterations),
+		parallelism: uint8(cfg.Argon2Parallelism),
+	}
+}
+
+// hashPassword hashes a password with the configured algorithm, peppered
+// with the current pepper if there is one
+func hashPassword(password string) (hash string, err error) {
+	prefix := ""
+	if set := peppers.Load(); set != nil {
+		password, _ = set.apply(set.current, password)
+		prefix = pepperPrefix + set.current
+	}
+	if poolErr := runPasswordWork(func() {
+		if config.Passwords.Algorithm == passwordAlgArgon2id {
+			hash, err = hashArgon2id(password, configuredArgon2Params())
+			return
+		}
+		var raw []byte
+		raw, err = bcrypt.GenerateFromPassword([]byte(password), config.Passwords.BcryptCost)
+		hash = string(raw)
+	}); poolErr != nil {
+		return "", poolErr
+	}
+	if err != nil {
+		return "", err
+	}
+	return prefix + hash, nil
+}
+
+// verifyPassword checks a password against a stored hash of either
+// algorithm. rehash reports that the hash is out of date with the
+// configuration and should be replaced now that the password is known.
+// err is errPasswordBusy when the check couldn't run.
+func verifyPassword(hash, password string) (ok, rehash bool, err error) {
+	err = runPasswordWork(func() {
+		ok, rehash = comparePassword(hash, password)
+	})
+	return ok, rehash, err
+}
+
+// comparePassword does the work for verifyPassword, unwrapping the pepper
+func comparePassword(hash, password string) (ok, rehash bool) {
+	set := peppers.Load()
+	id, inner, peppered := splitPepper(hash)
+	if !peppered {
+		ok, rehash = compareHash(hash, password)
+		return ok, rehash || set != nil
+	}
+
+	var known bool
+	if set != nil {
+		password, known = set.apply(id, password)
+	}
+	if !known {
+		slog.Error("Password hash uses a pepper that isn't configured", "pepper_id", id)
+		return false, false
+	}
+	ok, rehash = compareHash(inner, password)
+	return ok, rehash || id != set.current
+}
+
+// compareHash checks a password against an unpeppered hash
+func compareHash(hash, password string) (ok, rehash bool) {
+	if strings.HasPrefix(hash, "$"+passwordAlgArgon2id+"$") {
+		params, salt, key, err := parseArgon2id(hash)
+		if err != nil {
+			return false, false
+		}
+		computed := argon2.IDKey([]byte(password), salt, params.iterations, params.memory, params.parallelism, uint32(len(key)))
+		if subtle.ConstantTimeCompare(computed, key) != 1 {
+			return false, false
+		}
+		return true, config.Passwords.Algorithm != passwordAlgArgon2id || params != configuredArgon2Params()
+	}
+
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+		return false, false
+	}
+	cost, _ := bcrypt.Cost([]byte(hash))
+	return true, config.Passwords.Algorithm != passwordAlgBcrypt || cost != config.Passwords.BcryptCost
+}
+
+// checkPasswordHash reports whether a precomputed hash (e.g. from a seed
+// file) is in a supported format
+func checkPasswordHash(hash string) error {
+	if id, inner, peppered := splitPepper(hash); peppered {
+		if set := peppers.Load(); set == nil || set.keys[id] == nil {
+			return fmt.Errorf("pepper %q is not configured", id)
+		}
+		hash = inner
+	}
+	if strings.HasPrefix(hash, "$"+passwordAlgArgon2id+"$") {
+		_, _, _, err := parseArgon2id(hash)
+		return err
+	}
+	if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+		return errors.New("not a bcrypt or argon2id hash")
+	}
+	return nil
+}
+
+// upgradePasswordHash replaces a user's outdated hash after a successful
+// login; lock guards the user's fields. A failure only means the upgrade
+// waits for the next login.
+func upgradePasswordHash(lock *sync.RWMutex, user *User, oldHash, password string) {
+	hash, err := hashPassword(password)
+	if err != nil {
+		slog.Warn("Password rehash failed", "user_id", user.ID, "error", err)
+		return
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	// Skip if the password changed while we were hashing
+	if user.Password != oldHash {
+		return
+	}
+	user.Password = hash
+	if err := saveUser(user); err != nil {
+		user.Password = oldHash
+		return
+	}
+	slog.Info("Password hash upgraded", "user_id", user.ID, "algorithm", config.Passwords.Algorithm)
+}
+
+// hashArgon2id encodes an argon2id hash in PHC string format:
+// $argon2id$v=19$m=65536,t=3,p=2$<salt>$<key>
+func hashArgon2id(password string, params argon2Params) (string, error) {
+	salt := make([]byte, argon2SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, params.iterations, params.memory, params.parallelism, argon2KeyLength)
+	return fmt.Sprintf("$%s$v=%d$m=%d,t=%d,p=%d$%s$%s", passwordAlgArgon2id, argon2.Version,
+		params.memory, params.iterations, params.parallelism,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+func parseArgon2id(hash string) (params argon2Params, salt, key []byte, err error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != passwordAlgArgon2id {
+		return params, nil, nil, errors.New("malformed argon2id hash")
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return params, nil, nil, errors.New("unsupported argon2id version")
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.memory, &params.iterations, &params.parallelism); err != nil {
+		return params, nil, nil, errors.New("malformed argon2id parameters")
+	}
+	if err := params.check(); err != nil {
+		return params, nil, nil, err
+	}
+	salt, err = base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil || len(salt) < argon2MinSaltLength || len(salt) > argon2MaxSaltLength {
+		return params, nil, nil, errors.New("malformed argon2id salt")
+	}
+	key, err = base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) < argon2MinKeyLength || len(key) > argon2MaxKeyLength {
+		return params, nil, nil, errors.New("malformed argon2id key")
+	}
+	return params, salt, key, nil
+}
+
+// ----------------------------------------------------------------------------
+// Peppers
+// ----------------------------------------------------------------------------
+
+// pepperSet is the configured peppers by ID and the one new hashes use
+type pepperSet struct {
+	keys    map[string][]byte
+	current string
+}
+
+var peppers atomic.Pointer[pepperSet] // nil hashes without a pepper
+
+// parsePeppers reads passwords.peppers, "id:base64-key,..."; current
+// defaults to the last ID listed. It returns nil when none are set.
+func parsePeppers(raw, current string) (*pepperSet, error) {
+	if strings.TrimSpace(raw) == "" {
+		if current != "" {
+			return nil, errors.New("passwords.pepper_id is set but passwords.peppers is empty")
+		}
+		return nil, nil
+	}
+
+	set := &pepperSet{keys: make(map[string][]byte)}
+	for _, entry := range strings.Split(raw, ",") {
+		id, encoded, ok := strings.Cut(strings.TrimSpace(entry), ":")
+		if !ok || !validPepperID(id) {
+			return nil, fmt.Errorf("passwords.peppers entries must be id:base64-key with IDs of letters, digits, - and _")
+		}
+		if set.keys[id] != nil {
+			return nil, fmt.Errorf("passwords.peppers lists %q twice", id)
+		}
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(key) < minPepperLength {
+			return nil, fmt.Errorf("passwords.peppers: %q must be base64 of at least %d bytes", id, minPepperLength)
+		}
+		set.keys[id], set.current = key, id
+	}
+	if current != "" {
+		if set.keys[current] == nil {
+			return nil, fmt.Errorf("passwords.pepper_id %q is not in passwords.peppers", current)
+		}
+		set.current = current
+	}
+	return set, nil
+}
+
+func validPepperID(id string) bool {
+	if id == "" || len(id) > maxPepperIDLength {
+		return false
+	}
+	for _, r := range id {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// setupPeppers installs the configured peppers
+func setupPeppers() error {
+	set, err := parsePeppers(config.Passwords.Peppers, config.Passwords.PepperID)
+	if err != nil {
+		return err
+	}
+	peppers.Store(set)
+	return nil
+}
+
+// apply keys a password with the pepper id, reporting whether it exists
+func (p *pepperSet) apply(id, password string) (string, bool) {
+	key := p.keys[id]
+	if key == nil {
+		return "", false
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(password))
+	// Encoded so bcrypt sees no NUL bytes and stays under its 72-byte limit
+	return base64.RawStdEncoding.EncodeToString(mac.Sum(nil)), true
+}
+
+// splitPepper separates a peppered hash into its pepper ID and inner hash
+func splitPepper(hash string) (id, inner string, peppered bool) {
+	rest, peppered := strings.CutPrefix(hash, pepperPrefix)
+	if !peppered {
+		return "", hash, false
+	}
+	id, inner, _ = strings.Cut(rest, "$")
+	return id, "$" + inner, true
+}
+
+// pepperUsage counts password hashes by pepper ID, "" for none, so retired
+// peppers can be dropped once nothing uses them
+func pepperUsage() map[string]int {
+	usage := make(map[string]int)
+	localUsers.Each(func(user *User) {
+		lock := localUsers.FieldLock(user)
+		lock.RLock()
+		hash := user.Password
+		lock.RUnlock()
+		if hash == "" {
+			return
+		}
+		id, _, _ := splitPepper(hash)
+		usage[id]++
+	})
+	return usage
+}
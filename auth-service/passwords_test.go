@@ -0,0 +1,252 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// cheapArgon2 keeps argon2id tests fast
+func cheapArgon2(cfg *Config) {
+	cfg.Passwords.Algorithm = passwordAlgArgon2id
+	cfg.Passwords.Argon2Memory = 64
+	cfg.Passwords.Argon2Iterations = 1
+	cfg.Passwords.Argon2Parallelism = 1
+}
+
+func TestPasswordHashMigratesToArgon2id(t *testing.T) {
+	withConfig(t, func(cfg *Config) { cfg.Passwords.BcryptCost = bcrypt.MinCost })
+	hash, err := hashPassword("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := &User{ID: "u1", Password: hash}
+
+	withConfig(t, cheapArgon2)
+	ok, rehash, _ := verifyPassword(user.Password, "correct horse")
+	if !ok || !rehash {
+		t.Fatalf("bcrypt hash under argon2id config: ok=%v rehash=%v, want true true", ok, rehash)
+	}
+	if ok, _, _ := verifyPassword(user.Password, "wrong"); ok {
+		t.Fatal("wrong password accepted")
+	}
+
+	upgradePasswordHash(userLock(user), user, hash, "correct horse")
+	if !strings.HasPrefix(user.Password, "$argon2id$") {
+		t.Fatalf("hash not upgraded: %s", user.Password)
+	}
+	ok, rehash, _ = verifyPassword(user.Password, "correct horse")
+	if !ok || rehash {
+		t.Fatalf("upgraded hash: ok=%v rehash=%v, want true false", ok, rehash)
+	}
+}
+
+func TestPasswordHashRehashedOnParameterChange(t *testing.T) {
+	withConfig(t, cheapArgon2)
+	hash, err := hashPassword("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	withConfig(t, func(cfg *Config) { cfg.Passwords.Argon2Iterations = 2 })
+	if ok, rehash, _ := verifyPassword(hash, "correct horse"); !ok || !rehash {
+		t.Fatalf("ok=%v rehash=%v, want true true", ok, rehash)
+	}
+
+	// Back to bcrypt: argon2id hashes keep working and are replaced
+	withConfig(t, func(cfg *Config) {
+		cfg.Passwords.Algorithm = passwordAlgBcrypt
+		cfg.Passwords.BcryptCost = bcrypt.MinCost
+	})
+	if ok, rehash, _ := verifyPassword(hash, "correct horse"); !ok || !rehash {
+		t.Fatalf("ok=%v rehash=%v, want true true", ok, rehash)
+	}
+}
+
+func TestUpgradeSkippedWhenPasswordChanged(t *testing.T) {
+	withConfig(t, cheapArgon2)
+	user := &User{ID: "u1", Password: "new-hash"}
+	upgradePasswordHash(userLock(user), user, "old-hash", "correct horse")
+	if user.Password != "new-hash" {
+		t.Fatalf("upgrade overwrote a newer password: %s", user.Password)
+	}
+}
+
+func TestParseArgon2idRejectsBadParameters(t *testing.T) {
+	salt := "c2FsdHNhbHRzYWx0c2FsdA"              // 16 bytes
+	key := "a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5" // 27 bytes
+	hash := func(params string) string {
+		return fmt.Sprintf("$argon2id$v=19$%s$%s$%s", params, salt, key)
+	}
+
+	if _, _, _, err := parseArgon2id(hash("m=64,t=1,p=1")); err != nil {
+		t.Fatalf("valid hash rejected: %v", err)
+	}
+	for _, bad := range []string{
+		hash("m=64,t=0,p=1"),                            // no passes
+		hash("m=64,t=1,p=0"),                            // no lanes
+		hash("m=7,t=1,p=1"),                             // below 8 KiB per lane
+		hash("m=64,t=1,p=16"),                           // below 8 KiB per lane
+		hash("m=4194304,t=1,p=1"),                       // 4 GiB
+		hash("m=64,t=1000000,p=1"),                      // too many passes
+		"$argon2id$v=19$m=64,t=1,p=1$c2FsdA$" + key,     // short salt
+		"$argon2id$v=19$m=64,t=1,p=1$" + salt + "$a2V5", // short key
+		"$argon2id$v=16$m=64,t=1,p=1$" + salt + "$" + key,
+		"$argon2id$m=64,t=1,p=1$" + salt + "$" + key,
+	} {
+		if _, _, _, err := parseArgon2id(bad); err == nil {
+			t.Errorf("accepted %s", bad)
+		}
+		if ok, _, _ := verifyPassword(bad, "anything"); ok {
+			t.Errorf("verified against %s", bad)
+		}
+	}
+}
+
+func TestPasswordPoolBackpressure(t *testing.T) {
+	passwordPool = &passwordWorkers{slots: make(chan struct{}, 1), limit: 1, timeout: 100 * time.Millisecond}
+	t.Cleanup(func() { passwordPool = nil })
+
+	// Occupy the only worker
+	running, release := make(chan struct{}), make(chan struct{})
+	go runPasswordWork(func() {
+		close(running)
+		<-release
+	})
+	<-running
+
+	// The first caller queues, the next finds the queue full
+	queued := make(chan error)
+	go func() { queued <- runPasswordWork(func() {}) }()
+	for queuedPasswordWork() != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	if err := runPasswordWork(func() { t.Error("ran past a full queue") }); err != errPasswordBusy {
+		t.Fatalf("with a full queue: %v, want errPasswordBusy", err)
+	}
+
+	// Nothing frees up before the queued caller's timeout
+	if err := <-queued; err != errPasswordBusy {
+		t.Fatalf("after the queue timeout: %v, want errPasswordBusy", err)
+	}
+
+	close(release)
+	ran := false
+	if err := runPasswordWork(func() { ran = true }); err != nil || !ran {
+		t.Fatalf("with a free worker: ran=%v err=%v", ran, err)
+	}
+}
+
+func TestPasswordPoolRunsQueuedWork(t *testing.T) {
+	passwordPool = &passwordWorkers{slots: make(chan struct{}, 2), limit: 100, timeout: 5 * time.Second}
+	t.Cleanup(func() { passwordPool = nil })
+
+	var running, peak atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := runPasswordWork(func() {
+				n := running.Add(1)
+				for {
+					if p := peak.Load(); n <= p || peak.CompareAndSwap(p, n) {
+						break
+					}
+				}
+				time.Sleep(5 * time.Millisecond)
+				running.Add(-1)
+			})
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if peak.Load() > 2 {
+		t.Fatalf("%d operations ran at once on 2 workers", peak.Load())
+	}
+}
+
+// usePeppers installs peppers for the duration of a test
+func usePeppers(t *testing.T, raw, current string) {
+	t.Helper()
+	set, err := parsePeppers(raw, current)
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := peppers.Swap(set)
+	t.Cleanup(func() { peppers.Store(previous) })
+}
+
+func TestPepperRotation(t *testing.T) {
+	withConfig(t, func(cfg *Config) { cfg.Passwords.BcryptCost = bcrypt.MinCost })
+	key1 := base64.StdEncoding.EncodeToString([]byte(strings.Repeat("1", 32)))
+	key2 := base64.StdEncoding.EncodeToString([]byte(strings.Repeat("2", 32)))
+
+	plain, _ := hashPassword("correct horse")
+	usePeppers(t, "p1:"+key1, "")
+	if ok, rehash, _ := verifyPassword(plain, "correct horse"); !ok || !rehash {
+		t.Fatalf("unpeppered hash: ok=%v rehash=%v, want true true", ok, rehash)
+	}
+
+	hash, err := hashPassword("correct horse")
+	if err != nil || !strings.HasPrefix(hash, "$pepper$p1$2a$") || checkPasswordHash(hash) != nil {
+		t.Fatalf("peppered hash %q: %v", hash, err)
+	}
+	if ok, rehash, _ := verifyPassword(hash, "correct horse"); !ok || rehash {
+		t.Fatalf("current pepper: ok=%v rehash=%v, want true false", ok, rehash)
+	}
+	if ok, _, _ := verifyPassword(hash, "wrong"); ok {
+		t.Fatal("wrong password accepted")
+	}
+
+	// Without the pepper the hash is useless, e.g. to someone with only the
+	// database
+	if ok, _, _ := verifyPassword(strings.TrimPrefix(hash, "$pepper$p1"), "correct horse"); ok {
+		t.Fatal("inner hash verified without the pepper")
+	}
+
+	// A new pepper becomes current; the old one still verifies and asks
+	// for a rehash
+	usePeppers(t, "p1:"+key1+",p2:"+key2, "")
+	if ok, rehash, _ := verifyPassword(hash, "correct horse"); !ok || !rehash {
+		t.Fatalf("retired pepper: ok=%v rehash=%v, want true true", ok, rehash)
+	}
+	user := &User{ID: "u1", Password: hash}
+	upgradePasswordHash(userLock(user), user, hash, "correct horse")
+	if !strings.HasPrefix(user.Password, "$pepper$p2$") {
+		t.Fatalf("upgraded hash %q", user.Password)
+	}
+
+	usePeppers(t, "p2:"+key2, "")
+	if ok, _, _ := verifyPassword(hash, "correct horse"); ok || checkPasswordHash(hash) == nil {
+		t.Fatal("hash with an unconfigured pepper verified")
+	}
+}
+
+func TestParsePeppers(t *testing.T) {
+	key := base64.StdEncoding.EncodeToString([]byte(strings.Repeat("k", 32)))
+	for _, c := range []struct{ raw, current string }{
+		{"p1", ""},
+		{"p1:" + base64.StdEncoding.EncodeToString([]byte("short")), ""},
+		{"p1:" + key + ",p1:" + key, ""},
+		{"bad id:" + key, ""},
+		{"p1:" + key, "p2"},
+		{"", "p1"},
+	} {
+		if _, err := parsePeppers(c.raw, c.current); err == nil {
+			t.Errorf("parsePeppers(%q, %q) accepted", c.raw, c.current)
+		}
+	}
+	set, err := parsePeppers("p1:"+key+", p2:"+key, "p1")
+	if err != nil || set.current != "p1" || len(set.keys) != 2 {
+		t.Fatalf("valid peppers: %+v %v", set, err)
+	}
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ============================================================================
+// Phone Numbers
+// ============================================================================
+//
+// A user may add a phone number as a second identity: POST
+// /users/me/phone texts a code, and the number is saved, and shown in the
+// profile, only once the code comes back. With sms.login on, a verified
+// number can then sign in without a password: /auth/phone/code texts a
+// login code and /auth/phone/login exchanges it for a session, subject to
+// the same account status and anomaly checks as a password login. Numbers
+// are E.164 and unique across accounts. Codes are six digits, stored
+// hashed, single use, and void after sms.code_ttl or sms.max_attempts wrong
+// guesses; like invitations they are held by the instance that sent them.
+
+const (
+	phoneCodeDigits         = 6
+	phoneCodeResendInterval = 30 * time.Second
+)
+
+var (
+	errPhoneTaken         = errors.New("Phone number is already in use")
+	errInvalidPhoneCode   = errors.New("Invalid or expired code")
+	errPhoneCodeTooSoon   = errors.New("A code was sent recently; wait before asking for another")
+	errSMSUnavailable     = errors.New("Text message could not be sent; try again later")
+	errPhoneLoginDisabled = errors.New("Phone login is disabled")
+)
+
+// PhoneRequest for POST /users/me/phone and /auth/phone/code
+type PhoneRequest struct {
+	Phone string `json:"phone" binding:"required,e164"` // e.g. +14155550100
+}
+
+// PhoneVerifyRequest for POST /users/me/phone/verify
+type PhoneVerifyRequest struct {
+	Code string `json:"code" binding:"required"`
+}
+
+// PhoneLoginRequest for POST /auth/phone/login
+type PhoneLoginRequest struct {
+	Phone string `json:"phone" binding:"required,e164"`
+	Code  string `json:"code" binding:"required"`
+
+	RememberMe   bool   `json:"remember_me"`
+	CaptchaToken string `json:"captcha_token,omitempty"`
+}
+
+// ----------------------------------------------------------------------------
+// Codes
+// ----------------------------------------------------------------------------
+
+type phoneCode struct {
+	subject   string // the number being verified, or the user logging in
+	hash      [32]byte
+	sentAt    time.Time
+	expiresAt time.Time
+	attempts  int
+}
+
+var (
+	phoneCodes     = make(map[string]*phoneCode) // "verify:"+user ID or "login:"+phone -> code
+	phoneCodeMutex sync.Mutex
+)
+
+// issuePhoneCode replaces the code under key, refusing if the last one
+// was sent moments ago
+func issuePhoneCode(key, subject string) (string, time.Time, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(1_000_000))
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	code := fmt.Sprintf("%0*d", phoneCodeDigits, n)
+	now := time.Now()
+
+	phoneCodeMutex.Lock()
+	defer phoneCodeMutex.Unlock()
+	for k, pc := range phoneCodes {
+		if now.After(pc.expiresAt) {
+			delete(phoneCodes, k)
+		}
+	}
+	if pc, exists := phoneCodes[key]; exists && now.Sub(pc.sentAt) < phoneCodeResendInterval {
+		return "", time.Time{}, errPhoneCodeTooSoon
+	}
+	expiresAt := now.Add(config.SMS.CodeTTL).UTC()
+	phoneCodes[key] = &phoneCode{subject: subject, hash: sha256.Sum256([]byte(code)), sentAt: now, expiresAt: expiresAt}
+	return code, expiresAt, nil
+}
+
+// takePhoneCode consumes the code under key, returning its subject. A
+// wrong guess counts against the code.
+func takePhoneCode(key, code string) (string, bool) {
+	sum := sha256.Sum256([]byte(code))
+
+	phoneCodeMutex.Lock()
+	defer phoneCodeMutex.Unlock()
+	pc, exists := phoneCodes[key]
+	if !exists {
+		return "", false
+	}
+	if time.Now().After(pc.expiresAt) {
+		delete(phoneCodes, key)
+		return "", false
+	}
+	if subtle.ConstantTimeCompare(sum[:], pc.hash[:]) != 1 {
+		pc.attempts++
+		if pc.attempts >= config.SMS.MaxAttempts {
+			delete(phoneCodes, key)
+		}
+		return "", false
+	}
+	delete(phoneCodes, key)
+	return pc.subject, true
+}
+
+// sendPhoneCode texts a code in the user's language
+func sendPhoneCode(phone, lang, code string) error {
+	minutes := int(config.SMS.CodeTTL / time.Minute)
+	return sendSMS(phone, fmt.Sprintf(translate(lang, "%s code: %s. It expires in %d minutes; don't share it."),
+		config.Mail.FromName, code, minutes))
+}
+
+// ----------------------------------------------------------------------------
+// Service operations
+// ----------------------------------------------------------------------------
+
+// SetPhone saves a verified phone number, or removes it when phone is empty
+func (s *Service) SetPhone(user *User, phone string) error {
+	lock := s.users.FieldLock(user)
+	lock.RLock()
+	previous := *user
+	lock.RUnlock()
+	if phone == previous.Phone {
+		return nil
+	}
+
+	if phone != "" {
+		if err := reservePhone(phone, user.ID); err != nil {
+			return err
+		}
+	}
+	if err := s.users.ChangePhone(user, previous.Phone, phone); err != nil {
+		releasePhone(phone)
+		return err
+	}
+
+	lock.Lock()
+	user.Phone, user.UpdatedAt = phone, time.Now()
+	err := saveUser(user)
+	if err != nil {
+		*user = previous
+	}
+	lock.Unlock()
+
+	if err != nil {
+		s.users.ChangePhone(user, phone, previous.Phone)
+		releasePhone(phone)
+		return err
+	}
+	releasePhone(previous.Phone)
+	bumpUserVersion()
+	return nil
+}
+
+// PhoneLogin exchanges a login code for a token
+func (s *Service) PhoneLogin(phone, code string) (*User, string, error) {
+	userID, ok := takePhoneCode("login:"+phone, code)
+	user := s.users.ByID(userID)
+	if !ok || user == nil {
+		return nil, "", errInvalidCredentials
+	}
+
+	lock := s.users.FieldLock(user)
+	lock.RLock()
+	current, status := user.Phone, accountStatus(user)
+	lock.RUnlock()
+	switch {
+	case current != phone || status == UserInvited:
+		return nil, "", errInvalidCredentials
+	case status == UserDisabled:
+		return nil, "", errAccountDisabled
+	case status == UserPending:
+		return nil, "", errApprovalPending
+	}
+
+	token, err := s.IssueToken(user)
+	if err != nil {
+		return nil, "", errTokenGeneration
+	}
+	return user, token, nil
+}
+
+// ----------------------------------------------------------------------------
+// Handlers
+// ----------------------------------------------------------------------------
+
+// addPhone texts a verification code to the number the caller wants to add
+func (s *Server) addPhone(c *gin.Context) {
+	var req PhoneRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondBindError(c, err)
+		return
+	}
+	user, _ := c.Get("user")
+	currentUser := user.(*User)
+	if owner := s.svc.users.ByPhone(req.Phone); owner != nil && owner != currentUser {
+		respondPhoneError(c, errPhoneTaken)
+		return
+	}
+
+	code, expiresAt, err := issuePhoneCode("verify:"+currentUser.ID, req.Phone)
+	if err == nil {
+		err = sendPhoneCode(req.Phone, requestLanguage(c), code)
+	}
+	if err != nil {
+		respondPhoneError(c, err)
+		return
+	}
+	c.JSON(http.StatusAccepted, gin.H{"message": "Verification code sent", "expires_at": expiresAt})
+}
+
+// verifyPhone saves the number once its code comes back
+func (s *Server) verifyPhone(c *gin.Context) {
+	var req PhoneVerifyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondBindError(c, err)
+		return
+	}
+	user, _ := c.Get("user")
+	currentUser := user.(*User)
+	phone, ok := takePhoneCode("verify:"+currentUser.ID, req.Code)
+	if !ok {
+		respondPhoneError(c, errInvalidPhoneCode)
+		return
+	}
+
+	before := s.profileOf(currentUser)
+	if err := s.svc.SetPhone(currentUser, phone); err != nil {
+		respondPhoneError(c, err)
+		return
+	}
+	after := s.profileOf(currentUser)
+	auditChange(c, "user.phone.verify", "user:"+currentUser.ID, before, after)
+	c.JSON(http.StatusOK, gin.H{"message": "Phone number verified", "user": after})
+}
+
+// removePhone removes the caller's phone number
+func (s *Server) removePhone(c *gin.Context) {
+	user, _ := c.Get("user")
+	currentUser := user.(*User)
+
+	before := s.profileOf(currentUser)
+	if err := s.svc.SetPhone(currentUser, ""); err != nil {
+		respondPhoneError(c, err)
+		return
+	}
+	after := s.profileOf(currentUser)
+	auditChange(c, "user.phone.remove", "user:"+currentUser.ID, before, after)
+	c.JSON(http.StatusOK, gin.H{"message": "Phone number removed", "user": after})
+}
+
+// sendLoginCode texts a login code to a verified number. The answer is the
+// same whether or not the number belongs to anyone.
+func (s *Server) sendLoginCode(c *gin.Context) {
+	if !config.SMS.Login {
+		respondPhoneError(c, errPhoneLoginDisabled)
+		return
+	}
+	var req PhoneRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondBindError(c, err)
+		return
+	}
+
+	if user := s.svc.users.ByPhone(req.Phone); user != nil && s.svc.active(user) {
+		code, _, err := issuePhoneCode("login:"+req.Phone, user.ID)
+		if err == nil {
+			err = sendPhoneCode(req.Phone, requestLanguage(c), code)
+		}
+		if err != nil && err != errPhoneCodeTooSoon {
+			slog.Warn("Login code not sent", "user_id", user.ID, "error", err)
+		}
+	}
+	c.JSON(http.StatusAccepted, gin.H{"message": "If the number belongs to an account, a code is on its way"})
+}
+
+// phoneLogin signs in with a texted code
+func (s *Server) phoneLogin(c *gin.Context) {
+	if !config.SMS.Login {
+		respondPhoneError(c, errPhoneLoginDisabled)
+		return
+	}
+	var req PhoneLoginRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondBindError(c, err)
+		return
+	}
+	if !screenLogin(c, req.Phone, req.CaptchaToken) {
+		return
+	}
+	user, token, err := s.svc.PhoneLogin(req.Phone, req.Code)
+	s.completeLogin(c, req.Phone, req.RememberMe, user, token, err)
+}
+
+// respondPhoneError adds the phone errors to respondServiceError
+func respondPhoneError(c *gin.Context, err error) {
+	switch err {
+	case errPhoneTaken:
+		respondError(c, http.StatusConflict, codePhoneTaken, err.Error())
+	case errInvalidPhoneCode:
+		respondError(c, http.StatusBadRequest, codeInvalidCode, err.Error())
+	case errPhoneCodeTooSoon:
+		respondError(c, http.StatusTooManyRequests, codeRateLimited, err.Error())
+	case errSMSUnavailable:
+		respondError(c, http.StatusServiceUnavailable, codeUpstreamUnavailable, err.Error())
+	case errPhoneLoginDisabled:
+		respondError(c, http.StatusForbidden, codeForbidden, err.Error())
+	default:
+		respondServiceError(c, err)
+	}
+}
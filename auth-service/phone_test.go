@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// smsRecorder stands in for the SMS provider, keeping what was sent
+type smsRecorder struct {
+	mu   sync.Mutex
+	sent map[string][]string // number -> bodies
+}
+
+func (r *smsRecorder) Send(ctx context.Context, to, body string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sent[to] = append(r.sent[to], body)
+	return nil
+}
+
+var phoneCodePattern = regexp.MustCompile(`\b[0-9]{6}\b`)
+
+// lastCode returns the code in the newest message to a number
+func (r *smsRecorder) lastCode(t *testing.T, to string) string {
+	t.Helper()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.sent[to]) == 0 {
+		t.Fatalf("no message to %s", to)
+	}
+	code := phoneCodePattern.FindString(r.sent[to][len(r.sent[to])-1])
+	if code == "" {
+		t.Fatalf("no code in %q", r.sent[to])
+	}
+	return code
+}
+
+func recordSMS(t *testing.T) *smsRecorder {
+	recorder := &smsRecorder{sent: make(map[string][]string)}
+	saved := smsSender
+	smsSender = recorder
+	reset := func() {
+		phoneCodeMutex.Lock()
+		phoneCodes = make(map[string]*phoneCode)
+		phoneCodeMutex.Unlock()
+	}
+	reset()
+	t.Cleanup(func() {
+		smsSender = saved
+		reset()
+	})
+	return recorder
+}
+
+// addPhone verifies a number for the token's user
+func (ts *testServer) addPhone(sms *smsRecorder, token, phone string) {
+	ts.t.Helper()
+	if w := ts.do(http.MethodPost, "/v1/users/me/phone", token, `{"phone":"`+phone+`"}`); w.Code != http.StatusAccepted {
+		ts.t.Fatalf("add phone: %d %s", w.Code, w.Body)
+	}
+	body := `{"code":"` + sms.lastCode(ts.t, phone) + `"}`
+	if w := ts.do(http.MethodPost, "/v1/users/me/phone/verify", token, body); w.Code != http.StatusOK {
+		ts.t.Fatalf("verify phone: %d %s", w.Code, w.Body)
+	}
+}
+
+func TestPhoneVerification(t *testing.T) {
+	sms := recordSMS(t)
+	ts := newTestServer(t)
+	token, _ := ts.register("a@example.com")
+	other, _ := ts.register("b@example.com")
+
+	if w := ts.do(http.MethodPost, "/v1/users/me/phone", token, `{"phone":"415-555-0100"}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("non-E.164 number: got %d, want 400", w.Code)
+	}
+	ts.do(http.MethodPost, "/v1/users/me/phone", token, `{"phone":"+14155550100"}`)
+	if w := ts.do(http.MethodPost, "/v1/users/me/phone", token, `{"phone":"+14155550100"}`); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("immediate resend: got %d, want 429", w.Code)
+	}
+	if w := ts.do(http.MethodPost, "/v1/users/me/phone/verify", token, `{"code":"not-it"}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("wrong code: got %d, want 400", w.Code)
+	}
+	// Another user's code doesn't work for this one
+	if w := ts.do(http.MethodPost, "/v1/users/me/phone/verify", other, `{"code":"`+sms.lastCode(t, "+14155550100")+`"}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("someone else's code: got %d, want 400", w.Code)
+	}
+
+	w := ts.do(http.MethodPost, "/v1/users/me/phone/verify", token, `{"code":"`+sms.lastCode(t, "+14155550100")+`"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("verify: %d %s", w.Code, w.Body)
+	}
+	var profile UserProfile
+	decodeJSON(t, ts.do(http.MethodGet, "/v1/users/me", token, ""), &profile)
+	if profile.Phone != "+14155550100" {
+		t.Fatalf("profile phone = %q", profile.Phone)
+	}
+
+	w = ts.do(http.MethodPost, "/v1/users/me/phone", other, `{"phone":"+14155550100"}`)
+	if w.Code != http.StatusConflict || !strings.Contains(w.Body.String(), codePhoneTaken) {
+		t.Fatalf("taken number: %d %s", w.Code, w.Body)
+	}
+
+	if w := ts.do(http.MethodDelete, "/v1/users/me/phone", token, ""); w.Code != http.StatusOK {
+		t.Fatalf("remove: %d %s", w.Code, w.Body)
+	}
+	if ts.srv.svc.users.ByPhone("+14155550100") != nil {
+		t.Fatal("removed number still indexed")
+	}
+	ts.addPhone(sms, other, "+14155550100")
+}
+
+func TestPhoneLogin(t *testing.T) {
+	sms := recordSMS(t)
+	ts := newTestServer(t)
+	token, id := ts.register("a@example.com")
+	ts.addPhone(sms, token, "+14155550100")
+
+	// Unknown numbers get the same answer and no message
+	if w := ts.do(http.MethodPost, "/v1/auth/phone/code", "", `{"phone":"+14155550199"}`); w.Code != http.StatusAccepted {
+		t.Fatalf("unknown number: got %d, want 202", w.Code)
+	}
+	if len(sms.sent["+14155550199"]) != 0 {
+		t.Fatal("code sent to an unknown number")
+	}
+
+	if w := ts.do(http.MethodPost, "/v1/auth/phone/code", "", `{"phone":"+14155550100"}`); w.Code != http.StatusAccepted {
+		t.Fatalf("send code: %d %s", w.Code, w.Body)
+	}
+	code := sms.lastCode(t, "+14155550100")
+	if w := ts.do(http.MethodPost, "/v1/auth/phone/login", "", `{"phone":"+14155550100","code":"000000x"}`); w.Code != http.StatusUnauthorized {
+		t.Fatalf("wrong code: got %d, want 401", w.Code)
+	}
+	w := ts.do(http.MethodPost, "/v1/auth/phone/login", "", `{"phone":"+14155550100","code":"`+code+`"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("phone login: %d %s", w.Code, w.Body)
+	}
+	var resp AuthResponse
+	decodeJSON(t, w, &resp)
+	if resp.User.ID != id || resp.Token == "" {
+		t.Fatalf("login response = %+v", resp)
+	}
+	if w := ts.do(http.MethodPost, "/v1/auth/phone/login", "", `{"phone":"+14155550100","code":"`+code+`"}`); w.Code != http.StatusUnauthorized {
+		t.Fatalf("code reused: got %d, want 401", w.Code)
+	}
+
+	withConfig(t, func(cfg *Config) { cfg.SMS.Login = false })
+	if w := ts.do(http.MethodPost, "/v1/auth/phone/code", "", `{"phone":"+14155550100"}`); w.Code != http.StatusForbidden {
+		t.Fatalf("phone login disabled: got %d, want 403", w.Code)
+	}
+}
+
+func TestPhoneCodeAttempts(t *testing.T) {
+	recordSMS(t)
+	withConfig(t, func(cfg *Config) { cfg.SMS.MaxAttempts = 2 })
+	code, _, err := issuePhoneCode("verify:u1", "+14155550100")
+	if err != nil {
+		t.Fatal(err)
+	}
+	takePhoneCode("verify:u1", "wrong")
+	takePhoneCode("verify:u1", "wrong")
+	if _, ok := takePhoneCode("verify:u1", code); ok {
+		t.Fatal("code still works after max_attempts wrong guesses")
+	}
+}
@@ -0,0 +1,416 @@
+// Package authmw enforces the auth service's access rules in other Go
+// services. It resolves a request's bearer token to an Identity, checks
+// Permissions against it, and filters documents by read access, with
+// net/http middleware (Middleware) and gRPC interceptors
+// (UnaryServerInterceptor, StreamServerInterceptor) on top.
+//
+// Tokens are verified by the auth service itself (GET /v1/auth/verify)
+// rather than by checking their signature locally, so a revoked token and
+// a disabled, merged or deleted account are refused exactly as the auth
+// service refuses them, and custom claims have passed their providers'
+// validation. A verified token is remembered for CacheTTL (never past its
+// expiry), so the service is asked at most once per token in that window.
+// Run WatchRevocations alongside to drop remembered tokens as soon as
+// their user logs out everywhere or has their tokens rotated, rather than
+// when CacheTTL runs out; it needs the internal token.
+// Document access goes through the internal access filter and needs the
+// shared internal token (WithInternalToken).
+//
+// A narrowed token, from token exchange or issued to an OAuth partner app,
+// carries the scopes it was narrowed to, or the user consented to, in
+// Identity.Scopes; a full user token carries none. Guard routes with
+// RequireScope so a narrowed token reaches only what its scopes cover.
+package authmw
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"auth-service/client"
+)
+
+const (
+	// DefaultCacheTTL is how long a verified token is trusted without
+	// asking the auth service again
+	DefaultCacheTTL = 30 * time.Second
+
+	// DefaultRevocationInterval is how often WatchRevocations asks for new
+	// token cut-offs
+	DefaultRevocationInterval = 5 * time.Second
+
+	maxCacheEntries = 10000
+	verifyRetries   = 1 // callers are waiting on the request
+)
+
+// Identity is the user a verified token belongs to
+type Identity struct {
+	UserID string
+	Email  string
+	Name   string
+	Role   string
+	Claims map[string]interface{} // custom claims, if any
+	Scopes []string               // an exchanged or OAuth token's scopes; empty for a full user token
+	Token  string
+}
+
+// Error is a refused request: the HTTP status and stable error code the
+// auth service would answer with, and a detail for humans
+type Error struct {
+	Status int
+	Code   string
+	Detail string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("authmw: %d %s: %s", e.Status, e.Code, e.Detail)
+}
+
+var (
+	errMissingToken  = &Error{Status: http.StatusUnauthorized, Code: "unauthorized", Detail: "Authorization header required"}
+	errInvalidFormat = &Error{Status: http.StatusUnauthorized, Code: "unauthorized", Detail: "Invalid authorization format"}
+	errUnavailable   = &Error{Status: http.StatusServiceUnavailable, Code: "upstream_unavailable", Detail: "Auth service unavailable"}
+)
+
+// Permission decides whether an identity may go on; it returns an *Error
+// saying why not
+type Permission func(id *Identity) error
+
+// RequireRole allows identities with one of the roles
+func RequireRole(roles ...string) Permission {
+	return func(id *Identity) error {
+		for _, role := range roles {
+			if id.Role == role {
+				return nil
+			}
+		}
+		// Same answer as the auth service's own admin routes
+		if len(roles) == 1 && roles[0] == "admin" {
+			return &Error{Status: http.StatusForbidden, Code: "admin_required", Detail: "Admin access required"}
+		}
+		return &Error{Status: http.StatusForbidden, Code: "forbidden", Detail: "Role " + strings.Join(roles, " or ") + " required"}
+	}
+}
+
+// RequireClaim allows identities whose token carries the custom claim,
+// equal to one of values when any are given
+func RequireClaim(name string, values ...interface{}) Permission {
+	return func(id *Identity) error {
+		value, present := id.Claims[name]
+		if present && len(values) == 0 {
+			return nil
+		}
+		for _, allowed := range values {
+			if present && fmt.Sprint(value) == fmt.Sprint(allowed) {
+				return nil
+			}
+		}
+		return &Error{Status: http.StatusForbidden, Code: "forbidden", Detail: "Claim " + name + " does not allow this"}
+	}
+}
+
+// RequireScope allows full user tokens and narrowed tokens granted scope
+func RequireScope(scope string) Permission {
+	return func(id *Identity) error {
+		if len(id.Scopes) == 0 {
+			return nil
+		}
+		for _, granted := range id.Scopes {
+			if granted == scope {
+				return nil
+			}
+		}
+		// Same answer as the auth service's own scoped routes
+		return &Error{Status: http.StatusForbidden, Code: "insufficient_scope", Detail: "Token scope does not allow this request"}
+	}
+}
+
+// Check runs permissions in order and returns the first refusal
+func Check(id *Identity, permissions ...Permission) error {
+	for _, permission := range permissions {
+		if err := permission(id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ----------------------------------------------------------------------------
+// Verifier
+// ----------------------------------------------------------------------------
+
+// Verifier checks tokens and document access against one auth service. It
+// is safe for concurrent use.
+type Verifier struct {
+	baseURL       string
+	httpClient    *http.Client
+	internalToken string
+	ttl           time.Duration
+
+	mu           sync.Mutex
+	cache        map[[sha256.Size]byte]cachedIdentity
+	revokedSince time.Time // the latest cut-off SyncRevocations has applied
+}
+
+type cachedIdentity struct {
+	identity  *Identity
+	issuedAt  time.Time
+	expiresAt time.Time
+}
+
+// Option configures a Verifier
+type Option func(*Verifier)
+
+// WithHTTPClient replaces the default HTTP client
+func WithHTTPClient(hc *http.Client) Option {
+	return func(v *Verifier) { v.httpClient = hc }
+}
+
+// WithInternalToken sets the shared token FilterDocuments needs
+func WithInternalToken(token string) Option {
+	return func(v *Verifier) { v.internalToken = token }
+}
+
+// WithCacheTTL sets how long a verified token is trusted; zero turns the
+// cache off
+func WithCacheTTL(ttl time.Duration) Option {
+	return func(v *Verifier) { v.ttl = ttl }
+}
+
+// New creates a Verifier for the auth service at baseURL
+// (e.g. "http://localhost:8001")
+func New(baseURL string, opts ...Option) *Verifier {
+	v := &Verifier{
+		baseURL:    baseURL,
+		httpClient: &http.Client{Timeout: 5 * time.Second},
+		ttl:        DefaultCacheTTL,
+		cache:      make(map[[sha256.Size]byte]cachedIdentity),
+	}
+	for _, opt := range opts {
+		opt(v)
+	}
+	return v
+}
+
+// Verify resolves a bearer token to its identity
+func (v *Verifier) Verify(ctx context.Context, token string) (*Identity, error) {
+	if token == "" {
+		return nil, errMissingToken
+	}
+	key := sha256.Sum256([]byte(token))
+	if identity, ok := v.cached(key); ok {
+		return identity, nil
+	}
+
+	c := client.New(v.baseURL, client.WithHTTPClient(v.httpClient), client.WithRetries(verifyRetries), client.WithToken(token))
+	verification, err := c.VerifyClaims(ctx)
+	if err != nil {
+		return nil, refusal(err)
+	}
+	identity := &Identity{
+		UserID: verification.User.ID,
+		Email:  verification.User.Email,
+		Name:   verification.User.Name,
+		Role:   verification.User.Role,
+		Claims: verification.Claims,
+		Scopes: strings.Fields(verification.Scope),
+		Token:  token,
+	}
+	v.remember(key, identity, token)
+	return identity, nil
+}
+
+// FilterDocuments returns the documents, of those given, that a user may
+// read, in order
+func (v *Verifier) FilterDocuments(ctx context.Context, userID string, documentIDs []string) ([]string, error) {
+	if v.internalToken == "" {
+		return nil, errors.New("authmw: FilterDocuments needs WithInternalToken")
+	}
+	c := client.New(v.baseURL, client.WithHTTPClient(v.httpClient), client.WithInternalToken(v.internalToken))
+	decision, err := c.FilterAccess(ctx, userID, documentIDs)
+	if err != nil {
+		return nil, refusal(err)
+	}
+	return decision.Allowed, nil
+}
+
+// Authorize verifies a token and checks permissions against its identity
+func (v *Verifier) Authorize(ctx context.Context, token string, permissions ...Permission) (*Identity, error) {
+	identity, err := v.Verify(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+	if err := Check(identity, permissions...); err != nil {
+		return nil, err
+	}
+	return identity, nil
+}
+
+func (v *Verifier) cached(key [sha256.Size]byte) (*Identity, bool) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	entry, ok := v.cache[key]
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(entry.expiresAt) {
+		delete(v.cache, key)
+		return nil, false
+	}
+	return entry.identity, true
+}
+
+// remember caches an identity until the TTL or the token's expiry,
+// whichever is sooner
+func (v *Verifier) remember(key [sha256.Size]byte, identity *Identity, token string) {
+	if v.ttl <= 0 {
+		return
+	}
+	issuedAt, tokenExpiresAt := tokenTimes(token)
+	expiresAt := time.Now().Add(v.ttl)
+	if !tokenExpiresAt.IsZero() && tokenExpiresAt.Before(expiresAt) {
+		expiresAt = tokenExpiresAt
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if len(v.cache) >= maxCacheEntries {
+		now := time.Now()
+		for k, entry := range v.cache {
+			if now.After(entry.expiresAt) {
+				delete(v.cache, k)
+			}
+		}
+		if len(v.cache) >= maxCacheEntries {
+			v.cache = make(map[[sha256.Size]byte]cachedIdentity)
+		}
+	}
+	v.cache[key] = cachedIdentity{identity: identity, issuedAt: issuedAt, expiresAt: expiresAt}
+}
+
+// SyncRevocations asks the auth service for the token cut-offs set since
+// the last sync and forgets the remembered tokens they revoke
+func (v *Verifier) SyncRevocations(ctx context.Context) error {
+	if v.internalToken == "" {
+		return errors.New("authmw: SyncRevocations needs WithInternalToken")
+	}
+	v.mu.Lock()
+	// Cut-offs are whole seconds, so one set later in the same second as
+	// the last is only caught by asking from a second before it
+	since := v.revokedSince
+	v.mu.Unlock()
+	if !since.IsZero() {
+		since = since.Add(-time.Second)
+	}
+	c := client.New(v.baseURL, client.WithHTTPClient(v.httpClient), client.WithInternalToken(v.internalToken))
+	revocations, err := c.Revocations(ctx, since)
+	if err != nil {
+		return refusal(err)
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	for _, revocation := range revocations {
+		for key, entry := range v.cache {
+			if entry.identity.UserID == revocation.UserID && !entry.issuedAt.After(revocation.RevokedBefore) {
+				delete(v.cache, key)
+			}
+		}
+		if revocation.RevokedBefore.After(v.revokedSince) {
+			v.revokedSince = revocation.RevokedBefore
+		}
+	}
+	return nil
+}
+
+// WatchRevocations runs SyncRevocations every interval until ctx is done.
+// A failed sync is tried again at the next tick; meanwhile remembered
+// tokens still expire after CacheTTL.
+func (v *Verifier) WatchRevocations(ctx context.Context, interval time.Duration) error {
+	if v.internalToken == "" {
+		return errors.New("authmw: WatchRevocations needs WithInternalToken")
+	}
+	if interval <= 0 {
+		interval = DefaultRevocationInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		v.SyncRevocations(ctx)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// refusal turns a client error into the Error to answer with. The auth
+// service's own 4xx answers pass through; anything else means it couldn't
+// be asked.
+func refusal(err error) error {
+	var apiErr *client.APIError
+	if errors.As(err, &apiErr) && apiErr.StatusCode >= 400 && apiErr.StatusCode < 500 {
+		return &Error{Status: apiErr.StatusCode, Code: apiErr.Code, Detail: apiErr.Message}
+	}
+	return errUnavailable
+}
+
+// tokenTimes reads iat and exp from a token's unverified claims; the auth
+// service has already vouched for the token. Missing ones are zero.
+func tokenTimes(token string) (issuedAt, expiresAt time.Time) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return time.Time{}, time.Time{}
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return time.Time{}, time.Time{}
+	}
+	var claims struct {
+		IssuedAt  int64 `json:"iat"`
+		ExpiresAt int64 `json:"exp"`
+	}
+	if json.Unmarshal(payload, &claims) != nil {
+		return time.Time{}, time.Time{}
+	}
+	if claims.IssuedAt != 0 {
+		issuedAt = time.Unix(claims.IssuedAt, 0)
+	}
+	if claims.ExpiresAt != 0 {
+		expiresAt = time.Unix(claims.ExpiresAt, 0)
+	}
+	return issuedAt, expiresAt
+}
+
+// bearerToken extracts the token from an "Authorization: Bearer" value
+func bearerToken(header string) (string, error) {
+	if header == "" {
+		return "", errMissingToken
+	}
+	parts := strings.Split(header, " ")
+	if len(parts) != 2 || parts[0] != "Bearer" {
+		return "", errInvalidFormat
+	}
+	return parts[1], nil
+}
+
+type identityKey struct{}
+
+// WithIdentity returns a context carrying an identity
+func WithIdentity(ctx context.Context, identity *Identity) context.Context {
+	return context.WithValue(ctx, identityKey{}, identity)
+}
+
+// FromContext returns the identity the middleware or interceptor resolved
+func FromContext(ctx context.Context) (*Identity, bool) {
+	identity, ok := ctx.Value(identityKey{}).(*Identity)
+	return identity, ok
+}
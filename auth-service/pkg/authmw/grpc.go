@@ -0,0 +1,93 @@
+package authmw
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// UnaryServerInterceptor requires a valid bearer token in the
+// "authorization" metadata that passes the permissions, and hands the
+// identity to the handler through its context (FromContext). Methods in
+// public are let through without a token.
+func UnaryServerInterceptor(v *Verifier, public map[string]bool, permissions ...Permission) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if public[info.FullMethod] {
+			return handler(ctx, req)
+		}
+		identity, err := authorizeCall(ctx, v, permissions)
+		if err != nil {
+			return nil, err
+		}
+		return handler(WithIdentity(ctx, identity), req)
+	}
+}
+
+// StreamServerInterceptor is UnaryServerInterceptor for streaming methods
+func StreamServerInterceptor(v *Verifier, public map[string]bool, permissions ...Permission) grpc.StreamServerInterceptor {
+	return func(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if public[info.FullMethod] {
+			return handler(srv, stream)
+		}
+		identity, err := authorizeCall(stream.Context(), v, permissions)
+		if err != nil {
+			return err
+		}
+		return handler(srv, &identityStream{ServerStream: stream, ctx: WithIdentity(stream.Context(), identity)})
+	}
+}
+
+// identityStream carries the resolved identity in its context
+type identityStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *identityStream) Context() context.Context { return s.ctx }
+
+func authorizeCall(ctx context.Context, v *Verifier, permissions []Permission) (*Identity, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	var header string
+	if values := md.Get("authorization"); len(values) > 0 {
+		header = values[0]
+	}
+	token, err := bearerToken(header)
+	if err != nil {
+		return nil, StatusError(err)
+	}
+	identity, err := v.Authorize(ctx, token, permissions...)
+	if err != nil {
+		return nil, StatusError(err)
+	}
+	return identity, nil
+}
+
+// StatusError converts a refusal to the gRPC status the auth service's own
+// gRPC API would return
+func StatusError(err error) error {
+	var refused *Error
+	if !errors.As(err, &refused) {
+		return status.Error(codes.Internal, "Internal server error")
+	}
+	code := codes.Internal
+	switch refused.Status {
+	case http.StatusBadRequest:
+		code = codes.InvalidArgument
+	case http.StatusUnauthorized:
+		code = codes.Unauthenticated
+	case http.StatusForbidden:
+		code = codes.PermissionDenied
+	case http.StatusNotFound:
+		code = codes.NotFound
+	case http.StatusTooManyRequests:
+		code = codes.ResourceExhausted
+	case http.StatusServiceUnavailable:
+		code = codes.Unavailable
+	}
+	return status.Error(code, refused.Detail)
+}
@@ -0,0 +1,64 @@
+package authmw
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+)
+
+// Middleware requires a valid bearer token that passes the permissions,
+// and hands the identity to next through the request context (FromContext).
+// Refusals are problem+json bodies in the auth service's format.
+func Middleware(v *Verifier, permissions ...Permission) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			token, err := bearerToken(r.Header.Get("Authorization"))
+			if err == nil {
+				var identity *Identity
+				if identity, err = v.Authorize(r.Context(), token, permissions...); err == nil {
+					next.ServeHTTP(w, r.WithContext(WithIdentity(r.Context(), identity)))
+					return
+				}
+			}
+			WriteError(w, r, err)
+		})
+	}
+}
+
+// Require checks permissions against the identity Middleware resolved, for
+// routes stricter than the rest of their handler chain
+func Require(permissions ...Permission) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			identity, ok := FromContext(r.Context())
+			if !ok {
+				WriteError(w, r, errMissingToken)
+				return
+			}
+			if err := Check(identity, permissions...); err != nil {
+				WriteError(w, r, err)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// WriteError answers with err as a problem+json body
+func WriteError(w http.ResponseWriter, r *http.Request, err error) {
+	var refused *Error
+	if !errors.As(err, &refused) {
+		refused = &Error{Status: http.StatusInternalServerError, Code: "internal_error", Detail: "Internal server error"}
+	}
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(refused.Status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"type":     "about:blank",
+		"title":    http.StatusText(refused.Status),
+		"status":   refused.Status,
+		"code":     refused.Code,
+		"detail":   refused.Detail,
+		"instance": r.URL.Path,
+		"error":    refused.Detail,
+	})
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ============================================================================
+// Query Plans
+// ============================================================================
+//
+// Every user is on a plan (User.Plan, set by admins; empty means
+// rate_limit.default_plan) that caps their queries per UTC day, e.g. free
+// users 100 and pro users 2000. The cap is spent where queries enter:
+// /query/stream, chat WebSocket messages, saved query runs, and any other
+// gateway through POST /internal/quota/queries, a single round trip it can
+// make before forwarding a query. A query is charged once it has passed
+// validation and access checks, so a refused one costs nothing. Counts live in the rate limiter's store,
+// so with the redis backend every instance spends from one shared budget;
+// with rate limiting disabled nothing is capped. Responses carry
+// X-Quota-Limit, X-Quota-Remaining and X-Quota-Reset (seconds until the
+// budget refills at midnight UTC). Admins, and plans whose queries_per_day
+// is 0, are unlimited. Like the rate limiter, a store that can't be reached
+// lets queries through.
+//
+// The query that takes a user past rate_limit.quota_warning_percent of
+// their day's budget leaves a quota.warning notification. The day's count
+// only grows, and the store adds to it atomically, so exactly one query
+// crosses the line each day, whichever instance serves it.
+
+var errQuotaExceeded = errors.New("Daily query limit reached; retry tomorrow or ask for a larger plan")
+
+// QueryPlan is one plan's allowance
+type QueryPlan struct {
+	QueriesPerDay int `yaml:"queries_per_day" json:"queries_per_day"` // 0 is unlimited
+}
+
+// QueryUsage is a user's query budget for today
+type QueryUsage struct {
+	Plan      string    `json:"plan"`
+	Limit     int       `json:"limit"` // 0 is unlimited
+	Used      int       `json:"used"`
+	Remaining int       `json:"remaining"`
+	ResetAt   time.Time `json:"reset_at"`
+	Allowed   bool      `json:"allowed"`
+}
+
+// QuotaCheckRequest for POST /internal/quota/queries
+type QuotaCheckRequest struct {
+	UserID string `json:"user_id" binding:"required"`
+	DryRun bool   `json:"dry_run"` // report the budget without spending from it
+}
+
+// planOf is the plan a user's queries are counted against
+func planOf(user *User) string {
+	if user.Plan != "" {
+		if _, known := config.RateLimit.Plans[user.Plan]; known {
+			return user.Plan
+		}
+	}
+	return config.RateLimit.DefaultPlan
+}
+
+// spendQueries takes n queries from a user's budget for today; n 0 only
+// reports it
+func spendQueries(ctx context.Context, user *User, n int) QueryUsage {
+	now := time.Now().UTC()
+	usage := QueryUsage{
+		Plan:    planOf(user),
+		ResetAt: time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC),
+		Allowed: true,
+	}
+	if user.Role == "admin" {
+		return usage
+	}
+	usage.Limit = config.RateLimit.Plans[usage.Plan].QueriesPerDay
+	if rateLimiter == nil || usage.Limit == 0 {
+		usage.Limit = 0
+		return usage
+	}
+
+	key := "quota:queries:" + user.ID + ":" + now.Format(time.DateOnly)
+	used, allowed, err := rateLimiter.spend(ctx, key, n, usage.Limit, usage.ResetAt)
+	if err != nil {
+		slog.Warn("Query quota check failed; allowing query", "user_id", user.ID, "error", err)
+		usage.Limit = 0
+		return usage
+	}
+	usage.Used, usage.Allowed = used, allowed
+	if n == 0 {
+		usage.Allowed = used < usage.Limit
+	}
+	usage.Remaining = max(usage.Limit-used, 0)
+	if allowed && n > 0 {
+		warnQuota(user, usage, n)
+	}
+	return usage
+}
+
+// warnQuota notifies a user whose spend of n just took them past the
+// warning threshold
+func warnQuota(user *User, usage QueryUsage, n int) {
+	percent := config.RateLimit.QuotaWarningPercent
+	if percent == 0 {
+		return
+	}
+	threshold := (usage.Limit*percent + 99) / 100 // rounded up, so 80% of 2 is 2
+	if usage.Used < threshold || usage.Used-n >= threshold {
+		return
+	}
+	notify(user.ID, NotificationQuotaWarning, "Daily query limit almost reached",
+		fmt.Sprintf("You have used %d of your %d queries today. The limit resets at %s.",
+			usage.Used, usage.Limit, usage.ResetAt.Format(time.RFC3339)),
+		map[string]string{
+			"plan":     usage.Plan,
+			"used":     strconv.Itoa(usage.Used),
+			"limit":    strconv.Itoa(usage.Limit),
+			"reset_at": usage.ResetAt.Format(time.RFC3339),
+		})
+}
+
+// setQuotaHeaders reports a budget to the client
+func setQuotaHeaders(c *gin.Context, usage QueryUsage) {
+	if usage.Limit == 0 {
+		return
+	}
+	c.Header("X-Quota-Limit", strconv.Itoa(usage.Limit))
+	c.Header("X-Quota-Remaining", strconv.Itoa(usage.Remaining))
+	c.Header("X-Quota-Reset", strconv.Itoa(ceilSeconds(time.Until(usage.ResetAt))))
+}
+
+// allowQuery spends one query of the user's budget and sets the quota
+// headers. When the budget is spent it answers 429 with Retry-After and
+// returns false.
+func allowQuery(c *gin.Context, user *User) bool {
+	usage := spendQueries(c.Request.Context(), user, 1)
+	setQuotaHeaders(c, usage)
+	if usage.Allowed {
+		return true
+	}
+	debugLog("ratelimit", "Query quota exhausted", "user_id", user.ID, "plan", usage.Plan)
+	c.Header("Retry-After", strconv.Itoa(ceilSeconds(time.Until(usage.ResetAt))))
+	respondError(c, http.StatusTooManyRequests, codeQuotaExceeded, errQuotaExceeded.Error())
+	return false
+}
+
+// ----------------------------------------------------------------------------
+
+// getMyUsage shows the current user's plan and today's query budget
+func getMyUsage(c *gin.Context) {
+	usage := spendQueries(c.Request.Context(), c.MustGet("user").(*User), 0)
+	setQuotaHeaders(c, usage)
+	c.JSON(http.StatusOK, usage)
+}
+
+// checkQueryQuota lets another gateway spend one of a user's queries
+// before it forwards the query; 429 means the budget is spent
+func (s *Server) checkQueryQuota(c *gin.Context) {
+	var req QuotaCheckRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondBindError(c, err)
+		return
+	}
+	user := s.svc.users.ByID(req.UserID)
+	if user == nil {
+		respondError(c, http.StatusNotFound, codeNotFound, "User not found")
+		return
+	}
+	n := 1
+	if req.DryRun {
+		n = 0
+	}
+	usage := spendQueries(c.Request.Context(), user, n)
+	setQuotaHeaders(c, usage)
+	status := http.StatusOK
+	if !usage.Allowed {
+		status = http.StatusTooManyRequests
+		c.Header("Retry-After", strconv.Itoa(ceilSeconds(time.Until(usage.ResetAt))))
+	}
+	c.JSON(status, usage)
+}
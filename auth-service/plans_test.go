@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestQueryPlans(t *testing.T) {
+	ts := newTestServer(t)
+	withConfig(t, func(cfg *Config) {
+		cfg.Auth.InternalAPIToken = testInternalToken
+		cfg.RateLimit.DefaultPlan = "free"
+		cfg.RateLimit.Plans = map[string]QueryPlan{"free": {QueriesPerDay: 2}, "pro": {}}
+	})
+	admin := ts.admin("admin@example.com")
+	user, userID := ts.register("user@example.com")
+	savedPolicy := apiRateLimit
+	apiRateLimit = rateLimitPolicy{name: "api", perMinute: 600, burst: 100}
+	t.Cleanup(func() { apiRateLimit = savedPolicy })
+	useRateLimiter(t, &memoryRateLimitStore{buckets: make(map[string]*tokenBucket)})
+	useSavedQueryStore(t)
+
+	var usage QueryUsage
+	decodeJSON(t, ts.do(http.MethodGet, "/v1/users/me/usage", user, ""), &usage)
+	if usage.Plan != "free" || usage.Limit != 2 || usage.Used != 0 || !usage.Allowed {
+		t.Fatalf("usage: %+v", usage)
+	}
+
+	// Queries refused before they are asked cost nothing
+	if w := ts.do(http.MethodPost, "/v1/query/stream", user, `{"question":"How much leave?"}`); w.Code != http.StatusForbidden {
+		t.Fatalf("query without documents: got %d, want 403", w.Code)
+	}
+	if w := ts.do(http.MethodPost, "/v1/query/stream", user, `{"question":`); w.Code != http.StatusBadRequest {
+		t.Fatalf("malformed query: got %d, want 400", w.Code)
+	}
+	var saved SavedQuery
+	decodeJSON(t, ts.do(http.MethodPost, "/v1/saved-queries", user, `{"name":"Leave","question":"How much leave?"}`), &saved)
+	if w := ts.do(http.MethodPost, "/v1/saved-queries/"+saved.ID+"/run", user, ""); w.Code != http.StatusOK {
+		t.Fatalf("saved query without documents: %d %s", w.Code, w.Body)
+	}
+	decodeJSON(t, ts.do(http.MethodGet, "/v1/users/me/usage", user, ""), &usage)
+	if usage.Used != 0 || usage.Remaining != 2 {
+		t.Fatalf("usage after refused queries: %+v", usage)
+	}
+	// The stream reads the process's document store
+	t.Cleanup(func() { resetLocalStores(t) })
+	if _, err := defaultService.ClaimDocument("handbook.pdf", userID); err != nil {
+		t.Fatal(err)
+	}
+
+	spend := func() *httptest.ResponseRecorder {
+		return ts.do(http.MethodPost, "/v1/internal/quota/queries", "", `{"user_id":"`+userID+`"}`, internalTokenHeader, testInternalToken)
+	}
+	for i := 0; i < 2; i++ {
+		if w := spend(); w.Code != http.StatusOK {
+			t.Fatalf("spend %d: %d %s", i+1, w.Code, w.Body)
+		}
+	}
+	if w := spend(); w.Code != http.StatusTooManyRequests || w.Header().Get("X-Quota-Remaining") != "0" {
+		t.Fatalf("spend over the plan: %d %v", w.Code, w.Header())
+	}
+
+	w := ts.do(http.MethodPost, "/v1/query/stream", user, `{"question":"How much leave?"}`)
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" || w.Header().Get("X-Quota-Limit") != "2" {
+		t.Fatalf("query over the plan: %d %v", w.Code, w.Header())
+	}
+	var problem Problem
+	decodeJSON(t, w, &problem)
+	if problem.Code != codeQuotaExceeded {
+		t.Fatalf("problem: %+v", problem)
+	}
+
+	if w := ts.do(http.MethodPatch, "/v1/admin/users/"+userID, admin, `{"plan":"gold"}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("unknown plan: got %d, want 400", w.Code)
+	}
+	if w := ts.do(http.MethodPatch, "/v1/admin/users/"+userID, admin, `{"plan":"pro"}`); w.Code != http.StatusOK {
+		t.Fatalf("set plan: %d %s", w.Code, w.Body)
+	}
+	decodeJSON(t, ts.do(http.MethodGet, "/v1/users/me/usage", user, ""), &usage)
+	if usage.Plan != "pro" || usage.Limit != 0 || !usage.Allowed {
+		t.Fatalf("usage on an unlimited plan: %+v", usage)
+	}
+	var profile UserProfile
+	decodeJSON(t, ts.do(http.MethodGet, "/v1/users/me", user, ""), &profile)
+	if profile.Plan != "pro" {
+		t.Fatalf("profile plan %q, want pro", profile.Plan)
+	}
+}
+
+func TestQuotaWarning(t *testing.T) {
+	ts := newTestServer(t)
+	withConfig(t, func(cfg *Config) {
+		cfg.Auth.InternalAPIToken = testInternalToken
+		cfg.RateLimit.DefaultPlan = "free"
+		cfg.RateLimit.Plans = map[string]QueryPlan{"free": {QueriesPerDay: 5}}
+		cfg.RateLimit.QuotaWarningPercent = 80
+	})
+	_, userID := ts.register("user@example.com")
+	useRateLimiter(t, &memoryRateLimitStore{buckets: make(map[string]*tokenBucket)})
+	resetNotifications(t)
+
+	spend := func(dryRun bool) int {
+		body := fmt.Sprintf(`{"user_id":%q,"dry_run":%t}`, userID, dryRun)
+		return ts.do(http.MethodPost, "/v1/internal/quota/queries", "", body, internalTokenHeader, testInternalToken).Code
+	}
+	warnings := func() []*Notification {
+		notificationMutex.Lock()
+		defer notificationMutex.Unlock()
+		var found []*Notification
+		for _, n := range notifications[userID] {
+			if n.Kind == NotificationQuotaWarning {
+				found = append(found, n)
+			}
+		}
+		return found
+	}
+
+	for i := 1; i <= 3; i++ {
+		spend(false)
+	}
+	if len(warnings()) != 0 {
+		t.Fatal("warned below the threshold")
+	}
+	spend(true)
+	if len(warnings()) != 0 {
+		t.Fatal("a dry run warned")
+	}
+	// The fourth of five queries crosses 80%; later ones don't warn again
+	spend(false)
+	if got := warnings(); len(got) != 1 || got[0].Data["used"] != "4" || got[0].Data["limit"] != "5" {
+		t.Fatalf("warnings after crossing: %+v", got)
+	}
+	spend(false)
+	if code := spend(false); code != http.StatusTooManyRequests {
+		t.Fatalf("spend over the plan: got %d, want 429", code)
+	}
+	if len(warnings()) != 1 {
+		t.Fatalf("warned %d times in one day", len(warnings()))
+	}
+}
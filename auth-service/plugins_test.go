@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// traceMiddleware appends its settings' step to X-Trace, to show order
+func traceMiddleware(settings map[string]string) (gin.HandlerFunc, error) {
+	step := settings["step"]
+	return func(c *gin.Context) {
+		c.Writer.Header().Add("X-Trace", step)
+		c.Next()
+	}, nil
+}
+
+func TestMiddlewarePlugins(t *testing.T) {
+	RegisterMiddleware("trace", traceMiddleware)
+	t.Cleanup(func() { delete(middlewareFactories, "trace") })
+	withConfig(t, func(cfg *Config) {
+		cfg.Middleware = []MiddlewareConfig{
+			{Name: "trace", Order: 2, Settings: map[string]string{"step": "late-2"}},
+			{Name: "trace", Stage: middlewareStageEarly, Settings: map[string]string{"step": "early"}},
+			{Name: "trace", Stage: middlewareStageLate, Order: 1, Settings: map[string]string{"step": "late-1a"}},
+			{Name: "trace", Order: 1, Settings: map[string]string{"step": "late-1b"}},
+			{Name: "headers", Settings: map[string]string{"x-frame-options": "DENY"}},
+			{Name: "request_headers", Settings: map[string]string{"Accept-Language": "es"}},
+		}
+	})
+	ts := newTestServer(t)
+
+	w := ts.do(http.MethodPost, "/v1/auth/login", "", `{"email":"nobody@example.com","password":"wrong-password"}`)
+	if got := strings.Join(w.Header().Values("X-Trace"), ","); got != "early,late-1a,late-1b,late-2" {
+		t.Fatalf("order = %s", got)
+	}
+	if w.Header().Get("X-Frame-Options") != "DENY" {
+		t.Fatalf("headers = %v", w.Header())
+	}
+	if w.Header().Get("Content-Language") != "es" {
+		t.Fatalf("rewritten Accept-Language not seen: %v", w.Header())
+	}
+
+	// Early middleware sees requests the gates reject; late middleware doesn't
+	w = ts.do(http.MethodPost, "/v1/auth/login", "", `not json`, "Content-Type", "text/plain")
+	if w.Code != http.StatusUnsupportedMediaType || strings.Join(w.Header().Values("X-Trace"), ",") != "early" {
+		t.Fatalf("rejected request: %d %v", w.Code, w.Header())
+	}
+}
+
+func TestMiddlewarePluginErrors(t *testing.T) {
+	withConfig(t, func(cfg *Config) {
+		cfg.Middleware = []MiddlewareConfig{{Name: "headers", Settings: map[string]string{"bad header": "x"}}}
+	})
+	if _, err := NewServer(NewService(newMemoryUserRepository(), newMemoryDocumentRepository(), &keyRing{})); err == nil {
+		t.Fatal("invalid header name accepted")
+	}
+
+	cfg := defaultConfig()
+	cfg.Middleware = []MiddlewareConfig{{Name: "missing"}, {Name: "headers", Stage: "first"}}
+	err := cfg.validate()
+	if err == nil || !strings.Contains(err.Error(), `middleware[0].name "missing"`) || !strings.Contains(err.Error(), "middleware[1].stage") {
+		t.Fatalf("validate = %v", err)
+	}
+}
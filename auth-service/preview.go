@@ -0,0 +1,645 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// ============================================================================
+// Document Previews
+// ============================================================================
+//
+// Once an ingest job has handed a file to the RAG backend, the job runner
+// pulls out what the UI needs to show it as more than a filename: title,
+// author, page count, language and the start of the first page's text. It
+// works from the payload it already holds and the type the upload was
+// sniffed as (filetypes.go). PDF and DOCX keep their own metadata; HTML has
+// <title> and <meta name="author">, and Markdown may have front matter.
+// Otherwise the title is the first heading or line. Only PDF and DOCX have
+// pages to count. When the file doesn't declare its language, it is guessed
+// from the text among en, es and hi, the languages the service speaks, and
+// left blank if the guess is weak.
+//
+// Extraction is best effort: a PDF whose text needs its fonts' encodings
+// to read yields metadata but no snippet. The preview is kept on the
+// document record, so it is replicated and backed up with it. Documents
+// ingested before this, or only registered by name, have none.
+
+const (
+	previewSnippetRunes = 500
+	previewTitleRunes   = 200
+
+	// pdfInflateLimit bounds how much of a PDF's compressed streams is
+	// inflated to find pages, metadata and text
+	pdfInflateLimit = 32 << 20
+)
+
+// DocumentPreview is what ingestion extracted from a document; it is
+// replaced, never changed in place
+type DocumentPreview struct {
+	Title    string `json:"title,omitempty" bson:"title,omitempty"`
+	Author   string `json:"author,omitempty" bson:"author,omitempty"`
+	Pages    int    `json:"pages,omitempty" bson:"pages,omitempty"`
+	Language string `json:"language,omitempty" bson:"language,omitempty"`
+	Snippet  string `json:"snippet,omitempty" bson:"snippet,omitempty"` // start of the first page's text
+}
+
+// DocumentPreviewResponse for GET /documents/:filename/preview
+type DocumentPreviewResponse struct {
+	Filename string           `json:"filename"`
+	Type     string           `json:"type,omitempty"`
+	Size     int64            `json:"size,omitempty"`
+	Preview  *DocumentPreview `json:"preview"` // null until ingestion has extracted it
+}
+
+// samePreview reports whether two previews match
+func samePreview(a, b *DocumentPreview) bool {
+	return (a == nil) == (b == nil) && (a == nil || *a == *b)
+}
+
+// SetDocumentPreview stores what was extracted from an ingested file
+func (s *Service) SetDocumentPreview(filename string, preview DocumentPreview) {
+	s.documents.Update(func(tx DocumentTx) error {
+		if record, exists := tx.get(filename); exists {
+			record.Preview = &preview
+			tx.put(filename, record)
+			saveDocumentMeta(filename, documentMeta(record))
+			bumpDocVersion() // listings filter by its language
+		}
+		return nil
+	})
+}
+
+func recordDocumentPreview(filename string, preview DocumentPreview) {
+	defaultService.SetDocumentPreview(filename, preview)
+}
+
+// extractPreview pulls a preview out of a file of a known document type
+func extractPreview(filename string, content []byte) DocumentPreview {
+	var preview DocumentPreview
+	var text string
+	switch sniffFileType(filename, content) {
+	case fileTypePDF:
+		preview, text = pdfPreview(content)
+	case fileTypeDOCX:
+		preview, text = docxPreview(content)
+	case fileTypeHTML:
+		preview, text = htmlPreview(content)
+	case fileTypeMD:
+		preview, text = markdownPreview(string(content))
+	case fileTypeTXT:
+		text = string(content)
+		if page, _, found := strings.Cut(text, "\f"); found {
+			text = page
+		}
+		preview.Title = firstLine(text)
+	}
+
+	text = collapseSpace(text)
+	preview.Title = truncateRunes(collapseSpace(preview.Title), previewTitleRunes)
+	preview.Author = truncateRunes(collapseSpace(preview.Author), previewTitleRunes)
+	preview.Snippet = truncateRunes(text, previewSnippetRunes)
+	if preview.Language == "" {
+		preview.Language = guessLanguage(preview.Title + " " + text)
+	}
+	return preview
+}
+
+// primaryLanguage reduces a language tag such as en-US to its language
+func primaryLanguage(tag string) string {
+	primary, _, _ := strings.Cut(strings.TrimSpace(tag), "-")
+	primary, _, _ = strings.Cut(primary, "_")
+	return strings.ToLower(primary)
+}
+
+// languageWords are frequent words that mark a text as English or Spanish
+var languageWords = map[string]string{
+	"the": "en", "and": "en", "of": "en", "to": "en", "is": "en", "that": "en", "for": "en", "with": "en", "this": "en", "are": "en",
+	"el": "es", "la": "es", "de": "es", "que": "es", "y": "es", "los": "es", "las": "es", "por": "es", "para": "es", "con": "es", "una": "es", "es": "es",
+}
+
+// guessLanguage names the language a text is most likely in, or "" if the
+// text doesn't say clearly enough
+func guessLanguage(text string) string {
+	var letters, devanagari int
+	for _, r := range text {
+		if unicode.IsLetter(r) {
+			letters++
+			if unicode.Is(unicode.Devanagari, r) {
+				devanagari++
+			}
+		}
+	}
+	if letters > 0 && devanagari*3 > letters {
+		return "hi"
+	}
+
+	counts := make(map[string]int)
+	for _, word := range strings.FieldsFunc(strings.ToLower(text), func(r rune) bool { return !unicode.IsLetter(r) }) {
+		counts[languageWords[word]]++
+	}
+	switch en, es := counts["en"], counts["es"]; {
+	case en >= 3 && en >= 2*es:
+		return "en"
+	case es >= 3 && es >= 2*en:
+		return "es"
+	}
+	return ""
+}
+
+// collapseSpace turns runs of whitespace into single spaces
+func collapseSpace(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
+
+// truncateRunes shortens s to at most n runes, at a word boundary where
+// there is one
+func truncateRunes(s string, n int) string {
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	cut := string([]rune(s)[:n-1])
+	if i := strings.LastIndexByte(cut, ' '); i > len(cut)/2 {
+		cut = cut[:i]
+	}
+	return cut + "…"
+}
+
+// firstLine returns the first line with text on it
+func firstLine(text string) string {
+	for _, line := range strings.Split(text, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			return line
+		}
+	}
+	return ""
+}
+
+// ----------------------------------------------------------------------------
+// Markdown and HTML
+// ----------------------------------------------------------------------------
+
+var markdownMarkup = strings.NewReplacer("**", "", "__", "", "`", "", "> ", "")
+
+// markdownPreview reads front matter (title, author, lang) and takes the
+// first heading as the title otherwise
+func markdownPreview(text string) (DocumentPreview, string) {
+	var preview DocumentPreview
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	if rest, found := strings.CutPrefix(text, "---\n"); found {
+		if front, body, found := strings.Cut(rest, "\n---\n"); found {
+			text = body
+			for _, line := range strings.Split(front, "\n") {
+				key, value, _ := strings.Cut(line, ":")
+				value = strings.Trim(strings.TrimSpace(value), `"'`)
+				switch strings.TrimSpace(key) {
+				case "title":
+					preview.Title = value
+				case "author":
+					preview.Author = value
+				case "lang", "language":
+					preview.Language = primaryLanguage(value)
+				}
+			}
+		}
+	}
+
+	var body []string
+	for _, line := range strings.Split(text, "\n") {
+		heading := strings.TrimLeft(line, "#")
+		if len(heading) < len(line) && strings.HasPrefix(heading, " ") {
+			if preview.Title == "" {
+				preview.Title = strings.TrimSpace(heading)
+			}
+			line = heading
+		}
+		body = append(body, line)
+	}
+	text = markdownMarkup.Replace(strings.Join(body, "\n"))
+	if preview.Title == "" {
+		preview.Title = firstLine(text)
+	}
+	return preview, text
+}
+
+// htmlPreview reads <title>, <meta name="author">, the lang attribute and
+// the page's visible text
+func htmlPreview(content []byte) (DocumentPreview, string) {
+	var preview DocumentPreview
+	var title, text strings.Builder
+	inTitle, hidden := false, 0
+	z := html.NewTokenizer(bytes.NewReader(content))
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			break
+		}
+		tok := z.Token()
+		switch tt {
+		case html.StartTagToken, html.SelfClosingTagToken:
+			switch tok.DataAtom {
+			case atom.Html:
+				preview.Language = primaryLanguage(htmlAttr(tok, "lang"))
+			case atom.Meta:
+				if strings.EqualFold(htmlAttr(tok, "name"), "author") {
+					preview.Author = htmlAttr(tok, "content")
+				}
+			case atom.Title:
+				inTitle = tt == html.StartTagToken
+			case atom.Script, atom.Style, atom.Noscript, atom.Template:
+				if tt == html.StartTagToken {
+					hidden++
+				}
+			}
+			text.WriteByte(' ')
+		case html.EndTagToken:
+			switch tok.DataAtom {
+			case atom.Title:
+				inTitle = false
+			case atom.Script, atom.Style, atom.Noscript, atom.Template:
+				hidden = max(hidden-1, 0)
+			}
+			text.WriteByte(' ')
+		case html.TextToken:
+			if inTitle {
+				title.WriteString(tok.Data)
+			} else if hidden == 0 {
+				text.WriteString(tok.Data)
+			}
+		}
+	}
+	preview.Title = title.String()
+	if strings.TrimSpace(preview.Title) == "" {
+		preview.Title = firstLine(text.String())
+	}
+	return preview, text.String()
+}
+
+func htmlAttr(tok html.Token, name string) string {
+	for _, attr := range tok.Attr {
+		if attr.Key == name {
+			return attr.Val
+		}
+	}
+	return ""
+}
+
+// ----------------------------------------------------------------------------
+// DOCX
+// ----------------------------------------------------------------------------
+
+// docxPreview reads docProps/core.xml and docProps/app.xml for metadata and
+// word/document.xml up to the first page break for text
+func docxPreview(content []byte) (DocumentPreview, string) {
+	var preview DocumentPreview
+	archive, err := zip.NewReader(bytes.NewReader(content), int64(len(content)))
+	if err != nil {
+		return preview, ""
+	}
+	var text strings.Builder
+	for _, f := range archive.File {
+		switch f.Name {
+		case "docProps/core.xml":
+			readXML(f, func(el xml.StartElement, d *xml.Decoder) bool {
+				switch el.Name.Local {
+				case "title":
+					preview.Title = xmlText(d)
+				case "creator":
+					preview.Author = xmlText(d)
+				case "language":
+					preview.Language = primaryLanguage(xmlText(d))
+				}
+				return true
+			})
+		case "docProps/app.xml":
+			readXML(f, func(el xml.StartElement, d *xml.Decoder) bool {
+				if el.Name.Local == "Pages" {
+					preview.Pages, _ = strconv.Atoi(strings.TrimSpace(xmlText(d)))
+				}
+				return true
+			})
+		case "word/document.xml":
+			readXML(f, func(el xml.StartElement, d *xml.Decoder) bool {
+				switch el.Name.Local {
+				case "t":
+					text.WriteString(xmlText(d))
+				case "p", "tab":
+					text.WriteByte(' ')
+				case "lastRenderedPageBreak":
+					return strings.TrimSpace(text.String()) == ""
+				case "br":
+					// Only page breaks end the first page; <w:br/> alone is a line break
+					return !isPageBreak(el) || strings.TrimSpace(text.String()) == ""
+				}
+				return true
+			})
+		}
+	}
+	if preview.Title == "" {
+		preview.Title = firstLine(text.String())
+	}
+	return preview, text.String()
+}
+
+// readXML calls visit with each element of a zipped XML file until it
+// returns false
+func readXML(f *zip.File, visit func(el xml.StartElement, d *xml.Decoder) bool) {
+	r, err := f.Open()
+	if err != nil {
+		return
+	}
+	defer r.Close()
+	d := xml.NewDecoder(io.LimitReader(r, maxUploadSize<<2))
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			return
+		}
+		if start, ok := tok.(xml.StartElement); ok && !visit(start, d) {
+			return
+		}
+	}
+}
+
+func isPageBreak(br xml.StartElement) bool {
+	for _, attr := range br.Attr {
+		if attr.Name.Local == "type" && attr.Value == "page" {
+			return true
+		}
+	}
+	return false
+}
+
+// xmlText reads the character data up to the end of the current element
+func xmlText(d *xml.Decoder) string {
+	var text strings.Builder
+	for depth := 1; depth > 0; {
+		tok, err := d.Token()
+		if err != nil {
+			break
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			depth++
+		case xml.EndElement:
+			depth--
+		case xml.CharData:
+			text.Write(t)
+		}
+	}
+	return text.String()
+}
+
+// ----------------------------------------------------------------------------
+// PDF
+// ----------------------------------------------------------------------------
+
+var (
+	pdfStream   = regexp.MustCompile(`(?s)<<(.{0,512}?)>>\s*stream\r?\n`)
+	pdfPageType = regexp.MustCompile(`/Type\s*/Page(?:[^a-zA-Z]|$)`)
+	pdfInfoKey  = regexp.MustCompile(`/(Title|Author|Lang)\s*([(<])`)
+)
+
+// pdfPreview finds page objects, the Info dictionary and the first
+// content stream with readable text, looking inside Flate-compressed
+// streams (object streams included) as well as the file itself
+func pdfPreview(content []byte) (DocumentPreview, string) {
+	var preview DocumentPreview
+	sections := [][]byte{content}
+	inflated := 0
+	for _, m := range pdfStream.FindAllSubmatchIndex(content, -1) {
+		if inflated >= pdfInflateLimit || !bytes.Contains(content[m[2]:m[3]], []byte("/FlateDecode")) {
+			continue
+		}
+		r, err := zlib.NewReader(bytes.NewReader(content[m[1]:]))
+		if err != nil {
+			continue
+		}
+		data, _ := io.ReadAll(io.LimitReader(r, int64(pdfInflateLimit-inflated)))
+		inflated += len(data)
+		sections = append(sections, data)
+	}
+
+	var text string
+	for _, section := range sections {
+		preview.Pages += len(pdfPageType.FindAllIndex(section, -1))
+		for _, m := range pdfInfoKey.FindAllSubmatchIndex(section, -1) {
+			value := pdfString(section, m[4])
+			switch string(section[m[2]:m[3]]) {
+			case "Title":
+				preview.Title = value
+			case "Author":
+				preview.Author = value
+			case "Lang":
+				preview.Language = primaryLanguage(value)
+			}
+		}
+		if text == "" && bytes.Contains(section, []byte("BT")) {
+			if t := pdfText(section); readable(t) {
+				text = t
+			}
+		}
+	}
+	if preview.Title == "" {
+		preview.Title = firstLine(text)
+	}
+	return preview, text
+}
+
+// pdfString decodes the literal or hex string starting at data[i]
+func pdfString(data []byte, i int) string {
+	var raw []byte
+	if data[i] == '(' {
+		raw, _ = pdfLiteral(data, i+1)
+	} else {
+		end := bytes.IndexByte(data[i:], '>')
+		if end < 0 {
+			return ""
+		}
+		hex := strings.Map(func(r rune) rune {
+			if unicode.Is(unicode.ASCII_Hex_Digit, r) {
+				return r
+			}
+			return -1
+		}, string(data[i+1:i+end]))
+		if len(hex)%2 == 1 {
+			hex += "0"
+		}
+		for j := 0; j < len(hex); j += 2 {
+			b, _ := strconv.ParseUint(hex[j:j+2], 16, 8)
+			raw = append(raw, byte(b))
+		}
+	}
+	return pdfTextString(raw)
+}
+
+// pdfTextString decodes a PDF text string: UTF-16BE with a byte order mark,
+// or a single-byte encoding read as Latin-1
+func pdfTextString(raw []byte) string {
+	if len(raw) >= 2 && raw[0] == 0xfe && raw[1] == 0xff {
+		units := make([]uint16, 0, len(raw)/2)
+		for j := 2; j+1 < len(raw); j += 2 {
+			units = append(units, binary.BigEndian.Uint16(raw[j:]))
+		}
+		return string(utf16.Decode(units))
+	}
+	runes := make([]rune, len(raw))
+	for j, b := range raw {
+		runes[j] = rune(b)
+	}
+	return string(runes)
+}
+
+// pdfLiteral reads a literal string whose opening parenthesis is just
+// before data[i], returning its bytes and the index after it
+func pdfLiteral(data []byte, i int) ([]byte, int) {
+	var out []byte
+	for depth := 1; i < len(data); i++ {
+		switch c := data[i]; c {
+		case '(':
+			depth++
+		case ')':
+			if depth--; depth == 0 {
+				return out, i + 1
+			}
+		case '\\':
+			if i++; i == len(data) {
+				return out, i
+			}
+			switch e := data[i]; e {
+			case 'n':
+				out = append(out, '\n')
+			case 'r':
+				out = append(out, '\r')
+			case 't':
+				out = append(out, '\t')
+			case 'b', 'f':
+				out = append(out, ' ')
+			case '\r', '\n':
+				// Line continuation
+			default:
+				if e >= '0' && e <= '7' {
+					n := 0
+					for k := 0; k < 3 && i < len(data) && data[i] >= '0' && data[i] <= '7'; k, i = k+1, i+1 {
+						n = n*8 + int(data[i]-'0')
+					}
+					i--
+					out = append(out, byte(n))
+				} else {
+					out = append(out, e)
+				}
+			}
+			continue
+		}
+		out = append(out, data[i])
+	}
+	return out, i
+}
+
+// pdfText pulls the strings shown between BT and ET out of a content
+// stream, with a space where the text moves or a TJ array kerns widely
+func pdfText(stream []byte) string {
+	var text strings.Builder
+	inText, inArray := false, false
+	for i := 0; i < len(stream); i++ {
+		c := stream[i]
+		switch {
+		case c == '(':
+			s, next := pdfLiteral(stream, i+1)
+			if inText {
+				text.WriteString(pdfTextString(s))
+			}
+			i = next - 1
+		case c == '[':
+			inArray = true
+		case c == ']':
+			inArray = false
+		case c == '%':
+			for i < len(stream) && stream[i] != '\n' && stream[i] != '\r' {
+				i++
+			}
+		case inArray && (c == '-' || c == '.' || (c >= '0' && c <= '9')):
+			j := i + 1
+			for j < len(stream) && (stream[j] == '.' || (stream[j] >= '0' && stream[j] <= '9')) {
+				j++
+			}
+			if n, err := strconv.ParseFloat(string(stream[i:j]), 64); err == nil && n < -200 && inText {
+				text.WriteByte(' ')
+			}
+			i = j - 1
+		case c == '\'' || c == '"' || (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z'):
+			j := i + 1
+			for j < len(stream) && ((stream[j] >= 'A' && stream[j] <= 'Z') || (stream[j] >= 'a' && stream[j] <= 'z') || stream[j] == '*') {
+				j++
+			}
+			switch string(stream[i:j]) {
+			case "BT":
+				inText = true
+			case "ET":
+				inText = false
+				text.WriteByte('\n')
+			case "Td", "TD", "T*", "Tm", "'", `"`:
+				text.WriteByte(' ')
+			}
+			i = j - 1
+		}
+	}
+	return text.String()
+}
+
+// readable reports whether extracted text is mostly letters and spaces,
+// rather than glyph IDs from a font with its own encoding
+func readable(text string) bool {
+	var good, total int
+	for _, r := range text {
+		total++
+		if unicode.IsLetter(r) || unicode.IsSpace(r) || unicode.IsDigit(r) || unicode.IsPunct(r) {
+			good++
+		}
+	}
+	return total >= 20 && good*10 >= total*9
+}
+
+// ----------------------------------------------------------------------------
+// Handlers
+// ----------------------------------------------------------------------------
+
+// DocumentPreview returns what ingestion extracted from a document the user
+// may read
+func (s *Service) DocumentPreview(filename string, user *User) (DocumentPreviewResponse, error) {
+	var resp DocumentPreviewResponse
+	var err error
+	s.documents.View(func(tx DocumentTx) {
+		var record documentRecord
+		if record, err = s.readableRecord(tx, filename, user); err == nil {
+			resp = DocumentPreviewResponse{Filename: filename, Type: record.Type, Size: record.Size, Preview: record.Preview}
+		}
+	})
+	return resp, err
+}
+
+// getDocumentPreview returns a document's title, author, pages, language and
+// opening text for the UI
+func (s *Server) getDocumentPreview(c *gin.Context) {
+	resp, err := s.svc.DocumentPreview(c.Param("filename"), c.MustGet("user").(*User))
+	if err != nil {
+		respondServiceError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, resp)
+}
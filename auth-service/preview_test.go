@@ -0,0 +1,102 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/zlib"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// minimalPDF builds a two-page PDF with an Info dictionary whose first
+// page's content stream is Flate-compressed
+func minimalPDF(t *testing.T) []byte {
+	t.Helper()
+	var stream bytes.Buffer
+	w := zlib.NewWriter(&stream)
+	w.Write([]byte("BT /F1 12 Tf 72 720 Td (Quarterly report for the board) Tj T* [(of the) -250 (company)] TJ ET"))
+	w.Close()
+	var pdf bytes.Buffer
+	pdf.WriteString("%PDF-1.4\n")
+	pdf.WriteString("1 0 obj << /Type /Catalog /Pages 2 0 R >> endobj\n")
+	pdf.WriteString("2 0 obj << /Type /Pages /Kids [3 0 R 4 0 R] /Count 2 >> endobj\n")
+	pdf.WriteString("3 0 obj << /Type /Page /Parent 2 0 R /Contents 5 0 R >> endobj\n")
+	pdf.WriteString("4 0 obj << /Type /Page /Parent 2 0 R >> endobj\n")
+	pdf.WriteString("5 0 obj << /Length " + strconv.Itoa(stream.Len()) + " /Filter /FlateDecode >> stream\n")
+	pdf.Write(stream.Bytes())
+	pdf.WriteString("\nendstream endobj\n")
+	pdf.WriteString("6 0 obj << /Title (Q3 \\(draft\\)) /Author <FEFF004100640061> >> endobj\n")
+	pdf.WriteString("trailer << /Root 1 0 R /Info 6 0 R >>\n%%EOF\n")
+	return pdf.Bytes()
+}
+
+func minimalDOCX(t *testing.T) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	z := zip.NewWriter(&buf)
+	files := map[string]string{
+		"docProps/core.xml": `<cp:coreProperties xmlns:cp="c" xmlns:dc="d"><dc:title>Plan anual</dc:title><dc:creator>Lucía</dc:creator><dc:language>es-ES</dc:language></cp:coreProperties>`,
+		"docProps/app.xml":  `<Properties><Pages>7</Pages></Properties>`,
+		"word/document.xml": `<w:document xmlns:w="w"><w:body><w:p><w:r><w:t>Primera página</w:t></w:r></w:p>` +
+			`<w:p><w:r><w:br w:type="page"/><w:t>Segunda</w:t></w:r></w:p></w:body></w:document>`,
+	}
+	for name, content := range files {
+		f, _ := z.Create(name)
+		f.Write([]byte(content))
+	}
+	z.Close()
+	return buf.Bytes()
+}
+
+func TestExtractPreview(t *testing.T) {
+	tests := []struct {
+		filename string
+		content  []byte
+		want     DocumentPreview
+	}{
+		{"q3.pdf", minimalPDF(t), DocumentPreview{Title: "Q3 (draft)", Author: "Ada", Pages: 2, Language: "en",
+			Snippet: "Quarterly report for the board of the company"}},
+		{"plan.docx", minimalDOCX(t), DocumentPreview{Title: "Plan anual", Author: "Lucía", Pages: 7, Language: "es", Snippet: "Primera página"}},
+		{"faq.html", []byte(`<html lang="en-GB"><head><title>FAQ</title><meta name="author" content="Support"><script>var x</script></head>` +
+			`<body><h1>Questions</h1><p>How do I reset it?</p></body></html>`),
+			DocumentPreview{Title: "FAQ", Author: "Support", Language: "en", Snippet: "Questions How do I reset it?"}},
+		{"notes.md", []byte("---\ntitle: \"Release notes\"\nauthor: Dev team\n---\n## What changed\nThe parser is **faster** and the docs are better for this release.\n"),
+			DocumentPreview{Title: "Release notes", Author: "Dev team", Language: "en",
+				Snippet: "What changed The parser is faster and the docs are better for this release."}},
+		{"readme.txt", []byte("\n  Read me first \nनमस्ते दुनिया यह एक परीक्षण है\fpage two"),
+			DocumentPreview{Title: "Read me first", Language: "hi", Snippet: "Read me first नमस्ते दुनिया यह एक परीक्षण है"}},
+	}
+	for _, tt := range tests {
+		if got := extractPreview(tt.filename, tt.content); got != tt.want {
+			t.Errorf("%s:\n got %+v\nwant %+v", tt.filename, got, tt.want)
+		}
+	}
+
+	long := extractPreview("long.txt", []byte(strings.Repeat("word ", 200)))
+	if n := len([]rune(long.Snippet)); n > previewSnippetRunes || !strings.HasSuffix(long.Snippet, "…") {
+		t.Errorf("long snippet: %d runes, %q", n, long.Snippet[len(long.Snippet)-10:])
+	}
+}
+
+func TestDocumentPreviewEndpoint(t *testing.T) {
+	ts := newTestServer(t)
+	owner, _ := ts.register("owner@example.com")
+	other, _ := ts.register("other@example.com")
+	ts.do(http.MethodPost, "/v1/documents/register", owner, `{"filename":"q3.pdf"}`)
+
+	var resp DocumentPreviewResponse
+	decodeJSON(t, ts.do(http.MethodGet, "/v1/documents/q3.pdf/preview", owner, ""), &resp)
+	if resp.Filename != "q3.pdf" || resp.Preview != nil {
+		t.Fatalf("before ingestion: %+v", resp)
+	}
+	ts.srv.svc.SetDocumentPreview("q3.pdf", extractPreview("q3.pdf", minimalPDF(t)))
+	decodeJSON(t, ts.do(http.MethodGet, "/v1/documents/q3.pdf/preview", owner, ""), &resp)
+	if resp.Preview == nil || resp.Preview.Pages != 2 || resp.Preview.Title != "Q3 (draft)" {
+		t.Fatalf("after ingestion: %+v", resp.Preview)
+	}
+	if w := ts.do(http.MethodGet, "/v1/documents/q3.pdf/preview", other, ""); w.Code != http.StatusNotFound {
+		t.Fatalf("preview of an unreadable document: got %d, want 404", w.Code)
+	}
+}
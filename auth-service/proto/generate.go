@@ -0,0 +1,8 @@
+// Package proto holds the protobuf definitions for the gRPC API.
+//
+// Regenerate the Go bindings in ../authpb after editing auth.proto:
+//
+//	go generate ./proto
+package proto
+
+//go:generate protoc -I . --go_out=.. --go_opt=module=auth-service --go-grpc_out=.. --go-grpc_opt=module=auth-service auth.proto
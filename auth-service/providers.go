@@ -0,0 +1,549 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ============================================================================
+// Provider Failover
+// ============================================================================
+//
+// The backend answers with an LLM and embeds with an embedding model, each
+// from a provider (OpenAI, Azure OpenAI, a local Ollama...). Admins keep a
+// failover chain per kind at PUT /admin/providers: the primary first, then
+// the providers to fall back to. The chain says which vendor, model and
+// endpoint each provider is; API keys stay in the backend's environment,
+// looked up by provider name, and never pass through here. Embedding
+// providers must all serve the same model, since vectors from different
+// models can't be searched together. Without a chain the backend uses its
+// own configuration.
+//
+// Every provider has a circuit breaker, fed by its health URL (probed
+// every providers.health_interval with health.timeout) and by the backend,
+// which reports each call that failed or recovered to POST
+// /internal/providers/report:
+//
+//	closed     calls go through; providers.failure_threshold failures in a
+//	           row open it
+//	open       skipped for providers.open_for
+//	half_open  after that, calls go through again; a success closes it and
+//	           a failure opens it for another providers.open_for
+//
+// Each query carries the chain to use (stream.go, evaluation.go) with
+// providers whose breaker is open moved to the end, so an outage at the
+// primary costs one failed call per replica rather than one per query, and
+// a chain whose every breaker is open is still tried in order. Other
+// gateways read the same routing from GET /internal/providers.
+//
+// The chain is versioned and changed with If-Match like search settings.
+// With cluster mode it is kept in the shared store, so one change reaches
+// every replica; otherwise in providers.store_file. Breakers are per
+// replica, each judging the providers by what it has seen.
+
+const (
+	providerLLM       = "llm"
+	providerEmbedding = "embedding"
+
+	breakerClosed   = "closed"
+	breakerOpen     = "open"
+	breakerHalfOpen = "half_open"
+
+	providerChainSetting = "provider-chain"
+	maxProviderChain     = 5
+)
+
+var (
+	providerNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_.-]{0,63}$`)
+	errProviderNotFound = errors.New("Provider not in the failover chain")
+)
+
+// providerError explains why a chain was refused
+type providerError struct {
+	Reason string
+}
+
+func (e *providerError) Error() string {
+	return "Invalid provider chain: " + e.Reason
+}
+
+// Provider is one link of a failover chain
+type Provider struct {
+	Name      string `json:"name" binding:"required,max=64"`                     // unique across the chain; the backend finds the API key by it
+	Vendor    string `json:"vendor" binding:"required,max=64"`                   // openai, azure_openai, anthropic, ollama...; picks the backend's client
+	Model     string `json:"model" binding:"required,max=128"`                   // e.g. gpt-4o-mini or text-embedding-3-small
+	BaseURL   string `json:"base_url,omitempty" binding:"omitempty,url,max=512"` // empty is the vendor's default endpoint
+	HealthURL string `json:"health_url,omitempty" binding:"omitempty,url,max=512"`
+}
+
+// ProviderChain lists the providers to try for each kind, in order
+type ProviderChain struct {
+	LLM       []Provider `json:"llm" binding:"dive"`
+	Embedding []Provider `json:"embedding" binding:"dive"`
+}
+
+// ProviderChainVersion is the chain in force
+type ProviderChainVersion struct {
+	ProviderChain
+	Version   int       `json:"version"` // 0 when none has been set
+	ChangedBy string    `json:"changed_by,omitempty"`
+	ChangedAt time.Time `json:"changed_at"`
+}
+
+// ProviderReport for POST /internal/providers/report
+type ProviderReport struct {
+	Name  string `json:"name" binding:"required"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty" binding:"max=200"` // what went wrong, e.g. "status 503" or "timeout"
+}
+
+// ProviderStatus is a provider's breaker
+type ProviderStatus struct {
+	Name                string     `json:"name"`
+	Kind                string     `json:"kind"`
+	State               string     `json:"state"` // closed | open | half_open
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	LastError           string     `json:"last_error,omitempty"`
+	LastCheckAt         *time.Time `json:"last_check_at,omitempty"`
+	RetryAt             *time.Time `json:"retry_at,omitempty"` // when an open breaker lets calls through again
+}
+
+// ProviderRoute is a provider as a query is told to use it
+type ProviderRoute struct {
+	Name    string `json:"name"`
+	Vendor  string `json:"vendor"`
+	Model   string `json:"model"`
+	BaseURL string `json:"base_url,omitempty"`
+	State   string `json:"state"`
+}
+
+// QueryProviders is the failover order a query uses, healthiest first
+type QueryProviders struct {
+	Version   int             `json:"version"`
+	LLM       []ProviderRoute `json:"llm"`
+	Embedding []ProviderRoute `json:"embedding"`
+}
+
+// providerBreaker tracks one provider's recent failures
+type providerBreaker struct {
+	failures  int
+	open      bool
+	retryAt   time.Time
+	lastError string
+	lastCheck time.Time
+}
+
+var (
+	providerChain    ProviderChainVersion
+	providerBreakers = make(map[string]*providerBreaker)
+	providerMutex    sync.Mutex
+	providerChanging sync.Mutex // held through a change so two don't take the same version
+)
+
+// state is the breaker's state at now; callers hold providerMutex
+func (b *providerBreaker) state(now time.Time) string {
+	switch {
+	case !b.open:
+		return breakerClosed
+	case now.Before(b.retryAt):
+		return breakerOpen
+	default:
+		return breakerHalfOpen
+	}
+}
+
+// record counts a call or health check; callers hold providerMutex. It
+// returns the state before and after.
+func (b *providerBreaker) record(ok bool, reason string, now time.Time) (string, string) {
+	before := b.state(now)
+	b.lastCheck = now
+	if ok {
+		// An open breaker waits out open_for before trusting a success
+		if before != breakerOpen {
+			b.failures, b.open, b.lastError = 0, false, ""
+		}
+		return before, b.state(now)
+	}
+	b.failures++
+	b.lastError = reason
+	if before == breakerHalfOpen || (before == breakerClosed && b.failures >= config.Providers.FailureThreshold) {
+		b.open, b.retryAt = true, now.Add(config.Providers.OpenFor)
+	}
+	return before, b.state(now)
+}
+
+// check validates a chain: names unique and well formed, one embedding
+// model, and an llm provider when anything is set
+func (chain ProviderChain) check() error {
+	if len(chain.LLM) > maxProviderChain || len(chain.Embedding) > maxProviderChain ||
+		(len(chain.LLM) == 0 && len(chain.Embedding) > 0) {
+		return &providerError{Reason: fmt.Sprintf("a chain needs an llm provider and at most %d of each kind", maxProviderChain)}
+	}
+	seen := make(map[string]bool)
+	for _, provider := range append(append([]Provider{}, chain.LLM...), chain.Embedding...) {
+		if !providerNamePattern.MatchString(provider.Name) {
+			return &providerError{Reason: "names must be lowercase letters, digits, ., - or _"}
+		}
+		if seen[provider.Name] {
+			return &providerError{Reason: fmt.Sprintf("%s is listed twice", provider.Name)}
+		}
+		seen[provider.Name] = true
+	}
+	for _, provider := range chain.Embedding {
+		if provider.Model != chain.Embedding[0].Model {
+			return &providerError{Reason: "embedding providers must all serve the same model"}
+		}
+	}
+	return nil
+}
+
+// kindOf finds which list a provider is in; callers hold providerMutex
+func kindOf(name string) (string, bool) {
+	for _, provider := range providerChain.LLM {
+		if provider.Name == name {
+			return providerLLM, true
+		}
+	}
+	for _, provider := range providerChain.Embedding {
+		if provider.Name == name {
+			return providerEmbedding, true
+		}
+	}
+	return "", false
+}
+
+// breakerOf returns a provider's breaker, creating it closed; callers hold
+// providerMutex
+func breakerOf(name string) *providerBreaker {
+	breaker := providerBreakers[name]
+	if breaker == nil {
+		breaker = &providerBreaker{}
+		providerBreakers[name] = breaker
+	}
+	return breaker
+}
+
+// recordProviderResult feeds a call or health check to a provider's breaker
+func recordProviderResult(name string, ok bool, reason string, now time.Time) error {
+	providerMutex.Lock()
+	defer providerMutex.Unlock()
+	kind, known := kindOf(name)
+	if !known {
+		return errProviderNotFound
+	}
+	before, after := breakerOf(name).record(ok, reason, now)
+	if before != after {
+		level := slog.LevelInfo
+		if after == breakerOpen {
+			level = slog.LevelWarn
+		}
+		slog.Log(context.Background(), level, "Provider circuit "+after, "provider", name, "kind", kind, "error", reason)
+	}
+	return nil
+}
+
+// ----------------------------------------------------------------------------
+// Storage
+// ----------------------------------------------------------------------------
+
+// startProviders loads the chain and starts probing health URLs
+func startProviders() {
+	if err := loadProviderChain(); err != nil {
+		fatal("Failed to load provider chain", "file", config.Providers.StoreFile, "error", err)
+	}
+	goBackground(func(ctx context.Context) {
+		ticker := time.NewTicker(config.Providers.HealthInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				checkProviders(ctx)
+			}
+		}
+	})
+}
+
+// loadProviderChain reads the chain from the shared store when clustered,
+// otherwise from providers.store_file
+func loadProviderChain() error {
+	if clustered() {
+		return refreshSetting(context.Background(), providerChainSetting)
+	}
+	data, err := os.ReadFile(config.Providers.StoreFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return applyProviderChain(data)
+}
+
+// applyProviderChain puts a stored chain in force, dropping the breakers of
+// providers that left it
+func applyProviderChain(data []byte) error {
+	var chain ProviderChainVersion
+	if err := json.Unmarshal(data, &chain); err != nil {
+		return err
+	}
+	providerMutex.Lock()
+	defer providerMutex.Unlock()
+	providerChain = chain
+	for name := range providerBreakers {
+		if _, known := kindOf(name); !known {
+			delete(providerBreakers, name)
+		}
+	}
+	return nil
+}
+
+// storeProviderChain writes a chain where loadProviderChain reads it
+func storeProviderChain(data []byte) error {
+	if clustered() {
+		return saveSharedSetting(providerChainSetting, data)
+	}
+	if dir := filepath.Dir(config.Providers.StoreFile); dir != "." {
+		if err := os.MkdirAll(dir, 0o700); err != nil {
+			return err
+		}
+	}
+	return jobFiles{}.write(config.Providers.StoreFile, data)
+}
+
+func providerETag(version int) string {
+	return makeETag("providers", "chain", version)
+}
+
+// changeProviderChain replaces the chain unless ifMatch is stale; it
+// returns the new version, or the current one's ETag if ifMatch failed
+func changeProviderChain(chain ProviderChain, ifMatch, actor string) (ProviderChainVersion, string, bool, error) {
+	providerChanging.Lock()
+	defer providerChanging.Unlock()
+	providerMutex.Lock()
+	current := providerChain
+	providerMutex.Unlock()
+	etag := providerETag(current.Version)
+	if ifMatch != "" && !etagMatches(ifMatch, etag, false) {
+		return ProviderChainVersion{}, etag, false, nil
+	}
+	version := ProviderChainVersion{
+		ProviderChain: chain,
+		Version:       current.Version + 1,
+		ChangedBy:     actor,
+		ChangedAt:     time.Now().UTC(),
+	}
+	data, err := json.Marshal(version)
+	if err == nil {
+		err = storeProviderChain(data)
+	}
+	if err == nil {
+		err = applyProviderChain(data)
+	}
+	if err != nil {
+		return ProviderChainVersion{}, etag, false, err
+	}
+	return version, providerETag(version.Version), true, nil
+}
+
+// ----------------------------------------------------------------------------
+// Health and routing
+// ----------------------------------------------------------------------------
+
+// checkProviders probes every provider with a health URL in parallel
+func checkProviders(ctx context.Context) {
+	providerMutex.Lock()
+	targets := make(map[string]string)
+	for _, provider := range append(append([]Provider{}, providerChain.LLM...), providerChain.Embedding...) {
+		if provider.HealthURL != "" {
+			targets[provider.Name] = provider.HealthURL
+		}
+	}
+	providerMutex.Unlock()
+
+	var wg sync.WaitGroup
+	for name, target := range targets {
+		wg.Add(1)
+		go func(name, target string) {
+			defer wg.Done()
+			result := checkService(ctx, name, target)
+			recordProviderResult(name, result.Status == healthHealthy, result.Error, time.Now())
+		}(name, target)
+	}
+	wg.Wait()
+}
+
+// routeProviders orders one kind's providers for a query: those that take
+// calls in chain order, then those whose breaker is open; callers hold
+// providerMutex
+func routeProviders(providers []Provider, now time.Time) []ProviderRoute {
+	routes := make([]ProviderRoute, 0, len(providers))
+	var skipped []ProviderRoute
+	for _, provider := range providers {
+		route := ProviderRoute{
+			Name:    provider.Name,
+			Vendor:  provider.Vendor,
+			Model:   provider.Model,
+			BaseURL: provider.BaseURL,
+			State:   breakerOf(provider.Name).state(now),
+		}
+		if route.State == breakerOpen {
+			skipped = append(skipped, route)
+		} else {
+			routes = append(routes, route)
+		}
+	}
+	return append(routes, skipped...)
+}
+
+// providersFor is the routing a query is sent with; nil without a chain,
+// which leaves the choice to the backend
+func providersFor(now time.Time) *QueryProviders {
+	providerMutex.Lock()
+	defer providerMutex.Unlock()
+	if len(providerChain.LLM) == 0 {
+		return nil
+	}
+	return &QueryProviders{
+		Version:   providerChain.Version,
+		LLM:       routeProviders(providerChain.LLM, now),
+		Embedding: routeProviders(providerChain.Embedding, now),
+	}
+}
+
+// providerStatuses lists every provider's breaker in chain order
+func providerStatuses(now time.Time) []ProviderStatus {
+	providerMutex.Lock()
+	defer providerMutex.Unlock()
+	statuses := []ProviderStatus{}
+	for _, list := range []struct {
+		kind      string
+		providers []Provider
+	}{{providerLLM, providerChain.LLM}, {providerEmbedding, providerChain.Embedding}} {
+		for _, provider := range list.providers {
+			breaker := breakerOf(provider.Name)
+			status := ProviderStatus{
+				Name:                provider.Name,
+				Kind:                list.kind,
+				State:               breaker.state(now),
+				ConsecutiveFailures: breaker.failures,
+				LastError:           breaker.lastError,
+			}
+			if !breaker.lastCheck.IsZero() {
+				at := breaker.lastCheck.UTC()
+				status.LastCheckAt = &at
+			}
+			if status.State == breakerOpen {
+				at := breaker.retryAt.UTC()
+				status.RetryAt = &at
+			}
+			statuses = append(statuses, status)
+		}
+	}
+	return statuses
+}
+
+// ----------------------------------------------------------------------------
+// Handlers
+// ----------------------------------------------------------------------------
+
+// getProviders shows the failover chain and each provider's breaker (admin)
+func getProviders(c *gin.Context) {
+	providerMutex.Lock()
+	chain := providerChain
+	providerMutex.Unlock()
+	if chain.LLM == nil {
+		chain.LLM = []Provider{}
+	}
+	if chain.Embedding == nil {
+		chain.Embedding = []Provider{}
+	}
+	c.Header("ETag", providerETag(chain.Version))
+	c.JSON(http.StatusOK, gin.H{"chain": chain, "status": providerStatuses(time.Now())})
+}
+
+// setProviders replaces the failover chain; an empty chain hands the choice
+// back to the backend (admin)
+func setProviders(c *gin.Context) {
+	var req ProviderChain
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondBindError(c, err)
+		return
+	}
+	if err := req.check(); err != nil {
+		var invalid *providerError
+		errors.As(err, &invalid)
+		respondProblem(c, Problem{
+			Status:     http.StatusBadRequest,
+			Code:       codeInvalidRequest,
+			Detail:     "Invalid provider chain",
+			Extensions: map[string]interface{}{"reason": invalid.Reason},
+		})
+		return
+	}
+	providerMutex.Lock()
+	before := providerChain
+	providerMutex.Unlock()
+
+	version, etag, ok, err := changeProviderChain(req, c.GetHeader("If-Match"), c.MustGet("user").(*User).ID)
+	if err != nil {
+		respondServiceError(c, err)
+		return
+	}
+	c.Header("ETag", etag)
+	if !ok {
+		respondError(c, http.StatusPreconditionFailed, codePreconditionFailed,
+			"Resource has changed since it was fetched; reload and try again")
+		return
+	}
+	auditChange(c, "providers.changed", "providers", before, version)
+	c.JSON(http.StatusOK, gin.H{"chain": version, "status": providerStatuses(time.Now())})
+}
+
+// checkProvidersNow probes the health URLs without waiting for the next
+// interval (admin)
+func checkProvidersNow(c *gin.Context) {
+	checkProviders(c.Request.Context())
+	c.JSON(http.StatusOK, gin.H{"status": providerStatuses(time.Now())})
+}
+
+// internalProviders tells another gateway which providers to use, in order
+func internalProviders(c *gin.Context) {
+	routing := providersFor(time.Now())
+	if routing == nil {
+		routing = &QueryProviders{LLM: []ProviderRoute{}, Embedding: []ProviderRoute{}}
+	}
+	c.JSON(http.StatusOK, routing)
+}
+
+// reportProvider takes the backend's word that a provider call failed or
+// succeeded
+func reportProvider(c *gin.Context) {
+	var req ProviderReport
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondBindError(c, err)
+		return
+	}
+	if err := recordProviderResult(req.Name, req.OK, req.Error, time.Now()); err != nil {
+		respondError(c, http.StatusNotFound, codeNotFound, err.Error())
+		return
+	}
+	for _, status := range providerStatuses(time.Now()) {
+		if status.Name == req.Name {
+			c.JSON(http.StatusOK, status)
+			return
+		}
+	}
+}
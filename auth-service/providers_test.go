@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestProviderBreaker(t *testing.T) {
+	withConfig(t, func(cfg *Config) {
+		cfg.Providers.FailureThreshold = 2
+		cfg.Providers.OpenFor = time.Minute
+	})
+	at := time.Date(2026, 3, 4, 10, 0, 0, 0, time.UTC)
+	var breaker providerBreaker
+	steps := []struct {
+		ok    bool
+		after time.Duration
+		want  string
+	}{
+		{false, 0, breakerClosed},
+		{false, 0, breakerOpen},
+		{true, 30 * time.Second, breakerOpen}, // successes don't count until open_for has passed
+		{false, time.Minute, breakerOpen},     // the half-open trial failed
+		{true, 2 * time.Minute, breakerClosed},
+		{false, 2 * time.Minute, breakerClosed},
+	}
+	for i, step := range steps {
+		if _, got := breaker.record(step.ok, "status 503", at.Add(step.after)); got != step.want {
+			t.Fatalf("step %d: %s, want %s", i+1, got, step.want)
+		}
+	}
+	if got := breaker.state(at.Add(3 * time.Minute)); got != breakerClosed || breaker.failures != 1 {
+		t.Fatalf("after recovering: %s with %d failures", got, breaker.failures)
+	}
+}
+
+func TestProviderFailover(t *testing.T) {
+	ts := newTestServer(t)
+	healthy := true
+	health := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/primary" && !healthy {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer health.Close()
+	var sent StreamQueryRequest
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&sent)
+		w.Write([]byte(`{"answer":"ok"}`))
+	}))
+	defer backend.Close()
+	withConfig(t, func(cfg *Config) {
+		cfg.Auth.InternalAPIToken = testInternalToken
+		cfg.RAGBackend.URL = backend.URL
+		cfg.Providers.StoreFile = filepath.Join(t.TempDir(), "provider-chain.json")
+		cfg.Providers.FailureThreshold = 2
+	})
+	t.Cleanup(func() {
+		providerMutex.Lock()
+		providerChain, providerBreakers = ProviderChainVersion{}, make(map[string]*providerBreaker)
+		providerMutex.Unlock()
+	})
+	admin := ts.admin("admin@example.com")
+
+	if routing := providersFor(time.Now()); routing != nil {
+		t.Fatalf("routing without a chain: %+v", routing)
+	}
+	for name, body := range map[string]string{
+		"duplicate name":  `{"llm":[{"name":"openai","vendor":"openai","model":"a"},{"name":"openai","vendor":"azure_openai","model":"a"}]}`,
+		"embedding model": `{"llm":[{"name":"openai","vendor":"openai","model":"a"}],"embedding":[{"name":"e1","vendor":"openai","model":"small"},{"name":"e2","vendor":"azure_openai","model":"large"}]}`,
+		"no llm":          `{"embedding":[{"name":"e1","vendor":"openai","model":"small"}]}`,
+		"missing model":   `{"llm":[{"name":"openai","vendor":"openai"}]}`,
+	} {
+		if w := ts.do(http.MethodPut, "/v1/admin/providers", admin, body); w.Code != http.StatusBadRequest {
+			t.Fatalf("%s: got %d, want 400", name, w.Code)
+		}
+	}
+
+	chain := `{"llm":[{"name":"openai","vendor":"openai","model":"gpt-4o-mini","health_url":"` + health.URL + `/primary"},` +
+		`{"name":"azure","vendor":"azure_openai","model":"gpt-4o-mini","base_url":"https://example.openai.azure.com","health_url":"` + health.URL + `/secondary"},` +
+		`{"name":"local","vendor":"ollama","model":"llama3"}],` +
+		`"embedding":[{"name":"openai-embed","vendor":"openai","model":"text-embedding-3-small"}]}`
+	w := ts.do(http.MethodPut, "/v1/admin/providers", admin, chain)
+	if w.Code != http.StatusOK {
+		t.Fatalf("set chain: %d %s", w.Code, w.Body)
+	}
+	etag := w.Header().Get("ETag")
+	if w := ts.do(http.MethodPut, "/v1/admin/providers", admin, chain, "If-Match", `"stale"`); w.Code != http.StatusPreconditionFailed {
+		t.Fatalf("stale If-Match: got %d, want 412", w.Code)
+	}
+
+	// The primary's health check fails until its breaker opens
+	healthy = false
+	checkProviders(context.Background())
+	checkProviders(context.Background())
+	var routing QueryProviders
+	decodeJSON(t, ts.do(http.MethodGet, "/v1/internal/providers", "", "", internalTokenHeader, testInternalToken), &routing)
+	if len(routing.LLM) != 3 || routing.LLM[0].Name != "azure" || routing.LLM[1].Name != "local" ||
+		routing.LLM[2].Name != "openai" || routing.LLM[2].State != breakerOpen || routing.Version != 1 {
+		t.Fatalf("routing with the primary down: %+v", routing)
+	}
+
+	// Queries carry the routing to the backend
+	if _, err := askBackend(context.Background(), StreamQueryRequest{Question: "How much leave?"}); err != nil {
+		t.Fatal(err)
+	}
+	if sent.Providers == nil || sent.Providers.LLM[0].Name != "azure" || len(sent.Providers.Embedding) != 1 {
+		t.Fatalf("sent providers: %+v", sent.Providers)
+	}
+
+	// The backend's reports count too
+	report := `{"name":"azure","ok":false,"error":"status 429"}`
+	for i := 0; i < 2; i++ {
+		ts.do(http.MethodPost, "/v1/internal/providers/report", "", report, internalTokenHeader, testInternalToken)
+	}
+	var status ProviderStatus
+	decodeJSON(t, ts.do(http.MethodPost, "/v1/internal/providers/report", "", report, internalTokenHeader, testInternalToken), &status)
+	if status.State != breakerOpen || status.ConsecutiveFailures != 3 || status.LastError != "status 429" || status.RetryAt == nil {
+		t.Fatalf("reported status: %+v", status)
+	}
+	if w := ts.do(http.MethodPost, "/v1/internal/providers/report", "", `{"name":"gone","ok":true}`,
+		internalTokenHeader, testInternalToken); w.Code != http.StatusNotFound {
+		t.Fatalf("unknown provider: got %d, want 404", w.Code)
+	}
+
+	// Dropping a provider drops its breaker; the new version needs the
+	// current ETag
+	w = ts.do(http.MethodPut, "/v1/admin/providers", admin, `{"llm":[{"name":"local","vendor":"ollama","model":"llama3"}]}`, "If-Match", etag)
+	if w.Code != http.StatusOK {
+		t.Fatalf("replace chain: %d %s", w.Code, w.Body)
+	}
+	var view struct {
+		Chain  ProviderChainVersion `json:"chain"`
+		Status []ProviderStatus     `json:"status"`
+	}
+	decodeJSON(t, ts.do(http.MethodGet, "/v1/admin/providers", admin, ""), &view)
+	if view.Chain.Version != 2 || len(view.Status) != 1 || view.Status[0].State != breakerClosed {
+		t.Fatalf("after replacing: %+v", view)
+	}
+
+	// Restarting reloads the stored chain
+	providerMutex.Lock()
+	providerChain = ProviderChainVersion{}
+	providerMutex.Unlock()
+	if err := loadProviderChain(); err != nil {
+		t.Fatal(err)
+	}
+	if routing := providersFor(time.Now()); routing == nil || routing.Version != 2 || routing.LLM[0].Name != "local" {
+		t.Fatalf("after reload: %+v", routing)
+	}
+}
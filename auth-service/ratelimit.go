@@ -0,0 +1,324 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+// ============================================================================
+// Rate Limiting
+// ============================================================================
+//
+// Token buckets refill at a steady rate up to a burst size. Auth endpoints
+// (login, register) get a strict per-IP bucket; authenticated API calls get
+// a looser per-user bucket. Buckets live in memory by default, or in Redis
+// when several instances must share them. If Redis is unreachable requests
+// are allowed rather than locking everyone out. The same stores count the
+// daily query budgets of plans (plans.go).
+
+const rateLimitSweepInterval = 5 * time.Minute
+
+// rateLimitPolicy is one class of bucket
+type rateLimitPolicy struct {
+	name      string
+	perMinute int
+	burst     int
+}
+
+// rateDecision is the outcome of taking a token
+type rateDecision struct {
+	allowed    bool
+	remaining  int
+	retryAfter time.Duration // until the next token, when denied
+	resetAfter time.Duration // until the bucket is full again
+}
+
+// rateLimitStore takes one token from the bucket for key, or spends n from
+// a counter that starts again at resetAt; a spend that would go over limit
+// is refused and changes nothing
+type rateLimitStore interface {
+	take(ctx context.Context, policy rateLimitPolicy, key string) (rateDecision, error)
+	spend(ctx context.Context, key string, n, limit int, resetAt time.Time) (used int, allowed bool, err error)
+}
+
+var (
+	authRateLimit rateLimitPolicy
+	apiRateLimit  rateLimitPolicy
+	rateLimiter   rateLimitStore
+)
+
+// setupRateLimiting builds the policies and store from the configuration
+func setupRateLimiting() error {
+	cfg := config.RateLimit
+	authRateLimit = rateLimitPolicy{name: "auth", perMinute: cfg.AuthPerMinute, burst: cfg.AuthBurst}
+	apiRateLimit = rateLimitPolicy{name: "api", perMinute: cfg.APIPerMinute, burst: cfg.APIBurst}
+	if !cfg.Enabled {
+		return nil
+	}
+
+	switch cfg.Backend {
+	case "redis":
+		opts, err := redis.ParseURL(cfg.RedisURL)
+		if err != nil {
+			return fmt.Errorf("rate_limit.redis_url: %w", err)
+		}
+		rateLimiter = &redisRateLimitStore{client: redis.NewClient(opts)}
+	default:
+		store := &memoryRateLimitStore{buckets: make(map[string]*tokenBucket)}
+		goBackground(store.sweep)
+		rateLimiter = store
+	}
+	return nil
+}
+
+// allowRequest takes a token for key and sets the X-RateLimit-* headers.
+// When the bucket is empty it answers 429 with Retry-After and returns false.
+func allowRequest(c *gin.Context, policy rateLimitPolicy, key string) bool {
+	if rateLimiter == nil {
+		return true
+	}
+	decision, err := rateLimiter.take(c.Request.Context(), policy, policy.name+":"+key)
+	if err != nil {
+		slog.Warn("Rate limit check failed; allowing request", "policy", policy.name, "error", err)
+		return true
+	}
+
+	c.Header("X-RateLimit-Limit", strconv.Itoa(policy.burst))
+	c.Header("X-RateLimit-Remaining", strconv.Itoa(decision.remaining))
+	c.Header("X-RateLimit-Reset", strconv.Itoa(ceilSeconds(decision.resetAfter)))
+	if decision.allowed {
+		return true
+	}
+
+	debugLog("ratelimit", "Request rate limited", "policy", policy.name, "key", key, "retry_after", decision.retryAfter)
+	c.Header("Retry-After", strconv.Itoa(ceilSeconds(decision.retryAfter)))
+	respondError(c, http.StatusTooManyRequests, codeRateLimited, "Too many requests; retry later")
+	recordAbuse(c.ClientIP(), "rate-limited requests")
+	return false
+}
+
+// rateLimitByIP limits a route per client IP
+func rateLimitByIP(policy rateLimitPolicy) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !allowRequest(c, policy, "ip:"+c.ClientIP()) {
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// allowCall applies a policy outside an HTTP handler (gRPC calls,
+// WebSocket messages)
+func allowCall(ctx context.Context, policy rateLimitPolicy, key string) bool {
+	if rateLimiter == nil {
+		return true
+	}
+	decision, err := rateLimiter.take(ctx, policy, policy.name+":"+key)
+	if err != nil {
+		slog.Warn("Rate limit check failed; allowing request", "policy", policy.name, "error", err)
+		return true
+	}
+	return decision.allowed
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
+
+// refill computes a bucket's tokens after elapsed time has passed
+func (p rateLimitPolicy) refill(tokens float64, elapsed time.Duration) float64 {
+	tokens += elapsed.Minutes() * float64(p.perMinute)
+	return math.Min(tokens, float64(p.burst))
+}
+
+// decide builds the decision for a bucket holding tokens after a take
+func (p rateLimitPolicy) decide(allowed bool, tokens float64) rateDecision {
+	perToken := time.Duration(float64(time.Minute) / float64(p.perMinute))
+	decision := rateDecision{
+		allowed:    allowed,
+		remaining:  int(tokens),
+		resetAfter: time.Duration((float64(p.burst) - tokens) * float64(perToken)),
+	}
+	if !allowed {
+		decision.retryAfter = time.Duration((1 - tokens) * float64(perToken))
+	}
+	return decision
+}
+
+// ----------------------------------------------------------------------------
+// Memory store
+// ----------------------------------------------------------------------------
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+	full   time.Time // when the bucket will have refilled completely
+}
+
+// windowCounter is a count that starts again at resetAt
+type windowCounter struct {
+	used    int
+	resetAt time.Time
+}
+
+type memoryRateLimitStore struct {
+	mu       sync.Mutex
+	buckets  map[string]*tokenBucket
+	counters map[string]*windowCounter
+}
+
+func (s *memoryRateLimitStore) take(_ context.Context, policy rateLimitPolicy, key string) (rateDecision, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	bucket, exists := s.buckets[key]
+	if !exists {
+		bucket = &tokenBucket{tokens: float64(policy.burst), last: now}
+		s.buckets[key] = bucket
+	}
+	bucket.tokens = policy.refill(bucket.tokens, now.Sub(bucket.last))
+	bucket.last = now
+
+	allowed := bucket.tokens >= 1
+	if allowed {
+		bucket.tokens--
+	}
+	decision := policy.decide(allowed, bucket.tokens)
+	bucket.full = now.Add(decision.resetAfter)
+	return decision, nil
+}
+
+func (s *memoryRateLimitStore) spend(_ context.Context, key string, n, limit int, resetAt time.Time) (int, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	counter, exists := s.counters[key]
+	if !exists || !time.Now().Before(counter.resetAt) {
+		if s.counters == nil {
+			s.counters = make(map[string]*windowCounter)
+		}
+		counter = &windowCounter{resetAt: resetAt}
+		s.counters[key] = counter
+	}
+	if counter.used+n > limit {
+		return counter.used, false, nil
+	}
+	counter.used += n
+	return counter.used, true, nil
+}
+
+// sweep drops buckets that have refilled completely, since a new bucket
+// starts full anyway, and counters whose window has passed
+func (s *memoryRateLimitStore) sweep(ctx context.Context) {
+	ticker := time.NewTicker(rateLimitSweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		now := time.Now()
+		s.mu.Lock()
+		for key, bucket := range s.buckets {
+			if bucket.full.Before(now) {
+				delete(s.buckets, key)
+			}
+		}
+		for key, counter := range s.counters {
+			if !now.Before(counter.resetAt) {
+				delete(s.counters, key)
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+// ----------------------------------------------------------------------------
+// Redis store
+// ----------------------------------------------------------------------------
+
+// redisTokenBucket refills and takes from a bucket atomically. It returns
+// whether the take succeeded and the tokens left, as a string to keep the
+// fraction.
+var redisTokenBucket = redis.NewScript(`
+local burst = tonumber(ARGV[1])
+local per_ms = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local state = redis.call("HMGET", KEYS[1], "tokens", "last")
+local tokens = tonumber(state[1]) or burst
+local last = tonumber(state[2]) or now
+tokens = math.min(burst, tokens + math.max(0, now - last) * per_ms)
+local allowed = 0
+if tokens >= 1 then
+  tokens = tokens - 1
+  allowed = 1
+end
+redis.call("HSET", KEYS[1], "tokens", tostring(tokens), "last", now)
+redis.call("PEXPIRE", KEYS[1], math.ceil(burst / per_ms))
+return {allowed, tostring(tokens)}
+`)
+
+// redisWindowCounter spends from a counter atomically, expiring it at the
+// end of its window. It returns whether the spend succeeded and the count.
+var redisWindowCounter = redis.NewScript(`
+local n = tonumber(ARGV[1])
+local limit = tonumber(ARGV[2])
+local used = tonumber(redis.call("GET", KEYS[1])) or 0
+if used + n > limit then
+  return {0, used}
+end
+if n > 0 then
+  used = redis.call("INCRBY", KEYS[1], n)
+  redis.call("PEXPIREAT", KEYS[1], ARGV[3])
+end
+return {1, used}
+`)
+
+type redisRateLimitStore struct {
+	client *redis.Client
+}
+
+func (s *redisRateLimitStore) take(ctx context.Context, policy rateLimitPolicy, key string) (rateDecision, error) {
+	perMs := float64(policy.perMinute) / float64(time.Minute/time.Millisecond)
+	result, err := redisTokenBucket.Run(ctx, s.client, []string{"ratelimit:" + key},
+		policy.burst, perMs, time.Now().UnixMilli()).Slice()
+	if err != nil {
+		return rateDecision{}, err
+	}
+	if len(result) != 2 {
+		return rateDecision{}, fmt.Errorf("unexpected rate limit script result %v", result)
+	}
+	allowed, _ := result[0].(int64)
+	tokensRaw, _ := result[1].(string)
+	tokens, err := strconv.ParseFloat(tokensRaw, 64)
+	if err != nil {
+		return rateDecision{}, err
+	}
+	return policy.decide(allowed == 1, tokens), nil
+}
+
+func (s *redisRateLimitStore) spend(ctx context.Context, key string, n, limit int, resetAt time.Time) (int, bool, error) {
+	result, err := redisWindowCounter.Run(ctx, s.client, []string{"ratelimit:" + key}, n, limit, resetAt.UnixMilli()).Slice()
+	if err != nil {
+		return 0, false, err
+	}
+	if len(result) != 2 {
+		return 0, false, fmt.Errorf("unexpected quota script result %v", result)
+	}
+	allowed, _ := result[0].(int64)
+	used, _ := result[1].(int64)
+	return int(used), allowed == 1, nil
+}
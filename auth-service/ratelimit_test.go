@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+var testRateLimit = rateLimitPolicy{name: "test", perMinute: 60, burst: 3}
+
+// rateLimitStores returns one store of each backend
+func rateLimitStores(t *testing.T) map[string]rateLimitStore {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { client.Close() })
+	return map[string]rateLimitStore{
+		"memory": &memoryRateLimitStore{buckets: make(map[string]*tokenBucket)},
+		"redis":  &redisRateLimitStore{client: client},
+	}
+}
+
+// useRateLimiter installs a store for the duration of a test
+func useRateLimiter(t *testing.T, store rateLimitStore) {
+	t.Helper()
+	rateLimiter = store
+	t.Cleanup(func() { rateLimiter = nil })
+}
+
+func rateLimitedRouter() *gin.Engine {
+	r := gin.New()
+	r.GET("/v1/limited", rateLimitByIP(testRateLimit), func(c *gin.Context) { c.Status(http.StatusNoContent) })
+	return r
+}
+
+func getFrom(r http.Handler, ip string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, "/v1/limited", nil)
+	req.RemoteAddr = ip + ":1234"
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestRateLimitByIP(t *testing.T) {
+	for name, store := range rateLimitStores(t) {
+		t.Run(name, func(t *testing.T) {
+			useRateLimiter(t, store)
+			r := rateLimitedRouter()
+
+			for i := 0; i < testRateLimit.burst; i++ {
+				w := getFrom(r, "192.0.2.1")
+				if w.Code != http.StatusNoContent {
+					t.Fatalf("request %d: got %d, want 204", i+1, w.Code)
+				}
+				if got := w.Header().Get("X-RateLimit-Remaining"); got != strconv.Itoa(testRateLimit.burst-i-1) {
+					t.Fatalf("request %d: remaining %s", i+1, got)
+				}
+				if got := w.Header().Get("X-RateLimit-Limit"); got != "3" {
+					t.Fatalf("limit header %s, want 3", got)
+				}
+			}
+
+			w := getFrom(r, "192.0.2.1")
+			if w.Code != http.StatusTooManyRequests {
+				t.Fatalf("over the burst: got %d, want 429", w.Code)
+			}
+			// One token a second
+			if got := w.Header().Get("Retry-After"); got != "1" {
+				t.Fatalf("Retry-After = %q, want 1", got)
+			}
+
+			// Other clients have their own bucket
+			if w := getFrom(r, "192.0.2.2"); w.Code != http.StatusNoContent {
+				t.Fatalf("second client: got %d, want 204", w.Code)
+			}
+		})
+	}
+}
+
+func TestRateLimitRefills(t *testing.T) {
+	for name, store := range rateLimitStores(t) {
+		t.Run(name, func(t *testing.T) {
+			policy := rateLimitPolicy{name: "fast", perMinute: 60 * 50, burst: 1} // a token every 20ms
+			ctx := context.Background()
+
+			if d, _ := store.take(ctx, policy, "k"); !d.allowed {
+				t.Fatal("first take denied")
+			}
+			if d, _ := store.take(ctx, policy, "k"); d.allowed {
+				t.Fatal("empty bucket allowed a take")
+			}
+			time.Sleep(30 * time.Millisecond)
+			if d, _ := store.take(ctx, policy, "k"); !d.allowed {
+				t.Fatal("bucket did not refill")
+			}
+		})
+	}
+}
+
+func TestRateLimitFailsOpen(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer client.Close()
+	mr.Close()
+	useRateLimiter(t, &redisRateLimitStore{client: client})
+
+	if w := getFrom(rateLimitedRouter(), "192.0.2.1"); w.Code != http.StatusNoContent {
+		t.Fatalf("with Redis down: got %d, want 204", w.Code)
+	}
+	if !allowCall(context.Background(), testRateLimit, "user:u1") {
+		t.Fatal("allowCall denied with Redis down")
+	}
+}
+
+func TestAllowCall(t *testing.T) {
+	if !allowCall(context.Background(), testRateLimit, "user:u1") {
+		t.Fatal("denied with rate limiting disabled")
+	}
+
+	useRateLimiter(t, &memoryRateLimitStore{buckets: make(map[string]*tokenBucket)})
+	for i := 0; i < testRateLimit.burst; i++ {
+		if !allowCall(context.Background(), testRateLimit, "user:u1") {
+			t.Fatalf("call %d denied", i+1)
+		}
+	}
+	if allowCall(context.Background(), testRateLimit, "user:u1") {
+		t.Fatal("call over the burst allowed")
+	}
+}
+
+func TestRateDecision(t *testing.T) {
+	d := testRateLimit.decide(false, 0.25)
+	if d.retryAfter != 750*time.Millisecond {
+		t.Fatalf("retryAfter = %v, want 750ms", d.retryAfter)
+	}
+	if d.resetAfter != 2750*time.Millisecond {
+		t.Fatalf("resetAfter = %v, want 2.75s", d.resetAfter)
+	}
+	if got := testRateLimit.refill(0, time.Hour); got != float64(testRateLimit.burst) {
+		t.Fatalf("refill capped at %v, want %d", got, testRateLimit.burst)
+	}
+}
+
+func TestRateLimitSpend(t *testing.T) {
+	for name, store := range rateLimitStores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			resetAt := time.Now().Add(time.Hour)
+			for i := 1; i <= 3; i++ {
+				if used, allowed, err := store.spend(ctx, "quota:u1", 1, 3, resetAt); err != nil || !allowed || used != i {
+					t.Fatalf("spend %d: used %d allowed %v err %v", i, used, allowed, err)
+				}
+			}
+			if used, allowed, _ := store.spend(ctx, "quota:u1", 1, 3, resetAt); allowed || used != 3 {
+				t.Fatalf("spend over the limit: used %d allowed %v", used, allowed)
+			}
+			if used, allowed, _ := store.spend(ctx, "quota:u1", 0, 3, resetAt); !allowed || used != 3 {
+				t.Fatalf("peek: used %d allowed %v", used, allowed)
+			}
+			if used, _, _ := store.spend(ctx, "quota:u2", 0, 3, resetAt); used != 0 {
+				t.Fatalf("another key starts at %d", used)
+			}
+		})
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ============================================================================
+// Referral Codes
+// ============================================================================
+//
+// Every user can have a referral code, made the first time they ask for it
+// at GET /users/me/referral. Registration accepts an optional
+// referral_code; the new account records who referred it, and a code that
+// doesn't exist is refused rather than dropped so a typo gets fixed. Users
+// see how many signups their code produced, and admins see every code's
+// count at GET /admin/referrals. Codes are eight characters from an
+// alphabet without look-alikes (0/O, 1/I), so they survive being read out.
+
+const (
+	referralCodeLength   = 8
+	referralCodeAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+)
+
+var errInvalidReferralCode = errors.New("Referral code is not valid")
+
+// ReferralSummary is one referral code and what it produced
+type ReferralSummary struct {
+	Code         string     `json:"code"`
+	UserID       string     `json:"user_id,omitempty"`
+	Email        string     `json:"email,omitempty"`
+	Signups      int        `json:"signups"`
+	Active       int        `json:"active"` // signups that can sign in today
+	LastSignupAt *time.Time `json:"last_signup_at,omitempty"`
+}
+
+// normalizeReferralCode uppercases a code as typed and drops spaces and
+// dashes
+func normalizeReferralCode(code string) string {
+	return strings.Map(func(r rune) rune {
+		if r == ' ' || r == '-' {
+			return -1
+		}
+		return r
+	}, strings.ToUpper(strings.TrimSpace(code)))
+}
+
+func newReferralCode() (string, error) {
+	raw := make([]byte, referralCodeLength)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	code := make([]byte, referralCodeLength)
+	for i, b := range raw {
+		code[i] = referralCodeAlphabet[int(b)%len(referralCodeAlphabet)]
+	}
+	return string(code), nil
+}
+
+// referrer returns the user a code belongs to
+func (s *Service) referrer(code string) *User {
+	code = normalizeReferralCode(code)
+	if code == "" {
+		return nil
+	}
+	var owner *User
+	s.users.Each(func(user *User) {
+		if user.ReferralCode == code {
+			owner = user
+		}
+	})
+	return owner
+}
+
+// ReferralCode returns a user's code, making one the first time
+func (s *Service) ReferralCode(user *User) (string, error) {
+	lock := s.users.FieldLock(user)
+	lock.RLock()
+	code := user.ReferralCode
+	lock.RUnlock()
+	if code != "" {
+		return code, nil
+	}
+
+	for {
+		var err error
+		if code, err = newReferralCode(); err != nil {
+			return "", err
+		}
+		// With 32^8 codes a clash is rare, but cheap to rule out
+		if s.referrer(code) == nil {
+			break
+		}
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	if user.ReferralCode != "" {
+		return user.ReferralCode, nil // made by a concurrent request
+	}
+	previous := *user
+	user.ReferralCode, user.UpdatedAt = code, time.Now()
+	if err := saveUser(user); err != nil {
+		*user = previous
+		return "", err
+	}
+	bumpUserVersion()
+	return code, nil
+}
+
+// referralSummaries counts the signups of every code, or only referrerID's
+func (s *Service) referralSummaries(referrerID string) []ReferralSummary {
+	byReferrer := make(map[string]*ReferralSummary)
+	s.users.Each(func(user *User) {
+		if user.ReferralCode != "" && (referrerID == "" || user.ID == referrerID) {
+			summary := byReferrer[user.ID]
+			if summary == nil {
+				summary = &ReferralSummary{}
+				byReferrer[user.ID] = summary
+			}
+			summary.Code, summary.UserID, summary.Email = user.ReferralCode, user.ID, user.Email
+		}
+	})
+	s.users.Each(func(user *User) {
+		summary := byReferrer[user.ReferredBy]
+		if user.ReferredBy == "" || summary == nil {
+			return
+		}
+		summary.Signups++
+		if accountStatus(user) == UserActive {
+			summary.Active++
+		}
+		if created := user.CreatedAt; summary.LastSignupAt == nil || created.After(*summary.LastSignupAt) {
+			summary.LastSignupAt = &created
+		}
+	})
+
+	summaries := make([]ReferralSummary, 0, len(byReferrer))
+	for _, summary := range byReferrer {
+		summaries = append(summaries, *summary)
+	}
+	sort.Slice(summaries, func(i, j int) bool {
+		if summaries[i].Signups != summaries[j].Signups {
+			return summaries[i].Signups > summaries[j].Signups
+		}
+		return summaries[i].Code < summaries[j].Code
+	})
+	return summaries
+}
+
+// ----------------------------------------------------------------------------
+// Handlers
+// ----------------------------------------------------------------------------
+
+// getMyReferral returns the caller's referral code and its signups
+func (s *Server) getMyReferral(c *gin.Context) {
+	user, _ := c.Get("user")
+	currentUser := user.(*User)
+	code, err := s.svc.ReferralCode(currentUser)
+	if err != nil {
+		respondServiceError(c, err)
+		return
+	}
+	summary := ReferralSummary{Code: code}
+	if summaries := s.svc.referralSummaries(currentUser.ID); len(summaries) == 1 {
+		summary = summaries[0]
+	}
+	summary.UserID, summary.Email = "", ""
+	c.JSON(http.StatusOK, summary)
+}
+
+// listReferrals returns every referral code by signups, most first (admin)
+func (s *Server) listReferrals(c *gin.Context) {
+	summaries := s.svc.referralSummaries("")
+	signups := 0
+	for _, summary := range summaries {
+		signups += summary.Signups
+	}
+	c.JSON(http.StatusOK, gin.H{"referrals": summaries, "count": len(summaries), "signups": signups})
+}
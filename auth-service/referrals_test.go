@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestReferralCodes(t *testing.T) {
+	ts := newTestServer(t)
+	admin := ts.admin("admin@example.com")
+	token, referrerID := ts.register("ambassador@example.com")
+
+	w := ts.do(http.MethodGet, "/v1/users/me/referral", token, "")
+	var mine ReferralSummary
+	decodeJSON(t, w, &mine)
+	if w.Code != http.StatusOK || len(mine.Code) != referralCodeLength || mine.Signups != 0 {
+		t.Fatalf("my referral: %d %+v", w.Code, mine)
+	}
+	w = ts.do(http.MethodGet, "/v1/users/me/referral", token, "")
+	var again ReferralSummary
+	decodeJSON(t, w, &again)
+	if again.Code != mine.Code {
+		t.Fatalf("code changed from %s to %s", mine.Code, again.Code)
+	}
+
+	// Codes are matched however they are typed
+	typed := strings.ToLower(mine.Code[:4]) + "-" + mine.Code[4:]
+	w = ts.do(http.MethodPost, "/v1/auth/register", "", `{"email":"friend@example.com","password":"secret123","name":"Friend","referral_code":"`+typed+`"}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("register with code: %d %s", w.Code, w.Body)
+	}
+	if friend := ts.srv.svc.users.ByEmail("friend@example.com"); friend.ReferredBy != referrerID {
+		t.Fatalf("referred_by = %q", friend.ReferredBy)
+	}
+	w = ts.do(http.MethodPost, "/v1/auth/register", "", `{"email":"typo@example.com","password":"secret123","name":"Typo","referral_code":"NOPE2345"}`)
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), codeInvalidReferralCode) {
+		t.Fatalf("unknown code: %d %s", w.Code, w.Body)
+	}
+
+	w = ts.do(http.MethodGet, "/v1/users/me/referral", token, "")
+	decodeJSON(t, w, &mine)
+	if mine.Signups != 1 || mine.Active != 1 || mine.LastSignupAt == nil || mine.Email != "" {
+		t.Fatalf("after a signup: %+v", mine)
+	}
+
+	if w := ts.do(http.MethodGet, "/v1/admin/referrals", token, ""); w.Code != http.StatusForbidden {
+		t.Fatalf("list as user: got %d, want 403", w.Code)
+	}
+	w = ts.do(http.MethodGet, "/v1/admin/referrals", admin, "")
+	var list struct {
+		Referrals []ReferralSummary `json:"referrals"`
+		Signups   int               `json:"signups"`
+	}
+	decodeJSON(t, w, &list)
+	if len(list.Referrals) != 1 || list.Referrals[0].Email != "ambassador@example.com" || list.Signups != 1 {
+		t.Fatalf("admin list = %+v", list)
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ============================================================================
+// Registration Settings
+// ============================================================================
+//
+// registration.mode decides who may self-register: anyone ("open"),
+// anyone subject to an admin's approval ("approval", see approvals.go) or
+// no one ("closed"). A non-empty registration.allowed_domains further
+// limits signups to those email domains, matched exactly, so "us.inc"
+// doesn't admit "eu.us.inc". Admins change both at /admin/registration
+// without a restart; accounts they create themselves aren't affected. The
+// override lasts until DELETE; in cluster mode it lives in the shared store
+// and applies to every replica, otherwise it also ends with a restart.
+
+// Registration modes
+const (
+	registrationOpen     = "open"
+	registrationApproval = "approval"
+	registrationClosed   = "closed"
+)
+
+// registrationSetting names the override in the shared store; null means
+// the configured settings apply
+const registrationSetting = "registration"
+
+var (
+	errRegistrationClosed    = errors.New("Registration is closed")
+	errEmailDomainNotAllowed = errors.New("Registration is not open to this email domain")
+)
+
+// RegistrationSettings are the registration rules in force
+type RegistrationSettings struct {
+	Mode           string   `json:"mode"`
+	AllowedDomains []string `json:"allowed_domains"` // empty allows any
+	Overridden     bool     `json:"overridden"`      // changed at runtime rather than from the configuration
+}
+
+// RegistrationRequest for PUT /admin/registration; omitted fields stay as
+// they are
+type RegistrationRequest struct {
+	Mode           *string   `json:"mode,omitempty" binding:"omitempty,oneof=open approval closed"`
+	AllowedDomains *[]string `json:"allowed_domains,omitempty"` // [] allows any
+}
+
+var (
+	registrationOverride *RegistrationSettings
+	registrationMu       sync.RWMutex
+)
+
+// currentRegistration returns the runtime settings, or the configured ones
+func currentRegistration() RegistrationSettings {
+	registrationMu.RLock()
+	defer registrationMu.RUnlock()
+	if registrationOverride != nil {
+		return *registrationOverride
+	}
+	domains := make([]string, 0, len(config.Registration.AllowedDomains))
+	for _, domain := range config.Registration.AllowedDomains {
+		domains = append(domains, normalizeEmailDomain(domain))
+	}
+	return RegistrationSettings{Mode: config.Registration.Mode, AllowedDomains: domains}
+}
+
+// checkRegistration refuses a self-registration the settings don't allow
+func checkRegistration(settings RegistrationSettings, email string) error {
+	if settings.Mode == registrationClosed {
+		return errRegistrationClosed
+	}
+	if len(settings.AllowedDomains) == 0 {
+		return nil
+	}
+	domain := normalizeEmailDomain(email[strings.LastIndex(email, "@")+1:])
+	for _, allowed := range settings.AllowedDomains {
+		if domain == allowed {
+			return nil
+		}
+	}
+	return errEmailDomainNotAllowed
+}
+
+// normalizeEmailDomain lower-cases a domain and drops a leading "@", so
+// "@US.inc" and "us.inc" are the same entry
+func normalizeEmailDomain(domain string) string {
+	return strings.ToLower(strings.TrimPrefix(strings.TrimSpace(domain), "@"))
+}
+
+// validEmailDomain reports whether an allowlist entry looks like a domain
+func validEmailDomain(domain string) bool {
+	domain = normalizeEmailDomain(domain)
+	return domain != "" && !strings.ContainsAny(domain, "@/ \t") &&
+		!strings.HasPrefix(domain, ".") && !strings.HasSuffix(domain, ".")
+}
+
+// overrideRegistration replaces the runtime settings, on every replica when
+// clustered; nil restores the configured ones
+func overrideRegistration(settings *RegistrationSettings) error {
+	if clustered() {
+		data, err := json.Marshal(settings)
+		if err != nil {
+			return err
+		}
+		if err := saveSharedSetting(registrationSetting, data); err != nil {
+			return err
+		}
+	}
+	registrationMu.Lock()
+	registrationOverride = settings
+	registrationMu.Unlock()
+	return nil
+}
+
+// applyRegistrationSetting follows an override made through another replica
+func applyRegistrationSetting(data []byte) error {
+	var settings *RegistrationSettings
+	if err := json.Unmarshal(data, &settings); err != nil {
+		return err
+	}
+	registrationMu.Lock()
+	registrationOverride = settings
+	registrationMu.Unlock()
+	return nil
+}
+
+// getRegistration reports the registration settings (admin only)
+func getRegistration(c *gin.Context) {
+	c.JSON(http.StatusOK, currentRegistration())
+}
+
+// setRegistration changes the registration settings (admin only)
+func setRegistration(c *gin.Context) {
+	var req RegistrationRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondBindError(c, err)
+		return
+	}
+	before := currentRegistration()
+	after := before
+	if req.Mode != nil {
+		after.Mode = *req.Mode
+	}
+	if req.AllowedDomains != nil {
+		after.AllowedDomains = make([]string, 0, len(*req.AllowedDomains))
+		for _, domain := range *req.AllowedDomains {
+			if !validEmailDomain(domain) {
+				respondError(c, http.StatusBadRequest, codeInvalidRequest, "allowed_domains: "+domain+" is not a domain")
+				return
+			}
+			after.AllowedDomains = append(after.AllowedDomains, normalizeEmailDomain(domain))
+		}
+	}
+	after.Overridden = true
+	if err := overrideRegistration(&after); err != nil {
+		respondServiceError(c, err)
+		return
+	}
+
+	auditChange(c, "registration.update", "registration", before, after)
+	c.JSON(http.StatusOK, after)
+}
+
+// resetRegistration drops the runtime settings for the configured ones
+// (admin only)
+func resetRegistration(c *gin.Context) {
+	before := currentRegistration()
+	if err := overrideRegistration(nil); err != nil {
+		respondServiceError(c, err)
+		return
+	}
+	after := currentRegistration()
+
+	auditChange(c, "registration.reset", "registration", before, after)
+	c.JSON(http.StatusOK, after)
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestCheckRegistration(t *testing.T) {
+	allowlist := RegistrationSettings{Mode: registrationOpen, AllowedDomains: []string{"us.inc"}}
+	for _, tc := range []struct {
+		settings RegistrationSettings
+		email    string
+		want     error
+	}{
+		{RegistrationSettings{Mode: registrationOpen}, "a@example.com", nil},
+		{RegistrationSettings{Mode: registrationClosed}, "a@example.com", errRegistrationClosed},
+		{allowlist, "a@us.inc", nil},
+		{allowlist, "a@US.Inc", nil},
+		{allowlist, "a@eu.us.inc", errEmailDomainNotAllowed},
+		{allowlist, "a@us.inc.evil.com", errEmailDomainNotAllowed},
+		{allowlist, `"a@us.inc"@evil.com`, errEmailDomainNotAllowed},
+	} {
+		if got := checkRegistration(tc.settings, tc.email); got != tc.want {
+			t.Errorf("%+v, %s: got %v, want %v", tc.settings, tc.email, got, tc.want)
+		}
+	}
+
+	for domain, want := range map[string]bool{"us.inc": true, "@us.inc": true, "": false, "a@us.inc": false, ".inc": false, "us inc": false} {
+		if got := validEmailDomain(domain); got != want {
+			t.Errorf("validEmailDomain(%q) = %v", domain, got)
+		}
+	}
+}
+
+func TestRegistrationSettings(t *testing.T) {
+	ts := newTestServer(t)
+	admin := ts.admin("admin@example.com")
+	user, _ := ts.register("user@example.com")
+	withConfig(t, func(cfg *Config) { cfg.Registration.AllowedDomains = []string{"@Example.com"} })
+	t.Cleanup(func() { registrationOverride = nil })
+
+	w := ts.do(http.MethodPost, "/v1/auth/register", "", `{"email":"a@other.com","password":"secret123","name":"Test User"}`)
+	if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), codeEmailDomainNotAllowed) {
+		t.Fatalf("disallowed domain: %d %s", w.Code, w.Body)
+	}
+	ts.register("b@example.com")
+
+	if w := ts.do(http.MethodPut, "/v1/admin/registration", user, `{"mode":"closed"}`); w.Code != http.StatusForbidden {
+		t.Fatalf("change as user: got %d, want 403", w.Code)
+	}
+	if w := ts.do(http.MethodPut, "/v1/admin/registration", admin, `{"allowed_domains":["not a domain"]}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("bad domain: got %d, want 400", w.Code)
+	}
+	w = ts.do(http.MethodPut, "/v1/admin/registration", admin, `{"mode":"closed"}`)
+	var settings RegistrationSettings
+	decodeJSON(t, w, &settings)
+	if settings.Mode != registrationClosed || len(settings.AllowedDomains) != 1 || settings.AllowedDomains[0] != "example.com" || !settings.Overridden {
+		t.Fatalf("settings = %+v", settings)
+	}
+	w = ts.do(http.MethodPost, "/v1/auth/register", "", `{"email":"c@example.com","password":"secret123","name":"Test User"}`)
+	if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), codeRegistrationClosed) {
+		t.Fatalf("closed registration: %d %s", w.Code, w.Body)
+	}
+	// Admins still create accounts
+	if w := ts.do(http.MethodPost, "/v1/admin/users", admin, `{"email":"d@other.com","name":"New User"}`); w.Code != http.StatusCreated {
+		t.Fatalf("admin create while closed: %d %s", w.Code, w.Body)
+	}
+
+	ts.do(http.MethodPut, "/v1/admin/registration", admin, `{"mode":"open","allowed_domains":[]}`)
+	ts.register("e@other.com")
+
+	decodeJSON(t, ts.do(http.MethodDelete, "/v1/admin/registration", admin, ""), &settings)
+	if settings.Overridden || settings.Mode != registrationOpen || len(settings.AllowedDomains) != 1 {
+		t.Fatalf("reset settings = %+v", settings)
+	}
+}
+
+func TestRegistrationReachesReplicas(t *testing.T) {
+	ts := newTestServer(t)
+	admin := ts.admin("admin@example.com")
+	useSharedStore(t)
+	t.Cleanup(func() { registrationOverride = nil })
+
+	if w := ts.do(http.MethodPut, "/v1/admin/registration", admin, `{"mode":"closed"}`); w.Code != http.StatusOK {
+		t.Fatalf("close: %d %s", w.Code, w.Body)
+	}
+	// A replica that missed the change feed closes on resync
+	registrationOverride = nil
+	if err := resyncShared(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if settings := currentRegistration(); settings.Mode != registrationClosed || !settings.Overridden {
+		t.Fatalf("after resync: %+v", settings)
+	}
+
+	// and drops the override when an admin resets it elsewhere
+	if w := ts.do(http.MethodDelete, "/v1/admin/registration", admin, ""); w.Code != http.StatusOK {
+		t.Fatalf("reset: %d %s", w.Code, w.Body)
+	}
+	registrationOverride = &RegistrationSettings{Mode: registrationClosed, Overridden: true}
+	if err := refreshRecord(context.Background(), clusterChange{Kind: "setting", ID: registrationSetting}); err != nil {
+		t.Fatal(err)
+	}
+	if settings := currentRegistration(); settings.Overridden || settings.Mode != config.Registration.Mode {
+		t.Fatalf("after reset message: %+v", settings)
+	}
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// ============================================================================
+// Reindex Campaigns
+// ============================================================================
+
+// CampaignStatus is the lifecycle state of a reindex campaign
+type CampaignStatus string
+
+const (
+	CampaignScheduled CampaignStatus = "scheduled"
+	CampaignRunning   CampaignStatus = "running"
+	CampaignPaused    CampaignStatus = "paused"
+	CampaignCompleted CampaignStatus = "completed"
+	CampaignCancelled CampaignStatus = "cancelled"
+)
+
+// ReindexFailure records a document that could not be reindexed
+type ReindexFailure struct {
+	Filename string `json:"filename"`
+	Error    string `json:"error"`
+}
+
+// ReindexCampaign re-chunks and re-embeds every registered document using
+// the backend's current model configuration
+type ReindexCampaign struct {
+	ID             string           `json:"id"`
+	Status         CampaignStatus   `json:"status"`
+	EmbeddingModel string           `json:"embedding_model,omitempty"` // label for the target configuration
+	StaleChunking  bool             `json:"stale_chunking,omitempty"`  // only documents whose chunking settings changed
+	CreatedBy      string           `json:"created_by"`
+	RunAt          time.Time        `json:"run_at"`
+	Total          int              `json:"total"`
+	Processed      int              `json:"processed"`
+	Failed         int              `json:"failed"`
+	Failures       []ReindexFailure `json:"failures,omitempty"`
+	CreatedAt      time.Time        `json:"created_at"`
+	StartedAt      *time.Time       `json:"started_at,omitempty"`
+	CompletedAt    *time.Time       `json:"completed_at,omitempty"`
+
+	documents []string
+	wake      chan struct{} // closed to release a paused or scheduled campaign
+	cancel    context.CancelFunc
+}
+
+// StartReindexRequest for starting or scheduling a campaign
+type StartReindexRequest struct {
+	EmbeddingModel string     `json:"embedding_model,omitempty"`
+	RunAt          *time.Time `json:"run_at,omitempty"`         // omit to start immediately
+	StaleChunking  bool       `json:"stale_chunking,omitempty"` // re-chunk only documents whose settings changed (chunking.go)
+}
+
+const (
+	reindexLock      = "reindex"
+	reindexLockRetry = 5 * time.Second
+)
+
+var (
+	campaigns     = make(map[string]*ReindexCampaign) // id -> campaign
+	campaignMutex sync.Mutex
+)
+
+// activeCampaign returns the campaign that is scheduled, running, or paused.
+// Callers must hold campaignMutex.
+func activeCampaign() *ReindexCampaign {
+	for _, campaign := range campaigns {
+		switch campaign.Status {
+		case CampaignScheduled, CampaignRunning, CampaignPaused:
+			return campaign
+		}
+	}
+	return nil
+}
+
+// Reindex fetches the original file from the backend and uploads it again
+// so it is processed from scratch, with the document's current chunking
+// settings. The backend replaces a file's chunks once the new upload is
+// processed, so nothing is deleted first: an interrupted reindex leaves the
+// document as it was.
+func (s *Service) Reindex(ctx context.Context, filename string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet,
+		ragBackendURL()+"/file?name="+url.QueryEscape(filename), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := backendClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("fetch original: %w", err)
+	}
+	content, err := io.ReadAll(io.LimitReader(resp.Body, maxUploadSize+1))
+	resp.Body.Close()
+	if err != nil {
+		return fmt.Errorf("fetch original: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("fetch original returned %s", resp.Status)
+	}
+	if len(content) > maxUploadSize {
+		return fmt.Errorf("original exceeds the 10MB upload limit")
+	}
+
+	chunking := s.ChunkingFor(filename)
+	if err := uploadToBackend(ctx, filename, bytes.NewReader(content), chunking); err != nil {
+		return err
+	}
+	s.MarkChunked(filename, chunking)
+	return nil
+}
+
+func reindexDocument(ctx context.Context, filename string) error {
+	return defaultService.Reindex(ctx, filename)
+}
+
+// runCampaign walks the campaign's documents, honoring pause and cancel.
+// Only one campaign reindexes at a time across replicas; the lock is given
+// up while paused so a paused campaign does not hold up others.
+func runCampaign(ctx context.Context, campaign *ReindexCampaign) {
+	var release func()
+	defer func() {
+		if release != nil {
+			release()
+		}
+	}()
+
+	for {
+		campaignMutex.Lock()
+		waiting := campaign.Status == CampaignScheduled || campaign.Status == CampaignPaused
+		campaignMutex.Unlock()
+		if waiting && release != nil {
+			release()
+			release = nil
+		}
+
+		campaignMutex.Lock()
+		// Block while scheduled or paused; wake is replaced on each pause
+		for campaign.Status == CampaignScheduled || campaign.Status == CampaignPaused {
+			wake := campaign.wake
+			campaignMutex.Unlock()
+			select {
+			case <-wake:
+			case <-ctx.Done():
+			}
+			campaignMutex.Lock()
+		}
+
+		if campaign.Status != CampaignRunning {
+			campaignMutex.Unlock()
+			return
+		}
+		if release == nil {
+			campaignMutex.Unlock()
+			var err error
+			if release, err = acquireLock(ctx, reindexLock, config.Cluster.LockTTL); err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				slog.Warn("Reindex lock unavailable; retrying", "campaign_id", campaign.ID, "error", err)
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(reindexLockRetry):
+				}
+			}
+			// Re-check the status, which may have changed while waiting
+			continue
+		}
+		if campaign.StartedAt == nil {
+			now := time.Now()
+			campaign.StartedAt = &now
+		}
+
+		next := campaign.Processed + campaign.Failed
+		if next >= len(campaign.documents) {
+			now := time.Now()
+			campaign.Status = CampaignCompleted
+			campaign.CompletedAt = &now
+			campaign.cancel()
+			campaignMutex.Unlock()
+			slog.Info("Reindex completed", "campaign_id", campaign.ID, "processed", campaign.Processed, "failed", campaign.Failed)
+			return
+		}
+		filename := campaign.documents[next]
+		campaignMutex.Unlock()
+
+		var err error
+		if !campaign.StaleChunking || defaultService.ChunkingStale(filename) {
+			err = reindexDocument(ctx, filename)
+		}
+
+		campaignMutex.Lock()
+		if ctx.Err() != nil {
+			// Cancelled mid-document; leave counters as they were
+			campaignMutex.Unlock()
+			return
+		}
+		if err != nil {
+			campaign.Failed++
+			campaign.Failures = append(campaign.Failures, ReindexFailure{Filename: filename, Error: err.Error()})
+			slog.Warn("Reindex failed for document", "campaign_id", campaign.ID, "file", filename, "error", err)
+		} else {
+			campaign.Processed++
+		}
+		campaignMutex.Unlock()
+	}
+}
+
+// startReindex creates a campaign over all registered documents (admin only)
+func startReindex(c *gin.Context) {
+	var req StartReindexRequest
+	if err := c.ShouldBindJSON(&req); err != nil && err != io.EOF {
+		respondBindError(c, err)
+		return
+	}
+
+	user, _ := c.Get("user")
+	currentUser := user.(*User)
+
+	campaignMutex.Lock()
+	defer campaignMutex.Unlock()
+
+	if active := activeCampaign(); active != nil {
+		respondProblem(c, Problem{
+			Status:     http.StatusConflict,
+			Code:       codeConflict,
+			Detail:     "A reindex campaign is already active",
+			Extensions: map[string]interface{}{"campaign_id": active.ID},
+		})
+		return
+	}
+
+	var filenames []string
+	if req.StaleChunking {
+		filenames = defaultService.StaleChunking()
+	} else {
+		localDocuments.View(func(tx DocumentTx) {
+			filenames = make([]string, 0, tx.len())
+			tx.each(func(filename string, _ documentRecord) {
+				filenames = append(filenames, filename)
+			})
+		})
+		sort.Strings(filenames)
+	}
+
+	c.JSON(http.StatusAccepted, launchCampaign(req, currentUser.ID, filenames))
+}
+
+// launchCampaign creates a campaign over filenames and starts its runner.
+// Callers must hold campaignMutex and have checked no campaign is active.
+func launchCampaign(req StartReindexRequest, createdBy string, filenames []string) *ReindexCampaign {
+	now := time.Now()
+	// Shutdown cancels the campaign mid-document; reindexing never deletes
+	// before uploading, so the document is left as it was
+	ctx, cancel := context.WithCancel(backgroundCtx)
+	campaign := &ReindexCampaign{
+		ID:             uuid.New().String(),
+		Status:         CampaignRunning,
+		EmbeddingModel: req.EmbeddingModel,
+		StaleChunking:  req.StaleChunking,
+		CreatedBy:      createdBy,
+		RunAt:          now,
+		Total:          len(filenames),
+		CreatedAt:      now,
+		documents:      filenames,
+		wake:           make(chan struct{}),
+		cancel:         cancel,
+	}
+
+	if req.RunAt != nil && req.RunAt.After(now) {
+		campaign.Status = CampaignScheduled
+		campaign.RunAt = *req.RunAt
+		time.AfterFunc(time.Until(*req.RunAt), func() {
+			campaignMutex.Lock()
+			defer campaignMutex.Unlock()
+			if campaign.Status == CampaignScheduled {
+				campaign.Status = CampaignRunning
+				close(campaign.wake)
+			}
+		})
+	}
+
+	campaigns[campaign.ID] = campaign
+	goBackground(func(context.Context) { runCampaign(ctx, campaign) })
+	return campaign
+}
+
+// listReindexCampaigns returns all campaigns, newest first (admin only)
+func listReindexCampaigns(c *gin.Context) {
+	campaignMutex.Lock()
+	list := make([]ReindexCampaign, 0, len(campaigns))
+	for _, campaign := range campaigns {
+		list = append(list, *campaign)
+	}
+	campaignMutex.Unlock()
+
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.After(list[j].CreatedAt) })
+
+	c.JSON(http.StatusOK, gin.H{
+		"campaigns": list,
+		"total":     len(list),
+	})
+}
+
+// getReindexCampaign returns a campaign's progress (admin only)
+func getReindexCampaign(c *gin.Context) {
+	campaignMutex.Lock()
+	campaign, exists := campaigns[c.Param("id")]
+	var snapshot ReindexCampaign
+	if exists {
+		snapshot = *campaign
+	}
+	campaignMutex.Unlock()
+
+	if !exists {
+		respondError(c, http.StatusNotFound, codeNotFound, "Campaign not found")
+		return
+	}
+
+	c.JSON(http.StatusOK, snapshot)
+}
+
+// updateReindexCampaign pauses, resumes, or cancels a campaign (admin only)
+func updateReindexCampaign(action string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		campaignMutex.Lock()
+		defer campaignMutex.Unlock()
+
+		campaign, exists := campaigns[c.Param("id")]
+		if !exists {
+			respondError(c, http.StatusNotFound, codeNotFound, "Campaign not found")
+			return
+		}
+
+		switch {
+		case action == "pause" && campaign.Status == CampaignRunning:
+			campaign.Status = CampaignPaused
+			campaign.wake = make(chan struct{})
+		case action == "resume" && campaign.Status == CampaignPaused:
+			campaign.Status = CampaignRunning
+			close(campaign.wake)
+		case action == "cancel" && activeCampaign() == campaign:
+			campaign.Status = CampaignCancelled
+			now := time.Now()
+			campaign.CompletedAt = &now
+			campaign.cancel()
+		default:
+			respondError(c, http.StatusConflict, codeConflict, fmt.Sprintf("Cannot %s a %s campaign", action, campaign.Status))
+			return
+		}
+
+		c.JSON(http.StatusOK, campaign)
+	}
+}
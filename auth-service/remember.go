@@ -0,0 +1,260 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// ============================================================================
+// Remembered Sessions
+// ============================================================================
+//
+// A sign-in lasts session.lifetime. With "remember_me": true it also
+// returns a refresh token bound to the device (devices.go), which
+// POST /auth/refresh trades for a new access token and a new refresh
+// token. Each refresh keeps the session for another
+// session.remember_lifetime, but never past session.absolute_lifetime
+// after the password was last entered; from then on the client gets
+// reauthentication_required and must sign in again.
+//
+// Only the refresh token's hash is kept, on the device record. Tokens
+// rotate: presenting an old one ends the remembered session, as it means
+// the token was copied. Logout on the device, logout-all, removing the
+// device and signing in again without remember_me end it too. In cookie
+// mode the refresh token travels in its own httpOnly cookie instead of the
+// response body.
+
+var (
+	errInvalidRefreshToken = errors.New("Refresh token is invalid or expired")
+	errReauthRequired      = errors.New("Session has reached its maximum age; sign in again")
+)
+
+// RefreshRequest for POST /auth/refresh; in cookie mode the token may come
+// from the refresh cookie instead
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// refreshCookieName is the cookie carrying the refresh token in cookie
+// mode
+func refreshCookieName() string {
+	return config.Session.CookieName + "_refresh"
+}
+
+// sessionCap is when a session whose password was entered at
+// authenticatedAt must end
+func sessionCap(authenticatedAt time.Time) time.Time {
+	return authenticatedAt.Add(config.Session.AbsoluteLifetime)
+}
+
+// earliest returns the earlier of two times
+func earliest(a, b time.Time) time.Time {
+	if b.Before(a) {
+		return b
+	}
+	return a
+}
+
+// newRefreshSecret generates a refresh token's secret part and its hash
+func newRefreshSecret() (secret, hash string, err error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", "", err
+	}
+	secret = base64.RawURLEncoding.EncodeToString(buf)
+	return secret, hashRefreshSecret(secret), nil
+}
+
+func hashRefreshSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// refreshToken joins what a refresh token names; the user and device IDs
+// locate the hash to check the secret against
+func refreshToken(userID, deviceID, secret string) string {
+	return userID + "." + deviceID + "." + secret
+}
+
+// remember starts or ends the remembered session of a device that was just
+// signed in to; callers hold the user's FieldLock and save the user.
+// It returns the refresh token, if one was issued.
+func remember(device *Device, userID string, remember bool, now time.Time) (string, error) {
+	device.RefreshHash, device.RememberedUntil = "", nil
+	if !remember {
+		return "", nil
+	}
+	secret, hash, err := newRefreshSecret()
+	if err != nil {
+		return "", err
+	}
+	until := earliest(now.Add(config.Session.RememberLifetime), sessionCap(device.AuthenticatedAt))
+	device.RefreshHash, device.RememberedUntil = hash, &until
+	return refreshToken(userID, device.ID, secret), nil
+}
+
+// RefreshSession trades a refresh token for a new access token and the
+// next refresh token
+func (s *Service) RefreshSession(token string) (*User, string, string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, "", "", errInvalidRefreshToken
+	}
+	user := s.users.ByID(parts[0])
+	if user == nil || !s.active(user) {
+		return nil, "", "", errInvalidRefreshToken
+	}
+
+	now := time.Now().UTC()
+	secret, deadline, err := s.rotateRefreshSecret(user, parts[1], parts[2], now)
+	if err != nil {
+		return nil, "", "", err
+	}
+	access, err := s.issueDeviceToken(user, earliest(now.Add(config.Session.Lifetime), deadline), "", parts[1])
+	if err != nil {
+		return nil, "", "", errTokenGeneration
+	}
+	return user, access, refreshToken(user.ID, parts[1], secret), nil
+}
+
+// rotateRefreshSecret checks a device's refresh secret and replaces it,
+// returning the new one and when the session must end
+func (s *Service) rotateRefreshSecret(user *User, deviceID, presented string, now time.Time) (string, time.Time, error) {
+	lock := s.users.FieldLock(user)
+	lock.Lock()
+	defer lock.Unlock()
+	i := slices.IndexFunc(user.Devices, func(d Device) bool { return d.ID == deviceID })
+	if i < 0 || user.Devices[i].RefreshHash == "" {
+		return "", time.Time{}, errInvalidRefreshToken
+	}
+	previous := user.Devices
+	devices := slices.Clone(previous)
+	device := &devices[i]
+
+	if subtle.ConstantTimeCompare([]byte(hashRefreshSecret(presented)), []byte(device.RefreshHash)) != 1 {
+		// A rotated-out token came back: someone else has a copy
+		device.RefreshHash, device.RememberedUntil = "", nil
+		user.Devices = devices
+		if saveUser(user) != nil {
+			user.Devices = previous
+		}
+		debugLog("auth", "Refresh token reused; remembered session ended", "user_id", user.ID, "device_id", device.ID)
+		return "", time.Time{}, errInvalidRefreshToken
+	}
+	if !device.AuthenticatedAt.Truncate(time.Millisecond).After(user.TokensRevokedAt) {
+		return "", time.Time{}, errInvalidRefreshToken // logged out everywhere since
+	}
+	deadline := sessionCap(device.AuthenticatedAt)
+	if !now.Before(deadline) {
+		return "", time.Time{}, errReauthRequired
+	}
+	if device.RememberedUntil == nil || !now.Before(*device.RememberedUntil) {
+		return "", time.Time{}, errInvalidRefreshToken
+	}
+
+	secret, hash, err := newRefreshSecret()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	until := earliest(now.Add(config.Session.RememberLifetime), deadline)
+	device.RefreshHash, device.RememberedUntil, device.LastSeenAt = hash, &until, now
+	user.Devices = devices
+	if err := saveUser(user); err != nil {
+		user.Devices = previous
+		return "", time.Time{}, err
+	}
+	return secret, deadline, nil
+}
+
+// Forget ends the remembered session of the device a session token is
+// bound to
+func (s *Service) Forget(user *User, sessionToken string) {
+	var claims jwt.MapClaims
+	if _, _, err := jwt.NewParser().ParseUnverified(sessionToken, &claims); err != nil {
+		return
+	}
+	deviceID, _ := claims["device_id"].(string)
+	if deviceID == "" {
+		return
+	}
+
+	lock := s.users.FieldLock(user)
+	lock.Lock()
+	defer lock.Unlock()
+	i := slices.IndexFunc(user.Devices, func(d Device) bool { return d.ID == deviceID })
+	if i < 0 || user.Devices[i].RefreshHash == "" {
+		return
+	}
+	previous := user.Devices
+	devices := slices.Clone(previous)
+	devices[i].RefreshHash, devices[i].RememberedUntil = "", nil
+	user.Devices = devices
+	if saveUser(user) != nil {
+		user.Devices = previous
+	}
+}
+
+// setRefreshCookie sets or, with an empty token, clears the refresh cookie
+func setRefreshCookie(c *gin.Context, token string, expiresAt time.Time) {
+	cfg := config.Session
+	maxAge := -1
+	if token != "" {
+		maxAge = int(time.Until(expiresAt).Seconds())
+	}
+	c.SetSameSite(sessionSameSite())
+	c.SetCookie(refreshCookieName(), token, maxAge, "/", cfg.CookieDomain, cfg.CookieSecure, true)
+}
+
+// withRefreshToken hands a refresh token to the client: in the response in
+// bearer mode, as a cookie otherwise
+func withRefreshToken(c *gin.Context, resp AuthResponse, token string) AuthResponse {
+	if token == "" {
+		return resp
+	}
+	if bearerTokens() {
+		resp.RefreshToken = token
+	}
+	if cookieSessions() {
+		setRefreshCookie(c, token, time.Now().Add(config.Session.RememberLifetime))
+	}
+	return resp
+}
+
+// refreshSession renews a remembered session
+func (s *Server) refreshSession(c *gin.Context) {
+	var req RefreshRequest
+	if err := c.ShouldBindJSON(&req); err != nil && err != io.EOF {
+		respondBindError(c, err)
+		return
+	}
+	token := req.RefreshToken
+	if token == "" && cookieSessions() {
+		token, _ = c.Cookie(refreshCookieName())
+	}
+	if token == "" {
+		respondError(c, http.StatusBadRequest, codeInvalidRequest, "refresh_token is required")
+		return
+	}
+
+	user, access, next, err := s.svc.RefreshSession(token)
+	if err != nil {
+		if cookieSessions() {
+			setRefreshCookie(c, "", time.Time{})
+		}
+		respondServiceError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, withRefreshToken(c, sessionResponse(c, user, access, "Session refreshed"), next))
+}
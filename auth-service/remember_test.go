@@ -0,0 +1,125 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+// rememberLogin signs in with remember_me and returns the access and
+// refresh tokens
+func (ts *testServer) rememberLogin(email string) (string, string) {
+	ts.t.Helper()
+	w := ts.do(http.MethodPost, "/v1/auth/login", "", `{"email":"`+email+`","password":"secret123","remember_me":true}`)
+	var resp AuthResponse
+	decodeJSON(ts.t, w, &resp)
+	if w.Code != http.StatusOK || resp.Token == "" || resp.RefreshToken == "" {
+		ts.t.Fatalf("remembered login: %d %s", w.Code, w.Body)
+	}
+	return resp.Token, resp.RefreshToken
+}
+
+// refresh trades a refresh token and returns the response
+func (ts *testServer) refresh(refreshToken string) (int, Problem, AuthResponse) {
+	ts.t.Helper()
+	w := ts.do(http.MethodPost, "/v1/auth/refresh", "", `{"refresh_token":"`+refreshToken+`"}`)
+	var problem Problem
+	var resp AuthResponse
+	if w.Code == http.StatusOK {
+		decodeJSON(ts.t, w, &resp)
+	} else {
+		decodeJSON(ts.t, w, &problem)
+	}
+	return w.Code, problem, resp
+}
+
+func TestRememberMe(t *testing.T) {
+	ts := newTestServer(t)
+	ts.register("a@example.com")
+
+	w := ts.do(http.MethodPost, "/v1/auth/login", "", `{"email":"a@example.com","password":"secret123"}`)
+	var plain AuthResponse
+	decodeJSON(t, w, &plain)
+	if w.Code != http.StatusOK || plain.RefreshToken != "" {
+		t.Fatalf("login without remember_me: %d %s", w.Code, w.Body)
+	}
+
+	_, first := ts.rememberLogin("a@example.com")
+	status, _, resp := ts.refresh(first)
+	if status != http.StatusOK || resp.RefreshToken == "" || resp.RefreshToken == first || resp.User.Email != "a@example.com" {
+		t.Fatalf("refresh: %d %+v", status, resp)
+	}
+	if w := ts.do(http.MethodGet, "/v1/auth/verify", resp.Token, ""); w.Code != http.StatusOK {
+		t.Fatalf("refreshed token: %d %s", w.Code, w.Body)
+	}
+
+	// Replaying the rotated-out token ends the session, new token included
+	if status, problem, _ := ts.refresh(first); status != http.StatusUnauthorized || problem.Code != codeInvalidToken {
+		t.Fatalf("reused refresh token: %d %+v", status, problem)
+	}
+	if status, _, _ := ts.refresh(resp.RefreshToken); status != http.StatusUnauthorized {
+		t.Fatalf("refresh after reuse: got %d, want 401", status)
+	}
+
+	for _, token := range []string{"", "nonsense", "a.b.c"} {
+		if status, _, _ := ts.refresh(token); status == http.StatusOK {
+			t.Fatalf("refresh %q succeeded", token)
+		}
+	}
+}
+
+func TestRememberMeEnds(t *testing.T) {
+	ts := newTestServer(t)
+	ts.register("a@example.com")
+
+	// Logout on the device
+	access, refresh := ts.rememberLogin("a@example.com")
+	if w := ts.do(http.MethodPost, "/v1/auth/logout", access, ""); w.Code != http.StatusOK {
+		t.Fatalf("logout: %d %s", w.Code, w.Body)
+	}
+	if status, _, _ := ts.refresh(refresh); status != http.StatusUnauthorized {
+		t.Fatalf("refresh after logout: got %d, want 401", status)
+	}
+
+	// Logout everywhere; tokens have whole-second issue times
+	access, refresh = ts.rememberLogin("a@example.com")
+	if w := ts.do(http.MethodPost, "/v1/auth/logout-all", access, ""); w.Code != http.StatusOK {
+		t.Fatalf("logout-all: %d %s", w.Code, w.Body)
+	}
+	if status, _, _ := ts.refresh(refresh); status != http.StatusUnauthorized {
+		t.Fatalf("refresh after logout-all: got %d, want 401", status)
+	}
+
+	// The absolute cap, counted from when the password was entered
+	ts.register("b@example.com")
+	_, refresh = ts.rememberLogin("b@example.com")
+	user := ts.srv.svc.users.ByEmail("b@example.com")
+	user.Devices[0].AuthenticatedAt = time.Now().Add(-config.Session.AbsoluteLifetime)
+	if status, problem, _ := ts.refresh(refresh); status != http.StatusUnauthorized || problem.Code != codeReauthRequired {
+		t.Fatalf("refresh past the cap: %d %+v", status, problem)
+	}
+}
+
+func TestRememberMeCookies(t *testing.T) {
+	ts := newTestServer(t)
+	withConfig(t, func(cfg *Config) { cfg.Session.Mode = sessionModeCookie })
+	ts.register("a@example.com")
+
+	w := ts.do(http.MethodPost, "/v1/auth/login", "", `{"email":"a@example.com","password":"secret123","remember_me":true}`)
+	var resp AuthResponse
+	decodeJSON(t, w, &resp)
+	var refresh *http.Cookie
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == refreshCookieName() {
+			refresh = cookie
+		}
+	}
+	if w.Code != http.StatusOK || resp.RefreshToken != "" || refresh == nil || !refresh.HttpOnly {
+		t.Fatalf("cookie login: %d %s", w.Code, w.Body)
+	}
+
+	w = ts.do(http.MethodPost, "/v1/auth/refresh", "", "", "Cookie", refresh.Name+"="+refresh.Value)
+	if w.Code != http.StatusOK {
+		t.Fatalf("cookie refresh: %d %s", w.Code, w.Body)
+	}
+}
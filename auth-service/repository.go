@@ -0,0 +1,73 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// ============================================================================
+// Repositories
+// ============================================================================
+//
+// The Service reaches users and documents only through these interfaces,
+// so a handler test can give each Server its own empty stores. The
+// in-memory implementations (userstore.go, docstore.go) are the only ones
+// today; in cluster mode they are the local replica that cluster.go keeps
+// in step with the shared store.
+
+// UserRepository stores accounts. Lookups return the stored *User, whose
+// fields are guarded by the lock FieldLock returns.
+type UserRepository interface {
+	ByID(id string) *User
+	ByEmail(email string) *User
+	Contact(id string) (name, email string, ok bool)
+	Snapshot(id string) *User
+	Add(user *User) (*User, error)
+	ChangeEmail(user *User, from, to string) error
+	ByPhone(phone string) *User
+	ChangePhone(user *User, from, to string) error
+	Remove(user *User)
+	FieldLock(user *User) *sync.RWMutex
+	Each(fn func(*User))
+	Count() int
+}
+
+// DocumentRepository stores document ownership. View sees a consistent
+// state; Update's changes are applied atomically.
+type DocumentRepository interface {
+	View(fn func(tx DocumentTx))
+	Update(fn func(tx DocumentTx) error) error
+}
+
+// DocumentTx reads and changes documents inside View or Update
+type DocumentTx interface {
+	get(filename string) (documentRecord, bool)
+	owner(filename string) string
+	put(filename string, record documentRecord)
+	setSize(filename string, size int64) (documentRecord, bool)
+	setOrgWide(filename string, orgWide bool) (documentRecord, bool)
+	remove(filename string) (documentRecord, bool)
+	ownedBy(userID string) []string
+	named(userID, name string) (string, bool)
+	owns(userID, filename string) bool
+	orgWideDocuments() []string
+	readable(userID, filename string) bool
+	grantedTo(userID string, now time.Time) map[string]time.Time
+	lapsedGrants(now time.Time) []DocumentGrant
+	countOwnedBy(userID string) int
+	owners() []string
+	ownerCount() int
+	totalBytes() int64
+	len() int
+	each(fn func(filename string, record documentRecord))
+}
+
+// The process's stores and the service over them. Cluster replication
+// writes to localUsers and localDocuments directly; the service reads users
+// through userCache (usercache.go).
+var (
+	localUsers     = newMemoryUserRepository()
+	localDocuments = newMemoryDocumentRepository()
+	userCache      = newCachedUserRepository(localUsers)
+	defaultService = NewService(userCache, localDocuments, &signingKeys)
+)
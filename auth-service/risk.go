@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ============================================================================
+// Login Risk
+// ============================================================================
+//
+// With risk.enabled, every sign-in attempt is scored from the failed
+// sign-ins in the last risk.window for its account, its address and its
+// network (ASN, read from risk.asn_header set by the edge proxy), each
+// weighted by risk.*_weight and capped at 100. The failures then decide
+// what the attempt meets before its password is checked:
+//
+//   - a delay that doubles from risk.delay_base with each failure on the
+//     account, up to risk.delay_max;
+//   - 429 once the address or network reaches risk.ip_max_failures or
+//     risk.asn_max_failures, until the window rolls over;
+//   - at risk.captcha_score and above, a CAPTCHA: the attempt needs a
+//     "captcha_token" that risk.captcha_verify_url accepts (any
+//     siteverify-style endpoint: hCaptcha, Turnstile, reCAPTCHA), or gets
+//     401 captcha_required with the site key to render the widget with.
+//
+// A successful sign-in clears its account's failures, not its address's.
+// Counters are per instance and do not survive a restart. Challenges, how
+// many were passed and throttled attempts are counted in /admin/stats.
+
+// Risk outcomes counted in /admin/stats
+const (
+	riskChallenged = iota
+	riskChallengePassed
+	riskThrottled
+)
+
+const (
+	maxRiskScore         = 100
+	riskSweepInterval    = time.Minute
+	captchaVerifyTimeout = 5 * time.Second
+)
+
+var (
+	errCaptchaRequired = errors.New("Complete the CAPTCHA to sign in")
+	errCaptchaFailed   = errors.New("CAPTCHA verification failed")
+)
+
+// riskCounter counts failed sign-ins for one key in the current window
+type riskCounter struct {
+	failures int
+	since    time.Time
+}
+
+var (
+	riskCounters  = make(map[string]*riskCounter) // "account:", "ip:" or "asn:" + value
+	riskMutex     sync.Mutex
+	riskLastSweep time.Time
+
+	captchaClient = &http.Client{Timeout: captchaVerifyTimeout}
+)
+
+// riskAssessment is what a sign-in attempt meets
+type riskAssessment struct {
+	Score      int
+	Delay      time.Duration
+	Throttled  string        // "ip" or "asn" when refused outright
+	RetryAfter time.Duration // when throttled
+	Challenge  bool          // a CAPTCHA is required
+}
+
+// riskKeys are the counters an attempt for identifier from ip and asn uses
+func riskKeys(identifier, ip, asn string) (account, address, network string) {
+	account = "account:" + strings.ToLower(strings.TrimSpace(identifier))
+	address = "ip:" + ip
+	if asn != "" {
+		network = "asn:" + asn
+	}
+	return account, address, network
+}
+
+// riskFailures returns a counter's failures and when its window ends;
+// callers hold riskMutex
+func riskFailures(key string, now time.Time) (int, time.Time) {
+	counter, exists := riskCounters[key]
+	if key == "" || !exists || now.Sub(counter.since) >= config.Risk.Window {
+		return 0, now
+	}
+	return counter.failures, counter.since.Add(config.Risk.Window)
+}
+
+// assessLogin scores a sign-in attempt before its password is checked
+func assessLogin(identifier, ip, asn string) riskAssessment {
+	cfg := config.Risk
+	var assessment riskAssessment
+	if !cfg.Enabled {
+		return assessment
+	}
+	account, address, network := riskKeys(identifier, ip, asn)
+
+	now := time.Now()
+	riskMutex.Lock()
+	accountFailures, _ := riskFailures(account, now)
+	ipFailures, ipReset := riskFailures(address, now)
+	asnFailures, asnReset := riskFailures(network, now)
+	riskMutex.Unlock()
+
+	switch {
+	case cfg.IPMaxFailures > 0 && ipFailures >= cfg.IPMaxFailures:
+		assessment.Throttled, assessment.RetryAfter = "ip", ipReset.Sub(now)
+	case cfg.ASNMaxFailures > 0 && asnFailures >= cfg.ASNMaxFailures:
+		assessment.Throttled, assessment.RetryAfter = "asn", asnReset.Sub(now)
+	}
+
+	score := accountFailures*cfg.AccountWeight + ipFailures*cfg.IPWeight + asnFailures*cfg.ASNWeight
+	assessment.Score = min(score, maxRiskScore)
+	assessment.Challenge = cfg.CaptchaScore > 0 && assessment.Score >= cfg.CaptchaScore
+	if accountFailures > 0 {
+		assessment.Delay = cfg.DelayMax
+		if shift := accountFailures - 1; shift < 32 {
+			assessment.Delay = min(cfg.DelayBase<<shift, cfg.DelayMax)
+		}
+	}
+	return assessment
+}
+
+// recordLoginRisk counts a failed sign-in against its account, address and
+// network, or clears the account's failures after a success
+func recordLoginRisk(identifier, ip, asn string, success bool) {
+	if !config.Risk.Enabled {
+		return
+	}
+	account, address, network := riskKeys(identifier, ip, asn)
+
+	now := time.Now()
+	riskMutex.Lock()
+	defer riskMutex.Unlock()
+	if success {
+		delete(riskCounters, account)
+		return
+	}
+	for _, key := range []string{account, address, network} {
+		if key == "" {
+			continue
+		}
+		counter, exists := riskCounters[key]
+		if !exists || now.Sub(counter.since) >= config.Risk.Window {
+			counter = &riskCounter{since: now}
+			riskCounters[key] = counter
+		}
+		counter.failures++
+	}
+
+	// Drop counters whose window has passed
+	if now.Sub(riskLastSweep) >= riskSweepInterval {
+		riskLastSweep = now
+		for key, counter := range riskCounters {
+			if now.Sub(counter.since) >= config.Risk.Window {
+				delete(riskCounters, key)
+			}
+		}
+	}
+}
+
+// verifyCaptcha asks the CAPTCHA provider whether a token is genuine
+func verifyCaptcha(ctx context.Context, token, ip string) (bool, error) {
+	cfg := config.Risk
+	form := url.Values{"secret": {cfg.CaptchaSecret}, "response": {token}, "remoteip": {ip}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, cfg.CaptchaVerifyURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := captchaClient.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("captcha provider returned %s", resp.Status)
+	}
+
+	var result struct {
+		Success bool `json:"success"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return false, err
+	}
+	return result.Success, nil
+}
+
+// riskASN is the network a request comes from, if the edge proxy says
+func riskASN(header func(string) string) string {
+	if config.Risk.ASNHeader == "" {
+		return ""
+	}
+	return strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(header(config.Risk.ASNHeader))), "AS")
+}
+
+// sleepContext waits for d or until ctx is done
+func sleepContext(ctx context.Context, d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+	case <-timer.C:
+	}
+}
+
+// screenLogin applies the risk engine to a sign-in attempt over HTTP. It
+// answers the request and returns false when the attempt may not proceed.
+func screenLogin(c *gin.Context, identifier, captchaToken string) bool {
+	assessment := assessLogin(identifier, c.ClientIP(), riskASN(c.GetHeader))
+	if assessment.Throttled != "" {
+		recordRiskOutcome(riskThrottled)
+		debugLog("ratelimit", "Sign-in throttled", "ip", c.ClientIP(), "by", assessment.Throttled, "score", assessment.Score)
+		c.Header("Retry-After", strconv.Itoa(max(ceilSeconds(assessment.RetryAfter), 1)))
+		respondError(c, http.StatusTooManyRequests, codeRateLimited, "Too many failed sign-ins from this network; retry later")
+		return false
+	}
+
+	if assessment.Challenge {
+		recordRiskOutcome(riskChallenged)
+		if captchaToken == "" {
+			respondCaptcha(c, errCaptchaRequired)
+			return false
+		}
+		ok, err := verifyCaptcha(c.Request.Context(), captchaToken, c.ClientIP())
+		if err != nil {
+			// Like the rate limiter, a provider outage shouldn't lock
+			// everyone out; the delay still applies
+			slog.Warn("CAPTCHA verification failed; allowing sign-in", "error", err)
+		} else if !ok {
+			respondCaptcha(c, errCaptchaFailed)
+			return false
+		} else {
+			recordRiskOutcome(riskChallengePassed)
+		}
+	}
+
+	sleepContext(c.Request.Context(), assessment.Delay)
+	return true
+}
+
+// respondCaptcha asks the client to complete a CAPTCHA
+func respondCaptcha(c *gin.Context, err error) {
+	respondProblem(c, Problem{
+		Status:     http.StatusUnauthorized,
+		Code:       codeCaptchaRequired,
+		Detail:     err.Error(),
+		Extensions: map[string]interface{}{"captcha_site_key": config.Risk.CaptchaSiteKey},
+	})
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// useRisk turns the risk engine on with fresh counters for a test
+func useRisk(t *testing.T, modify func(*RiskConfig)) {
+	t.Helper()
+	withConfig(t, func(cfg *Config) {
+		cfg.Risk.Enabled = true
+		cfg.Risk.DelayBase, cfg.Risk.DelayMax = time.Millisecond, 4*time.Millisecond
+		cfg.Risk.CaptchaScore = 0
+		modify(&cfg.Risk)
+	})
+	reset := func() {
+		riskMutex.Lock()
+		riskCounters = make(map[string]*riskCounter)
+		riskMutex.Unlock()
+	}
+	reset()
+	t.Cleanup(reset)
+}
+
+func TestAssessLogin(t *testing.T) {
+	useRisk(t, func(cfg *RiskConfig) {
+		cfg.IPMaxFailures, cfg.ASNMaxFailures = 4, 6
+		cfg.AccountWeight, cfg.IPWeight, cfg.ASNWeight = 20, 5, 1
+		cfg.CaptchaScore = 60
+	})
+
+	if got := assessLogin("a@example.com", "192.0.2.1", "64500"); got != (riskAssessment{}) {
+		t.Fatalf("no failures: %+v", got)
+	}
+
+	for i := 0; i < 3; i++ {
+		recordLoginRisk("A@example.com", "192.0.2.1", "64500", false)
+	}
+	got := assessLogin("a@example.com", "192.0.2.1", "64500")
+	if got.Score != 3*20+3*5+3 || !got.Challenge || got.Throttled != "" || got.Delay != 4*time.Millisecond {
+		t.Fatalf("three failures: %+v", got)
+	}
+	if got := assessLogin("b@example.com", "192.0.2.2", "64500"); got.Score != 3 || got.Delay != 0 || got.Challenge {
+		t.Fatalf("same network only: %+v", got)
+	}
+
+	// Success clears the account, not the address
+	recordLoginRisk("a@example.com", "192.0.2.1", "64500", true)
+	if got := assessLogin("a@example.com", "192.0.2.1", "64500"); got.Score != 3*5+3 || got.Delay != 0 {
+		t.Fatalf("after success: %+v", got)
+	}
+
+	recordLoginRisk("c@example.com", "192.0.2.1", "64500", false)
+	if got := assessLogin("d@example.com", "192.0.2.1", ""); got.Throttled != "ip" || got.RetryAfter <= 0 {
+		t.Fatalf("address throttle: %+v", got)
+	}
+	recordLoginRisk("c@example.com", "192.0.2.3", "64500", false)
+	recordLoginRisk("c@example.com", "192.0.2.3", "64500", false)
+	if got := assessLogin("d@example.com", "192.0.2.4", "64500"); got.Throttled != "asn" {
+		t.Fatalf("network throttle: %+v", got)
+	}
+}
+
+func TestLoginCaptcha(t *testing.T) {
+	verifier := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.PostFormValue("secret") != "captcha-secret" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Write([]byte(`{"success":` + map[bool]string{true: "true", false: "false"}[r.PostFormValue("response") == "solved"] + `}`))
+	}))
+	defer verifier.Close()
+
+	ts := newTestServer(t)
+	useRisk(t, func(cfg *RiskConfig) {
+		cfg.AccountWeight, cfg.CaptchaScore = 25, 50
+		cfg.CaptchaVerifyURL, cfg.CaptchaSecret, cfg.CaptchaSiteKey = verifier.URL, "captcha-secret", "site-key"
+	})
+	ts.register("a@example.com")
+
+	ts.login("a@example.com", "wrong-password", http.StatusUnauthorized)
+	ts.login("a@example.com", "wrong-password", http.StatusUnauthorized)
+
+	w := ts.do(http.MethodPost, "/v1/auth/login", "", `{"email":"a@example.com","password":"secret123"}`)
+	var problem map[string]interface{}
+	decodeJSON(t, w, &problem)
+	if w.Code != http.StatusUnauthorized || problem["code"] != codeCaptchaRequired || problem["captcha_site_key"] != "site-key" {
+		t.Fatalf("no captcha: %d %s", w.Code, w.Body)
+	}
+	w = ts.do(http.MethodPost, "/v1/auth/login", "", `{"email":"a@example.com","password":"secret123","captcha_token":"guessed"}`)
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("bad captcha: %d %s", w.Code, w.Body)
+	}
+	w = ts.do(http.MethodPost, "/v1/auth/login", "", `{"email":"a@example.com","password":"secret123","captcha_token":"solved"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("solved captcha: %d %s", w.Code, w.Body)
+	}
+
+	// The success cleared the account
+	ts.login("a@example.com", "secret123", http.StatusOK)
+
+	var stats StatsResponse
+	decodeJSON(t, ts.do(http.MethodGet, "/v1/admin/stats?period=day", ts.admin("admin@example.com"), ""), &stats)
+	if stats.Totals.Challenges < 3 || stats.Totals.ChallengesPassed < 1 || stats.Totals.ChallengeRate <= 0 {
+		t.Fatalf("stats: %+v", stats.Totals)
+	}
+}
+
+func TestLoginThrottle(t *testing.T) {
+	ts := newTestServer(t)
+	useRisk(t, func(cfg *RiskConfig) { cfg.IPMaxFailures = 2 })
+	ts.register("a@example.com")
+
+	ts.login("a@example.com", "wrong-password", http.StatusUnauthorized)
+	ts.login("b@example.com", "wrong-password", http.StatusUnauthorized)
+	w := ts.do(http.MethodPost, "/v1/auth/login", "", `{"email":"a@example.com","password":"secret123"}`)
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Fatalf("throttled address: %d %s", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,702 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// ============================================================================
+// Saved Queries
+// ============================================================================
+//
+// A saved query is a question a user asks again and again ("summarize new
+// HR policies"). It can be run on demand with POST /saved-queries/:id/run,
+// or scheduled daily or weekly at an hour (UTC); the scheduler checks for
+// due queries every savedQuerySweepInterval. Each run goes through the
+// same gateway as a chat query: the sources are cut down to what the owner
+// can read at that moment, the collection's search settings apply, it
+// spends one of the owner's daily queries (plans.go), and the query lands
+// in the query history (and any running experiment). A scheduled answer is
+// delivered as an in-app notification, an email, or both; a run that fails
+// is reported in the inbox only. The last run is kept with the query.
+// Saved queries are files under saved_queries.store_dir, or records in the
+// shared store in cluster mode, read from it whenever they're used and
+// changed under their lock; the scheduler runs on one replica at a time.
+
+// Saved query schedules
+const (
+	scheduleNone   = "none" // run on demand only
+	scheduleDaily  = "daily"
+	scheduleWeekly = "weekly"
+)
+
+// Delivery channels for scheduled answers
+const (
+	deliveryInApp = "in_app"
+	deliveryEmail = "email"
+)
+
+const (
+	maxSavedQueries         = 50 // per user
+	savedQuerySweepInterval = time.Minute
+	maxDigestPreview        = 280 // runes of the answer shown in a notification
+
+	savedQueryRecord = "saved-query" // id -> SavedQuery, in cluster mode
+)
+
+// NotificationSavedQuery carries a scheduled answer, or the reason it
+// failed
+const NotificationSavedQuery = "saved_query.answered"
+
+var (
+	errSavedQueryNotFound  = errors.New("Saved query not found")
+	errTooManySavedQueries = errors.New("You have too many saved queries")
+	errNoSourcesToQuery    = errors.New("No accessible documents to query")
+	errOwnerInactive       = errors.New("The saved query's owner is not active")
+)
+
+// SavedQuerySchedule says when a saved query runs by itself
+type SavedQuerySchedule struct {
+	Frequency string `json:"frequency" binding:"omitempty,oneof=none daily weekly"`
+	Hour      int    `json:"hour" binding:"min=0,max=23"`   // UTC
+	Weekday   int    `json:"weekday" binding:"min=0,max=6"` // weekly only; 0 is Sunday
+}
+
+// SavedQueryRun is the outcome of running a saved query once
+type SavedQueryRun struct {
+	At        time.Time `json:"at"`
+	Scheduled bool      `json:"scheduled"` // false when run on demand
+	Answer    string    `json:"answer,omitempty"`
+	Sources   []string  `json:"sources,omitempty"` // documents the answer drew on
+	Error     string    `json:"error,omitempty"`
+	LatencyMS int64     `json:"latency_ms"`
+}
+
+// SavedQuery is a stored question and when to ask it
+type SavedQuery struct {
+	ID            string             `json:"id"`
+	OwnerID       string             `json:"owner_id"`
+	Name          string             `json:"name"`
+	Question      string             `json:"question"`
+	Collection    string             `json:"collection,omitempty"`
+	FilterSources []string           `json:"filter_sources,omitempty"` // empty asks every readable document
+	Schedule      SavedQuerySchedule `json:"schedule"`
+	Delivery      []string           `json:"delivery"`
+	NextRunAt     *time.Time         `json:"next_run_at,omitempty"`
+	LastRun       *SavedQueryRun     `json:"last_run,omitempty"`
+	CreatedAt     time.Time          `json:"created_at"`
+	UpdatedAt     time.Time          `json:"updated_at"`
+}
+
+// SavedQueryRequest creates or replaces a saved query
+type SavedQueryRequest struct {
+	Name          string             `json:"name" binding:"required,max=200"`
+	Question      string             `json:"question" binding:"required,max=10000"`
+	Collection    string             `json:"collection" binding:"max=64"`
+	FilterSources []string           `json:"filter_sources,omitempty" binding:"max=50"`
+	Schedule      SavedQuerySchedule `json:"schedule"`
+	Delivery      []string           `json:"delivery,omitempty" binding:"max=2,dive,oneof=in_app email"`
+}
+
+var (
+	savedQueries    = make(map[string]*SavedQuery) // id -> query
+	savedQueryMutex sync.Mutex
+	savedQueryStore jobFiles // <id>.json
+)
+
+// startSavedQueries loads stored queries and starts the scheduler; in
+// cluster mode queries are read from the shared store as they're used
+func startSavedQueries(svc *Service) {
+	savedQueryStore = jobFiles{dir: config.SavedQueries.StoreDir}
+	if !clustered() {
+		if err := loadSavedQueries(); err != nil {
+			fatal("Failed to open saved query store", "dir", savedQueryStore.dir, "error", err)
+		}
+	}
+	goBackground(func(ctx context.Context) {
+		ticker := time.NewTicker(savedQuerySweepInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			svc.runDueQueries(ctx, time.Now())
+		}
+	})
+}
+
+func loadSavedQueries() error {
+	if err := os.MkdirAll(savedQueryStore.dir, 0o700); err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(savedQueryStore.dir)
+	if err != nil {
+		return err
+	}
+	savedQueryMutex.Lock()
+	defer savedQueryMutex.Unlock()
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(savedQueryStore.dir, entry.Name()))
+		if err != nil {
+			return err
+		}
+		var query SavedQuery
+		if err := json.Unmarshal(data, &query); err != nil {
+			slog.Warn("Skipping unreadable saved query", "file", entry.Name(), "error", err)
+			continue
+		}
+		savedQueries[query.ID] = &query
+	}
+	return nil
+}
+
+// refreshSavedQuery replaces the local copy of a query with the shared
+// store's in cluster mode; callers hold savedQueryMutex
+func refreshSavedQuery(id string) error {
+	if !clustered() {
+		return nil
+	}
+	data, found, err := keyedRecords().record(context.Background(), savedQueryRecord, id)
+	if err != nil {
+		slog.Error("Record store read failed", "op", "saved_query", "error", err)
+		return errStoreUnavailable
+	}
+	if !found {
+		delete(savedQueries, id)
+		return nil
+	}
+	var query SavedQuery
+	if err := json.Unmarshal(data, &query); err != nil {
+		return err
+	}
+	savedQueries[id] = &query
+	return nil
+}
+
+// refreshSavedQueries replaces every local copy with the shared store's in
+// cluster mode; callers hold savedQueryMutex
+func refreshSavedQueries() error {
+	if !clustered() {
+		return nil
+	}
+	records, err := keyedRecords().records(context.Background(), savedQueryRecord)
+	if err != nil {
+		slog.Error("Record store read failed", "op", "saved_queries", "error", err)
+		return errStoreUnavailable
+	}
+	savedQueries = make(map[string]*SavedQuery, len(records))
+	for id, data := range records {
+		var query SavedQuery
+		if err := json.Unmarshal(data, &query); err != nil {
+			slog.Warn("Skipping unreadable saved query", "saved_query_id", id, "error", err)
+			continue
+		}
+		savedQueries[id] = &query
+	}
+	return nil
+}
+
+// savedQueryLock serializes changes to a query, or with "owner:"+ID the
+// creation of a user's queries, across replicas; it's taken before
+// savedQueryMutex
+func savedQueryLock(name string) (func(), error) {
+	ctx, cancel := context.WithTimeout(context.Background(), config.Cluster.LockTTL)
+	defer cancel()
+	release, err := acquireLock(ctx, savedQueryRecord+":"+name, config.Cluster.LockTTL)
+	if err != nil {
+		slog.Error("Saved query lock failed", "error", err)
+		return nil, errStoreUnavailable
+	}
+	return release, nil
+}
+
+// persistSavedQuery saves a query like persistConversation: a failed write
+// to the shared store is returned, one to its file only logged. Callers
+// hold savedQueryMutex.
+func persistSavedQuery(query *SavedQuery) error {
+	data, err := json.Marshal(query)
+	if err != nil {
+		return err
+	}
+	if clustered() {
+		if err := keyedRecords().saveRecord(context.Background(), savedQueryRecord, query.ID, data, 0); err != nil {
+			slog.Error("Record store write failed", "op", "saved_query", "error", err)
+			return errStoreUnavailable
+		}
+		return nil
+	}
+	if err := savedQueryStore.write(savedQueryStore.path(query.ID, ".json"), data); err != nil {
+		slog.Error("Saved query store write failed", "saved_query_id", query.ID, "error", err)
+	}
+	return nil
+}
+
+// removeSavedQuery deletes a stored query; callers hold savedQueryMutex
+func removeSavedQuery(id string) error {
+	if clustered() {
+		if err := keyedRecords().deleteRecord(context.Background(), savedQueryRecord, id); err != nil {
+			slog.Error("Record store write failed", "op", "saved_query", "error", err)
+			return errStoreUnavailable
+		}
+		return nil
+	}
+	savedQueryStore.remove(id)
+	return nil
+}
+
+// nextRun is when a schedule next fires after a time, or nil when it
+// doesn't fire by itself
+func (schedule SavedQuerySchedule) nextRun(after time.Time) *time.Time {
+	after = after.UTC()
+	next := time.Date(after.Year(), after.Month(), after.Day(), schedule.Hour, 0, 0, 0, time.UTC)
+	switch schedule.Frequency {
+	case scheduleDaily:
+		if !next.After(after) {
+			next = next.AddDate(0, 0, 1)
+		}
+	case scheduleWeekly:
+		next = next.AddDate(0, 0, (schedule.Weekday-int(next.Weekday())+7)%7)
+		if !next.After(after) {
+			next = next.AddDate(0, 0, 7)
+		}
+	default:
+		return nil
+	}
+	return &next
+}
+
+// define fills a query in from a request
+func (query *SavedQuery) define(req SavedQueryRequest, now time.Time) {
+	query.Name, query.Question, query.FilterSources = req.Name, req.Question, req.FilterSources
+	query.Collection = normalizeCollection(req.Collection)
+	query.Schedule = req.Schedule
+	if query.Schedule.Frequency == "" {
+		query.Schedule.Frequency = scheduleNone
+	}
+	if query.Schedule.Frequency != scheduleWeekly {
+		query.Schedule.Weekday = 0
+	}
+	query.Delivery = []string{deliveryInApp}
+	if len(req.Delivery) > 0 {
+		query.Delivery = slices.Clone(req.Delivery)
+		slices.Sort(query.Delivery)
+		query.Delivery = slices.Compact(query.Delivery)
+	}
+	query.NextRunAt = query.Schedule.nextRun(now)
+	query.UpdatedAt = now
+}
+
+// ownedSavedQuery finds one of the user's queries; callers hold
+// savedQueryMutex
+func ownedSavedQuery(id string, user *User) (*SavedQuery, error) {
+	if err := refreshSavedQuery(id); err != nil {
+		return nil, err
+	}
+	query, exists := savedQueries[id]
+	if !exists || query.OwnerID != user.ID {
+		return nil, errSavedQueryNotFound
+	}
+	return query, nil
+}
+
+// CreateSavedQuery saves a question for a user
+func (s *Service) CreateSavedQuery(owner *User, req SavedQueryRequest) (SavedQuery, error) {
+	now := time.Now().UTC()
+	query := &SavedQuery{ID: uuid.New().String(), OwnerID: owner.ID, CreatedAt: now}
+	query.define(req, now)
+
+	release, err := savedQueryLock("owner:" + owner.ID)
+	if err != nil {
+		return SavedQuery{}, err
+	}
+	defer release()
+	savedQueryMutex.Lock()
+	defer savedQueryMutex.Unlock()
+	if err := refreshSavedQueries(); err != nil {
+		return SavedQuery{}, err
+	}
+	count := 0
+	for _, other := range savedQueries {
+		if other.OwnerID == owner.ID {
+			count++
+		}
+	}
+	if count >= maxSavedQueries {
+		return SavedQuery{}, errTooManySavedQueries
+	}
+	if err := persistSavedQuery(query); err != nil {
+		return SavedQuery{}, err
+	}
+	savedQueries[query.ID] = query
+	return *query, nil
+}
+
+// SavedQueries lists a user's saved queries, most recently changed first
+func (s *Service) SavedQueries(user *User) ([]SavedQuery, error) {
+	list := []SavedQuery{}
+	savedQueryMutex.Lock()
+	defer savedQueryMutex.Unlock()
+	if err := refreshSavedQueries(); err != nil {
+		return nil, err
+	}
+	for _, query := range savedQueries {
+		if query.OwnerID == user.ID {
+			list = append(list, *query)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].UpdatedAt.After(list[j].UpdatedAt) })
+	return list, nil
+}
+
+// SavedQuery returns one of a user's saved queries
+func (s *Service) SavedQuery(id string, user *User) (SavedQuery, error) {
+	savedQueryMutex.Lock()
+	defer savedQueryMutex.Unlock()
+	query, err := ownedSavedQuery(id, user)
+	if err != nil {
+		return SavedQuery{}, err
+	}
+	return *query, nil
+}
+
+// ReplaceSavedQuery redefines one of a user's saved queries; its schedule
+// starts again from now
+func (s *Service) ReplaceSavedQuery(id string, user *User, req SavedQueryRequest) (SavedQuery, error) {
+	release, err := savedQueryLock(id)
+	if err != nil {
+		return SavedQuery{}, err
+	}
+	defer release()
+	savedQueryMutex.Lock()
+	defer savedQueryMutex.Unlock()
+	query, err := ownedSavedQuery(id, user)
+	if err != nil {
+		return SavedQuery{}, err
+	}
+	query.define(req, time.Now().UTC())
+	if err := persistSavedQuery(query); err != nil {
+		return SavedQuery{}, err
+	}
+	return *query, nil
+}
+
+// DeleteSavedQuery removes one of a user's saved queries
+func (s *Service) DeleteSavedQuery(id string, user *User) error {
+	release, err := savedQueryLock(id)
+	if err != nil {
+		return err
+	}
+	defer release()
+	savedQueryMutex.Lock()
+	defer savedQueryMutex.Unlock()
+	if _, err := ownedSavedQuery(id, user); err != nil {
+		return err
+	}
+	if err := removeSavedQuery(id); err != nil {
+		return err
+	}
+	delete(savedQueries, id)
+	return nil
+}
+
+// RunSavedQuery runs one of a user's saved queries now and returns the
+// run; the answer is returned rather than delivered. allow charges the
+// query to the user's plan once it can be asked; a run it refuses returns
+// errQuotaExceeded and isn't kept.
+func (s *Service) RunSavedQuery(ctx context.Context, id string, user *User, allow func() bool) (SavedQueryRun, error) {
+	savedQueryMutex.Lock()
+	query, err := ownedSavedQuery(id, user)
+	var snapshot SavedQuery
+	if err == nil {
+		snapshot = *query
+	}
+	savedQueryMutex.Unlock()
+	if err != nil {
+		return SavedQueryRun{}, err
+	}
+	run := s.askSavedQuery(ctx, snapshot, user, false, allow)
+	if run.Error == errQuotaExceeded.Error() {
+		return run, errQuotaExceeded
+	}
+	recordSavedQueryRun(id, run)
+	return run, nil
+}
+
+// askSavedQuery sends a saved query through the gateway as its owner,
+// once allow has charged it to their plan
+func (s *Service) askSavedQuery(ctx context.Context, query SavedQuery, owner *User, scheduled bool, allow func() bool) SavedQueryRun {
+	run := SavedQueryRun{At: time.Now().UTC(), Scheduled: scheduled}
+	sources := s.AllowedSources(owner, query.FilterSources)
+	if owner.Role != "admin" && len(sources) == 0 {
+		run.Error = errNoSourcesToQuery.Error()
+		return run
+	}
+	if !allow() {
+		run.Error = errQuotaExceeded.Error()
+		return run
+	}
+	search := searchFor(query.Collection)
+	req := StreamQueryRequest{
+		Question:      query.Question,
+		NChunks:       config.SavedQueries.NChunks,
+		FilterSources: sources,
+		Collection:    query.Collection,
+		Search:        &search,
+		Language:      guessLanguage(query.Question),
+	}
+	if req.Language == "" {
+		req.Language = config.I18n.DefaultLanguage
+	}
+	if len(sources) > 0 {
+		req.PreferredSources = s.InLanguage(sources, req.Language)
+	}
+	record := startQueryRecord(uuid.New().String(), owner, "", &req)
+
+	ctx, cancel := context.WithTimeout(ctx, config.SavedQueries.Timeout)
+	defer cancel()
+	answer, err := askBackend(ctx, req)
+	run.LatencyMS = time.Since(run.At).Milliseconds()
+	if err != nil {
+		finishQueryRecord(record, queryFailed, time.Time{}, 0)
+		run.Error = err.Error()
+		return run
+	}
+	finishQueryRecord(record, queryAnswered, time.Time{}, len([]rune(answer.Answer)))
+	run.Answer = answer.Answer
+	for _, chunk := range answer.ChunksUsed {
+		if !slices.Contains(run.Sources, chunk.Source) {
+			run.Sources = append(run.Sources, chunk.Source)
+		}
+	}
+	return run
+}
+
+// recordSavedQueryRun keeps a run as the query's last, unless the query
+// was deleted meanwhile; the run has happened, so failures are only logged
+func recordSavedQueryRun(id string, run SavedQueryRun) {
+	release, err := savedQueryLock(id)
+	if err != nil {
+		slog.Warn("Saved query run not kept", "saved_query_id", id, "error", err)
+		return
+	}
+	defer release()
+	savedQueryMutex.Lock()
+	defer savedQueryMutex.Unlock()
+	if err := refreshSavedQuery(id); err != nil {
+		slog.Warn("Saved query run not kept", "saved_query_id", id, "error", err)
+		return
+	}
+	if query, exists := savedQueries[id]; exists {
+		query.LastRun = &run
+		persistSavedQuery(query)
+	}
+}
+
+// runDueQueries runs the saved queries whose time has come, one after
+// another, and delivers their answers. Each is moved to its next run
+// before it starts, so a slow backend doesn't run it twice.
+func (s *Service) runDueQueries(ctx context.Context, now time.Time) {
+	// Every replica sees the same queries; one sweep is enough
+	releaseSweep, err := tryLock("saved-query-sweep", config.Cluster.LockTTL)
+	if err != nil {
+		if err != errLockHeld {
+			slog.Warn("Saved query sweep skipped", "error", err)
+		}
+		return
+	}
+	defer releaseSweep()
+
+	var ids []string
+	savedQueryMutex.Lock()
+	err = refreshSavedQueries()
+	for id, query := range savedQueries {
+		if query.NextRunAt != nil && !query.NextRunAt.After(now) {
+			ids = append(ids, id)
+		}
+	}
+	savedQueryMutex.Unlock()
+	if err != nil {
+		slog.Warn("Saved query sweep skipped", "error", err)
+		return
+	}
+	sort.Strings(ids)
+	var due []SavedQuery
+	for _, id := range ids {
+		if query, ok := claimDueQuery(id, now); ok {
+			due = append(due, query)
+		}
+	}
+
+	for _, query := range due {
+		if ctx.Err() != nil {
+			return
+		}
+		owner := s.users.ByID(query.OwnerID)
+		if owner == nil || !s.active(owner) {
+			slog.Debug("Skipping saved query", "saved_query_id", query.ID, "reason", errOwnerInactive)
+			continue
+		}
+		run := s.askSavedQuery(ctx, query, owner, true, func() bool { return spendQueries(ctx, owner, 1).Allowed })
+		recordSavedQueryRun(query.ID, run)
+		deliverSavedQuery(query, owner, run)
+	}
+}
+
+// claimDueQuery moves a query that is still due to its next run and
+// returns it
+func claimDueQuery(id string, now time.Time) (SavedQuery, bool) {
+	release, err := savedQueryLock(id)
+	if err != nil {
+		return SavedQuery{}, false
+	}
+	defer release()
+	savedQueryMutex.Lock()
+	defer savedQueryMutex.Unlock()
+	if err := refreshSavedQuery(id); err != nil {
+		return SavedQuery{}, false
+	}
+	query, exists := savedQueries[id]
+	if !exists || query.NextRunAt == nil || query.NextRunAt.After(now) {
+		return SavedQuery{}, false
+	}
+	query.NextRunAt = query.Schedule.nextRun(now)
+	if err := persistSavedQuery(query); err != nil {
+		return SavedQuery{}, false
+	}
+	return *query, true
+}
+
+// deliverSavedQuery sends a scheduled answer over the query's channels;
+// failures go to the inbox only
+func deliverSavedQuery(query SavedQuery, owner *User, run SavedQueryRun) {
+	data := map[string]string{"saved_query_id": query.ID}
+	if run.Error != "" {
+		notify(owner.ID, NotificationSavedQuery, query.Name,
+			fmt.Sprintf("Your saved query couldn't run: %s", run.Error), data)
+		return
+	}
+	if slices.Contains(query.Delivery, deliveryInApp) {
+		preview := []rune(run.Answer)
+		if len(preview) > maxDigestPreview {
+			preview = append(preview[:maxDigestPreview], '…')
+		}
+		notify(owner.ID, NotificationSavedQuery, query.Name, string(preview), data)
+	}
+	if slices.Contains(query.Delivery, deliveryEmail) {
+		queueEmail(owner.Email, EmailSavedQuery, config.I18n.DefaultLanguage, map[string]any{
+			"Name":      owner.Name,
+			"QueryName": query.Name,
+			"Question":  query.Question,
+			"Answer":    run.Answer,
+			"Sources":   strings.Join(run.Sources, ", "),
+		})
+	}
+}
+
+// ----------------------------------------------------------------------------
+
+// respondSavedQueryError maps saved query errors to problems
+func respondSavedQueryError(c *gin.Context, err error) {
+	switch err {
+	case errSavedQueryNotFound:
+		respondError(c, http.StatusNotFound, codeNotFound, err.Error())
+	case errTooManySavedQueries:
+		respondError(c, http.StatusConflict, codeConflict, err.Error())
+	default:
+		respondServiceError(c, err)
+	}
+}
+
+// createSavedQuery saves a question for the current user
+func (s *Server) createSavedQuery(c *gin.Context) {
+	var req SavedQueryRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondBindError(c, err)
+		return
+	}
+	query, err := s.svc.CreateSavedQuery(c.MustGet("user").(*User), req)
+	if err != nil {
+		respondSavedQueryError(c, err)
+		return
+	}
+	c.JSON(http.StatusCreated, query)
+}
+
+// listSavedQueries lists the current user's saved queries
+func (s *Server) listSavedQueries(c *gin.Context) {
+	list, err := s.svc.SavedQueries(c.MustGet("user").(*User))
+	if err != nil {
+		respondSavedQueryError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"saved_queries": list, "count": len(list)})
+}
+
+// getSavedQuery shows one of the current user's saved queries with its
+// last run
+func (s *Server) getSavedQuery(c *gin.Context) {
+	query, err := s.svc.SavedQuery(c.Param("id"), c.MustGet("user").(*User))
+	if err != nil {
+		respondSavedQueryError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, query)
+}
+
+// replaceSavedQuery redefines one of the current user's saved queries
+func (s *Server) replaceSavedQuery(c *gin.Context) {
+	var req SavedQueryRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondBindError(c, err)
+		return
+	}
+	query, err := s.svc.ReplaceSavedQuery(c.Param("id"), c.MustGet("user").(*User), req)
+	if err != nil {
+		respondSavedQueryError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, query)
+}
+
+// deleteSavedQuery removes one of the current user's saved queries
+func (s *Server) deleteSavedQuery(c *gin.Context) {
+	id := c.Param("id")
+	if err := s.svc.DeleteSavedQuery(id, c.MustGet("user").(*User)); err != nil {
+		respondSavedQueryError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Saved query deleted", "id": id})
+}
+
+// runSavedQuery runs one of the current user's saved queries now
+func (s *Server) runSavedQuery(c *gin.Context) {
+	user := c.MustGet("user").(*User)
+	run, err := s.svc.RunSavedQuery(c.Request.Context(), c.Param("id"), user, func() bool { return allowQuery(c, user) })
+	if err == errQuotaExceeded {
+		return // allowQuery has answered
+	}
+	if err != nil {
+		respondSavedQueryError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, run)
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestSavedQueryNextRun(t *testing.T) {
+	at := time.Date(2026, 3, 4, 10, 30, 0, 0, time.UTC) // a Wednesday
+	cases := []struct {
+		schedule SavedQuerySchedule
+		want     time.Time
+	}{
+		{SavedQuerySchedule{Frequency: scheduleDaily, Hour: 12}, time.Date(2026, 3, 4, 12, 0, 0, 0, time.UTC)},
+		{SavedQuerySchedule{Frequency: scheduleDaily, Hour: 10}, time.Date(2026, 3, 5, 10, 0, 0, 0, time.UTC)},
+		{SavedQuerySchedule{Frequency: scheduleWeekly, Hour: 9, Weekday: 1}, time.Date(2026, 3, 9, 9, 0, 0, 0, time.UTC)},
+		{SavedQuerySchedule{Frequency: scheduleWeekly, Hour: 11, Weekday: 3}, time.Date(2026, 3, 4, 11, 0, 0, 0, time.UTC)},
+		{SavedQuerySchedule{Frequency: scheduleWeekly, Hour: 10, Weekday: 3}, time.Date(2026, 3, 11, 10, 0, 0, 0, time.UTC)},
+	}
+	for _, tc := range cases {
+		if got := tc.schedule.nextRun(at); got == nil || !got.Equal(tc.want) {
+			t.Errorf("%+v: got %v, want %v", tc.schedule, got, tc.want)
+		}
+	}
+	if got := (SavedQuerySchedule{Frequency: scheduleNone}).nextRun(at); got != nil {
+		t.Errorf("on-demand query scheduled for %v", got)
+	}
+}
+
+// useSavedQueryStore keeps a test's saved queries in a temporary directory
+// and forgets them, and the queries they ran, afterwards
+func useSavedQueryStore(t *testing.T) {
+	t.Helper()
+	savedStore := savedQueryStore
+	savedQueryStore = jobFiles{dir: t.TempDir()}
+	t.Cleanup(func() {
+		savedQueryMutex.Lock()
+		savedQueries, savedQueryStore = make(map[string]*SavedQuery), savedStore
+		savedQueryMutex.Unlock()
+		experimentMutex.Lock()
+		queryHistory, queryIndex = nil, make(map[string]*QueryRecord)
+		experimentMutex.Unlock()
+	})
+}
+
+func TestSavedQueries(t *testing.T) {
+	ts := newTestServer(t)
+	useSavedQueryStore(t)
+	owner, ownerID := ts.register("owner@example.com")
+	other, _ := ts.register("other@example.com")
+	ts.do(http.MethodPost, "/v1/documents/register", owner, `{"filename":"handbook.pdf"}`)
+
+	var sent []StreamQueryRequest
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req StreamQueryRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		sent = append(sent, req)
+		w.Write([]byte(`{"answer":"Parental leave rises to 20 weeks.",` +
+			`"chunks_used":[{"content":"Parental leave: 20 weeks.","source":"handbook.pdf"}]}`))
+	}))
+	defer backend.Close()
+	withConfig(t, func(cfg *Config) { cfg.RAGBackend.URL = backend.URL })
+
+	if w := ts.do(http.MethodPost, "/v1/saved-queries", owner,
+		`{"name":"HR","question":"Summarize new HR policies","schedule":{"frequency":"hourly"}}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("unknown frequency: got %d, want 400", w.Code)
+	}
+	if w := ts.do(http.MethodPost, "/v1/saved-queries", owner,
+		`{"name":"HR","question":"Summarize new HR policies","delivery":["sms"]}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("unknown delivery: got %d, want 400", w.Code)
+	}
+	var query SavedQuery
+	w := ts.do(http.MethodPost, "/v1/saved-queries", owner, `{"name":"HR","question":"Summarize new HR policies",`+
+		`"schedule":{"frequency":"daily","hour":9},"delivery":["in_app","email"]}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create: %d %s", w.Code, w.Body)
+	}
+	decodeJSON(t, w, &query)
+	if query.NextRunAt == nil || query.NextRunAt.Hour() != 9 || !query.NextRunAt.After(time.Now()) || len(query.Delivery) != 2 {
+		t.Fatalf("created: %+v", query)
+	}
+	path := "/v1/saved-queries/" + query.ID
+	if w := ts.do(http.MethodGet, path, other, ""); w.Code != http.StatusNotFound {
+		t.Fatalf("someone else's query: got %d, want 404", w.Code)
+	}
+
+	var run SavedQueryRun
+	decodeJSON(t, ts.do(http.MethodPost, path+"/run", owner, ""), &run)
+	if run.Scheduled || run.Error != "" || run.Answer == "" || len(run.Sources) != 1 {
+		t.Fatalf("run now: %+v", run)
+	}
+	if len(sent) != 1 || len(sent[0].FilterSources) != 1 || sent[0].FilterSources[0] != "handbook.pdf" || sent[0].Search == nil {
+		t.Fatalf("backend requests: %+v", sent)
+	}
+	if len(notifications[ownerID]) != 0 {
+		t.Fatal("running on demand delivered the answer")
+	}
+
+	// The scheduler runs what is due and moves it to its next run
+	due := *query.NextRunAt
+	ts.srv.svc.runDueQueries(context.Background(), due)
+	inbox := notifications[ownerID]
+	if len(inbox) != 1 || inbox[0].Kind != NotificationSavedQuery || inbox[0].Data["saved_query_id"] != query.ID {
+		t.Fatalf("inbox after a scheduled run: %+v", inbox)
+	}
+	decodeJSON(t, ts.do(http.MethodGet, path, owner, ""), &query)
+	if !query.NextRunAt.Equal(due.AddDate(0, 0, 1)) || query.LastRun == nil || !query.LastRun.Scheduled {
+		t.Fatalf("after a scheduled run: %+v", query)
+	}
+	ts.srv.svc.runDueQueries(context.Background(), due)
+	if len(sent) != 2 {
+		t.Fatalf("ran %d times, want 2", len(sent))
+	}
+
+	// Switching to on demand stops the schedule
+	var replaced SavedQuery
+	decodeJSON(t, ts.do(http.MethodPut, path, owner, `{"name":"HR","question":"Summarize new HR policies"}`), &replaced)
+	if replaced.NextRunAt != nil || replaced.Schedule.Frequency != scheduleNone || replaced.Delivery[0] != deliveryInApp {
+		t.Fatalf("replaced: %+v", replaced)
+	}
+
+	// Restarting reloads what was stored
+	savedQueryMutex.Lock()
+	savedQueries = make(map[string]*SavedQuery)
+	savedQueryMutex.Unlock()
+	if err := loadSavedQueries(); err != nil {
+		t.Fatal(err)
+	}
+	var list struct {
+		SavedQueries []SavedQuery `json:"saved_queries"`
+	}
+	decodeJSON(t, ts.do(http.MethodGet, "/v1/saved-queries", owner, ""), &list)
+	if len(list.SavedQueries) != 1 || list.SavedQueries[0].LastRun == nil {
+		t.Fatalf("after reload: %+v", list.SavedQueries)
+	}
+
+	if w := ts.do(http.MethodDelete, path, owner, ""); w.Code != http.StatusOK {
+		t.Fatalf("delete: %d %s", w.Code, w.Body)
+	}
+	if w := ts.do(http.MethodPost, path+"/run", owner, ""); w.Code != http.StatusNotFound {
+		t.Fatalf("running a deleted query: got %d, want 404", w.Code)
+	}
+}
+
+func TestSavedQueriesShared(t *testing.T) {
+	useSharedStore(t)
+	ts := newTestServer(t)
+	useSavedQueryStore(t)
+	owner, _ := ts.register("owner@example.com")
+	ts.do(http.MethodPost, "/v1/documents/register", owner, `{"filename":"handbook.pdf"}`)
+
+	sent := 0
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sent++
+		w.Write([]byte(`{"answer":"Parental leave rises to 20 weeks.",` +
+			`"chunks_used":[{"content":"Parental leave: 20 weeks.","source":"handbook.pdf"}]}`))
+	}))
+	defer backend.Close()
+	withConfig(t, func(cfg *Config) { cfg.RAGBackend.URL = backend.URL })
+
+	// Another replica: nothing local but what the shared store holds
+	otherReplica := func() {
+		savedQueryMutex.Lock()
+		savedQueries = make(map[string]*SavedQuery)
+		savedQueryMutex.Unlock()
+	}
+
+	var query SavedQuery
+	decodeJSON(t, ts.do(http.MethodPost, "/v1/saved-queries", owner,
+		`{"name":"HR","question":"Summarize new HR policies","schedule":{"frequency":"daily","hour":9}}`), &query)
+	otherReplica()
+	var list struct {
+		SavedQueries []SavedQuery `json:"saved_queries"`
+	}
+	decodeJSON(t, ts.do(http.MethodGet, "/v1/saved-queries", owner, ""), &list)
+	if len(list.SavedQueries) != 1 || list.SavedQueries[0].ID != query.ID {
+		t.Fatalf("listed on another replica: %+v", list.SavedQueries)
+	}
+
+	// A due query runs once, whichever replica's scheduler gets to it
+	due := *query.NextRunAt
+	otherReplica()
+	ts.srv.svc.runDueQueries(context.Background(), due)
+	otherReplica()
+	ts.srv.svc.runDueQueries(context.Background(), due)
+	if sent != 1 {
+		t.Fatalf("ran %d times, want 1", sent)
+	}
+	otherReplica()
+	decodeJSON(t, ts.do(http.MethodGet, "/v1/saved-queries/"+query.ID, owner, ""), &query)
+	if !query.NextRunAt.Equal(due.AddDate(0, 0, 1)) || query.LastRun == nil || !query.LastRun.Scheduled {
+		t.Fatalf("after a scheduled run: %+v", query)
+	}
+	if entries, _ := os.ReadDir(savedQueryStore.dir); len(entries) != 0 {
+		t.Fatalf("clustered saved queries written to files: %d", len(entries))
+	}
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ============================================================================
+// Upload Scanning
+// ============================================================================
+//
+// With scanning.provider set, every ingest job has its payload scanned
+// before it is sent to the RAG backend: clamav streams it to a clamd daemon
+// (INSTREAM over TCP) and http posts it to an external scanning API. The
+// scan runs on the job worker, so uploads are still acknowledged at once.
+// A file the scanner flags never reaches the backend: its job is marked
+// blocked, the payload stays in the job store as the quarantined copy, and
+// the owner is notified. Admins review the quarantine under
+// /admin/quarantine and either release a false positive, which queues it
+// again without a scan, or delete it along with the document's claim.
+//
+// A scanner that can't be reached fails the attempt like a backend error,
+// so the job retries and eventually dead-letters rather than skipping the
+// scan. Blocked jobs are not swept by jobs.retention; they wait for an
+// admin. "none", the default, uploads without scanning.
+
+const (
+	scanProviderNone   = "none"
+	scanProviderClamAV = "clamav"
+	scanProviderHTTP   = "http"
+
+	// clamdChunkSize is how much of a file goes in each INSTREAM chunk
+	clamdChunkSize = 64 << 10
+)
+
+// JobBlocked marks an ingest job whose file a scan flagged
+const JobBlocked JobStatus = "blocked"
+
+// NotificationDocumentBlocked tells an owner their upload was quarantined
+const NotificationDocumentBlocked = "document.blocked"
+
+// ScanResult is a scanner's verdict on one file
+type ScanResult struct {
+	Infected bool   `json:"infected"`
+	Threat   string `json:"threat,omitempty"` // signature name, when infected
+}
+
+// Scanner checks a file for malware
+type Scanner interface {
+	Scan(ctx context.Context, filename string, content []byte) (ScanResult, error)
+}
+
+// scanner is nil when scanning is off
+var scanner Scanner
+
+// newScanner builds the configured provider; "none" yields nil
+func newScanner(cfg ScanningConfig) (Scanner, error) {
+	switch cfg.Provider {
+	case scanProviderNone:
+		return nil, nil
+	case scanProviderClamAV:
+		if cfg.ClamAVAddress == "" {
+			return nil, errors.New("clamav_address is required for the clamav provider")
+		}
+		return &clamdScanner{address: cfg.ClamAVAddress}, nil
+	case scanProviderHTTP:
+		if !strings.HasPrefix(cfg.URL, "http://") && !strings.HasPrefix(cfg.URL, "https://") {
+			return nil, errors.New("url must be an http(s) URL for the http provider")
+		}
+		return &httpScanner{url: cfg.URL, token: cfg.Token, client: &http.Client{Timeout: cfg.Timeout}}, nil
+	}
+	return nil, fmt.Errorf("unknown scanning provider %q; expected none, clamav or http", cfg.Provider)
+}
+
+// startScanning installs the configured scanner
+func startScanning() {
+	s, err := newScanner(config.Scanning)
+	if err != nil {
+		fatal("Invalid scanning configuration", "error", err)
+	}
+	scanner = s
+	if s != nil {
+		slog.Info("Upload scanning enabled", "provider", config.Scanning.Provider)
+	}
+}
+
+// scanUpload runs the configured scanner over a job's payload
+func scanUpload(ctx context.Context, filename string, content []byte) (ScanResult, error) {
+	if scanner == nil {
+		return ScanResult{}, nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, config.Scanning.Timeout)
+	defer cancel()
+	result, err := scanner.Scan(ctx, filename, content)
+	if err != nil {
+		return result, fmt.Errorf("scan: %w", err)
+	}
+	if result.Infected && result.Threat == "" {
+		result.Threat = "unknown"
+	}
+	return result, nil
+}
+
+// quarantineJob blocks a job whose payload was flagged, keeping the payload
+// for review; callers hold jobMutex
+func quarantineJob(job *Job, verdict ScanResult) {
+	job.Status = JobBlocked
+	job.Threat = verdict.Threat
+	job.LastError = ""
+	slog.Warn("Upload quarantined", "job_id", job.ID, "file", job.Filename, "user_id", job.UserID, "threat", verdict.Threat)
+	notify(job.UserID, NotificationDocumentBlocked, "Document blocked",
+		fmt.Sprintf("%s was quarantined because a scan found %s; an administrator will review it.", job.Filename, verdict.Threat),
+		map[string]string{"filename": job.Filename, "job_id": job.ID, "threat": verdict.Threat})
+}
+
+// ----------------------------------------------------------------------------
+// ClamAV
+// ----------------------------------------------------------------------------
+
+// clamdScanner streams files to a clamd daemon
+type clamdScanner struct {
+	address string
+}
+
+func (s *clamdScanner) Scan(ctx context.Context, filename string, content []byte) (ScanResult, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", s.address)
+	if err != nil {
+		return ScanResult{}, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	w := bufio.NewWriter(conn)
+	w.WriteString("zINSTREAM\x00")
+	var size [4]byte
+	for len(content) > 0 {
+		chunk := content[:min(len(content), clamdChunkSize)]
+		content = content[len(chunk):]
+		binary.BigEndian.PutUint32(size[:], uint32(len(chunk)))
+		w.Write(size[:])
+		w.Write(chunk)
+	}
+	w.Write([]byte{0, 0, 0, 0})
+	if err := w.Flush(); err != nil {
+		return ScanResult{}, err
+	}
+
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && err != io.EOF {
+		return ScanResult{}, err
+	}
+	return parseClamdReply(strings.TrimRight(reply, "\x00\n"))
+}
+
+// parseClamdReply reads "stream: OK", "stream: <signature> FOUND" or an
+// error
+func parseClamdReply(reply string) (ScanResult, error) {
+	_, verdict, _ := strings.Cut(reply, ": ")
+	switch {
+	case verdict == "OK":
+		return ScanResult{}, nil
+	case strings.HasSuffix(verdict, " FOUND"):
+		return ScanResult{Infected: true, Threat: strings.TrimSuffix(verdict, " FOUND")}, nil
+	}
+	return ScanResult{}, fmt.Errorf("clamd replied %q", reply)
+}
+
+// ----------------------------------------------------------------------------
+// External API
+// ----------------------------------------------------------------------------
+
+// httpScanner posts files to a scanning API that answers with a
+// ScanResult as JSON
+type httpScanner struct {
+	url, token string
+	client     *http.Client
+}
+
+func (s *httpScanner) Scan(ctx context.Context, filename string, content []byte) (ScanResult, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(content))
+	if err != nil {
+		return ScanResult{}, err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("X-Filename", filename)
+	if s.token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.token)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return ScanResult{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return ScanResult{}, fmt.Errorf("scanner returned %s", resp.Status)
+	}
+	var result ScanResult
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&result); err != nil {
+		return ScanResult{}, fmt.Errorf("scanner response: %w", err)
+	}
+	return result, nil
+}
+
+// ----------------------------------------------------------------------------
+// Handlers
+// ----------------------------------------------------------------------------
+
+// quarantinedJob looks up a blocked job; callers hold jobMutex
+func quarantinedJob(c *gin.Context) (*Job, bool) {
+	job, exists := jobs[c.Param("id")]
+	if !exists {
+		respondError(c, http.StatusNotFound, codeNotFound, "Job not found")
+		return nil, false
+	}
+	if job.Status != JobBlocked {
+		respondError(c, http.StatusConflict, codeConflict, "Only blocked jobs are in quarantine")
+		return nil, false
+	}
+	return job, true
+}
+
+// listQuarantine returns blocked jobs, newest first (admin only)
+func listQuarantine(c *gin.Context) {
+	jobMutex.RLock()
+	blocked := make([]Job, 0)
+	for _, job := range jobs {
+		if job.Status == JobBlocked {
+			blocked = append(blocked, *job)
+		}
+	}
+	jobMutex.RUnlock()
+
+	sort.Slice(blocked, func(i, j int) bool { return blocked[i].UpdatedAt.After(blocked[j].UpdatedAt) })
+
+	c.JSON(http.StatusOK, gin.H{
+		"jobs":  blocked,
+		"total": len(blocked),
+	})
+}
+
+// releaseQuarantine queues a blocked file again without scanning it, for
+// false positives (admin only)
+func releaseQuarantine(c *gin.Context) {
+	jobMutex.Lock()
+	job, ok := quarantinedJob(c)
+	if !ok {
+		jobMutex.Unlock()
+		return
+	}
+	if !offerJob(job.ID) {
+		jobMutex.Unlock()
+		respondServiceError(c, errQueueFull)
+		return
+	}
+	before := *job
+	job.Status = JobQueued
+	job.Attempts = 0
+	job.ScanSkipped = true
+	job.UpdatedAt = time.Now()
+	persistJob(job)
+	after := *job
+	jobMutex.Unlock()
+
+	auditChange(c, "document.quarantine.release", "document:"+job.Filename, before, after)
+	c.JSON(http.StatusAccepted, gin.H{"message": "Job re-queued without scanning", "job_id": job.ID})
+}
+
+// deleteQuarantine discards a blocked file and, unless a later upload
+// replaced it, the owner's claim on its filename (admin only)
+func (s *Server) deleteQuarantine(c *gin.Context) {
+	jobMutex.Lock()
+	job, ok := quarantinedJob(c)
+	if !ok {
+		jobMutex.Unlock()
+		return
+	}
+	snapshot := *job
+	delete(jobs, job.ID)
+	jobStore.remove(job.ID)
+	replaced := false
+	for _, other := range jobs {
+		if other.Filename == snapshot.Filename && other.Status != JobBlocked {
+			replaced = true
+			break
+		}
+	}
+	jobMutex.Unlock()
+
+	if !replaced {
+		if err := s.svc.ReleaseDocument(snapshot.Filename, c.MustGet("user").(*User)); err != nil && err != errDocumentNotFound {
+			slog.Warn("Quarantined document not released", "file", snapshot.Filename, "error", err)
+		}
+	}
+	auditChange(c, "document.quarantine.delete", "document:"+snapshot.Filename, snapshot, nil)
+	c.JSON(http.StatusOK, gin.H{"message": "Quarantined file deleted", "job_id": snapshot.ID, "filename": snapshot.Filename})
+}
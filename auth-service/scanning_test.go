@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// fakeClamd answers one INSTREAM session, flagging content with "EICAR"
+func fakeClamd(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			command := make([]byte, len("zINSTREAM\x00"))
+			io.ReadFull(conn, command)
+			var content []byte
+			for {
+				var size uint32
+				if binary.Read(conn, binary.BigEndian, &size) != nil || size == 0 {
+					break
+				}
+				chunk := make([]byte, size)
+				io.ReadFull(conn, chunk)
+				content = append(content, chunk...)
+			}
+			reply := "stream: OK\x00"
+			if string(command) != "zINSTREAM\x00" {
+				reply = "UNKNOWN COMMAND\x00"
+			} else if bytes.Contains(content, []byte("EICAR")) {
+				reply = "stream: Eicar-Test-Signature FOUND\x00"
+			}
+			conn.Write([]byte(reply))
+			conn.Close()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestClamdScanner(t *testing.T) {
+	s := &clamdScanner{address: fakeClamd(t)}
+	clean := bytes.Repeat([]byte("a"), clamdChunkSize+10) // spans two chunks
+	if result, err := s.Scan(context.Background(), "a.txt", clean); err != nil || result.Infected {
+		t.Fatalf("clean file: %+v, %v", result, err)
+	}
+	result, err := s.Scan(context.Background(), "b.txt", append(clean, "EICAR"...))
+	if err != nil || !result.Infected || result.Threat != "Eicar-Test-Signature" {
+		t.Fatalf("infected file: %+v, %v", result, err)
+	}
+	if _, err := parseClamdReply("stream: Size limit exceeded. ERROR"); err == nil {
+		t.Error("clamd error reply accepted")
+	}
+}
+
+func TestNewScanner(t *testing.T) {
+	cfg := config.Scanning
+	if s, err := newScanner(cfg); s != nil || err != nil {
+		t.Fatalf("none: %v, %v", s, err)
+	}
+	cfg.Provider = scanProviderHTTP
+	if _, err := newScanner(cfg); err == nil {
+		t.Error("http without a URL accepted")
+	}
+	cfg.Provider = "antivirus"
+	if _, err := newScanner(cfg); err == nil {
+		t.Error("unknown provider accepted")
+	}
+}
+
+func TestQuarantine(t *testing.T) {
+	ts := newTestServer(t)
+	admin := ts.admin("admin@example.com")
+	owner, ownerID := ts.register("owner@example.com")
+
+	var uploads atomic.Int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { uploads.Add(1) }))
+	defer backend.Close()
+	scanAPI := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if strings.Contains(string(body), "EICAR") {
+			w.Write([]byte(`{"infected":true,"threat":"Eicar-Test-Signature"}`))
+			return
+		}
+		w.Write([]byte(`{"infected":false}`))
+	}))
+	defer scanAPI.Close()
+	withConfig(t, func(cfg *Config) {
+		cfg.RAGBackend.URL = backend.URL
+		cfg.Scanning.Provider, cfg.Scanning.URL = scanProviderHTTP, scanAPI.URL
+	})
+	savedScanner, savedStore := scanner, jobStore
+	t.Cleanup(func() { scanner, jobStore = savedScanner, savedStore })
+	scanner, _ = newScanner(config.Scanning)
+	jobStore = jobFiles{dir: t.TempDir()}
+
+	// ingest queues a file for the owner and runs its job once
+	ingest := func(filename, content string) Job {
+		t.Helper()
+		ts.do(http.MethodPost, "/v1/documents/register", owner, `{"filename":"`+filename+`"}`)
+		job, err := enqueueIngestJob(ownerID, filename, "text/plain", []byte(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { jobMutex.Lock(); delete(jobs, job.ID); jobMutex.Unlock() })
+		runJob(<-jobQueue)
+		return job
+	}
+	status := func(id string) Job {
+		jobMutex.RLock()
+		defer jobMutex.RUnlock()
+		return *jobs[id]
+	}
+
+	if job := ingest("clean.txt", "quarterly numbers"); status(job.ID).Status != JobSucceeded {
+		t.Fatalf("clean upload: %+v", status(job.ID))
+	}
+	blocked := ingest("infected.txt", "X5O!P%@AP EICAR")
+	if got := status(blocked.ID); got.Status != JobBlocked || got.Threat != "Eicar-Test-Signature" || uploads.Load() != 1 {
+		t.Fatalf("infected upload: %+v, %d uploads", got, uploads.Load())
+	}
+	var inbox struct {
+		Notifications []Notification `json:"notifications"`
+	}
+	decodeJSON(t, ts.do(http.MethodGet, "/v1/users/me/notifications", owner, ""), &inbox)
+	if len(inbox.Notifications) == 0 || inbox.Notifications[0].Kind != NotificationDocumentBlocked {
+		t.Fatalf("owner not notified: %+v", inbox.Notifications)
+	}
+
+	var quarantine struct {
+		Jobs []Job `json:"jobs"`
+	}
+	if w := ts.do(http.MethodGet, "/v1/admin/quarantine", owner, ""); w.Code != http.StatusForbidden {
+		t.Fatalf("member lists quarantine: got %d, want 403", w.Code)
+	}
+	decodeJSON(t, ts.do(http.MethodGet, "/v1/admin/quarantine", admin, ""), &quarantine)
+	if len(quarantine.Jobs) != 1 || quarantine.Jobs[0].ID != blocked.ID {
+		t.Fatalf("quarantine: %+v", quarantine.Jobs)
+	}
+
+	// A released false positive is processed without another scan
+	if w := ts.do(http.MethodPost, "/v1/admin/quarantine/"+blocked.ID+"/release", admin, ""); w.Code != http.StatusAccepted {
+		t.Fatalf("release: %d %s", w.Code, w.Body)
+	}
+	runJob(<-jobQueue)
+	if got := status(blocked.ID); got.Status != JobSucceeded || !got.ScanSkipped || uploads.Load() != 2 {
+		t.Fatalf("released upload: %+v, %d uploads", got, uploads.Load())
+	}
+	if w := ts.do(http.MethodDelete, "/v1/admin/quarantine/"+blocked.ID, admin, ""); w.Code != http.StatusConflict {
+		t.Fatalf("delete a job not in quarantine: got %d, want 409", w.Code)
+	}
+
+	// Deleting discards the file and the owner's claim on its name
+	again := ingest("again.txt", "EICAR")
+	if w := ts.do(http.MethodDelete, "/v1/admin/quarantine/"+again.ID, admin, ""); w.Code != http.StatusOK {
+		t.Fatalf("delete: %d %s", w.Code, w.Body)
+	}
+	if w := ts.do(http.MethodGet, "/v1/jobs/"+again.ID, admin, ""); w.Code != http.StatusNotFound {
+		t.Fatalf("deleted job still there: %d", w.Code)
+	}
+	if slices.Contains(ts.srv.svc.DocumentsOf(ownerID), "again.txt") {
+		t.Fatal("claim on a deleted quarantined file kept")
+	}
+}
@@ -0,0 +1,431 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ============================================================================
+// Search Settings
+// ============================================================================
+//
+// How the backend retrieves chunks for a collection: the share of BM25
+// keyword scoring in its hybrid score (the rest is vector similarity) and
+// an optional reranking model over the top candidates. search.* holds the
+// defaults; PUT /admin/search/:collection gives a collection (a document
+// tag, as in chunking.go) its own. Rerankers must be listed under
+// search.rerankers, the models the backend has loaded.
+//
+// Every change to a collection is a new version, including going back to
+// the defaults (DELETE) and restoring an earlier version (POST
+// .../rollback), so the history shows what was in effect when. GET and PUT
+// carry an ETag of the current version; PUT and DELETE honour If-Match so
+// two admins editing at once don't overwrite each other.
+//
+// A query names its collection with "collection"; the gateway sends the
+// collection's settings and their version with it (stream.go), and
+// evaluation runs record them in their pipeline. Other gateways read them
+// from GET /internal/search. Settings are kept in search.store_file, or in
+// the shared store in cluster mode so every replica searches a collection
+// the same way.
+
+const (
+	// searchSetting names the collections' versions in the shared store
+	searchSetting = "search"
+
+	maxRerankTopN     = 100
+	defaultRerankTopN = 20 // candidates reranked when a setting names a reranker without rerank_top_n
+)
+
+var errSearchVersionNotFound = errors.New("Search settings version not found")
+
+// searchError explains why settings were refused
+type searchError struct {
+	Reason string
+}
+
+func (e *searchError) Error() string {
+	return "Invalid search settings: " + e.Reason
+}
+
+// SearchSettings say how the backend ranks chunks
+type SearchSettings struct {
+	KeywordWeight float64 `json:"keyword_weight" yaml:"keyword_weight"`       // BM25's share of the hybrid score, 0 to 1
+	Reranker      string  `json:"reranker,omitempty" yaml:"reranker"`         // one of search.rerankers; empty skips reranking
+	RerankTopN    int     `json:"rerank_top_n,omitempty" yaml:"rerank_top_n"` // candidates the reranker scores
+}
+
+// SearchVersion is one change to a collection's settings
+type SearchVersion struct {
+	Version   int             `json:"version"`
+	Settings  *SearchSettings `json:"settings"` // null when the collection went back to the defaults
+	Note      string          `json:"note,omitempty"`
+	ChangedBy string          `json:"changed_by"`
+	ChangedAt time.Time       `json:"changed_at"`
+}
+
+// SearchSettingsRequest for PUT /admin/search/:collection
+type SearchSettingsRequest struct {
+	SearchSettings
+	Note string `json:"note,omitempty" binding:"max=200"`
+}
+
+// SearchRollbackRequest for POST /admin/search/:collection/rollback
+type SearchRollbackRequest struct {
+	Version int    `json:"version" binding:"required,min=1"`
+	Note    string `json:"note,omitempty" binding:"max=200"`
+}
+
+// QuerySearch is what a query is searched with
+type QuerySearch struct {
+	SearchSettings
+	Collection string `json:"collection,omitempty"`
+	Version    int    `json:"version"` // of the collection's settings; 0 for the defaults
+}
+
+var (
+	searchHistory = make(map[string][]SearchVersion) // collection -> versions, oldest first
+	searchMutex   sync.Mutex
+)
+
+// normalize fills in rerank_top_n for a reranker
+func (s SearchSettings) normalize() SearchSettings {
+	if s.Reranker != "" && s.RerankTopN == 0 {
+		s.RerankTopN = defaultRerankTopN
+	}
+	return s
+}
+
+// check validates settings against the loaded rerankers
+func (s SearchSettings) check(rerankers []string) error {
+	if s.KeywordWeight < 0 || s.KeywordWeight > 1 {
+		return &searchError{Reason: "keyword_weight must be between 0 and 1"}
+	}
+	if s.Reranker == "" {
+		if s.RerankTopN != 0 {
+			return &searchError{Reason: "rerank_top_n needs a reranker"}
+		}
+		return nil
+	}
+	if !slices.Contains(rerankers, s.Reranker) {
+		if len(rerankers) == 0 {
+			return &searchError{Reason: "no rerankers are configured"}
+		}
+		return &searchError{Reason: fmt.Sprintf("reranker must be one of %s", strings.Join(rerankers, ", "))}
+	}
+	if s.RerankTopN < 1 || s.RerankTopN > maxRerankTopN {
+		return &searchError{Reason: fmt.Sprintf("rerank_top_n must be between 1 and %d", maxRerankTopN)}
+	}
+	return nil
+}
+
+// defaultSearch is search.keyword_weight, reranker and rerank_top_n
+func defaultSearch() SearchSettings {
+	return SearchSettings{
+		KeywordWeight: config.Search.KeywordWeight,
+		Reranker:      config.Search.Reranker,
+		RerankTopN:    config.Search.RerankTopN,
+	}.normalize()
+}
+
+func normalizeCollection(collection string) string {
+	return strings.ToLower(strings.TrimSpace(collection))
+}
+
+// startSearchSettings loads the stored versions
+func startSearchSettings() {
+	if err := loadSearchSettings(); err != nil {
+		fatal("Failed to load search settings", "file", config.Search.StoreFile, "error", err)
+	}
+}
+
+// loadSearchSettings reads the versions from the shared store when
+// clustered, otherwise from search.store_file
+func loadSearchSettings() error {
+	if clustered() {
+		return refreshSetting(context.Background(), searchSetting)
+	}
+	data, err := os.ReadFile(config.Search.StoreFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return applySearchSetting(data)
+}
+
+// applySearchSetting replaces this replica's copy of the versions
+func applySearchSetting(data []byte) error {
+	history := make(map[string][]SearchVersion)
+	if err := json.Unmarshal(data, &history); err != nil {
+		return err
+	}
+	searchMutex.Lock()
+	searchHistory = history
+	searchMutex.Unlock()
+	return nil
+}
+
+// storeSearchSettings writes every collection's versions where
+// loadSearchSettings reads them
+func storeSearchSettings(history map[string][]SearchVersion) error {
+	data, err := json.Marshal(history)
+	if err != nil {
+		return err
+	}
+	if clustered() {
+		return saveSharedSetting(searchSetting, data)
+	}
+	if dir := filepath.Dir(config.Search.StoreFile); dir != "." {
+		err = os.MkdirAll(dir, 0o700)
+	}
+	if err == nil {
+		err = jobFiles{}.write(config.Search.StoreFile, data)
+	}
+	if err != nil {
+		slog.Error("Search settings write failed", "file", config.Search.StoreFile, "error", err)
+	}
+	return err
+}
+
+// currentSearch returns a collection's latest version, if any; callers
+// hold searchMutex
+func currentSearch(collection string) (SearchVersion, bool) {
+	versions := searchHistory[collection]
+	if len(versions) == 0 {
+		return SearchVersion{}, false
+	}
+	return versions[len(versions)-1], true
+}
+
+// searchFor resolves what a query in a collection is searched with
+func searchFor(collection string) QuerySearch {
+	collection = normalizeCollection(collection)
+	search := QuerySearch{SearchSettings: defaultSearch(), Collection: collection}
+	searchMutex.Lock()
+	defer searchMutex.Unlock()
+	if current, ok := currentSearch(collection); ok {
+		search.Version = current.Version
+		if current.Settings != nil {
+			search.SearchSettings = *current.Settings
+		}
+	}
+	return search
+}
+
+func searchETag(collection string, version int) string {
+	return makeETag("search", collection, version)
+}
+
+// changeSearch adds a version to a collection unless ifMatch is stale; it
+// returns the new version, or the current one's ETag if ifMatch failed.
+// Changes are made one writer at a time, starting from the shared store's
+// copy when clustered, and a failed save changes nothing.
+func changeSearch(collection, ifMatch string, settings *SearchSettings, note, actor string) (SearchVersion, string, bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), config.Cluster.LockTTL)
+	defer cancel()
+	release, err := acquireLock(ctx, searchSetting, config.Cluster.LockTTL)
+	if err != nil {
+		slog.Error("Search settings lock failed", "error", err)
+		return SearchVersion{}, "", false, errStoreUnavailable
+	}
+	defer release()
+	if clustered() {
+		if err := refreshSetting(ctx, searchSetting); err != nil {
+			slog.Error("Cluster store read failed", "op", "search_settings", "error", err)
+			return SearchVersion{}, "", false, errStoreUnavailable
+		}
+	}
+
+	searchMutex.Lock()
+	defer searchMutex.Unlock()
+	current, _ := currentSearch(collection)
+	etag := searchETag(collection, current.Version)
+	if ifMatch != "" && !etagMatches(ifMatch, etag, false) {
+		return SearchVersion{}, etag, false, nil
+	}
+	version := SearchVersion{
+		Version:   current.Version + 1,
+		Settings:  settings,
+		Note:      note,
+		ChangedBy: actor,
+		ChangedAt: time.Now().UTC(),
+	}
+	changed := maps.Clone(searchHistory)
+	changed[collection] = append(slices.Clone(changed[collection]), version)
+	if err := storeSearchSettings(changed); err != nil {
+		return SearchVersion{}, etag, false, err
+	}
+	searchHistory = changed
+	return version, searchETag(collection, version.Version), true, nil
+}
+
+// ----------------------------------------------------------------------------
+// Handlers
+// ----------------------------------------------------------------------------
+
+// respondSearchError maps search errors to problems
+func respondSearchError(c *gin.Context, err error) {
+	var invalid *searchError
+	switch {
+	case errors.As(err, &invalid):
+		respondProblem(c, Problem{
+			Status:     http.StatusBadRequest,
+			Code:       codeInvalidRequest,
+			Detail:     "Invalid search settings",
+			Extensions: map[string]interface{}{"reason": invalid.Reason},
+		})
+	case err == errSearchVersionNotFound:
+		respondError(c, http.StatusNotFound, codeNotFound, err.Error())
+	default:
+		respondServiceError(c, err)
+	}
+}
+
+// respondSearchChange answers a change, or 412 if If-Match was stale
+func respondSearchChange(c *gin.Context, collection string, before QuerySearch, version SearchVersion, etag string, ok bool, err error) {
+	if err != nil {
+		respondSearchError(c, err)
+		return
+	}
+	c.Header("ETag", etag)
+	if !ok {
+		respondError(c, http.StatusPreconditionFailed, codePreconditionFailed,
+			"Resource has changed since it was fetched; reload and try again")
+		return
+	}
+	after := searchFor(collection)
+	auditChange(c, "search.changed", "search:"+collection, before, after)
+	c.JSON(http.StatusOK, gin.H{"search": after, "version": version})
+}
+
+// getSearchSettings shows the defaults, the collections with their own
+// settings and the rerankers on offer (admin)
+func getSearchSettings(c *gin.Context) {
+	searchMutex.Lock()
+	collections := make([]string, 0, len(searchHistory))
+	for collection := range searchHistory {
+		collections = append(collections, collection)
+	}
+	searchMutex.Unlock()
+	sort.Strings(collections)
+
+	current := make([]QuerySearch, 0, len(collections))
+	for _, collection := range collections {
+		current = append(current, searchFor(collection))
+	}
+	rerankers := config.Search.Rerankers
+	if rerankers == nil {
+		rerankers = []string{}
+	}
+	c.JSON(http.StatusOK, gin.H{"defaults": defaultSearch(), "collections": current, "rerankers": rerankers})
+}
+
+// getCollectionSearch shows a collection's settings and their versions,
+// newest first (admin)
+func getCollectionSearch(c *gin.Context) {
+	collection := normalizeCollection(c.Param("collection"))
+	search := searchFor(collection)
+	searchMutex.Lock()
+	versions := slices.Clone(searchHistory[collection])
+	searchMutex.Unlock()
+	slices.Reverse(versions)
+	if versions == nil {
+		versions = []SearchVersion{}
+	}
+	if notModified(c, searchETag(collection, search.Version)) {
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"search": search, "versions": versions})
+}
+
+// setCollectionSearch gives a collection its own settings (admin)
+func setCollectionSearch(c *gin.Context) {
+	var req SearchSettingsRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondBindError(c, err)
+		return
+	}
+	settings := req.SearchSettings.normalize()
+	if err := settings.check(config.Search.Rerankers); err != nil {
+		respondSearchError(c, err)
+		return
+	}
+	collection := normalizeCollection(c.Param("collection"))
+	before := searchFor(collection)
+	version, etag, ok, err := changeSearch(collection, c.GetHeader("If-Match"), &settings, req.Note, c.MustGet("user").(*User).ID)
+	respondSearchChange(c, collection, before, version, etag, ok, err)
+}
+
+// resetCollectionSearch puts a collection back on the defaults as a new
+// version (admin)
+func resetCollectionSearch(c *gin.Context) {
+	collection := normalizeCollection(c.Param("collection"))
+	before := searchFor(collection)
+	version, etag, ok, err := changeSearch(collection, c.GetHeader("If-Match"), nil, "", c.MustGet("user").(*User).ID)
+	respondSearchChange(c, collection, before, version, etag, ok, err)
+}
+
+// rollbackCollectionSearch restores an earlier version's settings as a new
+// version (admin)
+func rollbackCollectionSearch(c *gin.Context) {
+	var req SearchRollbackRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondBindError(c, err)
+		return
+	}
+	collection := normalizeCollection(c.Param("collection"))
+	searchMutex.Lock()
+	var restored *SearchSettings
+	found := false
+	for _, version := range searchHistory[collection] {
+		if version.Version == req.Version {
+			found = true
+			if version.Settings != nil {
+				settings := *version.Settings
+				restored = &settings
+			}
+		}
+	}
+	searchMutex.Unlock()
+	if !found {
+		respondSearchError(c, errSearchVersionNotFound)
+		return
+	}
+	// The rerankers loaded may have changed since
+	if restored != nil {
+		if err := restored.check(config.Search.Rerankers); err != nil {
+			respondSearchError(c, err)
+			return
+		}
+	}
+	note := req.Note
+	if note == "" {
+		note = "Rollback to version " + strconv.Itoa(req.Version)
+	}
+	before := searchFor(collection)
+	version, etag, ok, err := changeSearch(collection, c.GetHeader("If-Match"), restored, note, c.MustGet("user").(*User).ID)
+	respondSearchChange(c, collection, before, version, etag, ok, err)
+}
+
+// internalSearchSettings tells another gateway what to search a collection
+// with; ?collection= is optional
+func internalSearchSettings(c *gin.Context) {
+	c.JSON(http.StatusOK, searchFor(c.Query("collection")))
+}
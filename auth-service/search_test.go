@@ -0,0 +1,134 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSearchSettings(t *testing.T) {
+	ts := newTestServer(t)
+	withConfig(t, func(cfg *Config) {
+		cfg.Auth.InternalAPIToken = testInternalToken
+		cfg.Search.KeywordWeight = 0.3
+		cfg.Search.Rerankers = []string{"cross-encoder"}
+		cfg.Search.StoreFile = filepath.Join(t.TempDir(), "search-settings.json")
+	})
+	t.Cleanup(func() {
+		searchMutex.Lock()
+		searchHistory = make(map[string][]SearchVersion)
+		searchMutex.Unlock()
+	})
+	admin := ts.admin("admin@example.com")
+
+	if w := ts.do(http.MethodPut, "/v1/admin/search/Policies", admin, `{"keyword_weight":0.5,"reranker":"other"}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("unknown reranker: got %d, want 400", w.Code)
+	}
+	if w := ts.do(http.MethodPut, "/v1/admin/search/policies", admin, `{"keyword_weight":1.5}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("keyword weight above 1: got %d, want 400", w.Code)
+	}
+
+	var changed struct {
+		Search  QuerySearch   `json:"search"`
+		Version SearchVersion `json:"version"`
+	}
+	w := ts.do(http.MethodPut, "/v1/admin/search/Policies", admin, `{"keyword_weight":0.5,"reranker":"cross-encoder","note":"more keywords"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("set settings: %d %s", w.Code, w.Body)
+	}
+	decodeJSON(t, w, &changed)
+	if s := changed.Search; s.Collection != "policies" || s.Version != 1 || s.KeywordWeight != 0.5 || s.RerankTopN != defaultRerankTopN {
+		t.Fatalf("settings: %+v", s)
+	}
+	etag := w.Header().Get("ETag")
+
+	ts.do(http.MethodDelete, "/v1/admin/search/policies", admin, "")
+	if w := ts.do(http.MethodPut, "/v1/admin/search/policies", admin, `{"keyword_weight":0.1}`, "If-Match", etag); w.Code != http.StatusPreconditionFailed {
+		t.Fatalf("stale If-Match: got %d, want 412", w.Code)
+	}
+	if got := searchFor("policies"); got.Version != 2 || got.KeywordWeight != 0.3 || got.Reranker != "" {
+		t.Fatalf("after reset: %+v", got)
+	}
+
+	decodeJSON(t, ts.do(http.MethodPost, "/v1/admin/search/policies/rollback", admin, `{"version":1}`), &changed)
+	if changed.Version.Version != 3 || changed.Search.Reranker != "cross-encoder" || changed.Version.Note != "Rollback to version 1" {
+		t.Fatalf("rollback: %+v", changed)
+	}
+	if w := ts.do(http.MethodPost, "/v1/admin/search/policies/rollback", admin, `{"version":9}`); w.Code != http.StatusNotFound {
+		t.Fatalf("rollback to a missing version: got %d, want 404", w.Code)
+	}
+
+	var history struct {
+		Versions []SearchVersion `json:"versions"`
+	}
+	decodeJSON(t, ts.do(http.MethodGet, "/v1/admin/search/policies", admin, ""), &history)
+	if len(history.Versions) != 3 || history.Versions[0].Version != 3 || history.Versions[1].Settings != nil {
+		t.Fatalf("versions: %+v", history.Versions)
+	}
+
+	var internal QuerySearch
+	decodeJSON(t, ts.do(http.MethodGet, "/v1/internal/search?collection=policies", "", "", internalTokenHeader, testInternalToken), &internal)
+	if internal.Version != 3 || internal.KeywordWeight != 0.5 {
+		t.Fatalf("internal settings: %+v", internal)
+	}
+	decodeJSON(t, ts.do(http.MethodGet, "/v1/internal/search", "", "", internalTokenHeader, testInternalToken), &internal)
+	if internal.Version != 0 || internal.KeywordWeight != 0.3 {
+		t.Fatalf("default settings: %+v", internal)
+	}
+
+	// Restarting reloads what was stored
+	searchMutex.Lock()
+	searchHistory = make(map[string][]SearchVersion)
+	searchMutex.Unlock()
+	if err := loadSearchSettings(); err != nil {
+		t.Fatal(err)
+	}
+	if got := searchFor("policies"); got.Version != 3 || got.Reranker != "cross-encoder" {
+		t.Fatalf("after reload: %+v", got)
+	}
+}
+
+func TestSearchSettingsShared(t *testing.T) {
+	useSharedStore(t)
+	ts := newTestServer(t)
+	storeFile := filepath.Join(t.TempDir(), "search-settings.json")
+	withConfig(t, func(cfg *Config) {
+		cfg.Search.StoreFile = storeFile
+	})
+	t.Cleanup(func() {
+		searchMutex.Lock()
+		searchHistory = make(map[string][]SearchVersion)
+		searchMutex.Unlock()
+	})
+	admin := ts.admin("admin@example.com")
+
+	if w := ts.do(http.MethodPut, "/v1/admin/search/policies", admin, `{"keyword_weight":0.5}`); w.Code != http.StatusOK {
+		t.Fatalf("set settings: %d %s", w.Code, w.Body)
+	}
+	if _, err := os.Stat(storeFile); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("clustered settings written to %s: %v", storeFile, err)
+	}
+
+	// Another replica: nothing local but what the shared store holds, and
+	// a change there builds on the first
+	searchMutex.Lock()
+	searchHistory = make(map[string][]SearchVersion)
+	searchMutex.Unlock()
+	if err := loadSearchSettings(); err != nil {
+		t.Fatal(err)
+	}
+	if got := searchFor("policies"); got.Version != 1 || got.KeywordWeight != 0.5 {
+		t.Fatalf("loaded from the shared store: %+v", got)
+	}
+	searchMutex.Lock()
+	searchHistory = make(map[string][]SearchVersion)
+	searchMutex.Unlock()
+	if w := ts.do(http.MethodPut, "/v1/admin/search/policies", admin, `{"keyword_weight":0.7}`, "If-Match", searchETag("policies", 1)); w.Code != http.StatusOK {
+		t.Fatalf("change on another replica: %d %s", w.Code, w.Body)
+	}
+	if got := searchFor("policies"); got.Version != 2 || got.KeywordWeight != 0.7 {
+		t.Fatalf("after the second change: %+v", got)
+	}
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// ============================================================================
+// Secrets Providers
+// ============================================================================
+//
+// Secret settings can be fetched from HashiCorp Vault or AWS Secrets Manager
+// instead of the environment. secrets.refs maps a secret config field to a
+// reference, "path#key" for Vault (KV v1 or v2) or "secret-id#key" for AWS,
+// where #key selects a field of a JSON secret. References are resolved
+// before the configuration is validated and re-fetched every
+// secrets.refresh_interval; a new JWT key takes effect immediately while
+// tokens signed with the previous one stay valid, and new password peppers
+// apply to the next hash (passwords.go).
+
+const (
+	secretsProviderNone  = "none"
+	secretsProviderVault = "vault"
+	secretsProviderAWS   = "aws"
+)
+
+// secretsProvider fetches one secret value by reference
+type secretsProvider interface {
+	fetch(ctx context.Context, ref string) (string, error)
+}
+
+var secretsClient = &http.Client{Timeout: 10 * time.Second}
+
+// newSecretsProvider builds the configured provider, or nil for none
+func newSecretsProvider(cfg SecretsConfig) (secretsProvider, error) {
+	switch cfg.Provider {
+	case secretsProviderVault:
+		return &vaultProvider{addr: strings.TrimRight(cfg.VaultAddr, "/"), token: cfg.VaultToken, namespace: cfg.VaultNamespace}, nil
+	case secretsProviderAWS:
+		// Standard AWS credential variables; instance roles are not supported
+		provider := &awsSecretsProvider{
+			region:       cfg.AWSRegion,
+			accessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+			secretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		}
+		if provider.accessKey == "" || provider.secretKey == "" {
+			return nil, fmt.Errorf("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY are required for the aws secrets provider")
+		}
+		return provider, nil
+	}
+	return nil, nil
+}
+
+// resolveSecrets fetches every reference into cfg
+func resolveSecrets(ctx context.Context, cfg *Config, provider secretsProvider) (map[string]string, error) {
+	values := make(map[string]string, len(cfg.Secrets.Refs))
+	for field, ref := range cfg.Secrets.Refs {
+		target, err := secretField(cfg, field)
+		if err != nil {
+			return nil, err
+		}
+		value, err := provider.fetch(ctx, ref)
+		if err != nil {
+			return nil, fmt.Errorf("secret for %s: %w", field, err)
+		}
+		target.SetString(value)
+		values[field] = value
+	}
+	return values, nil
+}
+
+// secretField finds a config field by its dotted yaml path, e.g.
+// "auth.jwt_secret". Only fields tagged secret may be fetched.
+func secretField(cfg *Config, path string) (reflect.Value, error) {
+	v := reflect.ValueOf(cfg).Elem()
+	parts := strings.Split(path, ".")
+	for i, part := range parts {
+		found := false
+		for j := 0; j < v.NumField(); j++ {
+			meta := v.Type().Field(j)
+			if strings.Split(meta.Tag.Get("yaml"), ",")[0] != part {
+				continue
+			}
+			v, found = v.Field(j), true
+			if i == len(parts)-1 && (meta.Tag.Get("secret") != "true" || v.Kind() != reflect.String) {
+				return reflect.Value{}, fmt.Errorf("secrets.refs: %s is not a secret setting", path)
+			}
+			break
+		}
+		if !found || (i < len(parts)-1 && v.Kind() != reflect.Struct) {
+			return reflect.Value{}, fmt.Errorf("secrets.refs: unknown setting %s", path)
+		}
+	}
+	return v, nil
+}
+
+// startSecretsRefresh re-fetches references periodically. The JWT key and
+// password peppers rotate in place; other settings are read once, so
+// changes to them are logged and take effect on restart.
+func startSecretsRefresh(provider secretsProvider, initial map[string]string) {
+	interval := config.Secrets.RefreshInterval
+	if provider == nil || interval == 0 || len(config.Secrets.Refs) == 0 {
+		return
+	}
+
+	goBackground(func(ctx context.Context) {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		current := initial
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			for field, ref := range config.Secrets.Refs {
+				fetchCtx, cancel := context.WithTimeout(ctx, secretsClient.Timeout)
+				value, err := provider.fetch(fetchCtx, ref)
+				cancel()
+				if err != nil {
+					slog.Warn("Secret refresh failed; keeping current value", "setting", field, "error", err)
+					continue
+				}
+				if value == current[field] {
+					continue
+				}
+				current[field] = value
+
+				if field == "auth.jwt_secret" {
+					if gin.Mode() == gin.ReleaseMode && len(value) < minJWTSecretLength {
+						slog.Warn("Fetched JWT secret is too short; not rotating")
+						continue
+					}
+					signingKeys.rotate([]byte(value))
+					slog.Info("JWT signing key rotated", "kid", signingKeys.currentID())
+				} else if field == "passwords.peppers" {
+					set, err := parsePeppers(value, config.Passwords.PepperID)
+					if err != nil || set == nil {
+						slog.Warn("Fetched password peppers are invalid; keeping the current ones", "error", err)
+						continue
+					}
+					peppers.Store(set)
+					slog.Info("Password peppers updated", "current", set.current)
+				} else {
+					slog.Warn("Secret changed; restart to apply", "setting", field)
+				}
+			}
+		}
+	})
+}
+
+// splitSecretRef separates "path#key" into its parts
+func splitSecretRef(ref string) (path, key string) {
+	path, key, _ = strings.Cut(ref, "#")
+	return path, key
+}
+
+// pickSecretKey returns the named field of a secret, or its only field
+func pickSecretKey(fields map[string]interface{}, key string) (string, error) {
+	if key == "" {
+		if len(fields) == 1 {
+			for _, value := range fields {
+				if s, ok := value.(string); ok {
+					return s, nil
+				}
+			}
+		}
+		return "", fmt.Errorf("secret has several fields; name one with #key")
+	}
+	value, ok := fields[key].(string)
+	if !ok {
+		return "", fmt.Errorf("secret has no string field %q", key)
+	}
+	return value, nil
+}
+
+// ----------------------------------------------------------------------------
+// HashiCorp Vault
+// ----------------------------------------------------------------------------
+
+type vaultProvider struct {
+	addr, token, namespace string
+}
+
+func (p *vaultProvider) fetch(ctx context.Context, ref string) (string, error) {
+	path, key := splitSecretRef(ref)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.addr+"/v1/"+strings.TrimPrefix(path, "/"), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Vault-Token", p.token)
+	if p.namespace != "" {
+		req.Header.Set("X-Vault-Namespace", p.namespace)
+	}
+
+	resp, err := secretsClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("vault returned %s for %s", resp.Status, path)
+	}
+
+	var body struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("decode vault response: %w", err)
+	}
+	fields := body.Data
+	// KV v2 nests the secret under data.data
+	if nested, ok := fields["data"].(map[string]interface{}); ok {
+		if _, versioned := fields["metadata"]; versioned {
+			fields = nested
+		}
+	}
+	return pickSecretKey(fields, key)
+}
+
+// ----------------------------------------------------------------------------
+// AWS Secrets Manager
+// ----------------------------------------------------------------------------
+
+type awsSecretsProvider struct {
+	region                             string
+	accessKey, secretKey, sessionToken string
+}
+
+func (p *awsSecretsProvider) fetch(ctx context.Context, ref string) (string, error) {
+	secretID, key := splitSecretRef(ref)
+	body, _ := json.Marshal(map[string]string{"SecretId": secretID})
+
+	endpoint := "https://secretsmanager." + p.region + ".amazonaws.com/"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "secretsmanager.GetSecretValue")
+	bodyHash := sha256.Sum256(body)
+	signAWSRequest(req, "secretsmanager", p.region, p.accessKey, p.secretKey, p.sessionToken,
+		hex.EncodeToString(bodyHash[:]), time.Now().UTC())
+
+	resp, err := secretsClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		detail, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return "", fmt.Errorf("secrets manager returned %s: %s", resp.Status, detail)
+	}
+
+	var out struct {
+		SecretString string `json:"SecretString"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return "", fmt.Errorf("decode secrets manager response: %w", err)
+	}
+	if key == "" {
+		return out.SecretString, nil
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal([]byte(out.SecretString), &fields); err != nil {
+		return "", fmt.Errorf("secret %s is not JSON, so #%s cannot be selected", secretID, key)
+	}
+	return pickSecretKey(fields, key)
+}
+
+// ----------------------------------------------------------------------------
+// JWT signing keys
+// ----------------------------------------------------------------------------
+
+// keyRing holds the current JWT signing key and the one before it. Tokens
+// carry the key ID in their kid header.
+type keyRing struct {
+	mu       sync.RWMutex
+	current  []byte
+	previous []byte
+}
+
+var signingKeys keyRing
+
+func jwtKeyID(key []byte) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:4])
+}
+
+// rotate makes key current, keeping the old key for verification
+func (k *keyRing) rotate(key []byte) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.current != nil {
+		k.previous = k.current
+	}
+	k.current = key
+	forgetAllTokens()
+}
+
+func (k *keyRing) currentID() string {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return jwtKeyID(k.current)
+}
+
+// sign signs a token with the current key
+func (k *keyRing) sign(token *jwt.Token) (string, error) {
+	k.mu.RLock()
+	key := k.current
+	k.mu.RUnlock()
+
+	token.Header["kid"] = jwtKeyID(key)
+	return token.SignedString(key)
+}
+
+// verificationKey returns the key a token names; tokens without a kid
+// predate rotation and use the current key
+func (k *keyRing) verificationKey(token *jwt.Token) (interface{}, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	kid, _ := token.Header["kid"].(string)
+	switch {
+	case kid == "" || kid == jwtKeyID(k.current):
+		return k.current, nil
+	case k.previous != nil && kid == jwtKeyID(k.previous):
+		return k.previous, nil
+	}
+	return nil, jwt.ErrTokenUnverifiable
+}
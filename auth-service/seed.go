@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"gopkg.in/yaml.v3"
+)
+
+// ============================================================================
+// Seed Data
+// ============================================================================
+//
+// With seed.file set, the accounts listed there are created at startup.
+// Otherwise the first boot creates a single admin with a random password,
+// printed once to stderr and never logged. Set seed.enabled to false to
+// start with an empty store.
+
+// SeedUser is one account in a seed file. Give either a bcrypt or argon2id
+// password_hash or, for local development only, a plaintext password.
+type SeedUser struct {
+	Email        string `yaml:"email"`
+	Name         string `yaml:"name"`
+	Role         string `yaml:"role"`
+	Password     string `yaml:"password"`
+	PasswordHash string `yaml:"password_hash"`
+}
+
+// SeedFile is the layout of seed.file
+type SeedFile struct {
+	Users []SeedUser `yaml:"users"`
+}
+
+// seedUsers populates the user store according to the seed configuration
+func seedUsers() error {
+	if !config.Seed.Enabled {
+		slog.Info("Seeding disabled; starting with no users")
+		return nil
+	}
+
+	// Replicas starting together seed one at a time, each seeing what the
+	// previous one created
+	ctx, cancel := context.WithTimeout(context.Background(), config.Cluster.LockTTL)
+	defer cancel()
+	release, err := acquireLock(ctx, "seed", config.Cluster.LockTTL)
+	if err != nil {
+		return err
+	}
+	defer release()
+	if clustered() {
+		if err := resyncShared(ctx); err != nil {
+			return err
+		}
+	}
+
+	if config.Seed.File != "" {
+		return seedFromFile(config.Seed.File)
+	}
+	return bootstrapAdmin()
+}
+
+// seedFromFile creates every account listed in a seed file
+func seedFromFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("read seed file: %w", err)
+	}
+	var file SeedFile
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("parse seed file %s: %w", path, err)
+	}
+
+	seen := make(map[string]bool, len(file.Users))
+	created := 0
+	for i, seed := range file.Users {
+		seed.Email = strings.TrimSpace(seed.Email)
+		if seed.Email == "" {
+			return fmt.Errorf("seed user %d: email is required", i)
+		}
+		if seed.Role == "" {
+			seed.Role = "user"
+		}
+		if seed.Role != "user" && seed.Role != "admin" {
+			return fmt.Errorf("seed user %s: role must be user or admin", seed.Email)
+		}
+
+		hash := seed.PasswordHash
+		switch {
+		case hash != "":
+			if err := checkPasswordHash(hash); err != nil {
+				return fmt.Errorf("seed user %s: password_hash: %w", seed.Email, err)
+			}
+		case seed.Password != "":
+			hashed, err := hashPassword(seed.Password)
+			if err != nil {
+				return fmt.Errorf("seed user %s: %w", seed.Email, err)
+			}
+			hash = hashed
+		default:
+			return fmt.Errorf("seed user %s: password or password_hash is required", seed.Email)
+		}
+
+		if seen[seed.Email] {
+			return fmt.Errorf("seed user %s: listed twice", seed.Email)
+		}
+		seen[seed.Email] = true
+		added, err := addSeedUser(seed.Email, hash, seed.Name, seed.Role)
+		if err != nil {
+			return fmt.Errorf("seed user %s: %w", seed.Email, err)
+		}
+		if !added {
+			// Created by another replica or an earlier start
+			slog.Info("Seed user already exists", "email", seed.Email)
+			continue
+		}
+		created++
+	}
+
+	slog.Info("Seeded users from file", "file", path, "count", created)
+	return nil
+}
+
+// bootstrapAdmin creates the first admin with a random password when the
+// store is empty
+func bootstrapAdmin() error {
+	if localUsers.Count() > 0 {
+		return nil
+	}
+
+	password, err := generatePassword()
+	if err != nil {
+		return fmt.Errorf("generate admin password: %w", err)
+	}
+	hash, err := hashPassword(password)
+	if err != nil {
+		return fmt.Errorf("hash admin password: %w", err)
+	}
+
+	email := config.Seed.AdminEmail
+	if _, err := addSeedUser(email, hash, "Admin User", "admin"); err != nil {
+		return fmt.Errorf("create admin: %w", err)
+	}
+
+	// Deliberately bypasses the logger so the password never reaches log
+	// pipelines as a structured field
+	fmt.Fprintf(os.Stderr, "\n"+
+		"  Bootstrap admin account created (shown once):\n"+
+		"    email:    %s\n"+
+		"    password: %s\n"+
+		"  Store it now; it will not be shown again.\n\n", email, password)
+	slog.Warn("Bootstrap admin created; initial password printed to stderr", "email", email)
+	return nil
+}
+
+// addSeedUser stores an account, reporting false if the email is taken
+func addSeedUser(email, hash, name, role string) (bool, error) {
+	if localUsers.ByEmail(email) != nil {
+		return false, nil
+	}
+	user := &User{
+		ID:        uuid.New().String(),
+		Email:     email,
+		Password:  hash,
+		Name:      name,
+		Role:      role,
+		CreatedAt: time.Now(),
+		UpdatedAt: time.Now(),
+	}
+	switch err := reserveEmail(user.Email, user.ID); err {
+	case nil:
+	case errEmailTaken:
+		return false, nil
+	default:
+		return false, err
+	}
+	if err := saveUser(user); err != nil {
+		releaseEmail(user.Email)
+		return false, err
+	}
+	if _, err := localUsers.Add(user); err != nil {
+		return false, nil
+	}
+	return true, nil
+}
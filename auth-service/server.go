@@ -0,0 +1,423 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ============================================================================
+// HTTP Server
+// ============================================================================
+//
+// A Server is the REST API over one Service: NewServer builds the router
+// and the core auth, user and document handlers are its methods. main
+// serves one over defaultService; tests build as many as they like over
+// empty repositories. Middleware and the remaining subsystems (jobs,
+// connectors, audit, rate limits) are still process-wide.
+
+// Server is the REST API over a Service
+type Server struct {
+	svc    *Service
+	engine *gin.Engine
+}
+
+// NewServer builds the router for svc
+func NewServer(svc *Service) (*Server, error) {
+	// gin trusts X-Forwarded-For from every peer unless told otherwise;
+	// with no proxies configured the client address is the peer's
+	r := gin.New()
+	if err := r.SetTrustedProxies(config.Server.TrustedProxies); err != nil {
+		return nil, fmt.Errorf("invalid trusted proxies: %w", err)
+	}
+	s := &Server{svc: svc, engine: r}
+	r.Use(requestID(), requestLogger(), compressResponses(), recoverPanics())
+
+	// Configured plugins run at fixed points in the chain (plugins.go)
+	early, err := pluginMiddleware(config.Middleware, middlewareStageEarly)
+	if err != nil {
+		return nil, err
+	}
+	late, err := pluginMiddleware(config.Middleware, middlewareStageLate)
+	if err != nil {
+		return nil, err
+	}
+	r.Use(early...)
+
+	// CORS middleware, ahead of the gates below so browsers can read their
+	// 403, 413/415 and maintenance 503 responses
+	r.Use(cors())
+
+	r.Use(denylist(), validateBody(), maintenanceGate())
+
+	r.Use(auditTrail())
+	r.Use(late...)
+
+	r.NoRoute(func(c *gin.Context) {
+		respondError(c, http.StatusNotFound, codeNotFound, "Route not found")
+	})
+
+	// Health check
+	r.GET("/health", func(c *gin.Context) {
+		if shuttingDown.Load() {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"status": "draining", "service": "auth-service"})
+			return
+		}
+		// Stay in the load balancer during maintenance; admins still need it
+		c.JSON(http.StatusOK, gin.H{"status": "healthy", "service": "auth-service", "maintenance": maintenanceOn.Load()})
+	})
+	r.GET("/health/system", getSystemHealth) // This service and its siblings, for a status indicator
+	r.GET("/health/ready", getReadiness)     // Readiness, including the shared store's schema version
+
+	// Versioned API, plus the original unversioned paths as deprecated
+	// aliases for clients that predate /v1
+	v1 := r.Group("/v1", apiVersion("v1"))
+	v1Admin := v1.Group("/admin", adminNetworkOnly(), s.authMiddleware(), requireAdmin())
+	{
+		v1Admin.GET("/audit", listAudit)                          // Query the audit log
+		v1Admin.GET("/audit/export", exportAudit)                 // Download as JSON or CSV
+		v1Admin.GET("/audit/verify", verifyAudit)                 // Check the hash chain
+		v1Admin.GET("/events/stream", streamAdminEvents)          // Live activity feed (Server-Sent Events)
+		v1Admin.GET("/config", getConfig)                         // Effective configuration, secrets masked
+		v1Admin.GET("/network-rules", listNetworkRules)           // IP allow and deny rules
+		v1Admin.GET("/network-rules/banned", listBannedAddresses) // Addresses banned automatically
+		v1Admin.POST("/network-rules", createNetworkRule)         // Add a rule at runtime
+		v1Admin.DELETE("/network-rules/:id", deleteNetworkRule)   // Remove a runtime or automatic rule
+		v1Admin.GET("/maintenance", getMaintenance)               // Maintenance state and drain progress
+		v1Admin.PUT("/maintenance", setMaintenanceMode)           // Turn maintenance mode on or off
+		v1Admin.GET("/logging", getLogging)                       // Log level and verbose modules
+		v1Admin.PUT("/logging", setLogging)                       // Change them without a restart
+		v1Admin.GET("/approvals", s.listApprovals)                // Registrations awaiting approval
+		v1Admin.POST("/approvals", s.decideApproval)              // Approve or deny one
+		v1Admin.GET("/pending-actions", listPendingActions)       // High-risk actions awaiting a second admin
+		v1Admin.POST("/pending-actions", s.decidePendingAction)   // Approve (and run) or reject one
+		v1Admin.GET("/registration", getRegistration)             // Registration mode and allowed email domains
+		v1Admin.PUT("/registration", setRegistration)             // Change them without a restart
+		v1Admin.DELETE("/registration", resetRegistration)        // Back to the configured settings
+		v1Admin.GET("/referrals", s.listReferrals)                // Signups per referral code
+
+		v1Admin.GET("/orgs", s.listOrgs)              // Cost orgs and a month's total for each
+		v1Admin.GET("/orgs/:id/costs", s.getOrgCosts) // An org's monthly cost report, as JSON or CSV
+
+		// Orgs and the email domains that place new accounts in them, in
+		// org mode (orgs.go)
+		v1Admin.POST("/orgs", createOrg)
+		v1Admin.GET("/orgs/:id", s.getOrg)
+		v1Admin.PATCH("/orgs/:id", updateOrgSettings)
+		v1Admin.DELETE("/orgs/:id", s.deleteOrg)
+		v1Admin.POST("/orgs/:id/domains", claimOrgDomain)
+		v1Admin.POST("/orgs/:id/domains/:domain/verify", verifyOrgDomain)
+		v1Admin.DELETE("/orgs/:id/domains/:domain", releaseOrgDomain)
+
+		// Create with a temporary password or an invitation, change name,
+		// email, role or status, or delete. Deleting and granting admin can
+		// be held for a second admin's approval (dualcontrol.go).
+		v1Admin.POST("/users", s.dualControl(dualControlRoleEscalate, requestsAdminRole), s.createUser)
+		v1Admin.PATCH("/users/:id", s.dualControl(dualControlRoleEscalate, requestsAdminRole), s.updateUser)
+		v1Admin.DELETE("/users/:id", s.dualControl(dualControlUserDelete, nil), s.deleteUser)
+
+		// Email an invited user a new link
+		v1Admin.POST("/users/:id/invitation", s.resendInvitation)
+
+		// Unregister, transfer or retag many documents at once
+		v1Admin.POST("/users/:id/documents:bulk", s.dualControl(dualControlBulkUnregister, bulkUnregisters), s.bulkUserDocuments)
+
+		// Fold another account into this one
+		v1Admin.POST("/users/:id/merge", s.dualControl(dualControlUserMerge, mergesForReal), s.mergeUser)
+
+		v1Admin.POST("/exports", s.createExport)             // Export audit, logins or usage for a date range
+		v1Admin.GET("/exports", listExports)                 // Exports and their progress
+		v1Admin.GET("/exports/:id", getExport)               // One export's progress and download link
+		v1Admin.GET("/exports/:id/download", downloadExport) // The generated file
+		v1Admin.DELETE("/exports/:id", deleteExport)         // Delete a finished export early
+
+		// Download an encrypted archive of users and documents, then load
+		// one, or diff it with ?dry_run=true
+		v1Admin.POST("/backup", s.createBackup)
+		v1Admin.POST("/restore", s.dualControl(dualControlRestore, restoresForReal), s.restoreBackup)
+
+		v1Admin.POST("/oauth/clients", registerOAuthClient)            // Register a third-party OAuth client
+		v1Admin.GET("/oauth/clients", listOAuthClients)                // Registered clients
+		v1Admin.DELETE("/oauth/clients/:client_id", deleteOAuthClient) // Remove one
+	}
+	registerDiagnostics(v1Admin)
+	s.registerAPIRoutes(v1)
+	s.registerAPIRoutes(r.Group("", deprecatedAlias(r, "v1")))
+
+	// Batch sub-requests run through the router, so this is versioned only
+	v1.POST("/batch", s.authMiddleware(), batchHandler(r, "v1"))
+
+	// Admin console, a static page over the API above
+	mountAdminUI(r)
+
+	// API docs (registered last so the spec covers every route)
+	mountAPIDocs(r)
+
+	// Decoys go after the docs so the spec doesn't advertise them
+	if err := registerHoneypots(r); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// ServeHTTP makes the Server an http.Handler
+func (s *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	s.engine.ServeHTTP(w, req)
+}
+
+// registerAPIRoutes mounts the API on a version group. Each version gets its
+// own function so a later version can change handlers without touching
+// older ones.
+func (s *Server) registerAPIRoutes(api *gin.RouterGroup) {
+	// Auth routes
+	auth := api.Group("/auth")
+	{
+		auth.POST("/register", rateLimitByIP(authRateLimit), idempotent(), s.register)
+		auth.POST("/login", rateLimitByIP(authRateLimit), s.login)
+		auth.POST("/logout", s.logout)
+		auth.POST("/logout-all", s.authMiddleware(), s.logoutAll)             // Revoke every token the caller holds
+		auth.POST("/refresh", rateLimitByIP(authRateLimit), s.refreshSession) // Renew a remember_me session
+		auth.GET("/verify", s.authMiddleware(), s.verifyToken)
+		auth.POST("/invitations/accept", rateLimitByIP(authRateLimit), s.acceptInvitation)
+		auth.POST("/phone/code", rateLimitByIP(authRateLimit), s.sendLoginCode) // Text a login code to a verified phone
+		auth.POST("/phone/login", rateLimitByIP(authRateLimit), s.phoneLogin)   // Sign in with it
+		// Checked as the user types, so under the looser API limit
+		auth.POST("/password-strength", rateLimitByIP(apiRateLimit), passwordStrength)
+	}
+
+	// User routes (protected)
+	userRoutes := api.Group("/users")
+	userRoutes.Use(s.authMiddleware())
+	{
+		userRoutes.GET("/me", s.getProfile)
+		userRoutes.PUT("/me", s.updateProfile)
+		userRoutes.GET("/me/security", getMySecurity)                                // Recent sign-ins and security alerts
+		userRoutes.GET("/me/usage", getMyUsage)                                      // My plan and today's query budget
+		userRoutes.POST("/me/phone", s.addPhone)                                     // Text a code to a phone to add
+		userRoutes.POST("/me/phone/verify", s.verifyPhone)                           // Save it once the code comes back
+		userRoutes.DELETE("/me/phone", s.removePhone)                                // Remove my phone
+		userRoutes.POST("/me/merge", s.mergeOwnAccount)                              // Fold another account of mine into this one
+		userRoutes.GET("/me/referral", s.getMyReferral)                              // My referral code and its signups
+		userRoutes.GET("/me/notifications", listMyNotifications)                     // My inbox, newest first
+		userRoutes.GET("/me/notifications/unread-count", getUnreadNotificationCount) // Badge count
+		userRoutes.POST("/me/notifications/read-all", markAllNotificationsRead)      // Mark everything read
+		userRoutes.POST("/me/notifications/:id/read", markNotificationRead)          // Mark one read
+		userRoutes.DELETE("/me/notifications/:id", deleteNotification)               // Remove one
+		userRoutes.GET("/me/devices", s.listMyDevices)                               // Devices I have signed in from
+		userRoutes.PATCH("/me/devices/:id", s.updateMyDevice)                        // Rename or trust one
+		userRoutes.DELETE("/me/devices/:id", s.removeMyDevice)                       // Sign one out
+		userRoutes.GET("/me/org", s.getMyOrg)                                        // My org and role (org mode)
+		userRoutes.GET("/me/org/costs", s.getMyOrgCosts)                             // My org's cost report (org managers)
+		userRoutes.GET("/:id", s.getUserByID)
+		userRoutes.GET("/", s.listUsers) // Admin only
+	}
+
+	// Document ownership routes (protected)
+	docRoutes := api.Group("/documents")
+	docRoutes.Use(s.authMiddleware())
+	{
+		docRoutes.POST("/upload", idempotent(), uploadDocument)       // Upload and queue a document for processing
+		docRoutes.POST("/register", idempotent(), s.registerDocument) // Register a document to user
+		docRoutes.DELETE("/:filename", s.unregisterDocument)          // Remove document ownership
+		docRoutes.GET("/my", s.getMyDocuments)                        // Get current user's documents
+		docRoutes.GET("/org", s.getOrgDocuments)                      // Documents shared with the whole org
+		docRoutes.GET("/user/:user_id", s.getUserDocuments)           // Admin: get specific user's docs
+		docRoutes.GET("/all", s.getAllDocuments)                      // Admin: get all documents with owners
+
+		// Time-boxed shares with other members (grants.go)
+		docRoutes.GET("/shared", s.getSharedDocuments)
+		docRoutes.GET("/:filename/grants", s.listDocumentGrants)
+		docRoutes.POST("/:filename/grants", s.grantDocument)
+		docRoutes.DELETE("/:filename/grants/:user_id", s.revokeDocumentGrant)
+
+		// Who read a document and when (accesslog.go)
+		docRoutes.GET("/:filename/access-log", s.getAccessLog)
+
+		// Quick source selection for the chat UI (favorites.go)
+		docRoutes.GET("/starred", s.getStarredDocuments)
+		docRoutes.GET("/recent", s.getRecentDocuments)
+		docRoutes.POST("/:filename/star", s.starDocument)
+		docRoutes.DELETE("/:filename/star", s.starDocument)
+
+		// Notes on a document, private or shared with it (notes.go)
+		docRoutes.GET("/:filename/notes", s.listNotes)
+		docRoutes.POST("/:filename/notes", s.createNote)
+		docRoutes.PATCH("/:filename/notes/:note_id", s.updateNote)
+		docRoutes.DELETE("/:filename/notes/:note_id", s.deleteNote)
+
+		// Title, author, pages and opening text for the UI (preview.go)
+		docRoutes.GET("/:filename/preview", s.getDocumentPreview)
+
+		// Per-language collections (languages.go); listings take ?language=
+		docRoutes.GET("/languages", s.getDocumentLanguages)
+
+		// How the backend splits a document (chunking.go)
+		docRoutes.GET("/:filename/chunking", s.getDocumentChunking)
+		docRoutes.PUT("/:filename/chunking", s.setDocumentChunking)
+
+		// How often answers cited a document (citations.go)
+		docRoutes.GET("/:filename/citations", s.getDocumentCitations)
+	}
+
+	// Saved conversations, shared with members or by link (conversations.go)
+	conversationRoutes := api.Group("/conversations")
+	conversationRoutes.Use(s.authMiddleware())
+	{
+		conversationRoutes.POST("", s.createConversation)
+		conversationRoutes.GET("", s.listConversations)                                // Mine and shared with me
+		conversationRoutes.GET("/:id", s.getConversation)                              // Sources I can't read are hidden
+		conversationRoutes.PATCH("/:id", s.renameConversation)                         // Owner
+		conversationRoutes.DELETE("/:id", s.deleteConversation)                        // Owner
+		conversationRoutes.POST("/:id/turns", s.addConversationTurn)                   // Owner or collaborator
+		conversationRoutes.POST("/:id/members", s.shareConversation)                   // Owner
+		conversationRoutes.DELETE("/:id/members/:user_id", s.removeConversationMember) // Owner, or a member leaving
+		conversationRoutes.PUT("/:id/link", s.setShareLink)                            // Owner; replaces any earlier link
+		conversationRoutes.DELETE("/:id/link", s.deleteShareLink)                      // Owner
+		conversationRoutes.GET("/shared/:token", s.openShareLink)                      // View through a link
+		conversationRoutes.POST("/shared/:token/join", s.joinShareLink)                // Become a member through a link
+	}
+
+	// Saved questions, run on demand or on a schedule (savedqueries.go)
+	savedQueryRoutes := api.Group("/saved-queries")
+	savedQueryRoutes.Use(s.authMiddleware())
+	{
+		savedQueryRoutes.POST("", s.createSavedQuery)
+		savedQueryRoutes.GET("", s.listSavedQueries)
+		savedQueryRoutes.GET("/:id", s.getSavedQuery)     // With its last run
+		savedQueryRoutes.PUT("/:id", s.replaceSavedQuery) // Its schedule starts again from now
+		savedQueryRoutes.DELETE("/:id", s.deleteSavedQuery)
+		savedQueryRoutes.POST("/:id/run", s.runSavedQuery) // Answer now, in the response
+	}
+
+	// Query routes (protected)
+	queryRoutes := api.Group("/query")
+	queryRoutes.Use(s.authMiddleware())
+	{
+		queryRoutes.POST("/stream", streamQuery) // SSE proxy to the RAG backend
+	}
+
+	// Job routes (protected)
+	jobRoutes := api.Group("/jobs")
+	jobRoutes.Use(s.authMiddleware())
+	{
+		jobRoutes.GET("/dead-letter", listDeadLetterJobs) // Admin: jobs that exhausted retries
+		jobRoutes.GET("/:id", getJob)                     // Job status (owner or admin)
+		jobRoutes.POST("/:id/retry", retryJob)            // Admin: re-queue a dead-lettered job
+	}
+
+	// Admin routes (protected, admin only)
+	adminRoutes := api.Group("/admin")
+	adminRoutes.Use(adminNetworkOnly(), s.authMiddleware(), requireAdmin())
+	{
+		adminRoutes.POST("/reindex", startReindex)                               // Start or schedule a reindex campaign
+		adminRoutes.GET("/reindex", listReindexCampaigns)                        // List campaigns
+		adminRoutes.GET("/reindex/:id", getReindexCampaign)                      // Campaign progress
+		adminRoutes.POST("/reindex/:id/pause", updateReindexCampaign("pause"))   // Pause after the current document
+		adminRoutes.POST("/reindex/:id/resume", updateReindexCampaign("resume")) // Resume a paused campaign
+		adminRoutes.POST("/reindex/:id/cancel", updateReindexCampaign("cancel")) // Stop a campaign
+		adminRoutes.POST("/graphql", adminGraphQL)                               // Dashboard queries over users, documents and jobs
+		adminRoutes.GET("/security-alerts", listSecurityAlerts)                  // Anomalous sign-ins, newest first
+		adminRoutes.POST("/security-alerts/:id/resolve", resolveSecurityAlert)   // Close an alert, optionally trusting a held sign-in
+		adminRoutes.GET("/stats", getStats)                                      // Signups, activity, login failures and document growth
+		adminRoutes.PUT("/documents/:filename/scope", s.setDocumentScope)        // Promote a document to org scope or back to personal
+
+		// Uploads a scan flagged (scanning.go)
+		adminRoutes.GET("/quarantine", listQuarantine)                 // Blocked jobs, newest first
+		adminRoutes.POST("/quarantine/:id/release", releaseQuarantine) // False positive: process without scanning
+		adminRoutes.DELETE("/quarantine/:id", s.deleteQuarantine)      // Discard the file and its claim
+
+		// Chunking defaults, collection profiles and stale documents (chunking.go)
+		adminRoutes.GET("/chunking", s.getChunkingSettings)
+
+		// Sources answers cite most (citations.go)
+		adminRoutes.GET("/citations", s.getMostCited)
+
+		// Golden sets and evaluation runs (evaluation.go)
+		adminRoutes.POST("/evaluations/sets", createGoldenSet)
+		adminRoutes.GET("/evaluations/sets", listGoldenSets)
+		adminRoutes.GET("/evaluations/sets/:id", getGoldenSet)
+		adminRoutes.PUT("/evaluations/sets/:id", replaceGoldenSet)
+		adminRoutes.DELETE("/evaluations/sets/:id", deleteGoldenSet)
+		adminRoutes.POST("/evaluations/sets/:id/runs", s.startEvaluation)
+		adminRoutes.GET("/evaluations/sets/:id/metrics", getEvaluationMetrics)
+		adminRoutes.GET("/evaluations/runs", listEvaluationRuns)
+		adminRoutes.GET("/evaluations/runs/:id", getEvaluationRun)
+
+		// Retrieval experiments and the query history (experiments.go)
+		adminRoutes.POST("/experiments", createExperiment)
+		adminRoutes.GET("/experiments", listExperiments)
+		adminRoutes.POST("/experiments/:id/stop", stopExperiment)
+		adminRoutes.GET("/experiments/:id/results", getExperimentResults)
+		adminRoutes.GET("/queries", listQueryHistory)
+
+		// Hybrid search weighting and rerankers per collection (search.go)
+		adminRoutes.GET("/search", getSearchSettings)
+		adminRoutes.GET("/search/:collection", getCollectionSearch)
+		adminRoutes.PUT("/search/:collection", setCollectionSearch)
+		adminRoutes.DELETE("/search/:collection", resetCollectionSearch)
+		adminRoutes.POST("/search/:collection/rollback", rollbackCollectionSearch)
+
+		// LLM and embedding failover chain and circuit breakers (providers.go)
+		adminRoutes.GET("/providers", getProviders)
+		adminRoutes.PUT("/providers", setProviders)
+		adminRoutes.POST("/providers/check", checkProvidersNow)
+	}
+
+	// Internal service-to-service routes (shared token)
+	internalRoutes := api.Group("/internal")
+	internalRoutes.Use(internalAuthMiddleware())
+	{
+		internalRoutes.POST("/access/filter", filterAccess)     // Filter candidate documents by read access
+		internalRoutes.POST("/token/exchange", s.exchangeToken) // Swap a user's token for a scoped one
+		internalRoutes.GET("/revocations", s.listRevocations)   // Users whose tokens were revoked since a time
+
+		// Sources a query read, for owners' access logs (accesslog.go)
+		internalRoutes.POST("/access/retrievals", s.recordRetrieval)
+
+		// Chunks an answer cited (citations.go)
+		internalRoutes.POST("/access/citations", s.recordCitations)
+
+		// What to search a collection with (search.go)
+		internalRoutes.GET("/search", internalSearchSettings)
+
+		// Which LLM and embedding providers to use, and how calls to them went (providers.go)
+		internalRoutes.GET("/providers", internalProviders)
+		internalRoutes.POST("/providers/report", reportProvider)
+
+		// Indexed notes a user may see, as extra query context (notes.go)
+		internalRoutes.POST("/access/notes", s.indexedNotes)
+
+		// Spend from a user's daily query budget before forwarding a query (plans.go)
+		internalRoutes.POST("/quota/queries", s.checkQueryQuota)
+
+		// Tokens an answer used, charged to the user's cost org (costs.go)
+		internalRoutes.POST("/usage", s.recordUsage)
+	}
+
+	// OAuth2 authorization server for third-party tools (oauthserver.go)
+	oauthRoutes := api.Group("/oauth")
+	{
+		oauthRoutes.GET("/authorize", s.authMiddleware(), getConsentScreen)     // What the consent page shows
+		oauthRoutes.POST("/authorize", s.authMiddleware(), decideAuthorization) // The user's decision
+		oauthRoutes.POST("/token", rateLimitByIP(authRateLimit), s.issueOAuthToken)
+	}
+
+	// WebSocket chat (authenticates during the upgrade)
+	api.GET("/ws/chat", s.chatWebSocket)
+
+	// Source connector routes (protected)
+	connectorRoutes := api.Group("/connectors")
+	connectorRoutes.Use(s.authMiddleware())
+	{
+		connectorRoutes.GET("", listConnectors)                     // Available connectors and my links
+		connectorRoutes.GET("/authorize/:kind", authorizeConnector) // Start OAuth linking
+		connectorRoutes.POST("/s3", linkS3Connector)                // Link an S3 bucket with access keys
+		connectorRoutes.POST("/links/:id/sync", syncConnectorLink)  // Trigger an immediate sync
+		connectorRoutes.DELETE("/links/:id", unlinkConnector)       // Remove a link
+	}
+	// OAuth providers redirect the browser here without a bearer token;
+	// the state parameter identifies the linking user
+	api.GET("/connectors/callback/:kind", connectorCallback)
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// testServer is a Server over its own empty repositories and key ring
+type testServer struct {
+	t   *testing.T
+	srv *Server
+}
+
+func newTestServer(t *testing.T) *testServer {
+	t.Helper()
+	withConfig(t, func(cfg *Config) {
+		cfg.Passwords.Algorithm, cfg.Passwords.BcryptCost = "bcrypt", bcrypt.MinCost
+		cfg.Passwords.MinScore = 0 // fixtures use short passwords; strength_test.go covers the check
+	})
+	keys := &keyRing{}
+	keys.rotate([]byte("server-test-key-0123456789abcdefghij"))
+	srv, err := NewServer(NewService(newMemoryUserRepository(), newMemoryDocumentRepository(), keys))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testServer{t: t, srv: srv}
+}
+
+// do sends a request with an optional bearer token and extra headers
+func (ts *testServer) do(method, path, token, body string, headers ...string) *httptest.ResponseRecorder {
+	ts.t.Helper()
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	w := httptest.NewRecorder()
+	ts.srv.ServeHTTP(w, req)
+	return w
+}
+
+// register creates an account and returns its token and ID
+func (ts *testServer) register(email string) (string, string) {
+	ts.t.Helper()
+	w := ts.do(http.MethodPost, "/v1/auth/register", "",
+		`{"email":"`+email+`","password":"secret123","name":"Test User"}`)
+	if w.Code != http.StatusCreated {
+		ts.t.Fatalf("register %s: %d %s", email, w.Code, w.Body)
+	}
+	var resp AuthResponse
+	decodeJSON(ts.t, w, &resp)
+	return resp.Token, resp.User.ID
+}
+
+// admin promotes a registered account and returns a fresh token for it
+func (ts *testServer) admin(email string) string {
+	ts.t.Helper()
+	_, id := ts.register(email)
+	user := ts.srv.svc.users.ByID(id)
+	user.Role = "admin"
+	token, err := ts.srv.svc.IssueToken(user)
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+	return token
+}
+
+func decodeJSON(t *testing.T, w *httptest.ResponseRecorder, v any) {
+	t.Helper()
+	if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+		t.Fatalf("invalid JSON: %v\n%s", err, w.Body)
+	}
+}
+
+func TestServerRegisterAndLogin(t *testing.T) {
+	ts := newTestServer(t)
+	token, id := ts.register("a@example.com")
+	if token == "" || id == "" {
+		t.Fatal("registration returned no token or ID")
+	}
+
+	if w := ts.do(http.MethodPost, "/v1/auth/register", "",
+		`{"email":"a@example.com","password":"secret123","name":"Again"}`); w.Code != http.StatusConflict {
+		t.Fatalf("duplicate registration: got %d, want 409", w.Code)
+	}
+	if w := ts.do(http.MethodPost, "/v1/auth/register", "",
+		`{"email":"not-an-email","password":"secret123","name":"Bad"}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("invalid registration: got %d, want 400", w.Code)
+	}
+
+	w := ts.do(http.MethodPost, "/v1/auth/login", "", `{"email":"a@example.com","password":"secret123"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("login: %d %s", w.Code, w.Body)
+	}
+	var resp AuthResponse
+	decodeJSON(t, w, &resp)
+	if resp.User.ID != id || resp.Token == "" {
+		t.Fatalf("login response = %+v", resp)
+	}
+
+	if w := ts.do(http.MethodPost, "/v1/auth/login", "", `{"email":"a@example.com","password":"wrong-password"}`); w.Code != http.StatusUnauthorized {
+		t.Fatalf("wrong password: got %d, want 401", w.Code)
+	}
+	if w := ts.do(http.MethodPost, "/v1/auth/login", "", `{"email":"b@example.com","password":"secret123"}`); w.Code != http.StatusUnauthorized {
+		t.Fatalf("unknown user: got %d, want 401", w.Code)
+	}
+}
+
+func TestServerVerifyToken(t *testing.T) {
+	ts := newTestServer(t)
+	token, id := ts.register("a@example.com")
+
+	w := ts.do(http.MethodGet, "/v1/auth/verify", token, "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("verify: %d %s", w.Code, w.Body)
+	}
+	var resp struct {
+		Valid bool        `json:"valid"`
+		User  UserProfile `json:"user"`
+	}
+	decodeJSON(t, w, &resp)
+	if !resp.Valid || resp.User.ID != id {
+		t.Fatalf("verify response = %+v", resp)
+	}
+
+	for name, tc := range map[string]struct{ header, want string }{
+		"missing":   {"", ""},
+		"malformed": {"Token " + token, ""},
+		"invalid":   {"Bearer not.a.token", codeInvalidToken},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/v1/auth/verify", nil)
+		if tc.header != "" {
+			req.Header.Set("Authorization", tc.header)
+		}
+		w := httptest.NewRecorder()
+		ts.srv.ServeHTTP(w, req)
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("%s token: got %d, want 401", name, w.Code)
+		}
+		if tc.want != "" && !strings.Contains(w.Body.String(), tc.want) {
+			t.Errorf("%s token: body %s lacks %q", name, w.Body, tc.want)
+		}
+	}
+}
+
+func TestServerProfile(t *testing.T) {
+	ts := newTestServer(t)
+	token, id := ts.register("a@example.com")
+
+	w := ts.do(http.MethodGet, "/v1/users/me", token, "")
+	etag := w.Header().Get("ETag")
+	if w.Code != http.StatusOK || etag == "" {
+		t.Fatalf("get profile: %d with ETag %q", w.Code, etag)
+	}
+	if w := ts.do(http.MethodGet, "/v1/users/me", token, "", "If-None-Match", etag); w.Code != http.StatusNotModified {
+		t.Fatalf("unchanged profile: got %d, want 304", w.Code)
+	}
+
+	w = ts.do(http.MethodPut, "/v1/users/me", token, `{"name":"Renamed"}`, "If-Match", etag)
+	if w.Code != http.StatusOK {
+		t.Fatalf("update profile: %d %s", w.Code, w.Body)
+	}
+	if ts.srv.svc.users.ByID(id).Name != "Renamed" {
+		t.Fatal("profile update not stored")
+	}
+	if w := ts.do(http.MethodPut, "/v1/users/me", token, `{"name":"Stale"}`, "If-Match", etag); w.Code != http.StatusPreconditionFailed {
+		t.Fatalf("stale If-Match: got %d, want 412", w.Code)
+	}
+
+	w = ts.do(http.MethodGet, "/v1/users/"+id, token, "")
+	var profile UserProfile
+	decodeJSON(t, w, &profile)
+	if w.Code != http.StatusOK || profile.Name != "Renamed" {
+		t.Fatalf("get user by ID: %d %+v", w.Code, profile)
+	}
+	if w := ts.do(http.MethodGet, "/v1/users/no-such-user", token, ""); w.Code != http.StatusNotFound {
+		t.Fatalf("unknown user: got %d, want 404", w.Code)
+	}
+}
+
+func TestServerDocuments(t *testing.T) {
+	ts := newTestServer(t)
+	alice, aliceID := ts.register("alice@example.com")
+	bob, _ := ts.register("bob@example.com")
+
+	if w := ts.do(http.MethodPost, "/v1/documents/register", alice, `{"filename":"report.pdf"}`); w.Code != http.StatusCreated {
+		t.Fatalf("register document: %d %s", w.Code, w.Body)
+	}
+	if w := ts.do(http.MethodPost, "/v1/documents/register", alice, `{"filename":"report.pdf"}`); w.Code != http.StatusOK {
+		t.Fatalf("re-register own document: got %d, want 200", w.Code)
+	}
+	withConfig(t, func(cfg *Config) { cfg.Documents.OnConflict = onConflictReject })
+	if w := ts.do(http.MethodPost, "/v1/documents/register", bob, `{"filename":"report.pdf"}`); w.Code != http.StatusConflict {
+		t.Fatalf("register another's document: got %d, want 409", w.Code)
+	}
+
+	w := ts.do(http.MethodGet, "/v1/documents/my", alice, "")
+	var mine struct {
+		UserID    string   `json:"user_id"`
+		Documents []string `json:"documents"`
+	}
+	decodeJSON(t, w, &mine)
+	if mine.UserID != aliceID || len(mine.Documents) != 1 || mine.Documents[0] != "report.pdf" {
+		t.Fatalf("my documents = %+v", mine)
+	}
+
+	if w := ts.do(http.MethodDelete, "/v1/documents/report.pdf", bob, ""); w.Code != http.StatusForbidden {
+		t.Fatalf("unregister another's document: got %d, want 403", w.Code)
+	}
+	if w := ts.do(http.MethodDelete, "/v1/documents/report.pdf", alice, ""); w.Code != http.StatusOK {
+		t.Fatalf("unregister: %d %s", w.Code, w.Body)
+	}
+	if w := ts.do(http.MethodDelete, "/v1/documents/report.pdf", alice, ""); w.Code != http.StatusNotFound {
+		t.Fatalf("unregister twice: got %d, want 404", w.Code)
+	}
+	if owner := ts.srv.svc.DocumentOwner("report.pdf"); owner != "" {
+		t.Fatalf("document still owned by %q", owner)
+	}
+}
+
+func TestServerAdminRoutes(t *testing.T) {
+	ts := newTestServer(t)
+	user, userID := ts.register("user@example.com")
+	admin := ts.admin("admin@example.com")
+	ts.do(http.MethodPost, "/v1/documents/register", user, `{"filename":"notes.txt"}`)
+
+	for _, path := range []string{"/v1/users/", "/v1/documents/user/" + userID, "/v1/documents/all"} {
+		if w := ts.do(http.MethodGet, path, user, ""); w.Code != http.StatusForbidden {
+			t.Errorf("%s as user: got %d, want 403", path, w.Code)
+		}
+		if w := ts.do(http.MethodGet, path, admin, ""); w.Code != http.StatusOK {
+			t.Errorf("%s as admin: got %d %s", path, w.Code, w.Body)
+		}
+	}
+
+	w := ts.do(http.MethodGet, "/v1/users/", admin, "")
+	var list struct {
+		Total int `json:"total"`
+	}
+	decodeJSON(t, w, &list)
+	if list.Total != 2 {
+		t.Fatalf("listed %d users, want 2", list.Total)
+	}
+
+	// Admins may release anyone's document
+	if w := ts.do(http.MethodDelete, "/v1/documents/notes.txt", admin, ""); w.Code != http.StatusOK {
+		t.Fatalf("admin unregister: %d %s", w.Code, w.Body)
+	}
+}
+
+func TestServersAreIsolated(t *testing.T) {
+	first, second := newTestServer(t), newTestServer(t)
+	token, _ := first.register("a@example.com")
+	first.do(http.MethodPost, "/v1/documents/register", token, `{"filename":"report.pdf"}`)
+
+	// Each server has its own users and documents
+	if w := second.do(http.MethodGet, "/v1/auth/verify", token, ""); w.Code != http.StatusUnauthorized {
+		t.Fatalf("token accepted by another server: %d", w.Code)
+	}
+	other, _ := second.register("a@example.com")
+	if w := second.do(http.MethodPost, "/v1/documents/register", other, `{"filename":"report.pdf"}`); w.Code != http.StatusCreated {
+		t.Fatalf("document claimed on another server: %d %s", w.Code, w.Body)
+	}
+	if localUsers.ByEmail("a@example.com") != nil {
+		t.Fatal("test server wrote to the process-wide store")
+	}
+}
@@ -0,0 +1,462 @@
+package main
+
+import (
+	"crypto/sha256"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+// ============================================================================
+// Service Layer
+// ============================================================================
+//
+// Core operations shared by the REST handlers and the gRPC server, on a
+// Service built over a UserRepository and a DocumentRepository. Errors
+// carry user-facing messages; each transport maps them to its status codes.
+
+var (
+	errEmailTaken         = errors.New("Email already registered")
+	errInvalidCredentials = errors.New("Invalid email or password")
+	errPasswordProcessing = errors.New("Failed to process password")
+	errTokenGeneration    = errors.New("Failed to generate token")
+	errDocumentNotFound   = errors.New("Document not found")
+	errNotDocumentOwner   = errors.New("Not authorized to delete this document")
+	errAccountDisabled    = errors.New("Account is disabled; contact an administrator")
+	errApprovalPending    = errors.New("Registration is awaiting administrator approval")
+)
+
+// Service is the core of the auth service over its repositories
+type Service struct {
+	users     UserRepository
+	documents DocumentRepository
+	keys      *keyRing
+	adminMu   sync.Mutex // serializes admin account changes (adminusers.go)
+}
+
+// NewService creates a Service; keys signs and verifies its tokens
+func NewService(users UserRepository, documents DocumentRepository, keys *keyRing) *Service {
+	return &Service{users: users, documents: documents, keys: keys}
+}
+
+// Register creates a user account and issues its first token.
+// referralCode, if given, must belong to an existing user.
+func (s *Service) Register(email, password, name, referralCode string) (*User, string, error) {
+	registration := currentRegistration()
+	if err := checkRegistration(registration, email); err != nil {
+		return nil, "", err
+	}
+
+	// Check if user already exists; Add settles races between
+	// registrations that both get past this check
+	if s.users.ByEmail(email) != nil {
+		return nil, "", errEmailTaken
+	}
+	if err := checkPasswordStrength(password, email, name); err != nil {
+		return nil, "", err
+	}
+	var referredBy string
+	if referralCode != "" {
+		referrer := s.referrer(referralCode)
+		if referrer == nil {
+			return nil, "", errInvalidReferralCode
+		}
+		referredBy = referrer.ID
+	}
+
+	// Hash password (no lock held, so logins carry on meanwhile)
+	hashedPassword, err := hashPassword(password)
+	if err == errPasswordBusy {
+		return nil, "", err
+	}
+	if err != nil {
+		return nil, "", errPasswordProcessing
+	}
+
+	// Create user
+	user := &User{
+		ID:        uuid.New().String(),
+		Email:     email,
+		Password:  hashedPassword,
+		Name:      name,
+		Role:      "user",
+		CreatedAt: time.Now(),
+		UpdatedAt: time.Now(),
+
+		ReferredBy: referredBy,
+	}
+	if registration.Mode == registrationApproval {
+		user.Status = UserPending
+	}
+	placeInOrg(user)
+
+	if err := reserveEmail(user.Email, user.ID); err != nil {
+		return nil, "", err
+	}
+	if err := saveUser(user); err != nil {
+		releaseEmail(user.Email)
+		return nil, "", err
+	}
+	user, err = s.users.Add(user)
+	if err != nil {
+		return nil, "", err
+	}
+	if user.Status == UserPending {
+		s.notifySignupPending(user)
+		return user, "", nil // no token until an admin approves
+	}
+
+	// Generate JWT token
+	token, err := s.IssueToken(user)
+	if err != nil {
+		return nil, "", errTokenGeneration
+	}
+	return user, token, nil
+}
+
+// Login checks credentials and issues a token
+func (s *Service) Login(email, password string) (*User, string, error) {
+	user := s.users.ByEmail(email)
+	if user == nil {
+		return nil, "", errInvalidCredentials
+	}
+
+	// Check password, upgrading a hash made under older settings
+	lock := s.users.FieldLock(user)
+	lock.RLock()
+	hash, status := user.Password, user.Status
+	lock.RUnlock()
+	if status == UserMerged {
+		return nil, "", errAccountMerged
+	}
+	if status == UserInvited || hash == "" {
+		return nil, "", errInvalidCredentials // no password until the invitation is accepted
+	}
+	ok, rehash, err := verifyPassword(hash, password)
+	if err != nil {
+		return nil, "", err
+	}
+	if !ok {
+		return nil, "", errInvalidCredentials
+	}
+	if status == UserDisabled {
+		return nil, "", errAccountDisabled
+	}
+	if status == UserPending {
+		return nil, "", errApprovalPending
+	}
+	if rehash {
+		upgradePasswordHash(lock, user, hash, password)
+	}
+
+	// Generate JWT token
+	token, err := s.IssueToken(user)
+	if err != nil {
+		return nil, "", errTokenGeneration
+	}
+	return user, token, nil
+}
+
+// IssueToken creates a JWT for a user, with any custom claims (claims.go)
+func (s *Service) IssueToken(user *User) (string, error) {
+	return s.issueToken(user, time.Now().Add(config.Session.Lifetime), "")
+}
+
+// issueToken creates a JWT expiring at expiresAt, limited to scope if one
+// is given (tokenexchange.go)
+func (s *Service) issueToken(user *User, expiresAt time.Time, scope string) (string, error) {
+	return s.issueDeviceToken(user, expiresAt, scope, "")
+}
+
+// issueDeviceToken is issueToken, bound to one of the user's devices if
+// deviceID is set (devices.go)
+func (s *Service) issueDeviceToken(user *User, expiresAt time.Time, scope, deviceID string) (string, error) {
+	custom, err := s.customClaims(user)
+	if err != nil {
+		slog.Error("Custom claims failed", "user_id", user.ID, "error", err)
+		return "", err
+	}
+	claims := jwt.MapClaims{}
+	for name, value := range custom {
+		claims[name] = value
+	}
+	claims["user_id"] = user.ID
+	claims["email"] = user.Email
+	claims["role"] = user.Role
+	claims["exp"] = expiresAt.Unix()
+	claims["iat"] = time.Now().Unix()
+	if revokedAt := s.revokedAt(user); !revokedAt.IsZero() {
+		claims["rev"] = revokedAt.Format(time.RFC3339Nano)
+	}
+	if scope != "" {
+		claims["scope"] = scope
+	}
+	if deviceID != "" {
+		claims["device_id"] = deviceID
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	return s.keys.sign(token)
+}
+
+// Authenticate parses a JWT and resolves the user it was issued to
+func (s *Service) Authenticate(tokenString string) (*User, error) {
+	user, _, err := s.AuthenticateClaims(tokenString)
+	return user, err
+}
+
+// AuthenticateClaims is Authenticate, also returning the token's custom
+// claims once their providers have accepted them. Scoped tokens are
+// refused; only authMiddleware accepts them, on the routes their scope
+// allows.
+func (s *Service) AuthenticateClaims(tokenString string) (*User, map[string]any, error) {
+	user, custom, scope, err := s.AuthenticateScoped(tokenString)
+	if err != nil {
+		return nil, nil, err
+	}
+	if scope != "" {
+		debugLog("auth", "Token rejected", "reason", "scoped token", "scope", scope, "user_id", user.ID)
+		return nil, nil, errInsufficientScope
+	}
+	return user, custom, nil
+}
+
+// AuthenticateScoped is AuthenticateClaims for callers that check the
+// token's scope themselves; an empty scope means an unrestricted token
+func (s *Service) AuthenticateScoped(tokenString string) (*User, map[string]any, string, error) {
+	cacheKey := sha256.Sum256([]byte(tokenString))
+	if entry, ok := cachedToken(s.keys, cacheKey); ok {
+		if user := s.users.ByID(entry.userID); user != nil && s.active(user) && !s.tokenRevoked(user, entry.issuedAt, entry.cutoff, entry.deviceID) {
+			if err := s.validateCustomClaims(user, entry.claims); err != nil {
+				return nil, nil, "", err
+			}
+			// Verified here, so its activity is already on record
+			if err := s.checkIdle(cacheKey, user, time.Time{}); err != nil {
+				return nil, nil, "", err
+			}
+			s.touchDevice(user, entry.deviceID)
+			return user, entry.claims, entry.scope, nil
+		}
+	}
+
+	// Parse and validate token
+	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, jwt.ErrSignatureInvalid
+		}
+		return s.keys.verificationKey(token)
+	})
+
+	if err != nil || !token.Valid {
+		if debugEnabled("auth") {
+			var kid string
+			if token != nil {
+				kid, _ = token.Header["kid"].(string)
+			}
+			debugLog("auth", "Token rejected", "reason", err, "kid", kid, "current_kid", s.keys.currentID())
+		}
+		return nil, nil, "", errInvalidToken
+	}
+
+	// Extract claims
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		debugLog("auth", "Token rejected", "reason", "claims are not a map")
+		return nil, nil, "", errInvalidClaims
+	}
+
+	// Get user from store
+	userID, ok := claims["user_id"].(string)
+	if !ok {
+		debugLog("auth", "Token rejected", "reason", "user_id claim missing")
+		return nil, nil, "", errInvalidClaims
+	}
+	user := s.users.ByID(userID)
+	if user == nil {
+		debugLog("auth", "Token rejected", "reason", "user not found", "user_id", userID)
+		return nil, nil, "", errUserNotFound
+	}
+	if !s.active(user) {
+		debugLog("auth", "Token rejected", "reason", "account not active", "user_id", userID)
+		return nil, nil, "", errAccountDisabled
+	}
+	var issuedAt, expiresAt time.Time
+	if iat, _ := claims.GetIssuedAt(); iat != nil {
+		issuedAt = iat.Time
+	}
+	deviceID, _ := claims["device_id"].(string)
+	rev, _ := claims["rev"].(string)
+	cutoff, _ := time.Parse(time.RFC3339Nano, rev)
+	if s.tokenRevoked(user, issuedAt, cutoff, deviceID) {
+		debugLog("auth", "Token rejected", "reason", "revoked", "user_id", userID)
+		return nil, nil, "", errTokenRevoked
+	}
+	if s.claimsStale(user, claims) {
+		debugLog("auth", "Token rejected", "reason", "email or role changed", "user_id", userID)
+		return nil, nil, "", errTokenRevoked
+	}
+
+	custom := extractCustomClaims(claims)
+	if err := s.validateCustomClaims(user, custom); err != nil {
+		return nil, nil, "", err
+	}
+
+	if err := s.checkIdle(cacheKey, user, issuedAt); err != nil {
+		debugLog("auth", "Token rejected", "reason", "idle", "user_id", userID)
+		return nil, nil, "", err
+	}
+	if exp, _ := claims.GetExpirationTime(); exp != nil {
+		expiresAt = exp.Time
+	}
+	s.touchDevice(user, deviceID)
+	scope, _ := claims["scope"].(string)
+	cacheToken(s.keys, cacheKey, tokenCacheEntry{userID: userID, claims: custom, scope: scope, deviceID: deviceID, issuedAt: issuedAt, cutoff: cutoff, expiresAt: expiresAt})
+	return user, custom, scope, nil
+}
+
+// active reports whether a user may use their tokens
+func (s *Service) active(user *User) bool {
+	lock := s.users.FieldLock(user)
+	lock.RLock()
+	defer lock.RUnlock()
+	return accountStatus(user) == UserActive
+}
+
+// ClaimDocument assigns a document to a user under its filename as its
+// name. It reports whether the document was newly registered; re-claiming
+// an owned document is a no-op.
+func (s *Service) ClaimDocument(filename, userID string) (bool, error) {
+	_, created, err := s.claimDocument(filename, filename, userID)
+	return created, err
+}
+
+// claimDocument registers filename to a user under name. It returns the
+// filename of the user's document with that name, an earlier one if they
+// have it already, and whether the document was newly registered.
+func (s *Service) claimDocument(filename, name, userID string) (string, bool, error) {
+	created := false
+	err := s.documents.Update(func(tx DocumentTx) error {
+		if existing, exists := tx.named(userID, name); exists {
+			filename = existing
+			return nil
+		}
+		// Filenames are unique across owners; one the user has under
+		// another name is taken as well
+		if tx.owner(filename) != "" {
+			return errDocumentOwned
+		}
+
+		// Register document to user, unless another replica just did
+		now := time.Now()
+		owner, err := claimSharedDocument(filename, userID, sharedDocumentMeta{Name: name, AddedAt: now})
+		if err != nil {
+			return err
+		}
+		record := documentRecord{Owner: owner, AddedAt: now}
+		if owner == userID {
+			record.Name = name
+		}
+		tx.put(filename, record)
+		bumpDocVersion()
+		if owner != userID {
+			return errDocumentOwned
+		}
+		created = true
+		return nil
+	})
+	return filename, created, err
+}
+
+// ReleaseDocument removes a document's ownership record. Only the owner or
+// an admin may release a document.
+func (s *Service) ReleaseDocument(filename string, actor *User) error {
+	return s.documents.Update(func(tx DocumentTx) error {
+		// Check ownership
+		ownerID := tx.owner(filename)
+		if ownerID == "" {
+			return errDocumentNotFound
+		}
+
+		// Only owner or admin can delete
+		if ownerID != actor.ID && actor.Role != "admin" {
+			return errNotDocumentOwner
+		}
+		if err := releaseSharedDocument(filename, ownerID); err != nil {
+			return err
+		}
+
+		tx.remove(filename)
+		bumpDocVersion()
+		return nil
+	})
+}
+
+// DocumentsOf returns a copy of the documents owned by a user, sorted
+func (s *Service) DocumentsOf(userID string) []string {
+	var docs []string
+	s.documents.View(func(tx DocumentTx) {
+		docs = tx.ownedBy(userID)
+	})
+	return docs
+}
+
+// DocumentOwner returns a document's owner, or ""
+func (s *Service) DocumentOwner(filename string) string {
+	var owner string
+	s.documents.View(func(tx DocumentTx) {
+		owner = tx.owner(filename)
+	})
+	return owner
+}
+
+// ----------------------------------------------------------------------------
+// Process-wide shortcuts
+// ----------------------------------------------------------------------------
+//
+// Code that isn't handed a Service (GraphQL resolvers, jobs, connectors,
+// WebSocket chat, the access filter) reaches defaultService through these.
+
+func lookupUser(id string) *User { return defaultService.users.ByID(id) }
+
+func userContact(id string) (name, email string, ok bool) {
+	return defaultService.users.Contact(id)
+}
+
+func userLock(user *User) *sync.RWMutex { return defaultService.users.FieldLock(user) }
+
+func documentsOf(userID string) []string { return defaultService.DocumentsOf(userID) }
+
+func orgWideDocuments(user *User) []string { return defaultService.OrgWideDocuments(user) }
+
+func grantsTo(userID string) map[string]time.Time { return defaultService.SharedWith(userID) }
+
+func documentTags(filename string) []string { return defaultService.DocumentTags(filename) }
+
+func registerDocumentAs(filename, userID string) (string, bool, error) {
+	return defaultService.RegisterDocument(filename, userID)
+}
+
+func releaseDocument(filename string, actor *User) error {
+	return defaultService.ReleaseDocument(filename, actor)
+}
+
+func authenticateToken(tokenString string) (*User, error) {
+	return defaultService.Authenticate(tokenString)
+}
+
+// readableSubset returns the candidate documents a user may read, in order
+func readableSubset(user *User, candidates []string) []string {
+	entry := readableDocuments(user)
+
+	allowed := make([]string, 0, len(candidates))
+	for _, id := range candidates {
+		if entry.allAccess || entry.readable[id] {
+			allowed = append(allowed, id)
+		}
+	}
+	return allowed
+}
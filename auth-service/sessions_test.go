@@ -0,0 +1,127 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+// sessionCookies returns the cookies a response sets, by name
+func sessionCookies(t *testing.T, resp *http.Response) map[string]*http.Cookie {
+	t.Helper()
+	cookies := make(map[string]*http.Cookie)
+	for _, cookie := range resp.Cookies() {
+		cookies[cookie.Name] = cookie
+	}
+	return cookies
+}
+
+func TestCookieSessionCSRF(t *testing.T) {
+	withConfig(t, func(cfg *Config) { cfg.Session.Mode = sessionModeCookie })
+	ts := newTestServer(t)
+
+	w := ts.do(http.MethodPost, "/v1/auth/register", "", `{"email":"user@example.com","password":"secret123","name":"Test User"}`)
+	var resp AuthResponse
+	decodeJSON(t, w, &resp)
+	cookies := sessionCookies(t, w.Result())
+	session, csrf := cookies[config.Session.CookieName], cookies[config.Session.CSRFCookieName]
+	if w.Code != http.StatusCreated || resp.Token != "" || session == nil || csrf == nil {
+		t.Fatalf("register: %d %+v, cookies %v", w.Code, resp, cookies)
+	}
+	if !session.HttpOnly || csrf.HttpOnly || resp.CSRFToken != csrf.Value || csrf.Value != csrfTokenFor(session.Value) {
+		t.Fatalf("session %+v, csrf %+v, body csrf %q", session, csrf, resp.CSRFToken)
+	}
+	cookie := session.String() + "; " + csrf.String()
+
+	// Reads need only the cookie
+	if w := ts.do(http.MethodGet, "/v1/users/me", "", "", "Cookie", cookie); w.Code != http.StatusOK {
+		t.Fatalf("read with the cookie: %d %s", w.Code, w.Body)
+	}
+
+	// Changes need the CSRF token copied into the header; one that matches
+	// a planted CSRF cookie but not the session doesn't do
+	register := `{"filename":"handbook.pdf"}`
+	for name, headers := range map[string][]string{
+		"no header":      {"Cookie", cookie},
+		"wrong header":   {"Cookie", cookie, csrfHeader, "forged"},
+		"planted cookie": {"Cookie", session.String() + "; " + config.Session.CSRFCookieName + "=forged", csrfHeader, "forged"},
+		"another's":      {"Cookie", cookie, csrfHeader, csrfTokenFor("another session")},
+	} {
+		w := ts.do(http.MethodPost, "/v1/documents/register", "", register, headers...)
+		var problem Problem
+		decodeJSON(t, w, &problem)
+		if w.Code != http.StatusForbidden || problem.Code != codeCSRFFailed {
+			t.Errorf("%s: %d %s", name, w.Code, w.Body)
+		}
+	}
+	if w := ts.do(http.MethodPost, "/v1/documents/register", "", register, "Cookie", cookie, csrfHeader, csrf.Value); w.Code != http.StatusCreated {
+		t.Fatalf("with the CSRF header: %d %s", w.Code, w.Body)
+	}
+
+	// Cookie mode takes no bearer tokens
+	if w := ts.do(http.MethodGet, "/v1/users/me", session.Value, ""); w.Code != http.StatusUnauthorized {
+		t.Fatalf("bearer in cookie mode: got %d, want 401", w.Code)
+	}
+
+	// Logging out expires both cookies
+	w = ts.do(http.MethodPost, "/v1/auth/logout", "", "", "Cookie", cookie, csrfHeader, csrf.Value)
+	cookies = sessionCookies(t, w.Result())
+	if w.Code != http.StatusOK || cookies[config.Session.CookieName].MaxAge >= 0 || cookies[config.Session.CSRFCookieName].MaxAge >= 0 {
+		t.Fatalf("logout: %d, cookies %v", w.Code, cookies)
+	}
+}
+
+func TestBothSessionModes(t *testing.T) {
+	withConfig(t, func(cfg *Config) { cfg.Session.Mode = sessionModeBoth })
+	ts := newTestServer(t)
+
+	w := ts.do(http.MethodPost, "/v1/auth/register", "", `{"email":"user@example.com","password":"secret123","name":"Test User"}`)
+	var resp AuthResponse
+	decodeJSON(t, w, &resp)
+	if resp.Token == "" || resp.CSRFToken == "" {
+		t.Fatalf("register: %+v", resp)
+	}
+
+	// A bearer header needs no CSRF token; a malformed one isn't passed
+	// over for the cookie
+	if w := ts.do(http.MethodPost, "/v1/documents/register", resp.Token, `{"filename":"handbook.pdf"}`); w.Code != http.StatusCreated {
+		t.Fatalf("bearer change: %d %s", w.Code, w.Body)
+	}
+	cookie := config.Session.CookieName + "=" + resp.Token
+	if w := ts.do(http.MethodGet, "/v1/users/me", "", "", "Cookie", cookie, "Authorization", "Basic abc"); w.Code != http.StatusUnauthorized {
+		t.Fatalf("malformed header with a cookie: got %d, want 401", w.Code)
+	}
+}
+
+func TestSessionCookieAttributes(t *testing.T) {
+	withConfig(t, func(cfg *Config) {
+		cfg.Session.Mode = sessionModeCookie
+		cfg.Session.SameSite, cfg.Session.CookieSecure = "strict", true
+		cfg.Session.CookieDomain = "example.com"
+	})
+	ts := newTestServer(t)
+	ts.do(http.MethodPost, "/v1/auth/register", "", `{"email":"user@example.com","password":"secret123","name":"Test User"}`)
+
+	// Logging in sets the same pair as registering
+	w := ts.do(http.MethodPost, "/v1/auth/login", "", `{"email":"user@example.com","password":"secret123"}`)
+	cookies := sessionCookies(t, w.Result())
+	for _, name := range []string{config.Session.CookieName, config.Session.CSRFCookieName} {
+		cookie := cookies[name]
+		if cookie == nil || !cookie.Secure || cookie.SameSite != http.SameSiteStrictMode || cookie.Domain != "example.com" ||
+			cookie.MaxAge != int(config.Session.Lifetime.Seconds()) {
+			t.Fatalf("login cookie %s: %+v", name, cookie)
+		}
+	}
+
+	// Bearer mode neither sets nor reads cookies
+	withConfig(t, func(cfg *Config) { cfg.Session.Mode = sessionModeBearer })
+	w = ts.do(http.MethodPost, "/v1/auth/login", "", `{"email":"user@example.com","password":"secret123"}`)
+	var resp AuthResponse
+	decodeJSON(t, w, &resp)
+	if len(w.Result().Cookies()) != 0 || resp.Token == "" || resp.CSRFToken != "" {
+		t.Fatalf("bearer login: %+v, cookies %v", resp, w.Result().Cookies())
+	}
+	cookie := config.Session.CookieName + "=" + resp.Token
+	if w := ts.do(http.MethodGet, "/v1/users/me", "", "", "Cookie", cookie); w.Code != http.StatusUnauthorized {
+		t.Fatalf("cookie in bearer mode: got %d, want 401", w.Code)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+// ============================================================================
+// Graceful Shutdown
+// ============================================================================
+//
+// On SIGTERM or SIGINT the service fails its health check, optionally waits
+// server.shutdown_drain_delay for load balancers to notice, then stops
+// accepting connections and drains in-flight HTTP and gRPC calls within
+// server.shutdown_timeout. Background loops stop after their current unit of
+// work and the SIEM exporter flushes what it has queued. A second signal
+// exits immediately.
+
+var (
+	// backgroundCtx is cancelled when shutdown starts; long-running loops
+	// started with goBackground watch it
+	backgroundCtx, stopBackground = context.WithCancel(context.Background())
+	backgroundTasks               sync.WaitGroup
+
+	shuttingDown atomic.Bool
+)
+
+// goBackground runs fn in a goroutine that shutdown waits for
+func goBackground(fn func(ctx context.Context)) {
+	backgroundTasks.Add(1)
+	go func() {
+		defer backgroundTasks.Done()
+		fn(backgroundCtx)
+	}()
+}
+
+// serveUntilSignal runs the HTTP server until a shutdown signal arrives,
+// then drains it, the gRPC server and background work in turn
+func serveUntilSignal(server *http.Server, grpcServer *grpc.Server) {
+	signals, stopSignals := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stopSignals()
+
+	serveErr := make(chan error, 1)
+	go func() {
+		if err := listenAndServe(server); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			serveErr <- err
+		}
+	}()
+
+	select {
+	case err := <-serveErr:
+		fatal("Failed to start server", "error", err)
+	case <-signals.Done():
+	}
+	// Restore default handling so a second signal exits immediately
+	stopSignals()
+
+	timeout := config.Server.ShutdownTimeout
+	slog.Info("Shutdown started", "timeout", timeout.String())
+	shuttingDown.Store(true)
+	if grpcHealth != nil {
+		grpcHealth.Shutdown() // NOT_SERVING for good, so probes stop routing here during the drain delay
+	}
+
+	if delay := config.Server.ShutdownDrainDelay; delay > 0 {
+		time.Sleep(delay)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := server.Shutdown(ctx); err != nil {
+		slog.Warn("HTTP drain incomplete, closing remaining connections", "error", err)
+		server.Close()
+	}
+	if redirectServer != nil {
+		redirectServer.Shutdown(ctx)
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		grpcServer.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		slog.Warn("gRPC drain incomplete, stopping")
+		grpcServer.Stop()
+	}
+
+	stopBackground()
+	finished := make(chan struct{})
+	go func() {
+		backgroundTasks.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-ctx.Done():
+		slog.Warn("Background work did not stop before the shutdown timeout")
+	}
+
+	slog.Info("Shutdown complete")
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"google.golang.org/grpc/peer"
+)
+
+// ============================================================================
+// Security Event Export (SIEM)
+// ============================================================================
+//
+// Security-relevant events are queued and pushed to a SIEM webhook
+// (siem.webhook_url) and/or a syslog collector (siem.syslog_addr, e.g.
+// "udp://siem.internal:514") in one JSON schema. Export is best-effort: when
+// the queue is full events are dropped and counted rather than blocking
+// logins.
+
+// Security event types
+const (
+	EventLoginSuccess  = "auth.login.success"
+	EventLoginFailure  = "auth.login.failure"
+	EventRegister      = "auth.register"
+	EventLogout        = "auth.logout"
+	EventTokenInvalid  = "auth.token.invalid"
+	EventTokenRevoked  = "auth.token.revoked"
+	EventLockout       = "auth.lockout"
+	EventRoleChanged   = "user.role.changed"
+	securitySchemaName = "use-rag.security.v1"
+)
+
+const (
+	siemQueueSize     = 4096
+	siemBatchSize     = 100
+	siemFlushInterval = 5 * time.Second
+	siemSignatureHdr  = "X-Signature-SHA256"
+)
+
+// SecurityEvent is the exported schema
+type SecurityEvent struct {
+	Schema    string            `json:"schema"`
+	ID        string            `json:"id"`
+	Timestamp time.Time         `json:"timestamp"`
+	Type      string            `json:"event_type"`
+	Outcome   string            `json:"outcome"` // success | failure
+	Severity  string            `json:"severity"`
+	Service   string            `json:"service"`
+	UserID    string            `json:"user_id,omitempty"`
+	Email     string            `json:"email,omitempty"`
+	ActorID   string            `json:"actor_id,omitempty"` // who acted, when not the user
+	SourceIP  string            `json:"source_ip,omitempty"`
+	UserAgent string            `json:"user_agent,omitempty"`
+	RequestID string            `json:"request_id,omitempty"`
+	Transport string            `json:"transport"` // http | grpc
+	Reason    string            `json:"reason,omitempty"`
+	Details   map[string]string `json:"details,omitempty"`
+}
+
+var (
+	securityEvents  = make(chan SecurityEvent, siemQueueSize)
+	droppedEvents   atomic.Uint64
+	siemExportReady atomic.Bool
+	siemClient      = &http.Client{Timeout: 10 * time.Second}
+)
+
+// newSecurityEvent fills the common fields of an event
+func newSecurityEvent(eventType, outcome string) SecurityEvent {
+	severity := "info"
+	if outcome == "failure" {
+		severity = "warning"
+	}
+	switch eventType {
+	case EventLockout, EventRoleChanged:
+		severity = "high"
+	}
+	return SecurityEvent{
+		Schema:    securitySchemaName,
+		ID:        uuid.New().String(),
+		Timestamp: time.Now().UTC(),
+		Type:      eventType,
+		Outcome:   outcome,
+		Severity:  severity,
+		Service:   "auth-service",
+	}
+}
+
+// httpSecurityEvent builds an event carrying the request's origin
+func httpSecurityEvent(c *gin.Context, eventType, outcome string) SecurityEvent {
+	event := newSecurityEvent(eventType, outcome)
+	event.SourceIP = c.ClientIP()
+	event.UserAgent = c.Request.UserAgent()
+	event.RequestID = c.GetString(requestIDContextKey)
+	event.Transport = "http"
+	if user, exists := c.Get("user"); exists {
+		event.UserID = user.(*User).ID
+		event.Email = user.(*User).Email
+	}
+	return event
+}
+
+// grpcSecurityEvent builds an event carrying the gRPC peer's address
+func grpcSecurityEvent(ctx context.Context, eventType, outcome string) SecurityEvent {
+	event := newSecurityEvent(eventType, outcome)
+	event.Transport = "grpc"
+	event.SourceIP = grpcPeerIP(ctx)
+	if user := grpcUser(ctx); user != nil {
+		event.UserID = user.ID
+		event.Email = user.Email
+	}
+	return event
+}
+
+// grpcPeerIP returns the calling peer's IP address, if known
+func grpcPeerIP(ctx context.Context) string {
+	if p, ok := peer.FromContext(ctx); ok {
+		if host, _, err := net.SplitHostPort(p.Addr.String()); err == nil {
+			return host
+		}
+	}
+	return ""
+}
+
+// emitSecurityEvent puts an event on the admin feed (adminevents.go) and
+// queues it for export without blocking
+func emitSecurityEvent(event SecurityEvent) {
+	publishAdminEvent(adminEventOf(event))
+	if !siemExportReady.Load() {
+		return
+	}
+	select {
+	case securityEvents <- event:
+	default:
+		if droppedEvents.Add(1)%100 == 1 {
+			slog.Warn("SIEM export queue full", "dropped_total", droppedEvents.Load())
+		}
+	}
+}
+
+// startSecurityExport starts the exporter if a sink is configured
+func startSecurityExport() {
+	webhook := config.SIEM.WebhookURL
+	syslogAddr := config.SIEM.SyslogAddr
+	if webhook == "" && syslogAddr == "" {
+		return
+	}
+
+	var syslog *syslogSink
+	if syslogAddr != "" {
+		sink, err := newSyslogSink(syslogAddr)
+		if err != nil {
+			fatal("Invalid SIEM_SYSLOG_ADDR", "error", err)
+		}
+		syslog = sink
+	}
+
+	siemExportReady.Store(true)
+	slog.Info("Security event export enabled", "sinks", describeSinks(webhook, syslogAddr))
+
+	goBackground(func(ctx context.Context) {
+		ticker := time.NewTicker(siemFlushInterval)
+		defer ticker.Stop()
+
+		var batch []SecurityEvent
+		flush := func() {
+			if len(batch) == 0 {
+				return
+			}
+			if webhook != "" {
+				if err := postSecurityEvents(webhook, batch); err != nil {
+					slog.Warn("SIEM webhook export failed", "events", len(batch), "error", err)
+				}
+			}
+			batch = nil
+		}
+
+		export := func(event SecurityEvent) {
+			if syslog != nil {
+				syslog.send(event)
+			}
+			batch = append(batch, event)
+			if len(batch) >= siemBatchSize {
+				flush()
+			}
+		}
+
+		for {
+			select {
+			case event := <-securityEvents:
+				export(event)
+			case <-ticker.C:
+				flush()
+			case <-ctx.Done():
+				// Send what is already queued before exiting
+				for {
+					select {
+					case event := <-securityEvents:
+						export(event)
+					default:
+						flush()
+						return
+					}
+				}
+			}
+		}
+	})
+}
+
+func describeSinks(webhook, syslogAddr string) string {
+	switch {
+	case webhook != "" && syslogAddr != "":
+		return "webhook and syslog"
+	case webhook != "":
+		return "webhook"
+	}
+	return "syslog"
+}
+
+// postSecurityEvents sends a batch to the webhook, signed with
+// SIEM_WEBHOOK_SECRET when set
+func postSecurityEvents(webhook string, batch []SecurityEvent) error {
+	body, err := json.Marshal(gin.H{"events": batch})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, webhook, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if secret := config.SIEM.WebhookSecret; secret != "" {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(body)
+		req.Header.Set(siemSignatureHdr, hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := siemClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+// syslogSink writes RFC 5424 messages with the event JSON as the body
+type syslogSink struct {
+	network, addr string
+	hostname      string
+	conn          net.Conn
+}
+
+func newSyslogSink(raw string) (*syslogSink, error) {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" || (u.Scheme != "udp" && u.Scheme != "tcp") {
+		return nil, fmt.Errorf("expected udp://host:port or tcp://host:port, got %q", raw)
+	}
+	hostname, _ := os.Hostname()
+	return &syslogSink{network: u.Scheme, addr: u.Host, hostname: hostname}, nil
+}
+
+// send writes one event, redialling after a failed write
+func (s *syslogSink) send(event SecurityEvent) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+
+	// Facility 10 (authpriv); severity 4 (warning) for failures, else 6 (info)
+	severity := 6
+	if event.Outcome == "failure" || event.Severity == "high" {
+		severity = 4
+	}
+	msg := fmt.Sprintf("<%d>1 %s %s auth-service - %s - %s",
+		10*8+severity, event.Timestamp.Format(time.RFC3339Nano), s.hostname, event.Type, body)
+	if s.network == "tcp" {
+		msg = fmt.Sprintf("%d %s", len(msg), msg) // RFC 6587 octet counting
+	}
+
+	for attempt := 0; attempt < 2; attempt++ {
+		if s.conn == nil {
+			conn, err := net.DialTimeout(s.network, s.addr, 5*time.Second)
+			if err != nil {
+				slog.Warn("SIEM syslog dial failed", "error", err)
+				return
+			}
+			s.conn = conn
+		}
+		s.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+		if _, err := s.conn.Write([]byte(msg)); err == nil {
+			return
+		}
+		s.conn.Close()
+		s.conn = nil
+	}
+}
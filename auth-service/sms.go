@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// ============================================================================
+// Text Messages
+// ============================================================================
+//
+// Phone verification and login codes (phone.go) go out through an
+// SMSSender chosen by sms.provider: twilio, sns (Amazon SNS direct
+// publish) or log, the default, which writes each message to the log
+// instead of sending it. Unlike email, a code is sent while the request
+// waits, so a failed send is reported to the user rather than retried; they
+// can ask for another code.
+
+const (
+	smsProviderLog    = "log"
+	smsProviderTwilio = "twilio"
+	smsProviderSNS    = "sns"
+
+	smsSendTimeout = 10 * time.Second
+)
+
+// SMSSender delivers a text message to an E.164 number
+type SMSSender interface {
+	Send(ctx context.Context, to, body string) error
+}
+
+var (
+	smsClient           = &http.Client{Timeout: smsSendTimeout}
+	smsSender SMSSender = logSMSSender{}
+
+	e164Pattern = regexp.MustCompile(`^\+[1-9][0-9]{7,14}$`)
+)
+
+// newSMSSender builds the configured provider
+func newSMSSender(cfg SMSConfig) (SMSSender, error) {
+	switch cfg.Provider {
+	case smsProviderLog:
+		return logSMSSender{}, nil
+	case smsProviderTwilio:
+		if cfg.TwilioAccountSID == "" || cfg.TwilioAuthToken == "" {
+			return nil, errors.New("twilio_account_sid and twilio_auth_token are required for the twilio provider")
+		}
+		if !e164Pattern.MatchString(cfg.From) {
+			return nil, errors.New("from must be an E.164 number such as +14155550100 for the twilio provider")
+		}
+		return &twilioSender{
+			accountSID: cfg.TwilioAccountSID,
+			authToken:  cfg.TwilioAuthToken,
+			from:       cfg.From,
+			endpoint:   "https://api.twilio.com/2010-04-01/Accounts/" + url.PathEscape(cfg.TwilioAccountSID) + "/Messages.json",
+		}, nil
+	case smsProviderSNS:
+		return newSNSSender(cfg)
+	}
+	return nil, fmt.Errorf("unknown sms provider %q; expected log, twilio or sns", cfg.Provider)
+}
+
+// startSMS switches from the log sender to the configured provider
+func startSMS() {
+	sender, err := newSMSSender(config.SMS)
+	if err != nil {
+		fatal("Invalid SMS configuration", "error", err)
+	}
+	smsSender = sender
+	slog.Info("Text messages enabled", "provider", config.SMS.Provider, "phone_login", config.SMS.Login)
+}
+
+// sendSMS delivers one message, logging why it failed
+func sendSMS(to, body string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), smsSendTimeout)
+	defer cancel()
+	if err := smsSender.Send(ctx, to, body); err != nil {
+		slog.Warn("Text message not sent", "provider", config.SMS.Provider, "error", err)
+		return errSMSUnavailable
+	}
+	return nil
+}
+
+// smsHTTPError describes a failed API response
+func smsHTTPError(provider string, resp *http.Response) error {
+	detail, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	return fmt.Errorf("%s returned %s: %s", provider, resp.Status, bytes.TrimSpace(detail))
+}
+
+// ----------------------------------------------------------------------------
+// Log (development)
+// ----------------------------------------------------------------------------
+
+// logSMSSender writes messages to the log instead of sending them
+type logSMSSender struct{}
+
+func (logSMSSender) Send(ctx context.Context, to, body string) error {
+	slog.Info("Text message not sent; sms.provider is log", "to", to, "body", body)
+	return nil
+}
+
+// ----------------------------------------------------------------------------
+// Twilio
+// ----------------------------------------------------------------------------
+
+type twilioSender struct {
+	accountSID, authToken string
+	from                  string
+	endpoint              string
+}
+
+func (s *twilioSender) Send(ctx context.Context, to, body string) error {
+	form := url.Values{"To": {to}, "From": {s.from}, "Body": {body}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(s.accountSID, s.authToken)
+
+	resp, err := smsClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return smsHTTPError("Twilio", resp)
+	}
+	return nil
+}
+
+// ----------------------------------------------------------------------------
+// Amazon SNS
+// ----------------------------------------------------------------------------
+
+type snsSender struct {
+	region                             string
+	accessKey, secretKey, sessionToken string
+	endpoint                           string
+}
+
+func newSNSSender(cfg SMSConfig) (*snsSender, error) {
+	if cfg.SNSRegion == "" {
+		return nil, errors.New("sns_region is required for the sns provider")
+	}
+	// Standard AWS credential variables, as for the ses mail provider
+	s := &snsSender{
+		region:       cfg.SNSRegion,
+		accessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		endpoint:     "https://sns." + cfg.SNSRegion + ".amazonaws.com/",
+	}
+	if s.accessKey == "" || s.secretKey == "" {
+		return nil, errors.New("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY are required for the sns provider")
+	}
+	return s, nil
+}
+
+func (s *snsSender) Send(ctx context.Context, to, body string) error {
+	form := url.Values{
+		"Action":      {"Publish"},
+		"Version":     {"2010-03-31"},
+		"PhoneNumber": {to},
+		"Message":     {body},
+		// Transactional messages are routed for delivery rather than cost
+		"MessageAttributes.entry.1.Name":              {"AWS.SNS.SMS.SMSType"},
+		"MessageAttributes.entry.1.Value.DataType":    {"String"},
+		"MessageAttributes.entry.1.Value.StringValue": {"Transactional"},
+	}
+	payload := []byte(form.Encode())
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.endpoint, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	payloadHash := sha256.Sum256(payload)
+	signAWSRequest(req, "sns", s.region, s.accessKey, s.secretKey, s.sessionToken,
+		hex.EncodeToString(payloadHash[:]), time.Now().UTC())
+
+	resp, err := smsClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return smsHTTPError("SNS", resp)
+	}
+	return nil
+}
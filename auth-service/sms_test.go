@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNewSMSSender(t *testing.T) {
+	cfg := config.SMS
+	cfg.Provider = smsProviderTwilio
+	if _, err := newSMSSender(cfg); err == nil {
+		t.Error("twilio without credentials accepted")
+	}
+	cfg.TwilioAccountSID, cfg.TwilioAuthToken, cfg.From = "AC123", "token", "4155550100"
+	if _, err := newSMSSender(cfg); err == nil {
+		t.Error("twilio with a non-E.164 sender accepted")
+	}
+	cfg.From = "+14155550100"
+	if _, err := newSMSSender(cfg); err != nil {
+		t.Error(err)
+	}
+	cfg.Provider = "carrier-pigeon"
+	if _, err := newSMSSender(cfg); err == nil {
+		t.Error("unknown provider accepted")
+	}
+}
+
+func TestTwilioSender(t *testing.T) {
+	status := http.StatusCreated
+	var user, pass, to, from, body string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pass, _ = r.BasicAuth()
+		r.ParseForm()
+		to, from, body = r.PostForm.Get("To"), r.PostForm.Get("From"), r.PostForm.Get("Body")
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+
+	s := &twilioSender{accountSID: "AC123", authToken: "token", from: "+14155550100", endpoint: srv.URL}
+	if err := s.Send(context.Background(), "+34600000000", "Your code"); err != nil {
+		t.Fatal(err)
+	}
+	if user != "AC123" || pass != "token" || to != "+34600000000" || from != "+14155550100" || body != "Your code" {
+		t.Fatalf("request: %s:%s %s -> %s %q", user, pass, from, to, body)
+	}
+	status = http.StatusBadRequest
+	if err := s.Send(context.Background(), "+34600000000", "Your code"); err == nil {
+		t.Error("400 accepted")
+	}
+}
+
+func TestSNSSender(t *testing.T) {
+	var auth, action, phone string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("Authorization")
+		r.ParseForm()
+		action, phone = r.PostForm.Get("Action"), r.PostForm.Get("PhoneNumber")
+	}))
+	defer srv.Close()
+
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIDEXAMPLE")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	cfg := config.SMS
+	cfg.Provider, cfg.SNSRegion = smsProviderSNS, "eu-west-1"
+	s, err := newSNSSender(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.endpoint = srv.URL + "/"
+
+	if err := s.Send(context.Background(), "+34600000000", "Your code"); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(auth, "/eu-west-1/sns/aws4_request") || action != "Publish" || phone != "+34600000000" {
+		t.Fatalf("request: auth %q, action %q, phone %q", auth, action, phone)
+	}
+}
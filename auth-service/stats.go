@@ -0,0 +1,284 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ============================================================================
+// Admin Statistics
+// ============================================================================
+//
+// GET /admin/stats?period=day|week|month|quarter returns what the ops
+// dashboard charts in one call: signups, active users, login outcomes and
+// document growth per bucket (hours for a day, days otherwise), plus
+// current totals. Activity and login outcomes are counted in hourly buckets
+// kept for statsRetention; signups and documents come from their
+// timestamps. Challenge rates come from the login risk engine (risk.go).
+// Storage covers uploaded and synced files, whose sizes are
+// known; documents registered by name only count towards the totals.
+
+const statsRetention = 90 * 24 * time.Hour
+
+// statsPeriods maps ?period= to its window and bucket size
+var statsPeriods = map[string]struct{ window, bucket time.Duration }{
+	"day":     {24 * time.Hour, time.Hour},
+	"week":    {7 * 24 * time.Hour, 24 * time.Hour},
+	"month":   {30 * 24 * time.Hour, 24 * time.Hour},
+	"quarter": {statsRetention, 24 * time.Hour},
+}
+
+// hourStats is what one hour of traffic recorded
+type hourStats struct {
+	active        map[string]struct{} // user IDs
+	logins        int
+	loginFailures int
+
+	challenges       int // CAPTCHAs required
+	challengesPassed int
+	throttled        int // sign-ins refused by the per-IP and per-ASN throttles
+}
+
+var (
+	hourlyStats = make(map[int64]*hourStats) // unix hour -> stats
+	statsMutex  sync.Mutex
+)
+
+// statsHour returns the bucket for now, creating it and pruning old ones;
+// callers hold statsMutex
+func statsHour() *hourStats {
+	hour := time.Now().Unix() / 3600
+	bucket, exists := hourlyStats[hour]
+	if !exists {
+		bucket = &hourStats{active: make(map[string]struct{})}
+		hourlyStats[hour] = bucket
+		oldest := hour - int64(statsRetention/time.Hour)
+		for h := range hourlyStats {
+			if h < oldest {
+				delete(hourlyStats, h)
+			}
+		}
+	}
+	return bucket
+}
+
+// recordActivity marks a user active in the current hour
+func recordActivity(userID string) {
+	statsMutex.Lock()
+	statsHour().active[userID] = struct{}{}
+	statsMutex.Unlock()
+}
+
+// recordLoginOutcome counts a login attempt that reached the password check
+func recordLoginOutcome(success bool) {
+	statsMutex.Lock()
+	bucket := statsHour()
+	if success {
+		bucket.logins++
+	} else {
+		bucket.loginFailures++
+	}
+	statsMutex.Unlock()
+}
+
+// recordRiskOutcome counts a sign-in the risk engine challenged or
+// throttled
+func recordRiskOutcome(outcome int) {
+	statsMutex.Lock()
+	bucket := statsHour()
+	switch outcome {
+	case riskChallenged:
+		bucket.challenges++
+	case riskChallengePassed:
+		bucket.challengesPassed++
+	case riskThrottled:
+		bucket.throttled++
+	}
+	statsMutex.Unlock()
+}
+
+// recordDocumentUpload notes an uploaded file's size and media type
+func recordDocumentUpload(filename string, size int, mediaType string) {
+	var record documentRecord
+	var owned bool
+	localDocuments.Update(func(tx DocumentTx) error {
+		if record, owned = tx.setSize(filename, int64(size)); owned {
+			record.Type = mediaType
+			tx.put(filename, record)
+		}
+		return nil
+	})
+	if owned {
+		saveDocumentMeta(filename, documentMeta(record))
+	}
+}
+
+// StatsBucket is one slice of the requested period
+type StatsBucket struct {
+	Start          time.Time `json:"start"`
+	Signups        int       `json:"signups"`
+	ActiveUsers    int       `json:"active_users"`
+	Logins         int       `json:"logins"`
+	LoginFailures  int       `json:"login_failures"`
+	FailureRate    float64   `json:"failure_rate"`
+	DocumentsAdded int       `json:"documents_added"`
+
+	Challenges       int     `json:"challenges"`
+	ChallengesPassed int     `json:"challenges_passed"`
+	ChallengeRate    float64 `json:"challenge_rate"` // challenges per sign-in attempt
+	Throttled        int     `json:"throttled"`
+}
+
+// StatsTotals summarises the period and the current stores
+type StatsTotals struct {
+	Users             int     `json:"users"`
+	Documents         int     `json:"documents"`
+	StorageBytes      int64   `json:"storage_bytes"`
+	DailyActiveUsers  int     `json:"daily_active_users"`
+	WeeklyActiveUsers int     `json:"weekly_active_users"`
+	Signups           int     `json:"signups"`
+	Logins            int     `json:"logins"`
+	LoginFailures     int     `json:"login_failures"`
+	FailureRate       float64 `json:"failure_rate"`
+	DocumentsAdded    int     `json:"documents_added"`
+	DocumentGrowthPct float64 `json:"document_growth_pct"` // added / documents at the start
+
+	Challenges       int     `json:"challenges"`
+	ChallengesPassed int     `json:"challenges_passed"`
+	ChallengeRate    float64 `json:"challenge_rate"`
+	Throttled        int     `json:"throttled"`
+}
+
+// StatsResponse is the GET /admin/stats body
+type StatsResponse struct {
+	Period      string        `json:"period"`
+	From        time.Time     `json:"from"`
+	To          time.Time     `json:"to"`
+	Bucket      string        `json:"bucket"` // bucket width, e.g. "1h0m0s"
+	Buckets     []StatsBucket `json:"buckets"`
+	Totals      StatsTotals   `json:"totals"`
+	GeneratedAt time.Time     `json:"generated_at"`
+}
+
+// failureRate is failures over attempts, 0 when there were none
+func failureRate(logins, failures int) float64 {
+	if logins+failures == 0 {
+		return 0
+	}
+	return float64(failures) / float64(logins+failures)
+}
+
+// challengeRate is CAPTCHAs required over sign-in attempts, counting the
+// ones refused before reaching the password check
+func challengeRate(b StatsBucket) float64 {
+	attempts := b.Logins + b.LoginFailures + b.Throttled
+	if attempts == 0 {
+		return 0
+	}
+	return min(float64(b.Challenges)/float64(attempts), 1)
+}
+
+// getStats returns time-bucketed usage statistics (admin only)
+func getStats(c *gin.Context) {
+	name := c.DefaultQuery("period", "week")
+	period, ok := statsPeriods[name]
+	if !ok {
+		respondError(c, http.StatusBadRequest, codeInvalidRequest, "period must be day, week, month or quarter")
+		return
+	}
+
+	now := time.Now().UTC()
+	end := now.Truncate(period.bucket).Add(period.bucket)
+	start := end.Add(-period.window)
+	buckets := make([]StatsBucket, period.window/period.bucket)
+	for i := range buckets {
+		buckets[i].Start = start.Add(time.Duration(i) * period.bucket)
+	}
+	indexOf := func(t time.Time) int {
+		if t.Before(start) || !t.Before(end) {
+			return -1
+		}
+		return int(t.Sub(start) / period.bucket)
+	}
+	var totals StatsTotals
+
+	localUsers.Each(func(user *User) {
+		totals.Users++
+		if i := indexOf(user.CreatedAt); i >= 0 {
+			buckets[i].Signups++
+			totals.Signups++
+		}
+	})
+
+	localDocuments.View(func(tx DocumentTx) {
+		totals.Documents = tx.len()
+		totals.StorageBytes = tx.totalBytes()
+		tx.each(func(_ string, record documentRecord) {
+			if i := indexOf(record.AddedAt); i >= 0 {
+				buckets[i].DocumentsAdded++
+				totals.DocumentsAdded++
+			}
+		})
+	})
+	if before := totals.Documents - totals.DocumentsAdded; before > 0 {
+		totals.DocumentGrowthPct = float64(totals.DocumentsAdded) / float64(before) * 100
+	}
+
+	statsMutex.Lock()
+	bucketActive := make([]map[string]struct{}, len(buckets))
+	daily, weekly := make(map[string]struct{}), make(map[string]struct{})
+	for hour, stats := range hourlyStats {
+		at := time.Unix(hour*3600, 0).UTC()
+		for id := range stats.active {
+			if now.Sub(at) < 24*time.Hour {
+				daily[id] = struct{}{}
+			}
+			if now.Sub(at) < 7*24*time.Hour {
+				weekly[id] = struct{}{}
+			}
+		}
+		i := indexOf(at)
+		if i < 0 {
+			continue
+		}
+		buckets[i].Logins += stats.logins
+		buckets[i].LoginFailures += stats.loginFailures
+		buckets[i].Challenges += stats.challenges
+		buckets[i].ChallengesPassed += stats.challengesPassed
+		buckets[i].Throttled += stats.throttled
+		if bucketActive[i] == nil {
+			bucketActive[i] = make(map[string]struct{})
+		}
+		for id := range stats.active {
+			bucketActive[i][id] = struct{}{}
+		}
+	}
+	statsMutex.Unlock()
+
+	for i := range buckets {
+		buckets[i].ActiveUsers = len(bucketActive[i])
+		buckets[i].FailureRate = failureRate(buckets[i].Logins, buckets[i].LoginFailures)
+		totals.Logins += buckets[i].Logins
+		totals.LoginFailures += buckets[i].LoginFailures
+		buckets[i].ChallengeRate = challengeRate(buckets[i])
+		totals.Challenges += buckets[i].Challenges
+		totals.ChallengesPassed += buckets[i].ChallengesPassed
+		totals.Throttled += buckets[i].Throttled
+	}
+	totals.FailureRate = failureRate(totals.Logins, totals.LoginFailures)
+	totals.ChallengeRate = challengeRate(StatsBucket{Logins: totals.Logins, LoginFailures: totals.LoginFailures, Challenges: totals.Challenges, Throttled: totals.Throttled})
+	totals.DailyActiveUsers, totals.WeeklyActiveUsers = len(daily), len(weekly)
+
+	c.JSON(http.StatusOK, StatsResponse{
+		Period:      name,
+		From:        start,
+		To:          end,
+		Bucket:      period.bucket.String(),
+		Buckets:     buckets,
+		Totals:      totals,
+		GeneratedAt: now,
+	})
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ============================================================================
+// Streaming Query Proxy
+// ============================================================================
+
+// StreamQueryRequest mirrors the RAG backend's ChatRequest
+type StreamQueryRequest struct {
+	Question       string   `json:"question" binding:"required"`
+	NChunks        int      `json:"n_chunks,omitempty"`
+	FilterSources  []string `json:"filter_sources,omitempty"`
+	ForceWebSearch bool     `json:"force_web_search,omitempty"`
+
+	// Language is the question's; detected when absent. PreferredSources are
+	// the allowed sources in that language (languages.go); the backend may
+	// rank them first.
+	Language         string   `json:"language,omitempty" binding:"omitempty,max=3"`
+	PreferredSources []string `json:"preferred_sources,omitempty"`
+
+	// Collection picks the search settings (search.go); Search carries
+	// them to the backend. Variant is set by a running experiment
+	// (experiments.go), never by the client.
+	Collection string       `json:"collection,omitempty" binding:"max=64"`
+	Search     *QuerySearch `json:"search,omitempty"`
+	Variant    string       `json:"variant,omitempty"`
+
+	// Providers is the failover order for the LLM and embeddings
+	// (providers.go), set as the query is sent
+	Providers *QueryProviders `json:"providers,omitempty"`
+}
+
+// streamClient has no timeout because streamed answers can run for minutes;
+// cancellation is driven by the request context instead.
+var streamClient = &http.Client{}
+
+// ragBackendURL returns the base URL of the Python RAG backend
+func ragBackendURL() string {
+	return strings.TrimRight(config.RAGBackend.URL, "/")
+}
+
+// allowedSources restricts the requested sources to documents the user owns
+// or that are org-wide. Admins may query any document, so their filter is
+// passed through unchanged.
+func allowedSources(user *User, requested []string) []string {
+	return defaultService.AllowedSources(user, requested)
+}
+
+// AllowedSources is allowedSources against this service's documents
+func (s *Service) AllowedSources(user *User, requested []string) []string {
+	if user.Role == "admin" {
+		return requested
+	}
+
+	if len(requested) == 0 {
+		return s.ReadableBy(user)
+	}
+
+	filtered := make([]string, 0, len(requested))
+	s.documents.View(func(tx DocumentTx) {
+		for _, doc := range requested {
+			if s.readable(tx, user, doc) {
+				filtered = append(filtered, doc)
+			}
+		}
+	})
+	return filtered
+}
+
+// prepareQuery scopes a query to the documents the user may read and, once
+// allow has charged it to their plan, fills in what the backend is sent:
+// the question's language and the sources in it, and the collection's
+// search settings. Sources the user picked move to the front of their
+// recent documents. It returns errNoSourcesToQuery or errQuotaExceeded
+// when the query can't be asked.
+func (s *Service) prepareQuery(user *User, req *StreamQueryRequest, fallbackLanguage string, allow func() bool) error {
+	picked := len(req.FilterSources) > 0
+	req.FilterSources = s.AllowedSources(user, req.FilterSources)
+	if user.Role != "admin" && len(req.FilterSources) == 0 {
+		return errNoSourcesToQuery
+	}
+	if !allow() {
+		return errQuotaExceeded
+	}
+	if picked {
+		touchDocuments(user.ID, req.FilterSources, time.Now().UTC())
+	}
+	req.Language = questionLanguage(*req, fallbackLanguage)
+	req.PreferredSources = nil
+	if len(req.FilterSources) > 0 {
+		req.PreferredSources = s.InLanguage(req.FilterSources, req.Language)
+	}
+	search := searchFor(req.Collection)
+	req.Collection, req.Search, req.Variant = search.Collection, &search, ""
+	return nil
+}
+
+// openQueryStream starts a streamed query against the RAG backend. The
+// caller owns the response body.
+func openQueryStream(ctx context.Context, req StreamQueryRequest) (*http.Response, error) {
+	req.Providers = providersFor(time.Now())
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, fmt.Errorf("encode query: %w", err)
+	}
+
+	upstreamReq, err := http.NewRequestWithContext(ctx, http.MethodPost,
+		ragBackendURL()+"/chat/stream", bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("build upstream request: %w", err)
+	}
+	upstreamReq.Header.Set("Content-Type", "application/json")
+	upstreamReq.Header.Set("Accept", "text/event-stream")
+	forwardRequestID(upstreamReq)
+
+	resp, err := streamClient.Do(upstreamReq)
+	if err != nil {
+		return nil, fmt.Errorf("upstream request failed: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("upstream returned %s", resp.Status)
+	}
+	return resp, nil
+}
+
+// streamQuery proxies a streamed answer from the RAG backend to the browser
+// as Server-Sent Events, scoped to the caller's documents
+func streamQuery(c *gin.Context) {
+	var req StreamQueryRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondBindError(c, err)
+		return
+	}
+
+	user, _ := c.Get("user")
+	currentUser := user.(*User)
+
+	err := defaultService.prepareQuery(currentUser, &req, requestLanguage(c), func() bool { return allowQuery(c, currentUser) })
+	if errors.Is(err, errNoSourcesToQuery) {
+		respondError(c, http.StatusForbidden, codeForbidden, err.Error())
+		return
+	}
+	if err != nil {
+		return // allowQuery has answered
+	}
+	record := startQueryRecord(c.GetString(requestIDContextKey), currentUser, "", &req)
+
+	// Tie the upstream request to the client connection so a disconnect
+	// cancels generation on the backend
+	resp, err := openQueryStream(c.Request.Context(), req)
+	if err != nil {
+		if c.Request.Context().Err() != nil {
+			finishQueryRecord(record, queryCancelled, time.Time{}, 0)
+			return
+		}
+		finishQueryRecord(record, queryFailed, time.Time{}, 0)
+		slog.Warn("Stream proxy failed", "request_id", c.GetString(requestIDContextKey), "error", err)
+		respondError(c, http.StatusBadGateway, codeUpstreamUnavailable, "Query backend unavailable")
+		return
+	}
+	defer resp.Body.Close()
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+
+	var firstByte time.Time
+	answerLength, outcome := 0, queryAnswered
+	reader := bufio.NewReader(resp.Body)
+	c.Stream(func(w io.Writer) bool {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 {
+			if data, ok := bytes.CutPrefix(bytes.TrimRight(line, "\r\n"), []byte("data: ")); ok && !bytes.HasPrefix(data, []byte("[")) {
+				if firstByte.IsZero() {
+					firstByte = time.Now()
+				}
+				answerLength += len([]rune(string(data)))
+			}
+			if _, werr := w.Write(line); werr != nil {
+				outcome = queryCancelled
+				return false
+			}
+		}
+		if err != nil {
+			if c.Request.Context().Err() != nil {
+				outcome = queryCancelled
+			} else if err != io.EOF {
+				outcome = queryFailed
+				slog.Warn("Stream proxy upstream read failed", "request_id", c.GetString(requestIDContextKey), "error", err)
+				w.Write([]byte("data: [ERROR]Upstream stream interrupted[/ERROR]\n\n"))
+			}
+			return false
+		}
+		return true
+	})
+	finishQueryRecord(record, outcome, firstByte, answerLength)
+}
@@ -0,0 +1,456 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ============================================================================
+// Password Strength
+// ============================================================================
+//
+// A zxcvbn-style estimate of how many guesses a password would take. The
+// password is matched against guessable patterns: common passwords, the
+// user's own name and email, sequences (abc, 9876), repeats, straight rows
+// of keys and recent years, with capitalized, reversed and l33t variants
+// of dictionary words. The cheapest way to cover the whole password with
+// matches and single brute-forced characters is the estimate; its order of
+// magnitude is the 0-4 score. POST /auth/password-strength lets the UI
+// show the same score and feedback the server enforces: registration and
+// invitation acceptance refuse passwords below passwords.min_score.
+//
+// The built-in dictionary is small, so the estimate is optimistic for
+// rarer words; it errs towards accepting, never towards rejecting good
+// passwords.
+
+const maxStrengthInput = 256
+
+var errWeakPassword = errors.New("Password is too easy to guess")
+
+// PasswordStrengthRequest for POST /auth/password-strength. Email and name,
+// when known, count as guessable words.
+type PasswordStrengthRequest struct {
+	Password string `json:"password" binding:"required,max=256"`
+	Email    string `json:"email" binding:"max=254"`
+	Name     string `json:"name" binding:"max=100"`
+}
+
+// PasswordStrength is the estimate for one password
+type PasswordStrength struct {
+	Score        int      `json:"score"`         // 0 (trivial) to 4 (very strong)
+	GuessesLog10 float64  `json:"guesses_log10"` // estimated guesses, as a power of ten
+	Warning      string   `json:"warning,omitempty"`
+	Suggestions  []string `json:"suggestions,omitempty"`
+	MinScore     int      `json:"min_score"`
+	Acceptable   bool     `json:"acceptable"`
+}
+
+// strengthMatch is a guessable stretch of the password, runes i to j
+type strengthMatch struct {
+	pattern      string // dictionary, user_input, sequence, repeat, keyboard, year
+	i, j         int
+	log10Guesses float64
+	capitalized  bool
+	l33t         bool
+	reversed     bool
+	rank         int
+}
+
+// commonPasswords is a short list of the most used passwords and words in
+// them, most common first
+var commonPasswords = rankedWords(strings.Fields(`
+	123456 password 12345678 qwerty 123456789 12345 1234 111111 1234567
+	dragon 123123 baseball abc123 football monkey letmein shadow master
+	696969 mustang michael pussy superman 1qaz2wsx 7777777 121212 000000
+	qazwsx 123qwe killer trustno1 jordan jennifer zxcvbnm asdfgh hunter
+	buster soccer harley batman andrew tigger sunshine iloveyou 2000
+	charlie robert thomas hockey ranger daniel starwars klaster 112233
+	george computer michelle jessica pepper 1111 zxcvbn 555555 11111111
+	131313 freedom 777777 pass maggie 159753 aaaaaa ginger princess
+	joshua cheese amanda summer love ashley nicole chelsea biteme matthew
+	access yankees 987654321 dallas austin thunder taylor matrix welcome
+	secret admin login hello changeme default guest root test user
+	qwertyuiop solo abc monkey dog cat flower winter spring autumn
+	love god money sex angel baby family friend friends happy lucky
+	blessed company service server system letmein1 passw0rd p@ssword
+`))
+
+// keyboardRows are the straight rows of a US keyboard
+var keyboardRows = []string{"`1234567890-=", "qwertyuiop[]\\", "asdfghjkl;'", "zxcvbnm,./"}
+
+// l33tTable undoes common character substitutions
+var l33tTable = map[rune]rune{'4': 'a', '@': 'a', '8': 'b', '(': 'c', '3': 'e', '6': 'g', '1': 'i', '!': 'i', '|': 'l', '0': 'o', '$': 's', '5': 's', '7': 't', '+': 't', '2': 'z'}
+
+func rankedWords(words []string) map[string]int {
+	ranked := make(map[string]int, len(words))
+	for i, word := range words {
+		if _, exists := ranked[word]; !exists {
+			ranked[word] = i + 1
+		}
+	}
+	return ranked
+}
+
+// userInputWords are the guessable parts of a user's email and name
+func userInputWords(email, name string) map[string]int {
+	var words []string
+	local, domain, _ := strings.Cut(strings.ToLower(email), "@")
+	words = append(words, local)
+	split := func(s string) []string {
+		return strings.FieldsFunc(s, func(r rune) bool { return !unicode.IsLetter(r) && !unicode.IsDigit(r) })
+	}
+	words = append(words, split(local)...)
+	if label, _, _ := strings.Cut(domain, "."); label != "" {
+		words = append(words, label)
+	}
+	words = append(words, split(strings.ToLower(name))...)
+
+	kept := words[:0]
+	for _, word := range words {
+		if len([]rune(word)) >= 3 {
+			kept = append(kept, word)
+		}
+	}
+	return rankedWords(kept)
+}
+
+// estimatePasswordStrength scores a password, counting the user's email
+// and name as guessable
+func estimatePasswordStrength(password, email, name string) PasswordStrength {
+	runes := []rune(password)
+	if len(runes) > maxStrengthInput {
+		runes = runes[:maxStrengthInput]
+	}
+	log10Guesses, path := mostGuessableCover(runes, userInputWords(email, name))
+
+	strength := PasswordStrength{
+		Score:        strengthScore(log10Guesses),
+		GuessesLog10: math.Round(log10Guesses*100) / 100,
+		MinScore:     config.Passwords.MinScore,
+	}
+	strength.Acceptable = strength.Score >= strength.MinScore
+	strength.Warning, strength.Suggestions = strengthFeedback(strength.Score, path)
+	return strength
+}
+
+// strengthScore maps guesses to zxcvbn's 0-4 scale
+func strengthScore(log10Guesses float64) int {
+	for score, limit := range []float64{3, 6, 8, 10} {
+		if log10Guesses < limit {
+			return score
+		}
+	}
+	return 4
+}
+
+// mostGuessableCover finds the fewest guesses that cover the password with
+// matches and brute-forced characters, returning the matches used
+func mostGuessableCover(runes []rune, userWords map[string]int) (float64, []strengthMatch) {
+	n := len(runes)
+	matches := findStrengthMatches(runes, userWords)
+	byEnd := make([][]strengthMatch, n)
+	for _, m := range matches {
+		byEnd[m.j] = append(byEnd[m.j], m)
+	}
+
+	const bruteforcePerChar = 1 // log10 of 10 guesses per character
+	best := make([]float64, n+1)
+	via := make([]*strengthMatch, n+1)
+	for k := 1; k <= n; k++ {
+		best[k] = best[k-1] + bruteforcePerChar
+		for idx := range byEnd[k-1] {
+			m := &byEnd[k-1][idx]
+			if cost := best[m.i] + m.log10Guesses; cost < best[k] {
+				best[k], via[k] = cost, m
+			}
+		}
+	}
+
+	var path []strengthMatch
+	for k := n; k > 0; {
+		if m := via[k]; m != nil {
+			path = append(path, *m)
+			k = m.i
+		} else {
+			k--
+		}
+	}
+	return best[n], path
+}
+
+// findStrengthMatches lists every guessable pattern in the password
+func findStrengthMatches(runes []rune, userWords map[string]int) []strengthMatch {
+	lower := []rune(strings.ToLower(string(runes)))
+	if len(lower) != len(runes) {
+		lower = runes // a case mapping changed the length; match as typed
+	}
+	unl33t := make([]rune, len(lower))
+	for i, r := range lower {
+		if plain, ok := l33tTable[r]; ok {
+			unl33t[i] = plain
+		} else {
+			unl33t[i] = r
+		}
+	}
+
+	var matches []strengthMatch
+	add := func(m strengthMatch) {
+		minimum := math.Log10(50)
+		if m.i == m.j {
+			minimum = 1
+		}
+		m.log10Guesses = math.Max(m.log10Guesses, minimum)
+		matches = append(matches, m)
+	}
+
+	// Dictionary words and the user's own details
+	for _, dict := range []struct {
+		pattern string
+		words   map[string]int
+	}{{"dictionary", commonPasswords}, {"user_input", userWords}} {
+		longest := 0
+		for word := range dict.words {
+			longest = max(longest, len([]rune(word)))
+		}
+		for i := range lower {
+			for j := i + 2; j < len(lower) && j-i < longest; j++ {
+				word := string(lower[i : j+1])
+				caseFactor := math.Log10(uppercaseVariations(runes[i : j+1]))
+				if rank, ok := dict.words[word]; ok {
+					add(strengthMatch{pattern: dict.pattern, i: i, j: j, rank: rank,
+						log10Guesses: math.Log10(float64(rank)) + caseFactor, capitalized: caseFactor > 0})
+				}
+				if rank, ok := dict.words[reverseString(word)]; ok {
+					add(strengthMatch{pattern: dict.pattern, i: i, j: j, rank: rank, reversed: true,
+						log10Guesses: math.Log10(float64(rank)*2) + caseFactor, capitalized: caseFactor > 0})
+				}
+				if plain := string(unl33t[i : j+1]); plain != word {
+					if rank, ok := dict.words[plain]; ok {
+						add(strengthMatch{pattern: dict.pattern, i: i, j: j, rank: rank, l33t: true,
+							log10Guesses: math.Log10(float64(rank)*2) + caseFactor, capitalized: caseFactor > 0})
+					}
+				}
+			}
+		}
+	}
+
+	// Sequences such as abc, 9876 or xyz
+	for i := 0; i+2 < len(lower); {
+		delta := lower[i+1] - lower[i]
+		j := i + 1
+		for j+1 < len(lower) && lower[j+1]-lower[j] == delta && sameCharClass(lower[j], lower[j+1]) {
+			j++
+		}
+		if (delta == 1 || delta == -1) && sameCharClass(lower[i], lower[i+1]) && j-i >= 2 {
+			base := 26.0
+			switch {
+			case strings.ContainsRune("a1z9", lower[i]):
+				base = 4
+			case unicode.IsDigit(lower[i]):
+				base = 10
+			}
+			if delta < 0 {
+				base *= 2
+			}
+			add(strengthMatch{pattern: "sequence", i: i, j: j, log10Guesses: math.Log10(base * float64(j-i+1))})
+			i = j
+			continue
+		}
+		i++
+	}
+
+	// Repeated characters or chunks: aaa, abcabc. Only the longest run from
+	// each position counts, so a long repetitive password stays cheap to score.
+	for i := 0; i < len(lower); {
+		size, count := 0, 0
+		for s := 1; i+2*s <= len(lower); s++ {
+			n := 1
+			for i+(n+1)*s <= len(lower) && equalRunes(lower[i:i+s], lower[i+n*s:i+(n+1)*s]) {
+				n++
+			}
+			if n >= 2 && (s > 1 || n >= 3) && n*s > count*size {
+				size, count = s, n
+			}
+		}
+		if count == 0 {
+			i++
+			continue
+		}
+		chunkGuesses, _ := mostGuessableCover(runes[i:i+size], userWords)
+		add(strengthMatch{pattern: "repeat", i: i, j: i + count*size - 1,
+			log10Guesses: chunkGuesses + math.Log10(float64(count))})
+		i += count * size
+	}
+
+	// Straight rows of keys, either direction
+	for _, row := range keyboardRows {
+		for _, keys := range []string{row, reverseString(row)} {
+			for i := 0; i < len(lower); {
+				j := i
+				for j+1 < len(lower) && strings.Contains(keys, string(lower[j:j+2])) {
+					j++
+				}
+				if j-i >= 3 {
+					add(strengthMatch{pattern: "keyboard", i: i, j: j, log10Guesses: math.Log10(94 * 4 * float64(j-i+1))})
+				}
+				i = j + 1
+			}
+		}
+	}
+
+	// Years from 1900 to 2099
+	thisYear := time.Now().Year()
+	for i := 0; i+4 <= len(lower); i++ {
+		year := 0
+		for _, r := range lower[i : i+4] {
+			if !unicode.IsDigit(r) || r > '9' {
+				year = -1
+				break
+			}
+			year = year*10 + int(r-'0')
+		}
+		if year >= 1900 && year <= 2099 {
+			distance := math.Max(math.Abs(float64(year-thisYear)), 20)
+			add(strengthMatch{pattern: "year", i: i, j: i + 3, log10Guesses: math.Log10(distance)})
+		}
+	}
+	return matches
+}
+
+// uppercaseVariations counts the capitalizations a guesser would try for
+// a word written this way
+func uppercaseVariations(word []rune) float64 {
+	upper, lower := 0, 0
+	for _, r := range word {
+		switch {
+		case unicode.IsUpper(r):
+			upper++
+		case unicode.IsLower(r):
+			lower++
+		}
+	}
+	if upper == 0 {
+		return 1
+	}
+	if lower == 0 || (upper == 1 && (unicode.IsUpper(word[0]) || unicode.IsUpper(word[len(word)-1]))) {
+		return 2
+	}
+	variations := 0.0
+	for k := 1; k <= upper && k <= lower; k++ {
+		variations += binomial(upper+lower, k)
+	}
+	return variations
+}
+
+func binomial(n, k int) float64 {
+	result := 1.0
+	for i := 1; i <= k; i++ {
+		result = result * float64(n-k+i) / float64(i)
+	}
+	return result
+}
+
+func sameCharClass(a, b rune) bool {
+	return (unicode.IsLower(a) && unicode.IsLower(b)) || (unicode.IsDigit(a) && unicode.IsDigit(b))
+}
+
+func equalRunes(a, b []rune) bool {
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func reverseString(s string) string {
+	runes := []rune(s)
+	for i, j := 0, len(runes)-1; i < j; i, j = i+1, j-1 {
+		runes[i], runes[j] = runes[j], runes[i]
+	}
+	return string(runes)
+}
+
+// strengthFeedback explains a weak score from the longest match behind it
+func strengthFeedback(score int, path []strengthMatch) (string, []string) {
+	if score >= 3 {
+		return "", nil
+	}
+	suggestions := []string{"Add another word or two; uncommon words are better"}
+	if len(path) == 0 {
+		return "", append(suggestions, "Use a few words and avoid common phrases")
+	}
+	longest := path[0]
+	for _, m := range path[1:] {
+		if m.j-m.i > longest.j-longest.i {
+			longest = m
+		}
+	}
+
+	warning := ""
+	switch longest.pattern {
+	case "dictionary":
+		warning = "This is a very common password"
+	case "user_input":
+		warning = "Passwords based on your name or email address are easy to guess"
+	case "sequence":
+		warning = "Sequences like abc or 6543 are easy to guess"
+	case "repeat":
+		warning = "Repeats like aaa or abcabc are easy to guess"
+	case "keyboard":
+		warning = "Straight rows of keys like qwerty are easy to guess"
+	case "year":
+		warning = "Recent years are easy to guess"
+		suggestions = append(suggestions, "Avoid years that are associated with you")
+	}
+	if longest.capitalized {
+		suggestions = append(suggestions, "Capitalization doesn't help very much")
+	}
+	if longest.reversed {
+		suggestions = append(suggestions, "Reversed words aren't much harder to guess")
+	}
+	if longest.l33t {
+		suggestions = append(suggestions, "Predictable substitutions like @ instead of a don't help very much")
+	}
+	return warning, suggestions
+}
+
+// translated returns the estimate's feedback in lang
+func (strength PasswordStrength) translated(lang string) PasswordStrength {
+	if strength.Warning != "" {
+		strength.Warning = translate(lang, strength.Warning)
+	}
+	suggestions := make([]string, len(strength.Suggestions))
+	for i, suggestion := range strength.Suggestions {
+		suggestions[i] = translate(lang, suggestion)
+	}
+	if len(suggestions) > 0 {
+		strength.Suggestions = suggestions
+	}
+	return strength
+}
+
+// checkPasswordStrength refuses a password below passwords.min_score
+func checkPasswordStrength(password, email, name string) error {
+	if config.Passwords.MinScore > 0 && !estimatePasswordStrength(password, email, name).Acceptable {
+		return errWeakPassword
+	}
+	return nil
+}
+
+// passwordStrength estimates a candidate password without storing it
+func passwordStrength(c *gin.Context) {
+	var req PasswordStrengthRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondBindError(c, err)
+		return
+	}
+	strength := estimatePasswordStrength(req.Password, req.Email, req.Name)
+	c.JSON(http.StatusOK, strength.translated(requestLanguage(c)))
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestEstimatePasswordStrength(t *testing.T) {
+	for _, tc := range []struct {
+		password    string
+		email, name string
+		maxScore    int
+		minScore    int
+		warning     string
+	}{
+		{"password", "", "", 0, 0, "This is a very common password"},
+		{"P@ssw0rd", "", "", 1, 0, "This is a very common password"},
+		{"drowssap", "", "", 1, 0, "This is a very common password"},
+		{"abcdefgh", "", "", 0, 0, "Sequences like abc or 6543 are easy to guess"},
+		{"aaaaaaaaaa", "", "", 0, 0, "Repeats like aaa or abcabc are easy to guess"},
+		{"qwertyuiop", "", "", 1, 0, "This is a very common password"},
+		{"asdfghjkl;", "", "", 1, 0, "Straight rows of keys like qwerty are easy to guess"},
+		{"jsmith1987", "jsmith@example.com", "", 1, 0, "Passwords based on your name or email address are easy to guess"},
+		{"Priyanka2021", "", "Priyanka Sharma", 1, 0, "Passwords based on your name or email address are easy to guess"},
+		{"correcthorsebatterystaple", "", "", 4, 4, ""},
+		{"Tr0ub4dour&3", "", "", 4, 3, ""},
+	} {
+		got := estimatePasswordStrength(tc.password, tc.email, tc.name)
+		if got.Score < tc.minScore || got.Score > tc.maxScore || got.Warning != tc.warning {
+			t.Errorf("%q: score %d, warning %q; want %d-%d, %q", tc.password, got.Score, got.Warning, tc.minScore, tc.maxScore, tc.warning)
+		}
+		if got.Score < 3 && len(got.Suggestions) == 0 {
+			t.Errorf("%q: weak password without suggestions", tc.password)
+		}
+	}
+
+	// Longer is stronger, all else equal
+	if short, long := estimatePasswordStrength("kx8q", "", ""), estimatePasswordStrength("kx8qv2mz", "", ""); short.GuessesLog10 >= long.GuessesLog10 {
+		t.Errorf("guesses: %v for 4 characters, %v for 8", short.GuessesLog10, long.GuessesLog10)
+	}
+}
+
+func TestPasswordStrengthEndpoint(t *testing.T) {
+	ts := newTestServer(t)
+	withConfig(t, func(cfg *Config) { cfg.Passwords.MinScore = 3 })
+
+	w := ts.do(http.MethodPost, "/v1/auth/password-strength", "", `{"password":"letmein"}`)
+	var strength PasswordStrength
+	decodeJSON(t, w, &strength)
+	if w.Code != http.StatusOK || strength.Score != 0 || strength.Acceptable || strength.MinScore != 3 || strength.Warning == "" {
+		t.Fatalf("weak: %d %+v", w.Code, strength)
+	}
+
+	w = ts.do(http.MethodPost, "/v1/auth/password-strength", "", `{"password":"violet kettle harbour ninety"}`)
+	strength = PasswordStrength{}
+	decodeJSON(t, w, &strength)
+	if !strength.Acceptable || strength.Score != 4 || strength.Warning != "" || len(strength.Suggestions) != 0 {
+		t.Fatalf("strong: %+v", strength)
+	}
+
+	w = ts.do(http.MethodPost, "/v1/auth/password-strength", "", `{"password":"letmein"}`, "Accept-Language", "es")
+	decodeJSON(t, w, &strength)
+	if strength.Warning != "Es una contraseña muy común" {
+		t.Fatalf("Spanish warning = %q", strength.Warning)
+	}
+
+	if w := ts.do(http.MethodPost, "/v1/auth/password-strength", "", `{}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("missing password: got %d, want 400", w.Code)
+	}
+}
+
+func TestWeakPasswordsRefused(t *testing.T) {
+	ts := newTestServer(t)
+	admin := ts.admin("admin@example.com")
+	withConfig(t, func(cfg *Config) { cfg.Passwords.MinScore = 2 })
+
+	for _, password := range []string{"secret123", "password1", "weakling@example"} {
+		w := ts.do(http.MethodPost, "/v1/auth/register", "", `{"email":"weakling@example.com","password":"`+password+`","name":"Test User"}`)
+		if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), codeWeakPassword) {
+			t.Fatalf("register with %q: %d %s", password, w.Code, w.Body)
+		}
+	}
+	w := ts.do(http.MethodPost, "/v1/auth/register", "", `{"email":"weakling@example.com","password":"violet kettle harbour","name":"Test User"}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("register with a strong password: %d %s", w.Code, w.Body)
+	}
+
+	// A refused password leaves the invitation usable
+	w = ts.do(http.MethodPost, "/v1/admin/users", admin, `{"email":"invitee@example.com","name":"Invitee","invite":true}`)
+	var created CreateUserResponse
+	decodeJSON(t, w, &created)
+	token, _, err := newInvitation(created.User.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w := ts.do(http.MethodPost, "/v1/auth/invitations/accept", "", `{"token":"`+token+`","password":"invitee123"}`); w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), codeWeakPassword) {
+		t.Fatalf("weak invitation password: %d %s", w.Code, w.Body)
+	}
+	if w := ts.do(http.MethodPost, "/v1/auth/invitations/accept", "", `{"token":"`+token+`","password":"violet kettle harbour"}`); w.Code != http.StatusOK {
+		t.Fatalf("accept: %d %s", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// ============================================================================
+// TLS
+// ============================================================================
+//
+// By default the service speaks plain HTTP behind a TLS-terminating proxy.
+// For standalone deployments tls.mode "files" serves a certificate and key
+// from disk (reloaded when the files change, e.g. after renewal) and
+// "autocert" obtains certificates from Let's Encrypt. With TLS on, a second
+// listener on tls.http_port redirects to HTTPS and answers ACME challenges.
+// The gRPC API uses the same certificates.
+
+const (
+	tlsModeOff      = "off"
+	tlsModeFiles    = "files"
+	tlsModeAutocert = "autocert"
+)
+
+// redirectServer is the HTTP→HTTPS listener, if running
+var redirectServer *http.Server
+
+// setupTLS configures server for the TLS mode and starts the redirect
+// listener. It returns the TLS config for gRPC, or nil when TLS is off.
+func setupTLS(server *http.Server) (*tls.Config, error) {
+	cfg := config.TLS
+	var redirect http.Handler = http.HandlerFunc(redirectToHTTPS)
+
+	switch cfg.Mode {
+	case tlsModeFiles:
+		loader := &keyPairLoader{certFile: cfg.CertFile, keyFile: cfg.KeyFile}
+		if _, err := loader.load(); err != nil {
+			return nil, err
+		}
+		server.TLSConfig = &tls.Config{GetCertificate: loader.getCertificate}
+	case tlsModeAutocert:
+		manager := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(cfg.AutocertDomains...),
+			Cache:      autocert.DirCache(cfg.AutocertCacheDir),
+			Email:      cfg.AutocertEmail,
+		}
+		server.TLSConfig = manager.TLSConfig()
+		redirect = manager.HTTPHandler(redirect)
+	default:
+		return nil, nil
+	}
+	server.TLSConfig.MinVersion = tls.VersionTLS12
+
+	if cfg.RedirectHTTP || cfg.Mode == tlsModeAutocert {
+		redirectServer = &http.Server{
+			Addr:              ":" + cfg.HTTPPort,
+			Handler:           redirect,
+			ReadHeaderTimeout: 10 * time.Second,
+		}
+		go func() {
+			if err := redirectServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				fatal("HTTP redirect listener failed", "port", cfg.HTTPPort, "error", err)
+			}
+		}()
+		slog.Info("Redirecting HTTP to HTTPS", "port", cfg.HTTPPort)
+	}
+
+	grpcTLS := server.TLSConfig.Clone()
+	grpcTLS.NextProtos = []string{"h2"}
+	return grpcTLS, nil
+}
+
+// listenAndServe serves HTTPS when setupTLS configured it, else HTTP
+func listenAndServe(server *http.Server) error {
+	if server.TLSConfig != nil {
+		return server.ListenAndServeTLS("", "")
+	}
+	return server.ListenAndServe()
+}
+
+// configureHTTP2 enables h2 on TLS listeners and h2c on plain ones, or
+// keeps the server on HTTP/1.1 when server.http2 is off
+func configureHTTP2(server *http.Server) error {
+	if !config.Server.HTTP2 {
+		// A non-nil, empty map turns off the built-in h2 support
+		server.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+		return nil
+	}
+	h2 := &http2.Server{IdleTimeout: config.Server.IdleTimeout}
+	if server.TLSConfig == nil {
+		server.Handler = h2c.NewHandler(server.Handler, h2)
+		return nil
+	}
+	return http2.ConfigureServer(server, h2)
+}
+
+// redirectToHTTPS sends plain HTTP requests to the HTTPS listener
+func redirectToHTTPS(w http.ResponseWriter, r *http.Request) {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if config.Server.Port != "443" {
+		host = net.JoinHostPort(host, config.Server.Port)
+	}
+	http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+}
+
+// keyPairLoader serves a certificate from disk, reloading it when either
+// file's modification time changes
+type keyPairLoader struct {
+	certFile, keyFile string
+
+	mu       sync.Mutex
+	cert     *tls.Certificate
+	modified time.Time
+}
+
+func (l *keyPairLoader) load() (*tls.Certificate, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	modified, err := latestModTime(l.certFile, l.keyFile)
+	if err != nil {
+		return nil, err
+	}
+	if l.cert != nil && !modified.After(l.modified) {
+		return l.cert, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(l.certFile, l.keyFile)
+	if err != nil {
+		if l.cert != nil {
+			// Keep serving the old pair while a renewal is half-written
+			slog.Warn("TLS certificate reload failed", "error", err)
+			return l.cert, nil
+		}
+		return nil, fmt.Errorf("load TLS key pair: %w", err)
+	}
+	if l.cert != nil {
+		slog.Info("TLS certificate reloaded", "cert_file", l.certFile)
+	}
+	l.cert, l.modified = &cert, modified
+	return l.cert, nil
+}
+
+func (l *keyPairLoader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return l.load()
+}
+
+func latestModTime(paths ...string) (time.Time, error) {
+	var latest time.Time
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
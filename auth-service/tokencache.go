@@ -0,0 +1,119 @@
+package main
+
+import (
+	"crypto/sha256"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ============================================================================
+// Token Validation Cache
+// ============================================================================
+//
+// Verifying a JWT's signature and claims on every request is most of the
+// cost of authMiddleware for clients that poll. A token that verified is
+// remembered, keyed by its SHA-256 so raw tokens are never held, for
+// auth.token_cache_ttl or until it expires, whichever is sooner. Only the
+// user ID is cached: the user is still looked up per request, so profile
+// and role edits to the stored user apply at once and a removed user is
+// rejected.
+//
+// The cache is dropped when the signing keys rotate, and a user's entries
+// are dropped when their role changes or their tokens are revoked
+// (logout.go). Entries keep the token's issue time, so a revocation racing
+// a verification is still seen.
+
+const (
+	maxTokenCacheTTL     = 5 * time.Minute
+	tokenCacheMaxEntries = 50000
+)
+
+type tokenCacheEntry struct {
+	keys      *keyRing // the ring that verified it
+	userID    string
+	claims    map[string]any // custom claims, validated again on each use
+	scope     string         // set on exchanged tokens (tokenexchange.go)
+	deviceID  string         // set on sign-in tokens (devices.go)
+	issuedAt  time.Time
+	cutoff    time.Time // the revocation cut-off it was issued after (logout.go)
+	expiresAt time.Time
+	epoch     uint64
+}
+
+var (
+	tokenCache      = make(map[[sha256.Size]byte]tokenCacheEntry)
+	tokenCacheMutex sync.RWMutex
+
+	// tokenCacheEpoch increments to invalidate every entry at once
+	tokenCacheEpoch atomic.Uint64
+
+	tokenCacheHits   atomic.Int64
+	tokenCacheMisses atomic.Int64
+)
+
+// cachedToken returns what a token verified to against keys, if that is
+// still cached
+func cachedToken(keys *keyRing, key [sha256.Size]byte) (tokenCacheEntry, bool) {
+	if config.Auth.TokenCacheTTL <= 0 {
+		return tokenCacheEntry{}, false
+	}
+	tokenCacheMutex.RLock()
+	entry, exists := tokenCache[key]
+	tokenCacheMutex.RUnlock()
+
+	if !exists || entry.keys != keys || entry.epoch != tokenCacheEpoch.Load() || !time.Now().Before(entry.expiresAt) {
+		tokenCacheMisses.Add(1)
+		return tokenCacheEntry{}, false
+	}
+	tokenCacheHits.Add(1)
+	return entry, true
+}
+
+// cacheToken remembers a verified token until the TTL or its own expiry,
+// which the entry's expiresAt holds on the way in
+func cacheToken(keys *keyRing, key [sha256.Size]byte, entry tokenCacheEntry) {
+	ttl := config.Auth.TokenCacheTTL
+	if ttl <= 0 {
+		return
+	}
+	now := time.Now()
+	tokenExpiry := entry.expiresAt
+	entry.expiresAt = now.Add(ttl)
+	if !tokenExpiry.IsZero() && tokenExpiry.Before(entry.expiresAt) {
+		entry.expiresAt = tokenExpiry
+	}
+	entry.keys, entry.epoch = keys, tokenCacheEpoch.Load()
+
+	tokenCacheMutex.Lock()
+	defer tokenCacheMutex.Unlock()
+	if len(tokenCache) >= tokenCacheMaxEntries {
+		for k, e := range tokenCache {
+			if !now.Before(e.expiresAt) || e.epoch != entry.epoch {
+				delete(tokenCache, k)
+			}
+		}
+		if len(tokenCache) >= tokenCacheMaxEntries {
+			tokenCache = make(map[[sha256.Size]byte]tokenCacheEntry)
+		}
+	}
+	tokenCache[key] = entry
+}
+
+// forgetAllTokens invalidates every cached validation
+func forgetAllTokens() {
+	tokenCacheEpoch.Add(1)
+}
+
+// forgetUserTokens invalidates the cached validations of one user's tokens,
+// and the cached user with them
+func forgetUserTokens(userID string) {
+	forgetCachedUser(userID)
+	tokenCacheMutex.Lock()
+	defer tokenCacheMutex.Unlock()
+	for k, entry := range tokenCache {
+		if entry.userID == userID {
+			delete(tokenCache, k)
+		}
+	}
+}
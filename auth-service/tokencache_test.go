@@ -0,0 +1,128 @@
+package main
+
+import (
+	"crypto/sha256"
+	"testing"
+	"time"
+)
+
+// useTokenCache gives a test a fresh cache, a signing key and one user
+func useTokenCache(t *testing.T, ttl time.Duration) (*User, string) {
+	t.Helper()
+	withConfig(t, func(cfg *Config) { cfg.Auth.TokenCacheTTL = ttl })
+	resetLocalStores(t)
+	t.Cleanup(func() { resetLocalStores(t) })
+	tokenCacheMutex.Lock()
+	tokenCache = make(map[[sha256.Size]byte]tokenCacheEntry)
+	tokenCacheMutex.Unlock()
+	signingKeys.rotate([]byte("token-cache-test-key-0123456789abcdef"))
+
+	user, err := localUsers.Add(&User{ID: "u1", Email: "a@example.com", Role: "user"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := defaultService.IssueToken(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return user, token
+}
+
+// authenticateCounting authenticates a token and reports whether the
+// cache answered
+func authenticateCounting(t *testing.T, token string) bool {
+	t.Helper()
+	hits := tokenCacheHits.Load()
+	if _, err := authenticateToken(token); err != nil {
+		t.Fatal(err)
+	}
+	return tokenCacheHits.Load() > hits
+}
+
+func TestTokenCacheHit(t *testing.T) {
+	user, token := useTokenCache(t, time.Minute)
+	if authenticateCounting(t, token) {
+		t.Fatal("first validation served from cache")
+	}
+	if !authenticateCounting(t, token) {
+		t.Fatal("second validation not served from cache")
+	}
+
+	// The user is still looked up, so edits show through
+	got, err := authenticateToken(token)
+	if err != nil || got != user {
+		t.Fatalf("cached user = %p, %v; want %p", got, err, user)
+	}
+}
+
+func TestTokenCacheDisabled(t *testing.T) {
+	_, token := useTokenCache(t, 0)
+	authenticateCounting(t, token)
+	if authenticateCounting(t, token) {
+		t.Fatal("cache used with token_cache_ttl 0")
+	}
+}
+
+func TestTokenCacheInvalidation(t *testing.T) {
+	_, token := useTokenCache(t, time.Minute)
+	authenticateCounting(t, token)
+
+	// The old key still verifies after one rotation, but the cache starts over
+	signingKeys.rotate([]byte("token-cache-test-key-rotated-456789"))
+	if authenticateCounting(t, token) {
+		t.Fatal("cache survived key rotation")
+	}
+	if !authenticateCounting(t, token) {
+		t.Fatal("token not cached again after rotation")
+	}
+
+	// A role change drops the cached validation, and the token's role
+	// claim is now stale
+	applySharedUser(sharedUser{ID: "u1", Email: "a@example.com", Role: "admin"})
+	if _, err := authenticateToken(token); err != errTokenRevoked {
+		t.Fatalf("after a role change = %v, want errTokenRevoked", err)
+	}
+}
+
+func TestTokenCacheRemovedUser(t *testing.T) {
+	_, token := useTokenCache(t, time.Minute)
+	authenticateCounting(t, token)
+
+	resetLocalStores(t)
+	if _, err := authenticateToken(token); err != errUserNotFound {
+		t.Fatalf("removed user = %v, want errUserNotFound", err)
+	}
+}
+
+func TestTokenCacheRespectsExpiry(t *testing.T) {
+	useTokenCache(t, time.Minute)
+	key := sha256.Sum256([]byte("expiring"))
+	cacheToken(&signingKeys, key, tokenCacheEntry{userID: "u1", expiresAt: time.Now().Add(-time.Second)})
+	if _, ok := cachedToken(&signingKeys, key); ok {
+		t.Fatal("expired token served from cache")
+	}
+}
+
+func BenchmarkAuthenticateToken(b *testing.B) {
+	for _, ttl := range []time.Duration{0, time.Minute} {
+		b.Run("ttl="+ttl.String(), func(b *testing.B) {
+			saved := config
+			cfg := *saved
+			cfg.Auth.TokenCacheTTL = ttl
+			config = &cfg
+			defer func() { config = saved }()
+			signingKeys.rotate([]byte("token-cache-bench-key-0123456789abc"))
+			user := &User{ID: "bench", Email: "bench@example.com", Role: "user"}
+			localUsers.byID.put(user.ID, user)
+			defer localUsers.byID.remove(user.ID, user)
+			token, _ := defaultService.IssueToken(user)
+
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := authenticateToken(token); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
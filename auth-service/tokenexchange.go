@@ -0,0 +1,196 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// ============================================================================
+// Token Exchange
+// ============================================================================
+//
+// Services acting for a user, like the query gateway, trade the user's
+// token for a narrower one before calling further down (RFC 8693):
+//
+//	POST /internal/token/exchange
+//	X-Internal-Token: ...
+//	Content-Type: application/x-www-form-urlencoded
+//
+//	grant_type=urn:ietf:params:oauth:grant-type:token-exchange
+//	&subject_token=<user's token>
+//	&subject_token_type=urn:ietf:params:oauth:token-type:access_token
+//	&scope=documents:read
+//
+// The issued token is for the same user, carries a scope claim and lasts
+// auth.exchange_token_ttl, or less if the subject token expires sooner.
+// A scoped token is only accepted on the routes its scope lists in
+// scopeRoutes; everywhere else, gRPC included, it is refused with
+// insufficient_scope, so a leaked one can read document listings for a
+// few minutes and do nothing else. A scoped token can be exchanged again
+// for a scope it holds, never a wider one. The scope claim is a
+// space-separated list, as OAuth clients may hold several (oauthserver.go).
+//
+// Errors use the service's problem format with the RFC 6749 codes
+// (invalid_grant, invalid_scope, unsupported_grant_type) as "code".
+
+const (
+	grantTypeTokenExchange = "urn:ietf:params:oauth:grant-type:token-exchange"
+	tokenTypeAccessToken   = "urn:ietf:params:oauth:token-type:access_token"
+	tokenTypeJWT           = "urn:ietf:params:oauth:token-type:jwt"
+
+	scopeDocumentsRead = "documents:read"
+	scopeProfileRead   = "profile:read"
+)
+
+var (
+	errInsufficientScope = errors.New("Token scope does not allow this request")
+	errInvalidGrant      = errors.New("Subject token is invalid or expired")
+)
+
+// scopeRoutes lists the routes each scope may call, keyed like routeDocs
+var scopeRoutes = map[string]map[string]bool{
+	scopeDocumentsRead: {
+		"GET /auth/verify":             true,
+		"GET /documents/my":            true,
+		"GET /documents/org":           true,
+		"GET /documents/user/:user_id": true, // still admin only
+		"GET /documents/all":           true, // still admin only
+	},
+	scopeProfileRead: {
+		"GET /auth/verify": true,
+		"GET /users/me":    true,
+	},
+}
+
+// scopeDescriptions are shown on the OAuth consent screen (oauthserver.go)
+var scopeDescriptions = map[string]string{
+	scopeDocumentsRead: "List your documents and the documents shared with your organization",
+	scopeProfileRead:   "Read your name, email address and role",
+}
+
+// TokenExchangeRequest for POST /internal/token/exchange, form-encoded
+type TokenExchangeRequest struct {
+	GrantType          string `form:"grant_type" binding:"required"`
+	SubjectToken       string `form:"subject_token" binding:"required"`
+	SubjectTokenType   string `form:"subject_token_type" binding:"required"`
+	RequestedTokenType string `form:"requested_token_type"`
+	Scope              string `form:"scope"` // defaults to documents:read
+}
+
+// TokenExchangeResponse is the RFC 8693 token response
+type TokenExchangeResponse struct {
+	AccessToken     string `json:"access_token"`
+	IssuedTokenType string `json:"issued_token_type"`
+	TokenType       string `json:"token_type"`
+	ExpiresIn       int    `json:"expires_in"`
+	Scope           string `json:"scope"`
+}
+
+// scopeAllows reports whether a token limited to scope, a space-separated
+// list, may call a route
+func scopeAllows(scope, routeKey string) bool {
+	for _, name := range strings.Fields(scope) {
+		if scopeRoutes[name][routeKey] {
+			return true
+		}
+	}
+	return false
+}
+
+// scopeWithin reports whether every scope in scope is also in granted
+func scopeWithin(scope, granted string) bool {
+	for _, name := range strings.Fields(scope) {
+		if !slices.Contains(strings.Fields(granted), name) {
+			return false
+		}
+	}
+	return true
+}
+
+// accessTokenType reports whether a token type names the bearer JWTs this
+// service issues
+func accessTokenType(tokenType string) bool {
+	return tokenType == tokenTypeAccessToken || tokenType == tokenTypeJWT
+}
+
+// ExchangeToken issues a token limited to scope for the user subjectToken
+// belongs to
+func (s *Service) ExchangeToken(subjectToken, scope string) (string, time.Time, error) {
+	user, _, subjectScope, err := s.AuthenticateScoped(subjectToken)
+	if err != nil {
+		return "", time.Time{}, errInvalidGrant
+	}
+	if subjectScope != "" && !scopeWithin(scope, subjectScope) {
+		return "", time.Time{}, errInsufficientScope
+	}
+
+	expiresAt := time.Now().Add(config.Auth.ExchangeTokenTTL)
+	// Already verified above, so only the expiry is read here
+	var claims jwt.MapClaims
+	if _, _, err := jwt.NewParser().ParseUnverified(subjectToken, &claims); err == nil {
+		if exp, _ := claims.GetExpirationTime(); exp != nil && exp.Before(expiresAt) {
+			expiresAt = exp.Time
+		}
+	}
+	token, err := s.issueToken(user, expiresAt, scope)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	debugLog("auth", "Token exchanged", "user_id", user.ID, "scope", scope, "expires_at", expiresAt)
+	return token, expiresAt, nil
+}
+
+// exchangeToken swaps a user's token for a narrower, shorter-lived one
+// (internal only)
+func (s *Server) exchangeToken(c *gin.Context) {
+	var req TokenExchangeRequest
+	if err := c.ShouldBind(&req); err != nil {
+		respondBindError(c, err)
+		return
+	}
+	if req.GrantType != grantTypeTokenExchange {
+		respondError(c, http.StatusBadRequest, codeUnsupportedGrantType, "grant_type must be "+grantTypeTokenExchange)
+		return
+	}
+	if !accessTokenType(req.SubjectTokenType) || (req.RequestedTokenType != "" && !accessTokenType(req.RequestedTokenType)) {
+		respondError(c, http.StatusBadRequest, codeInvalidRequest, "Only access tokens can be exchanged")
+		return
+	}
+	scope := strings.TrimSpace(req.Scope)
+	if scope == "" {
+		scope = scopeDocumentsRead
+	}
+	if _, known := scopeRoutes[scope]; !known {
+		respondError(c, http.StatusBadRequest, codeInvalidScope, "Unsupported scope")
+		return
+	}
+
+	token, expiresAt, err := s.svc.ExchangeToken(req.SubjectToken, scope)
+	switch err {
+	case nil:
+	case errInvalidGrant:
+		respondError(c, http.StatusBadRequest, codeInvalidGrant, err.Error())
+		return
+	case errInsufficientScope:
+		respondError(c, http.StatusBadRequest, codeInvalidScope, "A scoped token cannot be exchanged for a wider scope")
+		return
+	default:
+		respondServiceError(c, err)
+		return
+	}
+
+	c.Header("Cache-Control", "no-store")
+	c.JSON(http.StatusOK, TokenExchangeResponse{
+		AccessToken:     token,
+		IssuedTokenType: tokenTypeAccessToken,
+		TokenType:       "Bearer",
+		ExpiresIn:       int(time.Until(expiresAt).Round(time.Second).Seconds()),
+		Scope:           scope,
+	})
+}
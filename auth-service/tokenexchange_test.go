@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testInternalToken = "internal-test-token"
+
+// exchange posts a token exchange form and returns the response
+func (ts *testServer) exchange(form url.Values) (TokenExchangeResponse, int, string) {
+	ts.t.Helper()
+	w := ts.do(http.MethodPost, "/v1/internal/token/exchange", "", form.Encode(),
+		"Content-Type", "application/x-www-form-urlencoded", internalTokenHeader, testInternalToken)
+	var resp TokenExchangeResponse
+	if w.Code == http.StatusOK {
+		decodeJSON(ts.t, w, &resp)
+	}
+	return resp, w.Code, w.Body.String()
+}
+
+func exchangeForm(subject string) url.Values {
+	return url.Values{
+		"grant_type":         {grantTypeTokenExchange},
+		"subject_token":      {subject},
+		"subject_token_type": {tokenTypeAccessToken},
+	}
+}
+
+func TestTokenExchange(t *testing.T) {
+	ts := newTestServer(t)
+	withConfig(t, func(cfg *Config) {
+		cfg.Auth.InternalAPIToken = testInternalToken
+		cfg.Auth.ExchangeTokenTTL = 5 * time.Minute
+	})
+	token, _ := ts.register("a@example.com")
+
+	resp, code, body := ts.exchange(exchangeForm(token))
+	if code != http.StatusOK || resp.Scope != scopeDocumentsRead || resp.TokenType != "Bearer" ||
+		resp.IssuedTokenType != tokenTypeAccessToken || resp.ExpiresIn <= 0 || resp.ExpiresIn > 300 {
+		t.Fatalf("exchange: %d %s", code, body)
+	}
+	scoped := resp.AccessToken
+
+	// Readable where the scope allows, refused everywhere else
+	if w := ts.do(http.MethodGet, "/v1/documents/my", scoped, ""); w.Code != http.StatusOK {
+		t.Fatalf("GET /documents/my: got %d, want 200", w.Code)
+	}
+	w := ts.do(http.MethodGet, "/v1/auth/verify", scoped, "")
+	var verified struct {
+		Scope string `json:"scope"`
+	}
+	decodeJSON(t, w, &verified)
+	if w.Code != http.StatusOK || verified.Scope != scopeDocumentsRead {
+		t.Fatalf("verify: %d %s", w.Code, w.Body)
+	}
+	for _, call := range []struct{ method, path, body string }{
+		{http.MethodGet, "/v1/users/me", ""},
+		{http.MethodPost, "/v1/documents/register", `{"filename":"x.pdf"}`},
+		{http.MethodPut, "/v1/users/me", `{"name":"Mallory"}`},
+	} {
+		if w := ts.do(call.method, call.path, scoped, call.body); w.Code != http.StatusForbidden {
+			t.Errorf("%s %s with a scoped token: got %d, want 403", call.method, call.path, w.Code)
+		}
+	}
+	if _, err := ts.srv.svc.Authenticate(scoped); err != errInsufficientScope {
+		t.Fatalf("Authenticate(scoped) = %v, want errInsufficientScope", err)
+	}
+
+	// Re-exchanging keeps the scope; nothing widens it
+	if _, code, body := ts.exchange(exchangeForm(scoped)); code != http.StatusOK {
+		t.Fatalf("re-exchange: %d %s", code, body)
+	}
+}
+
+func TestTokenExchangeRejects(t *testing.T) {
+	ts := newTestServer(t)
+	withConfig(t, func(cfg *Config) { cfg.Auth.InternalAPIToken = testInternalToken })
+	token, _ := ts.register("a@example.com")
+
+	cases := map[string]struct {
+		form url.Values
+		want string
+	}{
+		"grant type":    {url.Values{"grant_type": {"password"}}, codeUnsupportedGrantType},
+		"bad subject":   {exchangeForm("not-a-token"), codeInvalidGrant},
+		"unknown scope": {exchangeForm(token), codeInvalidScope},
+		"token type":    {exchangeForm(token), codeInvalidRequest},
+	}
+	cases["grant type"].form.Set("subject_token", token)
+	cases["grant type"].form.Set("subject_token_type", tokenTypeAccessToken)
+	cases["unknown scope"].form.Set("scope", "users:write")
+	cases["token type"].form.Set("subject_token_type", "urn:ietf:params:oauth:token-type:saml2")
+	for name, tc := range cases {
+		if _, code, body := ts.exchange(tc.form); code != http.StatusBadRequest || !strings.Contains(body, `"code":"`+tc.want+`"`) {
+			t.Errorf("%s: %d %s; want 400 %s", name, code, body, tc.want)
+		}
+	}
+
+	// Only trusted services may exchange
+	w := ts.do(http.MethodPost, "/v1/internal/token/exchange", "", exchangeForm(token).Encode(),
+		"Content-Type", "application/x-www-form-urlencoded")
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("without the internal token: got %d, want 401", w.Code)
+	}
+}
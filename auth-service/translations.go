@@ -0,0 +1,739 @@
+package main
+
+// ============================================================================
+// Built-in Translations
+// ============================================================================
+//
+// Spanish and Hindi text for the messages end users see: status titles,
+// authentication and validation errors, document and job errors, and the
+// email templates. Operator-only messages (network rules, reindex
+// campaigns, diagnostics) stay English. Keys are the English text exactly
+// as the code writes it; a typo in either place silently falls back to
+// English, so TestBuiltinCatalogKeys checks the keys against the source.
+// Sentences with %s or %d are format strings and must keep their verbs.
+
+var builtinCatalog = mapCatalog{
+	"es": {
+		// Status titles
+		"Bad Request":              "Solicitud incorrecta",
+		"Unauthorized":             "No autorizado",
+		"Forbidden":                "Prohibido",
+		"Not Found":                "No encontrado",
+		"Conflict":                 "Conflicto",
+		"Precondition Failed":      "Falló la condición previa",
+		"Request Entity Too Large": "Contenido demasiado grande",
+		"Unsupported Media Type":   "Tipo de contenido no admitido",
+		"Unprocessable Entity":     "Entidad no procesable",
+		"Too Many Requests":        "Demasiadas solicitudes",
+		"Internal Server Error":    "Error interno del servidor",
+		"Bad Gateway":              "Puerta de enlace incorrecta",
+		"Service Unavailable":      "Servicio no disponible",
+
+		// Authentication
+		"Authorization token required":                                    "Se requiere un token de autorización",
+		"Authorization header required":                                   "Se requiere el encabezado Authorization",
+		"Authorization header or session cookie required":                 "Se requiere el encabezado Authorization o la cookie de sesión",
+		"Invalid authorization format":                                    "Formato de autorización no válido",
+		"Invalid or expired token":                                        "Token no válido o caducado",
+		"Invalid token claims":                                            "Los datos del token no son válidos",
+		"Invalid email or password":                                       "Correo electrónico o contraseña incorrectos",
+		"Email already registered":                                        "El correo electrónico ya está registrado",
+		"Failed to process password":                                      "No se pudo procesar la contraseña",
+		"Failed to generate token":                                        "No se pudo generar el token",
+		"Unusual sign-in held for verification; contact an administrator": "Inicio de sesión inusual retenido para verificación; contacta con un administrador",
+		"Too many password checks in progress; try again shortly":         "Hay demasiadas comprobaciones de contraseña en curso; inténtalo de nuevo en breve",
+		"Account is disabled; contact an administrator":                   "La cuenta está desactivada; contacta con un administrador",
+		"Invitation is invalid or has expired":                            "La invitación no es válida o ha caducado",
+		"At least one active admin must remain":                           "Debe quedar al menos un administrador activo",
+		"Registration is awaiting administrator approval":                 "El registro está pendiente de la aprobación de un administrador",
+		"User is not awaiting approval":                                   "El usuario no está pendiente de aprobación",
+		"Registration is closed":                                          "El registro está cerrado",
+		"Registration is not open to this email domain":                   "El registro no está abierto a este dominio de correo",
+		"7 days":                                 "7 días",
+		"Admin access required":                  "Se requiere acceso de administrador",
+		"User not found":                         "Usuario no encontrado",
+		"Origin not allowed":                     "Origen no permitido",
+		"Requests from this address are blocked": "Las solicitudes desde esta dirección están bloqueadas",
+
+		// Phone numbers
+		"Phone number is already in use":                           "El número de teléfono ya está en uso",
+		"Invalid or expired code":                                  "Código no válido o caducado",
+		"A code was sent recently; wait before asking for another": "Se envió un código hace poco; espera antes de pedir otro",
+		"Text message could not be sent; try again later":          "No se pudo enviar el mensaje de texto; inténtalo de nuevo más tarde",
+		"Phone login is disabled":                                  "El inicio de sesión con teléfono está desactivado",
+		"%s code: %s. It expires in %d minutes; don't share it.":   "Código de %s: %s. Caduca en %d minutos; no lo compartas.",
+		"%s must be a phone number such as +14155550100":           "%s debe ser un número de teléfono como +14155550100",
+
+		// Password strength
+		"Password is too easy to guess":                                      "La contraseña es demasiado fácil de adivinar",
+		"This is a very common password":                                     "Es una contraseña muy común",
+		"Passwords based on your name or email address are easy to guess":    "Las contraseñas basadas en tu nombre o correo son fáciles de adivinar",
+		"Sequences like abc or 6543 are easy to guess":                       "Las secuencias como abc o 6543 son fáciles de adivinar",
+		"Repeats like aaa or abcabc are easy to guess":                       "Las repeticiones como aaa o abcabc son fáciles de adivinar",
+		"Straight rows of keys like qwerty are easy to guess":                "Las filas de teclas como qwerty son fáciles de adivinar",
+		"Recent years are easy to guess":                                     "Los años recientes son fáciles de adivinar",
+		"Avoid years that are associated with you":                           "Evita los años relacionados contigo",
+		"Add another word or two; uncommon words are better":                 "Añade una o dos palabras más; mejor si son poco comunes",
+		"Use a few words and avoid common phrases":                           "Usa varias palabras y evita frases comunes",
+		"Capitalization doesn't help very much":                              "Las mayúsculas no ayudan mucho",
+		"Reversed words aren't much harder to guess":                         "Las palabras al revés no son mucho más difíciles de adivinar",
+		"Predictable substitutions like @ instead of a don't help very much": "Los cambios previsibles como @ en lugar de a no ayudan mucho",
+
+		// Account merge
+		"An account cannot be merged into itself":                                          "Una cuenta no se puede fusionar consigo misma",
+		"Account has been merged into another; sign in with that account":                  "La cuenta se fusionó con otra; inicia sesión con esa cuenta",
+		"Accounts in different orgs cannot be merged; move one into the other's org first": "No se pueden fusionar cuentas de organizaciones distintas; mueve primero una a la organización de la otra",
+		"The token for the account to merge is invalid":                                    "El token de la cuenta que se va a fusionar no es válido",
+
+		// Referrals
+		"Referral code is not valid": "El código de referencia no es válido",
+
+		// Bulk document operations
+		"Documents cannot be transferred to their owner": "Los documentos no se pueden transferir a su propietario",
+		"Target user not found":                          "Usuario de destino no encontrado",
+		"target_id is required to transfer documents":    "Se requiere target_id para transferir documentos",
+
+		// Idle sessions
+		"Session expired after inactivity; sign in again": "La sesión expiró por inactividad; inicia sesión de nuevo",
+
+		// Exports
+		"Too many exports in progress; retry later": "Demasiadas exportaciones en curso; inténtalo más tarde",
+		"until must be after since":                 "until debe ser posterior a since",
+		"Export not found":                          "Exportación no encontrada",
+		"Export is not ready":                       "La exportación aún no está lista",
+
+		// Backups
+		"Backups are not configured":                                       "Las copias de seguridad no están configuradas",
+		"Backup could not be decrypted; check the passphrase and the file": "No se pudo descifrar la copia de seguridad; revisa la frase de contraseña y el archivo",
+		"Backup is too large":                                              "La copia de seguridad es demasiado grande",
+
+		// Token exchange
+		"Token scope does not allow this request":              "El alcance del token no permite esta solicitud",
+		"Subject token is invalid or expired":                  "El token de origen no es válido o ha caducado",
+		"Only access tokens can be exchanged":                  "Solo se pueden intercambiar tokens de acceso",
+		"Unsupported scope":                                    "Alcance no admitido",
+		"A scoped token cannot be exchanged for a wider scope": "Un token con alcance no se puede intercambiar por uno más amplio",
+
+		// Logout everywhere
+		"Token has been revoked":         "El token ha sido revocado",
+		"since must be an RFC 3339 time": "since debe ser una fecha RFC 3339",
+
+		// OAuth
+		"Unknown OAuth client":                                       "Cliente OAuth desconocido",
+		"redirect_uri is not registered for this client":             "redirect_uri no está registrada para este cliente",
+		"code_challenge with code_challenge_method S256 is required": "Se requiere code_challenge con code_challenge_method S256",
+		"Scope is not allowed for this client":                       "El alcance no está permitido para este cliente",
+		"Authorization code is invalid or expired":                   "El código de autorización no es válido o ha caducado",
+		"Client authentication failed":                               "La autenticación del cliente ha fallado",
+		"response_type must be code":                                 "response_type debe ser code",
+		"grant_type must be authorization_code":                      "grant_type debe ser authorization_code",
+		"Redirect URIs must be https, or http on localhost":          "Las URI de redirección deben ser https, o http en localhost",
+
+		// Devices
+		"Device not found": "Dispositivo no encontrado",
+
+		// Remembered sessions
+		"Refresh token is invalid or expired":                "El token de actualización no es válido o ha caducado",
+		"Session has reached its maximum age; sign in again": "La sesión ha alcanzado su duración máxima; inicia sesión de nuevo",
+		"refresh_token is required":                          "refresh_token es obligatorio",
+
+		// Login risk
+		"Complete the CAPTCHA to sign in":                         "Completa el CAPTCHA para iniciar sesión",
+		"CAPTCHA verification failed":                             "La verificación del CAPTCHA ha fallado",
+		"Too many failed sign-ins from this network; retry later": "Demasiados inicios de sesión fallidos desde esta red; inténtalo más tarde",
+
+		// Two-person approval
+		"Pending action not found":                        "Acción pendiente no encontrada",
+		"Pending action was already decided":              "La acción pendiente ya se ha decidido",
+		"Pending action has expired":                      "La acción pendiente ha caducado",
+		"A second administrator must approve this action": "Un segundo administrador debe aprobar esta acción",
+		"Approval is invalid or was already used":         "La aprobación no es válida o ya se ha usado",
+
+		// Document grants
+		"expires_at must be a future date (YYYY-MM-DD) or RFC 3339 time": "expires_at debe ser una fecha futura (AAAA-MM-DD) o una hora RFC 3339",
+		"The owner can already read this document":                       "El propietario ya puede leer este documento",
+		"Grant not found":                               "Permiso no encontrado",
+		"No active user has that email":                 "Ningún usuario activo tiene ese correo electrónico",
+		"Too many starred documents; unstar some first": "Demasiados documentos destacados; quita algunos primero",
+		"Note not found":                                "Nota no encontrada",
+		"Only the author can edit this note":            "Solo el autor puede editar esta nota",
+		"Document has too many notes":                   "El documento tiene demasiadas notas",
+		"File type %s is not allowed":                   "No se permite el tipo de archivo %s",
+		"File content is %s but its name says %s":       "El contenido del archivo es %s pero su nombre indica %s",
+		"Only blocked jobs are in quarantine":           "Solo los trabajos bloqueados están en cuarentena",
+
+		// Document languages
+		"language must be a two- or three-letter language code": "language debe ser un código de idioma de dos o tres letras",
+
+		// Chunking settings
+		"Invalid chunking settings":                         "Configuración de fragmentación no válida",
+		"Only the document's owner can change its chunking": "Solo el propietario del documento puede cambiar su fragmentación",
+
+		// Evaluation
+		"Golden set not found":                                "Conjunto de referencia no encontrado",
+		"Evaluation run not found":                            "Evaluación no encontrada",
+		"An evaluation of this golden set is already running": "Ya hay una evaluación en curso para este conjunto de referencia",
+		"The golden set's collection has no documents":        "La colección del conjunto de referencia no tiene documentos",
+
+		// Experiments
+		"Experiment not found":                                 "Experimento no encontrado",
+		"Another experiment is already running; stop it first": "Ya hay otro experimento en curso; deténgalo primero",
+		"Variant names must be unique":                         "Los nombres de las variantes deben ser únicos",
+		"Unknown reranker %s":                                  "Reranker desconocido: %s",
+
+		// Search settings
+		"Invalid search settings":           "Configuración de búsqueda no válida",
+		"Search settings version not found": "Versión de la configuración de búsqueda no encontrada",
+
+		// Conversations
+		"Conversation not found":                           "Conversación no encontrada",
+		"Only the conversation's owner can do this":        "Solo el propietario de la conversación puede hacer esto",
+		"You can view this conversation but not add to it": "Puede ver esta conversación pero no añadir nada",
+		"Conversation has too many turns":                  "La conversación tiene demasiados turnos",
+		"Conversation has too many members":                "La conversación tiene demasiados miembros",
+		"The owner is already in this conversation":        "El propietario ya está en esta conversación",
+		"Member not found":                                 "Miembro no encontrado",
+		"Share link not found":                             "Enlace para compartir no encontrado",
+
+		// Saved queries
+		"Saved query not found":           "Consulta guardada no encontrada",
+		"You have too many saved queries": "Tiene demasiadas consultas guardadas",
+
+		// Plans
+		"Daily query limit reached; retry tomorrow or ask for a larger plan": "Has alcanzado el límite diario de consultas; vuelve a intentarlo mañana o pide un plan mayor",
+		"Unknown plan %s": "Plan desconocido: %s",
+
+		// Costs
+		"No usage recorded for this org in that month":     "No hay uso registrado para esta organización en ese mes",
+		"org_id must be lowercase letters, digits, - or _": "org_id solo puede tener minúsculas, dígitos, - o _",
+		"month must be YYYY-MM":                            "month debe tener el formato AAAA-MM",
+
+		// Providers
+		"Invalid provider chain":             "Cadena de proveedores no válida",
+		"Provider not in the failover chain": "El proveedor no está en la cadena de conmutación por error",
+
+		// Admin events
+		"Last-Event-ID must be an event id": "Last-Event-ID debe ser un id de evento",
+
+		// Requests
+		"Invalid request: one or more fields are invalid":                 "Solicitud no válida: uno o más campos no son válidos",
+		"Invalid request: unknown field %s":                               "Solicitud no válida: campo desconocido %s",
+		"%s is not a recognised field":                                    "%s no es un campo reconocido",
+		"%s is required":                                                  "%s es obligatorio",
+		"%s must be a valid email address":                                "%s debe ser una dirección de correo electrónico válida",
+		"%s must be at least %s characters":                               "%s debe tener al menos %s caracteres",
+		"%s must be at most %s characters":                                "%s debe tener como máximo %s caracteres",
+		"%s must be one of: %s":                                           "%s debe ser uno de: %s",
+		"%s failed the %s check":                                          "%s no superó la comprobación %s",
+		"Request body exceeds the %s limit":                               "El cuerpo de la solicitud supera el límite de %s",
+		"Content-Type must be %s":                                         "Content-Type debe ser %s",
+		"limit must be between 1 and %d":                                  "limit debe estar entre 1 y %d",
+		"Failed to read request body":                                     "No se pudo leer el cuerpo de la solicitud",
+		"Resource has changed since it was fetched; reload and try again": "El recurso ha cambiado desde que se obtuvo; vuelve a cargarlo e inténtalo de nuevo",
+		"Idempotency-Key was already used with a different request":       "La Idempotency-Key ya se usó con una solicitud diferente",
+		"A request with this Idempotency-Key is still being processed":    "Una solicitud con esta Idempotency-Key todavía se está procesando",
+		"Too many requests; retry later":                                  "Demasiadas solicitudes; vuelve a intentarlo más tarde",
+		"Too many requests in batch":                                      "Demasiadas solicitudes en el lote",
+		"Route not found":                                                 "Ruta no encontrada",
+		"Internal server error":                                           "Error interno del servidor",
+		"Shared store unavailable; try again shortly":                     "El almacén compartido no está disponible; inténtalo de nuevo en breve",
+		"cursor is not valid; use next_cursor from the previous page":     "cursor no es válido; usa next_cursor de la página anterior",
+		"offset must be a non-negative integer":                           "offset debe ser un número entero no negativo",
+
+		// Documents and jobs
+		"Document not found":                             "Documento no encontrado",
+		"Document already owned by another user":         "El documento ya pertenece a otro usuario",
+		"Not authorized to delete this document":         "No tienes autorización para eliminar este documento",
+		"File is required":                               "Se requiere un archivo",
+		"File exceeds 10MB limit":                        "El archivo supera el límite de 10 MB",
+		"Failed to read file":                            "No se pudo leer el archivo",
+		"Malformed multipart body":                       "Cuerpo multipart mal formado",
+		"No accessible documents to query":               "No hay documentos accesibles para consultar",
+		"Too many candidate documents":                   "Demasiados documentos candidatos",
+		"Query backend unavailable":                      "El servicio de consultas no está disponible",
+		"Processing queue is full; retry later":          "La cola de procesamiento está llena; vuelve a intentarlo más tarde",
+		"Job not found":                                  "Trabajo no encontrado",
+		"Not authorized to view this job":                "No tienes autorización para ver este trabajo",
+		"Notification not found":                         "Notificación no encontrada",
+		"Connector is not configured":                    "El conector no está configurado",
+		"Connector link not found":                       "Vínculo del conector no encontrado",
+		"Not authorized to manage this connector":        "No tienes autorización para administrar este conector",
+		"Unknown OAuth connector":                        "Conector OAuth desconocido",
+		"Failed to start authorization":                  "No se pudo iniciar la autorización",
+		"Failed to complete authorization":               "No se pudo completar la autorización",
+		"Invalid or expired authorization state":         "Estado de autorización no válido o caducado",
+		"Unable to access bucket with these credentials": "No se puede acceder al bucket con estas credenciales",
+		"Invalid bucket name or region":                  "Nombre o región del bucket no válidos",
+
+		// Emails
+		EmailVerification + ".subject": `Verifica tu dirección de correo de {{.AppName}}`,
+		EmailVerification + ".text": `Hola, {{.Name}}:
+
+Confirma tu dirección de correo electrónico abriendo este enlace:
+
+{{.Link}}
+
+El enlace caduca en {{.ExpiresIn}}. Si no creaste una cuenta, ignora este correo.
+`,
+		EmailVerification + ".html": `<p>Hola, {{.Name}}:</p>
+<p>Confirma tu dirección de correo electrónico:</p>
+<p><a href="{{.Link}}">Verificar dirección de correo</a></p>
+<p>El enlace caduca en {{.ExpiresIn}}. Si no creaste una cuenta, ignora este correo.</p>`,
+
+		EmailPasswordReset + ".subject": `Restablece tu contraseña de {{.AppName}}`,
+		EmailPasswordReset + ".text": `Hola, {{.Name}}:
+
+Alguien pidió restablecer tu contraseña. Para elegir una nueva, abre este enlace:
+
+{{.Link}}
+
+El enlace caduca en {{.ExpiresIn}}. Si no fuiste tú, ignora este correo; tu contraseña no cambiará.
+`,
+		EmailPasswordReset + ".html": `<p>Hola, {{.Name}}:</p>
+<p>Alguien pidió restablecer tu contraseña.</p>
+<p><a href="{{.Link}}">Elegir una contraseña nueva</a></p>
+<p>El enlace caduca en {{.ExpiresIn}}. Si no fuiste tú, ignora este correo; tu contraseña no cambiará.</p>`,
+
+		EmailInvitation + ".subject": `{{.InviterName}} te invitó a {{.AppName}}`,
+		EmailInvitation + ".text": `Hola:
+
+{{.InviterName}} te invitó a {{.AppName}}. Acepta la invitación y elige tu contraseña aquí:
+
+{{.Link}}
+
+La invitación caduca en {{.ExpiresIn}}.
+`,
+		EmailInvitation + ".html": `<p>Hola:</p>
+<p>{{.InviterName}} te invitó a {{.AppName}}.</p>
+<p><a href="{{.Link}}">Aceptar la invitación</a></p>
+<p>La invitación caduca en {{.ExpiresIn}}.</p>`,
+
+		EmailLoginAlert + ".subject": `Nuevo inicio de sesión en tu cuenta de {{.AppName}}`,
+		EmailLoginAlert + ".text": `Hola, {{.Name}}:
+
+Detectamos un inicio de sesión inusual en tu cuenta:
+
+  Hora:        {{.Time}}
+  Dirección:   {{.IP}}
+  Ubicación:   {{.Location}}
+  Dispositivo: {{.Device}}
+
+{{if .Held}}El inicio de sesión quedó retenido hasta que un administrador lo revise.{{else}}Si fuiste tú, no tienes que hacer nada.{{end}} Si no fuiste tú, cambia tu contraseña y revisa tu actividad reciente en {{.BaseURL}}.
+`,
+		EmailLoginAlert + ".html": `<p>Hola, {{.Name}}:</p>
+<p>Detectamos un inicio de sesión inusual en tu cuenta:</p>
+<table>
+<tr><td>Hora</td><td>{{.Time}}</td></tr>
+<tr><td>Dirección</td><td>{{.IP}}</td></tr>
+<tr><td>Ubicación</td><td>{{.Location}}</td></tr>
+<tr><td>Dispositivo</td><td>{{.Device}}</td></tr>
+</table>
+<p>{{if .Held}}El inicio de sesión quedó retenido hasta que un administrador lo revise.{{else}}Si fuiste tú, no tienes que hacer nada.{{end}}
+Si no fuiste tú, cambia tu contraseña y <a href="{{.BaseURL}}">revisa tu actividad reciente</a>.</p>`,
+
+		EmailSignupApproved + ".subject": `Tu cuenta de {{.AppName}} está lista`,
+		EmailSignupApproved + ".text": `Hola, {{.Name}}:
+
+Un administrador aprobó tu registro. Ya puedes iniciar sesión en {{.BaseURL}} con el correo electrónico y la contraseña que elegiste.
+`,
+		EmailSignupApproved + ".html": `<p>Hola, {{.Name}}:</p>
+<p>Un administrador aprobó tu registro.</p>
+<p><a href="{{.BaseURL}}">Inicia sesión</a> con el correo electrónico y la contraseña que elegiste.</p>`,
+
+		EmailSignupDenied + ".subject": `Tu registro en {{.AppName}}`,
+		EmailSignupDenied + ".text": `Hola, {{.Name}}:
+
+Un administrador revisó tu registro y no lo aprobó.{{if .Reason}}
+
+Motivo: {{.Reason}}{{end}}
+
+Tus datos se han eliminado. Si crees que es un error, contacta con tu administrador.
+`,
+		EmailSignupDenied + ".html": `<p>Hola, {{.Name}}:</p>
+<p>Un administrador revisó tu registro y no lo aprobó.</p>
+{{if .Reason}}<p>Motivo: {{.Reason}}</p>{{end}}
+<p>Tus datos se han eliminado. Si crees que es un error, contacta con tu administrador.</p>`,
+
+		EmailSavedQuery + ".subject": `{{.QueryName}}: tu respuesta programada`,
+		EmailSavedQuery + ".text": `Hola, {{.Name}}:
+
+Esta es la respuesta de hoy a tu consulta guardada "{{.QueryName}}".
+
+Pregunta: {{.Question}}
+
+{{.Answer}}
+{{if .Sources}}
+Fuentes: {{.Sources}}
+{{end}}
+Cambia o detén esta consulta en {{.BaseURL}}.
+`,
+		EmailSavedQuery + ".html": `<p>Hola, {{.Name}}:</p>
+<p>Esta es la respuesta de hoy a tu consulta guardada <strong>{{.QueryName}}</strong>.</p>
+<p><em>{{.Question}}</em></p>
+<p>{{.Answer}}</p>
+{{if .Sources}}<p>Fuentes: {{.Sources}}</p>{{end}}
+<p><a href="{{.BaseURL}}">Cambia o detén esta consulta</a>.</p>`,
+	},
+
+	"hi": {
+		// Status titles
+		"Bad Request":              "अमान्य अनुरोध",
+		"Unauthorized":             "अनधिकृत",
+		"Forbidden":                "निषिद्ध",
+		"Not Found":                "नहीं मिला",
+		"Conflict":                 "विरोध",
+		"Precondition Failed":      "पूर्व-शर्त विफल",
+		"Request Entity Too Large": "अनुरोध बहुत बड़ा है",
+		"Unsupported Media Type":   "असमर्थित सामग्री प्रकार",
+		"Unprocessable Entity":     "अनुरोध संसाधित नहीं किया जा सकता",
+		"Too Many Requests":        "बहुत अधिक अनुरोध",
+		"Internal Server Error":    "आंतरिक सर्वर त्रुटि",
+		"Bad Gateway":              "खराब गेटवे",
+		"Service Unavailable":      "सेवा उपलब्ध नहीं है",
+
+		// Authentication
+		"Authorization token required":                                    "प्राधिकरण टोकन आवश्यक है",
+		"Authorization header required":                                   "Authorization हेडर आवश्यक है",
+		"Authorization header or session cookie required":                 "Authorization हेडर या सत्र कुकी आवश्यक है",
+		"Invalid authorization format":                                    "प्राधिकरण का प्रारूप अमान्य है",
+		"Invalid or expired token":                                        "टोकन अमान्य है या उसकी अवधि समाप्त हो गई है",
+		"Invalid token claims":                                            "टोकन की जानकारी अमान्य है",
+		"Invalid email or password":                                       "ईमेल या पासवर्ड गलत है",
+		"Email already registered":                                        "यह ईमेल पहले से पंजीकृत है",
+		"Failed to process password":                                      "पासवर्ड संसाधित नहीं हो सका",
+		"Failed to generate token":                                        "टोकन नहीं बनाया जा सका",
+		"Unusual sign-in held for verification; contact an administrator": "असामान्य साइन-इन सत्यापन के लिए रोका गया है; किसी व्यवस्थापक से संपर्क करें",
+		"Too many password checks in progress; try again shortly":         "बहुत सारी पासवर्ड जाँचें चल रही हैं; थोड़ी देर में फिर से प्रयास करें",
+		"Account is disabled; contact an administrator":                   "खाता निष्क्रिय है; किसी व्यवस्थापक से संपर्क करें",
+		"Invitation is invalid or has expired":                            "आमंत्रण अमान्य है या उसकी अवधि समाप्त हो गई है",
+		"At least one active admin must remain":                           "कम से कम एक सक्रिय व्यवस्थापक बना रहना चाहिए",
+		"Registration is awaiting administrator approval":                 "पंजीकरण व्यवस्थापक की स्वीकृति की प्रतीक्षा में है",
+		"User is not awaiting approval":                                   "उपयोगकर्ता स्वीकृति की प्रतीक्षा में नहीं है",
+		"Registration is closed":                                          "पंजीकरण बंद है",
+		"Registration is not open to this email domain":                   "इस ईमेल डोमेन के लिए पंजीकरण खुला नहीं है",
+		"7 days":                                 "7 दिन",
+		"Admin access required":                  "व्यवस्थापक पहुँच आवश्यक है",
+		"User not found":                         "उपयोगकर्ता नहीं मिला",
+		"Origin not allowed":                     "यह ओरिजिन अनुमत नहीं है",
+		"Requests from this address are blocked": "इस पते से आने वाले अनुरोध अवरुद्ध हैं",
+
+		// Phone numbers
+		"Phone number is already in use":                           "यह फ़ोन नंबर पहले से उपयोग में है",
+		"Invalid or expired code":                                  "कोड अमान्य है या समाप्त हो गया है",
+		"A code was sent recently; wait before asking for another": "हाल ही में एक कोड भेजा गया था; दूसरा माँगने से पहले रुकें",
+		"Text message could not be sent; try again later":          "टेक्स्ट संदेश नहीं भेजा जा सका; बाद में फिर से प्रयास करें",
+		"Phone login is disabled":                                  "फ़ोन से साइन-इन बंद है",
+		"%s code: %s. It expires in %d minutes; don't share it.":   "%s कोड: %s। यह %d मिनट में समाप्त हो जाएगा; इसे किसी से साझा न करें।",
+		"%s must be a phone number such as +14155550100":           "%s +14155550100 जैसा फ़ोन नंबर होना चाहिए",
+
+		// Password strength
+		"Password is too easy to guess":                                      "पासवर्ड का अनुमान लगाना बहुत आसान है",
+		"This is a very common password":                                     "यह बहुत आम पासवर्ड है",
+		"Passwords based on your name or email address are easy to guess":    "आपके नाम या ईमेल पते पर आधारित पासवर्ड का अनुमान लगाना आसान है",
+		"Sequences like abc or 6543 are easy to guess":                       "abc या 6543 जैसे क्रम का अनुमान लगाना आसान है",
+		"Repeats like aaa or abcabc are easy to guess":                       "aaa या abcabc जैसे दोहराव का अनुमान लगाना आसान है",
+		"Straight rows of keys like qwerty are easy to guess":                "qwerty जैसी कुंजियों की सीधी पंक्तियों का अनुमान लगाना आसान है",
+		"Recent years are easy to guess":                                     "हाल के वर्षों का अनुमान लगाना आसान है",
+		"Avoid years that are associated with you":                           "अपने से जुड़े वर्षों से बचें",
+		"Add another word or two; uncommon words are better":                 "एक-दो शब्द और जोड़ें; कम प्रचलित शब्द बेहतर हैं",
+		"Use a few words and avoid common phrases":                           "कुछ शब्दों का उपयोग करें और आम वाक्यांशों से बचें",
+		"Capitalization doesn't help very much":                              "बड़े अक्षरों से ज़्यादा मदद नहीं मिलती",
+		"Reversed words aren't much harder to guess":                         "उलटे शब्दों का अनुमान लगाना ज़्यादा कठिन नहीं है",
+		"Predictable substitutions like @ instead of a don't help very much": "a की जगह @ जैसे अनुमानित बदलावों से ज़्यादा मदद नहीं मिलती",
+
+		// Account merge
+		"An account cannot be merged into itself":                                          "किसी खाते को उसी में मर्ज नहीं किया जा सकता",
+		"Account has been merged into another; sign in with that account":                  "यह खाता दूसरे खाते में मर्ज हो चुका है; उसी खाते से साइन इन करें",
+		"Accounts in different orgs cannot be merged; move one into the other's org first": "अलग-अलग संगठनों के खातों को मर्ज नहीं किया जा सकता; पहले एक को दूसरे के संगठन में ले जाएँ",
+		"The token for the account to merge is invalid":                                    "मर्ज किए जाने वाले खाते का टोकन अमान्य है",
+
+		// Referrals
+		"Referral code is not valid": "रेफ़रल कोड मान्य नहीं है",
+
+		// Bulk document operations
+		"Documents cannot be transferred to their owner": "दस्तावेज़ उनके स्वामी को स्थानांतरित नहीं किए जा सकते",
+		"Target user not found":                          "लक्ष्य उपयोगकर्ता नहीं मिला",
+		"target_id is required to transfer documents":    "दस्तावेज़ स्थानांतरित करने के लिए target_id आवश्यक है",
+
+		// Idle sessions
+		"Session expired after inactivity; sign in again": "निष्क्रियता के कारण सत्र समाप्त हो गया; फिर से साइन इन करें",
+
+		// Exports
+		"Too many exports in progress; retry later": "बहुत सारे निर्यात चल रहे हैं; बाद में पुनः प्रयास करें",
+		"until must be after since":                 "until, since के बाद होना चाहिए",
+		"Export not found":                          "निर्यात नहीं मिला",
+		"Export is not ready":                       "निर्यात अभी तैयार नहीं है",
+
+		// Backups
+		"Backups are not configured":                                       "बैकअप कॉन्फ़िगर नहीं हैं",
+		"Backup could not be decrypted; check the passphrase and the file": "बैकअप को डिक्रिप्ट नहीं किया जा सका; पासफ़्रेज़ और फ़ाइल जाँचें",
+		"Backup is too large":                                              "बैकअप बहुत बड़ा है",
+
+		// Token exchange
+		"Token scope does not allow this request":              "टोकन का दायरा इस अनुरोध की अनुमति नहीं देता",
+		"Subject token is invalid or expired":                  "मूल टोकन अमान्य है या उसकी अवधि समाप्त हो गई है",
+		"Only access tokens can be exchanged":                  "केवल एक्सेस टोकन बदले जा सकते हैं",
+		"Unsupported scope":                                    "असमर्थित दायरा",
+		"A scoped token cannot be exchanged for a wider scope": "सीमित दायरे वाले टोकन को व्यापक दायरे के लिए नहीं बदला जा सकता",
+
+		// Logout everywhere
+		"Token has been revoked":         "टोकन रद्द कर दिया गया है",
+		"since must be an RFC 3339 time": "since एक RFC 3339 समय होना चाहिए",
+
+		// OAuth
+		"Unknown OAuth client":                                       "अज्ञात OAuth क्लाइंट",
+		"redirect_uri is not registered for this client":             "इस क्लाइंट के लिए redirect_uri पंजीकृत नहीं है",
+		"code_challenge with code_challenge_method S256 is required": "code_challenge_method S256 के साथ code_challenge आवश्यक है",
+		"Scope is not allowed for this client":                       "इस क्लाइंट के लिए यह दायरा अनुमत नहीं है",
+		"Authorization code is invalid or expired":                   "प्राधिकरण कोड अमान्य है या उसकी अवधि समाप्त हो गई है",
+		"Client authentication failed":                               "क्लाइंट प्रमाणीकरण विफल रहा",
+		"response_type must be code":                                 "response_type code होना चाहिए",
+		"grant_type must be authorization_code":                      "grant_type authorization_code होना चाहिए",
+		"Redirect URIs must be https, or http on localhost":          "रीडायरेक्ट URI https होने चाहिए, या localhost पर http",
+
+		// Devices
+		"Device not found": "डिवाइस नहीं मिला",
+
+		// Remembered sessions
+		"Refresh token is invalid or expired":                "रीफ़्रेश टोकन अमान्य है या समाप्त हो गया है",
+		"Session has reached its maximum age; sign in again": "सत्र अपनी अधिकतम अवधि तक पहुँच गया है; फिर से साइन इन करें",
+		"refresh_token is required":                          "refresh_token आवश्यक है",
+
+		// Login risk
+		"Complete the CAPTCHA to sign in":                         "साइन इन करने के लिए CAPTCHA पूरा करें",
+		"CAPTCHA verification failed":                             "CAPTCHA सत्यापन विफल रहा",
+		"Too many failed sign-ins from this network; retry later": "इस नेटवर्क से बहुत अधिक असफल साइन-इन; बाद में पुनः प्रयास करें",
+
+		// Two-person approval
+		"Pending action not found":                        "लंबित कार्रवाई नहीं मिली",
+		"Pending action was already decided":              "लंबित कार्रवाई पर पहले ही निर्णय हो चुका है",
+		"Pending action has expired":                      "लंबित कार्रवाई की समय-सीमा समाप्त हो गई है",
+		"A second administrator must approve this action": "इस कार्रवाई को किसी दूसरे व्यवस्थापक की स्वीकृति चाहिए",
+		"Approval is invalid or was already used":         "स्वीकृति अमान्य है या पहले ही उपयोग की जा चुकी है",
+
+		// Document grants
+		"expires_at must be a future date (YYYY-MM-DD) or RFC 3339 time": "expires_at भविष्य की तारीख (YYYY-MM-DD) या RFC 3339 समय होना चाहिए",
+		"The owner can already read this document":                       "स्वामी पहले से ही यह दस्तावेज़ पढ़ सकता है",
+		"Grant not found":                               "अनुमति नहीं मिली",
+		"No active user has that email":                 "उस ईमेल वाला कोई सक्रिय उपयोगकर्ता नहीं है",
+		"Too many starred documents; unstar some first": "बहुत अधिक तारांकित दस्तावेज़; पहले कुछ का तारांकन हटाएँ",
+		"Note not found":                                "नोट नहीं मिला",
+		"Only the author can edit this note":            "केवल लेखक ही इस नोट को संपादित कर सकता है",
+		"Document has too many notes":                   "दस्तावेज़ में बहुत अधिक नोट हैं",
+		"File type %s is not allowed":                   "फ़ाइल प्रकार %s की अनुमति नहीं है",
+		"File content is %s but its name says %s":       "फ़ाइल की सामग्री %s है लेकिन उसका नाम %s बताता है",
+		"Only blocked jobs are in quarantine":           "केवल ब्लॉक किए गए जॉब क्वारंटीन में होते हैं",
+
+		// Document languages
+		"language must be a two- or three-letter language code": "language दो या तीन अक्षरों का भाषा कोड होना चाहिए",
+
+		// Chunking settings
+		"Invalid chunking settings":                         "अमान्य चंकिंग सेटिंग्स",
+		"Only the document's owner can change its chunking": "केवल दस्तावेज़ का स्वामी उसकी चंकिंग बदल सकता है",
+
+		// Evaluation
+		"Golden set not found":                                "गोल्डन सेट नहीं मिला",
+		"Evaluation run not found":                            "मूल्यांकन रन नहीं मिला",
+		"An evaluation of this golden set is already running": "इस गोल्डन सेट का मूल्यांकन पहले से चल रहा है",
+		"The golden set's collection has no documents":        "गोल्डन सेट के संग्रह में कोई दस्तावेज़ नहीं है",
+
+		// Experiments
+		"Experiment not found":                                 "प्रयोग नहीं मिला",
+		"Another experiment is already running; stop it first": "एक अन्य प्रयोग पहले से चल रहा है; पहले उसे रोकें",
+		"Variant names must be unique":                         "वेरिएंट के नाम अद्वितीय होने चाहिए",
+		"Unknown reranker %s":                                  "अज्ञात रीरैंकर %s",
+
+		// Search settings
+		"Invalid search settings":           "अमान्य खोज सेटिंग्स",
+		"Search settings version not found": "खोज सेटिंग्स का संस्करण नहीं मिला",
+
+		// Conversations
+		"Conversation not found":                           "वार्तालाप नहीं मिला",
+		"Only the conversation's owner can do this":        "केवल वार्तालाप का स्वामी ऐसा कर सकता है",
+		"You can view this conversation but not add to it": "आप यह वार्तालाप देख सकते हैं लेकिन इसमें कुछ जोड़ नहीं सकते",
+		"Conversation has too many turns":                  "वार्तालाप में बहुत अधिक प्रश्न-उत्तर हैं",
+		"Conversation has too many members":                "वार्तालाप में बहुत अधिक सदस्य हैं",
+		"The owner is already in this conversation":        "स्वामी पहले से इस वार्तालाप में है",
+		"Member not found":                                 "सदस्य नहीं मिला",
+		"Share link not found":                             "साझा करने का लिंक नहीं मिला",
+
+		// Saved queries
+		"Saved query not found":           "सहेजी गई क्वेरी नहीं मिली",
+		"You have too many saved queries": "आपकी बहुत अधिक सहेजी गई क्वेरी हैं",
+
+		// Plans
+		"Daily query limit reached; retry tomorrow or ask for a larger plan": "दैनिक क्वेरी सीमा पूरी हो गई; कल फिर से प्रयास करें या बड़ा प्लान माँगें",
+		"Unknown plan %s": "अज्ञात प्लान: %s",
+
+		// Costs
+		"No usage recorded for this org in that month":     "उस महीने इस संगठन का कोई उपयोग दर्ज नहीं है",
+		"org_id must be lowercase letters, digits, - or _": "org_id में केवल छोटे अक्षर, अंक, - या _ हो सकते हैं",
+		"month must be YYYY-MM":                            "month YYYY-MM प्रारूप में होना चाहिए",
+
+		// Providers
+		"Invalid provider chain":             "अमान्य प्रदाता श्रृंखला",
+		"Provider not in the failover chain": "प्रदाता फ़ेलओवर श्रृंखला में नहीं है",
+
+		// Admin events
+		"Last-Event-ID must be an event id": "Last-Event-ID एक इवेंट id होना चाहिए",
+
+		// Requests
+		"Invalid request: one or more fields are invalid":                 "अमान्य अनुरोध: एक या अधिक फ़ील्ड अमान्य हैं",
+		"Invalid request: unknown field %s":                               "अमान्य अनुरोध: अज्ञात फ़ील्ड %s",
+		"%s is not a recognised field":                                    "%s कोई मान्य फ़ील्ड नहीं है",
+		"%s is required":                                                  "%s आवश्यक है",
+		"%s must be a valid email address":                                "%s एक मान्य ईमेल पता होना चाहिए",
+		"%s must be at least %s characters":                               "%s कम से कम %s अक्षरों का होना चाहिए",
+		"%s must be at most %s characters":                                "%s अधिकतम %s अक्षरों का होना चाहिए",
+		"%s must be one of: %s":                                           "%s इनमें से एक होना चाहिए: %s",
+		"%s failed the %s check":                                          "%s %s जाँच में विफल रहा",
+		"Request body exceeds the %s limit":                               "अनुरोध का आकार %s की सीमा से अधिक है",
+		"Content-Type must be %s":                                         "Content-Type %s होना चाहिए",
+		"limit must be between 1 and %d":                                  "limit 1 और %d के बीच होना चाहिए",
+		"Failed to read request body":                                     "अनुरोध का मुख्य भाग पढ़ा नहीं जा सका",
+		"Resource has changed since it was fetched; reload and try again": "लाने के बाद संसाधन बदल गया है; फिर से लोड करके प्रयास करें",
+		"Idempotency-Key was already used with a different request":       "यह Idempotency-Key किसी दूसरे अनुरोध के साथ पहले ही इस्तेमाल हो चुकी है",
+		"A request with this Idempotency-Key is still being processed":    "इस Idempotency-Key वाला अनुरोध अभी संसाधित हो रहा है",
+		"Too many requests; retry later":                                  "बहुत अधिक अनुरोध; बाद में फिर से प्रयास करें",
+		"Too many requests in batch":                                      "बैच में बहुत अधिक अनुरोध हैं",
+		"Route not found":                                                 "रूट नहीं मिला",
+		"Internal server error":                                           "आंतरिक सर्वर त्रुटि",
+		"Shared store unavailable; try again shortly":                     "साझा स्टोर उपलब्ध नहीं है; थोड़ी देर में फिर से प्रयास करें",
+		"cursor is not valid; use next_cursor from the previous page":     "cursor मान्य नहीं है; पिछले पृष्ठ का next_cursor इस्तेमाल करें",
+		"offset must be a non-negative integer":                           "offset एक ऋणेतर पूर्णांक होना चाहिए",
+
+		// Documents and jobs
+		"Document not found":                             "दस्तावेज़ नहीं मिला",
+		"Document already owned by another user":         "यह दस्तावेज़ पहले से किसी दूसरे उपयोगकर्ता का है",
+		"Not authorized to delete this document":         "आपको यह दस्तावेज़ हटाने की अनुमति नहीं है",
+		"File is required":                               "फ़ाइल आवश्यक है",
+		"File exceeds 10MB limit":                        "फ़ाइल 10MB की सीमा से बड़ी है",
+		"Failed to read file":                            "फ़ाइल पढ़ी नहीं जा सकी",
+		"Malformed multipart body":                       "multipart अनुरोध का प्रारूप गलत है",
+		"No accessible documents to query":               "पूछताछ के लिए कोई सुलभ दस्तावेज़ नहीं है",
+		"Too many candidate documents":                   "बहुत अधिक संभावित दस्तावेज़",
+		"Query backend unavailable":                      "क्वेरी सेवा उपलब्ध नहीं है",
+		"Processing queue is full; retry later":          "प्रोसेसिंग कतार भरी हुई है; बाद में फिर से प्रयास करें",
+		"Job not found":                                  "जॉब नहीं मिला",
+		"Not authorized to view this job":                "आपको यह जॉब देखने की अनुमति नहीं है",
+		"Notification not found":                         "सूचना नहीं मिली",
+		"Connector is not configured":                    "कनेक्टर कॉन्फ़िगर नहीं है",
+		"Connector link not found":                       "कनेक्टर लिंक नहीं मिला",
+		"Not authorized to manage this connector":        "आपको यह कनेक्टर प्रबंधित करने की अनुमति नहीं है",
+		"Unknown OAuth connector":                        "अज्ञात OAuth कनेक्टर",
+		"Failed to start authorization":                  "प्राधिकरण शुरू नहीं हो सका",
+		"Failed to complete authorization":               "प्राधिकरण पूरा नहीं हो सका",
+		"Invalid or expired authorization state":         "प्राधिकरण स्थिति अमान्य है या उसकी अवधि समाप्त हो गई है",
+		"Unable to access bucket with these credentials": "इन क्रेडेंशियल से बकेट तक पहुँच नहीं हो सकी",
+		"Invalid bucket name or region":                  "बकेट का नाम या क्षेत्र अमान्य है",
+
+		// Emails
+		EmailVerification + ".subject": `अपना {{.AppName}} ईमेल पता सत्यापित करें`,
+		EmailVerification + ".text": `नमस्ते {{.Name}},
+
+यह लिंक खोलकर अपने ईमेल पते की पुष्टि करें:
+
+{{.Link}}
+
+यह लिंक {{.ExpiresIn}} में समाप्त हो जाएगा। अगर आपने खाता नहीं बनाया है, तो इस ईमेल को अनदेखा करें।
+`,
+		EmailVerification + ".html": `<p>नमस्ते {{.Name}},</p>
+<p>अपने ईमेल पते की पुष्टि करें:</p>
+<p><a href="{{.Link}}">ईमेल पता सत्यापित करें</a></p>
+<p>यह लिंक {{.ExpiresIn}} में समाप्त हो जाएगा। अगर आपने खाता नहीं बनाया है, तो इस ईमेल को अनदेखा करें।</p>`,
+
+		EmailPasswordReset + ".subject": `अपना {{.AppName}} पासवर्ड रीसेट करें`,
+		EmailPasswordReset + ".text": `नमस्ते {{.Name}},
+
+किसी ने आपका पासवर्ड रीसेट करने का अनुरोध किया है। नया पासवर्ड चुनने के लिए यह लिंक खोलें:
+
+{{.Link}}
+
+यह लिंक {{.ExpiresIn}} में समाप्त हो जाएगा। अगर यह आपने नहीं किया, तो इस ईमेल को अनदेखा करें; आपका पासवर्ड नहीं बदलेगा।
+`,
+		EmailPasswordReset + ".html": `<p>नमस्ते {{.Name}},</p>
+<p>किसी ने आपका पासवर्ड रीसेट करने का अनुरोध किया है।</p>
+<p><a href="{{.Link}}">नया पासवर्ड चुनें</a></p>
+<p>यह लिंक {{.ExpiresIn}} में समाप्त हो जाएगा। अगर यह आपने नहीं किया, तो इस ईमेल को अनदेखा करें; आपका पासवर्ड नहीं बदलेगा।</p>`,
+
+		EmailInvitation + ".subject": `{{.InviterName}} ने आपको {{.AppName}} पर आमंत्रित किया है`,
+		EmailInvitation + ".text": `नमस्ते,
+
+{{.InviterName}} ने आपको {{.AppName}} पर आमंत्रित किया है। आमंत्रण स्वीकार करें और यहाँ अपना पासवर्ड सेट करें:
+
+{{.Link}}
+
+यह आमंत्रण {{.ExpiresIn}} में समाप्त हो जाएगा।
+`,
+		EmailInvitation + ".html": `<p>नमस्ते,</p>
+<p>{{.InviterName}} ने आपको {{.AppName}} पर आमंत्रित किया है।</p>
+<p><a href="{{.Link}}">आमंत्रण स्वीकार करें</a></p>
+<p>यह आमंत्रण {{.ExpiresIn}} में समाप्त हो जाएगा।</p>`,
+
+		EmailLoginAlert + ".subject": `आपके {{.AppName}} खाते में नया साइन-इन`,
+		EmailLoginAlert + ".text": `नमस्ते {{.Name}},
+
+हमने आपके खाते में एक असामान्य साइन-इन देखा है:
+
+  समय:     {{.Time}}
+  पता:     {{.IP}}
+  स्थान:    {{.Location}}
+  डिवाइस:  {{.Device}}
+
+{{if .Held}}यह साइन-इन किसी व्यवस्थापक की समीक्षा तक रोका गया है।{{else}}अगर यह आप थे, तो आपको कुछ करने की ज़रूरत नहीं है।{{end}} अगर यह आप नहीं थे, तो अपना पासवर्ड बदलें और {{.BaseURL}} पर अपनी हाल की गतिविधि देखें।
+`,
+		EmailLoginAlert + ".html": `<p>नमस्ते {{.Name}},</p>
+<p>हमने आपके खाते में एक असामान्य साइन-इन देखा है:</p>
+<table>
+<tr><td>समय</td><td>{{.Time}}</td></tr>
+<tr><td>पता</td><td>{{.IP}}</td></tr>
+<tr><td>स्थान</td><td>{{.Location}}</td></tr>
+<tr><td>डिवाइस</td><td>{{.Device}}</td></tr>
+</table>
+<p>{{if .Held}}यह साइन-इन किसी व्यवस्थापक की समीक्षा तक रोका गया है।{{else}}अगर यह आप थे, तो आपको कुछ करने की ज़रूरत नहीं है।{{end}}
+अगर यह आप नहीं थे, तो अपना पासवर्ड बदलें और <a href="{{.BaseURL}}">अपनी हाल की गतिविधि देखें</a>।</p>`,
+
+		EmailSignupApproved + ".subject": `आपका {{.AppName}} खाता तैयार है`,
+		EmailSignupApproved + ".text": `नमस्ते {{.Name}},
+
+एक व्यवस्थापक ने आपका पंजीकरण स्वीकृत कर दिया है। अब आप अपने चुने हुए ईमेल पते और पासवर्ड से {{.BaseURL}} पर साइन इन कर सकते हैं।
+`,
+		EmailSignupApproved + ".html": `<p>नमस्ते {{.Name}},</p>
+<p>एक व्यवस्थापक ने आपका पंजीकरण स्वीकृत कर दिया है।</p>
+<p>अपने चुने हुए ईमेल पते और पासवर्ड से <a href="{{.BaseURL}}">साइन इन करें</a>।</p>`,
+
+		EmailSignupDenied + ".subject": `आपका {{.AppName}} पंजीकरण`,
+		EmailSignupDenied + ".text": `नमस्ते {{.Name}},
+
+एक व्यवस्थापक ने आपके पंजीकरण की समीक्षा की और उसे स्वीकृत नहीं किया।{{if .Reason}}
+
+कारण: {{.Reason}}{{end}}
+
+आपका विवरण हटा दिया गया है। अगर आपको लगता है कि यह गलती है, तो अपने व्यवस्थापक से संपर्क करें।
+`,
+		EmailSignupDenied + ".html": `<p>नमस्ते {{.Name}},</p>
+<p>एक व्यवस्थापक ने आपके पंजीकरण की समीक्षा की और उसे स्वीकृत नहीं किया।</p>
+{{if .Reason}}<p>कारण: {{.Reason}}</p>{{end}}
+<p>आपका विवरण हटा दिया गया है। अगर आपको लगता है कि यह गलती है, तो अपने व्यवस्थापक से संपर्क करें।</p>`,
+
+		EmailSavedQuery + ".subject": `{{.QueryName}}: आपका निर्धारित उत्तर`,
+		EmailSavedQuery + ".text": `नमस्ते {{.Name}},
+
+आपकी सहेजी गई क्वेरी "{{.QueryName}}" का आज का उत्तर यह है।
+
+प्रश्न: {{.Question}}
+
+{{.Answer}}
+{{if .Sources}}
+स्रोत: {{.Sources}}
+{{end}}
+इस क्वेरी को {{.BaseURL}} पर बदलें या रोकें।
+`,
+		EmailSavedQuery + ".html": `<p>नमस्ते {{.Name}},</p>
+<p>आपकी सहेजी गई क्वेरी <strong>{{.QueryName}}</strong> का आज का उत्तर यह है।</p>
+<p><em>{{.Question}}</em></p>
+<p>{{.Answer}}</p>
+{{if .Sources}}<p>स्रोत: {{.Sources}}</p>{{end}}
+<p><a href="{{.BaseURL}}">इस क्वेरी को बदलें या रोकें</a>।</p>`,
+	},
+}
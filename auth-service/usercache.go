@@ -0,0 +1,179 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ============================================================================
+// User Lookup Cache
+// ============================================================================
+//
+// authMiddleware looks the user up on every request, which costs a map read
+// while users live in memory but a round trip once the repository is a
+// database. With auth.user_cache_ttl set, the process's service looks users
+// up by ID and email through this write-through cache: a hit returns the
+// repository's own *User, and writes go to the repository first and drop
+// the entries they affect (Add, ChangeEmail, ChangePhone, Remove).
+//
+// Changes that don't go through the repository drop entries too: role and
+// status changes and deletions call forgetUserTokens, which forgets the
+// user here, and cluster replication forgets a user whose email it
+// changes. Anything else is seen at the latest after the TTL. Misses are
+// not cached, so a newly registered email is found at once.
+
+const userCacheMaxEntries = 50000
+
+type userCacheEntry struct {
+	user      *User
+	email     string // the key it is cached under by email, if any
+	expiresAt time.Time
+}
+
+// cachedUserRepository is a UserRepository with cached ID and email
+// lookups; everything else passes through
+type cachedUserRepository struct {
+	UserRepository
+
+	mu      sync.RWMutex
+	byID    map[string]userCacheEntry
+	byEmail map[string]userCacheEntry
+
+	hits   atomic.Int64
+	misses atomic.Int64
+}
+
+func newCachedUserRepository(users UserRepository) *cachedUserRepository {
+	return &cachedUserRepository{
+		UserRepository: users,
+		byID:           make(map[string]userCacheEntry),
+		byEmail:        make(map[string]userCacheEntry),
+	}
+}
+
+// ByID returns a user by ID, from the cache if it is fresh
+func (r *cachedUserRepository) ByID(id string) *User {
+	return r.lookup(id, false, func() *User { return r.UserRepository.ByID(id) })
+}
+
+// ByEmail returns a user by email, from the cache if it is fresh
+func (r *cachedUserRepository) ByEmail(email string) *User {
+	return r.lookup(email, true, func() *User { return r.UserRepository.ByEmail(email) })
+}
+
+// lookup serves an ID or email from the cache or loads and caches it
+func (r *cachedUserRepository) lookup(key string, byEmail bool, load func() *User) *User {
+	ttl := config.Auth.UserCacheTTL
+	if ttl <= 0 {
+		return load()
+	}
+	now := time.Now()
+	r.mu.RLock()
+	entry, exists := r.byID[key]
+	if byEmail {
+		entry, exists = r.byEmail[key]
+	}
+	r.mu.RUnlock()
+	if exists && now.Before(entry.expiresAt) {
+		r.hits.Add(1)
+		return entry.user
+	}
+
+	r.misses.Add(1)
+	user := load()
+	if user == nil {
+		return nil
+	}
+	// Keyed by the email the repository matched, which during a change
+	// can differ from the user's Email field
+	id, email := user.ID, key
+	if !byEmail {
+		lock := r.FieldLock(user)
+		lock.RLock()
+		email = user.Email
+		lock.RUnlock()
+	}
+
+	entry = userCacheEntry{user: user, email: email, expiresAt: now.Add(ttl)}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.byID) >= userCacheMaxEntries {
+		r.evict(now)
+	}
+	// Cached under both keys, so forgetting the ID drops the email too
+	if previous, exists := r.byID[id]; exists && previous.email != email {
+		delete(r.byEmail, previous.email)
+	}
+	r.byID[id], r.byEmail[email] = entry, entry
+	return user
+}
+
+// evict drops expired entries, or everything if none have expired; callers
+// hold r.mu
+func (r *cachedUserRepository) evict(now time.Time) {
+	for id, entry := range r.byID {
+		if !now.Before(entry.expiresAt) {
+			delete(r.byID, id)
+			delete(r.byEmail, entry.email)
+		}
+	}
+	if len(r.byID) >= userCacheMaxEntries {
+		r.byID, r.byEmail = make(map[string]userCacheEntry), make(map[string]userCacheEntry)
+	}
+}
+
+// forget drops a user's entries
+func (r *cachedUserRepository) forget(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if entry, exists := r.byID[id]; exists {
+		delete(r.byEmail, entry.email)
+		delete(r.byID, id)
+	}
+}
+
+// forgetEmail drops whatever is cached under an email
+func (r *cachedUserRepository) forgetEmail(email string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if entry, exists := r.byEmail[email]; exists {
+		delete(r.byID, entry.user.ID)
+		delete(r.byEmail, email)
+	}
+}
+
+// Add stores a user; a cached entry for the email can only be stale
+func (r *cachedUserRepository) Add(user *User) (*User, error) {
+	stored, err := r.UserRepository.Add(user)
+	r.forgetEmail(user.Email)
+	return stored, err
+}
+
+// ChangeEmail moves a user to another email
+func (r *cachedUserRepository) ChangeEmail(user *User, from, to string) error {
+	err := r.UserRepository.ChangeEmail(user, from, to)
+	r.forget(user.ID)
+	r.forgetEmail(from)
+	r.forgetEmail(to)
+	return err
+}
+
+// ChangePhone moves a user to another phone number
+func (r *cachedUserRepository) ChangePhone(user *User, from, to string) error {
+	err := r.UserRepository.ChangePhone(user, from, to)
+	r.forget(user.ID)
+	return err
+}
+
+// Remove deletes a user
+func (r *cachedUserRepository) Remove(user *User) {
+	r.UserRepository.Remove(user)
+	r.forget(user.ID)
+}
+
+// forgetCachedUser drops a user from the process's lookup cache after a
+// change made outside the repository
+func forgetCachedUser(id string) {
+	userCache.forget(id)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// countingUsers counts lookups that reach the repository
+type countingUsers struct {
+	UserRepository
+	lookups int
+}
+
+func (r *countingUsers) ByID(id string) *User {
+	r.lookups++
+	return r.UserRepository.ByID(id)
+}
+
+func (r *countingUsers) ByEmail(email string) *User {
+	r.lookups++
+	return r.UserRepository.ByEmail(email)
+}
+
+// newCountingCache returns a cache over a fresh repository with one user
+func newCountingCache(t *testing.T, ttl time.Duration) (*cachedUserRepository, *countingUsers, *User) {
+	t.Helper()
+	withConfig(t, func(cfg *Config) { cfg.Auth.UserCacheTTL = ttl })
+	backing := &countingUsers{UserRepository: newMemoryUserRepository()}
+	cache := newCachedUserRepository(backing)
+	user, err := cache.Add(&User{ID: "u1", Email: "a@example.com", Role: "user"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cache, backing, user
+}
+
+func TestUserCacheHits(t *testing.T) {
+	cache, backing, user := newCountingCache(t, time.Minute)
+	for i := 0; i < 3; i++ {
+		if cache.ByID("u1") != user || cache.ByEmail("a@example.com") != user {
+			t.Fatal("cache returned a different user")
+		}
+	}
+	// One load by ID caches the email too
+	if backing.lookups != 1 {
+		t.Fatalf("repository looked up %d times; want 1", backing.lookups)
+	}
+	if cache.ByID("missing") != nil || cache.ByID("missing") != nil || backing.lookups != 3 {
+		t.Fatalf("misses cached: %d lookups", backing.lookups)
+	}
+}
+
+func TestUserCacheDisabled(t *testing.T) {
+	cache, backing, _ := newCountingCache(t, 0)
+	cache.ByID("u1")
+	cache.ByID("u1")
+	if backing.lookups != 2 || len(cache.byID) != 0 {
+		t.Fatalf("disabled cache used: %d lookups, %d entries", backing.lookups, len(cache.byID))
+	}
+}
+
+func TestUserCacheInvalidation(t *testing.T) {
+	cache, backing, user := newCountingCache(t, time.Minute)
+	cache.ByID("u1")
+
+	if err := cache.ChangeEmail(user, "a@example.com", "b@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	user.Email = "b@example.com"
+	if cache.ByEmail("a@example.com") != nil || cache.ByEmail("b@example.com") != user {
+		t.Fatal("email change not seen")
+	}
+
+	// Role changes forget the user along with their tokens
+	lookups := backing.lookups
+	cache.ByID("u1")
+	saved := userCache
+	userCache = cache
+	defer func() { userCache = saved }()
+	forgetUserTokens("u1")
+	cache.ByID("u1")
+	if backing.lookups != lookups+1 {
+		t.Fatalf("forgotten user served from cache (%d lookups)", backing.lookups-lookups)
+	}
+
+	cache.Remove(user)
+	if cache.ByID("u1") != nil || cache.ByEmail("b@example.com") != nil {
+		t.Fatal("removed user still cached")
+	}
+}
+
+func TestUserCacheExpiry(t *testing.T) {
+	cache, backing, _ := newCountingCache(t, 10*time.Millisecond)
+	cache.ByID("u1")
+	time.Sleep(20 * time.Millisecond)
+	cache.ByID("u1")
+	if backing.lookups != 2 {
+		t.Fatalf("expired entry served: %d lookups", backing.lookups)
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"hash/fnv"
+	"sync"
+)
+
+// ============================================================================
+// User Store
+// ============================================================================
+//
+// memoryUserRepository is the in-memory UserRepository. Users are indexed
+// by email, by ID and by verified phone number, each index split into shards with their own lock so
+// lookups for different users don't contend. The lock of a user's ID shard
+// also guards that user's fields (see FieldLock); readers of Password, Role
+// or profile fields take it for reading.
+//
+// No code path holds two shard locks at once, and nothing slow (password
+// hashing, shared store writes) runs under one: registration hashes first
+// and then inserts with putIfAbsent, so a lost race reports the email as
+// taken instead of blocking logins while it hashes.
+
+const userShardCount = 32
+
+type userShard struct {
+	mu    sync.RWMutex
+	users map[string]*User
+}
+
+// userIndex maps a key (email or ID) to users across shards
+type userIndex struct {
+	shards [userShardCount]userShard
+}
+
+func newUserIndex() *userIndex {
+	ix := &userIndex{}
+	for i := range ix.shards {
+		ix.shards[i].users = make(map[string]*User)
+	}
+	return ix
+}
+
+func (ix *userIndex) shardFor(key string) *userShard {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return &ix.shards[h.Sum32()%userShardCount]
+}
+
+func (ix *userIndex) get(key string) (*User, bool) {
+	shard := ix.shardFor(key)
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+	user, exists := shard.users[key]
+	return user, exists
+}
+
+func (ix *userIndex) put(key string, user *User) {
+	shard := ix.shardFor(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	shard.users[key] = user
+}
+
+// putIfAbsent stores user under key unless the key is taken, in which case
+// it returns the existing user and false
+func (ix *userIndex) putIfAbsent(key string, user *User) (*User, bool) {
+	shard := ix.shardFor(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	if existing, exists := shard.users[key]; exists {
+		return existing, false
+	}
+	shard.users[key] = user
+	return user, true
+}
+
+// remove deletes key if it still maps to user
+func (ix *userIndex) remove(key string, user *User) {
+	shard := ix.shardFor(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	if shard.users[key] == user {
+		delete(shard.users, key)
+	}
+}
+
+func (ix *userIndex) len() int {
+	total := 0
+	for i := range ix.shards {
+		shard := &ix.shards[i]
+		shard.mu.RLock()
+		total += len(shard.users)
+		shard.mu.RUnlock()
+	}
+	return total
+}
+
+// each calls fn for every user, one shard at a time under that shard's
+// read lock; fn must not take other user locks
+func (ix *userIndex) each(fn func(*User)) {
+	for i := range ix.shards {
+		shard := &ix.shards[i]
+		shard.mu.RLock()
+		for _, user := range shard.users {
+			fn(user)
+		}
+		shard.mu.RUnlock()
+	}
+}
+
+type memoryUserRepository struct {
+	byEmail *userIndex
+	byID    *userIndex // shard locks also guard user fields
+	byPhone *userIndex
+}
+
+func newMemoryUserRepository() *memoryUserRepository {
+	return &memoryUserRepository{byEmail: newUserIndex(), byID: newUserIndex(), byPhone: newUserIndex()}
+}
+
+// FieldLock returns the lock guarding a user's fields
+func (r *memoryUserRepository) FieldLock(user *User) *sync.RWMutex {
+	return &r.byID.shardFor(user.ID).mu
+}
+
+// ByID returns a user by ID, or nil
+func (r *memoryUserRepository) ByID(id string) *User {
+	user, _ := r.byID.get(id)
+	return user
+}
+
+// ByEmail returns a user by email, or nil
+func (r *memoryUserRepository) ByEmail(email string) *User {
+	user, _ := r.byEmail.get(email)
+	return user
+}
+
+// Contact returns a user's name and email by ID
+func (r *memoryUserRepository) Contact(id string) (name, email string, ok bool) {
+	shard := r.byID.shardFor(id)
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+	if user, exists := shard.users[id]; exists {
+		return user.Name, user.Email, true
+	}
+	return "", "", false
+}
+
+// Snapshot returns a copy of a user taken under its lock, or nil
+func (r *memoryUserRepository) Snapshot(id string) *User {
+	shard := r.byID.shardFor(id)
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+	if user, exists := shard.users[id]; exists {
+		snapshot := *user
+		return &snapshot
+	}
+	return nil
+}
+
+// Add stores a new user in both indexes. It returns the stored user,
+// which is an existing one with the same ID if the change feed got there
+// first, and errEmailTaken if the email belongs to someone else.
+func (r *memoryUserRepository) Add(user *User) (*User, error) {
+	stored, added := r.byEmail.putIfAbsent(user.Email, user)
+	if !added && stored.ID != user.ID {
+		return nil, errEmailTaken
+	}
+	if existing, added := r.byID.putIfAbsent(user.ID, stored); !added {
+		return existing, nil
+	}
+	bumpUserVersion()
+	return stored, nil
+}
+
+// ChangeEmail moves a user to a new key in the email index, returning
+// errEmailTaken if it belongs to someone else. The caller then updates
+// user.Email under FieldLock; it must not hold that lock here.
+func (r *memoryUserRepository) ChangeEmail(user *User, from, to string) error {
+	if stored, added := r.byEmail.putIfAbsent(to, user); !added && stored != user {
+		return errEmailTaken
+	}
+	r.byEmail.remove(from, user)
+	return nil
+}
+
+// ByPhone returns a user by verified phone number, or nil
+func (r *memoryUserRepository) ByPhone(phone string) *User {
+	user, _ := r.byPhone.get(phone)
+	return user
+}
+
+// ChangePhone is ChangeEmail for the phone index; an empty from or to
+// adds or removes the number
+func (r *memoryUserRepository) ChangePhone(user *User, from, to string) error {
+	if to != "" {
+		if stored, added := r.byPhone.putIfAbsent(to, user); !added && stored != user {
+			return errPhoneTaken
+		}
+	}
+	if from != "" {
+		r.byPhone.remove(from, user)
+	}
+	return nil
+}
+
+// Remove deletes a user from every index
+func (r *memoryUserRepository) Remove(user *User) {
+	lock := r.FieldLock(user)
+	lock.RLock()
+	email, phone := user.Email, user.Phone
+	lock.RUnlock()
+	if phone != "" {
+		r.byPhone.remove(phone, user)
+	}
+	r.byEmail.remove(email, user)
+	r.byID.remove(user.ID, user)
+	bumpUserVersion()
+}
+
+// Each calls fn for every user; see userIndex.each
+func (r *memoryUserRepository) Each(fn func(*User)) {
+	r.byID.each(fn)
+}
+
+// Count returns the number of users
+func (r *memoryUserRepository) Count() int {
+	return r.byID.len()
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestAddUserSettlesRaces(t *testing.T) {
+	resetLocalStores(t)
+	t.Cleanup(func() { resetLocalStores(t) })
+
+	var wins atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			user := &User{ID: fmt.Sprintf("u%d", i), Email: "a@example.com"}
+			if _, err := localUsers.Add(user); err == nil {
+				wins.Add(1)
+			} else if err != errEmailTaken {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if wins.Load() != 1 {
+		t.Fatalf("%d registrations won, want 1", wins.Load())
+	}
+	winner := localUsers.ByEmail("a@example.com")
+	if winner == nil || lookupUser(winner.ID) != winner || localUsers.Count() != 1 {
+		t.Fatal("indexes disagree after racing registrations")
+	}
+}
+
+func TestAddUserKeepsFeedCopy(t *testing.T) {
+	resetLocalStores(t)
+	t.Cleanup(func() { resetLocalStores(t) })
+
+	// The change feed applied our own registration first
+	applySharedUser(sharedUser{ID: "u1", Email: "a@example.com", Name: "A"})
+	stored, err := localUsers.Add(&User{ID: "u1", Email: "a@example.com", Name: "A"})
+	if err != nil || stored != lookupUser("u1") {
+		t.Fatalf("Add = %p, %v; want the feed's copy %p", stored, err, lookupUser("u1"))
+	}
+}
+
+func TestApplySharedUserMovesEmail(t *testing.T) {
+	resetLocalStores(t)
+	t.Cleanup(func() { resetLocalStores(t) })
+
+	applySharedUser(sharedUser{ID: "u1", Email: "old@example.com"})
+	user := lookupUser("u1")
+	applySharedUser(sharedUser{ID: "u1", Email: "new@example.com"})
+
+	if lookupUser("u1") != user {
+		t.Fatal("record replaced instead of updated in place")
+	}
+	if localUsers.ByEmail("old@example.com") != nil {
+		t.Fatal("old email still indexed")
+	}
+	if localUsers.ByEmail("new@example.com") != user {
+		t.Fatal("new email not indexed")
+	}
+}
+
+// singleLockUsers mirrors the store before sharding: one RWMutex over the
+// maps and user fields, held for writing while a registration hashes
+type singleLockUsers struct {
+	mu      sync.RWMutex
+	byEmail map[string]*User
+}
+
+func (s *singleLockUsers) register(email string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	hash, _ := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.DefaultCost)
+	s.byEmail[email] = &User{ID: email, Email: email, Password: string(hash)}
+}
+
+func (s *singleLockUsers) login(email string) string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.byEmail[email].Password
+}
+
+// BenchmarkConcurrentLogin measures credential lookups from many goroutines
+// while a registration arrives every 100ms, before and after
+// sharding. Password verification is left out: it costs the same either way.
+func BenchmarkConcurrentLogin(b *testing.B) {
+	const accounts = 1024
+	emails := make([]string, accounts)
+	for i := range emails {
+		emails[i] = fmt.Sprintf("user%d@example.com", i)
+	}
+
+	run := func(b *testing.B, register func(string), login func(string) string) {
+		stop := make(chan struct{})
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ticker := time.NewTicker(100 * time.Millisecond)
+			defer ticker.Stop()
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					return
+				case <-ticker.C:
+				}
+				register(fmt.Sprintf("new%d@example.com", i))
+			}
+		}()
+
+		b.ResetTimer()
+		b.RunParallel(func(pb *testing.PB) {
+			i := 0
+			for pb.Next() {
+				login(emails[i%accounts])
+				i++
+			}
+		})
+		b.StopTimer()
+		close(stop)
+		wg.Wait()
+	}
+
+	b.Run("single-lock", func(b *testing.B) {
+		store := &singleLockUsers{byEmail: make(map[string]*User)}
+		for _, email := range emails {
+			store.byEmail[email] = &User{ID: email, Email: email}
+		}
+		run(b, store.register, store.login)
+	})
+
+	b.Run("sharded", func(b *testing.B) {
+		repo := newMemoryUserRepository()
+		for _, email := range emails {
+			repo.Add(&User{ID: email, Email: email})
+		}
+		// Registration hashes first, then inserts, as Service.Register does
+		register := func(email string) {
+			hash, _ := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.DefaultCost)
+			repo.Add(&User{ID: email, Email: email, Password: string(hash)})
+		}
+		login := func(email string) string {
+			user := repo.ByEmail(email)
+			lock := repo.FieldLock(user)
+			lock.RLock()
+			defer lock.RUnlock()
+			return user.Password
+		}
+		run(b, register, login)
+	})
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ============================================================================
+// API Versioning
+// ============================================================================
+
+const apiVersionHeader = "API-Version"
+
+// supportedAPIVersions lists the versions mounted under /<version>
+var supportedAPIVersions = map[string]bool{"v1": true}
+
+// apiVersion tags responses from a versioned route group
+func apiVersion(version string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Header(apiVersionHeader, version)
+		c.Next()
+	}
+}
+
+// deprecatedAlias serves the legacy unversioned paths with the handlers of
+// the given version. Clients may pick a version with the API-Version
+// header; without one they get deprecation headers pointing at the
+// versioned path.
+func deprecatedAlias(engine *gin.Engine, version string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		requested := c.GetHeader(apiVersionHeader)
+		if requested != "" && !supportedAPIVersions[requested] {
+			respondError(c, http.StatusBadRequest, codeUnsupportedVersion, "Unsupported API version: "+requested)
+			c.Abort()
+			return
+		}
+
+		// Another version was asked for: dispatch to its mounted routes
+		if requested != "" && requested != version {
+			c.Request.URL.Path = "/" + requested + c.Request.URL.Path
+			engine.HandleContext(c)
+			c.Abort()
+			return
+		}
+
+		c.Header(apiVersionHeader, version)
+		if requested == "" {
+			c.Header("Deprecation", "true")
+			if sunset := config.Server.LegacyAPISunset; sunset != "" {
+				c.Header("Sunset", sunset) // HTTP-date, e.g. "Wed, 01 Jul 2026 00:00:00 GMT"
+			}
+			c.Header("Link", "</"+version+c.Request.URL.Path+`>; rel="successor-version"`)
+		}
+		c.Next()
+	}
+}
+
+// splitAPIVersion separates a leading /<version> segment from a route path
+func splitAPIVersion(path string) (version, rest string) {
+	segment, remainder, _ := strings.Cut(strings.TrimPrefix(path, "/"), "/")
+	if supportedAPIVersions[segment] {
+		return segment, "/" + remainder
+	}
+	return "", path
+}
@@ -0,0 +1,401 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+)
+
+// ============================================================================
+// WebSocket Chat
+// ============================================================================
+
+const (
+	wsWriteWait      = 10 * time.Second      // Time allowed to write a message
+	wsPongWait       = 60 * time.Second      // Time allowed to read the next pong
+	wsPingPeriod     = (wsPongWait * 9) / 10 // Must be shorter than wsPongWait
+	wsMaxMessageSize = 64 * 1024
+)
+
+var wsUpgrader = websocket.Upgrader{
+	ReadBufferSize:  4096,
+	WriteBufferSize: 4096,
+	// Browsers don't preflight upgrades, so apply the CORS allowlist here
+	CheckOrigin: wsCheckOrigin,
+}
+
+// ChatMessage is the envelope for all WebSocket traffic in both directions
+type ChatMessage struct {
+	Type           string     `json:"type"` // query, cancel, history | ready, chunk, done, history, error
+	Question       string     `json:"question,omitempty"`
+	NChunks        int        `json:"n_chunks,omitempty"`
+	FilterSources  []string   `json:"filter_sources,omitempty"`
+	ForceWebSearch bool       `json:"force_web_search,omitempty"`
+	Collection     string     `json:"collection,omitempty"`
+	ConversationID string     `json:"conversation_id,omitempty"` // saves the exchange to a conversation (conversations.go)
+	SessionID      string     `json:"session_id,omitempty"`
+	Data           string     `json:"data,omitempty"`
+	History        []ChatTurn `json:"history,omitempty"`
+	Error          string     `json:"error,omitempty"`
+}
+
+// ChatTurn is one question/answer exchange within a session
+type ChatTurn struct {
+	Question string    `json:"question"`
+	Answer   string    `json:"answer"`
+	AskedAt  time.Time `json:"asked_at"`
+}
+
+// chatSessions tracks open sessions so shutdown can close them
+var (
+	chatSessions   = make(map[*chatSession]struct{})
+	chatSessionsMu sync.Mutex
+)
+
+// chatSession holds per-connection state
+type chatSession struct {
+	id       string
+	svc      *Service
+	token    string // checked again before each query
+	language string // negotiated at the upgrade; for questions it can't guess
+	conn     *websocket.Conn
+	writeMu  sync.Mutex
+
+	mu      sync.Mutex
+	history []ChatTurn
+	cancel  context.CancelFunc // cancels the in-flight query, if any
+	queryID uint64             // identifies the in-flight query
+}
+
+// wsToken extracts the bearer token from the upgrade request. Browsers
+// cannot set headers on WebSocket requests, so a token query parameter
+// is accepted as well, as is the session cookie in cookie mode (the
+// upgrade is a GET, so no CSRF token is needed; wsCheckOrigin applies).
+func wsToken(c *gin.Context) string {
+	if token, _, err := requestToken(c); err == nil {
+		return token
+	} else if err == errAuthFormat {
+		return ""
+	}
+	if !bearerTokens() {
+		return ""
+	}
+	return c.Query("token")
+}
+
+// chatWebSocket authenticates the caller and upgrades to a chat session
+func (s *Server) chatWebSocket(c *gin.Context) {
+	tokenString := wsToken(c)
+	if tokenString == "" {
+		respondError(c, http.StatusUnauthorized, codeUnauthorized, "Authorization token required")
+		return
+	}
+
+	// Authenticate before upgrading so failures get a proper HTTP status
+	if _, err := s.svc.Authenticate(tokenString); err != nil {
+		respondError(c, http.StatusUnauthorized, tokenErrorCode(err), err.Error())
+		return
+	}
+
+	conn, err := wsUpgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		// Upgrade has already written an HTTP error response
+		slog.Warn("ws chat: upgrade failed", "request_id", c.GetString(requestIDContextKey), "error", err)
+		return
+	}
+
+	session := &chatSession{
+		id:       uuid.New().String(),
+		svc:      s.svc,
+		token:    tokenString,
+		language: requestLanguage(c),
+		conn:     conn,
+	}
+	chatSessionsMu.Lock()
+	chatSessions[session] = struct{}{}
+	chatSessionsMu.Unlock()
+	defer func() {
+		chatSessionsMu.Lock()
+		delete(chatSessions, session)
+		chatSessionsMu.Unlock()
+	}()
+
+	session.run()
+}
+
+// closeChatSessions asks every connected client to go away so it reconnects
+// to another instance; each session ends when its client closes
+func closeChatSessions(reason string) {
+	chatSessionsMu.Lock()
+	defer chatSessionsMu.Unlock()
+
+	msg := websocket.FormatCloseMessage(websocket.CloseGoingAway, reason)
+	for session := range chatSessions {
+		session.conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(wsWriteWait))
+	}
+}
+
+// run drives the session until the client goes away
+func (s *chatSession) run() {
+	defer s.conn.Close()
+
+	done := make(chan struct{})
+	defer close(done)
+	go s.keepalive(done)
+
+	s.conn.SetReadLimit(wsMaxMessageSize)
+	s.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	s.conn.SetPongHandler(func(string) error {
+		return s.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+
+	s.send(ChatMessage{Type: "ready", SessionID: s.id})
+
+	for {
+		var msg ChatMessage
+		if err := s.conn.ReadJSON(&msg); err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				slog.Warn("ws chat: read failed", "session_id", s.id, "error", err)
+			}
+			s.cancelQuery()
+			return
+		}
+
+		switch msg.Type {
+		case "query":
+			s.startQuery(msg)
+		case "cancel":
+			s.cancelQuery()
+		case "history":
+			s.mu.Lock()
+			history := append([]ChatTurn(nil), s.history...)
+			s.mu.Unlock()
+			s.send(ChatMessage{Type: "history", SessionID: s.id, History: history})
+		default:
+			s.send(ChatMessage{Type: "error", Error: "Unknown message type"})
+		}
+	}
+}
+
+// keepalive pings the client until done is closed
+func (s *chatSession) keepalive(done <-chan struct{}) {
+	ticker := time.NewTicker(wsPingPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteWait)); err != nil {
+				return
+			}
+		case <-done:
+			// Graceful close; the client may already be gone
+			s.conn.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+				time.Now().Add(wsWriteWait))
+			return
+		}
+	}
+}
+
+// send writes a message to the client; writes are serialized per connection
+func (s *chatSession) send(msg ChatMessage) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	s.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+	return s.conn.WriteJSON(msg)
+}
+
+// endSession closes the connection with a policy violation once its token
+// no longer authenticates
+func (s *chatSession) endSession(err error) {
+	s.cancelQuery()
+	s.send(ChatMessage{Type: "error", Error: err.Error()})
+	s.conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.ClosePolicyViolation, err.Error()),
+		time.Now().Add(wsWriteWait))
+	s.conn.Close()
+}
+
+// startQuery launches a streamed query unless one is already running
+func (s *chatSession) startQuery(msg ChatMessage) {
+	// The connection outlives the token checks at the upgrade: logging out
+	// everywhere, removing the device, a role change, expiry or going idle
+	// all end the session at its next query
+	user, err := s.svc.Authenticate(s.token)
+	if err != nil {
+		s.endSession(err)
+		return
+	}
+	if strings.TrimSpace(msg.Question) == "" {
+		s.send(ChatMessage{Type: "error", Error: "Question cannot be empty"})
+		return
+	}
+
+	if msg.ConversationID != "" {
+		if err := s.svc.CanAddTurn(msg.ConversationID, user); err != nil {
+			s.send(ChatMessage{Type: "error", Error: err.Error()})
+			return
+		}
+	}
+	// Only the read loop starts queries, so nothing else can claim the slot
+	// between this check and taking it below
+	s.mu.Lock()
+	busy := s.cancel != nil
+	s.mu.Unlock()
+	if busy {
+		s.send(ChatMessage{Type: "error", Error: "A query is already in progress"})
+		return
+	}
+	// The upgrade bypasses authMiddleware, so each query takes a token
+	// from the caller's API bucket here, and one from their plan's daily
+	// queries once it is scoped
+	if !allowCall(context.Background(), apiRateLimit, "user:"+user.ID) {
+		s.send(ChatMessage{Type: "error", Error: "Too many requests; retry later"})
+		return
+	}
+	req := StreamQueryRequest{
+		Question:       msg.Question,
+		NChunks:        msg.NChunks,
+		FilterSources:  msg.FilterSources,
+		ForceWebSearch: msg.ForceWebSearch,
+		Collection:     msg.Collection,
+	}
+	err = s.svc.prepareQuery(user, &req, s.language, func() bool {
+		return spendQueries(context.Background(), user, 1).Allowed
+	})
+	if err != nil {
+		s.send(ChatMessage{Type: "error", Error: err.Error()})
+		return
+	}
+
+	s.mu.Lock()
+	// Each query gets its own request ID so the backend's citation report
+	// can be matched to its history record
+	queryID := uuid.New().String()
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), requestIDKey{}, queryID))
+	s.cancel = cancel
+	s.queryID++
+	id := s.queryID
+	s.mu.Unlock()
+
+	record := startQueryRecord(queryID, user, s.id, &req)
+	go s.relay(ctx, id, user, req, record, msg.ConversationID)
+}
+
+// cancelQuery stops the in-flight query, if any
+func (s *chatSession) cancelQuery() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.cancel != nil {
+		s.cancel()
+		s.cancel = nil
+	}
+}
+
+// finishQuery releases query id, unless it was cancelled and another
+// query has started since
+func (s *chatSession) finishQuery(id uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.queryID == id && s.cancel != nil {
+		s.cancel()
+		s.cancel = nil
+	}
+}
+
+// relay streams the backend's SSE answer to the client as chunk messages
+func (s *chatSession) relay(ctx context.Context, id uint64, user *User, req StreamQueryRequest, record *QueryRecord, conversationID string) {
+	defer s.finishQuery(id)
+
+	var answer strings.Builder
+	var sources []string
+	var firstByte time.Time
+	outcome := queryAnswered
+	defer func() {
+		if ctx.Err() != nil && outcome == queryAnswered {
+			outcome = queryCancelled
+		}
+		finishQueryRecord(record, outcome, firstByte, len([]rune(answer.String())))
+	}()
+
+	resp, err := openQueryStream(ctx, req)
+	if err != nil {
+		if ctx.Err() == nil {
+			outcome = queryFailed
+			slog.Warn("ws chat: upstream failed", "error", err)
+			s.send(ChatMessage{Type: "error", Error: "Query backend unavailable"})
+		}
+		return
+	}
+	defer resp.Body.Close()
+
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+		if !ok {
+			continue
+		}
+		if data == "[DONE]" {
+			break
+		}
+		if !strings.HasPrefix(data, "[") {
+			if firstByte.IsZero() {
+				firstByte = time.Now()
+			}
+			answer.WriteString(data)
+		}
+		if list, ok := strings.CutPrefix(data, "[SOURCES]"); ok {
+			sources = strings.Split(strings.TrimSuffix(list, "[/SOURCES]"), ",")
+		}
+		if err := s.send(ChatMessage{Type: "chunk", Data: data}); err != nil {
+			outcome = queryCancelled
+			return
+		}
+	}
+	if ctx.Err() != nil {
+		return
+	}
+	if err := scanner.Err(); err != nil {
+		outcome = queryFailed
+		slog.Warn("ws chat: upstream read failed", "session_id", s.id, "error", err)
+		s.send(ChatMessage{Type: "error", Error: "Upstream stream interrupted"})
+		return
+	}
+
+	s.mu.Lock()
+	s.history = append(s.history, ChatTurn{
+		Question: req.Question,
+		Answer:   answer.String(),
+		AskedAt:  time.Now(),
+	})
+	s.mu.Unlock()
+
+	if conversationID != "" {
+		// The backend names the documents the answer drew on. Without that
+		// an admin's query, which searched every document, can't say which
+		// it read.
+		turn := ConversationTurnRequest{Question: req.Question, Answer: answer.String(), Sources: req.FilterSources}
+		if len(sources) > 0 {
+			turn.Sources = sources
+		} else if len(req.FilterSources) == 0 {
+			turn.Unscoped = true
+		}
+		if _, err := s.svc.AddTurn(conversationID, user, turn); err != nil {
+			s.send(ChatMessage{Type: "error", Error: err.Error()})
+		}
+	}
+
+	s.send(ChatMessage{Type: "done", SessionID: s.id})
+}
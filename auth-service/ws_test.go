@@ -0,0 +1,270 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// chatBackend answers every streamed query with the given chunks
+func chatBackend(t *testing.T, chunks ...string) {
+	t.Helper()
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, chunk := range chunks {
+			w.Write([]byte("data: " + chunk + "\n\n"))
+		}
+		w.Write([]byte("data: [DONE]\n\n"))
+	}))
+	t.Cleanup(backend.Close)
+	withConfig(t, func(cfg *Config) { cfg.RAGBackend.URL = backend.URL })
+}
+
+// dialChat opens a chat session and reads its ready message
+func dialChat(t *testing.T, gateway *httptest.Server, token string) *websocket.Conn {
+	t.Helper()
+	url := "ws" + strings.TrimPrefix(gateway.URL, "http") + "/v1/ws/chat?token=" + token
+	conn, resp, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		status := 0
+		if resp != nil {
+			status = resp.StatusCode
+		}
+		t.Fatalf("dial: %v (%d)", err, status)
+	}
+	t.Cleanup(func() { conn.Close() })
+	if msg := readChat(t, conn); msg.Type != "ready" || msg.SessionID == "" {
+		t.Fatalf("first message: %+v", msg)
+	}
+	return conn
+}
+
+func readChat(t *testing.T, conn *websocket.Conn) ChatMessage {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var msg ChatMessage
+	if err := conn.ReadJSON(&msg); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	return msg
+}
+
+// askChat sends a query and collects the answer up to done or an error
+func askChat(t *testing.T, conn *websocket.Conn, question string) (string, ChatMessage) {
+	t.Helper()
+	if err := conn.WriteJSON(ChatMessage{Type: "query", Question: question}); err != nil {
+		t.Fatal(err)
+	}
+	var answer strings.Builder
+	for {
+		msg := readChat(t, conn)
+		if msg.Type != "chunk" {
+			return answer.String(), msg
+		}
+		answer.WriteString(msg.Data)
+	}
+}
+
+func TestChatSessionEndsWithItsToken(t *testing.T) {
+	ts := newTestServer(t)
+	chatBackend(t, "Twenty ", "days.")
+	gateway := httptest.NewServer(ts.srv)
+	defer gateway.Close()
+	token, _ := ts.register("user@example.com")
+	ts.do(http.MethodPost, "/v1/documents/register", token, `{"filename":"handbook.pdf"}`)
+
+	conn := dialChat(t, gateway, token)
+	if answer, last := askChat(t, conn, "How much leave?"); answer != "Twenty days." || last.Type != "done" {
+		t.Fatalf("answer %q ended with %+v", answer, last)
+	}
+
+	// Logging out everywhere ends the open session at its next query
+	if w := ts.do(http.MethodPost, "/v1/auth/logout-all", token, ""); w.Code != http.StatusOK {
+		t.Fatalf("logout-all: %d %s", w.Code, w.Body)
+	}
+	if _, last := askChat(t, conn, "And sick leave?"); last.Type != "error" || last.Error != errTokenRevoked.Error() {
+		t.Fatalf("query after logout-all: %+v", last)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, _, err := conn.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+		t.Fatalf("after a revoked token: %v, want a policy violation close", err)
+	}
+}
+
+func TestChatQueryInProgressIsFree(t *testing.T) {
+	ts := newTestServer(t)
+	withConfig(t, func(cfg *Config) {
+		cfg.RateLimit.DefaultPlan = "free"
+		cfg.RateLimit.Plans = map[string]QueryPlan{"free": {QueriesPerDay: 2}}
+	})
+	release := make(chan struct{}, 2)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("data: Twenty days.\n\n"))
+		w.(http.Flusher).Flush()
+		<-release
+		w.Write([]byte("data: [DONE]\n\n"))
+	}))
+	defer backend.Close()
+	withConfig(t, func(cfg *Config) { cfg.RAGBackend.URL = backend.URL })
+	gateway := httptest.NewServer(ts.srv)
+	defer gateway.Close()
+	token, _ := ts.register("user@example.com")
+	ts.do(http.MethodPost, "/v1/documents/register", token, `{"filename":"handbook.pdf"}`)
+	savedPolicy := apiRateLimit
+	apiRateLimit = rateLimitPolicy{name: "api", perMinute: 600, burst: 100}
+	t.Cleanup(func() { apiRateLimit = savedPolicy })
+	useRateLimiter(t, &memoryRateLimitStore{buckets: make(map[string]*tokenBucket)})
+	conn := dialChat(t, gateway, token)
+
+	// A query refused for the one in flight costs nothing from the plan
+	conn.WriteJSON(ChatMessage{Type: "query", Question: "How much leave?"})
+	if msg := readChat(t, conn); msg.Type != "chunk" {
+		t.Fatalf("first query: %+v", msg)
+	}
+	if _, last := askChat(t, conn, "And sick leave?"); last.Error != "A query is already in progress" {
+		t.Fatalf("second query: %+v", last)
+	}
+	release <- struct{}{}
+	if msg := readChat(t, conn); msg.Type != "done" {
+		t.Fatalf("first query ended with %+v", msg)
+	}
+	release <- struct{}{}
+	if _, last := askChat(t, conn, "And parental leave?"); last.Type != "done" {
+		t.Fatalf("second of two daily queries: %+v", last)
+	}
+	if _, last := askChat(t, conn, "One more?"); last.Error != errQuotaExceeded.Error() {
+		t.Fatalf("over the plan: %+v", last)
+	}
+}
+
+func TestChatSessionHandshake(t *testing.T) {
+	ts := newTestServer(t)
+	gateway := httptest.NewServer(ts.srv)
+	defer gateway.Close()
+	token, _ := ts.register("user@example.com")
+	url := "ws" + strings.TrimPrefix(gateway.URL, "http") + "/v1/ws/chat"
+	withConfig(t, func(cfg *Config) { cfg.CORS.AllowedOrigins = []string{"https://app.example"} })
+
+	// Failures are refused before the upgrade, with a status
+	for name, c := range map[string]struct {
+		url    string
+		header http.Header
+		want   int
+	}{
+		"no token":         {url, nil, http.StatusUnauthorized},
+		"bad token":        {url + "?token=nonsense", nil, http.StatusUnauthorized},
+		"malformed":        {url + "?token=" + token, http.Header{"Authorization": {"Token " + token}}, http.StatusUnauthorized},
+		"foreign origin":   {url + "?token=" + token, http.Header{"Origin": {"https://evil.example"}}, http.StatusForbidden},
+		"bearer header ok": {url, http.Header{"Authorization": {"Bearer " + token}}, http.StatusSwitchingProtocols},
+	} {
+		conn, resp, err := websocket.DefaultDialer.Dial(c.url, c.header)
+		if conn != nil {
+			conn.Close()
+		}
+		if resp == nil || resp.StatusCode != c.want {
+			t.Errorf("%s: %v, %v; want %d", name, resp, err, c.want)
+		}
+	}
+}
+
+func TestChatSessionMessages(t *testing.T) {
+	ts := newTestServer(t)
+	chatBackend(t, "Twenty ", "days.")
+	gateway := httptest.NewServer(ts.srv)
+	defer gateway.Close()
+	token, _ := ts.register("user@example.com")
+	conn := dialChat(t, gateway, token)
+
+	// Nothing to query yet
+	if _, last := askChat(t, conn, "How much leave?"); last.Error != "No accessible documents to query" {
+		t.Fatalf("without documents: %+v", last)
+	}
+	ts.do(http.MethodPost, "/v1/documents/register", token, `{"filename":"handbook.pdf"}`)
+	if _, last := askChat(t, conn, "  "); last.Error != "Question cannot be empty" {
+		t.Fatalf("empty question: %+v", last)
+	}
+	conn.WriteJSON(ChatMessage{Type: "shout"})
+	if msg := readChat(t, conn); msg.Error != "Unknown message type" {
+		t.Fatalf("unknown type: %+v", msg)
+	}
+
+	// Answered queries make up the session's history
+	askChat(t, conn, "How much leave?")
+	conn.WriteJSON(ChatMessage{Type: "history"})
+	msg := readChat(t, conn)
+	if msg.Type != "history" || len(msg.History) != 1 || msg.History[0].Question != "How much leave?" || msg.History[0].Answer != "Twenty days." {
+		t.Fatalf("history: %+v", msg)
+	}
+
+	// Another session has its own
+	other := dialChat(t, gateway, token)
+	other.WriteJSON(ChatMessage{Type: "history"})
+	if msg := readChat(t, other); msg.Type != "history" || len(msg.History) != 0 || msg.SessionID == "" {
+		t.Fatalf("other session's history: %+v", msg)
+	}
+
+	// Going away is a normal close
+	chatSessionsMu.Lock()
+	open := len(chatSessions)
+	chatSessionsMu.Unlock()
+	if open != 2 {
+		t.Fatalf("%d sessions open, want 2", open)
+	}
+	closeChatSessions("restarting")
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, _, err := conn.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Fatalf("after shutdown: %v, want going away", err)
+	}
+}
+
+func TestChatQueryPreparation(t *testing.T) {
+	ts := newTestServer(t)
+	sent := make(chan StreamQueryRequest, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req StreamQueryRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		sent <- req
+		w.Write([]byte("data: Veinte días.\n\ndata: [DONE]\n\n"))
+	}))
+	defer backend.Close()
+	withConfig(t, func(cfg *Config) { cfg.RAGBackend.URL = backend.URL })
+	gateway := httptest.NewServer(ts.srv)
+	defer gateway.Close()
+	token, _ := ts.register("user@example.com")
+	for filename, language := range map[string]string{"manual.pdf": "es", "handbook.pdf": "en"} {
+		ts.do(http.MethodPost, "/v1/documents/register", token, `{"filename":"`+filename+`"}`)
+		ts.srv.svc.SetDocumentPreview(filename, DocumentPreview{Language: language})
+	}
+	conn := dialChat(t, gateway, token)
+
+	// A chat query is sent as the same query over SSE would be
+	question := "¿Cuál es el plazo para la entrega de los informes?"
+	if err := conn.WriteJSON(ChatMessage{Type: "query", Question: question, FilterSources: []string{"manual.pdf", "handbook.pdf"}}); err != nil {
+		t.Fatal(err)
+	}
+	for msg := readChat(t, conn); msg.Type != "done"; msg = readChat(t, conn) {
+		if msg.Type == "error" {
+			t.Fatalf("query: %+v", msg)
+		}
+	}
+	req := <-sent
+	if req.Language != "es" || len(req.PreferredSources) != 1 || req.PreferredSources[0] != "manual.pdf" {
+		t.Fatalf("language %q, preferred %v", req.Language, req.PreferredSources)
+	}
+	if req.Search == nil || req.Collection != req.Search.Collection {
+		t.Fatalf("collection %q, search %+v", req.Collection, req.Search)
+	}
+	var recent struct {
+		Documents []RecentDocument `json:"documents"`
+	}
+	decodeJSON(t, ts.do(http.MethodGet, "/v1/documents/recent", token, ""), &recent)
+	if len(recent.Documents) != 2 {
+		t.Fatalf("recent after a picked query: %+v", recent.Documents)
+	}
+}
@@ -19,7 +19,7 @@ from pathlib import Path
 from typing import List, Optional
 from datetime import datetime
 
-from fastapi import FastAPI, UploadFile, File, HTTPException
+from fastapi import FastAPI, UploadFile, File, Form, HTTPException
 from fastapi.staticfiles import StaticFiles
 from fastapi.responses import FileResponse, JSONResponse, StreamingResponse
 from fastapi.middleware.cors import CORSMiddleware
@@ -147,15 +147,22 @@ async def health_check():
     return {"status": "healthy", "message": "RAG system is running!"}
 
 
-async def process_single_file(file: UploadFile) -> FileUploadResult:
+async def process_single_file(file: UploadFile, stored_name: Optional[str] = None) -> FileUploadResult:
     """
     Process a single file upload. Used by both single and multi-upload endpoints.
     Returns FileUploadResult with status.
     
+    stored_name is the filename the auth service assigned when the document
+    was registered. Two users can both upload report.pdf; the second is
+    registered as "report (1).pdf", and storing it under that name keeps it
+    from overwriting the first user's file. Without one the upload keeps its
+    own name.
+    
     For images: Uses quick local processing first, then enhances with Vision API in background.
     For other files: Processes normally (fast for text/PDF).
     """
-    filename = file.filename
+    # Only a bare name, so a stored name can't leave the uploads directory
+    filename = Path(stored_name or file.filename).name
     
     # Read file content to get size
     content = await file.read()
@@ -289,13 +296,17 @@ async def process_document_background(file_path: str, filename: str):
 
 
 @app.post("/upload", response_model=DocumentInfo)
-async def upload_document(file: UploadFile = File(...)):
+async def upload_document(file: UploadFile = File(...), filename: Optional[str] = Form(None)):
     """
     Upload a single document to be processed and indexed.
     
     Supports: .txt, .md, .pdf files (max 10MB)
+    
+    filename is the name the auth service registered the document under,
+    which differs from the upload's name when another user already has a
+    document by that name. The document is stored and indexed under it.
     """
-    result = await process_single_file(file)
+    result = await process_single_file(file, filename)
     
     if result.status == 'error':
         raise HTTPException(status_code=400, detail=result.error)
@@ -101,7 +101,7 @@ let authToken = null;
 let forceWebSearch = false; // Track if user wants to force web search
 
 // Auth service URL
-const AUTH_URL = 'http://localhost:8001';
+const AUTH_URL = 'http://localhost:8001/v1';
 
 // ============================================
 // Initialization
@@ -218,6 +218,51 @@ function getAuthHeaders() {
     return {};
 }
 
+// Register an upload with the auth service before storing it. The service
+// answers with the filename the document is stored and indexed under, which
+// differs from the file's own name when another user already has a document
+// by that name ("report (1).pdf"). Without a login the file keeps its name.
+async function registerUpload(file) {
+    if (!authToken) {
+        return file.name;
+    }
+    const response = await fetch(`${AUTH_URL}/documents/register`, {
+        method: 'POST',
+        headers: {
+            'Content-Type': 'application/json',
+            ...getAuthHeaders()
+        },
+        body: JSON.stringify({ filename: file.name })
+    });
+    const data = await response.json().catch(() => ({}));
+    if (!response.ok) {
+        throw new Error(data.detail || data.error || 'Registration failed');
+    }
+    return data.filename || file.name;
+}
+
+// Undo registerUpload when the upload itself fails
+function unregisterUpload(storedName) {
+    if (!authToken) {
+        return;
+    }
+    fetch(`${AUTH_URL}/documents/${encodeURIComponent(storedName)}`, {
+        method: 'DELETE',
+        headers: getAuthHeaders()
+    }).catch(() => {});
+}
+
+// Store a registered file under its assigned name
+function uploadAs(file, storedName) {
+    const formData = new FormData();
+    formData.append('file', file);
+    formData.append('filename', storedName);
+    return fetch('/upload', {
+        method: 'POST',
+        body: formData
+    });
+}
+
 function setupDeleteAll() {
     const deleteAllBtn = document.getElementById('delete-all-docs');
     if (deleteAllBtn) {
@@ -378,36 +423,24 @@ async function uploadFile(file, index) {
     statusEl.className = 'file-progress-status uploading';
     fillEl.style.width = '50%';
     
-    const formData = new FormData();
-    formData.append('file', file);
-    
     try {
-        const response = await fetch('/upload', {
-            method: 'POST',
-            body: formData
-        });
+        const storedName = await registerUpload(file);
+        const response = await uploadAs(file, storedName);
         
         if (!response.ok) {
+            unregisterUpload(storedName);
             throw new Error('Upload failed');
         }
         
-        // Register document with auth service if logged in (silent - no errors shown)
-        if (authToken) {
-            fetch(`${AUTH_URL}/documents/register`, {
-                method: 'POST',
-                headers: {
-                    'Content-Type': 'application/json',
-                    ...getAuthHeaders()
-                },
-                body: JSON.stringify({ filename: file.name })
-            }).catch(() => {});
-        }
-        
         fillEl.style.width = '100%';
         fillEl.classList.add('success');
         statusEl.textContent = 'Complete';
         statusEl.className = 'file-progress-status success';
-        showToast(`${file.name} uploaded successfully`, 'success');
+        if (storedName !== file.name) {
+            showToast(`${file.name} uploaded as ${storedName}`, 'success');
+        } else {
+            showToast(`${file.name} uploaded successfully`, 'success');
+        }
         
     } catch (error) {
         fillEl.style.width = '100%';
@@ -1141,26 +1174,12 @@ async function handleChatFileUpload(e) {
         
         // Upload the file
         try {
-            const formData = new FormData();
-            formData.append('file', file);
-            
-            const response = await fetch('/upload', {
-                method: 'POST',
-                body: formData
-            });
-            
-            if (!response.ok) throw new Error('Upload failed');
+            const storedName = await registerUpload(file);
+            const response = await uploadAs(file, storedName);
             
-            // Register document with auth service if logged in (silent - no errors shown)
-            if (authToken) {
-                fetch(`${AUTH_URL}/documents/register`, {
-                    method: 'POST',
-                    headers: {
-                        'Content-Type': 'application/json',
-                        ...getAuthHeaders()
-                    },
-                    body: JSON.stringify({ filename: file.name })
-                }).catch(() => {});
+            if (!response.ok) {
+                unregisterUpload(storedName);
+                throw new Error('Upload failed');
             }
             
             // Update status to success and add preview button
@@ -1176,9 +1195,9 @@ async function handleChatFileUpload(e) {
                         <polyline points="14 2 14 8 20 8"/>
                     </svg>
                 </div>
-                <span class="file-name">${file.name}</span>
+                <span class="file-name">${storedName}</span>
                 <span class="file-status success">Uploaded</span>
-                <button class="preview-btn" onclick="previewDocument('${file.name}')" title="Preview">
+                <button class="preview-btn" onclick="previewDocument('${storedName}')" title="Preview">
                     <svg width="14" height="14" viewBox="0 0 24 24" fill="none" stroke="currentColor" stroke-width="2">
                         <path d="M1 12s4-8 11-8 11 8 11 8-4 8-11 8-11-8-11-8z"/>
                         <circle cx="12" cy="12" r="3"/>
@@ -1192,8 +1211,12 @@ async function handleChatFileUpload(e) {
                 </button>
             `;
             
-            chatUploadedFiles.push({ id: fileId, name: file.name });
-            showToast(`${file.name} uploaded successfully`, 'success');
+            chatUploadedFiles.push({ id: fileId, name: storedName });
+            if (storedName !== file.name) {
+                showToast(`${file.name} uploaded as ${storedName}`, 'success');
+            } else {
+                showToast(`${file.name} uploaded successfully`, 'success');
+            }
             
             // Refresh documents list and stats
             await loadDocuments();